@@ -0,0 +1,86 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/internal/admin"
+	"github.com/AdguardTeam/dnsproxy/internal/dashboard"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+)
+
+// initAdmin returns the mux of the admin HTTP server with the handlers which
+// need to be set up before the proxy is created, if the admin listener is
+// enabled in options.  mux is nil if it's disabled.
+func initAdmin(baseLogger *slog.Logger, conf *proxy.Config, options *Options) (mux *http.ServeMux) {
+	if options.AdminListenAddr == "" {
+		if options.Dashboard {
+			fatal(baseLogger, "dashboard requires the admin listener")
+		} else if options.AdminToken != "" {
+			fatal(baseLogger, "admin token requires the admin listener")
+		}
+
+		return nil
+	}
+
+	mux = http.NewServeMux()
+	if options.Dashboard {
+		if options.AdminToken == "" {
+			// The status contains the recent queries with the addresses of
+			// the clients, so don't serve it to anyone.
+			fatal(baseLogger, "dashboard requires the admin token")
+		}
+
+		d := dashboard.New()
+		addMetricsListener(conf, d)
+		addQueryLogger(conf, d)
+		d.Register(mux, admin.Authenticate(options.AdminToken))
+	}
+
+	return mux
+}
+
+// startAdmin registers the admin API controlling p in mux, if it's enabled in
+// options, and starts the admin HTTP server serving mux.  r is used to reload
+// and dump the configuration.  It does nothing if mux is nil.
+func startAdmin(
+	baseLogger *slog.Logger,
+	mux *http.ServeMux,
+	p *proxy.Proxy,
+	levels *logLevels,
+	r *reloader,
+	options *Options,
+) {
+	if mux == nil {
+		return
+	}
+
+	l := baseLogger.With(slogutil.KeyPrefix, "admin")
+
+	if options.AdminToken != "" {
+		admin.New(&admin.Config{
+			Logger:     l,
+			Proxy:      p,
+			LogLevels:  levels,
+			Reload:     r.reload,
+			ConfigDump: r.configDump,
+			Token:      options.AdminToken,
+		}).Register(mux)
+	} else {
+		l.Info("admin api is disabled since no token is set")
+	}
+
+	addr := options.AdminListenAddr
+	go func() {
+		l.Info("listening", "addr", addr)
+		srv := &http.Server{
+			Addr:        addr,
+			ReadTimeout: 60 * time.Second,
+			Handler:     mux,
+		}
+		err := listenAndServe(l, srv, options.ReusePort)
+		l.Error("running server", slogutil.KeyError, err)
+	}()
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+)
+
+const (
+	// anomalyWebhookTimeout is the timeout of a single webhook request.
+	anomalyWebhookTimeout = 10 * time.Second
+
+	// anomalyWebhookMaxInFlight is the maximum number of the webhook requests
+	// being sent at once.  The anomalies detected while it's reached are only
+	// logged.
+	anomalyWebhookMaxInFlight = 16
+)
+
+// initAnomalies sets the detection of the anomalous clients into conf, if it's
+// enabled in options.
+func initAnomalies(l *slog.Logger, conf *proxy.Config, options *Options) {
+	if options.AnomalyNXDomainRatio == 0 && options.AnomalyEntropy == 0 {
+		return
+	}
+
+	conf.Anomalies = &proxy.AnomalyConfig{
+		Window:           options.AnomalyWindow.Duration,
+		ThrottleDuration: options.AnomalyThrottle.Duration,
+		MinRequests:      options.AnomalyMinRequests,
+		MaxClients:       options.AnomalyMaxClients,
+		MaxNXDomainRatio: options.AnomalyNXDomainRatio,
+		MaxEntropy:       options.AnomalyEntropy,
+	}
+
+	if options.AnomalyWebhook == "" {
+		return
+	}
+
+	u, err := url.Parse(options.AnomalyWebhook)
+	if err == nil && u.Scheme != "http" && u.Scheme != "https" {
+		err = fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+
+	if err != nil {
+		fatal(l, "parsing anomaly webhook", slogutil.KeyError, err)
+	}
+
+	addAnomalyHandler(conf, &anomalyWebhook{
+		logger: l.With(slogutil.KeyPrefix, "anomaly_webhook"),
+		client: &http.Client{
+			Timeout: anomalyWebhookTimeout,
+		},
+		sema: make(chan struct{}, anomalyWebhookMaxInFlight),
+		url:  u.String(),
+	})
+}
+
+// addAnomalyHandler adds h to the anomaly handlers of conf.  conf.Anomalies
+// must not be nil.
+func addAnomalyHandler(conf *proxy.Config, h proxy.AnomalyHandler) {
+	switch existing := conf.Anomalies.Handler.(type) {
+	case nil:
+		conf.Anomalies.Handler = h
+	case proxy.MultiAnomalyHandler:
+		conf.Anomalies.Handler = append(existing, h)
+	default:
+		conf.Anomalies.Handler = proxy.MultiAnomalyHandler{existing, h}
+	}
+}
+
+// anomalyWebhook is the [proxy.AnomalyHandler] posting the detected anomalies
+// as JSON objects to a URL.
+type anomalyWebhook struct {
+	// logger is used to log the failed requests.
+	logger *slog.Logger
+
+	// client is used to send the requests.
+	client *http.Client
+
+	// sema limits the number of the requests in flight.
+	sema chan struct{}
+
+	// url is the URL the anomalies are posted to.
+	url string
+}
+
+// type check
+var _ proxy.AnomalyHandler = (*anomalyWebhook)(nil)
+
+// anomalyJSON is the JSON representation of a [proxy.Anomaly].
+type anomalyJSON struct {
+	Addr      string  `json:"addr"`
+	Reason    string  `json:"reason"`
+	Window    string  `json:"window"`
+	Requests  uint    `json:"requests"`
+	NXDomain  uint    `json:"nxdomain"`
+	Entropy   float64 `json:"entropy"`
+	Throttled bool    `json:"throttled"`
+}
+
+// HandleAnomaly implements the [proxy.AnomalyHandler] interface for
+// *anomalyWebhook.  It sends the request in a separate goroutine.
+func (w *anomalyWebhook) HandleAnomaly(a *proxy.Anomaly) {
+	body, err := json.Marshal(&anomalyJSON{
+		Addr:      a.Addr.String(),
+		Reason:    string(a.Reason),
+		Window:    a.Window.String(),
+		Requests:  a.Requests,
+		NXDomain:  a.NXDomain,
+		Entropy:   a.Entropy,
+		Throttled: a.Throttled,
+	})
+	if err != nil {
+		// Should never happen.
+		panic(fmt.Errorf("marshaling anomaly: %w", err))
+	}
+
+	select {
+	case w.sema <- struct{}{}:
+	default:
+		w.logger.Warn("too many requests in flight, skipping", "addr", a.Addr)
+
+		return
+	}
+
+	go func() {
+		defer slogutil.RecoverAndLog(context.Background(), w.logger)
+		defer func() { <-w.sema }()
+
+		sendErr := w.send(body)
+		if sendErr != nil {
+			w.logger.Error("sending anomaly", "addr", a.Addr, slogutil.KeyError, sendErr)
+		}
+	}()
+}
+
+// send posts body to the webhook URL.
+func (w *anomalyWebhook) send(body []byte) (err error) {
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("creating request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("sending request: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, resp.Body.Close()) }()
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	return nil
+}
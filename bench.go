@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	goFlags "github.com/jessevdk/go-flags"
+	"github.com/miekg/dns"
+)
+
+// benchCommand is the name of the subcommand load-testing the upstreams.
+const benchCommand = "bench"
+
+// benchUsage is the usage line of the bench subcommand.
+const benchUsage = "bench [OPTIONS]"
+
+// defaultBenchQueries are the queries sent if no query list is given.
+var defaultBenchQueries = []string{
+	"example.org A",
+	"example.org AAAA",
+	"example.com A",
+	"example.com AAAA",
+	"example.net A",
+	"example.net MX",
+}
+
+// benchOptions are the options of the bench subcommand.  They're only set from
+// the command line, so unlike [Options], they have the default values.
+type benchOptions struct {
+	// QueriesFile is the path to the file with the queries, one "name [type]"
+	// per line.
+	QueriesFile string `long:"queries" description:"Path to the file with the queries to send, one 'name [type]' per line. A few built-in queries are used if not set."`
+
+	// QPS is the target rate of the queries sent to each upstream.
+	QPS int `long:"qps" description:"Target number of queries per second sent to each upstream." default:"100"`
+
+	// Duration is the duration of testing each upstream.
+	Duration time.Duration `long:"duration" description:"Duration of testing each upstream in a human-readable form." default:"10s"`
+}
+
+// benchResult is the result of testing a single upstream.
+type benchResult struct {
+	// rcodes are the numbers of the responses by their response codes.
+	rcodes map[int]int
+
+	// latencies are the durations of the successful exchanges.
+	latencies []time.Duration
+
+	// elapsed is the duration of the test.
+	elapsed time.Duration
+
+	// sent is the number of the queries sent.
+	sent int
+
+	// errors is the number of the failed exchanges.
+	errors int
+}
+
+// runBench sends the queries from the list to each of the general upstreams
+// from the options at the target rate and prints the latency percentiles, the
+// error rate, and the breakdown of the response codes for each of them.  The
+// upstreams are tested one after another using the same machinery as the
+// proxy.  It returns the exit code of the process.
+func runBench(args []string) (code int) {
+	benchOpts := &benchOptions{}
+	options, rest, err := parseArgs(args, goFlags.Default, benchUsage, benchOpts)
+	if err != nil {
+		return parseErrorCode(err)
+	} else if len(rest) > 0 {
+		_, _ = fmt.Fprintf(os.Stderr, "unexpected argument %q\nusage: dnsproxy %s\n", rest[0], benchUsage)
+
+		return 1
+	}
+
+	l, levels, closeOutput, _ := newLogger(options)
+	defer closeOutput()
+
+	reqs, err := loadBenchQueries(benchOpts.QueriesFile)
+	if err != nil {
+		l.Error("loading queries", slogutil.KeyError, err)
+
+		return 1
+	}
+
+	upsLogger := proxy.SubsystemLogger(l, levels.proxyLevels(), proxy.LogSubsystemUpstream)
+	upsOpts, err := newUpstreamOptions(upsLogger, options, nil, nil)
+	if err != nil {
+		l.Error("initializing upstream options", slogutil.KeyError, err)
+
+		return 1
+	}
+
+	upsOpts.Timeout = cmp.Or(upsOpts.Timeout, defaultQueryTimeout)
+
+	conf, err := proxy.ParseUpstreamsConfig(loadServersList(options.Upstreams), upsOpts)
+	if err != nil {
+		l.Error("parsing upstreams", slogutil.KeyError, err)
+
+		return 1
+	} else if len(conf.Upstreams) == 0 {
+		l.Error("no upstreams to test")
+
+		return 1
+	}
+	defer func() { _ = conf.Close() }()
+
+	qps, dur := benchOpts.QPS, benchOpts.Duration
+	if qps <= 0 {
+		l.Error("qps must be positive", "value", qps)
+
+		return 1
+	} else if dur <= 0 {
+		l.Error("duration must be positive", "value", dur)
+
+		return 1
+	}
+
+	for _, u := range conf.Upstreams {
+		l.Info("testing upstream", "upstream", u.Address(), "qps", qps, "duration", dur)
+
+		err = benchUpstream(u, reqs, qps, dur).write(os.Stdout, u.Address())
+		if err != nil {
+			l.Error("writing report", slogutil.KeyError, err)
+
+			return 1
+		}
+	}
+
+	return 0
+}
+
+// parseErrorCode returns the exit code for the error of parsing the
+// command-line arguments of a subcommand.  The errors of the parser itself are
+// already printed.
+func parseErrorCode(err error) (code int) {
+	if flagsErr, ok := err.(*goFlags.Error); ok && flagsErr.Type == goFlags.ErrHelp {
+		return 0
+	} else if !ok {
+		_, _ = fmt.Fprintf(os.Stderr, "loading config file: %s\n", err)
+	}
+
+	return 1
+}
+
+// loadBenchQueries returns the queries from the file at path or the default
+// ones if path is empty.
+func loadBenchQueries(path string) (reqs []*dns.Msg, err error) {
+	lines := defaultBenchQueries
+	if path != "" {
+		lines, err = readBenchQueries(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for i, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("query at index %d: too many fields in %q", i, line)
+		}
+
+		var req *dns.Msg
+		req, err = newQueryMsg(fields[0], strings.Join(fields[1:], ""))
+		if err != nil {
+			return nil, fmt.Errorf("query at index %d: %w", i, err)
+		}
+
+		reqs = append(reqs, req)
+	}
+
+	if len(reqs) == 0 {
+		return nil, errors.Error("no queries")
+	}
+
+	return reqs, nil
+}
+
+// readBenchQueries returns the non-empty lines of the file at path, except the
+// comments.
+func readBenchQueries(path string) (lines []string, err error) {
+	// #nosec G304 -- Trust the file path that is given in the command line.
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening queries file: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, f.Close()) }()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			lines = append(lines, line)
+		}
+	}
+
+	return lines, s.Err()
+}
+
+// benchUpstream sends reqs to u in turn at the rate of qps queries per second
+// for dur and returns the result.  It waits for all the sent queries to finish.
+func benchUpstream(u upstream.Upstream, reqs []*dns.Msg, qps int, dur time.Duration) (res *benchResult) {
+	res = &benchResult{
+		rcodes: map[int]int{},
+	}
+
+	mu := &sync.Mutex{}
+	wg := &sync.WaitGroup{}
+
+	ticker := time.NewTicker(time.Second / time.Duration(qps))
+	defer ticker.Stop()
+
+	start := time.Now()
+	deadline := time.After(dur)
+
+loop:
+	for i := 0; ; i++ {
+		select {
+		case <-deadline:
+			break loop
+		case <-ticker.C:
+			// Go on.
+		}
+
+		req := reqs[i%len(reqs)].Copy()
+		req.Id = dns.Id()
+
+		res.sent++
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			exStart := time.Now()
+			resp, err := u.Exchange(req)
+			elapsed := time.Since(exStart)
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if err != nil {
+				res.errors++
+
+				return
+			}
+
+			res.latencies = append(res.latencies, elapsed)
+			res.rcodes[resp.Rcode]++
+		}()
+	}
+
+	wg.Wait()
+	res.elapsed = time.Since(start)
+
+	return res
+}
+
+// write writes the human-readable report of res for the upstream with the
+// address addr into w.
+func (res *benchResult) write(w io.Writer, addr string) (err error) {
+	errRate := 0.0
+	if res.sent > 0 {
+		errRate = float64(res.errors) / float64(res.sent) * 100
+	}
+
+	latency := "none"
+	if len(res.latencies) > 0 {
+		slices.Sort(res.latencies)
+		latency = fmt.Sprintf(
+			"p50 %s, p90 %s, p99 %s, max %s",
+			percentile(res.latencies, 50),
+			percentile(res.latencies, 90),
+			percentile(res.latencies, 99),
+			percentile(res.latencies, 100),
+		)
+	}
+
+	rcodesStr := "none"
+	rcodes := make([]int, 0, len(res.rcodes))
+	for rcode := range res.rcodes {
+		rcodes = append(rcodes, rcode)
+	}
+	slices.Sort(rcodes)
+
+	strs := make([]string, 0, len(rcodes))
+	for _, rcode := range rcodes {
+		strs = append(strs, fmt.Sprintf("%s %d", dns.RcodeToString[rcode], res.rcodes[rcode]))
+	}
+
+	if len(strs) > 0 {
+		rcodesStr = strings.Join(strs, ", ")
+	}
+
+	_, err = fmt.Fprintf(
+		w,
+		"upstream: %s\n  queries: %d (%.1f qps), errors: %d (%.2f%%)\n  latency: %s\n  rcodes: %s\n",
+		addr,
+		res.sent,
+		float64(res.sent)/res.elapsed.Seconds(),
+		res.errors,
+		errRate,
+		latency,
+		rcodesStr,
+	)
+
+	return err
+}
+
+// percentile returns the p-th percentile of the sorted non-empty durations
+// using the nearest-rank method, rounded to microseconds.
+func percentile(sorted []time.Duration, p int) (d time.Duration) {
+	idx := (len(sorted)*p + 99) / 100
+	idx = max(idx-1, 0)
+
+	return sorted[idx].Round(time.Microsecond)
+}
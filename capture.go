@@ -0,0 +1,51 @@
+package main
+
+import (
+	"log/slog"
+
+	"github.com/AdguardTeam/dnsproxy/internal/capture"
+	proxynetutil "github.com/AdguardTeam/dnsproxy/internal/netutil"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+)
+
+// initCapture sets the capturing message tap into conf, if it's enabled in
+// options.  cpt is nil if the capturing is disabled, otherwise it should be
+// closed on exit.
+func initCapture(l *slog.Logger, conf *proxy.Config, options *Options) (cpt *capture.Capture) {
+	if options.CaptureFile == "" {
+		return nil
+	}
+
+	c := &capture.Config{
+		Logger:  l,
+		Path:    options.CaptureFile,
+		Format:  capture.Format(options.CaptureFormat),
+		Domains: options.CaptureDomains,
+	}
+
+	for i, s := range options.CaptureClients {
+		p, err := proxynetutil.ParseSubnet(s)
+		if err != nil {
+			fatal(l, "parsing capture client", "idx", i, slogutil.KeyError, err)
+		}
+
+		c.Clients = append(c.Clients, p)
+	}
+
+	cpt, err := capture.New(c)
+	if err != nil {
+		fatal(l, "initializing capture", slogutil.KeyError, err)
+	}
+
+	l.Warn(
+		"capturing dns transactions, it may affect performance",
+		slogutil.KeyPrefix, "capture",
+		"path", options.CaptureFile,
+		"format", c.Format,
+	)
+
+	addMessageTap(conf, cpt)
+
+	return cpt
+}
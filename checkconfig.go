@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/miekg/dns"
+)
+
+// checkConfig validates conf the same way the proxy does on startup, checks the
+// certificates of the listeners, and sends a probe query to each upstream once,
+// so that the bootstrap resolution, the connection, and the TLS verification of
+// each of them are checked.  It logs every problem found and returns false if
+// there are any.  The upstreams of conf are closed.
+func checkConfig(l *slog.Logger, conf *proxy.Config) (ok bool) {
+	l = l.With(slogutil.KeyPrefix, "check")
+	ok = true
+
+	ups := checkedUpstreams(conf)
+	defer closeCheckedUpstreams(l, ups)
+
+	// Don't let the proxy log the configuration details.
+	checkConf := *conf
+	checkConf.Logger = slogutil.NewDiscardLogger()
+	checkConf.LogLevels = nil
+
+	_, err := proxy.New(&checkConf)
+	if err != nil {
+		l.Error("invalid proxy configuration", slogutil.KeyError, err)
+		ok = false
+	}
+
+	err = checkCertificates(conf.TLSConfig, time.Now())
+	if err != nil {
+		l.Error("invalid listener certificate", slogutil.KeyError, err)
+		ok = false
+	}
+
+	var failed int
+	for _, res := range probeUpstreams(ups) {
+		if res.err != nil {
+			l.Error("probing upstream", "upstream", res.addr, slogutil.KeyError, res.err)
+			failed++
+
+			continue
+		}
+
+		l.Info("upstream ok", "upstream", res.addr, "rtt", res.rtt)
+	}
+
+	if failed > 0 {
+		ok = false
+	}
+
+	if ok {
+		l.Info("configuration is valid", "upstreams", len(ups))
+	} else {
+		l.Error("configuration is invalid", "failed_upstreams", failed)
+	}
+
+	return ok
+}
+
+// checkedUpstreams returns all the upstreams from conf: the general, the
+// domain-specific, the private, the fallback, the mirror, the comparison, and
+// the profile ones, deduplicated by address and sorted by it.
+func checkedUpstreams(conf *proxy.Config) (ups []upstream.Upstream) {
+	ucs := []*proxy.UpstreamConfig{
+		conf.UpstreamConfig,
+		conf.PrivateRDNSUpstreamConfig,
+		conf.Fallbacks,
+		conf.CompareUpstreamConfig,
+	}
+	for _, prof := range conf.Profiles {
+		ucs = append(ucs, prof.UpstreamConfig)
+	}
+
+	for _, uc := range ucs {
+		if uc == nil {
+			continue
+		}
+
+		ups = append(ups, uc.Upstreams...)
+		for _, specUps := range []map[string][]upstream.Upstream{
+			uc.DomainReservedUpstreams,
+			uc.SpecifiedDomainUpstreams,
+		} {
+			for _, domainUps := range specUps {
+				ups = append(ups, domainUps...)
+			}
+		}
+	}
+
+	if conf.MirrorUpstream != nil {
+		ups = append(ups, conf.MirrorUpstream)
+	}
+
+	slices.SortStableFunc(ups, func(a, b upstream.Upstream) (res int) {
+		return strings.Compare(a.Address(), b.Address())
+	})
+
+	return slices.CompactFunc(ups, func(a, b upstream.Upstream) (eq bool) {
+		return a.Address() == b.Address()
+	})
+}
+
+// closeCheckedUpstreams closes ups and logs the errors.
+func closeCheckedUpstreams(l *slog.Logger, ups []upstream.Upstream) {
+	for _, u := range ups {
+		err := u.Close()
+		if err != nil {
+			l.Debug("closing upstream", "upstream", u.Address(), slogutil.KeyError, err)
+		}
+	}
+}
+
+// upstreamProbeResult is the result of probing a single upstream.
+type upstreamProbeResult struct {
+	// err is the error of the exchange, if any.
+	err error
+
+	// addr is the address of the upstream.
+	addr string
+
+	// rtt is the duration of the exchange.
+	rtt time.Duration
+}
+
+// probeUpstreams sends the probe query to each of ups concurrently and returns
+// the results in the same order.
+func probeUpstreams(ups []upstream.Upstream) (results []upstreamProbeResult) {
+	results = make([]upstreamProbeResult, len(ups))
+
+	wg := &sync.WaitGroup{}
+	for i, u := range ups {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			req := &dns.Msg{}
+			req.SetQuestion(".", dns.TypeNS)
+			req.RecursionDesired = true
+
+			start := time.Now()
+			_, err := u.Exchange(req)
+			results[i] = upstreamProbeResult{
+				err:  err,
+				addr: u.Address(),
+				rtt:  time.Since(start),
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	return results
+}
+
+// checkCertificates returns an error if any of the certificates in conf isn't
+// valid at now.  conf may be nil.
+func checkCertificates(conf *tls.Config, now time.Time) (err error) {
+	if conf == nil {
+		return nil
+	}
+
+	for i, cert := range conf.Certificates {
+		leaf := cert.Leaf
+		if leaf == nil {
+			if len(cert.Certificate) == 0 {
+				return fmt.Errorf("certificate at index %d: empty chain", i)
+			}
+
+			leaf, err = x509.ParseCertificate(cert.Certificate[0])
+			if err != nil {
+				return fmt.Errorf("certificate at index %d: %w", i, err)
+			}
+		}
+
+		switch {
+		case now.Before(leaf.NotBefore):
+			return fmt.Errorf("certificate at index %d: not valid before %s", i, leaf.NotBefore)
+		case now.After(leaf.NotAfter):
+			return fmt.Errorf("certificate at index %d: expired at %s", i, leaf.NotAfter)
+		default:
+			// Go on.
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// clientRouteOptions are the options of a single entry of the client routing
+// table, see [proxy.ClientRoute].  These can only be set in the configuration
+// file.
+type clientRouteOptions struct {
+	// Name is the name of the route used in the logs.
+	Name string `yaml:"name"`
+
+	// Subnets are the networks of the clients of the route in CIDR notation.
+	Subnets []string `yaml:"subnets"`
+
+	// ServerNames are the TLS server names indicated by the clients of the
+	// route.
+	ServerNames []string `yaml:"server-names"`
+
+	// HTTPPaths are the URL paths of the DNS-over-HTTPS requests of the
+	// clients of the route.
+	HTTPPaths []string `yaml:"http-paths"`
+
+	// HTTPUsers are the basic authentication user names of the
+	// DNS-over-HTTPS clients of the route.
+	HTTPUsers []string `yaml:"http-users"`
+
+	// Countries are the ISO 3166-1 alpha-2 codes of the countries of the
+	// clients of the route.
+	Countries []string `yaml:"countries"`
+
+	// ASNs are the numbers of the autonomous systems of the clients of the
+	// route.
+	ASNs []uint32 `yaml:"asns"`
+
+	// Upstreams are the upstream servers of the route in the same format as
+	// the general ones.
+	Upstreams []string `yaml:"upstream"`
+
+	// Cache defines if the responses are cached.
+	Cache bool `yaml:"cache"`
+}
+
+// newClientRoutes returns the proxy client routes created from opts.  upsOpts
+// are used to create the upstreams of the routes.  The upstreams created
+// before an error occurred are closed.
+func newClientRoutes(
+	opts []*clientRouteOptions,
+	upsOpts *upstream.Options,
+) (routes []*proxy.ClientRoute, err error) {
+	for i, o := range opts {
+		var r *proxy.ClientRoute
+		r, err = newClientRoute(o, upsOpts)
+		if err != nil {
+			return nil, errors.WithDeferred(
+				fmt.Errorf("route at index %d: %w", i, err),
+				closeClientRoutes(routes),
+			)
+		}
+
+		routes = append(routes, r)
+	}
+
+	return routes, nil
+}
+
+// newClientRoute returns the proxy client route created from o.
+func newClientRoute(o *clientRouteOptions, upsOpts *upstream.Options) (r *proxy.ClientRoute, err error) {
+	if o == nil {
+		return nil, errors.Error("no route")
+	} else if len(o.Upstreams) == 0 {
+		return nil, errors.Error("no upstreams")
+	}
+
+	r = &proxy.ClientRoute{
+		Name:         o.Name,
+		ServerNames:  o.ServerNames,
+		HTTPPaths:    o.HTTPPaths,
+		HTTPUsers:    o.HTTPUsers,
+		Countries:    o.Countries,
+		ASNs:         o.ASNs,
+		CacheEnabled: o.Cache,
+	}
+
+	for _, s := range o.Subnets {
+		var pref netip.Prefix
+		pref, err = netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("parsing subnet: %w", err)
+		}
+
+		r.Subnets = append(r.Subnets, pref)
+	}
+
+	r.UpstreamConfig, err = proxy.ParseUpstreamsConfig(loadServersList(o.Upstreams), upsOpts)
+	if err != nil {
+		return nil, fmt.Errorf("parsing upstreams configuration: %w", err)
+	}
+
+	return r, nil
+}
+
+// closeClientRoutes closes the upstreams of routes.
+func closeClientRoutes(routes []*proxy.ClientRoute) (err error) {
+	var errs []error
+	for _, r := range routes {
+		errs = append(errs, r.UpstreamConfig.Close())
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/AdguardTeam/dnsproxy/internal/version"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+)
+
+// configDump is the JSON representation of the effective configuration of the
+// proxy, used by tooling and for diagnostics.
+type configDump struct {
+	// Upstreams are the general and the domain-specific upstreams.
+	Upstreams *upstreamConfigDump `json:"upstreams"`
+
+	// PrivateUpstreams are the upstreams for the private reverse DNS lookups.
+	PrivateUpstreams *upstreamConfigDump `json:"private_upstreams,omitempty"`
+
+	// Fallbacks are the fallback upstreams.
+	Fallbacks *upstreamConfigDump `json:"fallbacks,omitempty"`
+
+	// Cache is the configuration of the cache.
+	Cache *cacheDump `json:"cache"`
+
+	// Ratelimit is the configuration of the ratelimiting.
+	Ratelimit *ratelimitDump `json:"ratelimit"`
+
+	// Version is the version of the program.
+	Version string `json:"version"`
+
+	// UpstreamMode is the mode of using the upstreams.
+	UpstreamMode string `json:"upstream_mode"`
+
+	// Timeout is the timeout of the queries to the upstreams.
+	Timeout string `json:"timeout"`
+
+	// Listeners are the listening sockets.
+	Listeners []*listenerDump `json:"listeners"`
+
+	// Bootstrap are the bootstrap resolvers of the upstreams.
+	Bootstrap []string `json:"bootstrap"`
+
+	// MaxGoroutines is the maximum number of the requests processed
+	// simultaneously, zero means no limit.
+	MaxGoroutines uint `json:"max_goroutines"`
+
+	// EDNSClientSubnet is true if the EDNS Client Subnet option is sent to the
+	// upstreams.
+	EDNSClientSubnet bool `json:"edns_client_subnet"`
+}
+
+// listenerDump is the JSON representation of a listening socket.
+type listenerDump struct {
+	// Proto is the protocol of the listener.
+	Proto proxy.Proto `json:"proto"`
+
+	// Addr is the address of the socket.
+	Addr string `json:"addr"`
+}
+
+// upstreamConfigDump is the JSON representation of [proxy.UpstreamConfig].
+type upstreamConfigDump struct {
+	// DomainReserved are the upstreams by the domains, see
+	// [proxy.UpstreamConfig.DomainReservedUpstreams].
+	DomainReserved map[string][]*upstreamDump `json:"domain_reserved,omitempty"`
+
+	// SpecifiedDomain are the upstreams by the domains, see
+	// [proxy.UpstreamConfig.SpecifiedDomainUpstreams].
+	SpecifiedDomain map[string][]*upstreamDump `json:"specified_domain,omitempty"`
+
+	// Upstreams are the default upstreams.
+	Upstreams []*upstreamDump `json:"upstreams"`
+}
+
+// upstreamDump is the JSON representation of an upstream.
+type upstreamDump struct {
+	// Address is the address of the upstream, see
+	// [upstream.Upstream.Address].
+	Address string `json:"address"`
+
+	// Protocol is the protocol detected from the address.
+	Protocol string `json:"protocol"`
+}
+
+// cacheDump is the JSON representation of the cache configuration.
+type cacheDump struct {
+	// SizeBytes is the size of the cache in bytes.
+	SizeBytes int `json:"size_bytes"`
+
+	// MinTTL is the minimum TTL of the cached responses, in seconds.
+	MinTTL uint32 `json:"min_ttl"`
+
+	// MaxTTL is the maximum TTL of the cached responses, in seconds.
+	MaxTTL uint32 `json:"max_ttl"`
+
+	// Enabled is true if the cache is enabled.
+	Enabled bool `json:"enabled"`
+
+	// Optimistic is true if the optimistic cache is enabled.
+	Optimistic bool `json:"optimistic"`
+
+	// AggressiveNSEC is true if the negative responses are synthesized from
+	// the cached NSEC and NSEC3 records.
+	AggressiveNSEC bool `json:"aggressive_nsec"`
+}
+
+// ratelimitDump is the JSON representation of the ratelimiting configuration.
+type ratelimitDump struct {
+	// Limit is the number of the requests per second allowed per client.
+	Limit int `json:"limit"`
+
+	// LimitIPv6 is the limit for the IPv6 clients.
+	LimitIPv6 int `json:"limit_ipv6"`
+
+	// SubnetLenIPv4 is the length of the IPv4 subnets the clients are grouped
+	// by.
+	SubnetLenIPv4 int `json:"subnet_len_ipv4"`
+
+	// SubnetLenIPv6 is the length of the IPv6 subnets the clients are grouped
+	// by.
+	SubnetLenIPv6 int `json:"subnet_len_ipv6"`
+}
+
+// newConfigDump returns the dump of conf created from options, listening on
+// listeners.
+func newConfigDump(
+	conf *proxy.Config,
+	options *Options,
+	listeners []*listenerDump,
+) (d *configDump) {
+	return &configDump{
+		Upstreams:        newUpstreamConfigDump(conf.UpstreamConfig),
+		PrivateUpstreams: newUpstreamConfigDump(conf.PrivateRDNSUpstreamConfig),
+		Fallbacks:        newUpstreamConfigDump(conf.Fallbacks),
+		Cache: &cacheDump{
+			SizeBytes:  conf.CacheSizeBytes,
+			MinTTL:     conf.CacheMinTTL,
+			MaxTTL:     conf.CacheMaxTTL,
+			Enabled:    conf.CacheEnabled,
+			Optimistic: conf.CacheOptimistic,
+
+			AggressiveNSEC: conf.CacheAggressiveNSEC,
+		},
+		Ratelimit: &ratelimitDump{
+			Limit:         conf.Ratelimit,
+			LimitIPv6:     conf.RatelimitIPv6,
+			SubnetLenIPv4: conf.RatelimitSubnetLenIPv4,
+			SubnetLenIPv6: conf.RatelimitSubnetLenIPv6,
+		},
+		Version:          version.Version(),
+		UpstreamMode:     upstreamModeName(conf.UpstreamMode),
+		Timeout:          options.Timeout.String(),
+		Listeners:        listeners,
+		Bootstrap:        options.BootstrapDNS,
+		MaxGoroutines:    conf.MaxGoroutines,
+		EDNSClientSubnet: conf.EnableEDNSClientSubnet,
+	}
+}
+
+// newUpstreamConfigDump returns the dump of uc.  uc may be nil.
+func newUpstreamConfigDump(uc *proxy.UpstreamConfig) (d *upstreamConfigDump) {
+	if uc == nil {
+		return nil
+	}
+
+	return &upstreamConfigDump{
+		DomainReserved:  newDomainUpstreamsDump(uc.DomainReservedUpstreams),
+		SpecifiedDomain: newDomainUpstreamsDump(uc.SpecifiedDomainUpstreams),
+		Upstreams:       newUpstreamsDump(uc.Upstreams),
+	}
+}
+
+// newDomainUpstreamsDump returns the dump of the upstreams by the domains.
+func newDomainUpstreamsDump(
+	domainUps map[string][]upstream.Upstream,
+) (d map[string][]*upstreamDump) {
+	if len(domainUps) == 0 {
+		return nil
+	}
+
+	d = make(map[string][]*upstreamDump, len(domainUps))
+	for domain, ups := range domainUps {
+		d[domain] = newUpstreamsDump(ups)
+	}
+
+	return d
+}
+
+// newUpstreamsDump returns the dumps of ups.
+func newUpstreamsDump(ups []upstream.Upstream) (d []*upstreamDump) {
+	d = make([]*upstreamDump, 0, len(ups))
+	for _, u := range ups {
+		addr := u.Address()
+		d = append(d, &upstreamDump{
+			Address:  addr,
+			Protocol: upstreamProtocol(addr),
+		})
+	}
+
+	return d
+}
+
+// upstreamProtocol returns the protocol of the upstream with addr, see
+// [upstream.Upstream.Address].
+func upstreamProtocol(addr string) (proto string) {
+	scheme, _, ok := strings.Cut(addr, "://")
+	if !ok {
+		// The plain DNS-over-UDP upstreams have no scheme.
+		return "udp"
+	}
+
+	switch scheme {
+	case "sdns":
+		return "dnscrypt"
+	case "https", "h3":
+		return "https"
+	default:
+		return scheme
+	}
+}
+
+// upstreamModeName returns the name of mode.
+func upstreamModeName(mode proxy.UpstreamModeType) (name string) {
+	switch mode {
+	case proxy.UModeParallel:
+		return "parallel"
+	case proxy.UModeFastestAddr:
+		return "fastest_addr"
+	default:
+		return "load_balance"
+	}
+}
+
+// configuredListeners returns the listening sockets configured in conf.
+func configuredListeners(conf *proxy.Config) (listeners []*listenerDump) {
+	for _, l := range []struct {
+		proto proxy.Proto
+		addrs []net.Addr
+	}{{
+		proto: proxy.ProtoUDP,
+		addrs: toAddrs(conf.UDPListenAddr),
+	}, {
+		proto: proxy.ProtoTCP,
+		addrs: toAddrs(conf.TCPListenAddr),
+	}, {
+		proto: proxy.ProtoTLS,
+		addrs: toAddrs(conf.TLSListenAddr),
+	}, {
+		proto: proxy.ProtoHTTPS,
+		addrs: toAddrs(conf.HTTPSListenAddr),
+	}, {
+		proto: proxy.ProtoQUIC,
+		addrs: toAddrs(conf.QUICListenAddr),
+	}, {
+		proto: proxy.ProtoDNSCrypt,
+		addrs: toAddrs(conf.DNSCryptUDPListenAddr),
+	}} {
+		listeners = appendListeners(listeners, l.proto, l.addrs)
+	}
+
+	return listeners
+}
+
+// boundListeners returns the sockets p is actually listening on.
+func boundListeners(p *proxy.Proxy) (listeners []*listenerDump) {
+	for _, proto := range []proxy.Proto{
+		proxy.ProtoUDP,
+		proxy.ProtoTCP,
+		proxy.ProtoTLS,
+		proxy.ProtoHTTPS,
+		proxy.ProtoQUIC,
+		proxy.ProtoDNSCrypt,
+	} {
+		listeners = appendListeners(listeners, proto, p.Addrs(proto))
+	}
+
+	return listeners
+}
+
+// appendListeners appends the dumps of the sockets listening on addrs with
+// proto to dst and returns the result.
+func appendListeners(
+	dst []*listenerDump,
+	proto proxy.Proto,
+	addrs []net.Addr,
+) (res []*listenerDump) {
+	res = dst
+	for _, addr := range addrs {
+		res = append(res, &listenerDump{
+			Proto: proto,
+			Addr:  addr.String(),
+		})
+	}
+
+	return res
+}
+
+// toAddrs converts addrs to the slice of [net.Addr].
+func toAddrs[T net.Addr](addrs []T) (res []net.Addr) {
+	res = make([]net.Addr, 0, len(addrs))
+	for _, addr := range addrs {
+		res = append(res, addr)
+	}
+
+	return res
+}
+
+// dumpConfig prints the dump of conf created from options to stdout and closes
+// its upstreams.
+func dumpConfig(l *slog.Logger, conf *proxy.Config, options *Options) {
+	err := writeConfigDump(os.Stdout, newConfigDump(conf, options, configuredListeners(conf)))
+	if err != nil {
+		fatal(l, "dumping config", slogutil.KeyError, err)
+	}
+
+	err = closeUpstreamConfigs(conf)
+	if err != nil {
+		l.Debug("closing upstreams", slogutil.KeyError, err)
+	}
+}
+
+// writeConfigDump writes d to w as indented JSON.
+func writeConfigDump(w io.Writer, d *configDump) (err error) {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+
+	err = enc.Encode(d)
+	if err != nil {
+		return fmt.Errorf("encoding config dump: %w", err)
+	}
+
+	return nil
+}
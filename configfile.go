@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// maxIncludeDepth is the maximum depth of the nested includes of the
+// configuration files, which also stops the include cycles.
+const maxIncludeDepth = 8
+
+// envVarRe matches the references to the environment variables in the
+// ${NAME} form.
+var envVarRe = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// configIncludes is the part of the configuration file listing the included
+// files.
+type configIncludes struct {
+	// Include are the paths of the files to load before the file itself.  The
+	// relative paths are relative to the directory of the including file.
+	Include []string `yaml:"include"`
+}
+
+// loadConfigFile unmarshals the configuration file at path into options.  The
+// references to the environment variables in the values are expanded, and the
+// included files are unmarshaled first, so that the values from the including
+// file take precedence.  depth is the current depth of includes.
+func loadConfigFile(options *Options, path string, depth int) (err error) {
+	if depth > maxIncludeDepth {
+		return fmt.Errorf("including %q: max include depth %d exceeded", path, maxIncludeDepth)
+	}
+
+	// #nosec G304 -- Trust the file path that is given in the configuration.
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading config file: %w", err)
+	}
+
+	doc := &yaml.Node{}
+	err = yaml.Unmarshal(b, doc)
+	if err != nil {
+		return fmt.Errorf("unmarshaling config file %q: %w", path, err)
+	}
+
+	if doc.Kind == 0 {
+		// The file is empty.
+		return nil
+	}
+
+	err = expandEnv(doc)
+	if err != nil {
+		return fmt.Errorf("config file %q: %w", path, err)
+	}
+
+	inc := &configIncludes{}
+	err = doc.Decode(inc)
+	if err != nil {
+		return fmt.Errorf("decoding includes of config file %q: %w", path, err)
+	}
+
+	for _, incPath := range inc.Include {
+		if !filepath.IsAbs(incPath) {
+			incPath = filepath.Join(filepath.Dir(path), incPath)
+		}
+
+		err = loadConfigFile(options, incPath, depth+1)
+		if err != nil {
+			// Don't wrap the error, since it's informative enough as is.
+			return err
+		}
+	}
+
+	err = doc.Decode(options)
+	if err != nil {
+		return fmt.Errorf("decoding config file %q: %w", path, err)
+	}
+
+	return nil
+}
+
+// expandEnv replaces the references to the environment variables in the
+// scalar values of n and its children with the values of the variables.  It
+// returns an error if any of the referenced variables isn't set.
+func expandEnv(n *yaml.Node) (err error) {
+	if n.Kind == yaml.ScalarNode {
+		return expandScalar(n)
+	}
+
+	var errs []error
+	for _, c := range n.Content {
+		errs = append(errs, expandEnv(c))
+	}
+
+	return errors.Join(errs...)
+}
+
+// expandScalar expands the references to the environment variables in the
+// value of the scalar node n.
+func expandScalar(n *yaml.Node) (err error) {
+	if !envVarRe.MatchString(n.Value) {
+		return nil
+	}
+
+	var errs []error
+	n.Value = envVarRe.ReplaceAllStringFunc(n.Value, func(ref string) (val string) {
+		name := envVarRe.FindStringSubmatch(ref)[1]
+		val, ok := os.LookupEnv(name)
+		if !ok {
+			errs = append(errs, fmt.Errorf("line %d: environment variable %q is not set", n.Line, name))
+		}
+
+		return val
+	})
+
+	if n.Style&(yaml.SingleQuotedStyle|yaml.DoubleQuotedStyle|yaml.LiteralStyle|yaml.FoldedStyle) == 0 {
+		// Resolve the type of the plain scalar again, so that the expanded
+		// values may be numbers or booleans.
+		n.Tag = ""
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,24 @@
+//go:build !unix
+
+package main
+
+import (
+	"log/slog"
+	"os"
+)
+
+// daemonize exits with an error if options require running in the background,
+// since it isn't supported on this platform.
+func daemonize(options *Options) {
+	if options.Daemon {
+		fatal(slog.Default(), "running in background is not supported on this platform")
+	}
+}
+
+// notifyReopen does nothing, since there is no log reopening signal on this
+// platform.
+func notifyReopen(_ chan<- os.Signal) {}
+
+// isReopenSignal always returns false, since there is no log reopening signal
+// on this platform.
+func isReopenSignal(_ os.Signal) (ok bool) { return false }
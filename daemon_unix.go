@@ -0,0 +1,44 @@
+//go:build unix
+
+package main
+
+import (
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+)
+
+// daemonize starts a copy of the current process in the background and exits
+// once it's serving, if options require running in the background.  It does
+// nothing in the copy itself and in the process started by a binary upgrade,
+// which are both started with the readiness pipe.
+func daemonize(options *Options) {
+	if !options.Daemon {
+		return
+	}
+
+	if _, ok := os.LookupEnv(upgradeFDEnv); ok {
+		return
+	}
+
+	l := slog.Default()
+	err := startNewProcess(l, true)
+	if err != nil {
+		fatal(l, "starting in background", slogutil.KeyError, err)
+	}
+
+	os.Exit(0)
+}
+
+// notifyReopen makes the log reopening signal delivered to ch.
+func notifyReopen(ch chan<- os.Signal) {
+	signal.Notify(ch, syscall.SIGUSR1)
+}
+
+// isReopenSignal returns true if sig requests reopening the log file.
+func isReopenSignal(sig os.Signal) (ok bool) {
+	return sig == syscall.SIGUSR1
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/AdguardTeam/dnsproxy/internal/dnstap"
+	"github.com/AdguardTeam/dnsproxy/internal/version"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+)
+
+// unixPrefix is the prefix of the dnstap collector address specifying the
+// path to the unix socket.
+const unixPrefix = "unix:"
+
+// initDnstap sets the dnstap message tap into conf, if it's enabled in options.
+// tap is nil if the dnstap is disabled, otherwise it should be closed on exit
+// to flush the remaining messages.
+func initDnstap(l *slog.Logger, conf *proxy.Config, options *Options) (tap *dnstap.Tap) {
+	addr := options.DnstapAddr
+	if addr == "" {
+		return nil
+	}
+
+	network := dnstap.NetworkTCP
+	if path, ok := strings.CutPrefix(addr, unixPrefix); ok {
+		network, addr = dnstap.NetworkUnix, path
+	}
+
+	identity := options.DnstapIdentity
+	if identity == "" {
+		identity, _ = os.Hostname()
+	}
+
+	var traceIDCode uint16
+	if conf.TraceID != nil && conf.TraceID.Forward {
+		traceIDCode = options.TraceIDOptionCode
+	}
+
+	tap, err := dnstap.New(&dnstap.Config{
+		Network:           network,
+		Address:           addr,
+		Identity:          identity,
+		Version:           "dnsproxy " + version.Version(),
+		BufferSize:        options.DnstapBufferSize,
+		TraceIDOptionCode: traceIDCode,
+		Logger:            l,
+	})
+	if err != nil {
+		fatal(l, "initializing dnstap", slogutil.KeyError, err)
+	}
+
+	l.Info("writing messages", slogutil.KeyPrefix, "dnstap", "network", network, "addr", addr)
+
+	addMessageTap(conf, tap)
+
+	return tap
+}
+
+// addMessageTap adds t to the message taps of conf.
+func addMessageTap(conf *proxy.Config, t proxy.MessageTap) {
+	switch existing := conf.MessageTap.(type) {
+	case nil:
+		conf.MessageTap = t
+	case proxy.MultiMessageTap:
+		conf.MessageTap = append(existing, t)
+	default:
+		conf.MessageTap = proxy.MultiMessageTap{existing, t}
+	}
+}
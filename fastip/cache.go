@@ -3,12 +3,18 @@ package fastip
 import (
 	"encoding/binary"
 	"net/netip"
+	"slices"
 	"time"
 )
 
 const (
 	// fastestAddrCacheTTLSec is the cache TTL for IP addresses.
 	fastestAddrCacheTTLSec = 10 * 60
+
+	// maxCacheKeys is the number of the addresses remembered in the cache
+	// index, after which the evicted and the expired ones are removed from it.
+	// It's about the maximum number of the entries the cache is able to hold.
+	maxCacheKeys = 64 * 1024 / (4 + 4 + 1 + 2)
 )
 
 // cacheEntry represents an item that will be stored in the cache.
@@ -27,8 +33,10 @@ type cacheEntry struct {
 //   - expire   [4]byte  (Unix time, seconds),
 //   - status   byte     (0 for ok, 1 for timed out),
 //   - latency  [2]byte  (milliseconds).
-func packCacheEntry(ent *cacheEntry, ttl uint32) (d []byte) {
-	expire := uint32(time.Now().Unix()) + ttl
+//
+// now is the current time used to calculate the expiration time.
+func packCacheEntry(ent *cacheEntry, ttl uint32, now time.Time) (d []byte) {
+	expire := uint32(now.Unix()) + ttl
 
 	d = make([]byte, 4+1+2)
 	binary.BigEndian.PutUint32(d, expire)
@@ -43,12 +51,11 @@ func packCacheEntry(ent *cacheEntry, ttl uint32) (d []byte) {
 	return d
 }
 
-// unpackCacheEntry unpacks bytes to cache entry and checks TTL, if the record
-// is expired returns nil.
-func unpackCacheEntry(data []byte) (ent *cacheEntry) {
-	now := time.Now().Unix()
+// unpackCacheEntry unpacks bytes to cache entry and checks TTL against now, if
+// the record is expired returns nil.
+func unpackCacheEntry(data []byte, now time.Time) (ent *cacheEntry) {
 	expire := binary.BigEndian.Uint32(data[:4])
-	if int64(expire) <= now {
+	if int64(expire) <= now.Unix() {
 		return nil
 	}
 
@@ -72,7 +79,7 @@ func (f *FastestAddr) cacheFind(ip netip.Addr) (ent *cacheEntry) {
 		return nil
 	}
 
-	return unpackCacheEntry(val)
+	return unpackCacheEntry(val, f.Clock.Now())
 }
 
 // cacheAddFailure stores unsuccessful attempt in cache.
@@ -105,8 +112,74 @@ func (f *FastestAddr) cacheAddSuccessful(ip netip.Addr, latency uint) {
 	}
 }
 
-// cacheAdd adds a new entry to the cache.
+// cacheAdd adds a new entry to the cache.  f.ipCacheLock is expected to be
+// locked.
 func (f *FastestAddr) cacheAdd(ent *cacheEntry, ip netip.Addr, ttl uint32) {
-	val := packCacheEntry(ent, ttl)
+	val := packCacheEntry(ent, ttl, f.Clock.Now())
+	f.cacheSet(ip, val)
+}
+
+// cacheSet sets the packed entry val for ip into the cache and indexes it.
+// f.ipCacheLock is expected to be locked.
+func (f *FastestAddr) cacheSet(ip netip.Addr, val []byte) {
 	f.ipCache.Set(ip.AsSlice(), val)
+
+	f.ipCacheKeys.Add(ip)
+	if f.ipCacheKeys.Len() > maxCacheKeys {
+		f.ipCacheKeys.Range(func(ip netip.Addr) (cont bool) {
+			if f.cacheFind(ip) == nil {
+				f.ipCacheKeys.Delete(ip)
+			}
+
+			return true
+		})
+	}
+}
+
+// cachedEntry is a cached ping result with its address and expiration time.
+type cachedEntry struct {
+	// expire is the expiration time of the entry.
+	expire time.Time
+
+	// ent is the cached ping result.
+	ent *cacheEntry
+
+	// ip is the pinged address.
+	ip netip.Addr
+}
+
+// cacheEntries returns the unexpired entries of the cache sorted by address.
+// It removes the evicted and the expired entries from the index.
+func (f *FastestAddr) cacheEntries() (ents []*cachedEntry) {
+	f.ipCacheLock.Lock()
+	defer f.ipCacheLock.Unlock()
+
+	now := f.Clock.Now()
+	f.ipCacheKeys.Range(func(ip netip.Addr) (cont bool) {
+		val := f.ipCache.Get(ip.AsSlice())
+		if val == nil {
+			f.ipCacheKeys.Delete(ip)
+
+			return true
+		}
+
+		ent := unpackCacheEntry(val, now)
+		if ent == nil {
+			f.ipCacheKeys.Delete(ip)
+
+			return true
+		}
+
+		ents = append(ents, &cachedEntry{
+			expire: time.Unix(int64(binary.BigEndian.Uint32(val[:4])), 0),
+			ent:    ent,
+			ip:     ip,
+		})
+
+		return true
+	})
+
+	slices.SortFunc(ents, func(a, b *cachedEntry) (res int) { return a.ip.Compare(b.ip) })
+
+	return ents
 }
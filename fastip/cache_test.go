@@ -9,6 +9,17 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
+// fakeClock is the [Clock] returning the time set by the test.
+type fakeClock struct {
+	now time.Time
+}
+
+// type check
+var _ Clock = (*fakeClock)(nil)
+
+// Now implements the [Clock] interface for *fakeClock.
+func (c *fakeClock) Now() (now time.Time) { return c.now }
+
 func TestCacheAdd(t *testing.T) {
 	f := NewFastestAddr()
 	ent := cacheEntry{
@@ -24,7 +35,10 @@ func TestCacheAdd(t *testing.T) {
 }
 
 func TestCacheTtl(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1_700_000_000, 0)}
+
 	f := NewFastestAddr()
+	f.Clock = clock
 	ent := cacheEntry{
 		status:      0,
 		latencyMsec: 111,
@@ -36,8 +50,8 @@ func TestCacheTtl(t *testing.T) {
 	// check that it's there
 	assert.NotNil(t, f.cacheFind(ip))
 
-	// wait for more than one second
-	time.Sleep(time.Millisecond * 1001)
+	// move the time by one second
+	clock.now = clock.now.Add(time.Second)
 
 	// check that now it returns nil
 	assert.Nil(t, f.cacheFind(ip))
@@ -93,7 +107,7 @@ func TestCache(_ *testing.T) {
 		latencyMsec: 111,
 	}
 
-	val := packCacheEntry(&ent, 1)
+	val := packCacheEntry(&ent, 1, time.Now())
 	f.ipCache.Set(net.ParseIP("1.1.1.1").To4(), val)
 	ent = cacheEntry{
 		status:      0,
@@ -4,6 +4,7 @@
 package fastip
 
 import (
+	"log/slog"
 	"net"
 	"net/netip"
 	"strings"
@@ -13,7 +14,7 @@ import (
 	"github.com/AdguardTeam/dnsproxy/upstream"
 	"github.com/AdguardTeam/golibs/cache"
 	"github.com/AdguardTeam/golibs/container"
-	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
 	"github.com/AdguardTeam/golibs/netutil"
 	"github.com/miekg/dns"
 )
@@ -22,25 +23,97 @@ import (
 // operations to finish.
 const DefaultPingWaitTimeout = 1 * time.Second
 
+// Clock is the interface for provider of current time.  It's used to simplify
+// testing.
+type Clock interface {
+	// Now returns the current local time.
+	Now() (now time.Time)
+}
+
+// type check
+var _ Clock = realClock{}
+
+// realClock is the [Clock] which actually uses the [time] package.
+type realClock struct{}
+
+// Now implements the [Clock] interface for realClock.
+func (realClock) Now() (now time.Time) { return time.Now() }
+
 // FastestAddr provides methods to determine the fastest network addresses.
 type FastestAddr struct {
 	// pinger is the dialer with predefined timeout for pinging TCP connections.
 	pinger *net.Dialer
 
-	// ipCacheLock protects ipCache.
+	// ipCacheLock protects ipCache and ipCacheKeys.
 	ipCacheLock *sync.Mutex
 
 	// ipCache caches fastest IP addresses.
 	ipCache cache.Cache
 
-	// pingPorts are the ports to ping on.
-	pingPorts []uint
+	// ipCacheKeys are the addresses added to ipCache, which may already be
+	// evicted from it.  It's used to iterate over ipCache.
+	ipCacheKeys *container.MapSet[netip.Addr]
+
+	// icmpPing pings the addresses with ICMP if ICMP is true.
+	icmpPing icmpPingFunc
+
+	// decisions are the recent choices of the fastest addresses.
+	decisions *decisionLog
+
+	// stats are the counters of the detection.
+	stats *stats
+
+	// Logger is used to log the pinging process.  It should be configured
+	// right after the FastestAddr initialization since it isn't protected for
+	// concurrent usage.  It must not be nil.
+	Logger *slog.Logger
+
+	// Clock is used to get the current time for the expiration of the cached
+	// ping results and for measuring the latency.  It should be configured
+	// right after the FastestAddr initialization since it isn't protected for
+	// concurrent usage.  It must not be nil.
+	Clock Clock
 
 	// PingWaitTimeout is the timeout for waiting all the resolved addresses to
 	// be pinged.  Any ping results received after that moment are cached, but
 	// won't be used.  It should be configured right after the FastestAddr
 	// initialization since it isn't protected for concurrent usage.
 	PingWaitTimeout time.Duration
+
+	// PingPorts are the TCP ports dialed to ping an address.  It should be
+	// configured right after the FastestAddr initialization since it isn't
+	// protected for concurrent usage.
+	PingPorts []uint
+
+	// MaxConcurrentPings is the maximum number of the pings made at once for a
+	// single lookup.  The rest of the pings wait for them to finish.  Zero
+	// means no limit.  It should be configured right after the FastestAddr
+	// initialization since it isn't protected for concurrent usage.
+	MaxConcurrentPings uint
+
+	// FasterWait is the period of time to keep waiting for a faster result
+	// after the first successful ping, which makes sense when IPv6Preference
+	// is set.  The waiting never exceeds PingWaitTimeout.  Zero means the
+	// first successful ping is used right away.  It should be configured right
+	// after the FastestAddr initialization since it isn't protected for
+	// concurrent usage.
+	FasterWait time.Duration
+
+	// IPv6Preference is subtracted from the latencies of the IPv6 addresses
+	// when comparing them to the IPv4 ones, so that IPv6 is preferred on
+	// dual-stack hosts unless IPv4 is faster by more than that.  It should be
+	// configured right after the FastestAddr initialization since it isn't
+	// protected for concurrent usage.
+	IPv6Preference time.Duration
+
+	// ICMP, if true, makes the addresses also pinged with ICMP echo requests,
+	// in addition to dialing TCP connections, which makes the hosts with the
+	// firewalled TCP ports detected as well.  It requires either the support
+	// of the unprivileged ICMP sockets, or the capability to open the raw
+	// ones, like CAP_NET_RAW on Linux.  Otherwise, the ICMP pings just fail.
+	// It should be configured right after the FastestAddr initialization since
+	// it isn't protected for concurrent usage.
+	ICMP bool
 }
 
 // NewFastestAddr initializes a new instance of *FastestAddr.
@@ -51,9 +124,15 @@ func NewFastestAddr() (f *FastestAddr) {
 			MaxSize:   64 * 1024,
 			EnableLRU: true,
 		}),
-		pingPorts:       []uint{80, 443},
+		ipCacheKeys:     container.NewMapSet[netip.Addr](),
+		PingPorts:       []uint{80, 443},
+		icmpPing:        pingICMP,
+		decisions:       newDecisionLog(maxDecisions),
+		stats:           &stats{},
 		PingWaitTimeout: DefaultPingWaitTimeout,
 		pinger:          &net.Dialer{Timeout: pingTCPTimeout},
+		Logger:          slog.Default().With(slogutil.KeyPrefix, "fastip"),
+		Clock:           realClock{},
 	}
 }
 
@@ -81,11 +160,16 @@ func (f *FastestAddr) ExchangeFastest(
 
 	ips := ipSet.Values()
 	host := strings.ToLower(req.Question[0].Name)
-	if pingRes := f.pingAll(host, ips); pingRes != nil {
+
+	f.stats.lookups.Add(1)
+	pingRes := f.pingAll(host, ips)
+	f.decisions.add(newDecision(f.Clock.Now(), host, ips, pingRes))
+	if pingRes != nil {
 		return f.prepareReply(pingRes, replies)
 	}
 
-	log.Debug("fastip: %s: no fastest IP found, using the first response", host)
+	f.stats.noResults.Add(1)
+	f.Logger.Debug("no fastest ip found, using the first response", "host", host)
 
 	return replies[0].Resp, replies[0].Upstream, nil
 }
@@ -107,7 +191,7 @@ func (f *FastestAddr) prepareReply(
 	}
 
 	if resp == nil {
-		log.Error("fastip: found no replies with IP %s, most likely this is a bug", ip)
+		f.Logger.Error("found no replies with ip, most likely this is a bug", "ip", ip)
 
 		// TODO(d.kolyshev): Consider returning error?
 		return replies[0].Resp, replies[0].Upstream, nil
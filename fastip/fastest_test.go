@@ -32,7 +32,7 @@ func TestFastestAddr_ExchangeFastest(t *testing.T) {
 		port := listen(t, netip.IPv4Unspecified())
 
 		f := NewFastestAddr()
-		f.pingPorts = []uint{port}
+		f.PingPorts = []uint{port}
 
 		// The alive IP is the just created local listener's address.  The dead
 		// one is known as TEST-NET-1 which shouldn't be routed at all.  See
@@ -61,7 +61,7 @@ func TestFastestAddr_ExchangeFastest(t *testing.T) {
 
 	t.Run("all_dead", func(t *testing.T) {
 		f := NewFastestAddr()
-		f.pingPorts = []uint{getFreePort(t)}
+		f.PingPorts = []uint{getFreePort(t)}
 
 		firstIP := netip.MustParseAddr("127.0.0.1")
 		ups := &testAUpstream{
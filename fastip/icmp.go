@@ -0,0 +1,204 @@
+package fastip
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// pingICMPTimeout is the timeout of waiting for an ICMP echo reply.  It's the
+// same as pingTCPTimeout for the same reason.
+const pingICMPTimeout = pingTCPTimeout
+
+// Protocol numbers of ICMP and ICMPv6, see
+// https://www.iana.org/assignments/protocol-numbers/protocol-numbers.xhtml.
+const (
+	protoICMP   = 1
+	protoICMPv6 = 58
+)
+
+// icmpEchoData is the payload of the ICMP echo requests.
+var icmpEchoData = []byte("dnsproxy")
+
+// icmpPingFunc sends an ICMP echo request to addr and waits for the reply no
+// longer than timeout.
+type icmpPingFunc func(addr netip.Addr, timeout time.Duration) (err error)
+
+// type check
+var _ icmpPingFunc = pingICMP
+
+// pingICMP is the [icmpPingFunc] using the unprivileged ICMP sockets where the
+// OS supports them and the raw sockets otherwise, which require the
+// corresponding capability, like CAP_NET_RAW on Linux.
+func pingICMP(addr netip.Addr, timeout time.Duration) (err error) {
+	e := newICMPEcho(addr)
+
+	conn, dst, err := e.listen()
+	if err != nil {
+		return fmt.Errorf("opening icmp socket: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, conn.Close()) }()
+
+	err = conn.SetDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return fmt.Errorf("setting deadline: %w", err)
+	}
+
+	msg := &icmp.Message{
+		Type: e.reqType,
+		Body: &icmp.Echo{ID: e.id, Seq: e.seq, Data: icmpEchoData},
+	}
+
+	// The checksum of the ICMPv6 messages is calculated by the OS.
+	b, err := msg.Marshal(nil)
+	if err != nil {
+		// Should never happen, since the message is valid.
+		panic(fmt.Errorf("marshaling icmp echo: %w", err))
+	}
+
+	_, err = conn.WriteTo(b, dst)
+	if err != nil {
+		return fmt.Errorf("sending icmp echo: %w", err)
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, peer, readErr := conn.ReadFrom(buf)
+		if readErr != nil {
+			return fmt.Errorf("receiving icmp echo reply: %w", readErr)
+		}
+
+		if e.isReply(buf[:n], peer) {
+			return nil
+		}
+	}
+}
+
+// icmpEcho is a single ICMP echo exchange.
+type icmpEcho struct {
+	// addr is the address being pinged.
+	addr netip.Addr
+
+	// reqType is the type of the echo request message.
+	reqType icmp.Type
+
+	// respType is the type of the echo reply message.
+	respType icmp.Type
+
+	// proto is the protocol number of ICMP for the family of addr.
+	proto int
+
+	// id is the identifier of the echo request.
+	id int
+
+	// seq is the sequence number of the echo request.
+	seq int
+
+	// raw is true if the echo is sent over a raw socket.
+	raw bool
+}
+
+// newICMPEcho returns a new ICMP echo exchange with addr with random
+// identifier and sequence number.
+func newICMPEcho(addr netip.Addr) (e *icmpEcho) {
+	e = &icmpEcho{
+		addr:     addr.Unmap(),
+		reqType:  ipv4.ICMPTypeEcho,
+		respType: ipv4.ICMPTypeEchoReply,
+		proto:    protoICMP,
+		id:       rand.IntN(1 << 16),
+		seq:      rand.IntN(1 << 16),
+	}
+
+	if e.addr.Is6() {
+		e.reqType, e.respType = ipv6.ICMPTypeEchoRequest, ipv6.ICMPTypeEchoReply
+		e.proto = protoICMPv6
+	}
+
+	return e
+}
+
+// listen opens the socket for the exchange and returns it with the destination
+// address for the echo request.  It uses the unprivileged ICMP socket if
+// possible and falls back to the raw one.
+func (e *icmpEcho) listen() (conn net.PacketConn, dst net.Addr, err error) {
+	dgramNet, rawNet := "udp4", "ip4:icmp"
+	if e.addr.Is6() {
+		dgramNet, rawNet = "udp6", "ip6:ipv6-icmp"
+	}
+
+	ip, zone := e.addr.AsSlice(), e.addr.Zone()
+
+	conn, dgramErr := icmp.ListenPacket(dgramNet, "")
+	if dgramErr == nil {
+		return conn, &net.UDPAddr{IP: ip, Zone: zone}, nil
+	}
+
+	conn, err = icmp.ListenPacket(rawNet, "")
+	if err != nil {
+		return nil, nil, errors.Join(dgramErr, err)
+	}
+
+	e.raw = true
+
+	return conn, &net.IPAddr{IP: ip, Zone: zone}, nil
+}
+
+// isReply returns true if b received from peer is the reply to e.
+func (e *icmpEcho) isReply(b []byte, peer net.Addr) (ok bool) {
+	var peerIP net.IP
+	switch peer := peer.(type) {
+	case *net.UDPAddr:
+		peerIP = peer.IP
+	case *net.IPAddr:
+		peerIP = peer.IP
+	default:
+		return false
+	}
+
+	if !peerIP.Equal(e.addr.AsSlice()) {
+		return false
+	}
+
+	msg, err := icmp.ParseMessage(e.proto, b)
+	if err != nil || msg.Type != e.respType {
+		return false
+	}
+
+	echo, ok := msg.Body.(*icmp.Echo)
+
+	// The identifier is replaced by the OS for the unprivileged sockets, so
+	// only check it for the raw ones.
+	return ok && echo.Seq == e.seq && (!e.raw || echo.ID == e.id)
+}
+
+// pingDoICMP sends the result of pinging ip with ICMP into resCh.
+func (f *FastestAddr) pingDoICMP(host string, ip netip.Addr, resCh chan *pingResult) {
+	f.Logger.Debug("pinging", "host", host, "addr", ip)
+
+	start := f.Clock.Now()
+	err := f.icmpPing(ip, pingICMPTimeout)
+	elapsed := f.Clock.Now().Sub(start)
+
+	if err == nil {
+		f.Logger.Debug("pinged", "host", host, "addr", ip, "elapsed", elapsed)
+	} else {
+		f.Logger.Debug(
+			"failed to ping",
+			"host", host,
+			"addr", ip,
+			"elapsed", elapsed,
+			slogutil.KeyError, err,
+		)
+	}
+
+	f.sendPingResult(resCh, netip.AddrPortFrom(ip, 0), elapsed, err == nil)
+}
@@ -0,0 +1,48 @@
+package fastip
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFastestAddr_PingAll_icmp(t *testing.T) {
+	failedIP := netutil.IPv4Localhost()
+	pingedIP := netip.MustParseAddr("127.0.0.2")
+
+	f := NewFastestAddr()
+	f.ICMP = true
+	f.PingPorts = []uint{getFreePort(t)}
+	f.icmpPing = func(addr netip.Addr, _ time.Duration) (err error) {
+		if addr == pingedIP {
+			return nil
+		}
+
+		return errors.Error("test error")
+	}
+
+	res := f.pingAll("", []netip.Addr{failedIP, pingedIP})
+	require.NotNil(t, res)
+
+	assert.True(t, res.success)
+	assert.Equal(t, pingedIP, res.addrPort.Addr())
+	assert.Zero(t, res.addrPort.Port())
+
+	assertCaching(t, f, pingedIP, 0)
+	assertCaching(t, f, failedIP, 1)
+}
+
+func TestPingICMP(t *testing.T) {
+	err := pingICMP(netutil.IPv4Localhost(), time.Second)
+	if err != nil && strings.HasPrefix(err.Error(), "opening icmp socket") {
+		t.Skipf("icmp sockets are not supported: %s", err)
+	}
+
+	require.NoError(t, err)
+}
@@ -0,0 +1,215 @@
+package fastip
+
+import (
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// maxDecisions is the number of the recent decisions remembered.
+const maxDecisions = 1024
+
+// CachedResult is a cached result of pinging an address.
+type CachedResult struct {
+	// Expire is the time the result expires at.
+	Expire time.Time `json:"expire"`
+
+	// IP is the pinged address.
+	IP netip.Addr `json:"ip"`
+
+	// Latency is the latency of the successful ping.  It's zero if Failed is
+	// true.
+	Latency time.Duration `json:"latency"`
+
+	// Failed is true if the address hasn't been reached.
+	Failed bool `json:"failed"`
+}
+
+// CachedResults returns the unexpired cached ping results sorted by address.
+func (f *FastestAddr) CachedResults() (res []*CachedResult) {
+	ents := f.cacheEntries()
+	res = make([]*CachedResult, 0, len(ents))
+	for _, e := range ents {
+		res = append(res, &CachedResult{
+			Expire:  e.expire,
+			IP:      e.ip,
+			Latency: time.Duration(e.ent.latencyMsec) * time.Millisecond,
+			Failed:  e.ent.status != 0,
+		})
+	}
+
+	return res
+}
+
+// DecisionReason is the reason an address has been chosen as the fastest one.
+type DecisionReason string
+
+// DecisionReason values.
+const (
+	// DecisionSingle means the response only contained a single address, so
+	// nothing has been pinged.
+	DecisionSingle DecisionReason = "single"
+
+	// DecisionCached means the address has the lowest latency among the
+	// cached results, which are all better than the new ones, if any.
+	DecisionCached DecisionReason = "cached"
+
+	// DecisionPinged means the address has been the first one to respond to
+	// the pings.
+	DecisionPinged DecisionReason = "pinged"
+
+	// DecisionNoResult means no address has been reached in time, nor has
+	// been cached as reachable, so the first response has been used as is.
+	DecisionNoResult DecisionReason = "no_result"
+)
+
+// Decision is a choice of the fastest address for a hostname.
+type Decision struct {
+	// Time is the time of the decision.
+	Time time.Time `json:"time"`
+
+	// Host is the lowercased FQDN the addresses have been resolved for.
+	Host string `json:"host"`
+
+	// Reason is the reason Addr has been chosen.
+	Reason DecisionReason `json:"reason"`
+
+	// Candidates are the resolved addresses.
+	Candidates []netip.Addr `json:"candidates"`
+
+	// Addr is the chosen address.  It's invalid if Reason is
+	// [DecisionNoResult].
+	Addr netip.Addr `json:"addr"`
+
+	// Latency is the latency of Addr.  It's zero if Reason is
+	// [DecisionSingle] or [DecisionNoResult].
+	Latency time.Duration `json:"latency"`
+}
+
+// newDecision returns the decision made for host at now from ips based on res,
+// which may be nil.
+func newDecision(now time.Time, host string, ips []netip.Addr, res *pingResult) (d *Decision) {
+	d = &Decision{
+		Time:       now,
+		Host:       host,
+		Reason:     DecisionNoResult,
+		Candidates: ips,
+	}
+
+	if res != nil {
+		d.Reason = res.reason
+		d.Addr = res.addrPort.Addr()
+		d.Latency = time.Duration(res.latency) * time.Millisecond
+	}
+
+	return d
+}
+
+// LastDecision returns the most recent decision made for host, if it's still
+// remembered.  host is case-insensitive and may omit the trailing dot.
+func (f *FastestAddr) LastDecision(host string) (d *Decision, ok bool) {
+	return f.decisions.last(dns.Fqdn(strings.ToLower(host)))
+}
+
+// decisionLog is a bounded log of the recent decisions.  It's safe for
+// concurrent use.
+type decisionLog struct {
+	// mu protects ring and next.
+	mu *sync.Mutex
+
+	// ring contains the decisions, overwritten in a circular manner.
+	ring []*Decision
+
+	// next is the index of ring the next decision is written to.
+	next int
+}
+
+// newDecisionLog returns a new log remembering at most size decisions.  size
+// must be positive.
+func newDecisionLog(size int) (l *decisionLog) {
+	return &decisionLog{
+		mu:   &sync.Mutex{},
+		ring: make([]*Decision, size),
+	}
+}
+
+// add writes d to the log, overwriting the oldest decision if it's full.
+func (l *decisionLog) add(d *Decision) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.ring[l.next] = d
+	l.next = (l.next + 1) % len(l.ring)
+}
+
+// last returns the most recent decision for host.
+func (l *decisionLog) last(host string) (d *Decision, ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for i := range len(l.ring) {
+		d = l.ring[(l.next-1-i+len(l.ring))%len(l.ring)]
+		if d == nil {
+			return nil, false
+		} else if d.Host == host {
+			return d, true
+		}
+	}
+
+	return nil, false
+}
+
+// Stats are the counters of the fastest address detection.
+type Stats struct {
+	// Lookups is the number of the responses the fastest address has been
+	// looked for in.
+	Lookups uint64 `json:"lookups"`
+
+	// NoResults is the number of the lookups which found nothing, so the
+	// first response has been used as is.
+	NoResults uint64 `json:"no_results"`
+
+	// CacheHits is the number of the addresses the cached results have been
+	// found for.
+	CacheHits uint64 `json:"cache_hits"`
+
+	// Pings is the number of the pings made, including the failed ones.
+	Pings uint64 `json:"pings"`
+
+	// PingFailures is the number of the failed pings.
+	PingFailures uint64 `json:"ping_failures"`
+}
+
+// stats are the counters of the fastest address detection updated
+// concurrently.
+type stats struct {
+	// lookups is the value of [Stats.Lookups].
+	lookups atomic.Uint64
+
+	// noResults is the value of [Stats.NoResults].
+	noResults atomic.Uint64
+
+	// cacheHits is the value of [Stats.CacheHits].
+	cacheHits atomic.Uint64
+
+	// pings is the value of [Stats.Pings].
+	pings atomic.Uint64
+
+	// pingFailures is the value of [Stats.PingFailures].
+	pingFailures atomic.Uint64
+}
+
+// Stats returns the current values of the counters of f.
+func (f *FastestAddr) Stats() (s *Stats) {
+	return &Stats{
+		Lookups:      f.stats.lookups.Load(),
+		NoResults:    f.stats.noResults.Load(),
+		CacheHits:    f.stats.cacheHits.Load(),
+		Pings:        f.stats.pings.Load(),
+		PingFailures: f.stats.pingFailures.Load(),
+	}
+}
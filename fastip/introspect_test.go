@@ -0,0 +1,85 @@
+package fastip
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFastestAddr_introspection(t *testing.T) {
+	f := NewFastestAddr()
+	f.PingPorts = []uint{listen(t, netip.IPv4Unspecified())}
+	f.PingWaitTimeout = 100 * time.Millisecond
+
+	aliveAddr := netip.MustParseAddr("127.0.0.1")
+
+	// The dead address is known as TEST-NET-1, which shouldn't be routed at
+	// all, see RFC 5737.
+	deadAddr := netip.MustParseAddr("192.0.2.1")
+
+	ups := []upstream.Upstream{&testAUpstream{
+		recs: []*dns.A{newTestRec(t, aliveAddr), newTestRec(t, deadAddr)},
+	}}
+
+	host := strings.ToLower(t.Name())
+
+	_, _, err := f.ExchangeFastest(newTestReq(t), ups)
+	require.NoError(t, err)
+
+	d, ok := f.LastDecision(host)
+	require.True(t, ok)
+
+	assert.Equal(t, DecisionPinged, d.Reason)
+	assert.Equal(t, aliveAddr, d.Addr)
+	assert.ElementsMatch(t, []netip.Addr{aliveAddr, deadAddr}, d.Candidates)
+
+	// The dead address is still being pinged, so the cached result is used.
+	_, _, err = f.ExchangeFastest(newTestReq(t), ups)
+	require.NoError(t, err)
+
+	d, ok = f.LastDecision(strings.ToUpper(host))
+	require.True(t, ok)
+
+	assert.Equal(t, DecisionCached, d.Reason)
+	assert.Equal(t, aliveAddr, d.Addr)
+
+	res := f.CachedResults()
+	require.NotEmpty(t, res)
+
+	assert.Equal(t, aliveAddr, res[0].IP)
+	assert.False(t, res[0].Failed)
+
+	s := f.Stats()
+	assert.Equal(t, uint64(2), s.Lookups)
+	assert.Equal(t, uint64(1), s.CacheHits)
+	assert.Zero(t, s.NoResults)
+	assert.NotZero(t, s.Pings)
+
+	_, ok = f.LastDecision("unknown.example")
+	assert.False(t, ok)
+}
+
+func TestDecisionLog(t *testing.T) {
+	l := newDecisionLog(2)
+
+	l.add(&Decision{Host: "a.", Reason: DecisionSingle})
+	l.add(&Decision{Host: "b.", Reason: DecisionSingle})
+	l.add(&Decision{Host: "a.", Reason: DecisionCached})
+
+	d, ok := l.last("a.")
+	require.True(t, ok)
+
+	assert.Equal(t, DecisionCached, d.Reason)
+
+	l.add(&Decision{Host: "c.", Reason: DecisionSingle})
+
+	// The decision for b. has been overwritten.
+	_, ok = l.last("b.")
+	assert.False(t, ok)
+}
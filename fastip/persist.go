@@ -0,0 +1,102 @@
+package fastip
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/netip"
+)
+
+// cacheFileVersion is the version of the format of the persisted cache.
+const cacheFileVersion = 1
+
+// cacheFile is the persisted cache.
+type cacheFile struct {
+	// Entries are the cached ping results.
+	Entries []*cacheFileEntry `json:"entries"`
+
+	// Version is the version of the format, see [cacheFileVersion].
+	Version uint `json:"version"`
+}
+
+// cacheFileEntry is a persisted cached ping result.
+type cacheFileEntry struct {
+	// IP is the pinged address.
+	IP netip.Addr `json:"ip"`
+
+	// Expire is the expiration time of the result, in Unix seconds.
+	Expire int64 `json:"expire"`
+
+	// LatencyMsec is the latency of the successful ping in milliseconds.
+	LatencyMsec uint `json:"latency_msec"`
+
+	// Failed is true if the ping failed.
+	Failed bool `json:"failed"`
+}
+
+// WriteCache writes the unexpired cached ping results to w in JSON, so that
+// those could be restored with [FastestAddr.ReadCache], for example after a
+// restart.
+func (f *FastestAddr) WriteCache(w io.Writer) (err error) {
+	ents := f.cacheEntries()
+
+	file := &cacheFile{
+		Entries: make([]*cacheFileEntry, 0, len(ents)),
+		Version: cacheFileVersion,
+	}
+
+	for _, e := range ents {
+		file.Entries = append(file.Entries, &cacheFileEntry{
+			IP:          e.ip,
+			Expire:      e.expire.Unix(),
+			LatencyMsec: e.ent.latencyMsec,
+			Failed:      e.ent.status != 0,
+		})
+	}
+
+	err = json.NewEncoder(w).Encode(file)
+	if err != nil {
+		return fmt.Errorf("encoding cache: %w", err)
+	}
+
+	return nil
+}
+
+// ReadCache reads the cached ping results written by [FastestAddr.WriteCache]
+// from r and adds them to the cache of f, keeping their expiration times.  The
+// expired results are skipped.
+func (f *FastestAddr) ReadCache(r io.Reader) (err error) {
+	file := &cacheFile{}
+	err = json.NewDecoder(r).Decode(file)
+	if err != nil {
+		return fmt.Errorf("decoding cache: %w", err)
+	}
+
+	if file.Version != cacheFileVersion {
+		return fmt.Errorf("cache version: unsupported value %d", file.Version)
+	}
+
+	f.ipCacheLock.Lock()
+	defer f.ipCacheLock.Unlock()
+
+	now := f.Clock.Now()
+	for i, e := range file.Entries {
+		if !e.IP.IsValid() {
+			return fmt.Errorf("entry at index %d: bad ip", i)
+		}
+
+		ttl := e.Expire - now.Unix()
+		if ttl <= 0 {
+			continue
+		}
+
+		ent := &cacheEntry{latencyMsec: e.LatencyMsec}
+		if e.Failed {
+			ent.status = 1
+		}
+
+		f.cacheAdd(ent, e.IP.Unmap(), uint32(min(ttl, fastestAddrCacheTTLSec)))
+	}
+
+	return nil
+}
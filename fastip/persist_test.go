@@ -0,0 +1,88 @@
+package fastip
+
+import (
+	"bytes"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFastestAddr_WriteCache(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1_700_000_000, 0)}
+
+	var (
+		okIP      = netip.MustParseAddr("192.0.2.1")
+		failedIP  = netip.MustParseAddr("2001:db8::1")
+		expiredIP = netip.MustParseAddr("192.0.2.2")
+	)
+
+	const latency uint = 42
+
+	f := NewFastestAddr()
+	f.Clock = clock
+	f.cacheAddSuccessful(okIP, latency)
+	f.cacheAddFailure(failedIP)
+	f.cacheAdd(&cacheEntry{latencyMsec: 1}, expiredIP, 1)
+
+	clock.now = clock.now.Add(time.Second)
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, f.WriteCache(buf))
+
+	// Restart in a minute.
+	clock.now = clock.now.Add(time.Minute)
+
+	restored := NewFastestAddr()
+	restored.Clock = clock
+	require.NoError(t, restored.ReadCache(buf))
+
+	ent := restored.cacheFind(okIP)
+	require.NotNil(t, ent)
+
+	assert.Zero(t, ent.status)
+	assert.Equal(t, latency, ent.latencyMsec)
+
+	ent = restored.cacheFind(failedIP)
+	require.NotNil(t, ent)
+
+	assert.Equal(t, 1, ent.status)
+
+	assert.Nil(t, restored.cacheFind(expiredIP))
+
+	// The restored entries keep their expiration time.
+	clock.now = clock.now.Add(fastestAddrCacheTTLSec*time.Second - time.Minute)
+	assert.Nil(t, restored.cacheFind(okIP))
+	assert.Nil(t, restored.cacheFind(failedIP))
+}
+
+func TestFastestAddr_ReadCache_errors(t *testing.T) {
+	testCases := []struct {
+		name       string
+		in         string
+		wantErrMsg string
+	}{{
+		name:       "bad_json",
+		in:         "{",
+		wantErrMsg: "decoding cache: unexpected EOF",
+	}, {
+		name:       "bad_version",
+		in:         `{"version":2,"entries":[]}`,
+		wantErrMsg: "cache version: unsupported value 2",
+	}, {
+		name:       "bad_ip",
+		in:         `{"version":1,"entries":[{"expire":1}]}`,
+		wantErrMsg: "entry at index 0: bad ip",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := NewFastestAddr().ReadCache(strings.NewReader(tc.in))
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+		})
+	}
+}
@@ -1,10 +1,12 @@
 package fastip
 
 import (
+	"context"
 	"net/netip"
 	"time"
 
-	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/syncutil"
 )
 
 // pingTCPTimeout is a TCP connection timeout.  It's higher than pingWaitTimeout
@@ -16,6 +18,9 @@ type pingResult struct {
 	// addrPort is the address-port pair the result is related to.
 	addrPort netip.AddrPort
 
+	// reason is the reason the result has been chosen with, if it has.
+	reason DecisionReason
+
 	// latency is the duration of dialing process in milliseconds.
 	latency uint
 
@@ -25,36 +30,86 @@ type pingResult struct {
 
 // schedulePings returns the result with the fastest IP address from the cache,
 // if it's found, and starts pinging other IPs which are not cached or outdated.
-// Returns scheduled flag which indicates that some goroutines have been
-// scheduled.
+// scheduled is the number of the pings started.
 func (f *FastestAddr) schedulePings(
 	resCh chan *pingResult,
 	ips []netip.Addr,
 	host string,
-) (pr *pingResult, scheduled bool) {
+) (pr *pingResult, scheduled int) {
+	sema := f.pingSemaphore()
 	for _, ip := range ips {
 		cached := f.cacheFind(ip)
 		if cached == nil {
-			scheduled = true
-			for _, port := range f.pingPorts {
-				go f.pingDoTCP(host, netip.AddrPortFrom(ip, uint16(port)), resCh)
+			for _, port := range f.PingPorts {
+				addrPort := netip.AddrPortFrom(ip, uint16(port))
+				go f.limitPing(sema, func() { f.pingDoTCP(host, addrPort, resCh) })
+			}
+
+			scheduled += len(f.PingPorts)
+			if f.ICMP {
+				go f.limitPing(sema, func() { f.pingDoICMP(host, ip, resCh) })
+				scheduled++
 			}
 
 			continue
 		}
 
-		if cached.status == 0 && (pr == nil || cached.latencyMsec < pr.latency) {
-			pr = &pingResult{
-				addrPort: netip.AddrPortFrom(ip, 0),
-				latency:  cached.latencyMsec,
-				success:  true,
-			}
+		f.stats.cacheHits.Add(1)
+		if cached.status != 0 {
+			continue
+		}
+
+		res := &pingResult{
+			addrPort: netip.AddrPortFrom(ip, 0),
+			reason:   DecisionCached,
+			latency:  cached.latencyMsec,
+			success:  true,
+		}
+		if pr == nil || f.isFaster(res, pr) {
+			pr = res
 		}
 	}
 
 	return pr, scheduled
 }
 
+// pingSemaphore returns the semaphore limiting the number of the concurrent
+// pings of a single lookup.
+func (f *FastestAddr) pingSemaphore() (sema syncutil.Semaphore) {
+	if f.MaxConcurrentPings == 0 {
+		return syncutil.EmptySemaphore{}
+	}
+
+	return syncutil.NewChanSemaphore(f.MaxConcurrentPings)
+}
+
+// limitPing calls ping once sema allows to.
+func (f *FastestAddr) limitPing(sema syncutil.Semaphore, ping func()) {
+	// Don't check the error, since the context is never canceled.
+	_ = sema.Acquire(context.Background())
+	defer sema.Release()
+
+	ping()
+}
+
+// weightedLatency returns the latency of res in milliseconds used to compare
+// it with the other results, see [FastestAddr.IPv6Preference].
+func (f *FastestAddr) weightedLatency(res *pingResult) (latency uint) {
+	latency = res.latency
+	if ip := res.addrPort.Addr(); !ip.Is6() || ip.Is4In6() {
+		return latency
+	}
+
+	pref := uint(max(f.IPv6Preference.Milliseconds(), 0))
+
+	return latency - min(latency, pref)
+}
+
+// isFaster returns true if res is considered faster than other.
+func (f *FastestAddr) isFaster(res, other *pingResult) (ok bool) {
+	return f.weightedLatency(res) < f.weightedLatency(other)
+}
+
 // pingAll pings all ips concurrently and returns as soon as the fastest one is
 // found or the timeout is exceeded.
 func (f *FastestAddr) pingAll(host string, ips []netip.Addr) (pr *pingResult) {
@@ -65,30 +120,38 @@ func (f *FastestAddr) pingAll(host string, ips []netip.Addr) (pr *pingResult) {
 	case 1:
 		return &pingResult{
 			addrPort: netip.AddrPortFrom(ips[0], 0),
+			reason:   DecisionSingle,
 			success:  true,
 		}
 	}
 
-	resCh := make(chan *pingResult, ipN*len(f.pingPorts))
+	pingsNum := len(f.PingPorts)
+	if f.ICMP {
+		pingsNum++
+	}
+
+	resCh := make(chan *pingResult, ipN*pingsNum)
 	pr, scheduled := f.schedulePings(resCh, ips, host)
-	if !scheduled {
+	if scheduled == 0 {
 		if pr != nil {
-			log.Debug("fastip: pingAll: %s: return cached response: %s", host, pr.addrPort)
+			f.Logger.Debug("returning cached response", "host", host, "addr", pr.addrPort)
 		} else {
-			log.Debug("fastip: pingAll: %s: returning nothing", host)
+			f.Logger.Debug("returning nothing", "host", host)
 		}
 
 		return pr
 	}
 
-	res := f.firstSuccessRes(resCh, host)
+	res := f.fastestRes(resCh, host, scheduled)
 	if res == nil {
 		// In case of timeout return cached or nil.
 		return pr
 	}
 
-	if pr == nil || res.latency <= pr.latency {
+	if pr == nil || !f.isFaster(pr, res) {
 		// Cache wasn't found or is worse than res.
+		res.reason = DecisionPinged
+
 		return res
 	}
 
@@ -96,68 +159,112 @@ func (f *FastestAddr) pingAll(host string, ips []netip.Addr) (pr *pingResult) {
 	return pr
 }
 
-// firstSuccessRes waits and returns the first successful ping result or nil in
-// case of timeout.
-func (f *FastestAddr) firstSuccessRes(resCh chan *pingResult, host string) (res *pingResult) {
+// fastestRes waits and returns the fastest successful ping result or nil in
+// case of timeout.  The first successful result is returned right away unless
+// [FastestAddr.FasterWait] is set.  pending is the number of the results
+// expected from resCh.
+func (f *FastestAddr) fastestRes(
+	resCh chan *pingResult,
+	host string,
+	pending int,
+) (res *pingResult) {
 	after := time.After(f.PingWaitTimeout)
-	for {
+
+	// faster is nil until the first successful result is received, so that it
+	// blocks forever.
+	var faster <-chan time.Time
+	for ; pending > 0; pending-- {
 		select {
-		case res = <-resCh:
-			log.Debug(
-				"fastip: pingAll: %s: got result for %s status %v",
-				host,
-				res.addrPort,
-				res.success,
+		case r := <-resCh:
+			f.Logger.Debug(
+				"got ping result",
+				"host", host,
+				"addr", r.addrPort,
+				"success", r.success,
 			)
 
-			if !res.success {
+			if !r.success {
 				continue
 			}
 
+			if res == nil || f.isFaster(r, res) {
+				res = r
+			}
+
+			if f.FasterWait <= 0 {
+				return res
+			} else if faster == nil {
+				faster = time.After(f.FasterWait)
+			}
+		case <-faster:
 			return res
 		case <-after:
-			log.Debug("fastip: pingAll: %s: pinging timed out", host)
+			f.Logger.Debug("pinging timed out", "host", host)
 
-			return nil
+			return res
 		}
 	}
+
+	return res
 }
 
 // pingDoTCP sends the result of dialing the specified address into resCh.
 func (f *FastestAddr) pingDoTCP(host string, addrPort netip.AddrPort, resCh chan *pingResult) {
-	log.Debug("pingDoTCP: %s: connecting to %s", host, addrPort)
+	f.Logger.Debug("connecting", "host", host, "addr", addrPort)
 
-	start := time.Now()
+	start := f.Clock.Now()
 	conn, err := f.pinger.Dial("tcp", addrPort.String())
-	elapsed := time.Since(start)
+	elapsed := f.Clock.Now().Sub(start)
 
 	success := err == nil
 	if success {
 		if cErr := conn.Close(); cErr != nil {
-			log.Debug("fastip: closing tcp connection: %s", cErr)
+			f.Logger.Debug("closing tcp connection", slogutil.KeyError, cErr)
 		}
 	}
 
+	if success {
+		f.Logger.Debug("connected", "host", host, "addr", addrPort, "elapsed", elapsed)
+	} else {
+		f.Logger.Debug(
+			"failed to connect",
+			"host", host,
+			"addr", addrPort,
+			"elapsed", elapsed,
+			slogutil.KeyError, err,
+		)
+	}
+
+	f.sendPingResult(resCh, addrPort, elapsed, success)
+}
+
+// sendPingResult sends the result of pinging addrPort into resCh and caches
+// it.
+func (f *FastestAddr) sendPingResult(
+	resCh chan *pingResult,
+	addrPort netip.AddrPort,
+	elapsed time.Duration,
+	success bool,
+) {
 	latency := uint(elapsed.Milliseconds())
 
-	resCh <- &pingResult{
-		addrPort: addrPort,
-		latency:  latency,
-		success:  success,
+	f.stats.pings.Add(1)
+	if !success {
+		f.stats.pingFailures.Add(1)
 	}
 
+	// Cache the result before sending it, so that it's already cached when
+	// the lookup is finished.
 	addr := addrPort.Addr().Unmap()
 	if success {
-		log.Debug("fastip: pingDoTCP: %s: elapsed %s ms on %s", host, elapsed, addrPort)
 		f.cacheAddSuccessful(addr, latency)
 	} else {
-		log.Debug(
-			"fastip: pingDoTCP: %s: failed to connect to %s, elapsed %s ms: %v",
-			host,
-			addrPort,
-			elapsed,
-			err,
-		)
 		f.cacheAddFailure(addr)
 	}
+
+	resCh <- &pingResult{
+		addrPort: addrPort,
+		latency:  latency,
+		success:  success,
+	}
 }
@@ -107,18 +107,18 @@ func TestFastestAddr_PingAll_cache(t *testing.T) {
 		ip = netutil.IPv4Localhost()
 		f := NewFastestAddr()
 
-		f.pingPorts = []uint{uint(listener.Addr().(*net.TCPAddr).Port)}
+		f.PingPorts = []uint{uint(listener.Addr().(*net.TCPAddr).Port)}
 		ips := []netip.Addr{ip, ip}
 
 		wg := &sync.WaitGroup{}
-		wg.Add(len(ips) * len(f.pingPorts))
+		wg.Add(len(ips) * len(f.PingPorts))
 
 		f.pinger.Control = func(_, address string, _ syscall.RawConn) (err error) {
 			hostport, err := netutil.ParseHostPort(address)
 			require.NoError(t, err)
 
 			assert.Equal(t, ip.String(), hostport.Host)
-			assert.Contains(t, f.pingPorts, uint(hostport.Port))
+			assert.Contains(t, f.PingPorts, uint(hostport.Port))
 
 			wg.Done()
 
@@ -171,7 +171,7 @@ func TestFastestAddr_PingAll(t *testing.T) {
 		ctrlCh := make(chan unit, 1)
 
 		f := NewFastestAddr()
-		f.pingPorts = []uint{
+		f.PingPorts = []uint{
 			fastPort,
 			slowPort,
 		}
@@ -209,7 +209,7 @@ func TestFastestAddr_PingAll(t *testing.T) {
 		port := getFreePort(t)
 
 		f := NewFastestAddr()
-		f.pingPorts = []uint{port}
+		f.PingPorts = []uint{port}
 
 		res := f.pingAll("test", []netip.Addr{ip, ip})
 		require.Nil(t, res)
@@ -239,3 +239,128 @@ func getFreePort(t *testing.T) (port uint) {
 
 	return port
 }
+
+func TestFastestAddr_PingAll_ipv6Preference(t *testing.T) {
+	ip4 := netutil.IPv4Localhost()
+	ip6 := netutil.IPv6Localhost()
+
+	testCases := []struct {
+		want netip.Addr
+		name string
+		pref time.Duration
+	}{{
+		want: ip4,
+		name: "no_preference",
+		pref: 0,
+	}, {
+		want: ip4,
+		name: "small_preference",
+		pref: 10 * time.Millisecond,
+	}, {
+		want: ip6,
+		name: "large_preference",
+		pref: 50 * time.Millisecond,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			f := NewFastestAddr()
+			f.IPv6Preference = tc.pref
+			f.cacheAddSuccessful(ip4, 10)
+			f.cacheAddSuccessful(ip6, 30)
+
+			res := f.pingAll("", []netip.Addr{ip4, ip6})
+			require.NotNil(t, res)
+
+			assert.Equal(t, tc.want, res.addrPort.Addr())
+		})
+	}
+}
+
+func TestFastestAddr_fastestRes(t *testing.T) {
+	res4 := &pingResult{
+		addrPort: netip.AddrPortFrom(netutil.IPv4Localhost(), 80),
+		latency:  10,
+		success:  true,
+	}
+	res6 := &pingResult{
+		addrPort: netip.AddrPortFrom(netutil.IPv6Localhost(), 80),
+		latency:  30,
+		success:  true,
+	}
+
+	testCases := []struct {
+		want       *pingResult
+		name       string
+		fasterWait time.Duration
+	}{{
+		want:       res4,
+		name:       "first",
+		fasterWait: 0,
+	}, {
+		want:       res6,
+		name:       "faster_wait",
+		fasterWait: time.Second,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			f := NewFastestAddr()
+			f.IPv6Preference = 50 * time.Millisecond
+			f.FasterWait = tc.fasterWait
+
+			resCh := make(chan *pingResult, 2)
+			resCh <- res4
+			resCh <- res6
+
+			assert.Same(t, tc.want, f.fastestRes(resCh, "", 2))
+		})
+	}
+}
+
+func TestFastestAddr_PingAll_maxConcurrentPings(t *testing.T) {
+	port := listen(t, netip.IPv4Unspecified())
+
+	f := NewFastestAddr()
+	f.PingPorts = []uint{port}
+	f.MaxConcurrentPings = 1
+
+	ips := []netip.Addr{
+		netip.MustParseAddr("127.0.0.1"),
+		netip.MustParseAddr("127.0.0.2"),
+		netip.MustParseAddr("127.0.0.3"),
+	}
+
+	var (
+		mu       sync.Mutex
+		inFlight int
+		maxSeen  int
+	)
+
+	wg := &sync.WaitGroup{}
+	wg.Add(len(ips))
+
+	f.pinger.Control = func(_, _ string, _ syscall.RawConn) (err error) {
+		defer wg.Done()
+
+		mu.Lock()
+		inFlight++
+		maxSeen = max(maxSeen, inFlight)
+		mu.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+
+		return nil
+	}
+
+	res := f.pingAll("", ips)
+	require.NotNil(t, res)
+
+	wg.Wait()
+
+	assert.Equal(t, 1, maxSeen)
+}
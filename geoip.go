@@ -0,0 +1,27 @@
+package main
+
+import (
+	"log/slog"
+
+	"github.com/AdguardTeam/dnsproxy/internal/geoip"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+)
+
+// initGeoIP sets the geo locator into conf, if any databases are configured in
+// options.
+func initGeoIP(l *slog.Logger, conf *proxy.Config, options *Options) {
+	if len(options.GeoIPDatabases) == 0 {
+		return
+	}
+
+	loc, err := geoip.New(&geoip.Config{
+		Logger: l.With(slogutil.KeyPrefix, "geoip"),
+		Paths:  options.GeoIPDatabases,
+	})
+	if err != nil {
+		fatal(l, "initializing geoip", slogutil.KeyError, err)
+	}
+
+	conf.GeoLocator = loc
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/internal/health"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+)
+
+// initHealth starts the HTTP server serving the health and readiness checks
+// of p, if it's enabled in options.  hc is nil if it's disabled.
+func initHealth(
+	baseLogger *slog.Logger,
+	p *proxy.Proxy,
+	conf *proxy.Config,
+	options *Options,
+) (hc *health.Checker) {
+	addr := options.HealthListenAddr
+	if addr == "" {
+		return nil
+	}
+
+	l := baseLogger.With(slogutil.KeyPrefix, "health")
+
+	hc = health.New(&health.Config{
+		Logger:    l,
+		Server:    p,
+		Upstreams: conf.UpstreamConfig.Upstreams,
+	})
+	hc.Start()
+
+	mux := http.NewServeMux()
+	mux.Handle(health.PathHealth, hc)
+	mux.Handle(health.PathReady, hc)
+
+	go func() {
+		l.Info("listening", "addr", addr)
+		srv := &http.Server{
+			Addr:        addr,
+			ReadTimeout: 60 * time.Second,
+			Handler:     mux,
+		}
+		err := listenAndServe(l, srv, options.ReusePort)
+		l.Error("running server", slogutil.KeyError, err)
+	}()
+
+	return hc
+}
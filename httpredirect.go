@@ -0,0 +1,107 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+)
+
+// acmeChallengePath is the path the ACME HTTP-01 challenge responses are
+// requested at, see RFC 8555.
+const acmeChallengePath = "/.well-known/acme-challenge/"
+
+// initHTTPRedirect starts the plain HTTP server redirecting to the
+// DNS-over-HTTPS listener, if it's enabled in options.
+func initHTTPRedirect(baseLogger *slog.Logger, options *Options) {
+	addr := options.HTTPRedirectListenAddr
+	if addr == "" {
+		return
+	}
+
+	l := baseLogger.With(slogutil.KeyPrefix, "http_redirect")
+	if len(options.HTTPSListenPorts) == 0 {
+		fatal(l, "plain http redirect requires an https port")
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/", &httpsRedirector{
+		logger: l,
+		port:   options.HTTPSListenPorts[0],
+	})
+
+	if options.ACMEWebroot != "" {
+		l.Info("serving acme challenges", "webroot", options.ACMEWebroot)
+
+		files := http.FileServer(http.Dir(options.ACMEWebroot))
+		mux.HandleFunc(acmeChallengePath, func(w http.ResponseWriter, r *http.Request) {
+			// Don't list the directories.
+			if strings.HasSuffix(r.URL.Path, "/") {
+				http.NotFound(w, r)
+
+				return
+			}
+
+			files.ServeHTTP(w, r)
+		})
+	}
+
+	go func() {
+		l.Info("listening", "addr", addr)
+		srv := &http.Server{
+			Addr:        addr,
+			ReadTimeout: 60 * time.Second,
+			Handler:     mux,
+		}
+		err := listenAndServe(l, srv, options.ReusePort)
+		l.Error("running server", slogutil.KeyError, err)
+	}()
+}
+
+// httpsRedirector is the [http.Handler] permanently redirecting the requests
+// to the same host and path over HTTPS.
+type httpsRedirector struct {
+	// logger is used to log the redirects.
+	logger *slog.Logger
+
+	// port is the port of the DNS-over-HTTPS listener.
+	port int
+}
+
+// type check
+var _ http.Handler = (*httpsRedirector)(nil)
+
+// ServeHTTP implements the [http.Handler] interface for *httpsRedirector.
+func (h *httpsRedirector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		// The port is omitted.
+		host = strings.Trim(r.Host, "[]")
+	}
+
+	if host == "" {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+
+		return
+	}
+
+	if h.port != 443 {
+		host = net.JoinHostPort(host, strconv.Itoa(h.port))
+	}
+
+	u := &url.URL{
+		Scheme:   "https",
+		Host:     host,
+		Path:     r.URL.Path,
+		RawQuery: r.URL.RawQuery,
+	}
+
+	h.logger.Debug("redirecting", "url", u)
+
+	http.Redirect(w, r, u.String(), http.StatusMovedPermanently)
+}
@@ -0,0 +1,405 @@
+// Package admin contains the implementation of the authenticated HTTP API
+// controlling the proxy at runtime.
+package admin
+
+import (
+	"cmp"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+)
+
+// Paths of the HTTP endpoints.
+const (
+	// PathCacheFlush is the path of the endpoint clearing the cache.
+	PathCacheFlush = "/api/cache/flush"
+
+	// PathReload is the path of the endpoint reloading the configuration.
+	PathReload = "/api/reload"
+
+	// PathUpstreams is the path of the endpoint listing the upstreams.
+	PathUpstreams = "/api/upstreams"
+
+	// PathUpstreamsEnable is the path of the endpoint enabling an upstream.
+	PathUpstreamsEnable = "/api/upstreams/enable"
+
+	// PathUpstreamsDisable is the path of the endpoint disabling an upstream.
+	PathUpstreamsDisable = "/api/upstreams/disable"
+
+	// PathStats is the path of the endpoint serving the core counters.
+	PathStats = "/api/stats"
+
+	// PathLogLevel is the path of the endpoint getting and setting the logging
+	// levels.
+	PathLogLevel = "/api/log-level"
+
+	// PathConfig is the path of the endpoint serving the effective
+	// configuration.
+	PathConfig = "/api/config"
+
+	// PathCacheOnly is the path of the endpoint getting and setting the
+	// cache-only mode.
+	PathCacheOnly = "/api/cache-only"
+)
+
+// Proxy is the proxy controlled by the API.
+type Proxy interface {
+	// ClearCache removes all the cached responses.
+	ClearCache()
+
+	// Upstreams returns the states of the configured upstreams.
+	Upstreams() (states []*proxy.UpstreamState)
+
+	// SetUpstreamEnabled enables or disables the configured upstream with
+	// addr.
+	SetUpstreamEnabled(addr string, enabled bool) (err error)
+
+	// Stats returns the core counters of the proxy.
+	Stats() (s *proxy.Stats)
+
+	// IsCacheOnly returns true if the cache-only mode is enabled.
+	IsCacheOnly() (ok bool)
+
+	// SetCacheOnly enables or disables the cache-only mode.
+	SetCacheOnly(enabled bool)
+}
+
+// LogLevels are the logging levels changeable at runtime.
+type LogLevels interface {
+	// LogLevels returns the current levels by the names of the loggers.
+	LogLevels() (levels map[string]slog.Level)
+
+	// SetLogLevel sets the level of the logger with name.  If name is empty,
+	// the levels of all the loggers are set.
+	SetLogLevel(name string, lvl slog.Level) (err error)
+}
+
+// Config is the configuration of the [API].
+type Config struct {
+	// Logger is used to log the performed operations.  If nil,
+	// [slog.Default] is used.
+	Logger *slog.Logger
+
+	// Proxy is the proxy controlled by the API.  It must not be nil.
+	Proxy Proxy
+
+	// LogLevels are the logging levels changed by the API.  If nil, the levels
+	// can't be changed.
+	LogLevels LogLevels
+
+	// Reload reloads the configuration.  If nil, the reloading isn't
+	// supported.
+	Reload func(ctx context.Context) (err error)
+
+	// ConfigDump returns the effective configuration, which is served as
+	// JSON.  If nil, the configuration isn't served.
+	ConfigDump func() (dump any)
+
+	// Token is the secret the requests must be authenticated with, either as
+	// a bearer token or as the password of the basic authentication.  It must
+	// not be empty.
+	Token string
+}
+
+// API is the HTTP API controlling the proxy at runtime.
+type API struct {
+	// logger is used to log the performed operations.  It's never nil.
+	logger *slog.Logger
+
+	// proxy is the proxy controlled by the API.
+	proxy Proxy
+
+	// logLevels are the logging levels changed by the API.  It may be nil.
+	logLevels LogLevels
+
+	// reload reloads the configuration.  It may be nil.
+	reload func(ctx context.Context) (err error)
+
+	// configDump returns the effective configuration.  It may be nil.
+	configDump func() (dump any)
+
+	// token is the secret the requests must be authenticated with.
+	token []byte
+}
+
+// New returns a new properly initialized *API.  c must not be nil.
+func New(c *Config) (a *API) {
+	return &API{
+		logger:     cmp.Or(c.Logger, slog.Default()),
+		proxy:      c.Proxy,
+		logLevels:  c.LogLevels,
+		reload:     c.Reload,
+		configDump: c.ConfigDump,
+		token:      []byte(c.Token),
+	}
+}
+
+// Register registers the authenticated handlers of the API in mux.
+func (a *API) Register(mux *http.ServeMux) {
+	for pattern, h := range map[string]http.HandlerFunc{
+		"POST " + PathCacheFlush:       a.handleCacheFlush,
+		"POST " + PathReload:           a.handleReload,
+		"GET " + PathUpstreams:         a.handleUpstreams,
+		"POST " + PathUpstreamsEnable:  a.handleUpstreamState(true),
+		"POST " + PathUpstreamsDisable: a.handleUpstreamState(false),
+		"GET " + PathStats:             a.handleStats,
+		"GET " + PathLogLevel:          a.handleGetLogLevel,
+		"PUT " + PathLogLevel:          a.handleSetLogLevel,
+		"GET " + PathConfig:            a.handleConfig,
+		"GET " + PathCacheOnly:         a.handleGetCacheOnly,
+		"PUT " + PathCacheOnly:         a.handleSetCacheOnly,
+	} {
+		mux.Handle(pattern, a.authenticate(h))
+	}
+}
+
+// authenticate returns the handler calling h only for the requests
+// authenticated with the token.
+func (a *API) authenticate(h http.HandlerFunc) (wrapped http.Handler) {
+	return authenticate(a.token, h)
+}
+
+// Authenticate returns the middleware only passing the requests authenticated
+// with token to the wrapped handler, just like the API does, see
+// [Config.Token].  token must not be empty.
+func Authenticate(token string) (mw func(h http.Handler) (wrapped http.Handler)) {
+	return func(h http.Handler) (wrapped http.Handler) {
+		return authenticate([]byte(token), h)
+	}
+}
+
+// authenticate returns the handler calling h only for the requests
+// authenticated with token.
+func authenticate(token []byte, h http.Handler) (wrapped http.Handler) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isAuthenticated(r, token) {
+			// Offer the basic authentication as well, so that the browsers
+			// prompt for the credentials.
+			w.Header().Add("WWW-Authenticate", `Bearer realm="dnsproxy admin"`)
+			w.Header().Add("WWW-Authenticate", `Basic realm="dnsproxy admin"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// isAuthenticated returns true if r contains token either as a bearer token or
+// as the password of the basic authentication.
+func isAuthenticated(r *http.Request, token []byte) (ok bool) {
+	var got string
+	if _, pass, hasBasic := r.BasicAuth(); hasBasic {
+		got = pass
+	} else if bearer, hasBearer := strings.CutPrefix(
+		r.Header.Get("Authorization"),
+		"Bearer ",
+	); hasBearer {
+		got = bearer
+	} else {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(got), token) == 1
+}
+
+// handleCacheFlush clears the cache of the proxy.
+func (a *API) handleCacheFlush(w http.ResponseWriter, _ *http.Request) {
+	a.proxy.ClearCache()
+	a.logger.Info("cache flushed")
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleReload reloads the configuration.
+func (a *API) handleReload(w http.ResponseWriter, r *http.Request) {
+	if a.reload == nil {
+		http.Error(w, "reloading is not supported", http.StatusNotImplemented)
+
+		return
+	}
+
+	err := a.reload(r.Context())
+	if err != nil {
+		a.logger.Error("reloading configuration", slogutil.KeyError, err)
+		http.Error(w, fmt.Sprintf("reloading: %s", err), http.StatusInternalServerError)
+
+		return
+	}
+
+	a.logger.Info("configuration reloaded")
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// upstreamJSON is the JSON representation of [proxy.UpstreamState].
+type upstreamJSON struct {
+	Address string `json:"address"`
+	Enabled bool   `json:"enabled"`
+}
+
+// handleUpstreams serves the states of the upstreams.
+func (a *API) handleUpstreams(w http.ResponseWriter, _ *http.Request) {
+	states := a.proxy.Upstreams()
+	resp := make([]upstreamJSON, 0, len(states))
+	for _, s := range states {
+		resp = append(resp, upstreamJSON{
+			Address: s.Address,
+			Enabled: s.Enabled,
+		})
+	}
+
+	writeJSON(w, resp)
+}
+
+// upstreamStateReq is the body of the requests enabling or disabling an
+// upstream.
+type upstreamStateReq struct {
+	Address string `json:"address"`
+}
+
+// handleUpstreamState returns the handler enabling or disabling the upstream
+// from the request.
+func (a *API) handleUpstreamState(enabled bool) (h http.HandlerFunc) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req := &upstreamStateReq{}
+		err := json.NewDecoder(r.Body).Decode(req)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("bad body: %s", err), http.StatusBadRequest)
+
+			return
+		}
+
+		err = a.proxy.SetUpstreamEnabled(req.Address, enabled)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handleStats serves the core counters of the proxy.
+func (a *API) handleStats(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Ignore the error, since it's only possible if the client has gone.
+	_, _ = w.Write([]byte(a.proxy.Stats().Var().String()))
+}
+
+// logLevelJSON is the JSON representation of a logging level.  An empty name
+// refers to the base logger.
+type logLevelJSON struct {
+	Name  string     `json:"name"`
+	Level slog.Level `json:"level"`
+}
+
+// handleGetLogLevel serves the current logging levels.
+func (a *API) handleGetLogLevel(w http.ResponseWriter, _ *http.Request) {
+	if a.logLevels == nil {
+		http.Error(w, "log levels are not supported", http.StatusNotImplemented)
+
+		return
+	}
+
+	levels := a.logLevels.LogLevels()
+	resp := make([]logLevelJSON, 0, len(levels))
+	for name, lvl := range levels {
+		resp = append(resp, logLevelJSON{
+			Name:  name,
+			Level: lvl,
+		})
+	}
+
+	slices.SortFunc(resp, func(a, b logLevelJSON) (res int) {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	writeJSON(w, resp)
+}
+
+// handleSetLogLevel sets the logging level from the request.
+func (a *API) handleSetLogLevel(w http.ResponseWriter, r *http.Request) {
+	if a.logLevels == nil {
+		http.Error(w, "log levels are not supported", http.StatusNotImplemented)
+
+		return
+	}
+
+	req := &logLevelJSON{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("bad body: %s", err), http.StatusBadRequest)
+
+		return
+	}
+
+	err = a.logLevels.SetLogLevel(req.Name, req.Level)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	a.logger.Info("log level changed", "name", req.Name, "level", req.Level)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleConfig serves the effective configuration.
+func (a *API) handleConfig(w http.ResponseWriter, _ *http.Request) {
+	if a.configDump == nil {
+		http.Error(w, "config dump is not supported", http.StatusNotImplemented)
+
+		return
+	}
+
+	writeJSON(w, a.configDump())
+}
+
+// cacheOnlyJSON is the JSON representation of the state of the cache-only
+// mode.
+type cacheOnlyJSON struct {
+	Enabled bool `json:"enabled"`
+}
+
+// handleGetCacheOnly serves the state of the cache-only mode.
+func (a *API) handleGetCacheOnly(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, cacheOnlyJSON{
+		Enabled: a.proxy.IsCacheOnly(),
+	})
+}
+
+// handleSetCacheOnly sets the state of the cache-only mode from the request.
+func (a *API) handleSetCacheOnly(w http.ResponseWriter, r *http.Request) {
+	req := &cacheOnlyJSON{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("bad body: %s", err), http.StatusBadRequest)
+
+		return
+	}
+
+	a.proxy.SetCacheOnly(req.Enabled)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeJSON writes v to w as JSON.
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Ignore the error, since it's only possible if the client has gone.
+	_ = json.NewEncoder(w).Encode(v)
+}
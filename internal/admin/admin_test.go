@@ -0,0 +1,331 @@
+package admin_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/internal/admin"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// type check
+var _ admin.Proxy = (*proxy.Proxy)(nil)
+
+// testToken is the token used in tests.
+const testToken = "secret"
+
+// testProxy is an [admin.Proxy] for tests.
+type testProxy struct {
+	enabled   map[string]bool
+	stats     *proxy.Stats
+	flushed   bool
+	cacheOnly bool
+}
+
+// ClearCache implements the [admin.Proxy] interface for *testProxy.
+func (p *testProxy) ClearCache() { p.flushed = true }
+
+// Upstreams implements the [admin.Proxy] interface for *testProxy.
+func (p *testProxy) Upstreams() (states []*proxy.UpstreamState) {
+	for _, addr := range []string{"1.1.1.1:53", "8.8.8.8:53"} {
+		states = append(states, &proxy.UpstreamState{
+			Address: addr,
+			Enabled: p.enabled[addr],
+		})
+	}
+
+	return states
+}
+
+// SetUpstreamEnabled implements the [admin.Proxy] interface for *testProxy.
+func (p *testProxy) SetUpstreamEnabled(addr string, enabled bool) (err error) {
+	if _, ok := p.enabled[addr]; !ok {
+		return fmt.Errorf("unknown upstream %q", addr)
+	}
+
+	p.enabled[addr] = enabled
+
+	return nil
+}
+
+// Stats implements the [admin.Proxy] interface for *testProxy.
+func (p *testProxy) Stats() (s *proxy.Stats) { return p.stats }
+
+// IsCacheOnly implements the [admin.Proxy] interface for *testProxy.
+func (p *testProxy) IsCacheOnly() (ok bool) { return p.cacheOnly }
+
+// SetCacheOnly implements the [admin.Proxy] interface for *testProxy.
+func (p *testProxy) SetCacheOnly(enabled bool) { p.cacheOnly = enabled }
+
+// testLogLevels is an [admin.LogLevels] for tests.
+type testLogLevels map[string]slog.Level
+
+// LogLevels implements the [admin.LogLevels] interface for testLogLevels.
+func (ll testLogLevels) LogLevels() (levels map[string]slog.Level) { return ll }
+
+// SetLogLevel implements the [admin.LogLevels] interface for testLogLevels.
+func (ll testLogLevels) SetLogLevel(name string, lvl slog.Level) (err error) {
+	if _, ok := ll[name]; !ok {
+		return fmt.Errorf("unknown logger %q", name)
+	}
+
+	ll[name] = lvl
+
+	return nil
+}
+
+// newTestMux returns the mux with the API for p and levels registered.
+func newTestMux(
+	p *testProxy,
+	levels admin.LogLevels,
+	reload func(ctx context.Context) (err error),
+) (mux *http.ServeMux) {
+	mux = http.NewServeMux()
+	admin.New(&admin.Config{
+		Logger:    slogutil.NewDiscardLogger(),
+		Proxy:     p,
+		LogLevels: levels,
+		Reload:    reload,
+		Token:     testToken,
+	}).Register(mux)
+
+	return mux
+}
+
+// serve performs the authenticated request to mux and returns the response.
+func serve(mux *http.ServeMux, method, path, body string) (w *httptest.ResponseRecorder) {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer "+testToken)
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+
+	return w
+}
+
+func TestAPI_auth(t *testing.T) {
+	mux := newTestMux(&testProxy{stats: &proxy.Stats{}}, nil, nil)
+
+	testCases := []struct {
+		setAuth  func(r *http.Request)
+		name     string
+		wantCode int
+	}{{
+		setAuth:  func(_ *http.Request) {},
+		name:     "none",
+		wantCode: http.StatusUnauthorized,
+	}, {
+		setAuth:  func(r *http.Request) { r.Header.Set("Authorization", "Bearer bad") },
+		name:     "bad_bearer",
+		wantCode: http.StatusUnauthorized,
+	}, {
+		setAuth:  func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+testToken) },
+		name:     "bearer",
+		wantCode: http.StatusOK,
+	}, {
+		setAuth:  func(r *http.Request) { r.SetBasicAuth("admin", "bad") },
+		name:     "bad_basic",
+		wantCode: http.StatusUnauthorized,
+	}, {
+		setAuth:  func(r *http.Request) { r.SetBasicAuth("admin", testToken) },
+		name:     "basic",
+		wantCode: http.StatusOK,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, admin.PathStats, nil)
+			tc.setAuth(r)
+
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, r)
+
+			assert.Equal(t, tc.wantCode, w.Code)
+		})
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	h := admin.Authenticate(testToken)(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Contains(t, w.Header().Values("WWW-Authenticate"), `Basic realm="dnsproxy admin"`)
+
+	r.SetBasicAuth("admin", testToken)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusNoContent, w.Code)
+}
+
+func TestAPI_cacheFlush(t *testing.T) {
+	p := &testProxy{}
+	mux := newTestMux(p, nil, nil)
+
+	w := serve(mux, http.MethodPost, admin.PathCacheFlush, "")
+	require.Equal(t, http.StatusNoContent, w.Code)
+
+	assert.True(t, p.flushed)
+}
+
+func TestAPI_reload(t *testing.T) {
+	t.Run("unsupported", func(t *testing.T) {
+		w := serve(newTestMux(&testProxy{}, nil, nil), http.MethodPost, admin.PathReload, "")
+		assert.Equal(t, http.StatusNotImplemented, w.Code)
+	})
+
+	t.Run("success", func(t *testing.T) {
+		var reloaded bool
+		mux := newTestMux(&testProxy{}, nil, func(_ context.Context) (err error) {
+			reloaded = true
+
+			return nil
+		})
+
+		w := serve(mux, http.MethodPost, admin.PathReload, "")
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		assert.True(t, reloaded)
+	})
+
+	t.Run("error", func(t *testing.T) {
+		mux := newTestMux(&testProxy{}, nil, func(_ context.Context) (err error) {
+			return assert.AnError
+		})
+
+		w := serve(mux, http.MethodPost, admin.PathReload, "")
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+		assert.Contains(t, w.Body.String(), assert.AnError.Error())
+	})
+}
+
+func TestAPI_upstreams(t *testing.T) {
+	p := &testProxy{
+		enabled: map[string]bool{
+			"1.1.1.1:53": true,
+			"8.8.8.8:53": true,
+		},
+	}
+	mux := newTestMux(p, nil, nil)
+
+	w := serve(mux, http.MethodPost, admin.PathUpstreamsDisable, `{"address":"8.8.8.8:53"}`)
+	require.Equal(t, http.StatusNoContent, w.Code)
+
+	w = serve(mux, http.MethodGet, admin.PathUpstreams, "")
+	require.Equal(t, http.StatusOK, w.Code)
+
+	assert.JSONEq(t, `[
+		{"address":"1.1.1.1:53","enabled":true},
+		{"address":"8.8.8.8:53","enabled":false}
+	]`, w.Body.String())
+
+	w = serve(mux, http.MethodPost, admin.PathUpstreamsEnable, `{"address":"8.8.8.8:53"}`)
+	require.Equal(t, http.StatusNoContent, w.Code)
+
+	assert.True(t, p.enabled["8.8.8.8:53"])
+
+	w = serve(mux, http.MethodPost, admin.PathUpstreamsEnable, `{"address":"9.9.9.9:53"}`)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = serve(mux, http.MethodPost, admin.PathUpstreamsEnable, `bad`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestAPI_stats(t *testing.T) {
+	s := &proxy.Stats{}
+	s.OnCacheLookup(true)
+
+	w := serve(newTestMux(&testProxy{stats: s}, nil, nil), http.MethodGet, admin.PathStats, "")
+	require.Equal(t, http.StatusOK, w.Code)
+
+	got := map[string]any{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &got))
+
+	assert.Equal(t, float64(1), got["cache_hits"])
+}
+
+func TestAPI_logLevel(t *testing.T) {
+	levels := testLogLevels{
+		"":      slog.LevelInfo,
+		"cache": slog.LevelInfo,
+	}
+	mux := newTestMux(&testProxy{}, levels, nil)
+
+	w := serve(mux, http.MethodPut, admin.PathLogLevel, `{"name":"cache","level":"debug"}`)
+	require.Equal(t, http.StatusNoContent, w.Code)
+
+	w = serve(mux, http.MethodGet, admin.PathLogLevel, "")
+	require.Equal(t, http.StatusOK, w.Code)
+
+	assert.JSONEq(t, `[
+		{"name":"","level":"INFO"},
+		{"name":"cache","level":"DEBUG"}
+	]`, w.Body.String())
+
+	w = serve(mux, http.MethodPut, admin.PathLogLevel, `{"name":"unknown","level":"debug"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = serve(mux, http.MethodPut, admin.PathLogLevel, `{"name":"cache","level":"bad"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	t.Run("unsupported", func(t *testing.T) {
+		w = serve(newTestMux(&testProxy{}, nil, nil), http.MethodGet, admin.PathLogLevel, "")
+		assert.Equal(t, http.StatusNotImplemented, w.Code)
+	})
+}
+
+func TestAPI_config(t *testing.T) {
+	t.Run("unsupported", func(t *testing.T) {
+		w := serve(newTestMux(&testProxy{}, nil, nil), http.MethodGet, admin.PathConfig, "")
+		assert.Equal(t, http.StatusNotImplemented, w.Code)
+	})
+
+	t.Run("success", func(t *testing.T) {
+		mux := http.NewServeMux()
+		admin.New(&admin.Config{
+			Logger: slogutil.NewDiscardLogger(),
+			Proxy:  &testProxy{},
+			ConfigDump: func() (dump any) {
+				return map[string]any{"upstream_mode": "load_balance"}
+			},
+			Token: testToken,
+		}).Register(mux)
+
+		w := serve(mux, http.MethodGet, admin.PathConfig, "")
+		require.Equal(t, http.StatusOK, w.Code)
+
+		assert.JSONEq(t, `{"upstream_mode":"load_balance"}`, w.Body.String())
+	})
+}
+
+func TestAPI_cacheOnly(t *testing.T) {
+	p := &testProxy{}
+	mux := newTestMux(p, nil, nil)
+
+	w := serve(mux, http.MethodPut, admin.PathCacheOnly, `{"enabled":true}`)
+	require.Equal(t, http.StatusNoContent, w.Code)
+
+	assert.True(t, p.cacheOnly)
+
+	w = serve(mux, http.MethodGet, admin.PathCacheOnly, "")
+	require.Equal(t, http.StatusOK, w.Code)
+
+	assert.JSONEq(t, `{"enabled":true}`, w.Body.String())
+
+	w = serve(mux, http.MethodPut, admin.PathCacheOnly, `bad`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
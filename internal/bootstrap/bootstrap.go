@@ -5,14 +5,16 @@ package bootstrap
 import (
 	"context"
 	"fmt"
+	"log/slog"
 	"net"
 	"net/netip"
 	"net/url"
 	"slices"
+	"syscall"
 	"time"
 
 	"github.com/AdguardTeam/golibs/errors"
-	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
 	"github.com/AdguardTeam/golibs/netutil"
 )
 
@@ -42,13 +44,32 @@ const (
 // [NetworkTCP] or [NetworkUDP].
 type DialHandler func(ctx context.Context, network Network, addr string) (conn net.Conn, err error)
 
+// DialFunc dials the connection to addr over network, see
+// [net.Dialer.DialContext].
+type DialFunc = func(ctx context.Context, network Network, addr string) (conn net.Conn, err error)
+
+// ControlFunc is the function called after creating the network connection
+// but before dialing it, see [net.Dialer.Control].
+type ControlFunc = func(network, address string, c syscall.RawConn) (err error)
+
 // ResolveDialContext returns a DialHandler that uses addresses resolved from u
-// using resolver.  u must not be nil.
+// using resolver.  network is the address family to resolve and must be one of
+// [NetworkIP], [NetworkIP4], or [NetworkIP6].  preferV6 makes the IPv6
+// addresses dialed first, if network is [NetworkIP].  control is used to set
+// up the dialed sockets, if not nil.  multipathTCP enables Multipath TCP for
+// the TCP connections, where the OS supports it.  dial is used to dial the
+// resolved addresses, if not nil, see [NewDialContext].  u and l must not be
+// nil.
 func ResolveDialContext(
 	u *url.URL,
 	timeout time.Duration,
 	r Resolver,
+	network Network,
 	preferV6 bool,
+	control ControlFunc,
+	multipathTCP bool,
+	dial DialFunc,
+	l *slog.Logger,
 ) (h DialHandler, err error) {
 	defer func() { err = errors.Annotate(err, "dialing %q: %w", u.Host) }()
 
@@ -70,12 +91,20 @@ func ResolveDialContext(
 		defer cancel()
 	}
 
-	// TODO(e.burkov):  Use network properly, perhaps, pass it through options.
-	ips, err := r.LookupNetIP(ctx, NetworkIP, host)
+	ips, err := r.LookupNetIP(ctx, network, host)
 	if err != nil {
 		return nil, fmt.Errorf("resolving hostname: %w", err)
 	}
 
+	// Don't rely on the resolvers to filter the addresses, since some of them
+	// ignore network.
+	if len(ips) > 0 {
+		ips = filterFamily(ips, network)
+		if len(ips) == 0 {
+			return nil, fmt.Errorf("resolving hostname: no %s addresses", network)
+		}
+	}
+
 	if preferV6 {
 		slices.SortStableFunc(ips, netutil.PreferIPv6)
 	} else {
@@ -87,23 +116,58 @@ func ResolveDialContext(
 		addrs = append(addrs, netip.AddrPortFrom(ip, port).String())
 	}
 
-	return NewDialContext(timeout, addrs...), nil
+	return NewDialContext(timeout, control, multipathTCP, dial, l, addrs...), nil
+}
+
+// filterFamily removes the addresses not belonging to network from ips and
+// returns the result.
+func filterFamily(ips []netip.Addr, network Network) (res []netip.Addr) {
+	switch network {
+	case NetworkIP4:
+		return slices.DeleteFunc(ips, func(ip netip.Addr) (ok bool) { return !ip.Unmap().Is4() })
+	case NetworkIP6:
+		return slices.DeleteFunc(ips, func(ip netip.Addr) (ok bool) { return ip.Unmap().Is4() })
+	default:
+		return ips
+	}
 }
 
 // NewDialContext returns a DialHandler that dials addrs and returns the first
-// successful connection.  At least a single addr should be specified.
-func NewDialContext(timeout time.Duration, addrs ...string) (h DialHandler) {
-	l := len(addrs)
-	if l == 0 {
-		log.Debug("bootstrap: no addresses to dial")
+// successful connection.  At least a single addr should be specified.  control
+// is used to set up the dialed sockets, if not nil.  multipathTCP enables
+// Multipath TCP for the TCP connections, where the OS supports it, falling back
+// to the regular TCP otherwise.  dial, if not nil, is used to dial addrs
+// instead of [net.Dialer], in which case control, multipathTCP, and
+// [WithLocalPort] have no effect.  l must not be nil.
+func NewDialContext(
+	timeout time.Duration,
+	control ControlFunc,
+	multipathTCP bool,
+	dial DialFunc,
+	l *slog.Logger,
+	addrs ...string,
+) (h DialHandler) {
+	addrsNum := len(addrs)
+	if addrsNum == 0 {
+		l.Debug("no addresses to dial")
 
 		return func(_ context.Context, _, _ string) (conn net.Conn, err error) {
 			return nil, errors.Error("no addresses")
 		}
 	}
 
-	dialer := &net.Dialer{
-		Timeout: timeout,
+	if dial == nil {
+		dialer := &net.Dialer{
+			Timeout: timeout,
+			Control: control,
+		}
+		dialer.SetMultipathTCP(multipathTCP)
+
+		dial = func(ctx context.Context, network Network, addr string) (conn net.Conn, err error) {
+			return dialerFor(ctx, dialer, network).DialContext(ctx, network, addr)
+		}
+	} else if timeout > 0 {
+		dial = withDialTimeout(dial, timeout)
 	}
 
 	return func(ctx context.Context, network Network, _ string) (conn net.Conn, err error) {
@@ -112,19 +176,25 @@ func NewDialContext(timeout time.Duration, addrs ...string) (h DialHandler) {
 		// Return first succeeded connection.  Note that we're using addrs
 		// instead of what's passed to the function.
 		for i, addr := range addrs {
-			log.Debug("bootstrap: dialing %s (%d/%d)", addr, i+1, l)
+			l.DebugContext(ctx, "dialing", "addr", addr, "idx", i+1, "total", addrsNum)
 
 			start := time.Now()
-			conn, err = dialer.DialContext(ctx, network, addr)
+			conn, err = dial(ctx, network, addr)
 			elapsed := time.Since(start)
 			if err != nil {
-				log.Debug("bootstrap: connection to %s failed in %s: %s", addr, elapsed, err)
+				l.DebugContext(
+					ctx,
+					"connection failed",
+					"addr", addr,
+					"elapsed", elapsed,
+					slogutil.KeyError, err,
+				)
 				errs = append(errs, err)
 
 				continue
 			}
 
-			log.Debug("bootstrap: connection to %s succeeded in %s", addr, elapsed)
+			l.DebugContext(ctx, "connection succeeded", "addr", addr, "elapsed", elapsed)
 
 			return conn, nil
 		}
@@ -132,3 +202,42 @@ func NewDialContext(timeout time.Duration, addrs ...string) (h DialHandler) {
 		return nil, errors.Join(errs...)
 	}
 }
+
+// withDialTimeout returns dial limited to timeout, like [net.Dialer.Timeout].
+func withDialTimeout(dial DialFunc, timeout time.Duration) (wrapped DialFunc) {
+	return func(ctx context.Context, network Network, addr string) (conn net.Conn, err error) {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+
+		return dial(ctx, network, addr)
+	}
+}
+
+// localPortKey is the context key for the local port of the dialed sockets.
+type localPortKey struct{}
+
+// WithLocalPort returns a copy of parent which makes the [DialHandler] bind the
+// dialed sockets to port on the unspecified address.
+func WithLocalPort(parent context.Context, port uint16) (ctx context.Context) {
+	return context.WithValue(parent, localPortKey{}, port)
+}
+
+// dialerFor returns the dialer to dial network with according to ctx.  It
+// returns d itself, unless ctx specifies the local port.
+func dialerFor(ctx context.Context, d *net.Dialer, network Network) (res *net.Dialer) {
+	port, ok := ctx.Value(localPortKey{}).(uint16)
+	if !ok {
+		return d
+	}
+
+	res = &net.Dialer{}
+	*res = *d
+	switch network {
+	case NetworkTCP:
+		res.LocalAddr = &net.TCPAddr{Port: int(port)}
+	default:
+		res.LocalAddr = &net.UDPAddr{Port: int(port)}
+	}
+
+	return res
+}
@@ -10,6 +10,7 @@ import (
 
 	"github.com/AdguardTeam/dnsproxy/internal/bootstrap"
 	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
 	"github.com/AdguardTeam/golibs/netutil"
 	"github.com/AdguardTeam/golibs/testutil"
 	"github.com/stretchr/testify/assert"
@@ -19,6 +20,9 @@ import (
 // testTimeout is a common timeout used in tests of this package.
 const testTimeout = 1 * time.Second
 
+// testLogger is a common logger used in tests of this package.
+var testLogger = slogutil.NewDiscardLogger()
+
 // newListener creates a new listener of zero address of the specified network
 // type and returns it, adding it's closing to the test cleanup.  sig is used to
 // send the address of each accepted connection and must be read properly.
@@ -99,7 +103,12 @@ func TestResolveDialContext(t *testing.T) {
 				&url.URL{Host: netutil.JoinHostPort(hostname, port)},
 				testTimeout,
 				bootstrap.ParallelResolver{r},
+				bootstrap.NetworkIP,
 				tc.preferIPv6,
+				nil,
+				false,
+				nil,
+				testLogger,
 			)
 			require.NoError(t, err)
 
@@ -131,7 +140,12 @@ func TestResolveDialContext(t *testing.T) {
 			&url.URL{Host: netutil.JoinHostPort(hostname, port)},
 			testTimeout,
 			bootstrap.ParallelResolver{r},
+			bootstrap.NetworkIP,
+			false,
+			nil,
 			false,
+			nil,
+			testLogger,
 		)
 		require.NoError(t, err)
 
@@ -147,7 +161,12 @@ func TestResolveDialContext(t *testing.T) {
 			&url.URL{Host: "bad hostname"},
 			testTimeout,
 			nil,
+			bootstrap.NetworkIP,
+			false,
+			nil,
 			false,
+			nil,
+			testLogger,
 		)
 		testutil.AssertErrorMsg(t, errMsg, err)
 
@@ -159,7 +178,12 @@ func TestResolveDialContext(t *testing.T) {
 			&url.URL{Host: netutil.JoinHostPort(hostname, port)},
 			testTimeout,
 			nil,
+			bootstrap.NetworkIP,
 			false,
+			nil,
+			false,
+			nil,
+			testLogger,
 		)
 		assert.ErrorIs(t, err, bootstrap.ErrNoResolvers)
 		assert.Nil(t, dialContext)
@@ -2,13 +2,14 @@ package bootstrap
 
 import (
 	"context"
+	"log/slog"
 	"net"
 	"net/netip"
 	"slices"
 	"time"
 
 	"github.com/AdguardTeam/golibs/errors"
-	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
 )
 
 // Resolver resolves the hostnames to IP addresses.  Note, that [net.Resolver]
@@ -69,7 +70,7 @@ func (r ParallelResolver) LookupNetIP(
 // lookupAsync performs a lookup for ip of host with r and sends the result into
 // resCh.  It is intended to be used as a goroutine.
 func lookupAsync(ctx context.Context, r Resolver, network, host string, resCh chan<- any) {
-	defer log.OnPanic("parallel lookup")
+	defer slogutil.RecoverAndLog(ctx, slog.Default())
 
 	addrs, err := lookup(ctx, r, network, host)
 	if err != nil {
@@ -88,10 +89,11 @@ func lookup(ctx context.Context, r Resolver, network, host string) (addrs []neti
 	addrs, err = r.LookupNetIP(ctx, network, host)
 	elapsed := time.Since(start)
 
+	l := slog.Default().With(slogutil.KeyPrefix, "parallel lookup")
 	if err != nil {
-		log.Debug("parallel lookup: lookup for %s failed in %s: %s", host, elapsed, err)
+		l.DebugContext(ctx, "lookup failed", "host", host, "elapsed", elapsed, slogutil.KeyError, err)
 	} else {
-		log.Debug("parallel lookup: lookup for %s succeeded in %s: %s", host, elapsed, addrs)
+		l.DebugContext(ctx, "lookup succeeded", "host", host, "elapsed", elapsed, "addrs", addrs)
 	}
 
 	return addrs, err
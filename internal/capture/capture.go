@@ -0,0 +1,351 @@
+// Package capture contains the implementation of the proxy message tap writing
+// the matching DNS transactions to a pcap file or a hex dump for debugging.
+package capture
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/miekg/dns"
+)
+
+// Format is the format of the capture file.
+type Format string
+
+// Format values.
+const (
+	// FormatPcap is the pcap format readable by Wireshark and tcpdump.  The
+	// messages are written as plain DNS over UDP regardless of the actual
+	// transport, so that the analyzers are able to decode them.
+	FormatPcap Format = "pcap"
+
+	// FormatHex is the human-readable hex dump format.
+	FormatHex Format = "hex"
+)
+
+// maxActive is the maximum number of the client requests matching the client
+// filter tracked for matching the upstream exchanges.  The requests left
+// without a response are forgotten once it's exceeded.
+const maxActive = 4096
+
+// Config is the configuration of the [Capture].
+type Config struct {
+	// Logger is used to log the write errors.  If nil, [slog.Default] is used.
+	Logger *slog.Logger
+
+	// Path is the path to the capture file.  The file is overwritten.  It must
+	// not be empty.
+	Path string
+
+	// Format is the format of the capture file.  If empty, [FormatPcap] is
+	// used.
+	Format Format
+
+	// Domains are the suffixes of the question names of the transactions to
+	// capture.  If empty, all the names are matched.
+	Domains []string
+
+	// Clients are the networks of the clients of the transactions to capture.
+	// The upstream exchanges are matched if they're performed for the matching
+	// client requests.  If empty, all the clients are matched.
+	Clients []netip.Prefix
+}
+
+// Capture is the [proxy.MessageTap] implementation that writes the matching
+// client and upstream DNS transactions to a file.
+type Capture struct {
+	// logger is used to log the write errors.  It's never nil.
+	logger *slog.Logger
+
+	// mu protects the fields below.
+	mu *sync.Mutex
+
+	// file is the capture file.
+	file *os.File
+
+	// active is the set of the matching client requests being processed.
+	active map[reqKey]struct{}
+
+	domains []string
+	clients []netip.Prefix
+	format  Format
+}
+
+// reqKey identifies a request for matching the upstream exchanges with the
+// client requests.
+type reqKey struct {
+	name  string
+	id    uint16
+	qtype uint16
+}
+
+// New returns a new properly initialized *Capture writing to the file at
+// c.Path.  c must not be nil.
+func New(c *Config) (cpt *Capture, err error) {
+	if c.Path == "" {
+		return nil, errors.Error("empty path")
+	}
+
+	format := cmp.Or(c.Format, FormatPcap)
+	switch format {
+	case FormatPcap, FormatHex:
+		// Go on.
+	default:
+		return nil, fmt.Errorf("unsupported format %q", format)
+	}
+
+	domains := make([]string, 0, len(c.Domains))
+	for _, d := range c.Domains {
+		domains = append(domains, dns.Fqdn(strings.ToLower(d)))
+	}
+
+	// #nosec G302 -- Trust the file path that is given in the configuration.
+	file, err := os.OpenFile(c.Path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("opening file: %w", err)
+	}
+
+	if format == FormatPcap {
+		_, err = file.Write(pcapHeader())
+		if err != nil {
+			return nil, errors.WithDeferred(fmt.Errorf("writing header: %w", err), file.Close())
+		}
+	}
+
+	return &Capture{
+		logger:  cmp.Or(c.Logger, slog.Default()).With(slogutil.KeyPrefix, "capture"),
+		mu:      &sync.Mutex{},
+		file:    file,
+		active:  map[reqKey]struct{}{},
+		domains: domains,
+		clients: c.Clients,
+		format:  format,
+	}, nil
+}
+
+// type check
+var _ proxy.MessageTap = (*Capture)(nil)
+
+// OnClientQuery implements the [proxy.MessageTap] interface for *Capture.
+func (c *Capture) OnClientQuery(d *proxy.DNSContext, queryTime time.Time) {
+	if !c.matchName(d.Req) || !c.matchClient(d.Addr) {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.clients) > 0 {
+		if len(c.active) >= maxActive {
+			clear(c.active)
+		}
+
+		c.active[newReqKey(d.Req)] = struct{}{}
+	}
+
+	c.write(&record{
+		time:   queryTime,
+		kind:   "client query",
+		src:    d.Addr,
+		dst:    localAddr(d),
+		proto:  string(d.Proto),
+		msg:    d.Req,
+		remote: d.Addr.String(),
+	})
+}
+
+// OnClientResponse implements the [proxy.MessageTap] interface for *Capture.
+func (c *Capture) OnClientResponse(d *proxy.DNSContext, _, respTime time.Time) {
+	if !c.matchName(d.Req) || !c.matchClient(d.Addr) {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.active, newReqKey(d.Req))
+
+	c.write(&record{
+		time:   respTime,
+		kind:   "client response",
+		src:    localAddr(d),
+		dst:    d.Addr,
+		proto:  string(d.Proto),
+		msg:    d.Res,
+		remote: d.Addr.String(),
+	})
+}
+
+// OnUpstreamExchange implements the [proxy.MessageTap] interface for *Capture.
+func (c *Capture) OnUpstreamExchange(
+	u upstream.Upstream,
+	req *dns.Msg,
+	resp *dns.Msg,
+	queryTime time.Time,
+	respTime time.Time,
+) {
+	if !c.matchName(req) {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.clients) > 0 {
+		if _, ok := c.active[newReqKey(req)]; !ok {
+			return
+		}
+	}
+
+	upsAddr := u.Address()
+	ap := upstreamAddr(upsAddr)
+
+	c.write(&record{
+		time:   queryTime,
+		kind:   "upstream query",
+		dst:    ap,
+		proto:  "upstream",
+		msg:    req,
+		remote: upsAddr,
+	})
+
+	if resp == nil {
+		return
+	}
+
+	c.write(&record{
+		time:   respTime,
+		kind:   "upstream response",
+		src:    ap,
+		proto:  "upstream",
+		msg:    resp,
+		remote: upsAddr,
+	})
+}
+
+// Close closes the capture file.
+func (c *Capture) Close() (err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.file.Close()
+}
+
+// matchName returns true if the question name of m matches the domain filter.
+func (c *Capture) matchName(m *dns.Msg) (ok bool) {
+	if len(c.domains) == 0 {
+		return true
+	} else if m == nil || len(m.Question) == 0 {
+		return false
+	}
+
+	name := strings.ToLower(m.Question[0].Name)
+	for _, d := range c.domains {
+		if dns.IsSubDomain(d, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchClient returns true if addr matches the client filter.
+func (c *Capture) matchClient(addr netip.AddrPort) (ok bool) {
+	if len(c.clients) == 0 {
+		return true
+	}
+
+	ip := addr.Addr().Unmap()
+	for _, p := range c.clients {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// write writes r to the file in the configured format.  c.mu must be locked.
+func (c *Capture) write(r *record) {
+	b, err := r.msg.Pack()
+	if err != nil {
+		c.logger.Debug("packing message", slogutil.KeyError, err)
+
+		return
+	}
+
+	var w io.Writer = c.file
+	switch c.format {
+	case FormatHex:
+		_, err = io.WriteString(w, hexRecord(r, b))
+	default:
+		_, err = w.Write(pcapRecord(r, b))
+	}
+
+	if err != nil {
+		c.logger.Error("writing record", slogutil.KeyError, err)
+	}
+}
+
+// newReqKey returns the key of req.
+func newReqKey(req *dns.Msg) (k reqKey) {
+	k.id = req.Id
+	if len(req.Question) > 0 {
+		q := req.Question[0]
+		k.name, k.qtype = strings.ToLower(q.Name), q.Qtype
+	}
+
+	return k
+}
+
+// localAddr returns the local address the request has been received at, if
+// it's known.
+func localAddr(d *proxy.DNSContext) (addr netip.AddrPort) {
+	switch {
+	case d.Conn != nil:
+		return netutil.NetAddrToAddrPort(d.Conn.LocalAddr())
+	case d.QUICConnection != nil:
+		return netutil.NetAddrToAddrPort(d.QUICConnection.LocalAddr())
+	case d.HTTPRequest != nil:
+		la, _ := d.HTTPRequest.Context().Value(http.LocalAddrContextKey).(net.Addr)
+		if la != nil {
+			return netutil.NetAddrToAddrPort(la)
+		}
+	}
+
+	return netip.AddrPort{}
+}
+
+// upstreamAddr returns the address of the upstream with the given address.  The
+// returned address is invalid if the upstream is specified with a hostname.
+func upstreamAddr(addr string) (ap netip.AddrPort) {
+	if _, rest, ok := strings.Cut(addr, "://"); ok {
+		addr, _, _ = strings.Cut(rest, "/")
+	}
+
+	ap, err := netip.ParseAddrPort(addr)
+	if err == nil {
+		return ap
+	}
+
+	ip, err := netip.ParseAddr(strings.Trim(addr, "[]"))
+	if err != nil {
+		return netip.AddrPort{}
+	}
+
+	return netip.AddrPortFrom(ip, 0)
+}
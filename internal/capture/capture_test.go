@@ -0,0 +1,146 @@
+package capture_test
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/internal/capture"
+	"github.com/AdguardTeam/dnsproxy/internal/dnsproxytest"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Common addresses for tests.
+var (
+	testClientAddr = netip.MustParseAddrPort("192.0.2.1:12345")
+	testOtherAddr  = netip.MustParseAddrPort("198.51.100.1:12345")
+)
+
+// pcapGlobalHeaderLen is the length of the pcap file header.
+const pcapGlobalHeaderLen = 24
+
+// transact passes a single transaction for the name from the client at addr
+// through c.
+func transact(c *capture.Capture, name string, addr netip.AddrPort) {
+	req := (&dns.Msg{}).SetQuestion(name, dns.TypeA)
+	resp := (&dns.Msg{}).SetReply(req)
+	d := &proxy.DNSContext{
+		Proto: proxy.ProtoUDP,
+		Req:   req,
+		Res:   resp,
+		Addr:  addr,
+	}
+
+	ups := &dnsproxytest.FakeUpstream{
+		OnAddress: func() (addr string) { return "tls://1.1.1.1:853" },
+	}
+
+	now := time.Now()
+	c.OnClientQuery(d, now)
+	c.OnUpstreamExchange(ups, req, resp, now, now)
+	c.OnClientResponse(d, now, now)
+}
+
+// readPcap returns the packets of the pcap file at path.
+func readPcap(t *testing.T, path string) (pkts [][]byte) {
+	t.Helper()
+
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, len(b), pcapGlobalHeaderLen)
+
+	assert.Equal(t, uint32(0xa1b2c3d4), binary.LittleEndian.Uint32(b))
+	assert.Equal(t, uint32(101), binary.LittleEndian.Uint32(b[20:]))
+
+	for b = b[pcapGlobalHeaderLen:]; len(b) > 0; {
+		require.GreaterOrEqual(t, len(b), 16)
+
+		l := binary.LittleEndian.Uint32(b[8:])
+		require.GreaterOrEqual(t, uint32(len(b)-16), l)
+
+		pkts = append(pkts, b[16:16+l])
+		b = b[16+l:]
+	}
+
+	return pkts
+}
+
+func TestCapture_pcap(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.pcap")
+
+	c, err := capture.New(&capture.Config{
+		Path:    path,
+		Domains: []string{"Example.ORG"},
+		Clients: []netip.Prefix{netip.PrefixFrom(testClientAddr.Addr(), 32)},
+	})
+	require.NoError(t, err)
+
+	transact(c, "www.example.org.", testClientAddr)
+	transact(c, "www.example.org.", testOtherAddr)
+	transact(c, "example.net.", testClientAddr)
+
+	require.NoError(t, c.Close())
+
+	pkts := readPcap(t, path)
+	require.Len(t, pkts, 4)
+
+	// Client query.
+	pkt := pkts[0]
+	require.Greater(t, len(pkt), 28)
+
+	assert.Equal(t, byte(0x45), pkt[0])
+	assert.Equal(t, testClientAddr.Addr().AsSlice(), pkt[12:16])
+	assert.Equal(t, testClientAddr.Port(), binary.BigEndian.Uint16(pkt[20:]))
+	assert.Equal(t, uint16(53), binary.BigEndian.Uint16(pkt[22:]))
+
+	msg := &dns.Msg{}
+	require.NoError(t, msg.Unpack(pkt[28:]))
+	assert.Equal(t, "www.example.org.", msg.Question[0].Name)
+
+	// Upstream response.
+	pkt = pkts[2]
+	assert.Equal(t, []byte{1, 1, 1, 1}, pkt[12:16])
+	assert.Equal(t, uint16(53), binary.BigEndian.Uint16(pkt[20:]))
+
+	require.NoError(t, msg.Unpack(pkt[28:]))
+	assert.True(t, msg.Response)
+}
+
+func TestCapture_hex(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.txt")
+
+	c, err := capture.New(&capture.Config{
+		Path:   path,
+		Format: capture.FormatHex,
+	})
+	require.NoError(t, err)
+
+	transact(c, "example.org.", testClientAddr)
+	require.NoError(t, c.Close())
+
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	out := string(b)
+	assert.Contains(t, out, "client query udp 192.0.2.1:12345")
+	assert.Contains(t, out, "upstream response upstream tls://1.1.1.1:853")
+	assert.Contains(t, out, "example.org. A")
+	assert.Contains(t, out, "00000000  ")
+}
+
+func TestNew_invalid(t *testing.T) {
+	_, err := capture.New(&capture.Config{})
+	assert.Error(t, err)
+
+	_, err = capture.New(&capture.Config{
+		Path:   filepath.Join(t.TempDir(), "capture"),
+		Format: "bad",
+	})
+	assert.Error(t, err)
+}
@@ -0,0 +1,228 @@
+package capture
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// record is a single captured DNS message.
+type record struct {
+	// time is the time the message has been received or sent at.
+	time time.Time
+
+	// msg is the captured message.
+	msg *dns.Msg
+
+	// src and dst are the source and the destination addresses of the
+	// message.  Any of them may be invalid if it's unknown.
+	src netip.AddrPort
+	dst netip.AddrPort
+
+	// kind describes the direction of the message, like "client query".
+	kind string
+
+	// proto is the protocol of the client request or "upstream".
+	proto string
+
+	// remote is the address of the client or the upstream.
+	remote string
+}
+
+// Constants of the pcap format, see RFC 9631.
+const (
+	pcapMagic        = 0xa1b2c3d4
+	pcapVersionMajor = 2
+	pcapVersionMinor = 4
+	pcapSnapLen      = 0xffff
+
+	// pcapLinkTypeRaw is the link type of the raw IPv4 and IPv6 packets.
+	pcapLinkTypeRaw = 101
+)
+
+// Sizes and other constants of the synthesized packets headers.
+const (
+	ipv4HeaderLen = 20
+	ipv6HeaderLen = 40
+	udpHeaderLen  = 8
+
+	protoUDP   = 17
+	defaultTTL = 64
+
+	// dnsPort is the port of the server side of the synthesized packets, so
+	// that the analyzers decode the payload as DNS.
+	dnsPort = 53
+
+	// maxPayloadLen is the maximum length of the payload fitting the
+	// synthesized IPv6 packet.
+	maxPayloadLen = pcapSnapLen - ipv6HeaderLen - udpHeaderLen
+)
+
+// pcapHeader returns the global header of the pcap file.
+func pcapHeader() (b []byte) {
+	b = make([]byte, 0, 24)
+	b = binary.LittleEndian.AppendUint32(b, pcapMagic)
+	b = binary.LittleEndian.AppendUint16(b, pcapVersionMajor)
+	b = binary.LittleEndian.AppendUint16(b, pcapVersionMinor)
+
+	// Time zone offset and timestamps accuracy, both are always zero.
+	b = binary.LittleEndian.AppendUint32(b, 0)
+	b = binary.LittleEndian.AppendUint32(b, 0)
+
+	b = binary.LittleEndian.AppendUint32(b, pcapSnapLen)
+
+	return binary.LittleEndian.AppendUint32(b, pcapLinkTypeRaw)
+}
+
+// pcapRecord returns the pcap record of r with the packed message payload.
+func pcapRecord(r *record, payload []byte) (b []byte) {
+	if len(payload) > maxPayloadLen {
+		payload = payload[:maxPayloadLen]
+	}
+
+	src, dst := packetAddrs(r)
+	pkt := udpPacket(src, dst, payload)
+
+	ts := r.time.UTC()
+	b = make([]byte, 0, 16+len(pkt))
+	b = binary.LittleEndian.AppendUint32(b, uint32(ts.Unix()))
+	b = binary.LittleEndian.AppendUint32(b, uint32(ts.Nanosecond()/int(time.Microsecond)))
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(pkt)))
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(pkt)))
+
+	return append(b, pkt...)
+}
+
+// packetAddrs returns the addresses of the synthesized packet of r.  The unknown
+// addresses are replaced with the unspecified ones, and both addresses are
+// converted to IPv6 if their families differ.  The server side port is always
+// [dnsPort].
+func packetAddrs(r *record) (src, dst netip.AddrPort) {
+	srcIP, dstIP := r.src.Addr().Unmap(), r.dst.Addr().Unmap()
+	switch {
+	case !srcIP.IsValid() && !dstIP.IsValid():
+		srcIP, dstIP = netip.IPv4Unspecified(), netip.IPv4Unspecified()
+	case !srcIP.IsValid():
+		srcIP = unspecifiedLike(dstIP)
+	case !dstIP.IsValid():
+		dstIP = unspecifiedLike(srcIP)
+	case srcIP.Is4() != dstIP.Is4():
+		srcIP, dstIP = netip.AddrFrom16(srcIP.As16()), netip.AddrFrom16(dstIP.As16())
+	}
+
+	srcPort, dstPort := r.src.Port(), r.dst.Port()
+	if strings.HasSuffix(r.kind, "query") {
+		dstPort = dnsPort
+	} else {
+		srcPort = dnsPort
+	}
+
+	return netip.AddrPortFrom(srcIP, srcPort), netip.AddrPortFrom(dstIP, dstPort)
+}
+
+// unspecifiedLike returns the unspecified address of the same family as ip.
+func unspecifiedLike(ip netip.Addr) (unspec netip.Addr) {
+	if ip.Is4() {
+		return netip.IPv4Unspecified()
+	}
+
+	return netip.IPv6Unspecified()
+}
+
+// udpPacket returns the raw IP packet with the UDP datagram carrying payload
+// from src to dst.  src and dst must be of the same family.
+func udpPacket(src, dst netip.AddrPort, payload []byte) (pkt []byte) {
+	udpLen := udpHeaderLen + len(payload)
+
+	udp := make([]byte, 0, udpLen)
+	udp = binary.BigEndian.AppendUint16(udp, src.Port())
+	udp = binary.BigEndian.AppendUint16(udp, dst.Port())
+	udp = binary.BigEndian.AppendUint16(udp, uint16(udpLen))
+	udp = binary.BigEndian.AppendUint16(udp, 0)
+	udp = append(udp, payload...)
+
+	srcIP, dstIP := src.Addr().AsSlice(), dst.Addr().AsSlice()
+
+	// Pseudo-header of the UDP checksum, see RFC 768 and RFC 8200.
+	sum := checksumAdd(0, srcIP)
+	sum = checksumAdd(sum, dstIP)
+	sum += protoUDP + uint32(udpLen)
+	csum := checksumFold(checksumAdd(sum, udp))
+	if csum == 0 {
+		csum = 0xffff
+	}
+
+	binary.BigEndian.PutUint16(udp[6:], csum)
+
+	if src.Addr().Is4() {
+		pkt = make([]byte, ipv4HeaderLen, ipv4HeaderLen+udpLen)
+		pkt[0] = 0x45
+		binary.BigEndian.PutUint16(pkt[2:], uint16(ipv4HeaderLen+udpLen))
+
+		// Don't fragment.
+		pkt[6] = 0x40
+		pkt[8] = defaultTTL
+		pkt[9] = protoUDP
+		copy(pkt[12:], srcIP)
+		copy(pkt[16:], dstIP)
+		binary.BigEndian.PutUint16(pkt[10:], checksumFold(checksumAdd(0, pkt)))
+	} else {
+		pkt = make([]byte, ipv6HeaderLen, ipv6HeaderLen+udpLen)
+		pkt[0] = 0x60
+		binary.BigEndian.PutUint16(pkt[4:], uint16(udpLen))
+		pkt[6] = protoUDP
+		pkt[7] = defaultTTL
+		copy(pkt[8:], srcIP)
+		copy(pkt[24:], dstIP)
+	}
+
+	return append(pkt, udp...)
+}
+
+// checksumAdd adds b to the one's complement sum.
+func checksumAdd(sum uint32, b []byte) (res uint32) {
+	for len(b) >= 2 {
+		sum += uint32(binary.BigEndian.Uint16(b))
+		b = b[2:]
+	}
+
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+
+	return sum
+}
+
+// checksumFold returns the Internet checksum of the one's complement sum.
+func checksumFold(sum uint32) (csum uint16) {
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+
+	return ^uint16(sum)
+}
+
+// hexRecord returns the hex dump of r with the packed message payload.
+func hexRecord(r *record, payload []byte) (s string) {
+	q := "<no question>"
+	if len(r.msg.Question) > 0 {
+		rq := r.msg.Question[0]
+		q = rq.Name + " " + dns.Type(rq.Qtype).String()
+	}
+
+	return fmt.Sprintf(
+		"%s %s %s %s id=%d %s\n%s\n",
+		r.time.UTC().Format(time.RFC3339Nano),
+		r.kind,
+		r.proto,
+		r.remote,
+		r.msg.Id,
+		q,
+		hex.Dump(payload),
+	)
+}
@@ -0,0 +1,324 @@
+// Package dashboard contains the implementation of the small web dashboard
+// showing the live status of the proxy.
+package dashboard
+
+import (
+	_ "embed"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+)
+
+// indexHTML is the page of the dashboard.  It polls [PathStatus] and renders
+// the received [Status].
+//
+//go:embed index.html
+var indexHTML []byte
+
+// PathStatus is the path of the endpoint serving the [Status] as JSON.
+const PathStatus = "/api/status"
+
+// Constants of the collected data.
+const (
+	// qpsWindow is the number of the latest full seconds the queries per
+	// second are averaged over.
+	qpsWindow = 10
+
+	// recentQueriesLen is the maximum number of the recent queries kept.
+	recentQueriesLen = 50
+)
+
+// Dashboard is the [proxy.MetricsListener] and [proxy.QueryLogger] collecting
+// the live status of the proxy and serving it over HTTP.
+type Dashboard struct {
+	// EmptyMetricsListener is embedded here to avoid implementing the methods
+	// which the status isn't derived from.
+	proxy.EmptyMetricsListener
+
+	// now returns the current time.  It's replaced in tests.
+	now func() (now time.Time)
+
+	// started is the time the dashboard has been created at.
+	started time.Time
+
+	// mu protects the fields below.
+	mu *sync.Mutex
+
+	// upstreams maps the upstream addresses to their statuses.
+	upstreams map[string]*UpstreamStatus
+
+	// recent are the most recent queries, the newest last.
+	recent []*Query
+
+	// secCounts are the numbers of the requests processed within the latest
+	// seconds, indexed by the Unix time modulo its length.
+	secCounts [qpsWindow + 1]uint64
+
+	// secStarts are the Unix times of the seconds of the secCounts.
+	secStarts [qpsWindow + 1]int64
+
+	// total is the total number of the processed requests.
+	total uint64
+
+	// cacheHits and cacheMisses are the numbers of the cache lookups.
+	cacheHits   uint64
+	cacheMisses uint64
+}
+
+// type check
+var (
+	_ proxy.MetricsListener = (*Dashboard)(nil)
+	_ proxy.QueryLogger     = (*Dashboard)(nil)
+)
+
+// New returns a new properly initialized *Dashboard.
+func New() (d *Dashboard) {
+	return &Dashboard{
+		now:       time.Now,
+		started:   time.Now(),
+		mu:        &sync.Mutex{},
+		upstreams: map[string]*UpstreamStatus{},
+	}
+}
+
+// OnRequest implements the [proxy.MetricsListener] interface for *Dashboard.
+func (d *Dashboard) OnRequest(_ proxy.Proto, _ *dns.Msg, _ time.Duration) {
+	sec := d.now().Unix()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.total++
+
+	i := sec % int64(len(d.secCounts))
+	if d.secStarts[i] != sec {
+		d.secStarts[i], d.secCounts[i] = sec, 0
+	}
+
+	d.secCounts[i]++
+}
+
+// OnCacheLookup implements the [proxy.MetricsListener] interface for
+// *Dashboard.
+func (d *Dashboard) OnCacheLookup(hit bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if hit {
+		d.cacheHits++
+	} else {
+		d.cacheMisses++
+	}
+}
+
+// OnUpstreamExchange implements the [proxy.MetricsListener] interface for
+// *Dashboard.
+func (d *Dashboard) OnUpstreamExchange(addr string, rtt time.Duration, err error) {
+	now := d.now()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	u := d.upstreams[addr]
+	if u == nil {
+		u = &UpstreamStatus{Address: addr}
+		d.upstreams[addr] = u
+	}
+
+	u.LastExchange = now
+	u.LastRTTMs = float64(rtt) / float64(time.Millisecond)
+	if err != nil {
+		u.Failures++
+		u.Healthy = false
+		u.LastError = err.Error()
+	} else {
+		u.Successes++
+		u.Healthy = true
+		u.LastError = ""
+	}
+}
+
+// LogQuery implements the [proxy.QueryLogger] interface for *Dashboard.
+func (d *Dashboard) LogQuery(e *proxy.QueryLogEntry) {
+	q := &Query{
+		Time:      e.Time,
+		Proto:     string(e.Proto),
+		QName:     e.QName,
+		QType:     dns.Type(e.QType).String(),
+		Rcode:     dns.RcodeToString[e.Rcode],
+		Upstream:  e.Upstream,
+		ElapsedMs: float64(e.Elapsed) / float64(time.Millisecond),
+		Cached:    e.CacheHit,
+	}
+
+	if e.Client.IsValid() {
+		q.Client = e.Client.Addr().String()
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if len(d.recent) == recentQueriesLen {
+		d.recent = slices.Delete(d.recent, 0, 1)
+	}
+
+	d.recent = append(d.recent, q)
+}
+
+// Status is the live status of the proxy.
+type Status struct {
+	// Upstreams are the statuses of the upstreams sorted by address.
+	Upstreams []*UpstreamStatus `json:"upstreams"`
+
+	// RecentQueries are the most recent queries, the newest first.
+	RecentQueries []*Query `json:"recent_queries"`
+
+	// Cache is the statistics of the cache lookups.
+	Cache CacheStatus `json:"cache"`
+
+	// UptimeSec is the number of seconds since the dashboard has been
+	// started.
+	UptimeSec float64 `json:"uptime_sec"`
+
+	// QPS is the number of the queries per second averaged over the latest
+	// seconds.
+	QPS float64 `json:"qps"`
+
+	// Total is the total number of the processed requests.
+	Total uint64 `json:"total"`
+}
+
+// UpstreamStatus is the status of a single upstream.
+type UpstreamStatus struct {
+	// LastExchange is the time of the latest exchange with the upstream.
+	LastExchange time.Time `json:"last_exchange"`
+
+	// Address is the address of the upstream.
+	Address string `json:"address"`
+
+	// LastError is the error of the latest exchange, if any.
+	LastError string `json:"last_error,omitempty"`
+
+	// LastRTTMs is the round-trip time of the latest exchange in
+	// milliseconds.
+	LastRTTMs float64 `json:"last_rtt_ms"`
+
+	// Successes and Failures are the numbers of the exchanges.
+	Successes uint64 `json:"successes"`
+	Failures  uint64 `json:"failures"`
+
+	// Healthy is true if the latest exchange has succeeded.
+	Healthy bool `json:"healthy"`
+}
+
+// CacheStatus is the statistics of the cache lookups.
+type CacheStatus struct {
+	// Hits is the number of the responses found in the cache.
+	Hits uint64 `json:"hits"`
+
+	// Misses is the number of the responses not found in the cache.
+	Misses uint64 `json:"misses"`
+}
+
+// Query is a single recently processed query.
+type Query struct {
+	// Time is the time the request has been received at.
+	Time time.Time `json:"time"`
+
+	// Client is the address of the client.
+	Client string `json:"client"`
+
+	// Proto is the protocol of the request.
+	Proto string `json:"proto"`
+
+	// QName and QType are the question of the request.
+	QName string `json:"qname"`
+	QType string `json:"qtype"`
+
+	// Rcode is the response code of the response.
+	Rcode string `json:"rcode"`
+
+	// Upstream is the address of the upstream resolved the request.
+	Upstream string `json:"upstream,omitempty"`
+
+	// ElapsedMs is the time spent on processing the request in milliseconds.
+	ElapsedMs float64 `json:"elapsed_ms"`
+
+	// Cached is true if the response has been served from the cache.
+	Cached bool `json:"cached"`
+}
+
+// Status returns the current status of the proxy.
+func (d *Dashboard) Status() (s *Status) {
+	now := d.now()
+	sec := now.Unix()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// Only count the full seconds, skipping the current one.
+	var recent uint64
+	for i, start := range d.secStarts {
+		if start < sec && start >= sec-qpsWindow {
+			recent += d.secCounts[i]
+		}
+	}
+
+	s = &Status{
+		Upstreams:     make([]*UpstreamStatus, 0, len(d.upstreams)),
+		RecentQueries: make([]*Query, 0, len(d.recent)),
+		Cache: CacheStatus{
+			Hits:   d.cacheHits,
+			Misses: d.cacheMisses,
+		},
+		UptimeSec: now.Sub(d.started).Seconds(),
+		QPS:       float64(recent) / qpsWindow,
+		Total:     d.total,
+	}
+
+	for _, u := range d.upstreams {
+		uCopy := *u
+		s.Upstreams = append(s.Upstreams, &uCopy)
+	}
+
+	slices.SortFunc(s.Upstreams, func(a, b *UpstreamStatus) (res int) {
+		return strings.Compare(a.Address, b.Address)
+	})
+
+	for i := len(d.recent) - 1; i >= 0; i-- {
+		s.RecentQueries = append(s.RecentQueries, d.recent[i])
+	}
+
+	return s
+}
+
+// Register registers the handlers of the dashboard page at "/" and of the
+// status at [PathStatus] in mux, wrapped with auth, which should authenticate
+// the requests, since the status contains the addresses of the clients.  auth
+// must not be nil.
+func (d *Dashboard) Register(mux *http.ServeMux, auth func(h http.Handler) (wrapped http.Handler)) {
+	mux.Handle("GET /{$}", auth(http.HandlerFunc(d.serveIndex)))
+	mux.Handle("GET "+PathStatus, auth(http.HandlerFunc(d.serveStatus)))
+}
+
+// serveIndex serves the dashboard page.
+func (d *Dashboard) serveIndex(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+	// Ignore the error, since it's only possible if the client has gone.
+	_, _ = w.Write(indexHTML)
+}
+
+// serveStatus serves the current [Status] as JSON.
+func (d *Dashboard) serveStatus(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Ignore the error, since it's only possible if the client has gone.
+	_ = json.NewEncoder(w).Encode(d.Status())
+}
@@ -0,0 +1,115 @@
+package dashboard
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDashboard(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+
+	d := New()
+	d.now = func() (n time.Time) { return now }
+
+	// 20 requests within the first second and 10 within the next one.
+	for i := range 30 {
+		if i == 20 {
+			now = now.Add(time.Second)
+		}
+
+		d.OnRequest(proxy.ProtoUDP, nil, 0)
+	}
+
+	d.OnCacheLookup(true)
+	d.OnCacheLookup(false)
+	d.OnCacheLookup(false)
+
+	d.OnUpstreamExchange("tls://b.example", time.Millisecond, nil)
+	d.OnUpstreamExchange("tls://a.example", time.Millisecond, nil)
+	d.OnUpstreamExchange("tls://a.example", 2*time.Millisecond, assert.AnError)
+
+	for i := range recentQueriesLen + 1 {
+		d.LogQuery(&proxy.QueryLogEntry{
+			Client: netip.MustParseAddrPort("192.0.2.1:53"),
+			Proto:  proxy.ProtoUDP,
+			QName:  "example.org.",
+			QType:  dns.TypeA,
+			Rcode:  dns.RcodeSuccess,
+			Time:   now.Add(time.Duration(i) * time.Millisecond),
+		})
+	}
+
+	// Move to the next second, so that both previous seconds are full.
+	now = now.Add(time.Second)
+	s := d.Status()
+
+	assert.Equal(t, uint64(30), s.Total)
+	assert.InDelta(t, 3.0, s.QPS, 0.001)
+	assert.Equal(t, CacheStatus{Hits: 1, Misses: 2}, s.Cache)
+
+	require.Len(t, s.Upstreams, 2)
+
+	a := s.Upstreams[0]
+	assert.Equal(t, "tls://a.example", a.Address)
+	assert.False(t, a.Healthy)
+	assert.Equal(t, uint64(1), a.Successes)
+	assert.Equal(t, uint64(1), a.Failures)
+	assert.Equal(t, assert.AnError.Error(), a.LastError)
+	assert.True(t, s.Upstreams[1].Healthy)
+
+	require.Len(t, s.RecentQueries, recentQueriesLen)
+
+	q := s.RecentQueries[0]
+	assert.Equal(t, now.Add(-time.Second+recentQueriesLen*time.Millisecond), q.Time)
+	assert.Equal(t, "192.0.2.1", q.Client)
+	assert.Equal(t, "A", q.QType)
+	assert.Equal(t, "NOERROR", q.Rcode)
+
+	// The requests older than the window aren't counted.
+	now = now.Add(time.Minute)
+	assert.Zero(t, d.Status().QPS)
+}
+
+func TestDashboard_Register(t *testing.T) {
+	d := New()
+	d.OnRequest(proxy.ProtoUDP, nil, 0)
+
+	const authHeader = "X-Authenticated"
+
+	mux := http.NewServeMux()
+	d.Register(mux, func(h http.Handler) (wrapped http.Handler) {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(authHeader, "true")
+			h.ServeHTTP(w, r)
+		})
+	})
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	assert.Contains(t, w.Body.String(), "dnsproxy status")
+	assert.Equal(t, "true", w.Header().Get(authHeader))
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, PathStatus, nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "true", w.Header().Get(authHeader))
+
+	s := &Status{}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(s))
+	assert.Equal(t, uint64(1), s.Total)
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/unknown", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
@@ -0,0 +1,490 @@
+// Package dnstap contains the implementation of the proxy message tap writing
+// the messages in dnstap format.  See https://dnstap.info.
+package dnstap
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/miekg/dns"
+)
+
+// Supported networks of the collector.
+const (
+	NetworkTCP  = "tcp"
+	NetworkUnix = "unix"
+)
+
+// defaultBufferSize is the default number of messages buffered while the
+// collector is slow or unavailable.
+const defaultBufferSize = 1024
+
+// Timeouts of the collector connection.
+const (
+	ioTimeout         = 5 * time.Second
+	reconnectInterval = 1 * time.Second
+)
+
+// Config is the configuration of the dnstap [Tap].
+type Config struct {
+	// Network is the network of the collector, either [NetworkTCP] or
+	// [NetworkUnix].
+	Network string
+
+	// Address is the address of the collector, an address with port for
+	// [NetworkTCP] or the socket path for [NetworkUnix].
+	Address string
+
+	// Identity is the optional name of the server included into the messages.
+	Identity string
+
+	// Version is the optional version of the server included into the
+	// messages.
+	Version string
+
+	// BufferSize is the number of messages buffered while the collector is slow
+	// or unavailable.  The messages exceeding it are dropped.  If zero, the
+	// default value of 1024 is used.
+	BufferSize int
+
+	// TraceIDOptionCode is the code of the EDNS option carrying the trace ID of
+	// the requests to the upstreams, see [proxy.TraceIDConfig].  If not zero,
+	// the trace ID is included into the extra field of the upstream messages.
+	// The trace IDs of the client messages are always included, if any.
+	TraceIDOptionCode uint16
+
+	// Logger is used to log the connection state and the errors.  If nil,
+	// [slog.Default] is used.
+	Logger *slog.Logger
+}
+
+// Tap is the [proxy.MessageTap] implementation that writes the messages to
+// the dnstap collector using the Frame Streams protocol.  The connection is
+// reestablished if it fails.
+type Tap struct {
+	// frames is the buffer of the encoded frames to write.
+	frames chan []byte
+
+	// stop is closed to stop the writing goroutine.
+	stop chan struct{}
+
+	// done is closed when the writing goroutine exits.
+	done chan struct{}
+
+	// sent is the number of frames written to the collector.
+	sent atomic.Uint64
+
+	// dropped is the number of frames dropped due to the buffer overflow or
+	// write errors.
+	dropped atomic.Uint64
+
+	// logger is used to log the connection state and the errors.  It's never
+	// nil.
+	logger *slog.Logger
+
+	network  string
+	addr     string
+	identity []byte
+	version  []byte
+
+	traceIDCode uint16
+}
+
+// New returns a new properly initialized *Tap and starts writing the messages.
+// c must not be nil.
+func New(c *Config) (t *Tap, err error) {
+	switch c.Network {
+	case NetworkTCP, NetworkUnix:
+		// Go on.
+	default:
+		return nil, fmt.Errorf("unsupported network %q", c.Network)
+	}
+
+	if c.Address == "" {
+		return nil, errors.Error("empty address")
+	}
+
+	t = &Tap{
+		frames:   make(chan []byte, cmp.Or(c.BufferSize, defaultBufferSize)),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+		logger:   cmp.Or(c.Logger, slog.Default()).With(slogutil.KeyPrefix, "dnstap"),
+		network:  c.Network,
+		addr:     c.Address,
+		identity: []byte(c.Identity),
+		version:  []byte(c.Version),
+
+		traceIDCode: c.TraceIDOptionCode,
+	}
+
+	go t.run()
+
+	return t, nil
+}
+
+// type check
+var _ proxy.MessageTap = (*Tap)(nil)
+
+// OnClientQuery implements the [proxy.MessageTap] interface for *Tap.
+func (t *Tap) OnClientQuery(d *proxy.DNSContext, queryTime time.Time) {
+	t.enqueue(&message{
+		typ:       typeClientQuery,
+		proto:     clientProto(d.Proto),
+		queryAddr: d.Addr,
+		respAddr:  localAddr(d),
+		queryTime: queryTime,
+		queryMsg:  t.pack(d.Req),
+		extra:     []byte(d.TraceID),
+	})
+}
+
+// OnClientResponse implements the [proxy.MessageTap] interface for *Tap.
+func (t *Tap) OnClientResponse(d *proxy.DNSContext, queryTime, respTime time.Time) {
+	t.enqueue(&message{
+		typ:       typeClientResponse,
+		proto:     clientProto(d.Proto),
+		queryAddr: d.Addr,
+		respAddr:  localAddr(d),
+		queryTime: queryTime,
+		queryMsg:  t.pack(d.Req),
+		respTime:  respTime,
+		respMsg:   t.pack(d.Res),
+		extra:     []byte(d.TraceID),
+	})
+}
+
+// OnUpstreamExchange implements the [proxy.MessageTap] interface for *Tap.
+func (t *Tap) OnUpstreamExchange(
+	u upstream.Upstream,
+	req *dns.Msg,
+	resp *dns.Msg,
+	queryTime time.Time,
+	respTime time.Time,
+) {
+	upsAddr, proto := upstreamAddr(u.Address())
+	queryMsg := t.pack(req)
+
+	var extra []byte
+	if t.traceIDCode != 0 {
+		extra = []byte(proxy.TraceIDFromMsg(req, t.traceIDCode))
+	}
+
+	t.enqueue(&message{
+		typ:       typeResolverQuery,
+		proto:     proto,
+		respAddr:  upsAddr,
+		queryTime: queryTime,
+		queryMsg:  queryMsg,
+		extra:     extra,
+	})
+
+	if resp == nil {
+		return
+	}
+
+	t.enqueue(&message{
+		typ:       typeResolverResponse,
+		proto:     proto,
+		respAddr:  upsAddr,
+		queryTime: queryTime,
+		queryMsg:  queryMsg,
+		respTime:  respTime,
+		respMsg:   t.pack(resp),
+		extra:     extra,
+	})
+}
+
+// Sent returns the number of messages written to the collector.
+func (t *Tap) Sent() (n uint64) {
+	return t.sent.Load()
+}
+
+// Dropped returns the number of messages dropped due to the buffer overflow or
+// write errors.
+func (t *Tap) Dropped() (n uint64) {
+	return t.dropped.Load()
+}
+
+// Close stops writing the messages and flushes the buffered ones to the
+// collector, if it's connected.  It must only be called once.
+func (t *Tap) Close() (err error) {
+	close(t.stop)
+	<-t.done
+
+	t.logger.Info("closed", "sent", t.Sent(), "dropped", t.Dropped())
+
+	return nil
+}
+
+// enqueue encodes m and puts it into the buffer or drops it if the buffer is
+// full.
+func (t *Tap) enqueue(m *message) {
+	select {
+	case t.frames <- m.appendFrame(nil, t.identity, t.version):
+	default:
+		t.dropped.Add(1)
+	}
+}
+
+// run connects to the collector and writes the buffered frames until t is
+// closed.  It's intended to be used as a goroutine.
+func (t *Tap) run() {
+	defer slogutil.RecoverAndLog(context.TODO(), t.logger)
+	defer close(t.done)
+
+	for {
+		conn, err := t.connect()
+		if err != nil {
+			t.logger.Debug("connecting", "addr", t.addr, slogutil.KeyError, err)
+
+			select {
+			case <-t.stop:
+				return
+			case <-time.After(reconnectInterval):
+				continue
+			}
+		}
+
+		stopped := t.serve(conn)
+		if stopped {
+			return
+		}
+	}
+}
+
+// connect dials the collector and performs the bidirectional Frame Streams
+// handshake.
+func (t *Tap) connect() (conn net.Conn, err error) {
+	conn, err = net.DialTimeout(t.network, t.addr, ioTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("dialing: %w", err)
+	}
+
+	defer func() {
+		if err != nil {
+			err = errors.WithDeferred(err, conn.Close())
+		}
+	}()
+
+	err = conn.SetDeadline(time.Now().Add(ioTimeout))
+	if err != nil {
+		return nil, fmt.Errorf("setting deadline: %w", err)
+	}
+
+	err = writeControl(conn, controlReady)
+	if err != nil {
+		return nil, fmt.Errorf("writing ready: %w", err)
+	}
+
+	err = readControl(conn, controlAccept)
+	if err != nil {
+		return nil, fmt.Errorf("reading accept: %w", err)
+	}
+
+	err = writeControl(conn, controlStart)
+	if err != nil {
+		return nil, fmt.Errorf("writing start: %w", err)
+	}
+
+	return conn, conn.SetDeadline(time.Time{})
+}
+
+// serve writes the buffered frames to conn until t is closed or writing fails.
+// stopped is true if t has been closed.  conn is closed on return.
+func (t *Tap) serve(conn net.Conn) (stopped bool) {
+	defer func() {
+		err := conn.Close()
+		if err != nil {
+			t.logger.Debug("closing connection", slogutil.KeyError, err)
+		}
+	}()
+
+	t.logger.Info("connected", "addr", t.addr)
+
+	w := bufio.NewWriter(conn)
+	for {
+		select {
+		case <-t.stop:
+			t.finish(conn, w)
+
+			return true
+		case b := <-t.frames:
+			err := t.write(conn, w, b)
+			if err != nil {
+				t.logger.Error("writing", "addr", t.addr, slogutil.KeyError, err)
+
+				return false
+			}
+		}
+	}
+}
+
+// write writes the data frame b to w and flushes it, if there are no more
+// buffered frames.  The frame is counted as dropped if writing fails.
+func (t *Tap) write(conn net.Conn, w *bufio.Writer, b []byte) (err error) {
+	_ = conn.SetWriteDeadline(time.Now().Add(ioTimeout))
+
+	err = writeData(w, b)
+	if err == nil && len(t.frames) == 0 {
+		err = w.Flush()
+	}
+
+	if err != nil {
+		t.dropped.Add(1)
+
+		return err
+	}
+
+	t.sent.Add(1)
+
+	return nil
+}
+
+// finish writes the rest of the buffered frames to w and gracefully closes the
+// Frame Streams session.
+func (t *Tap) finish(conn net.Conn, w *bufio.Writer) {
+	for {
+		select {
+		case b := <-t.frames:
+			err := t.write(conn, w, b)
+			if err != nil {
+				t.logger.Debug("writing on close", slogutil.KeyError, err)
+
+				return
+			}
+		default:
+			_ = conn.SetDeadline(time.Now().Add(ioTimeout))
+
+			err := writeControl(w, controlStop)
+			if err == nil {
+				err = w.Flush()
+			}
+
+			if err == nil {
+				err = readControl(conn, controlFinish)
+			}
+
+			if err != nil {
+				t.logger.Debug("stopping session", slogutil.KeyError, err)
+			}
+
+			return
+		}
+	}
+}
+
+// pack returns the wire-format msg or nil if it can't be packed.
+func (t *Tap) pack(msg *dns.Msg) (b []byte) {
+	b, err := msg.Pack()
+	if err != nil {
+		t.logger.Debug("packing message", slogutil.KeyError, err)
+
+		return nil
+	}
+
+	return b
+}
+
+// clientProto returns the socket protocol of the client request.
+func clientProto(p proxy.Proto) (proto socketProtocol) {
+	switch p {
+	case proxy.ProtoUDP:
+		return protoUDP
+	case proxy.ProtoTCP:
+		return protoTCP
+	case proxy.ProtoTLS:
+		return protoDOT
+	case proxy.ProtoHTTPS:
+		return protoDOH
+	case proxy.ProtoQUIC:
+		return protoDOQ
+	case proxy.ProtoDNSCrypt:
+		return protoDNSCryptUDP
+	default:
+		return 0
+	}
+}
+
+// localAddr returns the local address the request has been received at, if
+// it's known.
+func localAddr(d *proxy.DNSContext) (addr netip.AddrPort) {
+	switch {
+	case d.Conn != nil:
+		return netutil.NetAddrToAddrPort(d.Conn.LocalAddr())
+	case d.QUICConnection != nil:
+		return netutil.NetAddrToAddrPort(d.QUICConnection.LocalAddr())
+	case d.HTTPRequest != nil:
+		la, _ := d.HTTPRequest.Context().Value(http.LocalAddrContextKey).(net.Addr)
+		if la != nil {
+			return netutil.NetAddrToAddrPort(la)
+		}
+	}
+
+	return netip.AddrPort{}
+}
+
+// upstreamAddr returns the address and the socket protocol of the upstream
+// with the given address.  The returned address is invalid if the upstream is
+// specified with a hostname.
+func upstreamAddr(addr string) (ap netip.AddrPort, proto socketProtocol) {
+	host, scheme := addr, "udp"
+	if strings.Contains(addr, "://") {
+		u, err := url.Parse(addr)
+		if err != nil {
+			return netip.AddrPort{}, 0
+		}
+
+		host, scheme = u.Host, u.Scheme
+	}
+
+	var defPort uint16
+	switch scheme {
+	case "udp":
+		proto, defPort = protoUDP, 53
+	case "tcp":
+		proto, defPort = protoTCP, 53
+	case "tls":
+		proto, defPort = protoDOT, 853
+	case "https", "h3":
+		proto, defPort = protoDOH, 443
+	case "quic":
+		proto, defPort = protoDOQ, 853
+	case "sdns":
+		return netip.AddrPort{}, protoDNSCryptUDP
+	default:
+		return netip.AddrPort{}, 0
+	}
+
+	hostname, portStr, err := net.SplitHostPort(host)
+	if err != nil {
+		hostname, portStr = strings.Trim(host, "[]"), ""
+	}
+
+	ip, err := netip.ParseAddr(hostname)
+	if err != nil {
+		return netip.AddrPort{}, proto
+	}
+
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		port = uint64(defPort)
+	}
+
+	return netip.AddrPortFrom(ip, uint16(port)), proto
+}
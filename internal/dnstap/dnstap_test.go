@@ -0,0 +1,309 @@
+package dnstap_test
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/internal/dnsproxytest"
+	"github.com/AdguardTeam/dnsproxy/internal/dnstap"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// testTimeout is the common timeout for tests.
+const testTimeout = 1 * time.Second
+
+// Frame Streams control frame types.
+const (
+	controlAccept = 0x01
+	controlStart  = 0x02
+	controlStop   = 0x03
+	controlReady  = 0x04
+	controlFinish = 0x05
+)
+
+// readFrame reads a single Frame Streams frame from r.  typ is the type of the
+// control frame, or zero for data frames.
+func readFrame(t testing.TB, r io.Reader) (typ uint32, data []byte) {
+	t.Helper()
+
+	var l uint32
+	require.NoError(t, binary.Read(r, binary.BigEndian, &l))
+
+	isControl := l == 0
+	if isControl {
+		require.NoError(t, binary.Read(r, binary.BigEndian, &l))
+	}
+
+	data = make([]byte, l)
+	_, err := io.ReadFull(r, data)
+	require.NoError(t, err)
+
+	if isControl {
+		return binary.BigEndian.Uint32(data), nil
+	}
+
+	return 0, data
+}
+
+// writeControl writes the Frame Streams control frame of type typ without
+// fields to w.
+func writeControl(t testing.TB, w io.Writer, typ uint32) {
+	t.Helper()
+
+	require.NoError(t, binary.Write(w, binary.BigEndian, []uint32{0, 4, typ}))
+}
+
+// serveCollector accepts a single connection on l, performs the Frame Streams
+// handshake, and sends the received data frames to frames until the session
+// is stopped.
+func serveCollector(t testing.TB, l net.Listener, frames chan<- []byte) {
+	t.Helper()
+
+	defer close(frames)
+
+	conn, err := l.Accept()
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+
+	typ, _ := readFrame(t, conn)
+	require.Equal(t, uint32(controlReady), typ)
+
+	writeControl(t, conn, controlAccept)
+
+	typ, _ = readFrame(t, conn)
+	require.Equal(t, uint32(controlStart), typ)
+
+	for {
+		var data []byte
+		typ, data = readFrame(t, conn)
+		if typ == controlStop {
+			writeControl(t, conn, controlFinish)
+
+			return
+		}
+
+		frames <- data
+	}
+}
+
+// testMessage is the decoded dnstap Message.
+type testMessage struct {
+	respAddr []byte
+	queryMsg []byte
+	respMsg  []byte
+	identity string
+	extra    string
+	typ      uint64
+	proto    uint64
+}
+
+// decodeFrame decodes the dnstap frame data.
+func decodeFrame(t testing.TB, data []byte) (m *testMessage) {
+	t.Helper()
+
+	m = &testMessage{}
+
+	var msg []byte
+	consumeFields(t, data, func(num protowire.Number, v []byte, _ uint64) {
+		switch num {
+		case 1:
+			m.identity = string(v)
+		case 3:
+			m.extra = string(v)
+		case 14:
+			msg = v
+		}
+	})
+
+	consumeFields(t, msg, func(num protowire.Number, v []byte, n uint64) {
+		switch num {
+		case 1:
+			m.typ = n
+		case 3:
+			m.proto = n
+		case 5:
+			m.respAddr = v
+		case 10:
+			m.queryMsg = v
+		case 14:
+			m.respMsg = v
+		}
+	})
+
+	return m
+}
+
+// consumeFields calls f for each field of the protobuf message b with either
+// its bytes or its numeric value.
+func consumeFields(t testing.TB, b []byte, f func(num protowire.Number, v []byte, n uint64)) {
+	t.Helper()
+
+	for len(b) > 0 {
+		num, typ, l := protowire.ConsumeTag(b)
+		require.Positive(t, l)
+		b = b[l:]
+
+		switch typ {
+		case protowire.BytesType:
+			var v []byte
+			v, l = protowire.ConsumeBytes(b)
+			f(num, v, 0)
+		case protowire.VarintType:
+			var n uint64
+			n, l = protowire.ConsumeVarint(b)
+			f(num, nil, n)
+		case protowire.Fixed32Type:
+			_, l = protowire.ConsumeFixed32(b)
+		default:
+			t.Fatalf("unexpected wire type %d", typ)
+		}
+
+		require.Positive(t, l)
+		b = b[l:]
+	}
+}
+
+func TestTap(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, l.Close)
+
+	frames := make(chan []byte, 10)
+	go serveCollector(t, l, frames)
+
+	tap, err := dnstap.New(&dnstap.Config{
+		Network:  dnstap.NetworkTCP,
+		Address:  l.Addr().String(),
+		Identity: "test",
+	})
+	require.NoError(t, err)
+
+	req := (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA)
+	resp := (&dns.Msg{}).SetRcode(req, dns.RcodeNameError)
+	d := &proxy.DNSContext{
+		Proto:   proxy.ProtoUDP,
+		Req:     req,
+		Res:     resp,
+		Addr:    netip.MustParseAddrPort("192.0.2.1:12345"),
+		TraceID: "0123456789abcdef",
+	}
+
+	ups := &dnsproxytest.FakeUpstream{
+		OnAddress: func() (addr string) { return "tls://1.1.1.1" },
+	}
+
+	now := time.Now()
+	tap.OnClientQuery(d, now)
+	tap.OnUpstreamExchange(ups, req, resp, now, now)
+	tap.OnClientResponse(d, now, now)
+
+	want := []struct {
+		respAddr []byte
+		extra    string
+		typ      uint64
+		proto    uint64
+		hasResp  bool
+	}{{
+		extra: d.TraceID,
+		typ:   5,
+		proto: 1,
+	}, {
+		respAddr: []byte{1, 1, 1, 1},
+		typ:      3,
+		proto:    3,
+	}, {
+		respAddr: []byte{1, 1, 1, 1},
+		typ:      4,
+		proto:    3,
+		hasResp:  true,
+	}, {
+		extra:   d.TraceID,
+		typ:     6,
+		proto:   1,
+		hasResp: true,
+	}}
+
+	wantReq, err := req.Pack()
+	require.NoError(t, err)
+
+	wantResp, err := resp.Pack()
+	require.NoError(t, err)
+
+	for _, w := range want {
+		data, ok := testutil.RequireReceive(t, frames, testTimeout)
+		require.True(t, ok)
+
+		m := decodeFrame(t, data)
+		assert.Equal(t, "test", m.identity)
+		assert.Equal(t, w.extra, m.extra)
+		assert.Equal(t, w.typ, m.typ)
+		assert.Equal(t, w.proto, m.proto)
+		assert.Equal(t, wantReq, m.queryMsg)
+
+		if w.respAddr != nil {
+			assert.Equal(t, w.respAddr, m.respAddr)
+		}
+
+		if w.hasResp {
+			assert.Equal(t, wantResp, m.respMsg)
+		} else {
+			assert.Empty(t, m.respMsg)
+		}
+	}
+
+	require.NoError(t, tap.Close())
+
+	// Make sure the session is finished gracefully.
+	_, ok := testutil.RequireReceive(t, frames, testTimeout)
+	assert.False(t, ok)
+
+	assert.Equal(t, uint64(4), tap.Sent())
+	assert.Zero(t, tap.Dropped())
+}
+
+func TestTap_dropped(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	// Close the listener to make the collector unavailable.
+	addr := l.Addr().String()
+	require.NoError(t, l.Close())
+
+	tap, err := dnstap.New(&dnstap.Config{
+		Network:    dnstap.NetworkTCP,
+		Address:    addr,
+		BufferSize: 1,
+	})
+	require.NoError(t, err)
+
+	d := &proxy.DNSContext{
+		Proto: proxy.ProtoTCP,
+		Req:   (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA),
+	}
+
+	for range 3 {
+		tap.OnClientQuery(d, time.Now())
+	}
+
+	require.NoError(t, tap.Close())
+
+	assert.Equal(t, uint64(2), tap.Dropped())
+	assert.Zero(t, tap.Sent())
+}
+
+func TestNew_invalid(t *testing.T) {
+	_, err := dnstap.New(&dnstap.Config{Network: "udp", Address: "127.0.0.1:6000"})
+	assert.Error(t, err)
+
+	_, err = dnstap.New(&dnstap.Config{Network: dnstap.NetworkUnix})
+	assert.Error(t, err)
+}
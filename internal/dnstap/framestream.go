@@ -0,0 +1,105 @@
+package dnstap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// contentType is the Frame Streams content type of dnstap data frames.
+const contentType = "protobuf:dnstap.Dnstap"
+
+// controlType is the type of a Frame Streams control frame.
+type controlType uint32
+
+// Control frame types.
+const (
+	controlAccept controlType = 0x01
+	controlStart  controlType = 0x02
+	controlStop   controlType = 0x03
+	controlReady  controlType = 0x04
+	controlFinish controlType = 0x05
+)
+
+// fieldContentType is the type of the content type control frame field.
+const fieldContentType = 0x01
+
+// maxControlLen is the maximum accepted length of a control frame.
+const maxControlLen = 512
+
+// errUnexpectedControl is returned when the control frame of unexpected type is
+// received.
+const errUnexpectedControl errors.Error = "unexpected control frame"
+
+// writeControl writes the control frame of type typ to w.  The content type
+// field is added for the frames which require it.
+func writeControl(w io.Writer, typ controlType) (err error) {
+	var fields []byte
+	switch typ {
+	case controlReady, controlAccept, controlStart:
+		fields = binary.BigEndian.AppendUint32(fields, fieldContentType)
+		fields = binary.BigEndian.AppendUint32(fields, uint32(len(contentType)))
+		fields = append(fields, contentType...)
+	default:
+		// Go on.
+	}
+
+	// The escape sequence, the length of the control frame, and the type.
+	b := make([]byte, 0, 12+len(fields))
+	b = binary.BigEndian.AppendUint32(b, 0)
+	b = binary.BigEndian.AppendUint32(b, uint32(4+len(fields)))
+	b = binary.BigEndian.AppendUint32(b, uint32(typ))
+	b = append(b, fields...)
+
+	_, err = w.Write(b)
+
+	return err
+}
+
+// readControl reads the control frame from r and checks that its type is
+// want.  The fields of the frame are ignored.
+func readControl(r io.Reader, want controlType) (err error) {
+	var hdr [12]byte
+	_, err = io.ReadFull(r, hdr[:])
+	if err != nil {
+		return fmt.Errorf("reading control frame: %w", err)
+	}
+
+	if esc := binary.BigEndian.Uint32(hdr[:4]); esc != 0 {
+		return fmt.Errorf("reading control frame: got data frame of length %d", esc)
+	}
+
+	l := binary.BigEndian.Uint32(hdr[4:8])
+	if l < 4 || l > maxControlLen {
+		return fmt.Errorf("reading control frame: bad length %d", l)
+	}
+
+	typ := controlType(binary.BigEndian.Uint32(hdr[8:]))
+	if typ != want {
+		return fmt.Errorf("%w: got %d, want %d", errUnexpectedControl, typ, want)
+	}
+
+	_, err = io.CopyN(io.Discard, r, int64(l-4))
+	if err != nil {
+		return fmt.Errorf("reading control frame fields: %w", err)
+	}
+
+	return nil
+}
+
+// writeData writes the data frame with the given payload to w.
+func writeData(w io.Writer, payload []byte) (err error) {
+	var hdr [4]byte
+	binary.BigEndian.PutUint32(hdr[:], uint32(len(payload)))
+
+	_, err = w.Write(hdr[:])
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(payload)
+
+	return err
+}
@@ -0,0 +1,218 @@
+package dnstap
+
+import (
+	"net/netip"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// messageType is the type of the dnstap message.  See the Message.Type enum in
+// dnstap.proto.
+type messageType uint64
+
+// Message types used by dnsproxy.
+const (
+	typeResolverQuery    messageType = 3
+	typeResolverResponse messageType = 4
+	typeClientQuery      messageType = 5
+	typeClientResponse   messageType = 6
+)
+
+// socketFamily is the network protocol family of a socket.  See the
+// SocketFamily enum in dnstap.proto.
+type socketFamily uint64
+
+// Socket families.
+const (
+	familyINET  socketFamily = 1
+	familyINET6 socketFamily = 2
+)
+
+// socketProtocol is the transport protocol of a socket.  See the
+// SocketProtocol enum in dnstap.proto.
+type socketProtocol uint64
+
+// Socket protocols.
+const (
+	protoUDP         socketProtocol = 1
+	protoTCP         socketProtocol = 2
+	protoDOT         socketProtocol = 3
+	protoDOH         socketProtocol = 4
+	protoDNSCryptUDP socketProtocol = 5
+	protoDOQ         socketProtocol = 7
+)
+
+// Field numbers of the Dnstap message.
+const (
+	fieldDnstapIdentity protowire.Number = 1
+	fieldDnstapVersion  protowire.Number = 2
+	fieldDnstapExtra    protowire.Number = 3
+	fieldDnstapMessage  protowire.Number = 14
+	fieldDnstapType     protowire.Number = 15
+)
+
+// dnstapTypeMessage is the only defined value of the Dnstap.Type enum.
+const dnstapTypeMessage = 1
+
+// Field numbers of the Message message.
+const (
+	fieldMessageType      protowire.Number = 1
+	fieldSocketFamily     protowire.Number = 2
+	fieldSocketProtocol   protowire.Number = 3
+	fieldQueryAddress     protowire.Number = 4
+	fieldResponseAddress  protowire.Number = 5
+	fieldQueryPort        protowire.Number = 6
+	fieldResponsePort     protowire.Number = 7
+	fieldQueryTimeSec     protowire.Number = 8
+	fieldQueryTimeNsec    protowire.Number = 9
+	fieldQueryMessage     protowire.Number = 10
+	fieldResponseTimeSec  protowire.Number = 12
+	fieldResponseTimeNsec protowire.Number = 13
+	fieldResponseMessage  protowire.Number = 14
+)
+
+// message is a single dnstap Message.  Zero-valued fields are omitted.
+type message struct {
+	// queryTime is the time the query has been sent by the initiator.
+	queryTime time.Time
+
+	// respTime is the time the response has been sent by the responder.
+	respTime time.Time
+
+	// queryAddr is the address of the initiator of the transaction.
+	queryAddr netip.AddrPort
+
+	// respAddr is the address of the responder of the transaction.
+	respAddr netip.AddrPort
+
+	// queryMsg is the wire-format query message.
+	queryMsg []byte
+
+	// respMsg is the wire-format response message.
+	respMsg []byte
+
+	// extra is the data put into the extra field of the Dnstap message, which
+	// is the trace ID of the request, if any.
+	extra []byte
+
+	// typ is the type of the message.
+	typ messageType
+
+	// proto is the transport protocol of the transaction.
+	proto socketProtocol
+}
+
+// appendFrame appends the Dnstap message carrying m to b and returns the
+// result.
+func (m *message) appendFrame(b, identity, version []byte) (res []byte) {
+	if len(identity) > 0 {
+		b = protowire.AppendTag(b, fieldDnstapIdentity, protowire.BytesType)
+		b = protowire.AppendBytes(b, identity)
+	}
+
+	if len(version) > 0 {
+		b = protowire.AppendTag(b, fieldDnstapVersion, protowire.BytesType)
+		b = protowire.AppendBytes(b, version)
+	}
+
+	if len(m.extra) > 0 {
+		b = protowire.AppendTag(b, fieldDnstapExtra, protowire.BytesType)
+		b = protowire.AppendBytes(b, m.extra)
+	}
+
+	b = protowire.AppendTag(b, fieldDnstapMessage, protowire.BytesType)
+	b = protowire.AppendBytes(b, m.appendTo(nil))
+
+	b = protowire.AppendTag(b, fieldDnstapType, protowire.VarintType)
+
+	return protowire.AppendVarint(b, dnstapTypeMessage)
+}
+
+// appendTo appends the encoded m to b and returns the result.
+func (m *message) appendTo(b []byte) (res []byte) {
+	b = appendVarintField(b, fieldMessageType, uint64(m.typ))
+
+	if fam := m.family(); fam != 0 {
+		b = appendVarintField(b, fieldSocketFamily, uint64(fam))
+	}
+
+	if m.proto != 0 {
+		b = appendVarintField(b, fieldSocketProtocol, uint64(m.proto))
+	}
+
+	b = appendAddrPort(b, fieldQueryAddress, fieldQueryPort, m.queryAddr)
+	b = appendAddrPort(b, fieldResponseAddress, fieldResponsePort, m.respAddr)
+	b = appendTime(b, fieldQueryTimeSec, fieldQueryTimeNsec, m.queryTime)
+
+	if len(m.queryMsg) > 0 {
+		b = protowire.AppendTag(b, fieldQueryMessage, protowire.BytesType)
+		b = protowire.AppendBytes(b, m.queryMsg)
+	}
+
+	b = appendTime(b, fieldResponseTimeSec, fieldResponseTimeNsec, m.respTime)
+
+	if len(m.respMsg) > 0 {
+		b = protowire.AppendTag(b, fieldResponseMessage, protowire.BytesType)
+		b = protowire.AppendBytes(b, m.respMsg)
+	}
+
+	return b
+}
+
+// family returns the socket family of the transaction addresses or zero if
+// none of them is known.
+func (m *message) family() (fam socketFamily) {
+	addr := m.queryAddr.Addr()
+	if !addr.IsValid() {
+		addr = m.respAddr.Addr()
+	}
+
+	switch {
+	case !addr.IsValid():
+		return 0
+	case addr.Unmap().Is4():
+		return familyINET
+	default:
+		return familyINET6
+	}
+}
+
+// appendVarintField appends the varint field with the given number to b and
+// returns the result.
+func appendVarintField(b []byte, num protowire.Number, v uint64) (res []byte) {
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+
+	return protowire.AppendVarint(b, v)
+}
+
+// appendAddrPort appends the address and port fields of ap to b, if ap is
+// valid, and returns the result.
+func appendAddrPort(b []byte, addrNum, portNum protowire.Number, ap netip.AddrPort) (res []byte) {
+	addr := ap.Addr()
+	if !addr.IsValid() {
+		return b
+	}
+
+	b = protowire.AppendTag(b, addrNum, protowire.BytesType)
+	b = protowire.AppendBytes(b, addr.Unmap().AsSlice())
+
+	if port := ap.Port(); port != 0 {
+		b = appendVarintField(b, portNum, uint64(port))
+	}
+
+	return b
+}
+
+// appendTime appends the seconds and nanoseconds fields of t to b, if t isn't
+// zero, and returns the result.
+func appendTime(b []byte, secNum, nsecNum protowire.Number, t time.Time) (res []byte) {
+	if t.IsZero() {
+		return b
+	}
+
+	b = appendVarintField(b, secNum, uint64(t.Unix()))
+	b = protowire.AppendTag(b, nsecNum, protowire.Fixed32Type)
+
+	return protowire.AppendFixed32(b, uint32(t.Nanosecond()))
+}
@@ -0,0 +1,189 @@
+// Package geoip implements looking up the countries and the autonomous systems
+// of the client addresses in the MaxMind DB files, such as the GeoLite2
+// Country, City, and ASN ones.
+package geoip
+
+import (
+	"cmp"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"os"
+	"sync"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+)
+
+// maxCachedRecords is the maximum number of the decoded records cached for a
+// single database.  The cache is cleared once it's exceeded.
+const maxCachedRecords = 65_536
+
+// Config is the configuration of the [Locator].
+type Config struct {
+	// Logger is used to log the lookup failures.  If nil, [slog.Default] is
+	// used.
+	Logger *slog.Logger
+
+	// Paths are the paths to the database files.  The country is taken from
+	// the first database which has it, and so is the ASN.  It must not be
+	// empty.
+	Paths []string
+}
+
+// Locator is the [proxy.GeoLocator] looking up the addresses in the MaxMind DB
+// files.  The files are read into memory on creation.
+type Locator struct {
+	// logger is used to log the lookup failures.
+	logger *slog.Logger
+
+	// dbs are the databases to look the addresses up in.
+	dbs []*database
+}
+
+// database is a single database with the cache of the decoded records.
+type database struct {
+	// db is the database.
+	db *mmdb
+
+	// mu protects records.
+	mu *sync.Mutex
+
+	// records are the data decoded from the records of db by their offsets.
+	records map[uint]*proxy.GeoInfo
+
+	// path is the path to the database file.
+	path string
+}
+
+// New returns a new *Locator with the databases from c.
+func New(c *Config) (l *Locator, err error) {
+	if len(c.Paths) == 0 {
+		return nil, errors.Error("no databases")
+	}
+
+	l = &Locator{
+		logger: cmp.Or(c.Logger, slog.Default()),
+	}
+
+	for _, path := range c.Paths {
+		var db *mmdb
+		db, err = readDB(path)
+		if err != nil {
+			return nil, fmt.Errorf("database %q: %w", path, err)
+		}
+
+		l.logger.Info("loaded database", "path", path, "type", db.dbType, "nodes", db.nodeCount)
+
+		l.dbs = append(l.dbs, &database{
+			db:      db,
+			mu:      &sync.Mutex{},
+			records: map[uint]*proxy.GeoInfo{},
+			path:    path,
+		})
+	}
+
+	return l, nil
+}
+
+// readDB reads and parses the database file at path.
+func readDB(path string) (db *mmdb, err error) {
+	// #nosec G304 -- Trust the file path that is given in the configuration.
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading: %w", err)
+	}
+
+	return newMMDB(b)
+}
+
+// type check
+var _ proxy.GeoLocator = (*Locator)(nil)
+
+// Locate implements the [proxy.GeoLocator] interface for *Locator.  The
+// returned info must not be modified.
+func (l *Locator) Locate(addr netip.Addr) (info *proxy.GeoInfo) {
+	for _, d := range l.dbs {
+		found, err := d.locate(addr)
+		if err != nil {
+			l.logger.Debug("looking up", "path", d.path, "addr", addr, slogutil.KeyError, err)
+
+			continue
+		} else if found == nil {
+			continue
+		}
+
+		if info == nil {
+			info = found
+
+			continue
+		}
+
+		// Merge the data from several databases, without modifying the cached
+		// ones.
+		info = &proxy.GeoInfo{
+			Country: cmp.Or(info.Country, found.Country),
+			ASN:     cmp.Or(info.ASN, found.ASN),
+		}
+	}
+
+	return info
+}
+
+// locate returns the data about addr from d.  info is nil if there is none.
+func (d *database) locate(addr netip.Addr) (info *proxy.GeoInfo, err error) {
+	off, ok, err := d.db.lookup(addr)
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	info, ok = d.records[off]
+	d.mu.Unlock()
+	if ok {
+		return info, nil
+	}
+
+	v, err := d.db.decode(off)
+	if err != nil {
+		return nil, fmt.Errorf("decoding record: %w", err)
+	}
+
+	info = newGeoInfo(v)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if len(d.records) >= maxCachedRecords {
+		clear(d.records)
+	}
+
+	d.records[off] = info
+
+	return info, nil
+}
+
+// newGeoInfo returns the data from the decoded record v.  info is nil if v has
+// neither the country nor the ASN.
+func newGeoInfo(v any) (info *proxy.GeoInfo) {
+	m, _ := v.(map[string]any)
+	info = &proxy.GeoInfo{
+		Country: cmp.Or(isoCode(m, "country"), isoCode(m, "registered_country")),
+		ASN:     uint32(mmdbUint(m["autonomous_system_number"])),
+	}
+
+	if info.Country == "" && info.ASN == 0 {
+		return nil
+	}
+
+	return info
+}
+
+// isoCode returns the ISO code of the country under key in m, if any.
+func isoCode(m map[string]any, key string) (code string) {
+	country, _ := m[key].(map[string]any)
+	code, _ = country["iso_code"].(string)
+
+	return code
+}
@@ -0,0 +1,244 @@
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testLogger is a common logger used in tests of this package.
+var testLogger = slogutil.NewDiscardLogger()
+
+// testNetwork is a network of the test database with its encoded record.
+type testNetwork struct {
+	prefix netip.Prefix
+	record []byte
+}
+
+// encodeControl encodes the control byte of the value of type typ, which must
+// not be an extended one, and size, which must be less than 285.
+func encodeControl(typ byte, size uint) (b []byte) {
+	var ext []byte
+	if size >= 29 {
+		ext, size = []byte{byte(size - 29)}, 29
+	}
+
+	return append([]byte{typ<<5 | byte(size)}, ext...)
+}
+
+// encodeString encodes s as the string value.
+func encodeString(s string) (b []byte) {
+	return append(encodeControl(mmdbTypeString, uint(len(s))), s...)
+}
+
+// encodeUint32 encodes v as the uint32 value.
+func encodeUint32(v uint32) (b []byte) {
+	b = binary.BigEndian.AppendUint32(nil, v)
+	b = bytes.TrimLeft(b, "\x00")
+
+	return append(encodeControl(mmdbTypeUint32, uint(len(b))), b...)
+}
+
+// encodePointer encodes the pointer to off, which must be less than 2048.
+func encodePointer(off uint) (b []byte) {
+	return []byte{mmdbTypePointer<<5 | byte(off>>8), byte(off)}
+}
+
+// encodeMap encodes the map with pairs of the keys and the encoded values.
+func encodeMap(pairs ...any) (b []byte) {
+	b = encodeControl(mmdbTypeMap, uint(len(pairs)/2))
+	for i := 0; i < len(pairs); i += 2 {
+		b = append(b, encodeString(pairs[i].(string))...)
+		b = append(b, pairs[i+1].([]byte)...)
+	}
+
+	return b
+}
+
+// newTestDB returns the IPv6 database with 24-bit records containing nets.
+// The IPv4 networks are put into the ::/96 subtree.
+func newTestDB(tb testing.TB, nets []testNetwork) (b []byte) {
+	tb.Helper()
+
+	const emptyRec = -1
+
+	var data []byte
+	var leaves []uint
+
+	// nodes are the records of the nodes.  The negative values below -1 are
+	// the leaves, the non-negative ones are the nodes.
+	nodes := [][2]int{{emptyRec, emptyRec}}
+	for i, n := range nets {
+		leaves = append(leaves, uint(len(data)))
+		data = append(data, n.record...)
+
+		addr, bits := n.prefix.Addr(), n.prefix.Bits()
+		if addr.Is4() {
+			addr, bits = netip.AddrFrom16(addr.As16()), bits+96
+			// Clear the ::ffff: part of the mapped address.
+			a := addr.As16()
+			a[10], a[11] = 0, 0
+			addr = netip.AddrFrom16(a)
+		}
+
+		ip := addr.As16()
+		node := 0
+		for j := range bits {
+			bit := ip[j/8] >> (7 - j%8) & 1
+			if j == bits-1 {
+				nodes[node][bit] = -2 - i
+
+				break
+			}
+
+			if nodes[node][bit] == emptyRec {
+				nodes = append(nodes, [2]int{emptyRec, emptyRec})
+				nodes[node][bit] = len(nodes) - 1
+			}
+
+			node = nodes[node][bit]
+		}
+	}
+
+	count := uint(len(nodes))
+	for _, n := range nodes {
+		for _, rec := range n {
+			var v uint
+			switch {
+			case rec == emptyRec:
+				v = count
+			case rec < emptyRec:
+				v = count + mmdbDataSeparatorLen + leaves[-2-rec]
+			default:
+				v = uint(rec)
+			}
+
+			b = append(b, byte(v>>16), byte(v>>8), byte(v))
+		}
+	}
+
+	b = append(b, make([]byte, mmdbDataSeparatorLen)...)
+	b = append(b, data...)
+	b = append(b, mmdbMetadataMarker...)
+	b = append(b, encodeMap(
+		"database_type", encodeString("Test"),
+		"ip_version", encodeUint32(6),
+		"node_count", encodeUint32(uint32(count)),
+		"record_size", encodeUint32(24),
+	)...)
+
+	return b
+}
+
+// writeTestDB writes the database with nets into a temporary file and returns
+// its path.
+func writeTestDB(tb testing.TB, nets []testNetwork) (path string) {
+	tb.Helper()
+
+	path = filepath.Join(tb.TempDir(), "test.mmdb")
+	err := os.WriteFile(path, newTestDB(tb, nets), 0o600)
+	require.NoError(tb, err)
+
+	return path
+}
+
+func TestLocator_Locate(t *testing.T) {
+	deRecord := encodeMap("country", encodeMap("iso_code", encodeString("DE")))
+
+	countryPath := writeTestDB(t, []testNetwork{{
+		prefix: netip.MustParsePrefix("192.0.2.0/24"),
+		record: deRecord,
+	}, {
+		prefix: netip.MustParsePrefix("198.51.100.0/24"),
+		record: encodeMap("registered_country", encodeMap("iso_code", encodeString("FR"))),
+	}, {
+		prefix: netip.MustParsePrefix("2001:db8::/32"),
+		// Point to the country map of the first record, following its control
+		// byte and the encoded key.
+		record: encodeMap("country", encodePointer(uint(1+len(encodeString("country"))))),
+	}})
+
+	asnPath := writeTestDB(t, []testNetwork{{
+		prefix: netip.MustParsePrefix("192.0.2.0/24"),
+		record: encodeMap(
+			"autonomous_system_number", encodeUint32(64496),
+			"autonomous_system_organization", encodeString("Example"),
+		),
+	}})
+
+	l, err := New(&Config{
+		Logger: testLogger,
+		Paths:  []string{countryPath, asnPath},
+	})
+	require.NoError(t, err)
+
+	testCases := []struct {
+		want *proxy.GeoInfo
+		name string
+		addr netip.Addr
+	}{{
+		want: &proxy.GeoInfo{Country: "DE", ASN: 64496},
+		name: "both",
+		addr: netip.MustParseAddr("192.0.2.1"),
+	}, {
+		want: &proxy.GeoInfo{Country: "FR"},
+		name: "registered_country",
+		addr: netip.MustParseAddr("198.51.100.1"),
+	}, {
+		want: &proxy.GeoInfo{Country: "DE"},
+		name: "ipv6_pointer",
+		addr: netip.MustParseAddr("2001:db8::1"),
+	}, {
+		want: nil,
+		name: "unknown",
+		addr: netip.MustParseAddr("203.0.113.1"),
+	}, {
+		want: nil,
+		name: "unknown_ipv6",
+		addr: netip.MustParseAddr("2001:db9::1"),
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Look up twice to use the cached record.
+			assert.Equal(t, tc.want, l.Locate(tc.addr))
+			assert.Equal(t, tc.want, l.Locate(tc.addr))
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	badPath := filepath.Join(t.TempDir(), "bad.mmdb")
+	err := os.WriteFile(badPath, []byte("not a database"), 0o600)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name       string
+		wantErrMsg string
+		paths      []string
+	}{{
+		name:       "no_paths",
+		wantErrMsg: "no databases",
+		paths:      nil,
+	}, {
+		name:       "bad_database",
+		wantErrMsg: `database "` + badPath + `": malformed database: no metadata`,
+		paths:      []string{badPath},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, newErr := New(&Config{Logger: testLogger, Paths: tc.paths})
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, newErr)
+		})
+	}
+}
@@ -0,0 +1,442 @@
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net/netip"
+
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// mmdbMetadataMarker precedes the metadata section of a MaxMind DB file.
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// mmdbDataSeparatorLen is the length of the zero bytes between the search tree
+// and the data section.
+const mmdbDataSeparatorLen = 16
+
+// mmdbMaxDepth is the maximum depth of the nested maps and arrays decoded.
+const mmdbMaxDepth = 32
+
+// The types of the fields of the data section.  See the MaxMind DB file format
+// specification.
+const (
+	mmdbTypeExtended  = 0
+	mmdbTypePointer   = 1
+	mmdbTypeString    = 2
+	mmdbTypeDouble    = 3
+	mmdbTypeBytes     = 4
+	mmdbTypeUint16    = 5
+	mmdbTypeUint32    = 6
+	mmdbTypeMap       = 7
+	mmdbTypeInt32     = 8
+	mmdbTypeUint64    = 9
+	mmdbTypeUint128   = 10
+	mmdbTypeArray     = 11
+	mmdbTypeContainer = 12
+	mmdbTypeEnd       = 13
+	mmdbTypeBool      = 14
+	mmdbTypeFloat     = 15
+)
+
+// errMMDBBad is returned when the database is malformed.
+const errMMDBBad errors.Error = "malformed database"
+
+// mmdb is a read-only MaxMind DB, see
+// https://maxmind.github.io/MaxMind-DB/.
+type mmdb struct {
+	// tree is the binary search tree section.
+	tree []byte
+
+	// data is the data section.
+	data []byte
+
+	// dbType is the type of the database from its metadata, for example
+	// "GeoLite2-Country".
+	dbType string
+
+	// nodeCount is the number of the nodes in the search tree.
+	nodeCount uint
+
+	// recordSize is the size of a single record of a node in bits.
+	recordSize uint
+
+	// ipv4Start is the node the IPv4 addresses are looked up from.
+	ipv4Start uint
+
+	// ipVersion is the version of the addresses in the search tree, either 4
+	// or 6.
+	ipVersion uint
+}
+
+// newMMDB parses the MaxMind DB from b.  b must not be modified afterwards.
+func newMMDB(b []byte) (db *mmdb, err error) {
+	i := bytes.LastIndex(b, mmdbMetadataMarker)
+	if i < 0 {
+		return nil, fmt.Errorf("%w: no metadata", errMMDBBad)
+	}
+
+	metaDec := &mmdbDecoder{buf: b[i+len(mmdbMetadataMarker):]}
+	metaVal, _, err := metaDec.decode(0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("decoding metadata: %w", err)
+	}
+
+	meta, ok := metaVal.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%w: metadata is %T", errMMDBBad, metaVal)
+	}
+
+	db = &mmdb{}
+	db.dbType, _ = meta["database_type"].(string)
+	db.nodeCount = uint(mmdbUint(meta["node_count"]))
+	db.recordSize = uint(mmdbUint(meta["record_size"]))
+	db.ipVersion = uint(mmdbUint(meta["ip_version"]))
+
+	switch db.recordSize {
+	case 24, 28, 32:
+		// Go on.
+	default:
+		return nil, fmt.Errorf("%w: record size %d", errMMDBBad, db.recordSize)
+	}
+
+	treeSize := db.nodeCount * db.recordSize / 4
+	if treeSize+mmdbDataSeparatorLen > uint(i) {
+		return nil, fmt.Errorf("%w: search tree size %d", errMMDBBad, treeSize)
+	}
+
+	db.tree = b[:treeSize]
+	db.data = b[treeSize+mmdbDataSeparatorLen : i]
+
+	switch db.ipVersion {
+	case 4:
+		db.ipv4Start = 0
+	case 6:
+		db.ipv4Start, err = db.findIPv4Start()
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("%w: ip version %d", errMMDBBad, db.ipVersion)
+	}
+
+	return db, nil
+}
+
+// findIPv4Start returns the node the IPv4 addresses mapped into the IPv6 ones
+// as ::a.b.c.d are looked up from.
+func (db *mmdb) findIPv4Start() (node uint, err error) {
+	for range 96 {
+		if node >= db.nodeCount {
+			break
+		}
+
+		node, err = db.record(node, 0)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return node, nil
+}
+
+// lookup returns the data offset of the record for addr.  ok is false if
+// there is no such record.
+func (db *mmdb) lookup(addr netip.Addr) (off uint, ok bool, err error) {
+	addr = addr.Unmap()
+
+	var ip []byte
+	node := uint(0)
+	if addr.Is4() {
+		ip4 := addr.As4()
+		ip, node = ip4[:], db.ipv4Start
+	} else if db.ipVersion == 6 {
+		ip16 := addr.As16()
+		ip = ip16[:]
+	} else {
+		return 0, false, nil
+	}
+
+	for i := 0; i < len(ip)*8 && node < db.nodeCount; i++ {
+		bit := uint(ip[i/8]>>(7-i%8)) & 1
+		node, err = db.record(node, bit)
+		if err != nil {
+			return 0, false, err
+		}
+	}
+
+	if node <= db.nodeCount {
+		// The node equal to the node count means that there is no data.
+		return 0, false, nil
+	}
+
+	off = node - db.nodeCount - mmdbDataSeparatorLen
+	if off >= uint(len(db.data)) {
+		return 0, false, fmt.Errorf("%w: data offset %d", errMMDBBad, off)
+	}
+
+	return off, true, nil
+}
+
+// record returns the left record of the node if bit is 0, and the right one
+// otherwise.
+func (db *mmdb) record(node, bit uint) (rec uint, err error) {
+	size := db.recordSize / 4
+	start := node * size
+	if start+size > uint(len(db.tree)) {
+		return 0, fmt.Errorf("%w: node %d", errMMDBBad, node)
+	}
+
+	b := db.tree[start : start+size]
+	switch db.recordSize {
+	case 24:
+		b = b[bit*3:]
+
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2]), nil
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2]), nil
+		}
+
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6]), nil
+	default:
+		return uint(binary.BigEndian.Uint32(b[bit*4:])), nil
+	}
+}
+
+// decode decodes the value at off of the data section.
+func (db *mmdb) decode(off uint) (v any, err error) {
+	dec := &mmdbDecoder{buf: db.data}
+	v, _, err = dec.decode(off, 0)
+
+	return v, err
+}
+
+// mmdbDecoder decodes the values of the data section.  The maps are decoded as
+// map[string]any, the arrays as []any, and the numbers as uint64, int64, or
+// float64.
+type mmdbDecoder struct {
+	// buf is the section being decoded.  The pointers are relative to its
+	// start.
+	buf []byte
+}
+
+// decode decodes the value at off and returns the offset of the next one.
+// depth is the depth of the value being decoded.
+func (d *mmdbDecoder) decode(off, depth uint) (v any, next uint, err error) {
+	if depth > mmdbMaxDepth {
+		return nil, 0, fmt.Errorf("%w: too deep", errMMDBBad)
+	}
+
+	typ, size, off, err := d.decodeControl(off)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if typ == mmdbTypePointer {
+		var ptr uint
+		ptr, next, err = d.decodePointer(size, off)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		v, _, err = d.decode(ptr, depth+1)
+
+		return v, next, err
+	}
+
+	switch typ {
+	case mmdbTypeMap:
+		return d.decodeMap(size, off, depth)
+	case mmdbTypeArray:
+		return d.decodeArray(size, off, depth)
+	case mmdbTypeBool:
+		return size != 0, off, nil
+	default:
+		// Go on.
+	}
+
+	b, err := d.bytes(off, size)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	next = off + size
+
+	switch typ {
+	case mmdbTypeString:
+		return string(b), next, nil
+	case mmdbTypeBytes, mmdbTypeUint128:
+		return b, next, nil
+	case mmdbTypeDouble:
+		if size != 8 {
+			return nil, 0, fmt.Errorf("%w: double size %d", errMMDBBad, size)
+		}
+
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), next, nil
+	case mmdbTypeFloat:
+		if size != 4 {
+			return nil, 0, fmt.Errorf("%w: float size %d", errMMDBBad, size)
+		}
+
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), next, nil
+	case mmdbTypeUint16, mmdbTypeUint32, mmdbTypeUint64:
+		if size > 8 {
+			return nil, 0, fmt.Errorf("%w: uint size %d", errMMDBBad, size)
+		}
+
+		return mmdbDecodeUint(b), next, nil
+	case mmdbTypeInt32:
+		if size > 4 {
+			return nil, 0, fmt.Errorf("%w: int32 size %d", errMMDBBad, size)
+		}
+
+		return int64(int32(uint32(mmdbDecodeUint(b)))), next, nil
+	default:
+		return nil, 0, fmt.Errorf("%w: type %d", errMMDBBad, typ)
+	}
+}
+
+// decodeControl decodes the control byte at off and returns the type and the
+// size of the value, and the offset of its payload.
+func (d *mmdbDecoder) decodeControl(off uint) (typ, size, next uint, err error) {
+	b, err := d.bytes(off, 1)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	ctrl := uint(b[0])
+	next = off + 1
+	typ = ctrl >> 5
+	if typ == mmdbTypeExtended {
+		b, err = d.bytes(next, 1)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+
+		typ = 7 + uint(b[0])
+		next++
+	}
+
+	if typ == mmdbTypePointer {
+		// The size bits of pointers are decoded separately.
+		return typ, ctrl & 0x1f, next, nil
+	}
+
+	size = ctrl & 0x1f
+	if size < 29 {
+		return typ, size, next, nil
+	}
+
+	n := size - 28
+	b, err = d.bytes(next, n)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	ext := mmdbDecodeUint(b)
+	switch size {
+	case 29:
+		size = 29 + uint(ext)
+	case 30:
+		size = 285 + uint(ext)
+	default:
+		size = 65821 + uint(ext)
+	}
+
+	return typ, size, next + n, nil
+}
+
+// decodePointer decodes the pointer with the size bits of the control byte
+// at off.
+func (d *mmdbDecoder) decodePointer(sizeBits, off uint) (ptr, next uint, err error) {
+	n := (sizeBits>>3)&0x3 + 1
+	b, err := d.bytes(off, n)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	v := uint(mmdbDecodeUint(b))
+	switch n {
+	case 1:
+		ptr = (sizeBits&0x7)<<8 | v
+	case 2:
+		ptr = ((sizeBits&0x7)<<16 | v) + 2048
+	case 3:
+		ptr = ((sizeBits&0x7)<<24 | v) + 526336
+	default:
+		ptr = v
+	}
+
+	return ptr, off + n, nil
+}
+
+// decodeMap decodes the map of size pairs at off.
+func (d *mmdbDecoder) decodeMap(size, off, depth uint) (v any, next uint, err error) {
+	m := make(map[string]any, size)
+	for range size {
+		var key, val any
+		key, off, err = d.decode(off, depth+1)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		k, ok := key.(string)
+		if !ok {
+			return nil, 0, fmt.Errorf("%w: map key is %T", errMMDBBad, key)
+		}
+
+		val, off, err = d.decode(off, depth+1)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		m[k] = val
+	}
+
+	return m, off, nil
+}
+
+// decodeArray decodes the array of size values at off.
+func (d *mmdbDecoder) decodeArray(size, off, depth uint) (v any, next uint, err error) {
+	// Don't trust the size for the preallocation, since it's not validated.
+	var a []any
+	for range size {
+		var val any
+		val, off, err = d.decode(off, depth+1)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		a = append(a, val)
+	}
+
+	return a, off, nil
+}
+
+// bytes returns n bytes of the buffer at off.
+func (d *mmdbDecoder) bytes(off, n uint) (b []byte, err error) {
+	if off+n > uint(len(d.buf)) || off+n < off {
+		return nil, fmt.Errorf("%w: offset %d out of range", errMMDBBad, off+n)
+	}
+
+	return d.buf[off : off+n], nil
+}
+
+// mmdbDecodeUint decodes the big-endian unsigned integer of up to 8 bytes.
+func mmdbDecodeUint(b []byte) (v uint64) {
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+
+	return v
+}
+
+// mmdbUint returns v as an unsigned integer, or zero if it's not one.
+func mmdbUint(v any) (u uint64) {
+	u, _ = v.(uint64)
+
+	return u
+}
@@ -0,0 +1,201 @@
+// Package health contains the implementation of the HTTP health and readiness
+// checks of the proxy.
+package health
+
+import (
+	"cmp"
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/miekg/dns"
+)
+
+// Paths of the HTTP endpoints.
+const (
+	// PathHealth is the path of the endpoint reporting if the listeners of the
+	// server are bound.
+	PathHealth = "/health"
+
+	// PathReady is the path of the endpoint reporting if the upstreams have
+	// answered the last probe.
+	PathReady = "/ready"
+)
+
+// DefaultProbeInterval is the interval between the upstream probes used
+// unless overridden.
+const DefaultProbeInterval = 10 * time.Second
+
+// Server is the DNS server whose listeners are checked.
+type Server interface {
+	// IsStarted returns true if the listeners of the server are bound.
+	IsStarted() (ok bool)
+}
+
+// Config is the configuration of the [Checker].
+type Config struct {
+	// Logger is used to log the probe results.  If nil, [slog.Default] is
+	// used.
+	Logger *slog.Logger
+
+	// Server is the server whose listeners are checked.  It must not be nil.
+	Server Server
+
+	// Upstreams are the upstreams to probe.  The checker is ready once at
+	// least one of them answers the probe.
+	Upstreams []upstream.Upstream
+
+	// ProbeInterval is the interval between the upstream probes.  If zero,
+	// [DefaultProbeInterval] is used.
+	ProbeInterval time.Duration
+}
+
+// Checker is an [http.Handler] serving the health and readiness checks.
+type Checker struct {
+	// logger is used to log the probe results.  It's never nil.
+	logger *slog.Logger
+
+	// server is the server whose listeners are checked.
+	server Server
+
+	// done is closed when the checker is closed.
+	done chan struct{}
+
+	// wg is used to wait for the probing goroutine to finish.
+	wg *sync.WaitGroup
+
+	// ready is true if at least one upstream has answered the last probe.
+	ready *atomic.Bool
+
+	// upstreamsMu protects upstreams.
+	upstreamsMu *sync.Mutex
+
+	// upstreams are the upstreams to probe.
+	upstreams []upstream.Upstream
+
+	// interval is the interval between the upstream probes.
+	interval time.Duration
+}
+
+// type check
+var (
+	_ http.Handler = (*Checker)(nil)
+	_ io.Closer    = (*Checker)(nil)
+)
+
+// New returns a new properly initialized *Checker.  c must not be nil.
+func New(c *Config) (hc *Checker) {
+	return &Checker{
+		logger:      cmp.Or(c.Logger, slog.Default()),
+		server:      c.Server,
+		done:        make(chan struct{}),
+		wg:          &sync.WaitGroup{},
+		ready:       &atomic.Bool{},
+		upstreamsMu: &sync.Mutex{},
+		upstreams:   c.Upstreams,
+		interval:    cmp.Or(c.ProbeInterval, DefaultProbeInterval),
+	}
+}
+
+// Start starts probing the upstreams in a separate goroutine.
+func (hc *Checker) Start() {
+	hc.wg.Add(1)
+	go hc.probeLoop()
+}
+
+// Close implements the [io.Closer] interface for *Checker.  It stops probing
+// the upstreams.
+func (hc *Checker) Close() (err error) {
+	close(hc.done)
+	hc.wg.Wait()
+
+	return nil
+}
+
+// IsReady returns true if at least one upstream has answered the last probe.
+func (hc *Checker) IsReady() (ok bool) {
+	return hc.ready.Load()
+}
+
+// SetUpstreams replaces the upstreams to probe, for example after they have
+// been reconfigured.  The change takes effect since the next probe.
+func (hc *Checker) SetUpstreams(ups []upstream.Upstream) {
+	hc.upstreamsMu.Lock()
+	defer hc.upstreamsMu.Unlock()
+
+	hc.upstreams = ups
+}
+
+// probeLoop probes the upstreams until the checker is closed.
+func (hc *Checker) probeLoop() {
+	defer hc.wg.Done()
+	defer slogutil.RecoverAndLog(context.TODO(), hc.logger)
+
+	t := time.NewTicker(hc.interval)
+	defer t.Stop()
+
+	for {
+		hc.probe()
+
+		select {
+		case <-hc.done:
+			return
+		case <-t.C:
+			// Go on.
+		}
+	}
+}
+
+// probe sends the probe query to the upstreams and updates the readiness.
+func (hc *Checker) probe() {
+	req := &dns.Msg{}
+	req.SetQuestion(".", dns.TypeNS)
+	req.RecursionDesired = true
+
+	hc.upstreamsMu.Lock()
+	ups := hc.upstreams
+	hc.upstreamsMu.Unlock()
+
+	_, u, err := upstream.ExchangeParallel(ups, req)
+	ready := err == nil
+	if hc.ready.Swap(ready) == ready {
+		return
+	}
+
+	if ready {
+		hc.logger.Info("ready", "upstream", u.Address())
+	} else {
+		hc.logger.Warn("not ready, no upstream answered probe", slogutil.KeyError, err)
+	}
+}
+
+// ServeHTTP implements the [http.Handler] interface for *Checker.
+func (hc *Checker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var ok bool
+	switch r.URL.Path {
+	case PathHealth:
+		ok = hc.server.IsStarted()
+	case PathReady:
+		ok = hc.server.IsStarted() && hc.IsReady()
+	default:
+		http.NotFound(w, r)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = io.WriteString(w, "not ok\n")
+
+		return
+	}
+
+	_, _ = io.WriteString(w, "ok\n")
+}
@@ -0,0 +1,96 @@
+package health_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/internal/dnsproxytest"
+	"github.com/AdguardTeam/dnsproxy/internal/health"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// type check
+var _ health.Server = (*proxy.Proxy)(nil)
+
+// testServer is a [health.Server] for tests.
+type testServer struct {
+	started *atomic.Bool
+}
+
+// IsStarted implements the [health.Server] interface for testServer.
+func (s testServer) IsStarted() (ok bool) {
+	return s.started.Load()
+}
+
+// testTimeout is the common timeout for tests.
+const testTimeout = 1 * time.Second
+
+// requireStatus requires the status code of the response to the request of
+// path from hc to be equal to want.
+func requireStatus(t *testing.T, hc *health.Checker, path string, want int) {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	hc.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+
+	require.Equal(t, want, w.Code)
+}
+
+func TestChecker(t *testing.T) {
+	answered := &atomic.Bool{}
+	ups := &dnsproxytest.FakeUpstream{
+		OnAddress: func() (addr string) { return "ups" },
+		OnExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			if !answered.Load() {
+				return nil, assert.AnError
+			}
+
+			return (&dns.Msg{}).SetReply(req), nil
+		},
+	}
+
+	srv := testServer{started: &atomic.Bool{}}
+	hc := health.New(&health.Config{
+		Logger:        slogutil.NewDiscardLogger(),
+		Server:        srv,
+		Upstreams:     []upstream.Upstream{ups},
+		ProbeInterval: 10 * time.Millisecond,
+	})
+
+	hc.Start()
+	testutil.CleanupAndRequireSuccess(t, hc.Close)
+
+	requireStatus(t, hc, health.PathHealth, http.StatusServiceUnavailable)
+	requireStatus(t, hc, health.PathReady, http.StatusServiceUnavailable)
+	requireStatus(t, hc, "/unknown", http.StatusNotFound)
+
+	srv.started.Store(true)
+	requireStatus(t, hc, health.PathHealth, http.StatusOK)
+	requireStatus(t, hc, health.PathReady, http.StatusServiceUnavailable)
+
+	answered.Store(true)
+	require.Eventually(t, hc.IsReady, testTimeout, 10*time.Millisecond)
+	requireStatus(t, hc, health.PathReady, http.StatusOK)
+
+	answered.Store(false)
+	require.Eventually(t, func() (ok bool) { return !hc.IsReady() }, testTimeout, 10*time.Millisecond)
+	requireStatus(t, hc, health.PathReady, http.StatusServiceUnavailable)
+
+	hc.SetUpstreams([]upstream.Upstream{&dnsproxytest.FakeUpstream{
+		OnAddress: func() (addr string) { return "new" },
+		OnExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			return (&dns.Msg{}).SetReply(req), nil
+		},
+	}})
+	require.Eventually(t, hc.IsReady, testTimeout, 10*time.Millisecond)
+	requireStatus(t, hc, health.PathReady, http.StatusOK)
+}
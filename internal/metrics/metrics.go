@@ -0,0 +1,223 @@
+// Package metrics contains the Prometheus implementation of the proxy metrics.
+package metrics
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// namespace is the namespace for all the dnsproxy metrics.
+const namespace = "dnsproxy"
+
+// Label names.
+const (
+	labelProto    = "proto"
+	labelRcode    = "rcode"
+	labelReason   = "reason"
+	labelResult   = "result"
+	labelUpstream = "upstream"
+)
+
+// Values of the cache lookup result label.
+const (
+	cacheResultHit  = "hit"
+	cacheResultMiss = "miss"
+)
+
+// Prometheus is the [proxy.MetricsListener] implementation that collects the
+// metrics in Prometheus format.
+type Prometheus struct {
+	// requests is the number of processed requests by protocol.
+	requests *prometheus.CounterVec
+
+	// responses is the number of sent responses by protocol and rcode.
+	responses *prometheus.CounterVec
+
+	// requestDuration is the histogram of the request processing durations by
+	// protocol.
+	requestDuration *prometheus.HistogramVec
+
+	// cacheLookups is the number of cache lookups by result.
+	cacheLookups *prometheus.CounterVec
+
+	// upstreamRTT is the histogram of upstream exchange durations by upstream
+	// address.
+	upstreamRTT *prometheus.HistogramVec
+
+	// upstreamErrors is the number of failed upstream exchanges by upstream
+	// address.
+	upstreamErrors *prometheus.CounterVec
+
+	// ratelimited is the number of requests dropped due to ratelimiting by
+	// protocol.
+	ratelimited *prometheus.CounterVec
+
+	// activeConns is the number of currently open client connections by
+	// protocol.
+	activeConns *prometheus.GaugeVec
+
+	// anomalies is the number of detected anomalous clients by reason.
+	anomalies *prometheus.CounterVec
+}
+
+// New registers the metrics in reg and returns the properly initialized
+// *Prometheus.  reg must not be nil.
+func New(reg prometheus.Registerer) (m *Prometheus, err error) {
+	m = &Prometheus{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "requests_total",
+			Help:      "The number of processed DNS requests.",
+		}, []string{labelProto}),
+		responses: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "responses_total",
+			Help:      "The number of sent DNS responses.",
+		}, []string{labelProto, labelRcode}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "request_duration_seconds",
+			Help:      "The time spent on processing DNS requests.",
+			Buckets:   []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+		}, []string{labelProto}),
+		cacheLookups: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "cache",
+			Name:      "lookups_total",
+			Help:      "The number of cache lookups.",
+		}, []string{labelResult}),
+		upstreamRTT: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "upstream",
+			Name:      "rtt_seconds",
+			Help:      "The round-trip time of exchanges with upstreams.",
+			Buckets:   []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+		}, []string{labelUpstream}),
+		upstreamErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "upstream",
+			Name:      "errors_total",
+			Help:      "The number of failed exchanges with upstreams.",
+		}, []string{labelUpstream}),
+		ratelimited: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "ratelimited_total",
+			Help:      "The number of DNS requests dropped due to ratelimiting.",
+		}, []string{labelProto}),
+		activeConns: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "active_connections",
+			Help:      "The number of currently open client connections.",
+		}, []string{labelProto}),
+		anomalies: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "anomalies_total",
+			Help:      "The number of detected anomalous clients.",
+		}, []string{labelReason}),
+	}
+
+	collectors := []prometheus.Collector{
+		m.requests,
+		m.responses,
+		m.requestDuration,
+		m.cacheLookups,
+		m.upstreamRTT,
+		m.upstreamErrors,
+		m.ratelimited,
+		m.activeConns,
+		m.anomalies,
+	}
+
+	var errs []error
+	for _, c := range collectors {
+		err = reg.Register(c)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if err = errors.Join(errs...); err != nil {
+		return nil, fmt.Errorf("registering metrics: %w", err)
+	}
+
+	return m, nil
+}
+
+// type check
+var _ proxy.MetricsListener = (*Prometheus)(nil)
+
+// OnRequest implements the [proxy.MetricsListener] interface for *Prometheus.
+func (m *Prometheus) OnRequest(proto proxy.Proto, resp *dns.Msg, elapsed time.Duration) {
+	p := string(proto)
+
+	m.requests.WithLabelValues(p).Inc()
+	m.requestDuration.WithLabelValues(p).Observe(elapsed.Seconds())
+
+	if resp != nil {
+		m.responses.WithLabelValues(p, rcodeToString(resp.Rcode)).Inc()
+	}
+}
+
+// rcodeToString returns the textual representation of rcode.
+func rcodeToString(rcode int) (s string) {
+	if s = dns.RcodeToString[rcode]; s != "" {
+		return s
+	}
+
+	return strconv.Itoa(rcode)
+}
+
+// OnCacheLookup implements the [proxy.MetricsListener] interface for
+// *Prometheus.
+func (m *Prometheus) OnCacheLookup(hit bool) {
+	if hit {
+		m.cacheLookups.WithLabelValues(cacheResultHit).Inc()
+	} else {
+		m.cacheLookups.WithLabelValues(cacheResultMiss).Inc()
+	}
+}
+
+// OnUpstreamExchange implements the [proxy.MetricsListener] interface for
+// *Prometheus.
+func (m *Prometheus) OnUpstreamExchange(addr string, rtt time.Duration, err error) {
+	if err != nil {
+		m.upstreamErrors.WithLabelValues(addr).Inc()
+
+		return
+	}
+
+	m.upstreamRTT.WithLabelValues(addr).Observe(rtt.Seconds())
+}
+
+// OnRatelimited implements the [proxy.MetricsListener] interface for
+// *Prometheus.
+func (m *Prometheus) OnRatelimited(proto proxy.Proto) {
+	m.ratelimited.WithLabelValues(string(proto)).Inc()
+}
+
+// OnConnectionOpened implements the [proxy.MetricsListener] interface for
+// *Prometheus.
+func (m *Prometheus) OnConnectionOpened(proto proxy.Proto) {
+	m.activeConns.WithLabelValues(string(proto)).Inc()
+}
+
+// OnConnectionClosed implements the [proxy.MetricsListener] interface for
+// *Prometheus.
+func (m *Prometheus) OnConnectionClosed(proto proxy.Proto) {
+	m.activeConns.WithLabelValues(string(proto)).Dec()
+}
+
+// type check
+var _ proxy.AnomalyHandler = (*Prometheus)(nil)
+
+// HandleAnomaly implements the [proxy.AnomalyHandler] interface for
+// *Prometheus.
+func (m *Prometheus) HandleAnomaly(a *proxy.Anomaly) {
+	m.anomalies.WithLabelValues(string(a.Reason)).Inc()
+}
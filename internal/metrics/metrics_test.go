@@ -0,0 +1,122 @@
+package metrics_test
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/internal/metrics"
+	"github.com/AdguardTeam/dnsproxy/internal/stats"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrometheus(t *testing.T) {
+	reg := prometheus.NewRegistry()
+
+	m, err := metrics.New(reg)
+	require.NoError(t, err)
+
+	req := (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA)
+	resp := (&dns.Msg{}).SetRcode(req, dns.RcodeNameError)
+
+	m.OnRequest(proxy.ProtoUDP, resp, time.Millisecond)
+	m.OnRequest(proxy.ProtoUDP, nil, time.Millisecond)
+	m.OnCacheLookup(true)
+	m.OnCacheLookup(false)
+	m.OnCacheLookup(false)
+	m.OnUpstreamExchange("1.1.1.1:53", 10*time.Millisecond, nil)
+	m.OnUpstreamExchange("1.1.1.1:53", 0, assert.AnError)
+	m.OnRatelimited(proxy.ProtoUDP)
+	m.OnConnectionOpened(proxy.ProtoTCP)
+	m.OnConnectionOpened(proxy.ProtoTCP)
+	m.OnConnectionClosed(proxy.ProtoTCP)
+	m.HandleAnomaly(&proxy.Anomaly{Reason: proxy.AnomalyReasonNXDomain})
+
+	const want = `
+# HELP dnsproxy_active_connections The number of currently open client connections.
+# TYPE dnsproxy_active_connections gauge
+dnsproxy_active_connections{proto="tcp"} 1
+# HELP dnsproxy_anomalies_total The number of detected anomalous clients.
+# TYPE dnsproxy_anomalies_total counter
+dnsproxy_anomalies_total{reason="nxdomain"} 1
+# HELP dnsproxy_cache_lookups_total The number of cache lookups.
+# TYPE dnsproxy_cache_lookups_total counter
+dnsproxy_cache_lookups_total{result="hit"} 1
+dnsproxy_cache_lookups_total{result="miss"} 2
+# HELP dnsproxy_ratelimited_total The number of DNS requests dropped due to ratelimiting.
+# TYPE dnsproxy_ratelimited_total counter
+dnsproxy_ratelimited_total{proto="udp"} 1
+# HELP dnsproxy_requests_total The number of processed DNS requests.
+# TYPE dnsproxy_requests_total counter
+dnsproxy_requests_total{proto="udp"} 2
+# HELP dnsproxy_responses_total The number of sent DNS responses.
+# TYPE dnsproxy_responses_total counter
+dnsproxy_responses_total{proto="udp",rcode="NXDOMAIN"} 1
+# HELP dnsproxy_upstream_errors_total The number of failed exchanges with upstreams.
+# TYPE dnsproxy_upstream_errors_total counter
+dnsproxy_upstream_errors_total{upstream="1.1.1.1:53"} 1
+`
+
+	err = testutil.GatherAndCompare(
+		reg,
+		strings.NewReader(want),
+		"dnsproxy_active_connections",
+		"dnsproxy_anomalies_total",
+		"dnsproxy_cache_lookups_total",
+		"dnsproxy_ratelimited_total",
+		"dnsproxy_requests_total",
+		"dnsproxy_responses_total",
+		"dnsproxy_upstream_errors_total",
+	)
+	assert.NoError(t, err)
+
+	assert.Equal(t, 1, testutil.CollectAndCount(reg, "dnsproxy_upstream_rtt_seconds"))
+	assert.Equal(t, 1, testutil.CollectAndCount(reg, "dnsproxy_request_duration_seconds"))
+
+	t.Run("duplicate", func(t *testing.T) {
+		_, err = metrics.New(reg)
+		assert.Error(t, err)
+	})
+}
+
+func TestRegisterTopTalkers(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	s := stats.New(&stats.Config{})
+
+	require.NoError(t, metrics.RegisterTopTalkers(reg, s, 1))
+
+	for _, e := range []*proxy.QueryLogEntry{{
+		Client: netip.MustParseAddrPort("192.0.2.1:53"),
+		Rcode:  dns.RcodeSuccess,
+	}, {
+		Client: netip.MustParseAddrPort("192.0.2.2:53"),
+		Rcode:  dns.RcodeSuccess,
+	}, {
+		Client: netip.MustParseAddrPort("192.0.2.3:53"),
+		Rcode:  dns.RcodeNameError,
+	}, {
+		Client: netip.MustParseAddrPort("[2001:db8::1]:53"),
+		Rcode:  dns.RcodeSuccess,
+	}} {
+		s.LogQuery(e)
+	}
+
+	const want = `
+# HELP dnsproxy_top_talker_qps The average number of DNS requests per second from the client subnet within the last minute.
+# TYPE dnsproxy_top_talker_qps gauge
+dnsproxy_top_talker_qps{subnet="192.0.2.0/24"} 0.05
+# HELP dnsproxy_top_talker_responses The number of DNS responses sent to the client subnet within the last minute.
+# TYPE dnsproxy_top_talker_responses gauge
+dnsproxy_top_talker_responses{rcode="NOERROR",subnet="192.0.2.0/24"} 2
+dnsproxy_top_talker_responses{rcode="NXDOMAIN",subnet="192.0.2.0/24"} 1
+`
+
+	err := testutil.GatherAndCompare(reg, strings.NewReader(want))
+	assert.NoError(t, err)
+}
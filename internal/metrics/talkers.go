@@ -0,0 +1,86 @@
+package metrics
+
+import (
+	"fmt"
+
+	"github.com/AdguardTeam/dnsproxy/internal/stats"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// labelSubnet is the name of the client subnet label.
+const labelSubnet = "subnet"
+
+// talkersCollector is the [prometheus.Collector] of the client subnets sending
+// the most requests within the last minute.
+type talkersCollector struct {
+	// stats is the source of the talkers.
+	stats *stats.Stats
+
+	// qps describes the rate of the requests from a subnet.
+	qps *prometheus.Desc
+
+	// responses describes the numbers of the responses to a subnet by rcode.
+	responses *prometheus.Desc
+
+	// n is the maximum number of the reported subnets.
+	n int
+}
+
+// type check
+var _ prometheus.Collector = (*talkersCollector)(nil)
+
+// RegisterTopTalkers registers the metrics of at most n client subnets sending
+// the most requests within the last minute, as counted by s, in reg.  s and reg
+// must not be nil, n must be positive.
+func RegisterTopTalkers(reg prometheus.Registerer, s *stats.Stats, n int) (err error) {
+	c := &talkersCollector{
+		stats: s,
+		qps: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "top_talker", "qps"),
+			"The average number of DNS requests per second from the client subnet "+
+				"within the last minute.",
+			[]string{labelSubnet},
+			nil,
+		),
+		responses: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "top_talker", "responses"),
+			"The number of DNS responses sent to the client subnet within the last minute.",
+			[]string{labelSubnet, labelRcode},
+			nil,
+		),
+		n: n,
+	}
+
+	err = reg.Register(c)
+	if err != nil {
+		return fmt.Errorf("registering top talkers: %w", err)
+	}
+
+	return nil
+}
+
+// Describe implements the [prometheus.Collector] interface for
+// *talkersCollector.
+func (c *talkersCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.qps
+	ch <- c.responses
+}
+
+// Collect implements the [prometheus.Collector] interface for
+// *talkersCollector.
+func (c *talkersCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, t := range c.stats.TopTalkers(stats.WindowMinute, c.n) {
+		subnet := t.Subnet.String()
+		ch <- prometheus.MustNewConstMetric(c.qps, prometheus.GaugeValue, t.QPS, subnet)
+
+		for rcode, n := range t.Rcodes {
+			ch <- prometheus.MustNewConstMetric(
+				c.responses,
+				prometheus.GaugeValue,
+				float64(n),
+				subnet,
+				rcode,
+			)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+// Package netmon contains the detection of the changes of the network
+// interfaces, their addresses, and the routes, for example when a laptop moves
+// between networks.
+package netmon
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+)
+
+const (
+	// DefaultSettleDelay is the time the changes of the network must settle
+	// for before they are reported, used unless overridden.
+	DefaultSettleDelay = 2 * time.Second
+
+	// DefaultPollInterval is the interval between the checks of the network
+	// interfaces on the platforms without the change notifications, used
+	// unless overridden.
+	DefaultPollInterval = 5 * time.Second
+)
+
+// Config is the configuration of the [Monitor].
+type Config struct {
+	// Logger is used to log the detected changes.  If nil, [slog.Default] is
+	// used.
+	Logger *slog.Logger
+
+	// OnChange is called once the network has changed and the changes have
+	// settled.  It's called sequentially from a separate goroutine.  It must
+	// not be nil.
+	OnChange func(ctx context.Context)
+
+	// SettleDelay is the time the changes must settle for before OnChange is
+	// called, so that a burst of changes, like the ones made by a DHCP
+	// client, is reported once.  If zero, [DefaultSettleDelay] is used.
+	SettleDelay time.Duration
+
+	// PollInterval is the interval between the checks of the network
+	// interfaces and their addresses on the platforms without the change
+	// notifications, i.e. other than Linux.  If zero, [DefaultPollInterval]
+	// is used.
+	PollInterval time.Duration
+}
+
+// source is the source of the notifications about the changes of the network.
+type source interface {
+	// wait blocks until the network changes or the source is closed, in which
+	// case it returns an error.
+	wait() (err error)
+
+	io.Closer
+}
+
+// Monitor detects the changes of the network.
+type Monitor struct {
+	// logger is used to log the detected changes.  It's never nil.
+	logger *slog.Logger
+
+	// src is the source of the notifications.
+	src source
+
+	// onChange is called once the changes have settled.
+	onChange func(ctx context.Context)
+
+	// ctx is canceled when the monitor is closed.  It's passed to onChange.
+	ctx context.Context
+
+	// cancel cancels ctx.
+	cancel context.CancelFunc
+
+	// wg is used to wait for the goroutines to finish.
+	wg *sync.WaitGroup
+
+	// settleDelay is the time the changes must settle for.
+	settleDelay time.Duration
+}
+
+// type check
+var _ io.Closer = (*Monitor)(nil)
+
+// New returns a new properly initialized *Monitor.  c must not be nil.
+func New(c *Config) (m *Monitor, err error) {
+	src, err := newSource(cmp.Or(c.PollInterval, DefaultPollInterval))
+	if err != nil {
+		return nil, fmt.Errorf("creating source: %w", err)
+	}
+
+	return newMonitor(c, src), nil
+}
+
+// newMonitor returns a new *Monitor with src as the source of the
+// notifications.
+func newMonitor(c *Config, src source) (m *Monitor) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &Monitor{
+		logger:      cmp.Or(c.Logger, slog.Default()),
+		src:         src,
+		onChange:    c.OnChange,
+		ctx:         ctx,
+		cancel:      cancel,
+		wg:          &sync.WaitGroup{},
+		settleDelay: cmp.Or(c.SettleDelay, DefaultSettleDelay),
+	}
+}
+
+// Start starts monitoring the network in separate goroutines.
+func (m *Monitor) Start() {
+	changes := make(chan struct{}, 1)
+
+	m.wg.Add(2)
+	go m.waitLoop(changes)
+	go m.notifyLoop(changes)
+}
+
+// Close implements the [io.Closer] interface for *Monitor.  It stops
+// monitoring the network.
+func (m *Monitor) Close() (err error) {
+	m.cancel()
+	err = m.src.Close()
+	m.wg.Wait()
+
+	return err
+}
+
+// waitLoop sends to changes each time the network changes, until the source is
+// closed.
+func (m *Monitor) waitLoop(changes chan<- struct{}) {
+	defer m.wg.Done()
+	defer slogutil.RecoverAndLog(m.ctx, m.logger)
+
+	for {
+		err := m.src.wait()
+		if err != nil {
+			if m.ctx.Err() == nil {
+				m.logger.Error("waiting for network changes", slogutil.KeyError, err)
+			}
+
+			return
+		}
+
+		select {
+		case changes <- struct{}{}:
+		default:
+			// The change is already pending.
+		}
+	}
+}
+
+// notifyLoop calls the change handler once the changes received from changes
+// settle, until the monitor is closed.
+func (m *Monitor) notifyLoop(changes <-chan struct{}) {
+	defer m.wg.Done()
+	defer slogutil.RecoverAndLog(m.ctx, m.logger)
+
+	settle := time.NewTimer(m.settleDelay)
+	settle.Stop()
+
+	for {
+		select {
+		case <-m.ctx.Done():
+			return
+		case <-changes:
+			m.logger.Debug("network change detected")
+			if !settle.Stop() {
+				// Drain the channel, if the timer has fired concurrently.
+				select {
+				case <-settle.C:
+				default:
+				}
+			}
+
+			settle.Reset(m.settleDelay)
+		case <-settle.C:
+			m.logger.Info("network changed")
+			m.onChange(m.ctx)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package netmon
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testTimeout is the common timeout for tests.
+const testTimeout = 1 * time.Second
+
+// testSettleDelay is the settle delay for tests.
+const testSettleDelay = 50 * time.Millisecond
+
+// fakeSource is a [source] for tests reporting the changes sent to changes.
+type fakeSource struct {
+	changes chan struct{}
+	done    chan struct{}
+}
+
+// type check
+var _ source = (*fakeSource)(nil)
+
+// newFakeSource returns a new *fakeSource.
+func newFakeSource() (s *fakeSource) {
+	return &fakeSource{
+		changes: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// wait implements the [source] interface for *fakeSource.
+func (s *fakeSource) wait() (err error) {
+	select {
+	case <-s.changes:
+		return nil
+	case <-s.done:
+		return errClosed
+	}
+}
+
+// Close implements the [source] interface for *fakeSource.
+func (s *fakeSource) Close() (err error) {
+	close(s.done)
+
+	return nil
+}
+
+func TestMonitor(t *testing.T) {
+	src := newFakeSource()
+	calls := &atomic.Int32{}
+
+	m := newMonitor(&Config{
+		Logger:      slogutil.NewDiscardLogger(),
+		OnChange:    func(_ context.Context) { calls.Add(1) },
+		SettleDelay: testSettleDelay,
+	}, src)
+	m.Start()
+
+	// Report a burst of changes.
+	for range 5 {
+		testutil.RequireSend(t, src.changes, struct{}{}, testTimeout)
+	}
+
+	require.Eventually(t, func() (ok bool) {
+		return calls.Load() == 1
+	}, testTimeout, testSettleDelay/5)
+
+	// Make sure the burst is reported once.
+	time.Sleep(2 * testSettleDelay)
+	assert.Equal(t, int32(1), calls.Load())
+
+	testutil.RequireSend(t, src.changes, struct{}{}, testTimeout)
+	require.Eventually(t, func() (ok bool) {
+		return calls.Load() == 2
+	}, testTimeout, testSettleDelay/5)
+
+	require.NoError(t, m.Close())
+}
+
+func TestPollSource(t *testing.T) {
+	fp := &atomic.Value{}
+	fp.Store("initial")
+
+	s := newPollSource(testSettleDelay/5, func() (f string, err error) {
+		return fp.Load().(string), nil
+	})
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- s.wait() }()
+
+	fp.Store("changed")
+	err, _ := testutil.RequireReceive(t, errCh, testTimeout)
+	require.NoError(t, err)
+
+	go func() { errCh <- s.wait() }()
+
+	require.NoError(t, s.Close())
+	err, _ = testutil.RequireReceive(t, errCh, testTimeout)
+	assert.ErrorIs(t, err, errClosed)
+}
+
+func TestInterfacesFingerprint(t *testing.T) {
+	fp, err := interfacesFingerprint()
+	require.NoError(t, err)
+
+	// The state of the network shouldn't change between the calls.
+	next, err := interfacesFingerprint()
+	require.NoError(t, err)
+
+	assert.Equal(t, fp, next)
+}
@@ -0,0 +1,114 @@
+package netmon
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// errClosed is returned by the sources which have been closed.
+const errClosed errors.Error = "source closed"
+
+// pollSource is the source of the notifications comparing the state of the
+// network each interval.  It's used on the platforms without the change
+// notifications.
+type pollSource struct {
+	// fingerprint returns the current state of the network.
+	fingerprint func() (fp string, err error)
+
+	// done is closed when the source is closed.
+	done chan struct{}
+
+	// last is the last state of the network.  It's only accessed by wait.
+	last string
+
+	// ivl is the interval between the checks.
+	ivl time.Duration
+}
+
+// type check
+var _ source = (*pollSource)(nil)
+
+// newPollSource returns a new source checking the state returned by fp each
+// ivl.
+func newPollSource(ivl time.Duration, fp func() (fp string, err error)) (s *pollSource) {
+	s = &pollSource{
+		fingerprint: fp,
+		done:        make(chan struct{}),
+		ivl:         ivl,
+	}
+
+	// Ignore the error, since the next check will be compared against the
+	// empty state then.
+	s.last, _ = fp()
+
+	return s
+}
+
+// wait implements the [source] interface for *pollSource.
+func (s *pollSource) wait() (err error) {
+	t := time.NewTicker(s.ivl)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return errClosed
+		case <-t.C:
+			// Go on.
+		}
+
+		fp, fpErr := s.fingerprint()
+		if fpErr != nil {
+			// Retry on the next tick, since the interfaces may be changing
+			// right now.
+			continue
+		}
+
+		if fp != s.last {
+			s.last = fp
+
+			return nil
+		}
+	}
+}
+
+// Close implements the [source] interface for *pollSource.
+func (s *pollSource) Close() (err error) {
+	close(s.done)
+
+	return nil
+}
+
+// interfacesFingerprint returns the state of the network interfaces, which are
+// up, and their addresses.
+func interfacesFingerprint() (fp string, err error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return "", fmt.Errorf("getting interfaces: %w", err)
+	}
+
+	b := &strings.Builder{}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+
+		addrs, addrsErr := iface.Addrs()
+		if addrsErr != nil {
+			return "", fmt.Errorf("getting addresses of %q: %w", iface.Name, addrsErr)
+		}
+
+		_, _ = fmt.Fprintf(b, "%d %s %s", iface.Index, iface.Name, iface.HardwareAddr)
+		for _, a := range addrs {
+			_, _ = fmt.Fprintf(b, " %s", a)
+		}
+
+		b.WriteByte('\n')
+	}
+
+	return b.String(), nil
+}
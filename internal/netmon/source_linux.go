@@ -0,0 +1,83 @@
+//go:build linux
+
+package netmon
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"golang.org/x/sys/unix"
+)
+
+// netlinkGroups are the rtnetlink multicast groups reporting the changes of the
+// links, their addresses, and the routes.
+const netlinkGroups = unix.RTMGRP_LINK |
+	unix.RTMGRP_IPV4_IFADDR |
+	unix.RTMGRP_IPV6_IFADDR |
+	unix.RTMGRP_IPV4_ROUTE |
+	unix.RTMGRP_IPV6_ROUTE
+
+// netlinkSource is the source of the notifications reading the rtnetlink
+// messages.
+type netlinkSource struct {
+	// file is the netlink socket.  It's non-blocking, so that closing it
+	// unblocks the pending read.
+	file *os.File
+
+	// buf is the buffer for the messages, which are only counted and not
+	// parsed.
+	buf []byte
+}
+
+// type check
+var _ source = (*netlinkSource)(nil)
+
+// newSource returns the netlink source of the notifications.  The polling
+// interval is not used on Linux.
+func newSource(_ time.Duration) (s source, err error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return nil, fmt.Errorf("opening netlink socket: %w", err)
+	}
+
+	err = unix.Bind(fd, &unix.SockaddrNetlink{
+		Family: unix.AF_NETLINK,
+		Groups: netlinkGroups,
+	})
+	if err != nil {
+		return nil, errors.WithDeferred(
+			fmt.Errorf("binding netlink socket: %w", err),
+			unix.Close(fd),
+		)
+	}
+
+	err = unix.SetNonblock(fd, true)
+	if err != nil {
+		return nil, errors.WithDeferred(
+			fmt.Errorf("setting non-blocking mode: %w", err),
+			unix.Close(fd),
+		)
+	}
+
+	return &netlinkSource{
+		file: os.NewFile(uintptr(fd), "netlink"),
+		buf:  make([]byte, os.Getpagesize()),
+	}, nil
+}
+
+// wait implements the [source] interface for *netlinkSource.
+func (s *netlinkSource) wait() (err error) {
+	_, err = s.file.Read(s.buf)
+	if err != nil {
+		return fmt.Errorf("reading netlink socket: %w", err)
+	}
+
+	return nil
+}
+
+// Close implements the [source] interface for *netlinkSource.
+func (s *netlinkSource) Close() (err error) {
+	return s.file.Close()
+}
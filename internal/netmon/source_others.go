@@ -0,0 +1,11 @@
+//go:build !linux
+
+package netmon
+
+import "time"
+
+// newSource returns the source of the notifications polling the network
+// interfaces each ivl.
+func newSource(ivl time.Duration) (s source, err error) {
+	return newPollSource(ivl, interfacesFingerprint), nil
+}
@@ -0,0 +1,17 @@
+package netutil
+
+import (
+	"syscall"
+)
+
+// InterfaceControl returns a [ControlFunc] binding the sockets to the network
+// interface named iface, so that the listening sockets only accept the traffic
+// received on it, regardless of the addresses assigned to it, and the dialed
+// ones only send the traffic through it.  On Linux, iface may also be a VRF
+// device, in which case the routing table of the VRF is used.  See
+// [BindToInterfaceSupported].
+func InterfaceControl(iface string) (f ControlFunc) {
+	return func(network, _ string, c syscall.RawConn) (err error) {
+		return bindToInterface(network, iface, c)
+	}
+}
@@ -0,0 +1,41 @@
+//go:build darwin
+
+package netutil
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"golang.org/x/sys/unix"
+)
+
+// BindToInterfaceSupported is true if the sockets may be bound to a network
+// interface.
+const BindToInterfaceSupported = true
+
+// bindToInterface sets the IP_BOUND_IF or the IPV6_BOUND_IF socket option on c
+// depending on network.
+func bindToInterface(network, iface string, c syscall.RawConn) (err error) {
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return fmt.Errorf("getting interface: %w", err)
+	}
+
+	level, opt, optName := unix.IPPROTO_IP, unix.IP_BOUND_IF, "IP_BOUND_IF"
+	if strings.HasSuffix(network, "6") {
+		level, opt, optName = unix.IPPROTO_IPV6, unix.IPV6_BOUND_IF, "IPV6_BOUND_IF"
+	}
+
+	var opErr error
+	err = c.Control(func(fd uintptr) {
+		opErr = unix.SetsockoptInt(int(fd), level, opt, ifi.Index)
+		if opErr != nil {
+			opErr = fmt.Errorf("setting %s to %q: %w", optName, iface, opErr)
+		}
+	})
+
+	return errors.WithDeferred(opErr, err)
+}
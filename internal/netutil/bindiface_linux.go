@@ -0,0 +1,28 @@
+//go:build linux
+
+package netutil
+
+import (
+	"fmt"
+	"syscall"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"golang.org/x/sys/unix"
+)
+
+// BindToInterfaceSupported is true if the sockets may be bound to a network
+// interface.
+const BindToInterfaceSupported = true
+
+// bindToInterface sets the SO_BINDTODEVICE socket option on c.
+func bindToInterface(_, iface string, c syscall.RawConn) (err error) {
+	var opErr error
+	err = c.Control(func(fd uintptr) {
+		opErr = unix.BindToDevice(int(fd), iface)
+		if opErr != nil {
+			opErr = fmt.Errorf("setting SO_BINDTODEVICE to %q: %w", iface, opErr)
+		}
+	})
+
+	return errors.WithDeferred(opErr, err)
+}
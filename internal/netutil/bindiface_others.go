@@ -0,0 +1,19 @@
+//go:build !linux && !darwin
+
+package netutil
+
+import (
+	"syscall"
+
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// BindToInterfaceSupported is true if the sockets may be bound to a network
+// interface.
+const BindToInterfaceSupported = false
+
+// bindToInterface returns an error, since binding the sockets to a network
+// interface isn't supported on this OS.
+func bindToInterface(_, _ string, _ syscall.RawConn) (err error) {
+	return errors.Error("binding to interface is not supported")
+}
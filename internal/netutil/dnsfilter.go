@@ -0,0 +1,74 @@
+package netutil
+
+import (
+	"net"
+
+	"golang.org/x/net/bpf"
+)
+
+// Offsets of the DNS header fields within the packets seen by the socket
+// filters of the UDP sockets, which start with the UDP header.
+const (
+	dnsFilterOffFlags   = 8 + 2
+	dnsFilterOffQDCount = 8 + 4
+	dnsFilterOffANCount = 8 + 6
+	dnsFilterOffNSCount = 8 + 8
+	dnsFilterOffARCount = 8 + 10
+)
+
+const (
+	// dnsFilterMinLen is the length of the shortest possible query along with
+	// the UDP header: the 12-byte DNS header and the question with the root
+	// name.
+	dnsFilterMinLen = 8 + 12 + 5
+
+	// dnsFilterMinRRLen is the length of the shortest possible resource
+	// record: the root name, the type, the class, the TTL, and the empty data.
+	dnsFilterMinRRLen = 11
+)
+
+// dnsFilter is the classic BPF program accepting only the packets which may be
+// DNS queries.  It drops the packets that are too short, have the QR bit set,
+// don't have exactly one question, or have more resource records than could
+// fit into the packet.
+var dnsFilter = []bpf.Instruction{
+	// 0: Drop the packets shorter than the minimal query.
+	bpf.LoadExtension{Num: bpf.ExtLen},
+	bpf.JumpIf{Cond: bpf.JumpLessThan, Val: dnsFilterMinLen, SkipTrue: 16},
+
+	// 2: Drop the responses.
+	bpf.LoadAbsolute{Off: dnsFilterOffFlags, Size: 1},
+	bpf.JumpIf{Cond: bpf.JumpBitsSet, Val: 0x80, SkipTrue: 14},
+
+	// 4: Drop the messages without exactly one question.
+	bpf.LoadAbsolute{Off: dnsFilterOffQDCount, Size: 2},
+	bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: 1, SkipTrue: 12},
+
+	// 6: Drop the messages with more records than could fit into the packet.
+	bpf.LoadAbsolute{Off: dnsFilterOffANCount, Size: 2},
+	bpf.TAX{},
+	bpf.LoadAbsolute{Off: dnsFilterOffNSCount, Size: 2},
+	bpf.ALUOpX{Op: bpf.ALUOpAdd},
+	bpf.TAX{},
+	bpf.LoadAbsolute{Off: dnsFilterOffARCount, Size: 2},
+	bpf.ALUOpX{Op: bpf.ALUOpAdd},
+	bpf.ALUOpConstant{Op: bpf.ALUOpMul, Val: dnsFilterMinRRLen},
+	bpf.TAX{},
+	bpf.LoadExtension{Num: bpf.ExtLen},
+	bpf.ALUOpConstant{Op: bpf.ALUOpSub, Val: dnsFilterMinLen},
+	bpf.JumpIfX{Cond: bpf.JumpGreaterOrEqual, SkipTrue: 1},
+
+	// 18: Drop.
+	bpf.RetConstant{Val: 0},
+
+	// 19: Accept the whole packet.
+	bpf.RetConstant{Val: 0xFFFF_FFFF},
+}
+
+// AttachDNSFilter attaches a socket filter to c, which discards the packets
+// that can't be DNS queries in the kernel, so that they don't reach the
+// application.  c must be a plain DNS listener, not a DNSCrypt or QUIC one.
+// See [DNSFilterSupported].
+func AttachDNSFilter(c *net.UDPConn) (err error) {
+	return attachDNSFilter(c)
+}
@@ -0,0 +1,50 @@
+//go:build linux
+
+package netutil
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+)
+
+// DNSFilterSupported is true if the socket filters dropping the packets that
+// can't be DNS queries are supported.
+const DNSFilterSupported = true
+
+// attachDNSFilter sets the SO_ATTACH_FILTER socket option on c.
+func attachDNSFilter(c *net.UDPConn) (err error) {
+	raw, err := bpf.Assemble(dnsFilter)
+	if err != nil {
+		// Should never happen, since the program is static.
+		panic(fmt.Errorf("assembling dns filter: %w", err))
+	}
+
+	filter := make([]unix.SockFilter, 0, len(raw))
+	for _, ins := range raw {
+		filter = append(filter, unix.SockFilter{Code: ins.Op, Jt: ins.Jt, Jf: ins.Jf, K: ins.K})
+	}
+
+	prog := &unix.SockFprog{
+		Len:    uint16(len(filter)),
+		Filter: &filter[0],
+	}
+
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return fmt.Errorf("getting raw conn: %w", err)
+	}
+
+	var opErr error
+	err = rc.Control(func(fd uintptr) {
+		opErr = unix.SetsockoptSockFprog(int(fd), unix.SOL_SOCKET, unix.SO_ATTACH_FILTER, prog)
+		if opErr != nil {
+			opErr = fmt.Errorf("setting SO_ATTACH_FILTER: %w", opErr)
+		}
+	})
+
+	return errors.WithDeferred(opErr, err)
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+
+package netutil
+
+import (
+	"net"
+
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// DNSFilterSupported is true if the socket filters dropping the packets that
+// can't be DNS queries are supported.
+const DNSFilterSupported = false
+
+// attachDNSFilter returns an error, since the socket filters aren't supported
+// on this OS.
+func attachDNSFilter(_ *net.UDPConn) (err error) {
+	return errors.Error("socket filters are not supported")
+}
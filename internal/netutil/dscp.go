@@ -0,0 +1,45 @@
+package netutil
+
+import (
+	"fmt"
+	"syscall"
+
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// MaxDSCP is the maximum value of a Differentiated Services Code Point, see
+// RFC 2474.
+const MaxDSCP = 63
+
+// DSCPControl returns a [ControlFunc] marking the packets sent from the sockets
+// with dscp, so that the network could prioritize them according to its QoS
+// policies.  It sets the IP_TOS or the IPV6_TCLASS socket option depending on
+// the network.  See [DSCPSupported].
+func DSCPControl(dscp uint8) (f ControlFunc) {
+	return func(network, _ string, c syscall.RawConn) (err error) {
+		err = ValidateDSCP(dscp)
+		if err != nil {
+			return fmt.Errorf("dscp: %w", err)
+		}
+
+		// The DSCP takes the upper six bits of the traffic class octet, see
+		// RFC 2474 Section 3.
+		return setTrafficClass(network, int(dscp)<<2, c)
+	}
+}
+
+// ValidateDSCP returns an error if dscp isn't a valid Differentiated Services
+// Code Point or can't be set on this OS.  Zero is always valid, since it means
+// not to mark the packets.
+func ValidateDSCP(dscp uint8) (err error) {
+	switch {
+	case dscp == 0:
+		return nil
+	case dscp > MaxDSCP:
+		return fmt.Errorf("value %d is greater than %d", dscp, MaxDSCP)
+	case !DSCPSupported:
+		return errors.Error("marking packets with dscp is not supported")
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,47 @@
+//go:build unix
+
+package netutil
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"golang.org/x/sys/unix"
+)
+
+// DSCPSupported is true if the packets sent from the sockets may be marked
+// with a DSCP.
+const DSCPSupported = true
+
+// setTrafficClass sets the IP_TOS or the IPV6_TCLASS socket option on c to tc
+// depending on network.  The IPv6 sockets also get IP_TOS, where possible, so
+// that the IPv4 traffic of the dual-stack sockets is marked as well.
+func setTrafficClass(network string, tc int, c syscall.RawConn) (err error) {
+	isIPv6 := strings.HasSuffix(network, "6")
+
+	var opErr error
+	err = c.Control(func(fd uintptr) {
+		if !isIPv6 {
+			opErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_TOS, tc)
+			if opErr != nil {
+				opErr = fmt.Errorf("setting IP_TOS: %w", opErr)
+			}
+
+			return
+		}
+
+		opErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_TCLASS, tc)
+		if opErr != nil {
+			opErr = fmt.Errorf("setting IPV6_TCLASS: %w", opErr)
+
+			return
+		}
+
+		// Not every OS allows it for the IPv6 sockets, so ignore the errors.
+		_ = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_TOS, tc)
+	})
+
+	return errors.WithDeferred(opErr, err)
+}
@@ -0,0 +1,19 @@
+//go:build windows
+
+package netutil
+
+import (
+	"syscall"
+
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// DSCPSupported is false on Windows, because it ignores the IP_TOS socket
+// option and only allows marking the packets using the QoS policies.
+const DSCPSupported = false
+
+// setTrafficClass returns an error, since marking the packets isn't supported
+// on Windows.
+func setTrafficClass(_ string, _ int, _ syscall.RawConn) (err error) {
+	return errors.Error("marking packets with dscp is not supported")
+}
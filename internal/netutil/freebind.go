@@ -0,0 +1,13 @@
+package netutil
+
+import (
+	"syscall"
+)
+
+// FreeBindControl is a [net.ListenConfig.Control] function allowing the sockets
+// to be bound to the addresses not assigned to any interface yet, such as the
+// virtual addresses moving between the hosts on failover.  See
+// [FreeBindSupported].
+func FreeBindControl(network, _ string, c syscall.RawConn) (err error) {
+	return setFreeBind(network, c)
+}
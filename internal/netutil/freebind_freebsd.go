@@ -0,0 +1,35 @@
+//go:build freebsd
+
+package netutil
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"golang.org/x/sys/unix"
+)
+
+// FreeBindSupported is true if the sockets may be bound to the non-local
+// addresses.
+const FreeBindSupported = true
+
+// setFreeBind sets the IP_BINDANY or the IPV6_BINDANY socket option on c
+// depending on network.  It requires the PRIV_NETINET_BINDANY privilege.
+func setFreeBind(network string, c syscall.RawConn) (err error) {
+	level, opt, optName := unix.IPPROTO_IP, unix.IP_BINDANY, "IP_BINDANY"
+	if strings.HasSuffix(network, "6") {
+		level, opt, optName = unix.IPPROTO_IPV6, unix.IPV6_BINDANY, "IPV6_BINDANY"
+	}
+
+	var opErr error
+	err = c.Control(func(fd uintptr) {
+		opErr = unix.SetsockoptInt(int(fd), level, opt, 1)
+		if opErr != nil {
+			opErr = fmt.Errorf("setting %s: %w", optName, opErr)
+		}
+	})
+
+	return errors.WithDeferred(opErr, err)
+}
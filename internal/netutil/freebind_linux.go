@@ -0,0 +1,30 @@
+//go:build linux
+
+package netutil
+
+import (
+	"fmt"
+	"syscall"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"golang.org/x/sys/unix"
+)
+
+// FreeBindSupported is true if the sockets may be bound to the non-local
+// addresses.
+const FreeBindSupported = true
+
+// setFreeBind sets the IP_FREEBIND socket option on c.  The IPv6 sockets
+// respect it as well, and unlike IPV6_FREEBIND, it's supported by the older
+// kernels.
+func setFreeBind(_ string, c syscall.RawConn) (err error) {
+	var opErr error
+	err = c.Control(func(fd uintptr) {
+		opErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_FREEBIND, 1)
+		if opErr != nil {
+			opErr = fmt.Errorf("setting IP_FREEBIND: %w", opErr)
+		}
+	})
+
+	return errors.WithDeferred(opErr, err)
+}
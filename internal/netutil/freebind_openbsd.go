@@ -0,0 +1,29 @@
+//go:build openbsd
+
+package netutil
+
+import (
+	"fmt"
+	"syscall"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"golang.org/x/sys/unix"
+)
+
+// FreeBindSupported is true if the sockets may be bound to the non-local
+// addresses.
+const FreeBindSupported = true
+
+// setFreeBind sets the SO_BINDANY socket option on c.  It requires the root
+// privileges.
+func setFreeBind(_ string, c syscall.RawConn) (err error) {
+	var opErr error
+	err = c.Control(func(fd uintptr) {
+		opErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_BINDANY, 1)
+		if opErr != nil {
+			opErr = fmt.Errorf("setting SO_BINDANY: %w", opErr)
+		}
+	})
+
+	return errors.WithDeferred(opErr, err)
+}
@@ -0,0 +1,19 @@
+//go:build !linux && !freebsd && !openbsd
+
+package netutil
+
+import (
+	"syscall"
+
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// FreeBindSupported is true if the sockets may be bound to the non-local
+// addresses.
+const FreeBindSupported = false
+
+// setFreeBind returns an error, since binding the sockets to the non-local
+// addresses isn't supported on this OS.
+func setFreeBind(_ string, _ syscall.RawConn) (err error) {
+	return errors.Error("binding to non-local addresses is not supported")
+}
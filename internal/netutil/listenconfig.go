@@ -1,9 +1,14 @@
 package netutil
 
-import "net"
+import (
+	"log/slog"
+	"net"
+	"syscall"
+)
 
 // ListenConfig returns the default [net.ListenConfig] used by the plain-DNS
-// servers in this module.
+// servers in this module.  l is used to log the socket option warnings and must
+// not be nil.
 //
 // TODO(a.garipov): Add tests.
 //
@@ -13,8 +18,39 @@ import "net"
 // See https://github.com/AdguardTeam/AdGuardHome/issues/5872.
 //
 // TODO(a.garipov): DRY with AdGuard DNS when we can.
-func ListenConfig() (lc *net.ListenConfig) {
+func ListenConfig(l *slog.Logger) (lc *net.ListenConfig) {
 	return &net.ListenConfig{
-		Control: defaultListenControl,
+		Control: newListenControl(l),
+	}
+}
+
+// ControlFunc is the function called after creating a socket but before
+// binding or dialing it, see [net.ListenConfig.Control] and
+// [net.Dialer.Control].
+type ControlFunc = func(network, address string, c syscall.RawConn) (err error)
+
+// AddControl makes lc call f after its current [net.ListenConfig.Control]
+// function, if any, succeeds.
+func AddControl(lc *net.ListenConfig, f ControlFunc) {
+	lc.Control = ChainControl(lc.Control, f)
+}
+
+// ChainControl returns the function calling f and then g, if f succeeds.
+// Either of them may be nil.
+func ChainControl(f, g ControlFunc) (h ControlFunc) {
+	switch {
+	case f == nil:
+		return g
+	case g == nil:
+		return f
+	default:
+		return func(network, address string, c syscall.RawConn) (err error) {
+			err = f(network, address, c)
+			if err != nil {
+				return err
+			}
+
+			return g(network, address, c)
+		}
 	}
 }
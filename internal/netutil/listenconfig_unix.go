@@ -4,17 +4,29 @@ package netutil
 
 import (
 	"fmt"
+	"log/slog"
 	"syscall"
 
 	"github.com/AdguardTeam/golibs/errors"
-	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
 	"golang.org/x/sys/unix"
 )
 
-// defaultListenControl is used as a [net.ListenConfig.Control] function to set
-// the SO_REUSEADDR and SO_REUSEPORT socket options on all sockets used by the
-// DNS servers in this module.
-func defaultListenControl(_, _ string, c syscall.RawConn) (err error) {
+// ReusePortSupported is true if the sockets may share the listen address using
+// SO_REUSEPORT.
+const ReusePortSupported = true
+
+// newListenControl returns a [net.ListenConfig.Control] function setting the
+// SO_REUSEADDR and SO_REUSEPORT socket options on all sockets used by the DNS
+// servers in this module.  l is used to log the warnings.
+func newListenControl(l *slog.Logger) (f func(_, _ string, c syscall.RawConn) (err error)) {
+	return func(_, _ string, c syscall.RawConn) (err error) {
+		return listenControl(l, c)
+	}
+}
+
+// listenControl sets the SO_REUSEADDR and SO_REUSEPORT socket options on c.
+func listenControl(l *slog.Logger, c syscall.RawConn) (err error) {
 	var opErr error
 	err = c.Control(func(fd uintptr) {
 		opErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
@@ -29,7 +41,7 @@ func defaultListenControl(_, _ string, c syscall.RawConn) (err error) {
 			if errors.Is(opErr, unix.ENOPROTOOPT) {
 				// Some Linux OSs do not seem to support SO_REUSEPORT, including
 				// some varieties of OpenWrt.  Issue a warning.
-				log.Info("warning: SO_REUSEPORT not supported: %s", opErr)
+				l.Warn("SO_REUSEPORT not supported", slogutil.KeyError, opErr)
 				opErr = nil
 			} else {
 				opErr = fmt.Errorf("setting SO_REUSEPORT: %w", opErr)
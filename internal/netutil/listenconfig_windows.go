@@ -2,8 +2,17 @@
 
 package netutil
 
-import "syscall"
+import (
+	"log/slog"
+	"syscall"
+)
 
-// defaultListenControl is nil on Windows, because it doesn't support
+// ReusePortSupported is false on Windows, because it doesn't support
 // SO_REUSEPORT.
-var defaultListenControl func(_, _ string, _ syscall.RawConn) (_ error)
+const ReusePortSupported = false
+
+// newListenControl returns nil on Windows, because it doesn't support
+// SO_REUSEPORT.
+func newListenControl(_ *slog.Logger) (f func(_, _ string, _ syscall.RawConn) (_ error)) {
+	return nil
+}
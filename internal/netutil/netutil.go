@@ -6,6 +6,7 @@
 package netutil
 
 import (
+	"fmt"
 	"net/netip"
 	"strings"
 )
@@ -32,3 +33,37 @@ func ParseSubnet(s string) (p netip.Prefix, err error) {
 
 	return p, nil
 }
+
+// bufferSetter is implemented by the connections which sizes of the socket
+// buffers can be set, such as [*net.UDPConn] and [*net.TCPConn].
+type bufferSetter interface {
+	SetReadBuffer(bytes int) (err error)
+	SetWriteBuffer(bytes int) (err error)
+}
+
+// SetBufferSizes sets the sizes of the receive and the send buffers of the
+// socket of conn to recv and send bytes respectively.  The non-positive sizes
+// are left to the system default, as well as both sizes for the connections
+// not supporting it, such as the TLS ones.
+func SetBufferSizes(conn any, recv, send int) (err error) {
+	bs, ok := conn.(bufferSetter)
+	if !ok {
+		return nil
+	}
+
+	if recv > 0 {
+		err = bs.SetReadBuffer(recv)
+		if err != nil {
+			return fmt.Errorf("setting receive buffer size: %w", err)
+		}
+	}
+
+	if send > 0 {
+		err = bs.SetWriteBuffer(send)
+		if err != nil {
+			return fmt.Errorf("setting send buffer size: %w", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,34 @@
+package netutil
+
+import (
+	"log/slog"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// tfoQueueLen is the maximum number of the pending TCP Fast Open requests of a
+// listening socket, i.e. the ones which data has been received, but the
+// handshake hasn't been completed yet.
+const tfoQueueLen = 256
+
+// AddFastOpenControl makes lc enable TCP Fast Open on the listening sockets if
+// the OS supports it.  l is used to log the socket option warnings and must not
+// be nil.
+func AddFastOpenControl(l *slog.Logger, lc *net.ListenConfig) {
+	AddControl(lc, func(_, _ string, c syscall.RawConn) (err error) {
+		return listenFastOpen(l, c)
+	})
+}
+
+// FastOpenControl is a [net.Dialer.Control] function enabling TCP Fast Open on
+// the outgoing TCP connections, if the OS supports it, so that the data of the
+// first write is sent within the SYN for the servers the connection has already
+// been established to.  It ignores the other networks.
+func FastOpenControl(network, _ string, c syscall.RawConn) (err error) {
+	if !strings.HasPrefix(network, "tcp") {
+		return nil
+	}
+
+	return connectFastOpen(c)
+}
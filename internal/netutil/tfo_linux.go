@@ -0,0 +1,48 @@
+//go:build linux
+
+package netutil
+
+import (
+	"fmt"
+	"log/slog"
+	"syscall"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"golang.org/x/sys/unix"
+)
+
+// listenFastOpen sets the TCP_FASTOPEN socket option on c.  The kernel may
+// still reject the Fast Open requests, unless the server side of it is enabled
+// by the net.ipv4.tcp_fastopen sysctl.
+func listenFastOpen(l *slog.Logger, c syscall.RawConn) (err error) {
+	var opErr error
+	err = c.Control(func(fd uintptr) {
+		opErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_FASTOPEN, tfoQueueLen)
+		if errors.Is(opErr, unix.ENOPROTOOPT) {
+			l.Warn("TCP_FASTOPEN not supported", slogutil.KeyError, opErr)
+			opErr = nil
+		} else if opErr != nil {
+			opErr = fmt.Errorf("setting TCP_FASTOPEN: %w", opErr)
+		}
+	})
+
+	return errors.WithDeferred(opErr, err)
+}
+
+// connectFastOpen sets the TCP_FASTOPEN_CONNECT socket option on c.  The
+// kernels not supporting it are ignored, so that the connections are
+// established as usual.
+func connectFastOpen(c syscall.RawConn) (err error) {
+	var opErr error
+	err = c.Control(func(fd uintptr) {
+		opErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_FASTOPEN_CONNECT, 1)
+		if errors.Is(opErr, unix.ENOPROTOOPT) {
+			opErr = nil
+		} else if opErr != nil {
+			opErr = fmt.Errorf("setting TCP_FASTOPEN_CONNECT: %w", opErr)
+		}
+	})
+
+	return errors.WithDeferred(opErr, err)
+}
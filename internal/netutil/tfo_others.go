@@ -0,0 +1,18 @@
+//go:build !linux
+
+package netutil
+
+import (
+	"log/slog"
+	"syscall"
+)
+
+// listenFastOpen does nothing, since TCP Fast Open is only supported on Linux.
+func listenFastOpen(_ *slog.Logger, _ syscall.RawConn) (err error) {
+	return nil
+}
+
+// connectFastOpen does nothing, since TCP Fast Open is only supported on Linux.
+func connectFastOpen(_ syscall.RawConn) (err error) {
+	return nil
+}
@@ -0,0 +1,43 @@
+package netutil
+
+import (
+	"net"
+	"net/netip"
+	"syscall"
+)
+
+// TransparentControl is a [ControlFunc] allowing the listening sockets to
+// accept the traffic intercepted with TPROXY, which is addressed to arbitrary
+// destinations, and makes the UDP ones receive the original destinations of
+// the datagrams, see [UDPReadOrigDst].  It requires the CAP_NET_ADMIN
+// capability.  See [TransparentSupported].
+func TransparentControl(network, _ string, c syscall.RawConn) (err error) {
+	return setTransparent(network, c)
+}
+
+// UDPOrigDstOOBSize returns the size of the OOB data containing the original
+// destination of a datagram, which should be added to [UDPGetOOBSize] when
+// reading from the sockets set up by [TransparentControl].
+func UDPOrigDstOOBSize() (oobSize int) {
+	return udpOrigDstOOBSize()
+}
+
+// UDPReadOrigDst is like [UDPRead] for the sockets set up by
+// [TransparentControl], but returns the original destination of the message,
+// including the port, instead of the local IP address.  origDst is invalid if
+// the OOB data doesn't contain it.
+func UDPReadOrigDst(
+	conn *net.UDPConn,
+	buf []byte,
+	oobSize int,
+) (n int, origDst netip.AddrPort, remoteAddr *net.UDPAddr, err error) {
+	return udpReadOrigDst(conn, buf, oobSize)
+}
+
+// UDPWriteFrom writes data to remoteAddr from src, which may be not assigned to
+// any interface, such as the original destination of an intercepted datagram
+// returned by [UDPReadOrigDst].  It uses a new transparent socket bound to src,
+// so it should only be used when the listening socket can't write from src.
+func UDPWriteFrom(data []byte, src netip.AddrPort, remoteAddr *net.UDPAddr) (err error) {
+	return udpWriteFrom(data, src, remoteAddr)
+}
@@ -0,0 +1,194 @@
+//go:build linux
+
+package netutil
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"syscall"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"golang.org/x/sys/unix"
+)
+
+// TransparentSupported is true if the listening sockets may accept the traffic
+// intercepted with TPROXY.
+const TransparentSupported = true
+
+// setTransparent sets the IP_TRANSPARENT and, for the IPv6 sockets, the
+// IPV6_TRANSPARENT socket options on c.  For the UDP sockets, it also sets
+// IP_RECVORIGDSTADDR and IPV6_RECVORIGDSTADDR respectively.  The IPv4 options
+// are set on the IPv6 sockets as well, so that the IPv4 traffic of the
+// dual-stack sockets is handled.
+func setTransparent(network string, c syscall.RawConn) (err error) {
+	isUDP := strings.HasPrefix(network, "udp")
+	isIPv6 := strings.HasSuffix(network, "6")
+
+	var opErr error
+	err = c.Control(func(fd uintptr) {
+		opErr = setTransparentFD(int(fd), isIPv6)
+		if opErr != nil || !isUDP {
+			return
+		}
+
+		opErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_RECVORIGDSTADDR, 1)
+		if opErr != nil {
+			opErr = fmt.Errorf("setting IP_RECVORIGDSTADDR: %w", opErr)
+
+			return
+		}
+
+		if isIPv6 {
+			opErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_RECVORIGDSTADDR, 1)
+			if opErr != nil {
+				opErr = fmt.Errorf("setting IPV6_RECVORIGDSTADDR: %w", opErr)
+			}
+		}
+	})
+
+	return errors.WithDeferred(opErr, err)
+}
+
+// setTransparentFD sets the IP_TRANSPARENT and, if isIPv6 is true, the
+// IPV6_TRANSPARENT socket options on fd.
+func setTransparentFD(fd int, isIPv6 bool) (err error) {
+	err = unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_TRANSPARENT, 1)
+	if err != nil {
+		return fmt.Errorf("setting IP_TRANSPARENT: %w", err)
+	}
+
+	if !isIPv6 {
+		return nil
+	}
+
+	err = unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_TRANSPARENT, 1)
+	if err != nil {
+		return fmt.Errorf("setting IPV6_TRANSPARENT: %w", err)
+	}
+
+	return nil
+}
+
+// udpOrigDstOOBSize returns the size of the control message containing the
+// original destination of either IP version.
+func udpOrigDstOOBSize() (oobSize int) {
+	return unix.CmsgSpace(unix.SizeofSockaddrInet6)
+}
+
+// udpReadOrigDst reads the message from c and parses its original destination
+// from the OOB data.
+func udpReadOrigDst(
+	c *net.UDPConn,
+	buf []byte,
+	oobSize int,
+) (n int, origDst netip.AddrPort, remoteAddr *net.UDPAddr, err error) {
+	var oobn int
+	oob := make([]byte, oobSize)
+	n, oobn, _, remoteAddr, err = c.ReadMsgUDP(buf, oob)
+	if err != nil {
+		return -1, netip.AddrPort{}, nil, err
+	}
+
+	origDst, err = parseOrigDst(oob[:oobn])
+	if errors.Is(err, errNoOrigDst) {
+		// Don't stop reading because of a single datagram, e.g. the one read
+		// before the option has been set.
+		return n, netip.AddrPort{}, remoteAddr, nil
+	} else if err != nil {
+		return -1, netip.AddrPort{}, nil, err
+	}
+
+	return n, origDst, remoteAddr, nil
+}
+
+// errNoOrigDst is returned when the OOB data doesn't contain the original
+// destination.
+const errNoOrigDst errors.Error = "no original destination in oob data"
+
+// parseOrigDst returns the original destination from the IP_ORIGDSTADDR or the
+// IPV6_ORIGDSTADDR control message in oob.  The addresses are encoded as
+// sockaddr_in and sockaddr_in6 respectively, which keep the port and the
+// address in the network byte order.
+func parseOrigDst(oob []byte) (dst netip.AddrPort, err error) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("parsing oob: %w", err)
+	}
+
+	for _, m := range msgs {
+		data := m.Data
+		switch {
+		case
+			m.Header.Level == unix.IPPROTO_IP &&
+				m.Header.Type == unix.IP_ORIGDSTADDR &&
+				len(data) >= unix.SizeofSockaddrInet4:
+			addr := netip.AddrFrom4([4]byte(data[4:8]))
+
+			return netip.AddrPortFrom(addr, binary.BigEndian.Uint16(data[2:4])), nil
+		case
+			m.Header.Level == unix.IPPROTO_IPV6 &&
+				m.Header.Type == unix.IPV6_ORIGDSTADDR &&
+				len(data) >= unix.SizeofSockaddrInet6:
+			addr := netip.AddrFrom16([16]byte(data[8:24])).Unmap()
+
+			return netip.AddrPortFrom(addr, binary.BigEndian.Uint16(data[2:4])), nil
+		default:
+			// Go on.
+		}
+	}
+
+	return netip.AddrPort{}, errNoOrigDst
+}
+
+// udpWriteFrom writes data to remoteAddr from a new transparent socket bound to
+// src.  The socket shares the address with the others using SO_REUSEADDR and
+// SO_REUSEPORT.
+func udpWriteFrom(data []byte, src netip.AddrPort, remoteAddr *net.UDPAddr) (err error) {
+	network := "udp6"
+	if src.Addr().Is4() {
+		network = "udp4"
+	}
+
+	lc := &net.ListenConfig{
+		Control: func(_, _ string, c syscall.RawConn) (err error) {
+			var opErr error
+			err = c.Control(func(fd uintptr) {
+				opErr = setTransparentFD(int(fd), network == "udp6")
+				if opErr != nil {
+					return
+				}
+
+				opErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
+				if opErr != nil {
+					opErr = fmt.Errorf("setting SO_REUSEADDR: %w", opErr)
+
+					return
+				}
+
+				opErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+				if opErr != nil {
+					opErr = fmt.Errorf("setting SO_REUSEPORT: %w", opErr)
+				}
+			})
+
+			return errors.WithDeferred(opErr, err)
+		},
+	}
+
+	conn, err := lc.ListenPacket(context.Background(), network, src.String())
+	if err != nil {
+		return fmt.Errorf("binding to %s: %w", src, err)
+	}
+	defer func() { err = errors.WithDeferred(err, conn.Close()) }()
+
+	_, err = conn.WriteTo(data, remoteAddr)
+	if err != nil {
+		return fmt.Errorf("writing: %w", err)
+	}
+
+	return nil
+}
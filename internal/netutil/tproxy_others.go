@@ -0,0 +1,43 @@
+//go:build !linux
+
+package netutil
+
+import (
+	"net"
+	"net/netip"
+	"syscall"
+
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// TransparentSupported is true if the listening sockets may accept the traffic
+// intercepted with TPROXY.
+const TransparentSupported = false
+
+// errTransparentUnsupported is returned by the functions of the transparent
+// mode on the OSs not supporting it.
+const errTransparentUnsupported errors.Error = "transparent mode is not supported"
+
+// setTransparent returns an error, since TPROXY is only supported on Linux.
+func setTransparent(_ string, _ syscall.RawConn) (err error) {
+	return errTransparentUnsupported
+}
+
+// udpOrigDstOOBSize returns zero, since TPROXY is only supported on Linux.
+func udpOrigDstOOBSize() (oobSize int) {
+	return 0
+}
+
+// udpReadOrigDst returns an error, since TPROXY is only supported on Linux.
+func udpReadOrigDst(
+	_ *net.UDPConn,
+	_ []byte,
+	_ int,
+) (n int, origDst netip.AddrPort, remoteAddr *net.UDPAddr, err error) {
+	return -1, netip.AddrPort{}, nil, errTransparentUnsupported
+}
+
+// udpWriteFrom returns an error, since TPROXY is only supported on Linux.
+func udpWriteFrom(_ []byte, _ netip.AddrPort, _ *net.UDPAddr) (err error) {
+	return errTransparentUnsupported
+}
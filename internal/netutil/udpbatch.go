@@ -0,0 +1,81 @@
+package netutil
+
+import (
+	"net"
+	"net/netip"
+)
+
+// UDPBatchSize is the maximum number of messages read or written by a single
+// call of the [UDPBatchConn] methods.
+const UDPBatchSize = 16
+
+// UDPMessage is a UDP message read or written by [UDPBatchConn].
+type UDPMessage struct {
+	// RemoteAddr is the address of the remote peer.
+	RemoteAddr *net.UDPAddr
+
+	// Buf is the data of the written message.  For the read message it's the
+	// buffer to read into, the first N bytes of which are set to the data.
+	Buf []byte
+
+	// LocalIP is the destination address of the read message or the source
+	// address of the written one.  It's invalid if unknown.
+	LocalIP netip.Addr
+
+	// N is the length of the data of the read message.
+	N int
+
+	// SegmentSize is the size of the datagrams coalesced into the read message
+	// by the generic receive offload.  If positive, the data of the message
+	// consists of the datagrams of this size, the last of which may be
+	// shorter.  Use [UDPMessage.Datagrams] to split those.
+	SegmentSize int
+}
+
+// Datagrams returns the datagrams of the read message m.
+func (m *UDPMessage) Datagrams() (dgs [][]byte) {
+	data := m.Buf[:m.N]
+	size := m.SegmentSize
+	if size <= 0 || size >= len(data) {
+		return [][]byte{data}
+	}
+
+	dgs = make([][]byte, 0, (len(data)+size-1)/size)
+	for len(data) > 0 {
+		l := min(size, len(data))
+		dgs = append(dgs, data[:l])
+		data = data[l:]
+	}
+
+	return dgs
+}
+
+// UDPBatchConn reads and writes the UDP messages in batches, so that multiple
+// messages are transferred by a single system call.  It may also use the UDP
+// segmentation and receive offloads, see [UDPMessage.SegmentSize].  Reading and writing may
+// be done concurrently, but each of them must only be done by a single
+// goroutine at a time.
+type UDPBatchConn interface {
+	// ReadBatch reads at most len(msgs) messages into msgs, blocking until at
+	// least one message is read.  It returns the number of read messages.
+	ReadBatch(msgs []UDPMessage) (n int, err error)
+
+	// WriteBatch writes at most len(msgs) messages from msgs.  It returns the
+	// number of written messages, and if it's less than len(msgs), err is the
+	// error of writing the message at n.
+	WriteBatch(msgs []UDPMessage) (n int, err error)
+}
+
+// NewUDPBatchConn returns the [UDPBatchConn] using conn, which must be
+// configured with [UDPSetOptions], and the control-message payload of size
+// udpOOBSize.  ok is false if the batch I/O isn't supported on the platform, so
+// the messages should be read and written one by one.
+func NewUDPBatchConn(conn *net.UDPConn, udpOOBSize int) (c UDPBatchConn, ok bool) {
+	return newUDPBatchConn(conn, udpOOBSize)
+}
+
+// UDPSegmentationSupported returns true if the kernel supports the UDP generic
+// segmentation offload for conn.
+func UDPSegmentationSupported(conn *net.UDPConn) (ok bool) {
+	return udpSegmentationSupported(conn)
+}
@@ -0,0 +1,314 @@
+//go:build linux
+
+package netutil
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// maxGSOSegments is the maximum number of datagrams sent by a single
+	// message using the segmentation offload.  It's the UDP_MAX_SEGMENTS of
+	// the older kernels.
+	maxGSOSegments = 64
+
+	// maxGSOPayload is the maximum total size of the datagrams sent by a
+	// single message using the segmentation offload.  It's the maximum size
+	// of an IP packet without the IPv6 and UDP headers.
+	maxGSOPayload = 0xffff - 40 - 8
+
+	// maxGSOSegmentSize is the maximum size of the datagrams sent using the
+	// segmentation offload, since each of them must fit the path MTU.  It's
+	// the maximum size of the UDP payload fitting the minimum IPv6 MTU.
+	maxGSOSegmentSize = 1280 - 40 - 8
+
+	// segmentSizeLen is the size of the UDP_GRO and UDP_SEGMENT control
+	// messages payloads.  The kernel receives the uint16 segment size and
+	// sends the int one, so the latter is used to allocate the buffers.
+	segmentSizeLen = 4
+)
+
+// mmsgConn is the [UDPBatchConn] using the recvmmsg and sendmmsg system calls.
+// Those don't depend on the address family of the socket, so the IPv4 API is
+// used for both IPv4 and IPv6 sockets.
+//
+// If the kernel supports it, the UDP generic receive offload is enabled on the
+// socket, so that the datagrams of the same flow may be read as a single
+// message, and the consecutive written datagrams of the same size and
+// destination are sent as a single message using the generic segmentation
+// offload.
+type mmsgConn struct {
+	// pc is used to make the system calls.
+	pc *ipv4.PacketConn
+
+	// readMsgs are reused by ReadBatch.
+	readMsgs []ipv4.Message
+
+	// writeMsgs are reused by WriteBatch.
+	writeMsgs []ipv4.Message
+
+	// writeSegs are the numbers of the datagrams sent by the corresponding
+	// writeMsgs.
+	writeSegs []int
+
+	// gro is true if the generic receive offload is enabled.
+	gro bool
+
+	// gso is true if the generic segmentation offload is supported.  It's
+	// reset if the device turns out not to support it.  It's only accessed by
+	// WriteBatch.
+	gso bool
+}
+
+// newUDPBatchConn returns a new *mmsgConn for conn.
+func newUDPBatchConn(conn *net.UDPConn, udpOOBSize int) (c UDPBatchConn, ok bool) {
+	gro, gso := setOffload(conn)
+
+	mc := &mmsgConn{
+		pc:        ipv4.NewPacketConn(conn),
+		readMsgs:  make([]ipv4.Message, UDPBatchSize),
+		writeMsgs: make([]ipv4.Message, UDPBatchSize),
+		writeSegs: make([]int, UDPBatchSize),
+		gro:       gro,
+		gso:       gso,
+	}
+
+	oobSize := udpOOBSize
+	if gro {
+		oobSize += unix.CmsgSpace(segmentSizeLen)
+	}
+
+	for i := range mc.readMsgs {
+		mc.readMsgs[i].Buffers = make([][]byte, 1)
+		mc.readMsgs[i].OOB = make([]byte, oobSize)
+	}
+
+	return mc, true
+}
+
+// setOffload enables the generic receive offload on conn and checks if the
+// generic segmentation offload is supported.  The errors are ignored, since
+// those only mean that the kernel doesn't support the offloads.
+func setOffload(conn *net.UDPConn) (gro, gso bool) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return false, false
+	}
+
+	_ = rc.Control(func(fd uintptr) {
+		gro = unix.SetsockoptInt(int(fd), unix.IPPROTO_UDP, unix.UDP_GRO, 1) == nil
+	})
+
+	return gro, udpSegmentationSupported(conn)
+}
+
+// udpSegmentationSupported checks if the UDP_SEGMENT socket option is
+// supported for conn.
+func udpSegmentationSupported(conn *net.UDPConn) (ok bool) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return false
+	}
+
+	_ = rc.Control(func(fd uintptr) {
+		_, err = unix.GetsockoptInt(int(fd), unix.IPPROTO_UDP, unix.UDP_SEGMENT)
+		ok = err == nil
+	})
+
+	return ok
+}
+
+// type check
+var _ UDPBatchConn = (*mmsgConn)(nil)
+
+// ReadBatch implements the [UDPBatchConn] interface for *mmsgConn.
+func (c *mmsgConn) ReadBatch(msgs []UDPMessage) (n int, err error) {
+	rms := c.readMsgs[:min(len(msgs), len(c.readMsgs))]
+	for i := range rms {
+		rms[i].Buffers[0] = msgs[i].Buf
+		rms[i].OOB = rms[i].OOB[:cap(rms[i].OOB)]
+	}
+
+	n, err = c.pc.ReadBatch(rms, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	for i, rm := range rms[:n] {
+		msg := &msgs[i]
+		msg.N = rm.N
+		oob := rm.OOB[:rm.NN]
+		msg.LocalIP, err = udpGetDstFromOOB(oob)
+		if err != nil {
+			return i, fmt.Errorf("message at index %d: %w", i, err)
+		}
+
+		msg.SegmentSize = 0
+		if c.gro {
+			msg.SegmentSize = segmentSizeFromOOB(oob)
+		}
+
+		msg.RemoteAddr, _ = rm.Addr.(*net.UDPAddr)
+	}
+
+	return n, nil
+}
+
+// segmentSizeFromOOB returns the size of the datagrams coalesced by the
+// generic receive offload from the UDP_GRO control message in oob.  It returns
+// zero if there is no such message.
+func segmentSizeFromOOB(oob []byte) (size int) {
+	cmsgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0
+	}
+
+	for _, cmsg := range cmsgs {
+		h := cmsg.Header
+		if h.Level == unix.SOL_UDP && h.Type == unix.UDP_GRO && len(cmsg.Data) >= segmentSizeLen {
+			return int(binary.NativeEndian.Uint32(cmsg.Data))
+		}
+	}
+
+	return 0
+}
+
+// WriteBatch implements the [UDPBatchConn] interface for *mmsgConn.
+func (c *mmsgConn) WriteBatch(msgs []UDPMessage) (n int, err error) {
+	wms, segs := c.pack(msgs)
+
+	var sent int
+	for sent < len(wms) {
+		var written int
+		written, err = c.pc.WriteBatch(wms[sent:], 0)
+		for _, s := range segs[sent : sent+written] {
+			n += s
+		}
+
+		sent += written
+		if err != nil {
+			break
+		} else if written == 0 {
+			return n, io.ErrShortWrite
+		}
+	}
+
+	if err == nil {
+		return n, nil
+	}
+
+	if segs[sent] > 1 && errors.Is(err, syscall.EIO) {
+		// The device doesn't support the segmentation offload, so disable it
+		// and retry the rest one by one.
+		c.gso = false
+
+		var retried int
+		retried, err = c.WriteBatch(msgs[n:])
+
+		return n + retried, err
+	}
+
+	return n, err
+}
+
+// pack fills the messages to write from msgs, coalescing the datagrams where
+// possible, and returns those with the numbers of the datagrams in each.
+func (c *mmsgConn) pack(msgs []UDPMessage) (wms []ipv4.Message, segs []int) {
+	wms, segs = c.writeMsgs[:0], c.writeSegs[:0]
+	for i := 0; i < len(msgs) && len(wms) < cap(wms); {
+		msg := &msgs[i]
+
+		k := 1
+		if c.gso {
+			k = coalescable(msgs[i:])
+		}
+
+		wm := ipv4.Message{
+			Buffers: make([][]byte, 0, k),
+			OOB:     udpMakeOOBWithSrc(msg.LocalIP),
+			Addr:    msg.RemoteAddr,
+		}
+
+		for _, m := range msgs[i : i+k] {
+			wm.Buffers = append(wm.Buffers, m.Buf)
+		}
+
+		if k > 1 {
+			wm.OOB = appendSegmentSize(wm.OOB, len(msg.Buf))
+		}
+
+		wms = append(wms, wm)
+		segs = append(segs, k)
+		i += k
+	}
+
+	return wms, segs
+}
+
+// coalescable returns the number of the datagrams at the beginning of msgs that
+// may be sent as a single message using the segmentation offload.  Those have
+// the same addresses and the same size, except for the last one, which may be
+// shorter.
+func coalescable(msgs []UDPMessage) (k int) {
+	first := &msgs[0]
+	size := len(first.Buf)
+	if size == 0 || size > maxGSOSegmentSize {
+		return 1
+	}
+
+	total := size
+	for k = 1; k < len(msgs) && k < maxGSOSegments; k++ {
+		msg := &msgs[k]
+		l := len(msg.Buf)
+		if l == 0 || l > size || total+l > maxGSOPayload || !sameAddrs(first, msg) {
+			break
+		}
+
+		total += l
+		if l < size {
+			return k + 1
+		}
+	}
+
+	return k
+}
+
+// sameAddrs returns true if a and b have the same source and destination.
+func sameAddrs(a, b *UDPMessage) (ok bool) {
+	if a.LocalIP != b.LocalIP || a.RemoteAddr == nil || b.RemoteAddr == nil {
+		return false
+	}
+
+	return a.RemoteAddr.AddrPort() == b.RemoteAddr.AddrPort()
+}
+
+// appendSegmentSize appends the UDP_SEGMENT control message with size to oob.
+func appendSegmentSize(oob []byte, size int) (res []byte) {
+	start := len(oob)
+	res = append(oob, make([]byte, unix.CmsgSpace(2))...)
+	h := res[start:]
+
+	// The layout is the one of [unix.Cmsghdr], the length of which depends on
+	// the architecture.
+	l := unix.CmsgLen(2)
+	if unix.SizeofCmsghdr == 16 {
+		binary.NativeEndian.PutUint64(h, uint64(l))
+	} else {
+		binary.NativeEndian.PutUint32(h, uint32(l))
+	}
+
+	lenSize := unix.SizeofCmsghdr - 8
+	binary.NativeEndian.PutUint32(h[lenSize:], uint32(unix.IPPROTO_UDP))
+	binary.NativeEndian.PutUint32(h[lenSize+4:], uint32(unix.UDP_SEGMENT))
+	binary.NativeEndian.PutUint16(h[unix.SizeofCmsghdr:], uint16(size))
+
+	return res
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+
+package netutil
+
+import "net"
+
+// newUDPBatchConn returns false, since the batch I/O is only supported on
+// Linux.
+func newUDPBatchConn(_ *net.UDPConn, _ int) (c UDPBatchConn, ok bool) {
+	return nil, false
+}
+
+// udpSegmentationSupported returns false, since the segmentation offload is
+// only supported on Linux.
+func udpSegmentationSupported(_ *net.UDPConn) (ok bool) {
+	return false
+}
@@ -0,0 +1,321 @@
+// Package plugin implements the hook asking external programs for a verdict
+// about each DNS query.
+//
+// A plugin is a long-running program reading the queries from its standard
+// input and writing the verdicts to its standard output, one JSON object per
+// line.  A query looks like:
+//
+//	{"qname":"example.com.","qtype":1,"client":"192.0.2.1","protocol":"udp"}
+//
+// And a verdict looks like:
+//
+//	{"action":"rewrite","addresses":["192.0.2.2"],"ttl":60,"cache_ttl":300}
+//
+// The action is one of allow, deny, rewrite, or redirect, in which case the
+// target field contains the domain name to resolve instead.  If cache_ttl is
+// positive, the verdict is used for the queries with the same name and type
+// for that many seconds without asking the plugin.
+package plugin
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/internal/verdict"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/bluele/gcache"
+	"github.com/miekg/dns"
+)
+
+// Default values of the configuration.
+const (
+	DefaultWorkers   = 4
+	DefaultTimeout   = 1 * time.Second
+	DefaultCacheSize = 1000
+)
+
+// errNoCommand is returned by [New] when the command is empty.
+const errNoCommand errors.Error = "no plugin command"
+
+// errTimeout is returned when the plugin doesn't respond in time.
+const errTimeout errors.Error = "plugin timed out"
+
+// Config is the configuration of a plugin.
+type Config struct {
+	// Logger is used to log the failed exchanges.  If nil, [slog.Default] is
+	// used.
+	Logger *slog.Logger
+
+	// Stderr receives the standard error of the plugin processes.  If nil, it's
+	// discarded.
+	Stderr io.Writer
+
+	// Command is the program to run and its arguments.  It must not be empty.
+	Command []string
+
+	// Workers is the number of the plugin processes handling the queries
+	// concurrently.  If zero, [DefaultWorkers] is used.
+	Workers int
+
+	// Timeout is the timeout of a single exchange with the plugin, including
+	// the waiting for a free worker.  If zero, [DefaultTimeout] is used.
+	Timeout time.Duration
+
+	// CacheSize is the maximum number of the cached verdicts.  If zero,
+	// [DefaultCacheSize] is used.
+	CacheSize int
+}
+
+// Plugin is the [proxy.BeforeRequestHandler] asking the external program for a
+// verdict about each query.  If the plugin fails or times out, the query is
+// resolved as usual.
+type Plugin struct {
+	// logger is used to log the failed exchanges.
+	logger *slog.Logger
+
+	// stderr receives the standard error of the plugin processes.
+	stderr io.Writer
+
+	// cache contains the verdicts by the query name and type.
+	cache gcache.Cache
+
+	// workers is the pool of the plugin processes.  A nil worker is started on
+	// demand.
+	workers chan *worker
+
+	// command is the program to run and its arguments.
+	command []string
+
+	// timeout is the timeout of a single exchange.
+	timeout time.Duration
+}
+
+// New returns a new properly initialized *Plugin.  The processes are started on
+// demand.  It should be closed with [Plugin.Close].
+func New(c *Config) (p *Plugin, err error) {
+	if len(c.Command) == 0 {
+		return nil, errNoCommand
+	}
+
+	n := cmp.Or(c.Workers, DefaultWorkers)
+	p = &Plugin{
+		logger:  cmp.Or(c.Logger, slog.Default()),
+		stderr:  c.Stderr,
+		cache:   gcache.New(cmp.Or(c.CacheSize, DefaultCacheSize)).LRU().Build(),
+		workers: make(chan *worker, n),
+		command: c.Command,
+		timeout: cmp.Or(c.Timeout, DefaultTimeout),
+	}
+
+	for range n {
+		p.workers <- nil
+	}
+
+	return p, nil
+}
+
+// query is a query sent to the plugin.
+type query struct {
+	QName      string `json:"qname"`
+	Client     string `json:"client"`
+	Protocol   string `json:"protocol"`
+	ServerName string `json:"server_name,omitempty"`
+	HTTPPath   string `json:"http_path,omitempty"`
+	HTTPUser   string `json:"http_user,omitempty"`
+	QType      uint16 `json:"qtype"`
+}
+
+// response is a verdict received from the plugin.
+type response struct {
+	Action    string   `json:"action"`
+	Target    string   `json:"target"`
+	Addresses []string `json:"addresses"`
+	TTL       uint32   `json:"ttl"`
+	CacheTTL  uint32   `json:"cache_ttl"`
+}
+
+// type check
+var _ proxy.BeforeRequestHandler = (*Plugin)(nil)
+
+// HandleBefore implements the [proxy.BeforeRequestHandler] interface for
+// *Plugin.
+func (p *Plugin) HandleBefore(prx *proxy.Proxy, dctx *proxy.DNSContext) (err error) {
+	if len(dctx.Req.Question) == 0 {
+		return nil
+	}
+
+	q := dctx.Req.Question[0]
+	qry := &query{
+		QName:      strings.ToLower(dns.Fqdn(q.Name)),
+		Client:     dctx.Addr.Addr().String(),
+		Protocol:   string(dctx.Proto),
+		ServerName: dctx.ServerName,
+		HTTPPath:   dctx.HTTPPath,
+		HTTPUser:   dctx.HTTPUser,
+		QType:      q.Qtype,
+	}
+
+	v, err := p.verdict(qry)
+	if err == nil {
+		err = v.Apply(prx, dctx)
+	}
+
+	if err == nil || errors.As(err, new(*proxy.BeforeRequestError)) {
+		return err
+	}
+
+	p.logger.Debug("asking plugin", "qname", qry.QName, slogutil.KeyError, err)
+
+	return nil
+}
+
+// verdict returns the verdict about qry, either the cached one or the one
+// received from the plugin.
+func (p *Plugin) verdict(qry *query) (v *verdict.Verdict, err error) {
+	key := fmt.Sprintf("%s/%d", qry.QName, qry.QType)
+	if cached, cacheErr := p.cache.Get(key); cacheErr == nil {
+		return cached.(*verdict.Verdict), nil
+	}
+
+	resp, err := p.ask(qry)
+	if err != nil {
+		return nil, err
+	}
+
+	v, err = resp.verdict()
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.CacheTTL > 0 {
+		_ = p.cache.SetWithExpire(key, v, time.Duration(resp.CacheTTL)*time.Second)
+	}
+
+	return v, nil
+}
+
+// exchangeResult is the result of an exchange with a worker.
+type exchangeResult struct {
+	// err is the error of the exchange, if any.
+	err error
+
+	// resp is the response line.
+	resp []byte
+}
+
+// ask sends qry to a free worker and returns its response.
+func (p *Plugin) ask(qry *query) (resp *response, err error) {
+	req, err := json.Marshal(qry)
+	if err != nil {
+		return nil, fmt.Errorf("marshaling query: %w", err)
+	}
+
+	req = append(req, '\n')
+
+	timer := time.NewTimer(p.timeout)
+	defer timer.Stop()
+
+	var w *worker
+	select {
+	case w = <-p.workers:
+	case <-timer.C:
+		return nil, fmt.Errorf("waiting for worker: %w", errTimeout)
+	}
+
+	if w == nil {
+		w, err = startWorker(p.command, p.stderr)
+		if err != nil {
+			p.workers <- nil
+
+			return nil, fmt.Errorf("starting plugin: %w", err)
+		}
+	}
+
+	resCh := make(chan exchangeResult, 1)
+	go func() {
+		data, exchErr := w.exchange(req)
+		resCh <- exchangeResult{err: exchErr, resp: data}
+	}()
+
+	var res exchangeResult
+	select {
+	case res = <-resCh:
+	case <-timer.C:
+		res.err = errTimeout
+	}
+
+	if res.err != nil {
+		// The process state is unknown, so replace it.
+		p.closeWorker(w)
+		p.workers <- nil
+
+		return nil, res.err
+	}
+
+	p.workers <- w
+
+	resp = &response{}
+	err = json.Unmarshal(bytes.TrimSpace(res.resp), resp)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshaling verdict: %w", err)
+	}
+
+	return resp, nil
+}
+
+// closeWorker stops w and logs the error, if any.
+func (p *Plugin) closeWorker(w *worker) {
+	err := w.close()
+	if err != nil {
+		p.logger.Debug("closing plugin process", slogutil.KeyError, err)
+	}
+}
+
+// verdict converts r into a verdict.
+func (r *response) verdict() (v *verdict.Verdict, err error) {
+	v = &verdict.Verdict{
+		Target: r.Target,
+		TTL:    r.TTL,
+	}
+
+	switch r.Action {
+	case "", "allow":
+		v.Action = verdict.ActionAllow
+	case "deny":
+		v.Action = verdict.ActionDeny
+	case "rewrite":
+		v.Action = verdict.ActionRewrite
+		v.Addrs, err = verdict.ParseAddrs(r.Addresses)
+		if err != nil {
+			return nil, fmt.Errorf("rewrite addresses: %w", err)
+		}
+	case "redirect":
+		v.Action = verdict.ActionRedirect
+	default:
+		return nil, fmt.Errorf("unknown action %q", r.Action)
+	}
+
+	return v, nil
+}
+
+// Close stops the plugin processes.  It waits for the exchanges in progress to
+// finish.
+func (p *Plugin) Close() (err error) {
+	var errs []error
+	for range cap(p.workers) {
+		w := <-p.workers
+		if w != nil {
+			errs = append(errs, w.close())
+		}
+	}
+
+	return errors.Join(errs...)
+}
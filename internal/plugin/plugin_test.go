@@ -0,0 +1,157 @@
+package plugin_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/internal/plugin"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testPluginEnv is the environment variable that makes the test binary act as
+// a plugin.
+const testPluginEnv = "DNSPROXY_TEST_PLUGIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(testPluginEnv) != "" {
+		runTestPlugin()
+
+		os.Exit(0)
+	}
+
+	os.Exit(m.Run())
+}
+
+// runTestPlugin answers the queries from stdin depending on the queried name.
+func runTestPlugin() {
+	s := bufio.NewScanner(os.Stdin)
+	for s.Scan() {
+		q := struct {
+			QName string `json:"qname"`
+		}{}
+		_ = json.Unmarshal(s.Bytes(), &q)
+
+		var resp string
+		switch q.QName {
+		case "deny.example.":
+			resp = `{"action":"deny"}`
+		case "cached.example.":
+			resp = `{"action":"rewrite","addresses":["192.0.2.1"],"cache_ttl":60}`
+		case "slow.example.":
+			time.Sleep(time.Second)
+
+			resp = `{"action":"deny"}`
+		case "bad.example.":
+			resp = `not json`
+		default:
+			resp = `{"action":"allow"}`
+		}
+
+		_, _ = fmt.Println(resp)
+	}
+}
+
+// newTestContext returns a new request context for host.
+func newTestContext(host string) (dctx *proxy.DNSContext) {
+	return &proxy.DNSContext{
+		Req:   (&dns.Msg{}).SetQuestion(dns.Fqdn(host), dns.TypeA),
+		Addr:  netip.MustParseAddrPort("192.0.2.1:53"),
+		Proto: proxy.ProtoUDP,
+	}
+}
+
+// requireResponse requires err to be a [proxy.BeforeRequestError] and returns
+// its response.
+func requireResponse(t *testing.T, err error) (resp *dns.Msg) {
+	t.Helper()
+
+	befErr := &proxy.BeforeRequestError{}
+	require.ErrorAs(t, err, &befErr)
+	require.NotNil(t, befErr.Response)
+
+	return befErr.Response
+}
+
+func TestPlugin_HandleBefore(t *testing.T) {
+	t.Setenv(testPluginEnv, "1")
+
+	exe, err := os.Executable()
+	require.NoError(t, err)
+
+	p, err := plugin.New(&plugin.Config{
+		Logger:  slogutil.NewDiscardLogger(),
+		Command: []string{exe},
+		Workers: 2,
+		Timeout: 500 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, p.Close)
+
+	t.Run("allow", func(t *testing.T) {
+		assert.NoError(t, p.HandleBefore(nil, newTestContext("allow.example")))
+	})
+
+	t.Run("deny", func(t *testing.T) {
+		resp := requireResponse(t, p.HandleBefore(nil, newTestContext("deny.example")))
+		assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+	})
+
+	t.Run("cached", func(t *testing.T) {
+		for range 2 {
+			resp := requireResponse(t, p.HandleBefore(nil, newTestContext("cached.example")))
+			require.Len(t, resp.Answer, 1)
+
+			a := testutil.RequireTypeAssert[*dns.A](t, resp.Answer[0])
+			assert.Equal(t, "192.0.2.1", a.A.String())
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		assert.NoError(t, p.HandleBefore(nil, newTestContext("slow.example")))
+
+		// The timed out worker is replaced.
+		resp := requireResponse(t, p.HandleBefore(nil, newTestContext("deny.example")))
+		assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+	})
+
+	t.Run("bad_verdict", func(t *testing.T) {
+		assert.NoError(t, p.HandleBefore(nil, newTestContext("bad.example")))
+	})
+
+	t.Run("concurrent", func(t *testing.T) {
+		var denied atomic.Int32
+		done := make(chan struct{})
+		for range 8 {
+			go func() {
+				defer func() { done <- struct{}{} }()
+
+				err := p.HandleBefore(nil, newTestContext("deny.example"))
+				if err != nil {
+					denied.Add(1)
+				}
+			}()
+		}
+
+		for range 8 {
+			<-done
+		}
+
+		assert.Equal(t, int32(8), denied.Load())
+	})
+}
+
+func TestNew_noCommand(t *testing.T) {
+	_, err := plugin.New(&plugin.Config{})
+	assert.Error(t, err)
+}
@@ -0,0 +1,83 @@
+package plugin
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// worker is a single running plugin process.  It's not safe for concurrent
+// use.
+type worker struct {
+	// cmd is the plugin process.
+	cmd *exec.Cmd
+
+	// stdin is the standard input of the process.
+	stdin io.WriteCloser
+
+	// stdout is the standard output of the process.
+	stdout *bufio.Reader
+}
+
+// startWorker starts a new plugin process running command.  stderr receives
+// the standard error of the process, if not nil.
+func startWorker(command []string, stderr io.Writer) (w *worker, err error) {
+	// #nosec G204 -- Trust the plugin command from the configuration.
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stderr = stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("creating stdin pipe: %w", err)
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("creating stdout pipe: %w", err)
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return nil, fmt.Errorf("starting %q: %w", command[0], err)
+	}
+
+	return &worker{
+		cmd:    cmd,
+		stdin:  stdin,
+		stdout: bufio.NewReader(stdout),
+	}, nil
+}
+
+// exchange writes the line req to the process and reads the response line.
+// req must end with a newline.
+func (w *worker) exchange(req []byte) (resp []byte, err error) {
+	_, err = w.stdin.Write(req)
+	if err != nil {
+		return nil, fmt.Errorf("writing request: %w", err)
+	}
+
+	resp, err = w.stdout.ReadBytes('\n')
+	if err != nil {
+		return nil, fmt.Errorf("reading response: %w", err)
+	}
+
+	return resp, nil
+}
+
+// close stops the process.  It's safe to call while [worker.exchange] is in
+// progress, which then returns an error.
+func (w *worker) close() (err error) {
+	err = w.stdin.Close()
+	if killErr := w.cmd.Process.Kill(); killErr != nil && !errors.Is(killErr, os.ErrProcessDone) {
+		err = errors.WithDeferred(err, killErr)
+	}
+
+	// The process is killed, so the exit error is expected.
+	_ = w.cmd.Wait()
+
+	return err
+}
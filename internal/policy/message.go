@@ -0,0 +1,260 @@
+package policy
+
+import (
+	"fmt"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// action is the decision of the policy service.  See the Action enum in
+// policy.proto.
+type action uint64
+
+// Actions of the policy service.
+const (
+	actionUnspecified action = 0
+	actionAllow       action = 1
+	actionDeny        action = 2
+	actionRewrite     action = 3
+	actionRedirect    action = 4
+)
+
+// Field numbers of the CheckRequest message.
+const (
+	fieldRequestQName      protowire.Number = 1
+	fieldRequestQType      protowire.Number = 2
+	fieldRequestClient     protowire.Number = 3
+	fieldRequestProtocol   protowire.Number = 4
+	fieldRequestServerName protowire.Number = 5
+	fieldRequestHTTPPath   protowire.Number = 6
+	fieldRequestHTTPUser   protowire.Number = 7
+)
+
+// Field numbers of the CheckResponse message.
+const (
+	fieldResponseAction    protowire.Number = 1
+	fieldResponseAddresses protowire.Number = 2
+	fieldResponseTarget    protowire.Number = 3
+	fieldResponseTTL       protowire.Number = 4
+)
+
+// checkRequest is the CheckRequest message.
+type checkRequest struct {
+	// qname is the queried name in the lowercase FQDN form.
+	qname string
+
+	// client is the IP address of the client.
+	client string
+
+	// protocol is the protocol the query has been received over.
+	protocol string
+
+	// serverName is the TLS server name indicated by the client.
+	serverName string
+
+	// httpPath is the URL path of the DNS-over-HTTPS request.
+	httpPath string
+
+	// httpUser is the basic authentication user name of the DNS-over-HTTPS
+	// request.
+	httpUser string
+
+	// qtype is the type of the query.
+	qtype uint16
+}
+
+// checkResponse is the CheckResponse message.
+type checkResponse struct {
+	// target is the domain name to resolve for [actionRedirect].
+	target string
+
+	// addresses are the IP addresses to answer with for [actionRewrite].
+	addresses []string
+
+	// action is the decision.
+	action action
+
+	// ttl is the TTL of the answer records in seconds.
+	ttl uint32
+}
+
+// appendString appends the string field with num to b, unless s is empty.
+func appendString(b []byte, num protowire.Number, s string) (res []byte) {
+	if s == "" {
+		return b
+	}
+
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+
+	return protowire.AppendString(b, s)
+}
+
+// appendVarint appends the varint field with num to b, unless v is zero.
+func appendVarint(b []byte, num protowire.Number, v uint64) (res []byte) {
+	if v == 0 {
+		return b
+	}
+
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+
+	return protowire.AppendVarint(b, v)
+}
+
+// marshal returns the protobuf encoding of r.
+func (r *checkRequest) marshal() (b []byte) {
+	b = appendString(b, fieldRequestQName, r.qname)
+	b = appendVarint(b, fieldRequestQType, uint64(r.qtype))
+	b = appendString(b, fieldRequestClient, r.client)
+	b = appendString(b, fieldRequestProtocol, r.protocol)
+	b = appendString(b, fieldRequestServerName, r.serverName)
+	b = appendString(b, fieldRequestHTTPPath, r.httpPath)
+
+	return appendString(b, fieldRequestHTTPUser, r.httpUser)
+}
+
+// marshal returns the protobuf encoding of r.
+func (r *checkResponse) marshal() (b []byte) {
+	b = appendVarint(b, fieldResponseAction, uint64(r.action))
+	for _, addr := range r.addresses {
+		b = protowire.AppendTag(b, fieldResponseAddresses, protowire.BytesType)
+		b = protowire.AppendString(b, addr)
+	}
+
+	b = appendString(b, fieldResponseTarget, r.target)
+
+	return appendVarint(b, fieldResponseTTL, uint64(r.ttl))
+}
+
+// field is a single decoded field of a message.  Only the varint and the
+// length-delimited fields are decoded.
+type field struct {
+	// bytes is the value of a length-delimited field.
+	bytes []byte
+
+	// num is the field number.
+	num protowire.Number
+
+	// varint is the value of a varint field.
+	varint uint64
+}
+
+// consumeFields calls f for each field of the encoded message b.  The fields of
+// the other wire types are skipped.
+func consumeFields(b []byte, f func(fld *field)) (err error) {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return fmt.Errorf("consuming tag: %w", protowire.ParseError(n))
+		}
+
+		b = b[n:]
+
+		fld := &field{num: num}
+		switch typ {
+		case protowire.VarintType:
+			fld.varint, n = protowire.ConsumeVarint(b)
+		case protowire.BytesType:
+			fld.bytes, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			fld = nil
+		}
+
+		if n < 0 {
+			return fmt.Errorf("consuming field %d: %w", num, protowire.ParseError(n))
+		}
+
+		b = b[n:]
+
+		if fld != nil {
+			f(fld)
+		}
+	}
+
+	return nil
+}
+
+// unmarshal decodes the protobuf encoding b into r.
+func (r *checkRequest) unmarshal(b []byte) (err error) {
+	return consumeFields(b, func(fld *field) {
+		switch fld.num {
+		case fieldRequestQName:
+			r.qname = string(fld.bytes)
+		case fieldRequestQType:
+			r.qtype = uint16(fld.varint)
+		case fieldRequestClient:
+			r.client = string(fld.bytes)
+		case fieldRequestProtocol:
+			r.protocol = string(fld.bytes)
+		case fieldRequestServerName:
+			r.serverName = string(fld.bytes)
+		case fieldRequestHTTPPath:
+			r.httpPath = string(fld.bytes)
+		case fieldRequestHTTPUser:
+			r.httpUser = string(fld.bytes)
+		default:
+			// Go on.
+		}
+	})
+}
+
+// unmarshal decodes the protobuf encoding b into r.
+func (r *checkResponse) unmarshal(b []byte) (err error) {
+	return consumeFields(b, func(fld *field) {
+		switch fld.num {
+		case fieldResponseAction:
+			r.action = action(fld.varint)
+		case fieldResponseAddresses:
+			r.addresses = append(r.addresses, string(fld.bytes))
+		case fieldResponseTarget:
+			r.target = string(fld.bytes)
+		case fieldResponseTTL:
+			r.ttl = uint32(fld.varint)
+		default:
+			// Go on.
+		}
+	})
+}
+
+// errUnsupportedMessage is returned by [codec] for the values of unknown types.
+const errUnsupportedMessage errors.Error = "unsupported message type"
+
+// codec is the gRPC codec of the messages of the policy service.  It's used
+// instead of the generated code, like the one of the dnstap messages.
+type codec struct{}
+
+// type check
+var _ encoding.Codec = codec{}
+
+// Marshal implements the [encoding.Codec] interface for codec.
+func (codec) Marshal(v any) (b []byte, err error) {
+	switch v := v.(type) {
+	case *checkRequest:
+		return v.marshal(), nil
+	case *checkResponse:
+		return v.marshal(), nil
+	default:
+		return nil, fmt.Errorf("marshaling %T: %w", v, errUnsupportedMessage)
+	}
+}
+
+// Unmarshal implements the [encoding.Codec] interface for codec.
+func (codec) Unmarshal(b []byte, v any) (err error) {
+	switch v := v.(type) {
+	case *checkRequest:
+		return v.unmarshal(b)
+	case *checkResponse:
+		return v.unmarshal(b)
+	default:
+		return fmt.Errorf("unmarshaling %T: %w", v, errUnsupportedMessage)
+	}
+}
+
+// Name implements the [encoding.Codec] interface for codec.  It's the name of
+// the standard protobuf codec, so that the content type is the same as the one
+// of the generated clients and servers.
+func (codec) Name() (name string) {
+	return "proto"
+}
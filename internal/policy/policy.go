@@ -0,0 +1,198 @@
+// Package policy implements the hook asking an external policy service over
+// gRPC for a decision about each DNS query.  See policy.proto for the schema
+// of the service.
+package policy
+
+import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/internal/verdict"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/miekg/dns"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// methodCheck is the full name of the Check method of the policy service.
+const methodCheck = "/dnsproxy.policy.v1.Policy/Check"
+
+// DefaultTimeout is the default timeout of a single policy check.
+const DefaultTimeout = 1 * time.Second
+
+// Config is the configuration of the policy hook.
+type Config struct {
+	// Logger is used to log the failed checks.  If nil, [slog.Default] is
+	// used.
+	Logger *slog.Logger
+
+	// TLSConfig is used to connect to the policy service.  If nil, the
+	// connection isn't encrypted.
+	TLSConfig *tls.Config
+
+	// Address is the address of the policy service in the gRPC target form,
+	// for example "localhost:50051".  It must not be empty.
+	Address string
+
+	// Timeout is the timeout of a single check.  If zero, [DefaultTimeout] is
+	// used.
+	Timeout time.Duration
+
+	// FailClosed, if true, makes the queries answered with SERVFAIL when the
+	// policy service fails or times out.  Otherwise they are resolved as
+	// usual.
+	FailClosed bool
+}
+
+// Policy is the [proxy.BeforeRequestHandler] asking the policy service for a
+// decision about each query.
+type Policy struct {
+	// logger is used to log the failed checks.
+	logger *slog.Logger
+
+	// conn is the connection to the policy service.
+	conn *grpc.ClientConn
+
+	// timeout is the timeout of a single check.
+	timeout time.Duration
+
+	// failClosed makes the queries answered with SERVFAIL when the check
+	// fails.
+	failClosed bool
+}
+
+// New returns a new properly initialized *Policy.  The connection is
+// established lazily.  It should be closed with [Policy.Close].
+func New(c *Config) (p *Policy, err error) {
+	creds := insecure.NewCredentials()
+	if c.TLSConfig != nil {
+		creds = credentials.NewTLS(c.TLSConfig)
+	}
+
+	conn, err := grpc.NewClient(
+		c.Address,
+		grpc.WithTransportCredentials(creds),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(codec{})),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("creating grpc client: %w", err)
+	}
+
+	return &Policy{
+		logger:     cmp.Or(c.Logger, slog.Default()),
+		conn:       conn,
+		timeout:    cmp.Or(c.Timeout, DefaultTimeout),
+		failClosed: c.FailClosed,
+	}, nil
+}
+
+// type check
+var _ proxy.BeforeRequestHandler = (*Policy)(nil)
+
+// HandleBefore implements the [proxy.BeforeRequestHandler] interface for
+// *Policy.
+func (p *Policy) HandleBefore(prx *proxy.Proxy, dctx *proxy.DNSContext) (err error) {
+	if len(dctx.Req.Question) == 0 {
+		return nil
+	}
+
+	q := dctx.Req.Question[0]
+	req := &checkRequest{
+		qname:      strings.ToLower(dns.Fqdn(q.Name)),
+		client:     dctx.Addr.Addr().String(),
+		protocol:   string(dctx.Proto),
+		serverName: dctx.ServerName,
+		httpPath:   dctx.HTTPPath,
+		httpUser:   dctx.HTTPUser,
+		qtype:      q.Qtype,
+	}
+
+	err = p.decide(prx, dctx, req)
+	if err == nil || errors.As(err, new(*proxy.BeforeRequestError)) {
+		return err
+	}
+
+	p.logger.Debug("checking policy", "qname", req.qname, slogutil.KeyError, err)
+
+	if !p.failClosed {
+		return nil
+	}
+
+	return &proxy.BeforeRequestError{
+		Err:      fmt.Errorf("checking policy: %w", err),
+		Response: proxy.GenEmptyMessage(dctx.Req, dns.RcodeServerFailure, 0),
+	}
+}
+
+// decide asks the policy service about req and applies the decision to dctx.
+func (p *Policy) decide(
+	prx *proxy.Proxy,
+	dctx *proxy.DNSContext,
+	req *checkRequest,
+) (err error) {
+	resp, err := p.check(req)
+	if err != nil {
+		return err
+	}
+
+	v, err := resp.verdict()
+	if err != nil {
+		return err
+	}
+
+	return v.Apply(prx, dctx)
+}
+
+// check sends req to the policy service.
+func (p *Policy) check(req *checkRequest) (resp *checkResponse, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+
+	resp = &checkResponse{}
+	err = p.conn.Invoke(ctx, methodCheck, req, resp)
+	if err != nil {
+		return nil, fmt.Errorf("invoking check: %w", err)
+	}
+
+	return resp, nil
+}
+
+// verdict converts the decision r into a verdict.
+func (r *checkResponse) verdict() (v *verdict.Verdict, err error) {
+	v = &verdict.Verdict{
+		Target: r.target,
+		TTL:    r.ttl,
+	}
+
+	switch r.action {
+	case actionUnspecified, actionAllow:
+		v.Action = verdict.ActionAllow
+	case actionDeny:
+		v.Action = verdict.ActionDeny
+	case actionRewrite:
+		v.Action = verdict.ActionRewrite
+		v.Addrs, err = verdict.ParseAddrs(r.addresses)
+		if err != nil {
+			return nil, fmt.Errorf("rewrite addresses: %w", err)
+		}
+	case actionRedirect:
+		v.Action = verdict.ActionRedirect
+	default:
+		return nil, fmt.Errorf("unknown action %d", r.action)
+	}
+
+	return v, nil
+}
+
+// Close closes the connection to the policy service.
+func (p *Policy) Close() (err error) {
+	return p.conn.Close()
+}
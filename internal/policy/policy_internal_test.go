@@ -0,0 +1,242 @@
+package policy
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/internal/dnsproxytest"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+// testTimeout is the common timeout for tests.
+const testTimeout = 1 * time.Second
+
+// policyServer is the interface of the policy service handler for
+// [grpc.ServiceDesc].
+type policyServer interface {
+	check(req *checkRequest) (resp *checkResponse, err error)
+}
+
+// checkFunc is a [policyServer] implemented by a function.
+type checkFunc func(req *checkRequest) (resp *checkResponse, err error)
+
+// check implements the [policyServer] interface for checkFunc.
+func (f checkFunc) check(req *checkRequest) (resp *checkResponse, err error) {
+	return f(req)
+}
+
+// startServer starts the policy service answering with check and returns its
+// address.
+func startServer(t *testing.T, check checkFunc) (addr string) {
+	t.Helper()
+
+	srv := grpc.NewServer(grpc.ForceServerCodec(codec{}))
+	srv.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "dnsproxy.policy.v1.Policy",
+		HandlerType: (*policyServer)(nil),
+		Methods: []grpc.MethodDesc{{
+			MethodName: "Check",
+			Handler: func(
+				s any,
+				_ context.Context,
+				dec func(any) error,
+				_ grpc.UnaryServerInterceptor,
+			) (resp any, err error) {
+				req := &checkRequest{}
+				err = dec(req)
+				if err != nil {
+					return nil, err
+				}
+
+				return s.(policyServer).check(req)
+			},
+		}},
+	}, check)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	go func() { _ = srv.Serve(l) }()
+	t.Cleanup(srv.Stop)
+
+	return l.Addr().String()
+}
+
+// newTestPolicy returns a new *Policy connected to addr.
+func newTestPolicy(t *testing.T, addr string, failClosed bool) (p *Policy) {
+	t.Helper()
+
+	p, err := New(&Config{
+		Logger:     slogutil.NewDiscardLogger(),
+		Address:    addr,
+		Timeout:    testTimeout,
+		FailClosed: failClosed,
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, p.Close)
+
+	return p
+}
+
+// newTestContext returns a new request context for host of type qtype.
+func newTestContext(host string, qtype uint16) (dctx *proxy.DNSContext) {
+	req := (&dns.Msg{}).SetQuestion(dns.Fqdn(host), qtype)
+
+	return &proxy.DNSContext{
+		Req:   req,
+		Addr:  netip.MustParseAddrPort("192.0.2.1:53"),
+		Proto: proxy.ProtoUDP,
+	}
+}
+
+// requireResponse requires err to be a [proxy.BeforeRequestError] and returns
+// its response.
+func requireResponse(t *testing.T, err error) (resp *dns.Msg) {
+	t.Helper()
+
+	befErr := &proxy.BeforeRequestError{}
+	require.ErrorAs(t, err, &befErr)
+	require.NotNil(t, befErr.Response)
+
+	return befErr.Response
+}
+
+func TestPolicy_HandleBefore(t *testing.T) {
+	addr := startServer(t, func(req *checkRequest) (resp *checkResponse, err error) {
+		switch req.qname {
+		case "deny.example.":
+			return &checkResponse{action: actionDeny}, nil
+		case "rewrite.example.":
+			return &checkResponse{
+				action:    actionRewrite,
+				addresses: []string{"192.0.2.2", "2001:db8::2"},
+				ttl:       30,
+			}, nil
+		case "fail.example.":
+			return nil, errors.Error("test error")
+		case "identity.example.":
+			if req.serverName == "family.example" &&
+				req.httpPath == "/dns-query/kids" &&
+				req.httpUser == "kid" {
+				return &checkResponse{action: actionDeny}, nil
+			}
+
+			return &checkResponse{action: actionAllow}, nil
+		default:
+			return &checkResponse{action: actionAllow}, nil
+		}
+	})
+
+	p := newTestPolicy(t, addr, false)
+
+	t.Run("allow", func(t *testing.T) {
+		assert.NoError(t, p.HandleBefore(nil, newTestContext("allow.example", dns.TypeA)))
+	})
+
+	t.Run("deny", func(t *testing.T) {
+		err := p.HandleBefore(nil, newTestContext("deny.example", dns.TypeA))
+		resp := requireResponse(t, err)
+
+		assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+	})
+
+	t.Run("rewrite", func(t *testing.T) {
+		err := p.HandleBefore(nil, newTestContext("rewrite.example", dns.TypeAAAA))
+		resp := requireResponse(t, err)
+
+		require.Len(t, resp.Answer, 1)
+
+		aaaa := testutil.RequireTypeAssert[*dns.AAAA](t, resp.Answer[0])
+		assert.Equal(t, net.ParseIP("2001:db8::2"), aaaa.AAAA)
+		assert.Equal(t, uint32(30), aaaa.Hdr.Ttl)
+	})
+
+	t.Run("identity", func(t *testing.T) {
+		dctx := newTestContext("identity.example", dns.TypeA)
+		assert.NoError(t, p.HandleBefore(nil, dctx))
+
+		dctx.Proto = proxy.ProtoHTTPS
+		dctx.ServerName = "family.example"
+		dctx.HTTPPath = "/dns-query/kids"
+		dctx.HTTPUser = "kid"
+
+		resp := requireResponse(t, p.HandleBefore(nil, dctx))
+		assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+	})
+
+	t.Run("fail_open", func(t *testing.T) {
+		assert.NoError(t, p.HandleBefore(nil, newTestContext("fail.example", dns.TypeA)))
+	})
+
+	t.Run("fail_closed", func(t *testing.T) {
+		closed := newTestPolicy(t, addr, true)
+
+		err := closed.HandleBefore(nil, newTestContext("fail.example", dns.TypeA))
+		resp := requireResponse(t, err)
+
+		assert.Equal(t, dns.RcodeServerFailure, resp.Rcode)
+	})
+}
+
+func TestPolicy_HandleBefore_redirect(t *testing.T) {
+	const target = "target.example."
+
+	addr := startServer(t, func(_ *checkRequest) (resp *checkResponse, err error) {
+		return &checkResponse{action: actionRedirect, target: target}, nil
+	})
+
+	p := newTestPolicy(t, addr, false)
+
+	ups := &dnsproxytest.FakeUpstream{
+		OnAddress: func() (addr string) { return "fake" },
+		OnExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			resp = (&dns.Msg{}).SetReply(req)
+			resp.Answer = []dns.RR{&dns.A{
+				Hdr: dns.RR_Header{
+					Name:   req.Question[0].Name,
+					Rrtype: dns.TypeA,
+					Class:  dns.ClassINET,
+					Ttl:    60,
+				},
+				A: net.IP{192, 0, 2, 3},
+			}}
+
+			return resp, nil
+		},
+		OnClose: func() (err error) { return nil },
+	}
+
+	prx, err := proxy.New(&proxy.Config{
+		Logger: slogutil.NewDiscardLogger(),
+		UpstreamConfig: &proxy.UpstreamConfig{
+			Upstreams: []upstream.Upstream{ups},
+		},
+		TrustedProxies: netutil.SliceSubnetSet{netip.MustParsePrefix("0.0.0.0/0")},
+	})
+	require.NoError(t, err)
+
+	dctx := newTestContext("source.example", dns.TypeA)
+	resp := requireResponse(t, p.HandleBefore(prx, dctx))
+
+	require.Len(t, resp.Answer, 2)
+	assert.Equal(t, dctx.Req.Id, resp.Id)
+	assert.Equal(t, "source.example.", resp.Question[0].Name)
+
+	cname := testutil.RequireTypeAssert[*dns.CNAME](t, resp.Answer[0])
+	assert.Equal(t, target, cname.Target)
+
+	a := testutil.RequireTypeAssert[*dns.A](t, resp.Answer[1])
+	assert.Equal(t, target, a.Hdr.Name)
+}
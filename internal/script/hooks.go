@@ -0,0 +1,156 @@
+package script
+
+import (
+	"fmt"
+
+	"github.com/AdguardTeam/dnsproxy/internal/verdict"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/miekg/dns"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// type check
+var _ proxy.BeforeRequestHandler = (*Script)(nil)
+
+// HandleBefore implements the [proxy.BeforeRequestHandler] interface for
+// *Script.  It calls the before function of the script, if any.
+func (s *Script) HandleBefore(prx *proxy.Proxy, dctx *proxy.DNSContext) (err error) {
+	if !s.hasBefore || len(dctx.Req.Question) == 0 {
+		return nil
+	}
+
+	var v *verdict.Verdict
+	err = s.call(fnBefore, func(l *lua.LState) (vals []lua.LValue) {
+		return []lua.LValue{queryTable(l, dctx)}
+	}, func(ret lua.LValue) (herr error) {
+		v, herr = toVerdict(ret)
+
+		return herr
+	})
+	if err == nil {
+		err = v.Apply(prx, dctx)
+	}
+
+	if err == nil || errors.As(err, new(*proxy.BeforeRequestError)) {
+		return err
+	}
+
+	s.logCallError(dctx, err)
+
+	return nil
+}
+
+// HandleResponse is a [proxy.ResponseHandler] calling the after function of
+// the script, if any, with the response of dctx.
+func (s *Script) HandleResponse(dctx *proxy.DNSContext, _ error) {
+	if !s.hasAfter || dctx.Res == nil || len(dctx.Req.Question) == 0 {
+		return
+	}
+
+	var respTable *lua.LTable
+	err := s.call(fnAfter, func(l *lua.LState) (vals []lua.LValue) {
+		respTable = responseTable(l, dctx.Res)
+
+		return []lua.LValue{queryTable(l, dctx), respTable}
+	}, func(_ lua.LValue) (herr error) {
+		return applyResponseTable(respTable, dctx.Res)
+	})
+	if err != nil {
+		s.logCallError(dctx, err)
+	}
+}
+
+// toVerdict converts the value returned from the before function into a
+// verdict.  A nil value means allowing the query.
+func toVerdict(ret lua.LValue) (v *verdict.Verdict, err error) {
+	if ret == lua.LNil {
+		return &verdict.Verdict{Action: verdict.ActionAllow}, nil
+	}
+
+	t, ok := ret.(*lua.LTable)
+	if !ok {
+		return nil, fmt.Errorf("before returned %s, want table or nil", ret.Type())
+	}
+
+	v = &verdict.Verdict{
+		Target: lua.LVAsString(t.RawGetString("target")),
+		TTL:    uint32(lua.LVAsNumber(t.RawGetString("ttl"))),
+	}
+
+	switch action := lua.LVAsString(t.RawGetString("action")); action {
+	case "", "allow":
+		v.Action = verdict.ActionAllow
+	case "deny":
+		v.Action = verdict.ActionDeny
+	case "rewrite":
+		v.Action = verdict.ActionRewrite
+		v.Addrs, err = verdict.ParseAddrs(stringList(t.RawGetString("addresses")))
+		if err != nil {
+			return nil, fmt.Errorf("rewrite addresses: %w", err)
+		}
+	case "redirect":
+		v.Action = verdict.ActionRedirect
+	default:
+		return nil, fmt.Errorf("unknown action %q", action)
+	}
+
+	return v, nil
+}
+
+// stringList returns the string elements of the array table val.  It returns
+// nil if val isn't a table.
+func stringList(val lua.LValue) (strs []string) {
+	t, ok := val.(*lua.LTable)
+	if !ok {
+		return nil
+	}
+
+	for i := 1; i <= t.Len(); i++ {
+		strs = append(strs, lua.LVAsString(t.RawGetInt(i)))
+	}
+
+	return strs
+}
+
+// responseTable returns the response table for resp.
+func responseTable(l *lua.LState, resp *dns.Msg) (t *lua.LTable) {
+	answers := l.NewTable()
+	for _, rr := range resp.Answer {
+		answers.Append(lua.LString(rr.String()))
+	}
+
+	t = l.NewTable()
+	t.RawSetString("rcode", lua.LNumber(resp.Rcode))
+	t.RawSetString("answers", answers)
+
+	return t
+}
+
+// applyResponseTable sets the rcode and the answer records from t into resp.
+// resp is left unchanged if t is invalid.
+func applyResponseTable(t *lua.LTable, resp *dns.Msg) (err error) {
+	rcode, ok := t.RawGetString("rcode").(lua.LNumber)
+	if !ok {
+		return fmt.Errorf("bad rcode %s", t.RawGetString("rcode"))
+	}
+
+	var answers []dns.RR
+	for i, s := range stringList(t.RawGetString("answers")) {
+		var rr dns.RR
+		rr, err = dns.NewRR(s)
+		if err != nil {
+			return fmt.Errorf("answer at index %d: %w", i, err)
+		} else if rr == nil {
+			// Skip the empty strings.
+			continue
+		}
+
+		answers = append(answers, rr)
+	}
+
+	resp.Rcode = int(rcode)
+	resp.Answer = answers
+
+	return nil
+}
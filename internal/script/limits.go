@@ -0,0 +1,295 @@
+package script
+
+import (
+	"context"
+	"runtime/metrics"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// memoryCheckInterval is the number of the Lua instructions executed between
+// the checks of the memory allocated by a call.
+const memoryCheckInterval = 256
+
+// metricAllocs is the name of the runtime metric of the total number of bytes
+// allocated on the heap.
+const metricAllocs = "/gc/heap/allocs:bytes"
+
+// errMemoryLimit is the cause of interrupting a call which has allocated too
+// much memory.
+const errMemoryLimit errors.Error = "memory limit exceeded"
+
+// callContext is the context of a call of the Lua code limiting its duration
+// and the memory it allocates.  The Lua virtual machine calls its Done method
+// before executing each instruction, which is used to check the memory
+// allocated since the start of the call every [memoryCheckInterval]
+// instructions.  The memory is measured for the whole process, so the limit is
+// approximate.
+type callContext struct {
+	context.Context
+
+	// cancel interrupts the call with the cause.
+	cancel context.CancelCauseFunc
+
+	// sample is used to read [metricAllocs].
+	sample []metrics.Sample
+
+	// limit is the value of [metricAllocs] after which the call is interrupted.
+	limit uint64
+
+	// steps is the number of the calls of Done.
+	steps uint
+}
+
+// newCallContext returns a new context of a call limited by timeout and
+// maxMemory.  cancel must be called when the call is finished.
+func newCallContext(
+	timeout time.Duration,
+	maxMemory uint64,
+) (ctx *callContext, cancel context.CancelFunc) {
+	timeoutCtx, cancelTimeout := context.WithTimeout(context.Background(), timeout)
+	causeCtx, cancelCause := context.WithCancelCause(timeoutCtx)
+
+	ctx = &callContext{
+		Context: causeCtx,
+		cancel:  cancelCause,
+		sample:  []metrics.Sample{{Name: metricAllocs}},
+	}
+	ctx.limit = ctx.allocated() + maxMemory
+
+	return ctx, func() {
+		cancelCause(nil)
+		cancelTimeout()
+	}
+}
+
+// type check
+var _ context.Context = (*callContext)(nil)
+
+// Done implements the [context.Context] interface for *callContext.
+func (ctx *callContext) Done() (done <-chan struct{}) {
+	ctx.steps++
+	if ctx.steps%memoryCheckInterval == 0 && ctx.allocated() > ctx.limit {
+		ctx.cancel(errMemoryLimit)
+	}
+
+	return ctx.Context.Done()
+}
+
+// Err implements the [context.Context] interface for *callContext.  It returns
+// the cause of interrupting the call, so that the Lua virtual machine reports
+// it.
+func (ctx *callContext) Err() (err error) {
+	return context.Cause(ctx.Context)
+}
+
+// allocated returns the total number of bytes allocated by the process.
+func (ctx *callContext) allocated() (n uint64) {
+	metrics.Read(ctx.sample)
+
+	return ctx.sample[0].Value.Uint64()
+}
+
+// maxFormatNumLen is the maximum length of a number formatted by string.format
+// without the width and the precision, which is the length of -math.MaxFloat64
+// formatted with %f.
+const maxFormatNumLen = 317
+
+// limitStrings replaces the functions of the string and table libraries of l
+// which build a string out of their arguments with a single Go call, so that
+// the Lua virtual machine can't interrupt it, with the ones raising an error if
+// the result may be longer than s.maxStringLen.
+func (s *Script) limitStrings(l *lua.LState) {
+	strLib := l.GetGlobal(lua.StringLibName).(*lua.LTable)
+	tabLib := l.GetGlobal(lua.TabLibName).(*lua.LTable)
+
+	for _, f := range []struct {
+		lib  *lua.LTable
+		name string
+		max  func(l *lua.LState) (n int)
+	}{{
+		lib:  strLib,
+		name: "rep",
+		max:  repLen,
+	}, {
+		lib:  strLib,
+		name: "format",
+		max:  formatLen,
+	}, {
+		lib:  strLib,
+		name: "gsub",
+		max:  s.gsubLen,
+	}, {
+		lib:  tabLib,
+		name: "concat",
+		max:  concatLen,
+	}} {
+		orig := f.lib.RawGetString(f.name).(*lua.LFunction).GFunction
+		name, maxLen := f.name, f.max
+		f.lib.RawSetString(f.name, l.NewFunction(func(l *lua.LState) (n int) {
+			if maxLen(l) > s.maxStringLen {
+				l.RaiseError("%s: result is longer than %d bytes", name, s.maxStringLen)
+			}
+
+			return orig(l)
+		}))
+	}
+}
+
+// repLen returns the length of the result of string.rep called with the
+// arguments on the stack of l.
+func repLen(l *lua.LState) (n int) {
+	str, count := l.CheckString(1), l.CheckInt(2)
+
+	return satMul(len(str), max(count, 0))
+}
+
+// formatLen returns the upper bound of the length of the result of
+// string.format called with the arguments on the stack of l.
+func formatLen(l *lua.LState) (n int) {
+	format := l.CheckString(1)
+	n = len(format)
+	for i := 2; i <= l.GetTop(); i++ {
+		n += len(l.Get(i).String())
+	}
+
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			continue
+		}
+
+		n += maxFormatNumLen
+		i = skipFormatFlags(format, i+1)
+		for i < len(format) && (format[i] == '.' || isDigit(format[i])) {
+			var num int
+			num, i = parseNum(format, i)
+			n += num
+		}
+	}
+
+	return n
+}
+
+// skipFormatFlags returns the index of the first byte of format starting at i
+// which isn't a flag of a formatting verb.
+func skipFormatFlags(format string, i int) (next int) {
+	for i < len(format) && strings.IndexByte("-+ #0", format[i]) >= 0 {
+		i++
+	}
+
+	return i
+}
+
+// parseNum parses the decimal number starting at the i-th byte of s, possibly
+// prefixed by a dot.  next is the index right after the number.
+func parseNum(s string, i int) (num, next int) {
+	if s[i] == '.' {
+		i++
+	}
+
+	for ; i < len(s) && isDigit(s[i]); i++ {
+		num = min(num*10+int(s[i]-'0'), maxInt/10)
+	}
+
+	return num, i
+}
+
+// isDigit returns true if c is a decimal digit.
+func isDigit(c byte) (ok bool) {
+	return c >= '0' && c <= '9'
+}
+
+// gsubLen returns the upper bound of the length of the result of string.gsub
+// called with the arguments on the stack of l.  The replacement table or
+// function is replaced with a function checking the lengths of the
+// replacements as they are made.
+func (s *Script) gsubLen(l *lua.LState) (n int) {
+	str := l.CheckString(1)
+	matches := len(str) + 1
+	if limit := l.OptInt(4, -1); limit >= 0 {
+		matches = min(matches, limit)
+	}
+
+	switch repl := l.Get(3).(type) {
+	case lua.LString:
+		// The captures referenced in the replacement are parts of the matches,
+		// which don't overlap, so each reference adds at most the length of the
+		// string in total.
+		refs := strings.Count(string(repl), "%")
+
+		return len(str) + satMul(matches, len(repl)) + satMul(refs, len(str))
+	case *lua.LTable:
+		l.Replace(3, s.limitedReplacement(l, len(str), func(l *lua.LState) (v lua.LValue) {
+			return l.GetTable(repl, l.Get(1))
+		}))
+	case *lua.LFunction:
+		l.Replace(3, s.limitedReplacement(l, len(str), func(l *lua.LState) (v lua.LValue) {
+			nargs := l.GetTop()
+			l.Push(repl)
+			for i := 1; i <= nargs; i++ {
+				l.Push(l.Get(i))
+			}
+
+			l.Call(nargs, 1)
+
+			return l.Get(-1)
+		}))
+	}
+
+	return len(str)
+}
+
+// limitedReplacement returns the replacement function for string.gsub calling
+// replace and raising an error once the total length of the replacements and
+// strLen, the length of the string, exceeds s.maxStringLen.
+func (s *Script) limitedReplacement(
+	l *lua.LState,
+	strLen int,
+	replace func(l *lua.LState) (v lua.LValue),
+) (f *lua.LFunction) {
+	total := strLen
+
+	return l.NewFunction(func(l *lua.LState) (n int) {
+		v := replace(l)
+		if lua.LVCanConvToString(v) {
+			total += len(lua.LVAsString(v))
+			if total > s.maxStringLen {
+				l.RaiseError("gsub: result is longer than %d bytes", s.maxStringLen)
+			}
+		}
+
+		l.Push(v)
+
+		return 1
+	})
+}
+
+// concatLen returns the length of the result of table.concat called with the
+// arguments on the stack of l, not counting the separators after the values
+// which can't be converted to strings, since those fail the call.
+func concatLen(l *lua.LState) (n int) {
+	tbl := l.CheckTable(1)
+	sep := l.OptString(2, "")
+	i, j := max(l.OptInt(3, 1), 1), min(l.OptInt(4, tbl.Len()), tbl.Len())
+	for ; i <= j && n <= maxInt/2; i++ {
+		n += len(lua.LVAsString(tbl.RawGetInt(i))) + len(sep)
+	}
+
+	return n
+}
+
+// maxInt is the maximum value of int.
+const maxInt = int(^uint(0) >> 1)
+
+// satMul returns the product of the non-negative a and b or [maxInt] if it
+// overflows.
+func satMul(a, b int) (n int) {
+	if a != 0 && b > maxInt/a {
+		return maxInt
+	}
+
+	return a * b
+}
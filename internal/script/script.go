@@ -0,0 +1,318 @@
+// Package script implements the hooks running a Lua script for each DNS query
+// before it's resolved and after the response is received.
+//
+// The script may define the global functions before and after.  The before
+// function is called with the query table:
+//
+//	{qname = "example.com.", qtype = 1, client = "192.0.2.1", protocol = "udp"}
+//
+// It may return nothing to resolve the query as usual or a verdict table:
+//
+//	{action = "rewrite", addresses = {"192.0.2.2"}, ttl = 60}
+//
+// The action is one of allow, deny, rewrite, or redirect, in which case the
+// target field contains the domain name to resolve instead.  The after function
+// is called with the query table and the response table:
+//
+//	{rcode = 0, answers = {"example.com. 300 IN A 192.0.2.1"}}
+//
+// It may modify the rcode and the answer records of the response table in
+// place, the records are in the presentation format.
+//
+// The scripts run in a sandbox without the os, io, package, and debug
+// libraries, and each call is limited in time, in the memory it allocates, and
+// in the sizes of the stacks and of the strings built by the library functions.
+package script
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/miekg/dns"
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// Default values of the configuration.
+const (
+	DefaultStates          = 4
+	DefaultTimeout         = 50 * time.Millisecond
+	DefaultCallStackSize   = 128
+	DefaultRegistryMaxSize = 64 * 1024
+	DefaultMaxStringLen    = 64 * 1024
+	DefaultMaxMemory       = 64 * 1024 * 1024
+)
+
+// Names of the hook functions.
+const (
+	fnBefore = "before"
+	fnAfter  = "after"
+)
+
+// errNoHooks is returned by [New] when the script defines no hook functions.
+const errNoHooks errors.Error = "script defines neither before nor after function"
+
+// Config is the configuration of a script.
+type Config struct {
+	// Logger is used to log the failed calls.  If nil, [slog.Default] is used.
+	Logger *slog.Logger
+
+	// Name is the name of the script used in the error messages, for example
+	// the path to its file.
+	Name string
+
+	// Source is the Lua source code of the script.
+	Source string
+
+	// States is the number of the Lua states running the script concurrently.
+	// If zero, [DefaultStates] is used.
+	States int
+
+	// Timeout is the maximum duration of a single call of a hook function,
+	// including the waiting for a free state.  If zero, [DefaultTimeout] is
+	// used.
+	Timeout time.Duration
+
+	// CallStackSize is the maximum depth of the Lua calls.  If zero,
+	// [DefaultCallStackSize] is used.
+	CallStackSize int
+
+	// RegistryMaxSize is the maximum number of the slots of the Lua data
+	// stack.  If zero, [DefaultRegistryMaxSize] is used.
+	RegistryMaxSize int
+
+	// MaxStringLen is the maximum length of the strings built by the library
+	// functions repeating or joining their arguments, like string.rep and
+	// table.concat.  If zero, [DefaultMaxStringLen] is used.
+	MaxStringLen int
+
+	// MaxMemory is the maximum number of bytes allocated during a single call
+	// of a hook function, after which the call is interrupted.  Since the
+	// allocations are measured for the whole process and only checked
+	// periodically, it's approximate and should be well above the needs of the
+	// script.  If zero, [DefaultMaxMemory] is used.
+	MaxMemory uint64
+}
+
+// Script runs the hook functions of a Lua script.  If a call fails or times
+// out, the query is processed as if there were no hook.
+type Script struct {
+	// logger is used to log the failed calls.
+	logger *slog.Logger
+
+	// proto is the compiled script.
+	proto *lua.FunctionProto
+
+	// states is the pool of the Lua states.  A nil state is created on
+	// demand.
+	states chan *lua.LState
+
+	// opts are the options of the new Lua states.
+	opts lua.Options
+
+	// timeout is the maximum duration of a single call.
+	timeout time.Duration
+
+	// maxMemory is the maximum number of bytes allocated during a single call.
+	maxMemory uint64
+
+	// maxStringLen is the maximum length of the strings built by the library
+	// functions.
+	maxStringLen int
+
+	// hasBefore is true if the script defines the before function.
+	hasBefore bool
+
+	// hasAfter is true if the script defines the after function.
+	hasAfter bool
+}
+
+// New compiles the script and returns a new properly initialized *Script.  It
+// returns an error if the script can't be compiled or run, or if it defines no
+// hooks.  It should be closed with [Script.Close].
+func New(c *Config) (s *Script, err error) {
+	chunk, err := parse.Parse(strings.NewReader(c.Source), c.Name)
+	if err != nil {
+		return nil, fmt.Errorf("parsing: %w", err)
+	}
+
+	proto, err := lua.Compile(chunk, c.Name)
+	if err != nil {
+		return nil, fmt.Errorf("compiling: %w", err)
+	}
+
+	n := cmp.Or(c.States, DefaultStates)
+	s = &Script{
+		logger: cmp.Or(c.Logger, slog.Default()),
+		proto:  proto,
+		states: make(chan *lua.LState, n),
+		opts: lua.Options{
+			CallStackSize:   cmp.Or(c.CallStackSize, DefaultCallStackSize),
+			RegistryMaxSize: cmp.Or(c.RegistryMaxSize, DefaultRegistryMaxSize),
+			SkipOpenLibs:    true,
+		},
+		timeout:      cmp.Or(c.Timeout, DefaultTimeout),
+		maxMemory:    cmp.Or(c.MaxMemory, DefaultMaxMemory),
+		maxStringLen: cmp.Or(c.MaxStringLen, DefaultMaxStringLen),
+	}
+
+	// Run the script once to check it and to find out the defined hooks.
+	l, err := s.newState()
+	if err != nil {
+		return nil, err
+	}
+
+	s.hasBefore = l.GetGlobal(fnBefore).Type() == lua.LTFunction
+	s.hasAfter = l.GetGlobal(fnAfter).Type() == lua.LTFunction
+	if !s.hasBefore && !s.hasAfter {
+		l.Close()
+
+		return nil, errNoHooks
+	}
+
+	s.states <- l
+	for range n - 1 {
+		s.states <- nil
+	}
+
+	return s, nil
+}
+
+// sandboxLibs are the Lua libraries available to the scripts.
+var sandboxLibs = []struct {
+	open lua.LGFunction
+	name string
+}{
+	{open: lua.OpenBase, name: lua.BaseLibName},
+	{open: lua.OpenTable, name: lua.TabLibName},
+	{open: lua.OpenString, name: lua.StringLibName},
+	{open: lua.OpenMath, name: lua.MathLibName},
+}
+
+// unsafeGlobals are the functions of the base library accessing the file
+// system.
+var unsafeGlobals = []string{"dofile", "loadfile"}
+
+// newState returns a new sandboxed Lua state with the script loaded.
+func (s *Script) newState() (l *lua.LState, err error) {
+	l = lua.NewState(s.opts)
+	for _, lib := range sandboxLibs {
+		l.Push(l.NewFunction(lib.open))
+		l.Push(lua.LString(lib.name))
+		l.Call(1, 0)
+	}
+
+	for _, name := range unsafeGlobals {
+		l.SetGlobal(name, lua.LNil)
+	}
+
+	s.limitStrings(l)
+
+	ctx, cancel := newCallContext(s.timeout, s.maxMemory)
+	defer cancel()
+
+	l.SetContext(ctx)
+	defer l.RemoveContext()
+
+	l.Push(l.NewFunctionFromProto(s.proto))
+	err = l.PCall(0, 0, nil)
+	if err != nil {
+		l.Close()
+
+		return nil, fmt.Errorf("running script: %w", err)
+	}
+
+	return l, nil
+}
+
+// call calls the global fn with the arguments returned by args and passes the
+// returned value to handle.  The state is discarded if the call fails, since
+// it may be left broken.
+func (s *Script) call(
+	fn string,
+	args func(l *lua.LState) (vals []lua.LValue),
+	handle func(ret lua.LValue) (err error),
+) (err error) {
+	timer := time.NewTimer(s.timeout)
+	defer timer.Stop()
+
+	var l *lua.LState
+	select {
+	case l = <-s.states:
+	case <-timer.C:
+		return fmt.Errorf("calling %s: waiting for state: %w", fn, context.DeadlineExceeded)
+	}
+
+	if l == nil {
+		l, err = s.newState()
+		if err != nil {
+			s.states <- nil
+
+			return err
+		}
+	}
+
+	ctx, cancel := newCallContext(s.timeout, s.maxMemory)
+	defer cancel()
+
+	l.SetContext(ctx)
+	err = l.CallByParam(lua.P{
+		Fn:      l.GetGlobal(fn),
+		NRet:    1,
+		Protect: true,
+	}, args(l)...)
+	l.RemoveContext()
+	if err != nil {
+		l.Close()
+		s.states <- nil
+
+		return fmt.Errorf("calling %s: %w", fn, err)
+	}
+
+	// Handle the returned value before returning the state to the pool, since
+	// the script may retain it.
+	err = handle(l.Get(-1))
+	l.Pop(1)
+	s.states <- l
+
+	return err
+}
+
+// queryTable returns the query table for dctx.  dctx.Req must have a question.
+func queryTable(l *lua.LState, dctx *proxy.DNSContext) (t *lua.LTable) {
+	q := dctx.Req.Question[0]
+
+	t = l.NewTable()
+	t.RawSetString("qname", lua.LString(strings.ToLower(dns.Fqdn(q.Name))))
+	t.RawSetString("qtype", lua.LNumber(q.Qtype))
+	t.RawSetString("client", lua.LString(dctx.Addr.Addr().String()))
+	t.RawSetString("protocol", lua.LString(dctx.Proto))
+	t.RawSetString("server_name", lua.LString(dctx.ServerName))
+	t.RawSetString("http_path", lua.LString(dctx.HTTPPath))
+	t.RawSetString("http_user", lua.LString(dctx.HTTPUser))
+
+	return t
+}
+
+// Close closes the Lua states.  It waits for the calls in progress to finish.
+func (s *Script) Close() (err error) {
+	for range cap(s.states) {
+		if l := <-s.states; l != nil {
+			l.Close()
+		}
+	}
+
+	return nil
+}
+
+// logCallError logs the error of calling a hook function for dctx.
+func (s *Script) logCallError(dctx *proxy.DNSContext, err error) {
+	s.logger.Debug("running script", "qname", dctx.Req.Question[0].Name, slogutil.KeyError, err)
+}
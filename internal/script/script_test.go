@@ -0,0 +1,283 @@
+package script_test
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/internal/script"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testSource is the source of the script used in tests.
+const testSource = `
+function before(q)
+	if q.qname == "deny.example." then
+		return {action = "deny"}
+	elseif q.qname == "rewrite.example." then
+		return {action = "rewrite", addresses = {"192.0.2.2"}, ttl = 30}
+	elseif q.qname == "loop.example." then
+		while true do end
+	elseif q.qname == "bad.example." then
+		return 42
+	elseif q.qname == "identity.example." and q.server_name == "family.example" and
+		q.http_path == "/dns-query/kids" and q.http_user == "kid" then
+		return {action = "deny"}
+	end
+end
+
+function after(q, r)
+	if q.qname == "filtered.example." then
+		r.rcode = 3
+		r.answers = {}
+	elseif q.qname == "extended.example." then
+		table.insert(r.answers, "extended.example. 60 IN A 192.0.2.3")
+	end
+end
+`
+
+// newTestScript returns a new *Script running source.
+func newTestScript(t *testing.T, source string) (s *script.Script) {
+	t.Helper()
+
+	s, err := script.New(&script.Config{
+		Logger:  slogutil.NewDiscardLogger(),
+		Name:    "test.lua",
+		Source:  source,
+		States:  2,
+		Timeout: 100 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, s.Close)
+
+	return s
+}
+
+// newTestContext returns a new request context for host with a response with
+// a single A record.
+func newTestContext(host string) (dctx *proxy.DNSContext) {
+	req := (&dns.Msg{}).SetQuestion(dns.Fqdn(host), dns.TypeA)
+	resp := (&dns.Msg{}).SetReply(req)
+	resp.Answer = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{
+			Name:   req.Question[0].Name,
+			Rrtype: dns.TypeA,
+			Class:  dns.ClassINET,
+			Ttl:    60,
+		},
+		A: net.IP{192, 0, 2, 1},
+	}}
+
+	return &proxy.DNSContext{
+		Req:   req,
+		Res:   resp,
+		Addr:  netip.MustParseAddrPort("192.0.2.1:53"),
+		Proto: proxy.ProtoUDP,
+	}
+}
+
+// requireResponse requires err to be a [proxy.BeforeRequestError] and returns
+// its response.
+func requireResponse(t *testing.T, err error) (resp *dns.Msg) {
+	t.Helper()
+
+	befErr := &proxy.BeforeRequestError{}
+	require.ErrorAs(t, err, &befErr)
+	require.NotNil(t, befErr.Response)
+
+	return befErr.Response
+}
+
+func TestScript_HandleBefore(t *testing.T) {
+	s := newTestScript(t, testSource)
+
+	t.Run("allow", func(t *testing.T) {
+		assert.NoError(t, s.HandleBefore(nil, newTestContext("allow.example")))
+	})
+
+	t.Run("deny", func(t *testing.T) {
+		resp := requireResponse(t, s.HandleBefore(nil, newTestContext("deny.example")))
+		assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+	})
+
+	t.Run("rewrite", func(t *testing.T) {
+		resp := requireResponse(t, s.HandleBefore(nil, newTestContext("rewrite.example")))
+		require.Len(t, resp.Answer, 1)
+
+		a := testutil.RequireTypeAssert[*dns.A](t, resp.Answer[0])
+		assert.Equal(t, "192.0.2.2", a.A.String())
+		assert.Equal(t, uint32(30), a.Hdr.Ttl)
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		assert.NoError(t, s.HandleBefore(nil, newTestContext("loop.example")))
+
+		// The interrupted state is replaced.
+		resp := requireResponse(t, s.HandleBefore(nil, newTestContext("deny.example")))
+		assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+	})
+
+	t.Run("bad_return", func(t *testing.T) {
+		assert.NoError(t, s.HandleBefore(nil, newTestContext("bad.example")))
+	})
+
+	t.Run("identity", func(t *testing.T) {
+		dctx := newTestContext("identity.example")
+		assert.NoError(t, s.HandleBefore(nil, dctx))
+
+		dctx.Proto = proxy.ProtoHTTPS
+		dctx.ServerName = "family.example"
+		dctx.HTTPPath = "/dns-query/kids"
+		dctx.HTTPUser = "kid"
+
+		resp := requireResponse(t, s.HandleBefore(nil, dctx))
+		assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+	})
+}
+
+func TestScript_HandleResponse(t *testing.T) {
+	s := newTestScript(t, testSource)
+
+	t.Run("unchanged", func(t *testing.T) {
+		dctx := newTestContext("other.example")
+		s.HandleResponse(dctx, nil)
+
+		assert.Equal(t, dns.RcodeSuccess, dctx.Res.Rcode)
+		assert.Len(t, dctx.Res.Answer, 1)
+	})
+
+	t.Run("filtered", func(t *testing.T) {
+		dctx := newTestContext("filtered.example")
+		s.HandleResponse(dctx, nil)
+
+		assert.Equal(t, dns.RcodeNameError, dctx.Res.Rcode)
+		assert.Empty(t, dctx.Res.Answer)
+	})
+
+	t.Run("extended", func(t *testing.T) {
+		dctx := newTestContext("extended.example")
+		s.HandleResponse(dctx, nil)
+
+		require.Len(t, dctx.Res.Answer, 2)
+
+		a := testutil.RequireTypeAssert[*dns.A](t, dctx.Res.Answer[1])
+		assert.Equal(t, "192.0.2.3", a.A.String())
+	})
+}
+
+func TestNew(t *testing.T) {
+	testCases := []struct {
+		name       string
+		source     string
+		wantErrMsg string
+	}{{
+		name:       "syntax_error",
+		source:     "function before(",
+		wantErrMsg: "parsing: test.lua at EOF:   syntax error\n",
+	}, {
+		name:       "no_hooks",
+		source:     "x = 1",
+		wantErrMsg: "script defines neither before nor after function",
+	}, {
+		name:       "no_os",
+		source:     "os.exit(1)",
+		wantErrMsg: "",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := script.New(&script.Config{
+				Name:   "test.lua",
+				Source: tc.source,
+			})
+			require.Error(t, err)
+
+			if tc.wantErrMsg != "" {
+				assert.Equal(t, tc.wantErrMsg, err.Error())
+			}
+		})
+	}
+}
+
+func TestNew_limits(t *testing.T) {
+	testCases := []struct {
+		name       string
+		source     string
+		wantErrMsg string
+	}{{
+		name:       "rep",
+		source:     `s = string.rep("x", 2^40)`,
+		wantErrMsg: "rep: result is longer than 1024 bytes",
+	}, {
+		name:       "method_rep",
+		source:     `s = ("x"):rep(2^40)`,
+		wantErrMsg: "rep: result is longer than 1024 bytes",
+	}, {
+		name:       "format",
+		source:     `s = string.format("%999999d", 1)`,
+		wantErrMsg: "format: result is longer than 1024 bytes",
+	}, {
+		name:       "gsub",
+		source:     `s = string.gsub(string.rep("x", 512), "x", "%0%0%0")`,
+		wantErrMsg: "gsub: result is longer than 1024 bytes",
+	}, {
+		name:       "gsub_function",
+		source:     `s = string.gsub(string.rep("x", 512), "x", function(c) return c .. c .. c end)`,
+		wantErrMsg: "gsub: result is longer than 1024 bytes",
+	}, {
+		name:       "concat",
+		source:     `t = {} for i = 1, 512 do t[i] = "xyz" end s = table.concat(t)`,
+		wantErrMsg: "concat: result is longer than 1024 bytes",
+	}, {
+		name:       "table_growth",
+		source:     `t = {} while true do t[#t + 1] = {} end`,
+		wantErrMsg: "memory limit exceeded",
+	}, {
+		name:       "string_growth",
+		source:     `s = "x" while true do s = s .. "x" end`,
+		wantErrMsg: "memory limit exceeded",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := script.New(&script.Config{
+				Name:         "test.lua",
+				Source:       tc.source,
+				Timeout:      time.Minute,
+				MaxStringLen: 1024,
+				MaxMemory:    1024 * 1024,
+			})
+			assert.ErrorContains(t, err, tc.wantErrMsg)
+		})
+	}
+
+	t.Run("within_limits", func(t *testing.T) {
+		s, err := script.New(&script.Config{
+			Logger: slogutil.NewDiscardLogger(),
+			Name:   "test.lua",
+			Source: `
+function before(q)
+	local s = string.format("%s:%3d", q.qname, q.qtype)
+	s = string.gsub(string.rep(s, 2), "%d", "%0%0")
+	s = string.gsub(s, "%a+", {deny = "ok"})
+	s = string.gsub(s, "%.", function(c) return c .. c end)
+	if s == "ok..example..:  11ok..example..:  11" then
+		return {action = "deny"}
+	end
+end
+`,
+			MaxStringLen: 1024,
+		})
+		require.NoError(t, err)
+		testutil.CleanupAndRequireSuccess(t, s.Close)
+
+		resp := requireResponse(t, s.HandleBefore(nil, newTestContext("deny.example")))
+		assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+	})
+}
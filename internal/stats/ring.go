@@ -0,0 +1,167 @@
+package stats
+
+import (
+	"net/netip"
+	"time"
+)
+
+// ring is the fixed number of the buckets collecting the statistics for the
+// consecutive periods of time.
+type ring struct {
+	// buckets are the buckets of the ring, the bucket for a time is chosen by
+	// the number of the period since the Unix epoch.
+	buckets []*bucket
+
+	// width is the period of time of a single bucket.
+	width time.Duration
+}
+
+// newRing returns a new ring of n buckets for the periods of width.
+func newRing(width time.Duration, n int) (r *ring) {
+	r = &ring{
+		buckets: make([]*bucket, n),
+		width:   width,
+	}
+
+	for i := range r.buckets {
+		r.buckets[i] = newBucket(time.Time{})
+	}
+
+	return r
+}
+
+// bucket returns the bucket for now, resetting it if it has been collecting
+// the statistics for an earlier period.
+func (r *ring) bucket(now time.Time) (b *bucket) {
+	start := now.Truncate(r.width)
+	i := int(start.Unix()/int64(r.width/time.Second)) % len(r.buckets)
+
+	b = r.buckets[i]
+	if !b.start.Equal(start) {
+		b = newBucket(start)
+		r.buckets[i] = b
+	}
+
+	return b
+}
+
+// bucket is the statistics collected for a single period of time.
+type bucket struct {
+	// start is the start of the period.
+	start time.Time
+
+	// domains maps the queried domains to the number of the requests.
+	domains map[string]uint64
+
+	// blockedDomains maps the blocked domains to the number of the requests.
+	blockedDomains map[string]uint64
+
+	// clients maps the client addresses to the number of the requests.
+	clients map[string]uint64
+
+	// rcodes maps the response codes to the number of the responses.
+	rcodes map[string]uint64
+
+	// protos maps the protocols to the shapes of the responses sent over
+	// them.
+	protos map[string]*shape
+
+	// upstreams maps the upstream addresses to the shapes of the responses
+	// resolved with them.
+	upstreams map[string]*shape
+
+	// talkers maps the client subnets to their counters.
+	talkers map[netip.Prefix]*talker
+
+	// total is the total number of the requests.
+	total uint64
+
+	// blocked is the number of the blocked requests.
+	blocked uint64
+}
+
+// newBucket returns a new empty bucket for the period starting at start.
+func newBucket(start time.Time) (b *bucket) {
+	return &bucket{
+		start:          start,
+		domains:        map[string]uint64{},
+		blockedDomains: map[string]uint64{},
+		clients:        map[string]uint64{},
+		rcodes:         map[string]uint64{},
+		protos:         map[string]*shape{},
+		upstreams:      map[string]*shape{},
+		talkers:        map[netip.Prefix]*talker{},
+	}
+}
+
+// add counts a single request.  The empty domain and client aren't counted in
+// the top lists.
+func (b *bucket) add(domain, client, rcode string, blocked bool) {
+	b.total++
+	b.rcodes[rcode]++
+	incBounded(b.domains, domain, 1)
+	incBounded(b.clients, client, 1)
+
+	if blocked {
+		b.blocked++
+		incBounded(b.blockedDomains, domain, 1)
+	}
+}
+
+// addShape counts the shape of a single response sent over proto and resolved
+// with upstream.  The empty upstream isn't counted.
+func (b *bucket) addShape(proto, upstream string, size, answers int, truncated bool) {
+	addShape(b.protos, proto, size, answers, truncated)
+	addShape(b.upstreams, upstream, size, answers, truncated)
+}
+
+// merge adds the counters of other to b.
+func (b *bucket) merge(other *bucket) {
+	b.total += other.total
+	b.blocked += other.blocked
+
+	for k, v := range other.rcodes {
+		b.rcodes[k] += v
+	}
+
+	for k, v := range other.domains {
+		b.domains[k] += v
+	}
+
+	for k, v := range other.blockedDomains {
+		b.blockedDomains[k] += v
+	}
+
+	for k, v := range other.clients {
+		b.clients[k] += v
+	}
+
+	mergeShapes(b.protos, other.protos)
+	mergeShapes(b.upstreams, other.upstreams)
+	mergeTalkers(b.talkers, other.talkers)
+}
+
+// mergeShapes adds the shapes from other to shapes.
+func mergeShapes(shapes, other map[string]*shape) {
+	for k, v := range other {
+		s, ok := shapes[k]
+		if !ok {
+			s = &shape{}
+			shapes[k] = s
+		}
+
+		s.merge(v)
+	}
+}
+
+// incBounded adds n to the counter of key in counts, unless key is empty or
+// counts already has [maxBucketKeys] other keys.
+func incBounded(counts map[string]uint64, key string, n uint64) {
+	if key == "" {
+		return
+	}
+
+	if _, ok := counts[key]; ok || len(counts) < maxBucketKeys {
+		counts[key] += n
+	}
+}
@@ -0,0 +1,167 @@
+package stats
+
+import "math"
+
+// sizeBounds are the upper bounds of the response size histogram buckets in
+// bytes.  Those are chosen to show the responses exceeding the minimum DNS
+// message size, the recommended EDNS buffer size of 1232 bytes avoiding the IP
+// fragmentation, and the Ethernet MTU.
+var sizeBounds = [...]int{
+	512,
+	1232,
+	1452,
+	4096,
+	math.MaxUint16,
+}
+
+// answerBounds are the upper bounds of the answer count histogram buckets.
+var answerBounds = [...]int{
+	0,
+	1,
+	2,
+	4,
+	8,
+	16,
+	math.MaxUint16,
+}
+
+// shape is the statistics of the sizes and the contents of the responses.
+type shape struct {
+	// sizes are the numbers of the responses by the buckets of [sizeBounds].
+	sizes [len(sizeBounds)]uint64
+
+	// answers are the numbers of the responses by the buckets of
+	// [answerBounds].
+	answers [len(answerBounds)]uint64
+
+	// total is the total number of the responses.
+	total uint64
+
+	// truncated is the number of the responses with the TC flag set.
+	truncated uint64
+}
+
+// add counts a single response.
+func (s *shape) add(size, answers int, truncated bool) {
+	s.total++
+	s.sizes[boundIndex(sizeBounds[:], size)]++
+	s.answers[boundIndex(answerBounds[:], answers)]++
+
+	if truncated {
+		s.truncated++
+	}
+}
+
+// merge adds the counters of other to s.
+func (s *shape) merge(other *shape) {
+	s.total += other.total
+	s.truncated += other.truncated
+
+	for i, n := range other.sizes {
+		s.sizes[i] += n
+	}
+
+	for i, n := range other.answers {
+		s.answers[i] += n
+	}
+}
+
+// boundIndex returns the index of the first of bounds not less than v, or the
+// last index if there is none.
+func boundIndex(bounds []int, v int) (i int) {
+	for i = range bounds[:len(bounds)-1] {
+		if v <= bounds[i] {
+			return i
+		}
+	}
+
+	return len(bounds) - 1
+}
+
+// HistogramBucket is a single bucket of a histogram.
+type HistogramBucket struct {
+	// Max is the inclusive upper bound of the bucket.  The lower bound is the
+	// upper bound of the previous bucket, exclusively.
+	Max int `json:"max"`
+
+	// Count is the number of the values within the bucket.
+	Count uint64 `json:"count"`
+}
+
+// Shape is the statistics of the sizes and the contents of the responses,
+// which help to diagnose the IP fragmentation and the retries over TCP.
+type Shape struct {
+	// Sizes is the histogram of the sizes of the responses in bytes.
+	Sizes []HistogramBucket `json:"sizes"`
+
+	// Answers is the histogram of the numbers of the records in the answer
+	// sections of the responses.
+	Answers []HistogramBucket `json:"answers"`
+
+	// Total is the total number of the responses.
+	Total uint64 `json:"total"`
+
+	// Truncated is the number of the responses with the TC flag set.
+	Truncated uint64 `json:"truncated"`
+
+	// TruncationRate is the ratio of Truncated to Total.
+	TruncationRate float64 `json:"truncation_rate"`
+}
+
+// export returns the exported representation of s.
+func (s *shape) export() (sh *Shape) {
+	sh = &Shape{
+		Sizes:     histogram(sizeBounds[:], s.sizes[:]),
+		Answers:   histogram(answerBounds[:], s.answers[:]),
+		Total:     s.total,
+		Truncated: s.truncated,
+	}
+
+	if s.total > 0 {
+		sh.TruncationRate = float64(s.truncated) / float64(s.total)
+	}
+
+	return sh
+}
+
+// histogram returns the histogram buckets with the upper bounds from bounds
+// and the numbers of the values from counts.  bounds and counts must be of the
+// same length.
+func histogram(bounds []int, counts []uint64) (h []HistogramBucket) {
+	h = make([]HistogramBucket, len(bounds))
+	for i, b := range bounds {
+		h[i] = HistogramBucket{Max: b, Count: counts[i]}
+	}
+
+	return h
+}
+
+// exportShapes returns the exported representations of shapes.
+func exportShapes(shapes map[string]*shape) (exported map[string]*Shape) {
+	exported = make(map[string]*Shape, len(shapes))
+	for k, s := range shapes {
+		exported[k] = s.export()
+	}
+
+	return exported
+}
+
+// addShape counts a single response in the shape of key in shapes, unless key
+// is empty or shapes already has [maxBucketKeys] other keys.
+func addShape(shapes map[string]*shape, key string, size, answers int, truncated bool) {
+	if key == "" {
+		return
+	}
+
+	s, ok := shapes[key]
+	if !ok {
+		if len(shapes) >= maxBucketKeys {
+			return
+		}
+
+		s = &shape{}
+		shapes[key] = s
+	}
+
+	s.add(size, answers, truncated)
+}
@@ -0,0 +1,272 @@
+// Package stats contains the implementation of the proxy query logger keeping
+// the rolling statistics of the processed requests.
+package stats
+
+import (
+	"cmp"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+)
+
+// Window is the period of time the statistics are collected for.
+type Window string
+
+// Valid windows.
+const (
+	// WindowMinute is the last minute, collected with five-second precision.
+	WindowMinute Window = "minute"
+
+	// WindowHour is the last hour, collected with one-minute precision.
+	WindowHour Window = "hour"
+
+	// WindowDay is the last day, collected with one-hour precision.
+	WindowDay Window = "day"
+)
+
+// DefaultTopLen is the default number of the entries in the top lists.
+const DefaultTopLen = 10
+
+// maxBucketKeys is the maximum number of the distinct domains or clients
+// counted within a single bucket.  The requests for the new keys exceeding it
+// are only counted in the totals, so that the memory consumption stays bounded.
+const maxBucketKeys = 10_000
+
+// Config is the configuration of the [Stats].
+type Config struct {
+	// TopLen is the default number of the entries in the top lists.  If zero,
+	// [DefaultTopLen] is used.
+	TopLen int
+
+	// SubnetLenIPv4 is the length of the IPv4 client subnets the talkers are
+	// counted for.  If zero, [DefaultSubnetLenIPv4] is used.
+	SubnetLenIPv4 int
+
+	// SubnetLenIPv6 is the length of the IPv6 client subnets the talkers are
+	// counted for.  If zero, [DefaultSubnetLenIPv6] is used.
+	SubnetLenIPv6 int
+}
+
+// Stats is the [proxy.QueryLogger] keeping the rolling counters of the top
+// queried and blocked domains, the top clients and client subnets, the
+// response codes, and the shapes of the responses.  It's also an
+// [http.Handler] serving the statistics as JSON.
+type Stats struct {
+	// now returns the current time.  It's replaced in tests.
+	now func() (now time.Time)
+
+	// mu protects minute, hour, and day.
+	mu *sync.Mutex
+
+	// minute collects the statistics for [WindowMinute].
+	minute *ring
+
+	// hour collects the statistics for [WindowHour].
+	hour *ring
+
+	// day collects the statistics for [WindowDay].
+	day *ring
+
+	// topLen is the default number of the entries in the top lists.
+	topLen int
+
+	// subnetLenIPv4 is the length of the IPv4 client subnets of the talkers.
+	subnetLenIPv4 int
+
+	// subnetLenIPv6 is the length of the IPv6 client subnets of the talkers.
+	subnetLenIPv6 int
+}
+
+// type check
+var (
+	_ proxy.QueryLogger = (*Stats)(nil)
+	_ http.Handler      = (*Stats)(nil)
+)
+
+// New returns a new properly initialized *Stats.  c must not be nil.
+func New(c *Config) (s *Stats) {
+	return &Stats{
+		now:           time.Now,
+		mu:            &sync.Mutex{},
+		minute:        newRing(5*time.Second, 12),
+		hour:          newRing(time.Minute, 60),
+		day:           newRing(time.Hour, 24),
+		topLen:        cmp.Or(c.TopLen, DefaultTopLen),
+		subnetLenIPv4: cmp.Or(c.SubnetLenIPv4, DefaultSubnetLenIPv4),
+		subnetLenIPv6: cmp.Or(c.SubnetLenIPv6, DefaultSubnetLenIPv6),
+	}
+}
+
+// LogQuery implements the [proxy.QueryLogger] interface for *Stats.
+func (s *Stats) LogQuery(e *proxy.QueryLogEntry) {
+	domain := strings.ToLower(strings.TrimSuffix(e.QName, "."))
+
+	var client string
+	if e.Client.IsValid() {
+		client = e.Client.Addr().String()
+	}
+
+	subnet := s.subnet(e.Client.Addr())
+
+	rcode, ok := dns.RcodeToString[e.Rcode]
+	if !ok {
+		rcode = strconv.Itoa(e.Rcode)
+	}
+
+	now := s.now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, r := range []*ring{s.minute, s.hour, s.day} {
+		b := r.bucket(now)
+		b.add(domain, client, rcode, e.Blocked)
+		b.addShape(string(e.Proto), e.Upstream, e.Size, e.Answers, e.Truncated)
+		b.addTalker(subnet, rcode)
+	}
+}
+
+// Entry is a single entry of a top list.
+type Entry struct {
+	// Name is the domain name or the client address.
+	Name string `json:"name"`
+
+	// Count is the number of the requests.
+	Count uint64 `json:"count"`
+}
+
+// Summary is the statistics collected for a window.
+type Summary struct {
+	// Rcodes maps the response codes to the number of the responses.
+	Rcodes map[string]uint64 `json:"rcodes"`
+
+	// Protos maps the protocols to the shapes of the responses sent over
+	// them.
+	Protos map[string]*Shape `json:"protos"`
+
+	// Upstreams maps the upstream addresses to the shapes of the responses
+	// resolved with them, including the ones served from the cache.
+	Upstreams map[string]*Shape `json:"upstreams"`
+
+	// Window is the period of time of the statistics.
+	Window Window `json:"window"`
+
+	// TopDomains are the most queried domains.
+	TopDomains []Entry `json:"top_domains"`
+
+	// TopBlockedDomains are the most blocked domains.
+	TopBlockedDomains []Entry `json:"top_blocked_domains"`
+
+	// TopClients are the clients sending the most requests.
+	TopClients []Entry `json:"top_clients"`
+
+	// TopTalkers are the client subnets sending the most requests.
+	TopTalkers []*Talker `json:"top_talkers"`
+
+	// Total is the total number of the requests.
+	Total uint64 `json:"total"`
+
+	// Blocked is the total number of the blocked requests.
+	Blocked uint64 `json:"blocked"`
+}
+
+// Summary returns the statistics for w with at most n entries in each of the
+// top lists.  If n is not positive, the configured default is used.  It
+// returns nil if w is not a valid window.
+func (s *Stats) Summary(w Window, n int) (sum *Summary) {
+	if n <= 0 {
+		n = s.topLen
+	}
+
+	var r *ring
+	switch w {
+	case WindowMinute:
+		r = s.minute
+	case WindowHour:
+		r = s.hour
+	case WindowDay:
+		r = s.day
+	default:
+		return nil
+	}
+
+	now := s.now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dur := r.width * time.Duration(len(r.buckets))
+	total := newBucket(time.Time{})
+	for _, b := range r.buckets {
+		if b.start.After(now.Add(-dur)) {
+			total.merge(b)
+		}
+	}
+
+	return &Summary{
+		Rcodes:            total.rcodes,
+		Protos:            exportShapes(total.protos),
+		Upstreams:         exportShapes(total.upstreams),
+		Window:            w,
+		TopDomains:        top(total.domains, n),
+		TopBlockedDomains: top(total.blockedDomains, n),
+		TopClients:        top(total.clients, n),
+		TopTalkers:        topTalkers(total.talkers, n, dur),
+		Total:             total.total,
+		Blocked:           total.blocked,
+	}
+}
+
+// ServeHTTP implements the [http.Handler] interface for *Stats.  It serves the
+// [Summary] for the window from the "window" query parameter, [WindowHour] by
+// default, with the number of the top entries from the "limit" parameter.
+func (s *Stats) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	win := Window(cmp.Or(q.Get("window"), string(WindowHour)))
+
+	var n int
+	if limit := q.Get("limit"); limit != "" {
+		var err error
+		n, err = strconv.Atoi(limit)
+		if err != nil {
+			http.Error(w, "bad limit: "+err.Error(), http.StatusBadRequest)
+
+			return
+		}
+	}
+
+	sum := s.Summary(win, n)
+	if sum == nil {
+		http.Error(w, "bad window: "+string(win), http.StatusBadRequest)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	// Ignore the error, since it's only possible if the client has gone.
+	_ = json.NewEncoder(w).Encode(sum)
+}
+
+// top returns at most n entries of counts with the largest counts, sorted by
+// the count descending and by the name ascending.
+func top(counts map[string]uint64, n int) (entries []Entry) {
+	entries = make([]Entry, 0, len(counts))
+	for name, count := range counts {
+		entries = append(entries, Entry{Name: name, Count: count})
+	}
+
+	slices.SortFunc(entries, func(a, b Entry) (res int) {
+		return cmp.Or(cmp.Compare(b.Count, a.Count), strings.Compare(a.Name, b.Name))
+	})
+
+	return entries[:min(n, len(entries))]
+}
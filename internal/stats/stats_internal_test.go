@@ -0,0 +1,221 @@
+package stats
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Common clients for tests.
+var (
+	testClientA = netip.MustParseAddrPort("192.0.2.1:53")
+	testClientB = netip.MustParseAddrPort("192.0.2.2:53")
+)
+
+func TestStats(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 30, 0, 0, time.UTC)
+
+	s := New(&Config{})
+	s.now = func() (n time.Time) { return now }
+
+	logQuery := func(name string, client netip.AddrPort, rcode int, blocked bool) {
+		s.LogQuery(&proxy.QueryLogEntry{
+			Client:  client,
+			QName:   name,
+			Rcode:   rcode,
+			Blocked: blocked,
+		})
+	}
+
+	logQuery("Old.Example.", testClientB, dns.RcodeSuccess, false)
+
+	now = now.Add(90 * time.Minute)
+	logQuery("a.example.", testClientA, dns.RcodeSuccess, false)
+	logQuery("a.example.", testClientA, dns.RcodeSuccess, false)
+	logQuery("ads.example.", testClientA, dns.RcodeSuccess, true)
+	logQuery("b.example.", testClientB, dns.RcodeNameError, false)
+
+	hour := s.Summary(WindowHour, 0)
+	require.NotNil(t, hour)
+
+	assert.Equal(t, uint64(4), hour.Total)
+	assert.Equal(t, uint64(1), hour.Blocked)
+	assert.Equal(t, []Entry{
+		{Name: "a.example", Count: 2},
+		{Name: "ads.example", Count: 1},
+		{Name: "b.example", Count: 1},
+	}, hour.TopDomains)
+	assert.Equal(t, []Entry{{Name: "ads.example", Count: 1}}, hour.TopBlockedDomains)
+	assert.Equal(t, []Entry{
+		{Name: "192.0.2.1", Count: 3},
+		{Name: "192.0.2.2", Count: 1},
+	}, hour.TopClients)
+	assert.Equal(t, map[string]uint64{"NOERROR": 3, "NXDOMAIN": 1}, hour.Rcodes)
+
+	day := s.Summary(WindowDay, 1)
+	require.NotNil(t, day)
+
+	assert.Equal(t, uint64(5), day.Total)
+	assert.Equal(t, []Entry{{Name: "a.example", Count: 2}}, day.TopDomains)
+	assert.Equal(t, []Entry{{Name: "192.0.2.1", Count: 3}}, day.TopClients)
+
+	now = now.Add(25 * time.Hour)
+	day = s.Summary(WindowDay, 0)
+	require.NotNil(t, day)
+
+	assert.Zero(t, day.Total)
+	assert.Empty(t, day.TopDomains)
+
+	assert.Nil(t, s.Summary("week", 0))
+}
+
+func TestStats_ServeHTTP(t *testing.T) {
+	s := New(&Config{})
+	s.LogQuery(&proxy.QueryLogEntry{
+		Client: testClientA,
+		QName:  "example.org.",
+		Rcode:  dns.RcodeSuccess,
+	})
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/stats?window=day&limit=5", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	sum := &Summary{}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(sum))
+
+	assert.Equal(t, WindowDay, sum.Window)
+	assert.Equal(t, uint64(1), sum.Total)
+	assert.Equal(t, []Entry{{Name: "example.org", Count: 1}}, sum.TopDomains)
+
+	for _, target := range []string{"/stats?window=week", "/stats?limit=many"} {
+		w = httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		assert.Equal(t, http.StatusBadRequest, w.Code, target)
+	}
+}
+
+func TestStats_shapes(t *testing.T) {
+	const ups = "192.0.2.53:53"
+
+	s := New(&Config{})
+
+	s.LogQuery(&proxy.QueryLogEntry{
+		Client:   testClientA,
+		Proto:    proxy.ProtoUDP,
+		QName:    "a.example.",
+		Upstream: ups,
+		Size:     100,
+		Answers:  1,
+	})
+	s.LogQuery(&proxy.QueryLogEntry{
+		Client:    testClientA,
+		Proto:     proxy.ProtoUDP,
+		QName:     "b.example.",
+		Upstream:  ups,
+		Size:      1232,
+		Answers:   20,
+		Truncated: true,
+	})
+	s.LogQuery(&proxy.QueryLogEntry{
+		Client:  testClientB,
+		Proto:   proxy.ProtoTCP,
+		QName:   "b.example.",
+		Size:    3000,
+		Answers: 40,
+	})
+
+	sum := s.Summary(WindowHour, 0)
+	require.NotNil(t, sum)
+
+	require.Contains(t, sum.Protos, string(proxy.ProtoUDP))
+	udp := sum.Protos[string(proxy.ProtoUDP)]
+	assert.Equal(t, uint64(2), udp.Total)
+	assert.Equal(t, uint64(1), udp.Truncated)
+	assert.InDelta(t, 0.5, udp.TruncationRate, 1e-9)
+	assert.Equal(t, []HistogramBucket{
+		{Max: 512, Count: 1},
+		{Max: 1232, Count: 1},
+		{Max: 1452, Count: 0},
+		{Max: 4096, Count: 0},
+		{Max: 65535, Count: 0},
+	}, udp.Sizes)
+	assert.Equal(t, []HistogramBucket{
+		{Max: 0, Count: 0},
+		{Max: 1, Count: 1},
+		{Max: 2, Count: 0},
+		{Max: 4, Count: 0},
+		{Max: 8, Count: 0},
+		{Max: 16, Count: 0},
+		{Max: 65535, Count: 1},
+	}, udp.Answers)
+
+	require.Contains(t, sum.Protos, string(proxy.ProtoTCP))
+	tcp := sum.Protos[string(proxy.ProtoTCP)]
+	assert.Equal(t, uint64(1), tcp.Total)
+	assert.Zero(t, tcp.TruncationRate)
+	assert.Equal(t, uint64(1), tcp.Sizes[3].Count)
+
+	assert.Len(t, sum.Upstreams, 1)
+	require.Contains(t, sum.Upstreams, ups)
+	assert.Equal(t, udp, sum.Upstreams[ups])
+}
+
+func TestStats_TopTalkers(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 30, 0, 0, time.UTC)
+
+	s := New(&Config{SubnetLenIPv4: 16})
+	s.now = func() (n time.Time) { return now }
+
+	logQuery := func(client string, rcode int) {
+		s.LogQuery(&proxy.QueryLogEntry{
+			Client: netip.MustParseAddrPort(client),
+			QName:  "example.org.",
+			Rcode:  rcode,
+		})
+	}
+
+	logQuery("198.51.100.1:53", dns.RcodeSuccess)
+
+	now = now.Add(2 * time.Minute)
+	logQuery("192.0.2.1:53", dns.RcodeSuccess)
+	logQuery("[::ffff:192.0.3.1]:53", dns.RcodeRefused)
+	logQuery("[2001:db8::1]:53", dns.RcodeSuccess)
+	logQuery("[2001:db8:0:ff::1]:53", dns.RcodeSuccess)
+	logQuery("[2001:db8:0:100::1]:53", dns.RcodeSuccess)
+
+	talkers := s.TopTalkers(WindowMinute, 0)
+	assert.Equal(t, []*Talker{{
+		Rcodes: map[string]uint64{"NOERROR": 1, "REFUSED": 1},
+		Subnet: netip.MustParsePrefix("192.0.0.0/16"),
+		Count:  2,
+		QPS:    2.0 / 60,
+	}, {
+		Rcodes: map[string]uint64{"NOERROR": 2},
+		Subnet: netip.MustParsePrefix("2001:db8::/56"),
+		Count:  2,
+		QPS:    2.0 / 60,
+	}, {
+		Rcodes: map[string]uint64{"NOERROR": 1},
+		Subnet: netip.MustParsePrefix("2001:db8:0:100::/56"),
+		Count:  1,
+		QPS:    1.0 / 60,
+	}}, talkers)
+
+	hour := s.Summary(WindowHour, 1)
+	require.NotNil(t, hour)
+	require.Len(t, hour.TopTalkers, 1)
+
+	assert.Equal(t, netip.MustParsePrefix("192.0.0.0/16"), hour.TopTalkers[0].Subnet)
+	assert.Equal(t, uint64(2), hour.TopTalkers[0].Count)
+
+	assert.Nil(t, s.TopTalkers("week", 0))
+}
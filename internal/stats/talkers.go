@@ -0,0 +1,134 @@
+package stats
+
+import (
+	"cmp"
+	"maps"
+	"net/netip"
+	"slices"
+	"time"
+)
+
+const (
+	// DefaultSubnetLenIPv4 is the default length of the IPv4 client subnets
+	// the talkers are counted for, which is the default one of the
+	// ratelimiting.
+	DefaultSubnetLenIPv4 = 24
+
+	// DefaultSubnetLenIPv6 is the default length of the IPv6 client subnets
+	// the talkers are counted for, which is the default one of the
+	// ratelimiting.
+	DefaultSubnetLenIPv6 = 56
+)
+
+// Talker is the statistics of a single client subnet.
+type Talker struct {
+	// Rcodes maps the response codes to the number of the responses sent to
+	// the subnet.
+	Rcodes map[string]uint64 `json:"rcodes"`
+
+	// Subnet is the client subnet.
+	Subnet netip.Prefix `json:"subnet"`
+
+	// Count is the number of the requests from the subnet.
+	Count uint64 `json:"count"`
+
+	// QPS is the average number of the requests per second from the subnet
+	// within the window.
+	QPS float64 `json:"qps"`
+}
+
+// talker is the counters of a single client subnet within a bucket.
+type talker struct {
+	// rcodes maps the response codes to the number of the responses.
+	rcodes map[string]uint64
+
+	// total is the total number of the requests.
+	total uint64
+}
+
+// addTalker counts a single request from subnet answered with rcode.  The
+// invalid subnet isn't counted.
+func (b *bucket) addTalker(subnet netip.Prefix, rcode string) {
+	if !subnet.IsValid() {
+		return
+	}
+
+	t, ok := b.talkers[subnet]
+	if !ok {
+		if len(b.talkers) >= maxBucketKeys {
+			return
+		}
+
+		t = &talker{rcodes: map[string]uint64{}}
+		b.talkers[subnet] = t
+	}
+
+	t.total++
+	t.rcodes[rcode]++
+}
+
+// mergeTalkers adds the talkers from other to talkers.
+func mergeTalkers(talkers, other map[netip.Prefix]*talker) {
+	for subnet, o := range other {
+		t, ok := talkers[subnet]
+		if !ok {
+			t = &talker{rcodes: map[string]uint64{}}
+			talkers[subnet] = t
+		}
+
+		t.total += o.total
+		for rcode, n := range o.rcodes {
+			t.rcodes[rcode] += n
+		}
+	}
+}
+
+// topTalkers returns at most n talkers with the largest numbers of requests,
+// sorted by the number descending and by the subnet ascending.  dur is the
+// duration of the window the requests have been counted within.
+func topTalkers(talkers map[netip.Prefix]*talker, n int, dur time.Duration) (res []*Talker) {
+	res = make([]*Talker, 0, len(talkers))
+	for subnet, t := range talkers {
+		res = append(res, &Talker{
+			Rcodes: maps.Clone(t.rcodes),
+			Subnet: subnet,
+			Count:  t.total,
+			QPS:    float64(t.total) / dur.Seconds(),
+		})
+	}
+
+	slices.SortFunc(res, func(a, b *Talker) (c int) {
+		return cmp.Or(cmp.Compare(b.Count, a.Count), a.Subnet.Addr().Compare(b.Subnet.Addr()))
+	})
+
+	return res[:min(n, len(res))]
+}
+
+// subnet returns the client subnet of addr the talkers are counted for.  It
+// returns an invalid prefix if addr is invalid.
+func (s *Stats) subnet(addr netip.Addr) (pref netip.Prefix) {
+	if !addr.IsValid() {
+		return netip.Prefix{}
+	}
+
+	addr = addr.Unmap()
+	if addr.Is4() {
+		pref = netip.PrefixFrom(addr, s.subnetLenIPv4)
+	} else {
+		pref = netip.PrefixFrom(addr, s.subnetLenIPv6)
+	}
+
+	return pref.Masked()
+}
+
+// TopTalkers returns at most n client subnets sending the most requests within
+// w.  If n is not positive, the configured default is used.  It returns nil if
+// w is not a valid window.
+func (s *Stats) TopTalkers(w Window, n int) (talkers []*Talker) {
+	sum := s.Summary(w, n)
+	if sum == nil {
+		return nil
+	}
+
+	return sum.TopTalkers
+}
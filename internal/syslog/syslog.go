@@ -0,0 +1,304 @@
+//go:build unix
+
+// Package syslog contains the implementation of the proxy query logger and
+// metrics listener sending the query logs and significant events to syslog.
+package syslog
+
+import (
+	"cmp"
+	"fmt"
+	"log/slog"
+	stdsyslog "log/syslog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/miekg/dns"
+)
+
+// Event is the kind of a message sent to syslog.
+type Event string
+
+// Event kinds.
+const (
+	// EventQuery is a processed DNS request.
+	EventQuery Event = "query"
+
+	// EventUpstreamDown is the first failed exchange with an upstream after a
+	// successful one.
+	EventUpstreamDown Event = "upstream_down"
+
+	// EventUpstreamUp is the first successful exchange with an upstream after a
+	// failed one.
+	EventUpstreamUp Event = "upstream_up"
+
+	// EventRatelimit is a summary of the requests dropped due to ratelimiting.
+	EventRatelimit Event = "ratelimit"
+)
+
+// defaultSeverities are the severities of the events used unless overridden.
+var defaultSeverities = map[Event]stdsyslog.Priority{
+	EventQuery:        stdsyslog.LOG_INFO,
+	EventUpstreamDown: stdsyslog.LOG_WARNING,
+	EventUpstreamUp:   stdsyslog.LOG_NOTICE,
+	EventRatelimit:    stdsyslog.LOG_WARNING,
+}
+
+// ratelimitReportInterval is the minimum interval between the ratelimit event
+// messages.
+const ratelimitReportInterval = 1 * time.Minute
+
+// Config is the configuration of the syslog [Logger].
+type Config struct {
+	// Severities overrides the severities of the events.  The keys are the
+	// [Event] values and the values are the severity names, like "warning".
+	Severities map[Event]string
+
+	// Network is the network of the remote syslog server, "udp" or "tcp".  If
+	// empty, the local syslog server is used.
+	Network string
+
+	// Address is the address of the remote syslog server.  It's ignored if
+	// Network is empty.
+	Address string
+
+	// Facility is the name of the facility of the messages, like "daemon" or
+	// "local0".  If empty, "daemon" is used.
+	Facility string
+
+	// Tag is the tag of the messages.  If empty, the program name is used.
+	Tag string
+
+	// Logger is used to log the errors of sending the messages.  If nil,
+	// [slog.Default] is used.
+	Logger *slog.Logger
+}
+
+// Logger is the [proxy.QueryLogger] and [proxy.MetricsListener] implementation
+// sending the messages to syslog.
+type Logger struct {
+	// EmptyMetricsListener is embedded here to avoid implementing the methods
+	// which the events aren't derived from.
+	proxy.EmptyMetricsListener
+
+	// w sends the messages.  It's safe for concurrent use.
+	w *stdsyslog.Writer
+
+	// logger is used to log the errors of sending the messages.  It's never
+	// nil.
+	logger *slog.Logger
+
+	// severities are the severities of the events.
+	severities map[Event]stdsyslog.Priority
+
+	// mu protects the fields below.
+	mu *sync.Mutex
+
+	// downUpstreams is the set of addresses of the upstreams considered down.
+	downUpstreams map[string]struct{}
+
+	// lastRatelimitReport is the time the last ratelimit event has been sent.
+	lastRatelimitReport time.Time
+
+	// ratelimited is the number of ratelimited requests since the last report.
+	ratelimited uint64
+}
+
+// New returns a new *Logger connected to the syslog server.  c must not be nil.
+func New(c *Config) (l *Logger, err error) {
+	facility, err := parseFacility(c.Facility)
+	if err != nil {
+		return nil, err
+	}
+
+	severities := make(map[Event]stdsyslog.Priority, len(defaultSeverities))
+	for ev, sev := range defaultSeverities {
+		severities[ev] = sev
+	}
+
+	for ev, name := range c.Severities {
+		if _, ok := defaultSeverities[ev]; !ok {
+			return nil, fmt.Errorf("unknown event %q", ev)
+		}
+
+		severities[ev], err = parseSeverity(name)
+		if err != nil {
+			return nil, fmt.Errorf("event %q: %w", ev, err)
+		}
+	}
+
+	addr := c.Address
+	if c.Network == "" {
+		addr = ""
+	}
+
+	w, err := stdsyslog.Dial(c.Network, addr, facility|stdsyslog.LOG_INFO, c.Tag)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to syslog: %w", err)
+	}
+
+	return &Logger{
+		w:             w,
+		logger:        cmp.Or(c.Logger, slog.Default()).With(slogutil.KeyPrefix, "syslog"),
+		severities:    severities,
+		mu:            &sync.Mutex{},
+		downUpstreams: map[string]struct{}{},
+	}, nil
+}
+
+// type check
+var (
+	_ proxy.QueryLogger     = (*Logger)(nil)
+	_ proxy.MetricsListener = (*Logger)(nil)
+)
+
+// LogQuery implements the [proxy.QueryLogger] interface for *Logger.
+func (l *Logger) LogQuery(e *proxy.QueryLogEntry) {
+	l.send(EventQuery, fmt.Sprintf(
+		"query client=%s proto=%s qname=%s qtype=%s rcode=%s upstream=%s duration=%s cache_hit=%t",
+		e.Client.Addr(),
+		e.Proto,
+		e.QName,
+		dns.Type(e.QType),
+		dns.RcodeToString[e.Rcode],
+		e.Upstream,
+		e.Elapsed,
+		e.CacheHit,
+	))
+}
+
+// OnUpstreamExchange implements the [proxy.MetricsListener] interface for
+// *Logger.
+func (l *Logger) OnUpstreamExchange(addr string, _ time.Duration, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	_, isDown := l.downUpstreams[addr]
+	switch {
+	case err != nil && !isDown:
+		l.downUpstreams[addr] = struct{}{}
+		l.send(EventUpstreamDown, fmt.Sprintf("upstream %s is down: %s", addr, err))
+	case err == nil && isDown:
+		delete(l.downUpstreams, addr)
+		l.send(EventUpstreamUp, fmt.Sprintf("upstream %s is up", addr))
+	default:
+		// The state hasn't changed.
+	}
+}
+
+// OnRatelimited implements the [proxy.MetricsListener] interface for *Logger.
+// The ratelimited requests are reported once per [ratelimitReportInterval].
+func (l *Logger) OnRatelimited(proto proxy.Proto) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.ratelimited++
+
+	now := time.Now()
+	if now.Sub(l.lastRatelimitReport) < ratelimitReportInterval {
+		return
+	}
+
+	l.send(EventRatelimit, fmt.Sprintf(
+		"ratelimit: %d requests dropped, the last one over %s",
+		l.ratelimited,
+		proto,
+	))
+
+	l.lastRatelimitReport, l.ratelimited = now, 0
+}
+
+// Close closes the connection to the syslog server.
+func (l *Logger) Close() (err error) {
+	return l.w.Close()
+}
+
+// send sends msg with the severity of ev.
+func (l *Logger) send(ev Event, msg string) {
+	var err error
+	switch l.severities[ev] {
+	case stdsyslog.LOG_EMERG:
+		err = l.w.Emerg(msg)
+	case stdsyslog.LOG_ALERT:
+		err = l.w.Alert(msg)
+	case stdsyslog.LOG_CRIT:
+		err = l.w.Crit(msg)
+	case stdsyslog.LOG_ERR:
+		err = l.w.Err(msg)
+	case stdsyslog.LOG_WARNING:
+		err = l.w.Warning(msg)
+	case stdsyslog.LOG_NOTICE:
+		err = l.w.Notice(msg)
+	case stdsyslog.LOG_DEBUG:
+		err = l.w.Debug(msg)
+	default:
+		err = l.w.Info(msg)
+	}
+
+	if err != nil {
+		l.logger.Debug("sending event", "event", ev, slogutil.KeyError, err)
+	}
+}
+
+// facilities maps the facility names to the values.
+var facilities = map[string]stdsyslog.Priority{
+	"kern":     stdsyslog.LOG_KERN,
+	"user":     stdsyslog.LOG_USER,
+	"mail":     stdsyslog.LOG_MAIL,
+	"daemon":   stdsyslog.LOG_DAEMON,
+	"auth":     stdsyslog.LOG_AUTH,
+	"syslog":   stdsyslog.LOG_SYSLOG,
+	"lpr":      stdsyslog.LOG_LPR,
+	"news":     stdsyslog.LOG_NEWS,
+	"uucp":     stdsyslog.LOG_UUCP,
+	"cron":     stdsyslog.LOG_CRON,
+	"authpriv": stdsyslog.LOG_AUTHPRIV,
+	"ftp":      stdsyslog.LOG_FTP,
+	"local0":   stdsyslog.LOG_LOCAL0,
+	"local1":   stdsyslog.LOG_LOCAL1,
+	"local2":   stdsyslog.LOG_LOCAL2,
+	"local3":   stdsyslog.LOG_LOCAL3,
+	"local4":   stdsyslog.LOG_LOCAL4,
+	"local5":   stdsyslog.LOG_LOCAL5,
+	"local6":   stdsyslog.LOG_LOCAL6,
+	"local7":   stdsyslog.LOG_LOCAL7,
+}
+
+// parseFacility returns the facility with the given name.  Empty name means
+// "daemon".
+func parseFacility(name string) (f stdsyslog.Priority, err error) {
+	if name == "" {
+		return stdsyslog.LOG_DAEMON, nil
+	}
+
+	f, ok := facilities[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("unknown facility %q", name)
+	}
+
+	return f, nil
+}
+
+// severities maps the severity names to the values.
+var severities = map[string]stdsyslog.Priority{
+	"emerg":   stdsyslog.LOG_EMERG,
+	"alert":   stdsyslog.LOG_ALERT,
+	"crit":    stdsyslog.LOG_CRIT,
+	"err":     stdsyslog.LOG_ERR,
+	"warning": stdsyslog.LOG_WARNING,
+	"notice":  stdsyslog.LOG_NOTICE,
+	"info":    stdsyslog.LOG_INFO,
+	"debug":   stdsyslog.LOG_DEBUG,
+}
+
+// parseSeverity returns the severity with the given name.
+func parseSeverity(name string) (sev stdsyslog.Priority, err error) {
+	sev, ok := severities[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("unknown severity %q", name)
+	}
+
+	return sev, nil
+}
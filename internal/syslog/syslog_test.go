@@ -0,0 +1,131 @@
+//go:build unix
+
+package syslog_test
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/internal/syslog"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testTimeout is the common timeout for tests.
+const testTimeout = 1 * time.Second
+
+// newTestLogger returns a new *syslog.Logger sending the messages to a local
+// UDP listener, and a function reading the next message received.
+func newTestLogger(t *testing.T, c *syslog.Config) (l *syslog.Logger, next func() (msg string)) {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, conn.Close)
+
+	c.Network, c.Address, c.Tag = "udp", conn.LocalAddr().String(), "dnsproxy"
+
+	l, err = syslog.New(c)
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, l.Close)
+
+	return l, func() (msg string) {
+		t.Helper()
+
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(testTimeout)))
+
+		buf := make([]byte, 1024)
+		n, _, readErr := conn.ReadFrom(buf)
+		require.NoError(t, readErr)
+
+		return string(buf[:n])
+	}
+}
+
+func TestLogger(t *testing.T) {
+	l, next := newTestLogger(t, &syslog.Config{
+		Facility: "local0",
+		Severities: map[syslog.Event]string{
+			syslog.EventUpstreamUp: "info",
+		},
+	})
+
+	// local0 is 16, so the priorities are 16*8 plus the severity.
+	const (
+		priWarning = "<132>"
+		priInfo    = "<134>"
+	)
+
+	t.Run("query", func(t *testing.T) {
+		l.LogQuery(&proxy.QueryLogEntry{
+			Client:   netip.MustParseAddrPort("192.0.2.1:53"),
+			Proto:    proxy.ProtoUDP,
+			QName:    "example.org.",
+			Upstream: "8.8.8.8:53",
+			Elapsed:  time.Millisecond,
+			Rcode:    dns.RcodeSuccess,
+			QType:    dns.TypeA,
+		})
+
+		msg := next()
+		assert.True(t, strings.HasPrefix(msg, priInfo), msg)
+		assert.Contains(t, msg, "dnsproxy")
+		assert.Contains(t, msg, "client=192.0.2.1 proto=udp qname=example.org. qtype=A rcode=NOERROR")
+	})
+
+	t.Run("upstream", func(t *testing.T) {
+		const addr = "1.1.1.1:53"
+
+		l.OnUpstreamExchange(addr, 0, assert.AnError)
+		msg := next()
+		assert.True(t, strings.HasPrefix(msg, priWarning), msg)
+		assert.Contains(t, msg, "upstream 1.1.1.1:53 is down")
+
+		// Consecutive failures aren't reported.
+		l.OnUpstreamExchange(addr, 0, assert.AnError)
+		l.OnUpstreamExchange(addr, 0, nil)
+		msg = next()
+		assert.True(t, strings.HasPrefix(msg, priInfo), msg)
+		assert.Contains(t, msg, "upstream 1.1.1.1:53 is up")
+	})
+
+	t.Run("ratelimit", func(t *testing.T) {
+		l.OnRatelimited(proxy.ProtoUDP)
+		msg := next()
+		assert.True(t, strings.HasPrefix(msg, priWarning), msg)
+		assert.Contains(t, msg, "ratelimit: 1 requests dropped")
+	})
+}
+
+func TestNew_invalid(t *testing.T) {
+	testCases := []struct {
+		conf *syslog.Config
+		name string
+	}{{
+		conf: &syslog.Config{Facility: "bad"},
+		name: "facility",
+	}, {
+		conf: &syslog.Config{
+			Severities: map[syslog.Event]string{syslog.EventQuery: "bad"},
+		},
+		name: "severity",
+	}, {
+		conf: &syslog.Config{
+			Severities: map[syslog.Event]string{"bad": "info"},
+		},
+		name: "event",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := syslog.New(tc.conf)
+			assert.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,186 @@
+// Package verdict contains the decisions about DNS queries made by the external
+// hooks and the logic of applying them.
+package verdict
+
+import (
+	"cmp"
+	"fmt"
+	"net/netip"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+)
+
+// Action is the kind of a decision about a query.
+type Action uint8
+
+// Actions of the verdict.
+const (
+	// ActionAllow resolves the query as usual.
+	ActionAllow Action = iota
+
+	// ActionDeny answers the query with NXDOMAIN.
+	ActionDeny
+
+	// ActionRewrite answers the query with [Verdict.Addrs].
+	ActionRewrite
+
+	// ActionRedirect resolves [Verdict.Target] instead of the queried name and
+	// answers with a CNAME record pointing to it.
+	ActionRedirect
+)
+
+// DefaultTTL is the TTL of the answer records used if the verdict doesn't
+// specify one.
+const DefaultTTL uint32 = 60
+
+// Verdict is a decision about a query.
+type Verdict struct {
+	// Target is the domain name to resolve for [ActionRedirect].
+	Target string
+
+	// Addrs are the addresses to answer with for [ActionRewrite].  Only the
+	// ones of the queried family are used.
+	Addrs []netip.Addr
+
+	// Action is the kind of the decision.
+	Action Action
+
+	// TTL is the TTL of the answer records in seconds.  If zero, [DefaultTTL]
+	// is used.
+	TTL uint32
+}
+
+// Apply applies v to dctx.  It returns nil if the query should be resolved as
+// usual, or a [*proxy.BeforeRequestError] with the response to the query, so
+// that the result can be returned from [proxy.BeforeRequestHandler.HandleBefore].
+// Any other error means that v can't be applied.  prx is used to construct the
+// response for [ActionDeny] and to resolve the target for [ActionRedirect], it
+// may be nil for other actions, in which case [ActionDeny] uses the default
+// constructor.  dctx.Req must have a question.
+func (v *Verdict) Apply(prx *proxy.Proxy, dctx *proxy.DNSContext) (err error) {
+	var msg *dns.Msg
+	switch v.Action {
+	case ActionAllow:
+		return nil
+	case ActionDeny:
+		msg = messages(prx).NewMsgBlocked(dctx.Req)
+	case ActionRewrite:
+		msg = v.rewrite(dctx.Req)
+	case ActionRedirect:
+		msg, err = v.redirect(prx, dctx)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown action %d", v.Action)
+	}
+
+	return &proxy.BeforeRequestError{
+		Err:      fmt.Errorf("verdict action %d", v.Action),
+		Response: msg,
+	}
+}
+
+// messages returns the message constructor of prx or the default one if prx is
+// nil.
+func messages(prx *proxy.Proxy) (mc proxy.MessageConstructor) {
+	if prx == nil {
+		return proxy.DefaultMessageConstructor{}
+	}
+
+	return prx.Messages()
+}
+
+// ttl returns the TTL of the answer records.
+func (v *Verdict) ttl() (ttl uint32) {
+	return cmp.Or(v.TTL, DefaultTTL)
+}
+
+// rewrite returns the answer to req with the addresses of the queried family.
+func (v *Verdict) rewrite(req *dns.Msg) (msg *dns.Msg) {
+	q := req.Question[0]
+	msg = (&dns.Msg{}).SetReply(req)
+	msg.RecursionAvailable = true
+
+	hdr := dns.RR_Header{
+		Name:   q.Name,
+		Rrtype: q.Qtype,
+		Class:  dns.ClassINET,
+		Ttl:    v.ttl(),
+	}
+
+	for _, addr := range v.Addrs {
+		switch {
+		case q.Qtype == dns.TypeA && addr.Is4():
+			msg.Answer = append(msg.Answer, &dns.A{Hdr: hdr, A: addr.AsSlice()})
+		case q.Qtype == dns.TypeAAAA && addr.Is6():
+			msg.Answer = append(msg.Answer, &dns.AAAA{Hdr: hdr, AAAA: addr.AsSlice()})
+		default:
+			// Go on.
+		}
+	}
+
+	return msg
+}
+
+// redirect resolves the target instead of the queried name using prx and
+// returns the answer to the original request with the CNAME record pointing to
+// the target prepended.
+func (v *Verdict) redirect(
+	prx *proxy.Proxy,
+	dctx *proxy.DNSContext,
+) (msg *dns.Msg, err error) {
+	if _, ok := dns.IsDomainName(v.Target); !ok || v.Target == "" {
+		return nil, fmt.Errorf("bad redirect target %q", v.Target)
+	}
+
+	target := dns.Fqdn(v.Target)
+	q := dctx.Req.Question[0]
+
+	sub := &proxy.DNSContext{
+		Req:             dctx.Req.Copy(),
+		Addr:            dctx.Addr,
+		Proto:           dctx.Proto,
+		IsPrivateClient: dctx.IsPrivateClient,
+	}
+	sub.Req.Question[0].Name = target
+
+	err = prx.Resolve(sub)
+	if err != nil {
+		return nil, fmt.Errorf("resolving redirect target: %w", err)
+	} else if sub.Res == nil {
+		return nil, fmt.Errorf("resolving redirect target %q: no response", target)
+	}
+
+	msg = sub.Res
+	msg.Id = dctx.Req.Id
+	msg.Question = dctx.Req.Question
+	msg.Answer = append([]dns.RR{&dns.CNAME{
+		Hdr: dns.RR_Header{
+			Name:   q.Name,
+			Rrtype: dns.TypeCNAME,
+			Class:  dns.ClassINET,
+			Ttl:    v.ttl(),
+		},
+		Target: target,
+	}}, msg.Answer...)
+
+	return msg, nil
+}
+
+// ParseAddrs parses the addresses for [ActionRewrite].
+func ParseAddrs(strs []string) (addrs []netip.Addr, err error) {
+	addrs = make([]netip.Addr, 0, len(strs))
+	for i, s := range strs {
+		var addr netip.Addr
+		addr, err = netip.ParseAddr(s)
+		if err != nil {
+			return nil, fmt.Errorf("address at index %d: %w", i, err)
+		}
+
+		addrs = append(addrs, addr)
+	}
+
+	return addrs, nil
+}
@@ -0,0 +1,35 @@
+// Package xdp implements the XDP program answering the repeated plain DNS
+// queries over UDP with the responses stored in the kernel, so that those
+// queries never reach the userspace.  It's only supported on Linux 5.18 or
+// newer and only built with the xdp build tag, see [Supported].
+package xdp
+
+import "net/netip"
+
+const (
+	// MinQueryLen is the length of the shortest query answered in the kernel:
+	// the header and the question with the root name.
+	MinQueryLen = 12 + 5
+
+	// MaxQueryLen is the maximum length of the queries answered in the kernel.
+	MaxQueryLen = 254
+
+	// MaxResponseLen is the maximum length of the stored responses.
+	MaxResponseLen = 512
+)
+
+// Config is the configuration of a [Responder].
+type Config struct {
+	// Interface is the name of the network interface the program is attached
+	// to.  It must not be empty.
+	Interface string
+
+	// Addrs are the addresses of the plain DNS UDP listeners, the queries to
+	// which are answered.  The unspecified IPv6 address also matches the IPv4
+	// queries, just like the dual-stack sockets do.  It must not be empty.
+	Addrs []netip.AddrPort
+
+	// MaxEntries is the maximum number of the stored responses.  The least
+	// recently used ones are evicted.  It must be positive.
+	MaxEntries uint
+}
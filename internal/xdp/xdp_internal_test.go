@@ -0,0 +1,263 @@
+//go:build linux && xdp
+
+package xdp
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/cilium/ebpf"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+// Test MAC addresses.
+var (
+	testClientMAC = []byte{0x02, 0, 0, 0, 0, 0x01}
+	testServerMAC = []byte{0x02, 0, 0, 0, 0, 0x02}
+)
+
+// newTestResponder returns a new detached *Responder for addrs and skips the
+// test if the program can't be loaded.
+func newTestResponder(tb testing.TB, addrs ...netip.AddrPort) (r *Responder) {
+	tb.Helper()
+
+	r, err := newResponder(&Config{
+		Addrs:      addrs,
+		MaxEntries: 16,
+	})
+	if errors.Is(err, unix.EPERM) || errors.Is(err, ebpf.ErrNotSupported) {
+		tb.Skipf("loading xdp programs is not supported: %s", err)
+	}
+
+	require.NoError(tb, err)
+	testutil.CleanupAndRequireSuccess(tb, r.Close)
+
+	return r
+}
+
+// checksum returns the Internet checksum of data.
+func checksum(data []byte) (s uint16) {
+	var acc uint32
+	for i := 0; i < len(data); i += 2 {
+		w := uint32(data[i]) << 8
+		if i+1 < len(data) {
+			w |= uint32(data[i+1])
+		}
+
+		acc += w
+	}
+
+	for acc > 0xffff {
+		acc = acc&0xffff + acc>>16
+	}
+
+	return ^uint16(acc)
+}
+
+// newTestPacket returns the Ethernet frame with the UDP datagram carrying
+// payload from src to dst.
+func newTestPacket(tb testing.TB, src, dst netip.AddrPort, payload []byte) (pkt []byte) {
+	tb.Helper()
+
+	udp := binary.BigEndian.AppendUint16(nil, src.Port())
+	udp = binary.BigEndian.AppendUint16(udp, dst.Port())
+	udp = binary.BigEndian.AppendUint16(udp, uint16(udpLen+len(payload)))
+	udp = binary.BigEndian.AppendUint16(udp, 0)
+	udp = append(udp, payload...)
+
+	pkt = append(pkt, testServerMAC...)
+	pkt = append(pkt, testClientMAC...)
+	if src.Addr().Is4() {
+		pkt = binary.BigEndian.AppendUint16(pkt, etherIPv4)
+		ip := []byte{0x45, 0}
+		ip = binary.BigEndian.AppendUint16(ip, uint16(20+len(udp)))
+		ip = append(ip, 0, 0, 0x40, 0, defaultTTL, protoUDP, 0, 0)
+		ip = append(ip, src.Addr().AsSlice()...)
+		ip = append(ip, dst.Addr().AsSlice()...)
+		binary.BigEndian.PutUint16(ip[10:], checksum(ip))
+		pkt = append(pkt, ip...)
+	} else {
+		pkt = binary.BigEndian.AppendUint16(pkt, etherIPv6)
+		pkt = append(pkt, 0x60, 0, 0, 0)
+		pkt = binary.BigEndian.AppendUint16(pkt, uint16(len(udp)))
+		pkt = append(pkt, protoUDP, defaultTTL)
+		pkt = append(pkt, src.Addr().AsSlice()...)
+		pkt = append(pkt, dst.Addr().AsSlice()...)
+	}
+
+	return append(pkt, udp...)
+}
+
+// run runs the program on pkt and returns the action and the resulting packet.
+func run(tb testing.TB, r *Responder, pkt []byte) (action uint32, out []byte) {
+	tb.Helper()
+
+	opts := &ebpf.RunOptions{
+		Data:    pkt,
+		DataOut: make([]byte, 1500),
+	}
+
+	action, err := r.prog.Run(opts)
+	require.NoError(tb, err)
+
+	return action, opts.DataOut
+}
+
+// requireReply checks that out is the valid reply with resp to the query from
+// client to server.
+func requireReply(tb testing.TB, out []byte, client, server netip.AddrPort, resp *dns.Msg) {
+	tb.Helper()
+
+	require.Greater(tb, len(out), dnsOffIPv4)
+
+	assert.Equal(tb, testClientMAC, out[0:6])
+	assert.Equal(tb, testServerMAC, out[6:12])
+
+	var ip, udp []byte
+	var src, dst netip.Addr
+	if client.Addr().Is4() {
+		ip, udp = out[ethLen:udpOffIPv4], out[udpOffIPv4:]
+		src, _ = netip.AddrFromSlice(ip[12:16])
+		dst, _ = netip.AddrFromSlice(ip[16:20])
+
+		assert.Equal(tb, uint16(len(out)-ethLen), binary.BigEndian.Uint16(ip[2:]))
+		assert.Zero(tb, checksum(ip))
+		assert.Zero(tb, binary.BigEndian.Uint16(udp[6:]))
+	} else {
+		require.Greater(tb, len(out), dnsOffIPv6)
+
+		ip, udp = out[ethLen:udpOffIPv6], out[udpOffIPv6:]
+		src, _ = netip.AddrFromSlice(ip[8:24])
+		dst, _ = netip.AddrFromSlice(ip[24:40])
+
+		assert.Equal(tb, uint16(len(udp)), binary.BigEndian.Uint16(ip[4:]))
+
+		pseudo := append(append([]byte{}, ip[8:40]...), 0, 0)
+		pseudo = binary.BigEndian.AppendUint16(pseudo, uint16(len(udp)))
+		pseudo = append(pseudo, 0, 0, 0, protoUDP)
+		assert.Zero(tb, checksum(append(pseudo, udp...)))
+	}
+
+	assert.Equal(tb, server.Addr(), src)
+	assert.Equal(tb, client.Addr(), dst)
+	assert.Equal(tb, server.Port(), binary.BigEndian.Uint16(udp[0:]))
+	assert.Equal(tb, client.Port(), binary.BigEndian.Uint16(udp[2:]))
+	assert.Equal(tb, uint16(len(udp)), binary.BigEndian.Uint16(udp[4:]))
+
+	got := &dns.Msg{}
+	require.NoError(tb, got.Unpack(udp[udpLen:]))
+
+	assert.Equal(tb, resp.String(), got.String())
+}
+
+func TestResponder(t *testing.T) {
+	testCases := []struct {
+		client netip.AddrPort
+		server netip.AddrPort
+		listen netip.AddrPort
+		name   string
+	}{{
+		client: netip.MustParseAddrPort("192.0.2.1:34567"),
+		server: netip.MustParseAddrPort("192.0.2.53:53"),
+		listen: netip.MustParseAddrPort("192.0.2.53:53"),
+		name:   "ipv4",
+	}, {
+		client: netip.MustParseAddrPort("192.0.2.1:34567"),
+		server: netip.MustParseAddrPort("192.0.2.53:53"),
+		listen: netip.MustParseAddrPort("[::]:53"),
+		name:   "ipv4_unspecified",
+	}, {
+		client: netip.MustParseAddrPort("[2001:db8::1]:34567"),
+		server: netip.MustParseAddrPort("[2001:db8::53]:53"),
+		listen: netip.MustParseAddrPort("[2001:db8::53]:53"),
+		name:   "ipv6",
+	}, {
+		client: netip.MustParseAddrPort("[2001:db8::1]:34567"),
+		server: netip.MustParseAddrPort("[2001:db8::53]:53"),
+		listen: netip.MustParseAddrPort("[::]:53"),
+		name:   "ipv6_unspecified",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := newTestResponder(t, tc.listen)
+
+			req := (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA)
+			req.Id = 0x1234
+			reqData, err := req.Pack()
+			require.NoError(t, err)
+
+			resp := (&dns.Msg{}).SetReply(req)
+			resp.Answer = []dns.RR{&dns.A{
+				Hdr: dns.RR_Header{
+					Name:   req.Question[0].Name,
+					Rrtype: dns.TypeA,
+					Class:  dns.ClassINET,
+					Ttl:    60,
+				},
+				A: net.IP{192, 0, 2, 2},
+			}}
+
+			// Store the response with another ID, like the cache does.
+			stored := resp.Copy()
+			stored.Id = 0x4321
+			respData, err := stored.Pack()
+			require.NoError(t, err)
+
+			pkt := newTestPacket(t, tc.client, tc.server, reqData)
+
+			action, _ := run(t, r, pkt)
+			assert.Equal(t, uint32(xdpPass), action)
+
+			require.NoError(t, r.Set(reqData, respData, time.Minute))
+
+			action, out := run(t, r, pkt)
+			require.Equal(t, uint32(xdpTX), action)
+
+			requireReply(t, out, tc.client, tc.server, resp)
+
+			// The response stored earlier isn't replaced until it expires.
+			newer := stored.Copy()
+			newer.Answer[0].Header().Ttl = 30
+			newerData, err := newer.Pack()
+			require.NoError(t, err)
+
+			require.NoError(t, r.Set(reqData, newerData, time.Minute))
+
+			action, out = run(t, r, pkt)
+			require.Equal(t, uint32(xdpTX), action)
+
+			requireReply(t, out, tc.client, tc.server, resp)
+
+			otherPort := netip.AddrPortFrom(tc.server.Addr(), 5353)
+			action, _ = run(t, r, newTestPacket(t, tc.client, otherPort, reqData))
+			assert.Equal(t, uint32(xdpPass), action)
+
+			otherReq := req.Copy()
+			otherReq.Question[0].Qtype = dns.TypeAAAA
+			otherData, err := otherReq.Pack()
+			require.NoError(t, err)
+
+			action, _ = run(t, r, newTestPacket(t, tc.client, tc.server, otherData))
+			assert.Equal(t, uint32(xdpPass), action)
+
+			require.NoError(t, r.Clear())
+
+			action, _ = run(t, r, pkt)
+			assert.Equal(t, uint32(xdpPass), action)
+
+			require.NoError(t, r.Set(reqData, respData, 0))
+
+			action, _ = run(t, r, pkt)
+			assert.Equal(t, uint32(xdpPass), action)
+		})
+	}
+}
@@ -0,0 +1,645 @@
+//go:build linux && xdp
+
+package xdp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	glcache "github.com/AdguardTeam/golibs/cache"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"github.com/cilium/ebpf/link"
+	"golang.org/x/sys/unix"
+)
+
+// Supported is true if the in-kernel responder is supported by this build.
+const Supported = true
+
+// Layout of the keys of the stored responses.  The key is the length of the
+// query in the host byte order followed by the query itself without the ID,
+// padded with zeros.
+const (
+	keyOffLen  = 0
+	keyOffData = 4
+	keyDataLen = MaxQueryLen - 2
+	keyLen     = keyOffData + keyDataLen
+)
+
+// Layout of the stored responses.  The value is the time the response expires
+// at as returned by the CLOCK_MONOTONIC clock in nanoseconds, the length of the
+// response, and the partial checksum of the response, see [sum], all in the
+// host byte order, followed by the response itself with the zero ID, padded
+// with zeros.
+const (
+	valOffExpire = 0
+	valOffLen    = 8
+	valOffSum    = 10
+	valOffData   = 16
+	valLen       = valOffData + MaxResponseLen
+)
+
+// Responder answers the plain DNS queries over UDP in the kernel with the
+// responses previously stored with [Responder.Set].  All methods are safe for
+// concurrent use.
+type Responder struct {
+	// mu prevents closing cache while it's used and storing the responses
+	// while it's cleared.
+	mu *sync.RWMutex
+
+	// cache stores the responses by the queries, see [keyLen] and [valLen].
+	cache *ebpf.Map
+
+	// stored is the userspace copy of the keys of cache with the times the
+	// stored responses expire at, see [valOffExpire].  It's used to avoid
+	// updating cache with the responses it already has.
+	stored glcache.Cache
+
+	// prog is the XDP program answering the queries.
+	prog *ebpf.Program
+
+	// link attaches prog to the interface.  It's nil if the program isn't
+	// attached.
+	link link.Link
+
+	// closed is true if the responder is closed.  It's protected by mu.
+	closed bool
+}
+
+// errClosed is returned when the responder is used after closing.
+const errClosed errors.Error = "responder is closed"
+
+// New loads the program and attaches it to the interface.  c must not be nil
+// and must be valid.
+func New(c *Config) (r *Responder, err error) {
+	iface, err := net.InterfaceByName(c.Interface)
+	if err != nil {
+		return nil, fmt.Errorf("getting interface: %w", err)
+	}
+
+	r, err = newResponder(c)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	r.link, err = link.AttachXDP(link.XDPOptions{
+		Program:   r.prog,
+		Interface: iface.Index,
+	})
+	if err != nil {
+		return nil, errors.WithDeferred(fmt.Errorf("attaching program: %w", err), r.Close())
+	}
+
+	return r, nil
+}
+
+// newResponder loads the program without attaching it.  c must not be nil and
+// must be valid.
+func newResponder(c *Config) (r *Responder, err error) {
+	cache, err := ebpf.NewMap(&ebpf.MapSpec{
+		Name:       "dnsproxy_cache",
+		Type:       ebpf.LRUHash,
+		KeySize:    keyLen,
+		ValueSize:  valLen,
+		MaxEntries: uint32(c.MaxEntries),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("creating map: %w", err)
+	}
+
+	prog, err := ebpf.NewProgram(&ebpf.ProgramSpec{
+		Name:         "dnsproxy_xdp",
+		Type:         ebpf.XDP,
+		Instructions: newInstructions(cache.FD(), c.Addrs),
+		License:      "Apache-2.0",
+	})
+	if err != nil {
+		return nil, errors.WithDeferred(fmt.Errorf("loading program: %w", err), cache.Close())
+	}
+
+	return &Responder{
+		mu:    &sync.RWMutex{},
+		cache: cache,
+		stored: glcache.New(glcache.Config{
+			MaxCount:  c.MaxEntries,
+			EnableLRU: true,
+		}),
+		prog: prog,
+	}, nil
+}
+
+// Set stores resp as the response to req for ttl.  Both req and resp must be
+// the wire-format messages, the ID of resp is replaced with the one of the
+// query when answering.  Set does nothing if any of the messages is too short
+// or too long to be handled in the kernel, see [MaxQueryLen] and
+// [MaxResponseLen], or if the response to req stored earlier hasn't expired
+// yet, so that it may be called each time resp is used.
+func (r *Responder) Set(req, resp []byte, ttl time.Duration) (err error) {
+	if len(req) < MinQueryLen || len(req) > MaxQueryLen {
+		return nil
+	} else if len(resp) < dnsHdrLen || len(resp) > MaxResponseLen {
+		return nil
+	}
+
+	var ts unix.Timespec
+	err = unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts)
+	if err != nil {
+		return fmt.Errorf("getting time: %w", err)
+	}
+
+	var key [keyLen]byte
+	binary.NativeEndian.PutUint16(key[keyOffLen:], uint16(len(req)))
+	copy(key[keyOffData:], req[2:])
+
+	if exp := r.stored.Get(key[:]); exp != nil && int64(binary.NativeEndian.Uint64(exp)) > ts.Nano() {
+		return nil
+	}
+
+	var val [valLen]byte
+	binary.NativeEndian.PutUint64(val[valOffExpire:], uint64(ts.Nano()+ttl.Nanoseconds()))
+	binary.NativeEndian.PutUint16(val[valOffLen:], uint16(len(resp)))
+	copy(val[valOffData+2:], resp[2:])
+	binary.NativeEndian.PutUint16(val[valOffSum:], sum(val[valOffData:]))
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.closed {
+		return errClosed
+	}
+
+	err = r.cache.Put(key[:], val[:])
+	if err != nil {
+		return fmt.Errorf("storing response: %w", err)
+	}
+
+	r.stored.Set(key[:], val[valOffExpire:valOffLen])
+
+	return nil
+}
+
+// Clear removes all the stored responses.
+func (r *Responder) Clear() (err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return errClosed
+	}
+
+	r.stored.Clear()
+
+	var keys [][keyLen]byte
+	var key [keyLen]byte
+	var val [valLen]byte
+	for iter := r.cache.Iterate(); iter.Next(&key, &val); {
+		keys = append(keys, key)
+	}
+
+	var errs []error
+	for _, k := range keys {
+		err = r.cache.Delete(k[:])
+		if err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Close detaches the program and releases the resources.
+func (r *Responder) Close() (err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return errClosed
+	}
+
+	r.closed = true
+
+	var errs []error
+	if r.link != nil {
+		errs = append(errs, r.link.Close())
+	}
+
+	errs = append(errs, r.prog.Close(), r.cache.Close())
+
+	return errors.Join(errs...)
+}
+
+// sum returns the one's complement sum of data in 16-bit words in the host
+// byte order.  It's used to compute the UDP checksum of the IPv6 responses in
+// the kernel, since it's mandatory there.
+func sum(data []byte) (s uint16) {
+	var acc uint32
+	for i := 0; i+1 < len(data); i += 2 {
+		acc += uint32(binary.NativeEndian.Uint16(data[i:]))
+	}
+
+	for acc > 0xffff {
+		acc = acc&0xffff + acc>>16
+	}
+
+	return uint16(acc)
+}
+
+// XDP actions, see enum xdp_action in the Linux UAPI.
+const (
+	xdpDrop = 1
+	xdpPass = 2
+	xdpTX   = 3
+)
+
+// Lengths of the headers preceding the DNS message.
+const (
+	ethLen      = 14
+	udpLen      = 8
+	dnsOffIPv4  = ethLen + 20 + udpLen
+	dnsOffIPv6  = ethLen + 40 + udpLen
+	udpOffIPv4  = dnsOffIPv4 - udpLen
+	udpOffIPv6  = dnsOffIPv6 - udpLen
+	hdrBufLen   = dnsOffIPv6 + 2
+	dnsHdrLen   = 12
+	defaultTTL  = 64
+	protoUDP    = 17
+	etherIPv4   = 0x0800
+	etherIPv6   = 0x86dd
+	checksumMax = 0xffff
+)
+
+// Layout of the program stack: the copy of the headers, including the DNS
+// message ID, followed by the lookup key.  The verifier requires the stack
+// accesses to be aligned, so the IP header in the copy is aligned to 4 bytes and
+// the key is aligned to 8 bytes.
+const (
+	stackHdr = -hdrBufLen - 2
+	stackKey = -hdrBufLen - 8 - keyLen
+)
+
+// program builds the instructions, labeling those following the label calls.
+type program struct {
+	insns asm.Instructions
+	label string
+}
+
+// emit appends the instructions.
+func (p *program) emit(insns ...asm.Instruction) {
+	for _, ins := range insns {
+		if p.label != "" {
+			ins = ins.WithSymbol(p.label)
+			p.label = ""
+		}
+
+		p.insns = append(p.insns, ins)
+	}
+}
+
+// mark labels the next emitted instruction.
+func (p *program) mark(label string) {
+	p.label = label
+}
+
+// load emits loading the value of size from the headers copy at off into dst.
+func (p *program) load(dst asm.Register, off int, size asm.Size) {
+	p.emit(asm.LoadMem(dst, asm.RFP, int16(stackHdr+off), size))
+}
+
+// store emits storing the value of size from src into the headers copy at off.
+func (p *program) store(off int, src asm.Register, size asm.Size) {
+	p.emit(asm.StoreMem(asm.RFP, int16(stackHdr+off), src, size))
+}
+
+// swap emits swapping the values of size at a and b in the headers copy.
+func (p *program) swap(a, b int, size asm.Size) {
+	p.load(asm.R1, a, size)
+	p.load(asm.R2, b, size)
+	p.store(a, asm.R2, size)
+	p.store(b, asm.R1, size)
+}
+
+// loadHeaders emits copying n first bytes of the packet into the headers copy.
+func (p *program) loadHeaders(n int32) {
+	p.emit(
+		asm.Mov.Reg(asm.R1, asm.R6),
+		asm.Mov.Imm(asm.R2, 0),
+		asm.Mov.Reg(asm.R3, asm.RFP),
+		asm.Add.Imm(asm.R3, stackHdr),
+		asm.Mov.Imm(asm.R4, n),
+		asm.FnXdpLoadBytes.Call(),
+		asm.JNE.Imm(asm.R0, 0, "pass"),
+	)
+}
+
+// fold emits folding the one's complement sum in R1 into 16 bits and
+// complementing it.
+func (p *program) fold() {
+	for range 4 {
+		p.emit(
+			asm.Mov.Reg(asm.R2, asm.R1),
+			asm.RSh.Imm(asm.R2, 16),
+			asm.And.Imm(asm.R1, checksumMax),
+			asm.Add.Reg(asm.R1, asm.R2),
+		)
+	}
+
+	p.emit(asm.Xor.Imm(asm.R1, checksumMax))
+}
+
+// addWords emits adding n 16-bit words of the headers copy starting at off to
+// the sum in R1.
+func (p *program) addWords(off, n int) {
+	for i := range n {
+		p.load(asm.R2, off+2*i, asm.Half)
+		p.emit(asm.Add.Reg(asm.R1, asm.R2))
+	}
+}
+
+// native16 returns the 16-bit value in the network byte order as loaded by the
+// program.
+func native16(v uint16) (n int32) {
+	return int32(binary.NativeEndian.Uint16(binary.BigEndian.AppendUint16(nil, v)))
+}
+
+// native32 returns the 4 bytes as loaded by the program.
+func native32(b []byte) (n int32) {
+	return int32(binary.NativeEndian.Uint32(b))
+}
+
+// newInstructions returns the program answering the queries to addrs from the
+// map with the descriptor fd.  addrs must not be empty.
+//
+// The callee-saved registers are: R6 is the context, R7 is the offset of the
+// DNS message, R8 is the length of the query and then of the response, and R9
+// is the length of the packet and then the pointer to the stored response.
+func newInstructions(fd int, addrs []netip.AddrPort) (insns asm.Instructions) {
+	var addrs4, addrs6 []netip.AddrPort
+	for _, a := range addrs {
+		ip := a.Addr().Unmap()
+		if ip.Is4() || ip == netip.IPv6Unspecified() {
+			addrs4 = append(addrs4, a)
+		}
+
+		if ip.Is6() {
+			addrs6 = append(addrs6, a)
+		}
+	}
+
+	p := &program{}
+
+	p.emit(
+		asm.Mov.Reg(asm.R6, asm.R1),
+		asm.FnXdpGetBuffLen.Call(),
+		asm.Mov.Reg(asm.R9, asm.R0),
+		asm.JLT.Imm(asm.R9, dnsOffIPv4+MinQueryLen, "pass"),
+	)
+	p.loadHeaders(dnsOffIPv4 + 2)
+	p.load(asm.R1, 12, asm.Half)
+	p.emit(asm.HostTo(asm.BE, asm.R1, asm.Half))
+
+	// Only emit the parsing of the address families in use, since the
+	// verifier rejects the unreachable instructions.
+	switch {
+	case len(addrs4) > 0 && len(addrs6) > 0:
+		p.emit(
+			asm.JEq.Imm(asm.R1, etherIPv6, "ipv6"),
+			asm.JNE.Imm(asm.R1, etherIPv4, "pass"),
+		)
+	case len(addrs4) > 0:
+		p.emit(asm.JNE.Imm(asm.R1, etherIPv4, "pass"))
+	default:
+		p.emit(asm.JNE.Imm(asm.R1, etherIPv6, "pass"))
+	}
+
+	if len(addrs4) > 0 {
+		p.parseIPv4(addrs4)
+		if len(addrs6) > 0 {
+			p.emit(asm.Ja.Label("query"))
+		}
+	}
+
+	if len(addrs6) > 0 {
+		p.mark("ipv6")
+		p.parseIPv6(addrs6)
+	}
+
+	// Look the query up.
+	p.mark("query")
+	p.emit(
+		asm.HostTo(asm.BE, asm.R8, asm.Half),
+		asm.Sub.Imm(asm.R8, udpLen),
+		asm.JLT.Imm(asm.R8, MinQueryLen, "pass"),
+		asm.JGT.Imm(asm.R8, MaxQueryLen, "pass"),
+	)
+	for off := 0; off < keyLen; off += 8 {
+		p.emit(asm.StoreImm(asm.RFP, int16(stackKey+off), 0, asm.DWord))
+	}
+
+	p.emit(
+		asm.StoreMem(asm.RFP, stackKey+keyOffLen, asm.R8, asm.Half),
+		asm.Mov.Reg(asm.R1, asm.R6),
+		asm.Mov.Reg(asm.R2, asm.R7),
+		asm.Add.Imm(asm.R2, 2),
+		asm.Mov.Reg(asm.R3, asm.RFP),
+		asm.Add.Imm(asm.R3, stackKey+keyOffData),
+		asm.Mov.Reg(asm.R4, asm.R8),
+		asm.Sub.Imm(asm.R4, 2),
+		asm.FnXdpLoadBytes.Call(),
+		asm.JNE.Imm(asm.R0, 0, "pass"),
+
+		asm.LoadMapPtr(asm.R1, fd),
+		asm.Mov.Reg(asm.R2, asm.RFP),
+		asm.Add.Imm(asm.R2, stackKey),
+		asm.FnMapLookupElem.Call(),
+		asm.JEq.Imm(asm.R0, 0, "pass"),
+		asm.Mov.Reg(asm.R9, asm.R0),
+
+		asm.FnKtimeGetNs.Call(),
+		asm.LoadMem(asm.R1, asm.R9, valOffExpire, asm.DWord),
+		asm.JGE.Reg(asm.R0, asm.R1, "pass"),
+		asm.LoadMem(asm.R8, asm.R9, valOffLen, asm.Half),
+		asm.JLT.Imm(asm.R8, dnsHdrLen, "pass"),
+		asm.JGT.Imm(asm.R8, MaxResponseLen, "pass"),
+
+		// Resize the packet and write the response keeping the ID.
+		asm.Mov.Reg(asm.R1, asm.R6),
+		asm.FnXdpGetBuffLen.Call(),
+		asm.Mov.Reg(asm.R2, asm.R7),
+		asm.Add.Reg(asm.R2, asm.R8),
+		asm.Sub.Reg(asm.R2, asm.R0),
+		asm.Mov.Reg(asm.R1, asm.R6),
+		asm.FnXdpAdjustTail.Call(),
+		asm.JNE.Imm(asm.R0, 0, "pass"),
+		asm.Mov.Reg(asm.R1, asm.R6),
+		asm.Mov.Reg(asm.R2, asm.R7),
+		asm.Add.Imm(asm.R2, 2),
+		asm.Mov.Reg(asm.R3, asm.R9),
+		asm.Add.Imm(asm.R3, valOffData+2),
+		asm.Mov.Reg(asm.R4, asm.R8),
+		asm.Sub.Imm(asm.R4, 2),
+		asm.FnXdpStoreBytes.Call(),
+		asm.JNE.Imm(asm.R0, 0, "drop"),
+	)
+
+	// Turn the headers around.
+	for i := 0; i < 6; i += 2 {
+		p.swap(i, 6+i, asm.Half)
+	}
+
+	p.emit(asm.JEq.Imm(asm.R7, dnsOffIPv6, "ipv6_reply"))
+
+	p.swap(ethLen+12, ethLen+16, asm.Word)
+	p.swap(udpOffIPv4, udpOffIPv4+2, asm.Half)
+	p.emit(
+		asm.Mov.Reg(asm.R1, asm.R8),
+		asm.Add.Imm(asm.R1, udpLen),
+		asm.HostTo(asm.BE, asm.R1, asm.Half),
+	)
+	p.store(udpOffIPv4+4, asm.R1, asm.Half)
+	p.emit(
+		asm.StoreImm(asm.RFP, stackHdr+udpOffIPv4+6, 0, asm.Half),
+		asm.Mov.Reg(asm.R1, asm.R8),
+		asm.Add.Imm(asm.R1, dnsOffIPv4-ethLen),
+		asm.HostTo(asm.BE, asm.R1, asm.Half),
+	)
+	p.store(ethLen+2, asm.R1, asm.Half)
+	p.emit(
+		asm.StoreImm(asm.RFP, stackHdr+ethLen+8, defaultTTL, asm.Byte),
+		asm.StoreImm(asm.RFP, stackHdr+ethLen+10, 0, asm.Half),
+		asm.Mov.Imm(asm.R1, 0),
+	)
+	p.addWords(ethLen, 10)
+	p.fold()
+	p.store(ethLen+10, asm.R1, asm.Half)
+	p.emit(asm.Ja.Label("reply"))
+
+	p.mark("ipv6_reply")
+	for i := 0; i < 16; i += 4 {
+		p.swap(ethLen+8+i, ethLen+24+i, asm.Word)
+	}
+
+	p.swap(udpOffIPv6, udpOffIPv6+2, asm.Half)
+	p.emit(
+		asm.Mov.Reg(asm.R1, asm.R8),
+		asm.Add.Imm(asm.R1, udpLen),
+		asm.HostTo(asm.BE, asm.R1, asm.Half),
+	)
+	p.store(ethLen+4, asm.R1, asm.Half)
+	p.store(udpOffIPv6+4, asm.R1, asm.Half)
+	p.emit(
+		asm.StoreImm(asm.RFP, stackHdr+ethLen+7, defaultTTL, asm.Byte),
+		asm.StoreImm(asm.RFP, stackHdr+udpOffIPv6+6, 0, asm.Half),
+
+		// Sum the pseudo-header, the UDP header, the ID, and the rest of the
+		// response summed in advance.
+		asm.LoadMem(asm.R1, asm.R9, valOffSum, asm.Half),
+		asm.Add.Imm(asm.R1, native16(protoUDP)),
+	)
+	p.addWords(ethLen+8, 16+4+1)
+	p.addWords(udpOffIPv6+4, 1)
+	p.fold()
+	p.emit(
+		asm.JNE.Imm(asm.R1, 0, "ipv6_checksum"),
+		asm.Mov.Imm(asm.R1, checksumMax),
+	)
+	p.mark("ipv6_checksum")
+	p.store(udpOffIPv6+6, asm.R1, asm.Half)
+
+	p.mark("reply")
+	p.emit(
+		asm.Mov.Reg(asm.R1, asm.R6),
+		asm.Mov.Imm(asm.R2, 0),
+		asm.Mov.Reg(asm.R3, asm.RFP),
+		asm.Add.Imm(asm.R3, stackHdr),
+		asm.Mov.Reg(asm.R4, asm.R7),
+		asm.FnXdpStoreBytes.Call(),
+		asm.JNE.Imm(asm.R0, 0, "drop"),
+		asm.Mov.Imm(asm.R0, xdpTX),
+		asm.Return(),
+
+		asm.Mov.Imm(asm.R0, xdpPass).WithSymbol("pass"),
+		asm.Return(),
+
+		asm.Mov.Imm(asm.R0, xdpDrop).WithSymbol("drop"),
+		asm.Return(),
+	)
+
+	return p.insns
+}
+
+// parseIPv4 emits parsing the IPv4 header without options and fragmentation
+// and matching the destination against addrs.  It leaves the offset of the DNS
+// message in R7 and the UDP length in R8.
+func (p *program) parseIPv4(addrs []netip.AddrPort) {
+	p.load(asm.R1, ethLen, asm.Byte)
+	p.emit(asm.JNE.Imm(asm.R1, 0x45, "pass"))
+	p.load(asm.R1, ethLen+9, asm.Byte)
+	p.emit(asm.JNE.Imm(asm.R1, protoUDP, "pass"))
+	p.load(asm.R1, ethLen+6, asm.Half)
+	p.emit(
+		asm.HostTo(asm.BE, asm.R1, asm.Half),
+		asm.And.Imm(asm.R1, 0x3fff),
+		asm.JNE.Imm(asm.R1, 0, "pass"),
+		asm.Mov.Imm(asm.R7, dnsOffIPv4),
+	)
+	p.load(asm.R2, udpOffIPv4+2, asm.Half)
+	p.load(asm.R3, ethLen+16, asm.Word)
+	for i, a := range addrs {
+		next := fmt.Sprintf("ipv4_next_%d", i)
+		p.emit(asm.JNE.Imm(asm.R2, native16(a.Port()), next))
+		if ip := a.Addr().Unmap(); ip.Is4() && !ip.IsUnspecified() {
+			b := ip.As4()
+			p.emit(asm.JNE.Imm32(asm.R3, native32(b[:]), next))
+		}
+
+		p.emit(asm.Ja.Label("ipv4_match"))
+		p.mark(next)
+	}
+
+	p.emit(asm.Ja.Label("pass"))
+	p.mark("ipv4_match")
+	p.load(asm.R8, udpOffIPv4+4, asm.Half)
+}
+
+// parseIPv6 emits parsing the IPv6 header without extension headers and
+// matching the destination against addrs.  It leaves the offset of the DNS
+// message in R7 and the UDP length in R8.
+func (p *program) parseIPv6(addrs []netip.AddrPort) {
+	regs := []asm.Register{asm.R3, asm.R4, asm.R5, asm.R0}
+
+	p.emit(asm.JLT.Imm(asm.R9, dnsOffIPv6+MinQueryLen, "pass"))
+	p.loadHeaders(dnsOffIPv6 + 2)
+	p.load(asm.R1, ethLen+6, asm.Byte)
+	p.emit(
+		asm.JNE.Imm(asm.R1, protoUDP, "pass"),
+		asm.Mov.Imm(asm.R7, dnsOffIPv6),
+	)
+	p.load(asm.R2, udpOffIPv6+2, asm.Half)
+	for i, r := range regs {
+		p.load(r, ethLen+24+4*i, asm.Word)
+	}
+
+	for i, a := range addrs {
+		next := fmt.Sprintf("ipv6_next_%d", i)
+		p.emit(asm.JNE.Imm(asm.R2, native16(a.Port()), next))
+		if ip := a.Addr(); !ip.IsUnspecified() {
+			b := ip.As16()
+			for j, r := range regs {
+				p.emit(asm.JNE.Imm32(r, native32(b[4*j:]), next))
+			}
+		}
+
+		p.emit(asm.Ja.Label("ipv6_match"))
+		p.mark(next)
+	}
+
+	p.emit(asm.Ja.Label("pass"))
+	p.mark("ipv6_match")
+	p.load(asm.R8, udpOffIPv6+4, asm.Half)
+}
@@ -0,0 +1,44 @@
+//go:build !linux || !xdp
+
+package xdp
+
+import (
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// Supported is true if the in-kernel responder is supported by this build.
+const Supported = false
+
+// errUnsupported is returned when the in-kernel responder isn't supported by
+// the build.
+const errUnsupported errors.Error = "xdp is not supported by this build"
+
+// Responder answers the plain DNS queries over UDP in the kernel.  It isn't
+// supported by this build.
+type Responder struct{}
+
+// New returns an error, since the in-kernel responder isn't supported by this
+// build.
+func New(_ *Config) (r *Responder, err error) {
+	return nil, errUnsupported
+}
+
+// Set returns an error, since the in-kernel responder isn't supported by this
+// build.
+func (r *Responder) Set(_, _ []byte, _ time.Duration) (err error) {
+	return errUnsupported
+}
+
+// Clear returns an error, since the in-kernel responder isn't supported by this
+// build.
+func (r *Responder) Clear() (err error) {
+	return errUnsupported
+}
+
+// Close returns an error, since the in-kernel responder isn't supported by this
+// build.
+func (r *Responder) Close() (err error) {
+	return errUnsupported
+}
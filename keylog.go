@@ -0,0 +1,35 @@
+package main
+
+import (
+	"cmp"
+	"io"
+	"log/slog"
+	"os"
+
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+)
+
+// envKeyLogFile is the conventional environment variable with the path to the
+// TLS key log file, used unless the path is set in the options.
+const envKeyLogFile = "SSLKEYLOGFILE"
+
+// newKeyLogWriter opens the TLS key log file from options or from the
+// [envKeyLogFile] environment variable.  w is nil if the key logging is
+// disabled.  The file is kept open until the program exits.
+func newKeyLogWriter(l *slog.Logger, options *Options) (w io.Writer) {
+	path := cmp.Or(options.TLSKeyLogFile, os.Getenv(envKeyLogFile))
+	if path == "" {
+		return nil
+	}
+
+	// #nosec G302 G304 -- Trust the file path that is given in the options or
+	// in the environment, and only let the owner read the secrets.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		fatal(l, "opening tls key log file", "path", path, slogutil.KeyError, err)
+	}
+
+	l.Warn("writing tls session secrets, use it for debugging only", "path", path)
+
+	return f
+}
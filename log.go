@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/AdguardTeam/dnsproxy/internal/admin"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+)
+
+// newLogger returns the base logger writing to the output from options and the
+// logging levels, which can be changed at runtime.  closeOutput closes the
+// output file, if any, and should be called on exit.  reopenOutput reopens the
+// output file, if any, for example, after it's been rotated.  When run as a
+// Windows service without the output file, the log is written to the event log.
+func newLogger(options *Options) (
+	l *slog.Logger,
+	levels *logLevels,
+	closeOutput func(),
+	reopenOutput func() (err error),
+) {
+	output, closeOutput := io.Writer(os.Stderr), func() {}
+	reopenOutput = func() (err error) { return nil }
+	addTimestamp := true
+	if options.LogOutput != "" {
+		file, err := newLogFile(options.LogOutput)
+		if err != nil {
+			fatal(slog.Default(), "cannot create a log file", slogutil.KeyError, err)
+		}
+
+		output, closeOutput, reopenOutput = file, func() { _ = file.Close() }, file.reopen
+	} else if w := newServiceLogOutput(); w != nil {
+		// The event log has its own timestamps.
+		output, closeOutput, addTimestamp = w, func() { _ = w.Close() }, false
+	}
+
+	l = slogutil.New(&slogutil.Config{
+		Output:       output,
+		Format:       slogutil.FormatDefault,
+		AddTimestamp: addTimestamp,
+		Verbose:      options.Verbose,
+	})
+
+	subLevels, err := parseLogLevels(options.LogLevels)
+	if err != nil {
+		fatal(l, "parsing log levels", slogutil.KeyError, err)
+	}
+
+	baseLvl := slog.LevelInfo
+	if options.Verbose {
+		baseLvl = slog.LevelDebug
+	}
+
+	levels = newLogLevels(baseLvl, subLevels)
+	l = slog.New(slogutil.NewLevelHandler(levels.base, l.Handler()))
+
+	return l, levels, closeOutput, reopenOutput
+}
+
+// logFile is the log output file, which can be reopened.  It's safe for
+// concurrent use.
+type logFile struct {
+	// mu protects file.
+	mu *sync.Mutex
+
+	// file is the currently opened file.
+	file *os.File
+
+	// path is the path to the file.
+	path string
+}
+
+// type check
+var _ io.WriteCloser = (*logFile)(nil)
+
+// newLogFile opens the log file at path for appending.
+func newLogFile(path string) (f *logFile, err error) {
+	file, err := openLogFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &logFile{
+		mu:   &sync.Mutex{},
+		file: file,
+		path: path,
+	}, nil
+}
+
+// openLogFile opens the file at path for appending, creating it if needed.
+func openLogFile(path string) (file *os.File, err error) {
+	// #nosec G302 -- Trust the file path that is given in the configuration.
+	return os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+}
+
+// Write implements the [io.Writer] interface for *logFile.
+func (f *logFile) Write(p []byte) (n int, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.file.Write(p)
+}
+
+// Close implements the [io.Closer] interface for *logFile.
+func (f *logFile) Close() (err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.file.Close()
+}
+
+// reopen closes the file and opens it again at the same path, so that the
+// writing continues into the new file after the old one has been moved.  If
+// the file can't be opened, the old one is kept.
+func (f *logFile) reopen() (err error) {
+	file, err := openLogFile(f.path)
+	if err != nil {
+		return fmt.Errorf("reopening log file: %w", err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	err = f.file.Close()
+	f.file = file
+	if err != nil {
+		return fmt.Errorf("closing old log file: %w", err)
+	}
+
+	return nil
+}
+
+// logLevels are the logging levels of the base logger and of the proxy
+// subsystems, which can be changed at runtime.  The methods are safe for
+// concurrent use.
+type logLevels struct {
+	// base is the level of the base logger.
+	base *slog.LevelVar
+
+	// subsystems are the levels of the proxy subsystems.  It contains all the
+	// [proxy.LogSubsystems].
+	subsystems map[proxy.LogSubsystem]*slog.LevelVar
+}
+
+// type check
+var _ admin.LogLevels = (*logLevels)(nil)
+
+// newLogLevels returns the levels set to base, overridden by the levels of the
+// subsystems from subs.
+func newLogLevels(base slog.Level, subs map[proxy.LogSubsystem]slog.Level) (ll *logLevels) {
+	ll = &logLevels{
+		base:       &slog.LevelVar{},
+		subsystems: make(map[proxy.LogSubsystem]*slog.LevelVar, len(proxy.LogSubsystems)),
+	}
+
+	ll.base.Set(base)
+	for _, sub := range proxy.LogSubsystems {
+		v := &slog.LevelVar{}
+		v.Set(base)
+		if lvl, ok := subs[sub]; ok {
+			v.Set(lvl)
+		}
+
+		ll.subsystems[sub] = v
+	}
+
+	ll.setDefault()
+
+	return ll
+}
+
+// proxyLevels returns the levels to use as [proxy.Config.LogLevels].
+func (ll *logLevels) proxyLevels() (levels map[proxy.LogSubsystem]slog.Leveler) {
+	levels = make(map[proxy.LogSubsystem]slog.Leveler, len(ll.subsystems))
+	for sub, v := range ll.subsystems {
+		levels[sub] = v
+	}
+
+	return levels
+}
+
+// LogLevels implements the [admin.LogLevels] interface for *logLevels.  The
+// level of the base logger has the empty name.
+func (ll *logLevels) LogLevels() (levels map[string]slog.Level) {
+	levels = make(map[string]slog.Level, len(ll.subsystems)+1)
+	levels[""] = ll.base.Level()
+	for sub, v := range ll.subsystems {
+		levels[string(sub)] = v.Level()
+	}
+
+	return levels
+}
+
+// SetLogLevel implements the [admin.LogLevels] interface for *logLevels.  If
+// sub is empty, the levels of the base logger and of all the subsystems are
+// set.
+func (ll *logLevels) SetLogLevel(sub string, lvl slog.Level) (err error) {
+	if sub == "" {
+		ll.base.Set(lvl)
+		for _, v := range ll.subsystems {
+			v.Set(lvl)
+		}
+	} else {
+		v, ok := ll.subsystems[proxy.LogSubsystem(sub)]
+		if !ok {
+			return fmt.Errorf("unknown subsystem %q", sub)
+		}
+
+		v.Set(lvl)
+	}
+
+	ll.setDefault()
+
+	return nil
+}
+
+// setDefault sets the level of [slog.Default] to the one of the upstream
+// subsystem, since the code which doesn't accept a logger, like the bootstrap
+// resolution, uses it.
+func (ll *logLevels) setDefault() {
+	slog.SetLogLoggerLevel(ll.subsystems[proxy.LogSubsystemUpstream].Level())
+}
+
+// parseLogLevels parses the logging levels of the proxy subsystems in the
+// subsystem:level form, like "cache:debug".
+func parseLogLevels(specs []string) (levels map[proxy.LogSubsystem]slog.Level, err error) {
+	levels = make(map[proxy.LogSubsystem]slog.Level, len(specs))
+	for i, s := range specs {
+		subStr, lvlStr, ok := strings.Cut(s, ":")
+		if !ok {
+			return nil, fmt.Errorf("at index %d: bad value %q: expected subsystem:level", i, s)
+		}
+
+		sub := proxy.LogSubsystem(subStr)
+		if !slices.Contains(proxy.LogSubsystems, sub) {
+			return nil, fmt.Errorf("at index %d: unknown subsystem %q", i, subStr)
+		}
+
+		var lvl slog.Level
+		err = lvl.UnmarshalText([]byte(lvlStr))
+		if err != nil {
+			return nil, fmt.Errorf("at index %d: %w", i, err)
+		}
+
+		levels[sub] = lvl
+	}
+
+	return levels, nil
+}
+
+// fatal logs msg with args at the error level and exits with a non-zero code.
+func fatal(l *slog.Logger, msg string, args ...any) {
+	l.Error(msg, args...)
+
+	os.Exit(1)
+}
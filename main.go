@@ -2,9 +2,14 @@
 package main
 
 import (
+	"cmp"
 	"context"
 	"crypto/tls"
+	"encoding/base64"
+	"expvar"
 	"fmt"
+	"io"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/http/pprof"
@@ -12,7 +17,11 @@ import (
 	"net/url"
 	"os"
 	"os/signal"
+	runtimepprof "runtime/pprof"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -20,12 +29,14 @@ import (
 	"github.com/AdguardTeam/dnsproxy/internal/version"
 	"github.com/AdguardTeam/dnsproxy/proxy"
 	"github.com/AdguardTeam/dnsproxy/upstream"
-	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
 	"github.com/AdguardTeam/golibs/netutil"
 	"github.com/AdguardTeam/golibs/osutil"
 	"github.com/AdguardTeam/golibs/timeutil"
 	"github.com/ameshkov/dnscrypt/v2"
 	goFlags "github.com/jessevdk/go-flags"
+	"github.com/miekg/dns"
 	"gopkg.in/yaml.v3"
 )
 
@@ -49,6 +60,10 @@ type Options struct {
 	// TLSKeyPath is the path to the file with the private key.
 	TLSKeyPath string `yaml:"tls-key" short:"k" long:"tls-key" description:"Path to a file with the private key"`
 
+	// TLSKeyLogFile is the path to the file to write the TLS session secrets
+	// to in the NSS key log format.
+	TLSKeyLogFile string `yaml:"tls-keylog-file" long:"tls-keylog-file" description:"Path to a file to append the TLS session secrets of the listeners and the upstreams to, for decrypting the traffic while debugging. SSLKEYLOGFILE is used if not set."`
+
 	// HTTPSServerName sets Server header for the HTTPS server.
 	HTTPSServerName string `yaml:"https-server-name" long:"https-server-name" description:"Set the Server header for the responses from the HTTPS server." default:"dnsproxy"`
 
@@ -90,6 +105,31 @@ type Options struct {
 	// Fallbacks is the list of fallback DNS upstream servers.
 	Fallbacks []string `yaml:"fallback" short:"f" long:"fallback" description:"Fallback resolvers to use when regular ones are unavailable, can be specified multiple times. You can also specify path to a file with the list of servers"`
 
+	// FallbackOn is the comma-separated list of the outcomes of the exchange
+	// with the upstreams, which make the request resolved with the fallbacks.
+	FallbackOn string `yaml:"fallback-on" long:"fallback-on" description:"Comma-separated list of the outcomes of the exchange with the upstreams making the request resolved with the fallbacks: error, servfail, refused, empty, validation, or none." default:"error"`
+
+	// FallbackOnDomains are the outcomes making the requests for the domain
+	// names and their subdomains resolved with the fallbacks, each in the
+	// DOMAIN:OUTCOMES form.
+	FallbackOnDomains []string `yaml:"fallback-on-domain" long:"fallback-on-domain" description:"Outcomes like in --fallback-on for the requests for the domain name and its subdomains, in the DOMAIN:OUTCOMES form, for example example.com:error,servfail. Can be specified multiple times."`
+
+	// UpstreamsURL is the HTTPS URL or the path of the file with the list of
+	// the general upstreams used along with Upstreams.
+	UpstreamsURL string `yaml:"upstreams-url" long:"upstreams-url" description:"HTTPS URL or path to a file with the list of servers to be used along with --upstream, which is fetched again every --upstreams-url-interval."`
+
+	// UpstreamsURLInterval is the time between the fetches of the list from
+	// UpstreamsURL.
+	UpstreamsURLInterval timeutil.Duration `yaml:"upstreams-url-interval" long:"upstreams-url-interval" description:"The time between the fetches of the list from --upstreams-url in a human-readable form." default:"1h"`
+
+	// UpstreamsURLKey is the base64-encoded Ed25519 public key the list from
+	// UpstreamsURL is verified with.
+	UpstreamsURLKey string `yaml:"upstreams-url-key" long:"upstreams-url-key" description:"Base64-encoded Ed25519 public key to verify the list from --upstreams-url with. The base64-encoded signature is fetched from the same URL with .sig appended."`
+
+	// UpstreamsURLChecksum makes the list from UpstreamsURL verified with its
+	// SHA-256 checksum.
+	UpstreamsURLChecksum bool `yaml:"upstreams-url-checksum" long:"upstreams-url-checksum" description:"Verify the list from --upstreams-url with the hex-encoded SHA-256 checksum fetched from the same URL with .sha256 appended." optional:"yes" optional-value:"true"`
+
 	// PrivateRDNSUpstreams are upstreams to use for reverse DNS lookups of
 	// private addresses, including the requests for authority records, such as
 	// SOA and NS.
@@ -100,6 +140,11 @@ type Options struct {
 	// Well-Known Prefix.  This option can be specified multiple times.
 	DNS64Prefix []string `yaml:"dns64-prefix" long:"dns64-prefix" description:"Prefix used to handle DNS64. If not specified, dnsproxy uses the 'Well-Known Prefix' 64:ff9b::.  Can be specified multiple times" required:"false"`
 
+	// DNS64Exclude defines the IPv4 ranges, the addresses within which are
+	// not used to synthesize the AAAA records.  This option can be specified
+	// multiple times.
+	DNS64Exclude []string `yaml:"dns64-exclude" long:"dns64-exclude" description:"IPv4 range the addresses within which are not used for DNS64 synthesis.  Can be specified multiple times" required:"false"`
+
 	// PrivateSubnets is the list of private subnets to determine private
 	// addresses.
 	PrivateSubnets []string `yaml:"private-subnets" long:"private-subnets" description:"Private subnets to use for reverse DNS lookups of private addresses" required:"false"`
@@ -115,6 +160,14 @@ type Options struct {
 	// human-readable form.  Default is 10s.
 	Timeout timeutil.Duration `yaml:"timeout" long:"timeout" description:"Timeout for outbound DNS queries to remote upstream servers in a human-readable form" default:"10s"`
 
+	// QueryBudget is the maximum time of resolving a single request with the
+	// upstreams, including the retries and the fallbacks.
+	QueryBudget timeutil.Duration `yaml:"query-budget" long:"query-budget" description:"Maximum time of resolving a single request with the upstreams, including the retries and the fallbacks, in a human-readable form, after which the request is answered with SERVFAIL. The upstreams tried in turn share it equally. A zero value will disable it."`
+
+	// QueryBudgetFallback is the part of QueryBudget reserved for the
+	// fallbacks.
+	QueryBudgetFallback timeutil.Duration `yaml:"query-budget-fallback" long:"query-budget-fallback" description:"Part of --query-budget reserved for the fallbacks in a human-readable form."`
+
 	// CacheMinTTL is the minimum TTL value for caching DNS entries, in seconds.
 	// It overrides the TTL value from the upstream server, if the one is less.
 	CacheMinTTL uint32 `yaml:"cache-min-ttl" long:"cache-min-ttl" description:"Minimum TTL value for DNS entries, in seconds. Capped at 3600. Artificially extending TTLs should only be done with careful consideration."`
@@ -124,12 +177,47 @@ type Options struct {
 	// greater.
 	CacheMaxTTL uint32 `yaml:"cache-max-ttl" long:"cache-max-ttl" description:"Maximum TTL value for DNS entries, in seconds."`
 
+	// CacheTypeTTLs are the TTL ranges for the particular record types, each
+	// in the TYPE:MIN:MAX form, overriding CacheMinTTL and CacheMaxTTL.
+	CacheTypeTTLs []string `yaml:"cache-type-ttl" long:"cache-type-ttl" description:"Minimum and maximum TTL values for the DNS entries of the given type in seconds instead of --cache-min-ttl and --cache-max-ttl, for example HTTPS:0:300 or PTR:3600:0. A zero maximum means no maximum. Can be specified multiple times."`
+
+	// AnswerOrder is the order of the address records in the responses
+	// received from the upstreams.
+	AnswerOrder string `yaml:"answer-order" long:"answer-order" description:"Order of the A and AAAA records in the responses received from the upstreams: upstream, shuffle, or sort. Doesn't affect the cached responses." default:"upstream"`
+
+	// ResponseCompression defines whether the domain names in the responses
+	// are compressed.
+	ResponseCompression string `yaml:"response-compression" long:"response-compression" description:"Compression of the domain names in the responses: force, auto to only compress the responses which don't fit otherwise, or disable to truncate those instead." default:"force"`
+
+	// ResolveCNAMETargets makes the proxy resolve the targets of the CNAME
+	// chains the upstreams return without the requested records.
+	ResolveCNAMETargets bool `yaml:"resolve-cname-targets" long:"resolve-cname-targets" description:"If specified, resolve the target of the CNAME chain returned by the upstream without the records of the requested type, using the upstreams for the target, and append the records to the response." optional:"yes" optional-value:"true"`
+
 	// CacheSizeBytes is the cache size in bytes.  Default is 64k.
 	CacheSizeBytes int `yaml:"cache-size" long:"cache-size" description:"Cache size (in bytes). Default: 64k"`
 
 	// Ratelimit is the maximum number of requests per second.
 	Ratelimit int `yaml:"ratelimit" short:"r" long:"ratelimit" description:"Ratelimit (requests per second)"`
 
+	// RatelimitIPv6 is the maximum number of requests per second from an IPv6
+	// subnet.
+	RatelimitIPv6 int `yaml:"ratelimit-ipv6" long:"ratelimit-ipv6" description:"Ratelimit for the IPv6 subnets (requests per second). --ratelimit is used if not set."`
+
+	// RatelimitBurst is the maximum number of requests from a subnet allowed
+	// at once.
+	RatelimitBurst int `yaml:"ratelimit-burst" long:"ratelimit-burst" description:"Maximum number of requests from a subnet allowed at once above the ratelimit. Equal to the ratelimit if not set."`
+
+	// RatelimitBurstIPv6 is the maximum number of requests from an IPv6
+	// subnet allowed at once.
+	RatelimitBurstIPv6 int `yaml:"ratelimit-burst-ipv6" long:"ratelimit-burst-ipv6" description:"Maximum number of requests from an IPv6 subnet allowed at once. --ratelimit-burst is used if not set."`
+
+	// RatelimitTruncate is the number of requests per second over UDP from a
+	// subnet, above which those are answered with truncated responses.
+	RatelimitTruncate int `yaml:"ratelimit-truncate" long:"ratelimit-truncate" description:"Soft ratelimit (requests per second over UDP), above which the requests are answered with truncated responses, so that the clients retry over TCP."`
+
+	// RatelimitSlip is the slip ratio of the ratelimit.
+	RatelimitSlip int `yaml:"ratelimit-slip" long:"ratelimit-slip" description:"Answer every Nth ratelimited request in a row with a truncated response instead of dropping it, like the slip of BIND. Disabled if not set."`
+
 	// RatelimitSubnetLenIPv4 is a subnet length for IPv4 addresses used for
 	// rate limiting requests.
 	RatelimitSubnetLenIPv4 int `yaml:"ratelimit-subnet-len-ipv4" long:"ratelimit-subnet-len-ipv4" description:"Ratelimit subnet length for IPv4." default:"24"`
@@ -138,12 +226,363 @@ type Options struct {
 	// rate limiting requests.
 	RatelimitSubnetLenIPv6 int `yaml:"ratelimit-subnet-len-ipv6" long:"ratelimit-subnet-len-ipv6" description:"Ratelimit subnet length for IPv6." default:"56"`
 
+	// RatelimitAllowlistFile is the path to the file with the client networks
+	// excluded from rate limiting.
+	RatelimitAllowlistFile string `yaml:"ratelimit-allowlist-file" long:"ratelimit-allowlist-file" description:"Path to the file with the IP addresses and CIDRs of the clients excluded from rate limiting, one per line. The file is re-read once modified."`
+
+	// RatelimitDenylistFile is the path to the file with the client networks
+	// the requests from which are always ratelimited.
+	RatelimitDenylistFile string `yaml:"ratelimit-denylist-file" long:"ratelimit-denylist-file" description:"Path to the file with the IP addresses and CIDRs of the clients the requests from which are always ratelimited, one per line. The file is re-read once modified."`
+
 	// UDPBufferSize is the size of the UDP buffer in bytes.  A value <= 0 will
 	// use the system default.
 	UDPBufferSize int `yaml:"udp-buf-size" long:"udp-buf-size" description:"Set the size of the UDP buffer in bytes. A value <= 0 will use the system default."`
 
+	// UDPSendBufferSize is the size of the send buffer of the UDP listeners in
+	// bytes.  A value <= 0 will use the system default.
+	UDPSendBufferSize int `yaml:"udp-send-buf-size" long:"udp-send-buf-size" description:"Set the size of the send buffer of the UDP listeners in bytes. A value <= 0 will use the system default."`
+
+	// UDPSocketFilter attaches a socket filter dropping the packets that can't
+	// be DNS queries to the UDP listeners.
+	UDPSocketFilter bool `yaml:"udp-socket-filter" long:"udp-socket-filter" description:"If present, the packets received by the plain DNS UDP listeners that can't be DNS queries are dropped in the kernel. Only supported on Linux." optional:"yes" optional-value:"true"`
+
+	// XDPInterface is the name of the network interface the repeated queries
+	// for the hot cache entries received on are answered in the kernel.
+	XDPInterface string `yaml:"xdp-interface" long:"xdp-interface" description:"If set, the repeated plain DNS queries over UDP for the hot cache entries received on this network interface are answered in the kernel with XDP. Requires --cache. Only supported on Linux 5.18 or newer when built with the xdp build tag."`
+
+	// XDPMaxEntries is the maximum number of the responses stored in the
+	// kernel.
+	XDPMaxEntries uint `yaml:"xdp-max-entries" long:"xdp-max-entries" description:"The maximum number of the responses stored in the kernel for --xdp-interface." default:"65536"`
+
+	// XDPMaxAge is the maximum duration a response is served by the kernel for.
+	XDPMaxAge timeutil.Duration `yaml:"xdp-max-age" long:"xdp-max-age" description:"The maximum time a response is served by the kernel for --xdp-interface, which limits how stale its TTLs get, in a human-readable form." default:"30s"`
+
+	// UDPMaxResponseSizes are the maximum sizes of the responses sent over
+	// UDP, each optionally followed by the listen address it's only applied
+	// to.
+	UDPMaxResponseSizes []string `yaml:"udp-max-response-size" long:"udp-max-response-size" description:"The maximum size of the responses sent over UDP in bytes, which is also advertised in their OPT records. Append a listen address to only apply it to that listener, for example 1232:127.0.0.1:53. Can be specified multiple times."`
+
+	// UpstreamUDPSizes are the EDNS buffer sizes advertised to the upstreams,
+	// each optionally followed by the listen address it's only applied to.
+	UpstreamUDPSizes []string `yaml:"upstream-udp-size" long:"upstream-udp-size" description:"The EDNS buffer size in bytes advertised to the upstreams in the requests with the OPT record, clamped between 512 and 4096. Append a listen address to only apply it to the requests received on that listener, for example 1232:0.0.0.0:53. Can be specified multiple times."`
+
+	// UDPUnverifiedMaxSize is the maximum size of the responses sent over UDP
+	// to the clients which haven't made a request over TCP recently.
+	UDPUnverifiedMaxSize uint16 `yaml:"udp-unverified-max-size" long:"udp-unverified-max-size" description:"If set, the responses larger than this size in bytes are truncated for the clients which haven't made a request over TCP, TLS, HTTPS, or QUIC recently, so that they retry over TCP."`
+
+	// UDPVerifiedTTL is the duration a client is considered verified after
+	// its last request over a connection-oriented protocol.
+	UDPVerifiedTTL timeutil.Duration `yaml:"udp-verified-ttl" long:"udp-verified-ttl" description:"The time a client is exempt from --udp-unverified-max-size after its last request over TCP, TLS, HTTPS, or QUIC in a human-readable form." default:"1h"`
+
+	// UDPMaxVerifiedClients is the maximum number of the verified clients
+	// remembered.
+	UDPMaxVerifiedClients uint `yaml:"udp-max-verified-clients" long:"udp-max-verified-clients" description:"The maximum number of the clients exempt from --udp-unverified-max-size remembered at once, the least recently verified ones are forgotten first." default:"10000"`
+
+	// UpstreamRecvBufferSize is the size of the receive buffer of the sockets
+	// dialed to the upstreams in bytes.  A value <= 0 will use the system
+	// default.
+	UpstreamRecvBufferSize int `yaml:"upstream-recv-buf-size" long:"upstream-recv-buf-size" description:"Set the size of the receive buffer of the upstream sockets in bytes, except for DNS-over-QUIC and HTTP/3. A value <= 0 will use the system default."`
+
+	// UpstreamSendBufferSize is the size of the send buffer of the sockets
+	// dialed to the upstreams in bytes.  A value <= 0 will use the system
+	// default.
+	UpstreamSendBufferSize int `yaml:"upstream-send-buf-size" long:"upstream-send-buf-size" description:"Set the size of the send buffer of the upstream sockets in bytes, except for DNS-over-QUIC and HTTP/3. A value <= 0 will use the system default."`
+
+	// UpstreamDSCP is the DSCP the packets sent to the upstreams are marked
+	// with.
+	UpstreamDSCP uint8 `yaml:"upstream-dscp" long:"upstream-dscp" description:"The DSCP value from 0 to 63 to mark the packets sent to the upstreams with, except for DNSCrypt. A zero value will not mark the packets. Not supported on Windows."`
+
+	// UpstreamInterface is the name of the network interface or the VRF device
+	// to bind the sockets dialed to the upstreams to.
+	UpstreamInterface string `yaml:"upstream-interface" long:"upstream-interface" description:"Name of the network interface or the VRF device to send the queries to the upstreams through, except for DNSCrypt. Only supported on Linux and macOS."`
+
+	// UpstreamIPVersions are the preferences of the address family used to dial
+	// the upstreams, either for all of them or for a single one.
+	UpstreamIPVersions []string `yaml:"upstream-ip-version" long:"upstream-ip-version" description:"The address family to dial the upstreams with when their hostnames resolve to both: prefer-ipv4, prefer-ipv6, ipv4-only, or ipv6-only. Prepend it to an upstream to only apply it to that upstream, for example ipv6-only:tls://dns.example. Can be specified multiple times."`
+
+	// RootHints are the addresses of the root name servers the recursive://
+	// upstream starts the resolution from.
+	RootHints []string `yaml:"root-hint" long:"root-hint" description:"IP address, optionally with a port, of a root name server the recursive:// upstream starts the resolution from instead of the IANA ones. Can be specified multiple times."`
+
+	// DNSCryptRelays are the Anonymized DNSCrypt relays the queries to the
+	// DNSCrypt upstreams are sent through.
+	DNSCryptRelays []string `yaml:"dnscrypt-relay" long:"dnscrypt-relay" description:"IP address with a port or sdns:// stamp of an Anonymized DNSCrypt relay the queries to the DNSCrypt upstreams are sent through, hiding the address of dnsproxy from them. Can be specified multiple times."`
+
+	// UpstreamSRVRefresh is the time after which the SRV records of the srv+
+	// upstreams are looked up again.
+	UpstreamSRVRefresh timeutil.Duration `yaml:"upstream-srv-refresh" long:"upstream-srv-refresh" description:"The time after which the SRV records of the srv+ upstreams are looked up again to discover the added and removed instances in a human-readable form." default:"30s"`
+
+	// UpstreamPoolMaxIdle is the maximum number of the idle connections kept
+	// for reuse by each plain DNS-over-TCP and DNS-over-TLS upstream.
+	UpstreamPoolMaxIdle uint `yaml:"upstream-pool-max-idle" long:"upstream-pool-max-idle" description:"The maximum number of the idle connections kept for reuse by each plain DNS-over-TCP and DNS-over-TLS upstream. A zero value will not set a maximum."`
+
+	// UpstreamPoolMaxAge is the maximum age of a reused connection to a plain
+	// DNS-over-TCP or DNS-over-TLS upstream.
+	UpstreamPoolMaxAge timeutil.Duration `yaml:"upstream-pool-max-age" long:"upstream-pool-max-age" description:"The maximum age of a reused connection to a plain DNS-over-TCP or DNS-over-TLS upstream in a human-readable form. A zero value will not set a maximum."`
+
+	// UpstreamPoolIdleTimeout is the maximum duration a connection to a plain
+	// DNS-over-TCP or DNS-over-TLS upstream is kept idle for reuse.
+	UpstreamPoolIdleTimeout timeutil.Duration `yaml:"upstream-pool-idle-time" long:"upstream-pool-idle-time" description:"The maximum time a connection to a plain DNS-over-TCP or DNS-over-TLS upstream is kept idle for reuse in a human-readable form. A zero value will not set a maximum."`
+
+	// UpstreamPoolMaxDials is the maximum number of the connections dialed
+	// simultaneously by each plain DNS-over-TCP and DNS-over-TLS upstream.
+	UpstreamPoolMaxDials uint `yaml:"upstream-pool-max-dials" long:"upstream-pool-max-dials" description:"The maximum number of the connections dialed simultaneously by each plain DNS-over-TCP and DNS-over-TLS upstream. A zero value will not set a maximum."`
+
+	// UpstreamPoolPrewarm is the number of the connections dialed in advance
+	// by each plain DNS-over-TCP and DNS-over-TLS upstream.
+	UpstreamPoolPrewarm uint `yaml:"upstream-pool-prewarm" long:"upstream-pool-prewarm" description:"The number of the connections dialed at startup by each plain DNS-over-TCP and DNS-over-TLS upstream."`
+
+	// UpstreamUDPPorts is the number of the sockets bound to the random source
+	// ports kept by each plain DNS-over-UDP upstream.
+	UpstreamUDPPorts uint `yaml:"upstream-udp-ports" long:"upstream-udp-ports" description:"The number of the sockets bound to random source ports kept by each plain DNS-over-UDP upstream. A zero value will make each query use a new socket."`
+
+	// UpstreamUDPPortsLifetime is the duration a pooled socket of a plain
+	// DNS-over-UDP upstream is used for before being replaced.
+	UpstreamUDPPortsLifetime timeutil.Duration `yaml:"upstream-udp-ports-lifetime" long:"upstream-udp-ports-lifetime" description:"The time a socket kept by a plain DNS-over-UDP upstream is used for before being replaced with one bound to another random port in a human-readable form." default:"1m"`
+
+	// UpstreamMaxCompressionPointers is the maximum number of the compression
+	// pointers forming a domain name in the responses from the upstreams.
+	UpstreamMaxCompressionPointers uint `yaml:"upstream-max-compression-pointers" long:"upstream-max-compression-pointers" description:"The maximum number of the compression pointers forming a domain name in the responses from the upstreams, except for the DNSCrypt ones. The responses exceeding it or containing the pointers which don't point backward are rejected. A zero value will disable the checks." default:"16"`
+
+	// UpstreamEDNSBufferSize is the EDNS buffer size advertised to the plain
+	// DNS-over-UDP upstreams initially.
+	UpstreamEDNSBufferSize uint16 `yaml:"upstream-edns-buffer-size" long:"upstream-edns-buffer-size" description:"The EDNS buffer size advertised to plain DNS-over-UDP upstreams, reduced to 512 bytes and then to TCP for an upstream once its responses look lost to fragmentation. A zero value will disable the adaptive sizing." default:"1232"`
+
+	// UpstreamEDNSProbeInterval is the duration the reduced EDNS buffer size of
+	// a plain DNS-over-UDP upstream is used for.
+	UpstreamEDNSProbeInterval timeutil.Duration `yaml:"upstream-edns-probe-interval" long:"upstream-edns-probe-interval" description:"The time a plain DNS-over-UDP upstream keeps using the reduced EDNS buffer size or TCP before trying --upstream-edns-buffer-size again in a human-readable form." default:"10m"`
+
+	// ForceTCPDomains are the domain names, the requests for which and for
+	// their subdomains are resolved with the plain DNS upstreams over TCP.
+	ForceTCPDomains []string `yaml:"force-tcp-domain" long:"force-tcp-domain" description:"Domain name the requests for which and for its subdomains are resolved with the plain DNS upstreams over TCP only. Can be specified multiple times."`
+
+	// ForceTCPQtypes are the types of the requests resolved with the plain DNS
+	// upstreams over TCP.
+	ForceTCPQtypes []string `yaml:"force-tcp-qtype" long:"force-tcp-qtype" description:"Type of the requests resolved with the plain DNS upstreams over TCP only, for example DNSKEY. Can be specified multiple times."`
+
+	// SVCBStripECH are the domain names, the ech parameter of the SVCB and
+	// HTTPS records for which and for their subdomains is removed.
+	SVCBStripECH []string `yaml:"svcb-strip-ech" long:"svcb-strip-ech" description:"Domain name the responses for which and for its subdomains have the ech parameter removed from the SVCB and HTTPS records. Use . for all domains. Can be specified multiple times."`
+
+	// SVCBStripIPv4Hint are the domain names, the ipv4hint parameter of the
+	// SVCB and HTTPS records for which and for their subdomains is removed.
+	SVCBStripIPv4Hint []string `yaml:"svcb-strip-ipv4hint" long:"svcb-strip-ipv4hint" description:"Domain name the responses for which and for its subdomains have the ipv4hint parameter removed from the SVCB and HTTPS records. Use . for all domains. Can be specified multiple times."`
+
+	// SVCBStripIPv6Hint are the domain names, the ipv6hint parameter of the
+	// SVCB and HTTPS records for which and for their subdomains is removed.
+	SVCBStripIPv6Hint []string `yaml:"svcb-strip-ipv6hint" long:"svcb-strip-ipv6hint" description:"Domain name the responses for which and for its subdomains have the ipv6hint parameter removed from the SVCB and HTTPS records. Use . for all domains. Can be specified multiple times."`
+
+	// SVCBDrop are the domain names, the SVCB and HTTPS records for which and
+	// for their subdomains are removed from the responses.
+	SVCBDrop []string `yaml:"svcb-drop" long:"svcb-drop" description:"Domain name the responses for which and for its subdomains have the SVCB and HTTPS records removed. Use . for all domains. Can be specified multiple times."`
+
+	// InsecureDomains are the domain names, the requests for which and for
+	// their subdomains are exempt from DNSSEC.
+	InsecureDomains []string `yaml:"insecure-domain" long:"insecure-domain" description:"Domain name the requests for which and for its subdomains are exempt from DNSSEC: sent with the CD flag to disable the validation by the upstreams and without the DO flag added. Can be specified multiple times."`
+
+	// ZoneTransferUpstreams are the plain DNS upstreams the AXFR and IXFR
+	// requests are proxied to over TCP.
+	ZoneTransferUpstreams []string `yaml:"zone-transfer-upstream" long:"zone-transfer-upstream" description:"Plain DNS upstream the zone transfer requests are proxied to over TCP. Can be specified multiple times."`
+
+	// ZoneTransferAllowed are the networks of the clients allowed to transfer
+	// the zones.
+	ZoneTransferAllowed []string `yaml:"zone-transfer-allow" long:"zone-transfer-allow" description:"Network in CIDR notation of the clients allowed to transfer the zones. Can be specified multiple times."`
+
+	// DynamicUpdateUpstreams are the primary servers the dynamic updates are
+	// forwarded to.
+	DynamicUpdateUpstreams []string `yaml:"dynamic-update-upstream" long:"dynamic-update-upstream" description:"Upstream the dynamic update requests are forwarded to, normally the primary server of the zones. If not specified, the upstreams used for the queries are used. Can be specified multiple times."`
+
+	// DynamicUpdateAllowed are the networks of the clients allowed to update
+	// the zones.
+	DynamicUpdateAllowed []string `yaml:"dynamic-update-allow" long:"dynamic-update-allow" description:"Network in CIDR notation of the clients allowed to update the zones. Can be specified multiple times."`
+
+	// TSIGKeys are the keys the signatures of the requests are verified with,
+	// in the [algorithm:]name:secret form.
+	TSIGKeys []string `yaml:"tsig-key" long:"tsig-key" description:"Key the TSIG signatures of the requests are verified with and the responses to them are signed with, in the [algorithm:]name:secret form, for example hmac-sha256:key.example:c2VjcmV0. Can be specified multiple times."`
+
+	// ZoneTransferTSIGKey is the name of the key the requests to the zone
+	// transfer upstreams are signed with.
+	ZoneTransferTSIGKey string `yaml:"zone-transfer-tsig-key" long:"zone-transfer-tsig-key" description:"Name of the key specified with --tsig-key the requests to the zone transfer upstreams are signed with."`
+
+	// ZoneTransferAllowedKeys are the names of the keys the zone transfer
+	// requests signed with which are allowed regardless of the client address.
+	ZoneTransferAllowedKeys []string `yaml:"zone-transfer-allow-key" long:"zone-transfer-allow-key" description:"Name of the key specified with --tsig-key the zone transfer requests signed with which are allowed from any client. Can be specified multiple times."`
+
+	// DynamicUpdateTSIGKey is the name of the key the updates forwarded to the
+	// dynamic update upstreams are signed with.
+	DynamicUpdateTSIGKey string `yaml:"dynamic-update-tsig-key" long:"dynamic-update-tsig-key" description:"Name of the key specified with --tsig-key the updates forwarded to the dynamic update upstreams are signed with."`
+
+	// DynamicUpdateAllowedKeys are the names of the keys the updates signed
+	// with which are allowed regardless of the client address.
+	DynamicUpdateAllowedKeys []string `yaml:"dynamic-update-allow-key" long:"dynamic-update-allow-key" description:"Name of the key specified with --tsig-key the updates signed with which are allowed from any client. Can be specified multiple times."`
+
+	// NotifyAllowed are the networks of the primary servers allowed to notify
+	// about the changes of the zones.
+	NotifyAllowed []string `yaml:"notify-allow" long:"notify-allow" description:"Network in CIDR notation of the primary servers the NOTIFY messages from which flush the cached responses for the zone. Can be specified multiple times."`
+
+	// NotifyAllowedKeys are the names of the keys the NOTIFY messages signed
+	// with which are accepted regardless of the address.
+	NotifyAllowedKeys []string `yaml:"notify-allow-key" long:"notify-allow-key" description:"Name of the key specified with --tsig-key the NOTIFY messages signed with which are accepted from any address. Can be specified multiple times."`
+
+	// UpstreamH2MaxConns is the maximum number of the HTTP/2 connections to
+	// each DNS-over-HTTPS upstream.
+	UpstreamH2MaxConns uint `yaml:"upstream-h2-max-conns" long:"upstream-h2-max-conns" description:"The maximum number of the HTTP/2 connections to each DNS-over-HTTPS upstream." default:"2"`
+
+	// UpstreamH2MaxStreams is the maximum number of the queries sent
+	// simultaneously over each connection to a DNS-over-HTTPS upstream.
+	UpstreamH2MaxStreams uint `yaml:"upstream-h2-max-streams" long:"upstream-h2-max-streams" description:"The maximum number of the queries sent simultaneously over each connection to a DNS-over-HTTPS upstream. A zero value will not set a maximum."`
+
+	// UpstreamH2IdleTime is the maximum duration an HTTP/2 connection to a
+	// DNS-over-HTTPS upstream is kept idle.
+	UpstreamH2IdleTime timeutil.Duration `yaml:"upstream-h2-idle-time" long:"upstream-h2-idle-time" description:"The maximum time an HTTP/2 connection to a DNS-over-HTTPS upstream is kept idle in a human-readable form." default:"5m"`
+
+	// UpstreamH2PingInterval is the duration without any frames received on
+	// an HTTP/2 connection to a DNS-over-HTTPS upstream, after which its
+	// liveness is checked with a ping.
+	UpstreamH2PingInterval timeutil.Duration `yaml:"upstream-h2-ping-interval" long:"upstream-h2-ping-interval" description:"The time without any data received on an HTTP/2 connection to a DNS-over-HTTPS upstream, after which its liveness is checked with a ping, in a human-readable form." default:"30s"`
+
+	// UpstreamH2PingTimeout is the maximum duration of waiting for the
+	// response to a ping, after which the HTTP/2 connection is replaced.
+	UpstreamH2PingTimeout timeutil.Duration `yaml:"upstream-h2-ping-timeout" long:"upstream-h2-ping-timeout" description:"The maximum time to wait for the response to a ping, after which the HTTP/2 connection to a DNS-over-HTTPS upstream is replaced, in a human-readable form." default:"15s"`
+
+	// QUICSessionFile is the path to the file the TLS sessions of the
+	// DNS-over-QUIC upstreams are persisted to.
+	QUICSessionFile string `yaml:"quic-session-file" long:"quic-session-file" description:"Path to the file the TLS sessions of the DNS-over-QUIC upstreams are saved to on shutdown and restored from on startup, so that the first queries after a restart could use 0-RTT. The file contains the session secrets."`
+
+	// UpstreamECH enables Encrypted Client Hello for the DNS-over-HTTPS and
+	// DNS-over-TLS upstreams.
+	UpstreamECH bool `yaml:"upstream-ech" long:"upstream-ech" description:"If present, the DNS-over-HTTPS and DNS-over-TLS upstreams, except for HTTP/3, use Encrypted Client Hello, if their hostnames publish the ECH configurations in the HTTPS records. Those are looked up with the bootstrap DNS servers." optional:"yes" optional-value:"true"`
+
+	// UpstreamRetries is the maximum number of the retries of a failed
+	// exchange with an upstream.
+	UpstreamRetries uint `yaml:"upstream-retries" long:"upstream-retries" description:"The maximum number of the retries of a failed exchange with an upstream. A zero value will disable the retries."`
+
+	// UpstreamTryTimeout is the timeout of each attempt of an exchange with
+	// an upstream.
+	UpstreamTryTimeout timeutil.Duration `yaml:"upstream-try-timeout" long:"upstream-try-timeout" description:"The timeout of each attempt of an exchange with an upstream in a human-readable form, which is used instead of --timeout when the retries are enabled. A zero value will use --timeout."`
+
+	// UpstreamRetryDeadline is the maximum duration since the first attempt
+	// of an exchange with an upstream, after which it's not retried.
+	UpstreamRetryDeadline timeutil.Duration `yaml:"upstream-retry-deadline" long:"upstream-retry-deadline" description:"The time since the first attempt of an exchange with an upstream, after which it's not retried, in a human-readable form. A zero value will not set a deadline."`
+
+	// UpstreamRetryBackoff is the delay before the first retry of an
+	// exchange with an upstream.
+	UpstreamRetryBackoff timeutil.Duration `yaml:"upstream-retry-backoff" long:"upstream-retry-backoff" description:"The delay before the first retry of an exchange with an upstream in a human-readable form, which doubles with each next retry. The actual delays are randomized." default:"10ms"`
+
+	// UpstreamRetryMaxBackoff is the maximum delay between the retries of an
+	// exchange with an upstream.
+	UpstreamRetryMaxBackoff timeutil.Duration `yaml:"upstream-retry-max-backoff" long:"upstream-retry-max-backoff" description:"The maximum delay between the retries of an exchange with an upstream in a human-readable form. A zero value will not set a maximum."`
+
+	// UpstreamRetryRcodes are the response codes, the responses from the
+	// upstreams with which are retried.
+	UpstreamRetryRcodes []string `yaml:"upstream-retry-rcode" long:"upstream-retry-rcode" description:"Response code, for example FORMERR or REFUSED, the responses from an upstream with which are retried like the failed exchanges. Can be specified multiple times."`
+
+	// UpstreamFailureBackoff is the time a failing upstream is skipped for in
+	// the load-balancing mode after its first failure in a row.
+	UpstreamFailureBackoff timeutil.Duration `yaml:"upstream-failure-backoff" long:"upstream-failure-backoff" description:"The time a failing upstream is skipped for after its first failure in a row in a human-readable form, which doubles with each next failure. The actual times are randomized. Only used in the load-balancing mode. A zero value will disable the backoff."`
+
+	// UpstreamFailureMaxBackoff is the maximum time a failing upstream is
+	// skipped for in the load-balancing mode.
+	UpstreamFailureMaxBackoff timeutil.Duration `yaml:"upstream-failure-max-backoff" long:"upstream-failure-max-backoff" description:"The maximum time a failing upstream is skipped for in a human-readable form. A zero value will not set a maximum." default:"5m"`
+
+	// NextUpstreamRcodes are the response codes, the responses from an
+	// upstream with which make the request sent to the next upstream in the
+	// load-balancing mode.
+	NextUpstreamRcodes []string `yaml:"next-upstream-rcode" long:"next-upstream-rcode" description:"Response code, for example SERVFAIL or REFUSED, the responses from an upstream with which make the request sent to the next upstream, if any. Only used in the load-balancing mode. Can be specified multiple times."`
+
+	// UpstreamRefused defines how the REFUSED responses from the upstreams are
+	// handled.
+	UpstreamRefused string `yaml:"upstream-refused" long:"upstream-refused" description:"Handling of the REFUSED responses from the upstreams: pass to send those to the clients, fail to treat those as the failures of the upstreams, or servfail to answer SERVFAIL with an extended DNS error instead." default:"pass"`
+
+	// UpstreamNotImp defines how the NOTIMP responses from the upstreams are
+	// handled.
+	UpstreamNotImp string `yaml:"upstream-notimp" long:"upstream-notimp" description:"Handling of the NOTIMP responses from the upstreams, like in --upstream-refused." default:"pass"`
+
+	// UpstreamStatsFile is the path to the file the statistics of the upstreams
+	// used in the load-balancing mode are persisted to.
+	UpstreamStatsFile string `yaml:"upstream-stats-file" long:"upstream-stats-file" description:"Path to the file the round-trip times and the failures of the upstreams used to choose those in the load-balancing mode are saved to on shutdown and restored from on startup"`
+
+	// TCPFastOpen enables TCP Fast Open on the TCP-based listeners and for the
+	// connections to the upstreams.
+	TCPFastOpen bool `yaml:"tcp-fast-open" long:"tcp-fast-open" description:"If present, enables TCP Fast Open on the TCP-based listeners and for the TCP connections to the upstreams, where the OS supports it." optional:"yes" optional-value:"true"`
+
+	// MultipathTCP enables Multipath TCP on the TCP-based listeners and for the
+	// connections to the upstreams.
+	MultipathTCP bool `yaml:"multipath-tcp" long:"multipath-tcp" description:"If present, enables Multipath TCP on the TCP-based listeners and for the TCP connections to the upstreams, where the OS supports it." optional:"yes" optional-value:"true"`
+
+	// ListenSockets is the number of the UDP and TCP sockets opened for each
+	// plain DNS listen address using SO_REUSEPORT.
+	ListenSockets uint `yaml:"listen-sockets" long:"listen-sockets" description:"Number of UDP and TCP sockets opened per plain DNS listen address using SO_REUSEPORT, so that the load is spread across CPU cores. Not supported on Windows." default:"1"`
+
+	// ReusePort makes all the listeners, including the encrypted and the HTTP
+	// ones, share their addresses using SO_REUSEPORT.
+	ReusePort bool `yaml:"reuse-port" long:"reuse-port" description:"If present, binds all the listeners, including the encrypted DNS and the HTTP ones, with SO_REUSEPORT, like the plain DNS ones always are, which is required for the binary upgrade on SIGUSR2. Not supported on Windows." optional:"yes" optional-value:"true"`
+
+	// ListenInterface is the name of the network interface to bind the
+	// listeners to.
+	ListenInterface string `yaml:"listen-interface" long:"listen-interface" description:"Name of the network interface or the VRF device to bind all the listeners to, in addition to the listen addresses. Only supported on Linux and macOS."`
+
+	// ListenFreeBind allows the listeners to be bound to the addresses not
+	// assigned to any interface yet.
+	ListenFreeBind bool `yaml:"listen-freebind" long:"listen-freebind" description:"If present, allows binding the listeners to the addresses not assigned to any interface yet, such as the failover virtual addresses. Only supported on Linux, FreeBSD, and OpenBSD." optional:"yes" optional-value:"true"`
+
+	// ListenDSCP is the DSCP the responses to the clients are marked with.
+	ListenDSCP uint8 `yaml:"listen-dscp" long:"listen-dscp" description:"The DSCP value from 0 to 63 to mark the responses to the clients with. A zero value will not mark the packets. Not supported on Windows."`
+
+	// TransparentProxy makes the listeners accept the queries intercepted with
+	// TPROXY.
+	TransparentProxy bool `yaml:"transparent-proxy" long:"transparent-proxy" description:"If present, accepts the queries intercepted with TPROXY and answers the plain DNS ones from their original destinations. Requires CAP_NET_ADMIN. Only supported on Linux." optional:"yes" optional-value:"true"`
+
 	// MaxGoRoutines is the maximum number of goroutines.
-	MaxGoRoutines uint `yaml:"max-go-routines" long:"max-go-routines" description:"Set the maximum number of go routines. A zero value will not not set a maximum."`
+	MaxGoRoutines uint `yaml:"max-go-routines" long:"max-go-routines" description:"Set the maximum number of go routines. A zero value will not not set a maximum. With --adaptive-concurrency, it also caps --adaptive-concurrency-max."`
+
+	// AdaptiveConcurrency enables the adaptive limit of the number of the
+	// requests processed simultaneously.
+	AdaptiveConcurrency bool `yaml:"adaptive-concurrency" long:"adaptive-concurrency" description:"If present, limits the number of the requests processed simultaneously adaptively, following the latency of the upstreams, and answers the requests exceeding the limit right away according to --overload-policy." optional:"yes" optional-value:"true"`
+
+	// AdaptiveConcurrencyMin is the lowest value of the adaptive concurrency
+	// limit.
+	AdaptiveConcurrencyMin uint `yaml:"adaptive-concurrency-min" long:"adaptive-concurrency-min" description:"The lowest value of the adaptive concurrency limit." default:"10"`
+
+	// AdaptiveConcurrencyMax is the highest value of the adaptive concurrency
+	// limit.
+	AdaptiveConcurrencyMax uint `yaml:"adaptive-concurrency-max" long:"adaptive-concurrency-max" description:"The highest value of the adaptive concurrency limit." default:"1000"`
+
+	// MaxInflight is the maximum number of the requests processed
+	// simultaneously.
+	MaxInflight uint `yaml:"max-inflight" long:"max-inflight" description:"The maximum number of the requests processed simultaneously. The requests exceeding it are answered according to --overload-policy. A zero value will not set a maximum."`
+
+	// MaxInflightPerClient is the maximum number of the requests from a single
+	// client address processed simultaneously.
+	MaxInflightPerClient uint `yaml:"max-inflight-per-client" long:"max-inflight-per-client" description:"The maximum number of the requests from a single client address processed simultaneously. The requests exceeding it are answered according to --overload-policy. A zero value will not set a maximum."`
+
+	// OverloadPolicy defines how the requests exceeding the limits of the
+	// requests processed simultaneously are answered.
+	OverloadPolicy string `yaml:"overload-policy" long:"overload-policy" description:"How to answer the requests exceeding the limits of the requests processed simultaneously: drop, truncate, or servfail. By default, a truncated response is sent over UDP and SERVFAIL otherwise."`
+
+	// TCPIdleTimeout is the maximum duration of waiting for the next query on
+	// a TCP or TLS connection.
+	TCPIdleTimeout timeutil.Duration `yaml:"tcp-idle-timeout" long:"tcp-idle-timeout" description:"Maximum time to wait for the next query on a TCP or TLS connection in a human-readable form." default:"10s"`
+
+	// TCPReadTimeout is the maximum duration of reading a query from a TCP or
+	// TLS connection once its length is received.
+	TCPReadTimeout timeutil.Duration `yaml:"tcp-read-timeout" long:"tcp-read-timeout" description:"Maximum time to read a query from a TCP or TLS connection once its length is received in a human-readable form." default:"10s"`
+
+	// TCPMaxConns is the maximum number of the connections handled
+	// simultaneously by each TCP and TLS listener.
+	TCPMaxConns uint `yaml:"tcp-max-conns" long:"tcp-max-conns" description:"The maximum number of the connections handled simultaneously by each TCP and TLS listener. A zero value will not set a maximum."`
+
+	// TCPMaxConnsPerIP is the maximum number of the connections from a single
+	// client address handled simultaneously by each TCP and TLS listener.
+	TCPMaxConnsPerIP uint `yaml:"tcp-max-conns-per-ip" long:"tcp-max-conns-per-ip" description:"The maximum number of the connections from a single client address handled simultaneously by each TCP and TLS listener. A zero value will not set a maximum."`
+
+	// TCPMaxQueriesPerConn is the maximum number of the queries read from a
+	// single TCP or TLS connection.
+	TCPMaxQueriesPerConn uint `yaml:"tcp-max-queries-per-conn" long:"tcp-max-queries-per-conn" description:"The maximum number of the queries read from a single TCP or TLS connection before closing it. A zero value will not set a maximum."`
+
+	// TCPMaxWorkers is the maximum number of the goroutines handling the
+	// queries received over the connections of each TCP and TLS listener.
+	TCPMaxWorkers uint `yaml:"tcp-max-workers" long:"tcp-max-workers" description:"The maximum number of the goroutines handling the queries received over the connections of each TCP and TLS listener simultaneously. A zero value sets the default of 1024."`
 
 	// TLSMinVersion is the minimum allowed version of TLS.
 	TLSMinVersion float32 `yaml:"tls-min-version" long:"tls-min-version" description:"Minimum TLS version, for example 1.0" optional:"yes"`
@@ -155,12 +594,342 @@ type Options struct {
 	// localhost:6060 or not.
 	Pprof bool `yaml:"pprof" long:"pprof" description:"If present, exposes pprof information on localhost:6060." optional:"yes" optional-value:"true"`
 
+	// PprofListenAddr is the address to expose the pprof, expvar, and
+	// goroutine dump information on.  It overrides the address used by Pprof.
+	PprofListenAddr string `yaml:"pprof-addr" long:"pprof-addr" description:"If set, exposes pprof information, expvar variables, and goroutine dumps on the given address, for example localhost:6060."`
+
+	// MetricsListenAddr is the address to serve the Prometheus metrics on.  If
+	// empty, the metrics aren't collected.
+	MetricsListenAddr string `yaml:"metrics-addr" long:"metrics-addr" description:"If set, exposes Prometheus metrics on the given address at /metrics, for example localhost:9153."`
+
+	// MetricsTopTalkers is the number of the client subnets sending the most
+	// requests reported in the metrics.  Zero disables it.
+	MetricsTopTalkers int `yaml:"metrics-top-talkers" long:"metrics-top-talkers" description:"If set, the metrics include the request rates and the response codes of this number of the client subnets sending the most requests within the last minute."`
+
+	// StatsListenAddr is the address to serve the statistics of the processed
+	// requests on.  If empty, the statistics aren't collected.
+	StatsListenAddr string `yaml:"stats-addr" long:"stats-addr" description:"If set, collects the statistics of the processed requests and serves them as JSON on the given address at /stats, for example localhost:8081."`
+
+	// AdminListenAddr is the address of the admin HTTP listener.  If empty,
+	// the admin listener is disabled.
+	AdminListenAddr string `yaml:"admin-addr" long:"admin-addr" description:"If set, serves the admin HTTP handlers, like the dashboard, on the given address, for example localhost:8082."`
+
+	// Dashboard defines whether the web status dashboard should be served at
+	// the root of the admin listener.
+	Dashboard bool `yaml:"dashboard" long:"dashboard" description:"If present, serves the web status dashboard at the root of the admin listener, authenticated with the admin token." optional:"yes" optional-value:"true"`
+
+	// AdminToken is the secret authenticating the requests to the admin API.
+	// If empty, the admin API is disabled.
+	AdminToken string `yaml:"admin-token" long:"admin-token" description:"If set, serves the admin API under /api/ on the admin listener, authenticated with the given token."`
+
+	// HealthListenAddr is the address to serve the health and readiness checks
+	// on.  If empty, the checks aren't served.
+	HealthListenAddr string `yaml:"health-addr" long:"health-addr" description:"If set, serves the health check at /health and the readiness check at /ready on the given address, for example localhost:8080."`
+
+	// HTTPRedirectListenAddr is the address of the plain HTTP listener
+	// redirecting to the DNS-over-HTTPS one.  If empty, the requests aren't
+	// redirected.
+	HTTPRedirectListenAddr string `yaml:"http-redirect-addr" long:"http-redirect-addr" description:"If set, redirects the plain HTTP requests on the given address, for example :80, to the first DNS-over-HTTPS port."`
+
+	// ACMEWebroot is the directory the ACME HTTP-01 challenge responses are
+	// served from on the plain HTTP listener.
+	ACMEWebroot string `yaml:"acme-webroot" long:"acme-webroot" description:"If set, serves the files from the given directory at /.well-known/acme-challenge/ on the plain HTTP redirect listener instead of redirecting."`
+
+	// TraceID, if true, makes the proxy assign a trace ID to each request,
+	// which is included into the query log, the traces, and the dnstap
+	// messages.
+	TraceID bool `yaml:"trace-id" long:"trace-id" description:"If present, assigns a trace ID to each request, or uses the one received in the EDNS option from the client, and includes it into the query log, traces, and dnstap messages." optional:"yes" optional-value:"true"`
+
+	// TraceIDForward, if true, makes the trace IDs sent to the upstreams.
+	TraceIDForward bool `yaml:"trace-id-forward" long:"trace-id-forward" description:"If present, sends the trace ID to the upstreams in the EDNS option, so that the cooperating dnsproxy instances use the same one. Implies --trace-id." optional:"yes" optional-value:"true"`
+
+	// TraceIDOptionCode is the code of the EDNS option carrying the trace ID.
+	TraceIDOptionCode uint16 `yaml:"trace-id-option-code" long:"trace-id-option-code" description:"The code of the EDNS option carrying the trace ID, within the local range of 65001 to 65534." default:"65301"`
+
+	// OTLPTracesURL is the URL of the OpenTelemetry collector to export the
+	// traces of the request processing to.  If empty, the tracing is disabled.
+	OTLPTracesURL string `yaml:"otlp-traces-url" long:"otlp-traces-url" description:"If set, exports the traces of DNS requests processing to the given OTLP/HTTP endpoint, for example http://localhost:4318/v1/traces."`
+
+	// DnstapAddr is the address of the dnstap collector to write the DNS
+	// messages to.  It's either a TCP address with port or a unix socket path
+	// prefixed with "unix:".  If empty, the dnstap is disabled.
+	DnstapAddr string `yaml:"dnstap-addr" long:"dnstap-addr" description:"If set, writes the DNS messages in dnstap format to the given TCP address or unix socket, for example 127.0.0.1:6000 or unix:/var/run/dnstap.sock."`
+
+	// DnstapIdentity is the server identity included into the dnstap messages.
+	// If empty, the hostname is used.
+	DnstapIdentity string `yaml:"dnstap-identity" long:"dnstap-identity" description:"The server identity included into the dnstap messages. Hostname is used if not set."`
+
+	// DnstapBufferSize is the number of dnstap messages buffered while the
+	// collector is slow or unavailable.
+	DnstapBufferSize int `yaml:"dnstap-buffer-size" long:"dnstap-buffer-size" description:"The number of dnstap messages buffered while the collector is unavailable. Messages exceeding it are dropped." default:"1024"`
+
+	// QueryLogFile is the path to the file to write the query log to.  If
+	// empty, the query log is disabled.
+	QueryLogFile string `yaml:"querylog-file" long:"querylog-file" description:"If set, writes the processed DNS requests as JSON lines to the given file."`
+
+	// QueryLogRotationInterval is the interval to rotate the query log file at.
+	// If zero, the file is only rotated by size.
+	QueryLogRotationInterval timeutil.Duration `yaml:"querylog-interval" long:"querylog-interval" description:"Rotate the query log file at this interval in a human-readable form, for example 24h. Only rotated by size if not set."`
+
+	// QueryLogMaxSize is the maximum size of the query log file in megabytes
+	// before it gets rotated.
+	QueryLogMaxSize int `yaml:"querylog-max-size" long:"querylog-max-size" description:"Maximum size of the query log file in megabytes before it gets rotated." default:"100"`
+
+	// QueryLogMaxBackups is the maximum number of rotated query log files to
+	// retain.  If zero, all of them are retained.
+	QueryLogMaxBackups int `yaml:"querylog-max-backups" long:"querylog-max-backups" description:"Maximum number of rotated query log files to retain. All are retained if not set."`
+
+	// QueryLogMaxAge is the maximum number of days to retain the rotated query
+	// log files for.  If zero, the files aren't removed based on age.
+	QueryLogMaxAge int `yaml:"querylog-max-age" long:"querylog-max-age" description:"Maximum number of days to retain the rotated query log files for. Not removed based on age if not set."`
+
+	// QueryLogCompress defines if the rotated query log files should be
+	// compressed.
+	QueryLogCompress bool `yaml:"querylog-compress" long:"querylog-compress" description:"If present, the rotated query log files are compressed using gzip." optional:"yes" optional-value:"true"`
+
+	// ClickHouseDSN is the URL of the ClickHouse HTTP interface to insert the
+	// query log records into.  If empty, the records aren't inserted.
+	ClickHouseDSN string `yaml:"clickhouse-dsn" long:"clickhouse-dsn" description:"If set, inserts the processed DNS requests into ClickHouse using its HTTP interface URL, for example http://localhost:8123."`
+
+	// ClickHouseTable is the name of the ClickHouse table to insert the query
+	// log records into.
+	ClickHouseTable string `yaml:"clickhouse-table" long:"clickhouse-table" description:"The ClickHouse table to insert the processed DNS requests into." default:"querylog"`
+
+	// ClickHouseBatchSize is the number of query log records inserted into
+	// ClickHouse at once.
+	ClickHouseBatchSize int `yaml:"clickhouse-batch-size" long:"clickhouse-batch-size" description:"The number of records inserted into ClickHouse at once." default:"1000"`
+
+	// ClickHouseFlushInterval is the maximum time the query log records are
+	// kept before being inserted into ClickHouse.
+	ClickHouseFlushInterval timeutil.Duration `yaml:"clickhouse-flush-interval" long:"clickhouse-flush-interval" description:"The maximum time the records are kept before being inserted into ClickHouse in a human-readable form." default:"5s"`
+
+	// QueryLogFilters are the conditions the requests written to the query log
+	// sinks must match, in the kind:value form.
+	QueryLogFilters []string `yaml:"querylog-filter" long:"querylog-filter" description:"Only writes the requests matching the condition to the query log file and ClickHouse, for example rcode:NXDOMAIN, client:192.168.1.0/24, or domain:example.org. The conditions of the same kind are alternatives. Can be specified multiple times."`
+
+	// QueryLogSampleRate is the number of the matching requests per one
+	// written to the query log sinks.
+	QueryLogSampleRate uint64 `yaml:"querylog-sample-rate" long:"querylog-sample-rate" description:"If greater than one, only writes one of each this number of the matching requests to the query log file and ClickHouse."`
+
+	// Syslog, if true, sends the significant events to syslog.
+	Syslog bool `yaml:"syslog" long:"syslog" description:"If present, sends the significant events, like upstreams going down and up, to syslog." optional:"yes" optional-value:"true"`
+
+	// SyslogAddr is the URL of the remote syslog server.  If empty, the local
+	// syslog server is used.
+	SyslogAddr string `yaml:"syslog-addr" long:"syslog-addr" description:"The remote syslog server, for example udp://192.168.1.1:514. Local syslog is used if not set."`
+
+	// SyslogFacility is the facility of the syslog messages.
+	SyslogFacility string `yaml:"syslog-facility" long:"syslog-facility" description:"The facility of the syslog messages, for example local0." default:"daemon"`
+
+	// SyslogSeverities overrides the severities of the syslog messages by
+	// event, in the event:severity form.
+	SyslogSeverities []string `yaml:"syslog-severity" long:"syslog-severity" description:"Overrides the severity of the syslog messages of an event, for example upstream_down:err. Can be specified multiple times."`
+
+	// SyslogQueries, if true, sends the query logs to syslog as well.
+	SyslogQueries bool `yaml:"syslog-queries" long:"syslog-queries" description:"If present, sends the processed DNS requests to syslog as well." optional:"yes" optional-value:"true"`
+
+	// CaptureFile is the path to the file to write the matching DNS
+	// transactions to for debugging.  If empty, the transactions aren't
+	// captured.
+	CaptureFile string `yaml:"capture-file" long:"capture-file" description:"If set, writes the matching client and upstream DNS transactions to the given file for debugging."`
+
+	// CaptureFormat is the format of the capture file.
+	CaptureFormat string `yaml:"capture-format" long:"capture-format" description:"The format of the capture file: pcap or hex." default:"pcap"`
+
+	// CaptureDomains are the suffixes of the question names of the DNS
+	// transactions to capture.
+	CaptureDomains []string `yaml:"capture-domain" long:"capture-domain" description:"Only capture the transactions for the given domain and its subdomains. Can be specified multiple times."`
+
+	// CaptureClients are the addresses or subnets of the clients of the DNS
+	// transactions to capture.
+	CaptureClients []string `yaml:"capture-client" long:"capture-client" description:"Only capture the transactions of the clients from the given address or subnet. Can be specified multiple times."`
+
+	// MirrorUpstream is the upstream to send the copies of the client requests
+	// to.  Its responses are discarded.
+	MirrorUpstream string `yaml:"mirror-upstream" long:"mirror-upstream" description:"If set, asynchronously sends the copies of the client requests to the given upstream discarding its responses, for example to load-test it."`
+
+	// MirrorPercentage is the percentage of the client requests to send to the
+	// mirror upstream.
+	MirrorPercentage uint `yaml:"mirror-percentage" long:"mirror-percentage" description:"The percentage of the client requests sent to the mirror upstream, from 0 to 100." default:"100"`
+
+	// CompareUpstreams are the upstreams to compare the responses of the
+	// general upstreams with.
+	CompareUpstreams []string `yaml:"compare-upstream" long:"compare-upstream" description:"If set, also resolves the client requests with the given upstreams and logs the differences between their responses and the ones of the general upstreams. Can be specified multiple times."`
+
+	// ErrorReporting enables sending the DNS error reports.
+	ErrorReporting bool `yaml:"error-reporting" long:"error-reporting" description:"If present, reports the extended DNS errors of the upstream responses to the reporting agents signaled by the upstreams, see RFC 9567." optional:"yes" optional-value:"true"`
+
+	// ErrorReportingAgent is the domain of the DNS error reporting agent the
+	// proxy acts as.
+	ErrorReportingAgent string `yaml:"error-reporting-agent" long:"error-reporting-agent" description:"If set, acts as the DNS error reporting agent for the given domain, advertising it to the clients and logging the received reports."`
+
+	// ResolverInfo enables answering the RESINFO requests and serving the
+	// resolver information over HTTPS.
+	ResolverInfo bool `yaml:"resolver-info" long:"resolver-info" description:"If present, answers the RESINFO requests for resolver.arpa and the TLS server name, see RFC 9606, and serves the resolver information as JSON at /.well-known/dns-query on the DNS-over-HTTPS listeners." optional:"yes" optional-value:"true"`
+
+	// ResolverInfoURL is the URL of the web page about the resolver.
+	ResolverInfoURL string `yaml:"resolver-info-url" long:"resolver-info-url" description:"HTTPS URL of the web page about the resolver reported in the resolver information."`
+
+	// ResolverInfoExtendedErrors are the codes of the extended DNS errors the
+	// resolver may return.
+	ResolverInfoExtendedErrors []uint16 `yaml:"resolver-info-exterr" long:"resolver-info-exterr" description:"Code of the extended DNS error the resolver may return reported in the resolver information. Can be specified multiple times."`
+
+	// ResolverInfoQNAMEMinimization reports that the resolver minimizes the
+	// query names.
+	ResolverInfoQNAMEMinimization bool `yaml:"resolver-info-qnamemin" long:"resolver-info-qnamemin" description:"If present, reports that the resolver minimizes the query names in the resolver information." optional:"yes" optional-value:"true"`
+
+	// ResolverInfoFiltering reports that the resolver filters the responses.
+	ResolverInfoFiltering bool `yaml:"resolver-info-filtering" long:"resolver-info-filtering" description:"If present, reports that the resolver filters the responses in the resolver information served over HTTPS." optional:"yes" optional-value:"true"`
+
+	// ResolverInfoDNSSEC reports that the resolver validates DNSSEC.
+	ResolverInfoDNSSEC bool `yaml:"resolver-info-dnssec" long:"resolver-info-dnssec" description:"If present, reports that the resolver validates DNSSEC in the resolver information served over HTTPS." optional:"yes" optional-value:"true"`
+
+	// AnomalyNXDomainRatio is the ratio of the NXDOMAIN responses to a client,
+	// exceeding which makes it anomalous.
+	AnomalyNXDomainRatio float64 `yaml:"anomaly-nxdomain-ratio" long:"anomaly-nxdomain-ratio" description:"If set, the clients the requests of which are answered with NXDOMAIN more often than this ratio from 0 to 1 are reported as anomalous, for example running DGA malware or enumerating subdomains."`
+
+	// AnomalyEntropy is the mean entropy of the leftmost labels of the names
+	// requested by a client, exceeding which makes it anomalous.
+	AnomalyEntropy float64 `yaml:"anomaly-entropy" long:"anomaly-entropy" description:"If set, the clients requesting the names with the leftmost labels looking random, with the mean Shannon entropy in bits per character exceeding this value, are reported as anomalous. Values around 3.5 are reasonable."`
+
+	// AnomalyMinRequests is the number of the requests from a client within
+	// the window required to consider it anomalous.
+	AnomalyMinRequests uint `yaml:"anomaly-min-requests" long:"anomaly-min-requests" description:"The number of the requests from a client within --anomaly-window required to report it as anomalous." default:"50"`
+
+	// AnomalyMaxClients is the maximum number of the clients the statistics
+	// are collected for at once.
+	AnomalyMaxClients uint `yaml:"anomaly-max-clients" long:"anomaly-max-clients" description:"The maximum number of the clients the statistics are collected for at once for the anomaly detection." default:"10000"`
+
+	// AnomalyWindow is the duration the statistics of each client are
+	// collected over.
+	AnomalyWindow timeutil.Duration `yaml:"anomaly-window" long:"anomaly-window" description:"The time the statistics of each client are collected over for the anomaly detection in a human-readable form." default:"1m"`
+
+	// AnomalyThrottle is the duration the requests from an anomalous client
+	// are refused for.
+	AnomalyThrottle timeutil.Duration `yaml:"anomaly-throttle" long:"anomaly-throttle" description:"If set, the requests from the anomalous clients are refused for this time in a human-readable form."`
+
+	// AnomalyWebhook is the URL the detected anomalies are posted to.
+	AnomalyWebhook string `yaml:"anomaly-webhook" long:"anomaly-webhook" description:"If set, the detected anomalous clients are posted to this HTTP or HTTPS URL as JSON objects."`
+
+	// StartupGating defines how the requests are handled until the upstreams
+	// are verified on startup.
+	StartupGating string `yaml:"startup-gating" long:"startup-gating" description:"If set, verifies the upstreams on startup and either delays binding the listeners until an upstream answers, if set to delay, or answers SERVFAIL with the Not Ready extended error until then, if set to servfail."`
+
+	// UpstreamVerification is the policy of the verification of each upstream
+	// on startup.
+	UpstreamVerification string `yaml:"upstream-verification" long:"upstream-verification" description:"If set, sends a probe query to each upstream on startup and either refuses to start if any of them fails, if set to fail, only logs the failures, if set to warn, or removes the failing upstreams, if set to disable."`
+
+	// FaultInjection enables the injection of the artificial faults for
+	// testing.
+	FaultInjection bool `yaml:"fault-injection" long:"fault-injection" description:"If present, enables the injection of the artificial faults for testing the clients and the monitoring. Never use it in production." optional:"yes" optional-value:"true"`
+
+	// FaultSide is the side to inject the faults on, either "listener" or
+	// "upstream".
+	FaultSide string `yaml:"fault-side" long:"fault-side" description:"Where to inject the faults, either listener or upstream." default:"listener"`
+
+	// FaultLatency is the artificial delay added to each request.
+	FaultLatency timeutil.Duration `yaml:"fault-latency" long:"fault-latency" description:"The artificial delay added to each request in a human-readable form."`
+
+	// FaultServFailPercentage is the percentage of the requests answered with
+	// SERVFAIL.
+	FaultServFailPercentage uint `yaml:"fault-servfail-percentage" long:"fault-servfail-percentage" description:"The percentage of the requests answered with SERVFAIL, from 0 to 100."`
+
+	// FaultDropPercentage is the percentage of the requests dropped.
+	FaultDropPercentage uint `yaml:"fault-drop-percentage" long:"fault-drop-percentage" description:"The percentage of the requests dropped, from 0 to 100."`
+
+	// PolicyAddr is the address of the external policy service asked for a
+	// decision about each query.
+	PolicyAddr string `yaml:"policy-addr" long:"policy-addr" description:"If set, asks the external gRPC policy service at this address to allow, deny, rewrite, or redirect each query, see internal/policy/policy.proto."`
+
+	// PolicyTimeout is the timeout of a single policy check.
+	PolicyTimeout timeutil.Duration `yaml:"policy-timeout" long:"policy-timeout" description:"Timeout of a single policy check in a human-readable form." default:"1s"`
+
+	// PolicyFailClosed makes the queries answered with SERVFAIL if the policy
+	// service fails.
+	PolicyFailClosed bool `yaml:"policy-fail-closed" long:"policy-fail-closed" description:"If present, answers the queries with SERVFAIL when the policy service fails or times out, instead of resolving them as usual." optional:"yes" optional-value:"true"`
+
+	// PolicyTLS enables TLS for the connection to the policy service.
+	PolicyTLS bool `yaml:"policy-tls" long:"policy-tls" description:"If present, connects to the policy service over TLS." optional:"yes" optional-value:"true"`
+
+	// Plugins are the commands of the external programs asked for a verdict
+	// about each query.
+	Plugins []string `yaml:"plugin" long:"plugin" description:"Command line of an external program asked for a verdict about each query over its standard input and output. Can be specified multiple times."`
+
+	// PluginWorkers is the number of the processes of each plugin.
+	PluginWorkers int `yaml:"plugin-workers" long:"plugin-workers" description:"Number of the processes of each plugin handling the queries concurrently." default:"4"`
+
+	// PluginTimeout is the timeout of a single exchange with a plugin.
+	PluginTimeout timeutil.Duration `yaml:"plugin-timeout" long:"plugin-timeout" description:"Timeout of a single exchange with a plugin in a human-readable form." default:"1s"`
+
+	// PluginCacheSize is the maximum number of the cached verdicts of each
+	// plugin.
+	PluginCacheSize int `yaml:"plugin-cache-size" long:"plugin-cache-size" description:"Maximum number of the cached verdicts of each plugin." default:"1000"`
+
+	// ScriptPath is the path to the Lua script run for each query.
+	ScriptPath string `yaml:"script" long:"script" description:"Path to the Lua script defining the before and after functions called for each query before resolving it and after receiving the response."`
+
+	// ScriptTimeout is the maximum duration of a single call of a script
+	// function.
+	ScriptTimeout timeutil.Duration `yaml:"script-timeout" long:"script-timeout" description:"Maximum duration of a single call of a script function in a human-readable form." default:"50ms"`
+
+	// ScriptMaxMemory is the approximate maximum number of bytes allocated
+	// during a single call of a script function.
+	ScriptMaxMemory uint64 `yaml:"script-max-memory" long:"script-max-memory" description:"Approximate maximum number of bytes allocated during a single call of a script function." default:"67108864"`
+
+	// ShutdownTimeout is the maximum duration of waiting for the queries being
+	// handled to be answered on shutdown.
+	ShutdownTimeout timeutil.Duration `yaml:"shutdown-timeout" long:"shutdown-timeout" description:"Maximum time to wait for the queries being handled to be answered on shutdown in a human-readable form." default:"10s"`
+
+	// Profiles are the listener profiles, which override the general settings
+	// for the queries received on their listen addresses.  These can only be
+	// set in the configuration file.
+	Profiles []*profileOptions `yaml:"profiles"`
+
+	// ClientRoutes is the client routing table, which makes the queries from
+	// particular client subnets resolved with separate upstreams.  These can
+	// only be set in the configuration file.
+	ClientRoutes []*clientRouteOptions `yaml:"client-routes"`
+
+	// GeoIPDatabases are the paths to the MaxMind DB files the countries and
+	// the autonomous systems of the clients are looked up in.
+	GeoIPDatabases []string `yaml:"geoip-db" long:"geoip-db" description:"Path to the MaxMind DB file, such as GeoLite2-Country or GeoLite2-ASN, to look up the countries and the autonomous systems of the clients in. Can be specified multiple times."`
+
+	// PIDFile is the path to the file to write the process identifier into.
+	PIDFile string `yaml:"pidfile" long:"pidfile" description:"Path to the file to write the process identifier into once the proxy is serving. The file is removed on exit."`
+
+	// Daemon, if true, makes the process run in the background.
+	Daemon bool `yaml:"daemon" long:"daemon" description:"If present, runs in the background and returns once the proxy is serving. Unix only." optional:"yes" optional-value:"true"`
+
+	// Service is the action to perform with the Windows service: install or
+	// uninstall.
+	Service string `long:"service" description:"Windows only: install or uninstall dnsproxy as a Windows service started with the other given options"`
+
+	// AnonymizeClientIP defines how the client addresses are anonymized in the
+	// log and the query log output.
+	AnonymizeClientIP string `yaml:"anonymize-client-ip" long:"anonymize-client-ip" description:"If set, anonymizes the client addresses in the log and query log output: truncate cuts them to /24 and /56, hash replaces them with keyed hashes."`
+
+	// PrivacyMode strips the client-identifying data from everything leaving
+	// the proxy.
+	PrivacyMode bool `yaml:"privacy-mode" long:"privacy-mode" description:"If present, strips the client-identifying data from everything leaving the proxy: doesn't send EDNS Client Subnet to the upstreams, anonymizes the client addresses in the log, query log, and dnstap output, with truncate unless --anonymize-client-ip is set, and removes them from the extended DNS error texts." optional:"yes" optional-value:"true"`
+
 	// Version, if true, prints the program version, and exits.
 	Version bool `yaml:"version" long:"version" description:"Prints the program version"`
 
+	// CheckConfig, if true, validates the configuration, probes each upstream,
+	// and exits.
+	CheckConfig bool `yaml:"check-config" long:"check-config" description:"Validates the configuration, sends a probe query to each upstream, and exits with a non-zero code on problems"`
+
+	// DumpConfigJSON, if true, prints the effective configuration as JSON, and
+	// exits.
+	DumpConfigJSON bool `yaml:"dump-config-json" long:"dump-config-json" description:"Prints the fully resolved effective configuration as JSON, and exits"`
+
 	// Verbose controls the verbosity of the output.
 	Verbose bool `yaml:"verbose" short:"v" long:"verbose" description:"Verbose output (optional)" optional:"yes" optional-value:"true"`
 
+	// LogLevels overrides the logging levels of the proxy subsystems, in the
+	// subsystem:level form.
+	LogLevels []string `yaml:"log-level" long:"log-level" description:"Overrides the logging level of a subsystem: server, cache, upstream, or ratelimit, for example cache:debug. Can be specified multiple times."`
+
 	// Insecure disables upstream servers TLS certificate verification.
 	Insecure bool `yaml:"insecure" long:"insecure" description:"Disable secure TLS certificate validation" optional:"yes" optional-value:"false"`
 
@@ -171,6 +940,27 @@ type Options struct {
 	// It enables HTTP/3 support for both the DoH upstreams and the DoH server.
 	HTTP3 bool `yaml:"http3" long:"http3" description:"Enable HTTP/3 support" optional:"yes" optional-value:"false"`
 
+	// QUICRetryThreshold is the number of the connection attempts from the
+	// unvalidated addresses per second, exceeding which the QUIC listeners
+	// require the address validation.
+	QUICRetryThreshold uint `yaml:"quic-retry-threshold" long:"quic-retry-threshold" description:"If set, the DNS-over-QUIC and HTTP/3 listeners only validate the client addresses with Retry packets when the connection attempts from the unvalidated addresses exceed this number per second."`
+
+	// QUICRetryTokenLifetime is the time the validated addresses aren't
+	// validated again for.
+	QUICRetryTokenLifetime timeutil.Duration `yaml:"quic-retry-token-lifetime" long:"quic-retry-token-lifetime" description:"If set, the time the client addresses validated by the DNS-over-QUIC and HTTP/3 listeners aren't validated again for, in a human-readable form."`
+
+	// EncryptedMaxConnsPerIP is the maximum number of the connections from a
+	// single client address to all the encrypted listeners.
+	EncryptedMaxConnsPerIP uint `yaml:"encrypted-max-conns-per-ip" long:"encrypted-max-conns-per-ip" description:"If set, the maximum number of the simultaneous DNS-over-TLS, DNS-over-HTTPS, and DNS-over-QUIC connections from a single client address. The connections exceeding it are closed."`
+
+	// EncryptedHandshakeRate is the maximum number of the new connections to
+	// all the encrypted listeners per second.
+	EncryptedHandshakeRate uint `yaml:"encrypted-handshake-rate" long:"encrypted-handshake-rate" description:"If set, the maximum number of the new DNS-over-TLS, DNS-over-HTTPS, and DNS-over-QUIC connections per second. The connections exceeding it are closed before the handshake."`
+
+	// EncryptedHandshakeBurst is the maximum number of the new connections to
+	// all the encrypted listeners allowed at once.
+	EncryptedHandshakeBurst uint `yaml:"encrypted-handshake-burst" long:"encrypted-handshake-burst" description:"The maximum number of the new connections allowed at once by --encrypted-handshake-rate. If not set, it's equal to the rate."`
+
 	// AllServers makes server to query all configured upstream servers in
 	// parallel.
 	AllServers bool `yaml:"all-servers" long:"all-servers" description:"If specified, parallel queries to all configured upstream servers are enabled" optional:"yes" optional-value:"true"`
@@ -180,11 +970,58 @@ type Options struct {
 	// or TCP connection time.
 	FastestAddress bool `yaml:"fastest-addr" long:"fastest-addr" description:"Respond to A or AAAA requests only with the fastest IP address" optional:"yes" optional-value:"true"`
 
+	// FastestAddressICMP makes the addresses also pinged with ICMP to detect
+	// the fastest one.
+	FastestAddressICMP bool `yaml:"fastest-addr-icmp" long:"fastest-addr-icmp" description:"If specified, --fastest-addr also pings the addresses with ICMP in addition to connecting to their TCP ports 80 and 443. Requires unprivileged ICMP sockets or the capability to open raw sockets" optional:"yes" optional-value:"true"`
+
+	// FastestAddressCacheFile is the path to the file the ping results of the
+	// fastest address detection are persisted to.
+	FastestAddressCacheFile string `yaml:"fastest-addr-cache-file" long:"fastest-addr-cache-file" description:"Path to the file the ping results of --fastest-addr are saved to on shutdown and restored from on startup"`
+
+	// FastestAddressPingPorts are the TCP ports dialed to detect the fastest
+	// address.
+	FastestAddressPingPorts []uint `yaml:"fastest-addr-ping-port" long:"fastest-addr-ping-port" description:"TCP port connected to by --fastest-addr to ping the addresses instead of 80 and 443. Can be specified multiple times."`
+
+	// FastestAddressMaxPings is the maximum number of the concurrent pings for
+	// a single request.
+	FastestAddressMaxPings uint `yaml:"fastest-addr-max-pings" long:"fastest-addr-max-pings" description:"The maximum number of the pings made at once by --fastest-addr for a single request. A zero value will disable the limit."`
+
+	// FastestAddressTimeout is the timeout for waiting the ping results.
+	FastestAddressTimeout timeutil.Duration `yaml:"fastest-addr-timeout" long:"fastest-addr-timeout" description:"The timeout for waiting the ping results of --fastest-addr in a human-readable form. A zero value will use the default of 1s."`
+
+	// FastestAddressFasterWait is the period of time to wait for a faster ping
+	// result after the first successful one.
+	FastestAddressFasterWait timeutil.Duration `yaml:"fastest-addr-faster-wait" long:"fastest-addr-faster-wait" description:"The period of time --fastest-addr keeps waiting for a faster ping result after the first successful one in a human-readable form. A zero value will use the first one."`
+
+	// FastestAddressIPv6Preference is the latency advantage given to the IPv6
+	// addresses.
+	FastestAddressIPv6Preference timeutil.Duration `yaml:"fastest-addr-ipv6-preference" long:"fastest-addr-ipv6-preference" description:"The latency advantage --fastest-addr gives to the IPv6 addresses over the IPv4 ones in a human-readable form, so that IPv6 is preferred unless IPv4 is faster by more than that."`
+
 	// CacheOptimistic, if set to true, enables the optimistic DNS cache. That
 	// means that cached results will be served even if their cache TTL has
 	// already expired.
 	CacheOptimistic bool `yaml:"cache-optimistic" long:"cache-optimistic" description:"If specified, optimistic DNS cache is enabled" optional:"yes" optional-value:"true"`
 
+	// CacheAggressiveNSEC, if set to true, makes the proxy synthesize the
+	// negative responses from the cached NSEC and NSEC3 records.
+	CacheAggressiveNSEC bool `yaml:"cache-aggressive-nsec" long:"cache-aggressive-nsec" description:"If specified, NXDOMAIN and NODATA responses are synthesized from the cached NSEC and NSEC3 records of the validated responses, see RFC 8198. Requires --trust-upstream-ad" optional:"yes" optional-value:"true"`
+
+	// TrustUpstreamAD, if set to true, makes the proxy rely on the AD flag of
+	// the upstream responses.
+	TrustUpstreamAD bool `yaml:"trust-upstream-ad" long:"trust-upstream-ad" description:"If specified, the upstreams are trusted to validate DNSSEC, so the AD flag of their responses is relied on" optional:"yes" optional-value:"true"`
+
+	// CacheOnly makes the proxy start in the cache-only mode, answering the
+	// requests from the cache only and never using the upstreams.
+	CacheOnly bool `yaml:"cache-only" long:"cache-only" description:"If specified, the requests are only answered from the cache, including the expired responses, and never sent to the upstreams. The mode can be changed at runtime with the admin API" optional:"yes" optional-value:"true"`
+
+	// NetworkChangeFlushCache makes the proxy clear the cache when the network
+	// interfaces, their addresses, or the routes change.
+	NetworkChangeFlushCache bool `yaml:"network-change-flush-cache" long:"network-change-flush-cache" description:"If specified, the cache is cleared when the network interfaces, their addresses, or the routes change" optional:"yes" optional-value:"true"`
+
+	// NetworkChangeResetUpstreams makes the proxy recreate the upstreams when
+	// the network interfaces, their addresses, or the routes change.
+	NetworkChangeResetUpstreams bool `yaml:"network-change-reset-upstreams" long:"network-change-reset-upstreams" description:"If specified, the upstream connections are closed and the upstream addresses are resolved with the bootstrap again when the network interfaces, their addresses, or the routes change" optional:"yes" optional-value:"true"`
+
 	// Cache controls whether DNS responses are cached or not.
 	Cache bool `yaml:"cache" long:"cache" description:"If specified, DNS cache is enabled" optional:"yes" optional-value:"true"`
 
@@ -197,6 +1034,19 @@ type Options struct {
 	// DNS64 defines whether DNS64 functionality is enabled or not.
 	DNS64 bool `yaml:"dns64" long:"dns64" description:"If specified, dnsproxy will act as a DNS64 server" optional:"yes" optional-value:"true"`
 
+	// DNS64Discovery defines whether the NAT64 prefixes are discovered by
+	// resolving ipv4only.arpa with the upstreams.
+	DNS64Discovery bool `yaml:"dns64-discovery" long:"dns64-discovery" description:"If specified, the DNS64 prefixes are discovered by resolving ipv4only.arpa with the upstreams and rechecked periodically. The --dns64-prefix ones are only used until the discovery succeeds." optional:"yes" optional-value:"true"`
+
+	// DNS64Synthesis defines which of the DNS64 prefixes are used to
+	// synthesize the AAAA records.
+	DNS64Synthesis string `yaml:"dns64-synthesis" long:"dns64-synthesis" description:"Which of the DNS64 prefixes are used for synthesis: first, all, or round_robin, which is like all but rotates the prefixes with each response." default:"first"`
+
+	// DNS64ReverseSynthesis defines whether the PTR requests for the addresses
+	// within the DNS64 prefixes are answered using the PTR of the embedded
+	// IPv4 address.
+	DNS64ReverseSynthesis bool `yaml:"dns64-reverse-synthesis" long:"dns64-reverse-synthesis" description:"If specified, PTR requests for the addresses within the DNS64 prefixes are answered with a CNAME to the in-addr.arpa name of the embedded IPv4 address and its PTR resolved, instead of being routed to the private upstreams." optional:"yes" optional-value:"true"`
+
 	// UsePrivateRDNS makes the server to use private upstreams for reverse DNS
 	// lookups of private addresses, including the requests for authority
 	// records, such as SOA and NS.
@@ -205,10 +1055,25 @@ type Options struct {
 
 const (
 	defaultLocalTimeout = 1 * time.Second
+
+	// defaultShutdownTimeout is the default maximum duration of waiting for
+	// the queries being handled on shutdown.
+	defaultShutdownTimeout = 10 * time.Second
 )
 
 func main() {
-	options := &Options{}
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case queryCommand:
+			os.Exit(runQuery(os.Args[2:]))
+		case benchCommand:
+			os.Exit(runBench(os.Args[2:]))
+		case stampsCommand:
+			os.Exit(runStamps(os.Args[2:]))
+		default:
+			// Go on.
+		}
+	}
 
 	for _, arg := range os.Args {
 		if arg == "--version" {
@@ -216,65 +1081,184 @@ func main() {
 
 			os.Exit(0)
 		}
+	}
 
-		// TODO(e.burkov, a.garipov):  Use flag package and remove the manual
-		// options parsing.
-		//
-		// See https://github.com/AdguardTeam/dnsproxy/issues/182.
-		if len(arg) > 13 {
-			if arg[:13] == "--config-path" {
-				fmt.Printf("Path: %s\n", arg[14:])
-				b, err := os.ReadFile(arg[14:])
-				if err != nil {
-					log.Fatalf("failed to read the config file %s: %v", arg[14:], err)
-				}
-				err = yaml.Unmarshal(b, options)
-				if err != nil {
-					log.Fatalf("failed to unmarshal the config file %s: %v", arg[14:], err)
-				}
-			}
-		}
+	prepareService()
+
+	if path := configPath(os.Args[1:]); path != "" {
+		fmt.Printf("Path: %s\n", path)
 	}
 
-	parser := goFlags.NewParser(options, goFlags.Default)
-	_, err := parser.Parse()
+	options, err := parseOptions(os.Args[1:], goFlags.Default)
 	if err != nil {
 		if flagsErr, ok := err.(*goFlags.Error); ok && flagsErr.Type == goFlags.ErrHelp {
 			os.Exit(0)
+		} else if !ok {
+			fatal(slog.Default(), "failed to load the config file", slogutil.KeyError, err)
 		}
 
 		os.Exit(1)
 	}
 
+	if options.Service != "" {
+		controlService(options, os.Args[1:])
+	}
+
+	if runService(options) {
+		return
+	}
+
+	daemonize(options)
+
 	run(options)
 }
 
-func run(options *Options) {
-	if options.Verbose {
-		log.SetLevel(log.DEBUG)
+// configPath returns the path of the configuration file from the
+// --config-path argument, if any.
+//
+// TODO(e.burkov, a.garipov):  Use flag package and remove the manual options
+// parsing.
+//
+// See https://github.com/AdguardTeam/dnsproxy/issues/182.
+func configPath(args []string) (path string) {
+	for _, arg := range args {
+		if len(arg) > 13 && arg[:13] == "--config-path" {
+			path = arg[14:]
+		}
 	}
-	if options.LogOutput != "" {
-		// #nosec G302 -- Trust the file path that is given in the
-		// configuration.
-		file, err := os.OpenFile(options.LogOutput, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+
+	return path
+}
+
+// parseOptions returns the options from the configuration file from args, if
+// any, overridden by the command-line arguments args.  flags are the options of
+// the command-line parser.
+func parseOptions(args []string, flags goFlags.Options) (options *Options, err error) {
+	options, _, err = parseArgs(args, flags, "", nil)
+
+	return options, err
+}
+
+// parseArgs is like [parseOptions] but also returns the remaining positional
+// arguments.  usage, if not empty, replaces the usage line of the help message.
+// extra, if not nil, is the pointer to the struct with the additional options
+// of a subcommand, which are parsed along with the common ones.
+func parseArgs(
+	args []string,
+	flags goFlags.Options,
+	usage string,
+	extra any,
+) (options *Options, rest []string, err error) {
+	options = &Options{}
+
+	if path := configPath(args); path != "" {
+		err = loadConfigFile(options, path, 0)
 		if err != nil {
-			log.Fatalf("cannot create a log file: %s", err)
+			return nil, nil, err
 		}
+	}
+
+	parser := goFlags.NewParser(options, flags)
+	if usage != "" {
+		parser.Usage = usage
+	}
 
-		defer func() { _ = file.Close() }()
-		log.SetOutput(file)
+	if extra != nil {
+		_, err = parser.AddGroup("Subcommand Options", "", extra)
+		if err != nil {
+			return nil, nil, fmt.Errorf("adding subcommand options: %w", err)
+		}
 	}
 
-	runPprof(options)
+	rest, err = parser.ParseArgs(args)
+	if err != nil {
+		// Don't wrap the error to keep its type.
+		return nil, nil, err
+	}
 
-	log.Info("Starting dnsproxy %s", version.Version())
+	return options, rest, nil
+}
+
+func run(options *Options) {
+	l, levels, closeOutput, reopenOutput := newLogger(options)
+	defer closeOutput()
+
+	runPprof(l, options)
+
+	l.Info("starting dnsproxy", "version", version.Version())
 
 	// Prepare the proxy server and its configuration.
-	conf := createProxyConfig(options)
+	keyLog := newKeyLogWriter(l, options)
+	sessions := loadQUICSessions(l, options.QUICSessionFile)
+	remote := initRemoteUpstreams(l, options)
+	conf := createProxyConfig(l, levels, options, remote.list(), keyLog, sessions)
+	if options.CheckConfig {
+		code := 0
+		if !checkConfig(l, conf) {
+			code = 1
+		}
+
+		closeOutput()
+		os.Exit(code)
+	}
+
+	if options.DumpConfigJSON {
+		dumpConfig(l, conf, options)
+		closeOutput()
+		os.Exit(0)
+	}
+
+	verifyUpstreams(l, conf, options.UpstreamVerification)
+
+	st := initStats(l, conf, options)
+	initMetrics(l, conf, options, st)
+	lists := initRatelimitLists(l, conf, options)
+	adminMux := initAdmin(l, conf, options)
+
+	tp := initTracing(l, conf, options)
+	tap := initDnstap(l, conf, options)
+	cpt := initCapture(l, conf, options)
+	pol := initPolicy(l, conf, options)
+	plugins := initPlugins(l, conf, options)
+	scr := initScript(l, conf, options)
+	loggers := initQueryLog(l, conf, options)
+	if sl := initSyslog(l, conf, options); sl != nil {
+		loggers = append(loggers, sl)
+	}
 
 	dnsProxy, err := proxy.New(conf)
 	if err != nil {
-		log.Fatalf("creating proxy: %s", err)
+		fatal(l, "creating proxy", slogutil.KeyError, err)
+	}
+
+	expvar.Publish("dnsproxy", dnsProxy.Stats().Var())
+
+	hc := initHealth(l, dnsProxy, conf, options)
+	initHTTPRedirect(l, options)
+
+	r := &reloader{
+		logger:   l,
+		levels:   levels,
+		proxy:    dnsProxy,
+		health:   hc,
+		keyLog:   keyLog,
+		sessions: sessions,
+		remote:   remote,
+		lists:    lists,
+		options:  options,
+		mu:       &sync.Mutex{},
+		args:     os.Args[1:],
+	}
+	startAdmin(l, adminMux, dnsProxy, levels, r, options)
+
+	mon := initNetworkMonitor(l, dnsProxy, r, options)
+
+	if remote != nil {
+		go remote.refresh(context.Background(), r.reload)
+	}
+
+	if lists != nil {
+		go lists.refresh(context.Background())
 	}
 
 	// Add extra handler if needed.
@@ -290,24 +1274,145 @@ func run(options *Options) {
 
 	err = dnsProxy.Start(ctx)
 	if err != nil {
-		log.Fatalf("cannot start the DNS proxy due to %s", err)
+		fatal(l, "cannot start the dns proxy", slogutil.KeyError, err)
 	}
 
-	signalChannel := make(chan os.Signal, 1)
-	signal.Notify(signalChannel, syscall.SIGINT, syscall.SIGTERM)
-	<-signalChannel
+	// Write the PID file before reporting the readiness, so that it already
+	// exists when the process started in the background exits.
+	writePIDFile(l, options.PIDFile)
+	defer removePIDFile(l, options.PIDFile)
+
+	reportUpgradeReady(l)
+	waitSignals(ctx, l, r, reopenOutput)
+
+	// Stop reacting to the network changes before stopping the proxy.
+	if mon != nil {
+		err = mon.Close()
+		if err != nil {
+			l.Error("closing network monitor", slogutil.KeyError, err)
+		}
+	}
 
 	// Stopping the proxy.
-	err = dnsProxy.Shutdown(ctx)
+	shutdownTimeout := cmp.Or(options.ShutdownTimeout.Duration, defaultShutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(ctx, shutdownTimeout)
+	defer cancel()
+
+	err = dnsProxy.Shutdown(shutdownCtx)
 	if err != nil {
-		log.Fatalf("cannot stop the DNS proxy due to %s", err)
+		fatal(l, "cannot stop the dns proxy", slogutil.KeyError, err)
+	}
+
+	saveQUICSessions(l, sessions, options.QUICSessionFile)
+
+	if hc != nil {
+		err = hc.Close()
+		if err != nil {
+			l.Error("closing health checker", slogutil.KeyError, err)
+		}
+	}
+
+	if tp != nil {
+		err = tp.Shutdown(ctx)
+		if err != nil {
+			l.Error("shutting down tracing", slogutil.KeyError, err)
+		}
+	}
+
+	if tap != nil {
+		err = tap.Close()
+		if err != nil {
+			l.Error("closing dnstap", slogutil.KeyError, err)
+		}
+	}
+
+	if cpt != nil {
+		err = cpt.Close()
+		if err != nil {
+			l.Error("closing capture", slogutil.KeyError, err)
+		}
+	}
+
+	if pol != nil {
+		err = pol.Close()
+		if err != nil {
+			l.Error("closing policy", slogutil.KeyError, err)
+		}
+	}
+
+	for _, pl := range plugins {
+		err = pl.Close()
+		if err != nil {
+			l.Error("closing plugin", slogutil.KeyError, err)
+		}
+	}
+
+	if scr != nil {
+		err = scr.Close()
+		if err != nil {
+			l.Error("closing script", slogutil.KeyError, err)
+		}
+	}
+
+	for _, c := range loggers {
+		err = c.Close()
+		if err != nil {
+			l.Error("closing logger", slogutil.KeyError, err)
+		}
 	}
 }
 
-// runPprof runs pprof server on localhost:6060 if it's enabled in the options.
-func runPprof(options *Options) {
-	if !options.Pprof {
-		return
+// waitSignals handles the signals until the proxy should be stopped.  SIGHUP
+// reloads the configuration, the reopening signal reopens the log file with
+// reopenOutput, and the upgrade signal starts the binary upgrade.
+func waitSignals(
+	ctx context.Context,
+	l *slog.Logger,
+	r *reloader,
+	reopenOutput func() (err error),
+) {
+	signalChannel := make(chan os.Signal, 1)
+	signal.Notify(signalChannel, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	notifyUpgrade(signalChannel)
+	notifyService(signalChannel)
+	notifyReopen(signalChannel)
+
+	for sig := range signalChannel {
+		switch {
+		case sig == syscall.SIGHUP:
+			r.reloadLogged(ctx)
+		case isReopenSignal(sig):
+			err := reopenOutput()
+			if err != nil {
+				l.ErrorContext(ctx, "reopening log output", slogutil.KeyError, err)
+			} else {
+				l.InfoContext(ctx, "reopened log output")
+			}
+		case isUpgradeSignal(sig):
+			if upgradeBinary(ctx, l) {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+// defaultPprofAddr is the address of the pprof server used if it's enabled
+// without setting an address.
+const defaultPprofAddr = "localhost:6060"
+
+// runPprof runs the pprof server if it's enabled in the options.  Besides the
+// pprof handlers, it serves the expvar variables at /debug/vars and the stack
+// traces of all goroutines at /debug/goroutines.
+func runPprof(l *slog.Logger, options *Options) {
+	addr := options.PprofListenAddr
+	if addr == "" {
+		if !options.Pprof {
+			return
+		}
+
+		addr = defaultPprofAddr
 	}
 
 	mux := http.NewServeMux()
@@ -322,33 +1427,68 @@ func runPprof(options *Options) {
 	mux.Handle("/debug/pprof/heap", pprof.Handler("heap"))
 	mux.Handle("/debug/pprof/mutex", pprof.Handler("mutex"))
 	mux.Handle("/debug/pprof/threadcreate", pprof.Handler("threadcreate"))
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/debug/goroutines", serveGoroutines)
 
 	go func() {
-		log.Info("pprof: listening on localhost:6060")
+		l.Info("listening", slogutil.KeyPrefix, "pprof", "addr", addr)
 		srv := &http.Server{
-			Addr:        "localhost:6060",
+			Addr:        addr,
 			ReadTimeout: 60 * time.Second,
 			Handler:     mux,
 		}
-		err := srv.ListenAndServe()
-		log.Error("error while running the pprof server: %s", err)
+		err := listenAndServe(l, srv, options.ReusePort)
+		l.Error("running server", slogutil.KeyPrefix, "pprof", slogutil.KeyError, err)
 	}()
 }
 
-// createProxyConfig creates proxy.Config from the command line arguments
-func createProxyConfig(options *Options) (conf *proxy.Config) {
+// serveGoroutines writes the stack traces of all goroutines in the same format
+// the Go runtime uses when it panics.
+func serveGoroutines(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	// Ignore the error, since it's only possible if the client has gone.
+	_ = runtimepprof.Lookup("goroutine").WriteTo(w, 2)
+}
+
+// createProxyConfig creates proxy.Config from the command line arguments.  l
+// and levels are used as the logging configuration of the proxy.  remote are
+// the general upstreams from the remote list, if any.  keyLog is used to write
+// the TLS session secrets, if not nil.  sessions is the TLS session cache of
+// the DNS-over-QUIC upstreams, if not nil.
+func createProxyConfig(
+	l *slog.Logger,
+	levels *logLevels,
+	options *Options,
+	remote []string,
+	keyLog io.Writer,
+	sessions *upstream.SessionCache,
+) (conf *proxy.Config) {
 	conf = &proxy.Config{
+		Logger:              l,
+		LogLevels:           levels.proxyLevels(),
+		ClientAnonymization: proxy.ClientAnonymization(options.AnonymizeClientIP),
+		PrivacyMode:         options.PrivacyMode,
+
 		RatelimitSubnetLenIPv4: options.RatelimitSubnetLenIPv4,
 		RatelimitSubnetLenIPv6: options.RatelimitSubnetLenIPv6,
-
-		Ratelimit:       options.Ratelimit,
-		CacheEnabled:    options.Cache,
-		CacheSizeBytes:  options.CacheSizeBytes,
-		CacheMinTTL:     options.CacheMinTTL,
-		CacheMaxTTL:     options.CacheMaxTTL,
-		CacheOptimistic: options.CacheOptimistic,
-		RefuseAny:       options.RefuseAny,
-		HTTP3:           options.HTTP3,
+		RatelimitIPv6:          options.RatelimitIPv6,
+		RatelimitBurst:         options.RatelimitBurst,
+		RatelimitBurstIPv6:     options.RatelimitBurstIPv6,
+		RatelimitTruncate:      options.RatelimitTruncate,
+		RatelimitSlip:          options.RatelimitSlip,
+
+		Ratelimit:           options.Ratelimit,
+		CacheEnabled:        options.Cache,
+		CacheSizeBytes:      options.CacheSizeBytes,
+		CacheMinTTL:         options.CacheMinTTL,
+		CacheMaxTTL:         options.CacheMaxTTL,
+		CacheOptimistic:     options.CacheOptimistic,
+		CacheOnly:           options.CacheOnly,
+		CacheAggressiveNSEC: options.CacheAggressiveNSEC,
+		TrustUpstreamAD:     options.TrustUpstreamAD,
+		RefuseAny:           options.RefuseAny,
+		HTTP3:               options.HTTP3,
 		// TODO(e.burkov):  The following CIDRs are aimed to match any address.
 		// This is not quite proper approach to be used by default so think
 		// about configuring it.
@@ -358,10 +1498,29 @@ func createProxyConfig(options *Options) (conf *proxy.Config) {
 		},
 		EnableEDNSClientSubnet: options.EnableEDNSSubnet,
 		UDPBufferSize:          options.UDPBufferSize,
+		UDPSendBufferSize:      options.UDPSendBufferSize,
+		UDPSocketFilter:        options.UDPSocketFilter,
+		TCPFastOpen:            options.TCPFastOpen,
+		MultipathTCP:           options.MultipathTCP,
+		ListenSockets:          options.ListenSockets,
+		ReusePort:              options.ReusePort,
+		ListenInterface:        options.ListenInterface,
+		ListenFreeBind:         options.ListenFreeBind,
+		ListenDSCP:             options.ListenDSCP,
+		TransparentProxy:       options.TransparentProxy,
 		HTTPSServerName:        options.HTTPSServerName,
 		MaxGoroutines:          options.MaxGoRoutines,
 		UsePrivateRDNS:         options.UsePrivateRDNS,
 		PrivateSubnets:         netutil.SubnetSetFunc(netutil.IsLocallyServed),
+		StartupGating:          proxy.StartupGating(options.StartupGating),
+		ErrorReporting:         options.ErrorReporting,
+		ErrorReportingAgent:    options.ErrorReportingAgent,
+		InsecureDomains:        options.InsecureDomains,
+		AnswerOrder:            proxy.AnswerOrder(options.AnswerOrder),
+		ResponseCompression:    proxy.Compression(options.ResponseCompression),
+		ResolveCNAMETargets:    options.ResolveCNAMETargets,
+		UpstreamRefusedPolicy:  proxy.RcodePolicy(options.UpstreamRefused),
+		UpstreamNotImpPolicy:   proxy.RcodePolicy(options.UpstreamNotImp),
 	}
 
 	if uiStr := options.HTTPSUserinfo; uiStr != "" {
@@ -373,98 +1532,528 @@ func createProxyConfig(options *Options) (conf *proxy.Config) {
 		}
 	}
 
-	// TODO(e.burkov):  Make these methods of [Options].
-	initUpstreams(conf, options)
-	initEDNS(conf, options)
-	initBogusNXDomain(conf, options)
-	initTLSConfig(conf, options)
-	initDNSCryptConfig(conf, options)
-	initListenAddrs(conf, options)
-	initSubnets(conf, options)
+	// TODO(e.burkov):  Make these methods of [Options].
+	initUpstreams(l, conf, options, remote, keyLog, sessions)
+	initEDNS(l, conf, options)
+	initBogusNXDomain(l, conf, options)
+	initTLSConfig(l, conf, options, keyLog)
+	initDNSCryptConfig(l, conf, options)
+	initListenAddrs(l, conf, options)
+	initSubnets(l, conf, options)
+	initFaults(l, conf, options)
+	initUDPTruncation(l, conf, options)
+	initUpstreamUDPSize(l, conf, options)
+	initForceTCP(l, conf, options)
+	initSVCBRewrite(conf, options)
+	initFallbackTriggers(l, conf, options)
+	initQueryBudget(conf, options)
+	initTraceID(conf, options)
+
+	var err error
+	conf.CacheTTLOverrides, err = parseTTLOverrides(options.CacheTypeTTLs)
+	if err != nil {
+		fatal(l, "parsing cache type ttls", slogutil.KeyError, err)
+	}
+	initAnomalies(l, conf, options)
+	initGeoIP(l, conf, options)
+
+	if options.XDPInterface != "" {
+		conf.XDP = &proxy.XDPConfig{
+			Interface:  options.XDPInterface,
+			MaxEntries: options.XDPMaxEntries,
+			MaxAge:     options.XDPMaxAge.Duration,
+		}
+	}
+
+	if options.AdaptiveConcurrency {
+		conf.ConcurrencyLimit = &proxy.ConcurrencyLimitConfig{
+			MinLimit: options.AdaptiveConcurrencyMin,
+			MaxLimit: options.AdaptiveConcurrencyMax,
+		}
+	}
+
+	if options.QUICRetryThreshold > 0 || options.QUICRetryTokenLifetime.Duration > 0 {
+		conf.QUICRetry = &proxy.QUICRetryConfig{
+			Threshold:     options.QUICRetryThreshold,
+			TokenLifetime: options.QUICRetryTokenLifetime.Duration,
+		}
+	}
+
+	if options.EncryptedMaxConnsPerIP > 0 || options.EncryptedHandshakeRate > 0 {
+		conf.EncryptedConnLimit = &proxy.EncryptedConnLimitConfig{
+			MaxConnsPerIP:       options.EncryptedMaxConnsPerIP,
+			HandshakesPerSecond: options.EncryptedHandshakeRate,
+			HandshakeBurst:      options.EncryptedHandshakeBurst,
+		}
+	}
+
+	if options.ResolverInfo {
+		conf.ResolverInfo = &proxy.ResolverInfo{
+			InfoURL:           options.ResolverInfoURL,
+			ExtendedErrors:    options.ResolverInfoExtendedErrors,
+			QNAMEMinimization: options.ResolverInfoQNAMEMinimization,
+			Filtering:         options.ResolverInfoFiltering,
+			DNSSECValidation:  options.ResolverInfoDNSSEC,
+		}
+	}
+
+	conf.MaxInflightRequests = options.MaxInflight
+	conf.MaxInflightRequestsPerClient = options.MaxInflightPerClient
+	conf.OverloadPolicy = proxy.OverloadPolicy(options.OverloadPolicy)
+
+	tcpConn := &proxy.TCPConnConfig{
+		IdleTimeout:       options.TCPIdleTimeout.Duration,
+		ReadTimeout:       options.TCPReadTimeout.Duration,
+		MaxConns:          options.TCPMaxConns,
+		MaxConnsPerIP:     options.TCPMaxConnsPerIP,
+		MaxQueriesPerConn: options.TCPMaxQueriesPerConn,
+		MaxWorkers:        options.TCPMaxWorkers,
+	}
+	conf.TCPConn, conf.TLSConn = tcpConn, tcpConn
+
+	return conf
+}
+
+// isEmpty returns false if uc contains at least a single upstream.  uc must not
+// be nil.
+//
+// TODO(e.burkov):  Think of a better way to validate the config.  Perhaps,
+// return an error from [ParseUpstreamsConfig] if no upstreams were initialized.
+func isEmpty(uc *proxy.UpstreamConfig) (ok bool) {
+	return len(uc.Upstreams) == 0 &&
+		len(uc.DomainReservedUpstreams) == 0 &&
+		len(uc.SpecifiedDomainUpstreams) == 0
+}
+
+// initUpstreams inits upstream-related config.  remote are the general
+// upstreams from the remote list, if any.  keyLog is used to write the TLS
+// session secrets of the upstream connections, if not nil.  sessions is the TLS
+// session cache of the DNS-over-QUIC upstreams, if not nil.
+func initUpstreams(
+	l *slog.Logger,
+	config *proxy.Config,
+	options *Options,
+	remote []string,
+	keyLog io.Writer,
+	sessions *upstream.SessionCache,
+) {
+	upsOpts, err := setUpstreams(l, config, options, remote, keyLog, sessions)
+	if err != nil {
+		fatal(l, "initializing upstreams", slogutil.KeyError, err)
+	}
+
+	if addr := options.MirrorUpstream; addr != "" {
+		config.MirrorUpstream, err = upstream.AddressToUpstream(addr, upsOpts)
+		if err != nil {
+			fatal(l, "parsing mirror upstream", slogutil.KeyError, err)
+		}
+
+		config.MirrorPercentage = options.MirrorPercentage
+	}
+
+	compareUpstreams := loadServersList(options.CompareUpstreams)
+	compare, err := proxy.ParseUpstreamsConfig(compareUpstreams, upsOpts)
+	if err != nil {
+		fatal(l, "parsing comparison upstreams configuration", slogutil.KeyError, err)
+	}
+
+	if !isEmpty(compare) {
+		config.CompareUpstreamConfig = compare
+	}
+
+	config.Profiles, err = newProfiles(options.Profiles, upsOpts)
+	if err != nil {
+		fatal(l, "initializing profiles", slogutil.KeyError, err)
+	}
+
+	config.ClientRoutes, err = newClientRoutes(options.ClientRoutes, upsOpts)
+	if err != nil {
+		fatal(l, "initializing client routes", slogutil.KeyError, err)
+	}
+
+	config.TSIGKeys, err = parseTSIGKeys(options.TSIGKeys)
+	if err != nil {
+		fatal(l, "parsing tsig keys", slogutil.KeyError, err)
+	}
+
+	config.ZoneTransfer, err = newZoneTransfer(options, upsOpts, config.TSIGKeys)
+	if err != nil {
+		fatal(l, "initializing zone transfer", slogutil.KeyError, err)
+	}
+
+	config.DynamicUpdate, err = newDynamicUpdate(options, upsOpts, config.TSIGKeys)
+	if err != nil {
+		fatal(l, "initializing dynamic update", slogutil.KeyError, err)
+	}
+
+	config.Notify, err = newNotify(options)
+	if err != nil {
+		fatal(l, "initializing notify", slogutil.KeyError, err)
+	}
+
+	if options.AllServers {
+		config.UpstreamMode = proxy.UModeParallel
+	} else if options.FastestAddress {
+		config.UpstreamMode = proxy.UModeFastestAddr
+		config.FastestPingICMP = options.FastestAddressICMP
+		config.FastestCachePath = options.FastestAddressCacheFile
+		config.FastestPingPorts = options.FastestAddressPingPorts
+		config.FastestMaxConcurrentPings = options.FastestAddressMaxPings
+		config.FastestPingTimeout = options.FastestAddressTimeout.Duration
+		config.FastestFasterWait = options.FastestAddressFasterWait.Duration
+		config.FastestIPv6Preference = options.FastestAddressIPv6Preference.Duration
+	} else {
+		config.UpstreamMode = proxy.UModeLoadBalance
+		config.UpstreamStatsPath = options.UpstreamStatsFile
+		for i, s := range options.NextUpstreamRcodes {
+			rcode, ok := dns.StringToRcode[strings.ToUpper(s)]
+			if !ok {
+				fatal(l, "parsing next upstream rcode", "idx", i, "rcode", s)
+			}
+
+			config.NextUpstreamRcodes = append(config.NextUpstreamRcodes, rcode)
+		}
+
+		if options.UpstreamFailureBackoff.Duration > 0 {
+			config.UpstreamBackoff = &proxy.UpstreamBackoffConfig{
+				Backoff:    options.UpstreamFailureBackoff.Duration,
+				MaxBackoff: options.UpstreamFailureMaxBackoff.Duration,
+			}
+		}
+	}
+}
+
+// setUpstreams sets the general, the private, and the fallback upstream
+// configurations from options into config.  remote are the general upstreams
+// from the remote list, which are used along with the ones from options.
+// upsOpts are the options used for the general upstreams.  keyLog is used to
+// write the TLS session secrets of the upstream connections, if not nil.
+// sessions is the TLS session cache of the DNS-over-QUIC upstreams, if not nil.
+func setUpstreams(
+	l *slog.Logger,
+	config *proxy.Config,
+	options *Options,
+	remote []string,
+	keyLog io.Writer,
+	sessions *upstream.SessionCache,
+) (upsOpts *upstream.Options, err error) {
+	upsLogger := proxy.SubsystemLogger(l, config.LogLevels, proxy.LogSubsystemUpstream)
+	upsOpts, err = newUpstreamOptions(upsLogger, options, keyLog, sessions)
+	if err != nil {
+		// Don't wrap the error, since it's informative enough as is.
+		return nil, err
+	}
+
+	upstreams := append(loadServersList(options.Upstreams), remote...)
+
+	config.UpstreamConfig, err = proxy.ParseUpstreamsConfig(upstreams, upsOpts)
+	if err != nil {
+		return nil, fmt.Errorf("parsing upstreams configuration: %w", err)
+	}
+
+	privUpsOpts := &upstream.Options{
+		Logger:       upsLogger,
+		HTTPVersions: upsOpts.HTTPVersions,
+		Bootstrap:    upsOpts.Bootstrap,
+		Timeout:      min(defaultLocalTimeout, upsOpts.Timeout),
+		KeyLogWriter: keyLog,
+	}
+	privUpstreams := loadServersList(options.PrivateRDNSUpstreams)
+
+	private, err := proxy.ParseUpstreamsConfig(privUpstreams, privUpsOpts)
+	if err != nil {
+		return nil, fmt.Errorf("parsing private rdns upstreams configuration: %w", err)
+	}
+	if !isEmpty(private) {
+		config.PrivateRDNSUpstreamConfig = private
+	}
+
+	fallbackUpstreams := loadServersList(options.Fallbacks)
+	fallbacks, err := proxy.ParseUpstreamsConfig(fallbackUpstreams, upsOpts)
+	if err != nil {
+		return nil, fmt.Errorf("parsing fallback upstreams configuration: %w", err)
+	}
+
+	if !isEmpty(fallbacks) {
+		config.Fallbacks = fallbacks
+	}
+
+	return upsOpts, nil
+}
+
+// newUpstreamOptions returns the options for the general upstreams from options
+// with the initialized bootstrap.  l is used for the upstreams and the
+// bootstrap.  keyLog is used to write the TLS session secrets of the upstream
+// connections, if not nil.  sessions is the TLS session cache of the
+// DNS-over-QUIC upstreams, if not nil.
+func newUpstreamOptions(
+	l *slog.Logger,
+	options *Options,
+	keyLog io.Writer,
+	sessions *upstream.SessionCache,
+) (upsOpts *upstream.Options, err error) {
+	httpVersions := upstream.DefaultHTTPVersions
+	if options.HTTP3 {
+		httpVersions = []upstream.HTTPVersion{
+			upstream.HTTPVersion3,
+			upstream.HTTPVersion2,
+			upstream.HTTPVersion11,
+		}
+	}
+
+	err = proxynetutil.ValidateDSCP(options.UpstreamDSCP)
+	if err != nil {
+		return nil, fmt.Errorf("upstream dscp: %w", err)
+	}
+
+	if options.UpstreamInterface != "" && !proxynetutil.BindToInterfaceSupported {
+		return nil, errors.Error("upstream interface: binding to interface is not supported")
+	}
+
+	ipVer, ipVers, err := parseIPVersions(options.UpstreamIPVersions)
+	if err != nil {
+		return nil, fmt.Errorf("upstream ip version: %w", err)
+	}
+
+	retry, err := retryConfig(options)
+	if err != nil {
+		return nil, fmt.Errorf("upstream retry: %w", err)
+	}
+
+	rootHints, err := parseRootHints(options.RootHints)
+	if err != nil {
+		return nil, fmt.Errorf("root hints: %w", err)
+	}
+
+	relays, err := parseDNSCryptRelays(options.DNSCryptRelays)
+	if err != nil {
+		return nil, fmt.Errorf("dnscrypt relays: %w", err)
+	}
+
+	timeout := options.Timeout.Duration
+	bootOpts := &upstream.Options{
+		Logger:             l,
+		HTTPVersions:       httpVersions,
+		InsecureSkipVerify: options.Insecure,
+		Timeout:            timeout,
+		KeyLogWriter:       keyLog,
+		DSCP:               options.UpstreamDSCP,
+		Interface:          options.UpstreamInterface,
+		IPVersion:          ipVer,
+		IPVersions:         ipVers,
+	}
+	boot, err := initBootstrap(options.BootstrapDNS, bootOpts)
+	if err != nil {
+		return nil, fmt.Errorf("initializing bootstrap: %w", err)
+	}
+
+	return &upstream.Options{
+		Logger:                 l,
+		HTTPVersions:           httpVersions,
+		InsecureSkipVerify:     options.Insecure,
+		Bootstrap:              boot,
+		Timeout:                timeout,
+		KeyLogWriter:           keyLog,
+		ReceiveBufferSize:      options.UpstreamRecvBufferSize,
+		SendBufferSize:         options.UpstreamSendBufferSize,
+		TCPFastOpen:            options.TCPFastOpen,
+		MultipathTCP:           options.MultipathTCP,
+		DSCP:                   options.UpstreamDSCP,
+		Interface:              options.UpstreamInterface,
+		IPVersion:              ipVer,
+		IPVersions:             ipVers,
+		ConnPool:               connPoolConfig(options),
+		UDPPorts:               udpPortPoolConfig(options),
+		EDNSBuffer:             ednsBufferConfig(options),
+		MaxCompressionPointers: options.UpstreamMaxCompressionPointers,
+		Retry:                  retry,
+		RootHints:              rootHints,
+		SRVRefreshInterval:     options.UpstreamSRVRefresh.Duration,
+		DNSCryptRelays:         relays,
+		QUICSessionCache:       sessions,
+		ECH:                    options.UpstreamECH,
+		HTTP2: &upstream.HTTP2Config{
+			MaxConns:             options.UpstreamH2MaxConns,
+			MaxConcurrentStreams: options.UpstreamH2MaxStreams,
+			IdleConnTimeout:      options.UpstreamH2IdleTime.Duration,
+			ReadIdleTimeout:      options.UpstreamH2PingInterval.Duration,
+			PingTimeout:          options.UpstreamH2PingTimeout.Duration,
+		},
+	}, nil
+}
+
+// parseRootHints parses the addresses of the root name servers.  Each hint is
+// either an IP address or an IP address with a port.
+func parseRootHints(hints []string) (addrs []netip.AddrPort, err error) {
+	for i, h := range hints {
+		var addr netip.AddrPort
+		addr, err = netip.ParseAddrPort(h)
+		if err != nil {
+			var ip netip.Addr
+			ip, err = netip.ParseAddr(h)
+			if err != nil {
+				return nil, fmt.Errorf("hint at index %d: %w", i, err)
+			}
+
+			addr = netip.AddrPortFrom(ip, 53)
+		}
+
+		addrs = append(addrs, addr)
+	}
+
+	return addrs, nil
+}
+
+// dnsCryptRelayStampProto is the protocol identifier of the Anonymized DNSCrypt
+// relay stamps.
+const dnsCryptRelayStampProto = 0x81
+
+// parseDNSCryptRelays parses the addresses of the Anonymized DNSCrypt relays.
+// Each relay is either an IP address with a port or a relay stamp.
+func parseDNSCryptRelays(relays []string) (addrs []netip.AddrPort, err error) {
+	for i, r := range relays {
+		if rest, ok := strings.CutPrefix(r, "sdns://"); ok {
+			r, err = relayStampAddr(rest)
+			if err != nil {
+				return nil, fmt.Errorf("relay at index %d: %w", i, err)
+			}
+		}
+
+		var addr netip.AddrPort
+		addr, err = netip.ParseAddrPort(r)
+		if err != nil {
+			return nil, fmt.Errorf("relay at index %d: %w", i, err)
+		}
+
+		addrs = append(addrs, addr)
+	}
+
+	return addrs, nil
+}
+
+// relayStampAddr returns the address of the relay from the base64-encoded
+// relay stamp data, with the default port added if it's missing.
+func relayStampAddr(data string) (addr string, err error) {
+	b, err := base64.RawURLEncoding.DecodeString(data)
+	if err != nil {
+		return "", fmt.Errorf("decoding stamp: %w", err)
+	}
+
+	if len(b) < 2 || b[0] != dnsCryptRelayStampProto || int(b[1]) != len(b)-2 {
+		return "", errors.Error("not a relay stamp")
+	}
+
+	addr = string(b[2:])
+	if _, err = netip.ParseAddr(strings.Trim(addr, "[]")); err == nil {
+		addr = net.JoinHostPort(strings.Trim(addr, "[]"), "443")
+	}
 
-	return conf
+	return addr, nil
 }
 
-// isEmpty returns false if uc contains at least a single upstream.  uc must not
-// be nil.
-//
-// TODO(e.burkov):  Think of a better way to validate the config.  Perhaps,
-// return an error from [ParseUpstreamsConfig] if no upstreams were initialized.
-func isEmpty(uc *proxy.UpstreamConfig) (ok bool) {
-	return len(uc.Upstreams) == 0 &&
-		len(uc.DomainReservedUpstreams) == 0 &&
-		len(uc.SpecifiedDomainUpstreams) == 0
-}
+// parseIPVersions parses the preferences of the address family used to dial
+// the upstreams.  Each spec is either a preference applied to all the upstreams
+// or a preference followed by a colon and the address of the upstream to apply
+// it to.
+func parseIPVersions(
+	specs []string,
+) (v upstream.IPVersion, byAddr map[string]upstream.IPVersion, err error) {
+	for i, s := range specs {
+		verStr, addr, ok := strings.Cut(s, ":")
+		ver := upstream.IPVersion(verStr)
+		err = ver.Validate()
+		if err != nil {
+			return "", nil, fmt.Errorf("at index %d: %w", i, err)
+		}
 
-// initUpstreams inits upstream-related config
-func initUpstreams(config *proxy.Config, options *Options) {
-	// Init upstreams
+		if !ok {
+			v = ver
 
-	httpVersions := upstream.DefaultHTTPVersions
-	if options.HTTP3 {
-		httpVersions = []upstream.HTTPVersion{
-			upstream.HTTPVersion3,
-			upstream.HTTPVersion2,
-			upstream.HTTPVersion11,
+			continue
 		}
-	}
 
-	timeout := options.Timeout.Duration
-	bootOpts := &upstream.Options{
-		HTTPVersions:       httpVersions,
-		InsecureSkipVerify: options.Insecure,
-		Timeout:            timeout,
+		if byAddr == nil {
+			byAddr = map[string]upstream.IPVersion{}
+		}
+
+		byAddr[addr] = ver
 	}
-	boot, err := initBootstrap(options.BootstrapDNS, bootOpts)
-	if err != nil {
-		log.Fatalf("error while initializing bootstrap: %s", err)
+
+	return v, byAddr, nil
+}
+
+// connPoolConfig returns the configuration of the pools of the connections to
+// the upstreams from options.  It returns nil if none of the pool options is
+// set, so that the connections to plain DNS-over-TCP upstreams aren't reused.
+func connPoolConfig(options *Options) (c *upstream.ConnPoolConfig) {
+	c = &upstream.ConnPoolConfig{
+		MaxIdleConns:       options.UpstreamPoolMaxIdle,
+		MaxConnAge:         options.UpstreamPoolMaxAge.Duration,
+		IdleTimeout:        options.UpstreamPoolIdleTimeout.Duration,
+		MaxConcurrentDials: options.UpstreamPoolMaxDials,
+		Prewarm:            options.UpstreamPoolPrewarm,
 	}
 
-	upsOpts := &upstream.Options{
-		HTTPVersions:       httpVersions,
-		InsecureSkipVerify: options.Insecure,
-		Bootstrap:          boot,
-		Timeout:            timeout,
+	if *c == (upstream.ConnPoolConfig{}) {
+		return nil
 	}
-	upstreams := loadServersList(options.Upstreams)
 
-	config.UpstreamConfig, err = proxy.ParseUpstreamsConfig(upstreams, upsOpts)
-	if err != nil {
-		log.Fatalf("error while parsing upstreams configuration: %s", err)
+	return c
+}
+
+// udpPortPoolConfig returns the configuration of the pools of the sockets used
+// for the queries to plain DNS-over-UDP upstreams from options.  It returns nil
+// if the pools are disabled.
+func udpPortPoolConfig(options *Options) (c *upstream.UDPPortPoolConfig) {
+	if options.UpstreamUDPPorts == 0 {
+		return nil
 	}
 
-	privUpsOpts := &upstream.Options{
-		HTTPVersions: httpVersions,
-		Bootstrap:    boot,
-		Timeout:      min(defaultLocalTimeout, timeout),
+	return &upstream.UDPPortPoolConfig{
+		Size:     options.UpstreamUDPPorts,
+		Lifetime: options.UpstreamUDPPortsLifetime.Duration,
 	}
-	privUpstreams := loadServersList(options.PrivateRDNSUpstreams)
+}
 
-	private, err := proxy.ParseUpstreamsConfig(privUpstreams, privUpsOpts)
-	if err != nil {
-		log.Fatalf("error while parsing private rdns upstreams configuration: %s", err)
+// ednsBufferConfig returns the configuration of the adaptive EDNS buffer
+// sizing of plain DNS-over-UDP upstreams from options.  It returns nil if it's
+// disabled.
+func ednsBufferConfig(options *Options) (c *upstream.EDNSBufferConfig) {
+	if options.UpstreamEDNSBufferSize == 0 {
+		return nil
 	}
-	if !isEmpty(private) {
-		config.PrivateRDNSUpstreamConfig = private
+
+	return &upstream.EDNSBufferConfig{
+		Size:          options.UpstreamEDNSBufferSize,
+		ProbeInterval: options.UpstreamEDNSProbeInterval.Duration,
 	}
+}
 
-	fallbackUpstreams := loadServersList(options.Fallbacks)
-	fallbacks, err := proxy.ParseUpstreamsConfig(fallbackUpstreams, upsOpts)
-	if err != nil {
-		log.Fatalf("error while parsing fallback upstreams configuration: %s", err)
+// retryConfig returns the configuration of retrying the failed exchanges with
+// the upstreams from options.  It returns nil if the retries are disabled.
+func retryConfig(options *Options) (c *upstream.RetryConfig, err error) {
+	if options.UpstreamRetries == 0 {
+		return nil, nil
 	}
 
-	if !isEmpty(fallbacks) {
-		config.Fallbacks = fallbacks
+	c = &upstream.RetryConfig{
+		Retries:    options.UpstreamRetries,
+		TryTimeout: options.UpstreamTryTimeout.Duration,
+		Deadline:   options.UpstreamRetryDeadline.Duration,
+		Backoff:    options.UpstreamRetryBackoff.Duration,
+		MaxBackoff: options.UpstreamRetryMaxBackoff.Duration,
 	}
 
-	if options.AllServers {
-		config.UpstreamMode = proxy.UModeParallel
-	} else if options.FastestAddress {
-		config.UpstreamMode = proxy.UModeFastestAddr
-	} else {
-		config.UpstreamMode = proxy.UModeLoadBalance
+	for i, s := range options.UpstreamRetryRcodes {
+		rcode, ok := dns.StringToRcode[strings.ToUpper(s)]
+		if !ok {
+			return nil, fmt.Errorf("rcode at index %d: unknown value %q", i, s)
+		}
+
+		c.Rcodes = append(c.Rcodes, rcode)
 	}
+
+	return c, nil
 }
 
 // initBootstrap initializes the [upstream.Resolver] for bootstrapping upstream
@@ -487,7 +2076,7 @@ func initBootstrap(bootstraps []string, opts *upstream.Options) (r upstream.Reso
 	case 0:
 		etcHosts, hostsErr := upstream.NewDefaultHostsResolver(osutil.RootDirFS())
 		if hostsErr != nil {
-			log.Error("creating default hosts resolver: %s", hostsErr)
+			opts.Logger.Error("creating default hosts resolver", slogutil.KeyError, hostsErr)
 
 			return net.DefaultResolver, nil
 		}
@@ -501,22 +2090,22 @@ func initBootstrap(bootstraps []string, opts *upstream.Options) (r upstream.Reso
 }
 
 // initEDNS inits EDNS-related config
-func initEDNS(config *proxy.Config, options *Options) {
+func initEDNS(l *slog.Logger, config *proxy.Config, options *Options) {
 	if options.EDNSAddr != "" {
 		if options.EnableEDNSSubnet {
 			ednsIP := net.ParseIP(options.EDNSAddr)
 			if ednsIP == nil {
-				log.Fatalf("cannot parse %s", options.EDNSAddr)
+				fatal(l, "cannot parse edns address", "addr", options.EDNSAddr)
 			}
 			config.EDNSAddr = ednsIP
 		} else {
-			log.Printf("--edns-addr=%s need --edns to work", options.EDNSAddr)
+			l.Warn("--edns-addr needs --edns to work", "addr", options.EDNSAddr)
 		}
 	}
 }
 
 // initBogusNXDomain inits BogusNXDomain structure
-func initBogusNXDomain(config *proxy.Config, options *Options) {
+func initBogusNXDomain(l *slog.Logger, config *proxy.Config, options *Options) {
 	if len(options.BogusNXDomain) == 0 {
 		return
 	}
@@ -524,52 +2113,64 @@ func initBogusNXDomain(config *proxy.Config, options *Options) {
 	for i, s := range options.BogusNXDomain {
 		p, err := proxynetutil.ParseSubnet(s)
 		if err != nil {
-			log.Error("parsing bogus nxdomain subnet at index %d: %s", i, err)
+			l.Error("parsing bogus nxdomain subnet", "idx", i, slogutil.KeyError, err)
 		} else {
 			config.BogusNXDomain = append(config.BogusNXDomain, p)
 		}
 	}
 }
 
-// initTLSConfig inits the TLS config
-func initTLSConfig(config *proxy.Config, options *Options) {
+// initTLSConfig inits the TLS config.  keyLog is used to write the TLS session
+// secrets of the listeners, if not nil.
+func initTLSConfig(l *slog.Logger, config *proxy.Config, options *Options, keyLog io.Writer) {
 	if options.TLSCertPath != "" && options.TLSKeyPath != "" {
 		tlsConfig, err := newTLSConfig(options)
 		if err != nil {
-			log.Fatalf("failed to load TLS config: %s", err)
+			fatal(l, "failed to load tls config", slogutil.KeyError, err)
 		}
+		tlsConfig.KeyLogWriter = keyLog
 		config.TLSConfig = tlsConfig
 	}
 }
 
 // initDNSCryptConfig inits the DNSCrypt config
-func initDNSCryptConfig(config *proxy.Config, options *Options) {
+func initDNSCryptConfig(l *slog.Logger, config *proxy.Config, options *Options) {
 	if options.DNSCryptConfigPath == "" {
 		return
 	}
 
-	b, err := os.ReadFile(options.DNSCryptConfigPath)
-	if err != nil {
-		log.Fatalf("failed to read DNSCrypt config %s: %v", options.DNSCryptConfigPath, err)
-	}
-
-	rc := &dnscrypt.ResolverConfig{}
-	err = yaml.Unmarshal(b, rc)
+	rc, err := loadDNSCryptConfig(options.DNSCryptConfigPath)
 	if err != nil {
-		log.Fatalf("failed to unmarshal DNSCrypt config: %v", err)
+		fatal(l, "failed to load dnscrypt config", "path", options.DNSCryptConfigPath, slogutil.KeyError, err)
 	}
 
 	cert, err := rc.CreateCert()
 	if err != nil {
-		log.Fatalf("failed to create DNSCrypt certificate: %v", err)
+		fatal(l, "failed to create dnscrypt certificate", slogutil.KeyError, err)
 	}
 
 	config.DNSCryptResolverCert = cert
 	config.DNSCryptProviderName = rc.ProviderName
 }
 
+// loadDNSCryptConfig reads the DNSCrypt configuration from the file at path.
+func loadDNSCryptConfig(path string) (rc *dnscrypt.ResolverConfig, err error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading: %w", err)
+	}
+
+	rc = &dnscrypt.ResolverConfig{}
+	err = yaml.Unmarshal(b, rc)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshaling: %w", err)
+	}
+
+	return rc, nil
+}
+
 // initListenAddrs inits listen addrs
-func initListenAddrs(config *proxy.Config, options *Options) {
+func initListenAddrs(l *slog.Logger, config *proxy.Config, options *Options) {
 	listenIPs := []netip.Addr{}
 
 	if len(options.ListenAddrs) == 0 {
@@ -587,7 +2188,7 @@ func initListenAddrs(config *proxy.Config, options *Options) {
 	for i, a := range options.ListenAddrs {
 		ip, err := netip.ParseAddr(a)
 		if err != nil {
-			log.Fatalf("parsing listen address at index %d: %s", i, a)
+			fatal(l, "parsing listen address", "idx", i, "addr", a)
 		}
 
 		listenIPs = append(listenIPs, ip)
@@ -644,12 +2245,12 @@ func initListenAddrs(config *proxy.Config, options *Options) {
 }
 
 // mustParsePrefixes parses prefixes and considers any error as fatal, logging
-// it with the entity name.
-func mustParsePrefixes(prefixes []string, entity string) (prefs []netip.Prefix) {
+// it with the entity name using l.
+func mustParsePrefixes(l *slog.Logger, prefixes []string, entity string) (prefs []netip.Prefix) {
 	for i, p := range prefixes {
 		pref, err := netip.ParsePrefix(p)
 		if err != nil {
-			log.Fatalf("parsing %s at index %d: %v", entity, i, err)
+			fatal(l, "parsing "+entity, "idx", i, slogutil.KeyError, err)
 		}
 
 		prefs = append(prefs, pref)
@@ -659,19 +2260,446 @@ func mustParsePrefixes(prefixes []string, entity string) (prefs []netip.Prefix)
 }
 
 // initSubnets sets the DNS64 configuration into conf.
-func initSubnets(conf *proxy.Config, options *Options) {
+func initSubnets(l *slog.Logger, conf *proxy.Config, options *Options) {
 	if conf.UseDNS64 = options.DNS64; conf.UseDNS64 {
-		conf.DNS64Prefs = mustParsePrefixes(options.DNS64Prefix, "dns64 prefix")
+		conf.DNS64Prefs = mustParsePrefixes(l, options.DNS64Prefix, "dns64 prefix")
+		conf.DNS64Exclude = mustParsePrefixes(l, options.DNS64Exclude, "dns64 exclude")
+		conf.DNS64Discovery = options.DNS64Discovery
+		conf.DNS64Synthesis = proxy.DNS64Synthesis(options.DNS64Synthesis)
+		conf.DNS64ReverseSynthesis = options.DNS64ReverseSynthesis
 	}
 
 	if options.UsePrivateRDNS {
-		private := mustParsePrefixes(options.PrivateSubnets, "private subnet")
+		private := mustParsePrefixes(l, options.PrivateSubnets, "private subnet")
 		if len(private) > 0 {
 			conf.PrivateSubnets = netutil.SliceSubnetSet(private)
 		}
 	}
 }
 
+// initFaults sets the fault injection configuration into conf, if it's
+// enabled.
+func initFaults(l *slog.Logger, conf *proxy.Config, options *Options) {
+	if !options.FaultInjection {
+		return
+	}
+
+	faults := &proxy.FaultConfig{
+		Latency:            options.FaultLatency.Duration,
+		ServFailPercentage: options.FaultServFailPercentage,
+		DropPercentage:     options.FaultDropPercentage,
+	}
+
+	switch options.FaultSide {
+	case "listener":
+		conf.ListenerFaults = faults
+	case "upstream":
+		conf.UpstreamFaults = faults
+	default:
+		fatal(l, "unsupported fault side", "side", options.FaultSide)
+	}
+}
+
+// initUDPTruncation sets the limits of the sizes of the UDP responses into
+// conf.
+func initUDPTruncation(l *slog.Logger, conf *proxy.Config, options *Options) {
+	if len(options.UDPMaxResponseSizes) == 0 && options.UDPUnverifiedMaxSize == 0 {
+		return
+	}
+
+	c := &proxy.UDPTruncationConfig{
+		VerifiedTTL:        options.UDPVerifiedTTL.Duration,
+		MaxVerifiedClients: options.UDPMaxVerifiedClients,
+		UnverifiedMaxSize:  options.UDPUnverifiedMaxSize,
+	}
+
+	var err error
+	c.MaxSize, c.ListenerMaxSizes, err = parseUDPSizes(options.UDPMaxResponseSizes)
+	if err != nil {
+		fatal(l, "parsing udp max response size", slogutil.KeyError, err)
+	}
+
+	conf.UDPTruncation = c
+}
+
+// initUpstreamUDPSize sets the EDNS buffer sizes advertised to the upstreams
+// into conf.
+func initUpstreamUDPSize(l *slog.Logger, conf *proxy.Config, options *Options) {
+	if len(options.UpstreamUDPSizes) == 0 {
+		return
+	}
+
+	size, listenerSizes, err := parseUDPSizes(options.UpstreamUDPSizes)
+	if err != nil {
+		fatal(l, "parsing upstream udp size", slogutil.KeyError, err)
+	}
+
+	conf.UpstreamUDPSize = &proxy.UpstreamUDPSizeConfig{
+		ListenerSizes: listenerSizes,
+		Size:          size,
+	}
+}
+
+// parseUDPSizes parses the UDP message sizes from specs, each in the form of
+// "SIZE[:LISTEN_ADDR]".  listenerSizes is nil if no spec has a listen address.
+func parseUDPSizes(
+	specs []string,
+) (size uint16, listenerSizes map[netip.AddrPort]uint16, err error) {
+	for i, spec := range specs {
+		sizeStr, addrStr, ok := strings.Cut(spec, ":")
+		var n uint64
+		n, err = strconv.ParseUint(sizeStr, 10, 16)
+		if err != nil {
+			return 0, nil, fmt.Errorf("at index %d: %w", i, err)
+		}
+
+		if !ok {
+			size = uint16(n)
+
+			continue
+		}
+
+		var addr netip.AddrPort
+		addr, err = netip.ParseAddrPort(addrStr)
+		if err != nil {
+			return 0, nil, fmt.Errorf("at index %d: %w", i, err)
+		}
+
+		if listenerSizes == nil {
+			listenerSizes = map[netip.AddrPort]uint16{}
+		}
+
+		listenerSizes[addr] = uint16(n)
+	}
+
+	return size, listenerSizes, nil
+}
+
+// parseTTLOverrides parses the TTL ranges for the record types from specs, each
+// in the TYPE:MIN:MAX form.  overrides is nil if specs are empty.
+func parseTTLOverrides(specs []string) (overrides map[uint16]proxy.TTLRange, err error) {
+	if len(specs) == 0 {
+		return nil, nil
+	}
+
+	overrides = make(map[uint16]proxy.TTLRange, len(specs))
+	for i, spec := range specs {
+		parts := strings.Split(spec, ":")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("spec at index %d: want TYPE:MIN:MAX, got %q", i, spec)
+		}
+
+		rrType, ok := dns.StringToType[strings.ToUpper(parts[0])]
+		if !ok {
+			return nil, fmt.Errorf("spec at index %d: unknown type %q", i, parts[0])
+		}
+
+		var minTTL, maxTTL uint64
+		minTTL, err = strconv.ParseUint(parts[1], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("spec at index %d: min: %w", i, err)
+		}
+
+		maxTTL, err = strconv.ParseUint(parts[2], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("spec at index %d: max: %w", i, err)
+		}
+
+		overrides[rrType] = proxy.TTLRange{
+			Min: uint32(minTTL),
+			Max: uint32(maxTTL),
+		}
+	}
+
+	return overrides, nil
+}
+
+// initForceTCP sets the requests resolved over TCP into conf.
+func initForceTCP(l *slog.Logger, conf *proxy.Config, options *Options) {
+	if len(options.ForceTCPDomains) == 0 && len(options.ForceTCPQtypes) == 0 {
+		return
+	}
+
+	c := &proxy.ForceTCPConfig{
+		Domains: options.ForceTCPDomains,
+	}
+
+	for i, s := range options.ForceTCPQtypes {
+		qt, ok := dns.StringToType[strings.ToUpper(s)]
+		if !ok {
+			fatal(l, "parsing force tcp qtype", "idx", i, "qtype", s)
+		}
+
+		c.Qtypes = append(c.Qtypes, qt)
+	}
+
+	conf.ForceTCP = c
+}
+
+// initSVCBRewrite sets the rewriting of the SVCB and HTTPS records into conf.
+func initSVCBRewrite(conf *proxy.Config, options *Options) {
+	if len(options.SVCBStripECH) == 0 &&
+		len(options.SVCBStripIPv4Hint) == 0 &&
+		len(options.SVCBStripIPv6Hint) == 0 &&
+		len(options.SVCBDrop) == 0 {
+		return
+	}
+
+	conf.SVCBRewrite = &proxy.SVCBRewriteConfig{
+		StripECHDomains:      options.SVCBStripECH,
+		StripIPv4HintDomains: options.SVCBStripIPv4Hint,
+		StripIPv6HintDomains: options.SVCBStripIPv6Hint,
+		DropDomains:          options.SVCBDrop,
+	}
+}
+
+// initQueryBudget sets the time budget of resolving a single request into
+// conf.
+func initQueryBudget(conf *proxy.Config, options *Options) {
+	if options.QueryBudget.Duration == 0 && options.QueryBudgetFallback.Duration == 0 {
+		return
+	}
+
+	conf.QueryBudget = &proxy.QueryBudgetConfig{
+		Total:           options.QueryBudget.Duration,
+		FallbackReserve: options.QueryBudgetFallback.Duration,
+	}
+}
+
+// initTraceID sets the configuration of the request trace IDs into conf.
+func initTraceID(conf *proxy.Config, options *Options) {
+	if !options.TraceID && !options.TraceIDForward {
+		return
+	}
+
+	conf.TraceID = &proxy.TraceIDConfig{
+		OptionCode: options.TraceIDOptionCode,
+		Forward:    options.TraceIDForward,
+	}
+}
+
+// initFallbackTriggers sets the outcomes triggering the fallbacks into conf.
+func initFallbackTriggers(l *slog.Logger, conf *proxy.Config, options *Options) {
+	if options.FallbackOn == "error" && len(options.FallbackOnDomains) == 0 {
+		// Use the default.
+		return
+	}
+
+	t, err := parseFallbackTriggers(options.FallbackOn)
+	if err != nil {
+		fatal(l, "parsing fallback triggers", slogutil.KeyError, err)
+	}
+
+	c := &proxy.FallbackConfig{
+		Domains:  make(map[string]proxy.FallbackTrigger, len(options.FallbackOnDomains)),
+		Triggers: t,
+	}
+
+	for i, spec := range options.FallbackOnDomains {
+		domain, triggers, ok := strings.Cut(spec, ":")
+		if !ok {
+			fatal(l, "parsing fallback domain triggers", "idx", i, "spec", spec)
+		}
+
+		c.Domains[domain], err = parseFallbackTriggers(triggers)
+		if err != nil {
+			fatal(l, "parsing fallback domain triggers", "idx", i, slogutil.KeyError, err)
+		}
+	}
+
+	conf.FallbackTriggers = c
+}
+
+// parseFallbackTriggers parses the comma-separated list of the fallback
+// triggers.
+func parseFallbackTriggers(s string) (t proxy.FallbackTrigger, err error) {
+	for _, name := range strings.Split(s, ",") {
+		switch strings.TrimSpace(name) {
+		case "error":
+			t |= proxy.FallbackOnError
+		case "servfail":
+			t |= proxy.FallbackOnServFail
+		case "refused":
+			t |= proxy.FallbackOnRefused
+		case "empty":
+			t |= proxy.FallbackOnEmpty
+		case "validation":
+			t |= proxy.FallbackOnValidationFailure
+		case "none":
+			// Go on.
+		default:
+			return 0, fmt.Errorf("unknown outcome %q", name)
+		}
+	}
+
+	return t, nil
+}
+
+// newZoneTransfer returns the zone transfer configuration from options.  keys
+// are the parsed TSIG keys.  conf is nil if no zone transfer upstreams are
+// specified.
+func newZoneTransfer(
+	options *Options,
+	upsOpts *upstream.Options,
+	keys []*upstream.TSIGKey,
+) (conf *proxy.ZoneTransferConfig, err error) {
+	if len(options.ZoneTransferUpstreams) == 0 {
+		return nil, nil
+	}
+
+	conf = &proxy.ZoneTransferConfig{
+		AllowedKeys: options.ZoneTransferAllowedKeys,
+	}
+
+	conf.Upstreams, err = newSignedUpstreams(
+		options.ZoneTransferUpstreams,
+		upsOpts,
+		keys,
+		options.ZoneTransferTSIGKey,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	conf.AllowedClients, err = parseAllowedClients(options.ZoneTransferAllowed)
+	if err != nil {
+		return nil, err
+	}
+
+	return conf, nil
+}
+
+// newDynamicUpdate returns the dynamic update configuration from options.  keys
+// are the parsed TSIG keys.  conf is nil if neither the dynamic update
+// upstreams nor the allowed clients are specified.
+func newDynamicUpdate(
+	options *Options,
+	upsOpts *upstream.Options,
+	keys []*upstream.TSIGKey,
+) (conf *proxy.DynamicUpdateConfig, err error) {
+	if len(options.DynamicUpdateUpstreams) == 0 &&
+		len(options.DynamicUpdateAllowed) == 0 &&
+		len(options.DynamicUpdateAllowedKeys) == 0 {
+		return nil, nil
+	}
+
+	conf = &proxy.DynamicUpdateConfig{
+		AllowedKeys: options.DynamicUpdateAllowedKeys,
+	}
+
+	conf.Upstreams, err = newSignedUpstreams(
+		options.DynamicUpdateUpstreams,
+		upsOpts,
+		keys,
+		options.DynamicUpdateTSIGKey,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	conf.AllowedClients, err = parseAllowedClients(options.DynamicUpdateAllowed)
+	if err != nil {
+		return nil, err
+	}
+
+	return conf, nil
+}
+
+// newNotify returns the NOTIFY handling configuration from options.  conf is
+// nil if no primary servers are allowed.
+func newNotify(options *Options) (conf *proxy.NotifyConfig, err error) {
+	if len(options.NotifyAllowed) == 0 && len(options.NotifyAllowedKeys) == 0 {
+		return nil, nil
+	}
+
+	conf = &proxy.NotifyConfig{
+		AllowedKeys: options.NotifyAllowedKeys,
+	}
+
+	conf.Masters, err = parseAllowedClients(options.NotifyAllowed)
+	if err != nil {
+		return nil, err
+	}
+
+	return conf, nil
+}
+
+// newSignedUpstreams returns the upstreams for addrs created with upsOpts.  If
+// keyName isn't empty, the requests to them are signed with the key named so
+// from keys.
+func newSignedUpstreams(
+	addrs []string,
+	upsOpts *upstream.Options,
+	keys []*upstream.TSIGKey,
+	keyName string,
+) (ups []upstream.Upstream, err error) {
+	if keyName != "" {
+		i := slices.IndexFunc(keys, func(k *upstream.TSIGKey) (ok bool) {
+			return k.CanonicalName() == dns.CanonicalName(keyName)
+		})
+		if i < 0 {
+			return nil, fmt.Errorf("tsig key %q: not found", keyName)
+		}
+
+		upsOpts = upsOpts.Clone()
+		upsOpts.TSIGKey = keys[i]
+	}
+
+	for i, addr := range addrs {
+		var u upstream.Upstream
+		u, err = upstream.AddressToUpstream(addr, upsOpts)
+		if err != nil {
+			return nil, fmt.Errorf("upstream at index %d: %w", i, err)
+		}
+
+		ups = append(ups, u)
+	}
+
+	return ups, nil
+}
+
+// parseTSIGKeys parses the TSIG keys in the [algorithm:]name:secret form.
+func parseTSIGKeys(strs []string) (keys []*upstream.TSIGKey, err error) {
+	for i, s := range strs {
+		parts := strings.Split(s, ":")
+
+		k := &upstream.TSIGKey{}
+		switch len(parts) {
+		case 2:
+			k.Name, k.Secret = parts[0], parts[1]
+		case 3:
+			k.Algorithm, k.Name, k.Secret = parts[0], parts[1], parts[2]
+		default:
+			return nil, fmt.Errorf("key at index %d: bad format", i)
+		}
+
+		err = k.Validate()
+		if err != nil {
+			return nil, fmt.Errorf("key at index %d: %w", i, err)
+		}
+
+		keys = append(keys, k)
+	}
+
+	return keys, nil
+}
+
+// parseAllowedClients parses the networks of the allowed clients in CIDR
+// notation.
+func parseAllowedClients(nets []string) (prefs []netip.Prefix, err error) {
+	for i, s := range nets {
+		var pref netip.Prefix
+		pref, err = netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("allowed client at index %d: %w", i, err)
+		}
+
+		prefs = append(prefs, pref)
+	}
+
+	return prefs, nil
+}
+
 // IPv6 configuration
 type ipv6Configuration struct {
 	ipv6Disabled bool // If true, all AAAA requests will be replied with NoError RCode and empty answer
@@ -760,19 +2788,27 @@ func loadServersList(sources []string) []string {
 			servers = append(servers, source)
 		}
 
-		lines := strings.Split(string(data), "\n")
-		for _, line := range lines {
-			line = strings.TrimSpace(line)
+		servers = append(servers, parseServersList(data)...)
+	}
 
-			// Ignore comments in the file.
-			if line == "" ||
-				strings.HasPrefix(line, "!") ||
-				strings.HasPrefix(line, "#") {
-				continue
-			}
+	return servers
+}
 
-			servers = append(servers, line)
+// parseServersList returns the addresses of DNS servers from the list in data,
+// one per line.  Empty lines and comments are ignored.
+func parseServersList(data []byte) (servers []string) {
+	lines := strings.Split(string(data), "\n")
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+
+		// Ignore comments in the file.
+		if line == "" ||
+			strings.HasPrefix(line, "!") ||
+			strings.HasPrefix(line, "#") {
+			continue
 		}
+
+		servers = append(servers, line)
 	}
 
 	return servers
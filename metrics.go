@@ -0,0 +1,81 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/internal/metrics"
+	"github.com/AdguardTeam/dnsproxy/internal/stats"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// initMetrics sets the Prometheus metrics listener into conf and starts the
+// HTTP server exposing the collected metrics, if it's enabled in options.  st
+// is used to report the top talkers, it may be nil if those aren't reported.
+func initMetrics(
+	baseLogger *slog.Logger,
+	conf *proxy.Config,
+	options *Options,
+	st *stats.Stats,
+) {
+	addr := options.MetricsListenAddr
+	if addr == "" {
+		return
+	}
+
+	l := baseLogger.With(slogutil.KeyPrefix, "metrics")
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+
+	m, err := metrics.New(reg)
+	if err != nil {
+		fatal(l, "initializing", slogutil.KeyError, err)
+	}
+
+	addMetricsListener(conf, m)
+	if conf.Anomalies != nil {
+		addAnomalyHandler(conf, m)
+	}
+
+	if options.MetricsTopTalkers > 0 {
+		err = metrics.RegisterTopTalkers(reg, st, options.MetricsTopTalkers)
+		if err != nil {
+			fatal(l, "initializing top talkers", slogutil.KeyError, err)
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+
+	go func() {
+		l.Info("listening", "addr", addr)
+		srv := &http.Server{
+			Addr:        addr,
+			ReadTimeout: 60 * time.Second,
+			Handler:     mux,
+		}
+		err = listenAndServe(l, srv, options.ReusePort)
+		l.Error("running server", slogutil.KeyError, err)
+	}()
+}
+
+// addMetricsListener adds l to the metrics listeners of conf.
+func addMetricsListener(conf *proxy.Config, l proxy.MetricsListener) {
+	switch existing := conf.MetricsListener.(type) {
+	case nil:
+		conf.MetricsListener = l
+	case proxy.MultiMetricsListener:
+		conf.MetricsListener = append(existing, l)
+	default:
+		conf.MetricsListener = proxy.MultiMetricsListener{existing, l}
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/AdguardTeam/dnsproxy/internal/netmon"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+)
+
+// initNetworkMonitor starts monitoring the network changes, if any reaction to
+// them is enabled in options.  On change, it clears the cache of p and resets
+// the upstreams with r, as configured.  mon is nil if it's disabled.
+func initNetworkMonitor(
+	baseLogger *slog.Logger,
+	p *proxy.Proxy,
+	r *reloader,
+	options *Options,
+) (mon *netmon.Monitor) {
+	flush, reset := options.NetworkChangeFlushCache, options.NetworkChangeResetUpstreams
+	if !flush && !reset {
+		return nil
+	}
+
+	l := baseLogger.With(slogutil.KeyPrefix, "netmon")
+
+	mon, err := netmon.New(&netmon.Config{
+		Logger: l,
+		OnChange: func(ctx context.Context) {
+			if reset {
+				err := r.resetUpstreams(ctx)
+				if err != nil {
+					l.ErrorContext(ctx, "resetting upstreams", slogutil.KeyError, err)
+				} else {
+					l.InfoContext(ctx, "upstreams reset")
+				}
+			}
+
+			// Clear the cache after resetting the upstreams, so that it isn't
+			// filled by the requests to the previous network in between.
+			if flush {
+				p.ClearCache()
+				l.InfoContext(ctx, "cache cleared")
+			}
+		},
+	})
+	if err != nil {
+		fatal(l, "initializing network monitor", slogutil.KeyError, err)
+	}
+
+	mon.Start()
+
+	return mon
+}
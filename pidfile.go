@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"os"
+	"strconv"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+)
+
+// pidFileData returns the contents of the PID file of the current process.
+func pidFileData() (data []byte) {
+	return []byte(strconv.Itoa(os.Getpid()) + "\n")
+}
+
+// writePIDFile writes the identifier of the current process into the file at
+// path, if it's set.
+func writePIDFile(l *slog.Logger, path string) {
+	if path == "" {
+		return
+	}
+
+	// #nosec G306 -- The PID file is supposed to be readable by everyone.
+	err := os.WriteFile(path, pidFileData(), 0o644)
+	if err != nil {
+		fatal(l, "writing pid file", slogutil.KeyError, err)
+	}
+
+	l.Debug("wrote pid file", "path", path)
+}
+
+// removePIDFile removes the file at path, if it's set and still contains the
+// identifier of the current process.  It may contain another one after a binary
+// upgrade, since the new process overwrites it before the old one exits.
+func removePIDFile(l *slog.Logger, path string) {
+	if path == "" {
+		return
+	}
+
+	// #nosec G304 -- Trust the file path that is given in the configuration.
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	} else if err != nil {
+		l.Warn("reading pid file", slogutil.KeyError, err)
+
+		return
+	}
+
+	if !bytes.Equal(bytes.TrimSpace(data), bytes.TrimSpace(pidFileData())) {
+		l.Debug("pid file belongs to another process", "path", path)
+
+		return
+	}
+
+	err = os.Remove(path)
+	if err != nil {
+		l.Warn("removing pid file", slogutil.KeyError, err)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/AdguardTeam/dnsproxy/internal/plugin"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+)
+
+// initPlugins adds the plugins from options to the before request handlers of
+// conf.  The plugins should be closed on exit.
+func initPlugins(l *slog.Logger, conf *proxy.Config, options *Options) (plugins []*plugin.Plugin) {
+	for i, cmdLine := range options.Plugins {
+		command := strings.Fields(cmdLine)
+
+		pl, err := plugin.New(&plugin.Config{
+			Logger:    l.With(slogutil.KeyPrefix, "plugin", "idx", i),
+			Stderr:    os.Stderr,
+			Command:   command,
+			Workers:   options.PluginWorkers,
+			Timeout:   options.PluginTimeout.Duration,
+			CacheSize: options.PluginCacheSize,
+		})
+		if err != nil {
+			fatal(l, "initializing plugin", "cmd", cmdLine, slogutil.KeyError, err)
+		}
+
+		l.Info("using plugin", "cmd", cmdLine)
+
+		addBeforeRequestHandler(conf, pl)
+		plugins = append(plugins, pl)
+	}
+
+	return plugins
+}
+
+// addBeforeRequestHandler adds h to the before request handlers of conf.
+func addBeforeRequestHandler(conf *proxy.Config, h proxy.BeforeRequestHandler) {
+	switch existing := conf.BeforeRequestHandler.(type) {
+	case nil:
+		conf.BeforeRequestHandler = h
+	case proxy.MultiBeforeRequestHandler:
+		conf.BeforeRequestHandler = append(existing, h)
+	default:
+		conf.BeforeRequestHandler = proxy.MultiBeforeRequestHandler{existing, h}
+	}
+}
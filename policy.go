@@ -0,0 +1,45 @@
+package main
+
+import (
+	"crypto/tls"
+	"log/slog"
+
+	"github.com/AdguardTeam/dnsproxy/internal/policy"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+)
+
+// initPolicy sets the external policy hook into conf, if it's enabled in
+// options.  pol is nil if the hook is disabled, otherwise it should be closed
+// on exit.
+func initPolicy(l *slog.Logger, conf *proxy.Config, options *Options) (pol *policy.Policy) {
+	if options.PolicyAddr == "" {
+		return nil
+	}
+
+	var tlsConf *tls.Config
+	if options.PolicyTLS {
+		tlsConf = &tls.Config{
+			MinVersion: tls.VersionTLS12,
+		}
+	}
+
+	l = l.With(slogutil.KeyPrefix, "policy")
+
+	pol, err := policy.New(&policy.Config{
+		Logger:     l,
+		TLSConfig:  tlsConf,
+		Address:    options.PolicyAddr,
+		Timeout:    options.PolicyTimeout.Duration,
+		FailClosed: options.PolicyFailClosed,
+	})
+	if err != nil {
+		fatal(l, "initializing policy", slogutil.KeyError, err)
+	}
+
+	l.Info("checking queries", "addr", options.PolicyAddr, "fail_closed", options.PolicyFailClosed)
+
+	addBeforeRequestHandler(conf, pol)
+
+	return pol
+}
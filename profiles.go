@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/netip"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// profileOptions are the options of a single listener profile, see
+// [proxy.Profile].  These can only be set in the configuration file.
+type profileOptions struct {
+	// EDNSAddr is the custom EDNS Client Address to send.
+	EDNSAddr string `yaml:"edns-addr"`
+
+	// Name is the name of the profile used in the logs.
+	Name string `yaml:"name"`
+
+	// ListenAddrs are the local addresses of the listeners the profile is
+	// applied to, in the ip:port form.
+	ListenAddrs []string `yaml:"listen-addrs"`
+
+	// ServerNames are the TLS server names the profile is applied to on any of
+	// the encrypted listeners.
+	ServerNames []string `yaml:"server-names"`
+
+	// TLSCertPath is the path to the certificate chain presented to the
+	// clients indicating any of ServerNames.
+	TLSCertPath string `yaml:"tls-crt"`
+
+	// TLSKeyPath is the path to the private key of the certificate.
+	TLSKeyPath string `yaml:"tls-key"`
+
+	// Upstreams are the upstream servers of the profile in the same format as
+	// the general ones.  If empty, the general upstreams are used.
+	Upstreams []string `yaml:"upstream"`
+
+	// Ratelimit is the maximum number of requests per second from a single
+	// client subnet.  Zero disables the ratelimiting.
+	Ratelimit int `yaml:"ratelimit"`
+
+	// RatelimitBurst is the maximum number of requests from a single client
+	// subnet allowed at once.  Zero means the general burst.
+	RatelimitBurst int `yaml:"ratelimit-burst"`
+
+	// RatelimitProtos are the protocols the ratelimit is applied to, such as
+	// "udp" or "tls".  If empty, it's only applied to plain DNS over UDP.
+	RatelimitProtos []string `yaml:"ratelimit-protos"`
+
+	// Cache defines if the responses are cached.
+	Cache bool `yaml:"cache"`
+
+	// EnableEDNSSubnet uses EDNS Client Subnet extension.
+	EnableEDNSSubnet bool `yaml:"edns"`
+}
+
+// newProfiles returns the proxy profiles created from opts.  upsOpts are used
+// to create the upstreams of the profiles.  The upstreams created before an
+// error occurred are closed.
+func newProfiles(
+	opts []*profileOptions,
+	upsOpts *upstream.Options,
+) (profiles []*proxy.Profile, err error) {
+	for i, o := range opts {
+		var prof *proxy.Profile
+		prof, err = newProfile(o, upsOpts)
+		if err != nil {
+			return nil, errors.WithDeferred(
+				fmt.Errorf("profile at index %d: %w", i, err),
+				closeProfiles(profiles),
+			)
+		}
+
+		profiles = append(profiles, prof)
+	}
+
+	return profiles, nil
+}
+
+// newProfile returns the proxy profile created from o.
+func newProfile(o *profileOptions, upsOpts *upstream.Options) (prof *proxy.Profile, err error) {
+	if o == nil {
+		return nil, errors.Error("no profile")
+	}
+
+	prof = &proxy.Profile{
+		Name:                   o.Name,
+		ServerNames:            o.ServerNames,
+		Ratelimit:              o.Ratelimit,
+		RatelimitBurst:         o.RatelimitBurst,
+		CacheEnabled:           o.Cache,
+		EnableEDNSClientSubnet: o.EnableEDNSSubnet,
+	}
+
+	for _, s := range o.RatelimitProtos {
+		prof.RatelimitProtos = append(prof.RatelimitProtos, proxy.Proto(s))
+	}
+
+	for _, s := range o.ListenAddrs {
+		var addr netip.AddrPort
+		addr, err = netip.ParseAddrPort(s)
+		if err != nil {
+			return nil, fmt.Errorf("parsing listen addr: %w", err)
+		}
+
+		prof.ListenAddrs = append(prof.ListenAddrs, addr)
+	}
+
+	if o.TLSCertPath != "" || o.TLSKeyPath != "" {
+		var cert tls.Certificate
+		cert, err = loadX509KeyPair(o.TLSCertPath, o.TLSKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("loading tls cert: %w", err)
+		}
+
+		prof.Certificates = []tls.Certificate{cert}
+	}
+
+	if o.EDNSAddr != "" {
+		prof.EDNSAddr = net.ParseIP(o.EDNSAddr)
+		if prof.EDNSAddr == nil {
+			return nil, fmt.Errorf("parsing edns addr %q: bad ip", o.EDNSAddr)
+		}
+	}
+
+	if len(o.Upstreams) > 0 {
+		prof.UpstreamConfig, err = proxy.ParseUpstreamsConfig(loadServersList(o.Upstreams), upsOpts)
+		if err != nil {
+			return nil, fmt.Errorf("parsing upstreams configuration: %w", err)
+		}
+	}
+
+	return prof, nil
+}
+
+// closeProfiles closes the upstreams of profiles.
+func closeProfiles(profiles []*proxy.Profile) (err error) {
+	var errs []error
+	for _, prof := range profiles {
+		if prof.UpstreamConfig != nil {
+			errs = append(errs, prof.UpstreamConfig.Close())
+		}
+	}
+
+	return errors.Join(errs...)
+}
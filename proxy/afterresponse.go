@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+)
+
+// AfterResponseHandler is an object that can handle the response before it's
+// sent to the client by [Proxy].
+type AfterResponseHandler interface {
+	// HandleAfter is called after each DNS request has been resolved, from the
+	// upstreams, the cache, or otherwise, and the response has been cached,
+	// but before it's sent to the client.  The passed [DNSContext] contains
+	// the non-nil Res field, which the handler may modify or replace, and the
+	// changes aren't cached.  dctx must not be retained after HandleAfter
+	// returns if [Config.EnableDNSContextPooling] is set.
+	//
+	// If err is not nil, it's logged, and the response is sent anyway.
+	HandleAfter(p *Proxy, dctx *DNSContext) (err error)
+}
+
+// noopResponseHandler is a no-op implementation of [AfterResponseHandler] that
+// always returns nil.
+type noopResponseHandler struct{}
+
+// type check
+var _ AfterResponseHandler = noopResponseHandler{}
+
+// HandleAfter implements the [AfterResponseHandler] interface for
+// noopResponseHandler.
+func (noopResponseHandler) HandleAfter(_ *Proxy, _ *DNSContext) (err error) {
+	return nil
+}
+
+// MultiAfterResponseHandler is an [AfterResponseHandler] that calls each of the
+// handlers in order until one of them returns an error.
+type MultiAfterResponseHandler []AfterResponseHandler
+
+// type check
+var _ AfterResponseHandler = MultiAfterResponseHandler(nil)
+
+// HandleAfter implements the [AfterResponseHandler] interface for
+// MultiAfterResponseHandler.
+func (m MultiAfterResponseHandler) HandleAfter(p *Proxy, dctx *DNSContext) (err error) {
+	for _, h := range m {
+		err = h.HandleAfter(p, dctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// handleAfter calls the [AfterResponseHandler] if d has a response.
+func (p *Proxy) handleAfter(d *DNSContext) {
+	if d.Res == nil {
+		return
+	}
+
+	span := p.startChildSpan(d, spanAfter)
+	err := p.afterResponseHandler.HandleAfter(p, d)
+	endSpanWithErr(span, err)
+	if err != nil {
+		p.logger.Debug("handling after response", slogutil.KeyError, err)
+	}
+}
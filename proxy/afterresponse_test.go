@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testAfterResponseHandler is a mock after response handler implementation to
+// simplify testing.
+type testAfterResponseHandler struct {
+	onHandleAfter func(p *Proxy, dctx *DNSContext) (err error)
+}
+
+// type check
+var _ AfterResponseHandler = (*testAfterResponseHandler)(nil)
+
+// HandleAfter implements the [AfterResponseHandler] interface for
+// *testAfterResponseHandler.
+func (h *testAfterResponseHandler) HandleAfter(p *Proxy, dctx *DNSContext) (err error) {
+	return h.onHandleAfter(p, dctx)
+}
+
+func TestProxy_HandleDNSRequest_afterResponseHandler(t *testing.T) {
+	rewrittenIP := net.IP{192, 0, 2, 2}
+
+	// mu protects cacheHits and seen, which are set by the handler.
+	mu := &sync.Mutex{}
+	var cacheHits []bool
+	var seen []string
+
+	p := mustNew(t, &Config{
+		Logger:        testLogger,
+		UDPListenAddr: []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{newProfileTestUpstream("192.0.2.1")},
+		},
+		TrustedProxies: defaultTrustedProxies,
+		CacheEnabled:   true,
+		CacheSizeBytes: defaultCacheSize,
+		AfterResponseHandler: &testAfterResponseHandler{
+			onHandleAfter: func(_ *Proxy, dctx *DNSContext) (err error) {
+				a := testutil.RequireTypeAssert[*dns.A](t, dctx.Res.Answer[0])
+
+				mu.Lock()
+				cacheHits = append(cacheHits, dctx.cacheHit)
+				seen = append(seen, a.A.String())
+				mu.Unlock()
+
+				a.A = rewrittenIP
+
+				return nil
+			},
+		},
+	})
+
+	ctx := context.Background()
+	require.NoError(t, p.Start(ctx))
+	testutil.CleanupAndRequireSuccess(t, func() (err error) { return p.Shutdown(ctx) })
+
+	client := &dns.Client{Net: string(ProtoUDP), Timeout: defaultTimeout}
+	for range 2 {
+		resp, _, err := client.Exchange(newHostTestMessage("after.example"), p.Addr(ProtoUDP).String())
+		require.NoError(t, err)
+		require.NotEmpty(t, resp.Answer)
+
+		a := testutil.RequireTypeAssert[*dns.A](t, resp.Answer[0])
+		assert.Equal(t, rewrittenIP, a.A.To4())
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	// The second response is served from the cache, which isn't affected by
+	// the rewriting.
+	assert.Equal(t, []bool{false, true}, cacheHits)
+	assert.Equal(t, []string{"192.0.2.1", "192.0.2.1"}, seen)
+}
+
+func TestMultiAfterResponseHandler(t *testing.T) {
+	var calls []int
+	newHandler := func(n int, err error) (h *testAfterResponseHandler) {
+		return &testAfterResponseHandler{
+			onHandleAfter: func(_ *Proxy, _ *DNSContext) (_ error) {
+				calls = append(calls, n)
+
+				return err
+			},
+		}
+	}
+
+	m := MultiAfterResponseHandler{
+		newHandler(1, nil),
+		newHandler(2, assert.AnError),
+		newHandler(3, nil),
+	}
+
+	err := m.HandleAfter(nil, &DNSContext{})
+	assert.ErrorIs(t, err, assert.AnError)
+	assert.Equal(t, []int{1, 2}, calls)
+}
@@ -0,0 +1,429 @@
+package proxy
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// defaultAnomalyWindow is the default duration of the window the
+	// statistics of a client are collected over.
+	defaultAnomalyWindow = 1 * time.Minute
+
+	// defaultAnomalyMinRequests is the default number of the requests from a
+	// client within a window required to detect an anomaly.
+	defaultAnomalyMinRequests = 50
+
+	// defaultAnomalyMaxClients is the default maximum number of the clients
+	// tracked at once.
+	defaultAnomalyMaxClients = 10_000
+)
+
+// AnomalyReason is the reason a client has been considered anomalous.
+type AnomalyReason string
+
+// Valid anomaly reasons.
+const (
+	// AnomalyReasonNXDomain means that too many of the requests of the client
+	// have been answered with NXDOMAIN, which is typical for the DGA malware
+	// probing the generated domains and for the subdomain enumeration.
+	AnomalyReasonNXDomain AnomalyReason = "nxdomain"
+
+	// AnomalyReasonEntropy means that the leftmost labels of the requested
+	// names look random, which is typical for the DGA malware and for the
+	// tunneling over DNS.
+	AnomalyReasonEntropy AnomalyReason = "entropy"
+)
+
+// Anomaly describes a client, the requests of which look like the ones of the
+// DGA malware or of a subdomain enumeration.
+type Anomaly struct {
+	// Addr is the address of the client.
+	Addr netip.Addr
+
+	// Reason is the threshold exceeded by the client.
+	Reason AnomalyReason
+
+	// Window is the duration the statistics have been collected over.
+	Window time.Duration
+
+	// Requests is the number of the requests from the client within the
+	// window.
+	Requests uint
+
+	// NXDomain is the number of the requests answered with NXDOMAIN.
+	NXDomain uint
+
+	// Entropy is the mean Shannon entropy of the leftmost labels of the
+	// requested names, in bits per character.
+	Entropy float64
+
+	// Throttled is true if the requests from the client are now refused, see
+	// [AnomalyConfig.ThrottleDuration].
+	Throttled bool
+}
+
+// AnomalyHandler is an object that receives the detected anomalies, for example
+// to alert the administrator.
+type AnomalyHandler interface {
+	// HandleAnomaly is called once a client exceeds any of the thresholds,
+	// at most once per window for each client.  It's called synchronously
+	// with the request processing, so it must not block.  a must not be
+	// modified.
+	HandleAnomaly(a *Anomaly)
+}
+
+// MultiAnomalyHandler is an [AnomalyHandler] that passes the anomalies to each
+// of the handlers in order.
+type MultiAnomalyHandler []AnomalyHandler
+
+// type check
+var _ AnomalyHandler = MultiAnomalyHandler(nil)
+
+// HandleAnomaly implements the [AnomalyHandler] interface for
+// MultiAnomalyHandler.
+func (m MultiAnomalyHandler) HandleAnomaly(a *Anomaly) {
+	for _, h := range m {
+		h.HandleAnomaly(a)
+	}
+}
+
+// AnomalyConfig is the configuration of the detection of the clients looking
+// like those running the DGA malware or enumerating subdomains.  The detected
+// anomalies are logged.
+type AnomalyConfig struct {
+	// Handler, if not nil, additionally receives the detected anomalies.
+	Handler AnomalyHandler
+
+	// Window is the duration the statistics of each client are collected
+	// over, after which those are reset.  Zero means the default of one
+	// minute.
+	Window time.Duration
+
+	// ThrottleDuration is the duration the requests from an anomalous client
+	// are refused for.  Zero disables the throttling.
+	ThrottleDuration time.Duration
+
+	// MinRequests is the number of the requests from a client within the
+	// window required to consider it anomalous, so that the occasional typos
+	// aren't.  Zero means the default of 50.
+	MinRequests uint
+
+	// MaxClients is the maximum number of the clients tracked at once.  The
+	// requests from the new clients aren't accounted while there are that many
+	// clients within their windows or throttled.  Zero means the default of
+	// 10000.
+	MaxClients uint
+
+	// MaxNXDomainRatio is the ratio of the requests answered with NXDOMAIN,
+	// exceeding which makes the client anomalous.  It must be within [0, 1],
+	// zero disabling the check.
+	MaxNXDomainRatio float64
+
+	// MaxEntropy is the mean Shannon entropy of the leftmost labels of the
+	// requested names in bits per character, exceeding which makes the client
+	// anomalous.  The generated labels usually exceed 3.5, while the ones
+	// chosen by people rarely do.  Zero disables the check.
+	MaxEntropy float64
+}
+
+// validate returns an error if c is invalid.  c may be nil.
+func (c *AnomalyConfig) validate() (err error) {
+	switch {
+	case c == nil:
+		return nil
+	case c.Window < 0:
+		return fmt.Errorf("window: negative value %s", c.Window)
+	case c.ThrottleDuration < 0:
+		return fmt.Errorf("throttle duration: negative value %s", c.ThrottleDuration)
+	case c.MaxNXDomainRatio < 0 || c.MaxNXDomainRatio > 1:
+		return fmt.Errorf("max nxdomain ratio: %v is not within [0, 1]", c.MaxNXDomainRatio)
+	case c.MaxEntropy < 0:
+		return fmt.Errorf("max entropy: negative value %v", c.MaxEntropy)
+	case c.MaxNXDomainRatio == 0 && c.MaxEntropy == 0:
+		return fmt.Errorf("no thresholds set")
+	default:
+		return nil
+	}
+}
+
+// clientAnomalyStats are the statistics of a single client within the current
+// window.
+type clientAnomalyStats struct {
+	// start is the start of the current window.
+	start time.Time
+
+	// throttledUntil is the time the throttling of the client expires at.
+	throttledUntil time.Time
+
+	// entropySum is the sum of the entropies of the leftmost labels.
+	entropySum float64
+
+	// requests is the number of the requests within the window.
+	requests uint
+
+	// nxdomain is the number of the requests answered with NXDOMAIN.
+	nxdomain uint
+
+	// reported is true if the anomaly has already been reported within the
+	// window.
+	reported bool
+}
+
+// anomalyDetector collects the statistics of the clients and detects the
+// anomalous ones.  A nil *anomalyDetector detects nothing.  All methods are
+// safe for concurrent use.
+type anomalyDetector struct {
+	// handler receives the detected anomalies.  It's never nil.
+	handler AnomalyHandler
+
+	// clock is used to track the windows and the throttling.
+	clock Clock
+
+	// mu protects clients.
+	mu *sync.Mutex
+
+	// clients are the statistics by the client addresses.
+	clients map[netip.Addr]*clientAnomalyStats
+
+	// conf is the configuration of the detection.
+	conf *AnomalyConfig
+
+	// window is the duration of the window.
+	window time.Duration
+
+	// minRequests is the minimum number of the requests within the window.
+	minRequests uint
+
+	// maxClients is the maximum number of the clients tracked at once.
+	maxClients int
+}
+
+// newAnomalyDetector returns a new detector for conf.  It returns nil if conf
+// is nil.  clock must not be nil.
+func newAnomalyDetector(conf *AnomalyConfig, clock Clock) (d *anomalyDetector) {
+	if conf == nil {
+		return nil
+	}
+
+	d = &anomalyDetector{
+		handler:     conf.Handler,
+		clock:       clock,
+		mu:          &sync.Mutex{},
+		clients:     map[netip.Addr]*clientAnomalyStats{},
+		conf:        conf,
+		window:      cmp.Or(conf.Window, defaultAnomalyWindow),
+		minRequests: cmp.Or(conf.MinRequests, defaultAnomalyMinRequests),
+		maxClients:  int(cmp.Or(conf.MaxClients, defaultAnomalyMaxClients)),
+	}
+
+	if d.handler == nil {
+		d.handler = MultiAnomalyHandler(nil)
+	}
+
+	return d
+}
+
+// isThrottled returns true if the requests from addr should be refused.
+func (d *anomalyDetector) isThrottled(addr netip.Addr) (ok bool) {
+	if d == nil || d.conf.ThrottleDuration == 0 {
+		return false
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	s := d.clients[addr.Unmap()]
+
+	return s != nil && d.clock.Now().Before(s.throttledUntil)
+}
+
+// observe accounts the request and the response of dctx and returns the
+// anomaly, if the client of dctx has just become anomalous.
+func (d *anomalyDetector) observe(dctx *DNSContext) (a *Anomaly) {
+	if d == nil || dctx.Res == nil || len(dctx.Req.Question) == 0 {
+		return nil
+	}
+
+	addr := dctx.Addr.Addr().Unmap()
+	entropy := labelEntropy(dctx.Req.Question[0].Name)
+	now := d.clock.Now()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	s := d.statsFor(addr, now)
+	if s == nil || now.Before(s.throttledUntil) {
+		return nil
+	}
+
+	s.requests++
+	s.entropySum += entropy
+	if dctx.Res.Rcode == dns.RcodeNameError {
+		s.nxdomain++
+	}
+
+	if s.reported || s.requests < d.minRequests {
+		return nil
+	}
+
+	a = d.detect(addr, s)
+	if a == nil {
+		return nil
+	}
+
+	s.reported = true
+	if a.Throttled {
+		s.throttledUntil = now.Add(d.conf.ThrottleDuration)
+	}
+
+	return a
+}
+
+// statsFor returns the statistics of addr within the window containing now,
+// creating those if needed.  s is nil if there are too many clients tracked.
+// d.mu must be locked.
+func (d *anomalyDetector) statsFor(addr netip.Addr, now time.Time) (s *clientAnomalyStats) {
+	s = d.clients[addr]
+	if s != nil {
+		if now.Sub(s.start) >= d.window {
+			*s = clientAnomalyStats{
+				start:          now,
+				throttledUntil: s.throttledUntil,
+			}
+		}
+
+		return s
+	}
+
+	if len(d.clients) >= d.maxClients {
+		d.removeStale(now)
+		if len(d.clients) >= d.maxClients {
+			return nil
+		}
+	}
+
+	s = &clientAnomalyStats{
+		start: now,
+	}
+	d.clients[addr] = s
+
+	return s
+}
+
+// removeStale removes the clients the windows and the throttling of which have
+// expired by now.  d.mu must be locked.
+func (d *anomalyDetector) removeStale(now time.Time) {
+	for addr, s := range d.clients {
+		if now.Sub(s.start) >= d.window && !now.Before(s.throttledUntil) {
+			delete(d.clients, addr)
+		}
+	}
+}
+
+// detect returns the anomaly of the client with addr and statistics s, if any
+// of the thresholds is exceeded.  d.mu must be locked.
+func (d *anomalyDetector) detect(addr netip.Addr, s *clientAnomalyStats) (a *Anomaly) {
+	a = &Anomaly{
+		Addr:      addr,
+		Window:    d.window,
+		Requests:  s.requests,
+		NXDomain:  s.nxdomain,
+		Entropy:   s.entropySum / float64(s.requests),
+		Throttled: d.conf.ThrottleDuration > 0,
+	}
+
+	switch {
+	case d.conf.MaxNXDomainRatio > 0 &&
+		float64(s.nxdomain)/float64(s.requests) > d.conf.MaxNXDomainRatio:
+		a.Reason = AnomalyReasonNXDomain
+	case d.conf.MaxEntropy > 0 && a.Entropy > d.conf.MaxEntropy:
+		a.Reason = AnomalyReasonEntropy
+	default:
+		return nil
+	}
+
+	return a
+}
+
+// labelEntropy returns the Shannon entropy of the leftmost label of the
+// case-insensitive name in bits per character.
+func labelEntropy(name string) (entropy float64) {
+	label, _, _ := strings.Cut(name, ".")
+	if label == "" {
+		return 0
+	}
+
+	var counts [256]uint
+	for i := range len(label) {
+		c := label[i]
+		if 'A' <= c && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+
+		counts[c]++
+	}
+
+	n := float64(len(label))
+	for _, c := range counts {
+		if c == 0 {
+			continue
+		}
+
+		p := float64(c) / n
+		entropy -= p * math.Log2(p)
+	}
+
+	return entropy
+}
+
+// textThrottled is the text of the extended DNS error of the responses to the
+// requests of the throttled anomalous clients.
+const textThrottled = "client is throttled"
+
+// checkAnomalous returns the REFUSED response to the request of d if its client
+// is throttled as anomalous, or nil otherwise.
+func (p *Proxy) checkAnomalous(d *DNSContext) (resp *dns.Msg) {
+	if !p.anomalies.isThrottled(d.Addr.Addr()) {
+		return nil
+	}
+
+	p.logger.Debug(
+		"refusing request",
+		"reason", textThrottled,
+		"addr", p.anonymizer.addrPort(d.Addr),
+	)
+
+	resp = reply(d.Req, dns.RcodeRefused)
+	addEDE(d.Req, resp, dns.ExtendedErrorCodeProhibited, textThrottled)
+
+	return resp
+}
+
+// observeAnomalies accounts the processed request of d and reports the
+// anomaly, if its client has just become anomalous.
+func (p *Proxy) observeAnomalies(d *DNSContext) {
+	a := p.anomalies.observe(d)
+	if a == nil {
+		return
+	}
+
+	p.logger.Warn(
+		"anomalous client",
+		"addr", p.anonymizer.addr(a.Addr),
+		"reason", a.Reason,
+		"requests", a.Requests,
+		"nxdomain", a.NXDomain,
+		"entropy", a.Entropy,
+		"throttled", a.Throttled,
+	)
+
+	p.anomalies.handler.HandleAnomaly(a)
+}
@@ -0,0 +1,145 @@
+package proxy
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// anomalyHandlerFunc is the function-based implementation of the
+// [AnomalyHandler] interface.
+type anomalyHandlerFunc func(a *Anomaly)
+
+// type check
+var _ AnomalyHandler = anomalyHandlerFunc(nil)
+
+// HandleAnomaly implements the [AnomalyHandler] interface for
+// anomalyHandlerFunc.
+func (f anomalyHandlerFunc) HandleAnomaly(a *Anomaly) { f(a) }
+
+func TestProxy_anomalies(t *testing.T) {
+	const (
+		minRequests = 4
+		throttle    = 10 * time.Minute
+	)
+
+	now := time.Now()
+	clock := &fakeClock{onNow: func() (t time.Time) { return now }}
+
+	ups := &fakeUpstream{
+		onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			return (&dns.Msg{}).SetRcode(req, dns.RcodeNameError), nil
+		},
+		onAddress: func() (addr string) { return "nxdomain" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	var anomalies []*Anomaly
+	p := mustNew(t, &Config{
+		Logger:         testLogger,
+		UpstreamConfig: &UpstreamConfig{Upstreams: []upstream.Upstream{ups}},
+		Clock:          clock,
+		Anomalies: &AnomalyConfig{
+			Handler:          anomalyHandlerFunc(func(a *Anomaly) { anomalies = append(anomalies, a) }),
+			ThrottleDuration: throttle,
+			MinRequests:      minRequests,
+			MaxNXDomainRatio: 0.5,
+		},
+	})
+
+	cliAddr := netip.MustParseAddrPort("192.0.2.1:53")
+	resolve := func(t *testing.T) (resp *dns.Msg) {
+		t.Helper()
+
+		d := &DNSContext{
+			Req:  newHostTestMessage("qx7kz9wd.example"),
+			Addr: cliAddr,
+		}
+
+		require.NoError(t, p.handleDNSRequest(d))
+		require.NotNil(t, d.Res)
+
+		return d.Res
+	}
+
+	for range minRequests - 1 {
+		assert.Equal(t, dns.RcodeNameError, resolve(t).Rcode)
+	}
+
+	assert.Empty(t, anomalies)
+
+	assert.Equal(t, dns.RcodeNameError, resolve(t).Rcode)
+	require.Len(t, anomalies, 1)
+
+	a := anomalies[0]
+	assert.Equal(t, cliAddr.Addr(), a.Addr)
+	assert.Equal(t, AnomalyReasonNXDomain, a.Reason)
+	assert.Equal(t, uint(minRequests), a.Requests)
+	assert.Equal(t, uint(minRequests), a.NXDomain)
+	assert.True(t, a.Throttled)
+
+	assert.Equal(t, dns.RcodeRefused, resolve(t).Rcode)
+
+	now = now.Add(throttle)
+	assert.Equal(t, dns.RcodeNameError, resolve(t).Rcode)
+	assert.Len(t, anomalies, 1)
+}
+
+func TestAnomalyDetector_maxClients(t *testing.T) {
+	const window = time.Minute
+
+	now := time.Now()
+	d := newAnomalyDetector(&AnomalyConfig{
+		Window:           window,
+		MaxClients:       1,
+		MaxNXDomainRatio: 0.5,
+	}, &fakeClock{onNow: func() (t time.Time) { return now }})
+
+	first, second := netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("192.0.2.2")
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	require.NotNil(t, d.statsFor(first, now))
+	assert.Nil(t, d.statsFor(second, now))
+
+	// The first client is removed once its window expires.
+	now = now.Add(window)
+	assert.NotNil(t, d.statsFor(second, now))
+	assert.NotContains(t, d.clients, first)
+}
+
+func TestLabelEntropy(t *testing.T) {
+	testCases := []struct {
+		name string
+		in   string
+		want float64
+	}{{
+		name: "empty",
+		in:   ".",
+		want: 0,
+	}, {
+		name: "single_char",
+		in:   "aaaa.example.",
+		want: 0,
+	}, {
+		name: "two_chars",
+		in:   "abAB.example.",
+		want: 1,
+	}, {
+		name: "distinct",
+		in:   "abcdefgh.example.",
+		want: 3,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.InDelta(t, tc.want, labelEntropy(tc.in), 1e-9)
+		})
+	}
+}
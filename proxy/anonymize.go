@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"net/netip"
+)
+
+// ClientAnonymization defines how the client addresses are anonymized in the
+// log and the query log output.  The real addresses are still used internally,
+// for example for ratelimiting and EDNS Client Subnet, and passed to the
+// [MessageTap], unless [Config.PrivacyMode] is set.
+type ClientAnonymization string
+
+// ClientAnonymization values.
+const (
+	// ClientAnonymizationNone means that the client addresses are output as
+	// is.
+	ClientAnonymizationNone ClientAnonymization = ""
+
+	// ClientAnonymizationTruncate means that the client addresses are
+	// truncated to /24 for IPv4 and to /56 for IPv6.
+	ClientAnonymizationTruncate ClientAnonymization = "truncate"
+
+	// ClientAnonymizationHash means that the client addresses are replaced with
+	// the addresses of the same family derived from their keyed hashes.  The
+	// key is random, so the same address has the same replacement until the
+	// proxy is recreated.
+	ClientAnonymizationHash ClientAnonymization = "hash"
+)
+
+// Prefix lengths of the truncated client addresses.
+const (
+	anonymizedPrefixLenIPv4 = 24
+	anonymizedPrefixLenIPv6 = 56
+)
+
+// clientAnonymizer anonymizes the client addresses for output.  The zero value
+// doesn't anonymize the addresses.
+type clientAnonymizer struct {
+	// key is the key of the hash, it's only set for
+	// [ClientAnonymizationHash].
+	key []byte
+
+	// mode is the way the addresses are anonymized.
+	mode ClientAnonymization
+}
+
+// newClientAnonymizer returns a new clientAnonymizer for mode.
+func newClientAnonymizer(mode ClientAnonymization) (a clientAnonymizer, err error) {
+	switch mode {
+	case ClientAnonymizationNone, ClientAnonymizationTruncate:
+		return clientAnonymizer{mode: mode}, nil
+	case ClientAnonymizationHash:
+		key := make([]byte, sha256.Size)
+		_, err = rand.Read(key)
+		if err != nil {
+			return clientAnonymizer{}, fmt.Errorf("generating hash key: %w", err)
+		}
+
+		return clientAnonymizer{mode: mode, key: key}, nil
+	default:
+		return clientAnonymizer{}, fmt.Errorf("unknown client anonymization %q", mode)
+	}
+}
+
+// addr returns the anonymized ip.
+func (a clientAnonymizer) addr(ip netip.Addr) (res netip.Addr) {
+	if !ip.IsValid() {
+		return ip
+	}
+
+	switch a.mode {
+	case ClientAnonymizationTruncate:
+		bits := anonymizedPrefixLenIPv6
+		if ip.Is4() || ip.Is4In6() {
+			ip, bits = ip.Unmap(), anonymizedPrefixLenIPv4
+		}
+
+		return netip.PrefixFrom(ip, bits).Masked().Addr()
+	case ClientAnonymizationHash:
+		ip = ip.Unmap()
+
+		h := hmac.New(sha256.New, a.key)
+		_, _ = h.Write(ip.AsSlice())
+		sum := h.Sum(nil)
+
+		if ip.Is4() {
+			return netip.AddrFrom4([4]byte(sum))
+		}
+
+		return netip.AddrFrom16([16]byte(sum))
+	default:
+		return ip
+	}
+}
+
+// addrPort returns the anonymized addr.  The port is dropped, if the address is
+// anonymized, since it may help to identify the client as well.
+func (a clientAnonymizer) addrPort(addr netip.AddrPort) (res netip.AddrPort) {
+	if a.mode == ClientAnonymizationNone || !addr.IsValid() {
+		return addr
+	}
+
+	return netip.AddrPortFrom(a.addr(addr.Addr()), 0)
+}
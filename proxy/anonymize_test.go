@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientAnonymizer(t *testing.T) {
+	var (
+		addr4 = netip.MustParseAddrPort("192.0.2.123:5353")
+		addr6 = netip.MustParseAddrPort("[2001:db8:1:2:3::4]:5353")
+	)
+
+	t.Run("none", func(t *testing.T) {
+		a, err := newClientAnonymizer(ClientAnonymizationNone)
+		require.NoError(t, err)
+
+		assert.Equal(t, addr4, a.addrPort(addr4))
+		assert.Equal(t, addr6, a.addrPort(addr6))
+	})
+
+	t.Run("truncate", func(t *testing.T) {
+		a, err := newClientAnonymizer(ClientAnonymizationTruncate)
+		require.NoError(t, err)
+
+		assert.Equal(t, netip.MustParseAddrPort("192.0.2.0:0"), a.addrPort(addr4))
+		assert.Equal(t, netip.MustParseAddrPort("[2001:db8:1::]:0"), a.addrPort(addr6))
+
+		mapped := netip.AddrPortFrom(netip.AddrFrom16(addr4.Addr().As16()), 53)
+		assert.Equal(t, netip.MustParseAddrPort("192.0.2.0:0"), a.addrPort(mapped))
+	})
+
+	t.Run("hash", func(t *testing.T) {
+		a, err := newClientAnonymizer(ClientAnonymizationHash)
+		require.NoError(t, err)
+
+		got4 := a.addrPort(addr4)
+		assert.True(t, got4.Addr().Is4())
+		assert.NotEqual(t, addr4.Addr(), got4.Addr())
+		assert.Zero(t, got4.Port())
+		assert.Equal(t, got4, a.addrPort(addr4))
+
+		got6 := a.addrPort(addr6)
+		assert.True(t, got6.Addr().Is6())
+		assert.NotEqual(t, addr6.Addr(), got6.Addr())
+
+		other, err := newClientAnonymizer(ClientAnonymizationHash)
+		require.NoError(t, err)
+
+		assert.NotEqual(t, got4, other.addrPort(addr4))
+	})
+
+	t.Run("invalid_addr", func(t *testing.T) {
+		a, err := newClientAnonymizer(ClientAnonymizationHash)
+		require.NoError(t, err)
+
+		assert.Equal(t, netip.AddrPort{}, a.addrPort(netip.AddrPort{}))
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		_, err := newClientAnonymizer("bad")
+		assert.Error(t, err)
+	})
+}
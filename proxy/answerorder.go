@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net/netip"
+	"slices"
+
+	"github.com/miekg/dns"
+)
+
+// AnswerOrder defines the order of the address records in the responses
+// received from the upstreams.
+type AnswerOrder string
+
+// AnswerOrder values.
+const (
+	// AnswerOrderUpstream keeps the order the upstream has returned the
+	// records in.
+	AnswerOrderUpstream AnswerOrder = "upstream"
+
+	// AnswerOrderShuffle shuffles the address records randomly, so that the
+	// clients using the first address are distributed among the hosts.
+	AnswerOrderShuffle AnswerOrder = "shuffle"
+
+	// AnswerOrderSort sorts the address records by the address, the IPv4 ones
+	// first, so that the responses are stable.
+	AnswerOrderSort AnswerOrder = "sort"
+)
+
+// Validate returns an error if o is not a valid answer order.
+func (o AnswerOrder) Validate() (err error) {
+	switch o {
+	case "", AnswerOrderUpstream, AnswerOrderShuffle, AnswerOrderSort:
+		return nil
+	default:
+		return fmt.Errorf("unknown value %q", string(o))
+	}
+}
+
+// orderAnswers reorders the A and AAAA records of the answer section of resp
+// according to [Config.AnswerOrder].  The other records, like the CNAME ones
+// leading to the addresses, keep their positions.
+func (p *Proxy) orderAnswers(resp *dns.Msg) {
+	if resp == nil {
+		return
+	}
+
+	switch p.AnswerOrder {
+	case AnswerOrderShuffle:
+		reorderAddrs(resp.Answer, func(rrs []dns.RR) {
+			rand.Shuffle(len(rrs), func(i, j int) { rrs[i], rrs[j] = rrs[j], rrs[i] })
+		})
+	case AnswerOrderSort:
+		reorderAddrs(resp.Answer, func(rrs []dns.RR) {
+			slices.SortStableFunc(rrs, func(a, b dns.RR) (res int) {
+				return rrAddr(a).Compare(rrAddr(b))
+			})
+		})
+	default:
+		// Keep the upstream order.
+	}
+}
+
+// reorderAddrs calls reorder with the A and AAAA records of rrs and puts the
+// reordered records back into the positions of the original ones.
+func reorderAddrs(rrs []dns.RR, reorder func(addrs []dns.RR)) {
+	var idxs []int
+	var addrs []dns.RR
+	for i, rr := range rrs {
+		switch rr.(type) {
+		case *dns.A, *dns.AAAA:
+			idxs = append(idxs, i)
+			addrs = append(addrs, rr)
+		default:
+			// Go on.
+		}
+	}
+
+	if len(addrs) < 2 {
+		return
+	}
+
+	reorder(addrs)
+
+	for i, idx := range idxs {
+		rrs[idx] = addrs[i]
+	}
+}
+
+// rrAddr returns the address of the A or AAAA record rr.
+func rrAddr(rr dns.RR) (addr netip.Addr) {
+	switch rr := rr.(type) {
+	case *dns.A:
+		addr, _ = netip.AddrFromSlice(rr.A.To4())
+	case *dns.AAAA:
+		addr, _ = netip.AddrFromSlice(rr.AAAA)
+	}
+
+	return addr
+}
@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_orderAnswers(t *testing.T) {
+	const (
+		name   = "host.example."
+		target = "target.example."
+	)
+
+	newAnswer := func(t *testing.T) (rrs []dns.RR) {
+		t.Helper()
+
+		return []dns.RR{
+			newRR(t, name, dns.TypeCNAME, 60, target),
+			newRR(t, target, dns.TypeAAAA, 60, net.ParseIP("2001:db8::1")),
+			newRR(t, target, dns.TypeA, 60, net.IP{192, 0, 2, 3}),
+			newRR(t, target, dns.TypeA, 60, net.IP{192, 0, 2, 1}),
+			newRR(t, target, dns.TypeA, 60, net.IP{192, 0, 2, 2}),
+		}
+	}
+
+	ups := &fakeUpstream{
+		onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			resp = (&dns.Msg{}).SetReply(req)
+			resp.Answer = newAnswer(t)
+
+			return resp, nil
+		},
+		onAddress: func() (addr string) { return "ordered" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	testCases := []struct {
+		name  string
+		order AnswerOrder
+		want  []dns.RR
+	}{{
+		name:  "upstream",
+		order: AnswerOrderUpstream,
+		want:  newAnswer(t),
+	}, {
+		name:  "sort",
+		order: AnswerOrderSort,
+		want: []dns.RR{
+			newRR(t, name, dns.TypeCNAME, 60, target),
+			newRR(t, target, dns.TypeA, 60, net.IP{192, 0, 2, 1}),
+			newRR(t, target, dns.TypeA, 60, net.IP{192, 0, 2, 2}),
+			newRR(t, target, dns.TypeA, 60, net.IP{192, 0, 2, 3}),
+			newRR(t, target, dns.TypeAAAA, 60, net.ParseIP("2001:db8::1")),
+		},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := mustNew(t, &Config{
+				Logger:         testLogger,
+				UpstreamConfig: &UpstreamConfig{Upstreams: []upstream.Upstream{ups}},
+				CacheEnabled:   true,
+				CacheSizeBytes: defaultCacheSize,
+				AnswerOrder:    tc.order,
+			})
+
+			d := &DNSContext{Req: (&dns.Msg{}).SetQuestion(name, dns.TypeA)}
+			require.NoError(t, p.Resolve(d))
+			require.NotNil(t, d.Res)
+
+			assert.Equal(t, rrStrings(tc.want), rrStrings(d.Res.Answer))
+
+			// The cached response keeps the upstream order.
+			ci, _, _ := p.cache.get(d.Req, nil)
+			require.NotNil(t, ci)
+
+			assert.Equal(t, rrStrings(newAnswer(t)), rrStrings(ci.m.Answer))
+		})
+	}
+
+	t.Run("shuffle", func(t *testing.T) {
+		p := mustNew(t, &Config{
+			Logger:         testLogger,
+			UpstreamConfig: &UpstreamConfig{Upstreams: []upstream.Upstream{ups}},
+			AnswerOrder:    AnswerOrderShuffle,
+		})
+
+		d := &DNSContext{Req: (&dns.Msg{}).SetQuestion(name, dns.TypeA)}
+		require.NoError(t, p.Resolve(d))
+		require.NotNil(t, d.Res)
+
+		require.Len(t, d.Res.Answer, 5)
+		want := rrStrings(newAnswer(t))
+		got := rrStrings(d.Res.Answer)
+		assert.Equal(t, want[0], got[0])
+		assert.ElementsMatch(t, want[1:], got[1:])
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := New(&Config{
+			Logger:         testLogger,
+			UpstreamConfig: &UpstreamConfig{Upstreams: []upstream.Upstream{ups}},
+			AnswerOrder:    "random",
+		})
+		testutil.AssertErrorMsg(t, `validating answer order: unknown value "random"`, err)
+	})
+}
+
+// rrStrings returns the string representations of rrs.
+func rrStrings(rrs []dns.RR) (strs []string) {
+	for _, rr := range rrs {
+		strs = append(strs, rr.String())
+	}
+
+	return strs
+}
@@ -0,0 +1,231 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"net/netip"
+	"sync"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+)
+
+// defaultBatchWorkers is the default number of the queries of a batch resolved
+// simultaneously.
+const defaultBatchWorkers = 16
+
+// BatchOptions are the options for [Proxy.ResolveBatch].
+type BatchOptions struct {
+	// Addr is the client address the queries are considered sent from.  It's
+	// used to choose the upstreams and the ECS subnet, just like for the
+	// queries received by the proxy.  It may be empty.
+	Addr netip.AddrPort
+
+	// Proto is the protocol the queries are considered received over.  Empty
+	// value means [ProtoUDP].
+	Proto Proto
+
+	// Workers is the maximum number of the queries resolved simultaneously.
+	// Zero means the default of 16.
+	Workers uint
+}
+
+// proto returns the protocol of the queries.  o may be nil.
+func (o *BatchOptions) proto() (proto Proto) {
+	if o == nil || o.Proto == "" {
+		return ProtoUDP
+	}
+
+	return o.Proto
+}
+
+// workers returns the maximum number of the queries resolved simultaneously.
+// o may be nil.
+func (o *BatchOptions) workers() (n uint) {
+	if o == nil || o.Workers == 0 {
+		return defaultBatchWorkers
+	}
+
+	return o.Workers
+}
+
+// addr returns the client address of the queries.  o may be nil.
+func (o *BatchOptions) addr() (addr netip.AddrPort) {
+	if o == nil {
+		return netip.AddrPort{}
+	}
+
+	return o.Addr
+}
+
+// BatchResult is the result of resolving a single query of a batch.
+type BatchResult struct {
+	// Res is the response to the query.  It may be nil if Err is not nil.
+	Res *dns.Msg
+
+	// Upstream is the upstream which resolved the query.  It's nil if the
+	// response has been taken from the cache or no upstream has been chosen.
+	Upstream upstream.Upstream
+
+	// Result is the information about resolving the query, see
+	// [DNSContext.Result].  It's nil if Res is nil.
+	Result *ResolveResult
+
+	// Err is the error of resolving the query, if any.
+	Err error
+}
+
+// ResolveBatch resolves reqs concurrently, just like [Proxy.Resolve] does, and
+// returns the results in the same order.  The identical queries within the
+// batch are only resolved once, and the responses to them differ only in ID.
+// The queries not started by the time ctx is canceled fail with its error, and
+// the exchanges of the ones in progress are aborted.
+// opts may be nil, in which case the defaults are used.  reqs must not be
+// modified until ResolveBatch returns.
+func (p *Proxy) ResolveBatch(
+	ctx context.Context,
+	reqs []*dns.Msg,
+	opts *BatchOptions,
+) (results []BatchResult) {
+	results = make([]BatchResult, len(reqs))
+	primaries, dups := groupBatch(reqs)
+
+	jobs := make(chan int)
+	wg := &sync.WaitGroup{}
+	for range min(opts.workers(), uint(len(primaries))) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for i := range jobs {
+				results[i] = p.resolveBatchItem(ctx, reqs[i], opts)
+			}
+		}()
+	}
+
+	for _, i := range primaries {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	for i, idxs := range dups {
+		for _, j := range idxs {
+			results[j] = results[i]
+			if res := results[i].Res; res != nil {
+				results[j].Res = res.Copy()
+				results[j].Res.Id = reqs[j].Id
+			}
+		}
+	}
+
+	return results
+}
+
+// resolveBatchItem resolves a single query of a batch.
+func (p *Proxy) resolveBatchItem(
+	ctx context.Context,
+	req *dns.Msg,
+	opts *BatchOptions,
+) (r BatchResult) {
+	err := ctx.Err()
+	if err != nil {
+		return BatchResult{Err: err}
+	}
+
+	d := p.newDNSContext(opts.proto(), req)
+	d.Addr = opts.addr()
+
+	r.Err = p.ResolveContext(ctx, d)
+	r.Res, r.Upstream, r.Result = d.Res, d.Upstream, d.Result()
+	p.releaseDNSContext(d)
+
+	return r
+}
+
+// groupBatch groups the identical queries of reqs.  primaries are the indexes
+// of the queries to resolve, and dups maps some of those to the indexes of the
+// queries identical to them.
+func groupBatch(reqs []*dns.Msg) (primaries []int, dups map[int][]int) {
+	primaries = make([]int, 0, len(reqs))
+	seen := make(map[string]int, len(reqs))
+	for i, req := range reqs {
+		key, ok := batchKey(req)
+		if !ok {
+			primaries = append(primaries, i)
+
+			continue
+		}
+
+		first, ok := seen[key]
+		if !ok {
+			seen[key] = i
+			primaries = append(primaries, i)
+
+			continue
+		}
+
+		if dups == nil {
+			dups = map[int][]int{}
+		}
+
+		dups[first] = append(dups[first], i)
+	}
+
+	return primaries, dups
+}
+
+// Flags of the batch keys.
+const (
+	batchFlagRD byte = 1 << iota
+	batchFlagCD
+	batchFlagAD
+	batchFlagEDNS
+	batchFlagDO
+)
+
+// batchKey returns the key identifying the queries with identical responses.
+// Unlike the cache key, it keeps the case of the name, since the responses
+// should echo the question as is, and the UDP payload size, since the responses
+// are truncated to it.  ok is false if req shouldn't be deduplicated, e.g. if it
+// has EDNS options, which may change the response.
+func batchKey(req *dns.Msg) (key string, ok bool) {
+	if len(req.Question) != 1 || req.Opcode != dns.OpcodeQuery {
+		return "", false
+	}
+
+	var flags byte
+	var size uint16
+	if req.RecursionDesired {
+		flags |= batchFlagRD
+	}
+
+	if req.CheckingDisabled {
+		flags |= batchFlagCD
+	}
+
+	if req.AuthenticatedData {
+		flags |= batchFlagAD
+	}
+
+	if opt := req.IsEdns0(); opt != nil {
+		if len(opt.Option) > 0 {
+			return "", false
+		}
+
+		flags |= batchFlagEDNS
+		size = opt.UDPSize()
+		if opt.Do() {
+			flags |= batchFlagDO
+		}
+	}
+
+	q := req.Question[0]
+	b := make([]byte, 0, 7+len(q.Name))
+	b = append(b, flags)
+	b = binary.BigEndian.AppendUint16(b, size)
+	b = binary.BigEndian.AppendUint16(b, q.Qtype)
+	b = binary.BigEndian.AppendUint16(b, q.Qclass)
+
+	return string(append(b, q.Name...)), true
+}
@@ -0,0 +1,148 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_ResolveBatch(t *testing.T) {
+	var exchanges atomic.Int32
+	u := newProfileTestUpstream("192.0.2.1")
+	u.onExchange = func(req *dns.Msg) (resp *dns.Msg, err error) {
+		exchanges.Add(1)
+
+		return newCompareTestReply(req, "192.0.2.1", defaultTestTTL), nil
+	}
+
+	p := mustNew(t, &Config{
+		Logger:         testLogger,
+		UDPListenAddr:  []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig: &UpstreamConfig{Upstreams: []upstream.Upstream{u}},
+		TrustedProxies: defaultTrustedProxies,
+	})
+
+	newReq := func(host string, id uint16) (req *dns.Msg) {
+		req = newHostTestMessage(host)
+		req.Id = id
+
+		return req
+	}
+
+	t.Run("dedup", func(t *testing.T) {
+		exchanges.Store(0)
+
+		reqs := []*dns.Msg{
+			newReq("example.org", 1),
+			newReq("EXAMPLE.org", 2),
+			newReq("example.net", 3),
+			newReq("example.org", 4),
+		}
+
+		results := p.ResolveBatch(context.Background(), reqs, &BatchOptions{Workers: 2})
+		require.Len(t, results, len(reqs))
+
+		for i, r := range results {
+			require.NoError(t, r.Err)
+			require.NotNil(t, r.Res)
+
+			assert.Equal(t, reqs[i].Id, r.Res.Id)
+			assert.Equal(t, reqs[i].Question[0].Name, r.Res.Answer[0].Header().Name)
+			assert.Same(t, u, r.Upstream)
+		}
+
+		assert.Equal(t, int32(3), exchanges.Load())
+		assert.NotSame(t, results[0].Res, results[3].Res)
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		exchanges.Store(0)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		reqs := []*dns.Msg{newReq("example.org", 1), newReq("example.net", 2)}
+		results := p.ResolveBatch(ctx, reqs, nil)
+		require.Len(t, results, len(reqs))
+
+		for _, r := range results {
+			assert.ErrorIs(t, r.Err, context.Canceled)
+			assert.Nil(t, r.Res)
+		}
+
+		assert.Zero(t, exchanges.Load())
+	})
+
+	t.Run("canceled_in_progress", func(t *testing.T) {
+		hanging := newHangingUpstream("hanging")
+		hp := mustNew(t, &Config{
+			Logger:         testLogger,
+			UDPListenAddr:  []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+			UpstreamConfig: &UpstreamConfig{Upstreams: []upstream.Upstream{hanging}},
+			TrustedProxies: defaultTrustedProxies,
+		})
+
+		const timeout = 100 * time.Millisecond
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		t.Cleanup(cancel)
+
+		reqs := []*dns.Msg{newReq("example.org", 1), newReq("example.net", 2)}
+
+		start := time.Now()
+		results := hp.ResolveBatch(ctx, reqs, nil)
+		assert.Less(t, time.Since(start), 10*timeout)
+
+		require.Len(t, results, len(reqs))
+
+		for _, r := range results {
+			assert.ErrorIs(t, r.Err, context.DeadlineExceeded)
+		}
+
+		assert.Equal(t, int32(len(reqs)), hanging.exchanges.Load())
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		assert.Empty(t, p.ResolveBatch(context.Background(), nil, nil))
+	})
+}
+
+func TestBatchKey(t *testing.T) {
+	base := newHostTestMessage("example.org")
+
+	key, ok := batchKey(base)
+	require.True(t, ok)
+
+	other := newHostTestMessage("example.org")
+	other.Id = base.Id + 1
+
+	got, ok := batchKey(other)
+	require.True(t, ok)
+	assert.Equal(t, key, got)
+
+	got, ok = batchKey(newHostTestMessage("EXAMPLE.ORG"))
+	require.True(t, ok)
+	assert.NotEqual(t, key, got)
+
+	withDO := newHostTestMessage("example.org")
+	withDO.SetEdns0(dns.DefaultMsgSize, true)
+
+	got, ok = batchKey(withDO)
+	require.True(t, ok)
+	assert.NotEqual(t, key, got)
+
+	withECS := newHostTestMessage("example.org")
+	withECS.SetEdns0(dns.DefaultMsgSize, false)
+	opt := withECS.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1})
+
+	_, ok = batchKey(withECS)
+	assert.False(t, ok)
+}
@@ -4,7 +4,7 @@ import (
 	"fmt"
 
 	"github.com/AdguardTeam/golibs/errors"
-	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
 	"github.com/miekg/dns"
 )
 
@@ -44,7 +44,13 @@ type BeforeRequestHandler interface {
 	//
 	// If returned err is a [BeforeRequestError], the given response message is
 	// used.  If err is nil, the request is processed further.  [Proxy] assumes
-	// a handler itself doesn't set the [DNSContext.Res] field.
+	// a handler itself doesn't set the [DNSContext.Res] field, but it may
+	// annotate the request with [DNSContext.SetValue] for the later stages.
+	//
+	// The handlers performing the blocking operations should abort them once
+	// the context returned by [DNSContext.Context] is canceled.  dctx must not
+	// be retained after HandleBefore returns if
+	// [Config.EnableDNSContextPooling] is set.
 	HandleBefore(p *Proxy, dctx *DNSContext) (err error)
 }
 
@@ -61,17 +67,39 @@ func (noopRequestHandler) HandleBefore(_ *Proxy, _ *DNSContext) (err error) {
 	return nil
 }
 
+// MultiBeforeRequestHandler is a [BeforeRequestHandler] that calls each of the
+// handlers in order until one of them returns an error.
+type MultiBeforeRequestHandler []BeforeRequestHandler
+
+// type check
+var _ BeforeRequestHandler = MultiBeforeRequestHandler(nil)
+
+// HandleBefore implements the [BeforeRequestHandler] interface for
+// MultiBeforeRequestHandler.
+func (m MultiBeforeRequestHandler) HandleBefore(p *Proxy, dctx *DNSContext) (err error) {
+	for _, h := range m {
+		err = h.HandleBefore(p, dctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 // handleBefore calls the [BeforeRequestHandler] if it's set.  If the returned
 // error is nil, it returns true and the request is processed further.  If the
 // returned error has type [BeforeRequestError], the specified response is sent
 // to the client.  Otherwise, the request just ignored.
 func (p *Proxy) handleBefore(d *DNSContext) (cont bool) {
+	span := p.startChildSpan(d, spanBefore)
 	err := p.beforeRequestHandler.HandleBefore(p, d)
+	endSpanWithErr(span, err)
 	if err == nil {
 		return true
 	}
 
-	log.Debug("dnsproxy: handling before request: %s", err)
+	p.logger.Debug("handling before request", slogutil.KeyError, err)
 
 	if befReqErr := (&BeforeRequestError{}); errors.As(err, &befReqErr) {
 		d.Res = befReqErr.Response
@@ -120,3 +120,30 @@ func TestProxy_HandleDNSRequest_beforeRequestHandler(t *testing.T) {
 		assert.Equal(t, errorResponse, resp)
 	})
 }
+
+func TestMultiBeforeRequestHandler(t *testing.T) {
+	t.Parallel()
+
+	const errTest errors.Error = "test error"
+
+	var calls []int
+	newHandler := func(n int, err error) (h *testBeforeRequestHandler) {
+		return &testBeforeRequestHandler{
+			onHandleBefore: func(_ *Proxy, _ *DNSContext) (herr error) {
+				calls = append(calls, n)
+
+				return err
+			},
+		}
+	}
+
+	m := MultiBeforeRequestHandler{
+		newHandler(1, nil),
+		newHandler(2, errTest),
+		newHandler(3, nil),
+	}
+
+	err := m.HandleBefore(nil, &DNSContext{})
+	assert.ErrorIs(t, err, errTest)
+	assert.Equal(t, []int{1, 2}, calls)
+}
@@ -3,6 +3,8 @@ package proxy
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
+	"log/slog"
 	"math"
 	"net"
 	"slices"
@@ -12,8 +14,8 @@ import (
 
 	"github.com/AdguardTeam/dnsproxy/upstream"
 	glcache "github.com/AdguardTeam/golibs/cache"
-	"github.com/AdguardTeam/golibs/log"
 	"github.com/AdguardTeam/golibs/mathutil"
+	"github.com/AdguardTeam/golibs/syncutil"
 	"github.com/miekg/dns"
 )
 
@@ -28,12 +30,35 @@ type cache struct {
 	// itemsWithSubnetLock protects requests cache.
 	itemsWithSubnetLock *sync.RWMutex
 
+	// flushesLock protects flushes.
+	flushesLock *sync.RWMutex
+
 	// items is the requests cache.
 	items glcache.Cache
 
+	// flushes maps the lowercased names of the flushed zones to the Unix times
+	// those have been flushed at.  The items for the names within those zones
+	// stored before are considered absent.  It's never nil.
+	flushes map[string]int64
+
 	// itemsWithSubnet is the requests cache.
 	itemsWithSubnet glcache.Cache
 
+	// clock is used to get the current time for the expiration of the items.
+	// It's never nil.
+	clock Clock
+
+	// logger is used to log the caching decisions.  It's never nil.
+	logger *slog.Logger
+
+	// keys is the pool of buffers for the keys of the lookups, so that those
+	// don't allocate.  It's never nil.
+	keys *syncutil.Pool[[]byte]
+
+	// nsec stores the NSEC and NSEC3 records to synthesize the negative
+	// responses from.  It's nil if the aggressive NSEC caching is disabled.
+	nsec *nsecCache
+
 	// optimistic defines if the cache should return expired items and resolve
 	// those again.
 	optimistic bool
@@ -54,9 +79,9 @@ type cacheItem struct {
 }
 
 // respToItem converts the pair of the response and upstream resolved the one
-// into item for storing it in cache.
-func respToItem(m *dns.Msg, u upstream.Upstream) (item *cacheItem) {
-	ttl := cacheTTL(m)
+// into item for storing it in cache.  l is used for logging.
+func respToItem(m *dns.Msg, u upstream.Upstream, l *slog.Logger) (item *cacheItem) {
+	ttl := cacheTTL(m, l)
 	if ttl == 0 {
 		return nil
 	}
@@ -85,14 +110,21 @@ const (
 	minPackedLen = expTimeSz + packedMsgLenSz
 )
 
-// pack converts the ci into bytes slice.
-func (ci *cacheItem) pack() (packed []byte) {
-	pm, _ := ci.m.Pack()
+// pack converts the ci into bytes slice.  now is the current time used to
+// calculate the expiration time.  The OPT RRs aren't stored, since those are
+// never returned from cache, and the message is compressed, so that the stored
+// message could be written as is, see [Proxy.replyFromCacheWire].
+func (ci *cacheItem) pack(now time.Time) (packed []byte) {
+	m := *ci.m
+	m.Extra = withoutOPT(m.Extra)
+	m.Compress = true
+
+	pm, _ := m.Pack()
 	pmLen := len(pm)
 	packed = make([]byte, minPackedLen, minPackedLen+pmLen+len(ci.u))
 
 	// Put expiration time.
-	binary.BigEndian.PutUint32(packed, uint32(time.Now().Unix())+ci.ttl)
+	binary.BigEndian.PutUint32(packed, uint32(now.Unix())+ci.ttl)
 
 	// Put the length of the packed message.
 	binary.BigEndian.PutUint16(packed[expTimeSz:], uint16(pmLen))
@@ -106,6 +138,27 @@ func (ci *cacheItem) pack() (packed []byte) {
 	return packed
 }
 
+// withoutOPT returns rrs without the OPT RRs.  rrs itself is returned if it
+// doesn't contain any.
+func withoutOPT(rrs []dns.RR) (res []dns.RR) {
+	for i, rr := range rrs {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			continue
+		}
+
+		res = slices.Clone(rrs[:i])
+		for _, rr = range rrs[i+1:] {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				res = append(res, rr)
+			}
+		}
+
+		return res
+	}
+
+	return rrs
+}
+
 // optimisticTTL is the default TTL for expired cached responses in seconds.
 const optimisticTTL = 10
 
@@ -113,16 +166,26 @@ const optimisticTTL = 10
 // expired is true if the item exists but expired.  The expired cached items are
 // only returned if c is optimistic.  req must not be nil.
 func (c *cache) unpackItem(data []byte, req *dns.Msg) (ci *cacheItem, expired bool) {
+	return c.unpackItemStale(data, req, c.optimistic)
+}
+
+// unpackItemStale is like [cache.unpackItem], but the expired cached items are
+// only returned if stale is true.
+func (c *cache) unpackItemStale(
+	data []byte,
+	req *dns.Msg,
+	stale bool,
+) (ci *cacheItem, expired bool) {
 	if len(data) < minPackedLen {
 		return nil, false
 	}
 
 	b := bytes.NewBuffer(data)
 	expire := int64(binary.BigEndian.Uint32(b.Next(expTimeSz)))
-	now := time.Now().Unix()
+	now := c.clock.Now().Unix()
 	var ttl uint32
 	if expired = expire <= now; expired {
-		if !c.optimistic {
+		if !stale {
 			return nil, expired
 		}
 
@@ -141,6 +204,13 @@ func (c *cache) unpackItem(data []byte, req *dns.Msg) (ci *cacheItem, expired bo
 		return nil, expired
 	}
 
+	// The item has been packed with the TTL calculated from the records of m,
+	// see [cache.set].
+	storedAt := expire - int64(calculateTTL(m))
+	if flushedAt, ok := c.flushedAt(req.Question[0].Name); ok && storedAt <= flushedAt {
+		return nil, false
+	}
+
 	res := (&dns.Msg{}).SetRcode(req, m.Rcode)
 	res.AuthenticatedData = m.AuthenticatedData
 	res.RecursionAvailable = m.RecursionAvailable
@@ -164,24 +234,33 @@ func (c *cache) unpackItem(data []byte, req *dns.Msg) (ci *cacheItem, expired bo
 // initCache initializes cache if it's enabled.
 func (p *Proxy) initCache() {
 	if !p.CacheEnabled {
-		log.Info("dnsproxy: cache: disabled")
+		p.cacheLogger.Info("cache disabled")
 
 		return
 	}
 
 	size := p.CacheSizeBytes
-	log.Info("dnsproxy: cache: enabled, size %d b", size)
+	p.cacheLogger.Info("cache enabled", "size", size)
+
+	p.cache = newCache(size, p.EnableEDNSClientSubnet, p.CacheOptimistic, p.time, p.cacheLogger)
+	if p.CacheAggressiveNSEC {
+		p.cache.nsec = newNSECCache(p.time)
+	}
 
-	p.cache = newCache(size, p.EnableEDNSClientSubnet, p.CacheOptimistic)
-	p.shortFlighter = newOptimisticResolver(p)
+	p.shortFlighter = newOptimisticResolver(p, p.cacheLogger)
 }
 
-// newCache returns a properly initialized cache.
-func newCache(size int, withECS, optimistic bool) (c *cache) {
+// newCache returns a properly initialized cache.  clock and l must not be nil.
+func newCache(size int, withECS, optimistic bool, clock Clock, l *slog.Logger) (c *cache) {
 	c = &cache{
 		itemsLock:           &sync.RWMutex{},
 		itemsWithSubnetLock: &sync.RWMutex{},
+		flushesLock:         &sync.RWMutex{},
 		items:               createCache(size),
+		flushes:             map[string]int64{},
+		clock:               clock,
+		logger:              l,
+		keys:                syncutil.NewSlicePool[byte](keyBufLen),
 		optimistic:          optimistic,
 	}
 
@@ -194,8 +273,19 @@ func newCache(size int, withECS, optimistic bool) (c *cache) {
 
 // get returns cached item for the req if it's found.  expired is true if the
 // item's TTL is expired.  key is the resulting key for req.  It's returned to
-// avoid recalculating it afterwards.
-func (c *cache) get(req *dns.Msg) (ci *cacheItem, expired bool, key []byte) {
+// avoid recalculating it afterwards.  The key is written into buf, if it's
+// large enough.  buf may be nil.
+func (c *cache) get(req *dns.Msg, buf []byte) (ci *cacheItem, expired bool, key []byte) {
+	return c.getStale(req, buf, c.optimistic)
+}
+
+// getStale is like [cache.get], but the expired cached items are only returned
+// if stale is true.
+func (c *cache) getStale(
+	req *dns.Msg,
+	buf []byte,
+	stale bool,
+) (ci *cacheItem, expired bool, key []byte) {
 	c.itemsLock.RLock()
 	defer c.itemsLock.RUnlock()
 
@@ -203,26 +293,61 @@ func (c *cache) get(req *dns.Msg) (ci *cacheItem, expired bool, key []byte) {
 		return nil, false, nil
 	}
 
-	key = msgToKey(req)
+	key = appendKey(buf[:0], req)
 	data := c.items.Get(key)
 	if data == nil {
 		return nil, false, key
 	}
 
-	if ci, expired = c.unpackItem(data, req); ci == nil {
+	if ci, expired = c.unpackItemStale(data, req, stale); ci == nil {
 		c.items.Del(key)
 	}
 
 	return ci, expired, key
 }
 
+// getPacked returns the packed cached item for req from the general cache or
+// nil if there is none.  The returned slice must not be modified.
+func (c *cache) getPacked(req *dns.Msg) (data []byte) {
+	c.itemsLock.RLock()
+	defer c.itemsLock.RUnlock()
+
+	if !canLookUpInCache(c.items, req) {
+		return nil
+	} else if _, ok := c.flushedAt(req.Question[0].Name); ok {
+		// Let the usual path check if the item has been flushed.
+		return nil
+	}
+
+	keyPtr := c.keys.Get()
+	defer c.keys.Put(keyPtr)
+
+	return c.items.Get(appendKey((*keyPtr)[:0], req))
+}
+
 // getWithSubnet returns cached item for the req if it's found by n.  expired
 // is true if the item's TTL is expired.  k is the resulting key for req.  It's
-// returned to avoid recalculating it afterwards.
+// returned to avoid recalculating it afterwards.  The key is written into buf,
+// if it's large enough.  buf may be nil.
 //
 // Note that a slow longest-prefix-match algorithm is used, so cache searches
 // are performed up to mask+1 times.
-func (c *cache) getWithSubnet(req *dns.Msg, n *net.IPNet) (ci *cacheItem, expired bool, k []byte) {
+func (c *cache) getWithSubnet(
+	req *dns.Msg,
+	n *net.IPNet,
+	buf []byte,
+) (ci *cacheItem, expired bool, k []byte) {
+	return c.getWithSubnetStale(req, n, buf, c.optimistic)
+}
+
+// getWithSubnetStale is like [cache.getWithSubnet], but the expired cached
+// items are only returned if stale is true.
+func (c *cache) getWithSubnetStale(
+	req *dns.Msg,
+	n *net.IPNet,
+	buf []byte,
+	stale bool,
+) (ci *cacheItem, expired bool, k []byte) {
 	c.itemsWithSubnetLock.RLock()
 	defer c.itemsWithSubnetLock.RUnlock()
 
@@ -230,11 +355,10 @@ func (c *cache) getWithSubnet(req *dns.Msg, n *net.IPNet) (ci *cacheItem, expire
 		return nil, false, nil
 	}
 
-	ecsIP := n.IP.Mask(n.Mask)
-	ipLen := len(ecsIP)
 	m, _ := n.Mask.Size()
 
-	k = msgToKeyWithSubnet(req, ecsIP, m)
+	k = appendKeyWithSubnet(buf[:0], req, n)
+	ipLen := len(k) - keyIPIndex - len(req.Question[0].Name)
 	data := c.itemsWithSubnet.Get(k)
 
 	// In order to reduce allocations we apply mask on bits level.  As the key
@@ -269,7 +393,7 @@ func (c *cache) getWithSubnet(req *dns.Msg, n *net.IPNet) (ci *cacheItem, expire
 		return nil, false, k
 	}
 
-	if ci, expired = c.unpackItem(data, req); ci == nil {
+	if ci, expired = c.unpackItemStale(data, req, stale); ci == nil {
 		c.itemsWithSubnet.Del(k)
 	}
 
@@ -298,13 +422,13 @@ func createCache(cacheSize int) (glc glcache.Cache) {
 
 // set tries to add the ci into cache.
 func (c *cache) set(m *dns.Msg, u upstream.Upstream) {
-	item := respToItem(m, u)
+	item := respToItem(m, u, c.logger)
 	if item == nil {
 		return
 	}
 
-	key := msgToKey(m)
-	packed := item.pack()
+	key := appendKey(nil, m)
+	packed := item.pack(c.clock.Now())
 
 	c.itemsLock.Lock()
 	defer c.itemsLock.Unlock()
@@ -315,14 +439,13 @@ func (c *cache) set(m *dns.Msg, u upstream.Upstream) {
 // setWithSubnet tries to add the ci into cache with subnet and ip used to
 // calculate the key.
 func (c *cache) setWithSubnet(m *dns.Msg, u upstream.Upstream, subnet *net.IPNet) {
-	item := respToItem(m, u)
+	item := respToItem(m, u, c.logger)
 	if item == nil {
 		return
 	}
 
-	pref, _ := subnet.Mask.Size()
-	key := msgToKeyWithSubnet(m, subnet.IP.Mask(subnet.Mask), pref)
-	packed := item.pack()
+	key := appendKeyWithSubnet(nil, m, subnet)
+	packed := item.pack(c.clock.Now())
 
 	c.itemsWithSubnetLock.Lock()
 	defer c.itemsWithSubnetLock.Unlock()
@@ -336,6 +459,39 @@ func (c *cache) clearItems() {
 	defer c.itemsLock.Unlock()
 
 	c.items.Clear()
+	c.nsec.clear()
+}
+
+// flushZone makes the items for zone and its subdomains stored until now
+// absent.
+func (c *cache) flushZone(zone string) {
+	c.flushesLock.Lock()
+	defer c.flushesLock.Unlock()
+
+	c.flushes[strings.ToLower(dns.Fqdn(zone))] = c.clock.Now().Unix()
+	c.nsec.flushZone(zone)
+}
+
+// flushedAt returns the latest Unix time any zone containing name has been
+// flushed at.  ok is false if none of those has been.
+func (c *cache) flushedAt(name string) (t int64, ok bool) {
+	c.flushesLock.RLock()
+	defer c.flushesLock.RUnlock()
+
+	if len(c.flushes) == 0 {
+		return 0, false
+	}
+
+	name = strings.ToLower(name)
+	for name != "" {
+		if zoneT, has := c.flushes[name]; has {
+			t, ok = max(t, zoneT), true
+		}
+
+		_, name, _ = strings.Cut(name, ".")
+	}
+
+	return t, ok
 }
 
 // clearItemsWithSubnet empties the subnet cache, if any.
@@ -356,23 +512,24 @@ func (c *cache) clearItemsWithSubnet() {
 // kinds of responses.
 //
 // See https://datatracker.ietf.org/doc/html/rfc2308#section-2.1,
-// https://datatracker.ietf.org/doc/html/rfc2308#section-2.2.
-func cacheTTL(m *dns.Msg) (ttl uint32) {
+// https://datatracker.ietf.org/doc/html/rfc2308#section-2.2.  l is used for
+// logging.
+func cacheTTL(m *dns.Msg, l *slog.Logger) (ttl uint32) {
 	switch {
 	case m == nil:
 		return 0
 	case m.Truncated:
-		log.Debug("dnsproxy: cache: truncated message; not caching")
+		l.Debug("truncated message; not caching")
 
 		return 0
 	case len(m.Question) != 1:
-		log.Debug("dnsproxy: cache: message with wrong number of questions; not caching")
+		l.Debug("message with wrong number of questions; not caching")
 
 		return 0
 	default:
 		ttl = calculateTTL(m)
 		if ttl == 0 {
-			log.Debug("dnsproxy: cache: ttl calculated to be 0; not caching")
+			l.Debug("ttl calculated to be 0; not caching")
 
 			return 0
 		}
@@ -384,17 +541,17 @@ func cacheTTL(m *dns.Msg) (ttl uint32) {
 			return ttl
 		}
 
-		log.Debug("dnsproxy: cache: not a cacheable noerror response; not caching")
+		l.Debug("not a cacheable noerror response; not caching")
 	case dns.RcodeNameError:
 		if isCacheableNegative(m) {
 			return ttl
 		}
 
-		log.Debug("dnsproxy: cache: not a cacheable nxdomain response; not caching")
+		l.Debug("not a cacheable nxdomain response; not caching")
 	case dns.RcodeServerFailure:
 		return ttl
 	default:
-		log.Debug("dnsproxy: cache: response code %s; not caching", dns.RcodeToString[rcode])
+		l.Debug("not a cacheable response code; not caching", "rcode", dns.RcodeToString[rcode])
 	}
 
 	return 0
@@ -487,6 +644,28 @@ func minTTL(h *dns.RR_Header, ttl uint32) uint32 {
 	}
 }
 
+// TTLRange is the range the TTLs of the records are clamped to, see
+// [Config.CacheTTLOverrides].
+type TTLRange struct {
+	// Min is the minimum TTL in seconds.
+	Min uint32
+
+	// Max is the maximum TTL in seconds.  Zero means no maximum.
+	Max uint32
+}
+
+// validateTTLOverrides returns an error if any of the ranges of overrides is
+// invalid.
+func validateTTLOverrides(overrides map[uint16]TTLRange) (err error) {
+	for rrType, r := range overrides {
+		if r.Max != 0 && r.Min > r.Max {
+			return fmt.Errorf("type %s: min %d greater than max %d", dns.Type(rrType), r.Min, r.Max)
+		}
+	}
+
+	return nil
+}
+
 // Updates a given TTL to fall within the range specified by the cacheMinTTL and
 // cacheMaxTTL settings.
 func respectTTLOverrides(ttl, cacheMinTTL, cacheMaxTTL uint32) uint32 {
@@ -503,16 +682,19 @@ func respectTTLOverrides(ttl, cacheMinTTL, cacheMaxTTL uint32) uint32 {
 
 // msgToKey constructs the cache key from type, class and question's name of m.
 func msgToKey(m *dns.Msg) (b []byte) {
+	return appendKey(nil, m)
+}
+
+// appendKey appends the cache key constructed from type, class and question's
+// name of m to b.
+func appendKey(b []byte, m *dns.Msg) (res []byte) {
 	q := m.Question[0]
-	name := q.Name
-	b = make([]byte, packedMsgLenSz+packedMsgLenSz+len(name))
 
 	// Put QTYPE, QCLASS, and QNAME.
-	binary.BigEndian.PutUint16(b, q.Qtype)
-	binary.BigEndian.PutUint16(b[packedMsgLenSz:], q.Qclass)
-	copy(b[2*packedMsgLenSz:], strings.ToLower(name))
+	res = binary.BigEndian.AppendUint16(b, q.Qtype)
+	res = binary.BigEndian.AppendUint16(res, q.Qclass)
 
-	return b
+	return appendLowerName(res, q.Name)
 }
 
 const (
@@ -521,50 +703,106 @@ const (
 
 	// keyIPIndex is the start index of the IP address in the key.
 	keyIPIndex = keyMaskIndex + 1
+
+	// keyBufLen is the length of the pooled buffers for the keys.  It's enough
+	// for the names of the maximum length of 254 characters in the
+	// presentation format, unless those contain escaped characters, in which
+	// case the keys are allocated.
+	keyBufLen = keyIPIndex + net.IPv6len + 254
 )
 
 // msgToKeyWithSubnet constructs the cache key from DO bit, type, class, subnet
 // mask, client's IP address and question's name of m.  ecsIP is expected to be
 // masked already.
 func msgToKeyWithSubnet(m *dns.Msg, ecsIP net.IP, mask int) (key []byte) {
-	q := m.Question[0]
-	keyLen := keyIPIndex + len(q.Name)
-	masked := mask != 0
-	if masked {
-		keyLen += len(ecsIP)
-	}
+	return appendKeyWithSubnet(nil, m, &net.IPNet{
+		IP:   ecsIP,
+		Mask: net.CIDRMask(mask, len(ecsIP)*8),
+	})
+}
 
-	// Initialize the slice.
-	key = make([]byte, keyLen)
+// appendKeyWithSubnet appends the cache key constructed from DO bit, type,
+// class, subnet mask, masked client's IP address and question's name of m to
+// b.  n must not be nil.
+func appendKeyWithSubnet(b []byte, m *dns.Msg, n *net.IPNet) (key []byte) {
+	q := m.Question[0]
+	mask, _ := n.Mask.Size()
 
 	// Put DO.
 	opt := m.IsEdns0()
-	key[0] = mathutil.BoolToNumber[byte](opt != nil && opt.Do())
+	do := mathutil.BoolToNumber[byte](opt != nil && opt.Do())
+
+	start := len(b)
+	key = append(b, do, 0, 0, 0, 0, byte(mask))
 
 	// Put Qtype.
 	//
 	// TODO(d.kolyshev): We should put Qtype in key[1:].
-	binary.BigEndian.PutUint16(key[:], q.Qtype)
+	binary.BigEndian.PutUint16(key[start:], q.Qtype)
 
 	// Put Qclass.
-	binary.BigEndian.PutUint16(key[1+packedMsgLenSz:], q.Qclass)
+	binary.BigEndian.PutUint16(key[start+1+packedMsgLenSz:], q.Qclass)
 
-	// Add mask.
-	key[keyMaskIndex] = uint8(mask)
-	k := keyIPIndex
-	if masked {
-		k += copy(key[keyIPIndex:], ecsIP)
+	if mask != 0 {
+		key = appendMaskedIP(key, n.IP, n.Mask)
 	}
 
-	copy(key[k:], strings.ToLower(q.Name))
+	return appendLowerName(key, q.Name)
+}
+
+// appendMaskedIP appends ip masked with mask to b just like [net.IP.Mask] does,
+// but without allocating.  Nothing is appended if ip and mask don't match.
+func appendMaskedIP(b []byte, ip net.IP, mask net.IPMask) (res []byte) {
+	if len(mask) == net.IPv6len && len(ip) == net.IPv4len {
+		if !bytes.Equal(mask[:net.IPv6len-net.IPv4len], v4InV6MaskPrefix) {
+			return b
+		}
+
+		mask = mask[net.IPv6len-net.IPv4len:]
+	} else if len(mask) == net.IPv4len && len(ip) == net.IPv6len {
+		ip = ip.To4()
+	}
+
+	if len(ip) != len(mask) {
+		return b
+	}
 
-	return key
+	res = b
+	for i, octet := range ip {
+		res = append(res, octet&mask[i])
+	}
+
+	return res
+}
+
+// v4InV6MaskPrefix is the prefix of the IPv6 mask matching an IPv4 address.
+var v4InV6MaskPrefix = bytes.Repeat([]byte{0xff}, net.IPv6len-net.IPv4len)
+
+// appendLowerName appends name to b with the ASCII letters converted to lower
+// case.  Unlike [strings.ToLower], it doesn't allocate the intermediate string.
+func appendLowerName(b []byte, name string) (res []byte) {
+	res = b
+	for i := range len(name) {
+		c := name[i]
+		if 'A' <= c && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+
+		res = append(res, c)
+	}
+
+	return res
 }
 
 // isDNSSEC returns true if r is a DNSSEC RR.  NSEC, NSEC3, DS, DNSKEY and
 // RRSIG/SIG are DNSSEC records.
 func isDNSSEC(r dns.RR) bool {
-	switch r.Header().Rrtype {
+	return isDNSSECType(r.Header().Rrtype)
+}
+
+// isDNSSECType returns true if t is the type of DNSSEC RRs, see [isDNSSEC].
+func isDNSSECType(t uint16) (ok bool) {
+	switch t {
 	case
 		dns.TypeNSEC,
 		dns.TypeNSEC3,
@@ -116,7 +116,7 @@ func TestCache_expired(t *testing.T) {
 		optimistic: true,
 	}}
 
-	testCache := newCache(testCacheSize, false, false)
+	testCache := newCache(testCacheSize, false, false, realClock{}, testLogger)
 	for _, tc := range testCases {
 		ans.Hdr.Ttl = tc.ttl
 		req := (&dns.Msg{}).SetQuestion(host, dns.TypeA)
@@ -132,11 +132,11 @@ func TestCache_expired(t *testing.T) {
 				m:   reply,
 				u:   testUpsAddr,
 				ttl: tc.ttl,
-			}).pack()
+			}).pack(time.Now())
 			testCache.items.Set(key, data)
 			t.Cleanup(testCache.items.Clear)
 
-			r, expired, key := testCache.get(req)
+			r, expired, key := testCache.get(req, nil)
 			assert.Equal(t, msgToKey(req), key)
 			assert.Equal(t, tc.ttl == 0, expired)
 
@@ -153,7 +153,7 @@ func TestCache_expired(t *testing.T) {
 }
 
 func TestCacheDO(t *testing.T) {
-	testCache := newCache(testCacheSize, false, false)
+	testCache := newCache(testCacheSize, false, false, realClock{}, testLogger)
 
 	// Fill the cache.
 	reply := (&dns.Msg{
@@ -171,7 +171,7 @@ func TestCacheDO(t *testing.T) {
 	request := (&dns.Msg{}).SetQuestion("google.com.", dns.TypeA)
 
 	t.Run("without_do", func(t *testing.T) {
-		ci, expired, key := testCache.get(request)
+		ci, expired, key := testCache.get(request, nil)
 		assert.False(t, expired)
 		assert.Equal(t, msgToKey(request), key)
 		assert.NotNil(t, ci)
@@ -185,7 +185,7 @@ func TestCacheDO(t *testing.T) {
 
 		request.SetEdns0(4096, true)
 
-		ci, expired, key := testCache.get(request)
+		ci, expired, key := testCache.get(request, nil)
 		assert.False(t, expired)
 		assert.Equal(t, msgToKey(request), key)
 
@@ -196,7 +196,7 @@ func TestCacheDO(t *testing.T) {
 }
 
 func TestCacheCNAME(t *testing.T) {
-	testCache := newCache(testCacheSize, false, false)
+	testCache := newCache(testCacheSize, false, false, realClock{}, testLogger)
 
 	// Fill the cache
 	reply := (&dns.Msg{
@@ -211,7 +211,7 @@ func TestCacheCNAME(t *testing.T) {
 	request := (&dns.Msg{}).SetQuestion("google.com.", dns.TypeA)
 
 	t.Run("no_cnames", func(t *testing.T) {
-		r, expired, _ := testCache.get(request)
+		r, expired, _ := testCache.get(request, nil)
 		assert.Nil(t, r)
 		assert.False(t, expired)
 	})
@@ -222,7 +222,7 @@ func TestCacheCNAME(t *testing.T) {
 
 	// We are testing that a proper CNAME response gets cached
 	t.Run("cnames_exist", func(t *testing.T) {
-		r, expired, key := testCache.get(request)
+		r, expired, key := testCache.get(request, nil)
 		assert.False(t, expired)
 		assert.Equal(t, key, msgToKey(request))
 
@@ -233,7 +233,7 @@ func TestCacheCNAME(t *testing.T) {
 }
 
 func TestCache_uncacheable(t *testing.T) {
-	testCache := newCache(testCacheSize, false, false)
+	testCache := newCache(testCacheSize, false, false, realClock{}, testLogger)
 
 	// Create a DNS request.
 	request := (&dns.Msg{}).SetQuestion("google.com.", dns.TypeA)
@@ -243,13 +243,13 @@ func TestCache_uncacheable(t *testing.T) {
 	// We are testing that SERVFAIL responses aren't cached
 	testCache.set(reply, upstreamWithAddr)
 
-	r, expired, _ := testCache.get(request)
+	r, expired, _ := testCache.get(request, nil)
 	assert.Nil(t, r)
 	assert.False(t, expired)
 }
 
 func TestCache_concurrent(t *testing.T) {
-	testCache := newCache(testCacheSize, false, false)
+	testCache := newCache(testCacheSize, false, false, realClock{}, testLogger)
 
 	hosts := map[string]string{
 		dns.Fqdn("yandex.com"):     "213.180.204.62",
@@ -305,7 +305,7 @@ func TestCacheExpiration(t *testing.T) {
 	}
 
 	for _, r := range replies {
-		ci, expired, key := dnsProxy.cache.get(r)
+		ci, expired, key := dnsProxy.cache.get(r, nil)
 		require.NotNil(t, ci)
 
 		assert.False(t, expired)
@@ -316,7 +316,7 @@ func TestCacheExpiration(t *testing.T) {
 
 	assert.Eventually(t, func() bool {
 		for _, r := range replies {
-			if ci, _, _ := dnsProxy.cache.get(r); ci != nil {
+			if ci, _, _ := dnsProxy.cache.get(r, nil); ci != nil {
 				return false
 			}
 		}
@@ -325,6 +325,95 @@ func TestCacheExpiration(t *testing.T) {
 	}, 1100*time.Millisecond, 100*time.Millisecond)
 }
 
+func TestCache_clock(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	clock := &fakeClock{onNow: func() (t time.Time) { return now }}
+
+	testCases := []struct {
+		name       string
+		optimistic bool
+		wantTTL    uint32
+	}{{
+		name:       "not_optimistic",
+		optimistic: false,
+		wantTTL:    0,
+	}, {
+		name:       "optimistic",
+		optimistic: true,
+		wantTTL:    optimisticTTL,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newCache(testCacheSize, false, tc.optimistic, clock, testLogger)
+
+			rep := (&dns.Msg{
+				MsgHdr: dns.MsgHdr{
+					Response: true,
+				},
+				Answer: []dns.RR{newRR(t, "example.org.", dns.TypeA, 10, net.IP{192, 0, 2, 1})},
+			}).SetQuestion("example.org.", dns.TypeA)
+			c.set(rep, upstreamWithAddr)
+
+			now = now.Add(4 * time.Second)
+			ci, expired, _ := c.get(rep, nil)
+			require.NotNil(t, ci)
+
+			assert.False(t, expired)
+			require.NotEmpty(t, ci.m.Answer)
+			assert.Equal(t, uint32(6), ci.m.Answer[0].Header().Ttl)
+
+			now = now.Add(6 * time.Second)
+			ci, expired, _ = c.get(rep, nil)
+			assert.True(t, expired)
+
+			if tc.wantTTL == 0 {
+				assert.Nil(t, ci)
+			} else {
+				require.NotNil(t, ci)
+				require.NotEmpty(t, ci.m.Answer)
+				assert.Equal(t, tc.wantTTL, ci.m.Answer[0].Header().Ttl)
+			}
+		})
+	}
+}
+
+func TestCache_flushZone(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	clock := &fakeClock{onNow: func() (t time.Time) { return now }}
+
+	c := newCache(testCacheSize, false, false, clock, testLogger)
+
+	newReply := func(name string) (rep *dns.Msg) {
+		return (&dns.Msg{
+			MsgHdr: dns.MsgHdr{
+				Response: true,
+			},
+			Answer: []dns.RR{newRR(t, name, dns.TypeA, 10, net.IP{192, 0, 2, 1})},
+		}).SetQuestion(name, dns.TypeA)
+	}
+
+	flushed, kept := newReply("www.example.org."), newReply("example.com.")
+	c.set(flushed, upstreamWithAddr)
+	c.set(kept, upstreamWithAddr)
+
+	now = now.Add(time.Second)
+	c.flushZone("Example.ORG")
+
+	ci, _, _ := c.get(flushed, nil)
+	assert.Nil(t, ci)
+
+	ci, _, _ = c.get(kept, nil)
+	assert.NotNil(t, ci)
+
+	// The responses cached after the flush are served.
+	now = now.Add(time.Second)
+	c.set(flushed, upstreamWithAddr)
+
+	ci, _, _ = c.get(flushed, nil)
+	assert.NotNil(t, ci)
+}
+
 func TestCacheExpirationWithTTLOverride(t *testing.T) {
 	u := testUpstream{}
 
@@ -365,7 +454,7 @@ func TestCacheExpirationWithTTLOverride(t *testing.T) {
 		err = dnsProxy.Resolve(d)
 		require.NoError(t, err)
 
-		ci, expired, key := dnsProxy.cache.get(d.Req)
+		ci, expired, key := dnsProxy.cache.get(d.Req, nil)
 		assert.False(t, expired)
 		assert.Equal(t, msgToKey(d.Req), key)
 
@@ -389,7 +478,7 @@ func TestCacheExpirationWithTTLOverride(t *testing.T) {
 		err = dnsProxy.Resolve(d)
 		assert.Nil(t, err)
 
-		ci, expired, key := dnsProxy.cache.get(d.Req)
+		ci, expired, key := dnsProxy.cache.get(d.Req, nil)
 		assert.False(t, expired)
 		assert.Equal(t, msgToKey(d.Req), key)
 
@@ -398,6 +487,69 @@ func TestCacheExpirationWithTTLOverride(t *testing.T) {
 	})
 }
 
+func TestProxy_setMinMaxTTL_overrides(t *testing.T) {
+	p := mustNew(t, &Config{
+		Logger:         testLogger,
+		UpstreamConfig: newTestUpstreamConfig(t, defaultTimeout, testDefaultUpstreamAddr),
+		CacheEnabled:   true,
+		CacheMinTTL:    20,
+		CacheMaxTTL:    40,
+		CacheTTLOverrides: map[uint16]TTLRange{
+			dns.TypeHTTPS: {Max: 300},
+			dns.TypePTR:   {Min: 3600},
+		},
+	})
+
+	testCases := []struct {
+		rr      dns.RR
+		name    string
+		wantTTL uint32
+	}{{
+		rr:      &dns.A{Hdr: dns.RR_Header{Rrtype: dns.TypeA, Ttl: 60}},
+		name:    "general",
+		wantTTL: 40,
+	}, {
+		rr:      &dns.HTTPS{SVCB: dns.SVCB{Hdr: dns.RR_Header{Rrtype: dns.TypeHTTPS, Ttl: 600}}},
+		name:    "capped",
+		wantTTL: 300,
+	}, {
+		rr:      &dns.HTTPS{SVCB: dns.SVCB{Hdr: dns.RR_Header{Rrtype: dns.TypeHTTPS, Ttl: 10}}},
+		name:    "no_min",
+		wantTTL: 10,
+	}, {
+		rr:      &dns.PTR{Hdr: dns.RR_Header{Rrtype: dns.TypePTR, Ttl: 60}},
+		name:    "floored",
+		wantTTL: 3600,
+	}, {
+		rr:      &dns.PTR{Hdr: dns.RR_Header{Rrtype: dns.TypePTR, Ttl: 86400}},
+		name:    "no_max",
+		wantTTL: 86400,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p.setMinMaxTTL(&dns.Msg{Answer: []dns.RR{tc.rr}})
+
+			assert.Equal(t, tc.wantTTL, tc.rr.Header().Ttl)
+		})
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := New(&Config{
+			Logger:         testLogger,
+			UpstreamConfig: newTestUpstreamConfig(t, defaultTimeout, testDefaultUpstreamAddr),
+			CacheTTLOverrides: map[uint16]TTLRange{
+				dns.TypePTR: {Min: 3600, Max: 60},
+			},
+		})
+		testutil.AssertErrorMsg(
+			t,
+			"validating cache ttl overrides: type PTR: min 3600 greater than max 60",
+			err,
+		)
+	})
+}
+
 type testEntry struct {
 	q string
 	a []dns.RR
@@ -512,7 +664,7 @@ func TestCache(t *testing.T) {
 }
 
 func (tests testCases) run(t *testing.T) {
-	testCache := newCache(testCacheSize, false, false)
+	testCache := newCache(testCacheSize, false, false, realClock{}, testLogger)
 
 	for _, res := range tests.cache {
 		reply := (&dns.Msg{
@@ -527,7 +679,7 @@ func (tests testCases) run(t *testing.T) {
 	for _, tc := range tests.cases {
 		request := (&dns.Msg{}).SetQuestion(tc.q, tc.t)
 
-		ci, expired, _ := testCache.get(request)
+		ci, expired, _ := testCache.get(request, nil)
 		assert.False(t, expired)
 		tc.ok(t, ci != nil)
 
@@ -594,7 +746,7 @@ func setAndGetCache(t *testing.T, c *cache, g *sync.WaitGroup, host, ip string)
 	c.set(dnsMsg, upstreamWithAddr)
 
 	for range 2 {
-		ci, expired, key := c.get(dnsMsg)
+		ci, expired, key := c.get(dnsMsg, nil)
 		require.NotNilf(t, ci, "no cache found for %s", host)
 
 		assert.False(t, expired)
@@ -604,7 +756,7 @@ func setAndGetCache(t *testing.T, c *cache, g *sync.WaitGroup, host, ip string)
 	}
 
 	assert.Eventuallyf(t, func() bool {
-		ci, _, _ := c.get(dnsMsg)
+		ci, _, _ := c.get(dnsMsg, nil)
 
 		return ci == nil
 	}, 1100*time.Millisecond, 100*time.Millisecond, "cache for %s should already be removed", host)
@@ -618,10 +770,10 @@ func TestCache_getWithSubnet(t *testing.T) {
 	mask16 := net.CIDRMask(16, netutil.IPv4BitLen)
 	mask24 := net.CIDRMask(24, netutil.IPv4BitLen)
 
-	c := newCache(testCacheSize, true, false)
+	c := newCache(testCacheSize, true, false, realClock{}, testLogger)
 
 	t.Run("empty", func(t *testing.T) {
-		ci, expired, _ := c.getWithSubnet(req, &net.IPNet{IP: ip1234, Mask: mask24})
+		ci, expired, _ := c.getWithSubnet(req, &net.IPNet{IP: ip1234, Mask: mask24}, nil)
 		assert.Nil(t, ci)
 		assert.False(t, expired)
 	})
@@ -633,7 +785,7 @@ func TestCache_getWithSubnet(t *testing.T) {
 	c.setWithSubnet(resp, upstreamWithAddr, &net.IPNet{IP: ip1234, Mask: mask16})
 
 	t.Run("different_ip", func(t *testing.T) {
-		ci, expired, key := c.getWithSubnet(req, &net.IPNet{IP: ip2234, Mask: mask24})
+		ci, expired, key := c.getWithSubnet(req, &net.IPNet{IP: ip2234, Mask: mask24}, nil)
 		assert.False(t, expired)
 		assert.Equal(t, msgToKeyWithSubnet(req, ip2234, 0), key)
 		assert.Nil(t, ci)
@@ -652,7 +804,7 @@ func TestCache_getWithSubnet(t *testing.T) {
 	c.setWithSubnet(resp, upstreamWithAddr, &net.IPNet{IP: nil, Mask: nil})
 
 	t.Run("with_subnet_1", func(t *testing.T) {
-		ci, expired, key := c.getWithSubnet(req, &net.IPNet{IP: ip1234, Mask: mask24})
+		ci, expired, key := c.getWithSubnet(req, &net.IPNet{IP: ip1234, Mask: mask24}, nil)
 		assert.False(t, expired)
 		assert.Equal(t, msgToKeyWithSubnet(req, ip1234.Mask(mask16), 16), key)
 
@@ -665,7 +817,7 @@ func TestCache_getWithSubnet(t *testing.T) {
 	})
 
 	t.Run("with_subnet_2", func(t *testing.T) {
-		ci, expired, key := c.getWithSubnet(req, &net.IPNet{IP: ip2234, Mask: mask24})
+		ci, expired, key := c.getWithSubnet(req, &net.IPNet{IP: ip2234, Mask: mask24}, nil)
 		assert.False(t, expired)
 		assert.Equal(t, msgToKeyWithSubnet(req, ip2234.Mask(mask16), 16), key)
 
@@ -678,7 +830,7 @@ func TestCache_getWithSubnet(t *testing.T) {
 	})
 
 	t.Run("with_subnet_3", func(t *testing.T) {
-		ci, expired, key := c.getWithSubnet(req, &net.IPNet{IP: ip3234, Mask: mask24})
+		ci, expired, key := c.getWithSubnet(req, &net.IPNet{IP: ip3234, Mask: mask24}, nil)
 		assert.False(t, expired)
 		assert.Equal(t, msgToKeyWithSubnet(req, ip1234, 0), key)
 
@@ -704,7 +856,7 @@ func TestCache_getWithSubnet_mask(t *testing.T) {
 
 	ansIP := net.IP{4, 4, 4, 4}
 
-	c := newCache(testCacheSize, true, true)
+	c := newCache(testCacheSize, true, true, realClock{}, testLogger)
 
 	req := (&dns.Msg{}).SetQuestion(testFQDN, dns.TypeA)
 	resp := (&dns.Msg{
@@ -722,7 +874,7 @@ func TestCache_getWithSubnet_mask(t *testing.T) {
 		ci, expired, key := c.getWithSubnet(req, &net.IPNet{
 			IP:   testIP,
 			Mask: net.CIDRMask(24, netutil.IPv4BitLen),
-		})
+		}, nil)
 		assert.False(t, expired)
 		assert.Equal(t, msgToKeyWithSubnet(req, testIP.Mask(cidrMask), cidrMaskOnes), key)
 
@@ -738,7 +890,7 @@ func TestCache_getWithSubnet_mask(t *testing.T) {
 		ci, expired, key := c.getWithSubnet(req, &net.IPNet{
 			IP:   noMatchIP,
 			Mask: net.CIDRMask(24, netutil.IPv4BitLen),
-		})
+		}, nil)
 		assert.False(t, expired)
 		assert.Equal(t, msgToKeyWithSubnet(req, noMatchIP, 0), key)
 		assert.Nil(t, ci)
@@ -943,7 +1095,58 @@ func TestCache_IsCacheable_negative(t *testing.T) {
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			assert.Equal(t, tc.wantTTL, cacheTTL(tc.req))
+			assert.Equal(t, tc.wantTTL, cacheTTL(tc.req, testLogger))
+		})
+	}
+}
+
+func TestAppendKeyWithSubnet(t *testing.T) {
+	req := newHostTestMessage("ExAmple.ORG")
+	want := msgToKeyWithSubnet(req, net.IP{192, 0, 2, 0}, 24)
+
+	testCases := []struct {
+		n    *net.IPNet
+		name string
+	}{{
+		n:    &net.IPNet{IP: net.IP{192, 0, 2, 1}, Mask: net.CIDRMask(24, netutil.IPv4BitLen)},
+		name: "ipv4",
+	}, {
+		n:    &net.IPNet{IP: net.ParseIP("192.0.2.1"), Mask: net.CIDRMask(24, netutil.IPv4BitLen)},
+		name: "ipv4_in_ipv6",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, want, appendKeyWithSubnet(nil, req, tc.n))
 		})
 	}
+
+	t.Run("lower_case", func(t *testing.T) {
+		key := msgToKey(req)
+		name := key[2*packedMsgLenSz:]
+
+		assert.Equal(t, strings.ToLower(req.Question[0].Name), string(name))
+	})
+}
+
+func BenchmarkAppendKey(b *testing.B) {
+	req := newHostTestMessage("WWW.Example.ORG")
+	req.SetEdns0(dns.DefaultMsgSize, true)
+
+	n := &net.IPNet{IP: net.IP{192, 0, 2, 1}, Mask: net.CIDRMask(24, netutil.IPv4BitLen)}
+	buf := make([]byte, 0, keyBufLen)
+
+	b.Run("general", func(b *testing.B) {
+		b.ReportAllocs()
+		for range b.N {
+			_ = appendKey(buf, req)
+		}
+	})
+
+	b.Run("subnet", func(b *testing.B) {
+		b.ReportAllocs()
+		for range b.N {
+			_ = appendKeyWithSubnet(buf, req, n)
+		}
+	})
 }
@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/miekg/dns"
+)
+
+// errCacheOnly is returned when the request can't be resolved in the
+// cache-only mode, see [Config.CacheOnly].
+const errCacheOnly errors.Error = "cache-only mode"
+
+// SetCacheOnly enables or disables the cache-only mode, see [Config.CacheOnly].
+// It's safe for concurrent use.
+func (p *Proxy) SetCacheOnly(enabled bool) {
+	if p.cacheOnly.Swap(enabled) != enabled {
+		p.logger.Info("cache-only mode changed", "enabled", enabled)
+	}
+}
+
+// IsCacheOnly returns true if the cache-only mode is enabled, see
+// [Config.CacheOnly].  It's safe for concurrent use.
+func (p *Proxy) IsCacheOnly() (ok bool) {
+	return p.cacheOnly.Load()
+}
+
+// replyCacheOnly answers the request of dctx, which isn't cached, in the
+// cache-only mode.  err is always [errCacheOnly].
+func (p *Proxy) replyCacheOnly(dctx *DNSContext) (err error) {
+	p.logger.Debug("not resolving in cache-only mode", "qname", dctx.Req.Question[0].Name)
+
+	dctx.Res = p.newMsgCacheOnly(dctx.Req)
+	dctx.scrub()
+
+	if p.ResponseHandler != nil {
+		p.ResponseHandler(dctx, errCacheOnly)
+	}
+
+	return errCacheOnly
+}
+
+// newMsgCacheOnly returns the SERVFAIL response to req with the "No Reachable
+// Authority" extended DNS error, see RFC 8914.  The error is only added if req
+// has an OPT record.
+func (p *Proxy) newMsgCacheOnly(req *dns.Msg) (resp *dns.Msg) {
+	resp = p.messages.NewMsgSERVFAIL(req)
+	addEDE(req, resp, dns.ExtendedErrorCodeNoReachableAuthority, "cache-only mode")
+
+	return resp
+}
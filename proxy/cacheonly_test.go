@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_SetCacheOnly(t *testing.T) {
+	now := time.Now()
+	clock := &fakeClock{onNow: func() (t time.Time) { return now }}
+
+	var exchanges int
+	ups := &fakeUpstream{
+		onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			exchanges++
+
+			resp = (&dns.Msg{}).SetReply(req)
+			resp.Answer = append(resp.Answer, &dns.A{
+				Hdr: dns.RR_Header{
+					Name:   req.Question[0].Name,
+					Rrtype: dns.TypeA,
+					Class:  dns.ClassINET,
+					Ttl:    60,
+				},
+				A: net.IP{192, 0, 2, 1},
+			})
+
+			return resp, nil
+		},
+		onAddress: func() (addr string) { return "fake.address" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	p := mustNew(t, &Config{
+		Logger:         testLogger,
+		UpstreamConfig: &UpstreamConfig{Upstreams: []upstream.Upstream{ups}},
+		Clock:          clock,
+		CacheEnabled:   true,
+	})
+
+	resolve := func(t *testing.T, host string) (resp *dns.Msg) {
+		t.Helper()
+
+		req := newHostTestMessage(host)
+		req.SetEdns0(defaultUDPBufSize, false)
+
+		d := &DNSContext{Req: req}
+		_ = p.Resolve(d)
+		require.NotNil(t, d.Res)
+
+		return d.Res
+	}
+
+	resp := resolve(t, "cached.example")
+	require.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	require.Equal(t, 1, exchanges)
+
+	p.SetCacheOnly(true)
+	require.True(t, p.IsCacheOnly())
+
+	t.Run("cached", func(t *testing.T) {
+		resp = resolve(t, "cached.example")
+		assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+		assert.Len(t, resp.Answer, 1)
+		assert.Equal(t, 1, exchanges)
+	})
+
+	t.Run("stale", func(t *testing.T) {
+		now = now.Add(time.Hour)
+
+		resp = resolve(t, "cached.example")
+		assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+		require.Len(t, resp.Answer, 1)
+		assert.Equal(t, uint32(optimisticTTL), resp.Answer[0].Header().Ttl)
+		assert.Equal(t, 1, exchanges)
+	})
+
+	t.Run("not_cached", func(t *testing.T) {
+		resp = resolve(t, "uncached.example")
+		assert.Equal(t, dns.RcodeServerFailure, resp.Rcode)
+		assert.Equal(t, 1, exchanges)
+
+		opt := resp.IsEdns0()
+		require.NotNil(t, opt)
+		require.Len(t, opt.Option, 1)
+
+		ede := testutil.RequireTypeAssert[*dns.EDNS0_EDE](t, opt.Option[0])
+		assert.Equal(t, dns.ExtendedErrorCodeNoReachableAuthority, ede.InfoCode)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		p.SetCacheOnly(false)
+		require.False(t, p.IsCacheOnly())
+
+		resp = resolve(t, "uncached.example")
+		assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+		assert.Equal(t, 2, exchanges)
+	})
+}
@@ -0,0 +1,332 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// dnsHeaderLen is the length of the DNS message header.
+	dnsHeaderLen = 12
+
+	// rrFixedLen is the length of the part of a resource record following its
+	// name: the type, the class, the TTL, and the length of the data.
+	rrFixedLen = 10
+)
+
+// Bits of the flags of the DNS message header.
+const (
+	flagQR = 1 << 15
+	flagTC = 1 << 9
+	flagRD = 1 << 8
+	flagRA = 1 << 7
+	flagAD = 1 << 5
+	flagCD = 1 << 4
+
+	opcodeShift = 11
+	rcodeMask   = 0xf
+)
+
+// replyFromCacheWire answers d from the general cache by writing the stored
+// packed response right away, without unpacking and packing it again.  Only
+// the ID, the flags, the question name, and the TTLs of the response are
+// patched, and the OPT RR is appended if the request has one.  It returns
+// false if the response can't be written this way, so that d should be
+// handled as usual, e.g. when the item is expired, or when it requires any
+// other modifications, or when something could observe or change the response
+// on its way to the client.
+//
+// On success, d.Res is set to the message only containing the header of the
+// written response.
+func (p *Proxy) replyFromCacheWire(d *DNSContext) (ok bool) {
+	if !p.canWritePacked(d) {
+		return false
+	}
+
+	p.reconfigureLock.RLock()
+	defer p.reconfigureLock.RUnlock()
+
+	if ecsEnabled, _ := p.ecsConfig(d); ecsEnabled {
+		return false
+	}
+
+	d.calcFlagsAndSize()
+	if p.cacheDisabledReason(d) != "" {
+		return false
+	}
+
+	c := p.cacheForContext(d)
+	data := c.getPacked(d.Req)
+	if data == nil {
+		return false
+	}
+
+	bufPtr := p.bytesPool.Get()
+	defer p.bytesPool.Put(bufPtr)
+
+	// Reserve the space for the length prefix of TCP.
+	buf := *bufPtr
+	now := c.clock.Now().Unix()
+	b, upsAddr, ok := packedReply(buf[2:2], data, d, now)
+	if !ok || len(b) > int(d.responseSize()) {
+		// Let the usual path handle the truncation.
+		return false
+	}
+
+	d.Res = packedHeader(b, d.Req)
+	d.CachedUpstreamAddr = upsAddr
+	d.cacheHit = true
+	p.metrics.OnCacheLookup(true)
+	p.eventListener().OnCacheHit(d)
+	c.logger.Debug("serving cached response")
+
+	p.mirror(d.Req)
+	p.writePacked(d, buf, b)
+
+	if c == p.cache {
+		p.pushXDP(d, data, b, now)
+	}
+
+	return true
+}
+
+// writePacked writes the packed response b to the client of d.  b must start
+// at buf[2:], so that the length prefix of TCP is written into buf right before
+// it.  The errors are logged.
+func (p *Proxy) writePacked(d *DNSContext, buf, b []byte) {
+	conn := d.respConn()
+	if conn != nil {
+		_ = conn.SetWriteDeadline(time.Now().Add(defaultTimeout))
+	}
+
+	var err error
+	if d.Proto == ProtoUDP {
+		err = p.writeUDP(d, b)
+	} else {
+		binary.BigEndian.PutUint16(buf, uint16(len(b)))
+		err = writeTCP(conn, buf[:2+len(b)])
+	}
+
+	if err != nil {
+		logWithNonCrit(p.logger, err, fmt.Sprintf("responding %s request", d.Proto))
+	}
+}
+
+// canWritePacked returns true if the response to d may be written right away
+// in the wire format, e.g. by [Proxy.replyFromCacheWire], i.e. the request is
+// a plain DNS query and there is nothing to handle, observe, or modify the
+// response.  The compression of the packed responses is also required to be
+// forced, since the cached ones are always compressed, and the SVCB and HTTPS
+// records for the request must not be rewritten, see [Config.SVCBRewrite].
+func (p *Proxy) canWritePacked(d *DNSContext) (ok bool) {
+	switch d.Proto {
+	case ProtoUDP, ProtoTCP, ProtoTLS:
+		// Go on.
+	default:
+		return false
+	}
+
+	return d.Req.Opcode == dns.OpcodeQuery &&
+		len(d.Req.Question) == 1 &&
+		d.tsig == nil &&
+		(p.ResponseCompression == "" || p.ResponseCompression == CompressionForce) &&
+		!p.svcbRewriter.match(d.Req.Question[0].Name) &&
+		len(p.middlewares) == 0 &&
+		(d.profile == nil || d.profile.handler == nil) &&
+		p.RequestHandler == nil &&
+		p.ResponseHandler == nil &&
+		p.AfterResponseHandler == nil &&
+		p.MetricsListener == nil &&
+		p.MessageTap == nil &&
+		p.QueryLogger == nil &&
+		p.TracerProvider == nil &&
+		p.errorReportingAgent == "" &&
+		!p.logger.Enabled(context.TODO(), levelTrace)
+}
+
+// packedReply appends the response to the request of d made of data, the
+// packed cache item, to dst.  now is the current Unix time.  It returns the
+// response with the address of the upstream the response has been received
+// from.  ok is false if the item is expired or malformed, or if the response
+// requires the modifications other than the ones described in
+// [Proxy.replyFromCacheWire].
+func packedReply(dst, data []byte, d *DNSContext, now int64) (b []byte, upsAddr string, ok bool) {
+	if len(data) < minPackedLen {
+		return nil, "", false
+	}
+
+	expire := int64(binary.BigEndian.Uint32(data))
+	if expire <= now {
+		// Let the usual path serve the optimistic response or remove the item.
+		return nil, "", false
+	}
+
+	l := int(binary.BigEndian.Uint16(data[expTimeSz:]))
+	msg := data[minPackedLen:]
+	if l < dnsHeaderLen || l > len(msg) {
+		return nil, "", false
+	}
+
+	b = append(dst, msg[:l]...)
+	if !patchPackedReply(b, d, uint32(expire-now)) {
+		return nil, "", false
+	}
+
+	if d.hasEDNS0 {
+		// RFC 6891 requires the response to contain the OPT RR if the request
+		// does.
+		b = appendOPT(b, d.udpSize, d.doBit)
+	}
+
+	return b, string(msg[l:]), true
+}
+
+// patchPackedReply modifies the packed cached response b to be the response
+// to the request of d, just like [cache.unpackItem] does, setting the TTLs of
+// all the RRs to ttl.  ok is false if b can't be modified this way.
+func patchPackedReply(b []byte, d *DNSContext, ttl uint32) (ok bool) {
+	req := d.Req
+	if len(b) < dnsHeaderLen || binary.BigEndian.Uint16(b[4:]) != 1 {
+		return false
+	}
+
+	binary.BigEndian.PutUint16(b, req.Id)
+
+	flags := binary.BigEndian.Uint16(b[2:])
+	newFlags := flagQR | uint16(req.Opcode)<<opcodeShift | flags&(flagRA|rcodeMask)
+	if req.RecursionDesired {
+		newFlags |= flagRD
+	}
+
+	if req.CheckingDisabled {
+		newFlags |= flagCD
+	}
+
+	// See the comment in filterMsg.
+	if flags&flagAD != 0 && (d.adBit || d.doBit) {
+		newFlags |= flagAD
+	}
+
+	binary.BigEndian.PutUint16(b[2:], newFlags)
+
+	// Use the question name of the request, which may only differ in case from
+	// the stored one.  The stored name is never compressed, since it's the
+	// first one in the message.
+	q := req.Question[0]
+	nameEnd := skipPackedName(b, dnsHeaderLen)
+	off, err := dns.PackDomainName(q.Name, b, dnsHeaderLen, nil, false)
+	if err != nil || nameEnd < 0 || off != nameEnd {
+		return false
+	}
+
+	return patchPackedRRs(b, off+4, q.Qtype, d.doBit, ttl)
+}
+
+// patchPackedRRs sets the TTLs of all the RRs of the packed message b, which
+// start at off, to ttl.  ok is false if b is malformed or contains any OPT RRs,
+// or any DNSSEC RRs which would be removed, see [filterMsg].  qtype is the type
+// of the question.
+func patchPackedRRs(b []byte, off int, qtype uint16, do bool, ttl uint32) (ok bool) {
+	anCount := int(binary.BigEndian.Uint16(b[6:]))
+	total := anCount + int(binary.BigEndian.Uint16(b[8:])) + int(binary.BigEndian.Uint16(b[10:]))
+	for i := range total {
+		off = skipPackedName(b, off)
+		if off < 0 || off+rrFixedLen > len(b) {
+			return false
+		}
+
+		rrType := binary.BigEndian.Uint16(b[off:])
+		if rrType == dns.TypeOPT {
+			return false
+		}
+
+		if !do && isDNSSECType(rrType) && (i >= anCount || rrType != qtype) {
+			return false
+		}
+
+		binary.BigEndian.PutUint32(b[off+4:], ttl)
+		off += rrFixedLen + int(binary.BigEndian.Uint16(b[off+8:]))
+	}
+
+	return off == len(b)
+}
+
+// skipPackedName returns the offset right after the possibly compressed domain
+// name starting at off in the packed message msg.  It returns -1 if the name is
+// malformed.
+func skipPackedName(msg []byte, off int) (next int) {
+	for off >= 0 && off < len(msg) {
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			return off + 1
+		case l&0xc0 == 0xc0:
+			// The pointer ends the name.
+			if off+2 > len(msg) {
+				return -1
+			}
+
+			return off + 2
+		case l&0xc0 != 0:
+			// The extended and the reserved label types.
+			return -1
+		default:
+			off += 1 + l
+		}
+	}
+
+	return -1
+}
+
+// appendOPT appends the OPT RR with udpSize and the DO bit set if do is true to
+// the packed message b and updates its count of the additional RRs, just like
+// [dns.Msg.SetEdns0] does.
+func appendOPT(b []byte, udpSize uint16, do bool) (res []byte) {
+	var doFlag byte
+	if do {
+		doFlag = 0x80
+	}
+
+	res = append(
+		b,
+		// The root domain name.
+		0,
+		// The type.
+		0, byte(dns.TypeOPT),
+		// The class is the UDP payload size.
+		byte(udpSize>>8), byte(udpSize),
+		// The TTL is the extended RCODE, the version, and the flags.
+		0, 0, doFlag, 0,
+		// The length of the data.
+		0, 0,
+	)
+
+	binary.BigEndian.PutUint16(res[10:], binary.BigEndian.Uint16(res[10:])+1)
+
+	return res
+}
+
+// packedHeader returns the message only containing the header of the packed
+// response b to req, which must be valid.
+func packedHeader(b []byte, req *dns.Msg) (m *dns.Msg) {
+	flags := binary.BigEndian.Uint16(b[2:])
+
+	return &dns.Msg{
+		MsgHdr: dns.MsgHdr{
+			Id:                 req.Id,
+			Response:           true,
+			Opcode:             req.Opcode,
+			Truncated:          flags&flagTC != 0,
+			RecursionDesired:   flags&flagRD != 0,
+			RecursionAvailable: flags&flagRA != 0,
+			AuthenticatedData:  flags&flagAD != 0,
+			CheckingDisabled:   flags&flagCD != 0,
+			Rcode:              int(flags & rcodeMask),
+		},
+		Question: req.Question,
+	}
+}
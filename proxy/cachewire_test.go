@@ -0,0 +1,320 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newWireTestRequest returns a new A request for host with the OPT RR if edns
+// is true.
+func newWireTestRequest(host string, edns, do, ad bool) (req *dns.Msg) {
+	req = newHostTestMessage(host)
+	req.AuthenticatedData = ad
+	if edns {
+		req.SetEdns0(dns.DefaultMsgSize, do)
+	}
+
+	return req
+}
+
+// newWireTestResponse returns a new cacheable response to req with ans in the
+// answer section.
+func newWireTestResponse(req *dns.Msg, ad bool, ans ...dns.RR) (resp *dns.Msg) {
+	name := strings.ToLower(req.Question[0].Name)
+
+	resp = (&dns.Msg{}).SetReply(req)
+	resp.AuthenticatedData = ad
+	resp.RecursionAvailable = true
+	resp.Answer = ans
+	resp.Ns = []dns.RR{&dns.NS{
+		Hdr: dns.RR_Header{
+			Name:   name,
+			Rrtype: dns.TypeNS,
+			Class:  dns.ClassINET,
+			Ttl:    defaultTestTTL,
+		},
+		Ns: "ns." + name,
+	}}
+	resp.SetEdns0(dns.DefaultMsgSize, true)
+
+	return resp
+}
+
+// newWireTestRRs returns the A RR for name and the RRSIG RR covering it.
+func newWireTestRRs(name string) (a, sig dns.RR) {
+	a = &dns.A{
+		Hdr: dns.RR_Header{
+			Name:   name,
+			Rrtype: dns.TypeA,
+			Class:  dns.ClassINET,
+			Ttl:    defaultTestTTL,
+		},
+		A: net.IP{192, 0, 2, 1},
+	}
+
+	sig = &dns.RRSIG{
+		Hdr: dns.RR_Header{
+			Name:   name,
+			Rrtype: dns.TypeRRSIG,
+			Class:  dns.ClassINET,
+			Ttl:    defaultTestTTL,
+		},
+		TypeCovered: dns.TypeA,
+		Algorithm:   dns.RSASHA256,
+		Labels:      2,
+		SignerName:  name,
+		Signature:   "c29tZSBycnNpZyByZWxhdGVkIHN0dWZm",
+	}
+
+	return a, sig
+}
+
+func TestPackedReply(t *testing.T) {
+	const host = "example.org"
+
+	now := time.Now()
+	clock := &fakeClock{onNow: func() (t time.Time) { return now }}
+
+	a, sig := newWireTestRRs(host + ".")
+
+	testCases := []struct {
+		req    *dns.Msg
+		name   string
+		ans    []dns.RR
+		respAD bool
+		wantOK bool
+	}{{
+		req:    newWireTestRequest(host, false, false, false),
+		name:   "plain",
+		ans:    []dns.RR{a},
+		respAD: false,
+		wantOK: true,
+	}, {
+		req:    newWireTestRequest(host, true, false, false),
+		name:   "edns",
+		ans:    []dns.RR{a},
+		respAD: true,
+		wantOK: true,
+	}, {
+		req:    newWireTestRequest(host, true, true, false),
+		name:   "do",
+		ans:    []dns.RR{a, sig},
+		respAD: true,
+		wantOK: true,
+	}, {
+		req:    newWireTestRequest(host, false, false, true),
+		name:   "ad",
+		ans:    []dns.RR{a},
+		respAD: true,
+		wantOK: true,
+	}, {
+		req:    newWireTestRequest(host, true, false, false),
+		name:   "dnssec_without_do",
+		ans:    []dns.RR{a, sig},
+		respAD: true,
+		wantOK: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newCache(testCacheSize, false, false, clock, testLogger)
+			c.set(newWireTestResponse(tc.req, tc.respAD, tc.ans...), nil)
+
+			data := c.getPacked(tc.req)
+			require.NotNil(t, data)
+
+			d := &DNSContext{Proto: ProtoUDP, Req: tc.req}
+			d.calcFlagsAndSize()
+
+			b, _, ok := packedReply(nil, data, d, now.Unix())
+			require.Equal(t, tc.wantOK, ok)
+
+			if !ok {
+				return
+			}
+
+			ci, _ := c.unpackItem(data, tc.req)
+			require.NotNil(t, ci)
+
+			d.Res = ci.m
+			d.scrub()
+
+			packed, err := d.Res.Pack()
+			require.NoError(t, err)
+
+			want, got := &dns.Msg{}, &dns.Msg{}
+			require.NoError(t, want.Unpack(packed))
+			require.NoError(t, got.Unpack(b))
+
+			assert.Equal(t, want, got)
+		})
+	}
+
+	t.Run("case", func(t *testing.T) {
+		c := newCache(testCacheSize, false, false, clock, testLogger)
+		c.set(newWireTestResponse(newWireTestRequest(host, false, false, false), false, a), nil)
+
+		req := newWireTestRequest("ExAmple.ORG", false, false, false)
+		data := c.getPacked(req)
+		require.NotNil(t, data)
+
+		d := &DNSContext{Proto: ProtoUDP, Req: req}
+		d.calcFlagsAndSize()
+
+		b, _, ok := packedReply(nil, data, d, now.Unix())
+		require.True(t, ok)
+
+		got := &dns.Msg{}
+		require.NoError(t, got.Unpack(b))
+
+		assert.Equal(t, req.Question, got.Question)
+		require.Len(t, got.Answer, 1)
+		assert.True(t, strings.EqualFold(host+".", got.Answer[0].Header().Name))
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		c := newCache(testCacheSize, false, false, clock, testLogger)
+		req := newWireTestRequest(host, false, false, false)
+		c.set(newWireTestResponse(req, false, a), nil)
+
+		data := c.getPacked(req)
+		require.NotNil(t, data)
+
+		d := &DNSContext{Proto: ProtoUDP, Req: req}
+		d.calcFlagsAndSize()
+
+		_, _, ok := packedReply(nil, data, d, now.Unix()+defaultTestTTL)
+		assert.False(t, ok)
+	})
+}
+
+func TestProxy_replyFromCacheWire(t *testing.T) {
+	const host = "example.org"
+
+	a, sig := newWireTestRRs(host + ".")
+
+	// Larger than the default UDP payload size to require truncation.
+	txt := &dns.TXT{
+		Hdr: dns.RR_Header{
+			Name:   host + ".",
+			Rrtype: dns.TypeTXT,
+			Class:  dns.ClassINET,
+			Ttl:    defaultTestTTL,
+		},
+		Txt: []string{strings.Repeat("a", 255), strings.Repeat("b", 255), strings.Repeat("c", 255)},
+	}
+
+	var exchanges atomic.Int32
+	u := &fakeUpstream{
+		onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			exchanges.Add(1)
+
+			if req.Question[0].Qtype == dns.TypeTXT {
+				return newWireTestResponse(req, false, txt), nil
+			}
+
+			return newWireTestResponse(req, true, a, sig), nil
+		},
+		onAddress: func() (addr string) { return "fake" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	p := mustNew(t, &Config{
+		Logger:         testLogger,
+		UDPListenAddr:  []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		TCPListenAddr:  []*net.TCPAddr{net.TCPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig: &UpstreamConfig{Upstreams: []upstream.Upstream{u}},
+		TrustedProxies: defaultTrustedProxies,
+		CacheEnabled:   true,
+		CacheSizeBytes: testCacheSize,
+
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+	})
+
+	ctx := context.Background()
+	require.NoError(t, p.Start(ctx))
+	testutil.CleanupAndRequireSuccess(t, func() (err error) { return p.Shutdown(ctx) })
+
+	for _, proto := range []Proto{ProtoUDP, ProtoTCP} {
+		client := &dns.Client{Net: string(proto), Timeout: defaultTimeout}
+		addr := p.Addr(proto).String()
+
+		t.Run(string(proto), func(t *testing.T) {
+			req := newWireTestRequest(host, true, true, false)
+			for range 2 {
+				resp, _, err := client.Exchange(req, addr)
+				require.NoError(t, err)
+
+				assert.Equal(t, req.Id, resp.Id)
+				assert.True(t, resp.AuthenticatedData)
+				assert.Len(t, resp.Answer, 2)
+
+				opt := resp.IsEdns0()
+				require.NotNil(t, opt)
+
+				assert.True(t, opt.Do())
+			}
+
+			req = newWireTestRequest(host, false, false, false)
+			resp, _, err := client.Exchange(req, addr)
+			require.NoError(t, err)
+
+			assert.False(t, resp.AuthenticatedData)
+			assert.Len(t, resp.Answer, 1)
+			assert.Nil(t, resp.IsEdns0())
+		})
+	}
+
+	assert.Equal(t, int32(1), exchanges.Load())
+
+	t.Run("truncated", func(t *testing.T) {
+		req := newWireTestRequest(host, false, false, false)
+		req.Question[0].Qtype = dns.TypeTXT
+
+		tcpClient := &dns.Client{Net: string(ProtoTCP), Timeout: defaultTimeout}
+		tcpAddr := p.Addr(ProtoTCP).String()
+		for range 2 {
+			resp, _, err := tcpClient.Exchange(req, tcpAddr)
+			require.NoError(t, err)
+
+			assert.False(t, resp.Truncated)
+			assert.Len(t, resp.Answer, 1)
+		}
+
+		udpClient := &dns.Client{Net: string(ProtoUDP), Timeout: defaultTimeout}
+		resp, _, err := udpClient.Exchange(req, p.Addr(ProtoUDP).String())
+		require.NoError(t, err)
+
+		assert.True(t, resp.Truncated)
+	})
+}
+
+func BenchmarkProxy_cacheHit(b *testing.B) {
+	for _, proto := range []Proto{ProtoUDP, ProtoTCP} {
+		b.Run(string(proto), func(b *testing.B) {
+			benchmarkExchange(b, startBenchProxy(b, func(conf *Config) {
+				conf.CacheEnabled = true
+			}), proto)
+		})
+
+		b.Run(string(proto)+"_msg", func(b *testing.B) {
+			benchmarkExchange(b, startBenchProxy(b, func(conf *Config) {
+				conf.CacheEnabled = true
+				conf.RequestHandler = func(p *Proxy, d *DNSContext) (err error) {
+					return p.Resolve(d)
+				}
+			}), proto)
+		})
+	}
+}
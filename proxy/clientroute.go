@@ -0,0 +1,225 @@
+package proxy
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// ClientRoute is an entry of the client routing table, which makes the queries
+// from particular client subnets or with particular client identities resolved
+// with a separate set of upstreams, so that, for example, the guest network
+// uses a filtering public resolver and the servers network uses the internal
+// one.  The routes are evaluated before the per-domain routing of the upstream
+// configuration.
+type ClientRoute struct {
+	// UpstreamConfig is the set of upstream servers used to resolve the
+	// queries of the clients within Subnets, including its own per-domain
+	// routing.  It must not be nil.  It's closed on shutdown.
+	UpstreamConfig *UpstreamConfig
+
+	// Name is the name of the route used in the logs.
+	Name string
+
+	// Subnets are the networks of the clients of the route.  The route with
+	// the most specific subnet containing the client address is used, unless
+	// the client identity matches another route.
+	Subnets []netip.Prefix
+
+	// ServerNames are the TLS server names indicated by the clients of the
+	// route, see [DNSContext.ServerName].  Those are compared
+	// case-insensitively.
+	ServerNames []string
+
+	// HTTPPaths are the URL paths of the DNS-over-HTTPS requests of the
+	// clients of the route, see [DNSContext.HTTPPath].
+	HTTPPaths []string
+
+	// HTTPUsers are the basic authentication user names of the
+	// DNS-over-HTTPS clients of the route, see [DNSContext.HTTPUser].
+	HTTPUsers []string
+
+	// Countries are the ISO 3166-1 alpha-2 codes of the countries of the
+	// clients of the route, see [DNSContext.Geo].  Those are compared
+	// case-insensitively.  The routes with the countries are only used if no
+	// route matches the client identity, subnet, or ASN.
+	Countries []string
+
+	// ASNs are the numbers of the autonomous systems of the clients of the
+	// route, see [DNSContext.Geo].  The routes with the ASNs are only used if
+	// no route matches the client identity or subnet.
+	ASNs []uint32
+
+	// CacheEnabled defines if the responses are cached.  The route has its own
+	// cache of [Config.CacheSizeBytes] size, which isn't shared with the
+	// general one or the ones of the profiles, since its upstreams may respond
+	// differently.
+	CacheEnabled bool
+}
+
+// clientRoute is a [ClientRoute] prepared to be used by the proxy.
+type clientRoute struct {
+	*ClientRoute
+
+	// cache is the cache of the route.  It's nil if the cache is disabled.
+	cache *cache
+}
+
+// validateClientRoutes returns an error if any of p.ClientRoutes is invalid.
+func (p *Proxy) validateClientRoutes() (err error) {
+	for i, r := range p.ClientRoutes {
+		err = r.validate()
+		if err == nil && p.GeoLocator == nil && (len(r.Countries) > 0 || len(r.ASNs) > 0) {
+			err = errors.Error("geo: no geo locator")
+		}
+
+		if err != nil {
+			return fmt.Errorf("route at index %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+// validate returns an error if r is invalid.
+func (r *ClientRoute) validate() (err error) {
+	if r == nil {
+		return errors.Error("no route")
+	} else if !r.hasClients() {
+		return errors.Error("no clients")
+	}
+
+	for i, pref := range r.Subnets {
+		if !pref.IsValid() {
+			return fmt.Errorf("subnet at index %d: bad prefix", i)
+		}
+	}
+
+	for i, c := range r.Countries {
+		if len(c) != 2 {
+			return fmt.Errorf("country at index %d: bad code %q", i, c)
+		}
+	}
+
+	if r.UpstreamConfig == nil {
+		return errors.Error("upstreams: no upstream config")
+	}
+
+	err = r.UpstreamConfig.validate()
+	if err != nil {
+		return fmt.Errorf("upstreams: %w", err)
+	}
+
+	return nil
+}
+
+// hasClients returns true if r matches any clients.
+func (r *ClientRoute) hasClients() (ok bool) {
+	return len(r.Subnets) > 0 ||
+		len(r.ServerNames) > 0 ||
+		len(r.HTTPPaths) > 0 ||
+		len(r.HTTPUsers) > 0 ||
+		len(r.Countries) > 0 ||
+		len(r.ASNs) > 0
+}
+
+// matchesIdentity returns true if the client identity of d matches r.
+func (r *ClientRoute) matchesIdentity(d *DNSContext) (ok bool) {
+	if d.ServerName != "" && slices.ContainsFunc(r.ServerNames, func(n string) (eq bool) {
+		return strings.EqualFold(n, d.ServerName)
+	}) {
+		return true
+	}
+
+	return d.Proto == ProtoHTTPS &&
+		(slices.Contains(r.HTTPPaths, d.HTTPPath) ||
+			d.HTTPUser != "" && slices.Contains(r.HTTPUsers, d.HTTPUser))
+}
+
+// initClientRoutes prepares the client routes of p to be used.
+func (p *Proxy) initClientRoutes() {
+	p.clientRoutes = make([]*clientRoute, 0, len(p.ClientRoutes))
+	for _, r := range p.ClientRoutes {
+		var c *cache
+		if r.CacheEnabled {
+			// The subnet cache is always created, since the EDNS Client Subnet
+			// settings depend on the profile of the request.
+			c = newCache(p.CacheSizeBytes, true, false, p.time, p.cacheLogger)
+		}
+
+		p.clientRoutes = append(p.clientRoutes, &clientRoute{
+			ClientRoute: r,
+			cache:       c,
+		})
+
+		p.logger.Info("using client route", "name", r.Name, "subnets", r.Subnets)
+	}
+}
+
+// clientRouteFor returns the client route for the request of d.  The first
+// route matching the client identity is used, then the one with the most
+// specific subnet containing the client address, and then the first one
+// matching the ASN or the country of the client.  It returns nil if there is
+// no such route.
+func (p *Proxy) clientRouteFor(d *DNSContext) (r *clientRoute) {
+	for _, r = range p.clientRoutes {
+		if r.matchesIdentity(d) {
+			return r
+		}
+	}
+
+	r = p.clientRouteForAddr(d.Addr.Addr())
+	if r != nil || d.Geo == nil {
+		return r
+	}
+
+	return p.clientRouteForGeo(d.Geo)
+}
+
+// clientRouteForGeo returns the first client route matching the ASN from info,
+// or, if there is none, the first one matching the country.  It returns nil if
+// there is no such route.
+func (p *Proxy) clientRouteForGeo(info *GeoInfo) (r *clientRoute) {
+	if info.ASN != 0 {
+		for _, r = range p.clientRoutes {
+			if slices.Contains(r.ASNs, info.ASN) {
+				return r
+			}
+		}
+	}
+
+	if info.Country != "" {
+		for _, r = range p.clientRoutes {
+			if slices.ContainsFunc(r.Countries, func(c string) (eq bool) {
+				return strings.EqualFold(c, info.Country)
+			}) {
+				return r
+			}
+		}
+	}
+
+	return nil
+}
+
+// clientRouteForAddr returns the client route with the most specific subnet
+// containing addr.  It returns nil if there is no such route.
+func (p *Proxy) clientRouteForAddr(addr netip.Addr) (r *clientRoute) {
+	if !addr.IsValid() {
+		return nil
+	}
+
+	addr = addr.Unmap()
+	bits := -1
+	for _, candidate := range p.clientRoutes {
+		for _, pref := range candidate.Subnets {
+			if pref.Bits() > bits && pref.Contains(addr) {
+				r, bits = candidate, pref.Bits()
+			}
+		}
+	}
+
+	return r
+}
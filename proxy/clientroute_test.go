@@ -0,0 +1,406 @@
+package proxy
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/netip"
+	"net/url"
+	"sync/atomic"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_clientRoutes(t *testing.T) {
+	var exchanges atomic.Int32
+	routeUps := newProfileTestUpstream("192.0.2.3")
+	onExchange := routeUps.onExchange
+	routeUps.onExchange = func(req *dns.Msg) (resp *dns.Msg, err error) {
+		exchanges.Add(1)
+
+		return onExchange(req)
+	}
+
+	p := mustNew(t, &Config{
+		Logger:        testLogger,
+		UDPListenAddr: []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{newProfileTestUpstream("192.0.2.1")},
+		},
+		TrustedProxies: defaultTrustedProxies,
+		CacheEnabled:   true,
+		CacheSizeBytes: defaultCacheSize,
+		ClientRoutes: []*ClientRoute{{
+			UpstreamConfig: &UpstreamConfig{
+				Upstreams: []upstream.Upstream{newProfileTestUpstream("192.0.2.2")},
+			},
+			Name:    "loopback",
+			Subnets: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")},
+		}, {
+			UpstreamConfig: &UpstreamConfig{
+				Upstreams: []upstream.Upstream{routeUps},
+			},
+			Name:         "localhost",
+			Subnets:      []netip.Prefix{netip.MustParsePrefix("127.0.0.1/32")},
+			CacheEnabled: true,
+		}},
+	})
+
+	ctx := context.Background()
+	require.NoError(t, p.Start(ctx))
+	testutil.CleanupAndRequireSuccess(t, func() (err error) { return p.Shutdown(ctx) })
+
+	client := &dns.Client{Net: string(ProtoUDP), Timeout: defaultTimeout}
+	exchange := func(t *testing.T) (ip net.IP) {
+		t.Helper()
+
+		resp, _, err := client.Exchange(newHostTestMessage("route.example"), p.Addr(ProtoUDP).String())
+		require.NoError(t, err)
+		require.NotEmpty(t, resp.Answer)
+
+		a := testutil.RequireTypeAssert[*dns.A](t, resp.Answer[0])
+
+		return a.A.To4()
+	}
+
+	// The most specific route is used.
+	assert.Equal(t, net.IP{192, 0, 2, 3}, exchange(t))
+
+	// The response is cached in the cache of the route.
+	assert.Equal(t, net.IP{192, 0, 2, 3}, exchange(t))
+	assert.Equal(t, int32(1), exchanges.Load())
+}
+
+func TestProxy_clientRouteForAddr(t *testing.T) {
+	p := mustNew(t, &Config{
+		Logger:         testLogger,
+		UpstreamConfig: newTestUpstreamConfig(t, defaultTimeout, testDefaultUpstreamAddr),
+		ClientRoutes: []*ClientRoute{{
+			UpstreamConfig: newTestUpstreamConfig(t, defaultTimeout, testDefaultUpstreamAddr),
+			Name:           "guests",
+			Subnets:        []netip.Prefix{netip.MustParsePrefix("192.168.0.0/16")},
+		}, {
+			UpstreamConfig: newTestUpstreamConfig(t, defaultTimeout, testDefaultUpstreamAddr),
+			Name:           "servers",
+			Subnets: []netip.Prefix{
+				netip.MustParsePrefix("192.168.10.0/24"),
+				netip.MustParsePrefix("2001:db8::/32"),
+			},
+		}},
+	})
+
+	testCases := []struct {
+		addr     netip.Addr
+		name     string
+		wantName string
+	}{{
+		addr:     netip.MustParseAddr("192.168.1.1"),
+		name:     "guests",
+		wantName: "guests",
+	}, {
+		addr:     netip.MustParseAddr("192.168.10.1"),
+		name:     "more_specific",
+		wantName: "servers",
+	}, {
+		addr:     netip.MustParseAddr("::ffff:192.168.10.1"),
+		name:     "mapped",
+		wantName: "servers",
+	}, {
+		addr:     netip.MustParseAddr("2001:db8::1"),
+		name:     "ipv6",
+		wantName: "servers",
+	}, {
+		addr:     netip.MustParseAddr("10.0.0.1"),
+		name:     "none",
+		wantName: "",
+	}, {
+		addr:     netip.Addr{},
+		name:     "invalid",
+		wantName: "",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := p.clientRouteForAddr(tc.addr)
+			if tc.wantName == "" {
+				assert.Nil(t, r)
+			} else {
+				require.NotNil(t, r)
+				assert.Equal(t, tc.wantName, r.Name)
+			}
+		})
+	}
+}
+
+// fakeGeoLocator is a [GeoLocator] for tests.
+type fakeGeoLocator map[netip.Addr]*GeoInfo
+
+// type check
+var _ GeoLocator = fakeGeoLocator(nil)
+
+// Locate implements the [GeoLocator] interface for fakeGeoLocator.
+func (l fakeGeoLocator) Locate(addr netip.Addr) (info *GeoInfo) {
+	return l[addr]
+}
+
+func TestProxy_clientRouteFor_geo(t *testing.T) {
+	p := mustNew(t, &Config{
+		Logger:         testLogger,
+		UpstreamConfig: newTestUpstreamConfig(t, defaultTimeout, testDefaultUpstreamAddr),
+		GeoLocator: fakeGeoLocator{
+			netip.MustParseAddr("192.168.1.1"):  {Country: "DE", ASN: 64496},
+			netip.MustParseAddr("192.0.2.1"):    {Country: "DE", ASN: 64496},
+			netip.MustParseAddr("192.0.2.2"):    {Country: "DE", ASN: 64497},
+			netip.MustParseAddr("2001:db8::1"):  {Country: "FR"},
+			netip.MustParseAddr("198.51.100.1"): {ASN: 64497},
+		},
+		ClientRoutes: []*ClientRoute{{
+			UpstreamConfig: newTestUpstreamConfig(t, defaultTimeout, testDefaultUpstreamAddr),
+			Name:           "germany",
+			Countries:      []string{"de"},
+		}, {
+			UpstreamConfig: newTestUpstreamConfig(t, defaultTimeout, testDefaultUpstreamAddr),
+			Name:           "provider",
+			ASNs:           []uint32{64496},
+		}, {
+			UpstreamConfig: newTestUpstreamConfig(t, defaultTimeout, testDefaultUpstreamAddr),
+			Name:           "lan",
+			Subnets:        []netip.Prefix{netip.MustParsePrefix("192.168.0.0/16")},
+		}},
+	})
+
+	testCases := []struct {
+		addr     netip.Addr
+		name     string
+		wantName string
+	}{{
+		addr:     netip.MustParseAddr("192.168.1.1"),
+		name:     "subnet",
+		wantName: "lan",
+	}, {
+		addr:     netip.MustParseAddr("192.0.2.1"),
+		name:     "asn",
+		wantName: "provider",
+	}, {
+		addr:     netip.MustParseAddr("::ffff:192.0.2.2"),
+		name:     "country",
+		wantName: "germany",
+	}, {
+		addr:     netip.MustParseAddr("2001:db8::1"),
+		name:     "other_country",
+		wantName: "",
+	}, {
+		addr:     netip.MustParseAddr("198.51.100.1"),
+		name:     "other_asn",
+		wantName: "",
+	}, {
+		addr:     netip.MustParseAddr("203.0.113.1"),
+		name:     "unknown",
+		wantName: "",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			d := &DNSContext{Addr: netip.AddrPortFrom(tc.addr, 53)}
+			d.Geo = p.locate(d)
+
+			r := p.clientRouteFor(d)
+			if tc.wantName == "" {
+				assert.Nil(t, r)
+			} else {
+				require.NotNil(t, r)
+				assert.Equal(t, tc.wantName, r.Name)
+			}
+		})
+	}
+}
+
+func TestNew_clientRoutes(t *testing.T) {
+	subnets := []netip.Prefix{netip.MustParsePrefix("192.168.0.0/16")}
+
+	testCases := []struct {
+		name       string
+		wantErrMsg string
+		routes     []*ClientRoute
+	}{{
+		name:       "nil",
+		wantErrMsg: "validating client routes: route at index 0: no route",
+		routes:     []*ClientRoute{nil},
+	}, {
+		name:       "no_clients",
+		wantErrMsg: "validating client routes: route at index 0: no clients",
+		routes: []*ClientRoute{{
+			UpstreamConfig: &UpstreamConfig{},
+		}},
+	}, {
+		name:       "bad_subnet",
+		wantErrMsg: "validating client routes: route at index 0: subnet at index 0: bad prefix",
+		routes: []*ClientRoute{{
+			Subnets: []netip.Prefix{{}},
+		}},
+	}, {
+		name:       "no_upstreams",
+		wantErrMsg: "validating client routes: route at index 0: upstreams: no upstream config",
+		routes: []*ClientRoute{{
+			Subnets: subnets,
+		}},
+	}, {
+		name:       "bad_country",
+		wantErrMsg: `validating client routes: route at index 0: country at index 0: bad code "DEU"`,
+		routes: []*ClientRoute{{
+			Countries: []string{"DEU"},
+		}},
+	}, {
+		name:       "no_geo_locator",
+		wantErrMsg: "validating client routes: route at index 0: geo: no geo locator",
+		routes: []*ClientRoute{{
+			UpstreamConfig: &UpstreamConfig{
+				Upstreams: []upstream.Upstream{newProfileTestUpstream("192.0.2.2")},
+			},
+			ASNs: []uint32{64496},
+		}},
+	}, {
+		name:       "empty_upstreams",
+		wantErrMsg: "validating client routes: route at index 0: upstreams: no upstream specified",
+		routes: []*ClientRoute{{
+			UpstreamConfig: &UpstreamConfig{},
+			Subnets:        subnets,
+		}},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := New(&Config{
+				Logger: testLogger,
+				UpstreamConfig: &UpstreamConfig{
+					Upstreams: []upstream.Upstream{newProfileTestUpstream("192.0.2.1")},
+				},
+				ClientRoutes: tc.routes,
+			})
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+		})
+	}
+}
+
+func TestProxy_clientRoutes_identity(t *testing.T) {
+	tlsConf, caPem := newTLSConfig(t)
+	p := mustNew(t, &Config{
+		Logger:          testLogger,
+		HTTPSListenAddr: []*net.TCPAddr{net.TCPAddrFromAddrPort(localhostAnyPort)},
+		TLSConfig:       tlsConf,
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{newProfileTestUpstream("192.0.2.1")},
+		},
+		TrustedProxies: defaultTrustedProxies,
+		ClientRoutes: []*ClientRoute{{
+			UpstreamConfig: &UpstreamConfig{
+				Upstreams: []upstream.Upstream{newProfileTestUpstream("192.0.2.2")},
+			},
+			Name:      "kids",
+			HTTPPaths: []string{"/dns-query/kids"},
+		}, {
+			UpstreamConfig: &UpstreamConfig{
+				Upstreams: []upstream.Upstream{newProfileTestUpstream("192.0.2.3")},
+			},
+			Name:      "laptop",
+			HTTPUsers: []string{"laptop"},
+		}},
+	})
+
+	type identity struct {
+		serverName string
+		path       string
+		user       string
+	}
+
+	idents := make(chan identity, 1)
+	p.Use(func(next RequestHandler) (h RequestHandler) {
+		return func(p *Proxy, d *DNSContext) (err error) {
+			idents <- identity{
+				serverName: d.ServerName,
+				path:       d.HTTPPath,
+				user:       d.HTTPUser,
+			}
+
+			return next(p, d)
+		}
+	})
+
+	ctx := context.Background()
+	require.NoError(t, p.Start(ctx))
+	testutil.CleanupAndRequireSuccess(t, func() (err error) { return p.Shutdown(ctx) })
+
+	client := createTestHTTPClient(p, caPem, false)
+
+	testCases := []struct {
+		user      *url.Userinfo
+		wantIP    net.IP
+		name      string
+		path      string
+		wantIdent identity
+	}{{
+		user:   nil,
+		wantIP: net.IP{192, 0, 2, 1},
+		name:   "default",
+		path:   "/dns-query",
+		wantIdent: identity{
+			serverName: tlsServerName,
+			path:       "/dns-query",
+		},
+	}, {
+		user:   nil,
+		wantIP: net.IP{192, 0, 2, 2},
+		name:   "path",
+		path:   "/dns-query/kids",
+		wantIdent: identity{
+			serverName: tlsServerName,
+			path:       "/dns-query/kids",
+		},
+	}, {
+		user:   url.UserPassword("laptop", "secret"),
+		wantIP: net.IP{192, 0, 2, 3},
+		name:   "user",
+		path:   "/dns-query",
+		wantIdent: identity{
+			serverName: tlsServerName,
+			path:       "/dns-query",
+			user:       "laptop",
+		},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			packed, err := newHostTestMessage("route.example").Pack()
+			require.NoError(t, err)
+
+			u := &url.URL{
+				Scheme:   "https",
+				User:     tc.user,
+				Host:     tlsServerName,
+				Path:     tc.path,
+				RawQuery: "dns=" + base64.RawURLEncoding.EncodeToString(packed),
+			}
+
+			httpResp, err := client.Get(u.String())
+			require.NoError(t, err)
+			testutil.CleanupAndRequireSuccess(t, httpResp.Body.Close)
+
+			body, err := io.ReadAll(httpResp.Body)
+			require.NoError(t, err)
+
+			resp := &dns.Msg{}
+			require.NoError(t, resp.Unpack(body))
+			require.NotEmpty(t, resp.Answer)
+
+			a := testutil.RequireTypeAssert[*dns.A](t, resp.Answer[0])
+			assert.Equal(t, tc.wantIP, a.A.To4())
+			assert.Equal(t, tc.wantIdent, <-idents)
+		})
+	}
+}
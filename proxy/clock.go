@@ -2,20 +2,21 @@ package proxy
 
 import "time"
 
-// clock is the interface for provider of current time.  It's used to simplify
-// testing.
+// Clock is the interface for provider of current time.  It's used to simplify
+// testing and to virtualize the time, so that the expiration of the cached
+// responses and the ratelimiting windows are deterministic.
 //
 // TODO(e.burkov):  Move to golibs.
-type clock interface {
+type Clock interface {
 	// Now returns the current local time.
 	Now() (now time.Time)
 }
 
 // type check
-var _ clock = realClock{}
+var _ Clock = realClock{}
 
-// realClock is the [clock] which actually uses the [time] package.
+// realClock is the [Clock] which actually uses the [time] package.
 type realClock struct{}
 
-// Now implements the [clock] interface for RealClock.
+// Now implements the [Clock] interface for RealClock.
 func (realClock) Now() (now time.Time) { return time.Now() }
@@ -0,0 +1,183 @@
+package proxy
+
+import (
+	"net/netip"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/miekg/dns"
+)
+
+// maxCNAMEChaseDepth is the maximum number of the CNAME targets resolved for a
+// single response, so that the long and looping chains don't multiply the
+// upstream requests.
+const maxCNAMEChaseDepth = 8
+
+// chaseCNAME resolves the target of the CNAME chain of dctx.Res, if the
+// upstream has returned the chain without the records of the requested type,
+// and appends the resolved records to the answer section.  It does nothing
+// unless [Config.ResolveCNAMETargets] is set.
+//
+// The targets are resolved through the cache and the upstreams chosen for them
+// just like the requests of the same client would be, so that the per-domain
+// upstreams are respected.
+func (p *Proxy) chaseCNAME(dctx *DNSContext) {
+	resp := dctx.Res
+	if !p.ResolveCNAMETargets || resp == nil || resp.Rcode != dns.RcodeSuccess {
+		return
+	}
+
+	q := dctx.Req.Question[0]
+	switch q.Qtype {
+	case dns.TypeCNAME, dns.TypeANY:
+		return
+	default:
+		// Go on.
+	}
+
+	seen := map[string]struct{}{strings.ToLower(q.Name): {}}
+	for range maxCNAMEChaseDepth {
+		target := cnameChainTarget(resp, q.Name, q.Qtype)
+		if target == "" {
+			return
+		}
+
+		target = strings.ToLower(target)
+		if _, ok := seen[target]; ok {
+			p.logger.Debug("cname loop detected", "qname", q.Name, "target", target)
+
+			return
+		}
+
+		seen[target] = struct{}{}
+
+		p.logger.Debug("resolving cname target", "qname", q.Name, "target", target)
+
+		targetResp := p.resolveCNAMETarget(dctx, target, q.Qtype)
+		if targetResp == nil || len(targetResp.Answer) == 0 {
+			return
+		}
+
+		resp.Answer = append(resp.Answer, targetResp.Answer...)
+		resp.AuthenticatedData = resp.AuthenticatedData && targetResp.AuthenticatedData
+		if targetResp.Rcode == dns.RcodeNameError {
+			resp.Rcode = dns.RcodeNameError
+			resp.Ns = targetResp.Ns
+
+			return
+		}
+	}
+}
+
+// cnameChainTarget returns the last name of the CNAME chain starting at name
+// in the answer section of resp, if resp contains no records of qtype for it.
+// Otherwise, it returns an empty string.
+func cnameChainTarget(resp *dns.Msg, name string, qtype uint16) (target string) {
+	// The chain can't be longer than the answer section, which also stops the
+	// looping chains.
+	for range len(resp.Answer) {
+		next := cnameOf(resp.Answer, name)
+		if next == "" {
+			break
+		}
+
+		name, target = next, next
+	}
+
+	if target == "" {
+		return ""
+	}
+
+	for _, rr := range resp.Answer {
+		hdr := rr.Header()
+		if hdr.Rrtype == qtype && strings.EqualFold(hdr.Name, target) {
+			return ""
+		}
+	}
+
+	return target
+}
+
+// cnameOf returns the target of the CNAME record of name among rrs, or an
+// empty string if there is none.
+func cnameOf(rrs []dns.RR, name string) (target string) {
+	for _, rr := range rrs {
+		if cname, ok := rr.(*dns.CNAME); ok && strings.EqualFold(cname.Hdr.Name, name) {
+			return cname.Target
+		}
+	}
+
+	return ""
+}
+
+// resolveCNAMETarget resolves the records of qtype for target on behalf of the
+// client of dctx.  It returns nil if target couldn't be resolved.  It must
+// only be called within [Proxy.Resolve], since it doesn't lock the
+// configuration.
+func (p *Proxy) resolveCNAMETarget(dctx *DNSContext, target string, qtype uint16) (resp *dns.Msg) {
+	sub := newCNAMETargetContext(dctx, target, qtype)
+
+	cacheWorks := p.cacheWorks(sub)
+	insecure := p.insecure.match(sub.Req)
+	if cacheWorks {
+		if p.replyFromCache(sub) {
+			return sub.Res
+		}
+
+		if !insecure {
+			addDO(sub.Req)
+		}
+	}
+
+	if p.cacheOnly.Load() {
+		return nil
+	}
+
+	var ok bool
+	var err error
+	if insecure {
+		ok, err = p.replyFromUpstreamInsecure(sub)
+	} else {
+		ok, err = p.replyFromUpstream(sub)
+	}
+
+	if err != nil || !ok {
+		p.logger.Debug("resolving cname target", "target", target, slogutil.KeyError, err)
+
+		return nil
+	}
+
+	isPrivate := sub.RequestedPrivateRDNS != netip.Prefix{}
+	if cacheWorks && !sub.Res.CheckingDisabled && !isPrivate {
+		p.cacheResp(sub)
+	}
+
+	return sub.Res
+}
+
+// newCNAMETargetContext returns a copy of dctx for the request of the records
+// of qtype for target.  The copy keeps the client information used to choose
+// the upstreams and the cache, but none of the results of dctx.
+func newCNAMETargetContext(dctx *DNSContext, target string, qtype uint16) (sub *DNSContext) {
+	req := (&dns.Msg{}).SetQuestion(target, qtype)
+	req.RecursionDesired = dctx.Req.RecursionDesired
+	req.CheckingDisabled = dctx.Req.CheckingDisabled
+	if opt := dctx.Req.IsEdns0(); opt != nil {
+		// Keep the EDNS Client Subnet option and the DO bit of the client.
+		req.Extra = append(req.Extra, dns.Copy(opt))
+	}
+
+	clone := *dctx
+	sub = &clone
+	sub.Req = req
+	sub.Res = nil
+	sub.Upstream = nil
+	sub.CachedUpstreamAddr = ""
+	sub.RequestedPrivateRDNS = netip.Prefix{}
+	sub.resECS = netip.Prefix{}
+	sub.QueryDuration = 0
+	sub.cacheHit = false
+	sub.calcFlagsAndSize()
+
+	return sub
+}
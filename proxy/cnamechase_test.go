@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_chaseCNAME(t *testing.T) {
+	const (
+		qname       = "www.example.org."
+		targetLocal = "cdn.example.org."
+		targetExt   = "edge.example.net."
+		loopName    = "loop.example.org."
+	)
+
+	targetAddr := netip.MustParseAddr("192.0.2.1")
+
+	newCNAME := func(name, target string) (rr dns.RR) {
+		return &dns.CNAME{
+			Hdr:    dns.RR_Header{Name: name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60},
+			Target: target,
+		}
+	}
+
+	// The default upstream returns the CNAME records only.
+	defaultUps := &fakeUpstream{
+		onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			resp = (&dns.Msg{}).SetReply(req)
+			switch name := req.Question[0].Name; name {
+			case qname:
+				resp.Answer = append(resp.Answer, newCNAME(qname, targetLocal))
+			case targetLocal:
+				resp.Answer = append(resp.Answer, newCNAME(targetLocal, targetExt))
+			case loopName:
+				resp.Answer = append(resp.Answer, newCNAME(loopName, loopName))
+			}
+
+			return resp, nil
+		},
+		onAddress: func() (addr string) { return "default" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	var targetReqs int
+	targetUps := &fakeUpstream{
+		onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			targetReqs++
+
+			resp = (&dns.Msg{}).SetReply(req)
+			resp.Answer = append(resp.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: targetExt, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   targetAddr.AsSlice(),
+			})
+
+			return resp, nil
+		},
+		onAddress: func() (addr string) { return "target" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	newProxy := func(t *testing.T, resolve bool) (p *Proxy) {
+		t.Helper()
+
+		return mustNew(t, &Config{
+			Logger:        testLogger,
+			UDPListenAddr: []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+			UpstreamConfig: &UpstreamConfig{
+				Upstreams: []upstream.Upstream{defaultUps},
+				DomainReservedUpstreams: map[string][]upstream.Upstream{
+					"example.net.": {targetUps},
+				},
+			},
+			TrustedProxies:      defaultTrustedProxies,
+			CacheEnabled:        true,
+			CacheSizeBytes:      defaultCacheSize,
+			ResolveCNAMETargets: resolve,
+		})
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		p := newProxy(t, false)
+
+		d := &DNSContext{Req: newHostTestMessage("www.example.org")}
+		require.NoError(t, p.Resolve(d))
+
+		assert.Len(t, d.Res.Answer, 1)
+	})
+
+	t.Run("enabled", func(t *testing.T) {
+		targetReqs = 0
+		p := newProxy(t, true)
+
+		d := &DNSContext{Req: newHostTestMessage("www.example.org")}
+		require.NoError(t, p.Resolve(d))
+
+		require.Len(t, d.Res.Answer, 3)
+		assert.Equal(t, targetExt, d.Res.Answer[1].(*dns.CNAME).Target)
+
+		a := testutil.RequireTypeAssert[*dns.A](t, d.Res.Answer[2])
+		assert.Equal(t, net.IP(targetAddr.AsSlice()), a.A)
+		assert.Equal(t, 1, targetReqs)
+
+		// The complete response is cached.
+		d = &DNSContext{Req: newHostTestMessage("www.example.org")}
+		require.NoError(t, p.Resolve(d))
+
+		assert.Len(t, d.Res.Answer, 3)
+		assert.Equal(t, 1, targetReqs)
+	})
+
+	t.Run("loop", func(t *testing.T) {
+		p := newProxy(t, true)
+
+		d := &DNSContext{Req: newHostTestMessage("loop.example.org")}
+		require.NoError(t, p.Resolve(d))
+
+		assert.Len(t, d.Res.Answer, 1)
+	})
+}
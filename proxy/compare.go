@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/miekg/dns"
+)
+
+// compareMaxInFlight is the maximum number of the comparison requests being
+// exchanged at once.  The requests exceeding it aren't compared, so that a slow
+// comparison upstream doesn't affect the proxy.
+const compareMaxInFlight = 256
+
+// initCompare initializes the comparison of the responses.
+func (p *Proxy) initCompare() {
+	if p.CompareUpstreamConfig == nil {
+		p.compareSema = nil
+
+		return
+	}
+
+	p.logger.Info("comparing responses with the comparison upstreams")
+
+	p.compareSema = make(chan struct{}, compareMaxInFlight)
+}
+
+// compare resolves req with the comparison upstreams in a separate goroutine
+// and logs the differences between the response and resp received from u.
+func (p *Proxy) compare(req, resp *dns.Msg, u upstream.Upstream) {
+	if p.compareSema == nil || resp == nil {
+		return
+	}
+
+	ups := p.CompareUpstreamConfig.getUpstreamsForDomain(req.Question[0].Name)
+	if len(ups) == 0 {
+		return
+	}
+
+	select {
+	case p.compareSema <- struct{}{}:
+	default:
+		p.upstreamLogger.Debug("too many compared requests in flight, skipping")
+
+		return
+	}
+
+	req, resp = req.Copy(), resp.Copy()
+	go func() {
+		defer func() { <-p.compareSema }()
+		defer slogutil.RecoverAndLog(context.TODO(), p.upstreamLogger)
+
+		q := req.Question[0]
+		l := p.upstreamLogger.With(
+			"qname", q.Name,
+			"qtype", dns.Type(q.Qtype),
+			"primary", u.Address(),
+		)
+
+		cmpResp, cmpUps, err := upstream.ExchangeParallel(ups, req)
+		if err != nil {
+			l.Info("comparison exchange failed", slogutil.KeyError, err)
+
+			return
+		}
+
+		diff := responseDiff(resp, cmpResp)
+		if len(diff) == 0 {
+			l.Debug("responses are equal", "secondary", cmpUps.Address())
+
+			return
+		}
+
+		l.Info(
+			"responses differ",
+			"secondary", cmpUps.Address(),
+			"diff", strings.Join(diff, "; "),
+		)
+	}()
+}
+
+// responseDiff returns the descriptions of the structural differences between
+// the primary and the secondary responses: the response codes, the addresses
+// and the other records in the answer sections, and the minimum TTLs of the
+// answers.  diff is empty if there are no differences.
+func responseDiff(primary, secondary *dns.Msg) (diff []string) {
+	if primary.Rcode != secondary.Rcode {
+		diff = append(diff, fmt.Sprintf(
+			"rcode: %s != %s",
+			dns.RcodeToString[primary.Rcode],
+			dns.RcodeToString[secondary.Rcode],
+		))
+	}
+
+	pIPs, pRRs, pTTL := answerSummary(primary)
+	sIPs, sRRs, sTTL := answerSummary(secondary)
+
+	if !slices.Equal(pIPs, sIPs) {
+		diff = append(diff, fmt.Sprintf("answer ips: %v != %v", pIPs, sIPs))
+	}
+
+	if !slices.Equal(pRRs, sRRs) {
+		diff = append(diff, fmt.Sprintf("answer records: %v != %v", pRRs, sRRs))
+	}
+
+	if pTTL != sTTL {
+		diff = append(diff, fmt.Sprintf("min ttl: %d != %d", pTTL, sTTL))
+	}
+
+	return diff
+}
+
+// answerSummary returns the sorted addresses of the A and AAAA records, the
+// sorted other records without their headers, and the minimum TTL of the
+// answer section of m.
+func answerSummary(m *dns.Msg) (ips, rrs []string, minTTL uint32) {
+	for i, rr := range m.Answer {
+		hdr := rr.Header()
+		if i == 0 || hdr.Ttl < minTTL {
+			minTTL = hdr.Ttl
+		}
+
+		switch rr := rr.(type) {
+		case *dns.A:
+			ips = append(ips, rr.A.String())
+		case *dns.AAAA:
+			ips = append(ips, rr.AAAA.String())
+		default:
+			s := strings.TrimPrefix(rr.String(), hdr.String())
+			rrs = append(rrs, dns.Type(hdr.Rrtype).String()+" "+s)
+		}
+	}
+
+	slices.Sort(ips)
+	slices.Sort(rrs)
+
+	return ips, rrs, minTTL
+}
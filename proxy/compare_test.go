@@ -0,0 +1,173 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newCompareTestReply returns a reply to req with a single A record with the
+// given address and TTL.
+func newCompareTestReply(req *dns.Msg, ip string, ttl uint32) (resp *dns.Msg) {
+	resp = (&dns.Msg{}).SetReply(req)
+	resp.Answer = append(resp.Answer, &dns.A{
+		Hdr: dns.RR_Header{
+			Name:   req.Question[0].Name,
+			Rrtype: dns.TypeA,
+			Class:  dns.ClassINET,
+			Ttl:    ttl,
+		},
+		A: net.ParseIP(ip),
+	})
+
+	return resp
+}
+
+func TestResponseDiff(t *testing.T) {
+	req := newHostTestMessage("compare.example")
+	base := newCompareTestReply(req, "192.0.2.1", 60)
+
+	nxdomain := (&dns.Msg{}).SetRcode(req, dns.RcodeNameError)
+
+	reordered := newCompareTestReply(req, "192.0.2.2", 60)
+	reordered.Answer = append(reordered.Answer, base.Answer[0])
+
+	withCNAME := newCompareTestReply(req, "192.0.2.1", 60)
+	withCNAME.Answer = append(withCNAME.Answer, &dns.CNAME{
+		Hdr: dns.RR_Header{
+			Name:   req.Question[0].Name,
+			Rrtype: dns.TypeCNAME,
+			Class:  dns.ClassINET,
+			Ttl:    60,
+		},
+		Target: "other.example.",
+	})
+
+	testCases := []struct {
+		secondary *dns.Msg
+		name      string
+		want      []string
+	}{{
+		secondary: newCompareTestReply(req, "192.0.2.1", 60),
+		name:      "equal",
+		want:      nil,
+	}, {
+		secondary: nxdomain,
+		name:      "rcode",
+		want: []string{
+			"rcode: NOERROR != NXDOMAIN",
+			"answer ips: [192.0.2.1] != []",
+			"min ttl: 60 != 0",
+		},
+	}, {
+		secondary: newCompareTestReply(req, "192.0.2.2", 60),
+		name:      "ips",
+		want:      []string{"answer ips: [192.0.2.1] != [192.0.2.2]"},
+	}, {
+		secondary: newCompareTestReply(req, "192.0.2.1", 30),
+		name:      "ttl",
+		want:      []string{"min ttl: 60 != 30"},
+	}, {
+		secondary: withCNAME,
+		name:      "records",
+		want:      []string{"answer records: [] != [CNAME other.example.]"},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, responseDiff(base, tc.secondary))
+		})
+	}
+
+	t.Run("order", func(t *testing.T) {
+		primary := newCompareTestReply(req, "192.0.2.1", 60)
+		primary.Answer = append(primary.Answer, reordered.Answer[0])
+
+		assert.Empty(t, responseDiff(primary, reordered))
+	})
+}
+
+// syncBuffer is a [bytes.Buffer] safe for concurrent use.
+type syncBuffer struct {
+	mu  *sync.Mutex
+	buf *bytes.Buffer
+}
+
+// Write implements the [io.Writer] interface for *syncBuffer.
+func (b *syncBuffer) Write(p []byte) (n int, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.Write(p)
+}
+
+// String returns the contents of the buffer.
+func (b *syncBuffer) String() (s string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.String()
+}
+
+func TestProxy_compare(t *testing.T) {
+	ups := &fakeUpstream{
+		onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			return newCompareTestReply(req, "192.0.2.1", 60), nil
+		},
+		onAddress: func() (addr string) { return "primary" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	cmpUps := &fakeUpstream{
+		onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			return newCompareTestReply(req, "192.0.2.2", 60), nil
+		},
+		onAddress: func() (addr string) { return "secondary" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	buf := &syncBuffer{mu: &sync.Mutex{}, buf: &bytes.Buffer{}}
+	p := mustNew(t, &Config{
+		Logger:        slog.New(slog.NewTextHandler(buf, nil)),
+		UDPListenAddr: []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{ups},
+		},
+		CompareUpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{cmpUps},
+		},
+		TrustedProxies: defaultTrustedProxies,
+	})
+
+	ctx := context.Background()
+	require.NoError(t, p.Start(ctx))
+	testutil.CleanupAndRequireSuccess(t, func() (err error) { return p.Shutdown(ctx) })
+
+	client := &dns.Client{Net: string(ProtoUDP), Timeout: defaultTimeout}
+	addr := p.Addr(ProtoUDP).String()
+
+	// The client always receives the response of the general upstreams.
+	resp, _, err := client.Exchange(newHostTestMessage("compare.example"), addr)
+	require.NoError(t, err)
+	require.Len(t, resp.Answer, 1)
+
+	a := testutil.RequireTypeAssert[*dns.A](t, resp.Answer[0])
+	assert.Equal(t, net.IPv4(192, 0, 2, 1).To4(), a.A.To4())
+
+	assert.Eventually(t, func() (ok bool) {
+		return strings.Contains(buf.String(), "responses differ")
+	}, defaultTimeout, 10*time.Millisecond)
+
+	assert.Contains(t, buf.String(), "answer ips: [192.0.2.1] != [192.0.2.2]")
+}
@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"fmt"
+
+	"github.com/miekg/dns"
+)
+
+// Compression defines whether the domain names in the responses are
+// compressed.
+type Compression string
+
+// Compression values.
+const (
+	// CompressionForce compresses all the resolved responses, since some
+	// devices require that.
+	CompressionForce Compression = "force"
+
+	// CompressionAuto only compresses the responses which don't fit into the
+	// size limit of the request otherwise.
+	CompressionAuto Compression = "auto"
+
+	// CompressionDisable never compresses the responses.  The responses which
+	// don't fit into the size limit of the request uncompressed are truncated.
+	CompressionDisable Compression = "disable"
+)
+
+// Validate returns an error if c is not a valid compression.
+func (c Compression) Validate() (err error) {
+	switch c {
+	case "", CompressionForce, CompressionAuto, CompressionDisable:
+		return nil
+	default:
+		return fmt.Errorf("unknown value %q", string(c))
+	}
+}
+
+// compress sets the compression of the response of d according to
+// [Config.ResponseCompression], truncating it if necessary.
+func (p *Proxy) compress(d *DNSContext) {
+	resp := d.Res
+	if resp == nil {
+		return
+	}
+
+	switch p.ResponseCompression {
+	case CompressionAuto:
+		resp.Compress = false
+		if d.Req != nil && resp.Len() > int(d.responseSize()) {
+			resp.Compress = true
+		}
+	case CompressionDisable:
+		resp.Compress = false
+		if d.Req != nil {
+			truncateUncompressed(resp, int(d.responseSize()))
+		}
+	default:
+		// The resolved responses are already compressed, see
+		// [DNSContext.scrub].
+	}
+}
+
+// truncateUncompressed removes the records from the end of resp, except for
+// the OPT one, until it fits into size bytes uncompressed.  The TC flag is set
+// if any record has been removed.  The responses with TSIG aren't truncated,
+// just like [dns.Msg.Truncate] does.
+func truncateUncompressed(resp *dns.Msg, size int) {
+	if resp.IsTsig() != nil || resp.Len() <= size {
+		return
+	}
+
+	var opt dns.RR
+	extra := resp.Extra[:0]
+	for _, rr := range resp.Extra {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			opt = rr
+		} else {
+			extra = append(extra, rr)
+		}
+	}
+
+	resp.Extra = extra
+	if opt != nil {
+		size -= dns.Len(opt)
+	}
+
+	for _, sec := range []*[]dns.RR{&resp.Extra, &resp.Ns, &resp.Answer} {
+		for len(*sec) > 0 && resp.Len() > size {
+			*sec = (*sec)[:len(*sec)-1]
+			resp.Truncated = true
+		}
+	}
+
+	if opt != nil {
+		resp.Extra = append(resp.Extra, opt)
+	}
+}
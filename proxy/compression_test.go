@@ -0,0 +1,169 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_compress(t *testing.T) {
+	// newResp returns a response to req with rrsNum A records.  The response
+	// with 20 records is 653 bytes long uncompressed and 353 bytes long
+	// compressed.
+	newResp := func(req *dns.Msg, rrsNum int) (resp *dns.Msg) {
+		resp, err := newLargeTestUpstream(rrsNum).Exchange(req)
+		require.NoError(t, err)
+
+		return resp
+	}
+
+	testCases := []struct {
+		name          string
+		compression   Compression
+		rrsNum        int
+		wantAnswers   int
+		wantCompress  bool
+		wantTruncated bool
+	}{{
+		name:          "default",
+		compression:   "",
+		rrsNum:        5,
+		wantAnswers:   5,
+		wantCompress:  true,
+		wantTruncated: false,
+	}, {
+		name:          "force",
+		compression:   CompressionForce,
+		rrsNum:        5,
+		wantAnswers:   5,
+		wantCompress:  true,
+		wantTruncated: false,
+	}, {
+		name:          "auto_fits",
+		compression:   CompressionAuto,
+		rrsNum:        5,
+		wantAnswers:   5,
+		wantCompress:  false,
+		wantTruncated: false,
+	}, {
+		name:          "auto_large",
+		compression:   CompressionAuto,
+		rrsNum:        20,
+		wantAnswers:   20,
+		wantCompress:  true,
+		wantTruncated: false,
+	}, {
+		name:          "disable_fits",
+		compression:   CompressionDisable,
+		rrsNum:        5,
+		wantAnswers:   5,
+		wantCompress:  false,
+		wantTruncated: false,
+	}, {
+		name:          "disable_large",
+		compression:   CompressionDisable,
+		rrsNum:        20,
+		wantAnswers:   15,
+		wantCompress:  false,
+		wantTruncated: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := &Proxy{Config: Config{ResponseCompression: tc.compression}}
+
+			req := (&dns.Msg{}).SetQuestion("www.example.com.", dns.TypeA)
+			d := &DNSContext{
+				Proto: ProtoUDP,
+				Req:   req,
+				Res:   newResp(req, tc.rrsNum),
+			}
+
+			d.scrub()
+			p.compress(d)
+
+			assert.Equal(t, tc.wantCompress, d.Res.Compress)
+			assert.Equal(t, tc.wantTruncated, d.Res.Truncated)
+			assert.Len(t, d.Res.Answer, tc.wantAnswers)
+			assert.LessOrEqual(t, d.Res.Len(), dns.MinMsgSize)
+		})
+	}
+
+	t.Run("disable_edns", func(t *testing.T) {
+		p := &Proxy{Config: Config{ResponseCompression: CompressionDisable}}
+
+		req := (&dns.Msg{}).SetQuestion("www.example.com.", dns.TypeA)
+		req.SetEdns0(dns.MinMsgSize, false)
+
+		d := &DNSContext{
+			Proto: ProtoUDP,
+			Req:   req,
+			Res:   newResp(req, 20),
+		}
+
+		d.scrub()
+		p.compress(d)
+
+		assert.True(t, d.Res.Truncated)
+		assert.NotNil(t, d.Res.IsEdns0())
+		assert.LessOrEqual(t, d.Res.Len(), dns.MinMsgSize)
+	})
+}
+
+func TestProxy_compress_cached(t *testing.T) {
+	testCases := []struct {
+		name          string
+		compression   Compression
+		wantAnswers   int
+		wantTruncated bool
+	}{{
+		name:          "default",
+		compression:   "",
+		wantAnswers:   20,
+		wantTruncated: false,
+	}, {
+		name:          "disable",
+		compression:   CompressionDisable,
+		wantAnswers:   15,
+		wantTruncated: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := mustNew(t, &Config{
+				Logger:        testLogger,
+				UDPListenAddr: []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+				UpstreamConfig: &UpstreamConfig{
+					Upstreams: []upstream.Upstream{newLargeTestUpstream(20)},
+				},
+				TrustedProxies:      defaultTrustedProxies,
+				CacheEnabled:        true,
+				CacheSizeBytes:      testCacheSize,
+				ResponseCompression: tc.compression,
+			})
+
+			ctx := context.Background()
+			require.NoError(t, p.Start(ctx))
+			testutil.CleanupAndRequireSuccess(t, func() (err error) { return p.Shutdown(ctx) })
+
+			client := &dns.Client{Net: string(ProtoUDP), Timeout: defaultTimeout}
+			req := (&dns.Msg{}).SetQuestion("www.example.com.", dns.TypeA)
+			req.SetEdns0(dns.MinMsgSize, false)
+
+			// The second response is served from the cache.
+			for range 2 {
+				resp, _, err := client.Exchange(req, p.Addr(ProtoUDP).String())
+				require.NoError(t, err)
+
+				assert.Equal(t, tc.wantTruncated, resp.Truncated)
+				assert.Len(t, resp.Answer, tc.wantAnswers)
+			}
+		})
+	}
+}
@@ -0,0 +1,212 @@
+package proxy
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/syncutil"
+)
+
+// ConcurrencyLimitConfig is the configuration of the adaptive limit of the
+// number of the requests processed simultaneously.  The limit follows the
+// gradient of the latency of the upstream exchanges: it grows while the recent
+// latency stays close to the long-term one and decreases as the recent latency
+// grows, which means that the requests are queued somewhere on the way.
+//
+// The requests exceeding the limit are answered right away according to
+// [Config.OverloadPolicy].
+type ConcurrencyLimitConfig struct {
+	// InitialLimit is the limit used until the latency is measured.  Zero
+	// means MinLimit.
+	InitialLimit uint
+
+	// MinLimit is the lowest value of the limit.  It must be positive.
+	MinLimit uint
+
+	// MaxLimit is the highest value of the limit.  It must not be less than
+	// MinLimit.
+	MaxLimit uint
+}
+
+// validate returns an error if c is invalid.  c may be nil.
+func (c *ConcurrencyLimitConfig) validate() (err error) {
+	switch {
+	case c == nil:
+		return nil
+	case c.MinLimit == 0:
+		return errors.Error("min limit: must be positive")
+	case c.MaxLimit < c.MinLimit:
+		return fmt.Errorf("max limit: %d is less than min limit %d", c.MaxLimit, c.MinLimit)
+	case c.InitialLimit != 0 && (c.InitialLimit < c.MinLimit || c.InitialLimit > c.MaxLimit):
+		return fmt.Errorf(
+			"initial limit: %d is out of range [%d, %d]",
+			c.InitialLimit,
+			c.MinLimit,
+			c.MaxLimit,
+		)
+	default:
+		return nil
+	}
+}
+
+const (
+	// limitShortAlpha and limitLongAlpha are the smoothing factors of the
+	// recent and the long-term latencies, which correspond to the moving
+	// averages of about 10 and 600 exchanges.
+	limitShortAlpha = 2.0 / (10 + 1)
+	limitLongAlpha  = 2.0 / (600 + 1)
+
+	// limitRTTTolerance is how many times the recent latency may exceed the
+	// long-term one before the limit starts decreasing.
+	limitRTTTolerance = 1.5
+
+	// limitSmoothing is the share of the new estimate of the limit applied on
+	// each exchange.
+	limitSmoothing = 0.2
+)
+
+// concurrencyLimiter is the adaptive limit of the number of the requests
+// processed simultaneously, see [ConcurrencyLimitConfig].  A nil
+// *concurrencyLimiter doesn't limit anything.  All methods are safe for
+// concurrent use.
+type concurrencyLimiter struct {
+	// mu protects the fields below.
+	mu *sync.Mutex
+
+	// limit is the current limit.  It's fractional to accumulate the small
+	// changes.
+	limit float64
+
+	// minLimit and maxLimit are the bounds of limit.
+	minLimit float64
+	maxLimit float64
+
+	// shortRTT is the average latency of the recent exchanges, in nanoseconds.
+	shortRTT float64
+
+	// longRTT is the average latency over a longer period, in nanoseconds.  It
+	// lags behind shortRTT under the growing load, so that it estimates the
+	// latency without the load.
+	longRTT float64
+
+	// inflight is the number of the requests being processed.
+	inflight uint
+}
+
+// newConcurrencyLimiter returns a new limiter configured with c.  maxGoroutines
+// is [Config.MaxGoroutines], which caps the limit, if positive, since no more
+// requests are processed simultaneously anyway.  It returns nil if c is nil.
+func newConcurrencyLimiter(c *ConcurrencyLimitConfig, maxGoroutines uint) (l *concurrencyLimiter) {
+	if c == nil {
+		return nil
+	}
+
+	maxLimit := c.MaxLimit
+	if maxGoroutines > 0 {
+		maxLimit = min(maxLimit, maxGoroutines)
+	}
+
+	minLimit := min(c.MinLimit, maxLimit)
+	initial := min(max(c.InitialLimit, minLimit), maxLimit)
+
+	return &concurrencyLimiter{
+		mu:       &sync.Mutex{},
+		limit:    float64(initial),
+		minLimit: float64(minLimit),
+		maxLimit: float64(maxLimit),
+	}
+}
+
+// newRequestsSema returns the semaphore limiting the number of the goroutines
+// serving the connections and processing the requests according to
+// [Config.MaxGoroutines].  It's used regardless of the adaptive limit, which
+// only decides whether to admit the requests, see [newConcurrencyLimiter].
+func (p *Proxy) newRequestsSema() (sema syncutil.Semaphore) {
+	if p.MaxGoroutines == 0 {
+		return syncutil.EmptySemaphore{}
+	}
+
+	p.logger.Info("max goroutines is set", "num", p.MaxGoroutines)
+
+	return syncutil.NewChanSemaphore(p.MaxGoroutines)
+}
+
+// acquire returns true if one more request may be processed, in which case
+// release must be called once it is.
+func (l *concurrencyLimiter) acquire() (ok bool) {
+	if l == nil {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if float64(l.inflight) >= math.Floor(l.limit) {
+		return false
+	}
+
+	l.inflight++
+
+	return true
+}
+
+// release marks the request, for which acquire has returned true, processed.
+func (l *concurrencyLimiter) release() {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.inflight--
+}
+
+// currentLimit returns the current limit rounded down.  l must not be nil.
+func (l *concurrencyLimiter) currentLimit() (n uint) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return uint(l.limit)
+}
+
+// onExchange updates the limit using rtt, the latency of an upstream exchange.
+func (l *concurrencyLimiter) onExchange(rtt time.Duration) {
+	if l == nil || rtt <= 0 {
+		return
+	}
+
+	sample := float64(rtt)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.longRTT == 0 {
+		l.shortRTT, l.longRTT = sample, sample
+
+		return
+	}
+
+	l.shortRTT += (sample - l.shortRTT) * limitShortAlpha
+	l.longRTT += (l.shortRTT - l.longRTT) * limitLongAlpha
+
+	// Let the long-term latency recover quickly once the load is gone, so that
+	// the next overload is detected without waiting for the latency measured
+	// under the previous one to decay.
+	if l.longRTT > 2*l.shortRTT {
+		l.longRTT *= 0.95
+	}
+
+	// The latency says nothing about the higher load while the limit is far
+	// from being reached, so don't change it then.
+	if float64(l.inflight) < l.limit/2 {
+		return
+	}
+
+	gradient := max(0.5, min(1, limitRTTTolerance*l.longRTT/l.shortRTT))
+	estimate := l.limit*gradient + math.Sqrt(l.limit)
+	l.limit = max(l.minLimit, min(l.maxLimit, l.limit*(1-limitSmoothing)+estimate*limitSmoothing))
+}
@@ -0,0 +1,200 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConcurrencyLimitConfig_validate(t *testing.T) {
+	testCases := []struct {
+		conf       *ConcurrencyLimitConfig
+		name       string
+		wantErrMsg string
+	}{{
+		conf:       nil,
+		name:       "nil",
+		wantErrMsg: "",
+	}, {
+		conf:       &ConcurrencyLimitConfig{MinLimit: 1, MaxLimit: 10, InitialLimit: 5},
+		name:       "valid",
+		wantErrMsg: "",
+	}, {
+		conf:       &ConcurrencyLimitConfig{MinLimit: 0, MaxLimit: 10},
+		name:       "zero_min",
+		wantErrMsg: "min limit: must be positive",
+	}, {
+		conf:       &ConcurrencyLimitConfig{MinLimit: 10, MaxLimit: 1},
+		name:       "max_less_than_min",
+		wantErrMsg: "max limit: 1 is less than min limit 10",
+	}, {
+		conf:       &ConcurrencyLimitConfig{MinLimit: 1, MaxLimit: 10, InitialLimit: 20},
+		name:       "initial_out_of_range",
+		wantErrMsg: "initial limit: 20 is out of range [1, 10]",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, tc.conf.validate())
+		})
+	}
+}
+
+// fillLimiter acquires l until the limit is reached and returns the number of
+// the acquired requests.
+func fillLimiter(l *concurrencyLimiter) (n uint) {
+	for l.acquire() {
+		n++
+	}
+
+	return n
+}
+
+func TestConcurrencyLimiter(t *testing.T) {
+	const rtt = 10 * time.Millisecond
+
+	l := newConcurrencyLimiter(&ConcurrencyLimitConfig{
+		InitialLimit: 10,
+		MinLimit:     2,
+		MaxLimit:     100,
+	}, 0)
+
+	require.Equal(t, uint(10), fillLimiter(l))
+
+	// Stable latency under the full load increases the limit.
+	for range 100 {
+		l.onExchange(rtt)
+	}
+
+	grown := l.currentLimit()
+	assert.Greater(t, grown, uint(10))
+	assert.LessOrEqual(t, grown, uint(100))
+
+	// The increased latency under the full load decreases it.
+	acquired := 10 + fillLimiter(l)
+	for range 100 {
+		l.onExchange(10 * rtt)
+	}
+
+	assert.Less(t, l.currentLimit(), grown)
+
+	// The limit doesn't change while it's far from being reached.
+	for range acquired {
+		l.release()
+	}
+
+	limit := l.currentLimit()
+	for range 100 {
+		l.onExchange(100 * rtt)
+	}
+
+	assert.Equal(t, limit, l.currentLimit())
+
+	var nilLimiter *concurrencyLimiter
+	assert.True(t, nilLimiter.acquire())
+}
+
+func TestConcurrencyLimiter_maxGoroutines(t *testing.T) {
+	l := newConcurrencyLimiter(&ConcurrencyLimitConfig{
+		InitialLimit: 10,
+		MinLimit:     5,
+		MaxLimit:     100,
+	}, 3)
+
+	require.Equal(t, uint(3), fillLimiter(l))
+
+	for range 100 {
+		l.onExchange(time.Millisecond)
+	}
+
+	assert.Equal(t, uint(3), l.currentLimit())
+}
+
+func TestProxy_concurrencyLimit(t *testing.T) {
+	unblock := make(chan struct{})
+	exchanged := make(chan struct{}, 1)
+	u := &fakeUpstream{
+		onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			exchanged <- struct{}{}
+			<-unblock
+
+			return newCompareTestReply(req, "192.0.2.1", defaultTestTTL), nil
+		},
+		onAddress: func() (addr string) { return "fake" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	p := mustNew(t, &Config{
+		Logger:         testLogger,
+		UDPListenAddr:  []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		TCPListenAddr:  []*net.TCPAddr{net.TCPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig: &UpstreamConfig{Upstreams: []upstream.Upstream{u}},
+		TrustedProxies: defaultTrustedProxies,
+		ConcurrencyLimit: &ConcurrencyLimitConfig{
+			MinLimit: 1,
+			MaxLimit: 1,
+		},
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+	})
+
+	ctx := context.Background()
+	require.NoError(t, p.Start(ctx))
+	testutil.CleanupAndRequireSuccess(t, func() (err error) { return p.Shutdown(ctx) })
+
+	udpClient := &dns.Client{Net: string(ProtoUDP), Timeout: defaultTimeout}
+	udpAddr := p.Addr(ProtoUDP).String()
+
+	blockedResp := make(chan *dns.Msg, 1)
+	go func() {
+		pt := testutil.PanicT{}
+
+		resp, _, err := udpClient.Exchange(newHostTestMessage("blocked.example"), udpAddr)
+		require.NoError(pt, err)
+
+		blockedResp <- resp
+	}()
+
+	testutil.RequireReceive(t, exchanged, defaultTimeout)
+
+	t.Run("udp", func(t *testing.T) {
+		resp, _, err := udpClient.Exchange(newHostTestMessage("shed.example"), udpAddr)
+		require.NoError(t, err)
+
+		assert.True(t, resp.Truncated)
+		assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	})
+
+	t.Run("tcp", func(t *testing.T) {
+		req := newHostTestMessage("shed.example")
+		req.SetEdns0(dns.DefaultMsgSize, false)
+
+		tcpClient := &dns.Client{Net: string(ProtoTCP), Timeout: defaultTimeout}
+		resp, _, err := tcpClient.Exchange(req, p.Addr(ProtoTCP).String())
+		require.NoError(t, err)
+
+		assert.Equal(t, dns.RcodeServerFailure, resp.Rcode)
+
+		opt := resp.IsEdns0()
+		require.NotNil(t, opt)
+		require.Len(t, opt.Option, 1)
+
+		ede := testutil.RequireTypeAssert[*dns.EDNS0_EDE](t, opt.Option[0])
+		assert.Equal(t, dns.ExtendedErrorCodeOther, ede.InfoCode)
+	})
+
+	close(unblock)
+
+	resp, ok := testutil.RequireReceive(t, blockedResp, defaultTimeout)
+	require.True(t, ok)
+
+	assert.False(t, resp.Truncated)
+	assert.Len(t, resp.Answer, 1)
+}
@@ -1,18 +1,22 @@
 package proxy
 
 import (
+	"cmp"
 	"crypto/tls"
 	"fmt"
+	"log/slog"
 	"net"
 	"net/netip"
 	"net/url"
 	"time"
 
+	proxynetutil "github.com/AdguardTeam/dnsproxy/internal/netutil"
 	"github.com/AdguardTeam/dnsproxy/upstream"
 	"github.com/AdguardTeam/golibs/errors"
-	"github.com/AdguardTeam/golibs/log"
 	"github.com/AdguardTeam/golibs/netutil"
 	"github.com/ameshkov/dnscrypt/v2"
+	"github.com/miekg/dns"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // UpstreamModeType - upstream mode
@@ -30,7 +34,11 @@ const (
 // RequestHandler is an optional custom handler for DNS requests.  It's used
 // instead of [Proxy.Resolve] if set.  The resulting error doesn't affect the
 // request processing.  The custom handler is responsible for calling
-// [ResponseHandler], if it doesn't call [Proxy.Resolve].
+// [ResponseHandler], if it doesn't call [Proxy.Resolve].  If dctx.Res is left
+// nil, the request isn't answered, and its TCP or TLS connection is closed once
+// the responses to the other queries pipelined over it are written.  If
+// [Config.EnableDNSContextPooling] is set, dctx must not be retained after the
+// handler returns.
 //
 // TODO(e.burkov):  Use the same interface-based approach as
 // [BeforeRequestHandler].
@@ -39,7 +47,10 @@ type RequestHandler func(p *Proxy, dctx *DNSContext) (err error)
 // ResponseHandler is an optional custom handler called when DNS query has been
 // processed.  When called from [Proxy.Resolve], dctx will contain the response
 // message if the upstream or cache succeeded.  err is only not nil if the
-// upstream failed to respond.
+// upstream failed to respond.  The annotations set with [DNSContext.SetValue]
+// by the handlers called earlier are available in dctx.  If
+// [Config.EnableDNSContextPooling] is set, dctx must not be retained after the
+// handler returns.
 //
 // TODO(e.burkov):  Use the same interface-based approach as
 // [BeforeRequestHandler].
@@ -49,6 +60,27 @@ type ResponseHandler func(dctx *DNSContext, err error)
 //
 // TODO(a.garipov): Consider extracting conf blocks for better fieldalignment.
 type Config struct {
+	// Logger is used as the base logger for the proxy subsystems.  If nil,
+	// [slog.Default] is used.
+	Logger *slog.Logger
+
+	// LogLevels overrides the logging levels of the proxy subsystems, see
+	// [LogSubsystem].  The subsystems missing from it use the level of Logger.
+	// The values may be [*slog.LevelVar] to change the levels at runtime.
+	LogLevels map[LogSubsystem]slog.Leveler
+
+	// ClientAnonymization defines how the client addresses are anonymized in
+	// the log and the query log output.
+	ClientAnonymization ClientAnonymization
+
+	// PrivacyMode strips the client-identifying data from everything leaving
+	// the proxy: the EDNS Client Subnet options aren't sent to the upstreams,
+	// even if received from the clients, the client addresses are anonymized
+	// for the [MessageTap] as well, with [ClientAnonymizationTruncate] unless
+	// ClientAnonymization is set, and the texts of the extended DNS errors
+	// containing the client addresses are removed from the responses.
+	PrivacyMode bool
+
 	// TrustedProxies is the trusted list of CIDR networks to detect proxy
 	// servers addresses from where the DoH requests should be handled.  The
 	// value of nil makes Proxy not trust any address.
@@ -59,15 +91,26 @@ type Config struct {
 	// set.
 	PrivateSubnets netutil.SubnetSet
 
-	// MessageConstructor used to build DNS messages.  If nil, the default
-	// constructor will be used.
+	// MessageConstructor used to build DNS messages.  If nil, the zero
+	// [DefaultMessageConstructor] will be used.
 	MessageConstructor MessageConstructor
 
+	// Clock is used to get the current time for the expiration of the cached
+	// responses, the ratelimiting windows, the recursion detection, and the
+	// fastest address cache.  If nil, the real time is used.
+	Clock Clock
+
 	// BeforeRequestHandler is an optional custom handler called before each DNS
 	// request is started processing, see [BeforeRequestHandler].  The default
-	// no-op implementation is used, if it's nil.
+	// no-op implementation is used, if it's nil.  See [Proxy.Use] for composing
+	// several handlers.
 	BeforeRequestHandler BeforeRequestHandler
 
+	// AfterResponseHandler is an optional custom handler called before each
+	// response is sent, see [AfterResponseHandler].  The default no-op
+	// implementation is used, if it's nil.
+	AfterResponseHandler AfterResponseHandler
+
 	// RequestHandler is an optional custom handler for DNS requests.  It's used
 	// instead of [Proxy.Resolve] if set.  See [RequestHandler].
 	RequestHandler RequestHandler
@@ -76,6 +119,22 @@ type Config struct {
 	// been processed.  See [ResponseHandler].
 	ResponseHandler ResponseHandler
 
+	// MetricsListener is an optional listener of the request processing
+	// events.  If nil, [EmptyMetricsListener] is used.
+	MetricsListener MetricsListener
+
+	// TracerProvider is an optional provider of the tracer used to trace the
+	// request processing stages.  If nil, the tracing is disabled.
+	TracerProvider trace.TracerProvider
+
+	// MessageTap is an optional receiver of the DNS messages passing through
+	// the proxy.  If nil, [EmptyMessageTap] is used.
+	MessageTap MessageTap
+
+	// QueryLogger is an optional logger of the processed requests.  If nil,
+	// [EmptyQueryLogger] is used.
+	QueryLogger QueryLogger
+
 	// UpstreamConfig is a general set of DNS servers to forward requests to.
 	UpstreamConfig *UpstreamConfig
 
@@ -86,9 +145,124 @@ type Config struct {
 	PrivateRDNSUpstreamConfig *UpstreamConfig
 
 	// Fallbacks is a list of fallback resolvers.  Those will be used if the
-	// general set fails responding.
+	// general set fails responding or, see FallbackTriggers, responds with an
+	// unwanted response.
 	Fallbacks *UpstreamConfig
 
+	// FallbackTriggers, if not nil, defines the outcomes of the exchange with
+	// the general upstreams, which make the request resolved with Fallbacks,
+	// see [FallbackConfig].  If nil, the fallbacks are only used when the
+	// general upstreams fail to respond.
+	FallbackTriggers *FallbackConfig
+
+	// QueryBudget, if not nil, bounds the total time of resolving a single
+	// request with the upstreams, including the retries and the fallbacks, see
+	// [QueryBudgetConfig].
+	QueryBudget *QueryBudgetConfig
+
+	// MirrorUpstream is the upstream to asynchronously send the copies of the
+	// client requests to, for example to load-test it with the real traffic.
+	// Its responses are discarded.  If nil, the requests aren't mirrored.
+	MirrorUpstream upstream.Upstream
+
+	// CompareUpstreamConfig is the configuration of the upstreams to compare
+	// the responses of the general upstreams with, for example to audit a
+	// migration to another resolver.  The requests resolved with the general
+	// upstreams are also resolved with these in the background and the
+	// differences are logged, while the clients always receive the responses
+	// of the general upstreams.  If nil, the responses aren't compared.
+	CompareUpstreamConfig *UpstreamConfig
+
+	// ListenerFaults are the faults injected into the handling of the client
+	// requests, before they are resolved.  It's intended for testing only.  If
+	// nil, no faults are injected.
+	ListenerFaults *FaultConfig
+
+	// ForceTCP, if not nil, defines the requests resolved with the plain DNS
+	// upstreams over TCP only, see [ForceTCPConfig].
+	ForceTCP *ForceTCPConfig
+
+	// SVCBRewrite, if not nil, defines the rewriting of the SVCB and HTTPS
+	// records in the responses, see [SVCBRewriteConfig].
+	SVCBRewrite *SVCBRewriteConfig
+
+	// InsecureDomains are the domain names, typically the internal
+	// split-horizon zones, the requests for which and for their subdomains are
+	// exempt from DNSSEC.  Those are sent to the upstreams with the CD flag
+	// set, so that the validating upstreams don't answer SERVFAIL for the
+	// unsigned zones, and without the DO flag added for caching.
+	InsecureDomains []string
+
+	// ZoneTransfer, if not nil, makes the zone transfer requests proxied to
+	// the designated upstreams, see [ZoneTransferConfig].  The upstreams are
+	// closed on shutdown.  If nil, those are resolved like any other requests.
+	ZoneTransfer *ZoneTransferConfig
+
+	// TSIGKeys are the keys the signatures of the requests are verified with,
+	// see RFC 8945.  The requests signed with an unknown key or with an invalid
+	// signature are answered with NOTAUTH, and the responses to the valid ones
+	// are signed with the same key.  If empty, the signed requests are resolved
+	// like any other requests.
+	TSIGKeys []*upstream.TSIGKey
+
+	// Notify, if not nil, makes the NOTIFY messages from the primary servers
+	// answered by the proxy itself and flush the cached responses for the
+	// zone, see [NotifyConfig].  If nil, those are resolved like any other
+	// requests.
+	Notify *NotifyConfig
+
+	// DynamicUpdate, if not nil, makes the dynamic update requests forwarded to
+	// the primary servers of the zones, see [DynamicUpdateConfig].  The
+	// upstreams are closed on shutdown.  If nil, those are resolved like any
+	// other requests.
+	DynamicUpdate *DynamicUpdateConfig
+
+	// UpstreamFaults are the faults injected into the exchanges with the
+	// upstreams.  The dropped exchanges fail with an error.  It's intended for
+	// testing only.  If nil, no faults are injected.
+	UpstreamFaults *FaultConfig
+
+	// ConcurrencyLimit, if not nil, enables the adaptive limit of the number
+	// of the requests processed simultaneously, see [ConcurrencyLimitConfig].
+	// The requests exceeding it are answered right away, so that the latency
+	// of the processed ones stays low when the proxy is overloaded, unlike the
+	// ones exceeding MaxGoroutines, which still limits the goroutines serving
+	// the connections and caps MaxLimit.
+	ConcurrencyLimit *ConcurrencyLimitConfig
+
+	// OverloadPolicy defines how the requests exceeding ConcurrencyLimit,
+	// MaxInflightRequests, or MaxInflightRequestsPerClient are answered.
+	OverloadPolicy OverloadPolicy
+
+	// UDPTruncation limits the sizes of the responses sent over plain
+	// DNS-over-UDP.  If nil, only the sizes advertised by the clients are
+	// respected.
+	UDPTruncation *UDPTruncationConfig
+
+	// UpstreamUDPSize defines the EDNS buffer sizes advertised to the
+	// upstreams.  If nil, the sizes advertised by the clients are used.
+	UpstreamUDPSize *UpstreamUDPSizeConfig
+
+	// Anomalies, if not nil, enables the detection of the clients looking like
+	// those running the DGA malware or enumerating subdomains, see
+	// [AnomalyConfig].
+	Anomalies *AnomalyConfig
+
+	// StartupGating defines how the client requests are handled until at least
+	// one of the general upstreams answers the probe query on startup.
+	StartupGating StartupGating
+
+	// ErrorReportingAgent is the domain of the DNS error reporting agent the
+	// proxy acts as, see RFC 9567.  If set, the domain is advertised in the
+	// Report-Channel option of the responses to the requests with EDNS, and
+	// the received reports are logged.
+	ErrorReportingAgent string
+
+	// ResolverInfo, if not nil, is the information about the resolver returned
+	// in the responses to the RESINFO requests for resolver.arpa and the TLS
+	// server name, and over HTTPS, see [ResolverInfo].
+	ResolverInfo *ResolverInfo
+
 	// Userinfo is the sole permitted userinfo for the DoH basic authentication.
 	// If Userinfo is set, all DoH queries are required to have this basic
 	// authentication information.
@@ -148,9 +322,43 @@ type Config struct {
 	// default Well-Known Prefix.
 	DNS64Prefs []netip.Prefix
 
+	// DNS64Exclude is the set of IPv4 networks, the A records within which are
+	// not used to synthesize the AAAA records, see RFC 6147, Section 5.1.4.
+	// Each of them must be an IPv4 prefix.
+	DNS64Exclude []netip.Prefix
+
 	// RatelimitWhitelist is a list of IP addresses excluded from rate limiting.
 	RatelimitWhitelist []netip.Addr
 
+	// RatelimitAllowlist, if not nil, is the set of the client networks
+	// excluded from rate limiting along with [Config.RatelimitWhitelist].  It's
+	// consulted for each request, so its contents may change while the proxy
+	// is running.
+	RatelimitAllowlist netutil.SubnetSet
+
+	// RatelimitDenylist, if not nil, is the set of the client networks the
+	// requests from which are always considered exceeding the ratelimit, even
+	// if the rate limiting is disabled.  It takes precedence over the
+	// allowlists.  It's consulted for each request, so its contents may change
+	// while the proxy is running.
+	RatelimitDenylist netutil.SubnetSet
+
+	// Profiles are the sets of settings used instead of the general ones for
+	// the queries received on particular listen addresses.  The listen
+	// addresses of different profiles must not overlap.
+	Profiles []*Profile
+
+	// ClientRoutes is the client routing table, which makes the queries from
+	// particular client subnets or with particular client identities resolved
+	// with separate upstreams instead of the ones of the profile or the general
+	// ones, see [ClientRoute].
+	ClientRoutes []*ClientRoute
+
+	// GeoLocator, if not nil, is used to look up the geographical data about
+	// the clients, see [DNSContext.Geo].  It's required for the client routes
+	// with [ClientRoute.Countries] or [ClientRoute.ASNs].
+	GeoLocator GeoLocator
+
 	// EDNSAddr is the ECS IP used in request.
 	EDNSAddr net.IP
 
@@ -165,9 +373,44 @@ type Config struct {
 	RatelimitSubnetLenIPv6 int
 
 	// Ratelimit is a maximum number of requests per second from a given IP (0
-	// to disable).
+	// to disable).  It's the sustained rate, while the short bursts may exceed
+	// it, see [Config.RatelimitBurst].
 	Ratelimit int
 
+	// RatelimitIPv6 is the maximum number of requests per second from a single
+	// IPv6 subnet.  If zero, [Config.Ratelimit] is used.  It has no effect if
+	// the rate limiting is disabled.
+	RatelimitIPv6 int
+
+	// RatelimitBurst is the maximum number of requests from a single IPv4
+	// subnet allowed at once, which are then restored at the rate of
+	// [Config.Ratelimit].  It's also used for the IPv6 subnets unless
+	// [Config.RatelimitBurstIPv6] is set.  If zero, the burst is equal to the
+	// rate.
+	RatelimitBurst int
+
+	// RatelimitBurstIPv6 is the maximum number of requests from a single IPv6
+	// subnet allowed at once.  If zero, [Config.RatelimitBurst] is used.
+	RatelimitBurstIPv6 int
+
+	// RatelimitTruncate is the soft ratelimit: the maximum number of requests
+	// per second over UDP from a single client subnet, above which the
+	// requests are answered with the empty truncated responses instead of
+	// being resolved, so that the clients retry over TCP.  The real clients
+	// keep working, while the ones with spoofed addresses, used for the
+	// amplification attacks, can't.  It allows no bursts and applies to all
+	// the profiles, while the requests exceeding [Config.Ratelimit] are still
+	// dropped.  Zero disables it.
+	RatelimitTruncate int
+
+	// RatelimitSlip is the slip ratio of the ratelimit: every RatelimitSlip-th
+	// request in a row exceeding the ratelimit from a client subnet is answered
+	// with the empty truncated response instead of being dropped, just like
+	// the response rate limiting of BIND does.  Thus, the legitimate clients
+	// sharing the subnet, e.g. behind a NAT, could still retry over TCP.  It
+	// doesn't apply to [Config.RatelimitDenylist].  Zero disables it.
+	RatelimitSlip int
+
 	// CacheSizeBytes is the maximum cache size in bytes.
 	CacheSizeBytes int
 
@@ -177,31 +420,243 @@ type Config struct {
 	// CacheMaxTTL is the maximum TTL for cached DNS responses in seconds.
 	CacheMaxTTL uint32
 
+	// CacheTTLOverrides maps the record types to the ranges the TTLs of the
+	// answer records of those types are clamped to instead of CacheMinTTL and
+	// CacheMaxTTL, for example to cap the TTLs of the HTTPS records while
+	// extending the ones of the PTR records.
+	CacheTTLOverrides map[uint16]TTLRange
+
+	// AnswerOrder defines the order of the address records in the responses
+	// received from the upstreams.  The responses served from the cache keep
+	// the order they have been cached in.  The default is
+	// [AnswerOrderUpstream].
+	AnswerOrder AnswerOrder
+
+	// ResponseCompression defines whether the domain names in the responses
+	// are compressed.  The default is [CompressionForce].
+	ResponseCompression Compression
+
+	// ResolveCNAMETargets, if true, makes the proxy resolve the target of the
+	// CNAME chain when the upstream returns the chain without the records of
+	// the requested type, and append the resolved records to the response.
+	// The targets are resolved using the upstreams chosen for them.
+	ResolveCNAMETargets bool
+
 	// MaxGoroutines is the maximum number of goroutines processing DNS
-	// requests.  Important for mobile users.
-	//
-	// TODO(a.garipov): Rename this to something like “MaxDNSRequestGoroutines”
-	// in a later major version, as it doesn't actually limit all goroutines.
+	// requests and serving the TCP-based connections.  Important for mobile
+	// users.  If ConcurrencyLimit is set, it also caps
+	// [ConcurrencyLimitConfig.MaxLimit].
 	MaxGoroutines uint
 
+	// MaxInflightRequests is the maximum number of the requests processed
+	// simultaneously, including the pending upstream exchanges.  The requests
+	// exceeding it are answered according to OverloadPolicy.  Zero means no
+	// limit.
+	MaxInflightRequests uint
+
+	// MaxInflightRequestsPerClient is the maximum number of the requests from
+	// a single client address processed simultaneously, so that a single
+	// client can't take all the resources.  The requests exceeding it are
+	// answered according to OverloadPolicy.  Zero means no limit.
+	MaxInflightRequestsPerClient uint
+
+	// TCPConn limits the connections accepted by each of the TCP listeners and
+	// their timeouts.  If nil, the connections aren't limited and the default
+	// timeouts are used.
+	TCPConn *TCPConnConfig
+
+	// TLSConn is like TCPConn, but for the TLS listeners.
+	TLSConn *TCPConnConfig
+
+	// TCPFastOpen enables TCP Fast Open on the TCP-based listeners where the
+	// OS supports it, so that the repeat clients save a round trip.  The
+	// server side of it must also be enabled in the OS, e.g. by the
+	// net.ipv4.tcp_fastopen sysctl on Linux.
+	TCPFastOpen bool
+
+	// MultipathTCP enables Multipath TCP on the TCP-based listeners, so that
+	// the clients with several uplinks could keep the long-lived connections,
+	// e.g. DNS-over-TLS ones, when switching between them.  The connections of
+	// the clients not supporting it are handled as the regular TCP ones.  It's
+	// only effective where the OS supports it, e.g. on Linux 5.6 and newer.
+	MultipathTCP bool
+
+	// MirrorPercentage is the percentage of the client requests sent to
+	// MirrorUpstream, from 0 to 100.  Zero disables the mirroring.
+	MirrorPercentage uint
+
+	// ErrorReporting enables sending the DNS error reports, see RFC 9567.  If
+	// true, the extended DNS errors in the upstream responses with the
+	// Report-Channel option are reported to the reporting agents using the
+	// general upstreams.
+	ErrorReporting bool
+
 	// The size of the read buffer on the underlying socket.  Larger read
 	// buffers can handle larger bursts of requests before packets get dropped.
 	UDPBufferSize int
 
+	// UDPSendBufferSize is the size of the send buffer on the underlying UDP
+	// socket.  Larger send buffers can handle larger bursts of responses
+	// before packets get dropped.  A value <= 0 means the system default.
+	UDPSendBufferSize int
+
+	// UDPSocketFilter attaches a socket filter to the plain DNS UDP listeners,
+	// which discards the packets that can't be DNS queries in the kernel, so
+	// that the floods of garbage don't reach the proxy.  The packets that are
+	// too short, have the QR bit set, don't have exactly one question, or have
+	// more resource records than could fit into them are dropped silently.
+	// It's only supported on Linux.
+	UDPSocketFilter bool
+
+	// XDP configures answering the repeated queries for the hot cache entries
+	// over plain DNS-over-UDP in the kernel.  It requires CacheEnabled and is
+	// incompatible with the settings which require all the requests to reach
+	// the proxy, e.g. Ratelimit or RequestHandler, or the middlewares added
+	// with [Proxy.Use].  If nil, the queries are only answered by the proxy.
+	XDP *XDPConfig
+
+	// ListenSockets is the number of the sockets opened for each of the plain
+	// DNS UDP and TCP listen addresses.  If it's greater than one, the sockets
+	// share the address using SO_REUSEPORT and are served independently, so
+	// that the kernel distributes the incoming requests among them.  Zero
+	// means a single socket.  It isn't supported on Windows.
+	ListenSockets uint
+
+	// ReusePort makes the listeners other than the plain DNS ones, which always
+	// do, share their addresses using SO_REUSEPORT, so that another process is
+	// able to bind them too, e.g. during a binary upgrade.  Otherwise, binding
+	// the address already bound by another process fails.  It isn't supported
+	// on Windows.
+	ReusePort bool
+
+	// ListenInterface is the name of the network interface to bind all the
+	// listening sockets to, so that only the queries received on it are
+	// accepted, regardless of the addresses assigned to it.  It's applied in
+	// addition to the listen addresses, which may be unspecified.  On Linux, it
+	// may also be a VRF device, so that only the clients within the VRF are
+	// served, while the upstreams are still reached through the default one,
+	// unless [upstream.Options.Interface] is set.  If empty, the sockets aren't
+	// bound to an interface.  It's only supported on Linux, using
+	// SO_BINDTODEVICE, and on macOS, using IP_BOUND_IF.
+	ListenInterface string
+
+	// ListenFreeBind allows the listening sockets to be bound to the addresses
+	// not assigned to any interface yet, e.g. the virtual addresses moving
+	// between the hosts with VRRP.  It's only supported on Linux, using
+	// IP_FREEBIND, and on FreeBSD and OpenBSD, using IP_BINDANY and SO_BINDANY
+	// respectively, which require the additional privileges.
+	ListenFreeBind bool
+
+	// ListenDSCP is the Differentiated Services Code Point the responses to the
+	// clients are marked with, see RFC 2474.  It must not be greater than 63.
+	// Zero means the responses aren't marked.  The DSCP of the queries to the
+	// upstreams is set by [upstream.Options.DSCP].  It isn't supported on
+	// Windows.
+	ListenDSCP uint8
+
+	// TransparentProxy makes the listeners accept the queries intercepted with
+	// TPROXY, which are addressed to arbitrary destinations, so that the
+	// queries could be intercepted on a gateway without DNAT.  The plain DNS
+	// queries are answered from their original destinations, which are stored
+	// in [DNSContext.OrigDst].  The TCP-based listeners handle the intercepted
+	// connections as is, while the QUIC-based and DNSCrypt ones only handle the
+	// queries addressed to them.  It requires the CAP_NET_ADMIN capability and
+	// is only supported on Linux.
+	TransparentProxy bool
+
+	// EnableDNSContextPooling enables reusing the [DNSContext] values across
+	// the requests.  If set, the context of a request received by a listener
+	// is reset and reused once the request is handled, so none of the
+	// handlers, the hooks, and the listeners the contexts are passed to may
+	// retain those after returning, for example by using them in a separate
+	// goroutine.
+	EnableDNSContextPooling bool
+
 	// UpstreamMode determines the logic through which upstreams will be used.
 	UpstreamMode UpstreamModeType
 
+	// NextUpstreamRcodes are the response codes, for example
+	// [dns.RcodeServerFailure] or [dns.RcodeRefused], the responses with which
+	// make the request sent to the next upstream of the set, like the failed
+	// exchanges, in the load-balancing mode.  If all the upstreams respond with
+	// those, the last response is used.  The retries are bounded by
+	// [Config.QueryBudget], if set.
+	NextUpstreamRcodes []int
+
+	// UpstreamRefusedPolicy defines how the REFUSED responses from the
+	// upstreams are handled.  The default is [RcodePolicyPass].
+	UpstreamRefusedPolicy RcodePolicy
+
+	// UpstreamNotImpPolicy defines how the NOTIMP responses from the upstreams
+	// are handled.  The default is [RcodePolicyPass].
+	UpstreamNotImpPolicy RcodePolicy
+
+	// TraceID, if not nil, makes the proxy assign a trace ID to each request,
+	// see [TraceIDConfig].
+	TraceID *TraceIDConfig
+
+	// UpstreamBackoff, if not nil, makes the repeatedly failing upstreams
+	// skipped for an exponentially growing time when the UpstreamMode is set to
+	// UModeLoadBalance, see [UpstreamBackoffConfig].
+	UpstreamBackoff *UpstreamBackoffConfig
+
+	// UpstreamStatsPath, if not empty, is the path to the file the statistics
+	// of the upstreams used to choose those when the UpstreamMode is set to
+	// UModeLoadBalance are saved to on shutdown and restored from on startup,
+	// so that those aren't learned again after restart.
+	UpstreamStatsPath string
+
 	// FastestPingTimeout is the timeout for waiting the first successful
 	// dialing when the UpstreamMode is set to UModeFastestAddr.  Non-positive
 	// value will be replaced with the default one.
 	FastestPingTimeout time.Duration
 
+	// FastestPingICMP makes the addresses also pinged with ICMP echo requests,
+	// in addition to dialing their TCP ports, when the UpstreamMode is set to
+	// UModeFastestAddr.
+	FastestPingICMP bool
+
+	// FastestPingPorts are the TCP ports dialed to ping the addresses when the
+	// UpstreamMode is set to UModeFastestAddr.  If empty, ports 80 and 443 are
+	// used.
+	FastestPingPorts []uint
+
+	// FastestMaxConcurrentPings is the maximum number of the pings made at
+	// once for a single request when the UpstreamMode is set to
+	// UModeFastestAddr.  Zero means no limit.
+	FastestMaxConcurrentPings uint
+
+	// FastestFasterWait is the period of time to keep waiting for a faster
+	// ping result after the first successful one when the UpstreamMode is set
+	// to UModeFastestAddr.  Zero means the first one is used.
+	FastestFasterWait time.Duration
+
+	// FastestIPv6Preference is the latency advantage given to the IPv6
+	// addresses over the IPv4 ones when the UpstreamMode is set to
+	// UModeFastestAddr.
+	FastestIPv6Preference time.Duration
+
+	// FastestCachePath, if not empty, is the path to the file the ping results
+	// of the fastest address detection are saved to on shutdown and restored
+	// from on startup, so that those aren't lost on restart.
+	FastestCachePath string
+
 	// RefuseAny makes proxy refuse the requests of type ANY.
 	RefuseAny bool
 
 	// HTTP3 enables HTTP/3 support for HTTPS server.
 	HTTP3 bool
 
+	// QUICRetry, if not nil, configures the source address validation on the
+	// DNS-over-QUIC and HTTP/3 listeners.  If nil, the addresses connecting to
+	// the DNS-over-QUIC listeners for the first time are always validated,
+	// while the HTTP/3 ones aren't.
+	QUICRetry *QUICRetryConfig
+
+	// EncryptedConnLimit, if not nil, limits the connections to the
+	// DNS-over-TLS, DNS-over-HTTPS, and DNS-over-QUIC listeners.
+	EncryptedConnLimit *EncryptedConnLimitConfig
+
 	// Enable EDNS Client Subnet option DNS requests to the upstream server will
 	// contain an OPT record with Client Subnet option.  If the original request
 	// already has this option set, we pass it through as is.  Otherwise, we set
@@ -230,13 +685,51 @@ type Config struct {
 	// CacheOptimistic defines if the optimistic cache mechanism should be used.
 	CacheOptimistic bool
 
+	// CacheAggressiveNSEC, if true, makes the proxy synthesize the NXDOMAIN and
+	// NODATA responses from the cached NSEC and NSEC3 records for the names and
+	// types those prove absent, see RFC 8198.  Only the records from the
+	// responses with the AD flag set are used, so it requires TrustUpstreamAD.
+	// The records are only used for the names resolved with the upstreams
+	// they've been received from.  It only affects the general cache.
+	CacheAggressiveNSEC bool
+
+	// TrustUpstreamAD, if true, means that the upstreams are trusted to validate
+	// DNSSEC, so that the AD flag of their responses can be relied on.
+	TrustUpstreamAD bool
+
+	// CacheOnly, if true, makes the proxy start in the cache-only mode, which
+	// can be changed with [Proxy.SetCacheOnly].  In this mode the requests are
+	// only answered from the cache, including the expired responses, and by
+	// the handlers, like RequestHandler, and the upstreams are never used.
+	// The other requests are answered with SERVFAIL.
+	CacheOnly bool
+
 	// UseDNS64 enables DNS64 handling.  If true, proxy will translate IPv4
-	// answers into IPv6 answers using first of DNS64Prefs.  Note also that PTR
+	// answers into IPv6 answers using DNS64Prefs as DNS64Synthesis specifies.  Note also that PTR
 	// requests for addresses within the specified networks are considered
 	// private and will be forwarded as PrivateRDNSUpstreamConfig specifies.
 	// Those will be responded with NXDOMAIN if UsePrivateRDNS is false.
 	UseDNS64 bool
 
+	// DNS64Discovery enables discovering the NAT64 prefixes by resolving the
+	// ipv4only.arpa name with the general upstreams, see RFC 7050.  The
+	// discovered prefixes replace DNS64Prefs, which are only used until the
+	// discovery succeeds.  The discovery is repeated once the TTL of the
+	// response expires.  It requires UseDNS64.
+	DNS64Discovery bool
+
+	// DNS64Synthesis defines which of the NAT64 prefixes are used to
+	// synthesize the AAAA records.  The empty value is the same as
+	// [DNS64SynthesisFirst].
+	DNS64Synthesis DNS64Synthesis
+
+	// DNS64ReverseSynthesis enables answering the PTR requests for the
+	// addresses within the NAT64 prefixes by resolving the PTR of the embedded
+	// IPv4 address and synthesizing a CNAME record pointing to it, see RFC
+	// 6147, Section 5.3.1.  Otherwise, those are considered private.  It
+	// requires UseDNS64.
+	DNS64ReverseSynthesis bool
+
 	// UsePrivateRDNS defines if the PTR requests for private IP addresses
 	// should be resolved via PrivateRDNSUpstreamConfig.  Note that it requires
 	// a valid PrivateRDNSUpstreamConfig with at least a single general upstream
@@ -251,6 +744,238 @@ type Config struct {
 // validateConfig verifies that the supplied configuration is valid and returns
 // an error if it's not.
 func (p *Proxy) validateConfig() (err error) {
+	err = p.validateReloadable()
+	if err != nil {
+		return err
+	}
+
+	if p.CompareUpstreamConfig != nil {
+		err = p.CompareUpstreamConfig.validate()
+		if err != nil {
+			return fmt.Errorf("validating comparison upstreams: %w", err)
+		}
+	}
+
+	err = p.validateMirror()
+	if err != nil {
+		return fmt.Errorf("validating mirroring: %w", err)
+	}
+
+	err = p.validateErrorReporting()
+	if err != nil {
+		return fmt.Errorf("validating error reporting: %w", err)
+	}
+
+	err = p.QUICRetry.validate()
+	if err != nil {
+		return fmt.Errorf("validating quic retry: %w", err)
+	}
+
+	err = p.EncryptedConnLimit.validate()
+	if err != nil {
+		return fmt.Errorf("validating encrypted conn limit: %w", err)
+	}
+
+	err = p.ResolverInfo.validate()
+	if err != nil {
+		return fmt.Errorf("validating resolver info: %w", err)
+	}
+
+	err = p.validateStartupGating()
+	if err != nil {
+		return fmt.Errorf("validating startup gating: %w", err)
+	}
+
+	err = p.validateProfiles()
+	if err != nil {
+		return fmt.Errorf("validating profiles: %w", err)
+	}
+
+	err = p.validateClientRoutes()
+	if err != nil {
+		return fmt.Errorf("validating client routes: %w", err)
+	}
+
+	if p.ListenSockets > 1 && !proxynetutil.ReusePortSupported {
+		return errors.Error("listen sockets: multiple sockets per address are not supported")
+	}
+
+	if p.ReusePort && !proxynetutil.ReusePortSupported {
+		return errors.Error("reuse port: sharing listen addresses is not supported")
+	}
+
+	if p.ListenInterface != "" && !proxynetutil.BindToInterfaceSupported {
+		return errors.Error("listen interface: binding to interface is not supported")
+	}
+
+	if p.ListenFreeBind && !proxynetutil.FreeBindSupported {
+		return errors.Error("listen free bind: binding to non-local addresses is not supported")
+	}
+
+	if p.DNS64Discovery && !p.UseDNS64 {
+		return errors.Error("dns64 discovery: dns64 is disabled")
+	}
+
+	if p.DNS64ReverseSynthesis && !p.UseDNS64 {
+		return errors.Error("dns64 reverse synthesis: dns64 is disabled")
+	}
+
+	if p.UDPSocketFilter && !proxynetutil.DNSFilterSupported {
+		return errors.Error("udp socket filter: not supported")
+	}
+
+	if p.TransparentProxy && !proxynetutil.TransparentSupported {
+		return errors.Error("transparent proxy: not supported")
+	}
+
+	err = p.validateXDP()
+	if err != nil {
+		return fmt.Errorf("validating xdp: %w", err)
+	}
+
+	err = proxynetutil.ValidateDSCP(p.ListenDSCP)
+	if err != nil {
+		return fmt.Errorf("listen dscp: %w", err)
+	}
+
+	err = p.ConcurrencyLimit.validate()
+	if err != nil {
+		return fmt.Errorf("validating concurrency limit: %w", err)
+	}
+
+	err = p.validateOverload()
+	if err != nil {
+		return fmt.Errorf("validating overload: %w", err)
+	}
+
+	err = p.UpstreamBackoff.validate()
+	if err != nil {
+		return fmt.Errorf("validating upstream backoff: %w", err)
+	}
+
+	err = p.UDPTruncation.validate()
+	if err != nil {
+		return fmt.Errorf("validating udp truncation: %w", err)
+	}
+
+	err = p.UpstreamUDPSize.validate()
+	if err != nil {
+		return fmt.Errorf("validating upstream udp size: %w", err)
+	}
+
+	err = p.TCPConn.validate()
+	if err != nil {
+		return fmt.Errorf("validating tcp connections: %w", err)
+	}
+
+	err = p.TLSConn.validate()
+	if err != nil {
+		return fmt.Errorf("validating tls connections: %w", err)
+	}
+
+	err = p.ListenerFaults.validate()
+	if err != nil {
+		return fmt.Errorf("validating listener faults: %w", err)
+	}
+
+	err = p.UpstreamFaults.validate()
+	if err != nil {
+		return fmt.Errorf("validating upstream faults: %w", err)
+	}
+
+	err = p.ForceTCP.validate()
+	if err != nil {
+		return fmt.Errorf("validating force tcp: %w", err)
+	}
+
+	err = validateNextUpstreamRcodes(p.NextUpstreamRcodes)
+	if err != nil {
+		return fmt.Errorf("validating next upstream rcodes: %w", err)
+	}
+
+	err = p.UpstreamRefusedPolicy.Validate()
+	if err != nil {
+		return fmt.Errorf("validating upstream refused policy: %w", err)
+	}
+
+	err = p.UpstreamNotImpPolicy.Validate()
+	if err != nil {
+		return fmt.Errorf("validating upstream notimp policy: %w", err)
+	}
+
+	err = p.TraceID.validate()
+	if err != nil {
+		return fmt.Errorf("validating trace id: %w", err)
+	}
+
+	err = p.QueryBudget.validate()
+	if err != nil {
+		return fmt.Errorf("validating query budget: %w", err)
+	}
+
+	err = p.SVCBRewrite.validate()
+	if err != nil {
+		return fmt.Errorf("validating svcb rewrite: %w", err)
+	}
+
+	err = p.Anomalies.validate()
+	if err != nil {
+		return fmt.Errorf("validating anomalies: %w", err)
+	}
+
+	err = p.FallbackTriggers.validate()
+	if err != nil {
+		return fmt.Errorf("validating fallback triggers: %w", err)
+	}
+
+	err = p.AnswerOrder.Validate()
+	if err != nil {
+		return fmt.Errorf("validating answer order: %w", err)
+	}
+
+	err = p.ResponseCompression.Validate()
+	if err != nil {
+		return fmt.Errorf("validating response compression: %w", err)
+	}
+
+	err = validateInsecureDomains(p.InsecureDomains)
+	if err != nil {
+		return fmt.Errorf("validating insecure domains: %w", err)
+	}
+
+	err = validateTSIGKeys(p.TSIGKeys)
+	if err != nil {
+		return fmt.Errorf("validating tsig keys: %w", err)
+	}
+
+	err = p.ZoneTransfer.validate()
+	if err != nil {
+		return fmt.Errorf("validating zone transfer: %w", err)
+	}
+
+	err = p.DynamicUpdate.validate()
+	if err != nil {
+		return fmt.Errorf("validating dynamic update: %w", err)
+	}
+
+	err = p.Notify.validate()
+	if err != nil {
+		return fmt.Errorf("validating notify: %w", err)
+	}
+
+	err = p.validateFastestAddr()
+	if err != nil {
+		return fmt.Errorf("validating fastest addr: %w", err)
+	}
+
+	p.logConfigInfo()
+
+	return nil
+}
+
+// validateReloadable returns an error if the part of the configuration which
+// can be changed with [Proxy.Reconfigure] is invalid.
+func (p *Proxy) validateReloadable() (err error) {
 	err = p.UpstreamConfig.validate()
 	if err != nil {
 		return fmt.Errorf("validating general upstreams: %w", err)
@@ -275,18 +1000,53 @@ func (p *Proxy) validateConfig() (err error) {
 		return fmt.Errorf("validating ratelimit: %w", err)
 	}
 
-	p.logConfigInfo()
+	err = validateTTLOverrides(p.CacheTTLOverrides)
+	if err != nil {
+		return fmt.Errorf("validating cache ttl overrides: %w", err)
+	}
+
+	if p.CacheAggressiveNSEC && !p.TrustUpstreamAD {
+		return errUntrustedAD
+	}
+
+	err = p.validateXDPReloadable()
+	if err != nil {
+		return fmt.Errorf("validating xdp: %w", err)
+	}
 
 	return nil
 }
 
+// errUntrustedAD is returned when the aggressive NSEC caching is enabled without
+// trusting the AD flag of the upstream responses.
+const errUntrustedAD errors.Error = "cache aggressive nsec requires trusting upstream ad"
+
 // validateRatelimit validates ratelimit configuration and returns an error if
 // it's invalid.
 func (p *Proxy) validateRatelimit() (err error) {
-	if p.Ratelimit == 0 {
+	switch {
+	case p.RatelimitIPv6 < 0:
+		return fmt.Errorf("ratelimit ipv6: negative value %d", p.RatelimitIPv6)
+	case p.RatelimitBurst < 0:
+		return fmt.Errorf("ratelimit burst: negative value %d", p.RatelimitBurst)
+	case p.RatelimitBurstIPv6 < 0:
+		return fmt.Errorf("ratelimit burst ipv6: negative value %d", p.RatelimitBurstIPv6)
+	case p.RatelimitTruncate < 0:
+		return fmt.Errorf("ratelimit truncate: negative value %d", p.RatelimitTruncate)
+	case p.RatelimitSlip < 0:
+		return fmt.Errorf("ratelimit slip: negative value %d", p.RatelimitSlip)
+	}
+
+	if p.Ratelimit == 0 && p.RatelimitTruncate == 0 {
 		return nil
 	}
 
+	return p.validateRatelimitSubnetLens()
+}
+
+// validateRatelimitSubnetLens returns an error if the ratelimit subnet lengths
+// are invalid.
+func (p *Proxy) validateRatelimitSubnetLens() (err error) {
 	err = checkInclusion(p.RatelimitSubnetLenIPv4, 0, netutil.IPv4BitLen)
 	if err != nil {
 		return fmt.Errorf("ratelimit subnet len ipv4 is invalid: %w", err)
@@ -316,24 +1076,44 @@ func checkInclusion(n, minN, maxN int) (err error) {
 // logConfigInfo logs proxy configuration information.
 func (p *Proxy) logConfigInfo() {
 	if p.CacheMinTTL > 0 || p.CacheMaxTTL > 0 {
-		log.Info("Cache TTL override is enabled. Min=%d, Max=%d", p.CacheMinTTL, p.CacheMaxTTL)
+		p.cacheLogger.Info("cache ttl override is enabled", "min", p.CacheMinTTL, "max", p.CacheMaxTTL)
+	}
+
+	for rrType, r := range p.CacheTTLOverrides {
+		p.cacheLogger.Info(
+			"cache ttl override is enabled",
+			"type", dns.Type(rrType),
+			"min", r.Min,
+			"max", r.Max,
+		)
 	}
 
 	if p.Ratelimit > 0 {
-		log.Info(
-			"Ratelimit is enabled and set to %d rps, IPv4 subnet mask len %d, IPv6 subnet mask len %d",
-			p.Ratelimit,
-			p.RatelimitSubnetLenIPv4,
-			p.RatelimitSubnetLenIPv6,
+		p.ratelimitLogger.Info(
+			"ratelimit is enabled",
+			"rps", p.Ratelimit,
+			"rps_ipv6", cmp.Or(p.RatelimitIPv6, p.Ratelimit),
+			"burst", cmp.Or(p.RatelimitBurst, p.Ratelimit),
+			"slip", p.RatelimitSlip,
+			"ipv4_subnet_len", p.RatelimitSubnetLenIPv4,
+			"ipv6_subnet_len", p.RatelimitSubnetLenIPv6,
 		)
 	}
 
+	if p.RatelimitTruncate > 0 {
+		p.ratelimitLogger.Info("ratelimit truncation is enabled", "rps", p.RatelimitTruncate)
+	}
+
 	if p.RefuseAny {
-		log.Info("dnsproxy: server will refuse requests of type ANY")
+		p.logger.Info("server will refuse requests of type any")
 	}
 
 	if len(p.BogusNXDomain) > 0 {
-		log.Info("%d bogus-nxdomain IP specified", len(p.BogusNXDomain))
+		p.logger.Info("bogus-nxdomain ip specified", "num", len(p.BogusNXDomain))
+	}
+
+	if p.ListenerFaults != nil || p.UpstreamFaults != nil {
+		p.logger.Warn("fault injection is enabled, don't use it in production")
 	}
 }
 
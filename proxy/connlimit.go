@@ -0,0 +1,265 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// EncryptedConnLimitConfig is the configuration of the limits of the
+// connections to the encrypted listeners: DNS-over-TLS, DNS-over-HTTPS
+// including HTTP/3, and DNS-over-QUIC.  The limits are shared by all of these
+// listeners, since the TLS and QUIC handshakes are much more expensive than the
+// plain DNS queries the ratelimit is designed for.
+type EncryptedConnLimitConfig struct {
+	// MaxConnsPerIP is the maximum number of the connections from a single
+	// client address handled simultaneously.  The connections exceeding it are
+	// closed, before the handshake where possible.  Zero means no limit.
+	MaxConnsPerIP uint
+
+	// HandshakesPerSecond is the maximum number of the new connections per
+	// second, exceeding which the connections are closed before the
+	// handshake.  Zero means no limit.
+	HandshakesPerSecond uint
+
+	// HandshakeBurst is the maximum number of the new connections allowed at
+	// once.  Zero means HandshakesPerSecond.
+	HandshakeBurst uint
+}
+
+// validate returns an error if c is invalid.  c may be nil.
+func (c *EncryptedConnLimitConfig) validate() (err error) {
+	if c == nil {
+		return nil
+	}
+
+	if c.HandshakeBurst > 0 && c.HandshakesPerSecond == 0 {
+		return errors.Error("handshake burst: no handshakes per second")
+	}
+
+	return nil
+}
+
+// errHandshakeLimited is returned when a new QUIC connection exceeds
+// [Config.EncryptedConnLimit].
+const errHandshakeLimited errors.Error = "handshake limit exceeded"
+
+// connLimiter limits the connections to the encrypted listeners.  A nil
+// *connLimiter doesn't limit anything.  All methods are safe for concurrent
+// use.
+type connLimiter struct {
+	// conns counts the connections from each client.  It's nil if those
+	// aren't limited.
+	conns *inflightTracker
+
+	// handshakes limits the rate of the new connections.  It's nil if it's
+	// not limited.
+	handshakes *rateLimiter
+}
+
+// newConnLimiter returns a new limiter for conf.  It returns nil if conf is
+// nil.  clock must not be nil.
+func newConnLimiter(conf *EncryptedConnLimitConfig, clock Clock) (l *connLimiter) {
+	if conf == nil {
+		return nil
+	}
+
+	l = &connLimiter{
+		conns: newInflightTracker(0, conf.MaxConnsPerIP),
+	}
+
+	if rate := int(conf.HandshakesPerSecond); rate > 0 {
+		l.handshakes = newRateLimiter(ratelimitParams{
+			rate:  rate,
+			burst: max(int(conf.HandshakeBurst), rate),
+		}, clock)
+	}
+
+	return l
+}
+
+// allowHandshake returns true if a new connection from addr may start the
+// handshake.  It doesn't count the connection, see [connLimiter.acquire].
+func (l *connLimiter) allowHandshake(addr netip.Addr) (ok bool) {
+	if l == nil {
+		return true
+	}
+
+	if l.conns.isFull(addr) {
+		return false
+	}
+
+	return l.handshakes == nil || l.handshakes.allow()
+}
+
+// acquire returns true if one more connection from addr may be handled, in
+// which case release must be called with the same addr once it's closed.
+func (l *connLimiter) acquire(addr netip.Addr) (ok bool) {
+	return l == nil || l.conns.acquire(addr)
+}
+
+// release marks the connection from addr, for which acquire has returned true,
+// closed.
+func (l *connLimiter) release(addr netip.Addr) {
+	if l != nil {
+		l.conns.release(addr)
+	}
+}
+
+// limitedListener is a [net.Listener] closing the accepted connections
+// exceeding the limits of a [connLimiter].  It's supposed to wrap the TCP
+// listeners before TLS, so that the rejected connections never start the
+// handshake.
+type limitedListener struct {
+	net.Listener
+
+	// limiter limits the accepted connections.  It must not be nil.
+	limiter *connLimiter
+}
+
+// type check
+var _ net.Listener = (*limitedListener)(nil)
+
+// limitEncryptedConns returns l limited according to
+// [Config.EncryptedConnLimit].  It returns l itself if it's not limited.
+func (p *Proxy) limitEncryptedConns(l net.Listener) (limited net.Listener) {
+	if p.connLimiter == nil {
+		return l
+	}
+
+	return &limitedListener{
+		Listener: l,
+		limiter:  p.connLimiter,
+	}
+}
+
+// Accept implements the [net.Listener] interface for *limitedListener.
+func (l *limitedListener) Accept() (conn net.Conn, err error) {
+	for {
+		conn, err = l.Listener.Accept()
+		if err != nil {
+			// Don't wrap the error, since it's checked by the callers.
+			return nil, err
+		}
+
+		addr := netutil.NetAddrToAddrPort(conn.RemoteAddr()).Addr().Unmap()
+		if !l.limiter.allowHandshake(addr) || !l.limiter.acquire(addr) {
+			// Ignore the error, since the connection is rejected anyway.
+			_ = conn.Close()
+
+			continue
+		}
+
+		return &limitedConn{
+			Conn:    conn,
+			release: sync.OnceFunc(func() { l.limiter.release(addr) }),
+		}, nil
+	}
+}
+
+// limitedConn is a [net.Conn] accepted by a [limitedListener].
+type limitedConn struct {
+	net.Conn
+
+	// release marks the connection closed for the limiter.  It's safe to call
+	// multiple times.
+	release func()
+}
+
+// type check
+var _ net.Conn = (*limitedConn)(nil)
+
+// Close implements the [net.Conn] interface for *limitedConn.
+func (c *limitedConn) Close() (err error) {
+	c.release()
+
+	return c.Conn.Close()
+}
+
+// serverQUICConfig returns the configuration of the QUIC listeners rejecting
+// the connections exceeding [Config.EncryptedConnLimit] before the handshake.
+func (p *Proxy) serverQUICConfig() (conf *quic.Config) {
+	conf = newServerQUICConfig()
+	if p.connLimiter == nil {
+		return conf
+	}
+
+	conf.GetConfigForClient = func(info *quic.ClientHelloInfo) (c *quic.Config, err error) {
+		addr := netutil.NetAddrToAddrPort(info.RemoteAddr).Addr().Unmap()
+		if !p.connLimiter.allowHandshake(addr) {
+			return nil, errHandshakeLimited
+		}
+
+		return newServerQUICConfig(), nil
+	}
+
+	return conf
+}
+
+// acquireQUICConn returns true if conn may be handled according to
+// [Config.EncryptedConnLimit].  Otherwise, it closes conn with code.
+func (p *Proxy) acquireQUICConn(conn quic.Connection, code quic.ApplicationErrorCode) (ok bool) {
+	if p.connLimiter == nil {
+		return true
+	}
+
+	addr := netutil.NetAddrToAddrPort(conn.RemoteAddr()).Addr().Unmap()
+	if !p.connLimiter.acquire(addr) {
+		p.logger.Debug("rejecting quic connection", "raddr", p.anonymizer.addr(addr))
+
+		// Ignore the error, since the connection is rejected anyway.
+		_ = conn.CloseWithError(code, "")
+
+		return false
+	}
+
+	context.AfterFunc(conn.Context(), func() { p.connLimiter.release(addr) })
+
+	return true
+}
+
+// limitedH3Listener is an [http3.QUICEarlyListener] closing the accepted
+// connections exceeding [Config.EncryptedConnLimit].
+type limitedH3Listener struct {
+	*quic.EarlyListener
+
+	// proxy checks the accepted connections.
+	proxy *Proxy
+}
+
+// type check
+var _ http3.QUICEarlyListener = (*limitedH3Listener)(nil)
+
+// limitH3Conns returns l limited according to [Config.EncryptedConnLimit].
+func (p *Proxy) limitH3Conns(l *quic.EarlyListener) (limited http3.QUICEarlyListener) {
+	if p.connLimiter == nil {
+		return l
+	}
+
+	return &limitedH3Listener{
+		EarlyListener: l,
+		proxy:         p,
+	}
+}
+
+// Accept implements the [http3.QUICEarlyListener] interface for
+// *limitedH3Listener.
+func (l *limitedH3Listener) Accept(ctx context.Context) (conn quic.EarlyConnection, err error) {
+	for {
+		conn, err = l.EarlyListener.Accept(ctx)
+		if err != nil {
+			// Don't wrap the error, since it's checked by the callers.
+			return nil, err
+		}
+
+		if l.proxy.acquireQUICConn(conn, quic.ApplicationErrorCode(http3.ErrCodeExcessiveLoad)) {
+			return conn, nil
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/quic-go/quic-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnLimiter(t *testing.T) {
+	now := time.Now()
+	clock := &fakeClock{onNow: func() (n time.Time) { return now }}
+
+	addrA := netip.MustParseAddr("192.0.2.1")
+	addrB := netip.MustParseAddr("192.0.2.2")
+
+	t.Run("handshakes", func(t *testing.T) {
+		l := newConnLimiter(&EncryptedConnLimitConfig{
+			HandshakesPerSecond: 1,
+			HandshakeBurst:      2,
+		}, clock)
+
+		assert.True(t, l.allowHandshake(addrA))
+		assert.True(t, l.allowHandshake(addrB))
+		assert.False(t, l.allowHandshake(addrA))
+
+		now = now.Add(time.Second)
+		assert.True(t, l.allowHandshake(addrB))
+		assert.False(t, l.allowHandshake(addrB))
+	})
+
+	t.Run("per_ip", func(t *testing.T) {
+		l := newConnLimiter(&EncryptedConnLimitConfig{MaxConnsPerIP: 1}, clock)
+
+		require.True(t, l.acquire(addrA))
+		assert.False(t, l.allowHandshake(addrA))
+		assert.False(t, l.acquire(addrA))
+		assert.True(t, l.allowHandshake(addrB))
+
+		l.release(addrA)
+		assert.True(t, l.allowHandshake(addrA))
+	})
+
+	t.Run("nil", func(t *testing.T) {
+		var l *connLimiter
+
+		assert.True(t, l.allowHandshake(addrA))
+		assert.True(t, l.acquire(addrA))
+		l.release(addrA)
+	})
+}
+
+func TestLimitedListener(t *testing.T) {
+	ln, err := net.Listen("tcp", localhostAnyPort.String())
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, ln.Close)
+
+	l := &limitedListener{
+		Listener: ln,
+		limiter: newConnLimiter(&EncryptedConnLimitConfig{
+			MaxConnsPerIP: 1,
+		}, realClock{}),
+	}
+
+	dial := func(t *testing.T) (conn net.Conn) {
+		t.Helper()
+
+		conn, dialErr := net.Dial("tcp", ln.Addr().String())
+		require.NoError(t, dialErr)
+		testutil.CleanupAndRequireSuccess(t, conn.Close)
+
+		return conn
+	}
+
+	_ = dial(t)
+	accepted, err := l.Accept()
+	require.NoError(t, err)
+
+	// The second connection from the same address is closed by the listener,
+	// which then accepts the third one once the first one is closed.
+	second := dial(t)
+	require.NoError(t, second.SetReadDeadline(time.Now().Add(defaultTimeout)))
+
+	acceptedCh := make(chan net.Conn, 1)
+	go func() {
+		c, _ := l.Accept()
+		acceptedCh <- c
+	}()
+
+	_, err = second.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+
+	require.NoError(t, accepted.Close())
+
+	third := dial(t)
+
+	accepted, _ = testutil.RequireReceive(t, acceptedCh, defaultTimeout)
+	require.NotNil(t, accepted)
+	testutil.CleanupAndRequireSuccess(t, accepted.Close)
+
+	assert.Equal(t, third.LocalAddr().String(), accepted.RemoteAddr().String())
+}
+
+func TestProxy_serverQUICConfig(t *testing.T) {
+	p := &Proxy{
+		connLimiter: newConnLimiter(&EncryptedConnLimitConfig{
+			HandshakesPerSecond: 1,
+		}, realClock{}),
+	}
+
+	conf := p.serverQUICConfig()
+	require.NotNil(t, conf.GetConfigForClient)
+
+	info := &quic.ClientHelloInfo{
+		RemoteAddr: net.UDPAddrFromAddrPort(netip.MustParseAddrPort("192.0.2.1:443")),
+	}
+
+	c, err := conf.GetConfigForClient(info)
+	require.NoError(t, err)
+
+	assert.Equal(t, maxQUICIdleTimeout, c.MaxIdleTimeout)
+
+	_, err = conf.GetConfigForClient(info)
+	assert.ErrorIs(t, err, errHandshakeLimited)
+}
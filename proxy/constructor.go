@@ -1,8 +1,13 @@
 package proxy
 
-import "github.com/miekg/dns"
+import (
+	"cmp"
 
-// MessageConstructor creates DNS messages.
+	"github.com/miekg/dns"
+)
+
+// MessageConstructor creates DNS messages.  Implementations may embed
+// [DefaultMessageConstructor] to only override some of the methods.
 type MessageConstructor interface {
 	// NewMsgNXDOMAIN creates a new response message replying to req with the
 	// NXDOMAIN code.
@@ -15,29 +20,101 @@ type MessageConstructor interface {
 	// NewMsgNOTIMPLEMENTED creates a new response message replying to req with
 	// the NOTIMPLEMENTED code.
 	NewMsgNOTIMPLEMENTED(req *dns.Msg) (resp *dns.Msg)
+
+	// NewMsgNODATA creates a new response message replying to req with the
+	// NOERROR code and no answers.
+	NewMsgNODATA(req *dns.Msg) (resp *dns.Msg)
+
+	// NewMsgBlocked creates a new response message replying to req, which has
+	// been blocked by a filtering rule or a policy.
+	NewMsgBlocked(req *dns.Msg) (resp *dns.Msg)
+
+	// NewMsgRatelimited creates a new response message replying to req, which
+	// has been ratelimited.  If resp is nil, the request is dropped.
+	NewMsgRatelimited(req *dns.Msg) (resp *dns.Msg)
 }
 
-// defaultMessageConstructor is a default implementation of MessageConstructor.
-type defaultMessageConstructor struct{}
+// BlockingMode defines the response to the blocked requests.
+type BlockingMode uint8
+
+// Blocking modes.
+const (
+	// BlockingModeNXDOMAIN responds to the blocked requests with NXDOMAIN and
+	// the SOA record.
+	BlockingModeNXDOMAIN BlockingMode = iota
+
+	// BlockingModeNODATA responds to the blocked requests with NOERROR, no
+	// answers, and the SOA record.
+	BlockingModeNODATA
+
+	// BlockingModeREFUSED responds to the blocked requests with REFUSED.
+	BlockingModeREFUSED
+)
+
+const (
+	// defaultNegativeTTL is the TTL of the SOA records in the negative
+	// responses used if [DefaultMessageConstructor.NegativeTTL] is zero.
+	defaultNegativeTTL = 10
+
+	// defaultAuthorityNS is the primary name server of the SOA records in the
+	// negative responses used if [DefaultMessageConstructor.AuthorityNS] is
+	// empty.  It's copied from AdGuard DNS.
+	defaultAuthorityNS = "fake-for-negative-caching.adguard.com."
+)
+
+// DefaultMessageConstructor is the default implementation of
+// [MessageConstructor].  The zero value is ready to use and is the constructor
+// used by [Proxy] if [Config.MessageConstructor] is nil.
+type DefaultMessageConstructor struct {
+	// AuthorityNS is the primary name server of the SOA records in the
+	// negative responses.  If empty, a fake name server is used.
+	AuthorityNS string
+
+	// NegativeTTL is the TTL of the SOA records in the negative responses in
+	// seconds, which limits the time they're cached by the clients.  If zero,
+	// 10 seconds are used.
+	NegativeTTL uint32
+
+	// BlockingMode defines the responses of NewMsgBlocked.
+	BlockingMode BlockingMode
+
+	// NXDOMAINWithSOA, if true, adds the SOA record to the NXDOMAIN responses
+	// of NewMsgNXDOMAIN.
+	NXDOMAINWithSOA bool
+
+	// RespondRatelimited, if true, makes NewMsgRatelimited respond to the
+	// ratelimited requests with REFUSED instead of dropping them.
+	RespondRatelimited bool
+
+	// ExtendedErrors, if true, adds the Extended DNS Error options, see RFC
+	// 8914, to the blocked, ratelimited, and not implemented responses to the
+	// requests with EDNS.
+	ExtendedErrors bool
+}
 
 // type check
-var _ MessageConstructor = defaultMessageConstructor{}
+var _ MessageConstructor = DefaultMessageConstructor{}
 
 // NewMsgNXDOMAIN implements the [MessageConstructor] interface for
-// defaultMessageConstructor.
-func (defaultMessageConstructor) NewMsgNXDOMAIN(req *dns.Msg) (resp *dns.Msg) {
-	return reply(req, dns.RcodeNameError)
+// DefaultMessageConstructor.
+func (c DefaultMessageConstructor) NewMsgNXDOMAIN(req *dns.Msg) (resp *dns.Msg) {
+	resp = reply(req, dns.RcodeNameError)
+	if c.NXDOMAINWithSOA {
+		resp.Ns = c.soa(req)
+	}
+
+	return resp
 }
 
 // NewMsgSERVFAIL implements the [MessageConstructor] interface for
-// defaultMessageConstructor.
-func (defaultMessageConstructor) NewMsgSERVFAIL(req *dns.Msg) (resp *dns.Msg) {
+// DefaultMessageConstructor.
+func (DefaultMessageConstructor) NewMsgSERVFAIL(req *dns.Msg) (resp *dns.Msg) {
 	return reply(req, dns.RcodeServerFailure)
 }
 
 // NewMsgNOTIMPLEMENTED implements the [MessageConstructor] interface for
-// defaultMessageConstructor.
-func (defaultMessageConstructor) NewMsgNOTIMPLEMENTED(req *dns.Msg) (resp *dns.Msg) {
+// DefaultMessageConstructor.
+func (c DefaultMessageConstructor) NewMsgNOTIMPLEMENTED(req *dns.Msg) (resp *dns.Msg) {
 	resp = reply(req, dns.RcodeNotImplemented)
 
 	// Most of the Internet and especially the inner core has an MTU of at least
@@ -50,10 +127,83 @@ func (defaultMessageConstructor) NewMsgNOTIMPLEMENTED(req *dns.Msg) (resp *dns.M
 	// NOTIMPLEMENTED without EDNS is treated as 'we don't support EDNS', so
 	// explicitly set it.
 	resp.SetEdns0(maxUDPPayload, false)
+	c.addEDE(req, resp, dns.ExtendedErrorCodeNotSupported)
 
 	return resp
 }
 
+// NewMsgNODATA implements the [MessageConstructor] interface for
+// DefaultMessageConstructor.
+func (c DefaultMessageConstructor) NewMsgNODATA(req *dns.Msg) (resp *dns.Msg) {
+	resp = reply(req, dns.RcodeSuccess)
+	resp.Ns = c.soa(req)
+
+	return resp
+}
+
+// NewMsgBlocked implements the [MessageConstructor] interface for
+// DefaultMessageConstructor.
+func (c DefaultMessageConstructor) NewMsgBlocked(req *dns.Msg) (resp *dns.Msg) {
+	switch c.BlockingMode {
+	case BlockingModeNODATA:
+		resp = c.NewMsgNODATA(req)
+	case BlockingModeREFUSED:
+		resp = reply(req, dns.RcodeRefused)
+	default:
+		resp = reply(req, dns.RcodeNameError)
+		resp.Ns = c.soa(req)
+	}
+
+	c.addEDE(req, resp, dns.ExtendedErrorCodeBlocked)
+
+	return resp
+}
+
+// NewMsgRatelimited implements the [MessageConstructor] interface for
+// DefaultMessageConstructor.
+func (c DefaultMessageConstructor) NewMsgRatelimited(req *dns.Msg) (resp *dns.Msg) {
+	if !c.RespondRatelimited {
+		return nil
+	}
+
+	resp = reply(req, dns.RcodeRefused)
+	c.addEDE(req, resp, dns.ExtendedErrorCodeProhibited)
+
+	return resp
+}
+
+// soa returns the authority section with the SOA record for the negative
+// responses to req.
+func (c DefaultMessageConstructor) soa(req *dns.Msg) (ns []dns.RR) {
+	return newSOA(
+		req,
+		cmp.Or(c.AuthorityNS, defaultAuthorityNS),
+		cmp.Or(c.NegativeTTL, defaultNegativeTTL),
+		retryNoError,
+	)
+}
+
+// addEDE adds the Extended DNS Error option with code to resp, if enabled and
+// req has EDNS.
+func (c DefaultMessageConstructor) addEDE(req, resp *dns.Msg, code uint16) {
+	if !c.ExtendedErrors {
+		return
+	}
+
+	reqOpt := req.IsEdns0()
+	if reqOpt == nil {
+		return
+	}
+
+	opt := resp.IsEdns0()
+	if opt == nil {
+		resp.SetEdns0(reqOpt.UDPSize(), reqOpt.Do())
+		opt = resp.IsEdns0()
+	}
+
+	opt.Option = append(opt.Option, &dns.EDNS0_EDE{InfoCode: code})
+}
+
 // reply creates a new response message replying to req with the given code.
 func reply(req *dns.Msg, code int) (resp *dns.Msg) {
 	resp = (&dns.Msg{}).SetRcode(req, code)
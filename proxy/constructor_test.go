@@ -0,0 +1,166 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDefaultMessageConstructor(t *testing.T) {
+	req := (&dns.Msg{}).SetQuestion("blocked.example.", dns.TypeA)
+	ednsReq := req.Copy().SetEdns0(dns.DefaultMsgSize, false)
+
+	testCases := []struct {
+		mc        DefaultMessageConstructor
+		newMsg    func(mc DefaultMessageConstructor, req *dns.Msg) (resp *dns.Msg)
+		req       *dns.Msg
+		name      string
+		wantEDE   uint16
+		wantRcode int
+		wantTTL   uint32
+		wantSOA   bool
+		wantNil   bool
+	}{{
+		mc:        DefaultMessageConstructor{},
+		newMsg:    DefaultMessageConstructor.NewMsgNXDOMAIN,
+		req:       req,
+		name:      "nxdomain",
+		wantRcode: dns.RcodeNameError,
+	}, {
+		mc:        DefaultMessageConstructor{NXDOMAINWithSOA: true, NegativeTTL: 300},
+		newMsg:    DefaultMessageConstructor.NewMsgNXDOMAIN,
+		req:       req,
+		name:      "nxdomain_soa",
+		wantRcode: dns.RcodeNameError,
+		wantTTL:   300,
+		wantSOA:   true,
+	}, {
+		mc:        DefaultMessageConstructor{},
+		newMsg:    DefaultMessageConstructor.NewMsgNODATA,
+		req:       req,
+		name:      "nodata",
+		wantRcode: dns.RcodeSuccess,
+		wantTTL:   defaultNegativeTTL,
+		wantSOA:   true,
+	}, {
+		mc:        DefaultMessageConstructor{},
+		newMsg:    DefaultMessageConstructor.NewMsgBlocked,
+		req:       ednsReq,
+		name:      "blocked_default",
+		wantRcode: dns.RcodeNameError,
+		wantTTL:   defaultNegativeTTL,
+		wantSOA:   true,
+	}, {
+		mc: DefaultMessageConstructor{
+			BlockingMode:   BlockingModeREFUSED,
+			ExtendedErrors: true,
+		},
+		newMsg:    DefaultMessageConstructor.NewMsgBlocked,
+		req:       ednsReq,
+		name:      "blocked_refused_ede",
+		wantEDE:   dns.ExtendedErrorCodeBlocked,
+		wantRcode: dns.RcodeRefused,
+	}, {
+		mc: DefaultMessageConstructor{
+			BlockingMode:   BlockingModeNODATA,
+			ExtendedErrors: true,
+		},
+		newMsg:    DefaultMessageConstructor.NewMsgBlocked,
+		req:       req,
+		name:      "blocked_nodata_no_edns",
+		wantRcode: dns.RcodeSuccess,
+		wantTTL:   defaultNegativeTTL,
+		wantSOA:   true,
+	}, {
+		mc:      DefaultMessageConstructor{},
+		newMsg:  DefaultMessageConstructor.NewMsgRatelimited,
+		req:     req,
+		name:    "ratelimited_drop",
+		wantNil: true,
+	}, {
+		mc: DefaultMessageConstructor{
+			RespondRatelimited: true,
+			ExtendedErrors:     true,
+		},
+		newMsg:    DefaultMessageConstructor.NewMsgRatelimited,
+		req:       ednsReq,
+		name:      "ratelimited_refused_ede",
+		wantEDE:   dns.ExtendedErrorCodeProhibited,
+		wantRcode: dns.RcodeRefused,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := tc.newMsg(tc.mc, tc.req)
+			if tc.wantNil {
+				assert.Nil(t, resp)
+
+				return
+			}
+
+			require.NotNil(t, resp)
+			assert.Equal(t, tc.wantRcode, resp.Rcode)
+
+			if tc.wantSOA {
+				require.Len(t, resp.Ns, 1)
+
+				soa := testutil.RequireTypeAssert[*dns.SOA](t, resp.Ns[0])
+				assert.Equal(t, tc.wantTTL, soa.Hdr.Ttl)
+			} else {
+				assert.Empty(t, resp.Ns)
+			}
+
+			var ede *dns.EDNS0_EDE
+			if opt := resp.IsEdns0(); opt != nil {
+				for _, o := range opt.Option {
+					if e, ok := o.(*dns.EDNS0_EDE); ok {
+						ede = e
+					}
+				}
+			}
+
+			if tc.wantEDE == 0 {
+				assert.Nil(t, ede)
+			} else {
+				require.NotNil(t, ede)
+				assert.Equal(t, tc.wantEDE, ede.InfoCode)
+			}
+		})
+	}
+}
+
+func TestProxy_ratelimitedResponse(t *testing.T) {
+	p := mustNew(t, &Config{
+		Logger:        testLogger,
+		UDPListenAddr: []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{newProfileTestUpstream("192.0.2.1")},
+		},
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+		Ratelimit:              1,
+		MessageConstructor:     DefaultMessageConstructor{RespondRatelimited: true},
+	})
+
+	ctx := context.Background()
+	require.NoError(t, p.Start(ctx))
+	testutil.CleanupAndRequireSuccess(t, func() (err error) { return p.Shutdown(ctx) })
+
+	client := &dns.Client{Net: string(ProtoUDP), Timeout: defaultTimeout}
+	addr := p.Addr(ProtoUDP).String()
+
+	resp, _, err := client.Exchange(newHostTestMessage("first.example"), addr)
+	require.NoError(t, err)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+
+	resp, _, err = client.Exchange(newHostTestMessage("second.example"), addr)
+	require.NoError(t, err)
+	assert.Equal(t, dns.RcodeRefused, resp.Rcode)
+}
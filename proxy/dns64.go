@@ -1,12 +1,14 @@
 package proxy
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"net/netip"
+	"slices"
 
 	"github.com/AdguardTeam/dnsproxy/upstream"
-	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
 	"github.com/AdguardTeam/golibs/netutil"
 	"github.com/miekg/dns"
 )
@@ -30,24 +32,68 @@ const (
 	maxDNS64SynTTL uint32 = 600
 )
 
+// DNS64Synthesis defines which of the NAT64 prefixes are used to synthesize the
+// AAAA records.
+type DNS64Synthesis string
+
+// DNS64Synthesis values.
+const (
+	// DNS64SynthesisFirst makes only the first NAT64 prefix used.
+	DNS64SynthesisFirst DNS64Synthesis = "first"
+
+	// DNS64SynthesisAll makes an AAAA record synthesized with each of the
+	// NAT64 prefixes, in the order they're specified.
+	DNS64SynthesisAll DNS64Synthesis = "all"
+
+	// DNS64SynthesisRoundRobin is like [DNS64SynthesisAll], but the NAT64
+	// prefixes are rotated with each response, so that the clients using the
+	// first address are distributed among the NAT64 gateways.
+	DNS64SynthesisRoundRobin DNS64Synthesis = "round_robin"
+)
+
+// Validate returns an error if s is not a valid DNS64 synthesis mode.
+func (s DNS64Synthesis) Validate() (err error) {
+	switch s {
+	case "", DNS64SynthesisFirst, DNS64SynthesisAll, DNS64SynthesisRoundRobin:
+		return nil
+	default:
+		return fmt.Errorf("unknown value %q", string(s))
+	}
+}
+
 // setupDNS64 initializes DNS64 settings, the NAT64 prefixes in particular.  If
 // the DNS64 feature is enabled and no prefixes are configured, the default
 // Well-Known Prefix is used, just like Section 5.2 of RFC 6147 prescribes.  Any
 // configured set of prefixes discards the default Well-Known prefix unless it
 // is specified explicitly.  Each prefix also validated to be a valid IPv6 CIDR
-// with a maximum length of 96 bits.  The first specified prefix is then used to
-// synthesize AAAA records.
+// with a maximum length of 96 bits.  The prefixes are then used to synthesize
+// AAAA records as [Config.DNS64Synthesis] specifies.
 func (p *Proxy) setupDNS64() (err error) {
 	if !p.Config.UseDNS64 {
 		return nil
 	}
 
+	err = p.Config.DNS64Synthesis.Validate()
+	if err != nil {
+		return fmt.Errorf("synthesis: %w", err)
+	}
+
+	p.dns64Exclude = make(netutil.SliceSubnetSet, 0, len(p.Config.DNS64Exclude))
+	for i, pref := range p.Config.DNS64Exclude {
+		if !pref.Addr().Is4() {
+			return fmt.Errorf("excluded prefix at index %d: %q is not an IPv4 prefix", i, pref)
+		}
+
+		p.dns64Exclude = append(p.dns64Exclude, pref.Masked())
+	}
+
 	if len(p.Config.DNS64Prefs) == 0 {
-		p.dns64Prefs = netutil.SliceSubnetSet{dns64WellKnownPref}
+		p.dns64Prefs.Store(&netutil.SliceSubnetSet{dns64WellKnownPref})
 
 		return nil
 	}
 
+	prefs := make(netutil.SliceSubnetSet, 0, len(p.Config.DNS64Prefs))
 	for i, pref := range p.Config.DNS64Prefs {
 		if !pref.Addr().Is6() {
 			return fmt.Errorf("prefix at index %d: %q is not an IPv6 prefix", i, pref)
@@ -57,7 +103,19 @@ func (p *Proxy) setupDNS64() (err error) {
 			return fmt.Errorf("prefix at index %d: %q is too long for DNS64", i, pref)
 		}
 
-		p.dns64Prefs = append(p.dns64Prefs, pref.Masked())
+		prefs = append(prefs, pref.Masked())
+	}
+
+	p.dns64Prefs.Store(&prefs)
+
+	return nil
+}
+
+// nat64Prefixes returns the current NAT64 prefixes.  prefs is empty if the
+// DNS64 function is disabled.
+func (p *Proxy) nat64Prefixes() (prefs netutil.SliceSubnetSet) {
+	if ptr := p.dns64Prefs.Load(); ptr != nil {
+		return *ptr
 	}
 
 	return nil
@@ -70,7 +128,7 @@ func (p *Proxy) setupDNS64() (err error) {
 //
 // See https://datatracker.ietf.org/doc/html/rfc6147.
 func (p *Proxy) checkDNS64(req, resp *dns.Msg) (dns64Req *dns.Msg) {
-	if len(p.dns64Prefs) == 0 {
+	if len(p.nat64Prefixes()) == 0 {
 		return nil
 	}
 
@@ -114,14 +172,15 @@ func (p *Proxy) checkDNS64(req, resp *dns.Msg) (dns64Req *dns.Msg) {
 //
 // TODO(e.burkov):  Remove prefs from args when old API is removed.
 func (p *Proxy) filterNAT64Answers(rrs []dns.RR) (filtered []dns.RR, hasAnswers bool) {
+	prefs := p.nat64Prefixes()
 	filtered = make([]dns.RR, 0, len(rrs))
 	for _, ans := range rrs {
 		switch ans := ans.(type) {
 		case *dns.AAAA:
 			addr, err := netutil.IPToAddrNoMapped(ans.AAAA)
 			if err != nil {
-				log.Error("dnsproxy: bad aaaa record: %s", err)
-			} else if p.dns64Prefs.Contains(addr) {
+				p.logger.Error("bad aaaa record", slogutil.KeyError, err)
+			} else if prefs.Contains(addr) {
 				// Filter the record.
 				continue
 			} else {
@@ -168,15 +227,40 @@ func (p *Proxy) synthDNS64(origReq, origResp, resp *dns.Msg) (ok bool) {
 		}
 	}
 
-	newAns := make([]dns.RR, 0, len(resp.Answer))
+	prefs := p.synthesisPrefixes()
+	newAns := make([]dns.RR, 0, len(resp.Answer)*len(prefs))
+	var hasSynth bool
 	for _, ans := range resp.Answer {
-		rr := p.synthRR(ans, soaTTL)
-		if rr == nil {
-			// The error should have already been logged.
+		a, isA := ans.(*dns.A)
+		if !isA {
+			newAns = append(newAns, ans)
+
+			continue
+		}
+
+		addr, err := netutil.IPToAddr(a.A, netutil.AddrFamilyIPv4)
+		if err != nil {
+			p.logger.Error("bad a record", slogutil.KeyError, err)
+
 			return false
 		}
 
-		newAns = append(newAns, rr)
+		if p.dns64Exclude.Contains(addr) {
+			// Addresses within the excluded ranges are treated as though they
+			// weren't in the response at all.  See RFC 6147, Section 5.1.4.
+			continue
+		}
+
+		for _, pref := range prefs {
+			newAns = append(newAns, synthAAAA(a, addr, pref, soaTTL))
+		}
+
+		hasSynth = true
+	}
+
+	if !hasSynth {
+		// All the A records are excluded, so respond with the original answer.
+		return false
 	}
 
 	origResp.Answer = newAns
@@ -201,7 +285,8 @@ var dns64WellKnownPref = netip.MustParsePrefix("64:ff9b::/96")
 //
 // See https://datatracker.ietf.org/doc/html/rfc6147#section-5.3.1.
 func (p *Proxy) shouldStripDNS64(req *dns.Msg) (ok bool) {
-	if len(p.dns64Prefs) == 0 {
+	prefs := p.nat64Prefixes()
+	if len(prefs) == 0 {
 		return false
 	}
 
@@ -213,16 +298,16 @@ func (p *Proxy) shouldStripDNS64(req *dns.Msg) (ok bool) {
 	host := q.Name
 	ip, err := netutil.IPFromReversedAddr(host)
 	if err != nil {
-		log.Debug("dnsproxy: failed to parse ip from ptr request: %s", err)
+		p.logger.Debug("failed to parse ip from ptr request", slogutil.KeyError, err)
 
 		return false
 	}
 
 	switch {
-	case p.dns64Prefs.Contains(ip):
-		log.Debug("dnsproxy: %s is within DNS64 custom prefix set", ip)
+	case prefs.Contains(ip):
+		p.logger.Debug("ip is within dns64 custom prefix set", "ip", ip)
 	case dns64WellKnownPref.Contains(ip):
-		log.Debug("dnsproxy: %s is within DNS64 well-known prefix", ip)
+		p.logger.Debug("ip is within dns64 well-known prefix", "ip", ip)
 	default:
 		return false
 	}
@@ -230,57 +315,103 @@ func (p *Proxy) shouldStripDNS64(req *dns.Msg) (ok bool) {
 	return true
 }
 
-// mapDNS64 maps addr to IPv6 address using configured DNS64 prefix.  addr must
-// be a valid IPv4.  It panics, if there are no configured DNS64 prefixes,
-// because synthesis should not be performed unless DNS64 function enabled.
-//
-// TODO(e.burkov):  Remove pref from args when old API is removed.
-func (p *Proxy) mapDNS64(addr netip.Addr) (mapped net.IP) {
-	// Don't mask the address here since it should have already been masked on
-	// initialization stage.
-	prefData := p.dns64Prefs[0].Addr().As16()
-	addrData := addr.As4()
-
-	mapped = make(net.IP, net.IPv6len)
-	copy(mapped[:NAT64PrefixLength], prefData[:])
-	copy(mapped[NAT64PrefixLength:], addrData[:])
-
-	return mapped
+// synthesisPrefixes returns the NAT64 prefixes to synthesize the AAAA records
+// of a single response with, ordered as [Config.DNS64Synthesis] specifies.  It
+// must only be called when the DNS64 function is enabled.
+func (p *Proxy) synthesisPrefixes() (prefs []netip.Prefix) {
+	all := p.nat64Prefixes()
+
+	switch p.Config.DNS64Synthesis {
+	case DNS64SynthesisAll:
+		return all
+	case DNS64SynthesisRoundRobin:
+		i := int((p.dns64Counter.Add(1) - 1) % uint64(len(all)))
+
+		return append(slices.Clone(all[i:]), all[:i]...)
+	default:
+		return all[:1]
+	}
 }
 
-// synthRR synthesizes a DNS64 resource record in compliance with RFC 6147.  If
-// rr is not an A record, it's returned as is.  A records are modified to become
-// a DNS64-synthesized AAAA records, and the TTL is set according to the
-// original TTL of a record and soaTTL.  It returns nil on invalid A records.
-func (p *Proxy) synthRR(rr dns.RR, soaTTL uint32) (result dns.RR) {
-	aResp, ok := rr.(*dns.A)
-	if !ok {
-		return rr
+// nat64UOctet is the index of the byte of an IPv4-embedded IPv6 address which
+// must be zero, see RFC 6052, Section 2.2.
+const nat64UOctet = 8
+
+// nat64Embed returns the IPv4-embedded IPv6 address of addr within pref, which
+// must be masked, using the address format from Section 2.2 of RFC 6052.  The
+// prefixes of lengths not defined there are treated as the 96-bit ones.  addr
+// must be a valid IPv4 address.
+func nat64Embed(pref netip.Prefix, addr netip.Addr) (embedded netip.Addr) {
+	data := pref.Addr().As16()
+	v4 := addr.As4()
+
+	switch bits := pref.Bits(); bits {
+	case 32, 40, 48, 56, 64:
+		// Skip the u octet.
+		i := bits / 8
+		for _, b := range v4 {
+			if i == nat64UOctet {
+				data[i] = 0
+				i++
+			}
+
+			data[i] = b
+			i++
+		}
+	default:
+		copy(data[NAT64PrefixLength:], v4[:])
 	}
 
-	addr, err := netutil.IPToAddr(aResp.A, netutil.AddrFamilyIPv4)
-	if err != nil {
-		log.Error("dnsproxy: bad a record: %s", err)
+	return netip.AddrFrom16(data)
+}
 
-		return nil
+// nat64Extract returns the IPv4 address embedded into addr with a NAT64 prefix
+// of the given length, using the address format from Section 2.2 of RFC 6052.
+// The lengths not defined there are treated as 96 bits.  addr must be a valid
+// IPv6 address.
+func nat64Extract(addr netip.Addr, bits int) (v4 netip.Addr) {
+	data := addr.As16()
+
+	var res [net.IPv4len]byte
+	switch bits {
+	case 32, 40, 48, 56, 64:
+		i := bits / 8
+		for j := range res {
+			if i == nat64UOctet {
+				i++
+			}
+
+			res[j] = data[i]
+			i++
+		}
+	default:
+		copy(res[:], data[NAT64PrefixLength:])
 	}
 
-	aaaa := &dns.AAAA{
+	return netip.AddrFrom4(res)
+}
+
+// synthAAAA returns the DNS64-synthesized AAAA record for a, which contains
+// addr, in compliance with RFC 6147.  The TTL is set according to the original
+// TTL of a and soaTTL.  pref must be masked.
+func synthAAAA(a *dns.A, addr netip.Addr, pref netip.Prefix, soaTTL uint32) (aaaa *dns.AAAA) {
+	embedded := nat64Embed(pref, addr).As16()
+
+	return &dns.AAAA{
 		Hdr: dns.RR_Header{
-			Name:   aResp.Hdr.Name,
+			Name:   a.Hdr.Name,
 			Rrtype: dns.TypeAAAA,
-			Class:  aResp.Hdr.Class,
-			Ttl:    min(aResp.Hdr.Ttl, soaTTL),
+			Class:  a.Hdr.Class,
+			Ttl:    min(a.Hdr.Ttl, soaTTL),
 		},
-		AAAA: p.mapDNS64(addr),
+		AAAA: embedded[:],
 	}
-
-	return aaaa
 }
 
 // performDNS64 returns the upstream that was used to perform DNS64 request, or
 // nil, if the request was not performed.
 func (p *Proxy) performDNS64(
+	ctx context.Context,
 	origReq *dns.Msg,
 	origResp *dns.Msg,
 	upstreams []upstream.Upstream,
@@ -295,17 +426,17 @@ func (p *Proxy) performDNS64(
 	}
 
 	host := origReq.Question[0].Name
-	log.Debug("dnsproxy: received an empty aaaa response for %q, checking dns64", host)
+	p.logger.Debug("received an empty aaaa response, checking dns64", "host", host)
 
-	dns64Resp, u, err := p.exchangeUpstreams(dns64Req, upstreams)
+	dns64Resp, u, err := p.exchangeUpstreams(ctx, dns64Req, upstreams)
 	if err != nil {
-		log.Error("dnsproxy: dns64 request failed: %s", err)
+		p.logger.Error("dns64 request failed", slogutil.KeyError, err)
 
 		return nil
 	}
 
 	if dns64Resp != nil && p.synthDNS64(origReq, origResp, dns64Resp) {
-		log.Debug("dnsforward: synthesized aaaa response for %q", host)
+		p.logger.Debug("synthesized aaaa response", "host", host)
 
 		return u
 	}
@@ -4,11 +4,13 @@ import (
 	"context"
 	"net"
 	"net/netip"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/AdguardTeam/dnsproxy/upstream"
-	"github.com/AdguardTeam/golibs/log"
 	"github.com/AdguardTeam/golibs/netutil"
 	"github.com/AdguardTeam/golibs/testutil"
 	"github.com/miekg/dns"
@@ -19,8 +21,6 @@ import (
 const ipv4OnlyFqdn = "ipv4.only."
 
 func TestDNS64Race(t *testing.T) {
-	log.SetLevel(log.DEBUG)
-
 	ans := newRR(t, ipv4OnlyFqdn, dns.TypeA, 3600, net.ParseIP("1.2.3.4"))
 	ups := &fakeUpstream{
 		onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
@@ -395,3 +395,408 @@ func TestProxy_Resolve_dns64(t *testing.T) {
 		})
 	}
 }
+
+func TestNAT64Embed(t *testing.T) {
+	// See RFC 6052, Section 2.4.
+	v4 := netip.MustParseAddr("192.0.2.33")
+
+	testCases := []struct {
+		pref netip.Prefix
+		want netip.Addr
+	}{{
+		pref: netip.MustParsePrefix("2001:db8::/32"),
+		want: netip.MustParseAddr("2001:db8:c000:221::"),
+	}, {
+		pref: netip.MustParsePrefix("2001:db8:100::/40"),
+		want: netip.MustParseAddr("2001:db8:1c0:2:21::"),
+	}, {
+		pref: netip.MustParsePrefix("2001:db8:122::/48"),
+		want: netip.MustParseAddr("2001:db8:122:c000:2:2100::"),
+	}, {
+		pref: netip.MustParsePrefix("2001:db8:122:300::/56"),
+		want: netip.MustParseAddr("2001:db8:122:3c0:0:221::"),
+	}, {
+		pref: netip.MustParsePrefix("2001:db8:122:344::/64"),
+		want: netip.MustParseAddr("2001:db8:122:344:c0:2:2100:0"),
+	}, {
+		pref: netip.MustParsePrefix("2001:db8:122:344::/96"),
+		want: netip.MustParseAddr("2001:db8:122:344::192.0.2.33"),
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.pref.String(), func(t *testing.T) {
+			got := nat64Embed(tc.pref, v4)
+			assert.Equal(t, tc.want, got)
+
+			assert.Equal(t, v4, nat64Extract(got, tc.pref.Bits()))
+
+			pref, ok := nat64PrefixOf(nat64Embed(tc.pref, nat64WellKnownAddrs[0]))
+			require.True(t, ok)
+
+			assert.Equal(t, tc.pref, pref)
+		})
+	}
+}
+
+func TestProxy_dns64Discovery(t *testing.T) {
+	const ttl = 1
+
+	someIPv4 := net.IP{1, 2, 3, 4}
+
+	// discovered is the AAAA record of ipv4only.arpa synthesized by the
+	// upstream.
+	discovered := &atomic.Pointer[dns.AAAA]{}
+	setDiscovered := func(addr string) {
+		discovered.Store(&dns.AAAA{
+			Hdr: dns.RR_Header{
+				Name:   nat64DiscoveryName,
+				Rrtype: dns.TypeAAAA,
+				Class:  dns.ClassINET,
+				Ttl:    ttl,
+			},
+			AAAA: net.ParseIP(addr),
+		})
+	}
+	setDiscovered("2001:db8:122:344::192.0.0.170")
+
+	ups := &fakeUpstream{
+		onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			resp = (&dns.Msg{}).SetReply(req)
+
+			q := req.Question[0]
+			switch {
+			case q.Name == nat64DiscoveryName && q.Qtype == dns.TypeAAAA:
+				resp.Answer = []dns.RR{dns.Copy(discovered.Load())}
+			case q.Qtype == dns.TypeA:
+				resp.Answer = []dns.RR{newRR(t, q.Name, dns.TypeA, 3600, someIPv4)}
+			}
+
+			return resp, nil
+		},
+		onAddress: func() (addr string) { return "fake.address" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	p := mustNew(t, &Config{
+		Logger:         testLogger,
+		UDPListenAddr:  []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig: &UpstreamConfig{Upstreams: []upstream.Upstream{ups}},
+		TrustedProxies: defaultTrustedProxies,
+		UseDNS64:       true,
+		DNS64Discovery: true,
+	})
+	p.nat64MinInterval = 10 * time.Millisecond
+
+	resolveAAAA := func() (rr dns.RR) {
+		d := &DNSContext{Req: (&dns.Msg{}).SetQuestion(ipv4OnlyFqdn, dns.TypeAAAA)}
+		require.NoError(t, p.Resolve(d))
+		require.Len(t, d.Res.Answer, 1)
+
+		return d.Res.Answer[0]
+	}
+
+	// The Well-Known Prefix is used until the discovery succeeds.
+	aaaa := testutil.RequireTypeAssert[*dns.AAAA](t, resolveAAAA())
+	assert.Equal(t, net.ParseIP("64:ff9b::102:304"), aaaa.AAAA)
+
+	ctx := context.Background()
+	require.NoError(t, p.Start(ctx))
+	testutil.CleanupAndRequireSuccess(t, func() (err error) { return p.Shutdown(ctx) })
+
+	wantPrefs := netutil.SliceSubnetSet{netip.MustParsePrefix("2001:db8:122:344::/96")}
+	require.Eventually(t, func() (ok bool) {
+		return slices.Equal(wantPrefs, p.nat64Prefixes())
+	}, defaultTimeout, p.nat64MinInterval)
+
+	aaaa = testutil.RequireTypeAssert[*dns.AAAA](t, resolveAAAA())
+	assert.Equal(t, net.ParseIP("2001:db8:122:344::102:304"), aaaa.AAAA)
+
+	// The prefix is rechecked once the TTL expires.
+	setDiscovered("2001:db8:122:344:c0:0:aa00:0")
+
+	wantPrefs = netutil.SliceSubnetSet{netip.MustParsePrefix("2001:db8:122:344::/64")}
+	require.Eventually(t, func() (ok bool) {
+		return slices.Equal(wantPrefs, p.nat64Prefixes())
+	}, 2*ttl*time.Second+defaultTimeout, p.nat64MinInterval)
+
+	aaaa = testutil.RequireTypeAssert[*dns.AAAA](t, resolveAAAA())
+	assert.Equal(t, net.ParseIP("2001:db8:122:344:1:203:400:0"), aaaa.AAAA)
+}
+
+func TestProxy_dns64Synthesis(t *testing.T) {
+	const cnameTarget = "target.ipv4.only."
+
+	someIPv4 := net.IP{1, 2, 3, 4}
+	excludedIPv4 := net.IP{10, 0, 0, 1}
+
+	newProxy := func(t *testing.T, synth DNS64Synthesis, ans ...dns.RR) (p *Proxy) {
+		t.Helper()
+
+		ups := &fakeUpstream{
+			onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+				resp = (&dns.Msg{}).SetReply(req)
+				if req.Question[0].Qtype == dns.TypeA {
+					resp.Answer = ans
+				}
+
+				return resp, nil
+			},
+			onAddress: func() (addr string) { return "fake.address" },
+			onClose:   func() (err error) { return nil },
+		}
+
+		return mustNew(t, &Config{
+			Logger:         testLogger,
+			UDPListenAddr:  []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+			UpstreamConfig: &UpstreamConfig{Upstreams: []upstream.Upstream{ups}},
+			TrustedProxies: defaultTrustedProxies,
+			UseDNS64:       true,
+			DNS64Prefs: []netip.Prefix{
+				netip.MustParsePrefix("2001:db8:1::/96"),
+				netip.MustParsePrefix("2001:db8:2::/96"),
+			},
+			DNS64Exclude:   []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+			DNS64Synthesis: synth,
+		})
+	}
+
+	// resolveAAAA returns the addresses from the answer to the AAAA request.
+	// CNAME records are returned as nil.
+	resolveAAAA := func(t *testing.T, p *Proxy) (addrs []net.IP) {
+		t.Helper()
+
+		d := &DNSContext{Req: (&dns.Msg{}).SetQuestion(ipv4OnlyFqdn, dns.TypeAAAA)}
+		require.NoError(t, p.Resolve(d))
+
+		for _, rr := range d.Res.Answer {
+			switch rr := rr.(type) {
+			case *dns.AAAA:
+				addrs = append(addrs, rr.AAAA)
+			case *dns.CNAME:
+				addrs = append(addrs, nil)
+			default:
+				t.Fatalf("unexpected record %s", rr)
+			}
+		}
+
+		return addrs
+	}
+
+	synthFirst := net.ParseIP("2001:db8:1::102:304")
+	synthSecond := net.ParseIP("2001:db8:2::102:304")
+
+	ansA := newRR(t, ipv4OnlyFqdn, dns.TypeA, 3600, someIPv4)
+	ansExcluded := newRR(t, ipv4OnlyFqdn, dns.TypeA, 3600, excludedIPv4)
+
+	testCases := []struct {
+		name  string
+		synth DNS64Synthesis
+		ans   []dns.RR
+		want  []net.IP
+	}{{
+		name:  "default",
+		synth: "",
+		ans:   []dns.RR{ansA},
+		want:  []net.IP{synthFirst},
+	}, {
+		name:  "first",
+		synth: DNS64SynthesisFirst,
+		ans:   []dns.RR{ansA},
+		want:  []net.IP{synthFirst},
+	}, {
+		name:  "all",
+		synth: DNS64SynthesisAll,
+		ans:   []dns.RR{ansA},
+		want:  []net.IP{synthFirst, synthSecond},
+	}, {
+		name:  "excluded",
+		synth: DNS64SynthesisAll,
+		ans:   []dns.RR{ansExcluded, ansA},
+		want:  []net.IP{synthFirst, synthSecond},
+	}, {
+		name:  "all_excluded",
+		synth: DNS64SynthesisAll,
+		ans:   []dns.RR{ansExcluded},
+		want:  nil,
+	}, {
+		name:  "cname",
+		synth: DNS64SynthesisFirst,
+		ans: []dns.RR{
+			newRR(t, ipv4OnlyFqdn, dns.TypeCNAME, 3600, cnameTarget),
+			newRR(t, cnameTarget, dns.TypeA, 3600, someIPv4),
+		},
+		want: []net.IP{nil, synthFirst},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := newProxy(t, tc.synth, tc.ans...)
+
+			assert.Equal(t, tc.want, resolveAAAA(t, p))
+		})
+	}
+
+	t.Run("round_robin", func(t *testing.T) {
+		p := newProxy(t, DNS64SynthesisRoundRobin, ansA)
+
+		assert.Equal(t, []net.IP{synthFirst, synthSecond}, resolveAAAA(t, p))
+		assert.Equal(t, []net.IP{synthSecond, synthFirst}, resolveAAAA(t, p))
+		assert.Equal(t, []net.IP{synthFirst, synthSecond}, resolveAAAA(t, p))
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		upsConf := &UpstreamConfig{
+			Upstreams: []upstream.Upstream{newProfileTestUpstream("1.2.3.4")},
+		}
+
+		_, err := New(&Config{
+			UpstreamConfig: upsConf,
+			TrustedProxies: defaultTrustedProxies,
+			UseDNS64:       true,
+			DNS64Synthesis: "random",
+		})
+		testutil.AssertErrorMsg(t, `setting up DNS64: synthesis: unknown value "random"`, err)
+
+		_, err = New(&Config{
+			UpstreamConfig: upsConf,
+			TrustedProxies: defaultTrustedProxies,
+			UseDNS64:       true,
+			DNS64Exclude:   []netip.Prefix{netip.MustParsePrefix("2001:db8::/32")},
+		})
+		testutil.AssertErrorMsg(
+			t,
+			`setting up DNS64: excluded prefix at index 0: "2001:db8::/32" is not an IPv4 prefix`,
+			err,
+		)
+	})
+}
+
+func TestProxy_dns64ReverseSynthesis(t *testing.T) {
+	const (
+		globalHost    = "global.host."
+		globalTarget  = "4.3.2.1.in-addr.arpa."
+		privateHost   = "private.host."
+		privateTarget = "1.1.168.192.in-addr.arpa."
+	)
+
+	newUps := func(name, host string) (u upstream.Upstream) {
+		pt := testutil.PanicT{}
+
+		return &fakeUpstream{
+			onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+				q := req.Question[0]
+				require.Equal(pt, dns.TypePTR, q.Qtype)
+
+				resp = (&dns.Msg{}).SetReply(req)
+				if q.Name == name {
+					resp.Answer = []dns.RR{newRR(t, name, dns.TypePTR, 3600, host)}
+				} else {
+					resp.Rcode = dns.RcodeNameError
+				}
+
+				return resp, nil
+			},
+			onAddress: func() (addr string) { return "fake.address" },
+			onClose:   func() (err error) { return nil },
+		}
+	}
+
+	p := mustNew(t, &Config{
+		Logger:        testLogger,
+		UDPListenAddr: []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{newUps(globalTarget, globalHost)},
+		},
+		PrivateRDNSUpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{newUps(privateTarget, privateHost)},
+		},
+		TrustedProxies:        defaultTrustedProxies,
+		PrivateSubnets:        netutil.SubnetSetFunc(netutil.IsLocallyServed),
+		UsePrivateRDNS:        true,
+		UseDNS64:              true,
+		DNS64Prefs:            []netip.Prefix{netip.MustParsePrefix("2001:67c:27e4:1064::/64")},
+		DNS64ReverseSynthesis: true,
+	})
+
+	// newPTRName returns the ip6.arpa name of addr.
+	newPTRName := func(t *testing.T, addr string) (name string) {
+		t.Helper()
+
+		name, err := netutil.IPToReversedAddr(net.ParseIP(addr))
+		require.NoError(t, err)
+
+		return dns.Fqdn(name)
+	}
+
+	globalName := newPTRName(t, "2001:67c:27e4:1064:1:203:400::")
+	wellKnownName := newPTRName(t, "64:ff9b::1.2.3.4")
+	privateName := newPTRName(t, "2001:67c:27e4:1064:c0:a801:100::")
+
+	newCNAME := func(name, target string) (rr dns.RR) {
+		return &dns.CNAME{
+			Hdr: dns.RR_Header{
+				Name:   name,
+				Rrtype: dns.TypeCNAME,
+				Class:  dns.ClassINET,
+				Ttl:    maxDNS64SynTTL,
+			},
+			Target: target,
+		}
+	}
+
+	testCases := []struct {
+		name      string
+		qname     string
+		cliAddr   netip.AddrPort
+		wantAns   []dns.RR
+		wantRcode int
+	}{{
+		name:    "global",
+		qname:   globalName,
+		cliAddr: netip.MustParseAddrPort("1.2.3.4:1234"),
+		wantAns: []dns.RR{
+			newCNAME(globalName, globalTarget),
+			newRR(t, globalTarget, dns.TypePTR, 3600, globalHost),
+		},
+		wantRcode: dns.RcodeSuccess,
+	}, {
+		name:    "well_known",
+		qname:   wellKnownName,
+		cliAddr: netip.MustParseAddrPort("1.2.3.4:1234"),
+		wantAns: []dns.RR{
+			newCNAME(wellKnownName, globalTarget),
+			newRR(t, globalTarget, dns.TypePTR, 3600, globalHost),
+		},
+		wantRcode: dns.RcodeSuccess,
+	}, {
+		name:    "private",
+		qname:   privateName,
+		cliAddr: netip.MustParseAddrPort("192.168.1.2:1234"),
+		wantAns: []dns.RR{
+			newCNAME(privateName, privateTarget),
+			newRR(t, privateTarget, dns.TypePTR, 3600, privateHost),
+		},
+		wantRcode: dns.RcodeSuccess,
+	}, {
+		name:      "private_forbidden",
+		qname:     privateName,
+		cliAddr:   netip.MustParseAddrPort("1.2.3.4:1234"),
+		wantAns:   nil,
+		wantRcode: dns.RcodeNameError,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			d := &DNSContext{
+				Req:  (&dns.Msg{}).SetQuestion(tc.qname, dns.TypePTR),
+				Addr: tc.cliAddr,
+			}
+
+			require.NoError(t, p.handleDNSRequest(d))
+			require.NotNil(t, d.Res)
+
+			assert.Equal(t, tc.wantRcode, d.Res.Rcode)
+			assert.Equal(t, tc.wantAns, d.Res.Answer)
+		})
+	}
+}
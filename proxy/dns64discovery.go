@@ -0,0 +1,168 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"slices"
+	"time"
+
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/miekg/dns"
+)
+
+// nat64DiscoveryName is the name resolved to discover the NAT64 prefixes, see
+// RFC 7050, Section 3.
+const nat64DiscoveryName = "ipv4only.arpa."
+
+const (
+	// defaultNAT64MinInterval is the default minimum interval between the
+	// attempts to discover the NAT64 prefixes, which is also the interval of
+	// retrying a failed discovery.
+	defaultNAT64MinInterval = 1 * time.Minute
+
+	// nat64MaxInterval is the maximum interval between the attempts to
+	// discover the NAT64 prefixes, regardless of the TTL of the response.
+	nat64MaxInterval = 24 * time.Hour
+)
+
+// nat64WellKnownAddrs are the IPv4 addresses ipv4only.arpa resolves to, which
+// are looked for within the synthesized AAAA records, see RFC 7050, Section
+// 2.2.
+var nat64WellKnownAddrs = []netip.Addr{
+	netip.AddrFrom4([4]byte{192, 0, 0, 170}),
+	netip.AddrFrom4([4]byte{192, 0, 0, 171}),
+}
+
+// nat64PrefixLengths are the lengths of the NAT64 prefixes defined by RFC 6052,
+// Section 2.2, in the order of checking them.
+var nat64PrefixLengths = []int{96, 64, 56, 48, 40, 32}
+
+// startNAT64Discovery starts discovering the NAT64 prefixes in a separate
+// goroutine.  p must be locked.
+func (p *Proxy) startNAT64Discovery() {
+	ctx, cancel := context.WithCancel(context.Background())
+	p.cancelNAT64Discovery = cancel
+
+	go p.discoverNAT64Loop(ctx)
+}
+
+// stopNAT64Discovery stops the discovery of the NAT64 prefixes, if it's
+// running.  p must be locked.
+func (p *Proxy) stopNAT64Discovery() {
+	if p.cancelNAT64Discovery != nil {
+		p.cancelNAT64Discovery()
+		p.cancelNAT64Discovery = nil
+	}
+}
+
+// discoverNAT64Loop discovers the NAT64 prefixes until ctx is canceled,
+// repeating the discovery once the TTL of the previous response expires.  It's
+// intended to be used as a goroutine.
+func (p *Proxy) discoverNAT64Loop(ctx context.Context) {
+	defer slogutil.RecoverAndLog(ctx, p.logger)
+
+	for {
+		interval := p.nat64MinInterval
+
+		prefs, ttl, err := p.discoverNAT64(ctx)
+		if err != nil {
+			p.logger.WarnContext(ctx, "discovering nat64 prefixes", slogutil.KeyError, err)
+		} else {
+			p.setNAT64Prefixes(ctx, prefs)
+			interval = min(max(time.Duration(ttl)*time.Second, interval), nat64MaxInterval)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+			// Go on.
+		}
+	}
+}
+
+// setNAT64Prefixes replaces the NAT64 prefixes with prefs, if they differ.
+func (p *Proxy) setNAT64Prefixes(ctx context.Context, prefs netutil.SliceSubnetSet) {
+	if slices.Equal(prefs, p.nat64Prefixes()) {
+		return
+	}
+
+	p.dns64Prefs.Store(&prefs)
+	p.logger.InfoContext(ctx, "discovered nat64 prefixes", "prefixes", prefs)
+}
+
+// discoverNAT64 resolves the AAAA records of [nat64DiscoveryName] with the
+// general upstreams and returns the NAT64 prefixes found within them, as well
+// as the minimum TTL of the records.  It returns [errCacheOnly] in the
+// cache-only mode.
+func (p *Proxy) discoverNAT64(
+	ctx context.Context,
+) (prefs netutil.SliceSubnetSet, ttl uint32, err error) {
+	if p.cacheOnly.Load() {
+		return nil, 0, errCacheOnly
+	}
+
+	req := (&dns.Msg{}).SetQuestion(nat64DiscoveryName, dns.TypeAAAA)
+
+	p.reconfigureLock.RLock()
+	ups := p.UpstreamConfig.Upstreams
+	p.reconfigureLock.RUnlock()
+
+	resp, _, err := p.exchangeUpstreams(ctx, req, ups)
+	if err != nil {
+		return nil, 0, fmt.Errorf("resolving %s: %w", nat64DiscoveryName, err)
+	}
+
+	ttl = uint32(nat64MaxInterval / time.Second)
+	for _, rr := range resp.Answer {
+		aaaa, ok := rr.(*dns.AAAA)
+		if !ok {
+			continue
+		}
+
+		addr, addrErr := netutil.IPToAddr(aaaa.AAAA, netutil.AddrFamilyIPv6)
+		if addrErr != nil {
+			p.logger.Debug("bad aaaa record", slogutil.KeyError, addrErr)
+
+			continue
+		}
+
+		pref, found := nat64PrefixOf(addr)
+		if !found {
+			continue
+		}
+
+		ttl = min(ttl, aaaa.Hdr.Ttl)
+		if !slices.Contains(prefs, pref) {
+			prefs = append(prefs, pref)
+		}
+	}
+
+	if len(prefs) == 0 {
+		return nil, 0, fmt.Errorf("no nat64 prefixes in response to %s", nat64DiscoveryName)
+	}
+
+	return prefs, ttl, nil
+}
+
+// nat64PrefixOf returns the NAT64 prefix of addr, if it has one of
+// [nat64WellKnownAddrs] embedded.
+func nat64PrefixOf(addr netip.Addr) (pref netip.Prefix, ok bool) {
+	for _, bits := range nat64PrefixLengths {
+		if !slices.Contains(nat64WellKnownAddrs, nat64Extract(addr, bits)) {
+			continue
+		}
+
+		pref, err := addr.Prefix(bits)
+		if err != nil {
+			// Should never happen, since addr is an IPv6 address.
+			panic(fmt.Errorf("getting prefix of %s: %w", addr, err))
+		}
+
+		return pref, true
+	}
+
+	return netip.Prefix{}, false
+}
@@ -0,0 +1,141 @@
+package proxy
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/miekg/dns"
+)
+
+// dns64PTRTarget returns the in-addr.arpa name of the IPv4 address embedded
+// into the IPv6 address, the PTR of which req requests, if the reverse DNS64
+// synthesis is enabled and the address is within either one of the NAT64
+// prefixes or the Well-Known one.
+func (p *Proxy) dns64PTRTarget(req *dns.Msg) (target string, ok bool) {
+	if !p.DNS64ReverseSynthesis {
+		return "", false
+	}
+
+	prefs := p.nat64Prefixes()
+	if len(prefs) == 0 {
+		return "", false
+	}
+
+	q := req.Question[0]
+	if q.Qtype != dns.TypePTR || q.Qclass != dns.ClassINET {
+		return "", false
+	}
+
+	ip, err := netutil.IPFromReversedAddr(q.Name)
+	if err != nil || !ip.Is6() {
+		return "", false
+	}
+
+	var pref netip.Prefix
+	i := slices.IndexFunc(prefs, func(p netip.Prefix) (ok bool) { return p.Contains(ip) })
+	switch {
+	case i >= 0:
+		pref = prefs[i]
+	case dns64WellKnownPref.Contains(ip):
+		pref = dns64WellKnownPref
+	default:
+		return "", false
+	}
+
+	v4 := nat64Extract(ip, pref.Bits()).As4()
+	target, err = netutil.IPToReversedAddr(v4[:])
+	if err != nil {
+		// Should never happen, since v4 is a valid IPv4 address.
+		panic(fmt.Errorf("reversing %v: %w", v4, err))
+	}
+
+	return dns.Fqdn(target), true
+}
+
+// replyDNS64PTR resolves the PTR request of d by requesting the PTR of target,
+// which is the in-addr.arpa name of the embedded IPv4 address, and synthesizes
+// the response with a CNAME record mapping the requested name to target, as
+// RFC 6147, Section 5.3.1 describes.  The request for target is routed the same
+// way as if it were received from the client.
+func (p *Proxy) replyDNS64PTR(d *DNSContext, target string) (ok bool, err error) {
+	req := d.Req
+
+	targetReq := req.Copy()
+	targetReq.Question[0].Name = target
+
+	targetCtx := &DNSContext{
+		Req:                  targetReq,
+		CustomUpstreamConfig: d.CustomUpstreamConfig,
+		profile:              d.profile,
+		clientRoute:          d.clientRoute,
+		IsPrivateClient:      d.IsPrivateClient,
+	}
+
+	if targetCtx.isForbiddenARPA(p.privateNets, p.logger) {
+		p.logger.Debug("private arpa domain is requested via dns64", "qname", target)
+		d.Res = p.messages.NewMsgNXDOMAIN(req)
+
+		return false, nil
+	}
+
+	// Don't cache the responses for private addresses, see [Proxy.Resolve].
+	d.RequestedPrivateRDNS = targetCtx.RequestedPrivateRDNS
+
+	upstreams, isPrivate := p.selectUpstreams(targetCtx)
+	if len(upstreams) == 0 {
+		d.Res = p.messages.NewMsgNXDOMAIN(req)
+
+		return false, fmt.Errorf("selecting upstream: %w", upstream.ErrNoUpstreams)
+	}
+
+	if isPrivate {
+		p.recDetector.add(targetReq)
+	}
+
+	start := p.time.Now()
+	resp, u, err := p.exchangeUpstreams(d.Context(), targetReq, upstreams)
+	if err != nil {
+		p.logger.Debug("resolving dns64 ptr", "target", target, slogutil.KeyError, err)
+	}
+
+	if resp != nil {
+		d.QueryDuration = p.time.Now().Sub(start)
+		synthDNS64PTR(req, resp, target)
+		p.logger.Debug("synthesized dns64 ptr response", "target", target, "rtt", d.QueryDuration)
+	}
+
+	p.handleExchangeResult(d, req, resp, u)
+
+	return resp != nil, err
+}
+
+// synthDNS64PTR modifies resp, which is the response for the PTR of target, to
+// become the response for req, with a CNAME record mapping the name from req
+// to target prepended to the answer section.  The TTL of the CNAME record is
+// the minimum of the TTLs of the answers and [maxDNS64SynTTL].
+func synthDNS64PTR(req, resp *dns.Msg, target string) {
+	q := req.Question[0]
+
+	ttl := maxDNS64SynTTL
+	for _, rr := range resp.Answer {
+		ttl = min(ttl, rr.Header().Ttl)
+	}
+
+	cname := &dns.CNAME{
+		Hdr: dns.RR_Header{
+			Name:   q.Name,
+			Rrtype: dns.TypeCNAME,
+			Class:  q.Qclass,
+			Ttl:    ttl,
+		},
+		Target: target,
+	}
+
+	resp.Id = req.Id
+	resp.Question = []dns.Question{q}
+	resp.Answer = append([]dns.RR{cname}, resp.Answer...)
+}
@@ -1,21 +1,29 @@
 package proxy
 
 import (
+	"context"
 	"net"
 	"net/http"
 	"net/netip"
 	"time"
 
 	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/syncutil"
 	"github.com/ameshkov/dnscrypt/v2"
 	"github.com/miekg/dns"
 	"github.com/quic-go/quic-go"
 )
 
-// DNSContext represents a DNS request message context
+// DNSContext represents a DNS request message context.  If
+// [Config.EnableDNSContextPooling] is set, the contexts of the requests
+// received by the listeners are reused, so those must not be retained by the
+// handlers and the listeners after they return.
 type DNSContext struct {
 	// Conn is the underlying client connection.  It is nil if Proto is
-	// ProtoDNSCrypt, ProtoHTTPS, or ProtoQUIC.
+	// ProtoDNSCrypt, ProtoHTTPS, or ProtoQUIC.  For ProtoTLS it's a
+	// *tls.Conn.  The responses to the queries pipelined over a TCP or TLS
+	// connection are written by the proxy concurrently, so it must not be
+	// written to directly.
 	Conn net.Conn
 
 	// QUICConnection is the QUIC session from which we got the query.  For
@@ -47,6 +55,14 @@ type DNSContext struct {
 	// servers if it's not nil.
 	CustomUpstreamConfig *CustomUpstreamConfig
 
+	// ctx is the context of the request processing, see [DNSContext.Context].
+	// It's nil if the request has been created without one.
+	ctx context.Context
+
+	// values are the annotations of the request set by the middlewares, see
+	// [DNSContext.SetValue].  It's nil until the first value is set.
+	values map[any]any
+
 	// Req is the request message.
 	Req *dns.Msg
 	// Res is the response message.
@@ -54,6 +70,25 @@ type DNSContext struct {
 
 	Proto Proto
 
+	// ServerName is the TLS server name the client has indicated.  It's set
+	// for [ProtoTLS], [ProtoHTTPS], and [ProtoQUIC] only, and may be empty
+	// even then.
+	ServerName string
+
+	// HTTPPath is the path of the URL of the DNS-over-HTTPS request, for
+	// example "/dns-query/device1".  It's set for [ProtoHTTPS] only.
+	HTTPPath string
+
+	// HTTPUser is the user name of the basic authentication credentials of the
+	// DNS-over-HTTPS request, which the clients send for the userinfo of the
+	// URL.  The password isn't kept.  It's set for [ProtoHTTPS] only, and may
+	// be empty even then.
+	HTTPUser string
+
+	// Geo is the geographical data about the client address.  It's nil if
+	// [Config.GeoLocator] isn't set or knows nothing about the address.
+	Geo *GeoInfo
+
 	// CachedUpstreamAddr is the address of the upstream which the answer was
 	// cached with.  It's empty for responses resolved by the upstream server.
 	CachedUpstreamAddr string
@@ -66,9 +101,43 @@ type DNSContext struct {
 	// localIP - local IP address (for UDP socket to call udpMakeOOBWithSrc)
 	localIP netip.Addr
 
-	// Addr is the address of the client.
+	// udpWriter writes the response to the UDP client in a batch with the
+	// other ones.  It's nil if the batch I/O isn't used.
+	udpWriter *udpBatchWriter
+
+	// tcpWriter writes the response to the TCP or TLS client of Conn along
+	// with the responses to the other queries pipelined over the same
+	// connection.  It's nil if Proto is neither ProtoTCP nor ProtoTLS.
+	tcpWriter *tcpConnWriter
+
+	// profile is the profile of the listener the request has been received
+	// by.  It's nil if the general settings are used.
+	profile *profile
+
+	// clientRoute is the client route of the request.  It's nil if the client
+	// isn't within any of [Config.ClientRoutes].
+	clientRoute *clientRoute
+
+	// tsig is the state of the TSIG signature of the request.  It's nil if the
+	// request isn't signed or [Config.TSIGKeys] aren't set.
+	tsig *tsigState
+
+	// Addr is the address of the client.  For [ProtoQUIC], it's the address
+	// the request has been received from, which changes when the client
+	// migrates the connection.
 	Addr netip.AddrPort
 
+	// OrigDst is the original destination of the query intercepted with
+	// TPROXY, i.e. the server the client has addressed it to.  It's only set
+	// for the plain DNS queries if [Config.TransparentProxy] is true, and is
+	// invalid otherwise.
+	OrigDst netip.AddrPort
+
+	// resECS is the EDNS Client Subnet of the response with the scope prefix
+	// length.  It's saved before the OPT RR is filtered out of the response,
+	// and is invalid if the response has no EDNS Client Subnet option.
+	resECS netip.Prefix
+
 	// QueryDuration is the duration of a successful query to an upstream
 	// server or, if the upstream server is unavailable, to a fallback server.
 	QueryDuration time.Duration
@@ -83,10 +152,19 @@ type DNSContext struct {
 	// instance.
 	RequestID uint64
 
+	// TraceID is the hexadecimal identifier of this request, which is either
+	// received from the client or generated, see [Config.TraceID].  It's empty
+	// if [Config.TraceID] is not set.
+	TraceID string
+
 	// udpSize is the UDP buffer size from request's EDNS0 RR if presented,
 	// or default otherwise.
 	udpSize uint16
 
+	// maxUDPSize is the maximum size of the response over UDP, regardless of
+	// udpSize.  Zero means no limit.
+	maxUDPSize uint16
+
 	// IsPrivateClient is true if the client's address is considered private
 	// according to the configured private subnet set.
 	IsPrivateClient bool
@@ -99,6 +177,9 @@ type DNSContext struct {
 
 	// doBit is the DNSSEC OK flag from request's EDNS0 RR if presented.
 	doBit bool
+
+	// cacheHit is true if the response has been served from the cache.
+	cacheHit bool
 }
 
 // newDNSContext returns a new properly initialized *DNSContext.
@@ -108,12 +189,97 @@ type DNSContext struct {
 //
 // TODO(e.burkov):  Add remote address into arguments.
 func (p *Proxy) newDNSContext(proto Proto, req *dns.Msg) (d *DNSContext) {
-	return &DNSContext{
-		Proto: proto,
-		Req:   req,
+	if p.dctxPool == nil {
+		d = &DNSContext{}
+	} else {
+		d = p.dctxPool.Get()
+	}
+
+	d.Proto = proto
+	d.Req = req
+	d.RequestID = p.counter.Add(1)
 
-		RequestID: p.counter.Add(1),
+	return d
+}
+
+// newDNSContextPool returns a new pool of the request contexts or nil if
+// enabled is false.
+func newDNSContextPool(enabled bool) (pool *syncutil.Pool[DNSContext]) {
+	if !enabled {
+		return nil
 	}
+
+	return syncutil.NewPool(func() (d *DNSContext) { return &DNSContext{} })
+}
+
+// releaseDNSContext returns d created with [Proxy.newDNSContext] to the pool,
+// if the pooling is enabled.  d must not be used after that.  All its fields
+// are reset, so that the pool doesn't keep the messages, the connections, and
+// the values of the handled request alive, but the map of the values is kept
+// for reuse.
+func (p *Proxy) releaseDNSContext(d *DNSContext) {
+	if p.dctxPool == nil {
+		return
+	}
+
+	values := d.values
+	clear(values)
+
+	*d = DNSContext{
+		values: values,
+	}
+
+	p.dctxPool.Put(d)
+}
+
+// Context returns the context of the request processing.  It's canceled when
+// the request should be abandoned, for example when the DNS-over-HTTPS client
+// has gone, the DNS-over-QUIC connection has been closed, or the requests
+// still being handled on shutdown are aborted, and carries the trace of the
+// request.  The exchanges with the upstreams are aborted once it's canceled.
+// It's never nil.
+func (dctx *DNSContext) Context() (ctx context.Context) {
+	if dctx.ctx == nil {
+		return context.Background()
+	}
+
+	return dctx.ctx
+}
+
+// respConn returns the connection the response to dctx should be written to.
+// It's nil if Conn is nil.
+func (dctx *DNSContext) respConn() (conn net.Conn) {
+	if dctx.tcpWriter != nil {
+		return dctx.tcpWriter
+	}
+
+	return dctx.Conn
+}
+
+// SetValue annotates the request with val for key, so that the middlewares and
+// the handlers called later can retrieve it with [DNSContext.Value].  key must
+// be comparable and should be of an unexported type to avoid collisions, just
+// like the ones of [context.WithValue].  It's not safe for concurrent use.
+func (dctx *DNSContext) SetValue(key, val any) {
+	if dctx.values == nil {
+		dctx.values = map[any]any{}
+	}
+
+	dctx.values[key] = val
+}
+
+// Value returns the annotation of the request for key set with
+// [DNSContext.SetValue] or nil if there is none.
+func (dctx *DNSContext) Value(key any) (val any) {
+	return dctx.values[key]
+}
+
+// DNSContextValue returns the annotation of dctx for key set with
+// [DNSContext.SetValue].  ok is false if there is none or it isn't of type T.
+func DNSContextValue[T any](dctx *DNSContext, key any) (val T, ok bool) {
+	val, ok = dctx.values[key].(T)
+
+	return val, ok
 }
 
 // calcFlagsAndSize lazily calculates some values required for Resolve method.
@@ -129,6 +295,11 @@ func (dctx *DNSContext) calcFlagsAndSize() {
 		dctx.doBit = o.Do()
 		dctx.udpSize = o.UDPSize()
 	}
+
+	if dctx.Proto == ProtoUDP && dctx.maxUDPSize != 0 {
+		// Advertise the limit.
+		dctx.udpSize = min(dctx.udpSize, dctx.maxUDPSize)
+	}
 }
 
 // scrub prepares the d.Res to be written.  Truncation is applied as well if
@@ -149,11 +320,22 @@ func (dctx *DNSContext) scrub() {
 		dctx.Res.SetEdns0(dctx.udpSize, dctx.doBit)
 	}
 
-	dctx.Res.Truncate(int(dnsSize(dctx.Proto == ProtoUDP, dctx.Req)))
-	// Some devices require DNS message compression.
+	dctx.Res.Truncate(int(dctx.responseSize()))
+	// Some devices require DNS message compression, see
+	// [Config.ResponseCompression].
 	dctx.Res.Compress = true
 }
 
+// responseSize returns the maximum size of the response to the request of dctx.
+func (dctx *DNSContext) responseSize() (size uint16) {
+	size = dnsSize(dctx.Proto == ProtoUDP, dctx.Req)
+	if dctx.Proto == ProtoUDP && dctx.maxUDPSize != 0 {
+		size = max(min(size, dctx.maxUDPSize), dns.MinMsgSize)
+	}
+
+	return size
+}
+
 // dnsSize returns the buffer size advertised in the requests OPT record.  When
 // the request is over TCP, it returns the maximum allowed size of 64KiB.
 func dnsSize(isUDP bool, r *dns.Msg) (size uint16) {
@@ -195,7 +377,8 @@ type CustomUpstreamConfig struct {
 	cache *cache
 }
 
-// NewCustomUpstreamConfig returns new custom upstream configuration.
+// NewCustomUpstreamConfig returns new custom upstream configuration.  The cache
+// of the configuration, if enabled, uses the real time, see [Config.Clock].
 func NewCustomUpstreamConfig(
 	u *UpstreamConfig,
 	cacheEnabled bool,
@@ -205,7 +388,8 @@ func NewCustomUpstreamConfig(
 	var customCache *cache
 	if cacheEnabled {
 		// TODO(d.kolyshev): Support optimistic with newOptimisticResolver.
-		customCache = newCache(cacheSize, enableEDNSClientSubnet, false)
+		l := SubsystemLogger(nil, nil, LogSubsystemCache)
+		customCache = newCache(cacheSize, enableEDNSClientSubnet, false, realClock{}, l)
 	}
 
 	return &CustomUpstreamConfig{
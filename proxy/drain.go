@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// drainer tracks the listener loops and the handlers of the client queries and
+// connections started by them, so that [Proxy.Shutdown] can stop accepting new
+// queries and wait for the current ones to finish.
+type drainer struct {
+	// ctx is canceled when the shutdown starts.
+	ctx context.Context
+
+	// cancel cancels ctx.
+	cancel context.CancelFunc
+
+	// reqCtx is the parent of the contexts of the requests.  It's canceled
+	// once the waiting for the requests on shutdown is over, so that the ones
+	// still being handled are aborted.
+	reqCtx context.Context
+
+	// abort cancels reqCtx.
+	abort context.CancelFunc
+
+	// wg counts the running listener loops and handlers.
+	wg *sync.WaitGroup
+}
+
+// newDrainer returns a new properly initialized *drainer.
+func newDrainer() (d *drainer) {
+	ctx, cancel := context.WithCancel(context.Background())
+	reqCtx, abort := context.WithCancel(context.Background())
+
+	return &drainer{
+		ctx:    ctx,
+		cancel: cancel,
+		reqCtx: reqCtx,
+		abort:  abort,
+		wg:     &sync.WaitGroup{},
+	}
+}
+
+// draining returns true if the shutdown has started.
+func (d *drainer) draining() (ok bool) {
+	return d.ctx.Err() != nil
+}
+
+// goTracked runs f in a new goroutine counted by d.  To avoid racing with the
+// waiting, it must only be called before the shutdown starts or from within a
+// goroutine which is itself counted.
+func (d *drainer) goTracked(f func()) {
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+
+		f()
+	}()
+}
+
+// wait waits for all the counted goroutines to finish or for ctx to be done,
+// whichever happens first.  It returns the error of ctx in the latter case.
+// The requests still being handled are aborted then.
+func (d *drainer) wait(ctx context.Context) (err error) {
+	defer d.abort()
+
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("waiting for requests: %w", ctx.Err())
+	}
+}
+
+// withAbort returns the context of the requests received within parent, which
+// is also canceled when the requests are aborted on shutdown.  parent must be
+// canceled eventually, for example once the connection is closed.
+func (d *drainer) withAbort(parent context.Context) (ctx context.Context) {
+	ctx, cancel := context.WithCancel(parent)
+	stop := context.AfterFunc(d.reqCtx, cancel)
+
+	// Don't keep ctx registered in reqCtx after it's done.
+	context.AfterFunc(ctx, func() { stop() })
+
+	return ctx
+}
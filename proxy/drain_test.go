@@ -0,0 +1,160 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// slowTestHost is the host the upstream returned by newDrainTestUpstream
+// doesn't answer until it's released.
+const slowTestHost = "slow.example"
+
+// newDrainTestUpstream returns the upstream which reports the exchanges for
+// [slowTestHost] to started and blocks them until release is closed.
+func newDrainTestUpstream(started chan<- struct{}, release <-chan struct{}) (u *fakeUpstream) {
+	return &fakeUpstream{
+		onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			if req.Question[0].Name == dns.Fqdn(slowTestHost) {
+				started <- struct{}{}
+				<-release
+			}
+
+			return newCompareTestReply(req, "192.0.2.1", defaultTestTTL), nil
+		},
+		onAddress: func() (addr string) { return "192.0.2.1" },
+		onClose:   func() (err error) { return nil },
+	}
+}
+
+func TestProxy_Shutdown_drain(t *testing.T) {
+	serverConfig, _ := newTLSConfig(t)
+	listenAddr := net.UDPAddrFromAddrPort(localhostAnyPort)
+
+	started := make(chan struct{}, 3)
+	release := make(chan struct{})
+
+	p := mustNew(t, &Config{
+		Logger:         testLogger,
+		UDPListenAddr:  []*net.UDPAddr{listenAddr},
+		TCPListenAddr:  []*net.TCPAddr{net.TCPAddrFromAddrPort(localhostAnyPort)},
+		QUICListenAddr: []*net.UDPAddr{listenAddr},
+		TLSConfig:      serverConfig,
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{newDrainTestUpstream(started, release)},
+		},
+		TrustedProxies: defaultTrustedProxies,
+	})
+
+	ctx := context.Background()
+	require.NoError(t, p.Start(ctx))
+
+	quicUps, err := upstream.AddressToUpstream("quic://"+p.Addr(ProtoQUIC).String(), &upstream.Options{
+		Logger:             testLogger,
+		Timeout:            defaultTimeout,
+		InsecureSkipVerify: true,
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, quicUps.Close)
+
+	// Make sure the idle connection is accepted before shutting down.
+	idle, err := dns.Dial(string(ProtoTCP), p.Addr(ProtoTCP).String())
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, idle.Close)
+
+	require.NoError(t, idle.WriteMsg(newHostTestMessage("fast.example")))
+	_, err = idle.ReadMsg()
+	require.NoError(t, err)
+
+	exchanges := []func() (err error){
+		func() (err error) {
+			client := &dns.Client{Net: string(ProtoUDP), Timeout: defaultTimeout}
+			_, _, err = client.Exchange(newHostTestMessage(slowTestHost), p.Addr(ProtoUDP).String())
+
+			return err
+		},
+		func() (err error) {
+			client := &dns.Client{Net: string(ProtoTCP), Timeout: defaultTimeout}
+			_, _, err = client.Exchange(newHostTestMessage(slowTestHost), p.Addr(ProtoTCP).String())
+
+			return err
+		},
+		func() (err error) {
+			_, err = quicUps.Exchange(newHostTestMessage(slowTestHost))
+
+			return err
+		},
+	}
+
+	errCh := make(chan error, len(exchanges))
+	for _, exchange := range exchanges {
+		go func() { errCh <- exchange() }()
+	}
+
+	for range exchanges {
+		testutil.RequireReceive(t, started, defaultTimeout)
+	}
+
+	shutdownErr := make(chan error, 1)
+	go func() { shutdownErr <- p.Shutdown(ctx) }()
+
+	// The idle connection is closed without waiting for the queries.
+	require.NoError(t, idle.SetReadDeadline(time.Now().Add(defaultTimeout)))
+	_, err = idle.ReadMsg()
+	assert.ErrorIs(t, err, io.EOF)
+
+	select {
+	case err = <-shutdownErr:
+		t.Fatalf("shutdown returned before answering the queries: %v", err)
+	default:
+		// Go on.
+	}
+
+	close(release)
+
+	for range exchanges {
+		err, _ = testutil.RequireReceive(t, errCh, defaultTimeout)
+		assert.NoError(t, err)
+	}
+
+	err, _ = testutil.RequireReceive(t, shutdownErr, defaultTimeout)
+	assert.NoError(t, err)
+}
+
+func TestProxy_Shutdown_timeout(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	t.Cleanup(func() { close(release) })
+
+	p := mustNew(t, &Config{
+		Logger:        testLogger,
+		UDPListenAddr: []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{newDrainTestUpstream(started, release)},
+		},
+		TrustedProxies: defaultTrustedProxies,
+	})
+	require.NoError(t, p.Start(context.Background()))
+
+	go func() {
+		client := &dns.Client{Net: string(ProtoUDP), Timeout: defaultTimeout}
+		_, _, _ = client.Exchange(newHostTestMessage(slowTestHost), p.Addr(ProtoUDP).String())
+	}()
+
+	testutil.RequireReceive(t, started, defaultTimeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	err := p.Shutdown(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.False(t, p.IsStarted())
+}
@@ -0,0 +1,334 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/miekg/dns"
+)
+
+// Constants of the DNS error reporting, see RFC 9567.
+const (
+	// edns0ReportChannel is the code of the Report-Channel EDNS0 option
+	// carrying the domain of the reporting agent.
+	edns0ReportChannel = 18
+
+	// errorReportLabel is the label delimiting the parts of the report query
+	// name.
+	errorReportLabel = "_er"
+
+	// errorReportMaxInFlight is the maximum number of the report queries being
+	// exchanged at once.
+	errorReportMaxInFlight = 64
+
+	// errorReportMaxRecent is the maximum number of the recently sent reports
+	// remembered to avoid sending them again.
+	errorReportMaxRecent = 1024
+
+	// errorReportInterval is the minimum interval between the identical
+	// reports.
+	errorReportInterval = 1 * time.Hour
+
+	// errorReportTTL is the TTL of the responses to the received report
+	// queries, so that the reporting resolvers cache them and don't send the
+	// same reports again too soon.
+	errorReportTTL = uint32(errorReportInterval / time.Second)
+)
+
+// errorReporter contains the state of the DNS error reporting.
+type errorReporter struct {
+	// sema limits the number of the report queries in flight.
+	sema chan struct{}
+
+	// mu protects recent.
+	mu *sync.Mutex
+
+	// recent maps the names of the recently sent report queries to the time
+	// they've been sent at.
+	recent map[string]time.Time
+}
+
+// validateErrorReporting returns an error if the error reporting configuration
+// is invalid.
+func (p *Proxy) validateErrorReporting() (err error) {
+	if p.ErrorReportingAgent == "" {
+		return nil
+	}
+
+	if _, ok := dns.IsDomainName(p.ErrorReportingAgent); !ok {
+		return fmt.Errorf("agent domain: bad domain name %q", p.ErrorReportingAgent)
+	}
+
+	return nil
+}
+
+// initErrorReporting initializes the DNS error reporting.
+func (p *Proxy) initErrorReporting() {
+	p.errorReportingAgent = ""
+	if p.ErrorReportingAgent != "" {
+		p.errorReportingAgent = dns.Fqdn(strings.ToLower(p.ErrorReportingAgent))
+	}
+
+	if !p.ErrorReporting {
+		p.errorReporter = nil
+
+		return
+	}
+
+	p.errorReporter = &errorReporter{
+		sema:   make(chan struct{}, errorReportMaxInFlight),
+		mu:     &sync.Mutex{},
+		recent: map[string]time.Time{},
+	}
+}
+
+// reportErrors sends the error reports for the extended DNS errors in resp to
+// the reporting agent from its Report-Channel option, if the error reporting
+// is enabled.  resp may be nil.
+func (p *Proxy) reportErrors(req, resp *dns.Msg) {
+	if p.errorReporter == nil || resp == nil || len(req.Question) == 0 {
+		return
+	}
+
+	q := req.Question[0]
+	if isErrorReportName(q.Name) {
+		// Don't report the failures of the reports themselves.
+		return
+	}
+
+	opt := resp.IsEdns0()
+	if opt == nil {
+		return
+	}
+
+	agent, codes := reportChannel(opt)
+	if agent == "" {
+		return
+	}
+
+	for _, code := range codes {
+		name := errorReportName(q, code, agent)
+		if name != "" && p.errorReporter.shouldSend(name, p.time.Now()) {
+			p.sendErrorReport(name)
+		}
+	}
+}
+
+// reportChannel returns the domain of the reporting agent and the codes of the
+// extended DNS errors from opt.  agent is empty if opt has no valid
+// Report-Channel option.
+func reportChannel(opt *dns.OPT) (agent string, codes []uint16) {
+	for _, o := range opt.Option {
+		switch o := o.(type) {
+		case *dns.EDNS0_EDE:
+			codes = append(codes, o.InfoCode)
+		case *dns.EDNS0_LOCAL:
+			if o.Code != edns0ReportChannel {
+				continue
+			}
+
+			name, _, err := dns.UnpackDomainName(o.Data, 0)
+			if err == nil && name != "." {
+				agent = strings.ToLower(name)
+			}
+		default:
+			// Go on.
+		}
+	}
+
+	return agent, codes
+}
+
+// errorReportName returns the name of the report query for the failure of q
+// with the extended DNS error code to agent, see RFC 9567 Section 6.1.1.  name
+// is empty if the resulting name is too long.
+func errorReportName(q dns.Question, code uint16, agent string) (name string) {
+	qname := strings.TrimSuffix(strings.ToLower(q.Name), ".")
+
+	parts := []string{errorReportLabel, strconv.Itoa(int(q.Qtype))}
+	if qname != "" {
+		parts = append(parts, qname)
+	}
+
+	parts = append(parts, strconv.Itoa(int(code)), errorReportLabel, agent)
+
+	name = strings.Join(parts, ".")
+	if _, ok := dns.IsDomainName(name); !ok || len(name) > 254 {
+		return ""
+	}
+
+	return name
+}
+
+// isErrorReportName returns true if name looks like the name of a report
+// query.
+func isErrorReportName(name string) (ok bool) {
+	return strings.HasPrefix(strings.ToLower(name), errorReportLabel+".")
+}
+
+// shouldSend returns true if the report query with name hasn't been sent
+// recently, and remembers it as sent at now.
+func (r *errorReporter) shouldSend(name string, now time.Time) (ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if sent, has := r.recent[name]; has && now.Sub(sent) < errorReportInterval {
+		return false
+	}
+
+	if len(r.recent) >= errorReportMaxRecent {
+		for n, sent := range r.recent {
+			if now.Sub(sent) >= errorReportInterval {
+				delete(r.recent, n)
+			}
+		}
+
+		if len(r.recent) >= errorReportMaxRecent {
+			// Too many reports, drop this one.
+			return false
+		}
+	}
+
+	r.recent[name] = now
+
+	return true
+}
+
+// sendErrorReport resolves the report query with name with the general
+// upstreams in a separate goroutine.
+func (p *Proxy) sendErrorReport(name string) {
+	select {
+	case p.errorReporter.sema <- struct{}{}:
+	default:
+		p.upstreamLogger.Debug("too many error reports in flight, skipping")
+
+		return
+	}
+
+	req := &dns.Msg{}
+	req.SetQuestion(name, dns.TypeTXT)
+
+	ups := p.UpstreamConfig.getUpstreamsForDomain(name)
+
+	go func() {
+		defer func() { <-p.errorReporter.sema }()
+		defer slogutil.RecoverAndLog(context.TODO(), p.upstreamLogger)
+
+		_, _, err := upstream.ExchangeParallel(ups, req)
+		if err != nil {
+			p.upstreamLogger.Debug("sending error report", "name", name, slogutil.KeyError, err)
+
+			return
+		}
+
+		p.upstreamLogger.Debug("sent error report", "name", name)
+	}()
+}
+
+// receiveErrorReport returns the response to the report query sent to the
+// reporting agent of the proxy and logs the report.  resp is nil if d isn't a
+// report query for the agent.
+func (p *Proxy) receiveErrorReport(d *DNSContext) (resp *dns.Msg) {
+	agent := p.errorReportingAgent
+	if agent == "" {
+		return nil
+	}
+
+	q := d.Req.Question[0]
+	name := strings.ToLower(q.Name)
+
+	suffix := "." + errorReportLabel + "." + agent
+	rest, ok := strings.CutSuffix(name, suffix)
+	if !ok || q.Qtype != dns.TypeTXT {
+		return nil
+	}
+
+	rest, ok = strings.CutPrefix(rest, errorReportLabel+".")
+	if !ok {
+		return nil
+	}
+
+	qtypeStr, rest, _ := strings.Cut(rest, ".")
+	qnameStr, codeStr := "", rest
+	if i := strings.LastIndexByte(rest, '.'); i >= 0 {
+		qnameStr, codeStr = rest[:i], rest[i+1:]
+	}
+
+	qtype, qtypeErr := strconv.ParseUint(qtypeStr, 10, 16)
+	code, codeErr := strconv.ParseUint(codeStr, 10, 16)
+	if qtypeErr != nil || codeErr != nil {
+		p.logger.Debug("bad error report", "qname", q.Name)
+
+		return p.messages.NewMsgNXDOMAIN(d.Req)
+	}
+
+	p.logger.Info(
+		"error report received",
+		"addr", p.anonymizer.addrPort(d.Addr),
+		"qname", dns.Fqdn(qnameStr),
+		"qtype", dns.Type(qtype),
+		"ede", code,
+		"ede_text", dns.ExtendedErrorCodeToString[uint16(code)],
+	)
+
+	resp = (&dns.Msg{}).SetReply(d.Req)
+	resp.RecursionAvailable = true
+	resp.Answer = []dns.RR{&dns.TXT{
+		Hdr: dns.RR_Header{
+			Name:   q.Name,
+			Rrtype: dns.TypeTXT,
+			Class:  dns.ClassINET,
+			Ttl:    errorReportTTL,
+		},
+		Txt: []string{"Report received"},
+	}}
+
+	return resp
+}
+
+// addReportChannel adds the Report-Channel option with the reporting agent of
+// the proxy to d.Res, if d.Req has an OPT record.
+func (p *Proxy) addReportChannel(d *DNSContext) {
+	agent := p.errorReportingAgent
+	if agent == "" || d.Res == nil {
+		return
+	}
+
+	reqOpt := d.Req.IsEdns0()
+	if reqOpt == nil {
+		return
+	}
+
+	opt := d.Res.IsEdns0()
+	if opt == nil {
+		d.Res.SetEdns0(reqOpt.UDPSize(), reqOpt.Do())
+		opt = d.Res.IsEdns0()
+	}
+
+	for _, o := range opt.Option {
+		if o.Option() == edns0ReportChannel {
+			// Don't override the agent of the upstream.
+			return
+		}
+	}
+
+	data := make([]byte, len(agent)+1)
+	n, err := dns.PackDomainName(agent, data, 0, nil, false)
+	if err != nil {
+		// Shouldn't happen, since the agent domain is validated.
+		p.logger.Debug("packing report channel", slogutil.KeyError, err)
+
+		return
+	}
+
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{
+		Code: edns0ReportChannel,
+		Data: data[:n],
+	})
+}
@@ -0,0 +1,130 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testReportName is the name of the report query for the failed A request for
+// broken.example with the Signature Expired extended DNS error.
+const testReportName = "_er.1.broken.example.7._er.agent.example."
+
+func TestErrorReportName(t *testing.T) {
+	q := dns.Question{Name: "Broken.Example.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+
+	assert.Equal(t, testReportName, errorReportName(
+		q,
+		dns.ExtendedErrorCodeSignatureExpired,
+		"agent.example.",
+	))
+
+	q.Name = "."
+	assert.Equal(t, "_er.1.7._er.agent.example.", errorReportName(q, 7, "agent.example."))
+
+	q.Name = dns.Fqdn(string(make([]byte, 250)))
+	assert.Empty(t, errorReportName(q, 7, "agent.example."))
+}
+
+// startErrorReportTestProxy starts the proxy with the given configuration and
+// an upstream failing broken.example with a reportable error and sending the
+// report queries to reports.  It returns the address of the UDP listener.
+func startErrorReportTestProxy(t *testing.T, c *Config, reports chan<- string) (addr string) {
+	t.Helper()
+
+	agent := make([]byte, 32)
+	n, err := dns.PackDomainName("agent.example.", agent, 0, nil, false)
+	require.NoError(t, err)
+
+	ups := &fakeUpstream{
+		onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			q := req.Question[0]
+			if q.Qtype == dns.TypeTXT {
+				reports <- q.Name
+
+				return (&dns.Msg{}).SetReply(req), nil
+			}
+
+			resp = (&dns.Msg{}).SetRcode(req, dns.RcodeServerFailure)
+			resp.SetEdns0(dns.DefaultMsgSize, false)
+
+			opt := resp.IsEdns0()
+			opt.Option = append(
+				opt.Option,
+				&dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeSignatureExpired},
+				&dns.EDNS0_LOCAL{Code: edns0ReportChannel, Data: agent[:n]},
+			)
+
+			return resp, nil
+		},
+		onAddress: func() (addr string) { return "ups" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	c.Logger = testLogger
+	c.UDPListenAddr = []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)}
+	c.UpstreamConfig = &UpstreamConfig{Upstreams: []upstream.Upstream{ups}}
+	c.TrustedProxies = defaultTrustedProxies
+
+	p := mustNew(t, c)
+
+	ctx := context.Background()
+	require.NoError(t, p.Start(ctx))
+	testutil.CleanupAndRequireSuccess(t, func() (err error) { return p.Shutdown(ctx) })
+
+	return p.Addr(ProtoUDP).String()
+}
+
+func TestProxy_reportErrors(t *testing.T) {
+	reports := make(chan string, 2)
+	addr := startErrorReportTestProxy(t, &Config{ErrorReporting: true}, reports)
+
+	client := &dns.Client{Net: string(ProtoUDP), Timeout: defaultTimeout}
+	for range 2 {
+		resp, _, err := client.Exchange(newHostTestMessage("broken.example"), addr)
+		require.NoError(t, err)
+
+		assert.Equal(t, dns.RcodeServerFailure, resp.Rcode)
+	}
+
+	name, ok := testutil.RequireReceive(t, reports, defaultTimeout)
+	require.True(t, ok)
+
+	assert.Equal(t, testReportName, name)
+
+	// The same report isn't sent again.
+	assert.Empty(t, reports)
+}
+
+func TestProxy_receiveErrorReport(t *testing.T) {
+	reports := make(chan string, 1)
+	addr := startErrorReportTestProxy(t, &Config{ErrorReportingAgent: "Agent.Example"}, reports)
+
+	client := &dns.Client{Net: string(ProtoUDP), Timeout: defaultTimeout}
+
+	req := (&dns.Msg{}).SetQuestion(testReportName, dns.TypeTXT)
+	req.SetEdns0(dns.DefaultMsgSize, false)
+
+	resp, _, err := client.Exchange(req, addr)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	require.Len(t, resp.Answer, 1)
+
+	txt := testutil.RequireTypeAssert[*dns.TXT](t, resp.Answer[0])
+	assert.Equal(t, []string{"Report received"}, txt.Txt)
+
+	// The received report isn't resolved with the upstreams.
+	assert.Empty(t, reports)
+
+	opt := resp.IsEdns0()
+	require.NotNil(t, opt)
+
+	agent, _ := reportChannel(opt)
+	assert.Equal(t, "agent.example.", agent)
+}
@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"slices"
+
+	"github.com/miekg/dns"
+)
+
+// EventListener is an object that receives the notable events of the proxy,
+// e.g. to drive the metrics, alerts, or UI of the embedding application.  All
+// methods must be safe for concurrent use, must not block, and must not modify
+// the messages.  The passed contexts must not be retained after the methods
+// return if [Config.EnableDNSContextPooling] is set.  See
+// [Proxy.AddEventListener].
+type EventListener interface {
+	// OnCacheHit is called when the response to d.Req has been found in the
+	// cache.  d.Res is never nil.  d must not be retained, see the interface
+	// documentation.
+	OnCacheHit(d *DNSContext)
+
+	// OnCacheMiss is called when the response to d.Req hasn't been found in the
+	// cache.  d must not be retained, see the interface documentation.
+	OnCacheMiss(d *DNSContext)
+
+	// OnUpstreamError is called when the exchange of req with the upstream
+	// with address addr has failed with err.  addr is empty if the failed
+	// upstream is unknown, e.g. when all the upstreams have failed in the
+	// parallel mode.
+	OnUpstreamError(addr string, req *dns.Msg, err error)
+
+	// OnRatelimited is called when the request from the client has been
+	// ratelimited.  d must not be retained, see the interface documentation.
+	OnRatelimited(d *DNSContext)
+
+	// OnConfigReload is called when [Proxy.Reconfigure] has finished.  err is
+	// the error it has returned, if any.
+	OnConfigReload(err error)
+}
+
+// EmptyEventListener is an [EventListener] that does nothing.
+type EmptyEventListener struct{}
+
+// type check
+var _ EventListener = EmptyEventListener{}
+
+// OnCacheHit implements the [EventListener] interface for EmptyEventListener.
+func (EmptyEventListener) OnCacheHit(_ *DNSContext) {}
+
+// OnCacheMiss implements the [EventListener] interface for EmptyEventListener.
+func (EmptyEventListener) OnCacheMiss(_ *DNSContext) {}
+
+// OnUpstreamError implements the [EventListener] interface for
+// EmptyEventListener.
+func (EmptyEventListener) OnUpstreamError(_ string, _ *dns.Msg, _ error) {}
+
+// OnRatelimited implements the [EventListener] interface for
+// EmptyEventListener.
+func (EmptyEventListener) OnRatelimited(_ *DNSContext) {}
+
+// OnConfigReload implements the [EventListener] interface for
+// EmptyEventListener.
+func (EmptyEventListener) OnConfigReload(_ error) {}
+
+// MultiEventListener is an [EventListener] that passes the events to each of
+// the listeners in order.
+type MultiEventListener []EventListener
+
+// type check
+var _ EventListener = MultiEventListener(nil)
+
+// OnCacheHit implements the [EventListener] interface for MultiEventListener.
+func (m MultiEventListener) OnCacheHit(d *DNSContext) {
+	for _, l := range m {
+		l.OnCacheHit(d)
+	}
+}
+
+// OnCacheMiss implements the [EventListener] interface for MultiEventListener.
+func (m MultiEventListener) OnCacheMiss(d *DNSContext) {
+	for _, l := range m {
+		l.OnCacheMiss(d)
+	}
+}
+
+// OnUpstreamError implements the [EventListener] interface for
+// MultiEventListener.
+func (m MultiEventListener) OnUpstreamError(addr string, req *dns.Msg, err error) {
+	for _, l := range m {
+		l.OnUpstreamError(addr, req, err)
+	}
+}
+
+// OnRatelimited implements the [EventListener] interface for
+// MultiEventListener.
+func (m MultiEventListener) OnRatelimited(d *DNSContext) {
+	for _, l := range m {
+		l.OnRatelimited(d)
+	}
+}
+
+// OnConfigReload implements the [EventListener] interface for
+// MultiEventListener.
+func (m MultiEventListener) OnConfigReload(err error) {
+	for _, l := range m {
+		l.OnConfigReload(err)
+	}
+}
+
+// AddEventListener registers l to receive the events of p.  It's safe for
+// concurrent use and may be called while p is running, in which case l starts
+// receiving the events shortly.  l must not be nil.
+func (p *Proxy) AddEventListener(l EventListener) {
+	for {
+		cur := p.events.Load()
+
+		var next MultiEventListener
+		if cur != nil {
+			next = slices.Clip(*cur)
+		}
+
+		next = append(next, l)
+		if p.events.CompareAndSwap(cur, &next) {
+			return
+		}
+	}
+}
+
+// eventListener returns the listener of the events of p.  It's never nil.
+func (p *Proxy) eventListener() (l EventListener) {
+	if m := p.events.Load(); m != nil {
+		return *m
+	}
+
+	return EmptyEventListener{}
+}
@@ -0,0 +1,157 @@
+package proxy
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingEventListener is an [EventListener] recording the names of the
+// events.
+type recordingEventListener struct {
+	// mu protects events.
+	mu *sync.Mutex
+
+	// events are the names of the received events in order.
+	events []string
+}
+
+// type check
+var _ EventListener = (*recordingEventListener)(nil)
+
+// record appends the event name to l.
+func (l *recordingEventListener) record(name string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.events = append(l.events, name)
+}
+
+// take returns the recorded events and resets them.
+func (l *recordingEventListener) take() (events []string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	events, l.events = l.events, nil
+
+	return events
+}
+
+// OnCacheHit implements the [EventListener] interface for
+// *recordingEventListener.
+func (l *recordingEventListener) OnCacheHit(_ *DNSContext) { l.record("cache_hit") }
+
+// OnCacheMiss implements the [EventListener] interface for
+// *recordingEventListener.
+func (l *recordingEventListener) OnCacheMiss(_ *DNSContext) { l.record("cache_miss") }
+
+// OnUpstreamError implements the [EventListener] interface for
+// *recordingEventListener.
+func (l *recordingEventListener) OnUpstreamError(addr string, _ *dns.Msg, _ error) {
+	l.record("upstream_error " + addr)
+}
+
+// OnRatelimited implements the [EventListener] interface for
+// *recordingEventListener.
+func (l *recordingEventListener) OnRatelimited(_ *DNSContext) { l.record("ratelimited") }
+
+// OnConfigReload implements the [EventListener] interface for
+// *recordingEventListener.
+func (l *recordingEventListener) OnConfigReload(err error) {
+	if err != nil {
+		l.record("config_reload_error")
+	} else {
+		l.record("config_reload")
+	}
+}
+
+func TestProxy_AddEventListener(t *testing.T) {
+	const errTest errors.Error = "test error"
+
+	failing := true
+	ups := &fakeUpstream{
+		onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			if failing {
+				return nil, errTest
+			}
+
+			resp = (&dns.Msg{}).SetReply(req)
+			resp.Answer = append(resp.Answer, &dns.A{
+				Hdr: dns.RR_Header{
+					Name:   req.Question[0].Name,
+					Rrtype: dns.TypeA,
+					Class:  dns.ClassINET,
+					Ttl:    60,
+				},
+				A: net.IP{192, 0, 2, 1},
+			})
+
+			return resp, nil
+		},
+		onAddress: func() (a string) { return "ups" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	conf := &Config{
+		Logger:         testLogger,
+		UDPListenAddr:  []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig: &UpstreamConfig{Upstreams: []upstream.Upstream{ups}},
+		TrustedProxies: defaultTrustedProxies,
+		CacheEnabled:   true,
+		CacheSizeBytes: defaultCacheSize,
+		RatelimitDenylist: netutil.SliceSubnetSet{
+			netip.MustParsePrefix("192.0.2.2/32"),
+		},
+	}
+	p := mustNew(t, conf)
+
+	first := &recordingEventListener{mu: &sync.Mutex{}}
+	second := &recordingEventListener{mu: &sync.Mutex{}}
+	p.AddEventListener(first)
+	p.AddEventListener(second)
+
+	handle := func(proto Proto, addr string) (err error) {
+		return p.handleDNSRequest(&DNSContext{
+			Proto: proto,
+			Req:   newHostTestMessage("events.example"),
+			Addr:  netip.MustParseAddrPort(addr),
+		})
+	}
+
+	require.ErrorIs(t, handle("", "192.0.2.1:53"), errTest)
+	assert.Equal(t, []string{"cache_miss", "upstream_error ups"}, first.take())
+
+	failing = false
+	require.NoError(t, handle("", "192.0.2.1:53"))
+	assert.Equal(t, []string{"cache_miss"}, first.take())
+
+	require.NoError(t, handle("", "192.0.2.1:53"))
+	assert.Equal(t, []string{"cache_hit"}, first.take())
+
+	require.NoError(t, handle(ProtoUDP, "192.0.2.2:53"))
+	assert.Equal(t, []string{"ratelimited"}, first.take())
+
+	require.NoError(t, p.Reconfigure(conf))
+	assert.Equal(t, []string{"config_reload"}, first.take())
+
+	require.Error(t, p.Reconfigure(&Config{}))
+	assert.Equal(t, []string{"config_reload_error"}, first.take())
+
+	assert.Equal(t, []string{
+		"cache_miss",
+		"upstream_error ups",
+		"cache_miss",
+		"cache_hit",
+		"ratelimited",
+		"config_reload",
+		"config_reload_error",
+	}, second.take())
+}
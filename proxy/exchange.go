@@ -1,30 +1,43 @@
 package proxy
 
 import (
+	"context"
 	"fmt"
+	"log/slog"
 	"time"
 
 	"github.com/AdguardTeam/dnsproxy/upstream"
 	"github.com/AdguardTeam/golibs/errors"
-	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
 	"github.com/miekg/dns"
 	"gonum.org/v1/gonum/stat/sampleuv"
 )
 
 // exchangeUpstreams resolves req using the given upstreams.  It returns the DNS
 // response, the upstream that successfully resolved the request, and the error
-// if any.
+// if any.  The exchanges are aborted once ctx is canceled.
 func (p *Proxy) exchangeUpstreams(
+	ctx context.Context,
 	req *dns.Msg,
 	ups []upstream.Upstream,
 ) (resp *dns.Msg, u upstream.Upstream, err error) {
+	ups = p.withRcodeFailures(p.withUpstreamFaults(p.withForcedTCP(req, ups)))
+
 	switch p.UpstreamMode {
 	case UModeParallel:
-		return upstream.ExchangeParallel(ups, req)
+		start := p.time.Now()
+		resp, u, err = upstream.ExchangeParallelContext(ctx, ups, req)
+		p.recordExchange(u, req, resp, start, p.time.Now().Sub(start), err)
+
+		return resp, u, err
 	case UModeFastestAddr:
 		switch req.Question[0].Qtype {
 		case dns.TypeA, dns.TypeAAAA:
-			return p.fastestAddr.ExchangeFastest(req, ups)
+			start := p.time.Now()
+			resp, u, err = p.fastestAddr.ExchangeFastest(req, ups)
+			p.recordExchange(u, req, resp, start, p.time.Now().Sub(start), err)
+
+			return resp, u, err
 		default:
 			// Go on to the load-balancing mode.
 		}
@@ -32,9 +45,19 @@ func (p *Proxy) exchangeUpstreams(
 		// Go on to the load-balancing mode.
 	}
 
+	ups = p.backoffs.filter(ups, p.time.Now())
+
 	if len(ups) == 1 {
 		u = ups[0]
-		resp, _, err = exchange(u, req, p.time)
+
+		start := p.time.Now()
+
+		var elapsed time.Duration
+		resp, elapsed, err = exchange(ctx, u, req, p.time, p.upstreamLogger)
+		p.recordExchange(u, req, resp, start, elapsed, err)
+		if ctx.Err() == nil {
+			p.backoffs.update(u.Address(), err, start.Add(elapsed))
+		}
 		// TODO(e.burkov):  p.updateRTT(u.Address(), elapsed)
 
 		return resp, u, err
@@ -42,22 +65,71 @@ func (p *Proxy) exchangeUpstreams(
 
 	w := sampleuv.NewWeighted(p.calcWeights(ups), p.randSrc)
 	var errs []error
+
+	// nextResp and nextUps are the last response with one of
+	// [Config.NextUpstreamRcodes] and the upstream it's received from.
+	var nextResp *dns.Msg
+	var nextUps upstream.Upstream
+
+	tried := 0
 	for i, ok := w.Take(); ok; i, ok = w.Take() {
 		u = ups[i]
 
+		start := p.time.Now()
+
+		attemptCtx, cancel := p.attemptContext(ctx, len(ups)-tried)
+		tried++
+
 		var elapsed time.Duration
-		resp, elapsed, err = exchange(u, req, p.time)
+		resp, elapsed, err = exchange(attemptCtx, u, req, p.time, p.upstreamLogger)
+		cancel()
+
+		p.recordExchange(u, req, resp, start, elapsed, err)
 		if err == nil {
+			p.backoffs.update(u.Address(), nil, start.Add(elapsed))
 			p.updateRTT(u.Address(), elapsed)
 
-			return resp, u, nil
+			if !p.isNextUpstreamRcode(resp) {
+				return resp, u, nil
+			}
+
+			p.upstreamLogger.Debug(
+				"trying next upstream",
+				"upstream", u.Address(),
+				"rcode", dns.RcodeToString[resp.Rcode],
+			)
+
+			nextResp, nextUps = resp, u
+			if ctx.Err() != nil {
+				break
+			}
+
+			continue
 		}
 
 		errs = append(errs, err)
 
-		// TODO(e.burkov):  Use the actual configured timeout or, perhaps, the
-		// actual measured elapsed time.
-		p.updateRTT(u.Address(), defaultTimeout)
+		// Don't blame the upstream for the aborted request and don't try the
+		// rest of them.
+		if ctx.Err() != nil {
+			break
+		}
+
+		p.backoffs.update(u.Address(), err, start.Add(elapsed))
+
+		// The failing upstreams are skipped for a while instead of being
+		// penalized, if the backoff is enabled.
+		if p.backoffs == nil {
+			// Penalize the upstream as if it has timed out, or by the time it
+			// has actually taken, if that's longer, e.g. with a longer
+			// configured timeout.
+			p.updateRTT(u.Address(), max(elapsed, defaultTimeout))
+		}
+	}
+
+	if nextResp != nil {
+		// Surface the failure of the upstreams which have responded.
+		return nextResp, nextUps, nil
 	}
 
 	err = fmt.Errorf("all upstreams failed to exchange request: %w", errors.Join(errs...))
@@ -67,36 +139,72 @@ func (p *Proxy) exchangeUpstreams(
 
 // exchange returns the result of the DNS request exchange with the given
 // upstream and the elapsed time in milliseconds.  It uses the given clock to
-// measure the request duration.
-func exchange(u upstream.Upstream, req *dns.Msg, c clock) (resp *dns.Msg, dur time.Duration, err error) {
+// measure the request duration and l to log the result.  The exchange is
+// aborted once ctx is canceled.
+func exchange(
+	ctx context.Context,
+	u upstream.Upstream,
+	req *dns.Msg,
+	c Clock,
+	l *slog.Logger,
+) (resp *dns.Msg, dur time.Duration, err error) {
 	startTime := c.Now()
 
-	reply, err := u.Exchange(req)
+	reply, err := upstream.ExchangeContext(ctx, u, req)
 
 	// Don't use [time.Since] because it uses [time.Now].
 	dur = c.Now().Sub(startTime)
 
 	addr := u.Address()
 	if err != nil {
-		log.Error(
-			"dnsproxy: upstream %s failed to exchange %s in %s: %s",
-			addr,
-			req.Question[0].String(),
-			dur,
-			err,
+		l.Error(
+			"exchange failed",
+			"upstream", addr,
+			"question", req.Question[0].String(),
+			"duration", dur,
+			slogutil.KeyError, err,
 		)
 	} else {
-		log.Debug(
-			"dnsproxy: upstream %s successfully finished exchange of %s; elapsed %s",
-			addr,
-			req.Question[0].String(),
-			dur,
+		l.Debug(
+			"exchange successfully finished",
+			"upstream", addr,
+			"question", req.Question[0].String(),
+			"duration", dur,
 		)
 	}
 
 	return reply, dur, err
 }
 
+// recordExchange reports the result of the exchange of req with u, started at
+// start, to the metrics listener, the message tap, and the event listeners.  u
+// may be nil, if no upstream has responded, in which case only the error is
+// reported, since the failed upstreams are unknown.
+func (p *Proxy) recordExchange(
+	u upstream.Upstream,
+	req *dns.Msg,
+	resp *dns.Msg,
+	start time.Time,
+	rtt time.Duration,
+	err error,
+) {
+	if u == nil {
+		if err != nil {
+			p.eventListener().OnUpstreamError("", req, err)
+		}
+
+		return
+	}
+
+	if err != nil {
+		p.eventListener().OnUpstreamError(u.Address(), req, err)
+	}
+
+	p.metrics.OnUpstreamExchange(u.Address(), rtt, err)
+	p.concurrency.onExchange(rtt)
+	p.messageTap.OnUpstreamExchange(u, req, resp, start, start.Add(rtt))
+}
+
 // upstreamRTTStats is the statistics for a single upstream's round-trip time.
 type upstreamRTTStats struct {
 	// rttSum is the sum of all the round-trip times in microseconds.  The
@@ -14,15 +14,15 @@ import (
 	"golang.org/x/exp/rand"
 )
 
-// fakeClock is the function-based implementation of the [clock] interface.
+// fakeClock is the function-based implementation of the [Clock] interface.
 type fakeClock struct {
 	onNow func() (now time.Time)
 }
 
 // type check
-var _ clock = (*fakeClock)(nil)
+var _ Clock = (*fakeClock)(nil)
 
-// Now implements the [clock] interface for *fakeClock.
+// Now implements the [Clock] interface for *fakeClock.
 func (c *fakeClock) Now() (now time.Time) { return c.onNow() }
 
 // newUpstreamWithErrorRate returns an [upstream.Upstream] that responds with an
@@ -152,7 +152,7 @@ func TestProxy_Exchange_loadBalance(t *testing.T) {
 
 	testCases := []struct {
 		wantStat map[string]int64
-		clock    clock
+		clock    Clock
 		name     string
 		servers  []upstream.Upstream
 	}{{
@@ -0,0 +1,197 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/miekg/dns"
+)
+
+// FallbackTrigger is a set of the outcomes of the exchange with the general
+// upstreams, which make the request resolved with [Config.Fallbacks].
+type FallbackTrigger uint8
+
+// Valid fallback triggers, which may be combined.
+const (
+	// FallbackOnError means falling back when no upstream has responded, for
+	// example because of a network error or a timeout.
+	FallbackOnError FallbackTrigger = 1 << iota
+
+	// FallbackOnServFail means falling back when the response is SERVFAIL,
+	// including the DNSSEC validation failures.
+	FallbackOnServFail
+
+	// FallbackOnRefused means falling back when the response is REFUSED.
+	FallbackOnRefused
+
+	// FallbackOnEmpty means falling back when the response is NOERROR with no
+	// answers.
+	FallbackOnEmpty
+
+	// FallbackOnValidationFailure means falling back when the response is
+	// SERVFAIL with an Extended DNS Error reporting a DNSSEC validation
+	// failure, see RFC 8914.
+	FallbackOnValidationFailure
+)
+
+// fallbackTriggerAll is the union of all the valid fallback triggers.
+const fallbackTriggerAll = FallbackOnError |
+	FallbackOnServFail |
+	FallbackOnRefused |
+	FallbackOnEmpty |
+	FallbackOnValidationFailure
+
+// FallbackConfig defines the outcomes of the exchange with the general
+// upstreams, which make the request resolved with [Config.Fallbacks].  The
+// requests resolved with the private upstreams are never resolved with the
+// fallbacks.  If the fallbacks fail to resolve a request triggered by the
+// response, that response is used.
+type FallbackConfig struct {
+	// Domains are the triggers for the requests for the domain names and
+	// their subdomains, overriding Triggers.  The most specific domain name
+	// is used, and zero triggers mean not to fall back at all.
+	Domains map[string]FallbackTrigger
+
+	// Triggers are the triggers for the requests for the domain names not in
+	// Domains.  Zero means not to fall back at all.
+	Triggers FallbackTrigger
+}
+
+// validate returns an error if c is invalid.  c may be nil.
+func (c *FallbackConfig) validate() (err error) {
+	if c == nil {
+		return nil
+	}
+
+	if c.Triggers&^fallbackTriggerAll != 0 {
+		return fmt.Errorf("triggers: bad value %#x", uint8(c.Triggers))
+	}
+
+	for d, t := range c.Domains {
+		err = netutil.ValidateDomainName(strings.TrimSuffix(d, "."))
+		if err != nil {
+			return fmt.Errorf("domain %q: %w", d, err)
+		}
+
+		if t&^fallbackTriggerAll != 0 {
+			return fmt.Errorf("domain %q: triggers: bad value %#x", d, uint8(t))
+		}
+	}
+
+	return nil
+}
+
+// fallbackMatcher returns the fallback triggers for the requests.  A nil
+// *fallbackMatcher returns [FallbackOnError] for any request.
+type fallbackMatcher struct {
+	// domains are the triggers for the lowercased FQDNs.
+	domains map[string]FallbackTrigger
+
+	// triggers are the triggers for the other domain names.
+	triggers FallbackTrigger
+}
+
+// newFallbackMatcher returns a new matcher for conf.  It returns nil if conf
+// is nil.
+func newFallbackMatcher(conf *FallbackConfig) (m *fallbackMatcher) {
+	if conf == nil {
+		return nil
+	}
+
+	m = &fallbackMatcher{
+		domains:  make(map[string]FallbackTrigger, len(conf.Domains)),
+		triggers: conf.Triggers,
+	}
+
+	for d, t := range conf.Domains {
+		m.domains[dns.Fqdn(strings.ToLower(d))] = t
+	}
+
+	return m
+}
+
+// match returns the fallback triggers for req.
+func (m *fallbackMatcher) match(req *dns.Msg) (t FallbackTrigger) {
+	if m == nil {
+		return FallbackOnError
+	}
+
+	if len(req.Question) == 0 {
+		return m.triggers
+	}
+
+	name := strings.ToLower(req.Question[0].Name)
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if t, ok := m.domains[name[off:]]; ok {
+			return t
+		}
+	}
+
+	return m.triggers
+}
+
+// shouldFallback returns true if the request should be resolved with the
+// fallbacks after the general upstreams have responded with resp and err.
+func (p *Proxy) shouldFallback(
+	ctx context.Context,
+	req *dns.Msg,
+	resp *dns.Msg,
+	err error,
+) (ok bool) {
+	// Don't use the fallbacks for the aborted requests.
+	if p.Fallbacks == nil || ctx.Err() != nil {
+		return false
+	}
+
+	t := p.fallbackTriggers.match(req)
+	if err != nil || resp == nil {
+		return t&FallbackOnError != 0
+	}
+
+	switch resp.Rcode {
+	case dns.RcodeServerFailure:
+		return t&FallbackOnServFail != 0 ||
+			(t&FallbackOnValidationFailure != 0 && isValidationFailure(resp))
+	case dns.RcodeRefused:
+		return t&FallbackOnRefused != 0
+	case dns.RcodeSuccess:
+		return t&FallbackOnEmpty != 0 && len(resp.Answer) == 0
+	default:
+		return false
+	}
+}
+
+// isValidationFailure returns true if resp has an Extended DNS Error reporting
+// a DNSSEC validation failure.
+func isValidationFailure(resp *dns.Msg) (ok bool) {
+	opt := resp.IsEdns0()
+	if opt == nil {
+		return false
+	}
+
+	for _, o := range opt.Option {
+		ede, isEDE := o.(*dns.EDNS0_EDE)
+		if !isEDE {
+			continue
+		}
+
+		switch ede.InfoCode {
+		case
+			dns.ExtendedErrorCodeDNSSECIndeterminate,
+			dns.ExtendedErrorCodeDNSBogus,
+			dns.ExtendedErrorCodeSignatureExpired,
+			dns.ExtendedErrorCodeSignatureNotYetValid,
+			dns.ExtendedErrorCodeDNSKEYMissing,
+			dns.ExtendedErrorCodeRRSIGsMissing,
+			dns.ExtendedErrorCodeNoZoneKeyBitSet,
+			dns.ExtendedErrorCodeNSECMissing:
+			return true
+		default:
+			// Go on.
+		}
+	}
+
+	return false
+}
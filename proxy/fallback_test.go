@@ -0,0 +1,283 @@
+package proxy
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newFallbackTestUpstream returns a [fakeUpstream] responding to the requests
+// depending on the first label of the requested name.
+func newFallbackTestUpstream(addr string) (u *fakeUpstream) {
+	return &fakeUpstream{
+		onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			resp = (&dns.Msg{}).SetReply(req)
+
+			label, _, _ := strings.Cut(req.Question[0].Name, ".")
+			switch label {
+			case "error":
+				return nil, errors.Error("test error")
+			case "servfail":
+				resp.Rcode = dns.RcodeServerFailure
+			case "bogus":
+				resp.Rcode = dns.RcodeServerFailure
+				resp.SetEdns0(defaultUDPBufSize, false)
+				opt := resp.IsEdns0()
+				opt.Option = append(opt.Option, &dns.EDNS0_EDE{
+					InfoCode: dns.ExtendedErrorCodeDNSBogus,
+				})
+			case "refused":
+				resp.Rcode = dns.RcodeRefused
+			case "empty":
+				// Go on.
+			default:
+				resp.Answer = append(resp.Answer, &dns.A{
+					Hdr: dns.RR_Header{
+						Name:   req.Question[0].Name,
+						Rrtype: dns.TypeA,
+						Class:  dns.ClassINET,
+						Ttl:    60,
+					},
+					A: netip.MustParseAddr("192.0.2.1").AsSlice(),
+				})
+			}
+
+			return resp, nil
+		},
+		onAddress: func() (a string) { return addr },
+		onClose:   func() (err error) { return nil },
+	}
+}
+
+func TestProxy_fallbackTriggers(t *testing.T) {
+	ups := newFallbackTestUpstream("general.address")
+
+	fallback := &fakeUpstream{
+		onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			return (&dns.Msg{}).SetReply(req), nil
+		},
+		onAddress: func() (addr string) { return "fallback.address" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	p := mustNew(t, &Config{
+		Logger:         testLogger,
+		UDPListenAddr:  []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig: &UpstreamConfig{Upstreams: []upstream.Upstream{ups}},
+		Fallbacks:      &UpstreamConfig{Upstreams: []upstream.Upstream{fallback}},
+		TrustedProxies: defaultTrustedProxies,
+		FallbackTriggers: &FallbackConfig{
+			Domains: map[string]FallbackTrigger{
+				"Strict.Example":      FallbackOnServFail | FallbackOnEmpty,
+				"none.strict.example": 0,
+			},
+			Triggers: FallbackOnError | FallbackOnRefused | FallbackOnValidationFailure,
+		},
+	})
+
+	testCases := []struct {
+		name         string
+		host         string
+		wantUpstream upstream.Upstream
+	}{{
+		name:         "answer",
+		host:         "www.example.",
+		wantUpstream: ups,
+	}, {
+		name:         "error",
+		host:         "error.example.",
+		wantUpstream: fallback,
+	}, {
+		name:         "servfail",
+		host:         "servfail.example.",
+		wantUpstream: ups,
+	}, {
+		name:         "validation",
+		host:         "bogus.example.",
+		wantUpstream: fallback,
+	}, {
+		name:         "refused",
+		host:         "refused.example.",
+		wantUpstream: fallback,
+	}, {
+		name:         "empty",
+		host:         "empty.example.",
+		wantUpstream: ups,
+	}, {
+		name:         "domain_error",
+		host:         "error.strict.example.",
+		wantUpstream: nil,
+	}, {
+		name:         "domain_servfail",
+		host:         "servfail.strict.example.",
+		wantUpstream: fallback,
+	}, {
+		name:         "domain_refused",
+		host:         "refused.strict.example.",
+		wantUpstream: ups,
+	}, {
+		name:         "domain_empty",
+		host:         "empty.strict.example.",
+		wantUpstream: fallback,
+	}, {
+		name:         "subdomain_none",
+		host:         "servfail.none.strict.example.",
+		wantUpstream: ups,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			d := &DNSContext{Req: (&dns.Msg{}).SetQuestion(tc.host, dns.TypeA)}
+			_ = p.Resolve(d)
+			require.NotNil(t, d.Res)
+
+			assert.Equal(t, tc.wantUpstream, d.Upstream)
+		})
+	}
+
+	t.Run("fallback_failed", func(t *testing.T) {
+		failing := &fakeUpstream{
+			onExchange: func(_ *dns.Msg) (resp *dns.Msg, err error) {
+				return nil, errors.Error("fallback error")
+			},
+			onAddress: func() (addr string) { return "failing.address" },
+			onClose:   func() (err error) { return nil },
+		}
+
+		fp := mustNew(t, &Config{
+			Logger:         testLogger,
+			UDPListenAddr:  []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+			UpstreamConfig: &UpstreamConfig{Upstreams: []upstream.Upstream{ups}},
+			Fallbacks:      &UpstreamConfig{Upstreams: []upstream.Upstream{failing}},
+			TrustedProxies: defaultTrustedProxies,
+			FallbackTriggers: &FallbackConfig{
+				Triggers: FallbackOnRefused,
+			},
+		})
+
+		d := &DNSContext{Req: (&dns.Msg{}).SetQuestion("refused.example.", dns.TypeA)}
+		require.NoError(t, fp.Resolve(d))
+		require.NotNil(t, d.Res)
+
+		assert.Equal(t, dns.RcodeRefused, d.Res.Rcode)
+		assert.Equal(t, ups, d.Upstream)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := New(&Config{
+			UDPListenAddr:  []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+			UpstreamConfig: &UpstreamConfig{Upstreams: []upstream.Upstream{ups}},
+			TrustedProxies: defaultTrustedProxies,
+			FallbackTriggers: &FallbackConfig{
+				Domains: map[string]FallbackTrigger{"bad..domain": FallbackOnError},
+			},
+		})
+		testutil.AssertErrorMsg(
+			t,
+			`validating fallback triggers: domain "bad..domain": `+
+				`bad domain name "bad..domain": `+
+				`bad domain name label "": domain name label is empty`,
+			err,
+		)
+	})
+}
+
+// rttMetricsListener is a [MetricsListener] recording the round-trip times of
+// the exchanges with the upstreams.
+type rttMetricsListener struct {
+	EmptyMetricsListener
+
+	// mu protects rtts.
+	mu *sync.Mutex
+
+	// rtts are the last round-trip times by the addresses of the upstreams.
+	rtts map[string]time.Duration
+}
+
+// OnUpstreamExchange implements the [MetricsListener] interface for
+// *rttMetricsListener.
+func (l *rttMetricsListener) OnUpstreamExchange(addr string, rtt time.Duration, _ error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.rtts[addr] = rtt
+}
+
+func TestProxy_fallbackRTT(t *testing.T) {
+	const (
+		primaryRTT  = time.Minute
+		fallbackRTT = time.Second
+	)
+
+	// The exchanges advance the clock instead of taking time.
+	mu := &sync.Mutex{}
+	now := time.Now()
+	clock := &fakeClock{onNow: func() (n time.Time) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return now
+	}}
+	advance := func(d time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		now = now.Add(d)
+	}
+
+	primary := &fakeUpstream{
+		onExchange: func(_ *dns.Msg) (resp *dns.Msg, err error) {
+			advance(primaryRTT)
+
+			return nil, errors.Error("timeout")
+		},
+		onAddress: func() (addr string) { return "primary.address" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	fallback := newFallbackTestUpstream("fallback.address")
+	fallbackExchange := fallback.onExchange
+	fallback.onExchange = func(req *dns.Msg) (resp *dns.Msg, err error) {
+		advance(fallbackRTT)
+
+		return fallbackExchange(req)
+	}
+
+	ml := &rttMetricsListener{
+		mu:   &sync.Mutex{},
+		rtts: map[string]time.Duration{},
+	}
+
+	p := mustNew(t, &Config{
+		Logger:          testLogger,
+		UDPListenAddr:   []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig:  &UpstreamConfig{Upstreams: []upstream.Upstream{primary}},
+		Fallbacks:       &UpstreamConfig{Upstreams: []upstream.Upstream{fallback}},
+		TrustedProxies:  defaultTrustedProxies,
+		Clock:           clock,
+		MetricsListener: ml,
+	})
+
+	d := &DNSContext{Req: (&dns.Msg{}).SetQuestion("www.example.", dns.TypeA)}
+	require.NoError(t, p.Resolve(d))
+	require.Equal(t, fallback, d.Upstream)
+
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+
+	assert.Equal(t, primaryRTT, ml.rtts["primary.address"])
+
+	// The time spent on the primary upstream must not be included.
+	assert.Equal(t, fallbackRTT, ml.rtts["fallback.address"])
+	assert.Equal(t, fallbackRTT, d.QueryDuration)
+}
@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+)
+
+// loadFastestCache restores the cached ping results of the fastest address
+// detection from [Config.FastestCachePath], if it's set.  The errors are only
+// logged, since the cache is restored on a best-effort basis.
+func (p *Proxy) loadFastestCache(ctx context.Context) {
+	path := p.FastestCachePath
+	if p.fastestAddr == nil || path == "" {
+		return
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			p.logger.WarnContext(ctx, "reading fastest addr cache", slogutil.KeyError, err)
+		}
+
+		return
+	}
+
+	err = p.fastestAddr.ReadCache(bytes.NewReader(b))
+	if err != nil {
+		p.logger.WarnContext(ctx, "decoding fastest addr cache", "path", path, slogutil.KeyError, err)
+
+		return
+	}
+
+	p.logger.DebugContext(ctx, "restored fastest addr cache", "path", path)
+}
+
+// saveFastestCache writes the cached ping results of the fastest address
+// detection to [Config.FastestCachePath], if it's set.  The file is replaced
+// atomically.
+func (p *Proxy) saveFastestCache() (err error) {
+	path := p.FastestCachePath
+	if p.fastestAddr == nil || path == "" {
+		return nil
+	}
+
+	err = replaceFile(path, p.fastestAddr.WriteCache)
+	if err != nil {
+		return fmt.Errorf("saving fastest addr cache: %w", err)
+	}
+
+	return nil
+}
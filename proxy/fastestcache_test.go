@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_fastestCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fastest.json")
+
+	expire := time.Now().Add(time.Minute).Unix()
+	data := fmt.Sprintf(
+		`{"version":1,"entries":[{"ip":"192.0.2.1","expire":%d,"latency_msec":42,"failed":false}]}`,
+		expire,
+	)
+	require.NoError(t, os.WriteFile(path, []byte(data), 0o600))
+
+	p := mustNew(t, &Config{
+		Logger:        testLogger,
+		UDPListenAddr: []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{newProfileTestUpstream("192.0.2.1")},
+		},
+		TrustedProxies:   defaultTrustedProxies,
+		UpstreamMode:     UModeFastestAddr,
+		FastestCachePath: path,
+	})
+
+	ctx := context.Background()
+	require.NoError(t, p.Start(ctx))
+	require.NoError(t, os.Remove(path))
+	require.NoError(t, p.Shutdown(ctx))
+
+	// The restored entry is saved again on shutdown.
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	assert.JSONEq(t, data, string(b))
+}
+
+func TestProxy_validateFastestAddr(t *testing.T) {
+	testCases := []struct {
+		conf       *Config
+		name       string
+		wantErrMsg string
+	}{{
+		conf: &Config{
+			FastestPingPorts:      []uint{53, 853},
+			FastestFasterWait:     time.Millisecond,
+			FastestIPv6Preference: time.Millisecond,
+		},
+		name:       "valid",
+		wantErrMsg: "",
+	}, {
+		conf:       &Config{FastestPingPorts: []uint{53, 0}},
+		name:       "zero_port",
+		wantErrMsg: "ping port at index 1: bad value 0",
+	}, {
+		conf:       &Config{FastestPingPorts: []uint{65536}},
+		name:       "large_port",
+		wantErrMsg: "ping port at index 0: bad value 65536",
+	}, {
+		conf:       &Config{FastestFasterWait: -time.Second},
+		name:       "negative_faster_wait",
+		wantErrMsg: "faster wait: negative value -1s",
+	}, {
+		conf:       &Config{FastestIPv6Preference: -time.Second},
+		name:       "negative_ipv6_preference",
+		wantErrMsg: "ipv6 preference: negative value -1s",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := &Proxy{Config: *tc.conf}
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, p.validateFastestAddr())
+		})
+	}
+}
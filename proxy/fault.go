@@ -0,0 +1,154 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/miekg/dns"
+)
+
+// FaultConfig is the configuration of the artificial faults injected into the
+// request handling.  It's intended for testing the retry behavior of the
+// clients and the monitoring, and must never be used in production.
+type FaultConfig struct {
+	// Latency is the artificial delay added to each request.
+	Latency time.Duration
+
+	// ServFailPercentage is the percentage of the requests answered with
+	// SERVFAIL.
+	ServFailPercentage uint
+
+	// DropPercentage is the percentage of the requests dropped without a
+	// response.
+	DropPercentage uint
+}
+
+// validate returns an error if c is invalid.  c may be nil.
+func (c *FaultConfig) validate() (err error) {
+	if c == nil {
+		return nil
+	}
+
+	if c.Latency < 0 {
+		return fmt.Errorf("latency: negative value %s", c.Latency)
+	}
+
+	if sum := c.ServFailPercentage + c.DropPercentage; sum > 100 {
+		return fmt.Errorf("servfail and drop percentages: sum %d greater than max 100", sum)
+	}
+
+	return nil
+}
+
+// fault is the kind of an injected fault.
+type fault uint8
+
+// Valid faults.
+const (
+	faultNone fault = iota
+	faultServFail
+	faultDrop
+)
+
+// inject waits for the configured latency and returns the fault to inject into
+// the current request.  c may be nil.
+func (c *FaultConfig) inject() (f fault) {
+	if c == nil {
+		return faultNone
+	}
+
+	if c.Latency > 0 {
+		time.Sleep(c.Latency)
+	}
+
+	switch r := rand.UintN(100); {
+	case r < c.DropPercentage:
+		return faultDrop
+	case r < c.DropPercentage+c.ServFailPercentage:
+		return faultServFail
+	default:
+		return faultNone
+	}
+}
+
+// injectListenerFault injects the configured listener fault into d.  It sets
+// the SERVFAIL response if it's chosen and returns true if the request should
+// be dropped.
+func (p *Proxy) injectListenerFault(d *DNSContext) (drop bool) {
+	switch p.ListenerFaults.inject() {
+	case faultDrop:
+		p.logger.Debug("fault injection: dropping request", "addr", p.anonymizer.addrPort(d.Addr))
+
+		return true
+	case faultServFail:
+		p.logger.Debug("fault injection: answering servfail", "addr", p.anonymizer.addrPort(d.Addr))
+
+		d.Res = p.messages.NewMsgSERVFAIL(d.Req)
+	default:
+		// Go on.
+	}
+
+	return false
+}
+
+// errFaultDrop is returned by the upstreams when the request is dropped by the
+// fault injection.
+const errFaultDrop errors.Error = "request dropped by fault injection"
+
+// faultyUpstream is an [upstream.Upstream] injecting the configured faults into
+// the exchanges.
+type faultyUpstream struct {
+	upstream.Upstream
+
+	// faults is the configuration of the injected faults.  It must not be nil.
+	faults *FaultConfig
+}
+
+// type check
+var (
+	_ upstream.Upstream         = (*faultyUpstream)(nil)
+	_ upstream.ContextExchanger = (*faultyUpstream)(nil)
+)
+
+// Exchange implements the [upstream.Upstream] interface for *faultyUpstream.
+func (u *faultyUpstream) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	return u.ExchangeContext(context.Background(), req)
+}
+
+// ExchangeContext implements the [upstream.ContextExchanger] interface for
+// *faultyUpstream.
+func (u *faultyUpstream) ExchangeContext(
+	ctx context.Context,
+	req *dns.Msg,
+) (resp *dns.Msg, err error) {
+	switch u.faults.inject() {
+	case faultDrop:
+		return nil, errFaultDrop
+	case faultServFail:
+		return (&dns.Msg{}).SetRcode(req, dns.RcodeServerFailure), nil
+	default:
+		return upstream.ExchangeContext(ctx, u.Upstream, req)
+	}
+}
+
+// withUpstreamFaults returns ups wrapped to inject the configured upstream
+// faults.  It returns ups as is if the upstream fault injection is disabled.
+func (p *Proxy) withUpstreamFaults(ups []upstream.Upstream) (wrapped []upstream.Upstream) {
+	if p.UpstreamFaults == nil {
+		return ups
+	}
+
+	wrapped = make([]upstream.Upstream, 0, len(ups))
+	for _, u := range ups {
+		wrapped = append(wrapped, &faultyUpstream{
+			Upstream: u,
+			faults:   p.UpstreamFaults,
+		})
+	}
+
+	return wrapped
+}
@@ -0,0 +1,137 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startFaultTestProxy starts the proxy with the given faults and returns the
+// address of its UDP listener.
+func startFaultTestProxy(t *testing.T, listener, ups *FaultConfig) (addr string) {
+	t.Helper()
+
+	u := &fakeUpstream{
+		onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			return (&dns.Msg{}).SetReply(req), nil
+		},
+		onAddress: func() (addr string) { return "ups" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	p := mustNew(t, &Config{
+		Logger:        testLogger,
+		UDPListenAddr: []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{u},
+		},
+		TrustedProxies: defaultTrustedProxies,
+		ListenerFaults: listener,
+		UpstreamFaults: ups,
+	})
+
+	ctx := context.Background()
+	require.NoError(t, p.Start(ctx))
+	testutil.CleanupAndRequireSuccess(t, func() (err error) { return p.Shutdown(ctx) })
+
+	return p.Addr(ProtoUDP).String()
+}
+
+func TestProxy_faults(t *testing.T) {
+	const latency = 100 * time.Millisecond
+
+	testCases := []struct {
+		listener  *FaultConfig
+		upstream  *FaultConfig
+		name      string
+		wantRcode int
+	}{{
+		listener:  nil,
+		upstream:  nil,
+		name:      "none",
+		wantRcode: dns.RcodeSuccess,
+	}, {
+		listener:  &FaultConfig{ServFailPercentage: 100},
+		upstream:  nil,
+		name:      "listener_servfail",
+		wantRcode: dns.RcodeServerFailure,
+	}, {
+		listener:  nil,
+		upstream:  &FaultConfig{ServFailPercentage: 100},
+		name:      "upstream_servfail",
+		wantRcode: dns.RcodeServerFailure,
+	}, {
+		listener:  nil,
+		upstream:  &FaultConfig{DropPercentage: 100},
+		name:      "upstream_drop",
+		wantRcode: dns.RcodeServerFailure,
+	}, {
+		listener:  &FaultConfig{Latency: latency},
+		upstream:  nil,
+		name:      "listener_latency",
+		wantRcode: dns.RcodeSuccess,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			addr := startFaultTestProxy(t, tc.listener, tc.upstream)
+
+			client := &dns.Client{Net: string(ProtoUDP), Timeout: defaultTimeout}
+			resp, rtt, err := client.Exchange(newHostTestMessage("fault.example"), addr)
+			require.NoError(t, err)
+
+			assert.Equal(t, tc.wantRcode, resp.Rcode)
+			if tc.listener != nil && tc.listener.Latency > 0 {
+				assert.GreaterOrEqual(t, rtt, tc.listener.Latency)
+			}
+		})
+	}
+
+	t.Run("listener_drop", func(t *testing.T) {
+		addr := startFaultTestProxy(t, &FaultConfig{DropPercentage: 100}, nil)
+
+		client := &dns.Client{Net: string(ProtoUDP), Timeout: latency}
+		_, _, err := client.Exchange(newHostTestMessage("fault.example"), addr)
+		var netErr net.Error
+		require.ErrorAs(t, err, &netErr)
+
+		assert.True(t, netErr.Timeout())
+	})
+}
+
+func TestFaultConfig_validate(t *testing.T) {
+	testCases := []struct {
+		conf       *FaultConfig
+		name       string
+		wantErrMsg string
+	}{{
+		conf:       nil,
+		name:       "nil",
+		wantErrMsg: "",
+	}, {
+		conf:       &FaultConfig{ServFailPercentage: 50, DropPercentage: 50},
+		name:       "valid",
+		wantErrMsg: "",
+	}, {
+		conf:       &FaultConfig{ServFailPercentage: 60, DropPercentage: 50},
+		name:       "percentages",
+		wantErrMsg: "servfail and drop percentages: sum 110 greater than max 100",
+	}, {
+		conf:       &FaultConfig{Latency: -time.Second},
+		name:       "latency",
+		wantErrMsg: "latency: negative value -1s",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, tc.conf.validate())
+		})
+	}
+}
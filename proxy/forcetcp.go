@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/miekg/dns"
+)
+
+// ForceTCPConfig is the configuration of the requests resolved with the plain
+// DNS upstreams over TCP only, even if the clients sent them over UDP.  It's
+// useful for the large responses, like the ones to TXT or DNSKEY requests, and
+// for the zones the UDP responses from which are broken by middleboxes.
+type ForceTCPConfig struct {
+	// Domains are the domain names, the requests for which and for their
+	// subdomains are resolved over TCP.
+	Domains []string
+
+	// Qtypes are the types of the requests resolved over TCP.
+	Qtypes []uint16
+}
+
+// validate returns an error if c is invalid.  c may be nil.
+func (c *ForceTCPConfig) validate() (err error) {
+	if c == nil {
+		return nil
+	}
+
+	for i, d := range c.Domains {
+		err = netutil.ValidateDomainName(strings.TrimSuffix(d, "."))
+		if err != nil {
+			return fmt.Errorf("domain at index %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+// forceTCPMatcher matches the requests which should be resolved over TCP.  A
+// nil *forceTCPMatcher matches nothing.
+type forceTCPMatcher struct {
+	// domains is the set of the lowercased FQDNs to match.
+	domains map[string]struct{}
+
+	// qtypes is the set of the types of the requests to match.
+	qtypes map[uint16]struct{}
+}
+
+// newForceTCPMatcher returns a new matcher for conf.  It returns nil if conf is
+// nil.
+func newForceTCPMatcher(conf *ForceTCPConfig) (m *forceTCPMatcher) {
+	if conf == nil {
+		return nil
+	}
+
+	m = &forceTCPMatcher{
+		domains: make(map[string]struct{}, len(conf.Domains)),
+		qtypes:  make(map[uint16]struct{}, len(conf.Qtypes)),
+	}
+
+	for _, d := range conf.Domains {
+		m.domains[dns.Fqdn(strings.ToLower(d))] = struct{}{}
+	}
+
+	for _, qt := range conf.Qtypes {
+		m.qtypes[qt] = struct{}{}
+	}
+
+	return m
+}
+
+// match returns true if req should be resolved over TCP.
+func (m *forceTCPMatcher) match(req *dns.Msg) (ok bool) {
+	if m == nil || len(req.Question) == 0 {
+		return false
+	}
+
+	q := req.Question[0]
+	if _, ok = m.qtypes[q.Qtype]; ok {
+		return true
+	}
+
+	name := strings.ToLower(q.Name)
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if _, ok = m.domains[name[off:]]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// tcpUpstream is an [upstream.Upstream] exchanging over TCP only.
+type tcpUpstream struct {
+	upstream.Upstream
+
+	// tcp is the same upstream as the embedded one.
+	tcp upstream.TCPExchanger
+}
+
+// type check
+var _ upstream.Upstream = (*tcpUpstream)(nil)
+
+// Exchange implements the [upstream.Upstream] interface for *tcpUpstream.
+func (u *tcpUpstream) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	return u.tcp.ExchangeTCP(req)
+}
+
+// withForcedTCP returns ups wrapped to exchange over TCP, if req matches the
+// configured rules.  The upstreams which don't implement
+// [upstream.TCPExchanger] are used as is.
+func (p *Proxy) withForcedTCP(req *dns.Msg, ups []upstream.Upstream) (wrapped []upstream.Upstream) {
+	if !p.forceTCP.match(req) {
+		return ups
+	}
+
+	wrapped = make([]upstream.Upstream, 0, len(ups))
+	for _, u := range ups {
+		if tcp, ok := u.(upstream.TCPExchanger); ok {
+			u = &tcpUpstream{
+				Upstream: u,
+				tcp:      tcp,
+			}
+		}
+
+		wrapped = append(wrapped, u)
+	}
+
+	return wrapped
+}
@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// tcpFakeUpstream is a [fakeUpstream] also implementing the
+// [upstream.TCPExchanger] interface.
+type tcpFakeUpstream struct {
+	*fakeUpstream
+
+	// onExchangeTCP is called by ExchangeTCP.
+	onExchangeTCP func(req *dns.Msg) (resp *dns.Msg, err error)
+}
+
+// type check
+var _ upstream.TCPExchanger = (*tcpFakeUpstream)(nil)
+
+// ExchangeTCP implements the [upstream.TCPExchanger] interface for
+// *tcpFakeUpstream.
+func (u *tcpFakeUpstream) ExchangeTCP(req *dns.Msg) (resp *dns.Msg, err error) {
+	return u.onExchangeTCP(req)
+}
+
+func TestProxy_forceTCP(t *testing.T) {
+	// network is the network the last request has been sent over.
+	var network string
+
+	newResp := func(req *dns.Msg) (resp *dns.Msg) {
+		return (&dns.Msg{}).SetReply(req)
+	}
+
+	ups := &tcpFakeUpstream{
+		fakeUpstream: &fakeUpstream{
+			onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+				network = "udp"
+
+				return newResp(req), nil
+			},
+			onAddress: func() (addr string) { return "fake.address" },
+			onClose:   func() (err error) { return nil },
+		},
+		onExchangeTCP: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			network = "tcp"
+
+			return newResp(req), nil
+		},
+	}
+
+	p := mustNew(t, &Config{
+		Logger:         testLogger,
+		UDPListenAddr:  []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig: &UpstreamConfig{Upstreams: []upstream.Upstream{ups}},
+		TrustedProxies: defaultTrustedProxies,
+		ForceTCP: &ForceTCPConfig{
+			Domains: []string{"Flaky.Example"},
+			Qtypes:  []uint16{dns.TypeDNSKEY},
+		},
+	})
+
+	testCases := []struct {
+		name        string
+		host        string
+		wantNetwork string
+		qtype       uint16
+	}{{
+		name:        "not_matched",
+		host:        "example.org.",
+		wantNetwork: "udp",
+		qtype:       dns.TypeA,
+	}, {
+		name:        "domain",
+		host:        "flaky.example.",
+		wantNetwork: "tcp",
+		qtype:       dns.TypeA,
+	}, {
+		name:        "subdomain",
+		host:        "WWW.flaky.example.",
+		wantNetwork: "tcp",
+		qtype:       dns.TypeA,
+	}, {
+		name:        "similar_domain",
+		host:        "notflaky.example.",
+		wantNetwork: "udp",
+		qtype:       dns.TypeA,
+	}, {
+		name:        "qtype",
+		host:        "example.org.",
+		wantNetwork: "tcp",
+		qtype:       dns.TypeDNSKEY,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			d := &DNSContext{Req: (&dns.Msg{}).SetQuestion(tc.host, tc.qtype)}
+			require.NoError(t, p.Resolve(d))
+			require.NotNil(t, d.Res)
+
+			assert.Equal(t, tc.wantNetwork, network)
+		})
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := New(&Config{
+			UDPListenAddr:  []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+			UpstreamConfig: &UpstreamConfig{Upstreams: []upstream.Upstream{ups}},
+			TrustedProxies: defaultTrustedProxies,
+			ForceTCP:       &ForceTCPConfig{Domains: []string{"bad..domain"}},
+		})
+		testutil.AssertErrorMsg(
+			t,
+			`validating force tcp: domain at index 0: bad domain name "bad..domain": `+
+				`bad domain name label "": domain name label is empty`,
+			err,
+		)
+	})
+}
@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/miekg/dns"
+)
+
+// StartupGating defines how the proxy handles the client requests until the
+// general upstreams are verified on startup.
+type StartupGating string
+
+// Valid startup gating modes.
+const (
+	// StartupGatingNone means that the upstreams aren't verified.
+	StartupGatingNone StartupGating = ""
+
+	// StartupGatingDelay means that [Proxy.Start] doesn't bind the listeners
+	// until the upstreams are verified.
+	StartupGatingDelay StartupGating = "delay"
+
+	// StartupGatingServFail means that the listeners are bound immediately, but
+	// the requests are answered with SERVFAIL and the "Not Ready" extended DNS
+	// error until the upstreams are verified.
+	StartupGatingServFail StartupGating = "servfail"
+)
+
+// defaultUpstreamVerifyInterval is the interval between the attempts to verify
+// the upstreams.
+const defaultUpstreamVerifyInterval = 1 * time.Second
+
+// validateStartupGating returns an error if the startup gating mode is invalid.
+func (p *Proxy) validateStartupGating() (err error) {
+	switch p.StartupGating {
+	case StartupGatingNone, StartupGatingDelay, StartupGatingServFail:
+		return nil
+	default:
+		return fmt.Errorf("startup gating: unsupported mode %q", p.StartupGating)
+	}
+}
+
+// verifyUpstreams blocks until at least one of the general upstreams answers
+// the probe query or ctx is canceled.
+func (p *Proxy) verifyUpstreams(ctx context.Context) (err error) {
+	req := &dns.Msg{}
+	req.SetQuestion(".", dns.TypeNS)
+
+	for {
+		p.reconfigureLock.RLock()
+		ups := p.UpstreamConfig.Upstreams
+		p.reconfigureLock.RUnlock()
+
+		_, u, exchErr := upstream.ExchangeParallel(ups, req)
+		if exchErr == nil {
+			p.upstreamLogger.InfoContext(ctx, "upstreams verified", "upstream", u.Address())
+
+			return nil
+		}
+
+		p.upstreamLogger.WarnContext(ctx, "verifying upstreams", slogutil.KeyError, exchErr)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(p.upstreamVerifyInterval):
+			// Go on.
+		}
+	}
+}
+
+// startUpstreamsVerification starts verifying the upstreams in a separate
+// goroutine, answering the requests with SERVFAIL until it succeeds.  p must be
+// locked.
+func (p *Proxy) startUpstreamsVerification() {
+	ctx, cancel := context.WithCancel(context.Background())
+	p.cancelVerification = cancel
+
+	p.notReady.Store(true)
+	go func() {
+		if p.verifyUpstreams(ctx) == nil {
+			p.notReady.Store(false)
+		}
+	}()
+}
+
+// stopUpstreamsVerification stops the verification of the upstreams, if it's
+// running.  p must be locked.
+func (p *Proxy) stopUpstreamsVerification() {
+	if p.cancelVerification != nil {
+		p.cancelVerification()
+		p.cancelVerification = nil
+	}
+}
+
+// newMsgNotReady returns the SERVFAIL response to req with the "Not Ready"
+// extended DNS error, see RFC 8914.  The error is only added if req has an OPT
+// record.
+func (p *Proxy) newMsgNotReady(req *dns.Msg) (resp *dns.Msg) {
+	resp = p.messages.NewMsgSERVFAIL(req)
+	addEDE(req, resp, dns.ExtendedErrorCodeNotReady, "upstreams are not verified yet")
+
+	return resp
+}
+
+// addEDE adds the extended DNS error with code and text to resp, see RFC 8914.
+// The error is only added if req, the request resp answers, has an OPT record.
+func addEDE(req, resp *dns.Msg, code uint16, text string) {
+	reqOpt := req.IsEdns0()
+	if reqOpt == nil {
+		return
+	}
+
+	opt := resp.IsEdns0()
+	if opt == nil {
+		resp.SetEdns0(reqOpt.UDPSize(), reqOpt.Do())
+		opt = resp.IsEdns0()
+	}
+
+	opt.Option = append(opt.Option, &dns.EDNS0_EDE{
+		InfoCode:  code,
+		ExtraText: text,
+	})
+}
@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newGatingTestProxy returns a new proxy with the given startup gating mode
+// and an upstream answering only when answered is true.
+func newGatingTestProxy(t *testing.T, mode StartupGating, answered *atomic.Bool) (p *Proxy) {
+	t.Helper()
+
+	ups := &fakeUpstream{
+		onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			if !answered.Load() {
+				return nil, assert.AnError
+			}
+
+			return (&dns.Msg{}).SetReply(req), nil
+		},
+		onAddress: func() (addr string) { return "ups" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	p = mustNew(t, &Config{
+		Logger:        testLogger,
+		UDPListenAddr: []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{ups},
+		},
+		TrustedProxies: defaultTrustedProxies,
+		StartupGating:  mode,
+	})
+	p.upstreamVerifyInterval = 10 * time.Millisecond
+
+	return p
+}
+
+func TestProxy_startupGating_servFail(t *testing.T) {
+	answered := &atomic.Bool{}
+	p := newGatingTestProxy(t, StartupGatingServFail, answered)
+
+	ctx := context.Background()
+	require.NoError(t, p.Start(ctx))
+	testutil.CleanupAndRequireSuccess(t, func() (err error) { return p.Shutdown(ctx) })
+
+	client := &dns.Client{Net: string(ProtoUDP), Timeout: defaultTimeout}
+	addr := p.Addr(ProtoUDP).String()
+
+	req := newHostTestMessage("gating.example")
+	req.SetEdns0(dns.DefaultMsgSize, false)
+
+	resp, _, err := client.Exchange(req, addr)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeServerFailure, resp.Rcode)
+
+	opt := resp.IsEdns0()
+	require.NotNil(t, opt)
+	require.Len(t, opt.Option, 1)
+
+	ede := testutil.RequireTypeAssert[*dns.EDNS0_EDE](t, opt.Option[0])
+	assert.Equal(t, dns.ExtendedErrorCodeNotReady, ede.InfoCode)
+
+	answered.Store(true)
+	assert.Eventually(t, func() (ok bool) {
+		resp, _, err = client.Exchange(req, addr)
+
+		return err == nil && resp.Rcode == dns.RcodeSuccess
+	}, defaultTimeout, 10*time.Millisecond)
+}
+
+func TestProxy_startupGating_delay(t *testing.T) {
+	answered := &atomic.Bool{}
+	p := newGatingTestProxy(t, StartupGatingDelay, answered)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	err := p.Start(ctx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.False(t, p.IsStarted())
+
+	answered.Store(true)
+
+	ctx = context.Background()
+	require.NoError(t, p.Start(ctx))
+	testutil.CleanupAndRequireSuccess(t, func() (err error) { return p.Shutdown(ctx) })
+
+	assert.True(t, p.IsStarted())
+}
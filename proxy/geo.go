@@ -0,0 +1,34 @@
+package proxy
+
+import (
+	"net/netip"
+)
+
+// GeoInfo is the geographical data about a client address.
+type GeoInfo struct {
+	// Country is the ISO 3166-1 alpha-2 code of the country, for example "DE".
+	// It's empty if unknown.
+	Country string
+
+	// ASN is the number of the autonomous system.  It's zero if unknown.
+	ASN uint32
+}
+
+// GeoLocator looks up the geographical data about the client addresses, for
+// example, in the MaxMind GeoLite2 databases.
+type GeoLocator interface {
+	// Locate returns the data about addr.  info is nil if nothing is known
+	// about addr.  It must be safe for concurrent use.
+	Locate(addr netip.Addr) (info *GeoInfo)
+}
+
+// locate returns the geographical data about the client of d, if
+// [Config.GeoLocator] is set.
+func (p *Proxy) locate(d *DNSContext) (info *GeoInfo) {
+	addr := d.Addr.Addr()
+	if p.GeoLocator == nil || !addr.IsValid() {
+		return nil
+	}
+
+	return p.GeoLocator.Locate(addr.Unmap())
+}
@@ -7,6 +7,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/AdguardTeam/dnsproxy/upstream"
 	"github.com/AdguardTeam/golibs/testutil"
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
@@ -71,3 +72,82 @@ func TestFilteringHandler(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, dns.RcodeNotImplemented, r.Rcode)
 }
+
+func TestProxy_dnsContextPooling(t *testing.T) {
+	const reqNum = 10
+
+	type ctxKey struct{}
+
+	testCases := []struct {
+		name    string
+		enabled bool
+	}{{
+		name:    "enabled",
+		enabled: true,
+	}, {
+		name:    "disabled",
+		enabled: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mu := &sync.Mutex{}
+			var dctxs []*DNSContext
+			var stale []any
+
+			p := mustNew(t, &Config{
+				Logger:        testLogger,
+				UDPListenAddr: []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+				UpstreamConfig: &UpstreamConfig{
+					Upstreams: []upstream.Upstream{newProfileTestUpstream("192.0.2.1")},
+				},
+				TrustedProxies:          defaultTrustedProxies,
+				RatelimitSubnetLenIPv4:  24,
+				RatelimitSubnetLenIPv6:  64,
+				EnableDNSContextPooling: tc.enabled,
+				RequestHandler: func(p *Proxy, d *DNSContext) (err error) {
+					mu.Lock()
+					defer mu.Unlock()
+
+					if v := d.Value(ctxKey{}); v != nil || d.Res != nil || d.Upstream != nil {
+						stale = append(stale, v)
+					}
+
+					d.SetValue(ctxKey{}, d.RequestID)
+					dctxs = append(dctxs, d)
+
+					return p.Resolve(d)
+				},
+			})
+
+			ctx := context.Background()
+			require.NoError(t, p.Start(ctx))
+			testutil.CleanupAndRequireSuccess(t, func() (err error) { return p.Shutdown(ctx) })
+
+			client := &dns.Client{Net: string(ProtoUDP), Timeout: defaultTimeout}
+			for range reqNum {
+				resp, _, err := client.Exchange(newHostTestMessage("example.org"), p.Addr(ProtoUDP).String())
+				require.NoError(t, err)
+				require.NotNil(t, resp)
+
+				assert.Len(t, resp.Answer, 1)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			assert.Empty(t, stale)
+			require.Len(t, dctxs, reqNum)
+
+			if tc.enabled {
+				return
+			}
+
+			for _, d := range dctxs {
+				assert.NotNil(t, d.Req)
+				assert.NotNil(t, d.Res)
+				assert.Equal(t, d.RequestID, d.Value(ctxKey{}))
+			}
+		})
+	}
+}
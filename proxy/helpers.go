@@ -1,9 +1,9 @@
 package proxy
 
 import (
+	"log/slog"
 	"net"
 
-	"github.com/AdguardTeam/golibs/log"
 	"github.com/AdguardTeam/golibs/netutil"
 	"github.com/miekg/dns"
 )
@@ -13,7 +13,7 @@ const retryNoError = 60 // Retry time for NoError SOA
 // CheckDisabledAAAARequest checks if AAAA requests should be disabled or not and sets NoError empty response to given DNSContext if needed
 func CheckDisabledAAAARequest(ctx *DNSContext, ipv6Disabled bool) bool {
 	if ipv6Disabled && ctx.Req.Question[0].Qtype == dns.TypeAAAA {
-		log.Debug("IPv6 is disabled. Reply with NoError to %s AAAA request", ctx.Req.Question[0].Name)
+		slog.Debug("ipv6 is disabled; replying with noerror to aaaa request", "name", ctx.Req.Question[0].Name)
 		ctx.Res = genEmptyNoError(ctx.Req)
 		return true
 	}
@@ -37,6 +37,12 @@ func genEmptyNoError(request *dns.Msg) *dns.Msg {
 
 // genSOA returns SOA for an authority section
 func genSOA(request *dns.Msg, retry uint32) []dns.RR {
+	return newSOA(request, defaultAuthorityNS, defaultNegativeTTL, retry)
+}
+
+// newSOA returns the authority section with the SOA record for the zone of the
+// request with the primary name server ns and the given TTL and retry time.
+func newSOA(request *dns.Msg, ns string, ttl, retry uint32) []dns.RR {
 	zone := ""
 	if len(request.Question) > 0 {
 		zone = request.Question[0].Name
@@ -49,14 +55,13 @@ func genSOA(request *dns.Msg, retry uint32) []dns.RR {
 		Retry:   retry,
 		Expire:  604800,
 		Minttl:  86400,
-		// copied from AdGuard DNS
-		Ns:     "fake-for-negative-caching.adguard.com.",
-		Serial: 100500,
+		Ns:      ns,
+		Serial:  100500,
 		// rest is request-specific
 		Hdr: dns.RR_Header{
 			Name:   zone,
 			Rrtype: dns.TypeSOA,
-			Ttl:    10,
+			Ttl:    ttl,
 			Class:  dns.ClassINET,
 		},
 	}
@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/miekg/dns"
+)
+
+// validateInsecureDomains returns an error if any of domains is invalid.
+func validateInsecureDomains(domains []string) (err error) {
+	for i, d := range domains {
+		err = netutil.ValidateDomainName(strings.TrimSuffix(d, "."))
+		if err != nil {
+			return fmt.Errorf("domain at index %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+// insecureMatcher matches the requests for the domains exempt from the DNSSEC
+// validation, see [Config.InsecureDomains].  A nil *insecureMatcher matches
+// nothing.
+type insecureMatcher struct {
+	// domains is the set of the lowercased FQDNs to match.
+	domains map[string]struct{}
+}
+
+// newInsecureMatcher returns a new matcher for domains.  It returns nil if
+// domains are empty.
+func newInsecureMatcher(domains []string) (m *insecureMatcher) {
+	if len(domains) == 0 {
+		return nil
+	}
+
+	m = &insecureMatcher{
+		domains: make(map[string]struct{}, len(domains)),
+	}
+
+	for _, d := range domains {
+		m.domains[dns.Fqdn(strings.ToLower(d))] = struct{}{}
+	}
+
+	return m
+}
+
+// match returns true if req is for one of the domains or their subdomains.
+func (m *insecureMatcher) match(req *dns.Msg) (ok bool) {
+	if m == nil || len(req.Question) == 0 {
+		return false
+	}
+
+	name := strings.ToLower(req.Question[0].Name)
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if _, ok = m.domains[name[off:]]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// replyFromUpstreamInsecure resolves the request of dctx like
+// [Proxy.replyFromUpstream], but with the CD flag set, so that the validating
+// upstreams don't answer SERVFAIL for the zones with no or a broken chain of
+// trust.  The flag is cleared in both the request and the response afterwards,
+// so that the client gets the response it asked for and the response is still
+// cached.
+func (p *Proxy) replyFromUpstreamInsecure(dctx *DNSContext) (ok bool, err error) {
+	if dctx.Req.CheckingDisabled {
+		return p.replyFromUpstream(dctx)
+	}
+
+	dctx.Req.CheckingDisabled = true
+	defer func() {
+		dctx.Req.CheckingDisabled = false
+		if dctx.Res != nil {
+			dctx.Res.CheckingDisabled = false
+		}
+	}()
+
+	return p.replyFromUpstream(dctx)
+}
@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_insecureDomains(t *testing.T) {
+	// flags are the flags of the request received by the upstream.
+	type flags struct {
+		cd bool
+		do bool
+	}
+
+	reqs := make(chan flags, 1)
+	ups := newProfileTestUpstream("192.0.2.1")
+	onExchange := ups.onExchange
+	ups.onExchange = func(req *dns.Msg) (resp *dns.Msg, err error) {
+		opt := req.IsEdns0()
+		reqs <- flags{
+			cd: req.CheckingDisabled,
+			do: opt != nil && opt.Do(),
+		}
+
+		return onExchange(req)
+	}
+
+	p := mustNew(t, &Config{
+		Logger:          testLogger,
+		UpstreamConfig:  &UpstreamConfig{Upstreams: []upstream.Upstream{ups}},
+		CacheEnabled:    true,
+		CacheSizeBytes:  defaultCacheSize,
+		InsecureDomains: []string{"Corp.Example"},
+	})
+
+	testCases := []struct {
+		name      string
+		host      string
+		wantFlags flags
+	}{{
+		name:      "not_matched",
+		host:      "example.org",
+		wantFlags: flags{cd: false, do: true},
+	}, {
+		name:      "domain",
+		host:      "corp.example",
+		wantFlags: flags{cd: true, do: false},
+	}, {
+		name:      "subdomain",
+		host:      "host.corp.example",
+		wantFlags: flags{cd: true, do: false},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			d := &DNSContext{Req: newHostTestMessage(tc.host)}
+
+			require.NoError(t, p.Resolve(d))
+			require.NotNil(t, d.Res)
+
+			assert.Equal(t, tc.wantFlags, <-reqs)
+			assert.False(t, d.Req.CheckingDisabled)
+			assert.False(t, d.Res.CheckingDisabled)
+
+			// The response is cached.
+			d = &DNSContext{Req: newHostTestMessage(tc.host)}
+
+			require.NoError(t, p.Resolve(d))
+			require.NotNil(t, d.Res)
+
+			assert.Empty(t, reqs)
+		})
+	}
+}
+
+func TestNew_insecureDomains(t *testing.T) {
+	_, err := New(&Config{
+		Logger:          testLogger,
+		UpstreamConfig:  &UpstreamConfig{Upstreams: []upstream.Upstream{newProfileTestUpstream("192.0.2.1")}},
+		InsecureDomains: []string{"corp..example"},
+	})
+	testutil.AssertErrorMsg(
+		t,
+		`validating insecure domains: domain at index 0: bad domain name "corp..example": `+
+			`bad domain name label "": domain name label is empty`,
+		err,
+	)
+}
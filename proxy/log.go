@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"cmp"
+	"log/slog"
+
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+)
+
+// levelTrace is the logging level of the messages more detailed than the debug
+// ones, like the contents of the DNS messages.
+const levelTrace = slog.LevelDebug - 4
+
+// LogSubsystem is the name of a part of the proxy which logging verbosity can
+// be configured separately, see [Config.LogLevels].
+type LogSubsystem string
+
+// LogSubsystem values.
+const (
+	// LogSubsystemServer is the subsystem of the listeners and the request
+	// processing.
+	LogSubsystemServer LogSubsystem = "server"
+
+	// LogSubsystemCache is the subsystem of the response cache.
+	LogSubsystemCache LogSubsystem = "cache"
+
+	// LogSubsystemUpstream is the subsystem of the upstream exchanges.
+	// It's also intended to be used for [upstream.Options.Logger].
+	LogSubsystemUpstream LogSubsystem = "upstream"
+
+	// LogSubsystemRatelimit is the subsystem of the ratelimiter.
+	LogSubsystemRatelimit LogSubsystem = "ratelimit"
+)
+
+// LogSubsystems are all the valid [LogSubsystem] values.
+var LogSubsystems = []LogSubsystem{
+	LogSubsystemServer,
+	LogSubsystemCache,
+	LogSubsystemUpstream,
+	LogSubsystemRatelimit,
+}
+
+// SubsystemLogger returns the logger for sub derived from base.  The records
+// are prefixed with the name of sub.  If levels contains sub, the records are
+// filtered with that level instead of the one of base, so that it can be used
+// to either increase or decrease the verbosity.  If the level is a
+// [*slog.LevelVar], its changes take effect immediately.  If base is nil,
+// [slog.Default] is used.
+func SubsystemLogger(
+	base *slog.Logger,
+	levels map[LogSubsystem]slog.Leveler,
+	sub LogSubsystem,
+) (l *slog.Logger) {
+	l = cmp.Or(base, slog.Default()).With(slogutil.KeyPrefix, string(sub))
+	if lvl, ok := levels[sub]; ok {
+		l = slog.New(slogutil.NewLevelHandler(lvl, l.Handler()))
+	}
+
+	return l
+}
+
+// initLoggers sets the loggers of the subsystems of p according to the
+// configuration.
+func (p *Proxy) initLoggers() {
+	p.logger = SubsystemLogger(p.Logger, p.LogLevels, LogSubsystemServer)
+	p.cacheLogger = SubsystemLogger(p.Logger, p.LogLevels, LogSubsystemCache)
+	p.upstreamLogger = SubsystemLogger(p.Logger, p.LogLevels, LogSubsystemUpstream)
+	p.ratelimitLogger = SubsystemLogger(p.Logger, p.LogLevels, LogSubsystemRatelimit)
+}
@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubsystemLogger(t *testing.T) {
+	buf := &bytes.Buffer{}
+	base := slog.New(slog.NewTextHandler(buf, &slog.HandlerOptions{
+		Level: slog.LevelInfo,
+	}))
+
+	levels := map[LogSubsystem]slog.Leveler{
+		LogSubsystemCache:    slog.LevelDebug,
+		LogSubsystemUpstream: slog.LevelError,
+	}
+
+	testCases := []struct {
+		sub       LogSubsystem
+		name      string
+		wantDebug bool
+		wantInfo  bool
+	}{{
+		sub:       LogSubsystemServer,
+		name:      "default",
+		wantDebug: false,
+		wantInfo:  true,
+	}, {
+		sub:       LogSubsystemCache,
+		name:      "more_verbose",
+		wantDebug: true,
+		wantInfo:  true,
+	}, {
+		sub:       LogSubsystemUpstream,
+		name:      "less_verbose",
+		wantDebug: false,
+		wantInfo:  false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			buf.Reset()
+
+			l := SubsystemLogger(base, levels, tc.sub)
+			l.Debug("debug message")
+			l.Info("info message")
+
+			out := buf.String()
+			assert.Equal(t, tc.wantDebug, strings.Contains(out, "debug message"), out)
+			assert.Equal(t, tc.wantInfo, strings.Contains(out, "info message"), out)
+
+			if tc.wantInfo {
+				assert.Contains(t, out, "prefix="+string(tc.sub))
+			}
+		})
+	}
+}
+
+func TestSubsystemLogger_levelVar(t *testing.T) {
+	buf := &bytes.Buffer{}
+	base := slog.New(slog.NewTextHandler(buf, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+	}))
+
+	lvl := &slog.LevelVar{}
+	lvl.Set(slog.LevelInfo)
+
+	l := SubsystemLogger(base, map[LogSubsystem]slog.Leveler{LogSubsystemCache: lvl}, LogSubsystemCache)
+
+	l.Debug("first debug message")
+	assert.NotContains(t, buf.String(), "first debug message")
+
+	lvl.Set(slog.LevelDebug)
+
+	l.Debug("second debug message")
+	assert.Contains(t, buf.String(), "second debug message")
+}
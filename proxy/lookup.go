@@ -24,7 +24,10 @@ func (p *Proxy) lookupIPAddr(host string, qtype uint16, ch chan *lookupResult) {
 
 	d := p.newDNSContext(ProtoUDP, req)
 	err := p.Resolve(d)
-	ch <- &lookupResult{d.Res, err}
+	res := d.Res
+	p.releaseDNSContext(d)
+
+	ch <- &lookupResult{res, err}
 }
 
 // ErrEmptyHost is returned by LookupIPAddr when the host is empty and can't be
@@ -39,3 +39,17 @@ func TestLookupNetIP(t *testing.T) {
 		assert.Contains(t, addrs, netip.MustParseAddr("2001:4860:4860::8844"))
 	}
 }
+
+func TestProxy_NetResolver(t *testing.T) {
+	p := mustNew(t, &Config{
+		Logger: testLogger,
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{newProfileTestUpstream("192.0.2.1")},
+		},
+	})
+
+	addrs, err := p.NetResolver().LookupNetIP(context.Background(), "ip4", "netresolver.example.")
+	require.NoError(t, err)
+
+	assert.Equal(t, []netip.Addr{netip.MustParseAddr("192.0.2.1")}, addrs)
+}
@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+)
+
+// MessageTap is an object that receives the DNS messages passing through the
+// proxy, e.g. to export them in the dnstap format.  All methods must be safe
+// for concurrent use and must not modify the messages.  The passed contexts
+// must not be retained after the methods return if
+// [Config.EnableDNSContextPooling] is set.
+type MessageTap interface {
+	// OnClientQuery is called when the request has been received from the
+	// client.  queryTime is the time the request has been received at.  d must
+	// not be retained, see the interface documentation.
+	OnClientQuery(d *DNSContext, queryTime time.Time)
+
+	// OnClientResponse is called when the response to d.Req has been sent to
+	// the client.  d.Res is never nil.  d must not be retained, see the
+	// interface documentation.
+	OnClientResponse(d *DNSContext, queryTime, respTime time.Time)
+
+	// OnUpstreamExchange is called when the exchange of req with u has been
+	// finished.  resp is nil if the exchange failed.
+	OnUpstreamExchange(u upstream.Upstream, req, resp *dns.Msg, queryTime, respTime time.Time)
+}
+
+// EmptyMessageTap is a [MessageTap] that does nothing.
+type EmptyMessageTap struct{}
+
+// type check
+var _ MessageTap = EmptyMessageTap{}
+
+// OnClientQuery implements the [MessageTap] interface for EmptyMessageTap.
+func (EmptyMessageTap) OnClientQuery(_ *DNSContext, _ time.Time) {}
+
+// OnClientResponse implements the [MessageTap] interface for EmptyMessageTap.
+func (EmptyMessageTap) OnClientResponse(_ *DNSContext, _, _ time.Time) {}
+
+// OnUpstreamExchange implements the [MessageTap] interface for
+// EmptyMessageTap.
+func (EmptyMessageTap) OnUpstreamExchange(_ upstream.Upstream, _, _ *dns.Msg, _, _ time.Time) {}
+
+// MultiMessageTap is a [MessageTap] that passes the messages to each of the
+// taps in order.
+type MultiMessageTap []MessageTap
+
+// type check
+var _ MessageTap = MultiMessageTap(nil)
+
+// OnClientQuery implements the [MessageTap] interface for MultiMessageTap.
+func (m MultiMessageTap) OnClientQuery(d *DNSContext, queryTime time.Time) {
+	for _, t := range m {
+		t.OnClientQuery(d, queryTime)
+	}
+}
+
+// OnClientResponse implements the [MessageTap] interface for MultiMessageTap.
+func (m MultiMessageTap) OnClientResponse(d *DNSContext, queryTime, respTime time.Time) {
+	for _, t := range m {
+		t.OnClientResponse(d, queryTime, respTime)
+	}
+}
+
+// OnUpstreamExchange implements the [MessageTap] interface for
+// MultiMessageTap.
+func (m MultiMessageTap) OnUpstreamExchange(
+	u upstream.Upstream,
+	req *dns.Msg,
+	resp *dns.Msg,
+	queryTime time.Time,
+	respTime time.Time,
+) {
+	for _, t := range m {
+		t.OnUpstreamExchange(u, req, resp, queryTime, respTime)
+	}
+}
@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// MetricsListener is an object that receives the events of the request
+// processing to collect the statistics.  All methods must be safe for
+// concurrent use.
+type MetricsListener interface {
+	// OnRequest is called when the request has been processed.  resp is the
+	// response sent to the client, it's nil if the request has been dropped.
+	// elapsed is the total time spent on processing the request.
+	OnRequest(proto Proto, resp *dns.Msg, elapsed time.Duration)
+
+	// OnCacheLookup is called when the cache is looked up for the response.
+	// hit is true if the response has been found in the cache.
+	OnCacheLookup(hit bool)
+
+	// OnUpstreamExchange is called when the exchange with the upstream has been
+	// finished.  addr is the address of the upstream, rtt is the time spent on
+	// the exchange, and err is the exchange error, if any.
+	OnUpstreamExchange(addr string, rtt time.Duration, err error)
+
+	// OnRatelimited is called when the request has been dropped due to
+	// ratelimiting.
+	OnRatelimited(proto Proto)
+
+	// OnConnectionOpened is called when a new client connection has been
+	// accepted.  It's only called for the connection-oriented protocols.
+	OnConnectionOpened(proto Proto)
+
+	// OnConnectionClosed is called when the previously accepted client
+	// connection has been closed.
+	OnConnectionClosed(proto Proto)
+}
+
+// EmptyMetricsListener is a [MetricsListener] that does nothing.
+type EmptyMetricsListener struct{}
+
+// type check
+var _ MetricsListener = EmptyMetricsListener{}
+
+// OnRequest implements the [MetricsListener] interface for
+// EmptyMetricsListener.
+func (EmptyMetricsListener) OnRequest(_ Proto, _ *dns.Msg, _ time.Duration) {}
+
+// OnCacheLookup implements the [MetricsListener] interface for
+// EmptyMetricsListener.
+func (EmptyMetricsListener) OnCacheLookup(_ bool) {}
+
+// OnUpstreamExchange implements the [MetricsListener] interface for
+// EmptyMetricsListener.
+func (EmptyMetricsListener) OnUpstreamExchange(_ string, _ time.Duration, _ error) {}
+
+// OnRatelimited implements the [MetricsListener] interface for
+// EmptyMetricsListener.
+func (EmptyMetricsListener) OnRatelimited(_ Proto) {}
+
+// OnConnectionOpened implements the [MetricsListener] interface for
+// EmptyMetricsListener.
+func (EmptyMetricsListener) OnConnectionOpened(_ Proto) {}
+
+// OnConnectionClosed implements the [MetricsListener] interface for
+// EmptyMetricsListener.
+func (EmptyMetricsListener) OnConnectionClosed(_ Proto) {}
+
+// MultiMetricsListener is a [MetricsListener] that passes the events to each of
+// the listeners in order.
+type MultiMetricsListener []MetricsListener
+
+// type check
+var _ MetricsListener = MultiMetricsListener(nil)
+
+// OnRequest implements the [MetricsListener] interface for
+// MultiMetricsListener.
+func (m MultiMetricsListener) OnRequest(proto Proto, resp *dns.Msg, elapsed time.Duration) {
+	for _, l := range m {
+		l.OnRequest(proto, resp, elapsed)
+	}
+}
+
+// OnCacheLookup implements the [MetricsListener] interface for
+// MultiMetricsListener.
+func (m MultiMetricsListener) OnCacheLookup(hit bool) {
+	for _, l := range m {
+		l.OnCacheLookup(hit)
+	}
+}
+
+// OnUpstreamExchange implements the [MetricsListener] interface for
+// MultiMetricsListener.
+func (m MultiMetricsListener) OnUpstreamExchange(addr string, rtt time.Duration, err error) {
+	for _, l := range m {
+		l.OnUpstreamExchange(addr, rtt, err)
+	}
+}
+
+// OnRatelimited implements the [MetricsListener] interface for
+// MultiMetricsListener.
+func (m MultiMetricsListener) OnRatelimited(proto Proto) {
+	for _, l := range m {
+		l.OnRatelimited(proto)
+	}
+}
+
+// OnConnectionOpened implements the [MetricsListener] interface for
+// MultiMetricsListener.
+func (m MultiMetricsListener) OnConnectionOpened(proto Proto) {
+	for _, l := range m {
+		l.OnConnectionOpened(proto)
+	}
+}
+
+// OnConnectionClosed implements the [MetricsListener] interface for
+// MultiMetricsListener.
+func (m MultiMetricsListener) OnConnectionClosed(proto Proto) {
+	for _, l := range m {
+		l.OnConnectionClosed(proto)
+	}
+}
@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testMetricsListener is a [MetricsListener] implementation that records the
+// received events.
+type testMetricsListener struct {
+	// EmptyMetricsListener is embedded here to avoid implementing the methods
+	// which aren't used in tests.
+	EmptyMetricsListener
+
+	// mu protects the fields below.
+	mu *sync.Mutex
+
+	rcodes    []int
+	cacheHits []bool
+	upstreams []string
+}
+
+// type check
+var _ MetricsListener = (*testMetricsListener)(nil)
+
+// OnRequest implements the [MetricsListener] interface for
+// *testMetricsListener.
+func (l *testMetricsListener) OnRequest(_ Proto, resp *dns.Msg, _ time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.rcodes = append(l.rcodes, resp.Rcode)
+}
+
+// OnCacheLookup implements the [MetricsListener] interface for
+// *testMetricsListener.
+func (l *testMetricsListener) OnCacheLookup(hit bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.cacheHits = append(l.cacheHits, hit)
+}
+
+// OnUpstreamExchange implements the [MetricsListener] interface for
+// *testMetricsListener.
+func (l *testMetricsListener) OnUpstreamExchange(addr string, _ time.Duration, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err == nil {
+		l.upstreams = append(l.upstreams, addr)
+	}
+}
+
+func TestProxy_MetricsListener(t *testing.T) {
+	const upsAddr = "fake"
+
+	ml := &testMetricsListener{
+		mu: &sync.Mutex{},
+	}
+
+	p := mustNew(t, &Config{
+		UDPListenAddr: []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{&fakeUpstream{
+				onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+					resp = (&dns.Msg{}).SetReply(req)
+					resp.Answer = []dns.RR{&dns.A{
+						Hdr: dns.RR_Header{
+							Name:   req.Question[0].Name,
+							Rrtype: dns.TypeA,
+							Class:  dns.ClassINET,
+							Ttl:    defaultTestTTL,
+						},
+						A: net.IP{1, 2, 3, 4},
+					}}
+
+					return resp, nil
+				},
+				onAddress: func() (addr string) { return upsAddr },
+				onClose:   func() (err error) { return nil },
+			}},
+		},
+		TrustedProxies:  defaultTrustedProxies,
+		CacheEnabled:    true,
+		CacheSizeBytes:  defaultCacheSize,
+		MetricsListener: ml,
+	})
+
+	ctx := context.Background()
+	require.NoError(t, p.Start(ctx))
+	testutil.CleanupAndRequireSuccess(t, func() (err error) { return p.Shutdown(ctx) })
+
+	client := &dns.Client{Net: string(ProtoUDP), Timeout: defaultTimeout}
+	addr := p.Addr(ProtoUDP).String()
+
+	for range 2 {
+		req := newHostTestMessage("metrics.example")
+		_, _, err := client.Exchange(req, addr)
+		require.NoError(t, err)
+	}
+
+	// Make sure the deferred call finished.
+	require.Eventually(t, func() (ok bool) {
+		ml.mu.Lock()
+		defer ml.mu.Unlock()
+
+		return len(ml.rcodes) == 2
+	}, defaultTimeout, defaultTimeout/100)
+
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+
+	assert.Equal(t, []int{dns.RcodeSuccess, dns.RcodeSuccess}, ml.rcodes)
+	assert.Equal(t, []bool{false, true}, ml.cacheHits)
+	assert.Equal(t, []string{upsAddr}, ml.upstreams)
+}
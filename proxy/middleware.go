@@ -0,0 +1,54 @@
+package proxy
+
+import "github.com/AdguardTeam/golibs/errors"
+
+// Middleware wraps the handling of the requests, so that the custom logic can
+// be composed from independent parts, like access control, logging, and
+// filtering.  The returned handler receives each request which has passed the
+// [BeforeRequestHandler], the ratelimiting, and the validation, and may:
+//
+//   - pass the request through by calling next;
+//   - short-circuit by setting [DNSContext.Res] and returning without calling
+//     next, in which case the response is sent as is;
+//   - annotate the request with [DNSContext.SetValue] for the following
+//     middlewares and the handlers;
+//   - inspect or modify [DNSContext.Res] after next returns.
+//
+// next is the rest of the chain ending with the middlewares of the profile of
+// the request, see [Profile.Middlewares], and then [Config.RequestHandler] or
+// [Proxy.Resolve].  The errors are handled the same way as the ones of
+// [RequestHandler], and the contexts must not be retained the same way either.
+type Middleware func(next RequestHandler) (h RequestHandler)
+
+// Use appends mws to the middleware chain of p.  The first added middleware is
+// the outermost one, so it's called first.  It must not be called after
+// [Proxy.Start], since the chain is built on start.
+func (p *Proxy) Use(mws ...Middleware) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.middlewares = append(p.middlewares, mws...)
+}
+
+// buildHandler returns the handler of the requests wrapped into the middleware
+// chain of p.
+func (p *Proxy) buildHandler() (h RequestHandler) {
+	h = p.handleProfile
+	for i := len(p.middlewares) - 1; i >= 0; i-- {
+		h = p.middlewares[i](h)
+	}
+
+	return h
+}
+
+// resolveRequest is the innermost handler of the middleware chain.  It mirrors
+// the request and resolves it using the custom handler, if any.
+func (p *Proxy) resolveRequest(_ *Proxy, d *DNSContext) (err error) {
+	p.mirror(d.Req)
+
+	if p.RequestHandler != nil {
+		return errors.Annotate(p.RequestHandler(p, d), "using request handler: %w")
+	}
+
+	return errors.Annotate(p.Resolve(d), "using default request handler: %w")
+}
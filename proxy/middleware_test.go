@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// middlewareTestKey is the type of the keys of the annotations set in tests.
+type middlewareTestKey struct{}
+
+func TestProxy_Use(t *testing.T) {
+	const blockedHost = "blocked.example"
+
+	// mu protects calls and annotation, which are set by the handlers.
+	mu := &sync.Mutex{}
+
+	var calls []string
+	record := func(name string) (mw Middleware) {
+		return func(next RequestHandler) (h RequestHandler) {
+			return func(p *Proxy, dctx *DNSContext) (err error) {
+				mu.Lock()
+				calls = append(calls, name)
+				mu.Unlock()
+
+				return next(p, dctx)
+			}
+		}
+	}
+
+	acl := func(next RequestHandler) (h RequestHandler) {
+		return func(p *Proxy, dctx *DNSContext) (err error) {
+			if dctx.Req.Question[0].Name == dns.Fqdn(blockedHost) {
+				dctx.Res = (&dns.Msg{}).SetRcode(dctx.Req, dns.RcodeRefused)
+
+				return nil
+			}
+
+			dctx.SetValue(middlewareTestKey{}, "allowed")
+
+			return next(p, dctx)
+		}
+	}
+
+	var annotation any
+	inspect := func(next RequestHandler) (h RequestHandler) {
+		return func(p *Proxy, dctx *DNSContext) (err error) {
+			mu.Lock()
+			annotation = dctx.Value(middlewareTestKey{})
+			mu.Unlock()
+
+			return next(p, dctx)
+		}
+	}
+
+	p := mustNew(t, &Config{
+		Logger:        testLogger,
+		UDPListenAddr: []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{newProfileTestUpstream("192.0.2.1")},
+		},
+		TrustedProxies: defaultTrustedProxies,
+	})
+	p.Use(record("first"), acl, record("second"))
+	p.Use(inspect)
+
+	ctx := context.Background()
+	require.NoError(t, p.Start(ctx))
+	testutil.CleanupAndRequireSuccess(t, func() (err error) { return p.Shutdown(ctx) })
+
+	client := &dns.Client{Net: string(ProtoUDP), Timeout: defaultTimeout}
+	addr := p.Addr(ProtoUDP).String()
+
+	reset := func() {
+		mu.Lock()
+		defer mu.Unlock()
+
+		calls, annotation = nil, nil
+	}
+
+	t.Run("pass", func(t *testing.T) {
+		reset()
+
+		resp, _, err := client.Exchange(newHostTestMessage("allowed.example"), addr)
+		require.NoError(t, err)
+		require.NotEmpty(t, resp.Answer)
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		assert.Equal(t, []string{"first", "second"}, calls)
+		assert.Equal(t, "allowed", annotation)
+	})
+
+	t.Run("short_circuit", func(t *testing.T) {
+		reset()
+
+		resp, _, err := client.Exchange(newHostTestMessage(blockedHost), addr)
+		require.NoError(t, err)
+
+		assert.Equal(t, dns.RcodeRefused, resp.Rcode)
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		assert.Equal(t, []string{"first"}, calls)
+		assert.Nil(t, annotation)
+	})
+}
+
+func TestDNSContextValue(t *testing.T) {
+	dctx := &DNSContext{}
+
+	_, ok := DNSContextValue[string](dctx, middlewareTestKey{})
+	assert.False(t, ok)
+
+	dctx.SetValue(middlewareTestKey{}, "tenant")
+
+	val, ok := DNSContextValue[string](dctx, middlewareTestKey{})
+	assert.True(t, ok)
+	assert.Equal(t, "tenant", val)
+
+	_, ok = DNSContextValue[int](dctx, middlewareTestKey{})
+	assert.False(t, ok)
+}
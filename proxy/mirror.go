@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/miekg/dns"
+)
+
+// mirrorMaxInFlight is the maximum number of the mirrored requests being
+// exchanged at once.  The requests exceeding it aren't mirrored, so that a slow
+// mirror upstream doesn't affect the proxy.
+const mirrorMaxInFlight = 256
+
+// validateMirror returns an error if the mirroring configuration is invalid.
+func (p *Proxy) validateMirror() (err error) {
+	if p.MirrorPercentage > 100 {
+		return fmt.Errorf("mirror percentage: value %d greater than max 100", p.MirrorPercentage)
+	}
+
+	return nil
+}
+
+// initMirror initializes the mirroring of the requests.
+func (p *Proxy) initMirror() {
+	if p.MirrorUpstream == nil || p.MirrorPercentage == 0 {
+		p.mirrorSema = nil
+
+		return
+	}
+
+	p.logger.Info(
+		"mirroring requests",
+		"upstream", p.MirrorUpstream.Address(),
+		"percentage", p.MirrorPercentage,
+	)
+
+	p.mirrorSema = make(chan struct{}, mirrorMaxInFlight)
+}
+
+// mirror sends the copy of req to the mirror upstream in a separate goroutine,
+// if req is selected according to the configured percentage and the proxy isn't
+// in the cache-only mode.  The response is discarded.
+func (p *Proxy) mirror(req *dns.Msg) {
+	if p.mirrorSema == nil || p.cacheOnly.Load() || rand.UintN(100) >= p.MirrorPercentage {
+		return
+	}
+
+	select {
+	case p.mirrorSema <- struct{}{}:
+	default:
+		p.upstreamLogger.Debug("too many mirrored requests in flight, skipping")
+
+		return
+	}
+
+	req = req.Copy()
+	if p.PrivacyMode {
+		removeECS(req)
+	}
+
+	go func() {
+		defer func() { <-p.mirrorSema }()
+		defer slogutil.RecoverAndLog(context.TODO(), p.upstreamLogger)
+
+		_, err := p.MirrorUpstream.Exchange(req)
+		if err != nil {
+			p.upstreamLogger.Debug(
+				"exchanging mirrored request",
+				"upstream", p.MirrorUpstream.Address(),
+				slogutil.KeyError, err,
+			)
+		}
+	}()
+}
@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_mirror(t *testing.T) {
+	const mirrorAddr = "mirror"
+
+	mirrored := make(chan *dns.Msg, 1)
+	mirrorUps := &fakeUpstream{
+		onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			mirrored <- req
+
+			return nil, assert.AnError
+		},
+		onAddress: func() (addr string) { return mirrorAddr },
+		onClose:   func() (err error) { return nil },
+	}
+
+	ups := &fakeUpstream{
+		onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			return (&dns.Msg{}).SetReply(req), nil
+		},
+		onAddress: func() (addr string) { return "ups" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	p := mustNew(t, &Config{
+		Logger:        testLogger,
+		UDPListenAddr: []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{ups},
+		},
+		TrustedProxies:   defaultTrustedProxies,
+		MirrorUpstream:   mirrorUps,
+		MirrorPercentage: 100,
+	})
+
+	ctx := context.Background()
+	require.NoError(t, p.Start(ctx))
+	testutil.CleanupAndRequireSuccess(t, func() (err error) { return p.Shutdown(ctx) })
+
+	client := &dns.Client{Net: string(ProtoUDP), Timeout: defaultTimeout}
+	addr := p.Addr(ProtoUDP).String()
+
+	// The mirror upstream failure doesn't affect the client.
+	resp, _, err := client.Exchange(newHostTestMessage("mirror.example"), addr)
+	require.NoError(t, err)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+
+	req, ok := testutil.RequireReceive(t, mirrored, defaultTimeout)
+	require.True(t, ok)
+
+	assert.Equal(t, "mirror.example.", req.Question[0].Name)
+}
+
+func TestProxy_validateMirror(t *testing.T) {
+	_, err := New(&Config{
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{&fakeUpstream{}},
+		},
+		TrustedProxies:   defaultTrustedProxies,
+		MirrorPercentage: 101,
+	})
+	assert.Error(t, err)
+}
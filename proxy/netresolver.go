@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"context"
+	"net"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+)
+
+// NetResolver returns a *net.Resolver resolving the names with p, the same way
+// [Proxy.LookupNetIP] does, so that the name resolution of the standard library
+// could use the upstreams, the cache, and the other features of p.  See
+// [upstream.NewNetResolver].
+func (p *Proxy) NetResolver() (r *net.Resolver) {
+	return upstream.NewNetResolver(&resolveUpstream{proxy: p})
+}
+
+// resolveUpstream is the [upstream.Upstream] resolving the queries with
+// [Proxy.Resolve].
+type resolveUpstream struct {
+	// proxy resolves the queries.
+	proxy *Proxy
+}
+
+// type check
+var (
+	_ upstream.Upstream         = (*resolveUpstream)(nil)
+	_ upstream.ContextExchanger = (*resolveUpstream)(nil)
+)
+
+// Exchange implements the [upstream.Upstream] interface for *resolveUpstream.
+func (u *resolveUpstream) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	return u.ExchangeContext(context.Background(), req)
+}
+
+// ExchangeContext implements the [upstream.ContextExchanger] interface for
+// *resolveUpstream.  ctx becomes the context of the request, see
+// [DNSContext.Context].
+func (u *resolveUpstream) ExchangeContext(
+	ctx context.Context,
+	req *dns.Msg,
+) (resp *dns.Msg, err error) {
+	p := u.proxy
+
+	d := p.newDNSContext(ProtoUDP, req)
+	err = p.ResolveContext(ctx, d)
+	resp = d.Res
+	p.releaseDNSContext(d)
+
+	return resp, err
+}
+
+// Address implements the [upstream.Upstream] interface for *resolveUpstream.
+func (u *resolveUpstream) Address() (addr string) { return "dnsproxy" }
+
+// Close implements the [upstream.Upstream] interface for *resolveUpstream.  It
+// does nothing, since the proxy is closed separately.
+func (u *resolveUpstream) Close() (err error) { return nil }
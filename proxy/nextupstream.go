@@ -0,0 +1,28 @@
+package proxy
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/miekg/dns"
+)
+
+// validateNextUpstreamRcodes returns an error if any of rcodes is invalid.
+func validateNextUpstreamRcodes(rcodes []int) (err error) {
+	for i, rcode := range rcodes {
+		if _, ok := dns.RcodeToString[rcode]; !ok {
+			return fmt.Errorf("rcode at index %d: unknown value %d", i, rcode)
+		} else if rcode == dns.RcodeSuccess || rcode == dns.RcodeNameError {
+			return fmt.Errorf("rcode at index %d: %s is not a failure", i, dns.RcodeToString[rcode])
+		}
+	}
+
+	return nil
+}
+
+// isNextUpstreamRcode returns true if resp has one of
+// [Config.NextUpstreamRcodes], so that the request should be sent to the next
+// upstream.  resp must not be nil.
+func (p *Proxy) isNextUpstreamRcode(resp *dns.Msg) (ok bool) {
+	return slices.Contains(p.NextUpstreamRcodes, resp.Rcode)
+}
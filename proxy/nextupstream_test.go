@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newRcodeUpstream returns a new *fakeUpstream with the address addr, which
+// responds with rcode and counts the requests in n.
+func newRcodeUpstream(addr string, rcode int, n *int) (u *fakeUpstream) {
+	return &fakeUpstream{
+		onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			*n++
+
+			return (&dns.Msg{}).SetRcode(req, rcode), nil
+		},
+		onAddress: func() (a string) { return addr },
+		onClose:   func() (err error) { return nil },
+	}
+}
+
+func TestProxy_Resolve_nextUpstreamRcodes(t *testing.T) {
+	newProxy := func(t *testing.T, ups ...upstream.Upstream) (p *Proxy) {
+		t.Helper()
+
+		return mustNew(t, &Config{
+			Logger:             testLogger,
+			UDPListenAddr:      []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+			UpstreamConfig:     &UpstreamConfig{Upstreams: ups},
+			TrustedProxies:     defaultTrustedProxies,
+			UpstreamMode:       UModeLoadBalance,
+			NextUpstreamRcodes: []int{dns.RcodeServerFailure, dns.RcodeRefused},
+		})
+	}
+
+	t.Run("next", func(t *testing.T) {
+		var failed, succeeded int
+		p := newProxy(
+			t,
+			newRcodeUpstream("failing", dns.RcodeServerFailure, &failed),
+			newRcodeUpstream("working", dns.RcodeSuccess, &succeeded),
+		)
+
+		const reqNum = 10
+		for range reqNum {
+			d := &DNSContext{Req: newHostTestMessage("example.org")}
+			require.NoError(t, p.Resolve(d))
+
+			assert.Equal(t, dns.RcodeSuccess, d.Res.Rcode)
+		}
+
+		assert.Equal(t, reqNum, succeeded)
+	})
+
+	t.Run("all_failing", func(t *testing.T) {
+		var servfail, refused int
+		p := newProxy(
+			t,
+			newRcodeUpstream("servfail", dns.RcodeServerFailure, &servfail),
+			newRcodeUpstream("refused", dns.RcodeRefused, &refused),
+		)
+
+		d := &DNSContext{Req: newHostTestMessage("example.org")}
+		require.NoError(t, p.Resolve(d))
+
+		assert.Contains(t, []int{dns.RcodeServerFailure, dns.RcodeRefused}, d.Res.Rcode)
+		assert.Equal(t, 1, servfail)
+		assert.Equal(t, 1, refused)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := New(&Config{
+			UDPListenAddr: []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+			UpstreamConfig: &UpstreamConfig{
+				Upstreams: []upstream.Upstream{newRcodeUpstream("ups", dns.RcodeSuccess, new(int))},
+			},
+			TrustedProxies:     defaultTrustedProxies,
+			NextUpstreamRcodes: []int{dns.RcodeServerFailure, dns.RcodeNameError},
+		})
+		testutil.AssertErrorMsg(
+			t,
+			"validating next upstream rcodes: rcode at index 1: NXDOMAIN is not a failure",
+			err,
+		)
+	})
+}
@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+
+	"github.com/miekg/dns"
+)
+
+// NotifyHandler is an object that handles the changes of the zones the
+// primary servers notify about.
+type NotifyHandler interface {
+	// HandleNotify is called for each accepted NOTIFY message about zone, after
+	// the cached responses for it have been flushed.  It's called from the
+	// request handling goroutine, so it should return quickly.
+	HandleNotify(ctx context.Context, zone string)
+}
+
+// NotifyConfig is the configuration of handling the NOTIFY messages, see RFC
+// 1996.  The messages from the primary servers are answered by the proxy
+// itself, instead of being forwarded to the upstreams, and the cached
+// responses for the names within the zone are flushed.
+type NotifyConfig struct {
+	// Handler, if not nil, is called for each accepted message, for example,
+	// to refresh the data of the zone.
+	Handler NotifyHandler
+
+	// Masters are the networks of the primary servers allowed to notify about
+	// the changes.  The messages from other addresses are refused, unless
+	// signed with one of AllowedKeys.
+	Masters []netip.Prefix
+
+	// AllowedKeys are the names of the keys from [Config.TSIGKeys], the
+	// messages signed with which are accepted regardless of the address.
+	AllowedKeys []string
+}
+
+// validate returns an error if c is invalid.  c may be nil.
+func (c *NotifyConfig) validate() (err error) {
+	if c == nil {
+		return nil
+	}
+
+	for i, pref := range c.Masters {
+		if !pref.IsValid() {
+			return fmt.Errorf("master at index %d: bad prefix", i)
+		}
+	}
+
+	return nil
+}
+
+// handleNotify answers the NOTIFY message in d, if it's one and [Config.Notify]
+// is set, and flushes the cache for the zone.  resp is nil if the request isn't
+// a NOTIFY message.
+func (p *Proxy) handleNotify(d *DNSContext) (resp *dns.Msg) {
+	conf := p.Notify
+	if conf == nil || d.Req.Opcode != dns.OpcodeNotify {
+		return nil
+	}
+
+	addr := p.anonymizer.addrPort(d.Addr)
+	if !isClientAllowed(d, conf.Masters, conf.AllowedKeys) {
+		p.logger.Debug("notify refused", "addr", addr)
+
+		return reply(d.Req, dns.RcodeRefused)
+	}
+
+	zone := d.Req.Question[0].Name
+	p.logger.Debug("notify accepted", "addr", addr, "zone", zone)
+
+	p.flushZoneCache(zone)
+	if conf.Handler != nil {
+		conf.Handler.HandleNotify(context.TODO(), zone)
+	}
+
+	resp = reply(d.Req, dns.RcodeSuccess)
+	resp.Authoritative = true
+
+	return resp
+}
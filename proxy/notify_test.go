@@ -0,0 +1,161 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeNotifyHandler is the function-based implementation of the
+// [NotifyHandler] interface.
+type fakeNotifyHandler struct {
+	onHandleNotify func(ctx context.Context, zone string)
+}
+
+// type check
+var _ NotifyHandler = (*fakeNotifyHandler)(nil)
+
+// HandleNotify implements the [NotifyHandler] interface for
+// *fakeNotifyHandler.
+func (h *fakeNotifyHandler) HandleNotify(ctx context.Context, zone string) {
+	h.onHandleNotify(ctx, zone)
+}
+
+func TestProxy_notify(t *testing.T) {
+	const zone = "example.org."
+
+	testCases := []struct {
+		master      netip.Prefix
+		name        string
+		wantZone    string
+		wantRcode   int
+		wantQueries int32
+	}{{
+		master:      netip.MustParsePrefix("127.0.0.0/8"),
+		name:        "allowed",
+		wantZone:    zone,
+		wantRcode:   dns.RcodeSuccess,
+		wantQueries: 2,
+	}, {
+		master:      netip.MustParsePrefix("192.0.2.0/24"),
+		name:        "refused",
+		wantZone:    "",
+		wantRcode:   dns.RcodeRefused,
+		wantQueries: 1,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var queries, notifies atomic.Int32
+			ups := &fakeUpstream{
+				onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+					if req.Opcode == dns.OpcodeNotify {
+						notifies.Add(1)
+
+						return reply(req, dns.RcodeSuccess), nil
+					}
+
+					queries.Add(1)
+					resp = (&dns.Msg{}).SetReply(req)
+					resp.Answer = []dns.RR{newRR(t, req.Question[0].Name, dns.TypeA, 60, net.IP{192, 0, 2, 1})}
+
+					return resp, nil
+				},
+				onAddress: func() (addr string) { return "upstream.example" },
+				onClose:   func() (err error) { return nil },
+			}
+
+			zones := make(chan string, 1)
+			p := mustNew(t, &Config{
+				Logger:        testLogger,
+				UDPListenAddr: []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+				TCPListenAddr: []*net.TCPAddr{net.TCPAddrFromAddrPort(localhostAnyPort)},
+				UpstreamConfig: &UpstreamConfig{
+					Upstreams: []upstream.Upstream{ups},
+				},
+				TrustedProxies: defaultTrustedProxies,
+				CacheEnabled:   true,
+				Notify: &NotifyConfig{
+					Handler: &fakeNotifyHandler{
+						onHandleNotify: func(_ context.Context, z string) { zones <- z },
+					},
+					Masters: []netip.Prefix{tc.master},
+				},
+			})
+
+			ctx := context.Background()
+			require.NoError(t, p.Start(ctx))
+			testutil.CleanupAndRequireSuccess(t, func() (err error) { return p.Shutdown(ctx) })
+
+			client := &dns.Client{Net: string(ProtoUDP), Timeout: defaultTimeout}
+			addr := p.Addr(ProtoUDP).String()
+			req := (&dns.Msg{}).SetQuestion("www."+zone, dns.TypeA)
+
+			// Cache the response.
+			for range 2 {
+				_, _, err := client.Exchange(req, addr)
+				require.NoError(t, err)
+			}
+
+			notify := (&dns.Msg{}).SetNotify(zone)
+			resp, _, err := client.Exchange(notify, addr)
+			require.NoError(t, err)
+
+			assert.Equal(t, tc.wantRcode, resp.Rcode)
+			assert.Equal(t, dns.OpcodeNotify, resp.Opcode)
+
+			// The handler is called before the response is sent.
+			var gotZone string
+			select {
+			case gotZone = <-zones:
+			default:
+			}
+
+			assert.Equal(t, tc.wantZone, gotZone)
+
+			_, _, err = client.Exchange(req, addr)
+			require.NoError(t, err)
+
+			assert.Equal(t, tc.wantQueries, queries.Load())
+
+			// NOTIFY messages are never forwarded.
+			assert.Zero(t, notifies.Load())
+		})
+	}
+}
+
+func TestNotifyConfig_validate(t *testing.T) {
+	testCases := []struct {
+		conf       *NotifyConfig
+		name       string
+		wantErrMsg string
+	}{{
+		conf:       nil,
+		name:       "nil",
+		wantErrMsg: "",
+	}, {
+		conf:       &NotifyConfig{},
+		name:       "empty",
+		wantErrMsg: "",
+	}, {
+		conf: &NotifyConfig{
+			Masters: []netip.Prefix{{}},
+		},
+		name:       "bad_prefix",
+		wantErrMsg: "master at index 0: bad prefix",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, tc.conf.validate())
+		})
+	}
+}
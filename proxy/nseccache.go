@@ -0,0 +1,680 @@
+package proxy
+
+import (
+	"cmp"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/mathutil"
+	"github.com/miekg/dns"
+)
+
+// nsecMaxRecords is the maximum number of the NSEC and NSEC3 records stored by
+// a single [nsecCache].
+const nsecMaxRecords = 10_000
+
+// nsec3MaxIterations is the maximum number of the additional iterations of the
+// NSEC3 hash the records are used with, see RFC 9276.
+const nsec3MaxIterations = 150
+
+// nsec3FlagOptOut is the Opt-Out flag of the NSEC3 records, see RFC 5155.
+const nsec3FlagOptOut = 1
+
+// nsecCache stores the NSEC and NSEC3 records of the validated responses to
+// synthesize the negative responses for the names and types those prove
+// absent, see RFC 8198.
+type nsecCache struct {
+	// mu protects zones and records.
+	mu *sync.Mutex
+
+	// zones maps the lowercased names of the signed zones to their records.
+	// It's never nil.
+	zones map[string]*nsecZone
+
+	// clock is used to get the current time for the expiration of the records.
+	// It's never nil.
+	clock Clock
+
+	// records is the total number of the stored NSEC and NSEC3 records.
+	records int
+}
+
+// nsecZone is the set of the records of a single signed zone.
+type nsecZone struct {
+	// soa is the SOA record of the zone, which is used in the synthesized
+	// responses.  It's never nil.
+	soa *nsecRecord
+
+	// nsec are the NSEC records of the zone sorted by the canonical order of
+	// their owner names, see RFC 4034.
+	nsec []*nsecRecord
+
+	// nsec3 are the NSEC3 records of the zone sorted by their hashed owner
+	// names.  All of them have the same hash parameters.
+	nsec3 []*nsecRecord
+}
+
+// nsecRecord is a single stored record along with its signatures.
+type nsecRecord struct {
+	// rr is the stored record.  It's never modified.
+	rr dns.RR
+
+	// key is the lowercased owner name for NSEC and SOA records, and the
+	// uppercased hashed owner name for NSEC3 records.
+	key string
+
+	// sigs are the RRSIG records covering rr.
+	sigs []dns.RR
+
+	// src is the upstream rr has been received from.  It's never nil.
+	src upstream.Upstream
+
+	// expire is the Unix time the record expires at.
+	expire int64
+}
+
+// newNSECCache returns a new properly initialized *nsecCache.  clock must not
+// be nil.
+func newNSECCache(clock Clock) (c *nsecCache) {
+	return &nsecCache{
+		mu:    &sync.Mutex{},
+		zones: map[string]*nsecZone{},
+		clock: clock,
+	}
+}
+
+// add stores the NSEC and NSEC3 records from the authority section of m, if m
+// has been validated by src, the upstream it has been received from, i.e. has
+// the AD flag set.  Only the records of the zone of the SOA record from the
+// same section are stored.  c may be nil.
+func (c *nsecCache) add(m *dns.Msg, src upstream.Upstream) {
+	if c == nil || m == nil || src == nil || !m.AuthenticatedData {
+		return
+	}
+
+	switch m.Rcode {
+	case dns.RcodeSuccess, dns.RcodeNameError:
+		// Go on.
+	default:
+		return
+	}
+
+	now := c.clock.Now().Unix()
+	soa, nsecs := nsecRecords(m.Ns, src, now)
+	if soa == nil || len(nsecs) == 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.records+len(nsecs) > nsecMaxRecords {
+		c.purge(now)
+	}
+
+	z := c.zones[soa.key]
+	if z == nil {
+		z = &nsecZone{}
+		c.zones[soa.key] = z
+	}
+
+	z.soa = soa
+
+	for _, r := range nsecs {
+		if c.records >= nsecMaxRecords {
+			return
+		}
+
+		c.records += z.set(r)
+	}
+}
+
+// nsecRecords returns the signed SOA record and the signed NSEC and NSEC3
+// records of its zone from rrs received from src.  now is the current Unix time
+// used to calculate the expiration times.  soa is nil if there is no signed SOA
+// record in rrs.
+func nsecRecords(
+	rrs []dns.RR,
+	src upstream.Upstream,
+	now int64,
+) (soa *nsecRecord, nsecs []*nsecRecord) {
+	var soaRR *dns.SOA
+	for _, rr := range rrs {
+		if s, ok := rr.(*dns.SOA); ok {
+			soaRR = s
+		}
+	}
+
+	if soaRR == nil {
+		return nil, nil
+	}
+
+	zone := strings.ToLower(soaRR.Hdr.Name)
+	if strings.Contains(zone, `\`) {
+		// Don't bother with the escaped names, since those complicate the
+		// canonical ordering.
+		return nil, nil
+	}
+
+	// Don't store the records for longer than the negative responses could
+	// be cached for, see RFC 9077.
+	maxTTL := min(soaRR.Hdr.Ttl, soaRR.Minttl)
+
+	newRecord := func(rr dns.RR, key string) (r *nsecRecord) {
+		sigs, sigTTL := nsecSignatures(rrs, rr, zone)
+		if len(sigs) == 0 {
+			return nil
+		}
+
+		return &nsecRecord{
+			rr:     dns.Copy(rr),
+			key:    key,
+			sigs:   sigs,
+			src:    src,
+			expire: now + int64(min(rr.Header().Ttl, maxTTL, sigTTL)),
+		}
+	}
+
+	soa = newRecord(soaRR, zone)
+	if soa == nil {
+		return nil, nil
+	}
+
+	for _, rr := range rrs {
+		owner := strings.ToLower(rr.Header().Name)
+		if !dns.IsSubDomain(zone, owner) || strings.Contains(owner, `\`) {
+			continue
+		}
+
+		var key string
+		switch rr := rr.(type) {
+		case *dns.NSEC:
+			key = owner
+		case *dns.NSEC3:
+			if rr.Hash != dns.SHA1 || rr.Iterations > nsec3MaxIterations {
+				continue
+			}
+
+			key, _, _ = strings.Cut(strings.ToUpper(owner), ".")
+		default:
+			continue
+		}
+
+		if r := newRecord(rr, key); r != nil {
+			nsecs = append(nsecs, r)
+		}
+	}
+
+	return soa, nsecs
+}
+
+// nsecSignatures returns the copies of the RRSIG records from rrs covering rr
+// and made by zone, along with their minimum TTL.
+func nsecSignatures(rrs []dns.RR, rr dns.RR, zone string) (sigs []dns.RR, ttl uint32) {
+	hdr := rr.Header()
+	ttl = hdr.Ttl
+	for _, r := range rrs {
+		sig, ok := r.(*dns.RRSIG)
+		if ok &&
+			sig.TypeCovered == hdr.Rrtype &&
+			strings.EqualFold(sig.Hdr.Name, hdr.Name) &&
+			strings.EqualFold(sig.SignerName, zone) {
+			sigs = append(sigs, dns.Copy(sig))
+			ttl = min(ttl, sig.Hdr.Ttl)
+		}
+	}
+
+	return sigs, ttl
+}
+
+// set stores r in z replacing the record with the same key, if any.  added is
+// the change in the number of the stored records.
+func (z *nsecZone) set(r *nsecRecord) (added int) {
+	if nsec3, ok := r.rr.(*dns.NSEC3); ok {
+		if len(z.nsec3) > 0 && !sameNSEC3Params(z.nsec3[0].rr.(*dns.NSEC3), nsec3) {
+			// The zone has been signed with the new parameters.
+			added -= len(z.nsec3)
+			z.nsec3 = nil
+		}
+
+		var inserted bool
+		z.nsec3, inserted = setRecord(z.nsec3, r, strings.Compare)
+
+		return added + mathutil.BoolToNumber[int](inserted)
+	}
+
+	var inserted bool
+	z.nsec, inserted = setRecord(z.nsec, r, canonicalCompare)
+
+	return mathutil.BoolToNumber[int](inserted)
+}
+
+// setRecord stores r in recs sorted by the keys using compare, replacing the
+// record with the same key, if any.  inserted is true if r has been added.
+func setRecord(
+	recs []*nsecRecord,
+	r *nsecRecord,
+	compare func(a, b string) (res int),
+) (res []*nsecRecord, inserted bool) {
+	i, found := slices.BinarySearchFunc(recs, r.key, func(rec *nsecRecord, key string) (res int) {
+		return compare(rec.key, key)
+	})
+	if found {
+		recs[i] = r
+
+		return recs, false
+	}
+
+	return slices.Insert(recs, i, r), true
+}
+
+// sameNSEC3Params returns true if a and b are hashed with the same parameters.
+func sameNSEC3Params(a, b *dns.NSEC3) (ok bool) {
+	return a.Hash == b.Hash && a.Iterations == b.Iterations && strings.EqualFold(a.Salt, b.Salt)
+}
+
+// purge removes the expired records from c.  c.mu must be locked.
+func (c *nsecCache) purge(now int64) {
+	isExpired := func(r *nsecRecord) (ok bool) { return r.expire <= now }
+
+	for name, z := range c.zones {
+		n := len(z.nsec) + len(z.nsec3)
+		z.nsec = slices.DeleteFunc(z.nsec, isExpired)
+		z.nsec3 = slices.DeleteFunc(z.nsec3, isExpired)
+		c.records -= n - len(z.nsec) - len(z.nsec3)
+
+		if isExpired(z.soa) || len(z.nsec)+len(z.nsec3) == 0 {
+			c.records -= len(z.nsec) + len(z.nsec3)
+			delete(c.zones, name)
+		}
+	}
+}
+
+// clear removes all the records from c.  c may be nil.
+func (c *nsecCache) clear() {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	clear(c.zones)
+	c.records = 0
+}
+
+// flushZone removes the records of the zones containing or contained by zone
+// from c.  c may be nil.
+func (c *nsecCache) flushZone(zone string) {
+	if c == nil {
+		return
+	}
+
+	zone = strings.ToLower(dns.Fqdn(zone))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for name, z := range c.zones {
+		if dns.IsSubDomain(name, zone) || dns.IsSubDomain(zone, name) {
+			c.records -= len(z.nsec) + len(z.nsec3)
+			delete(c.zones, name)
+		}
+	}
+}
+
+// lookup returns the authority section of the negative response to req proved
+// by the stored records received from ups, the upstreams selected for req,
+// along with its response code and TTL.  ns is nil if the records prove
+// nothing, e.g. since those have been received from the upstreams of another
+// domain.  c may be nil.
+func (c *nsecCache) lookup(
+	req *dns.Msg,
+	ups []upstream.Upstream,
+) (ns []dns.RR, rcode int, ttl uint32) {
+	if c == nil || len(req.Question) != 1 {
+		return nil, 0, 0
+	}
+
+	q := req.Question[0]
+	switch {
+	case
+		q.Qclass != dns.ClassINET,
+		q.Qtype == dns.TypeDS,
+		q.Qtype == dns.TypeANY:
+		// The DS records are served by the parent zone and the ANY queries
+		// can't be proved to have no data.
+		return nil, 0, 0
+	}
+
+	name := strings.ToLower(q.Name)
+	if strings.Contains(name, `\`) {
+		return nil, 0, 0
+	}
+
+	now := c.clock.Now().Unix()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	zone, z := c.zoneFor(name)
+	if z == nil || z.soa.expire <= now {
+		return nil, 0, 0
+	}
+
+	recs, rcode, ok := z.nsecProof(name, q.Qtype, now)
+	if !ok {
+		recs, rcode, ok = z.nsec3Proof(zone, name, q.Qtype, now)
+		if !ok {
+			return nil, 0, 0
+		}
+	}
+
+	if !slices.Contains(ups, z.soa.src) {
+		return nil, 0, 0
+	}
+
+	expire := z.soa.expire
+	ns = appendRecord(ns, z.soa)
+	for _, r := range recs {
+		if !slices.Contains(ups, r.src) {
+			return nil, 0, 0
+		}
+
+		expire = min(expire, r.expire)
+		ns = appendRecord(ns, r)
+	}
+
+	return ns, rcode, uint32(expire - now)
+}
+
+// appendRecord appends the copies of r and its signatures to rrs.
+func appendRecord(rrs []dns.RR, r *nsecRecord) (res []dns.RR) {
+	res = append(rrs, dns.Copy(r.rr))
+	for _, sig := range r.sigs {
+		res = append(res, dns.Copy(sig))
+	}
+
+	return res
+}
+
+// zoneFor returns the closest zone containing name.  z is nil if there is no
+// such zone.  c.mu must be locked.
+func (c *nsecCache) zoneFor(name string) (zone string, z *nsecZone) {
+	for zone = name; zone != ""; zone = parentName(zone) {
+		if z = c.zones[zone]; z != nil {
+			return zone, z
+		}
+	}
+
+	return "", nil
+}
+
+// parentName returns the parent domain of the fully-qualified name.  It
+// returns an empty string for the root domain.
+func parentName(name string) (parent string) {
+	if name == "." {
+		return ""
+	}
+
+	_, parent, _ = strings.Cut(name, ".")
+	if parent == "" {
+		return "."
+	}
+
+	return parent
+}
+
+// nsecProof returns the NSEC records of z proving that name has no records of
+// qtype, or doesn't exist, along with the response code.  ok is false if there
+// are no such records.
+func (z *nsecZone) nsecProof(
+	name string,
+	qtype uint16,
+	now int64,
+) (recs []*nsecRecord, rcode int, ok bool) {
+	if match := findRecord(z.nsec, name, canonicalCompare, now); match != nil {
+		if !deniesType(match.rr.(*dns.NSEC).TypeBitMap, qtype) {
+			return nil, 0, false
+		}
+
+		return []*nsecRecord{match}, dns.RcodeSuccess, true
+	}
+
+	cover := z.coveringNSEC(name, now)
+	if cover == nil {
+		return nil, 0, false
+	}
+
+	nsec := cover.rr.(*dns.NSEC)
+	if dns.IsSubDomain(cover.key, name) && isDelegation(nsec.TypeBitMap) {
+		// The names below the delegation point aren't covered by the NSEC
+		// records of the parent zone.
+		return nil, 0, false
+	}
+
+	next := strings.ToLower(nsec.NextDomain)
+	ce := closestEncloser(name, cover.key)
+	if nextCE := closestEncloser(name, next); dns.CountLabel(nextCE) > dns.CountLabel(ce) {
+		ce = nextCE
+	}
+
+	wildcardCover := z.coveringNSEC("*."+ce, now)
+	if wildcardCover == nil {
+		return nil, 0, false
+	}
+
+	recs = []*nsecRecord{cover}
+	if wildcardCover != cover {
+		recs = append(recs, wildcardCover)
+	}
+
+	return recs, dns.RcodeNameError, true
+}
+
+// coveringNSEC returns the NSEC record of z covering name, i.e. the one which
+// owner name is before name and the next name is after it in the canonical
+// order.  It returns nil if there is no such record.
+func (z *nsecZone) coveringNSEC(name string, now int64) (r *nsecRecord) {
+	i, found := slices.BinarySearchFunc(z.nsec, name, func(rec *nsecRecord, key string) (res int) {
+		return canonicalCompare(rec.key, key)
+	})
+	if found || i == 0 {
+		return nil
+	}
+
+	r = z.nsec[i-1]
+	if r.expire <= now {
+		return nil
+	}
+
+	next := strings.ToLower(r.rr.(*dns.NSEC).NextDomain)
+	if canonicalCompare(name, next) < 0 || canonicalCompare(next, r.key) <= 0 {
+		// The last NSEC record of the zone points to the apex.
+		return r
+	}
+
+	return nil
+}
+
+// nsec3Proof returns the NSEC3 records of z proving that name has no records
+// of qtype, or doesn't exist, along with the response code.  zone is the name
+// of z.  ok is false if there are no such records.
+func (z *nsecZone) nsec3Proof(
+	zone string,
+	name string,
+	qtype uint16,
+	now int64,
+) (recs []*nsecRecord, rcode int, ok bool) {
+	if len(z.nsec3) == 0 {
+		return nil, 0, false
+	}
+
+	params := z.nsec3[0].rr.(*dns.NSEC3)
+	hash := func(n string) (h string) {
+		return dns.HashName(n, params.Hash, params.Iterations, params.Salt)
+	}
+
+	if match := findRecord(z.nsec3, hash(name), strings.Compare, now); match != nil {
+		if !deniesType(match.rr.(*dns.NSEC3).TypeBitMap, qtype) {
+			return nil, 0, false
+		}
+
+		return []*nsecRecord{match}, dns.RcodeSuccess, true
+	}
+
+	// Find the closest encloser proof, see RFC 5155 Section 8.3.
+	nextCloser := name
+	for ce := parentName(name); ce != "" && dns.IsSubDomain(zone, ce); ce = parentName(ce) {
+		ceMatch := findRecord(z.nsec3, hash(ce), strings.Compare, now)
+		if ceMatch == nil {
+			nextCloser = ce
+
+			continue
+		}
+
+		bitmap := ceMatch.rr.(*dns.NSEC3).TypeBitMap
+		if isDelegation(bitmap) || slices.Contains(bitmap, dns.TypeDNAME) {
+			return nil, 0, false
+		}
+
+		// The Opt-Out records don't prove the absence of the unsigned
+		// delegations.
+		nextCloserCover := z.coveringNSEC3(hash(nextCloser), now)
+		if nextCloserCover == nil || nextCloserCover.rr.(*dns.NSEC3).Flags&nsec3FlagOptOut != 0 {
+			return nil, 0, false
+		}
+
+		wildcardCover := z.coveringNSEC3(hash("*."+ce), now)
+		if wildcardCover == nil {
+			return nil, 0, false
+		}
+
+		recs = []*nsecRecord{ceMatch, nextCloserCover}
+		if wildcardCover != nextCloserCover {
+			recs = append(recs, wildcardCover)
+		}
+
+		return recs, dns.RcodeNameError, true
+	}
+
+	return nil, 0, false
+}
+
+// coveringNSEC3 returns the NSEC3 record of z covering the hashed name h.  It
+// returns nil if there is no such record.
+func (z *nsecZone) coveringNSEC3(h string, now int64) (r *nsecRecord) {
+	i, found := slices.BinarySearchFunc(z.nsec3, h, func(rec *nsecRecord, key string) (res int) {
+		return strings.Compare(rec.key, key)
+	})
+	if found {
+		return nil
+	}
+
+	// The hash before the first one is covered by the last record, which
+	// points to the first one.
+	r = z.nsec3[(i+len(z.nsec3)-1)%len(z.nsec3)]
+	if r.expire <= now {
+		return nil
+	}
+
+	owner, next := r.key, strings.ToUpper(r.rr.(*dns.NSEC3).NextDomain)
+	if owner < next {
+		if owner < h && h < next {
+			return r
+		}
+	} else if owner < h || h < next {
+		return r
+	}
+
+	return nil
+}
+
+// findRecord returns the unexpired record with key from recs sorted using
+// compare.  It returns nil if there is no such record.
+func findRecord(
+	recs []*nsecRecord,
+	key string,
+	compare func(a, b string) (res int),
+	now int64,
+) (r *nsecRecord) {
+	i, found := slices.BinarySearchFunc(recs, key, func(rec *nsecRecord, k string) (res int) {
+		return compare(rec.key, k)
+	})
+	if !found || recs[i].expire <= now {
+		return nil
+	}
+
+	return recs[i]
+}
+
+// deniesType returns true if the type bitmap of the record matching the name
+// proves that there are no records of qtype for the name.
+func deniesType(bitmap []uint16, qtype uint16) (ok bool) {
+	return !slices.Contains(bitmap, qtype) &&
+		!slices.Contains(bitmap, dns.TypeCNAME) &&
+		!isDelegation(bitmap)
+}
+
+// isDelegation returns true if the type bitmap is the one of a delegation
+// point, which records are served by the child zone.
+func isDelegation(bitmap []uint16) (ok bool) {
+	return slices.Contains(bitmap, dns.TypeNS) && !slices.Contains(bitmap, dns.TypeSOA)
+}
+
+// closestEncloser returns the longest common ancestor of the lowercased
+// fully-qualified names a and b.
+func closestEncloser(a, b string) (ce string) {
+	n := dns.CompareDomainName(a, b)
+	if n == 0 {
+		return "."
+	}
+
+	idx := dns.Split(a)
+
+	return a[idx[len(idx)-n]:]
+}
+
+// canonicalCompare compares the lowercased fully-qualified names a and b in
+// the canonical order, see RFC 4034 Section 6.1.
+func canonicalCompare(a, b string) (res int) {
+	la, lb := dns.SplitDomainName(a), dns.SplitDomainName(b)
+	for i, j := len(la)-1, len(lb)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if res = strings.Compare(la[i], lb[j]); res != 0 {
+			return res
+		}
+	}
+
+	return cmp.Compare(len(la), len(lb))
+}
+
+// replyFromNSEC tries to synthesize the negative response to d.Req from the
+// NSEC and NSEC3 records cached for d, see [Config.CacheAggressiveNSEC].  Only
+// the records received from the upstreams selected for d are used, so that the
+// domain-specific upstreams are respected.  It returns true on success.
+func (p *Proxy) replyFromNSEC(d *DNSContext) (ok bool) {
+	c := p.cacheForContext(d)
+	if c.nsec == nil || len(d.Req.Question) != 1 {
+		return false
+	}
+
+	ups, _ := p.selectUpstreams(d)
+	ns, rcode, ttl := c.nsec.lookup(d.Req, ups)
+	if ns == nil {
+		return false
+	}
+
+	res := (&dns.Msg{}).SetRcode(d.Req, rcode)
+	res.RecursionAvailable = true
+	res.AuthenticatedData = true
+	filterMsg(res, &dns.Msg{Question: d.Req.Question, Ns: ns}, d.adBit, d.doBit, ttl)
+
+	d.Res = res
+	d.cacheHit = true
+
+	c.logger.Debug("synthesized response from nsec records", "rcode", dns.RcodeToString[rcode])
+
+	return true
+}
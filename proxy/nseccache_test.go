@@ -0,0 +1,392 @@
+package proxy
+
+import (
+	"net"
+	"slices"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// nsecTestZone is the signed zone used in the tests of the aggressive NSEC
+// caching.
+const nsecTestZone = "example."
+
+// newNSECTestSig returns a new RRSIG record covering the records of typ owned
+// by name in [nsecTestZone].
+func newNSECTestSig(name string, typ uint16) (sig *dns.RRSIG) {
+	return &dns.RRSIG{
+		Hdr: dns.RR_Header{
+			Name:   name,
+			Rrtype: dns.TypeRRSIG,
+			Class:  dns.ClassINET,
+			Ttl:    3600,
+		},
+		TypeCovered: typ,
+		Algorithm:   dns.ECDSAP256SHA256,
+		Labels:      uint8(dns.CountLabel(name)),
+		SignerName:  nsecTestZone,
+		Signature:   "AAAA",
+	}
+}
+
+// newNSECTestAuthority returns the authority section of the negative responses
+// of [nsecTestZone] with rrs and their signatures.
+func newNSECTestAuthority(rrs ...dns.RR) (ns []dns.RR) {
+	soa := &dns.SOA{
+		Hdr: dns.RR_Header{
+			Name:   nsecTestZone,
+			Rrtype: dns.TypeSOA,
+			Class:  dns.ClassINET,
+			Ttl:    3600,
+		},
+		Ns:     "ns." + nsecTestZone,
+		Mbox:   "hostmaster." + nsecTestZone,
+		Minttl: 600,
+	}
+
+	ns = []dns.RR{soa, newNSECTestSig(nsecTestZone, dns.TypeSOA)}
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		ns = append(ns, rr, newNSECTestSig(hdr.Name, hdr.Rrtype))
+	}
+
+	return ns
+}
+
+// newNSECTestNSEC returns a new NSEC record owned by name.
+func newNSECTestNSEC(name, next string, types ...uint16) (rr *dns.NSEC) {
+	return &dns.NSEC{
+		Hdr: dns.RR_Header{
+			Name:   name,
+			Rrtype: dns.TypeNSEC,
+			Class:  dns.ClassINET,
+			Ttl:    3600,
+		},
+		NextDomain: next,
+		TypeBitMap: append(types, dns.TypeRRSIG, dns.TypeNSEC),
+	}
+}
+
+// newNSECTestNSEC3Chain returns the chain of the NSEC3 records for names, each
+// having the A records, except for the apex.
+func newNSECTestNSEC3Chain(flags uint8, names ...string) (rrs []dns.RR) {
+	const salt = "AABB"
+
+	hashes := make([]string, 0, len(names))
+	types := map[string][]uint16{}
+	for _, n := range names {
+		h := dns.HashName(n, dns.SHA1, 1, salt)
+		hashes = append(hashes, h)
+
+		types[h] = []uint16{dns.TypeA, dns.TypeRRSIG}
+		if n == nsecTestZone {
+			types[h] = []uint16{dns.TypeNS, dns.TypeSOA, dns.TypeRRSIG, dns.TypeNSEC3PARAM}
+		}
+	}
+
+	slices.Sort(hashes)
+
+	for i, h := range hashes {
+		rrs = append(rrs, &dns.NSEC3{
+			Hdr: dns.RR_Header{
+				Name:   h + "." + nsecTestZone,
+				Rrtype: dns.TypeNSEC3,
+				Class:  dns.ClassINET,
+				Ttl:    3600,
+			},
+			Hash:       dns.SHA1,
+			Flags:      flags,
+			Iterations: 1,
+			SaltLength: uint8(len(salt) / 2),
+			Salt:       salt,
+			HashLength: 20,
+			NextDomain: hashes[(i+1)%len(hashes)],
+			TypeBitMap: types[h],
+		})
+	}
+
+	return rrs
+}
+
+// newNSECTestProxy returns a new proxy with the aggressive NSEC caching and the
+// upstream responding with NXDOMAIN and the authority section ns.  ad is the
+// AD flag of the responses.  n counts the upstream requests.
+func newNSECTestProxy(t *testing.T, ns []dns.RR, ad bool, n *int) (p *Proxy) {
+	t.Helper()
+
+	return newNSECTestProxyWithConf(t, &UpstreamConfig{
+		Upstreams: []upstream.Upstream{newNSECTestUpstream(ns, ad, n)},
+	})
+}
+
+// newNSECTestProxyWithConf returns a new proxy with the aggressive NSEC caching
+// and the upstreams from conf.
+func newNSECTestProxyWithConf(t *testing.T, conf *UpstreamConfig) (p *Proxy) {
+	t.Helper()
+
+	return mustNew(t, &Config{
+		Logger:              testLogger,
+		UDPListenAddr:       []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig:      conf,
+		TrustedProxies:      defaultTrustedProxies,
+		CacheEnabled:        true,
+		CacheSizeBytes:      defaultCacheSize,
+		CacheAggressiveNSEC: true,
+		TrustUpstreamAD:     true,
+	})
+}
+
+// newNSECTestUpstream returns a new upstream responding with NXDOMAIN and the
+// authority section ns.  ad is the AD flag of the responses.  n counts the
+// requests.
+func newNSECTestUpstream(ns []dns.RR, ad bool, n *int) (u *fakeUpstream) {
+	return &fakeUpstream{
+		onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			*n++
+
+			resp = (&dns.Msg{}).SetRcode(req, dns.RcodeNameError)
+			resp.AuthenticatedData = ad
+			resp.RecursionAvailable = true
+			for _, rr := range ns {
+				resp.Ns = append(resp.Ns, dns.Copy(rr))
+			}
+
+			return resp, nil
+		},
+		onAddress: func() (a string) { return "ups" },
+		onClose:   func() (err error) { return nil },
+	}
+}
+
+func TestProxy_Resolve_aggressiveNSEC(t *testing.T) {
+	nsecAuthority := newNSECTestAuthority(
+		newNSECTestNSEC(nsecTestZone, "b."+nsecTestZone, dns.TypeNS, dns.TypeSOA),
+		newNSECTestNSEC("b."+nsecTestZone, "d."+nsecTestZone, dns.TypeA),
+		newNSECTestNSEC("d."+nsecTestZone, "f."+nsecTestZone, dns.TypeNS),
+	)
+
+	nsec3Authority := newNSECTestAuthority(
+		newNSECTestNSEC3Chain(0, nsecTestZone, "b."+nsecTestZone)...,
+	)
+
+	optOutAuthority := newNSECTestAuthority(
+		newNSECTestNSEC3Chain(nsec3FlagOptOut, nsecTestZone, "b."+nsecTestZone)...,
+	)
+
+	testCases := []struct {
+		name          string
+		authority     []dns.RR
+		qname         string
+		qtype         uint16
+		wantRcode     int
+		ad            bool
+		wantUpstream  bool
+		wantSynthesis bool
+	}{{
+		name:          "nsec_nxdomain",
+		authority:     nsecAuthority,
+		qname:         "ca." + nsecTestZone,
+		qtype:         dns.TypeA,
+		wantRcode:     dns.RcodeNameError,
+		ad:            true,
+		wantUpstream:  false,
+		wantSynthesis: true,
+	}, {
+		name:          "nsec_nxdomain_subdomain",
+		authority:     nsecAuthority,
+		qname:         "x.b." + nsecTestZone,
+		qtype:         dns.TypeA,
+		wantRcode:     dns.RcodeNameError,
+		ad:            true,
+		wantUpstream:  false,
+		wantSynthesis: true,
+	}, {
+		name:          "nsec_nodata",
+		authority:     nsecAuthority,
+		qname:         "b." + nsecTestZone,
+		qtype:         dns.TypeAAAA,
+		wantRcode:     dns.RcodeSuccess,
+		ad:            true,
+		wantUpstream:  false,
+		wantSynthesis: true,
+	}, {
+		name:          "nsec_existing_type",
+		authority:     nsecAuthority,
+		qname:         "b." + nsecTestZone,
+		qtype:         dns.TypeA,
+		wantRcode:     dns.RcodeNameError,
+		ad:            true,
+		wantUpstream:  true,
+		wantSynthesis: false,
+	}, {
+		name:          "nsec_below_delegation",
+		authority:     nsecAuthority,
+		qname:         "x.d." + nsecTestZone,
+		qtype:         dns.TypeA,
+		wantRcode:     dns.RcodeNameError,
+		ad:            true,
+		wantUpstream:  true,
+		wantSynthesis: false,
+	}, {
+		name:          "nsec_not_validated",
+		authority:     nsecAuthority,
+		qname:         "ca." + nsecTestZone,
+		qtype:         dns.TypeA,
+		wantRcode:     dns.RcodeNameError,
+		ad:            false,
+		wantUpstream:  true,
+		wantSynthesis: false,
+	}, {
+		name:          "nsec3_nxdomain",
+		authority:     nsec3Authority,
+		qname:         "zz." + nsecTestZone,
+		qtype:         dns.TypeA,
+		wantRcode:     dns.RcodeNameError,
+		ad:            true,
+		wantUpstream:  false,
+		wantSynthesis: true,
+	}, {
+		name:          "nsec3_nodata",
+		authority:     nsec3Authority,
+		qname:         "b." + nsecTestZone,
+		qtype:         dns.TypeAAAA,
+		wantRcode:     dns.RcodeSuccess,
+		ad:            true,
+		wantUpstream:  false,
+		wantSynthesis: true,
+	}, {
+		name:          "nsec3_opt_out",
+		authority:     optOutAuthority,
+		qname:         "zz." + nsecTestZone,
+		qtype:         dns.TypeA,
+		wantRcode:     dns.RcodeNameError,
+		ad:            true,
+		wantUpstream:  true,
+		wantSynthesis: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var n int
+			p := newNSECTestProxy(t, tc.authority, tc.ad, &n)
+
+			// Fill the cache.
+			d := &DNSContext{Req: (&dns.Msg{}).SetQuestion("c."+nsecTestZone, dns.TypeA)}
+			require.NoError(t, p.Resolve(d))
+			require.Equal(t, 1, n)
+
+			req := (&dns.Msg{}).SetQuestion(tc.qname, tc.qtype)
+			req.SetEdns0(defaultUDPBufSize, true)
+
+			d = &DNSContext{Req: req}
+			require.NoError(t, p.Resolve(d))
+			require.NotNil(t, d.Res)
+
+			assert.Equal(t, tc.wantRcode, d.Res.Rcode)
+			assert.Equal(t, tc.wantUpstream, n > 1)
+			assert.Equal(t, tc.wantSynthesis, d.cacheHit)
+			assert.Empty(t, d.Res.Answer)
+
+			if !tc.wantSynthesis {
+				return
+			}
+
+			assert.True(t, d.Res.AuthenticatedData)
+			require.NotEmpty(t, d.Res.Ns)
+			assert.IsType(t, (*dns.SOA)(nil), d.Res.Ns[0])
+
+			hasType := func(typ uint16) (ok bool) {
+				return slices.ContainsFunc(d.Res.Ns, func(rr dns.RR) (found bool) {
+					return rr.Header().Rrtype == typ
+				})
+			}
+			assert.True(t, hasType(dns.TypeRRSIG))
+			assert.True(t, hasType(dns.TypeNSEC) || hasType(dns.TypeNSEC3))
+		})
+	}
+
+	t.Run("no_do", func(t *testing.T) {
+		var n int
+		p := newNSECTestProxy(t, nsecAuthority, true, &n)
+
+		d := &DNSContext{Req: (&dns.Msg{}).SetQuestion("c."+nsecTestZone, dns.TypeA)}
+		require.NoError(t, p.Resolve(d))
+
+		d = &DNSContext{Req: (&dns.Msg{}).SetQuestion("ca."+nsecTestZone, dns.TypeA)}
+		require.NoError(t, p.Resolve(d))
+		require.NotNil(t, d.Res)
+
+		assert.Equal(t, 1, n)
+		assert.Equal(t, dns.RcodeNameError, d.Res.Rcode)
+		assert.False(t, d.Res.AuthenticatedData)
+
+		require.Len(t, d.Res.Ns, 1)
+		assert.IsType(t, (*dns.SOA)(nil), d.Res.Ns[0])
+	})
+
+	t.Run("domain_upstream", func(t *testing.T) {
+		var n, domainN int
+		p := newNSECTestProxyWithConf(t, &UpstreamConfig{
+			Upstreams: []upstream.Upstream{newNSECTestUpstream(nsecAuthority, true, &n)},
+			DomainReservedUpstreams: map[string][]upstream.Upstream{
+				"ca." + nsecTestZone: {newNSECTestUpstream(nsecAuthority, true, &domainN)},
+			},
+		})
+
+		d := &DNSContext{Req: (&dns.Msg{}).SetQuestion("c."+nsecTestZone, dns.TypeA)}
+		require.NoError(t, p.Resolve(d))
+		require.Equal(t, 1, n)
+
+		// The records of the general upstream don't prove anything for the
+		// domain-specific one.
+		d = &DNSContext{Req: (&dns.Msg{}).SetQuestion("ca."+nsecTestZone, dns.TypeA)}
+		require.NoError(t, p.Resolve(d))
+
+		assert.Equal(t, 1, domainN)
+		assert.False(t, d.cacheHit)
+
+		// The records of the domain-specific upstream don't prove anything for
+		// the general one either.
+		p.ClearCache()
+
+		d = &DNSContext{Req: (&dns.Msg{}).SetQuestion("x.ca."+nsecTestZone, dns.TypeA)}
+		require.NoError(t, p.Resolve(d))
+		require.Equal(t, 2, domainN)
+
+		d = &DNSContext{Req: (&dns.Msg{}).SetQuestion("cb."+nsecTestZone, dns.TypeA)}
+		require.NoError(t, p.Resolve(d))
+
+		assert.Equal(t, 2, n)
+		assert.False(t, d.cacheHit)
+	})
+
+	t.Run("untrusted_ad", func(t *testing.T) {
+		_, err := New(&Config{
+			Logger:              testLogger,
+			UpstreamConfig:      newTestUpstreamConfig(t, defaultTimeout, testDefaultUpstreamAddr),
+			CacheEnabled:        true,
+			CacheAggressiveNSEC: true,
+		})
+		testutil.AssertErrorMsg(t, "cache aggressive nsec requires trusting upstream ad", err)
+	})
+
+	t.Run("clear", func(t *testing.T) {
+		var n int
+		p := newNSECTestProxy(t, nsecAuthority, true, &n)
+
+		d := &DNSContext{Req: (&dns.Msg{}).SetQuestion("c."+nsecTestZone, dns.TypeA)}
+		require.NoError(t, p.Resolve(d))
+
+		p.ClearCache()
+
+		d = &DNSContext{Req: (&dns.Msg{}).SetQuestion("ca."+nsecTestZone, dns.TypeA)}
+		require.NoError(t, p.Resolve(d))
+
+		assert.Equal(t, 2, n)
+	})
+}
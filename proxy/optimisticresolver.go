@@ -1,10 +1,12 @@
 package proxy
 
 import (
+	"context"
 	"encoding/hex"
+	"log/slog"
 	"sync"
 
-	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
 )
 
 // cachingResolver is the DNS resolver that is also able to cache responses.
@@ -24,16 +26,18 @@ var _ cachingResolver = (*Proxy)(nil)
 
 // optimisticResolver is used to eventually resolve expired cached requests.
 type optimisticResolver struct {
-	reqs *sync.Map
-	cr   cachingResolver
+	reqs   *sync.Map
+	cr     cachingResolver
+	logger *slog.Logger
 }
 
 // newOptimisticResolver returns the new resolver for expired cached requests.
-// cr must not be nil.
-func newOptimisticResolver(cr cachingResolver) (s *optimisticResolver) {
+// cr and l must not be nil.
+func newOptimisticResolver(cr cachingResolver, l *slog.Logger) (s *optimisticResolver) {
 	return &optimisticResolver{
-		reqs: &sync.Map{},
-		cr:   cr,
+		reqs:   &sync.Map{},
+		cr:     cr,
+		logger: l,
 	}
 }
 
@@ -45,7 +49,7 @@ type unit = struct{}
 // goroutine.  Do not pass the *DNSContext which is used elsewhere since it
 // isn't intended to be used concurrently.
 func (s *optimisticResolver) ResolveOnce(dctx *DNSContext, key []byte) {
-	defer log.OnPanic("optimistic resolver")
+	defer slogutil.RecoverAndLog(context.TODO(), s.logger)
 
 	keyHexed := hex.EncodeToString(key)
 	if _, ok := s.reqs.LoadOrStore(keyHexed, unit{}); ok {
@@ -55,7 +59,7 @@ func (s *optimisticResolver) ResolveOnce(dctx *DNSContext, key []byte) {
 
 	ok, err := s.cr.replyFromUpstream(dctx)
 	if err != nil {
-		log.Debug("resolving request for optimistic cache: %s", err)
+		s.logger.Debug("resolving request for optimistic cache", slogutil.KeyError, err)
 	}
 
 	if ok {
@@ -2,11 +2,11 @@ package proxy
 
 import (
 	"bytes"
+	"log/slog"
 	"sync"
 	"testing"
 
 	"github.com/AdguardTeam/golibs/errors"
-	"github.com/AdguardTeam/golibs/log"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -48,7 +48,7 @@ func TestOptimisticResolver_ResolveOnce(t *testing.T) {
 		},
 	}
 
-	s := newOptimisticResolver(tcr)
+	s := newOptimisticResolver(tcr, testLogger)
 	sameKey := []byte{1, 2, 3}
 
 	// Start the primary goroutine.
@@ -83,20 +83,15 @@ func TestOptimisticResolver_ResolveOnce_unsuccessful(t *testing.T) {
 	t.Run("error", func(t *testing.T) {
 		logOutput := &bytes.Buffer{}
 
-		prevLevel := log.GetLevel()
-		prevOutput := log.Writer()
-		log.SetLevel(log.DEBUG)
-		log.SetOutput(logOutput)
-		t.Cleanup(func() {
-			log.SetLevel(prevLevel)
-			log.SetOutput(prevOutput)
-		})
+		l := slog.New(slog.NewTextHandler(logOutput, &slog.HandlerOptions{
+			Level: slog.LevelDebug,
+		}))
 
 		const rerr errors.Error = "sample resolving error"
 		s := newOptimisticResolver(&testCachingResolver{
 			onReplyFromUpstream: func(_ *DNSContext) (ok bool, err error) { return true, rerr },
 			onCacheResp:         func(_ *DNSContext) {},
-		})
+		}, l)
 		s.ResolveOnce(nil, key)
 
 		assert.Contains(t, logOutput.String(), rerr.Error())
@@ -107,7 +102,7 @@ func TestOptimisticResolver_ResolveOnce_unsuccessful(t *testing.T) {
 		s := newOptimisticResolver(&testCachingResolver{
 			onReplyFromUpstream: func(_ *DNSContext) (ok bool, err error) { return false, nil },
 			onCacheResp:         func(_ *DNSContext) { cached = true },
-		})
+		}, testLogger)
 		s.ResolveOnce(nil, key)
 
 		assert.False(t, cached)
@@ -0,0 +1,241 @@
+package proxy
+
+import (
+	"fmt"
+	"net/netip"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// OverloadPolicy defines how the proxy answers the requests it can't process
+// because of the limits of the requests in flight, see
+// [Config.ConcurrencyLimit], [Config.MaxInflightRequests], and
+// [Config.MaxInflightRequestsPerClient].
+type OverloadPolicy string
+
+// Valid overload policies.
+const (
+	// OverloadPolicyDefault means that the requests are answered with the
+	// truncated response over UDP, so that the client retries over TCP, and
+	// with SERVFAIL and the extended DNS error otherwise.
+	OverloadPolicyDefault OverloadPolicy = ""
+
+	// OverloadPolicyDrop means that the requests are left without a response.
+	OverloadPolicyDrop OverloadPolicy = "drop"
+
+	// OverloadPolicyTruncate means that the requests are answered with the
+	// truncated response.  It makes no sense for the protocols other than
+	// UDP, so those are answered as with [OverloadPolicyServFail].
+	OverloadPolicyTruncate OverloadPolicy = "truncate"
+
+	// OverloadPolicyServFail means that the requests are answered with
+	// SERVFAIL and the "Other" extended DNS error, see RFC 8914.
+	OverloadPolicyServFail OverloadPolicy = "servfail"
+)
+
+// validateOverload returns an error if the overload policy is invalid.
+func (p *Proxy) validateOverload() (err error) {
+	switch p.OverloadPolicy {
+	case
+		OverloadPolicyDefault,
+		OverloadPolicyDrop,
+		OverloadPolicyTruncate,
+		OverloadPolicyServFail:
+		return nil
+	default:
+		return fmt.Errorf("overload policy: unsupported value %q", p.OverloadPolicy)
+	}
+}
+
+// inflightTracker counts the requests or the connections in flight globally
+// and per client and bounds their numbers.  A nil *inflightTracker doesn't
+// limit anything.  All methods are safe for concurrent use.
+type inflightTracker struct {
+	// mu protects the fields below.
+	mu *sync.Mutex
+
+	// perClient are the numbers of the items in flight by the client
+	// addresses.  The clients without such requests are removed.
+	perClient map[netip.Addr]uint
+
+	// total is the number of all the items in flight.
+	total uint
+
+	// maxTotal is the maximum of total.  Zero means no limit.
+	maxTotal uint
+
+	// maxPerClient is the maximum of the values of perClient.  Zero means no
+	// limit.
+	maxPerClient uint
+}
+
+// newInflightTracker returns a new tracker limiting the items in flight to
+// maxTotal globally and to maxPerClient for each client, zero meaning no limit.
+// It returns nil if both are zero.
+func newInflightTracker(maxTotal, maxPerClient uint) (t *inflightTracker) {
+	if maxTotal == 0 && maxPerClient == 0 {
+		return nil
+	}
+
+	return &inflightTracker{
+		mu:           &sync.Mutex{},
+		perClient:    map[netip.Addr]uint{},
+		maxTotal:     maxTotal,
+		maxPerClient: maxPerClient,
+	}
+}
+
+// acquire returns true if one more item from addr may be processed, in which
+// case release must be called with the same addr once it is.
+func (t *inflightTracker) acquire(addr netip.Addr) (ok bool) {
+	if t == nil {
+		return true
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.maxTotal > 0 && t.total >= t.maxTotal {
+		return false
+	}
+
+	n := t.perClient[addr]
+	if t.maxPerClient > 0 && n >= t.maxPerClient {
+		return false
+	}
+
+	t.perClient[addr] = n + 1
+	t.total++
+
+	return true
+}
+
+// release marks the item from addr, for which acquire has returned true,
+// processed.
+func (t *inflightTracker) release(addr netip.Addr) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.total--
+	if n := t.perClient[addr]; n > 1 {
+		t.perClient[addr] = n - 1
+	} else {
+		delete(t.perClient, addr)
+	}
+}
+
+// isFull returns true if no more items from addr may be processed at the
+// moment.
+func (t *inflightTracker) isFull(addr netip.Addr) (ok bool) {
+	if t == nil {
+		return false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return (t.maxTotal > 0 && t.total >= t.maxTotal) ||
+		(t.maxPerClient > 0 && t.perClient[addr] >= t.maxPerClient)
+}
+
+// textOverloaded is the text of the extended DNS error of the responses to the
+// requests exceeding the limits of the requests in flight.
+const textOverloaded = "proxy is overloaded"
+
+// handleWithinLimit handles d using p.handler unless any of the limits of the
+// requests in flight is reached, in which case it sets the response according
+// to the overload policy.  written is true if the response has already been
+// written to the client.
+func (p *Proxy) handleWithinLimit(d *DNSContext) (written bool, err error) {
+	addr := d.Addr.Addr()
+	if !p.inflight.acquire(addr) {
+		p.logger.Debug(
+			"shedding request",
+			"proto", d.Proto,
+			"reason", "too many requests in flight",
+			"addr", p.anonymizer.addrPort(d.Addr),
+		)
+
+		return p.shed(d), nil
+	}
+
+	defer p.inflight.release(addr)
+
+	if !p.concurrency.acquire() {
+		p.logger.Debug(
+			"shedding request",
+			"proto", d.Proto,
+			"reason", "concurrency limit reached",
+			"limit", p.concurrency.currentLimit(),
+		)
+
+		return p.shed(d), nil
+	}
+
+	defer p.concurrency.release()
+
+	return false, p.handler(p, d)
+}
+
+// shed answers the request of d, which can't be processed since the proxy is
+// overloaded, according to the overload policy.  It writes the precompiled
+// response right away when possible, in which case written is true.
+// Otherwise, it sets d.Res.
+func (p *Proxy) shed(d *DNSContext) (written bool) {
+	if p.writeStaticReply(d, p.overloadedReply(d)) {
+		return true
+	}
+
+	d.Res = p.newMsgOverloaded(d)
+
+	return false
+}
+
+// overloadedReply returns the precompiled response of the overload policy to
+// the request of d.  r is nil if there is no such response.
+func (p *Proxy) overloadedReply(d *DNSContext) (r *staticReply) {
+	switch {
+	case p.OverloadPolicy == OverloadPolicyDrop:
+		return nil
+	case p.truncatesOverloaded(d):
+		return p.static.truncated
+	default:
+		return p.static.overloaded
+	}
+}
+
+// truncatesOverloaded returns true if the overload policy answers the request
+// of d with the truncated response.
+func (p *Proxy) truncatesOverloaded(d *DNSContext) (ok bool) {
+	switch p.OverloadPolicy {
+	case OverloadPolicyDefault, OverloadPolicyTruncate:
+		return d.Proto == ProtoUDP
+	default:
+		return false
+	}
+}
+
+// newMsgOverloaded returns the response to the request of d, which can't be
+// processed since the proxy is overloaded, according to the overload policy.
+// resp is nil if the request should be dropped.
+func (p *Proxy) newMsgOverloaded(d *DNSContext) (resp *dns.Msg) {
+	switch {
+	case p.OverloadPolicy == OverloadPolicyDrop:
+		return nil
+	case p.truncatesOverloaded(d):
+		resp = (&dns.Msg{}).SetReply(d.Req)
+		resp.Truncated = true
+
+		return resp
+	default:
+		resp = p.messages.NewMsgSERVFAIL(d.Req)
+		addEDE(d.Req, resp, dns.ExtendedErrorCodeOther, textOverloaded)
+
+		return resp
+	}
+}
@@ -0,0 +1,174 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInflightTracker(t *testing.T) {
+	var (
+		addr1 = netip.MustParseAddr("192.0.2.1")
+		addr2 = netip.MustParseAddr("192.0.2.2")
+		addr3 = netip.MustParseAddr("192.0.2.3")
+	)
+
+	tr := newInflightTracker(3, 2)
+
+	require.True(t, tr.acquire(addr1))
+	require.True(t, tr.acquire(addr1))
+	assert.False(t, tr.acquire(addr1))
+
+	require.True(t, tr.acquire(addr2))
+	assert.False(t, tr.acquire(addr3))
+
+	tr.release(addr1)
+	assert.True(t, tr.acquire(addr3))
+
+	for _, addr := range []netip.Addr{addr1, addr2, addr3} {
+		tr.release(addr)
+	}
+
+	assert.Zero(t, tr.total)
+	assert.Empty(t, tr.perClient)
+
+	assert.Nil(t, newInflightTracker(0, 0))
+
+	var nilTracker *inflightTracker
+	assert.True(t, nilTracker.acquire(addr1))
+}
+
+func TestProxy_overload(t *testing.T) {
+	unblock := make(chan struct{})
+	exchanged := make(chan struct{}, 1)
+	u := &fakeUpstream{
+		onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			exchanged <- struct{}{}
+			<-unblock
+
+			return newCompareTestReply(req, "192.0.2.1", defaultTestTTL), nil
+		},
+		onAddress: func() (addr string) { return "fake" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	testCases := []struct {
+		policy       OverloadPolicy
+		name         string
+		wantUDPTC    bool
+		wantUDPDrop  bool
+		wantTCPRcode int
+	}{{
+		policy:       OverloadPolicyDefault,
+		name:         "default",
+		wantUDPTC:    true,
+		wantUDPDrop:  false,
+		wantTCPRcode: dns.RcodeServerFailure,
+	}, {
+		policy:       OverloadPolicyTruncate,
+		name:         "truncate",
+		wantUDPTC:    true,
+		wantUDPDrop:  false,
+		wantTCPRcode: dns.RcodeServerFailure,
+	}, {
+		policy:       OverloadPolicyServFail,
+		name:         "servfail",
+		wantUDPTC:    false,
+		wantUDPDrop:  false,
+		wantTCPRcode: dns.RcodeServerFailure,
+	}, {
+		policy:       OverloadPolicyDrop,
+		name:         "drop",
+		wantUDPTC:    false,
+		wantUDPDrop:  true,
+		wantTCPRcode: -1,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := mustNew(t, &Config{
+				Logger:                       testLogger,
+				UDPListenAddr:                []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+				TCPListenAddr:                []*net.TCPAddr{net.TCPAddrFromAddrPort(localhostAnyPort)},
+				UpstreamConfig:               &UpstreamConfig{Upstreams: []upstream.Upstream{u}},
+				TrustedProxies:               defaultTrustedProxies,
+				MaxInflightRequestsPerClient: 1,
+				OverloadPolicy:               tc.policy,
+				RatelimitSubnetLenIPv4:       24,
+				RatelimitSubnetLenIPv6:       64,
+			})
+
+			ctx := context.Background()
+			require.NoError(t, p.Start(ctx))
+			testutil.CleanupAndRequireSuccess(t, func() (err error) { return p.Shutdown(ctx) })
+
+			udpClient := &dns.Client{Net: string(ProtoUDP), Timeout: defaultTimeout}
+			udpAddr := p.Addr(ProtoUDP).String()
+
+			blockedResp := make(chan *dns.Msg, 1)
+			go func() {
+				pt := testutil.PanicT{}
+
+				resp, _, err := udpClient.Exchange(newHostTestMessage("blocked.example"), udpAddr)
+				require.NoError(pt, err)
+
+				blockedResp <- resp
+			}()
+
+			testutil.RequireReceive(t, exchanged, defaultTimeout)
+
+			shortClient := &dns.Client{Net: string(ProtoUDP), Timeout: defaultTimeout / 10}
+			resp, _, err := shortClient.Exchange(newHostTestMessage("shed.example"), udpAddr)
+			if tc.wantUDPDrop {
+				assert.Error(t, err)
+			} else {
+				require.NoError(t, err)
+
+				assert.Equal(t, tc.wantUDPTC, resp.Truncated)
+			}
+
+			req := newHostTestMessage("shed.example")
+			req.SetEdns0(dns.DefaultMsgSize, false)
+
+			tcpClient := &dns.Client{Net: string(ProtoTCP), Timeout: defaultTimeout}
+			resp, _, err = tcpClient.Exchange(req, p.Addr(ProtoTCP).String())
+			if tc.wantTCPRcode < 0 {
+				// The connection is closed instead of leaving the client
+				// waiting.
+				assert.ErrorIs(t, err, io.EOF)
+			} else {
+				require.NoError(t, err)
+
+				assert.Equal(t, tc.wantTCPRcode, resp.Rcode)
+
+				opt := resp.IsEdns0()
+				require.NotNil(t, opt)
+				require.Len(t, opt.Option, 1)
+
+				ede := testutil.RequireTypeAssert[*dns.EDNS0_EDE](t, opt.Option[0])
+				assert.Equal(t, dns.ExtendedErrorCodeOther, ede.InfoCode)
+			}
+
+			unblock <- struct{}{}
+
+			resp, ok := testutil.RequireReceive(t, blockedResp, defaultTimeout)
+			require.True(t, ok)
+
+			assert.False(t, resp.Truncated)
+			assert.Len(t, resp.Answer, 1)
+		})
+	}
+}
+
+func TestProxy_validateOverload(t *testing.T) {
+	p := &Proxy{Config: Config{OverloadPolicy: "bad"}}
+	testutil.AssertErrorMsg(t, `overload policy: unsupported value "bad"`, p.validateOverload())
+}
@@ -0,0 +1,145 @@
+package proxy
+
+import (
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+)
+
+// clientAnonymization returns the anonymization of the client addresses,
+// which is [ClientAnonymizationTruncate] with [Config.PrivacyMode], unless
+// another one is configured.
+func (p *Proxy) clientAnonymization() (mode ClientAnonymization) {
+	if p.PrivacyMode && p.ClientAnonymization == ClientAnonymizationNone {
+		return ClientAnonymizationTruncate
+	}
+
+	return p.ClientAnonymization
+}
+
+// withPrivacy returns tap wrapped into [privacyMessageTap] with
+// [Config.PrivacyMode], and tap itself otherwise.  p.anonymizer must be
+// initialized.
+func (p *Proxy) withPrivacy(tap MessageTap) (wrapped MessageTap) {
+	if !p.PrivacyMode {
+		return tap
+	}
+
+	return privacyMessageTap{
+		tap:        tap,
+		anonymizer: p.anonymizer,
+	}
+}
+
+// privacyMessageTap is a [MessageTap] passing the messages exchanged with the
+// clients to the wrapped one with the client addresses anonymized and without
+// the EDNS Client Subnet options, see [Config.PrivacyMode].
+type privacyMessageTap struct {
+	// tap is the wrapped message tap.
+	tap MessageTap
+
+	// anonymizer anonymizes the client addresses.
+	anonymizer clientAnonymizer
+}
+
+// type check
+var _ MessageTap = privacyMessageTap{}
+
+// OnClientQuery implements the [MessageTap] interface for privacyMessageTap.
+func (t privacyMessageTap) OnClientQuery(d *DNSContext, queryTime time.Time) {
+	t.tap.OnClientQuery(t.scrub(d), queryTime)
+}
+
+// OnClientResponse implements the [MessageTap] interface for
+// privacyMessageTap.
+func (t privacyMessageTap) OnClientResponse(d *DNSContext, queryTime, respTime time.Time) {
+	t.tap.OnClientResponse(t.scrub(d), queryTime, respTime)
+}
+
+// OnUpstreamExchange implements the [MessageTap] interface for
+// privacyMessageTap.  The requests to the upstreams are already stripped of the
+// EDNS Client Subnet options.
+func (t privacyMessageTap) OnUpstreamExchange(
+	u upstream.Upstream,
+	req *dns.Msg,
+	resp *dns.Msg,
+	queryTime time.Time,
+	respTime time.Time,
+) {
+	t.tap.OnUpstreamExchange(u, req, resp, queryTime, respTime)
+}
+
+// scrub returns the shallow copy of d with the client address anonymized and
+// the messages without the EDNS Client Subnet options.
+func (t privacyMessageTap) scrub(d *DNSContext) (scrubbed *DNSContext) {
+	c := *d
+	c.Addr = t.anonymizer.addrPort(d.Addr)
+	c.ReqECS = nil
+	c.Req = withoutECS(d.Req)
+	c.Res = withoutECS(d.Res)
+
+	return &c
+}
+
+// withoutECS returns m without the EDNS Client Subnet option.  It returns m
+// itself if it has no such option, and a copy otherwise.  m may be nil.
+func withoutECS(m *dns.Msg) (res *dns.Msg) {
+	if m == nil {
+		return nil
+	}
+
+	opt := m.IsEdns0()
+	if opt == nil || !slices.ContainsFunc(opt.Option, isECSOption) {
+		return m
+	}
+
+	res = m.Copy()
+	removeECS(res)
+
+	return res
+}
+
+// removeECS removes the EDNS Client Subnet option from m in place.
+func removeECS(m *dns.Msg) {
+	opt := m.IsEdns0()
+	if opt != nil {
+		opt.Option = slices.DeleteFunc(opt.Option, isECSOption)
+	}
+}
+
+// isECSOption returns true if o is an EDNS Client Subnet option.
+func isECSOption(o dns.EDNS0) (ok bool) {
+	return o.Option() == dns.EDNS0SUBNET
+}
+
+// removeClientEDE removes the texts of the extended DNS errors in resp which
+// contain the address of the client of d, for example the ones added by the
+// middlewares.  resp may be nil.
+func (d *DNSContext) removeClientEDE(resp *dns.Msg) {
+	if resp == nil || !d.Addr.IsValid() {
+		return
+	}
+
+	opt := resp.IsEdns0()
+	if opt == nil {
+		return
+	}
+
+	addr := d.Addr.Addr()
+	addrs := []string{addr.String(), addr.Unmap().String()}
+	for _, o := range opt.Option {
+		ede, ok := o.(*dns.EDNS0_EDE)
+		if !ok || ede.ExtraText == "" {
+			continue
+		}
+
+		if slices.ContainsFunc(addrs, func(s string) (found bool) {
+			return strings.Contains(ede.ExtraText, s)
+		}) {
+			ede.ExtraText = ""
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingMessageTap is a [MessageTap] recording the client contexts passed
+// to it.
+type recordingMessageTap struct {
+	EmptyMessageTap
+
+	// queries are the contexts passed to OnClientQuery.
+	queries []*DNSContext
+}
+
+// OnClientQuery implements the [MessageTap] interface for
+// *recordingMessageTap.
+func (t *recordingMessageTap) OnClientQuery(d *DNSContext, _ time.Time) {
+	t.queries = append(t.queries, d)
+}
+
+func TestProxy_PrivacyMode(t *testing.T) {
+	cliAddr := netip.MustParseAddrPort("192.0.2.10:12345")
+
+	var upsReq *dns.Msg
+	ups := &fakeUpstream{
+		onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			upsReq = req.Copy()
+
+			return newCompareTestReply(req, "192.0.2.1", defaultTestTTL), nil
+		},
+		onAddress: func() (addr string) { return "privacy.upstream" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	tap := &recordingMessageTap{}
+	p := mustNew(t, &Config{
+		Logger:        testLogger,
+		UDPListenAddr: []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{ups},
+		},
+		TrustedProxies:         defaultTrustedProxies,
+		EnableEDNSClientSubnet: true,
+		MessageTap:             tap,
+		PrivacyMode:            true,
+	})
+
+	req := newHostTestMessage("example.org")
+	req.SetEdns0(dns.DefaultMsgSize, false)
+	setECS(req, net.IP{192, 0, 2, 10}, 0)
+
+	d := &DNSContext{
+		Req:  req,
+		Addr: cliAddr,
+	}
+	p.messageTap.OnClientQuery(d, time.Now())
+	require.NoError(t, p.Resolve(d))
+
+	t.Run("upstream_ecs", func(t *testing.T) {
+		require.NotNil(t, upsReq)
+
+		ecs, _ := ecsFromMsg(upsReq)
+		assert.Nil(t, ecs)
+	})
+
+	t.Run("message_tap", func(t *testing.T) {
+		require.Len(t, tap.queries, 1)
+
+		q := tap.queries[0]
+		assert.Equal(t, netip.MustParseAddrPort("192.0.2.0:0"), q.Addr)
+
+		ecs, _ := ecsFromMsg(q.Req)
+		assert.Nil(t, ecs)
+
+		// The context itself isn't modified.
+		assert.Equal(t, cliAddr, d.Addr)
+	})
+}
+
+func TestDNSContext_removeClientEDE(t *testing.T) {
+	d := &DNSContext{
+		Addr: netip.MustParseAddrPort("[::ffff:192.0.2.10]:12345"),
+	}
+
+	resp := (&dns.Msg{}).SetReply(newHostTestMessage("example.org"))
+	resp.SetEdns0(dns.DefaultMsgSize, false)
+
+	opt := resp.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_EDE{
+		InfoCode:  dns.ExtendedErrorCodeFiltered,
+		ExtraText: "filtered for 192.0.2.10",
+	}, &dns.EDNS0_EDE{
+		InfoCode:  dns.ExtendedErrorCodeFiltered,
+		ExtraText: "filtered by policy",
+	})
+
+	d.removeClientEDE(resp)
+
+	var texts []string
+	for _, o := range opt.Option {
+		texts = append(texts, testutil.RequireTypeAssert[*dns.EDNS0_EDE](t, o).ExtraText)
+	}
+
+	assert.Equal(t, []string{"", "filtered by policy"}, texts)
+}
@@ -0,0 +1,411 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/netutil"
+)
+
+// Profile is a set of settings used instead of the general ones of [Config]
+// for the queries received on particular listen addresses or for particular TLS
+// server names, so that, for example, an internal listener and a public one are
+// served differently by the same proxy.  The settings which aren't listed here
+// are the general ones.
+type Profile struct {
+	// UpstreamConfig is the set of upstream servers used to resolve the
+	// queries of the profile.  If nil, [Config.UpstreamConfig] is used.  It's
+	// closed on shutdown.
+	UpstreamConfig *UpstreamConfig
+
+	// EDNSAddr is the ECS IP used in requests, see [Config.EDNSAddr].
+	EDNSAddr net.IP
+
+	// Name is the name of the profile used in the logs.
+	Name string
+
+	// ListenAddrs are the local addresses which the queries of the profile are
+	// received on.  An address with an unspecified IP matches all the local
+	// addresses with the same port, unless a more specific address of another
+	// profile matches.  It must not be empty, unless ServerNames are set.
+	ListenAddrs []netip.AddrPort
+
+	// ServerNames are the TLS server names, which the clients of the profile
+	// indicate when connecting over DNS-over-TLS, DNS-over-HTTPS, or
+	// DNS-over-QUIC, on any of the listeners.  The names are compared
+	// case-insensitively and a match takes precedence over ListenAddrs.
+	ServerNames []string
+
+	// Certificates are presented to the clients indicating any of ServerNames
+	// instead of the ones of [Config.TLSConfig].  If empty, the general ones
+	// are used.
+	Certificates []tls.Certificate
+
+	// Middlewares wrap the handling of the requests of the profile, see
+	// [Middleware].  Those are called after the ones added with [Proxy.Use],
+	// so that, for example, the filtering can differ between the profiles.
+	Middlewares []Middleware
+
+	// Ratelimit is the maximum number of requests per second from a single
+	// client subnet, see [Config.Ratelimit].  It's used for both IPv4 and IPv6
+	// subnets, while the subnet lengths, the bursts, and the allowlists are
+	// the general ones.  Zero disables the ratelimiting.
+	Ratelimit int
+
+	// RatelimitBurst is the maximum number of requests from a single client
+	// subnet allowed at once, see [Config.RatelimitBurst].  If zero, the
+	// general burst is used.
+	RatelimitBurst int
+
+	// RatelimitProtos are the protocols the ratelimit of the profile is
+	// applied to.  If empty, it's only applied to [ProtoUDP], like the general
+	// one.  The requests over the other protocols exceeding it are never
+	// answered with the truncated responses, see [Config.RatelimitSlip].
+	RatelimitProtos []Proto
+
+	// CacheEnabled defines if the responses are cached.  The profile has its
+	// own cache of [Config.CacheSizeBytes] size, which isn't shared with the
+	// general one, and is optimistic if [Config.CacheOptimistic] is true.
+	CacheEnabled bool
+
+	// EnableEDNSClientSubnet defines if the EDNS Client Subnet option is
+	// added to the requests, see [Config.EnableEDNSClientSubnet].
+	EnableEDNSClientSubnet bool
+}
+
+// profile is a [Profile] prepared to be used by the proxy.
+type profile struct {
+	*Profile
+
+	// cache is the cache of the profile.  It's nil if the cache is disabled.
+	cache *cache
+
+	// ratelimitBuckets stores the ratelimiters of the client subnets.
+	ratelimitBuckets *ratelimitBuckets
+
+	// handler handles the requests of the profile wrapped into its
+	// middlewares.  It's nil if there are none.
+	handler RequestHandler
+}
+
+// validateProfiles returns an error if any of p.Profiles is invalid.
+func (p *Proxy) validateProfiles() (err error) {
+	addrs := map[netip.AddrPort]string{}
+	names := map[string]string{}
+	for i, prof := range p.Profiles {
+		err = validateProfile(prof, addrs, names)
+		if err != nil {
+			return fmt.Errorf("profile at index %d: %w", i, err)
+		}
+
+		if prof.Ratelimit > 0 {
+			err = p.validateRatelimitSubnetLens()
+			if err != nil {
+				return fmt.Errorf("profile at index %d: %w", i, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateProfile returns an error if prof is invalid.  addrs and names map the
+// listen addresses and the server names of the already validated profiles to
+// their names.
+func validateProfile(
+	prof *Profile,
+	addrs map[netip.AddrPort]string,
+	names map[string]string,
+) (err error) {
+	if prof == nil {
+		return errors.Error("no profile")
+	}
+
+	if len(prof.ListenAddrs) == 0 && len(prof.ServerNames) == 0 {
+		return errors.Error("no listen addrs")
+	} else if len(prof.Certificates) > 0 && len(prof.ServerNames) == 0 {
+		return errors.Error("certificates: no server names")
+	}
+
+	for _, n := range prof.ServerNames {
+		n = strings.ToLower(n)
+		if n == "" {
+			return errors.Error("server name: empty value")
+		} else if name, ok := names[n]; ok {
+			return fmt.Errorf("server name %q: already used by profile %q", n, name)
+		}
+
+		names[n] = prof.Name
+	}
+
+	for _, addr := range prof.ListenAddrs {
+		addr = netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+		if name, ok := addrs[addr]; ok {
+			return fmt.Errorf("listen addr %s: already used by profile %q", addr, name)
+		}
+
+		addrs[addr] = prof.Name
+	}
+
+	err = validateProfileRatelimit(prof)
+	if err != nil {
+		return err
+	}
+
+	if prof.UpstreamConfig != nil {
+		err = prof.UpstreamConfig.validate()
+		if err != nil {
+			return fmt.Errorf("upstreams: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// validateProfileRatelimit returns an error if the ratelimit settings of prof
+// are invalid.
+func validateProfileRatelimit(prof *Profile) (err error) {
+	if prof.Ratelimit < 0 {
+		return fmt.Errorf("ratelimit: negative value %d", prof.Ratelimit)
+	} else if prof.RatelimitBurst < 0 {
+		return fmt.Errorf("ratelimit burst: negative value %d", prof.RatelimitBurst)
+	}
+
+	for _, proto := range prof.RatelimitProtos {
+		if !slices.Contains(statsProtos[:], proto) {
+			return fmt.Errorf("ratelimit protos: bad value %q", proto)
+		}
+	}
+
+	return nil
+}
+
+// initProfiles prepares the profiles of p to be used.
+func (p *Proxy) initProfiles() {
+	p.profiles = make([]*profile, 0, len(p.Profiles))
+	for _, prof := range p.Profiles {
+		var c *cache
+		if prof.CacheEnabled {
+			c = newCache(
+				p.CacheSizeBytes,
+				prof.EnableEDNSClientSubnet,
+				p.CacheOptimistic,
+				p.time,
+				p.cacheLogger,
+			)
+		}
+
+		var h RequestHandler
+		if len(prof.Middlewares) > 0 {
+			h = p.resolveRequest
+			for i := len(prof.Middlewares) - 1; i >= 0; i-- {
+				h = prof.Middlewares[i](h)
+			}
+		}
+
+		v4, v6 := p.ratelimitParams(prof.Ratelimit, prof.Ratelimit)
+		if prof.RatelimitBurst > 0 {
+			v4.burst, v6.burst = prof.RatelimitBurst, prof.RatelimitBurst
+		}
+
+		p.profiles = append(p.profiles, &profile{
+			Profile:          prof,
+			cache:            c,
+			ratelimitBuckets: newRatelimitBuckets(v4, v6, p.time),
+			handler:          h,
+		})
+
+		p.logger.Info(
+			"using profile",
+			"name", prof.Name,
+			"addrs", prof.ListenAddrs,
+			"server_names", prof.ServerNames,
+		)
+	}
+}
+
+// handleProfile is the innermost handler of the general middleware chain.  It
+// passes d through the middlewares of its profile, if any.
+func (p *Proxy) handleProfile(_ *Proxy, d *DNSContext) (err error) {
+	if d.profile != nil && d.profile.handler != nil {
+		return d.profile.handler(p, d)
+	}
+
+	return p.resolveRequest(p, d)
+}
+
+// profileFor returns the profile for the queries received from a client
+// indicating the TLS server name on the local address addr.  It returns nil if
+// there is no such profile.
+func (p *Proxy) profileFor(serverName string, addr netip.AddrPort) (prof *profile) {
+	if serverName != "" {
+		prof = p.profileForServerName(serverName)
+		if prof != nil {
+			return prof
+		}
+	}
+
+	if !addr.IsValid() {
+		return nil
+	}
+
+	ip := addr.Addr().Unmap()
+	for _, candidate := range p.profiles {
+		for _, a := range candidate.ListenAddrs {
+			if a.Port() != addr.Port() {
+				continue
+			}
+
+			switch a.Addr().Unmap() {
+			case ip:
+				return candidate
+			case netip.IPv4Unspecified(), netip.IPv6Unspecified():
+				prof = candidate
+			default:
+				// Go on.
+			}
+		}
+	}
+
+	return prof
+}
+
+// profileForServerName returns the profile for the TLS server name or nil if
+// there is none.
+func (p *Proxy) profileForServerName(name string) (prof *profile) {
+	for _, prof = range p.profiles {
+		for _, n := range prof.ServerNames {
+			if strings.EqualFold(n, name) {
+				return prof
+			}
+		}
+	}
+
+	return nil
+}
+
+// getCertificate returns the certificate of the profile for the TLS server name
+// the client indicates in hello.  It returns nil if the general certificates
+// should be used.  It's used as [tls.Config.GetCertificate].
+func (p *Proxy) getCertificate(hello *tls.ClientHelloInfo) (cert *tls.Certificate, err error) {
+	prof := p.profileForServerName(hello.ServerName)
+	if prof == nil || len(prof.Certificates) == 0 {
+		return nil, nil
+	}
+
+	for i := range prof.Certificates {
+		cert = &prof.Certificates[i]
+		if hello.SupportsCertificate(cert) == nil {
+			return cert, nil
+		}
+	}
+
+	// Let the client report the mismatch.
+	return &prof.Certificates[0], nil
+}
+
+// serverTLSConfig returns a copy of [Config.TLSConfig] for the listeners
+// presenting the certificates of the profiles.  nextProtos replace the
+// application protocols of the copy, unless nil.
+func (p *Proxy) serverTLSConfig(nextProtos []string) (conf *tls.Config) {
+	conf = p.TLSConfig.Clone()
+	if nextProtos != nil {
+		conf.NextProtos = nextProtos
+	}
+
+	if !slices.ContainsFunc(p.Profiles, func(prof *Profile) (ok bool) {
+		return len(prof.Certificates) > 0
+	}) {
+		return conf
+	}
+
+	general := conf.GetCertificate
+	conf.GetCertificate = func(hello *tls.ClientHelloInfo) (cert *tls.Certificate, err error) {
+		cert, err = p.getCertificate(hello)
+		if cert == nil && general != nil {
+			return general(hello)
+		}
+
+		return cert, err
+	}
+
+	return conf
+}
+
+// serverName returns the TLS server name the client of dctx has indicated.  It
+// returns an empty string if it's unknown or the protocol doesn't use TLS.
+func (dctx *DNSContext) serverName() (name string) {
+	switch dctx.Proto {
+	case ProtoTLS:
+		return connServerName(dctx.Conn)
+	case ProtoQUIC:
+		if dctx.QUICConnection != nil {
+			return dctx.QUICConnection.ConnectionState().TLS.ServerName
+		}
+	case ProtoHTTPS:
+		if dctx.HTTPRequest != nil && dctx.HTTPRequest.TLS != nil {
+			return dctx.HTTPRequest.TLS.ServerName
+		}
+	default:
+		// Go on.
+	}
+
+	return ""
+}
+
+// connServerName returns the TLS server name of conn, if it's a TLS connection.
+func connServerName(conn net.Conn) (name string) {
+	if c, ok := conn.(*tls.Conn); ok {
+		return c.ConnectionState().ServerName
+	}
+
+	return ""
+}
+
+// localAddr returns the local address the query of dctx has been received on.
+// It returns an invalid address if it's unknown.
+func (dctx *DNSContext) localAddr() (addr netip.AddrPort) {
+	var local net.Addr
+	switch dctx.Proto {
+	case ProtoUDP:
+		if dctx.Conn == nil {
+			return addr
+		}
+
+		local = dctx.Conn.LocalAddr()
+		if dctx.localIP.IsValid() {
+			// The connection may be bound to an unspecified address.
+			return netip.AddrPortFrom(dctx.localIP, netutil.NetAddrToAddrPort(local).Port())
+		}
+	case ProtoTCP, ProtoTLS:
+		if dctx.Conn != nil {
+			local = dctx.Conn.LocalAddr()
+		}
+	case ProtoQUIC:
+		if dctx.QUICConnection != nil {
+			local = dctx.QUICConnection.LocalAddr()
+		}
+	case ProtoHTTPS:
+		if dctx.HTTPRequest != nil {
+			local, _ = dctx.HTTPRequest.Context().Value(http.LocalAddrContextKey).(net.Addr)
+		}
+	case ProtoDNSCrypt:
+		if dctx.DNSCryptResponseWriter != nil {
+			local = dctx.DNSCryptResponseWriter.LocalAddr()
+		}
+	default:
+		// Go on.
+	}
+
+	if local == nil {
+		return addr
+	}
+
+	return netutil.NetAddrToAddrPort(local)
+}
@@ -0,0 +1,368 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newProfileTestUpstream returns the upstream always answering with ip.
+func newProfileTestUpstream(ip string) (u *fakeUpstream) {
+	return &fakeUpstream{
+		onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			return newCompareTestReply(req, ip, defaultTestTTL), nil
+		},
+		onAddress: func() (addr string) { return ip },
+		onClose:   func() (err error) { return nil },
+	}
+}
+
+// freeUDPAddr returns a local UDP address which isn't currently bound.
+func freeUDPAddr(t *testing.T) (addr netip.AddrPort) {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp", net.UDPAddrFromAddrPort(localhostAnyPort))
+	require.NoError(t, err)
+
+	addr = conn.LocalAddr().(*net.UDPAddr).AddrPort()
+	require.NoError(t, conn.Close())
+
+	return addr
+}
+
+func TestProxy_profiles(t *testing.T) {
+	profileAddr := freeUDPAddr(t)
+
+	p := mustNew(t, &Config{
+		Logger: testLogger,
+		UDPListenAddr: []*net.UDPAddr{
+			net.UDPAddrFromAddrPort(localhostAnyPort),
+			net.UDPAddrFromAddrPort(profileAddr),
+		},
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{newProfileTestUpstream("192.0.2.1")},
+		},
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+		CacheEnabled:           true,
+		CacheSizeBytes:         defaultCacheSize,
+		Profiles: []*Profile{{
+			UpstreamConfig: &UpstreamConfig{
+				Upstreams: []upstream.Upstream{newProfileTestUpstream("192.0.2.2")},
+			},
+			Name:        "public",
+			ListenAddrs: []netip.AddrPort{profileAddr},
+			Ratelimit:   1,
+		}},
+	})
+
+	ctx := context.Background()
+	require.NoError(t, p.Start(ctx))
+	testutil.CleanupAndRequireSuccess(t, func() (err error) { return p.Shutdown(ctx) })
+
+	var generalAddr string
+	for _, a := range p.Addrs(ProtoUDP) {
+		if a.String() != profileAddr.String() {
+			generalAddr = a.String()
+		}
+	}
+	require.NotEmpty(t, generalAddr)
+
+	client := &dns.Client{Net: string(ProtoUDP), Timeout: defaultTimeout}
+	exchange := func(t *testing.T, addr string) (ip net.IP) {
+		t.Helper()
+
+		resp, _, err := client.Exchange(newHostTestMessage("profile.example"), addr)
+		require.NoError(t, err)
+		require.NotEmpty(t, resp.Answer)
+
+		a := testutil.RequireTypeAssert[*dns.A](t, resp.Answer[0])
+
+		return a.A.To4()
+	}
+
+	// Cache the response of the general upstream.
+	assert.Equal(t, net.IP{192, 0, 2, 1}, exchange(t, generalAddr))
+	assert.Equal(t, net.IP{192, 0, 2, 1}, exchange(t, generalAddr))
+
+	// The profile has its own upstreams and doesn't use the general cache.
+	assert.Equal(t, net.IP{192, 0, 2, 2}, exchange(t, profileAddr.String()))
+
+	t.Run("ratelimit", func(t *testing.T) {
+		limitedClient := &dns.Client{Net: string(ProtoUDP), Timeout: 200 * time.Millisecond}
+		_, _, err := limitedClient.Exchange(newHostTestMessage("limited.example"), profileAddr.String())
+		assert.Error(t, err)
+
+		// The general listener isn't limited.
+		assert.Equal(t, net.IP{192, 0, 2, 1}, exchange(t, generalAddr))
+	})
+}
+
+func TestProxy_profiles_serverNames(t *testing.T) {
+	const familyName = "family.example"
+
+	generalConf, _ := newTLSConfig(t)
+	familyConf, _ := newTLSConfig(t)
+
+	var filtered atomic.Int32
+	p := mustNew(t, &Config{
+		Logger:        testLogger,
+		TLSListenAddr: []*net.TCPAddr{net.TCPAddrFromAddrPort(localhostAnyPort)},
+		TLSConfig:     generalConf,
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{newProfileTestUpstream("192.0.2.1")},
+		},
+		TrustedProxies: defaultTrustedProxies,
+		CacheSizeBytes: defaultCacheSize,
+		Profiles: []*Profile{{
+			UpstreamConfig: &UpstreamConfig{
+				Upstreams: []upstream.Upstream{newProfileTestUpstream("192.0.2.2")},
+			},
+			Name:         "family",
+			CacheEnabled: true,
+			ServerNames:  []string{"FAMILY.example"},
+			Certificates: familyConf.Certificates,
+			Middlewares: []Middleware{func(next RequestHandler) (h RequestHandler) {
+				return func(p *Proxy, d *DNSContext) (err error) {
+					filtered.Add(1)
+
+					return next(p, d)
+				}
+			}},
+		}},
+	})
+
+	ctx := context.Background()
+	require.NoError(t, p.Start(ctx))
+	testutil.CleanupAndRequireSuccess(t, func() (err error) { return p.Shutdown(ctx) })
+
+	exchange := func(t *testing.T, serverName string) (ip net.IP, cert []byte) {
+		t.Helper()
+
+		conn, err := dns.DialWithTLS(string(ProtoTCP), p.Addr(ProtoTLS).String(), &tls.Config{
+			ServerName: serverName,
+			// #nosec G402 -- The certificates are self-signed.
+			InsecureSkipVerify: true,
+		})
+		require.NoError(t, err)
+		testutil.CleanupAndRequireSuccess(t, conn.Close)
+
+		require.NoError(t, conn.WriteMsg(newHostTestMessage("profile.example")))
+
+		resp, err := conn.ReadMsg()
+		require.NoError(t, err)
+		require.NotEmpty(t, resp.Answer)
+
+		a := testutil.RequireTypeAssert[*dns.A](t, resp.Answer[0])
+		tlsConn := testutil.RequireTypeAssert[*tls.Conn](t, conn.Conn)
+
+		return a.A.To4(), tlsConn.ConnectionState().PeerCertificates[0].Raw
+	}
+
+	ip, cert := exchange(t, tlsServerName)
+	assert.Equal(t, net.IP{192, 0, 2, 1}, ip)
+	assert.Equal(t, generalConf.Certificates[0].Certificate[0], cert)
+	assert.Zero(t, filtered.Load())
+
+	ip, cert = exchange(t, familyName)
+	assert.Equal(t, net.IP{192, 0, 2, 2}, ip)
+	assert.Equal(t, familyConf.Certificates[0].Certificate[0], cert)
+	assert.Equal(t, int32(1), filtered.Load())
+
+	// The cached responses pass through the middlewares of the profile too.
+	ip, _ = exchange(t, familyName)
+	assert.Equal(t, net.IP{192, 0, 2, 2}, ip)
+	assert.Equal(t, int32(2), filtered.Load())
+}
+
+func TestProxy_profiles_ratelimitProtos(t *testing.T) {
+	l, err := net.Listen("tcp", localhostAnyPort.String())
+	require.NoError(t, err)
+
+	addr := testutil.RequireTypeAssert[*net.TCPAddr](t, l.Addr()).AddrPort()
+	require.NoError(t, l.Close())
+
+	p := mustNew(t, &Config{
+		Logger:        testLogger,
+		TCPListenAddr: []*net.TCPAddr{net.TCPAddrFromAddrPort(addr)},
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{newProfileTestUpstream("192.0.2.1")},
+		},
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+		Profiles: []*Profile{{
+			Name:            "strict",
+			ListenAddrs:     []netip.AddrPort{addr},
+			Ratelimit:       1,
+			RatelimitBurst:  2,
+			RatelimitProtos: []Proto{ProtoTCP},
+		}},
+	})
+
+	ctx := context.Background()
+	require.NoError(t, p.Start(ctx))
+	testutil.CleanupAndRequireSuccess(t, func() (err error) { return p.Shutdown(ctx) })
+
+	client := &dns.Client{Net: string(ProtoTCP), Timeout: 200 * time.Millisecond}
+	for i := range 2 {
+		_, _, err := client.Exchange(newHostTestMessage("limited.example"), addr.String())
+		require.NoErrorf(t, err, "request at index %d", i)
+	}
+
+	_, _, err = client.Exchange(newHostTestMessage("limited.example"), addr.String())
+	assert.Error(t, err)
+}
+
+func TestProxy_profiles_optimistic(t *testing.T) {
+	start := time.Now()
+	var elapsed atomic.Int64
+	clock := &fakeClock{
+		onNow: func() (now time.Time) { return start.Add(time.Duration(elapsed.Load())) },
+	}
+
+	var exchanges atomic.Int32
+	profUps := newProfileTestUpstream("192.0.2.2")
+	profUps.onExchange = func(req *dns.Msg) (resp *dns.Msg, err error) {
+		exchanges.Add(1)
+
+		return newCompareTestReply(req, "192.0.2.2", defaultTestTTL), nil
+	}
+
+	p := mustNew(t, &Config{
+		Logger: testLogger,
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{newProfileTestUpstream("192.0.2.1")},
+		},
+		TrustedProxies:  defaultTrustedProxies,
+		Clock:           clock,
+		CacheEnabled:    true,
+		CacheOptimistic: true,
+		Profiles: []*Profile{{
+			UpstreamConfig: &UpstreamConfig{Upstreams: []upstream.Upstream{profUps}},
+			Name:           "optimistic",
+			ListenAddrs:    []netip.AddrPort{freeUDPAddr(t)},
+			CacheEnabled:   true,
+		}},
+	})
+
+	resolve := func(t *testing.T) (a *dns.A) {
+		t.Helper()
+
+		d := &DNSContext{Req: newHostTestMessage("profile.example"), profile: p.profiles[0]}
+		require.NoError(t, p.Resolve(d))
+		require.NotNil(t, d.Res)
+		require.NotEmpty(t, d.Res.Answer)
+
+		return testutil.RequireTypeAssert[*dns.A](t, d.Res.Answer[0])
+	}
+
+	require.Equal(t, net.IP{192, 0, 2, 2}, resolve(t).A.To4())
+	require.Equal(t, int32(1), exchanges.Load())
+
+	elapsed.Store(int64(2 * defaultTestTTL * time.Second))
+
+	// The expired response is served from the cache of the profile and is
+	// resolved again with the upstreams of the profile.
+	a := resolve(t)
+	assert.Equal(t, net.IP{192, 0, 2, 2}, a.A.To4())
+	assert.Equal(t, uint32(optimisticTTL), a.Hdr.Ttl)
+
+	assert.Eventually(t, func() (ok bool) {
+		return resolve(t).Hdr.Ttl == defaultTestTTL
+	}, defaultTimeout, defaultTimeout/100)
+	assert.Equal(t, int32(2), exchanges.Load())
+}
+
+func TestNew_profiles(t *testing.T) {
+	addr := netip.MustParseAddrPort("127.0.0.1:53")
+
+	testCases := []struct {
+		name       string
+		wantErrMsg string
+		profiles   []*Profile
+	}{{
+		name:       "no_listen_addrs",
+		wantErrMsg: "validating profiles: profile at index 0: no listen addrs",
+		profiles:   []*Profile{{Name: "empty"}},
+	}, {
+		name:       "certificates_without_names",
+		wantErrMsg: "validating profiles: profile at index 0: certificates: no server names",
+		profiles: []*Profile{{
+			Name:         "certs",
+			ListenAddrs:  []netip.AddrPort{addr},
+			Certificates: []tls.Certificate{{}},
+		}},
+	}, {
+		name: "duplicate_server_name",
+		wantErrMsg: `validating profiles: profile at index 1: ` +
+			`server name "family.example": already used by profile "first"`,
+		profiles: []*Profile{{
+			Name:        "first",
+			ServerNames: []string{"family.example"},
+		}, {
+			Name:        "second",
+			ServerNames: []string{"Family.Example"},
+		}},
+	}, {
+		name: "duplicate_addr",
+		wantErrMsg: `validating profiles: profile at index 1: ` +
+			`listen addr 127.0.0.1:53: already used by profile "first"`,
+		profiles: []*Profile{{
+			Name:        "first",
+			ListenAddrs: []netip.AddrPort{addr},
+		}, {
+			Name:        "second",
+			ListenAddrs: []netip.AddrPort{addr},
+		}},
+	}, {
+		name:       "negative_ratelimit",
+		wantErrMsg: "validating profiles: profile at index 0: ratelimit: negative value -1",
+		profiles: []*Profile{{
+			Name:        "negative",
+			ListenAddrs: []netip.AddrPort{addr},
+			Ratelimit:   -1,
+		}},
+	}, {
+		name: "bad_ratelimit_proto",
+		wantErrMsg: `validating profiles: profile at index 0: ` +
+			`ratelimit protos: bad value "dot"`,
+		profiles: []*Profile{{
+			Name:            "bad_proto",
+			ListenAddrs:     []netip.AddrPort{addr},
+			RatelimitProtos: []Proto{"dot"},
+		}},
+	}, {
+		name:       "empty_upstreams",
+		wantErrMsg: "validating profiles: profile at index 0: upstreams: no upstream specified",
+		profiles: []*Profile{{
+			UpstreamConfig: &UpstreamConfig{},
+			Name:           "empty_upstreams",
+			ListenAddrs:    []netip.AddrPort{addr},
+		}},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := New(&Config{
+				Logger: testLogger,
+				UpstreamConfig: &UpstreamConfig{
+					Upstreams: []upstream.Upstream{newProfileTestUpstream("192.0.2.1")},
+				},
+				Profiles: tc.profiles,
+			})
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+		})
+	}
+}
@@ -7,6 +7,8 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"log/slog"
+	"math"
 	"net"
 	"net/http"
 	"net/netip"
@@ -17,17 +19,18 @@ import (
 
 	"github.com/AdguardTeam/dnsproxy/fastip"
 	proxynetutil "github.com/AdguardTeam/dnsproxy/internal/netutil"
+	"github.com/AdguardTeam/dnsproxy/internal/xdp"
 	"github.com/AdguardTeam/dnsproxy/upstream"
 	"github.com/AdguardTeam/golibs/errors"
-	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
 	"github.com/AdguardTeam/golibs/netutil"
 	"github.com/AdguardTeam/golibs/service"
 	"github.com/AdguardTeam/golibs/syncutil"
 	"github.com/ameshkov/dnscrypt/v2"
 	"github.com/miekg/dns"
-	gocache "github.com/patrickmn/go-cache"
 	"github.com/quic-go/quic-go"
 	"github.com/quic-go/quic-go/http3"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/exp/rand"
 )
 
@@ -69,14 +72,49 @@ type Proxy struct {
 	// See also: https://github.com/AdguardTeam/AdGuardHome/issues/2242.
 	requestsSema syncutil.Semaphore
 
+	// mirrorSema limits the number of the mirrored requests in flight.  It's
+	// nil if the mirroring is disabled.
+	mirrorSema chan struct{}
+
+	// compareSema limits the number of the compared requests in flight.  It's
+	// nil if the comparison is disabled.
+	compareSema chan struct{}
+
+	// errorReporter contains the state of the DNS error reporting.  It's nil if
+	// the reporting is disabled.
+	errorReporter *errorReporter
+
+	// errorReportingAgent is the normalized domain of the reporting agent the
+	// proxy acts as.  It's empty if the proxy isn't a reporting agent.
+	errorReportingAgent string
+
+	// cancelVerification stops the background verification of the upstreams
+	// in the [StartupGatingServFail] mode.  It's nil if the verification isn't
+	// running.
+	cancelVerification context.CancelFunc
+
+	// notReady is true if the requests should be answered with SERVFAIL since
+	// the upstreams aren't verified yet.
+	notReady atomic.Bool
+
+	// cacheOnly is true if the requests should only be answered from the
+	// cache, see [Config.CacheOnly].
+	cacheOnly atomic.Bool
+
+	// cancelNAT64Discovery stops the background discovery of the NAT64
+	// prefixes.  It's nil if the discovery isn't running.
+	cancelNAT64Discovery context.CancelFunc
+
+	// upstreamVerifyInterval is the interval between the attempts to verify
+	// the upstreams on startup.
+	upstreamVerifyInterval time.Duration
+
 	// privateNets determines if the requested address and the client address
 	// are private.
 	privateNets netutil.SubnetSet
 
-	// time provides the current time.
-	//
-	// TODO(e.burkov):  Consider configuring it.
-	time clock
+	// time provides the current time, see [Config.Clock].
+	time Clock
 
 	// randSrc provides the source of randomness.
 	//
@@ -89,11 +127,68 @@ type Proxy struct {
 	// beforeRequestHandler handles the request's context before it is resolved.
 	beforeRequestHandler BeforeRequestHandler
 
+	// afterResponseHandler handles the request's context before the response
+	// is sent.
+	afterResponseHandler AfterResponseHandler
+
+	// middlewares are the middlewares added with [Proxy.Use].
+	middlewares []Middleware
+
+	// handler handles the requests, see [Proxy.buildHandler].  It's rebuilt on
+	// start to include the middlewares added after the initialization.
+	handler RequestHandler
+
+	// metrics receives the events of the request processing.  It's never nil.
+	metrics MetricsListener
+
+	// stats are the core counters of the proxy, also reported to by metrics.
+	// It's never nil.
+	stats *Stats
+
+	// tracer traces the request processing.  It's never nil.
+	tracer trace.Tracer
+
+	// messageTap receives the DNS messages passing through the proxy.  It's
+	// never nil.
+	messageTap MessageTap
+
+	// events are the listeners registered with [Proxy.AddEventListener].  The
+	// pointed slice is never modified, it's replaced as a whole instead.
+	events atomic.Pointer[MultiEventListener]
+
+	// queryLogger logs the processed requests.  It's never nil.
+	queryLogger QueryLogger
+
+	// logger is used for logging in the server subsystem.  It's never nil.
+	logger *slog.Logger
+
+	// cacheLogger is used for logging in the cache subsystem.  It's never nil.
+	cacheLogger *slog.Logger
+
+	// upstreamLogger is used for logging in the upstream subsystem.  It's
+	// never nil.
+	upstreamLogger *slog.Logger
+
+	// ratelimitLogger is used for logging in the ratelimit subsystem.  It's
+	// never nil.
+	ratelimitLogger *slog.Logger
+
+	// anonymizer anonymizes the client addresses in the log and the query log
+	// output.
+	anonymizer clientAnonymizer
+
 	// dnsCryptServer serves DNSCrypt queries.
 	dnsCryptServer *dnscrypt.Server
 
-	// ratelimitBuckets is a storage for ratelimiters for individual IPs.
-	ratelimitBuckets *gocache.Cache
+	// ratelimitBuckets stores the ratelimiters of the client subnets for the
+	// general ratelimit.  It's created on the first use, see
+	// [Proxy.ratelimiters], and reset when the ratelimit is reconfigured.
+	ratelimitBuckets atomic.Pointer[ratelimitBuckets]
+
+	// truncateBuckets stores the ratelimiters of the client subnets for
+	// [Config.RatelimitTruncate].  It's created on the first use, see
+	// [Proxy.truncateLimiters], and reset when the ratelimit is reconfigured.
+	truncateBuckets atomic.Pointer[ratelimitBuckets]
 
 	// fastestAddr finds the fastest IP address for the resolved domain.
 	fastestAddr *fastip.FastestAddr
@@ -111,14 +206,64 @@ type Proxy struct {
 	// requests for private addresses.
 	recDetector *recursionDetector
 
-	// bytesPool is a pool of byte slices used to read DNS packets.
-	//
-	// TODO(e.burkov):  Use [syncutil.Pool].
-	bytesPool *sync.Pool
+	// udpTruncator limits the sizes of the responses sent over UDP.  It's nil
+	// if [Config.UDPTruncation] is nil.
+	udpTruncator *udpTruncator
+
+	// connLimiter limits the connections to the encrypted listeners.  It's nil
+	// if [Config.EncryptedConnLimit] is nil.
+	connLimiter *connLimiter
+
+	// forceTCP matches the requests resolved over TCP.  It's nil if
+	// [Config.ForceTCP] is nil.
+	forceTCP *forceTCPMatcher
+
+	// svcbRewriter rewrites the SVCB and HTTPS records in the responses.  It's
+	// nil if [Config.SVCBRewrite] is nil.
+	svcbRewriter *svcbRewriter
+
+	// insecure matches the requests for the domains exempt from the DNSSEC
+	// validation.  It's nil if [Config.InsecureDomains] are empty.
+	insecure *insecureMatcher
+
+	// fallbackTriggers returns the outcomes of the exchanges triggering the
+	// fallbacks.  It's nil if [Config.FallbackTriggers] is nil.
+	fallbackTriggers *fallbackMatcher
+
+	// anomalies detects the anomalous clients.  It's nil if
+	// [Config.Anomalies] is nil.
+	anomalies *anomalyDetector
+
+	// bytesPool is a pool of byte slices used to read and pack DNS messages.
+	// The slices are large enough to hold any DNS message with the 2-byte
+	// length prefix used by TCP, TLS, and QUIC.
+	bytesPool *syncutil.Pool[[]byte]
+
+	// dctxPool is the pool of the request contexts.  It's nil unless the
+	// pooling is enabled, see [Config.EnableDNSContextPooling].
+	dctxPool *syncutil.Pool[DNSContext]
+
+	// concurrency is the adaptive limit of the number of the requests
+	// processed simultaneously.  It's nil if the limit is disabled, see
+	// [Config.ConcurrencyLimit].
+	concurrency *concurrencyLimiter
+
+	// static are the precompiled responses written without constructing the
+	// messages.
+	static staticReplies
+
+	// inflight bounds the numbers of the requests in flight globally and per
+	// client.  It's nil if those aren't limited, see
+	// [Config.MaxInflightRequests].
+	inflight *inflightTracker
 
 	// udpListen are the listened UDP connections.
 	udpListen []*net.UDPConn
 
+	// xdpResponder answers the queries for the hot cache entries in the
+	// kernel.  It's nil if [Config.XDP] is nil or the proxy isn't started.
+	xdpResponder atomic.Pointer[xdp.Responder]
+
 	// tcpListen are the listened TCP connections.
 	tcpListen []net.Listener
 
@@ -156,15 +301,42 @@ type Proxy struct {
 	// dnsCryptTCPListen are the listened TCP connections for DNSCrypt.
 	dnsCryptTCPListen []net.Listener
 
+	// profiles are the prepared [Config.Profiles].
+	profiles []*profile
+
+	// clientRoutes are the prepared [Config.ClientRoutes].
+	clientRoutes []*clientRoute
+
+	// drain tracks the queries being handled by the listeners.  It's recreated
+	// on each start.
+	drain *drainer
+
 	// upstreamRTTStats maps the upstream address to its round-trip time
 	// statistics.  It's holds the statistics for all upstreams to perform a
 	// weighted random selection when using the load balancing mode.
 	upstreamRTTStats map[string]upstreamRTTStats
 
+	// backoffs are the backoff states of the failing upstreams, see
+	// [Config.UpstreamBackoff].  It's nil if the backoff is disabled.
+	backoffs *upstreamBackoffs
+
 	// dns64Prefs is a set of NAT64 prefixes that are used to detect and
-	// construct DNS64 responses.  The DNS64 function is disabled if it is
-	// empty.
-	dns64Prefs netutil.SliceSubnetSet
+	// construct DNS64 responses.  The DNS64 function is disabled if it is nil.
+	// It's replaced with the discovered prefixes if [Config.DNS64Discovery] is
+	// set.
+	dns64Prefs atomic.Pointer[netutil.SliceSubnetSet]
+
+	// dns64Exclude is the set of IPv4 networks, the A records within which are
+	// not used for DNS64 synthesis.
+	dns64Exclude netutil.SliceSubnetSet
+
+	// dns64Counter is the number of responses synthesized with
+	// [DNS64SynthesisRoundRobin], used to rotate the NAT64 prefixes.
+	dns64Counter atomic.Uint64
+
+	// nat64MinInterval is the minimum interval between the attempts to
+	// discover the NAT64 prefixes.
+	nat64MinInterval time.Duration
 
 	// Config is the proxy configuration.
 	//
@@ -183,8 +355,18 @@ type Proxy struct {
 	// Also make it a pointer.
 	sync.RWMutex
 
-	// ratelimitLock protects ratelimitBuckets.
-	ratelimitLock sync.Mutex
+	// disabledUpstreams is the set of the addresses of the upstreams disabled
+	// with [Proxy.SetUpstreamEnabled].  It's never modified once stored, so
+	// that it can be read without locking.
+	disabledUpstreams atomic.Pointer[map[string]struct{}]
+
+	// upstreamStateLock serializes the modifications of disabledUpstreams.
+	upstreamStateLock sync.Mutex
+
+	// reconfigureLock protects the fields of the embedded Config changed by
+	// [Proxy.Reconfigure], as well as cache, shortFlighter, and
+	// ratelimitBuckets.  It's held for reading while a request is resolved.
+	reconfigureLock sync.RWMutex
 
 	// rttLock protects upstreamRTTStats.
 	//
@@ -209,27 +391,45 @@ func New(c *Config) (p *Proxy, err error) {
 			c.BeforeRequestHandler,
 			noopRequestHandler{},
 		),
+		afterResponseHandler: cmp.Or[AfterResponseHandler](
+			c.AfterResponseHandler,
+			noopResponseHandler{},
+		),
+		stats:            &Stats{},
+		tracer:           newTracer(c.TracerProvider),
+		messageTap:       cmp.Or[MessageTap](c.MessageTap, EmptyMessageTap{}),
+		queryLogger:      cmp.Or[QueryLogger](c.QueryLogger, EmptyQueryLogger{}),
 		upstreamRTTStats: map[string]upstreamRTTStats{},
 		rttLock:          sync.Mutex{},
-		ratelimitLock:    sync.Mutex{},
 		RWMutex:          sync.RWMutex{},
-		bytesPool: &sync.Pool{
-			New: func() any {
-				// 2 bytes may be used to store packet length (see TCP/TLS).
-				b := make([]byte, 2+dns.MaxMsgSize)
-
-				return &b
-			},
-		},
-		udpOOBSize: proxynetutil.UDPGetOOBSize(),
-		time:       realClock{},
+		bytesPool:        syncutil.NewSlicePool[byte](2 + dns.MaxMsgSize),
+		dctxPool:         newDNSContextPool(c.EnableDNSContextPooling),
+		concurrency:      newConcurrencyLimiter(c.ConcurrencyLimit, c.MaxGoroutines),
+		inflight:         newInflightTracker(c.MaxInflightRequests, c.MaxInflightRequestsPerClient),
+		udpOOBSize:       proxynetutil.UDPGetOOBSize(),
+		time:             cmp.Or[Clock](c.Clock, realClock{}),
 		messages: cmp.Or[MessageConstructor](
 			c.MessageConstructor,
-			defaultMessageConstructor{},
+			DefaultMessageConstructor{},
 		),
-		recDetector: newRecursionDetector(recursionTTL, cachedRecurrentReqNum),
 	}
 
+	p.recDetector = newRecursionDetector(recursionTTL, cachedRecurrentReqNum, p.time)
+	p.udpTruncator = newUDPTruncator(c.UDPTruncation, p.time)
+	p.connLimiter = newConnLimiter(c.EncryptedConnLimit, p.time)
+	p.backoffs = newUpstreamBackoffs(c.UpstreamBackoff)
+	p.stats.backoffs = p.backoffs
+	p.forceTCP = newForceTCPMatcher(c.ForceTCP)
+	p.svcbRewriter = newSVCBRewriter(c.SVCBRewrite)
+	p.insecure = newInsecureMatcher(c.InsecureDomains)
+	p.fallbackTriggers = newFallbackMatcher(c.FallbackTriggers)
+	p.cacheOnly.Store(c.CacheOnly)
+	p.anomalies = newAnomalyDetector(c.Anomalies, p.time)
+	p.static = newStaticReplies(p.messages)
+
+	p.metrics = newMetricsListener(p.stats, c.MetricsListener)
+	p.initLoggers()
+
 	// TODO(e.burkov):  Validate config separately and add the contract to the
 	// New function.
 	err = p.validateConfig()
@@ -237,6 +437,13 @@ func New(c *Config) (p *Proxy, err error) {
 		return nil, err
 	}
 
+	p.anonymizer, err = newClientAnonymizer(p.clientAnonymization())
+	if err != nil {
+		return nil, fmt.Errorf("client anonymization: %w", err)
+	}
+
+	p.messageTap = p.withPrivacy(p.messageTap)
+
 	// TODO(s.chzhen):  Consider moving to [Proxy.validateConfig].
 	err = p.validateBasicAuth()
 	if err != nil {
@@ -244,22 +451,21 @@ func New(c *Config) (p *Proxy, err error) {
 	}
 
 	p.initCache()
+	p.initProfiles()
+	p.initClientRoutes()
+	p.initMirror()
+	p.initCompare()
+	p.initErrorReporting()
+	p.handler = p.buildHandler()
+	p.upstreamVerifyInterval = defaultUpstreamVerifyInterval
+	p.nat64MinInterval = defaultNAT64MinInterval
 
-	if p.MaxGoroutines > 0 {
-		log.Info("dnsproxy: max goroutines is set to %d", p.MaxGoroutines)
-
-		p.requestsSema = syncutil.NewChanSemaphore(p.MaxGoroutines)
-	} else {
-		p.requestsSema = syncutil.EmptySemaphore{}
-	}
+	p.requestsSema = p.newRequestsSema()
 
 	if p.UpstreamMode == UModeFastestAddr {
-		log.Info("dnsproxy: fastest ip is enabled")
+		p.logger.Info("fastest ip is enabled")
 
-		p.fastestAddr = fastip.NewFastestAddr()
-		if timeout := p.FastestPingTimeout; timeout > 0 {
-			p.fastestAddr.PingWaitTimeout = timeout
-		}
+		p.fastestAddr = p.newFastestAddr()
 	}
 
 	err = p.setupDNS64()
@@ -277,6 +483,25 @@ func New(c *Config) (p *Proxy, err error) {
 //
 // Deprecated:  Use the [New] function instead.
 func (p *Proxy) Init() (err error) {
+	p.initLoggers()
+
+	p.time = cmp.Or[Clock](p.Clock, realClock{})
+	p.recDetector = newRecursionDetector(recursionTTL, cachedRecurrentReqNum, p.time)
+	p.udpTruncator = newUDPTruncator(p.UDPTruncation, p.time)
+	p.connLimiter = newConnLimiter(p.EncryptedConnLimit, p.time)
+	p.backoffs = newUpstreamBackoffs(p.UpstreamBackoff)
+	p.forceTCP = newForceTCPMatcher(p.ForceTCP)
+	p.svcbRewriter = newSVCBRewriter(p.SVCBRewrite)
+	p.insecure = newInsecureMatcher(p.InsecureDomains)
+	p.fallbackTriggers = newFallbackMatcher(p.FallbackTriggers)
+	p.cacheOnly.Store(p.CacheOnly)
+	p.anomalies = newAnomalyDetector(p.Anomalies, p.time)
+
+	p.anonymizer, err = newClientAnonymizer(p.clientAnonymization())
+	if err != nil {
+		return fmt.Errorf("client anonymization: %w", err)
+	}
+
 	// TODO(s.chzhen):  Consider moving to [Proxy.validateConfig].
 	err = p.validateBasicAuth()
 	if err != nil {
@@ -284,32 +509,34 @@ func (p *Proxy) Init() (err error) {
 	}
 
 	p.initCache()
-
-	if p.MaxGoroutines > 0 {
-		log.Info("dnsproxy: max goroutines is set to %d", p.MaxGoroutines)
-
-		p.requestsSema = syncutil.NewChanSemaphore(p.MaxGoroutines)
-	} else {
-		p.requestsSema = syncutil.EmptySemaphore{}
-	}
+	p.initProfiles()
+	p.initClientRoutes()
+	p.initMirror()
+	p.initCompare()
+	p.initErrorReporting()
+	p.handler = p.buildHandler()
+	p.upstreamVerifyInterval = defaultUpstreamVerifyInterval
+	p.nat64MinInterval = defaultNAT64MinInterval
+
+	p.stats = &Stats{backoffs: p.backoffs}
+	p.metrics = newMetricsListener(p.stats, p.MetricsListener)
+	p.tracer = newTracer(p.TracerProvider)
+	p.messageTap = p.withPrivacy(cmp.Or[MessageTap](p.MessageTap, EmptyMessageTap{}))
+	p.queryLogger = cmp.Or[QueryLogger](p.QueryLogger, EmptyQueryLogger{})
+
+	p.requestsSema = p.newRequestsSema()
 
 	p.udpOOBSize = proxynetutil.UDPGetOOBSize()
-	p.bytesPool = &sync.Pool{
-		New: func() interface{} {
-			// 2 bytes may be used to store packet length (see TCP/TLS)
-			b := make([]byte, 2+dns.MaxMsgSize)
-
-			return &b
-		},
-	}
+	p.bytesPool = syncutil.NewSlicePool[byte](2 + dns.MaxMsgSize)
+	p.dctxPool = newDNSContextPool(p.EnableDNSContextPooling)
+	p.concurrency = newConcurrencyLimiter(p.ConcurrencyLimit, p.MaxGoroutines)
+	p.inflight = newInflightTracker(p.MaxInflightRequests, p.MaxInflightRequestsPerClient)
+	p.static = newStaticReplies(p.messages)
 
 	if p.UpstreamMode == UModeFastestAddr {
-		log.Info("dnsproxy: fastest ip is enabled")
+		p.logger.Info("fastest ip is enabled")
 
-		p.fastestAddr = fastip.NewFastestAddr()
-		if timeout := p.FastestPingTimeout; timeout > 0 {
-			p.fastestAddr.PingWaitTimeout = timeout
-		}
+		p.fastestAddr = p.newFastestAddr()
 	}
 
 	err = p.setupDNS64()
@@ -320,8 +547,6 @@ func (p *Proxy) Init() (err error) {
 	p.RatelimitWhitelist = slices.Clone(p.RatelimitWhitelist)
 	slices.SortFunc(p.RatelimitWhitelist, netip.Addr.Compare)
 
-	p.time = realClock{}
-
 	return nil
 }
 
@@ -340,12 +565,59 @@ func (p *Proxy) validateBasicAuth() (err error) {
 	return nil
 }
 
+// validateFastestAddr returns an error if the fastest address detection
+// settings of p are invalid.
+func (p *Proxy) validateFastestAddr() (err error) {
+	for i, port := range p.FastestPingPorts {
+		if port == 0 || port > math.MaxUint16 {
+			return fmt.Errorf("ping port at index %d: bad value %d", i, port)
+		}
+	}
+
+	if p.FastestFasterWait < 0 {
+		return fmt.Errorf("faster wait: negative value %s", p.FastestFasterWait)
+	}
+
+	if p.FastestIPv6Preference < 0 {
+		return fmt.Errorf("ipv6 preference: negative value %s", p.FastestIPv6Preference)
+	}
+
+	return nil
+}
+
+// newFastestAddr returns the fastest address detector configured from p.
+func (p *Proxy) newFastestAddr() (f *fastip.FastestAddr) {
+	f = fastip.NewFastestAddr()
+	f.Logger = p.upstreamLogger
+	f.Clock = p.time
+	f.ICMP = p.FastestPingICMP
+	f.MaxConcurrentPings = p.FastestMaxConcurrentPings
+	f.FasterWait = p.FastestFasterWait
+	f.IPv6Preference = p.FastestIPv6Preference
+	if timeout := p.FastestPingTimeout; timeout > 0 {
+		f.PingWaitTimeout = timeout
+	}
+
+	if len(p.FastestPingPorts) > 0 {
+		f.PingPorts = slices.Clone(p.FastestPingPorts)
+	}
+
+	return f
+}
+
 // type check
 var _ service.Interface = (*Proxy)(nil)
 
 // Start implements the [service.Interface] for *Proxy.
 func (p *Proxy) Start(ctx context.Context) (err error) {
-	log.Info("dnsproxy: starting dns proxy server")
+	p.logger.InfoContext(ctx, "starting dns proxy server")
+
+	if p.StartupGating == StartupGatingDelay {
+		err = p.verifyUpstreams(ctx)
+		if err != nil {
+			return fmt.Errorf("verifying upstreams: %w", err)
+		}
+	}
 
 	p.Lock()
 	defer p.Unlock()
@@ -360,11 +632,24 @@ func (p *Proxy) Start(ctx context.Context) (err error) {
 		return err
 	}
 
+	p.loadFastestCache(ctx)
+	p.loadUpstreamStats(ctx)
+
+	p.handler = p.buildHandler()
+	p.drain = newDrainer()
 	err = p.startListeners(ctx)
 	if err != nil {
 		return fmt.Errorf("starting listeners: %w", err)
 	}
 
+	if p.StartupGating == StartupGatingServFail {
+		p.startUpstreamsVerification()
+	}
+
+	if p.UseDNS64 && p.DNS64Discovery {
+		p.startNAT64Discovery()
+	}
+
 	p.started = true
 
 	return nil
@@ -382,47 +667,47 @@ func closeAll[C io.Closer](errs []error, closers ...C) (appended []error) {
 	return errs
 }
 
-// Shutdown implements the [service.Interface] for *Proxy.
-//
-// TODO(e.burkov):  Use the context.
-func (p *Proxy) Shutdown(_ context.Context) (err error) {
-	log.Info("dnsproxy: stopping server")
+// Shutdown implements the [service.Interface] for *Proxy.  It stops accepting
+// new queries and connections, waits for the queries being handled to be
+// answered until ctx is done, aborting the upstream exchanges of the remaining
+// ones then, and then closes the listeners and the upstreams.
+// The idle TCP, DNS-over-TLS, and DNS-over-QUIC connections are closed
+// gracefully.  The HTTP/3 connections are only closed after waiting.
+func (p *Proxy) Shutdown(ctx context.Context) (err error) {
+	p.logger.InfoContext(ctx, "stopping server")
 
 	p.Lock()
 	defer p.Unlock()
 
 	if !p.started {
-		log.Info("dnsproxy: dns proxy server is not started")
+		p.logger.InfoContext(ctx, "dns proxy server is not started")
 
 		return nil
 	}
 
-	errs := closeAll(nil, p.tcpListen...)
-	p.tcpListen = nil
-
-	errs = closeAll(errs, p.udpListen...)
-	p.udpListen = nil
-
-	errs = closeAll(errs, p.tlsListen...)
-	p.tlsListen = nil
+	p.stopUpstreamsVerification()
+	p.stopNAT64Discovery()
 
-	if p.httpsServer != nil {
-		errs = closeAll(errs, p.httpsServer)
-		p.httpsServer = nil
+	errs := p.stopAccepting(ctx)
+	errs = appendErr(errs, p.closeXDP())
+	errs = appendErr(errs, p.saveFastestCache())
+	errs = appendErr(errs, p.saveUpstreamStats())
 
-		// No need to close these since they're closed by httpsServer.Close().
-		p.httpsListen = nil
+	err = p.drain.wait(ctx)
+	if err != nil {
+		p.logger.WarnContext(ctx, "not all queries answered before shutdown", slogutil.KeyError, err)
+		errs = append(errs, err)
 	}
 
+	errs = closeAll(errs, p.udpListen...)
+	p.udpListen = nil
+
 	if p.h3Server != nil {
 		errs = closeAll(errs, p.h3Server)
 		p.h3Server = nil
 	}
 
-	errs = closeAll(errs, p.h3Listen...)
 	p.h3Listen = nil
-
-	errs = closeAll(errs, p.quicListen...)
 	p.quicListen = nil
 
 	errs = closeAll(errs, p.quicTransports...)
@@ -437,6 +722,7 @@ func (p *Proxy) Shutdown(_ context.Context) (err error) {
 	errs = closeAll(errs, p.dnsCryptTCPListen...)
 	p.dnsCryptTCPListen = nil
 
+	p.reconfigureLock.RLock()
 	for _, u := range []*UpstreamConfig{
 		p.UpstreamConfig,
 		p.PrivateRDNSUpstreamConfig,
@@ -446,10 +732,29 @@ func (p *Proxy) Shutdown(_ context.Context) (err error) {
 			errs = closeAll(errs, u)
 		}
 	}
+	p.reconfigureLock.RUnlock()
+
+	for _, prof := range p.profiles {
+		if prof.UpstreamConfig != nil {
+			errs = closeAll(errs, prof.UpstreamConfig)
+		}
+	}
+
+	for _, r := range p.clientRoutes {
+		errs = closeAll(errs, r.UpstreamConfig)
+	}
+
+	if p.ZoneTransfer != nil {
+		errs = closeAll(errs, p.ZoneTransfer.Upstreams...)
+	}
+
+	if p.DynamicUpdate != nil {
+		errs = closeAll(errs, p.DynamicUpdate.Upstreams...)
+	}
 
 	p.started = false
 
-	log.Println("dnsproxy: stopped dns proxy server")
+	p.logger.InfoContext(ctx, "stopped dns proxy server")
 
 	if len(errs) > 0 {
 		return fmt.Errorf("stopping dns proxy server: %w", errors.Join(errs...))
@@ -458,6 +763,65 @@ func (p *Proxy) Shutdown(_ context.Context) (err error) {
 	return nil
 }
 
+// stopAccepting makes the listeners of p stop accepting new queries and
+// connections and appends the occurred errors to errs.  The UDP connections are
+// kept open, since the responses are written to them.  The HTTPS server is
+// shut down gracefully, bounded by ctx.  p must be locked.
+func (p *Proxy) stopAccepting(ctx context.Context) (errs []error) {
+	p.drain.cancel()
+
+	now := time.Now()
+	for _, c := range p.udpListen {
+		errs = appendErr(errs, c.SetReadDeadline(now))
+	}
+
+	errs = closeAll(errs, p.tcpListen...)
+	p.tcpListen = nil
+
+	errs = closeAll(errs, p.tlsListen...)
+	p.tlsListen = nil
+
+	// Established QUIC connections are unaffected by closing the listeners,
+	// since those are created by the transports.
+	errs = closeAll(errs, p.quicListen...)
+	errs = closeAll(errs, p.h3Listen...)
+
+	if p.httpsServer != nil {
+		// No need to close the listeners since they're closed by
+		// httpsServer.Shutdown.
+		errs = appendErr(errs, p.httpsServer.Shutdown(ctx))
+		p.httpsServer = nil
+		p.httpsListen = nil
+	}
+
+	if p.dnsCryptServer != nil {
+		err := p.dnsCryptServer.Shutdown(ctx)
+		if !errors.Is(err, dnscrypt.ErrServerNotStarted) {
+			errs = appendErr(errs, err)
+		}
+	}
+
+	return errs
+}
+
+// appendErr appends err to errs if it's not nil.
+func appendErr(errs []error, err error) (appended []error) {
+	if err != nil {
+		return append(errs, err)
+	}
+
+	return errs
+}
+
+// IsStarted returns true if the proxy has been started and its listeners are
+// bound.
+func (p *Proxy) IsStarted() (ok bool) {
+	p.RLock()
+	defer p.RUnlock()
+
+	return p.started
+}
+
 // Addrs returns all listen addresses for the specified proto or nil if the proxy does not listen to it.
 // proto must be "tcp", "tls", "https", "quic", or "udp"
 func (p *Proxy) Addrs(proto Proto) []net.Addr {
@@ -556,7 +920,7 @@ func (p *Proxy) Addr(proto Proto) net.Addr {
 
 // selectUpstreams returns the upstreams to use for the specified host.  It
 // firstly considers custom upstreams if those aren't empty and then the
-// configured ones.  The returned slice may be empty or nil.
+// configured ones of the client route, the profile, or the general ones.  The returned slice may be empty or nil.
 func (p *Proxy) selectUpstreams(d *DNSContext) (upstreams []upstream.Upstream, isPrivate bool) {
 	q := d.Req.Question[0]
 	host := q.Name
@@ -585,14 +949,25 @@ func (p *Proxy) selectUpstreams(d *DNSContext) (upstreams []upstream.Upstream, i
 		}
 	}
 
+	uc := p.UpstreamConfig
+	if d.clientRoute != nil {
+		uc = d.clientRoute.UpstreamConfig
+	} else if d.profile != nil && d.profile.UpstreamConfig != nil {
+		uc = d.profile.UpstreamConfig
+	}
+
 	// Use configured.
-	return getUpstreams(p.UpstreamConfig, host), false
+	return p.filterDisabled(getUpstreams(uc, host)), false
 }
 
 // replyFromUpstream tries to resolve the request via configured upstream
 // servers.  It returns true if the response actually came from an upstream.
 func (p *Proxy) replyFromUpstream(d *DNSContext) (ok bool, err error) {
-	req := d.Req
+	req := p.withTraceID(d, p.upstreamRequest(d))
+
+	if target, isDNS64PTR := p.dns64PTRTarget(req); isDNS64PTR {
+		return p.replyDNS64PTR(d, target)
+	}
 
 	upstreams, isPrivate := p.selectUpstreams(d)
 	if len(upstreams) == 0 {
@@ -605,41 +980,69 @@ func (p *Proxy) replyFromUpstream(d *DNSContext) (ok bool, err error) {
 		p.recDetector.add(d.Req)
 	}
 
-	start := time.Now()
+	start := p.time.Now()
 	src := "upstream"
 
 	// Perform the DNS request.
-	resp, u, err := p.exchangeUpstreams(req, upstreams)
-	if dns64Ups := p.performDNS64(req, resp, upstreams); dns64Ups != nil {
+	span := p.startChildSpan(d, spanUpstream)
+	ctx := d.Context()
+	upsCtx, cancel := p.generalUpstreamsContext(ctx)
+	resp, u, err := p.exchangeUpstreams(upsCtx, req, upstreams)
+	cancel()
+	endExchangeSpan(span, u, err)
+	if !isPrivate {
+		p.compare(req, resp, u)
+	}
+
+	if dns64Ups := p.performDNS64(ctx, req, resp, upstreams); dns64Ups != nil {
 		u = dns64Ups
 	} else if p.isBogusNXDomain(resp) {
-		log.Debug("dnsproxy: replying from upstream: response contains bogus-nxdomain ip")
+		p.logger.Debug("replying from upstream: response contains bogus-nxdomain ip")
 		resp = p.messages.NewMsgNXDOMAIN(req)
 	}
 
-	if err != nil && !isPrivate && p.Fallbacks != nil {
-		log.Debug("dnsproxy: replying from upstream: using fallback due to %s", err)
+	if !isPrivate && p.shouldFallback(ctx, req, resp, err) {
+		if err != nil {
+			p.logger.Debug("replying from upstream: using fallback", slogutil.KeyError, err)
+		} else {
+			p.logger.Debug(
+				"replying from upstream: using fallback",
+				"rcode", dns.RcodeToString[resp.Rcode],
+				"answers", len(resp.Answer),
+			)
+		}
 
-		// Reset the timer.
-		start = time.Now()
-		src = "fallback"
+		fbStart := p.time.Now()
 
 		// upstreams mustn't appear empty since they have been validated when
 		// creating proxy.
 		upstreams = p.Fallbacks.getUpstreamsForDomain(req.Question[0].Name)
 
-		resp, u, err = upstream.ExchangeParallel(upstreams, req)
+		span = p.startChildSpan(d, spanFallback)
+		fbResp, fbUps, fbErr := upstream.ExchangeParallelContext(ctx, upstreams, req)
+		p.recordExchange(fbUps, req, fbResp, fbStart, p.time.Now().Sub(fbStart), fbErr)
+		endExchangeSpan(span, fbUps, fbErr)
+
+		if fbErr == nil || resp == nil {
+			// Reset the timer.
+			start, src = fbStart, "fallback"
+			resp, u, err = fbResp, fbUps, fbErr
+		} else {
+			// Keep the response which has triggered the fallbacks.
+			p.logger.Debug("replying from upstream: fallback failed", slogutil.KeyError, fbErr)
+		}
 	}
 
 	if err != nil {
-		log.Debug("dnsproxy: replying from %s: %s", src, err)
+		p.logger.Debug("replying", "src", src, slogutil.KeyError, err)
 	}
 
 	if resp != nil {
-		d.QueryDuration = time.Since(start)
-		log.Debug("dnsproxy: replying from %s: rtt is %s", src, d.QueryDuration)
+		d.QueryDuration = p.time.Now().Sub(start)
+		p.logger.Debug("replying", "src", src, "rtt", d.QueryDuration)
 	}
 
+	p.reportErrors(req, resp)
 	p.handleExchangeResult(d, req, resp, u)
 
 	return resp != nil, err
@@ -686,11 +1089,35 @@ func addDO(msg *dns.Msg) {
 // defaultUDPBufSize defines the default size of UDP buffer for EDNS0 RRs.
 const defaultUDPBufSize = 2048
 
+// Messages returns the constructor of the DNS messages used by p, see
+// [Config.MessageConstructor].
+func (p *Proxy) Messages() (mc MessageConstructor) {
+	return p.messages
+}
+
+// ResolveContext is like [Proxy.Resolve], but uses ctx as the context of the
+// request, see [DNSContext.Context], so that the exchanges with the upstreams
+// are aborted once it's canceled.  ctx must not be nil.
+func (p *Proxy) ResolveContext(ctx context.Context, dctx *DNSContext) (err error) {
+	dctx.ctx = ctx
+
+	return p.Resolve(dctx)
+}
+
 // Resolve is the default resolving method used by the DNS proxy to query
 // upstream servers.  It expects dctx is filled with the request, the client's
 func (p *Proxy) Resolve(dctx *DNSContext) (err error) {
-	if p.EnableEDNSClientSubnet {
-		dctx.processECS(p.EDNSAddr)
+	p.reconfigureLock.RLock()
+	defer p.reconfigureLock.RUnlock()
+
+	defer p.withQueryBudget(dctx)()
+
+	p.assignTraceID(dctx)
+
+	if p.PrivacyMode {
+		removeECS(dctx.Req)
+	} else if ecsEnabled, ecsAddr := p.ecsConfig(dctx); ecsEnabled {
+		dctx.processECS(ecsAddr, p.logger)
 	}
 
 	dctx.calcFlagsAndSize()
@@ -699,36 +1126,72 @@ func (p *Proxy) Resolve(dctx *DNSContext) (err error) {
 	// since only validated responses are cached and those may be not the
 	// desired result for user specifying CD flag.
 	cacheWorks := p.cacheWorks(dctx)
+	insecure := p.insecure.match(dctx.Req)
 	if cacheWorks {
 		if p.replyFromCache(dctx) {
 			// Complete the response from cache.
+			p.rewriteSVCB(dctx)
+			dctx.scrub()
+
+			return nil
+		}
+
+		if !insecure && p.replyFromNSEC(dctx) {
 			dctx.scrub()
 
 			return nil
 		}
 
 		// On cache miss request for DNSSEC from the upstream to cache it
-		// afterwards.
-		addDO(dctx.Req)
+		// afterwards, unless the domain is exempt from DNSSEC.
+		if !insecure {
+			addDO(dctx.Req)
+		}
+	}
+
+	if p.cacheOnly.Load() {
+		return p.replyCacheOnly(dctx)
 	}
 
 	var ok bool
-	ok, err = p.replyFromUpstream(dctx)
+	if insecure {
+		ok, err = p.replyFromUpstreamInsecure(dctx)
+	} else {
+		ok, err = p.replyFromUpstream(dctx)
+	}
+
+	if ok {
+		p.chaseCNAME(dctx)
+	}
 
 	// Don't cache the responses having CD flag, just like Dnsmasq does.  It
 	// prevents the cache from being poisoned with unvalidated answers which may
 	// differ from validated ones.
 	//
 	// See https://github.com/imp/dnsmasq/blob/770bce967cfc9967273d0acfb3ea018fb7b17522/src/forward.c#L1169-L1172.
-	if cacheWorks && ok && !dctx.Res.CheckingDisabled {
+	//
+	// The private address may also be discovered while resolving, see
+	// [Proxy.replyDNS64PTR].
+	isPrivate := dctx.RequestedPrivateRDNS != netip.Prefix{}
+	if cacheWorks && ok && !dctx.Res.CheckingDisabled && !isPrivate {
 		// Cache the response with DNSSEC RRs.
 		p.cacheResp(dctx)
 	}
 
+	if ok {
+		p.orderAnswers(dctx.Res)
+	}
+
 	// It is possible that the response is nil if the upstream hasn't been
 	// chosen.
 	if dctx.Res != nil {
+		p.rewriteSVCB(dctx)
+		dctx.resECS = ecsPrefixFromMsg(dctx.Res)
 		filterMsg(dctx.Res, dctx.Res, dctx.adBit, dctx.doBit, 0)
+
+		// Replace the response after filtering, since it removes the OPT
+		// record with the extended DNS error.
+		dctx.Res = p.servFailForRcode(dctx.Req, dctx.Res)
 	}
 
 	// Complete the response.
@@ -744,14 +1207,26 @@ func (p *Proxy) Resolve(dctx *DNSContext) (err error) {
 // cacheWorks returns true if the cache works for the given context.  If not, it
 // returns false and logs the reason why.
 func (p *Proxy) cacheWorks(dctx *DNSContext) (ok bool) {
-	var reason string
+	reason := p.cacheDisabledReason(dctx)
+	if reason == "" {
+		return true
+	}
+
+	p.cacheLogger.Debug("not caching", "reason", reason)
+
+	return false
+}
+
+// cacheDisabledReason returns the reason why the cache doesn't work for the
+// given context or an empty string if it works.
+func (p *Proxy) cacheDisabledReason(dctx *DNSContext) (reason string) {
 	switch {
-	case p.cache == nil:
-		reason = "disabled"
+	case p.defaultCache(dctx) == nil:
+		return "disabled"
 	case dctx.RequestedPrivateRDNS != netip.Prefix{}:
 		// Don't cache the requests intended for local upstream servers, those
 		// should be fast enough as is.
-		reason = "requested address is private"
+		return "requested address is private"
 	case dctx.CustomUpstreamConfig != nil && dctx.CustomUpstreamConfig.cache == nil:
 		// In case of custom upstream cache is not configured, the global proxy
 		// cache cannot be used because different upstreams can return different
@@ -760,25 +1235,32 @@ func (p *Proxy) cacheWorks(dctx *DNSContext) (ok bool) {
 		// See https://github.com/AdguardTeam/dnsproxy/issues/169.
 		//
 		// TODO(e.burkov):  It probably should be decided after resolve.
-		reason = "custom upstreams cache is not configured"
+		return "custom upstreams cache is not configured"
 	case dctx.Req.CheckingDisabled:
-		reason = "dnssec check disabled"
+		return "dnssec check disabled"
 	default:
-		return true
+		return ""
 	}
+}
 
-	log.Debug("dnsproxy: cache: %s; not caching", reason)
+// ecsConfig returns the EDNS Client Subnet settings for dctx, which are the
+// ones of its profile, if any.
+func (p *Proxy) ecsConfig(dctx *DNSContext) (enabled bool, addr net.IP) {
+	if dctx.profile != nil {
+		return dctx.profile.EnableEDNSClientSubnet, dctx.profile.EDNSAddr
+	}
 
-	return false
+	return p.EnableEDNSClientSubnet, p.EDNSAddr
 }
 
-// processECS adds EDNS Client Subnet data into the request from d.
-func (dctx *DNSContext) processECS(cliIP net.IP) {
+// processECS adds EDNS Client Subnet data into the request from d.  l is used
+// for logging.
+func (dctx *DNSContext) processECS(cliIP net.IP, l *slog.Logger) {
 	if ecs, _ := ecsFromMsg(dctx.Req); ecs != nil {
 		if ones, _ := ecs.Mask.Size(); ones != 0 {
 			dctx.ReqECS = ecs
 
-			log.Debug("dnsproxy: passing through ecs: %s", dctx.ReqECS)
+			l.Debug("passing through ecs", "subnet", dctx.ReqECS)
 
 			return
 		}
@@ -797,6 +1279,6 @@ func (dctx *DNSContext) processECS(cliIP net.IP) {
 		// Section 6.
 		dctx.ReqECS = setECS(dctx.Req, cliIP, 0)
 
-		log.Debug("dnsproxy: setting ecs: %s", dctx.ReqECS)
+		l.Debug("setting ecs", "subnet", dctx.ReqECS)
 	}
 }
@@ -8,7 +8,7 @@ import (
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
-	"io"
+	"log/slog"
 	"math/big"
 	"net"
 	"net/netip"
@@ -18,9 +18,10 @@ import (
 	"testing"
 	"time"
 
+	proxynetutil "github.com/AdguardTeam/dnsproxy/internal/netutil"
 	"github.com/AdguardTeam/dnsproxy/upstream"
 	glcache "github.com/AdguardTeam/golibs/cache"
-	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
 	"github.com/AdguardTeam/golibs/netutil"
 	"github.com/AdguardTeam/golibs/testutil"
 	"github.com/miekg/dns"
@@ -28,9 +29,12 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
+// testLogger is the common logger for tests.
+var testLogger = slogutil.NewDiscardLogger()
+
 func TestMain(m *testing.M) {
 	// Disable logging in tests.
-	log.SetOutput(io.Discard)
+	slog.SetDefault(testLogger)
 
 	os.Exit(m.Run())
 }
@@ -533,7 +537,7 @@ func TestProxy_Resolve_dnssecCache(t *testing.T) {
 				t.Fatalf("wanted length has unexpected value %d", tc.wantLen)
 			}
 
-			cached, expired, key := p.cache.get(dctx.Req)
+			cached, expired, key := p.cache.get(dctx.Req, nil)
 			require.NotNil(t, cached)
 			require.Len(t, cached.m.Answer, 2)
 			assert.False(t, expired)
@@ -1316,7 +1320,7 @@ func TestECSProxyCacheMinMaxTTL(t *testing.T) {
 	ci, expired, key := prx.cache.getWithSubnet(d.Req, &net.IPNet{
 		IP:   clientIP,
 		Mask: net.CIDRMask(24, netutil.IPv4BitLen),
-	})
+	}, nil)
 	assert.False(t, expired)
 
 	assert.Equal(t, key, msgToKeyWithSubnet(d.Req, clientIP, 24))
@@ -1342,7 +1346,7 @@ func TestECSProxyCacheMinMaxTTL(t *testing.T) {
 	ci, expired, key = prx.cache.getWithSubnet(d.Req, &net.IPNet{
 		IP:   clientIP,
 		Mask: net.CIDRMask(24, netutil.IPv4BitLen),
-	})
+	}, nil)
 	assert.False(t, expired)
 	assert.Equal(t, key, msgToKeyWithSubnet(d.Req, clientIP, 24))
 	assert.True(t, ci.m.Answer[0].Header().Ttl == prx.CacheMaxTTL)
@@ -1386,6 +1390,12 @@ func TestProxy_Resolve_withOptimisticResolver(t *testing.T) {
 			CacheEnabled:    true,
 			CacheOptimistic: true,
 		},
+		metrics:     EmptyMetricsListener{},
+		tracer:      newTracer(nil),
+		messageTap:  EmptyMessageTap{},
+		logger:      testLogger,
+		cacheLogger: testLogger,
+		time:        realClock{},
 	}
 
 	p.initCache()
@@ -1419,7 +1429,7 @@ func TestProxy_Resolve_withOptimisticResolver(t *testing.T) {
 	data := (&cacheItem{
 		m: buildResp(req, 0),
 		u: testUpsAddr,
-	}).pack()
+	}).pack(time.Now())
 	items := glcache.New(glcache.Config{
 		EnableLRU: true,
 	})
@@ -1461,6 +1471,9 @@ type testMessageConstructor struct {
 	onNewMsgNXDOMAIN       func(req *dns.Msg) (resp *dns.Msg)
 	onNewMsgSERVFAIL       func(req *dns.Msg) (resp *dns.Msg)
 	onNewMsgNOTIMPLEMENTED func(req *dns.Msg) (resp *dns.Msg)
+	onNewMsgNODATA         func(req *dns.Msg) (resp *dns.Msg)
+	onNewMsgBlocked        func(req *dns.Msg) (resp *dns.Msg)
+	onNewMsgRatelimited    func(req *dns.Msg) (resp *dns.Msg)
 }
 
 // type check
@@ -1484,6 +1497,24 @@ func (c *testMessageConstructor) NewMsgNOTIMPLEMENTED(req *dns.Msg) (resp *dns.M
 	return c.onNewMsgNOTIMPLEMENTED(req)
 }
 
+// NewMsgNODATA implements the [MessageConstructor] interface for
+// *testMessageConstructor.
+func (c *testMessageConstructor) NewMsgNODATA(req *dns.Msg) (resp *dns.Msg) {
+	return c.onNewMsgNODATA(req)
+}
+
+// NewMsgBlocked implements the [MessageConstructor] interface for
+// *testMessageConstructor.
+func (c *testMessageConstructor) NewMsgBlocked(req *dns.Msg) (resp *dns.Msg) {
+	return c.onNewMsgBlocked(req)
+}
+
+// NewMsgRatelimited implements the [MessageConstructor] interface for
+// *testMessageConstructor.
+func (c *testMessageConstructor) NewMsgRatelimited(req *dns.Msg) (resp *dns.Msg) {
+	return c.onNewMsgRatelimited(req)
+}
+
 func TestProxy_HandleDNSRequest_private(t *testing.T) {
 	t.Parallel()
 
@@ -1526,6 +1557,9 @@ func TestProxy_HandleDNSRequest_private(t *testing.T) {
 		},
 		onNewMsgSERVFAIL:       func(_ *dns.Msg) (_ *dns.Msg) { panic("not implemented") },
 		onNewMsgNOTIMPLEMENTED: func(_ *dns.Msg) (_ *dns.Msg) { panic("not implemented") },
+		onNewMsgNODATA:         func(_ *dns.Msg) (_ *dns.Msg) { panic("not implemented") },
+		onNewMsgBlocked:        func(_ *dns.Msg) (_ *dns.Msg) { panic("not implemented") },
+		onNewMsgRatelimited:    func(_ *dns.Msg) (_ *dns.Msg) { panic("not implemented") },
 	}
 
 	p := mustNew(t, &Config{
@@ -1583,3 +1617,115 @@ func TestProxy_HandleDNSRequest_private(t *testing.T) {
 		})
 	}
 }
+
+func TestProxy_listenSockets(t *testing.T) {
+	if !proxynetutil.ReusePortSupported {
+		t.Skip("SO_REUSEPORT is not supported")
+	}
+
+	const socketsNum = 4
+
+	p := mustNew(t, &Config{
+		Logger:        testLogger,
+		UDPListenAddr: []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		TCPListenAddr: []*net.TCPAddr{net.TCPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{newProfileTestUpstream("192.0.2.1")},
+		},
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+		ListenSockets:          socketsNum,
+	})
+
+	ctx := context.Background()
+	require.NoError(t, p.Start(ctx))
+	testutil.CleanupAndRequireSuccess(t, func() (err error) { return p.Shutdown(ctx) })
+
+	for _, proto := range []Proto{ProtoUDP, ProtoTCP} {
+		t.Run(string(proto), func(t *testing.T) {
+			addrs := p.Addrs(proto)
+			require.Len(t, addrs, socketsNum)
+
+			addr := p.Addr(proto).String()
+			for _, a := range addrs {
+				assert.Equal(t, addr, a.String())
+			}
+
+			// Use a new connection for each request, so that the requests are
+			// distributed among the sockets.
+			client := &dns.Client{Net: string(proto), Timeout: defaultTimeout}
+			for range 2 * socketsNum {
+				resp, _, err := client.Exchange(newHostTestMessage("example.org"), addr)
+				require.NoError(t, err)
+				require.NotNil(t, resp)
+
+				assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+				assert.Len(t, resp.Answer, 1)
+			}
+		})
+	}
+}
+
+// startBenchProxy returns a new started proxy listening for plain DNS over UDP
+// and TCP and answering from an upstream without network.  modify, if not nil,
+// is called on the configuration before creating the proxy.
+func startBenchProxy(b *testing.B, modify func(conf *Config)) (p *Proxy) {
+	b.Helper()
+
+	conf := &Config{
+		Logger:        slogutil.NewDiscardLogger(),
+		UDPListenAddr: []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		TCPListenAddr: []*net.TCPAddr{net.TCPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{newProfileTestUpstream("192.0.2.1")},
+		},
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+	}
+	if modify != nil {
+		modify(conf)
+	}
+
+	p, err := New(conf)
+	require.NoError(b, err)
+
+	ctx := context.Background()
+	require.NoError(b, p.Start(ctx))
+	testutil.CleanupAndRequireSuccess(b, func() (err error) { return p.Shutdown(ctx) })
+
+	return p
+}
+
+// benchmarkExchange sends the requests to p over proto using a single
+// connection and checks the responses.
+func benchmarkExchange(b *testing.B, p *Proxy, proto Proto) {
+	b.Helper()
+
+	conn, err := dns.Dial(string(proto), p.Addr(proto).String())
+	require.NoError(b, err)
+	testutil.CleanupAndRequireSuccess(b, conn.Close)
+
+	req := newHostTestMessage("example.org")
+
+	var resp *dns.Msg
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		err = conn.WriteMsg(req)
+		if err != nil {
+			break
+		}
+
+		resp, err = conn.ReadMsg()
+		if err != nil {
+			break
+		}
+	}
+
+	require.NoError(b, err)
+	require.NotNil(b, resp)
+	require.Len(b, resp.Answer, 1)
+}
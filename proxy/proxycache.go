@@ -3,8 +3,6 @@ package proxy
 import (
 	"net"
 	"slices"
-
-	"github.com/AdguardTeam/golibs/log"
 )
 
 // cacheForContext returns cache object for the given context.
@@ -13,45 +11,77 @@ func (p *Proxy) cacheForContext(d *DNSContext) (c *cache) {
 		return d.CustomUpstreamConfig.cache
 	}
 
-	return p.cache
+	return p.defaultCache(d)
+}
+
+// defaultCache returns the cache of the client route or the profile of d, if
+// any, or the general one.  It ignores the custom upstream configuration.
+func (p *Proxy) defaultCache(d *DNSContext) (c *cache) {
+	switch {
+	case d.clientRoute != nil:
+		return d.clientRoute.cache
+	case d.profile != nil:
+		return d.profile.cache
+	default:
+		return p.cache
+	}
 }
 
 // replyFromCache tries to get the response from general or subnet cache.  In
 // case the cache is present in d, it's used first.  Returns true on success.
 func (p *Proxy) replyFromCache(d *DNSContext) (hit bool) {
+	span := p.startChildSpan(d, spanCache)
+	defer span.End()
+
 	dctxCache := p.cacheForContext(d)
 
+	keyPtr := dctxCache.keys.Get()
+	defer dctxCache.keys.Put(keyPtr)
+
 	var ci *cacheItem
 	var hitMsg string
 	var expired bool
 	var key []byte
 
+	// Serve the expired items in the cache-only mode, since those can't be
+	// resolved again.
+	cacheOnly := p.cacheOnly.Load()
+	stale := dctxCache.optimistic || cacheOnly
+
 	// TODO(d.kolyshev): Use EnableEDNSClientSubnet from dctxCache.
-	if !p.Config.EnableEDNSClientSubnet {
-		ci, expired, key = dctxCache.get(d.Req)
+	if ecsEnabled, _ := p.ecsConfig(d); !ecsEnabled {
+		ci, expired, key = dctxCache.getStale(d.Req, *keyPtr, stale)
 		hitMsg = "serving cached response"
 	} else if d.ReqECS != nil {
-		ci, expired, key = dctxCache.getWithSubnet(d.Req, d.ReqECS)
+		ci, expired, key = dctxCache.getWithSubnetStale(d.Req, d.ReqECS, *keyPtr, stale)
 		hitMsg = "serving response from subnet cache"
 	} else {
-		ci, expired, key = dctxCache.get(d.Req)
+		ci, expired, key = dctxCache.getStale(d.Req, *keyPtr, stale)
 		hitMsg = "serving response from general cache"
 	}
 
-	if hit = ci != nil; !hit {
+	hit = ci != nil
+	p.metrics.OnCacheLookup(hit)
+	span.SetAttributes(attrCacheHit.Bool(hit))
+	if !hit {
+		p.eventListener().OnCacheMiss(d)
+
 		return hit
 	}
 
 	d.Res = ci.m
 	d.CachedUpstreamAddr = ci.u
+	d.cacheHit = true
+	p.eventListener().OnCacheHit(d)
 
-	log.Debug("dnsproxy: cache: %s", hitMsg)
+	dctxCache.logger.Debug(hitMsg)
 
-	if dctxCache.optimistic && expired {
+	if dctxCache.optimistic && expired && !cacheOnly {
 		// Build a reduced clone of the current context to avoid data race.
 		minCtxClone := &DNSContext{
 			// It is only read inside the optimistic resolver.
 			CustomUpstreamConfig: d.CustomUpstreamConfig,
+			profile:              d.profile,
 			ReqECS:               cloneIPNet(d.ReqECS),
 			IsPrivateClient:      d.IsPrivateClient,
 		}
@@ -60,7 +90,16 @@ func (p *Proxy) replyFromCache(d *DNSContext) (hit bool) {
 			addDO(minCtxClone.Req)
 		}
 
-		go p.shortFlighter.ResolveOnce(minCtxClone, key)
+		// Clone the key, since the buffer is returned to the pool.
+		key = slices.Clone(key)
+
+		sf := p.shortFlighter
+		go func() {
+			p.reconfigureLock.RLock()
+			defer p.reconfigureLock.RUnlock()
+
+			sf.ResolveOnce(minCtxClone, key)
+		}()
 	}
 
 	return hit
@@ -82,8 +121,9 @@ func cloneIPNet(n *net.IPNet) (clone *net.IPNet) {
 // cache is present in d, it's used first.
 func (p *Proxy) cacheResp(d *DNSContext) {
 	dctxCache := p.cacheForContext(d)
+	dctxCache.nsec.add(d.Res, d.Upstream)
 
-	if !p.EnableEDNSClientSubnet {
+	if ecsEnabled, _ := p.ecsConfig(d); !ecsEnabled {
 		dctxCache.set(d.Res, d.Upstream)
 
 		return
@@ -103,7 +143,7 @@ func (p *Proxy) cacheResp(d *DNSContext) {
 		// TODO(a.meshkov):  The whole response MUST be dropped if ECS in it
 		// doesn't correspond.
 		if !ecs.IP.Mask(ecs.Mask).Equal(d.ReqECS.IP.Mask(d.ReqECS.Mask)) || ones != reqOnes {
-			log.Debug("dnsproxy: cache: bad response: ecs %s does not match %s", ecs, d.ReqECS)
+			dctxCache.logger.Debug("bad response: ecs does not match", "ecs", ecs, "req_ecs", d.ReqECS)
 
 			return
 		}
@@ -118,7 +158,7 @@ func (p *Proxy) cacheResp(d *DNSContext) {
 			ecs.IP = ecs.IP.Mask(ecs.Mask)
 		}
 
-		log.Debug("dnsproxy: cache: ecs option in response: %s", ecs)
+		dctxCache.logger.Debug("ecs option in response", "ecs", ecs)
 
 		dctxCache.setWithSubnet(d.Res, d.Upstream, ecs)
 	case d.ReqECS != nil:
@@ -130,11 +170,64 @@ func (p *Proxy) cacheResp(d *DNSContext) {
 	}
 }
 
-// ClearCache clears the DNS cache of p.
+// flushZoneCache flushes the cached responses for the names within zone from
+// the DNS cache of p, including the caches of the profiles and the client
+// routes.
+func (p *Proxy) flushZoneCache(zone string) {
+	p.reconfigureLock.RLock()
+	defer p.reconfigureLock.RUnlock()
+
+	if p.cache != nil {
+		p.cache.flushZone(zone)
+		p.cacheLogger.Debug("zone flushed", "zone", zone)
+	}
+
+	// The responses stored in the kernel can't be matched by zone, so remove
+	// them all.
+	p.clearXDP()
+
+	for _, prof := range p.profiles {
+		if prof.cache != nil {
+			prof.cache.flushZone(zone)
+			p.cacheLogger.Debug("profile zone flushed", "profile", prof.Name, "zone", zone)
+		}
+	}
+
+	for _, r := range p.clientRoutes {
+		if r.cache != nil {
+			r.cache.flushZone(zone)
+			p.cacheLogger.Debug("client route zone flushed", "route", r.Name, "zone", zone)
+		}
+	}
+}
+
+// ClearCache clears the DNS cache of p, including the caches of the profiles
+// and the client routes.
 func (p *Proxy) ClearCache() {
+	p.reconfigureLock.RLock()
+	defer p.reconfigureLock.RUnlock()
+
 	if p.cache != nil {
 		p.cache.clearItems()
 		p.cache.clearItemsWithSubnet()
-		log.Debug("dnsproxy: cache: cleared")
+		p.cacheLogger.Debug("cache cleared")
+	}
+
+	p.clearXDP()
+
+	for _, prof := range p.profiles {
+		if prof.cache != nil {
+			prof.cache.clearItems()
+			prof.cache.clearItemsWithSubnet()
+			p.cacheLogger.Debug("profile cache cleared", "profile", prof.Name)
+		}
+	}
+
+	for _, r := range p.clientRoutes {
+		if r.cache != nil {
+			r.cache.clearItems()
+			r.cache.clearItemsWithSubnet()
+			p.cacheLogger.Debug("client route cache cleared", "route", r.Name)
+		}
 	}
 }
@@ -0,0 +1,104 @@
+// Package proxytest provides utilities for the integration testing of the code
+// using dnsproxy: the test upstream servers of all the common protocols
+// answering with the scripted responses and the proxy listening on the
+// ephemeral ports.
+package proxytest
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// DefaultTimeout is the timeout used by the helpers of this package.
+const DefaultTimeout = 5 * time.Second
+
+// NewProxy returns a new started proxy with conf, which must not be nil.  The
+// proxy is shut down on the cleanup of tb.  Some of the zero fields of conf are
+// set to the values convenient for tests:
+//
+//   - the proxy listens for plain DNS over UDP and TCP on the ephemeral ports
+//     of the loopback interface, if it doesn't have any listen addresses;
+//   - all the addresses are trusted to be proxies;
+//   - the logs are discarded.
+func NewProxy(tb testing.TB, conf *proxy.Config) (p *proxy.Proxy) {
+	tb.Helper()
+
+	if !hasListenAddrs(conf) {
+		addr := netip.AddrPortFrom(netip.AddrFrom4([4]byte{127, 0, 0, 1}), 0)
+		conf.UDPListenAddr = []*net.UDPAddr{net.UDPAddrFromAddrPort(addr)}
+		conf.TCPListenAddr = []*net.TCPAddr{net.TCPAddrFromAddrPort(addr)}
+	}
+
+	if conf.TrustedProxies == nil {
+		conf.TrustedProxies = netutil.SliceSubnetSet{
+			netip.MustParsePrefix("0.0.0.0/0"),
+			netip.MustParsePrefix("::0/0"),
+		}
+	}
+
+	if conf.Logger == nil {
+		conf.Logger = slogutil.NewDiscardLogger()
+	}
+
+	p, err := proxy.New(conf)
+	require.NoError(tb, err)
+
+	ctx := context.Background()
+	require.NoError(tb, p.Start(ctx))
+	testutil.CleanupAndRequireSuccess(tb, func() (err error) { return p.Shutdown(ctx) })
+
+	return p
+}
+
+// hasListenAddrs returns true if conf has any listen addresses.
+func hasListenAddrs(conf *proxy.Config) (ok bool) {
+	return len(conf.UDPListenAddr) > 0 ||
+		len(conf.TCPListenAddr) > 0 ||
+		len(conf.TLSListenAddr) > 0 ||
+		len(conf.HTTPSListenAddr) > 0 ||
+		len(conf.QUICListenAddr) > 0 ||
+		len(conf.DNSCryptUDPListenAddr) > 0 ||
+		len(conf.DNSCryptTCPListenAddr) > 0 ||
+		len(conf.Profiles) > 0
+}
+
+// NewUpstreamConfig returns the upstream configuration with the upstreams of
+// servers, see [Server.Upstream].
+func NewUpstreamConfig(tb testing.TB, servers ...*Server) (conf *proxy.UpstreamConfig) {
+	tb.Helper()
+
+	conf = &proxy.UpstreamConfig{}
+	for _, s := range servers {
+		conf.Upstreams = append(conf.Upstreams, s.Upstream(tb, &upstream.Options{
+			Timeout: DefaultTimeout,
+		}))
+	}
+
+	return conf
+}
+
+// Exchange sends req to p over plain DNS using proto, which must be either
+// [proxy.ProtoUDP] or [proxy.ProtoTCP], and returns the response.
+func Exchange(tb testing.TB, p *proxy.Proxy, proto proxy.Proto, req *dns.Msg) (resp *dns.Msg) {
+	tb.Helper()
+
+	addr := p.Addr(proto)
+	require.NotNil(tb, addr)
+
+	client := &dns.Client{Net: string(proto), Timeout: DefaultTimeout}
+	resp, _, err := client.Exchange(req, addr.String())
+	require.NoError(tb, err)
+
+	return resp
+}
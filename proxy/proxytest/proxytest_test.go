@@ -0,0 +1,112 @@
+package proxytest_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/proxy/proxytest"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testHost is the host used in tests.
+const testHost = "example.org"
+
+// newTestScript returns the script answering the A queries for [testHost] with
+// ip.
+func newTestScript(tb testing.TB, ip string) (s *proxytest.Script) {
+	tb.Helper()
+
+	rr, err := dns.NewRR(testHost + ". 60 IN A " + ip)
+	require.NoError(tb, err)
+
+	return proxytest.NewScript().AddAnswer(testHost, dns.TypeA, rr)
+}
+
+// requireA requires resp to be the successful response with the single A
+// record and returns its address.
+func requireA(tb testing.TB, resp *dns.Msg) (ip net.IP) {
+	tb.Helper()
+
+	require.NotNil(tb, resp)
+	require.Equal(tb, dns.RcodeSuccess, resp.Rcode)
+	require.Len(tb, resp.Answer, 1)
+
+	a := testutil.RequireTypeAssert[*dns.A](tb, resp.Answer[0])
+
+	return a.A.To4()
+}
+
+func TestServer(t *testing.T) {
+	testCases := []struct {
+		newServer func(tb testing.TB, r proxytest.Responder) (s *proxytest.Server)
+		name      string
+	}{{
+		newServer: proxytest.NewPlainServer,
+		name:      "plain",
+	}, {
+		newServer: proxytest.NewTLSServer,
+		name:      "tls",
+	}, {
+		newServer: proxytest.NewHTTPSServer,
+		name:      "https",
+	}, {
+		newServer: proxytest.NewQUICServer,
+		name:      "quic",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			script := newTestScript(t, "192.0.2.1")
+			srv := tc.newServer(t, script.Respond)
+			u := srv.Upstream(t, &upstream.Options{Timeout: proxytest.DefaultTimeout})
+
+			resp, err := u.Exchange((&dns.Msg{}).SetQuestion(dns.Fqdn(testHost), dns.TypeA))
+			require.NoError(t, err)
+
+			assert.Equal(t, net.IP{192, 0, 2, 1}, requireA(t, resp))
+			assert.Equal(t, 1, script.Queries(testHost, dns.TypeA))
+
+			resp, err = u.Exchange((&dns.Msg{}).SetQuestion("unknown.example.", dns.TypeA))
+			require.NoError(t, err)
+
+			assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+		})
+	}
+}
+
+func TestScript_Add(t *testing.T) {
+	s := proxytest.NewScript().Add(
+		testHost,
+		dns.TypeA,
+		proxytest.Rcode(dns.RcodeServerFailure),
+		proxytest.Rcode(dns.RcodeRefused),
+	)
+
+	req := (&dns.Msg{}).SetQuestion("Example.ORG.", dns.TypeA)
+
+	assert.Equal(t, dns.RcodeServerFailure, s.Respond(req).Rcode)
+	assert.Equal(t, dns.RcodeRefused, s.Respond(req).Rcode)
+	assert.Equal(t, dns.RcodeRefused, s.Respond(req).Rcode)
+	assert.Equal(t, 3, s.Queries(testHost, dns.TypeA))
+	assert.Zero(t, s.Queries(testHost, dns.TypeAAAA))
+}
+
+func TestNewProxy(t *testing.T) {
+	script := newTestScript(t, "192.0.2.2")
+
+	p := proxytest.NewProxy(t, &proxy.Config{
+		UpstreamConfig: proxytest.NewUpstreamConfig(t, proxytest.NewTLSServer(t, script.Respond)),
+	})
+
+	req := (&dns.Msg{}).SetQuestion(dns.Fqdn(testHost), dns.TypeA)
+	for _, proto := range []proxy.Proto{proxy.ProtoUDP, proxy.ProtoTCP} {
+		assert.Equal(t, net.IP{192, 0, 2, 2}, requireA(t, proxytest.Exchange(t, p, proto, req)))
+	}
+
+	assert.Equal(t, 2, script.Queries(testHost, dns.TypeA))
+}
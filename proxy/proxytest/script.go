@@ -0,0 +1,142 @@
+package proxytest
+
+import (
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// Responder returns the response to req.  A nil resp means that req is left
+// unanswered, so that the client times out.  It must be safe for concurrent
+// use.
+type Responder func(req *dns.Msg) (resp *dns.Msg)
+
+// Answer returns a [Responder] answering with the copies of rrs.
+func Answer(rrs ...dns.RR) (r Responder) {
+	return func(req *dns.Msg) (resp *dns.Msg) {
+		resp = (&dns.Msg{}).SetReply(req)
+		resp.RecursionAvailable = true
+		for _, rr := range rrs {
+			resp.Answer = append(resp.Answer, dns.Copy(rr))
+		}
+
+		return resp
+	}
+}
+
+// Rcode returns a [Responder] answering with rcode and no records.
+func Rcode(rcode int) (r Responder) {
+	return func(req *dns.Msg) (resp *dns.Msg) {
+		resp = (&dns.Msg{}).SetRcode(req, rcode)
+		resp.RecursionAvailable = true
+
+		return resp
+	}
+}
+
+// Drop is a [Responder] leaving all the requests unanswered.
+func Drop(_ *dns.Msg) (resp *dns.Msg) {
+	return nil
+}
+
+// question is the key of the scripted responses.
+type question struct {
+	// name is the canonical name of the question.
+	name string
+
+	// qtype is the type of the question.
+	qtype uint16
+}
+
+// newQuestion returns the question for name and qtype.
+func newQuestion(name string, qtype uint16) (q question) {
+	return question{
+		name:  dns.CanonicalName(name),
+		qtype: qtype,
+	}
+}
+
+// Script responds to the questions with the responders added to it.  The
+// questions without responders are answered with NXDOMAIN.
+//
+// It's safe for concurrent use.
+type Script struct {
+	// mu protects responders and queries.
+	mu *sync.Mutex
+
+	// responders are the responders of the questions in the order of use.
+	responders map[question][]Responder
+
+	// queries are the numbers of the received queries per question.
+	queries map[question]int
+}
+
+// NewScript returns a new empty *Script.
+func NewScript() (s *Script) {
+	return &Script{
+		mu:         &sync.Mutex{},
+		responders: map[question][]Responder{},
+		queries:    map[question]int{},
+	}
+}
+
+// Add adds the responders for the question with name and qtype.  The first
+// query for the question is answered by the first responder, the second one by
+// the second responder and so on, and the last responder answers all the rest.
+// It returns s to allow chaining.
+func (s *Script) Add(name string, qtype uint16, rs ...Responder) (res *Script) {
+	q := newQuestion(name, qtype)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.responders[q] = append(s.responders[q], rs...)
+
+	return s
+}
+
+// AddAnswer is a shorthand for adding the [Answer] responder with rrs for the
+// question with name and qtype.  It returns s to allow chaining.
+func (s *Script) AddAnswer(name string, qtype uint16, rrs ...dns.RR) (res *Script) {
+	return s.Add(name, qtype, Answer(rrs...))
+}
+
+// Respond implements the [Responder] signature for *Script.
+func (s *Script) Respond(req *dns.Msg) (resp *dns.Msg) {
+	if len(req.Question) == 0 {
+		return Rcode(dns.RcodeFormatError)(req)
+	}
+
+	q := newQuestion(req.Question[0].Name, req.Question[0].Qtype)
+	r := s.next(q)
+	if r == nil {
+		return Rcode(dns.RcodeNameError)(req)
+	}
+
+	return r(req)
+}
+
+// next counts the query for q and returns the responder for it, if any.
+func (s *Script) next(q question) (r Responder) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := s.queries[q]
+	s.queries[q] = n + 1
+
+	rs := s.responders[q]
+	if len(rs) == 0 {
+		return nil
+	}
+
+	return rs[min(n, len(rs)-1)]
+}
+
+// Queries returns the number of the queries received for the question with
+// name and qtype.
+func (s *Script) Queries(name string, qtype uint16) (n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.queries[newQuestion(name, qtype)]
+}
@@ -0,0 +1,289 @@
+package proxytest
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxyutil"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	"github.com/stretchr/testify/require"
+)
+
+// loopbackAddr is the address the test servers listen on.
+const loopbackAddr = "127.0.0.1:0"
+
+// Server is a test DNS server listening on the loopback interface.  It's shut
+// down on the cleanup of the test it's been created for.
+type Server struct {
+	// RootCAs contains the certificate of the server.  It's nil for the plain
+	// DNS servers.
+	RootCAs *x509.CertPool
+
+	// Addr is the address of the server in the form accepted by
+	// [upstream.AddressToUpstream], e.g. "tls://127.0.0.1:12345".
+	Addr string
+}
+
+// Upstream returns the upstream for s created with opts, which may be nil.  The
+// root certificates of s are used unless opts has its own ones.  The upstream
+// is closed on the cleanup of tb.
+func (s *Server) Upstream(tb testing.TB, opts *upstream.Options) (u upstream.Upstream) {
+	tb.Helper()
+
+	if opts == nil {
+		opts = &upstream.Options{}
+	} else {
+		opts = opts.Clone()
+	}
+
+	if opts.RootCAs == nil {
+		opts.RootCAs = s.RootCAs
+	}
+
+	u, err := upstream.AddressToUpstream(s.Addr, opts)
+	require.NoError(tb, err)
+	testutil.CleanupAndRequireSuccess(tb, u.Close)
+
+	return u
+}
+
+// dnsHandler returns the handler of plain DNS requests using r.
+func dnsHandler(r Responder) (h dns.Handler) {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := r(req)
+		if resp == nil {
+			return
+		}
+
+		_ = w.WriteMsg(resp)
+	})
+}
+
+// startDNSServer starts srv and waits for it to be ready.  It's shut down on
+// the cleanup of tb.
+func startDNSServer(tb testing.TB, srv *dns.Server) {
+	tb.Helper()
+
+	started := make(chan struct{})
+	srv.NotifyStartedFunc = func() { close(started) }
+
+	go func() {
+		pt := testutil.PanicT{}
+		require.NoError(pt, srv.ActivateAndServe())
+	}()
+
+	testutil.RequireReceive(tb, started, time.Second)
+	testutil.CleanupAndRequireSuccess(tb, srv.Shutdown)
+}
+
+// NewPlainServer returns a new plain DNS server answering with r over both UDP
+// and TCP on the same port.
+func NewPlainServer(tb testing.TB, r Responder) (s *Server) {
+	tb.Helper()
+
+	conn, err := net.ListenPacket("udp", loopbackAddr)
+	require.NoError(tb, err)
+
+	addr := conn.LocalAddr().String()
+	l, err := net.Listen("tcp", addr)
+	require.NoError(tb, err)
+
+	h := dnsHandler(r)
+	startDNSServer(tb, &dns.Server{PacketConn: conn, Handler: h})
+	startDNSServer(tb, &dns.Server{Listener: l, Handler: h})
+
+	return &Server{
+		Addr: addr,
+	}
+}
+
+// NewTLSServer returns a new DNS-over-TLS server answering with r.
+func NewTLSServer(tb testing.TB, r Responder) (s *Server) {
+	tb.Helper()
+
+	conf, roots := NewTLSConfig(tb, "127.0.0.1")
+
+	l, err := tls.Listen("tcp", loopbackAddr, conf)
+	require.NoError(tb, err)
+
+	startDNSServer(tb, &dns.Server{Listener: l, Net: "tcp-tls", Handler: dnsHandler(r)})
+
+	return &Server{
+		RootCAs: roots,
+		Addr:    (&url.URL{Scheme: "tls", Host: l.Addr().String()}).String(),
+	}
+}
+
+// NewHTTPSServer returns a new DNS-over-HTTPS server answering with r over
+// HTTP/1.1 and HTTP/2 on any path.
+func NewHTTPSServer(tb testing.TB, r Responder) (s *Server) {
+	tb.Helper()
+
+	conf, roots := NewTLSConfig(tb, "127.0.0.1")
+	conf.NextProtos = []string{"h2", "http/1.1"}
+
+	l, err := tls.Listen("tcp", loopbackAddr, conf)
+	require.NoError(tb, err)
+
+	srv := &http.Server{
+		Handler:           dohHandler(r),
+		ReadHeaderTimeout: time.Second,
+	}
+
+	go func() { _ = srv.Serve(l) }()
+	testutil.CleanupAndRequireSuccess(tb, func() (err error) {
+		return srv.Shutdown(context.Background())
+	})
+
+	return &Server{
+		RootCAs: roots,
+		Addr: (&url.URL{
+			Scheme: "https",
+			Host:   l.Addr().String(),
+			Path:   "/dns-query",
+		}).String(),
+	}
+}
+
+// dohHandler returns the handler of DNS-over-HTTPS requests using r.
+func dohHandler(r Responder) (h http.Handler) {
+	return http.HandlerFunc(func(w http.ResponseWriter, hreq *http.Request) {
+		var b []byte
+		var err error
+		switch hreq.Method {
+		case http.MethodGet:
+			b, err = base64.RawURLEncoding.DecodeString(hreq.URL.Query().Get("dns"))
+		case http.MethodPost:
+			b, err = io.ReadAll(hreq.Body)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+
+			return
+		}
+
+		req := &dns.Msg{}
+		if err == nil {
+			err = req.Unpack(b)
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+
+			return
+		}
+
+		resp := r(req)
+		if resp == nil {
+			<-hreq.Context().Done()
+
+			return
+		}
+
+		packed, err := resp.Pack()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/dns-message")
+		_, _ = w.Write(packed)
+	})
+}
+
+// NewQUICServer returns a new DNS-over-QUIC server answering with r.
+func NewQUICServer(tb testing.TB, r Responder) (s *Server) {
+	tb.Helper()
+
+	conf, roots := NewTLSConfig(tb, "127.0.0.1")
+	conf.NextProtos = []string{upstream.NextProtoDQ}
+
+	l, err := quic.ListenAddrEarly(loopbackAddr, conf, &quic.Config{})
+	require.NoError(tb, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go serveQUIC(ctx, l, r)
+	testutil.CleanupAndRequireSuccess(tb, func() (err error) {
+		cancel()
+
+		return l.Close()
+	})
+
+	return &Server{
+		RootCAs: roots,
+		Addr:    (&url.URL{Scheme: "quic", Host: l.Addr().String()}).String(),
+	}
+}
+
+// serveQUIC accepts the QUIC connections from l and answers the requests
+// received on them with r until ctx is canceled or l is closed.
+func serveQUIC(ctx context.Context, l *quic.EarlyListener, r Responder) {
+	for {
+		conn, err := l.Accept(ctx)
+		if err != nil {
+			return
+		}
+
+		go func() {
+			defer func() { _ = conn.CloseWithError(0, "") }()
+
+			for {
+				stream, sErr := conn.AcceptStream(ctx)
+				if sErr != nil {
+					return
+				}
+
+				go func() { _ = handleQUICStream(stream, r) }()
+			}
+		}()
+	}
+}
+
+// handleQUICStream reads the request from stream and writes the response of r
+// to it.
+func handleQUICStream(stream quic.Stream, r Responder) (err error) {
+	defer func() { err = errors.WithDeferred(err, stream.Close()) }()
+
+	b, err := io.ReadAll(stream)
+	if err != nil {
+		return err
+	}
+
+	if len(b) < 2 {
+		return io.ErrUnexpectedEOF
+	}
+
+	req := &dns.Msg{}
+	err = req.Unpack(b[2:])
+	if err != nil {
+		return err
+	}
+
+	resp := r(req)
+	if resp == nil {
+		<-stream.Context().Done()
+
+		return nil
+	}
+
+	packed, err := resp.Pack()
+	if err != nil {
+		return err
+	}
+
+	_, err = stream.Write(proxyutil.AddPrefix(packed))
+
+	return err
+}
@@ -0,0 +1,69 @@
+package proxytest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// NewTLSConfig returns the server TLS configuration with a new self-signed
+// certificate for serverName, which is either a hostname or an IP address, and
+// the pool containing the certificate to be used by the clients.
+func NewTLSConfig(tb testing.TB, serverName string) (conf *tls.Config, roots *x509.CertPool) {
+	tb.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(tb, err)
+
+	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
+	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
+	require.NoError(tb, err)
+
+	notBefore := time.Now().Add(-time.Hour)
+	template := &x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               pkix.Name{Organization: []string{"dnsproxy tests"}},
+		NotBefore:             notBefore,
+		NotAfter:              notBefore.Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	if ip := net.ParseIP(serverName); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{serverName}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(tb, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(tb, err)
+
+	roots = x509.NewCertPool()
+	roots.AddCert(cert)
+
+	conf = &tls.Config{
+		Certificates: []tls.Certificate{{
+			Certificate: [][]byte{der},
+			PrivateKey:  key,
+			Leaf:        cert,
+		}},
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	return conf, roots
+}
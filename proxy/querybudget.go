@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"context"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// QueryBudgetConfig is the configuration of the total time budget of resolving
+// a single request.  The budget bounds all the upstream exchanges made for the
+// request, including the retries and the fallbacks, instead of the timeouts of
+// those, which may stack up to many seconds.  Once the budget is spent, the
+// client is answered with SERVFAIL.
+type QueryBudgetConfig struct {
+	// Total is the maximum duration of resolving a single request.  It must be
+	// positive.
+	Total time.Duration
+
+	// FallbackReserve is the part of Total reserved for the fallback
+	// upstreams, so that the general upstreams failing to respond don't leave
+	// no time for the fallbacks.  It's only reserved if [Config.Fallbacks] are
+	// set.  It must be less than Total.
+	FallbackReserve time.Duration
+}
+
+// validate returns an error if c is invalid.  c may be nil.
+func (c *QueryBudgetConfig) validate() (err error) {
+	switch {
+	case c == nil:
+		return nil
+	case c.Total <= 0:
+		return errors.Error("total: must be positive")
+	case c.FallbackReserve < 0:
+		return errors.Error("fallback reserve: must not be negative")
+	case c.FallbackReserve >= c.Total:
+		return errors.Error("fallback reserve: must be less than total")
+	default:
+		return nil
+	}
+}
+
+// withQueryBudget sets the context of dctx to the one limited according to
+// [Config.QueryBudget].  The returned restore function must be called once the
+// request is resolved to cancel the context and to set the original one back.
+func (p *Proxy) withQueryBudget(dctx *DNSContext) (restore func()) {
+	if p.QueryBudget == nil {
+		return func() {}
+	}
+
+	orig := dctx.ctx
+	ctx, cancel := context.WithTimeout(dctx.Context(), p.QueryBudget.Total)
+	dctx.ctx = ctx
+
+	return func() {
+		cancel()
+		dctx.ctx = orig
+	}
+}
+
+// generalUpstreamsContext returns the context for the exchanges with the
+// general upstreams, which leaves [QueryBudgetConfig.FallbackReserve] of the
+// budget of ctx for the fallbacks.
+func (p *Proxy) generalUpstreamsContext(
+	ctx context.Context,
+) (upsCtx context.Context, cancel context.CancelFunc) {
+	b := p.QueryBudget
+	if b == nil || b.FallbackReserve == 0 || p.Fallbacks == nil {
+		return ctx, func() {}
+	}
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return ctx, func() {}
+	}
+
+	return context.WithDeadline(ctx, deadline.Add(-b.FallbackReserve))
+}
+
+// attemptContext returns the context for the exchange with a single upstream,
+// when left upstreams, including this one, may be tried in turn within the
+// budget of ctx.  The remaining budget is divided equally between those, so
+// that a single unresponsive upstream doesn't spend all of it.
+func (p *Proxy) attemptContext(
+	ctx context.Context,
+	left int,
+) (attemptCtx context.Context, cancel context.CancelFunc) {
+	if p.QueryBudget == nil || left <= 1 {
+		return ctx, func() {}
+	}
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return ctx, func() {}
+	}
+
+	share := time.Until(deadline) / time.Duration(left)
+
+	return context.WithTimeout(ctx, share)
+}
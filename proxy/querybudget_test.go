@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// hangingUpstream is an [upstream.Upstream] never responding until the context
+// of the exchange is canceled.
+type hangingUpstream struct {
+	// fakeUpstream is embedded here to avoid implementing all the methods.
+	*fakeUpstream
+
+	// exchanges is the number of the exchanges started.
+	exchanges atomic.Int32
+}
+
+// ExchangeContext implements the [upstream.ContextExchanger] interface for
+// *hangingUpstream.
+func (u *hangingUpstream) ExchangeContext(
+	ctx context.Context,
+	_ *dns.Msg,
+) (resp *dns.Msg, err error) {
+	u.exchanges.Add(1)
+	<-ctx.Done()
+
+	return nil, ctx.Err()
+}
+
+// newHangingUpstream returns a new *hangingUpstream with the address addr.
+func newHangingUpstream(addr string) (u *hangingUpstream) {
+	return &hangingUpstream{
+		fakeUpstream: &fakeUpstream{
+			onAddress: func() (a string) { return addr },
+			onClose:   func() (err error) { return nil },
+		},
+	}
+}
+
+func TestProxy_Resolve_queryBudget(t *testing.T) {
+	const budget = 200 * time.Millisecond
+
+	fallback := &fakeUpstream{
+		onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			return (&dns.Msg{}).SetReply(req), nil
+		},
+		onAddress: func() (addr string) { return "fallback" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	t.Run("fallback", func(t *testing.T) {
+		first, second := newHangingUpstream("first"), newHangingUpstream("second")
+
+		p := mustNew(t, &Config{
+			Logger:        testLogger,
+			UDPListenAddr: []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+			UpstreamConfig: &UpstreamConfig{
+				Upstreams: []upstream.Upstream{first, second},
+			},
+			Fallbacks: &UpstreamConfig{
+				Upstreams: []upstream.Upstream{fallback},
+			},
+			TrustedProxies: defaultTrustedProxies,
+			UpstreamMode:   UModeLoadBalance,
+			QueryBudget: &QueryBudgetConfig{
+				Total:           budget,
+				FallbackReserve: budget / 2,
+			},
+		})
+
+		d := &DNSContext{Req: newHostTestMessage("example.org")}
+
+		start := time.Now()
+		require.NoError(t, p.Resolve(d))
+
+		assert.Less(t, time.Since(start), budget)
+		assert.Equal(t, dns.RcodeSuccess, d.Res.Rcode)
+
+		// Both upstreams are tried within their share of the budget.
+		assert.Equal(t, int32(1), first.exchanges.Load())
+		assert.Equal(t, int32(1), second.exchanges.Load())
+
+		// The original context is set back.
+		assert.Equal(t, context.Background(), d.Context())
+	})
+
+	t.Run("servfail", func(t *testing.T) {
+		p := mustNew(t, &Config{
+			Logger:        testLogger,
+			UDPListenAddr: []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+			UpstreamConfig: &UpstreamConfig{
+				Upstreams: []upstream.Upstream{newHangingUpstream("hanging")},
+			},
+			TrustedProxies: defaultTrustedProxies,
+			QueryBudget: &QueryBudgetConfig{
+				Total: budget,
+			},
+		})
+
+		d := &DNSContext{Req: newHostTestMessage("example.org")}
+
+		start := time.Now()
+		err := p.Resolve(d)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+
+		assert.Less(t, time.Since(start), 2*budget)
+		require.NotNil(t, d.Res)
+		assert.Equal(t, dns.RcodeServerFailure, d.Res.Rcode)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := New(&Config{
+			UDPListenAddr:  []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+			UpstreamConfig: &UpstreamConfig{Upstreams: []upstream.Upstream{fallback}},
+			TrustedProxies: defaultTrustedProxies,
+			QueryBudget: &QueryBudgetConfig{
+				Total:           budget,
+				FallbackReserve: budget,
+			},
+		})
+		testutil.AssertErrorMsg(
+			t,
+			"validating query budget: fallback reserve: must be less than total",
+			err,
+		)
+	})
+}
@@ -0,0 +1,161 @@
+package proxy
+
+import (
+	"net/netip"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// QueryLogEntry is the information about a single processed DNS request.
+type QueryLogEntry struct {
+	// Time is the time the request has been received at.
+	Time time.Time
+
+	// Client is the address of the client.
+	Client netip.AddrPort
+
+	// Proto is the protocol the request has been received over.
+	Proto Proto
+
+	// QName is the name from the question section of the request.  It's empty
+	// if the request has no questions.
+	QName string
+
+	// Upstream is the address of the upstream that has resolved the request.
+	// It's empty if the response hasn't been received from an upstream.
+	Upstream string
+
+	// TraceID is the trace ID of the request, see [DNSContext.TraceID].
+	TraceID string
+
+	// Country is the country of the client, see [GeoInfo.Country].  It's empty
+	// if unknown.
+	Country string
+
+	// Elapsed is the total time spent on processing the request.
+	Elapsed time.Duration
+
+	// Rcode is the response code of the response.
+	Rcode int
+
+	// Size is the size of the response in the wire format, after the
+	// truncation, if any.
+	Size int
+
+	// Answers is the number of the records in the answer section of the
+	// response.
+	Answers int
+
+	// ASN is the autonomous system of the client, see [GeoInfo.ASN].  It's
+	// zero if unknown.
+	ASN uint32
+
+	// QType is the type from the question section of the request.
+	QType uint16
+
+	// CacheHit is true if the response has been served from the cache.
+	CacheHit bool
+
+	// Truncated is true if the response has the TC flag set.
+	Truncated bool
+
+	// Blocked is true if the response looks like the one of a filtering
+	// resolver blocking the request, see [isBlocked].
+	Blocked bool
+}
+
+// QueryLogger is an object that logs the processed DNS requests.  LogQuery
+// must be safe for concurrent use.
+type QueryLogger interface {
+	// LogQuery is called when a response to the request has been sent.  The
+	// entry must not be retained after LogQuery returns.
+	LogQuery(e *QueryLogEntry)
+}
+
+// EmptyQueryLogger is a [QueryLogger] that does nothing.
+type EmptyQueryLogger struct{}
+
+// type check
+var _ QueryLogger = EmptyQueryLogger{}
+
+// LogQuery implements the [QueryLogger] interface for EmptyQueryLogger.
+func (EmptyQueryLogger) LogQuery(_ *QueryLogEntry) {}
+
+// logQuery reports the processed request to the query logger.  Requests left
+// without a response aren't reported.
+func (p *Proxy) logQuery(d *DNSContext, start time.Time, elapsed time.Duration) {
+	if d.Res == nil {
+		return
+	}
+
+	e := &QueryLogEntry{
+		Time:      start,
+		Client:    p.anonymizer.addrPort(d.Addr),
+		Proto:     d.Proto,
+		Elapsed:   elapsed,
+		Rcode:     d.Res.Rcode,
+		Size:      d.Res.Len(),
+		Answers:   len(d.Res.Answer),
+		CacheHit:  d.cacheHit,
+		Truncated: d.Res.Truncated,
+		Blocked:   isBlocked(d.Res),
+		Upstream:  d.upstreamAddr(),
+		TraceID:   d.TraceID,
+	}
+
+	if len(d.Req.Question) > 0 {
+		q := d.Req.Question[0]
+		e.QName, e.QType = q.Name, q.Qtype
+	}
+
+	if d.Geo != nil {
+		e.Country, e.ASN = d.Geo.Country, d.Geo.ASN
+	}
+
+	p.queryLogger.LogQuery(e)
+}
+
+// isBlocked returns true if resp contains the unspecified addresses in the
+// answer section or the Blocked, Censored, or Filtered extended DNS errors,
+// which the filtering resolvers use to respond to the blocked requests.
+func isBlocked(resp *dns.Msg) (ok bool) {
+	for _, rr := range resp.Answer {
+		switch rr := rr.(type) {
+		case *dns.A:
+			if rr.A.IsUnspecified() {
+				return true
+			}
+		case *dns.AAAA:
+			if rr.AAAA.IsUnspecified() {
+				return true
+			}
+		default:
+			// Go on.
+		}
+	}
+
+	opt := resp.IsEdns0()
+	if opt == nil {
+		return false
+	}
+
+	for _, o := range opt.Option {
+		ede, isEDE := o.(*dns.EDNS0_EDE)
+		if !isEDE {
+			continue
+		}
+
+		switch ede.InfoCode {
+		case
+			dns.ExtendedErrorCodeBlocked,
+			dns.ExtendedErrorCodeCensored,
+			dns.ExtendedErrorCodeFiltered:
+			return true
+		default:
+			// Go on.
+		}
+	}
+
+	return false
+}
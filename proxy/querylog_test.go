@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testQueryLogger is a [QueryLogger] implementation that sends the logged
+// entries to a channel.
+type testQueryLogger chan QueryLogEntry
+
+// type check
+var _ QueryLogger = testQueryLogger(nil)
+
+// LogQuery implements the [QueryLogger] interface for testQueryLogger.
+func (l testQueryLogger) LogQuery(e *QueryLogEntry) {
+	l <- *e
+}
+
+func TestProxy_QueryLogger(t *testing.T) {
+	const upsAddr = "fake"
+
+	ql := make(testQueryLogger, 2)
+
+	p := mustNew(t, &Config{
+		UDPListenAddr: []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{&fakeUpstream{
+				onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+					resp = (&dns.Msg{}).SetReply(req)
+					resp.Answer = []dns.RR{&dns.A{
+						Hdr: dns.RR_Header{
+							Name:   req.Question[0].Name,
+							Rrtype: dns.TypeA,
+							Class:  dns.ClassINET,
+							Ttl:    defaultTestTTL,
+						},
+						A: net.IP{1, 2, 3, 4},
+					}}
+
+					return resp, nil
+				},
+				onAddress: func() (addr string) { return upsAddr },
+				onClose:   func() (err error) { return nil },
+			}},
+		},
+		TrustedProxies: defaultTrustedProxies,
+		CacheEnabled:   true,
+		CacheSizeBytes: defaultCacheSize,
+		QueryLogger:    ql,
+	})
+
+	ctx := context.Background()
+	require.NoError(t, p.Start(ctx))
+	testutil.CleanupAndRequireSuccess(t, func() (err error) { return p.Shutdown(ctx) })
+
+	client := &dns.Client{Net: string(ProtoUDP), Timeout: defaultTimeout}
+	addr := p.Addr(ProtoUDP).String()
+
+	for _, wantHit := range []bool{false, true} {
+		_, _, err := client.Exchange(newHostTestMessage("querylog.example"), addr)
+		require.NoError(t, err)
+
+		e, ok := testutil.RequireReceive(t, ql, defaultTimeout)
+		require.True(t, ok)
+
+		assert.Equal(t, ProtoUDP, e.Proto)
+		assert.Equal(t, "querylog.example.", e.QName)
+		assert.Equal(t, dns.TypeA, e.QType)
+		assert.Equal(t, dns.RcodeSuccess, e.Rcode)
+		assert.Equal(t, upsAddr, e.Upstream)
+		assert.Equal(t, wantHit, e.CacheHit)
+		assert.True(t, e.Client.Addr().IsLoopback())
+	}
+}
+
+func TestIsBlocked(t *testing.T) {
+	req := newHostTestMessage("blocked.example")
+	hdr := dns.RR_Header{Name: "blocked.example.", Rrtype: dns.TypeA, Class: dns.ClassINET}
+
+	answered := (&dns.Msg{}).SetReply(req)
+	answered.Answer = []dns.RR{&dns.A{Hdr: hdr, A: net.IP{192, 0, 2, 1}}}
+
+	unspecified := (&dns.Msg{}).SetReply(req)
+	unspecified.Answer = []dns.RR{&dns.A{Hdr: hdr, A: net.IPv4zero}}
+
+	filtered := (&dns.Msg{}).SetRcode(req, dns.RcodeRefused)
+	filtered.SetEdns0(dns.DefaultMsgSize, false)
+	opt := filtered.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeFiltered})
+
+	assert.False(t, isBlocked(answered))
+	assert.False(t, isBlocked((&dns.Msg{}).SetRcode(req, dns.RcodeNameError)))
+	assert.True(t, isBlocked(unspecified))
+	assert.True(t, isBlocked(filtered))
+}
@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// QUICRetryConfig is the configuration of the source address validation using
+// the QUIC Retry packets on the DNS-over-QUIC and HTTP/3 listeners, see RFC
+// 9000 Section 8.1.2.
+type QUICRetryConfig struct {
+	// Threshold is the number of the connection attempts from the unvalidated
+	// addresses per second on a listener, exceeding which the further
+	// attempts are required to validate their addresses.  Zero means the
+	// addresses connecting for the first time are always validated.
+	Threshold uint
+
+	// TokenLifetime is the time the validated addresses aren't validated again
+	// for, which also limits the age of the address validation tokens issued
+	// for the subsequent connections.  If zero, the addresses are remembered
+	// for 30 minutes and the tokens are accepted for 24 hours.
+	TokenLifetime time.Duration
+}
+
+// validate returns an error if c is invalid.  c may be nil.
+func (c *QUICRetryConfig) validate() (err error) {
+	if c == nil {
+		return nil
+	}
+
+	if c.TokenLifetime < 0 {
+		return fmt.Errorf("token lifetime: negative value %s", c.TokenLifetime)
+	}
+
+	return nil
+}
+
+// newQUICTransport returns a new QUIC transport for conn validating the source
+// addresses according to [Config.QUICRetry].  validateByDefault tells if the
+// addresses connecting for the first time should be validated when
+// [Config.QUICRetry] is nil.
+func (p *Proxy) newQUICTransport(conn net.PacketConn, validateByDefault bool) (t *quic.Transport) {
+	t = &quic.Transport{
+		Conn: conn,
+	}
+
+	c := p.QUICRetry
+	if c == nil {
+		if validateByDefault {
+			v := newQUICAddrValidator(quicAddrValidatorCacheSize, quicAddrValidatorCacheTTL)
+			t.VerifySourceAddress = v.requiresValidation
+		}
+
+		return t
+	}
+
+	ttl := quicAddrValidatorCacheTTL
+	if c.TokenLifetime > 0 {
+		ttl = c.TokenLifetime
+		t.MaxTokenAge = c.TokenLifetime
+	}
+
+	v := newQUICAddrValidator(quicAddrValidatorCacheSize, ttl)
+	if c.Threshold > 0 {
+		v.load = &quicLoad{
+			clock:     p.time,
+			mu:        &sync.Mutex{},
+			threshold: c.Threshold,
+		}
+	}
+
+	t.VerifySourceAddress = v.requiresValidation
+
+	return t
+}
+
+// quicLoad counts the connection attempts from the unvalidated addresses to
+// tell if the listener is under load.
+type quicLoad struct {
+	// clock is used to get the current time.
+	clock Clock
+
+	// mu protects second and attempts.
+	mu *sync.Mutex
+
+	// second is the Unix time of the second the attempts are counted for.
+	second int64
+
+	// attempts is the number of the attempts within second.
+	attempts uint
+
+	// threshold is the number of the attempts per second, exceeding which
+	// makes the listener loaded.
+	threshold uint
+}
+
+// overloaded counts a connection attempt and returns true if the number of the
+// attempts within the current second exceeds the threshold.
+func (l *quicLoad) overloaded() (ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.clock.Now().Unix()
+	if now != l.second {
+		l.second, l.attempts = now, 0
+	}
+
+	l.attempts++
+
+	return l.attempts > l.threshold
+}
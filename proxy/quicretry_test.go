@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxy_newQUICTransport(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	p := &Proxy{
+		Config: Config{
+			QUICRetry: &QUICRetryConfig{
+				Threshold:     2,
+				TokenLifetime: time.Hour,
+			},
+		},
+		time: &fakeClock{onNow: func() (n time.Time) { return now }},
+	}
+
+	tr := p.newQUICTransport(nil, false)
+	assert.Equal(t, time.Hour, tr.MaxTokenAge)
+
+	addr := func(last byte) (a net.Addr) {
+		return &net.UDPAddr{IP: net.IP{192, 0, 2, last}, Port: 443}
+	}
+
+	// Not loaded yet.
+	assert.False(t, tr.VerifySourceAddress(addr(1)))
+	assert.False(t, tr.VerifySourceAddress(addr(2)))
+
+	// Exceeds the threshold.
+	assert.True(t, tr.VerifySourceAddress(addr(3)))
+
+	// Remembered for the token lifetime.
+	assert.False(t, tr.VerifySourceAddress(addr(3)))
+
+	now = now.Add(time.Second)
+	assert.False(t, tr.VerifySourceAddress(addr(4)))
+
+	t.Run("default", func(t *testing.T) {
+		dp := &Proxy{}
+
+		assert.NotNil(t, dp.newQUICTransport(nil, true).VerifySourceAddress)
+		assert.Nil(t, dp.newQUICTransport(nil, false).VerifySourceAddress)
+	})
+}
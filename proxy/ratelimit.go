@@ -1,64 +1,178 @@
 package proxy
 
 import (
+	"cmp"
 	"net/netip"
 	"slices"
-	"time"
+	"sync/atomic"
 
-	"github.com/AdguardTeam/golibs/log"
-	rate "github.com/beefsack/go-rate"
-	gocache "github.com/patrickmn/go-cache"
+	"github.com/miekg/dns"
 )
 
-func (p *Proxy) limiterForIP(ip string) interface{} {
-	p.ratelimitLock.Lock()
-	defer p.ratelimitLock.Unlock()
-	if p.ratelimitBuckets == nil {
-		p.ratelimitBuckets = gocache.New(time.Hour, time.Hour)
+// ratelimiters returns the ratelimiters of the client subnets for the general
+// ratelimit, creating those if needed.
+func (p *Proxy) ratelimiters() (b *ratelimitBuckets) {
+	v4, v6 := p.ratelimitParams(p.Ratelimit, cmp.Or(p.RatelimitIPv6, p.Ratelimit))
+
+	return p.loadRatelimiters(&p.ratelimitBuckets, v4, v6)
+}
+
+// truncateLimiters returns the ratelimiters of the client subnets for
+// [Config.RatelimitTruncate], creating those if needed.  Those don't allow any
+// bursts.
+func (p *Proxy) truncateLimiters() (b *ratelimitBuckets) {
+	params := ratelimitParams{
+		rate:  p.RatelimitTruncate,
+		burst: p.RatelimitTruncate,
+	}
+
+	return p.loadRatelimiters(&p.truncateBuckets, params, params)
+}
+
+// loadRatelimiters returns the ratelimiters stored in ptr, creating those with
+// v4 and v6 if there are none.
+func (p *Proxy) loadRatelimiters(
+	ptr *atomic.Pointer[ratelimitBuckets],
+	v4 ratelimitParams,
+	v6 ratelimitParams,
+) (b *ratelimitBuckets) {
+	b = ptr.Load()
+	if b != nil {
+		return b
 	}
 
-	// check if ratelimiter for that IP already exists, if not, create
-	value, found := p.ratelimitBuckets.Get(ip)
-	if !found {
-		value = rate.New(p.Ratelimit, time.Second)
-		p.ratelimitBuckets.Set(ip, value, time.Hour)
+	b = newRatelimitBuckets(v4, v6, cmp.Or[Clock](p.time, realClock{}))
+	if ptr.CompareAndSwap(nil, b) {
+		return b
 	}
 
-	return value
+	// The ratelimiters have been created concurrently.
+	return ptr.Load()
 }
 
+// ratelimitParams returns the parameters of the ratelimiters of the IPv4 and
+// IPv6 subnets with the sustained rates rate4 and rate6 respectively.  The
+// bursts not set in the configuration are equal to the rates.
+func (p *Proxy) ratelimitParams(rate4, rate6 int) (v4, v6 ratelimitParams) {
+	v4 = ratelimitParams{
+		rate:  rate4,
+		burst: cmp.Or(p.RatelimitBurst, rate4),
+	}
+
+	v6 = ratelimitParams{
+		rate:  rate6,
+		burst: cmp.Or(p.RatelimitBurstIPv6, p.RatelimitBurst, rate6),
+	}
+
+	return v4, v6
+}
+
+// isRatelimited returns true if the request from addr exceeds the general
+// ratelimit.
 func (p *Proxy) isRatelimited(addr netip.Addr) (ok bool) {
-	if p.Ratelimit <= 0 {
-		// The ratelimit is disabled.
+	return p.isProfileRatelimited(nil, addr)
+}
+
+// isProfileRatelimited returns true if the request from addr exceeds the
+// ratelimit of prof, or the general one if prof is nil.
+func (p *Proxy) isProfileRatelimited(prof *profile, addr netip.Addr) (ok bool) {
+	ok, _ = p.checkRatelimit(prof, addr)
+
+	return ok
+}
+
+// checkRatelimit returns true if the request from addr exceeds the ratelimit of
+// prof, or the general one if prof is nil.  slip is true if such request should
+// be answered with a truncated response instead of being dropped, see
+// [Config.RatelimitSlip].
+func (p *Proxy) checkRatelimit(prof *profile, addr netip.Addr) (limited, slip bool) {
+	p.reconfigureLock.RLock()
+	defer p.reconfigureLock.RUnlock()
+
+	addr = addr.Unmap()
+	if p.RatelimitDenylist != nil && p.RatelimitDenylist.Contains(addr) {
+		return true, false
+	}
+
+	limit := p.Ratelimit
+	if prof != nil {
+		limit = prof.Ratelimit
+	}
+
+	if limit <= 0 || p.isRatelimitExempt(addr) {
+		return false, false
+	}
+
+	var buckets *ratelimitBuckets
+	if prof != nil {
+		buckets = prof.ratelimitBuckets
+	} else {
+		buckets = p.ratelimiters()
+	}
+
+	ok, denied := buckets.limiter(p.ratelimitSubnet(addr)).take()
+	if ok {
+		return false, false
+	}
+
+	return true, p.RatelimitSlip > 0 && denied%uint64(p.RatelimitSlip) == 0
+}
+
+// isRatelimitedProto returns true if the ratelimit of prof, or the general one
+// if prof is nil, is applied to the requests over proto.
+func isRatelimitedProto(prof *profile, proto Proto) (ok bool) {
+	if prof == nil || len(prof.RatelimitProtos) == 0 {
+		return proto == ProtoUDP
+	}
+
+	return slices.Contains(prof.RatelimitProtos, proto)
+}
+
+// isTruncateLimited returns true if the request from addr exceeds
+// [Config.RatelimitTruncate], so that it should be answered with a truncated
+// response.
+func (p *Proxy) isTruncateLimited(addr netip.Addr) (ok bool) {
+	p.reconfigureLock.RLock()
+	defer p.reconfigureLock.RUnlock()
+
+	if p.RatelimitTruncate <= 0 {
 		return false
 	}
 
 	addr = addr.Unmap()
-	// Already sorted by [Proxy.Init].
-	_, ok = slices.BinarySearchFunc(p.RatelimitWhitelist, addr, netip.Addr.Compare)
-	if ok {
+	if p.isRatelimitExempt(addr) {
 		return false
 	}
 
-	var pref netip.Prefix
+	return !p.truncateLimiters().limiter(p.ratelimitSubnet(addr)).allow()
+}
+
+// isRatelimitExempt returns true if addr is within the ratelimit allowlists.
+// addr must be unmapped.
+func (p *Proxy) isRatelimitExempt(addr netip.Addr) (ok bool) {
+	// Already sorted by [Proxy.Init].
+	_, ok = slices.BinarySearchFunc(p.RatelimitWhitelist, addr, netip.Addr.Compare)
+
+	return ok || (p.RatelimitAllowlist != nil && p.RatelimitAllowlist.Contains(addr))
+}
+
+// ratelimitSubnet returns the client subnet of addr the ratelimits are applied
+// to.  addr must be unmapped.
+func (p *Proxy) ratelimitSubnet(addr netip.Addr) (pref netip.Prefix) {
 	if addr.Is4() {
 		pref = netip.PrefixFrom(addr, p.RatelimitSubnetLenIPv4)
 	} else {
 		pref = netip.PrefixFrom(addr, p.RatelimitSubnetLenIPv6)
 	}
-	pref = pref.Masked()
-
-	// TODO(s.chzhen):  Improve caching.  Decrease allocations.
-	ipStr := pref.Addr().String()
-	value := p.limiterForIP(ipStr)
-	rl, ok := value.(*rate.RateLimiter)
-	if !ok {
-		log.Error("dnsproxy: %T found in ratelimit cache", value)
 
-		return false
-	}
+	return pref.Masked()
+}
 
-	allow, _ := rl.Try()
+// newMsgTruncated returns the empty truncated response to req, which makes the
+// client retry over TCP.
+func newMsgTruncated(req *dns.Msg) (resp *dns.Msg) {
+	resp = (&dns.Msg{}).SetReply(req)
+	resp.Truncated = true
 
-	return !allow
+	return resp
 }
@@ -7,8 +7,11 @@ import (
 	"testing"
 	"time"
 
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/netutil"
 	"github.com/AdguardTeam/golibs/testutil"
 	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -51,6 +54,48 @@ func TestRatelimitingProxy(t *testing.T) {
 	}
 }
 
+func TestRatelimitTruncate(t *testing.T) {
+	dnsProxy := mustNew(t, &Config{
+		Logger:                 testLogger,
+		UDPListenAddr:          []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		TCPListenAddr:          []*net.TCPAddr{net.TCPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig:         &UpstreamConfig{Upstreams: []upstream.Upstream{newProfileTestUpstream("192.0.2.1")}},
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+		RatelimitTruncate:      1,
+	})
+
+	ctx := context.Background()
+	err := dnsProxy.Start(ctx)
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, func() (err error) { return dnsProxy.Shutdown(ctx) })
+
+	udpAddr := dnsProxy.Addr(ProtoUDP).String()
+	udpClient := &dns.Client{Net: "udp", Timeout: defaultTimeout}
+
+	resp, _, err := udpClient.Exchange(newHostTestMessage("first.example"), udpAddr)
+	require.NoError(t, err)
+
+	assert.False(t, resp.Truncated)
+	assert.Len(t, resp.Answer, 1)
+
+	resp, _, err = udpClient.Exchange(newHostTestMessage("second.example"), udpAddr)
+	require.NoError(t, err)
+
+	assert.True(t, resp.Truncated)
+	assert.Empty(t, resp.Answer)
+
+	tcpAddr := dnsProxy.Addr(ProtoTCP).String()
+	tcpClient := &dns.Client{Net: "tcp", Timeout: defaultTimeout}
+
+	resp, _, err = tcpClient.Exchange(newHostTestMessage("second.example"), tcpAddr)
+	require.NoError(t, err)
+
+	assert.False(t, resp.Truncated)
+	assert.Len(t, resp.Answer, 1)
+}
+
 func TestRatelimiting(t *testing.T) {
 	// rate limit is 1 per sec
 	p := Proxy{}
@@ -95,3 +140,107 @@ func TestWhitelist(t *testing.T) {
 		t.Fatal("Second request must have been allowed due to whitelist")
 	}
 }
+
+func TestRatelimiting_lists(t *testing.T) {
+	allowed := netip.MustParseAddr("192.0.2.1")
+	denied := netip.MustParseAddr("198.51.100.1")
+	other := netip.MustParseAddr("203.0.113.1")
+
+	p := Proxy{}
+	p.Ratelimit = 1
+	p.RatelimitAllowlist = netutil.SliceSubnetSet{netip.MustParsePrefix("192.0.2.0/24")}
+	p.RatelimitDenylist = netutil.SliceSubnetSet{netip.MustParsePrefix("198.51.100.0/24")}
+
+	for range 2 {
+		assert.False(t, p.isRatelimited(allowed))
+		assert.True(t, p.isRatelimited(denied))
+	}
+
+	assert.False(t, p.isRatelimited(other))
+	assert.True(t, p.isRatelimited(other))
+
+	t.Run("disabled", func(t *testing.T) {
+		p.Ratelimit = 0
+
+		assert.True(t, p.isRatelimited(denied))
+		assert.False(t, p.isRatelimited(other))
+	})
+}
+
+func TestRatelimiting_burst(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	p := Proxy{}
+	p.Ratelimit = 1
+	p.RatelimitIPv6 = 2
+	p.RatelimitBurst = 3
+	p.RatelimitSubnetLenIPv4 = 24
+	p.RatelimitSubnetLenIPv6 = 56
+	p.time = &fakeClock{onNow: func() (t time.Time) { return now }}
+
+	addr4 := netip.MustParseAddr("192.0.2.1")
+	addr6 := netip.MustParseAddr("2001:db8::1")
+
+	// The bursts are the same, while the rates differ.
+	for range 3 {
+		assert.False(t, p.isRatelimited(addr4))
+		assert.False(t, p.isRatelimited(addr6))
+	}
+
+	assert.True(t, p.isRatelimited(addr4))
+	assert.True(t, p.isRatelimited(addr6))
+
+	now = now.Add(time.Second)
+	assert.False(t, p.isRatelimited(addr4))
+	assert.True(t, p.isRatelimited(addr4))
+
+	assert.False(t, p.isRatelimited(addr6))
+	assert.False(t, p.isRatelimited(addr6))
+	assert.True(t, p.isRatelimited(addr6))
+}
+
+func TestRatelimiting_slip(t *testing.T) {
+	p := Proxy{}
+	p.Ratelimit = 1
+	p.RatelimitSlip = 2
+	p.time = &fakeClock{onNow: func() (t time.Time) { return time.Unix(1_700_000_000, 0) }}
+
+	addr := netip.MustParseAddr("192.0.2.1")
+
+	limited, slip := p.checkRatelimit(nil, addr)
+	assert.False(t, limited)
+	assert.False(t, slip)
+
+	// Every second request in a row exceeding the ratelimit slips.
+	for _, want := range []bool{false, true, false, true} {
+		limited, slip = p.checkRatelimit(nil, addr)
+		assert.True(t, limited)
+		assert.Equal(t, want, slip)
+	}
+
+	p.RatelimitDenylist = netutil.SliceSubnetSet{netip.MustParsePrefix("192.0.2.0/24")}
+	for range 2 {
+		limited, slip = p.checkRatelimit(nil, addr)
+		assert.True(t, limited)
+		assert.False(t, slip)
+	}
+}
+
+func TestRatelimiting_rate(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	p := Proxy{}
+	p.Ratelimit = 2
+	p.time = &fakeClock{onNow: func() (t time.Time) { return now }}
+
+	addr := netip.MustParseAddr("127.0.0.1")
+
+	assert.False(t, p.isRatelimited(addr))
+	assert.False(t, p.isRatelimited(addr))
+	assert.True(t, p.isRatelimited(addr))
+
+	// A single request is allowed each half of a second.
+	for range 2 {
+		now = now.Add(500 * time.Millisecond)
+		assert.False(t, p.isRatelimited(addr))
+		assert.True(t, p.isRatelimited(addr))
+	}
+}
@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"hash/maphash"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	// ratelimitShardsNum is the number of shards of [ratelimitBuckets].  It
+	// must be a power of two.
+	ratelimitShardsNum = 64
+
+	// ratelimitIdleTimeout is the duration since the latest allowed request
+	// from a subnet, after which its ratelimiter is evicted.
+	ratelimitIdleTimeout = 10 * time.Minute
+
+	// ratelimitSweepInterval is the minimum interval between the evictions of
+	// the idle ratelimiters from a single shard.
+	ratelimitSweepInterval = time.Minute
+)
+
+// ratelimitBuckets stores the ratelimiters of the client subnets.  The
+// ratelimiters are spread over the shards by the hash of the subnet, so that
+// the requests from different subnets rarely contend for the same lock.
+type ratelimitBuckets struct {
+	// clock is used by the ratelimiters and to evict the idle ones.
+	clock Clock
+
+	// seed is the seed of the hash of the subnets.
+	seed maphash.Seed
+
+	// shards are the shards of the ratelimiters.
+	shards [ratelimitShardsNum]ratelimitShard
+
+	// v4 are the parameters of the ratelimiters of the IPv4 subnets.
+	v4 ratelimitParams
+
+	// v6 are the parameters of the ratelimiters of the IPv6 subnets.
+	v6 ratelimitParams
+}
+
+// ratelimitShard is a single shard of [ratelimitBuckets].
+type ratelimitShard struct {
+	// mu protects limiters and lastSweep.
+	mu *sync.RWMutex
+
+	// limiters are the ratelimiters of the subnets of the shard.
+	limiters map[netip.Prefix]*rateLimiter
+
+	// lastSweep is the time of the latest eviction of the idle ratelimiters.
+	lastSweep time.Time
+}
+
+// newRatelimitBuckets returns new ratelimitBuckets limiting the requests from
+// each IPv4 and IPv6 subnet with v4 and v6 respectively.  The rates and the
+// bursts must be positive, clock must not be nil.
+func newRatelimitBuckets(v4, v6 ratelimitParams, clock Clock) (b *ratelimitBuckets) {
+	b = &ratelimitBuckets{
+		clock: clock,
+		seed:  maphash.MakeSeed(),
+		v4:    v4,
+		v6:    v6,
+	}
+
+	now := clock.Now()
+	for i := range b.shards {
+		b.shards[i] = ratelimitShard{
+			mu:        &sync.RWMutex{},
+			limiters:  map[netip.Prefix]*rateLimiter{},
+			lastSweep: now,
+		}
+	}
+
+	return b
+}
+
+// limiter returns the ratelimiter of the subnet pref, creating it if there is
+// none.  The idle ratelimiters of the shard are evicted when a new one is
+// created, at most once per [ratelimitSweepInterval].
+func (b *ratelimitBuckets) limiter(pref netip.Prefix) (l *rateLimiter) {
+	s := b.shard(pref)
+
+	s.mu.RLock()
+	l = s.limiters[pref]
+	s.mu.RUnlock()
+
+	if l != nil {
+		return l
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Check again, since the ratelimiter could have been created concurrently.
+	if l = s.limiters[pref]; l != nil {
+		return l
+	}
+
+	now := b.clock.Now()
+	if now.Sub(s.lastSweep) >= ratelimitSweepInterval {
+		s.sweep(now)
+	}
+
+	params := b.v6
+	if pref.Addr().Is4() {
+		params = b.v4
+	}
+
+	l = newRateLimiter(params, b.clock)
+	s.limiters[pref] = l
+
+	return l
+}
+
+// shard returns the shard of the subnet pref.
+func (b *ratelimitBuckets) shard(pref netip.Prefix) (s *ratelimitShard) {
+	addr := pref.Addr().As16()
+	h := maphash.Bytes(b.seed, addr[:])
+
+	return &b.shards[h&(ratelimitShardsNum-1)]
+}
+
+// sweep evicts the ratelimiters of s idle for [ratelimitIdleTimeout] by now.
+// s.mu must be locked.
+func (s *ratelimitShard) sweep(now time.Time) {
+	for pref, l := range s.limiters {
+		if l.idle(now, ratelimitIdleTimeout) {
+			delete(s.limiters, pref)
+		}
+	}
+
+	s.lastSweep = now
+}
@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRatelimitBuckets(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	clock := &fakeClock{onNow: func() (t time.Time) { return now }}
+
+	var (
+		pref1 = netip.MustParsePrefix("192.0.2.0/24")
+		pref2 = netip.MustParsePrefix("198.51.100.0/24")
+	)
+
+	params := ratelimitParams{rate: 1, burst: 1}
+	b := newRatelimitBuckets(params, params, clock)
+
+	l1 := b.limiter(pref1)
+	assert.Same(t, l1, b.limiter(pref1))
+	assert.True(t, l1.allow())
+	assert.False(t, b.limiter(pref1).allow())
+
+	now = now.Add(ratelimitIdleTimeout / 2)
+	l2 := b.limiter(pref2)
+	assert.True(t, l2.allow())
+
+	// Evict the ratelimiters idle since before the timeout.
+	now = now.Add(ratelimitIdleTimeout / 2)
+	for i := range b.shards {
+		b.shards[i].sweep(now)
+	}
+
+	assert.NotSame(t, l1, b.limiter(pref1))
+	assert.Same(t, l2, b.limiter(pref2))
+}
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	clock := &fakeClock{onNow: func() (t time.Time) { return now }}
+
+	l := newRateLimiter(ratelimitParams{rate: 2, burst: 4}, clock)
+
+	// The whole burst is allowed at once.
+	for range 4 {
+		assert.True(t, l.allow())
+	}
+
+	assert.False(t, l.allow())
+
+	// A single token is restored.
+	now = now.Add(500 * time.Millisecond)
+	assert.True(t, l.allow())
+	assert.False(t, l.allow())
+
+	// The bucket never holds more than the burst.
+	now = now.Add(time.Hour)
+	for range 4 {
+		assert.True(t, l.allow())
+	}
+
+	assert.False(t, l.allow())
+}
+
+func TestRateLimiter_idle(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	clock := &fakeClock{onNow: func() (t time.Time) { return now }}
+
+	l := newRateLimiter(ratelimitParams{rate: 1, burst: 2}, clock)
+	assert.True(t, l.idle(now, 0))
+
+	assert.True(t, l.allow())
+	assert.True(t, l.allow())
+
+	// The bucket isn't full yet.
+	assert.False(t, l.idle(now.Add(time.Second), time.Second))
+	assert.True(t, l.idle(now.Add(2*time.Second), time.Second))
+	assert.False(t, l.idle(now.Add(2*time.Second), 3*time.Second))
+}
+
+func BenchmarkProxy_isRatelimited(b *testing.B) {
+	p := &Proxy{}
+	p.Ratelimit = 100
+	p.RatelimitSubnetLenIPv4 = 24
+	p.RatelimitSubnetLenIPv6 = 64
+
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		var i byte
+		for pb.Next() {
+			i++
+			_ = p.isRatelimited(netip.AddrFrom4([4]byte{192, 0, i, 1}))
+		}
+	})
+}
@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+)
+
+// ratelimitParams are the parameters of the ratelimiters of the client subnets
+// of a single address family.
+type ratelimitParams struct {
+	// rate is the sustained number of events per second.
+	rate int
+
+	// burst is the maximum number of events allowed at once.
+	burst int
+}
+
+// rateLimiter is a token bucket: it allows the bursts of at most a fixed number
+// of events, while the allowance is restored at a fixed rate.  It's safe for
+// concurrent use.
+type rateLimiter struct {
+	// mu protects tokens, last, and denied.
+	mu *sync.Mutex
+
+	// clock is used to get the times of the events.
+	clock Clock
+
+	// last is the time the tokens have been restored at.
+	last time.Time
+
+	// tokens is the number of events currently allowed.
+	tokens float64
+
+	// rate is the number of tokens restored per second.
+	rate float64
+
+	// burst is the maximum number of tokens.
+	burst float64
+
+	// denied is the number of events denied since the latest allowed one.
+	denied uint64
+}
+
+// newRateLimiter returns a new *rateLimiter with a full bucket.  params.rate
+// and params.burst must be positive, clock must not be nil.
+func newRateLimiter(params ratelimitParams, clock Clock) (l *rateLimiter) {
+	return &rateLimiter{
+		mu:     &sync.Mutex{},
+		clock:  clock,
+		last:   clock.Now(),
+		tokens: float64(params.burst),
+		rate:   float64(params.rate),
+		burst:  float64(params.burst),
+	}
+}
+
+// allow returns true and takes a token if there is one.
+func (l *rateLimiter) allow() (ok bool) {
+	ok, _ = l.take()
+
+	return ok
+}
+
+// take returns true and takes a token if there is one.  Otherwise, it returns
+// the number of the events denied since the latest allowed one, including this
+// one.
+func (l *rateLimiter) take() (ok bool, denied uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.clock.Now()
+	l.tokens = l.tokensAt(now)
+	l.last = now
+
+	if l.tokens < 1 {
+		l.denied++
+
+		return false, l.denied
+	}
+
+	l.tokens--
+	l.denied = 0
+
+	return true, 0
+}
+
+// tokensAt returns the number of tokens restored by now.  l.mu must be locked.
+func (l *rateLimiter) tokensAt(now time.Time) (tokens float64) {
+	elapsed := now.Sub(l.last)
+	if elapsed <= 0 {
+		return l.tokens
+	}
+
+	return min(l.burst, l.tokens+elapsed.Seconds()*l.rate)
+}
+
+// idle returns true if the latest event is at least timeout before now and the
+// bucket is full by now, so that the limiter could be safely replaced with a
+// new one.
+func (l *rateLimiter) idle(now time.Time, timeout time.Duration) (ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return now.Sub(l.last) >= timeout && l.tokensAt(now) >= l.burst
+}
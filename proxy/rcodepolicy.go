@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/miekg/dns"
+)
+
+// RcodePolicy defines how the responses with a particular response code from
+// the upstreams are handled, since different upstreams use the REFUSED and the
+// NOTIMP codes differently.
+type RcodePolicy string
+
+// RcodePolicy values.
+const (
+	// RcodePolicyPass passes the response through to the client as is.
+	RcodePolicyPass RcodePolicy = "pass"
+
+	// RcodePolicyFail treats the response as the failure of the upstream, so
+	// that the next upstream is tried in the load-balancing mode, the upstream
+	// is penalized, and the fallbacks are used if no upstream responds.
+	RcodePolicyFail RcodePolicy = "fail"
+
+	// RcodePolicyServFail replaces the response with SERVFAIL with the
+	// extended DNS error describing the original response code, see RFC 8914.
+	RcodePolicyServFail RcodePolicy = "servfail"
+)
+
+// Validate returns an error if pol is not a valid response code policy.
+func (pol RcodePolicy) Validate() (err error) {
+	switch pol {
+	case "", RcodePolicyPass, RcodePolicyFail, RcodePolicyServFail:
+		return nil
+	default:
+		return fmt.Errorf("unknown value %q", string(pol))
+	}
+}
+
+// rcodePolicy returns the policy for the responses with rcode, see
+// [Config.UpstreamRefusedPolicy] and [Config.UpstreamNotImpPolicy].
+func (p *Proxy) rcodePolicy(rcode int) (pol RcodePolicy) {
+	switch rcode {
+	case dns.RcodeRefused:
+		pol = p.UpstreamRefusedPolicy
+	case dns.RcodeNotImplemented:
+		pol = p.UpstreamNotImpPolicy
+	default:
+		// Go on.
+	}
+
+	if pol == "" {
+		return RcodePolicyPass
+	}
+
+	return pol
+}
+
+// errRcodeFailure is returned by the upstreams responding with the response
+// codes having [RcodePolicyFail].
+const errRcodeFailure errors.Error = "upstream responded with failure rcode"
+
+// rcodeFailUpstream is an [upstream.Upstream] returning an error instead of the
+// responses with the response codes having [RcodePolicyFail].
+type rcodeFailUpstream struct {
+	upstream.Upstream
+
+	// proxy defines the policies of the response codes.  It must not be nil.
+	proxy *Proxy
+}
+
+// type check
+var (
+	_ upstream.Upstream         = (*rcodeFailUpstream)(nil)
+	_ upstream.ContextExchanger = (*rcodeFailUpstream)(nil)
+)
+
+// Exchange implements the [upstream.Upstream] interface for *rcodeFailUpstream.
+func (u *rcodeFailUpstream) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	return u.ExchangeContext(context.Background(), req)
+}
+
+// ExchangeContext implements the [upstream.ContextExchanger] interface for
+// *rcodeFailUpstream.
+func (u *rcodeFailUpstream) ExchangeContext(
+	ctx context.Context,
+	req *dns.Msg,
+) (resp *dns.Msg, err error) {
+	resp, err = upstream.ExchangeContext(ctx, u.Upstream, req)
+	if err != nil || resp == nil || u.proxy.rcodePolicy(resp.Rcode) != RcodePolicyFail {
+		return resp, err
+	}
+
+	return nil, fmt.Errorf("%w %s", errRcodeFailure, dns.RcodeToString[resp.Rcode])
+}
+
+// withRcodeFailures returns ups wrapped to fail on the responses with the
+// response codes having [RcodePolicyFail].  It returns ups as is if there are
+// no such codes.
+func (p *Proxy) withRcodeFailures(ups []upstream.Upstream) (wrapped []upstream.Upstream) {
+	if p.UpstreamRefusedPolicy != RcodePolicyFail && p.UpstreamNotImpPolicy != RcodePolicyFail {
+		return ups
+	}
+
+	wrapped = make([]upstream.Upstream, 0, len(ups))
+	for _, u := range ups {
+		wrapped = append(wrapped, &rcodeFailUpstream{
+			Upstream: u,
+			proxy:    p,
+		})
+	}
+
+	return wrapped
+}
+
+// servFailForRcode returns the SERVFAIL response to req with the extended DNS
+// error, if resp has the response code having [RcodePolicyServFail].
+// Otherwise, it returns resp as is.  resp may be nil.
+func (p *Proxy) servFailForRcode(req, resp *dns.Msg) (res *dns.Msg) {
+	if resp == nil || p.rcodePolicy(resp.Rcode) != RcodePolicyServFail {
+		return resp
+	}
+
+	code := dns.ExtendedErrorCodeProhibited
+	if resp.Rcode == dns.RcodeNotImplemented {
+		code = dns.ExtendedErrorCodeNotSupported
+	}
+
+	res = p.messages.NewMsgSERVFAIL(req)
+	addEDE(req, res, code, "upstream responded with "+dns.RcodeToString[resp.Rcode])
+
+	return res
+}
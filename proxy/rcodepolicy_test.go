@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_Resolve_rcodePolicy(t *testing.T) {
+	var refused, notImp, fallbacks int
+	refusedUps := newRcodeUpstream("refused", dns.RcodeRefused, &refused)
+	notImpUps := newRcodeUpstream("notimp", dns.RcodeNotImplemented, &notImp)
+	fallbackUps := newRcodeUpstream("fallback", dns.RcodeSuccess, &fallbacks)
+
+	testCases := []struct {
+		ups           upstream.Upstream
+		name          string
+		refusedPolicy RcodePolicy
+		notImpPolicy  RcodePolicy
+		wantEDE       uint16
+		wantRcode     int
+		wantFallback  bool
+	}{{
+		ups:           refusedUps,
+		name:          "pass",
+		refusedPolicy: "",
+		notImpPolicy:  RcodePolicyFail,
+		wantEDE:       0,
+		wantRcode:     dns.RcodeRefused,
+		wantFallback:  false,
+	}, {
+		ups:           refusedUps,
+		name:          "fail",
+		refusedPolicy: RcodePolicyFail,
+		notImpPolicy:  RcodePolicyPass,
+		wantEDE:       0,
+		wantRcode:     dns.RcodeSuccess,
+		wantFallback:  true,
+	}, {
+		ups:           refusedUps,
+		name:          "servfail_refused",
+		refusedPolicy: RcodePolicyServFail,
+		notImpPolicy:  RcodePolicyPass,
+		wantEDE:       dns.ExtendedErrorCodeProhibited,
+		wantRcode:     dns.RcodeServerFailure,
+		wantFallback:  false,
+	}, {
+		ups:           notImpUps,
+		name:          "servfail_notimp",
+		refusedPolicy: RcodePolicyPass,
+		notImpPolicy:  RcodePolicyServFail,
+		wantEDE:       dns.ExtendedErrorCodeNotSupported,
+		wantRcode:     dns.RcodeServerFailure,
+		wantFallback:  false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			fallbacks = 0
+
+			p := mustNew(t, &Config{
+				Logger:         testLogger,
+				UDPListenAddr:  []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+				UpstreamConfig: &UpstreamConfig{Upstreams: []upstream.Upstream{tc.ups}},
+				Fallbacks: &UpstreamConfig{
+					Upstreams: []upstream.Upstream{fallbackUps},
+				},
+				TrustedProxies:        defaultTrustedProxies,
+				UpstreamRefusedPolicy: tc.refusedPolicy,
+				UpstreamNotImpPolicy:  tc.notImpPolicy,
+			})
+
+			req := newHostTestMessage("example.org")
+			req.SetEdns0(defaultUDPBufSize, false)
+
+			d := &DNSContext{Req: req}
+			require.NoError(t, p.Resolve(d))
+
+			assert.Equal(t, tc.wantRcode, d.Res.Rcode)
+			assert.Equal(t, tc.wantFallback, fallbacks > 0)
+
+			var ede *dns.EDNS0_EDE
+			if opt := d.Res.IsEdns0(); opt != nil {
+				for _, o := range opt.Option {
+					if e, ok := o.(*dns.EDNS0_EDE); ok {
+						ede = e
+					}
+				}
+			}
+
+			if tc.wantEDE == 0 {
+				assert.Nil(t, ede)
+			} else {
+				require.NotNil(t, ede)
+				assert.Equal(t, tc.wantEDE, ede.InfoCode)
+			}
+		})
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := New(&Config{
+			UDPListenAddr:        []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+			UpstreamConfig:       &UpstreamConfig{Upstreams: []upstream.Upstream{refusedUps}},
+			TrustedProxies:       defaultTrustedProxies,
+			UpstreamNotImpPolicy: "drop",
+		})
+		testutil.AssertErrorMsg(t, `validating upstream notimp policy: unknown value "drop"`, err)
+	})
+}
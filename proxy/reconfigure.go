@@ -0,0 +1,168 @@
+package proxy
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// Reconfigure applies the reloadable part of c to the running proxy without
+// restarting the listeners.  The reloadable part is:
+//
+//   - the upstreams: [Config.UpstreamConfig], [Config.PrivateRDNSUpstreamConfig],
+//     and [Config.Fallbacks];
+//   - the filtering: [Config.BogusNXDomain];
+//   - the cache: [Config.CacheEnabled], [Config.CacheSizeBytes],
+//     [Config.CacheOptimistic], [Config.CacheAggressiveNSEC],
+//     [Config.TrustUpstreamAD], [Config.CacheMinTTL], [Config.CacheMaxTTL],
+//     and [Config.CacheTTLOverrides];
+//   - the ratelimiting: [Config.Ratelimit], [Config.RatelimitIPv6],
+//     [Config.RatelimitBurst], [Config.RatelimitBurstIPv6],
+//     [Config.RatelimitTruncate], [Config.RatelimitSlip],
+//     [Config.RatelimitWhitelist], [Config.RatelimitAllowlist],
+//     [Config.RatelimitDenylist], [Config.RatelimitSubnetLenIPv4], and
+//     [Config.RatelimitSubnetLenIPv6].
+//
+// The other fields of c are ignored.  It waits for the requests being resolved
+// to finish, while the new ones wait for the reconfiguration, and then closes
+// the replaced upstream configurations.  The cache is only recreated, and
+// thus cleared, if its size or mode changes.  It returns an error if c is
+// invalid, in which case p is left unchanged.  The result is reported to the
+// event listeners, see [EventListener.OnConfigReload].  c must not be nil.
+func (p *Proxy) Reconfigure(c *Config) (err error) {
+	defer func() { p.eventListener().OnConfigReload(err) }()
+
+	check := &Proxy{
+		Config:      *c,
+		privateNets: p.privateNets,
+	}
+
+	// The in-kernel responder isn't reloadable, but it restricts the reloadable
+	// settings.
+	check.XDP = p.XDP
+
+	err = check.validateReloadable()
+	if err != nil {
+		return fmt.Errorf("validating: %w", err)
+	}
+
+	p.reconfigureLock.Lock()
+	defer p.reconfigureLock.Unlock()
+
+	replaced := p.swapUpstreams(c)
+
+	p.BogusNXDomain = c.BogusNXDomain
+
+	p.reconfigureCache(c)
+	p.reconfigureRatelimit(c)
+
+	var errs []error
+	for _, uc := range replaced {
+		errs = closeAll(errs, uc)
+	}
+
+	p.logger.Info("reconfigured dns proxy")
+
+	if len(errs) > 0 {
+		return fmt.Errorf("closing replaced upstreams: %w", errors.Join(errs...))
+	}
+
+	return nil
+}
+
+// swapUpstreams sets the upstream configurations of p to the ones of c and
+// returns the replaced non-nil ones.  p.reconfigureLock must be locked.
+func (p *Proxy) swapUpstreams(c *Config) (replaced []*UpstreamConfig) {
+	for _, pair := range []struct {
+		cur  **UpstreamConfig
+		next *UpstreamConfig
+	}{{
+		cur:  &p.UpstreamConfig,
+		next: c.UpstreamConfig,
+	}, {
+		cur:  &p.PrivateRDNSUpstreamConfig,
+		next: c.PrivateRDNSUpstreamConfig,
+	}, {
+		cur:  &p.Fallbacks,
+		next: c.Fallbacks,
+	}} {
+		if *pair.cur != nil && *pair.cur != pair.next {
+			replaced = append(replaced, *pair.cur)
+		}
+
+		*pair.cur = pair.next
+	}
+
+	return replaced
+}
+
+// CurrentConfig returns a shallow copy of the configuration of p with the
+// reloadable part currently applied, see [Proxy.Reconfigure].  It's safe for
+// concurrent use.
+func (p *Proxy) CurrentConfig() (c *Config) {
+	p.reconfigureLock.RLock()
+	defer p.reconfigureLock.RUnlock()
+
+	conf := p.Config
+
+	return &conf
+}
+
+// reconfigureCache applies the cache settings of c to p, recreating the cache
+// if needed.  p.reconfigureLock must be locked.
+func (p *Proxy) reconfigureCache(c *Config) {
+	p.CacheMinTTL, p.CacheMaxTTL = c.CacheMinTTL, c.CacheMaxTTL
+	p.CacheTTLOverrides = c.CacheTTLOverrides
+	p.TrustUpstreamAD = c.TrustUpstreamAD
+
+	if p.CacheEnabled == c.CacheEnabled &&
+		p.CacheSizeBytes == c.CacheSizeBytes &&
+		p.CacheOptimistic == c.CacheOptimistic &&
+		p.CacheAggressiveNSEC == c.CacheAggressiveNSEC {
+		return
+	}
+
+	p.CacheEnabled = c.CacheEnabled
+	p.CacheSizeBytes = c.CacheSizeBytes
+	p.CacheOptimistic = c.CacheOptimistic
+	p.CacheAggressiveNSEC = c.CacheAggressiveNSEC
+
+	p.cache, p.shortFlighter = nil, nil
+	p.initCache()
+	p.clearXDP()
+}
+
+// reconfigureRatelimit applies the ratelimiting settings of c to p, resetting
+// the ratelimiters if needed.  p.reconfigureLock must be locked.
+func (p *Proxy) reconfigureRatelimit(c *Config) {
+	allowlist := slices.Clone(c.RatelimitWhitelist)
+	slices.SortFunc(allowlist, netip.Addr.Compare)
+	p.RatelimitWhitelist = allowlist
+	p.RatelimitAllowlist = c.RatelimitAllowlist
+	p.RatelimitDenylist = c.RatelimitDenylist
+	p.RatelimitSlip = c.RatelimitSlip
+
+	if p.Ratelimit == c.Ratelimit &&
+		p.RatelimitIPv6 == c.RatelimitIPv6 &&
+		p.RatelimitBurst == c.RatelimitBurst &&
+		p.RatelimitBurstIPv6 == c.RatelimitBurstIPv6 &&
+		p.RatelimitTruncate == c.RatelimitTruncate &&
+		p.RatelimitSubnetLenIPv4 == c.RatelimitSubnetLenIPv4 &&
+		p.RatelimitSubnetLenIPv6 == c.RatelimitSubnetLenIPv6 {
+		return
+	}
+
+	p.Ratelimit = c.Ratelimit
+	p.RatelimitIPv6 = c.RatelimitIPv6
+	p.RatelimitBurst = c.RatelimitBurst
+	p.RatelimitBurstIPv6 = c.RatelimitBurstIPv6
+	p.RatelimitTruncate = c.RatelimitTruncate
+	p.RatelimitSubnetLenIPv4 = c.RatelimitSubnetLenIPv4
+	p.RatelimitSubnetLenIPv6 = c.RatelimitSubnetLenIPv6
+
+	// Make the ratelimiters to be recreated with the new limit.
+	p.ratelimitBuckets.Store(nil)
+	p.truncateBuckets.Store(nil)
+}
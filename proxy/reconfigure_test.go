@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newReconfigureTestUpstream returns the upstream answering with ip and
+// reporting its closing to closed.
+func newReconfigureTestUpstream(ip string, closed *atomic.Bool) (u *fakeUpstream) {
+	return &fakeUpstream{
+		onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			return newCompareTestReply(req, ip, defaultTestTTL), nil
+		},
+		onAddress: func() (addr string) { return ip },
+		onClose: func() (err error) {
+			closed.Store(true)
+
+			return nil
+		},
+	}
+}
+
+func TestProxy_Reconfigure(t *testing.T) {
+	var oldClosed, newClosed atomic.Bool
+	oldUps := newReconfigureTestUpstream("192.0.2.1", &oldClosed)
+	newUps := newReconfigureTestUpstream("192.0.2.2", &newClosed)
+
+	conf := &Config{
+		Logger:        testLogger,
+		UDPListenAddr: []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{oldUps},
+		},
+		TrustedProxies: defaultTrustedProxies,
+		CacheEnabled:   true,
+		CacheSizeBytes: defaultCacheSize,
+	}
+	p := mustNew(t, conf)
+
+	ctx := context.Background()
+	require.NoError(t, p.Start(ctx))
+	testutil.CleanupAndRequireSuccess(t, func() (err error) { return p.Shutdown(ctx) })
+
+	client := &dns.Client{Net: string(ProtoUDP), Timeout: defaultTimeout}
+	addr := p.Addr(ProtoUDP).String()
+
+	exchange := func(t *testing.T, host string) (ip net.IP) {
+		t.Helper()
+
+		resp, _, err := client.Exchange(newHostTestMessage(host), addr)
+		require.NoError(t, err)
+		require.NotEmpty(t, resp.Answer)
+
+		a := testutil.RequireTypeAssert[*dns.A](t, resp.Answer[0])
+
+		return a.A
+	}
+
+	assert.Equal(t, net.IP{192, 0, 2, 1}, exchange(t, "cached.example").To4())
+
+	t.Run("invalid", func(t *testing.T) {
+		bad := *conf
+		bad.UpstreamConfig = &UpstreamConfig{}
+
+		err := p.Reconfigure(&bad)
+		require.Error(t, err)
+
+		assert.Same(t, conf.UpstreamConfig, p.UpstreamConfig)
+		assert.False(t, oldClosed.Load())
+	})
+
+	next := *conf
+	next.UpstreamConfig = &UpstreamConfig{
+		Upstreams: []upstream.Upstream{newUps},
+	}
+	next.Ratelimit = 10
+	next.RatelimitSubnetLenIPv4 = 24
+	next.RatelimitSubnetLenIPv6 = 64
+
+	require.NoError(t, p.Reconfigure(&next))
+
+	assert.True(t, oldClosed.Load())
+	assert.False(t, newClosed.Load())
+	assert.Equal(t, 10, p.Ratelimit)
+
+	cur := p.CurrentConfig()
+	assert.Same(t, next.UpstreamConfig, cur.UpstreamConfig)
+	assert.Equal(t, 10, cur.Ratelimit)
+
+	// The cache settings haven't changed, so the cached response is kept.
+	assert.Equal(t, net.IP{192, 0, 2, 1}, exchange(t, "cached.example").To4())
+	assert.Equal(t, net.IP{192, 0, 2, 2}, exchange(t, "new.example").To4())
+
+	t.Run("cache_disabled", func(t *testing.T) {
+		noCache := next
+		noCache.CacheEnabled = false
+
+		require.NoError(t, p.Reconfigure(&noCache))
+
+		assert.Nil(t, p.cache)
+		assert.Equal(t, net.IP{192, 0, 2, 2}, exchange(t, "cached.example").To4())
+	})
+}
@@ -30,6 +30,7 @@ const (
 // recursionDetector detects recursion in DNS forwarding.
 type recursionDetector struct {
 	recentRequests glcache.Cache
+	clock          Clock
 	ttl            time.Duration
 }
 
@@ -47,12 +48,12 @@ func (rd *recursionDetector) check(msg *dns.Msg) (ok bool) {
 
 	expire := time.Unix(0, int64(binary.BigEndian.Uint64(expireData)))
 
-	return time.Now().Before(expire)
+	return rd.clock.Now().Before(expire)
 }
 
 // add caches the msg if it has anything in the questions section.
 func (rd *recursionDetector) add(msg *dns.Msg) {
-	now := time.Now()
+	now := rd.clock.Now()
 
 	if len(msg.Question) == 0 {
 		return
@@ -71,14 +72,20 @@ func (rd *recursionDetector) clear() {
 	rd.recentRequests.Clear()
 }
 
-// newRecursionDetector returns the initialized *recursionDetector.
-func newRecursionDetector(ttl time.Duration, suspectsNum uint) (rd *recursionDetector) {
+// newRecursionDetector returns the initialized *recursionDetector.  clock must
+// not be nil.
+func newRecursionDetector(
+	ttl time.Duration,
+	suspectsNum uint,
+	clock Clock,
+) (rd *recursionDetector) {
 	return &recursionDetector{
 		recentRequests: glcache.New(glcache.Config{
 			EnableLRU: true,
 			MaxCount:  suspectsNum,
 		}),
-		ttl: ttl,
+		clock: clock,
+		ttl:   ttl,
 	}
 }
 
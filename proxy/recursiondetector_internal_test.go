@@ -3,17 +3,18 @@ package proxy
 import (
 	"bytes"
 	"encoding/binary"
+	"log/slog"
 	"testing"
 	"time"
 
-	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
 	"github.com/AdguardTeam/golibs/netutil"
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestRecursionDetector_Check(t *testing.T) {
-	rd := newRecursionDetector(0, 2)
+	rd := newRecursionDetector(0, 2, realClock{})
 
 	const (
 		recID  = 1234
@@ -81,7 +82,7 @@ func TestRecursionDetector_Check(t *testing.T) {
 }
 
 func TestRecursionDetector_Suspect(t *testing.T) {
-	rd := newRecursionDetector(0, 1)
+	rd := newRecursionDetector(0, 1, realClock{})
 
 	testCases := []struct {
 		msg  *dns.Msg
@@ -177,7 +178,7 @@ func msgToSignatureSlow(msg *dns.Msg) (sig []byte) {
 	}
 	copy(signature.name[:], q.Name)
 	if err := binary.Write(b, binary.BigEndian, signature); err != nil {
-		log.Debug("writing message signature: %s", err)
+		slog.Debug("writing message signature", slogutil.KeyError, err)
 	}
 
 	return b.Bytes()
@@ -0,0 +1,216 @@
+package proxy
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/httphdr"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/miekg/dns"
+)
+
+// Constants of the resolver information, see RFC 9606.
+const (
+	// typeRESINFO is the type of the resolver information records.
+	typeRESINFO uint16 = 261
+
+	// resolverInfoName is the special-use domain name the clients not knowing
+	// the name of the resolver request the information for, see RFC 9462.
+	resolverInfoName = "resolver.arpa."
+
+	// resolverInfoTTL is the TTL of the resolver information records.
+	resolverInfoTTL = 3600
+
+	// infoURLKey is the prefix of the RESINFO key containing the URL of the
+	// information page.
+	infoURLKey = "infourl="
+
+	// maxCharStringLen is the maximum length of a character string in the
+	// RESINFO data, as in TXT.
+	maxCharStringLen = 255
+
+	// resolverInfoPath is the path of the DNS-over-HTTPS listener the resolver
+	// information is served at in the JSON form.
+	resolverInfoPath = "/.well-known/dns-query"
+)
+
+// ResolverInfo is the information about the capabilities of the resolver
+// returned to the clients, see RFC 9606.
+type ResolverInfo struct {
+	// InfoURL, if not empty, is the URL of the web page with the information
+	// about the resolver.  It must be an HTTPS URL.
+	InfoURL string
+
+	// ExtendedErrors are the codes of the extended DNS errors the resolver may
+	// return.
+	ExtendedErrors []uint16
+
+	// QNAMEMinimization is true if the resolver minimizes the names it sends
+	// to the authoritative servers, see RFC 9156.
+	QNAMEMinimization bool
+
+	// Filtering is true if the resolver filters the responses.  It's only
+	// reported over HTTPS, since there is no registered RESINFO key for it.
+	Filtering bool
+
+	// DNSSECValidation is true if the resolver validates DNSSEC.  It's only
+	// reported over HTTPS, since there is no registered RESINFO key for it.
+	DNSSECValidation bool
+}
+
+// validate returns an error if c is invalid.  c may be nil.
+func (c *ResolverInfo) validate() (err error) {
+	if c == nil || c.InfoURL == "" {
+		return nil
+	}
+
+	u, err := url.Parse(c.InfoURL)
+	if err != nil {
+		return fmt.Errorf("info url: %w", err)
+	} else if u.Scheme != "https" {
+		return fmt.Errorf("info url: bad scheme %q, want https", u.Scheme)
+	} else if l := len(infoURLKey) + len(c.InfoURL); l > maxCharStringLen {
+		return fmt.Errorf("info url: too long key of %d bytes, max %d", l, maxCharStringLen)
+	}
+
+	return nil
+}
+
+// keys returns the RESINFO keys describing c.  c must not be nil.
+func (c *ResolverInfo) keys() (keys []string) {
+	if c.QNAMEMinimization {
+		keys = append(keys, "qnamemin")
+	}
+
+	if len(c.ExtendedErrors) > 0 {
+		codes := make([]string, 0, len(c.ExtendedErrors))
+		for _, code := range c.ExtendedErrors {
+			codes = append(codes, strconv.FormatUint(uint64(code), 10))
+		}
+
+		keys = append(keys, "exterr="+strings.Join(codes, ","))
+	}
+
+	if c.InfoURL != "" {
+		keys = append(keys, infoURLKey+c.InfoURL)
+	}
+
+	return keys
+}
+
+// resolverInfoRR returns the RESINFO record for name containing keys.  The
+// type isn't supported by the DNS library, so the record is built as unknown
+// one having the same data format as TXT.
+func resolverInfoRR(name string, keys []string) (rr dns.RR) {
+	var data []byte
+	for _, k := range keys {
+		// The keys are short enough, since the URL is the only long one and
+		// its length is validated.
+		data = append(data, byte(len(k)))
+		data = append(data, k...)
+	}
+
+	return &dns.RFC3597{
+		Hdr: dns.RR_Header{
+			Name:   name,
+			Rrtype: typeRESINFO,
+			Class:  dns.ClassINET,
+			Ttl:    resolverInfoTTL,
+		},
+		Rdata: hex.EncodeToString(data),
+	}
+}
+
+// handleResolverInfo returns the response to the RESINFO request for the
+// resolver, if [Config.ResolverInfo] is set, and nil otherwise.  The
+// information is returned for [resolverInfoName] and the server name the
+// request has been received for.
+func (p *Proxy) handleResolverInfo(d *DNSContext) (resp *dns.Msg) {
+	if p.ResolverInfo == nil {
+		return nil
+	}
+
+	q := d.Req.Question[0]
+	if q.Qtype != typeRESINFO || q.Qclass != dns.ClassINET {
+		return nil
+	}
+
+	name := strings.ToLower(q.Name)
+	isServerName := d.ServerName != "" && name == dns.Fqdn(strings.ToLower(d.ServerName))
+	if name != resolverInfoName && !isServerName {
+		return nil
+	}
+
+	resp = (&dns.Msg{}).SetReply(d.Req)
+	resp.RecursionAvailable = true
+	resp.Answer = append(resp.Answer, resolverInfoRR(q.Name, p.ResolverInfo.keys()))
+
+	return resp
+}
+
+// resolverInfoJSON is the JSON form of the resolver information served over
+// HTTPS.
+type resolverInfoJSON struct {
+	InfoURL           string   `json:"infourl,omitempty"`
+	ExtendedErrors    []uint16 `json:"exterr,omitempty"`
+	Transports        []Proto  `json:"transports"`
+	QNAMEMinimization bool     `json:"qnamemin"`
+	Filtering         bool     `json:"filtering"`
+	DNSSECValidation  bool     `json:"dnssec_validation"`
+}
+
+// serveResolverInfo writes the resolver information in the JSON form, if r
+// requests it at [resolverInfoPath] without the DNS message and
+// [Config.ResolverInfo] is set.  served is false if r should be handled as a
+// DNS-over-HTTPS request.
+func (p *Proxy) serveResolverInfo(w http.ResponseWriter, r *http.Request) (served bool) {
+	if p.ResolverInfo == nil ||
+		r.Method != http.MethodGet ||
+		r.URL.Path != resolverInfoPath ||
+		r.URL.Query().Has("dns") {
+		return false
+	}
+
+	info := &resolverInfoJSON{
+		InfoURL:           p.ResolverInfo.InfoURL,
+		ExtendedErrors:    p.ResolverInfo.ExtendedErrors,
+		Transports:        p.transports(),
+		QNAMEMinimization: p.ResolverInfo.QNAMEMinimization,
+		Filtering:         p.ResolverInfo.Filtering,
+		DNSSECValidation:  p.ResolverInfo.DNSSECValidation,
+	}
+
+	w.Header().Set(httphdr.ContentType, "application/json")
+	err := json.NewEncoder(w).Encode(info)
+	if err != nil {
+		p.logger.Debug("writing resolver info", slogutil.KeyError, err)
+	}
+
+	return true
+}
+
+// transports returns the protocols the proxy is configured to listen on.
+func (p *Proxy) transports() (protos []Proto) {
+	for proto, enabled := range map[Proto]bool{
+		ProtoUDP:      len(p.UDPListenAddr) > 0,
+		ProtoTCP:      len(p.TCPListenAddr) > 0,
+		ProtoTLS:      len(p.TLSListenAddr) > 0,
+		ProtoHTTPS:    len(p.HTTPSListenAddr) > 0,
+		ProtoQUIC:     len(p.QUICListenAddr) > 0,
+		ProtoDNSCrypt: len(p.DNSCryptUDPListenAddr) > 0 || len(p.DNSCryptTCPListenAddr) > 0,
+	} {
+		if enabled {
+			protos = append(protos, proto)
+		}
+	}
+
+	slices.Sort(protos)
+
+	return protos
+}
@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"encoding/hex"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_handleResolverInfo(t *testing.T) {
+	p := mustNew(t, &Config{
+		Logger:         testLogger,
+		UDPListenAddr:  []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig: newTestUpstreamConfig(t, defaultTimeout, testDefaultUpstreamAddr),
+		TrustedProxies: defaultTrustedProxies,
+		ResolverInfo: &ResolverInfo{
+			InfoURL:           "https://resolver.example/info",
+			ExtendedErrors:    []uint16{15, 17},
+			QNAMEMinimization: true,
+		},
+	})
+
+	testCases := []struct {
+		name       string
+		qname      string
+		serverName string
+		qtype      uint16
+		wantAnswer bool
+	}{{
+		name:       "resolver_arpa",
+		qname:      "resolver.arpa.",
+		serverName: "",
+		qtype:      typeRESINFO,
+		wantAnswer: true,
+	}, {
+		name:       "server_name",
+		qname:      "DNS.Example.",
+		serverName: "dns.example",
+		qtype:      typeRESINFO,
+		wantAnswer: true,
+	}, {
+		name:       "other_name",
+		qname:      "example.org.",
+		serverName: "dns.example",
+		qtype:      typeRESINFO,
+		wantAnswer: false,
+	}, {
+		name:       "other_type",
+		qname:      "resolver.arpa.",
+		serverName: "",
+		qtype:      dns.TypeTXT,
+		wantAnswer: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := (&dns.Msg{}).SetQuestion(tc.qname, tc.qtype)
+			resp := p.handleResolverInfo(&DNSContext{
+				Req:        req,
+				ServerName: tc.serverName,
+			})
+			if !tc.wantAnswer {
+				assert.Nil(t, resp)
+
+				return
+			}
+
+			require.NotNil(t, resp)
+			require.Len(t, resp.Answer, 1)
+
+			// Make sure the record is packed properly.
+			packed, err := resp.Pack()
+			require.NoError(t, err)
+			require.NoError(t, resp.Unpack(packed))
+
+			rr := testutil.RequireTypeAssert[*dns.RFC3597](t, resp.Answer[0])
+			data, err := hex.DecodeString(rr.Rdata)
+			require.NoError(t, err)
+
+			want := "\x08qnamemin" + "\x0cexterr=15,17" + "\x25infourl=https://resolver.example/info"
+			assert.Equal(t, want, string(data))
+			assert.Equal(t, tc.qname, rr.Hdr.Name)
+		})
+	}
+}
+
+func TestProxy_serveResolverInfo(t *testing.T) {
+	p := mustNew(t, &Config{
+		Logger:          testLogger,
+		UDPListenAddr:   []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		TCPListenAddr:   []*net.TCPAddr{net.TCPAddrFromAddrPort(localhostAnyPort)},
+		HTTPSListenAddr: []*net.TCPAddr{net.TCPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig:  newTestUpstreamConfig(t, defaultTimeout, testDefaultUpstreamAddr),
+		TrustedProxies:  defaultTrustedProxies,
+		ResolverInfo: &ResolverInfo{
+			Filtering:        true,
+			DNSSECValidation: true,
+		},
+	})
+
+	t.Run("info", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, resolverInfoPath, nil)
+		require.True(t, p.serveResolverInfo(w, r))
+
+		assert.JSONEq(t, `{
+			"transports": ["https", "tcp", "udp"],
+			"qnamemin": false,
+			"filtering": true,
+			"dnssec_validation": true
+		}`, w.Body.String())
+	})
+
+	t.Run("dns_request", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, resolverInfoPath+"?dns=AAAB", nil)
+		assert.False(t, p.serveResolverInfo(w, r))
+	})
+}
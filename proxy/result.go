@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"net/netip"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ResolveResult is the information about resolving a request, see
+// [DNSContext.Result].
+type ResolveResult struct {
+	// ECS is the EDNS Client Subnet of the response with the scope prefix
+	// length, i.e. the subnet the response is valid for.  It's invalid if the
+	// response has no EDNS Client Subnet option, which is always the case for
+	// the responses served from the cache.
+	ECS netip.Prefix
+
+	// Upstream is the address of the upstream that has resolved the request,
+	// or the one the response has been cached with.  It's empty if the
+	// response hasn't been received from an upstream.
+	Upstream string
+
+	// RTT is the duration of the exchange with the upstream.  It's zero if the
+	// response hasn't been received from an upstream just now.
+	RTT time.Duration
+
+	// Rcode is the response code of the response.
+	Rcode int
+
+	// CacheHit is true if the response has been served from the cache.
+	CacheHit bool
+}
+
+// Result returns the information about resolving the request of dctx, for
+// example with [Proxy.Resolve], so that it doesn't need to be derived from the
+// response or the logs.  It returns nil if there is no response.
+func (dctx *DNSContext) Result() (res *ResolveResult) {
+	if dctx.Res == nil {
+		return nil
+	}
+
+	res = &ResolveResult{
+		Upstream: dctx.upstreamAddr(),
+		Rcode:    dctx.Res.Rcode,
+		ECS:      dctx.resECS,
+		CacheHit: dctx.cacheHit,
+	}
+
+	if !dctx.cacheHit {
+		res.RTT = dctx.QueryDuration
+	}
+
+	return res
+}
+
+// upstreamAddr returns the address of the upstream that has resolved the
+// request of dctx, or the one the response has been cached with.
+func (dctx *DNSContext) upstreamAddr() (addr string) {
+	if dctx.Upstream != nil {
+		return dctx.Upstream.Address()
+	}
+
+	return dctx.CachedUpstreamAddr
+}
+
+// ecsPrefixFromMsg returns the EDNS Client Subnet of m with the scope prefix
+// length, or an invalid prefix if m has none.
+func ecsPrefixFromMsg(m *dns.Msg) (pref netip.Prefix) {
+	subnet, scope := ecsFromMsg(m)
+	if subnet == nil {
+		return netip.Prefix{}
+	}
+
+	addr, ok := netip.AddrFromSlice(subnet.IP)
+	if !ok {
+		return netip.Prefix{}
+	}
+
+	return netip.PrefixFrom(addr.Unmap(), scope).Masked()
+}
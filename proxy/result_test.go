@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDNSContext_Result(t *testing.T) {
+	const upsAddr = "result.upstream"
+
+	ups := &fakeUpstream{
+		onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			resp = newCompareTestReply(req, "192.0.2.1", defaultTestTTL)
+			resp.SetEdns0(dns.DefaultMsgSize, false)
+			opt := resp.IsEdns0()
+			opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+				Code:          dns.EDNS0SUBNET,
+				Family:        1,
+				SourceNetmask: 24,
+				SourceScope:   16,
+				Address:       net.IP{198, 51, 100, 0},
+			})
+
+			return resp, nil
+		},
+		onAddress: func() (addr string) { return upsAddr },
+		onClose:   func() (err error) { return nil },
+	}
+
+	p := mustNew(t, &Config{
+		Logger:         testLogger,
+		UpstreamConfig: &UpstreamConfig{Upstreams: []upstream.Upstream{ups}},
+		CacheEnabled:   true,
+		CacheSizeBytes: defaultCacheSize,
+	})
+
+	d := &DNSContext{Req: newHostTestMessage("result.example")}
+	assert.Nil(t, d.Result())
+
+	require.NoError(t, p.Resolve(d))
+
+	res := d.Result()
+	require.NotNil(t, res)
+
+	assert.Equal(t, upsAddr, res.Upstream)
+	assert.Equal(t, dns.RcodeSuccess, res.Rcode)
+	assert.Equal(t, netip.MustParsePrefix("198.51.0.0/16"), res.ECS)
+	assert.False(t, res.CacheHit)
+
+	d = &DNSContext{Req: newHostTestMessage("result.example")}
+	require.NoError(t, p.Resolve(d))
+
+	res = d.Result()
+	require.NotNil(t, res)
+
+	assert.Equal(t, upsAddr, res.Upstream)
+	assert.True(t, res.CacheHit)
+	assert.Zero(t, res.RTT)
+}
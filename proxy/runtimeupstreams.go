@@ -0,0 +1,151 @@
+package proxy
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// errDuplicateUpstream is returned by [Proxy.AddUpstream] when there already
+// is a general upstream with the same address.
+const errDuplicateUpstream errors.Error = "duplicate upstream"
+
+// SetUpstreamConfig replaces [Config.UpstreamConfig] of the running proxy with
+// uc.  It waits for the requests being resolved to finish, while the new ones
+// wait for the replacement, and then closes the replaced configuration, unless
+// it's uc itself.  It returns an error if uc is invalid, in which case p is left
+// unchanged.  It's safe for concurrent use.
+func (p *Proxy) SetUpstreamConfig(uc *UpstreamConfig) (err error) {
+	err = uc.validate()
+	if err != nil {
+		return fmt.Errorf("validating general upstreams: %w", err)
+	}
+
+	p.reconfigureLock.Lock()
+	prev := p.UpstreamConfig
+	p.UpstreamConfig = uc
+	p.reconfigureLock.Unlock()
+
+	p.logger.Info("upstream config replaced")
+
+	if prev == nil || prev == uc {
+		return nil
+	}
+
+	err = prev.Close()
+	if err != nil {
+		return fmt.Errorf("closing replaced upstreams: %w", err)
+	}
+
+	return nil
+}
+
+// AddUpstream appends u to the general upstreams of the running proxy.  It
+// returns an error if there already is a general upstream with the same
+// address, in which case u isn't used and should be closed by the caller.  The
+// [Config.UpstreamConfig] given on creation isn't modified.  It's safe for
+// concurrent use.
+func (p *Proxy) AddUpstream(u upstream.Upstream) (err error) {
+	addr := u.Address()
+
+	p.reconfigureLock.Lock()
+	defer p.reconfigureLock.Unlock()
+
+	uc := p.UpstreamConfig
+	if slices.ContainsFunc(uc.Upstreams, func(c upstream.Upstream) (ok bool) {
+		return c.Address() == addr
+	}) {
+		return fmt.Errorf("%w: %q", errDuplicateUpstream, addr)
+	}
+
+	// Copy the configuration, since it may be shared with the caller.
+	next := *uc
+	next.Upstreams = append(slices.Clone(uc.Upstreams), u)
+	p.UpstreamConfig = &next
+
+	p.logger.Info("upstream added", "addr", addr)
+
+	return nil
+}
+
+// RemoveUpstream removes the general upstream with addr from the running proxy.
+// It waits for the requests being resolved to finish and then closes the
+// removed upstream, unless it's still used for some domains.  It returns an
+// error if there is no such upstream or if it's the last general one.  The
+// [Config.UpstreamConfig] given on creation isn't modified.  It's safe for
+// concurrent use.
+func (p *Proxy) RemoveUpstream(addr string) (err error) {
+	removed, inUse, err := p.removeUpstream(addr)
+	if err != nil {
+		return err
+	}
+
+	p.dropDisabled(addr)
+
+	p.logger.Info("upstream removed", "addr", addr)
+
+	if inUse {
+		return nil
+	}
+
+	err = removed.Close()
+	if err != nil {
+		return fmt.Errorf("closing removed upstream: %w", err)
+	}
+
+	return nil
+}
+
+// removeUpstream removes the general upstream with addr from the upstream
+// configuration of p and returns it.  inUse is true if it's still used for some
+// domains.
+func (p *Proxy) removeUpstream(addr string) (removed upstream.Upstream, inUse bool, err error) {
+	p.reconfigureLock.Lock()
+	defer p.reconfigureLock.Unlock()
+
+	uc := p.UpstreamConfig
+	i := slices.IndexFunc(uc.Upstreams, func(u upstream.Upstream) (ok bool) {
+		return u.Address() == addr
+	})
+	if i < 0 {
+		return nil, false, fmt.Errorf("%w: %q", errUnknownUpstream, addr)
+	}
+
+	removed = uc.Upstreams[i]
+
+	// Copy the configuration, since it may be shared with the caller.
+	next := *uc
+	next.Upstreams = slices.Delete(slices.Clone(uc.Upstreams), i, i+1)
+
+	err = next.validate()
+	if err != nil {
+		return nil, false, fmt.Errorf("removing %q: %w", addr, err)
+	}
+
+	p.UpstreamConfig = &next
+
+	return removed, next.uses(removed), nil
+}
+
+// dropDisabled removes addr from the set of the disabled upstreams, so that the
+// upstream added later with the same address is enabled.
+func (p *Proxy) dropDisabled(addr string) {
+	p.upstreamStateLock.Lock()
+	defer p.upstreamStateLock.Unlock()
+
+	cur := p.disabledUpstreams.Load()
+	if cur == nil {
+		return
+	}
+
+	if _, ok := (*cur)[addr]; !ok {
+		return
+	}
+
+	next := maps.Clone(*cur)
+	delete(next, addr)
+	p.disabledUpstreams.Store(&next)
+}
@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_runtimeUpstreams(t *testing.T) {
+	var firstClosed, secondClosed, thirdClosed atomic.Bool
+	first := newReconfigureTestUpstream("192.0.2.1", &firstClosed)
+	second := newReconfigureTestUpstream("192.0.2.2", &secondClosed)
+	third := newReconfigureTestUpstream("192.0.2.3", &thirdClosed)
+
+	initial := &UpstreamConfig{
+		Upstreams: []upstream.Upstream{first},
+	}
+
+	p := mustNew(t, &Config{
+		Logger:         testLogger,
+		UDPListenAddr:  []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig: initial,
+		TrustedProxies: defaultTrustedProxies,
+	})
+
+	resolve := func(t *testing.T) (ip net.IP) {
+		t.Helper()
+
+		d := &DNSContext{Req: newHostTestMessage("host")}
+		require.NoError(t, p.Resolve(d))
+		require.NotNil(t, d.Res)
+		require.NotEmpty(t, d.Res.Answer)
+
+		a := testutil.RequireTypeAssert[*dns.A](t, d.Res.Answer[0])
+
+		return a.A.To4()
+	}
+
+	require.NoError(t, p.AddUpstream(second))
+	assert.Len(t, p.UpstreamConfig.Upstreams, 2)
+	assert.Len(t, initial.Upstreams, 1)
+
+	err := p.AddUpstream(second)
+	assert.ErrorIs(t, err, errDuplicateUpstream)
+
+	require.NoError(t, p.RemoveUpstream(first.Address()))
+	assert.True(t, firstClosed.Load())
+	assert.Equal(t, net.IP{192, 0, 2, 2}, resolve(t))
+
+	err = p.RemoveUpstream(first.Address())
+	assert.ErrorIs(t, err, errUnknownUpstream)
+
+	err = p.RemoveUpstream(second.Address())
+	assert.Error(t, err)
+	assert.False(t, secondClosed.Load())
+
+	err = p.SetUpstreamConfig(&UpstreamConfig{})
+	assert.Error(t, err)
+
+	require.NoError(t, p.SetUpstreamConfig(&UpstreamConfig{
+		Upstreams: []upstream.Upstream{third},
+	}))
+	assert.True(t, secondClosed.Load())
+	assert.False(t, thirdClosed.Load())
+	assert.Equal(t, net.IP{192, 0, 2, 3}, resolve(t))
+}
@@ -3,11 +3,12 @@ package proxy
 import (
 	"context"
 	"fmt"
+	"log/slog"
 	"net"
 	"time"
 
-	"github.com/AdguardTeam/golibs/errors"
-	"github.com/AdguardTeam/golibs/log"
+	proxynetutil "github.com/AdguardTeam/dnsproxy/internal/netutil"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
 	"github.com/AdguardTeam/golibs/netutil"
 	"github.com/miekg/dns"
 	"github.com/quic-go/quic-go"
@@ -25,36 +26,42 @@ func (p *Proxy) startListeners(ctx context.Context) error {
 		return err
 	}
 
-	err = p.createTLSListeners()
+	err = p.createTLSListeners(ctx)
 	if err != nil {
 		return err
 	}
 
-	err = p.createHTTPSListeners()
+	err = p.createHTTPSListeners(ctx)
 	if err != nil {
 		return err
 	}
 
-	err = p.createQUICListeners()
+	err = p.createQUICListeners(ctx)
 	if err != nil {
 		return err
 	}
 
-	err = p.createDNSCryptListeners()
+	err = p.createDNSCryptListeners(ctx)
 	if err != nil {
 		return err
 	}
 
+	err = p.startXDP(ctx)
+	if err != nil {
+		return fmt.Errorf("starting xdp: %w", err)
+	}
+
+	drain := p.drain
 	for _, l := range p.udpListen {
-		go p.udpPacketLoop(l, p.requestsSema)
+		drain.goTracked(func() { p.udpPacketLoop(l, p.requestsSema, drain) })
 	}
 
 	for _, l := range p.tcpListen {
-		go p.tcpPacketLoop(l, ProtoTCP, p.requestsSema)
+		drain.goTracked(func() { p.tcpPacketLoop(l, ProtoTCP, p.requestsSema, drain) })
 	}
 
 	for _, l := range p.tlsListen {
-		go p.tcpPacketLoop(l, ProtoTLS, p.requestsSema)
+		drain.goTracked(func() { p.tcpPacketLoop(l, ProtoTLS, p.requestsSema, drain) })
 	}
 
 	for _, l := range p.httpsListen {
@@ -62,11 +69,11 @@ func (p *Proxy) startListeners(ctx context.Context) error {
 	}
 
 	for _, l := range p.h3Listen {
-		go func(l *quic.EarlyListener) { _ = p.h3Server.ServeListener(l) }(l)
+		go func(l *quic.EarlyListener) { _ = p.h3Server.ServeListener(p.limitH3Conns(l)) }(l)
 	}
 
 	for _, l := range p.quicListen {
-		go p.quicPacketLoop(l, p.requestsSema)
+		drain.goTracked(func() { p.quicPacketLoop(l, p.requestsSema, drain) })
 	}
 
 	for _, l := range p.dnsCryptUDPListen {
@@ -80,21 +87,122 @@ func (p *Proxy) startListeners(ctx context.Context) error {
 	return nil
 }
 
+// listenTCP returns the TCP listener bound to addr, see [Proxy.listenConfig]
+// for plain.  It enables TCP Fast Open and Multipath TCP if configured.
+func (p *Proxy) listenTCP(
+	ctx context.Context,
+	addr *net.TCPAddr,
+	plain bool,
+) (l *net.TCPListener, err error) {
+	lc := p.listenConfig(plain)
+	if p.TCPFastOpen {
+		proxynetutil.AddFastOpenControl(p.logger, lc)
+	}
+
+	lc.SetMultipathTCP(p.MultipathTCP)
+	lsnr, err := lc.Listen(ctx, "tcp", addr.String())
+	if err != nil {
+		return nil, err
+	}
+
+	l, ok := lsnr.(*net.TCPListener)
+	if !ok {
+		_ = lsnr.Close()
+
+		return nil, fmt.Errorf("wrong listener type on tcp addr %s: %T", addr, lsnr)
+	}
+
+	return l, nil
+}
+
+// listenUDP returns the UDP connection bound to addr, see [Proxy.listenConfig]
+// for plain.
+func (p *Proxy) listenUDP(
+	ctx context.Context,
+	addr *net.UDPAddr,
+	plain bool,
+) (c *net.UDPConn, err error) {
+	conn, err := p.listenConfig(plain).ListenPacket(ctx, "udp", addr.String())
+	if err != nil {
+		return nil, err
+	}
+
+	c, ok := conn.(*net.UDPConn)
+	if !ok {
+		_ = conn.Close()
+
+		return nil, fmt.Errorf("wrong connection type on udp addr %s: %T", addr, conn)
+	}
+
+	return c, nil
+}
+
+// listenConfig returns the [net.ListenConfig] with the socket options of the
+// listeners configured in p.  The plain DNS listeners, for which plain is true,
+// always share their addresses using SO_REUSEPORT, see
+// [proxynetutil.ListenConfig], while the other ones only do if
+// [Config.ReusePort] is true, so that the same address can be bound by the new
+// process during a binary upgrade.
+func (p *Proxy) listenConfig(plain bool) (lc *net.ListenConfig) {
+	lc = &net.ListenConfig{}
+	if plain || p.ReusePort {
+		lc = proxynetutil.ListenConfig(p.logger)
+	}
+
+	if p.ListenInterface != "" {
+		proxynetutil.AddControl(lc, proxynetutil.InterfaceControl(p.ListenInterface))
+	}
+
+	if p.ListenFreeBind {
+		proxynetutil.AddControl(lc, proxynetutil.FreeBindControl)
+	}
+
+	if p.TransparentProxy {
+		proxynetutil.AddControl(lc, proxynetutil.TransparentControl)
+	}
+
+	if p.ListenDSCP != 0 {
+		proxynetutil.AddControl(lc, proxynetutil.DSCPControl(p.ListenDSCP))
+	}
+
+	return lc
+}
+
 // handleDNSRequest processes the context.  The only error it returns is the one
-// from the [RequestHandler], or [Resolve] if the [RequestHandler] is not set.
+// from the middleware chain, which ends with the [RequestHandler], or [Resolve]
+// if the [RequestHandler] is not set.
 // d is left without a response as the documentation to [BeforeRequestHandler]
 // says, and if it's ratelimited.
 func (p *Proxy) handleDNSRequest(d *DNSContext) (err error) {
+	start := p.time.Now()
+	defer func() {
+		elapsed := p.time.Now().Sub(start)
+		p.metrics.OnRequest(d.Proto, d.Res, elapsed)
+		p.observeAnomalies(d)
+		p.logQuery(d, start, elapsed)
+	}()
+
+	p.assignTraceID(d)
+
+	span := p.startRequestSpan(d)
+	defer endRequestSpan(span, d)
+
 	p.logDNSMessage(d.Req)
+	p.messageTap.OnClientQuery(d, start)
 
 	if d.Req.Response {
-		log.Debug("dnsproxy: dropping incoming response packet from %s", d.Addr)
+		p.logger.Debug("dropping incoming response packet", "addr", p.anonymizer.addrPort(d.Addr))
 
 		return nil
 	}
 
 	ip := d.Addr.Addr()
 	d.IsPrivateClient = p.privateNets.Contains(ip)
+	d.ServerName = d.serverName()
+	d.profile = p.profileFor(d.ServerName, d.localAddr())
+	d.Geo = p.locate(d)
+	d.clientRoute = p.clientRouteFor(d)
+	p.udpTruncator.prepare(d)
 
 	if !p.handleBefore(d) {
 		return nil
@@ -104,24 +212,112 @@ func (p *Proxy) handleDNSRequest(d *DNSContext) (err error) {
 	//
 	// TODO(e.burkov):  Investigate if written above true and move to UDP server
 	// implementation?
-	if d.Proto == ProtoUDP && p.isRatelimited(ip) {
-		log.Debug("dnsproxy: ratelimiting %s based on IP only", d.Addr)
+	var limited, slip bool
+	if isRatelimitedProto(d.profile, d.Proto) {
+		limited, slip = p.checkRatelimit(d.profile, ip)
+
+		// The truncated responses only make sense over UDP.
+		slip = slip && d.Proto == ProtoUDP
+	}
+
+	if limited {
+		p.ratelimitLogger.Debug(
+			"ratelimiting based on ip only",
+			"addr", p.anonymizer.addrPort(d.Addr),
+			"slip", slip,
+		)
+		p.metrics.OnRatelimited(d.Proto)
+		p.eventListener().OnRatelimited(d)
+
+		if slip {
+			if p.writeStaticReply(d, p.static.truncated) {
+				return nil
+			}
+
+			d.Res = newMsgTruncated(d.Req)
+		} else {
+			if p.writeStaticReply(d, p.static.ratelimited) {
+				return nil
+			}
+
+			// Don't reply to ratelimited clients, unless the constructor says
+			// otherwise.
+			d.Res = p.messages.NewMsgRatelimited(d.Req)
+			if d.Res == nil {
+				return nil
+			}
+		}
+	}
 
-		// Don't reply to ratelimitted clients.
+	if d.Res == nil && d.Proto == ProtoUDP && p.isTruncateLimited(ip) {
+		p.ratelimitLogger.Debug("requiring tcp", "addr", p.anonymizer.addrPort(d.Addr))
+
+		if p.writeStaticReply(d, p.static.truncated) {
+			return nil
+		}
+
+		d.Res = newMsgTruncated(d.Req)
+	}
+
+	if d.Res == nil && p.injectListenerFault(d) {
 		return nil
 	}
 
-	d.Res = p.validateRequest(d)
 	if d.Res == nil {
-		if p.RequestHandler != nil {
-			err = errors.Annotate(p.RequestHandler(p, d), "using request handler: %w")
-		} else {
-			err = errors.Annotate(p.Resolve(d), "using default request handler: %w")
+		d.Res = p.checkAnomalous(d)
+	}
+
+	if d.Res == nil {
+		d.Res = p.checkTSIG(d)
+	}
+
+	if d.Res == nil {
+		d.Res = p.validateRequest(d)
+	}
+
+	if d.Res == nil {
+		d.Res = p.receiveErrorReport(d)
+	}
+
+	if d.Res == nil {
+		d.Res = p.handleResolverInfo(d)
+	}
+
+	if d.Res == nil && p.handleTransfer(d) {
+		return nil
+	}
+
+	if d.Res == nil {
+		d.Res = p.handleUpdate(d)
+	}
+
+	if d.Res == nil {
+		d.Res = p.handleNotify(d)
+	}
+
+	if d.Res == nil && p.replyFromCacheWire(d) {
+		return nil
+	}
+
+	if d.Res == nil {
+		var written bool
+		written, err = p.handleWithinLimit(d)
+		if written {
+			return nil
 		}
 	}
 
+	p.handleAfter(d)
+	if p.PrivacyMode {
+		d.removeClientEDE(d.Res)
+	}
+
+	p.addReportChannel(d)
 	p.logDNSMessage(d.Res)
 	p.respond(d)
+	if d.Res != nil {
+		p.messageTap.OnClientResponse(d, start, p.time.Now())
+	}
 
 	return err
 }
@@ -131,22 +327,30 @@ func (p *Proxy) handleDNSRequest(d *DNSContext) (err error) {
 func (p *Proxy) validateRequest(d *DNSContext) (resp *dns.Msg) {
 	switch {
 	case len(d.Req.Question) != 1:
-		log.Debug("dnsproxy: got invalid number of questions: %d", len(d.Req.Question))
+		p.logger.Debug("got invalid number of questions", "num", len(d.Req.Question))
 
 		// TODO(e.burkov):  Probably, FORMERR would be a better choice here.
 		// Check out RFC.
 		return p.messages.NewMsgSERVFAIL(d.Req)
+	case p.notReady.Load():
+		p.logger.Debug("upstreams are not verified yet")
+
+		return p.newMsgNotReady(d.Req)
 	case p.RefuseAny && d.Req.Question[0].Qtype == dns.TypeANY:
 		// Refuse requests of type ANY (anti-DDOS measure).
-		log.Debug("dnsproxy: refusing type=ANY request")
+		p.logger.Debug("refusing type=ANY request")
 
 		return p.messages.NewMsgNOTIMPLEMENTED(d.Req)
 	case p.recDetector.check(d.Req):
-		log.Debug("dnsproxy: recursion detected resolving %q", d.Req.Question[0].Name)
+		p.logger.Debug("recursion detected", "qname", d.Req.Question[0].Name)
 
 		return p.messages.NewMsgNXDOMAIN(d.Req)
-	case d.isForbiddenARPA(p.privateNets):
-		log.Debug("dnsproxy: %s requests a private arpa domain %q", d.Addr, d.Req.Question[0].Name)
+	case d.isForbiddenARPA(p.privateNets, p.logger):
+		p.logger.Debug(
+			"private arpa domain is requested",
+			"addr", p.anonymizer.addrPort(d.Addr),
+			"qname", d.Req.Question[0].Name,
+		)
 
 		return p.messages.NewMsgNXDOMAIN(d.Req)
 	default:
@@ -156,8 +360,12 @@ func (p *Proxy) validateRequest(d *DNSContext) (resp *dns.Msg) {
 
 // isForbiddenARPA returns true if dctx contains a PTR, SOA, or NS request for
 // some private address and client's address is not within the private network.
-// Otherwise, it sets [DNSContext.RequestedPrivateRDNS] for future use.
-func (dctx *DNSContext) isForbiddenARPA(privateNets netutil.SubnetSet) (ok bool) {
+// Otherwise, it sets [DNSContext.RequestedPrivateRDNS] for future use.  l is
+// used for logging.
+func (dctx *DNSContext) isForbiddenARPA(
+	privateNets netutil.SubnetSet,
+	l *slog.Logger,
+) (ok bool) {
 	q := dctx.Req.Question[0]
 	switch q.Qtype {
 	case dns.TypePTR, dns.TypeSOA, dns.TypeNS:
@@ -172,7 +380,7 @@ func (dctx *DNSContext) isForbiddenARPA(privateNets netutil.SubnetSet) (ok bool)
 
 	requestedPref, err := netutil.ExtractReversedAddr(q.Name)
 	if err != nil {
-		log.Debug("proxy: parsing reversed subnet: %v", err)
+		l.Debug("parsing reversed subnet", slogutil.KeyError, err)
 
 		return false
 	}
@@ -188,11 +396,16 @@ func (dctx *DNSContext) isForbiddenARPA(privateNets netutil.SubnetSet) (ok bool)
 
 // respond writes the specified response to the client (or does nothing if d.Res is empty)
 func (p *Proxy) respond(d *DNSContext) {
+	span := p.startChildSpan(d, spanRespond)
+	defer span.End()
+
 	// d.Conn can be nil in the case of a DoH request.
-	if d.Conn != nil {
-		_ = d.Conn.SetWriteDeadline(time.Now().Add(defaultTimeout))
+	if conn := d.respConn(); conn != nil {
+		_ = conn.SetWriteDeadline(time.Now().Add(defaultTimeout))
 	}
 
+	p.compress(d)
+
 	var err error
 
 	switch d.Proto {
@@ -213,7 +426,8 @@ func (p *Proxy) respond(d *DNSContext) {
 	}
 
 	if err != nil {
-		logWithNonCrit(err, fmt.Sprintf("responding %s request", d.Proto))
+		span.RecordError(err)
+		logWithNonCrit(p.logger, err, fmt.Sprintf("responding %s request", d.Proto))
 	}
 }
 
@@ -221,10 +435,15 @@ func (p *Proxy) respond(d *DNSContext) {
 func (p *Proxy) setMinMaxTTL(r *dns.Msg) {
 	for _, rr := range r.Answer {
 		originalTTL := rr.Header().Ttl
-		newTTL := respectTTLOverrides(originalTTL, p.CacheMinTTL, p.CacheMaxTTL)
+		minTTL, maxTTL := p.CacheMinTTL, p.CacheMaxTTL
+		if o, ok := p.CacheTTLOverrides[rr.Header().Rrtype]; ok {
+			minTTL, maxTTL = o.Min, o.Max
+		}
+
+		newTTL := respectTTLOverrides(originalTTL, minTTL, maxTTL)
 
 		if originalTTL != newTTL {
-			log.Debug("Override TTL from %d to %d", originalTTL, newTTL)
+			p.cacheLogger.Debug("overriding ttl", "original", originalTTL, "new", newTTL)
 			rr.Header().Ttl = newTTL
 		}
 	}
@@ -236,8 +455,8 @@ func (p *Proxy) logDNSMessage(m *dns.Msg) {
 	}
 
 	if m.Response {
-		log.Tracef("OUT: %s", m)
+		p.logger.Log(context.TODO(), levelTrace, "out", "msg", m)
 	} else {
-		log.Tracef("IN: %s", m)
+		p.logger.Log(context.TODO(), levelTrace, "in", "msg", m)
 	}
 }
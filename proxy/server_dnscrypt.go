@@ -3,17 +3,15 @@ package proxy
 import (
 	"context"
 	"fmt"
-	"net"
 
 	"github.com/AdguardTeam/golibs/errors"
-	"github.com/AdguardTeam/golibs/log"
 	"github.com/AdguardTeam/golibs/netutil"
 	"github.com/AdguardTeam/golibs/syncutil"
 	"github.com/ameshkov/dnscrypt/v2"
 	"github.com/miekg/dns"
 )
 
-func (p *Proxy) createDNSCryptListeners() (err error) {
+func (p *Proxy) createDNSCryptListeners(ctx context.Context) (err error) {
 	if len(p.DNSCryptUDPListenAddr) == 0 && len(p.DNSCryptTCPListenAddr) == 0 {
 		// Do nothing if DNSCrypt listen addresses are not specified.
 		return nil
@@ -23,37 +21,38 @@ func (p *Proxy) createDNSCryptListeners() (err error) {
 		return errors.Error("invalid DNSCrypt configuration: no certificate or provider name")
 	}
 
-	log.Info("Initializing DNSCrypt: %s", p.DNSCryptProviderName)
+	p.logger.Info("initializing dnscrypt", "provider", p.DNSCryptProviderName)
 	p.dnsCryptServer = &dnscrypt.Server{
 		ProviderName: p.DNSCryptProviderName,
 		ResolverCert: p.DNSCryptResolverCert,
 		Handler: &dnsCryptHandler{
 			proxy: p,
+			ctx:   p.drain.reqCtx,
 
 			reqSema: p.requestsSema,
 		},
 	}
 
 	for _, a := range p.DNSCryptUDPListenAddr {
-		log.Info("Creating a DNSCrypt UDP listener")
-		udpListen, lErr := net.ListenUDP("udp", a)
+		p.logger.Info("creating a dnscrypt udp listener", "addr", a)
+		udpListen, lErr := p.listenUDP(ctx, a, false)
 		if lErr != nil {
 			return fmt.Errorf("listening to dnscrypt udp socket: %w", lErr)
 		}
 
 		p.dnsCryptUDPListen = append(p.dnsCryptUDPListen, udpListen)
-		log.Info("Listening for DNSCrypt messages on udp://%s", udpListen.LocalAddr())
+		p.logger.Info("listening for dnscrypt messages on udp", "addr", udpListen.LocalAddr())
 	}
 
 	for _, a := range p.DNSCryptTCPListenAddr {
-		log.Info("Creating a DNSCrypt TCP listener")
-		tcpListen, lErr := net.ListenTCP("tcp", a)
+		p.logger.Info("creating a dnscrypt tcp listener", "addr", a)
+		tcpListen, lErr := p.listenTCP(ctx, a, false)
 		if lErr != nil {
 			return fmt.Errorf("listening to dnscrypt tcp socket: %w", lErr)
 		}
 
 		p.dnsCryptTCPListen = append(p.dnsCryptTCPListen, tcpListen)
-		log.Info("Listening for DNSCrypt messages on tcp://%s", tcpListen.Addr())
+		p.logger.Info("listening for dnscrypt messages on tcp", "addr", tcpListen.Addr())
 	}
 
 	return nil
@@ -63,6 +62,9 @@ func (p *Proxy) createDNSCryptListeners() (err error) {
 type dnsCryptHandler struct {
 	proxy *Proxy
 
+	// ctx is the context of the requests.
+	ctx context.Context
+
 	reqSema syncutil.Semaphore
 }
 
@@ -72,11 +74,13 @@ var _ dnscrypt.Handler = &dnsCryptHandler{}
 // ServeDNS - processes the DNS query
 func (h *dnsCryptHandler) ServeDNS(rw dnscrypt.ResponseWriter, req *dns.Msg) (err error) {
 	d := h.proxy.newDNSContext(ProtoDNSCrypt, req)
+	defer h.proxy.releaseDNSContext(d)
+
+	d.ctx = h.ctx
 	d.Addr = netutil.NetAddrToAddrPort(rw.RemoteAddr())
 	d.DNSCryptResponseWriter = rw
 
-	// TODO(d.kolyshev): Pass and use context from above.
-	err = h.reqSema.Acquire(context.Background())
+	err = h.reqSema.Acquire(h.ctx)
 	if err != nil {
 		return fmt.Errorf("dnsproxy: dnscrypt: acquiring semaphore: %w", err)
 	}
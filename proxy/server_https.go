@@ -1,10 +1,12 @@
 package proxy
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/base64"
 	"fmt"
 	"io"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/netip"
@@ -12,8 +14,7 @@ import (
 	"strings"
 
 	"github.com/AdguardTeam/golibs/httphdr"
-	"github.com/AdguardTeam/golibs/log"
-	"github.com/miekg/dns"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
 	"github.com/quic-go/quic-go"
 	"github.com/quic-go/quic-go/http3"
 	"golang.org/x/net/http2"
@@ -22,17 +23,18 @@ import (
 // listenHTTP creates instances of TLS listeners that will be used to run an
 // H1/H2 server.  Returns the address the listener actually listens to (useful
 // in the case if port 0 is specified).
-func (p *Proxy) listenHTTP(addr *net.TCPAddr) (laddr *net.TCPAddr, err error) {
-	tcpListen, err := net.ListenTCP("tcp", addr)
+func (p *Proxy) listenHTTP(
+	ctx context.Context,
+	addr *net.TCPAddr,
+) (laddr *net.TCPAddr, err error) {
+	tcpListen, err := p.listenTCP(ctx, addr, false)
 	if err != nil {
 		return nil, fmt.Errorf("tcp listener: %w", err)
 	}
-	log.Info("Listening to https://%s", tcpListen.Addr())
+	p.logger.Info("listening to https", "addr", tcpListen.Addr())
 
-	tlsConfig := p.TLSConfig.Clone()
-	tlsConfig.NextProtos = []string{http2.NextProtoTLS, "http/1.1"}
-
-	tlsListen := tls.NewListener(tcpListen, tlsConfig)
+	tlsConfig := p.serverTLSConfig([]string{http2.NextProtoTLS, "http/1.1"})
+	tlsListen := tls.NewListener(p.limitEncryptedConns(tcpListen), tlsConfig)
 	p.httpsListen = append(p.httpsListen, tlsListen)
 
 	return tcpListen.Addr().(*net.TCPAddr), nil
@@ -40,14 +42,23 @@ func (p *Proxy) listenHTTP(addr *net.TCPAddr) (laddr *net.TCPAddr, err error) {
 
 // listenH3 creates instances of QUIC listeners that will be used for running
 // an HTTP/3 server.
-func (p *Proxy) listenH3(addr *net.UDPAddr) (err error) {
-	tlsConfig := p.TLSConfig.Clone()
-	tlsConfig.NextProtos = []string{"h3"}
-	quicListen, err := quic.ListenAddrEarly(addr.String(), tlsConfig, newServerQUICConfig())
+func (p *Proxy) listenH3(ctx context.Context, addr *net.UDPAddr) (err error) {
+	conn, err := p.listenUDP(ctx, addr, false)
+	if err != nil {
+		return fmt.Errorf("udp listener: %w", err)
+	}
+
+	p.quicConns = append(p.quicConns, conn)
+
+	transport := p.newQUICTransport(conn, false)
+	p.quicTransports = append(p.quicTransports, transport)
+
+	tlsConfig := p.serverTLSConfig([]string{"h3"})
+	quicListen, err := transport.ListenEarly(tlsConfig, p.serverQUICConfig())
 	if err != nil {
 		return fmt.Errorf("quic listener: %w", err)
 	}
-	log.Info("Listening to h3://%s", quicListen.Addr())
+	p.logger.Info("listening to h3", "addr", quicListen.Addr())
 
 	p.h3Listen = append(p.h3Listen, quicListen)
 
@@ -55,23 +66,31 @@ func (p *Proxy) listenH3(addr *net.UDPAddr) (err error) {
 }
 
 // createHTTPSListeners creates TCP/UDP listeners and HTTP/H3 servers.
-func (p *Proxy) createHTTPSListeners() (err error) {
+func (p *Proxy) createHTTPSListeners(ctx context.Context) (err error) {
+	// Make the contexts of the requests canceled when they're aborted on
+	// shutdown.
+	drain := p.drain
 	p.httpsServer = &http.Server{
 		Handler:           p,
 		ReadHeaderTimeout: defaultTimeout,
 		WriteTimeout:      defaultTimeout,
+		ConnState:         p.trackHTTPSConn,
+		BaseContext:       func(_ net.Listener) (ctx context.Context) { return drain.reqCtx },
 	}
 
 	if p.HTTP3 {
 		p.h3Server = &http3.Server{
 			Handler: p,
+			ConnContext: func(ctx context.Context, _ quic.Connection) (connCtx context.Context) {
+				return drain.withAbort(ctx)
+			},
 		}
 	}
 
 	for _, addr := range p.HTTPSListenAddr {
-		log.Info("Creating an HTTPS server")
+		p.logger.Info("creating an https server")
 
-		tcpAddr, lErr := p.listenHTTP(addr)
+		tcpAddr, lErr := p.listenHTTP(ctx, addr)
 		if lErr != nil {
 			return fmt.Errorf("failed to start HTTPS server on %s: %w", addr, lErr)
 		}
@@ -80,7 +99,7 @@ func (p *Proxy) createHTTPSListeners() (err error) {
 			// HTTP/3 server listens to the same pair IP:port as the one HTTP/2
 			// server listens to.
 			udpAddr := &net.UDPAddr{IP: tcpAddr.IP, Port: tcpAddr.Port}
-			err = p.listenH3(udpAddr)
+			err = p.listenH3(ctx, udpAddr)
 			if err != nil {
 				return fmt.Errorf("failed to start HTTP/3 server on %s: %w", udpAddr, err)
 			}
@@ -90,6 +109,19 @@ func (p *Proxy) createHTTPSListeners() (err error) {
 	return nil
 }
 
+// trackHTTPSConn reports the opened and closed HTTPS connections to the
+// metrics listener.  It's used as [http.Server.ConnState].
+func (p *Proxy) trackHTTPSConn(_ net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		p.metrics.OnConnectionOpened(ProtoHTTPS)
+	case http.StateClosed, http.StateHijacked:
+		p.metrics.OnConnectionClosed(ProtoHTTPS)
+	default:
+		// Don't track the intermediate states.
+	}
+}
+
 // ServeHTTP is the http.Handler implementation that handles DoH queries.
 // Here is what it returns:
 //
@@ -98,17 +130,25 @@ func (p *Proxy) createHTTPSListeners() (err error) {
 //     "application/dns-message";
 //   - http.StatusMethodNotAllowed if request method is not GET or POST.
 func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	log.Debug("dnsproxy: incoming https request on %s", r.URL)
+	p.logger.Debug("incoming https request", "url", r.URL)
 
-	raddr, prx, err := remoteAddr(r)
+	p.advertiseH3(w, r)
+
+	raddr, prx, err := remoteAddr(r, p.logger)
 	if err != nil {
-		log.Debug("dnsproxy: warning: getting real ip: %s", err)
+		p.logger.Debug("getting real ip", slogutil.KeyError, err)
+	} else if prx.IsValid() {
+		p.logger.Debug("using ip address from http request", "ip", p.anonymizer.addr(raddr.Addr()))
 	}
 
 	if !p.checkBasicAuth(w, r, raddr) {
 		return
 	}
 
+	if p.serveResolverInfo(w, r) {
+		return
+	}
+
 	var buf []byte
 
 	switch r.Method {
@@ -116,7 +156,11 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		dnsParam := r.URL.Query().Get("dns")
 		buf, err = base64.RawURLEncoding.DecodeString(dnsParam)
 		if len(buf) == 0 || err != nil {
-			log.Debug("dnsproxy: parsing dns request from get param %q: %v", dnsParam, err)
+			p.logger.Debug(
+				"parsing dns request from get param",
+				"param", dnsParam,
+				slogutil.KeyError, err,
+			)
 			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 
 			return
@@ -124,7 +168,7 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	case http.MethodPost:
 		contentType := r.Header.Get("Content-Type")
 		if contentType != "application/dns-message" {
-			log.Debug("dnsproxy: unsupported media type %q", contentType)
+			p.logger.Debug("unsupported media type", "type", contentType)
 			http.Error(w, http.StatusText(http.StatusUnsupportedMediaType), http.StatusUnsupportedMediaType)
 
 			return
@@ -132,46 +176,76 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 		buf, err = io.ReadAll(r.Body)
 		if err != nil {
-			log.Debug("dnsproxy: reading http request body: %s", err)
+			p.logger.Debug("reading http request body", slogutil.KeyError, err)
 			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 
 			return
 		}
 
-		defer log.OnCloserError(r.Body, log.DEBUG)
+		defer slogutil.CloseAndLog(r.Context(), p.logger, r.Body, slog.LevelDebug)
 	default:
-		log.Debug("dnsproxy: bad http method %q", r.Method)
+		p.logger.Debug("bad http method", "method", r.Method)
 		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
 
 		return
 	}
 
-	req := &dns.Msg{}
-	if err = req.Unpack(buf); err != nil {
-		log.Debug("dnsproxy: unpacking http msg: %s", err)
+	req, ts, err := p.unpackRequest(buf)
+	if err != nil {
+		p.logger.Debug("unpacking http msg", slogutil.KeyError, err)
 		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 
 		return
 	}
 
 	d := p.newDNSContext(ProtoHTTPS, req)
+	d.ctx = r.Context()
+	d.tsig = ts
 	d.Addr = raddr
 	d.HTTPRequest = r
 	d.HTTPResponseWriter = w
+	d.HTTPPath = r.URL.Path
+	d.HTTPUser, _, _ = r.BasicAuth()
 
 	if prx.IsValid() {
-		log.Debug("dnsproxy: request came from proxy server %s", prx)
+		p.logger.Debug("request came from proxy server", "proxy", prx)
 
 		if !p.TrustedProxies.Contains(prx.Addr()) {
-			log.Debug("dnsproxy: proxy %s is not trusted, using original remote addr", prx)
+			p.logger.Debug("proxy is not trusted, using original remote addr", "proxy", prx)
 			d.Addr = prx
 		}
 	}
 
 	err = p.handleDNSRequest(d)
 	if err != nil {
-		log.Debug("dnsproxy: handling dns (%s) request: %s", d.Proto, err)
+		p.logger.Debug("handling dns request", "proto", d.Proto, slogutil.KeyError, err)
 	}
+
+	p.releaseDNSContext(d)
+}
+
+// advertiseH3 sets the Alt-Svc header advertising the HTTP/3 server listening
+// on the same port as the one r has been received on, so that the capable
+// clients switch to it.  It does nothing if HTTP/3 is disabled or r has been
+// received over HTTP/3.
+func (p *Proxy) advertiseH3(w http.ResponseWriter, r *http.Request) {
+	if !p.HTTP3 || r.ProtoMajor >= 3 {
+		return
+	}
+
+	laddr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if !ok {
+		return
+	}
+
+	_, port, err := net.SplitHostPort(laddr.String())
+	if err != nil {
+		p.logger.Debug("getting local port", slogutil.KeyError, err)
+
+		return
+	}
+
+	w.Header().Set(httphdr.AltSvc, fmt.Sprintf(`h3=":%s"`, port))
 }
 
 // checkBasicAuth checks the basic authorization data, if necessary, and if the
@@ -192,7 +266,7 @@ func (p *Proxy) checkBasicAuth(
 		return true
 	}
 
-	log.Error("dnsproxy: basic auth failed for user %q from raddr %s", user, raddr)
+	p.logger.Error("basic auth failed", "user", user, "raddr", p.anonymizer.addrPort(raddr))
 
 	h := w.Header()
 	h.Set(httphdr.WWWAuthenticate, `Basic realm="DNS", charset="UTF-8"`)
@@ -221,7 +295,7 @@ func (p *Proxy) respondHTTPS(d *DNSContext) (err error) {
 		return nil
 	}
 
-	bytes, err := resp.Pack()
+	bytes, err := packResponse(d, resp, nil)
 	if err != nil {
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 
@@ -268,8 +342,8 @@ func realIPFromHdrs(r *http.Request) (realIP netip.Addr, err error) {
 }
 
 // remoteAddr returns the real client's address and the IP address of the latest
-// proxy server if any.
-func remoteAddr(r *http.Request) (addr, prx netip.AddrPort, err error) {
+// proxy server if any.  l is used for logging.
+func remoteAddr(r *http.Request, l *slog.Logger) (addr, prx netip.AddrPort, err error) {
 	host, err := netip.ParseAddrPort(r.RemoteAddr)
 	if err != nil {
 		return netip.AddrPort{}, netip.AddrPort{}, err
@@ -277,13 +351,11 @@ func remoteAddr(r *http.Request) (addr, prx netip.AddrPort, err error) {
 
 	realIP, err := realIPFromHdrs(r)
 	if err != nil {
-		log.Debug("dnsproxy: getting ip address from http request: %s", err)
+		l.Debug("getting ip address from http request", slogutil.KeyError, err)
 
 		return host, netip.AddrPort{}, nil
 	}
 
-	log.Debug("dnsproxy: using ip address from http request: %s", realIP)
-
 	// TODO(a.garipov): Add port if we can get it from headers like X-Real-Port,
 	// X-Forwarded-Port, etc.
 	addr = netip.AddrPortFrom(realIP, 0)
@@ -9,11 +9,14 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/netip"
 	"net/url"
 	"strings"
 	"testing"
 
+	"github.com/AdguardTeam/golibs/httphdr"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
 	"github.com/AdguardTeam/golibs/testutil"
 	"github.com/miekg/dns"
 	"github.com/quic-go/quic-go"
@@ -342,7 +345,7 @@ func TestRemoteAddr(t *testing.T) {
 
 		t.Run(tc.name, func(t *testing.T) {
 			var addr, prx netip.AddrPort
-			addr, prx, err = remoteAddr(r)
+			addr, prx, err = remoteAddr(r, slogutil.NewDiscardLogger())
 			if tc.wantErr != "" {
 				testutil.AssertErrorMsg(t, tc.wantErr, err)
 
@@ -464,3 +467,49 @@ func createTestHTTPClient(dnsProxy *Proxy, caPem []byte, http3Enabled bool) (cli
 		Timeout:   defaultTimeout,
 	}
 }
+
+func TestProxy_advertiseH3(t *testing.T) {
+	laddr := &net.TCPAddr{IP: net.IP{127, 0, 0, 1}, Port: 8443}
+
+	testCases := []struct {
+		name       string
+		want       string
+		protoMajor int
+		http3      bool
+	}{{
+		name:       "h2",
+		want:       `h3=":8443"`,
+		protoMajor: 2,
+		http3:      true,
+	}, {
+		name:       "h3",
+		want:       "",
+		protoMajor: 3,
+		http3:      true,
+	}, {
+		name:       "disabled",
+		want:       "",
+		protoMajor: 2,
+		http3:      false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := &Proxy{
+				Config: Config{
+					HTTP3: tc.http3,
+				},
+				logger: testLogger,
+			}
+
+			ctx := context.WithValue(context.Background(), http.LocalAddrContextKey, laddr)
+			r := httptest.NewRequest(http.MethodGet, "/dns-query", nil).WithContext(ctx)
+			r.ProtoMajor = tc.protoMajor
+
+			w := httptest.NewRecorder()
+			p.advertiseH3(w, r)
+
+			assert.Equal(t, tc.want, w.Header().Get(httphdr.AltSvc))
+		})
+	}
+}
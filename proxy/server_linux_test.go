@@ -0,0 +1,285 @@
+//go:build linux
+
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"syscall"
+	"testing"
+	"time"
+
+	proxynetutil "github.com/AdguardTeam/dnsproxy/internal/netutil"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestProxy_listenInterface(t *testing.T) {
+	newConf := func(iface string) (conf *Config) {
+		u := newProfileTestUpstream("192.0.2.1")
+
+		return &Config{
+			Logger:          testLogger,
+			UDPListenAddr:   []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+			TCPListenAddr:   []*net.TCPAddr{net.TCPAddrFromAddrPort(localhostAnyPort)},
+			UpstreamConfig:  &UpstreamConfig{Upstreams: []upstream.Upstream{u}},
+			TrustedProxies:  defaultTrustedProxies,
+			ListenInterface: iface,
+		}
+	}
+
+	ctx := context.Background()
+
+	t.Run("loopback", func(t *testing.T) {
+		p := mustNew(t, newConf("lo"))
+		require.NoError(t, p.Start(ctx))
+		testutil.CleanupAndRequireSuccess(t, func() (err error) { return p.Shutdown(ctx) })
+
+		for _, proto := range []Proto{ProtoUDP, ProtoTCP} {
+			c := &dns.Client{Net: string(proto), Timeout: defaultTimeout}
+			resp, _, err := c.Exchange(newHostTestMessage("example.org"), p.Addr(proto).String())
+			require.NoError(t, err)
+
+			assert.Len(t, resp.Answer, 1)
+		}
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		p := mustNew(t, newConf("dnsproxy-missing0"))
+		err := p.Start(ctx)
+		testutil.CleanupAndRequireSuccess(t, func() (err error) { return p.Shutdown(ctx) })
+
+		assert.ErrorContains(t, err, "SO_BINDTODEVICE")
+	})
+}
+
+func TestProxy_listenFreeBind(t *testing.T) {
+	// Use the address from TEST-NET-1, which is surely not assigned.
+	addr := netip.MustParseAddrPort("192.0.2.53:0")
+
+	newConf := func(freeBind bool) (conf *Config) {
+		u := newProfileTestUpstream("192.0.2.1")
+
+		return &Config{
+			Logger:         testLogger,
+			UDPListenAddr:  []*net.UDPAddr{net.UDPAddrFromAddrPort(addr)},
+			TCPListenAddr:  []*net.TCPAddr{net.TCPAddrFromAddrPort(addr)},
+			UpstreamConfig: &UpstreamConfig{Upstreams: []upstream.Upstream{u}},
+			TrustedProxies: defaultTrustedProxies,
+			ListenFreeBind: freeBind,
+		}
+	}
+
+	ctx := context.Background()
+
+	t.Run("enabled", func(t *testing.T) {
+		p := mustNew(t, newConf(true))
+		require.NoError(t, p.Start(ctx))
+		testutil.CleanupAndRequireSuccess(t, func() (err error) { return p.Shutdown(ctx) })
+
+		assert.Equal(t, addr.Addr(), netutil.NetAddrToAddrPort(p.Addr(ProtoUDP)).Addr())
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		p := mustNew(t, newConf(false))
+		err := p.Start(ctx)
+		testutil.CleanupAndRequireSuccess(t, func() (err error) { return p.Shutdown(ctx) })
+
+		assert.ErrorIs(t, err, syscall.EADDRNOTAVAIL)
+	})
+}
+
+func TestProxy_listenDSCP(t *testing.T) {
+	const dscp = 46
+
+	u := newProfileTestUpstream("192.0.2.1")
+	p := mustNew(t, &Config{
+		Logger:         testLogger,
+		UDPListenAddr:  []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		TCPListenAddr:  []*net.TCPAddr{net.TCPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig: &UpstreamConfig{Upstreams: []upstream.Upstream{u}},
+		TrustedProxies: defaultTrustedProxies,
+		ListenDSCP:     dscp,
+	})
+
+	ctx := context.Background()
+	require.NoError(t, p.Start(ctx))
+	testutil.CleanupAndRequireSuccess(t, func() (err error) { return p.Shutdown(ctx) })
+
+	tcpListener := testutil.RequireTypeAssert[*net.TCPListener](t, p.tcpListen[0])
+	conns := []syscall.Conn{p.udpListen[0], tcpListener}
+	for _, c := range conns {
+		raw, err := c.SyscallConn()
+		require.NoError(t, err)
+
+		var tos int
+		var opErr error
+		err = raw.Control(func(fd uintptr) {
+			tos, opErr = unix.GetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_TOS)
+		})
+		require.NoError(t, err)
+		require.NoError(t, opErr)
+
+		assert.Equal(t, dscp<<2, tos)
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := New(&Config{
+			UDPListenAddr:  []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+			UpstreamConfig: &UpstreamConfig{Upstreams: []upstream.Upstream{u}},
+			ListenDSCP:     64,
+		})
+		testutil.AssertErrorMsg(t, "listen dscp: value 64 is greater than 63", err)
+	})
+}
+
+func TestProxy_transparent(t *testing.T) {
+	origDsts := make(chan netip.AddrPort, 2)
+
+	u := newProfileTestUpstream("192.0.2.1")
+	p := mustNew(t, &Config{
+		Logger:           testLogger,
+		UDPListenAddr:    []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		TCPListenAddr:    []*net.TCPAddr{net.TCPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig:   &UpstreamConfig{Upstreams: []upstream.Upstream{u}},
+		TrustedProxies:   defaultTrustedProxies,
+		TransparentProxy: true,
+		RequestHandler: func(p *Proxy, d *DNSContext) (err error) {
+			origDsts <- d.OrigDst
+
+			return p.Resolve(d)
+		},
+	})
+
+	ctx := context.Background()
+	err := p.Start(ctx)
+	if errors.Is(err, unix.EPERM) {
+		t.Skip("transparent mode requires CAP_NET_ADMIN")
+	}
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, func() (err error) { return p.Shutdown(ctx) })
+
+	// The queries which aren't intercepted have the listen addresses as the
+	// original destinations.
+	for _, proto := range []Proto{ProtoUDP, ProtoTCP} {
+		addr := p.Addr(proto)
+
+		c := &dns.Client{Net: string(proto), Timeout: defaultTimeout}
+		resp, _, exchErr := c.Exchange(newHostTestMessage("example.org"), addr.String())
+		require.NoError(t, exchErr)
+		require.Len(t, resp.Answer, 1)
+
+		got, _ := testutil.RequireReceive(t, origDsts, defaultTimeout)
+		assert.Equal(t, netutil.NetAddrToAddrPort(addr), got)
+	}
+
+	t.Run("write_from", func(t *testing.T) {
+		client, lErr := net.ListenUDP("udp", net.UDPAddrFromAddrPort(localhostAnyPort))
+		require.NoError(t, lErr)
+		testutil.CleanupAndRequireSuccess(t, client.Close)
+
+		// Use the port the listener isn't bound to.
+		origDst := freeUDPAddr(t)
+
+		d := &DNSContext{
+			Proto:   ProtoUDP,
+			Conn:    p.udpListen[0],
+			Addr:    netutil.NetAddrToAddrPort(client.LocalAddr()),
+			OrigDst: origDst,
+		}
+		require.NoError(t, p.writeUDP(d, []byte("test")))
+
+		require.NoError(t, client.SetReadDeadline(time.Now().Add(defaultTimeout)))
+
+		buf := make([]byte, 16)
+		n, from, rErr := client.ReadFromUDPAddrPort(buf)
+		require.NoError(t, rErr)
+
+		assert.Equal(t, "test", string(buf[:n]))
+		assert.Equal(t, origDst, from)
+	})
+}
+
+func TestProxy_udpSocketFilter(t *testing.T) {
+	u := newProfileTestUpstream("192.0.2.1")
+	p := mustNew(t, &Config{
+		Logger:          testLogger,
+		UDPListenAddr:   []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig:  &UpstreamConfig{Upstreams: []upstream.Upstream{u}},
+		TrustedProxies:  defaultTrustedProxies,
+		UDPSocketFilter: true,
+	})
+
+	ctx := context.Background()
+	require.NoError(t, p.Start(ctx))
+	testutil.CleanupAndRequireSuccess(t, func() (err error) { return p.Shutdown(ctx) })
+
+	c := &dns.Client{Net: string(ProtoUDP), Timeout: defaultTimeout}
+	resp, _, err := c.Exchange(newHostTestMessage("example.org"), p.Addr(ProtoUDP).String())
+	require.NoError(t, err)
+	require.Len(t, resp.Answer, 1)
+
+	t.Run("junk", func(t *testing.T) {
+		srv, lErr := net.ListenUDP("udp", net.UDPAddrFromAddrPort(localhostAnyPort))
+		require.NoError(t, lErr)
+		testutil.CleanupAndRequireSuccess(t, srv.Close)
+
+		require.NoError(t, proxynetutil.AttachDNSFilter(srv))
+
+		client, dErr := net.DialUDP("udp", nil, srv.LocalAddr().(*net.UDPAddr))
+		require.NoError(t, dErr)
+		testutil.CleanupAndRequireSuccess(t, client.Close)
+
+		response := newHostTestMessage("example.org")
+		response.Response = true
+
+		twoQuestions := newHostTestMessage("example.org")
+		twoQuestions.Question = append(twoQuestions.Question, twoQuestions.Question[0])
+
+		// The header claiming too many additional records.
+		tooManyRRs := []byte{0, 1, 0, 0, 0, 1, 0, 0, 0, 0, 0, 100, 0, 0, 1, 0, 1}
+
+		valid := newHostTestMessage("example.org")
+
+		packets := [][]byte{
+			[]byte("junk"),
+			mustPack(t, response),
+			mustPack(t, twoQuestions),
+			tooManyRRs,
+			mustPack(t, valid),
+		}
+		for _, pkt := range packets {
+			_, err = client.Write(pkt)
+			require.NoError(t, err)
+		}
+
+		require.NoError(t, srv.SetReadDeadline(time.Now().Add(defaultTimeout)))
+
+		buf := make([]byte, dns.MaxMsgSize)
+		n, err := srv.Read(buf)
+		require.NoError(t, err)
+
+		got := &dns.Msg{}
+		require.NoError(t, got.Unpack(buf[:n]))
+		assert.Equal(t, valid.Id, got.Id)
+		assert.False(t, got.Response)
+		assert.Len(t, got.Question, 1)
+	})
+}
+
+// mustPack returns the wire form of msg.
+func mustPack(t *testing.T, msg *dns.Msg) (b []byte) {
+	t.Helper()
+
+	b, err := msg.Pack()
+	require.NoError(t, err)
+
+	return b
+}
@@ -5,14 +5,17 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"log/slog"
 	"math"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/AdguardTeam/dnsproxy/internal/bootstrap"
+	proxynetutil "github.com/AdguardTeam/dnsproxy/internal/netutil"
 	"github.com/AdguardTeam/dnsproxy/proxyutil"
 	"github.com/AdguardTeam/golibs/errors"
-	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
 	"github.com/AdguardTeam/golibs/netutil"
 	"github.com/AdguardTeam/golibs/syncutil"
 	"github.com/bluele/gcache"
@@ -48,6 +51,11 @@ const quicAddrValidatorCacheSize = 1000
 // TODO(ameshkov): make it configurable.
 const quicAddrValidatorCacheTTL = 30 * time.Minute
 
+// quicCloseDelay is the time since the last response after which a QUIC
+// connection is closed on shutdown.  Closing it immediately drops the responses
+// which aren't sent yet.
+const quicCloseDelay = 1 * time.Second
+
 const (
 	// DoQCodeNoError is used when the connection or stream needs to be closed,
 	// but there is no error to signal.
@@ -59,32 +67,36 @@ const (
 	// DoQCodeProtocolError signals that the DoQ implementation encountered
 	// a protocol error and is forcibly aborting the connection.
 	DoQCodeProtocolError quic.ApplicationErrorCode = 2
+	// DoQCodeExcessiveLoad signals that the DoQ implementation is closing the
+	// connection because of the excessive load.
+	DoQCodeExcessiveLoad quic.ApplicationErrorCode = 4
 )
 
 // createQUICListeners creates QUIC listeners for the DoQ server.
-func (p *Proxy) createQUICListeners() error {
+func (p *Proxy) createQUICListeners(ctx context.Context) error {
 	for _, a := range p.QUICListenAddr {
-		log.Info("creating listener quic://%s", a)
+		p.logger.Info("creating quic listener", "addr", a)
 
-		conn, err := net.ListenUDP(bootstrap.NetworkUDP, a)
+		conn, err := p.listenUDP(ctx, a, false)
 		if err != nil {
 			return fmt.Errorf("listening to %s: %w", a, err)
 		}
 
 		p.quicConns = append(p.quicConns, conn)
 
-		v := newQUICAddrValidator(quicAddrValidatorCacheSize, quicAddrValidatorCacheTTL)
-		transport := &quic.Transport{
-			Conn:                conn,
-			VerifySourceAddress: v.requiresValidation,
-		}
-
-		tlsConfig := p.TLSConfig.Clone()
-		tlsConfig.NextProtos = compatProtoDQ
-		quicListen, err := transport.ListenEarly(
-			tlsConfig,
-			newServerQUICConfig(),
+		// Pass the connection itself, so that the QUIC implementation uses the
+		// UDP segmentation offload where supported.  The receive offload isn't
+		// enabled, since the QUIC implementation doesn't support it.
+		p.logger.Debug(
+			"quic listener",
+			"addr", conn.LocalAddr(),
+			"segmentation_offload", proxynetutil.UDPSegmentationSupported(conn),
 		)
+
+		transport := p.newQUICTransport(conn, true)
+
+		tlsConfig := p.serverTLSConfig(compatProtoDQ)
+		quicListen, err := transport.ListenEarly(tlsConfig, p.serverQUICConfig())
 		if err != nil {
 			return fmt.Errorf("quic listener: %w", err)
 		}
@@ -92,7 +104,7 @@ func (p *Proxy) createQUICListeners() error {
 		p.quicTransports = append(p.quicTransports, transport)
 		p.quicListen = append(p.quicListen, quicListen)
 
-		log.Info("listening quic://%s", quicListen.Addr())
+		p.logger.Info("listening to quic", "addr", quicListen.Addr())
 	}
 	return nil
 }
@@ -100,88 +112,145 @@ func (p *Proxy) createQUICListeners() error {
 // quicPacketLoop listens for incoming QUIC packets.
 //
 // See also the comment on Proxy.requestsSema.
-func (p *Proxy) quicPacketLoop(l *quic.EarlyListener, reqSema syncutil.Semaphore) {
-	log.Info("Entering the DNS-over-QUIC listener loop on %s", l.Addr())
+func (p *Proxy) quicPacketLoop(l *quic.EarlyListener, reqSema syncutil.Semaphore, drain *drainer) {
+	p.logger.Info("entering dns-over-quic listener loop", "addr", l.Addr())
 	for {
 		ctx := context.Background()
 		conn, err := l.Accept(ctx)
 		if err != nil {
 			if isQUICErrorForDebugLog(err) {
-				log.Debug("accepting quic conn: closed or timed out: %s", err)
+				p.logger.Debug("accepting quic conn: closed or timed out", slogutil.KeyError, err)
 			} else {
-				log.Error("accepting quic conn: %s", err)
+				p.logger.Error("accepting quic conn", slogutil.KeyError, err)
 			}
 
 			break
 		}
 
+		if !p.acquireQUICConn(conn, DoQCodeExcessiveLoad) {
+			continue
+		}
+
 		err = reqSema.Acquire(ctx)
 		if err != nil {
-			log.Error("dnsproxy: quic: acquiring semaphore: %s", err)
+			p.logger.Error("quic: acquiring semaphore", slogutil.KeyError, err)
 
 			break
 		}
-		go func() {
+		drain.goTracked(func() {
 			defer reqSema.Release()
 
-			p.handleQUICConnection(conn, reqSema)
-		}()
+			p.handleQUICConnection(conn, reqSema, drain)
+		})
 	}
 }
 
 // handleQUICConnection handles a new QUIC connection.  It waits for new streams
-// and passes them to handleQUICStream.
+// and passes them to handleQUICStream.  When the shutdown starts, it stops
+// accepting streams, waits for the ones being handled, and closes the
+// connection without an error.
 //
 // See also the comment on Proxy.requestsSema.
-func (p *Proxy) handleQUICConnection(conn quic.Connection, reqSema syncutil.Semaphore) {
+func (p *Proxy) handleQUICConnection(
+	conn quic.Connection,
+	reqSema syncutil.Semaphore,
+	drain *drainer,
+) {
+	p.metrics.OnConnectionOpened(ProtoQUIC)
+	defer p.metrics.OnConnectionClosed(ProtoQUIC)
+
+	// The requests are abandoned once the connection is closed.
+	ctx := drain.withAbort(conn.Context())
+
+	// streams counts the streams being handled and lastDone is the time the
+	// last of them has been handled at, in nanoseconds since the Unix epoch.
+	streams := &sync.WaitGroup{}
+	lastDone := &atomic.Int64{}
 	for {
-		ctx := context.Background()
-
 		// The stub to resolver DNS traffic follows a simple pattern in which
 		// the client sends a query, and the server provides a response.  This
 		// design specifies that for each subsequent query on a QUIC connection
 		// the client MUST select the next available client-initiated
 		// bidirectional stream.
-		stream, err := conn.AcceptStream(ctx)
+		stream, err := conn.AcceptStream(drain.ctx)
 		if err != nil {
+			if drain.draining() {
+				p.logger.Debug("quic conn: shutting down", "raddr", conn.RemoteAddr())
+
+				streams.Wait()
+				waitQUICResponses(conn, lastDone.Load())
+				closeQUICConn(p.logger, conn, DoQCodeNoError)
+
+				return
+			}
+
 			if isQUICErrorForDebugLog(err) {
-				log.Debug("accepting quic stream: closed or timed out: %s", err)
+				p.logger.Debug("accepting quic stream: closed or timed out", slogutil.KeyError, err)
 			} else {
-				log.Error("accepting quic stream: %s", err)
+				p.logger.Error("accepting quic stream", slogutil.KeyError, err)
 			}
 
 			// Close the connection to make sure resources are freed.
-			closeQUICConn(conn, DoQCodeNoError)
+			closeQUICConn(p.logger, conn, DoQCodeNoError)
 
 			return
 		}
 
-		err = reqSema.Acquire(ctx)
+		err = reqSema.Acquire(context.Background())
 		if err != nil {
-			log.Error("dnsproxy: quic: acquiring semaphore: %s", err)
+			p.logger.Error("quic: acquiring semaphore", slogutil.KeyError, err)
 
 			// Close the connection to make sure resources are freed.
-			closeQUICConn(conn, DoQCodeNoError)
+			closeQUICConn(p.logger, conn, DoQCodeNoError)
 
 			return
 		}
+
+		streams.Add(1)
 		go func() {
+			defer streams.Done()
 			defer reqSema.Release()
 
-			p.handleQUICStream(stream, conn)
+			p.handleQUICStream(ctx, stream, conn)
 
 			// The server MUST send the response(s) on the same stream and MUST
 			// indicate, after the last response, through the STREAM FIN
 			// mechanism that no further data will be sent on that stream.
 			_ = stream.Close()
+
+			lastDone.Store(time.Now().UnixNano())
 		}()
 	}
 }
 
+// waitQUICResponses waits for the responses written to conn to be sent.  Since
+// quic-go doesn't report that, it waits until [quicCloseDelay] passes since
+// lastDone, the time of the last response in nanoseconds since the Unix epoch,
+// or until conn is closed by the client.  lastDone is zero if there were no
+// responses.
+func waitQUICResponses(conn quic.Connection, lastDone int64) {
+	if lastDone == 0 {
+		return
+	}
+
+	delay := quicCloseDelay - time.Since(time.Unix(0, lastDone))
+	if delay <= 0 {
+		return
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-conn.Context().Done():
+	}
+}
+
 // handleQUICStream reads DNS queries from the stream, processes them,
 // and writes back the response.
-func (p *Proxy) handleQUICStream(stream quic.Stream, conn quic.Connection) {
-	bufPtr := p.bytesPool.Get().(*[]byte)
+func (p *Proxy) handleQUICStream(ctx context.Context, stream quic.Stream, conn quic.Connection) {
+	bufPtr := p.bytesPool.Get()
 	defer p.bytesPool.Put(bufPtr)
 
 	// One query - one stream.
@@ -198,7 +267,7 @@ func (p *Proxy) handleQUICStream(stream quic.Stream, conn quic.Connection) {
 	// just a signal that there will be no data to read anymore from this
 	// stream.
 	if (err != nil && err != io.EOF) || n < minDNSPacketSize {
-		logShortQUICRead(err)
+		logShortQUICRead(p.logger, err)
 
 		return
 	}
@@ -208,36 +277,38 @@ func (p *Proxy) handleQUICStream(stream quic.Stream, conn quic.Connection) {
 	// query is encoded. If it's sent with a 2-byte prefix, we consider this a
 	// DoQ v1. Otherwise, a draft version.
 	doqVersion := DoQv1
-	req := &dns.Msg{}
+	packet := buf[:n]
 
 	// Note that we support both the old drafts and the new RFC. In the old
 	// draft DNS messages were not prefixed with the message length.
 	packetLen := binary.BigEndian.Uint16(buf[:2])
 	if packetLen == uint16(n-2) {
-		err = req.Unpack(buf[2:])
+		packet = buf[2:n]
 	} else {
-		err = req.Unpack(buf)
 		doqVersion = DoQv1Draft
 	}
 
+	req, ts, err := p.unpackRequest(packet)
 	if err != nil {
-		log.Error("unpacking quic packet: %s", err)
-		closeQUICConn(conn, DoQCodeProtocolError)
+		p.logger.Error("unpacking quic packet", slogutil.KeyError, err)
+		closeQUICConn(p.logger, conn, DoQCodeProtocolError)
 
 		return
 	}
 
-	if !validQUICMsg(req) {
+	if !validQUICMsg(req, p.logger) {
 		// If a peer encounters such an error condition, it is considered a
 		// fatal error. It SHOULD forcibly abort the connection using QUIC's
 		// CONNECTION_CLOSE mechanism and SHOULD use the DoQ error code
 		// DOQ_PROTOCOL_ERROR.
-		closeQUICConn(conn, DoQCodeProtocolError)
+		closeQUICConn(p.logger, conn, DoQCodeProtocolError)
 
 		return
 	}
 
 	d := p.newDNSContext(ProtoQUIC, req)
+	d.ctx = ctx
+	d.tsig = ts
 	d.Addr = netutil.NetAddrToAddrPort(conn.RemoteAddr())
 	d.QUICStream = stream
 	d.QUICConnection = conn
@@ -245,8 +316,16 @@ func (p *Proxy) handleQUICStream(stream quic.Stream, conn quic.Connection) {
 
 	err = p.handleDNSRequest(d)
 	if err != nil {
-		log.Tracef("error handling DNS (%s) request: %s", d.Proto, err)
+		p.logger.Log(
+			context.TODO(),
+			levelTrace,
+			"handling dns request",
+			"proto", d.Proto,
+			slogutil.KeyError, err,
+		)
 	}
+
+	p.releaseDNSContext(d)
 }
 
 // respondQUIC writes a response to the QUIC stream.
@@ -255,12 +334,12 @@ func (p *Proxy) respondQUIC(d *DNSContext) error {
 
 	if resp == nil {
 		// If no response has been written, close the QUIC connection now.
-		closeQUICConn(d.QUICConnection, DoQCodeInternalError)
+		closeQUICConn(p.logger, d.QUICConnection, DoQCodeInternalError)
 
 		return errors.Error("no response to write")
 	}
 
-	bytes, err := resp.Pack()
+	bytes, err := packResponse(d, resp, nil)
 	if err != nil {
 		return fmt.Errorf("couldn't convert message into wire format: %w", err)
 	}
@@ -290,7 +369,7 @@ func (p *Proxy) respondQUIC(d *DNSContext) error {
 
 // validQUICMsg validates the incoming DNS message and returns false if
 // something is wrong with the message.
-func validQUICMsg(req *dns.Msg) (ok bool) {
+func validQUICMsg(req *dns.Msg, l *slog.Logger) (ok bool) {
 	// See https://www.rfc-editor.org/rfc/rfc9250.html#name-protocol-errors
 
 	// 1. a client or server receives a message with a non-zero Message ID.
@@ -318,7 +397,7 @@ func validQUICMsg(req *dns.Msg) (ok bool) {
 		for _, option := range opt.Option {
 			// Check for EDNS TCP keepalive option
 			if option.Option() == dns.EDNS0TCPKEEPALIVE {
-				log.Debug("client sent EDNS0 TCP keepalive option")
+				l.Debug("client sent edns0 tcp keepalive option")
 
 				return false
 			}
@@ -337,17 +416,17 @@ func validQUICMsg(req *dns.Msg) (ok bool) {
 }
 
 // logShortQUICRead is a logging helper for short reads from a QUIC stream.
-func logShortQUICRead(err error) {
+func logShortQUICRead(l *slog.Logger, err error) {
 	if err == nil {
-		log.Info("quic packet too short for dns query")
+		l.Info("quic packet too short for dns query")
 
 		return
 	}
 
 	if isQUICErrorForDebugLog(err) {
-		log.Debug("reading from quic stream: closed or timeout: %s", err)
+		l.Debug("reading from quic stream: closed or timeout", slogutil.KeyError, err)
 	} else {
-		log.Error("reading from quic stream: %s", err)
+		l.Error("reading from quic stream", slogutil.KeyError, err)
 	}
 }
 
@@ -396,13 +475,13 @@ func isQUICErrorForDebugLog(err error) (ok bool) {
 	return errors.As(err, &qIdleErr)
 }
 
-// closeQUICConn quietly closes the QUIC connection.
-func closeQUICConn(conn quic.Connection, code quic.ApplicationErrorCode) {
-	log.Debug("closing quic conn %s with code %d", conn.LocalAddr(), code)
+// closeQUICConn quietly closes the QUIC connection.  l is used for logging.
+func closeQUICConn(l *slog.Logger, conn quic.Connection, code quic.ApplicationErrorCode) {
+	l.Debug("closing quic conn", "addr", conn.LocalAddr(), "code", code)
 
 	err := conn.CloseWithError(code, "")
 	if err != nil {
-		log.Debug("closing quic connection with code %d: %s", code, err)
+		l.Debug("closing quic conn", "code", code, slogutil.KeyError, err)
 	}
 }
 
@@ -422,7 +501,12 @@ func newServerQUICConfig() (conf *quic.Config) {
 // addresses for which we do not require address validation.
 type quicAddrValidator struct {
 	cache gcache.Cache
-	ttl   time.Duration
+
+	// load, if not nil, makes the addresses validated only when the listener
+	// is under load.
+	load *quicLoad
+
+	ttl time.Duration
 }
 
 // newQUICAddrValidator initializes a new instance of *quicAddrValidator.
@@ -437,6 +521,10 @@ func newQUICAddrValidator(cacheSize int, ttl time.Duration) (v *quicAddrValidato
 // client. This allows the server to verify the client's address but increases
 // the latency.
 func (v *quicAddrValidator) requiresValidation(addr net.Addr) (ok bool) {
+	if v.load != nil && !v.load.overloaded() {
+		return false
+	}
+
 	// addr must be *net.UDPAddr here and if it's not we don't mind panic.
 	key := addr.(*net.UDPAddr).IP.String()
 	if v.cache.Has(key) {
@@ -6,13 +6,16 @@ import (
 	"crypto/x509"
 	"io"
 	"net"
+	"net/netip"
 	"testing"
 	"time"
 
 	"github.com/AdguardTeam/dnsproxy/proxyutil"
+	"github.com/AdguardTeam/golibs/netutil"
 	"github.com/AdguardTeam/golibs/testutil"
 	"github.com/miekg/dns"
 	"github.com/quic-go/quic-go"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -154,6 +157,79 @@ func TestQuicProxy_largePackets(t *testing.T) {
 	requireResponse(t, msg, resp)
 }
 
+func TestQuicProxy_migration(t *testing.T) {
+	serverConfig, caPem := newTLSConfig(t)
+
+	addrs := make(chan netip.AddrPort, 1)
+	dnsProxy := mustNew(t, &Config{
+		Logger:                 testLogger,
+		QUICListenAddr:         []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		TLSConfig:              serverConfig,
+		UpstreamConfig:         newTestUpstreamConfig(t, defaultTimeout, testDefaultUpstreamAddr),
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+		RequestHandler: func(_ *Proxy, d *DNSContext) (err error) {
+			addrs <- d.Addr
+			d.Res = newCompareTestReply(d.Req, "8.8.8.8", defaultTestTTL)
+
+			return nil
+		},
+	})
+
+	ctx := context.Background()
+	require.NoError(t, dnsProxy.Start(ctx))
+	testutil.CleanupAndRequireSuccess(t, func() (err error) { return dnsProxy.Shutdown(ctx) })
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(caPem)
+	tlsConfig := &tls.Config{
+		ServerName: tlsServerName,
+		RootCAs:    roots,
+		NextProtos: []string{NextProtoDQ},
+	}
+
+	// newTransport returns a new client QUIC transport on a new local socket
+	// and its address.
+	newTransport := func(t *testing.T) (tr *quic.Transport, addr netip.AddrPort) {
+		t.Helper()
+
+		conn, err := net.ListenUDP("udp", net.UDPAddrFromAddrPort(localhostAnyPort))
+		require.NoError(t, err)
+
+		tr = &quic.Transport{Conn: conn}
+		testutil.CleanupAndRequireSuccess(t, tr.Close)
+
+		return tr, netutil.NetAddrToAddrPort(conn.LocalAddr())
+	}
+
+	wifi, wifiAddr := newTransport(t)
+	conn, err := wifi.DialEarly(ctx, dnsProxy.Addr(ProtoQUIC), tlsConfig, nil)
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, func() (err error) {
+		return conn.CloseWithError(DoQCodeNoError, "")
+	})
+
+	sendTestQUICMessage(t, conn, DoQv1)
+	addr, _ := testutil.RequireReceive(t, addrs, defaultTimeout)
+	require.Equal(t, wifiAddr, addr)
+
+	cellular, cellularAddr := newTransport(t)
+	path, err := conn.AddPath(cellular)
+	require.NoError(t, err)
+
+	probeCtx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	t.Cleanup(cancel)
+
+	require.NoError(t, path.Probe(probeCtx))
+	require.NoError(t, path.Switch())
+
+	// The same connection keeps working from the new address.
+	sendTestQUICMessage(t, conn, DoQv1)
+	addr, _ = testutil.RequireReceive(t, addrs, defaultTimeout)
+	assert.Equal(t, cellularAddr, addr)
+}
+
 // sendQUICMessage sends msg to the specified QUIC connection.
 func sendQUICMessage(
 	t *testing.T,
@@ -6,12 +6,13 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"log/slog"
 	"net"
+	"sync"
 	"time"
 
-	proxynetutil "github.com/AdguardTeam/dnsproxy/internal/netutil"
 	"github.com/AdguardTeam/golibs/errors"
-	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
 	"github.com/AdguardTeam/golibs/netutil"
 	"github.com/AdguardTeam/golibs/syncutil"
 	"github.com/miekg/dns"
@@ -19,40 +20,57 @@ import (
 
 func (p *Proxy) createTCPListeners(ctx context.Context) (err error) {
 	for _, a := range p.TCPListenAddr {
-		log.Info("dnsproxy: creating tcp server socket %s", a)
-
-		lsnr, lErr := proxynetutil.ListenConfig().Listen(ctx, "tcp", a.String())
+		tcpListener, lErr := p.tcpCreate(ctx, a)
 		if lErr != nil {
 			return fmt.Errorf("listening to tcp socket: %w", lErr)
 		}
 
-		tcpListener, ok := lsnr.(*net.TCPListener)
-		if !ok {
-			return fmt.Errorf("wrong listener type on tcp addr %s: %T", a, lsnr)
-		}
-
 		p.tcpListen = append(p.tcpListen, tcpListener)
 
-		log.Info("dnsproxy: listening to tcp://%s", tcpListener.Addr())
+		// Bind the rest of the sockets to the actual address of the first one,
+		// since the port of a may be zero.
+		bound := tcpListener.Addr().(*net.TCPAddr)
+		for i := uint(1); i < p.ListenSockets; i++ {
+			tcpListener, lErr = p.tcpCreate(ctx, bound)
+			if lErr != nil {
+				return fmt.Errorf("listening to tcp socket %d on %s: %w", i, a, lErr)
+			}
+
+			p.tcpListen = append(p.tcpListen, tcpListener)
+		}
 	}
 
 	return nil
 }
 
-func (p *Proxy) createTLSListeners() (err error) {
+// tcpCreate returns the TCP listener bound to addr.
+func (p *Proxy) tcpCreate(ctx context.Context, addr *net.TCPAddr) (l *net.TCPListener, err error) {
+	p.logger.InfoContext(ctx, "creating tcp server socket", "addr", addr)
+
+	l, err = p.listenTCP(ctx, addr, true)
+	if err != nil {
+		return nil, err
+	}
+
+	p.logger.InfoContext(ctx, "listening to tcp", "addr", l.Addr())
+
+	return l, nil
+}
+
+func (p *Proxy) createTLSListeners(ctx context.Context) (err error) {
 	for _, a := range p.TLSListenAddr {
-		log.Info("dnsproxy: creating tls server socket %s", a)
+		p.logger.Info("creating tls server socket", "addr", a)
 
 		var tcpListen *net.TCPListener
-		tcpListen, err = net.ListenTCP("tcp", a)
+		tcpListen, err = p.listenTCP(ctx, a, false)
 		if err != nil {
 			return fmt.Errorf("listening on tls addr %s: %w", a, err)
 		}
 
-		l := tls.NewListener(tcpListen, p.TLSConfig)
+		l := tls.NewListener(p.limitEncryptedConns(tcpListen), p.serverTLSConfig(nil))
 		p.tlsListen = append(p.tlsListen, l)
 
-		log.Info("dnsproxy: listening to tls://%s", l.Addr())
+		p.logger.Info("listening to tls", "addr", l.Addr())
 	}
 
 	return nil
@@ -62,143 +80,298 @@ func (p *Proxy) createTLSListeners() (err error) {
 // or "tls".
 //
 // See also the comment on Proxy.requestsSema.
-func (p *Proxy) tcpPacketLoop(l net.Listener, proto Proto, reqSema syncutil.Semaphore) {
-	log.Info("dnsproxy: entering %s listener loop on %s", proto, l.Addr())
+func (p *Proxy) tcpPacketLoop(
+	l net.Listener,
+	proto Proto,
+	reqSema syncutil.Semaphore,
+	drain *drainer,
+) {
+	p.logger.Info("entering listener loop", "proto", proto, "addr", l.Addr())
+
+	c := p.tcpConnConfig(proto)
+	conns := c.newConnTracker()
+
+	workers := newTCPWorkerPool(c.maxWorkers(), p.logger)
+	defer workers.close()
+
+	// Wait for the connections before closing the workers, since those may
+	// still submit the queries.
+	handlers := &sync.WaitGroup{}
+	defer handlers.Wait()
 
 	for {
 		clientConn, err := l.Accept()
 		if err != nil {
 			if errors.Is(err, net.ErrClosed) {
-				log.Debug("dnsproxy: tcp connection %s closed", l.Addr())
+				p.logger.Debug("tcp connection closed", "addr", l.Addr())
 			} else {
-				log.Error("dnsproxy: reading from tcp: %s", err)
+				p.logger.Error("reading from tcp", slogutil.KeyError, err)
 			}
 
 			break
 		}
 
+		addr := netutil.NetAddrToAddrPort(clientConn.RemoteAddr()).Addr()
+		if !conns.acquire(addr) {
+			p.rejectTCPConnection(clientConn, proto)
+
+			continue
+		}
+
 		// TODO(d.kolyshev): Pass and use context from above.
 		err = reqSema.Acquire(context.Background())
 		if err != nil {
-			log.Error("dnsproxy: tcp: acquiring semaphore: %s", err)
+			conns.release(addr)
+			p.logger.Error("tcp: acquiring semaphore", slogutil.KeyError, err)
 
 			break
 		}
-		go func() {
+		handlers.Add(1)
+		drain.goTracked(func() {
+			defer handlers.Done()
 			defer reqSema.Release()
+			defer conns.release(addr)
 
-			p.handleTCPConnection(clientConn, proto)
-		}()
+			p.handleTCPConnection(clientConn, proto, drain, workers)
+		})
 	}
 }
 
-// handleTCPConnection starts a loop that handles an incoming TCP connection.
-// proto must be either ProtoTCP or ProtoTLS.
-func (p *Proxy) handleTCPConnection(conn net.Conn, proto Proto) {
-	defer log.OnPanic("proxy.handleTCPConnection")
+// rejectTCPConnection closes conn exceeding the limits of the connections of
+// the listener.
+func (p *Proxy) rejectTCPConnection(conn net.Conn, proto Proto) {
+	p.logger.Debug(
+		"rejecting connection",
+		"proto", proto,
+		"raddr", p.anonymizer.addrPort(netutil.NetAddrToAddrPort(conn.RemoteAddr())),
+	)
+
+	err := conn.Close()
+	if err != nil {
+		logWithNonCrit(p.logger, err, "rejecting tcp connection: closing conn")
+	}
+}
 
-	log.Debug("dnsproxy: handling new %s request from %s", proto, conn.RemoteAddr())
+// maxTCPPipelined is the maximum number of the queries from a single TCP or TLS
+// connection processed simultaneously.  The next query isn't read from the
+// connection until one of these is answered.
+const maxTCPPipelined = 100
+
+// handleTCPConnection starts a loop that handles an incoming TCP connection.
+// proto must be either ProtoTCP or ProtoTLS.  The queries are processed
+// concurrently by workers and the responses are written by a separate goroutine
+// as soon as they're ready, possibly out of order, see RFC 7766 Section
+// 6.2.1.1.  When the shutdown starts, the queries being handled are still
+// answered, but the connection is closed instead of waiting for the next one.
+// The timeouts and the number of the queries are limited according to
+// [Config.TCPConn] or [Config.TLSConn].
+func (p *Proxy) handleTCPConnection(
+	conn net.Conn,
+	proto Proto,
+	drain *drainer,
+	workers *tcpWorkerPool,
+) {
+	defer slogutil.RecoverAndLog(context.TODO(), p.logger)
+
+	p.logger.Debug(
+		"handling new request",
+		"proto", proto,
+		"raddr", p.anonymizer.addrPort(netutil.NetAddrToAddrPort(conn.RemoteAddr())),
+	)
+
+	p.metrics.OnConnectionOpened(proto)
+	defer p.metrics.OnConnectionClosed(proto)
 
 	defer func() {
 		err := conn.Close()
 		if err != nil {
-			logWithNonCrit(err, "dnsproxy: handling tcp: closing conn")
+			logWithNonCrit(p.logger, err, "handling tcp: closing conn")
 		}
 	}()
 
-	for {
-		p.RLock()
-		if !p.started {
-			return
-		}
-		p.RUnlock()
-
-		err := conn.SetDeadline(time.Now().Add(defaultTimeout))
+	// Write the queued responses before closing the connection.
+	w := newTCPConnWriter(conn, maxTCPPipelined, p.bytesPool, p.logger)
+	defer w.closeQueue()
+
+	// Wait for the pending queries before closing the queue.
+	pending := &sync.WaitGroup{}
+	defer pending.Wait()
+
+	// Interrupt waiting for the next query on shutdown.  The loop below checks
+	// the shutdown and the closing of w after extending the deadline, so the
+	// one set here or by w is never overwritten before reading.
+	stop := context.AfterFunc(drain.ctx, func() {
+		_ = conn.SetReadDeadline(time.Now())
+	})
+	defer stop()
+
+	c := p.tcpConnConfig(proto)
+	idleTimeout, readTimeout, maxQueries := c.idleTimeout(), c.readTimeout(), c.maxQueries()
+
+	pipeline := syncutil.NewChanSemaphore(maxTCPPipelined)
+	lenBuf := make([]byte, 2)
+	for n := uint(0); maxQueries == 0 || n < maxQueries; n++ {
+		err := conn.SetReadDeadline(time.Now().Add(idleTimeout))
 		if err != nil {
 			// Consider deadline errors non-critical.
-			logWithNonCrit(err, "handling tcp: setting deadline")
+			logWithNonCrit(p.logger, err, "handling tcp: setting deadline")
 		}
 
-		packet, err := readPrefixed(conn)
+		if drain.draining() || w.isClosing() {
+			return
+		}
+
+		packet, bufPtr, err := readPrefixed(conn, lenBuf, p.bytesPool, readTimeout)
 		if err != nil {
-			logWithNonCrit(err, "handling tcp: reading msg")
+			logWithNonCrit(p.logger, err, "handling tcp: reading msg")
 
 			break
 		}
 
-		req := &dns.Msg{}
-		err = req.Unpack(packet)
+		req, ts, err := p.unpackRequest(packet)
+		p.bytesPool.Put(bufPtr)
 		if err != nil {
-			log.Error("dnsproxy: handling tcp: unpacking msg: %s", err)
+			p.logger.Error("handling tcp: unpacking msg", slogutil.KeyError, err)
+
+			return
+		}
 
+		err = pipeline.Acquire(drain.ctx)
+		if err != nil {
+			// The shutdown has started.
 			return
 		}
 
-		d := p.newDNSContext(proto, req)
-		d.Addr = netutil.NetAddrToAddrPort(conn.RemoteAddr())
-		d.Conn = conn
+		pending.Add(1)
+		err = workers.submit(drain.ctx, func() {
+			defer pending.Done()
+			defer pipeline.Release()
 
-		err = p.handleDNSRequest(d)
+			p.handleTCPRequest(drain.reqCtx, w, proto, req, ts)
+		})
 		if err != nil {
-			logWithNonCrit(err, fmt.Sprintf("handling tcp: handling %s request", d.Proto))
+			// The shutdown has started.
+			pending.Done()
+			pipeline.Release()
+
+			return
 		}
 	}
 }
 
+// handleTCPRequest handles req received over the connection of w.  It's safe
+// for concurrent use, since each response is written to w with a single write,
+// which w queues as a whole.  ctx is the context of the request.
+func (p *Proxy) handleTCPRequest(
+	ctx context.Context,
+	w *tcpConnWriter,
+	proto Proto,
+	req *dns.Msg,
+	ts *tsigState,
+) {
+	conn := w.Conn
+
+	d := p.newDNSContext(proto, req)
+	d.ctx = ctx
+	d.tsig = ts
+	d.Addr = netutil.NetAddrToAddrPort(conn.RemoteAddr())
+	d.Conn = conn
+	d.tcpWriter = w
+	if p.TransparentProxy && proto == ProtoTCP {
+		// The accepted connections keep the original destination as the local
+		// address.
+		d.OrigDst = netutil.NetAddrToAddrPort(conn.LocalAddr())
+	}
+
+	err := p.handleDNSRequest(d)
+	if err != nil {
+		logWithNonCrit(p.logger, err, fmt.Sprintf("handling tcp: handling %s request", d.Proto))
+	}
+
+	p.releaseDNSContext(d)
+}
+
 // errTooLarge means that a DNS message is larger than 64KiB.
 const errTooLarge errors.Error = "dns message is too large"
 
 // readPrefixed reads a DNS message with a 2-byte prefix containing message
-// length from conn.
-func readPrefixed(conn net.Conn) (b []byte, err error) {
-	l := make([]byte, 2)
-	_, err = conn.Read(l)
+// length from conn.  lenBuf is used to read the prefix and must have the length
+// of 2.  The message is read into the buffer from pool, which is only taken
+// once the prefix is read, so that the idle connections don't hold the
+// buffers.  The rest of the message must be read within readTimeout after the
+// prefix.  If err is nil, b is the beginning of *bufPtr, which the caller
+// should return to pool.
+func readPrefixed(
+	conn net.Conn,
+	lenBuf []byte,
+	pool *syncutil.Pool[[]byte],
+	readTimeout time.Duration,
+) (b []byte, bufPtr *[]byte, err error) {
+	_, err = io.ReadFull(conn, lenBuf)
 	if err != nil {
-		return nil, fmt.Errorf("reading len: %w", err)
+		return nil, nil, fmt.Errorf("reading len: %w", err)
 	}
 
-	packetLen := binary.BigEndian.Uint16(l)
+	packetLen := binary.BigEndian.Uint16(lenBuf)
 	if packetLen > dns.MaxMsgSize {
-		return nil, errTooLarge
+		return nil, nil, errTooLarge
 	}
 
-	b = make([]byte, packetLen)
+	err = conn.SetReadDeadline(time.Now().Add(readTimeout))
+	if err != nil {
+		return nil, nil, fmt.Errorf("setting read deadline: %w", err)
+	}
+
+	bufPtr = pool.Get()
+	b = (*bufPtr)[:packetLen]
 	_, err = io.ReadFull(conn, b)
 	if err != nil {
-		return nil, fmt.Errorf("reading msg: %w", err)
+		pool.Put(bufPtr)
+
+		return nil, nil, fmt.Errorf("reading msg: %w", err)
 	}
 
-	return b, nil
+	return b, bufPtr, nil
 }
 
 // logWithNonCrit logs the error on the appropriate level depending on whether
 // err is a critical error or not.
-func logWithNonCrit(err error, msg string) {
+func logWithNonCrit(l *slog.Logger, err error, msg string) {
 	if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) || isEPIPE(err) {
-		log.Debug("%s: connection is closed; original error: %s", msg, err)
+		l.Debug(msg+": connection is closed", slogutil.KeyError, err)
 	} else if netErr := net.Error(nil); errors.As(err, &netErr) && netErr.Timeout() {
-		log.Debug("%s: connection timed out; original error: %s", msg, err)
+		l.Debug(msg+": connection timed out", slogutil.KeyError, err)
 	} else {
-		log.Error("%s: %s", msg, err)
+		l.Error(msg, slogutil.KeyError, err)
 	}
 }
 
 // Writes a response to the TCP (or TLS) client
 func (p *Proxy) respondTCP(d *DNSContext) error {
 	resp := d.Res
-	conn := d.Conn
+	conn := d.respConn()
 
 	if resp == nil {
-		// If no response has been written, close the connection right away
+		// If no response has been written, close the connection, which still
+		// writes the responses to the other queries pipelined over it, see
+		// [tcpConnWriter.Close].
 		return conn.Close()
 	}
 
-	bytes, err := resp.Pack()
+	bufPtr := p.bytesPool.Get()
+	defer p.bytesPool.Put(bufPtr)
+
+	b, err := packPrefixed(d, resp, *bufPtr)
 	if err != nil {
 		return fmt.Errorf("packing message: %w", err)
 	}
 
-	err = writePrefixed(bytes, conn)
+	return writeTCP(conn, b)
+}
+
+// writeTCP writes b, the packed response with its length prefix, to conn.
+func writeTCP(conn net.Conn, b []byte) (err error) {
+	_, err = conn.Write(b)
 	if err != nil && !errors.Is(err, net.ErrClosed) {
 		return fmt.Errorf("writing message: %w", err)
 	}
@@ -206,12 +379,25 @@ func (p *Proxy) respondTCP(d *DNSContext) error {
 	return nil
 }
 
-// writePrefixed writes a DNS message to a TCP connection it first writes
-// a 2-byte prefix followed by the message itself.
-func writePrefixed(b []byte, conn net.Conn) (err error) {
-	l := make([]byte, 2)
-	binary.BigEndian.PutUint16(l, uint16(len(b)))
-	_, err = (&net.Buffers{l, b}).WriteTo(conn)
+// packPrefixed packs msg to the request of d with a 2-byte prefix containing
+// its length, so that both are written at once.  It uses buf if the message
+// fits it.
+func packPrefixed(d *DNSContext, msg *dns.Msg, buf []byte) (b []byte, err error) {
+	packed, err := packResponse(d, msg, buf[2:])
+	if err != nil {
+		return nil, err
+	} else if len(packed) > dns.MaxMsgSize {
+		return nil, errTooLarge
+	}
 
-	return err
+	if &packed[0] == &buf[2] {
+		b = buf[:2+len(packed)]
+	} else {
+		// The message hasn't fit buf, so it has been packed into a new slice.
+		b = append(make([]byte, 2, 2+len(packed)), packed...)
+	}
+
+	binary.BigEndian.PutUint16(b, uint16(len(packed)))
+
+	return b, nil
 }
@@ -4,11 +4,16 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"fmt"
+	"io"
 	"net"
 	"testing"
+	"time"
 
+	"github.com/AdguardTeam/dnsproxy/upstream"
 	"github.com/AdguardTeam/golibs/testutil"
 	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -53,3 +58,253 @@ func TestTlsProxy(t *testing.T) {
 
 	sendTestMessages(t, conn)
 }
+
+func TestTlsProxy_conn(t *testing.T) {
+	u := &fakeUpstream{
+		onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			return newCompareTestReply(req, "192.0.2.1", defaultTestTTL), nil
+		},
+		onAddress: func() (addr string) { return "fake" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	serverNames := make(chan string, 1)
+	serverConfig, caPem := newTLSConfig(t)
+	p := mustNew(t, &Config{
+		Logger:         testLogger,
+		TLSListenAddr:  []*net.TCPAddr{net.TCPAddrFromAddrPort(localhostAnyPort)},
+		TLSConfig:      serverConfig,
+		UpstreamConfig: &UpstreamConfig{Upstreams: []upstream.Upstream{u}},
+		TrustedProxies: defaultTrustedProxies,
+		RequestHandler: func(p *Proxy, d *DNSContext) (err error) {
+			// Embedders read the client's TLS state from the connection.
+			tlsConn, ok := d.Conn.(*tls.Conn)
+			if ok {
+				serverNames <- tlsConn.ConnectionState().ServerName
+			} else {
+				serverNames <- ""
+			}
+
+			return p.Resolve(d)
+		},
+	})
+
+	ctx := context.Background()
+	require.NoError(t, p.Start(ctx))
+	testutil.CleanupAndRequireSuccess(t, func() (err error) { return p.Shutdown(ctx) })
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(caPem)
+	tlsConfig := &tls.Config{ServerName: tlsServerName, RootCAs: roots}
+
+	conn, err := dns.DialWithTLS("tcp-tls", p.Addr(ProtoTLS).String(), tlsConfig)
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, conn.Close)
+
+	require.NoError(t, conn.SetDeadline(time.Now().Add(defaultTimeout)))
+
+	req := newHostTestMessage("example.org")
+	require.NoError(t, conn.WriteMsg(req))
+
+	resp, err := conn.ReadMsg()
+	require.NoError(t, err)
+
+	assert.Equal(t, req.Id, resp.Id)
+	assert.Equal(t, tlsServerName, <-serverNames)
+}
+
+func BenchmarkTcpProxy(b *testing.B) {
+	benchmarkExchange(b, startBenchProxy(b, nil), ProtoTCP)
+}
+
+func TestTcpProxy_pipelining(t *testing.T) {
+	const (
+		slowHost = "slow.example"
+		fastHost = "fast.example"
+	)
+
+	unblock := make(chan struct{})
+	u := &fakeUpstream{
+		onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			if req.Question[0].Name == slowHost+"." {
+				<-unblock
+			}
+
+			return newCompareTestReply(req, "192.0.2.1", defaultTestTTL), nil
+		},
+		onAddress: func() (addr string) { return "fake" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	p := mustNew(t, &Config{
+		Logger:                 testLogger,
+		TCPListenAddr:          []*net.TCPAddr{net.TCPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig:         &UpstreamConfig{Upstreams: []upstream.Upstream{u}},
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+	})
+
+	ctx := context.Background()
+	require.NoError(t, p.Start(ctx))
+	testutil.CleanupAndRequireSuccess(t, func() (err error) { return p.Shutdown(ctx) })
+
+	conn, err := dns.Dial("tcp", p.Addr(ProtoTCP).String())
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, conn.Close)
+
+	require.NoError(t, conn.SetDeadline(time.Now().Add(defaultTimeout)))
+
+	slowReq := newHostTestMessage(slowHost)
+	require.NoError(t, conn.WriteMsg(slowReq))
+
+	fastReq := newHostTestMessage(fastHost)
+	require.NoError(t, conn.WriteMsg(fastReq))
+
+	// The response to the second query must not wait for the first one.
+	resp, err := conn.ReadMsg()
+	require.NoError(t, err)
+
+	assert.Equal(t, fastReq.Id, resp.Id)
+
+	close(unblock)
+
+	resp, err = conn.ReadMsg()
+	require.NoError(t, err)
+
+	assert.Equal(t, slowReq.Id, resp.Id)
+}
+
+func TestTcpProxy_pipeliningNoResponse(t *testing.T) {
+	const (
+		droppedHost  = "dropped.example"
+		answeredHost = "answered.example"
+	)
+
+	u := &fakeUpstream{
+		onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			return newCompareTestReply(req, "192.0.2.1", defaultTestTTL), nil
+		},
+		onAddress: func() (addr string) { return "fake" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	dropped := make(chan struct{})
+	p := mustNew(t, &Config{
+		Logger:                 testLogger,
+		TCPListenAddr:          []*net.TCPAddr{net.TCPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig:         &UpstreamConfig{Upstreams: []upstream.Upstream{u}},
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+		RequestHandler: func(p *Proxy, d *DNSContext) (err error) {
+			if d.Req.Question[0].Name == droppedHost+"." {
+				defer close(dropped)
+
+				// Leave the request without a response.
+				return nil
+			}
+
+			// Answer after the other query has been dropped.
+			<-dropped
+
+			return p.Resolve(d)
+		},
+	})
+
+	ctx := context.Background()
+	require.NoError(t, p.Start(ctx))
+	testutil.CleanupAndRequireSuccess(t, func() (err error) { return p.Shutdown(ctx) })
+
+	conn, err := dns.Dial("tcp", p.Addr(ProtoTCP).String())
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, conn.Close)
+
+	require.NoError(t, conn.SetDeadline(time.Now().Add(defaultTimeout)))
+
+	answeredReq := newHostTestMessage(answeredHost)
+	require.NoError(t, conn.WriteMsg(answeredReq))
+	require.NoError(t, conn.WriteMsg(newHostTestMessage(droppedHost)))
+
+	resp, err := conn.ReadMsg()
+	require.NoError(t, err)
+
+	assert.Equal(t, answeredReq.Id, resp.Id)
+
+	// The connection is closed after the response to the answered query.
+	_, err = conn.ReadMsg()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestTcpProxy_fastOpen(t *testing.T) {
+	p := mustNew(t, &Config{
+		Logger:                 testLogger,
+		TCPListenAddr:          []*net.TCPAddr{net.TCPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig:         &UpstreamConfig{Upstreams: []upstream.Upstream{newProfileTestUpstream("192.0.2.1")}},
+		TrustedProxies:         defaultTrustedProxies,
+		TCPFastOpen:            true,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+	})
+
+	ctx := context.Background()
+	require.NoError(t, p.Start(ctx))
+	testutil.CleanupAndRequireSuccess(t, func() (err error) { return p.Shutdown(ctx) })
+
+	conn, err := dns.Dial("tcp", p.Addr(ProtoTCP).String())
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, conn.Close)
+
+	require.NoError(t, conn.SetDeadline(time.Now().Add(defaultTimeout)))
+
+	req := newHostTestMessage("example.org")
+	require.NoError(t, conn.WriteMsg(req))
+
+	resp, err := conn.ReadMsg()
+	require.NoError(t, err)
+
+	assert.Equal(t, req.Id, resp.Id)
+	assert.Len(t, resp.Answer, 1)
+}
+
+func TestTcpProxy_multipathTCP(t *testing.T) {
+	p := mustNew(t, &Config{
+		Logger:                 testLogger,
+		TCPListenAddr:          []*net.TCPAddr{net.TCPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig:         &UpstreamConfig{Upstreams: []upstream.Upstream{newProfileTestUpstream("192.0.2.1")}},
+		TrustedProxies:         defaultTrustedProxies,
+		MultipathTCP:           true,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+	})
+
+	ctx := context.Background()
+	require.NoError(t, p.Start(ctx))
+	testutil.CleanupAndRequireSuccess(t, func() (err error) { return p.Shutdown(ctx) })
+
+	// Both the clients supporting Multipath TCP and the ones not supporting it
+	// should be served.
+	for _, mptcp := range []bool{true, false} {
+		t.Run(fmt.Sprintf("client_mptcp_%t", mptcp), func(t *testing.T) {
+			d := &net.Dialer{Timeout: defaultTimeout}
+			d.SetMultipathTCP(mptcp)
+
+			c, err := d.DialContext(ctx, "tcp", p.Addr(ProtoTCP).String())
+			require.NoError(t, err)
+
+			conn := &dns.Conn{Conn: c}
+			testutil.CleanupAndRequireSuccess(t, conn.Close)
+
+			require.NoError(t, conn.SetDeadline(time.Now().Add(defaultTimeout)))
+
+			req := newHostTestMessage("example.org")
+			require.NoError(t, conn.WriteMsg(req))
+
+			resp, err := conn.ReadMsg()
+			require.NoError(t, err)
+
+			assert.Equal(t, req.Id, resp.Id)
+			assert.Len(t, resp.Answer, 1)
+		})
+	}
+}
@@ -8,7 +8,7 @@ import (
 
 	proxynetutil "github.com/AdguardTeam/dnsproxy/internal/netutil"
 	"github.com/AdguardTeam/golibs/errors"
-	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
 	"github.com/AdguardTeam/golibs/netutil"
 	"github.com/AdguardTeam/golibs/syncutil"
 	"github.com/miekg/dns"
@@ -23,6 +23,18 @@ func (p *Proxy) createUDPListeners(ctx context.Context) (err error) {
 		}
 
 		p.udpListen = append(p.udpListen, pc)
+
+		// Bind the rest of the sockets to the actual address of the first one,
+		// since the port of a may be zero.
+		bound := pc.LocalAddr().(*net.UDPAddr)
+		for i := uint(1); i < p.ListenSockets; i++ {
+			pc, sErr = p.udpCreate(ctx, bound)
+			if sErr != nil {
+				return fmt.Errorf("listening on udp addr %s: socket %d: %w", a, i, sErr)
+			}
+
+			p.udpListen = append(p.udpListen, pc)
+		}
 	}
 
 	return nil
@@ -30,21 +42,18 @@ func (p *Proxy) createUDPListeners(ctx context.Context) (err error) {
 
 // udpCreate - create a UDP listening socket
 func (p *Proxy) udpCreate(ctx context.Context, udpAddr *net.UDPAddr) (*net.UDPConn, error) {
-	log.Info("dnsproxy: creating udp server socket %s", udpAddr)
+	p.logger.InfoContext(ctx, "creating udp server socket", "addr", udpAddr)
 
-	packetConn, err := proxynetutil.ListenConfig().ListenPacket(ctx, "udp", udpAddr.String())
+	udpListen, err := p.listenUDP(ctx, udpAddr, true)
 	if err != nil {
 		return nil, fmt.Errorf("listening to udp socket: %w", err)
 	}
 
-	udpListen := packetConn.(*net.UDPConn)
-	if p.Config.UDPBufferSize > 0 {
-		err = udpListen.SetReadBuffer(p.Config.UDPBufferSize)
-		if err != nil {
-			_ = udpListen.Close()
+	err = proxynetutil.SetBufferSizes(udpListen, p.UDPBufferSize, p.UDPSendBufferSize)
+	if err != nil {
+		_ = udpListen.Close()
 
-			return nil, fmt.Errorf("setting udp buf size: %w", err)
-		}
+		return nil, fmt.Errorf("setting udp buf size: %w", err)
 	}
 
 	err = proxynetutil.UDPSetOptions(udpListen)
@@ -54,84 +63,211 @@ func (p *Proxy) udpCreate(ctx context.Context, udpAddr *net.UDPAddr) (*net.UDPCo
 		return nil, fmt.Errorf("setting udp opts: %w", err)
 	}
 
-	log.Info("dnsproxy: listening to udp://%s", udpListen.LocalAddr())
+	if p.UDPSocketFilter {
+		err = proxynetutil.AttachDNSFilter(udpListen)
+		if err != nil {
+			_ = udpListen.Close()
+
+			return nil, fmt.Errorf("attaching udp socket filter: %w", err)
+		}
+	}
+
+	p.logger.InfoContext(ctx, "listening to udp", "addr", udpListen.LocalAddr())
 
 	return udpListen, nil
 }
 
-// udpPacketLoop listens for incoming UDP packets.
+// udpPacketLoop listens for incoming UDP packets.  It returns when conn is
+// closed or when the read deadline set on it by the shutdown is reached, see
+// [Proxy.Shutdown].  The packets are read and the responses are written in
+// batches where supported.
 //
 // See also the comment on Proxy.requestsSema.
-func (p *Proxy) udpPacketLoop(conn *net.UDPConn, reqSema syncutil.Semaphore) {
-	log.Info("dnsproxy: entering udp listener loop on %s", conn.LocalAddr())
+func (p *Proxy) udpPacketLoop(conn *net.UDPConn, reqSema syncutil.Semaphore, drain *drainer) {
+	p.logger.Info("entering udp listener loop", "addr", conn.LocalAddr())
+
+	if p.TransparentProxy {
+		p.udpTransparentPacketLoop(conn, reqSema, drain)
+
+		return
+	}
+
+	bc, ok := proxynetutil.NewUDPBatchConn(conn, p.udpOOBSize)
+	if ok {
+		p.udpBatchPacketLoop(conn, bc, reqSema, drain)
+
+		return
+	}
 
 	b := make([]byte, dns.MaxMsgSize)
 	for {
-		p.RLock()
-		if !p.started {
-			return
-		}
-		p.RUnlock()
-
 		n, localIP, remoteAddr, err := proxynetutil.UDPRead(conn, b, p.udpOOBSize)
 		// documentation says to handle the packet even if err occurs, so do that first
-		if n > 0 {
-			// make a copy of all bytes because ReadFrom() will overwrite contents of b on next call
-			// we need the contents to survive the call because we're handling them in goroutine
-			packet := make([]byte, n)
-			copy(packet, b)
-
-			// TODO(d.kolyshev): Pass and use context from above.
-			sErr := reqSema.Acquire(context.Background())
-			if sErr != nil {
-				log.Error("dnsproxy: udp: acquiring semaphore: %s", sErr)
+		if n > 0 && !p.udpServePacket(b[:n], localIP, netip.AddrPort{}, remoteAddr, conn, nil, reqSema, drain) {
+			break
+		}
+
+		if err != nil {
+			p.logUDPReadError(conn, err, drain)
 
-				break
+			break
+		}
+	}
+}
+
+// udpBatchPacketLoop is the [Proxy.udpPacketLoop] reading the packets from conn
+// using bc.
+func (p *Proxy) udpBatchPacketLoop(
+	conn *net.UDPConn,
+	bc proxynetutil.UDPBatchConn,
+	reqSema syncutil.Semaphore,
+	drain *drainer,
+) {
+	w := newUDPBatchWriter(bc)
+	msgs := make([]proxynetutil.UDPMessage, proxynetutil.UDPBatchSize)
+	for i := range msgs {
+		msgs[i].Buf = make([]byte, dns.MaxMsgSize)
+	}
+
+	for {
+		n, err := bc.ReadBatch(msgs)
+		for _, msg := range msgs[:n] {
+			for _, dg := range msg.Datagrams() {
+				ok := len(dg) == 0 || p.udpServePacket(
+					dg,
+					msg.LocalIP,
+					netip.AddrPort{},
+					msg.RemoteAddr,
+					conn,
+					w,
+					reqSema,
+					drain,
+				)
+				if !ok {
+					return
+				}
 			}
-			go func() {
-				defer reqSema.Release()
+		}
+
+		if err != nil {
+			p.logUDPReadError(conn, err, drain)
+
+			return
+		}
+	}
+}
+
+// udpTransparentPacketLoop is the [Proxy.udpPacketLoop] reading the packets
+// intercepted with TPROXY from conn along with their original destinations, see
+// [Config.TransparentProxy].
+func (p *Proxy) udpTransparentPacketLoop(
+	conn *net.UDPConn,
+	reqSema syncutil.Semaphore,
+	drain *drainer,
+) {
+	oobSize := p.udpOOBSize + proxynetutil.UDPOrigDstOOBSize()
 
-				p.udpHandlePacket(packet, localIP, remoteAddr, conn)
-			}()
+	b := make([]byte, dns.MaxMsgSize)
+	for {
+		n, origDst, remoteAddr, err := proxynetutil.UDPReadOrigDst(conn, b, oobSize)
+		if n > 0 && !p.udpServePacket(b[:n], origDst.Addr(), origDst, remoteAddr, conn, nil, reqSema, drain) {
+			break
 		}
+
 		if err != nil {
-			if errors.Is(err, net.ErrClosed) {
-				log.Debug("dnsproxy: udp connection %s closed", conn.LocalAddr())
-			} else {
-				log.Error("dnsproxy: reading from udp: %s", err)
-			}
+			p.logUDPReadError(conn, err, drain)
 
 			break
 		}
 	}
 }
 
-// udpHandlePacket processes the incoming UDP packet and sends a DNS response
-func (p *Proxy) udpHandlePacket(
+// udpServePacket handles the copy of packet in a separate goroutine.  origDst
+// is the original destination of the packet intercepted with TPROXY, if any.
+// w is used to write the response, if not nil.  It returns false if the packet
+// loop should stop.
+func (p *Proxy) udpServePacket(
 	packet []byte,
 	localIP netip.Addr,
+	origDst netip.AddrPort,
+	remoteAddr *net.UDPAddr,
+	conn *net.UDPConn,
+	w *udpBatchWriter,
+	reqSema syncutil.Semaphore,
+	drain *drainer,
+) (ok bool) {
+	// TODO(d.kolyshev): Pass and use context from above.
+	err := reqSema.Acquire(context.Background())
+	if err != nil {
+		p.logger.Error("udp: acquiring semaphore", slogutil.KeyError, err)
+
+		return false
+	}
+
+	// Make a copy of the packet since the read buffer is reused and the
+	// contents must survive until the handling goroutine unpacks it.
+	bufPtr := p.bytesPool.Get()
+	n := copy(*bufPtr, packet)
+
+	drain.goTracked(func() {
+		defer reqSema.Release()
+
+		p.udpHandlePacket(drain.reqCtx, bufPtr, n, localIP, origDst, remoteAddr, conn, w)
+	})
+
+	return true
+}
+
+// logUDPReadError logs the error of reading from conn, which stops the packet
+// loop.
+func (p *Proxy) logUDPReadError(conn *net.UDPConn, err error, drain *drainer) {
+	if errors.Is(err, net.ErrClosed) || drain.draining() {
+		p.logger.Debug("udp connection closed", "addr", conn.LocalAddr())
+	} else {
+		p.logger.Error("reading from udp", slogutil.KeyError, err)
+	}
+}
+
+// udpHandlePacket processes the incoming UDP packet, which is the first n
+// bytes of *bufPtr, and sends a DNS response using w, if not nil.  bufPtr is
+// returned to [Proxy.bytesPool] once the packet is unpacked.  ctx is the
+// context of the request.
+func (p *Proxy) udpHandlePacket(
+	ctx context.Context,
+	bufPtr *[]byte,
+	n int,
+	localIP netip.Addr,
+	origDst netip.AddrPort,
 	remoteAddr *net.UDPAddr,
 	conn *net.UDPConn,
+	w *udpBatchWriter,
 ) {
-	log.Debug("dnsproxy: handling new udp packet from %s", remoteAddr)
+	addr := netutil.NetAddrToAddrPort(remoteAddr)
+	p.logger.Debug("handling new udp packet", "raddr", p.anonymizer.addrPort(addr))
 
-	req := &dns.Msg{}
-	err := req.Unpack(packet)
+	req, ts, err := p.unpackRequest((*bufPtr)[:n])
+	p.bytesPool.Put(bufPtr)
 	if err != nil {
-		log.Error("dnsproxy: unpacking udp packet: %s", err)
+		p.logger.Error("unpacking udp packet", slogutil.KeyError, err)
 
 		return
 	}
 
 	d := p.newDNSContext(ProtoUDP, req)
-	d.Addr = netutil.NetAddrToAddrPort(remoteAddr)
+	d.ctx = ctx
+	d.tsig = ts
+	d.Addr = addr
 	d.Conn = conn
 	d.localIP = localIP
+	d.OrigDst = origDst
+	d.udpWriter = w
 
 	err = p.handleDNSRequest(d)
 	if err != nil {
-		log.Debug("dnsproxy: handling dns (proto %s) request: %s", d.Proto, err)
+		p.logger.Debug("handling dns request", "proto", d.Proto, slogutil.KeyError, err)
 	}
+
+	p.releaseDNSContext(d)
 }
 
 // Writes a response to the UDP client
@@ -143,14 +279,45 @@ func (p *Proxy) respondUDP(d *DNSContext) error {
 		return nil
 	}
 
-	bytes, err := resp.Pack()
+	bufPtr := p.bytesPool.Get()
+	defer p.bytesPool.Put(bufPtr)
+
+	bytes, err := packResponse(d, resp, *bufPtr)
 	if err != nil {
 		return fmt.Errorf("packing message: %w", err)
 	}
 
-	conn := d.Conn.(*net.UDPConn)
+	return p.writeUDP(d, bytes)
+}
+
+// writeUDP writes the packed response b to the UDP client of d.
+func (p *Proxy) writeUDP(d *DNSContext, b []byte) (err error) {
 	rAddr := net.UDPAddrFromAddrPort(d.Addr)
-	n, err := proxynetutil.UDPWrite(bytes, conn, rAddr, d.localIP)
+	if d.udpWriter != nil {
+		err = d.udpWriter.write(proxynetutil.UDPMessage{
+			RemoteAddr: rAddr,
+			Buf:        b,
+			LocalIP:    d.localIP,
+		})
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			return fmt.Errorf("writing message: %w", err)
+		}
+
+		return nil
+	}
+
+	conn := d.Conn.(*net.UDPConn)
+	if d.OrigDst.IsValid() && d.OrigDst.Port() != netutil.NetAddrToAddrPort(conn.LocalAddr()).Port() {
+		// The listening socket can only write from its own port.
+		err = proxynetutil.UDPWriteFrom(b, d.OrigDst, rAddr)
+		if err != nil {
+			return fmt.Errorf("writing message from original destination: %w", err)
+		}
+
+		return nil
+	}
+
+	n, err := proxynetutil.UDPWrite(b, conn, rAddr, d.localIP)
 	if err != nil {
 		if errors.Is(err, net.ErrClosed) {
 			return nil
@@ -159,8 +326,8 @@ func (p *Proxy) respondUDP(d *DNSContext) error {
 		return fmt.Errorf("writing message: %w", err)
 	}
 
-	if n != len(bytes) {
-		return fmt.Errorf("udpWrite() returned with %d != %d", n, len(bytes))
+	if n != len(b) {
+		return fmt.Errorf("udpWrite() returned with %d != %d", n, len(b))
 	}
 
 	return nil
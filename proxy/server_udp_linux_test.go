@@ -0,0 +1,77 @@
+//go:build linux
+
+package proxy
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	proxynetutil "github.com/AdguardTeam/dnsproxy/internal/netutil"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUdpProxy_offload(t *testing.T) {
+	p := mustStartDefaultProxy(t)
+
+	conn, err := net.ListenUDP("udp", net.UDPAddrFromAddrPort(localhostAnyPort))
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, conn.Close)
+
+	require.NoError(t, proxynetutil.UDPSetOptions(conn))
+
+	bc, ok := proxynetutil.NewUDPBatchConn(conn, proxynetutil.UDPGetOOBSize())
+	require.True(t, ok)
+
+	// The queries of the same size to the same address are sent as a single
+	// message if the segmentation offload is supported.
+	const num = 4
+
+	proxyAddr := p.Addr(ProtoUDP).(*net.UDPAddr)
+	out := make([]proxynetutil.UDPMessage, 0, num)
+	for i := range num {
+		req := newHostTestMessage("offload.example")
+		req.Id = uint16(i + 1)
+
+		var b []byte
+		b, err = req.Pack()
+		require.NoError(t, err)
+
+		out = append(out, proxynetutil.UDPMessage{
+			RemoteAddr: proxyAddr,
+			Buf:        b,
+		})
+	}
+
+	n, err := bc.WriteBatch(out)
+	require.NoError(t, err)
+	require.Equal(t, num, n)
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(defaultTimeout)))
+
+	ids := map[uint16]struct{}{}
+	msgs := make([]proxynetutil.UDPMessage, proxynetutil.UDPBatchSize)
+	for i := range msgs {
+		msgs[i].Buf = make([]byte, dns.MaxMsgSize)
+	}
+
+	for len(ids) < num {
+		n, err = bc.ReadBatch(msgs)
+		require.NoError(t, err)
+
+		for _, msg := range msgs[:n] {
+			for _, dg := range msg.Datagrams() {
+				resp := &dns.Msg{}
+				require.NoError(t, resp.Unpack(dg))
+				require.Len(t, resp.Answer, 1)
+
+				ids[resp.Id] = struct{}{}
+			}
+		}
+	}
+
+	assert.Len(t, ids, num)
+}
@@ -17,3 +17,7 @@ func TestUdpProxy(t *testing.T) {
 
 	sendTestMessages(t, conn)
 }
+
+func BenchmarkUdpProxy(b *testing.B) {
+	benchmarkExchange(b, startBenchProxy(b, nil), ProtoUDP)
+}
@@ -0,0 +1,158 @@
+package proxy
+
+import (
+	"encoding/binary"
+
+	"github.com/miekg/dns"
+)
+
+// staticReply is the precompiled wire format of a response, which only depends
+// on the ID, the opcode, the flags, the question, and the OPT RR of the
+// request, such as the responses to the ratelimited requests.  It's written by
+// [Proxy.writeStaticReply] without constructing and packing a message.
+type staticReply struct {
+	// ede is the packed EDNS option with the extended DNS error, see RFC 8914.
+	// It's added within the OPT RR to the responses to the requests having
+	// one.  If nil, the responses have no OPT RR.
+	ede []byte
+
+	// flags are the flags of the header of the response, except for the ones
+	// copied from the request.
+	flags uint16
+}
+
+// newStaticReply returns a new precompiled response with rcode and the extra
+// flags to the header.  If ede is not nil, it's added to the responses to the
+// requests with EDNS.
+func newStaticReply(rcode int, flags uint16, ede *dns.EDNS0_EDE) (r *staticReply) {
+	r = &staticReply{
+		flags: flagQR | flags | uint16(rcode)&rcodeMask,
+	}
+
+	if ede != nil {
+		r.ede = binary.BigEndian.AppendUint16(nil, dns.EDNS0EDE)
+		r.ede = binary.BigEndian.AppendUint16(r.ede, uint16(2+len(ede.ExtraText)))
+		r.ede = binary.BigEndian.AppendUint16(r.ede, ede.InfoCode)
+		r.ede = append(r.ede, ede.ExtraText...)
+	}
+
+	return r
+}
+
+// appendTo writes the response to req into b, which must be large enough to
+// hold any DNS message, and returns the written part.  ok is false if the
+// response can't be written, e.g. if req doesn't have exactly one question.
+func (r *staticReply) appendTo(b []byte, req *dns.Msg) (res []byte, ok bool) {
+	if len(req.Question) != 1 {
+		return nil, false
+	}
+
+	flags := r.flags | uint16(req.Opcode)<<opcodeShift
+	if req.Opcode == dns.OpcodeQuery {
+		// Copy the bits just like [dns.Msg.SetReply] does.
+		if req.RecursionDesired {
+			flags |= flagRD
+		}
+
+		if req.CheckingDisabled {
+			flags |= flagCD
+		}
+	}
+
+	clear(b[:dnsHeaderLen])
+	binary.BigEndian.PutUint16(b, req.Id)
+	binary.BigEndian.PutUint16(b[2:], flags)
+	binary.BigEndian.PutUint16(b[4:], 1)
+
+	q := req.Question[0]
+	off, err := dns.PackDomainName(q.Name, b, dnsHeaderLen, nil, false)
+	if err != nil {
+		return nil, false
+	}
+
+	binary.BigEndian.PutUint16(b[off:], q.Qtype)
+	binary.BigEndian.PutUint16(b[off+2:], q.Qclass)
+	res = b[:off+4]
+
+	opt := req.IsEdns0()
+	if r.ede == nil || opt == nil {
+		return res, true
+	}
+
+	res = appendOPT(res, opt.UDPSize(), opt.Do())
+	binary.BigEndian.PutUint16(res[len(res)-2:], uint16(len(r.ede)))
+
+	return append(res, r.ede...), true
+}
+
+// staticReplies are the precompiled responses of the proxy.  The responses
+// depending on [Config.MessageConstructor] are nil unless it's a
+// [DefaultMessageConstructor], since the custom constructors may construct
+// anything.
+type staticReplies struct {
+	// ratelimited is the response to the ratelimited requests, see
+	// [MessageConstructor.NewMsgRatelimited].  It's nil if those are dropped.
+	ratelimited *staticReply
+
+	// overloaded is the SERVFAIL response to the requests exceeding the limits
+	// of the requests in flight, see [Proxy.newMsgOverloaded].
+	overloaded *staticReply
+
+	// truncated is the truncated response to the requests exceeding the limits
+	// of the requests in flight over UDP, see [Proxy.newMsgOverloaded].
+	truncated *staticReply
+}
+
+// newStaticReplies precompiles the responses constructed by m.
+func newStaticReplies(m MessageConstructor) (r staticReplies) {
+	r.truncated = newStaticReply(dns.RcodeSuccess, flagTC, nil)
+
+	c, ok := m.(DefaultMessageConstructor)
+	if !ok {
+		return r
+	}
+
+	if c.RespondRatelimited {
+		var ede *dns.EDNS0_EDE
+		if c.ExtendedErrors {
+			ede = &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeProhibited}
+		}
+
+		r.ratelimited = newStaticReply(dns.RcodeRefused, flagRA, ede)
+	}
+
+	r.overloaded = newStaticReply(dns.RcodeServerFailure, flagRA, &dns.EDNS0_EDE{
+		InfoCode:  dns.ExtendedErrorCodeOther,
+		ExtraText: textOverloaded,
+	})
+
+	return r
+}
+
+// writeStaticReply writes r to the client of d right away, if nothing could
+// observe or change the response on its way to the client, see
+// [Proxy.canWritePacked].  ok is false if the response hasn't been written, in
+// which case it should be constructed as usual.  r may be nil.
+//
+// On success, d.Res is set to the message only containing the header of the
+// written response.
+func (p *Proxy) writeStaticReply(d *DNSContext, r *staticReply) (ok bool) {
+	if r == nil || !p.canWritePacked(d) {
+		return false
+	}
+
+	bufPtr := p.bytesPool.Get()
+	defer p.bytesPool.Put(bufPtr)
+
+	// Reserve the space for the length prefix of TCP.
+	buf := *bufPtr
+	b, ok := r.appendTo(buf[2:], d.Req)
+	if !ok {
+		return false
+	}
+
+	d.Res = packedHeader(b, d.Req)
+	p.writePacked(d, buf, b)
+
+	return true
+}
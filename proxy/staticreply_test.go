@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStaticReply_appendTo(t *testing.T) {
+	c := DefaultMessageConstructor{
+		RespondRatelimited: true,
+		ExtendedErrors:     true,
+	}
+	static := newStaticReplies(c)
+
+	p := &Proxy{messages: c}
+	overloaded := func(req *dns.Msg) (resp *dns.Msg) {
+		return p.newMsgOverloaded(&DNSContext{Proto: ProtoTCP, Req: req})
+	}
+	truncated := func(req *dns.Msg) (resp *dns.Msg) {
+		return p.newMsgOverloaded(&DNSContext{Proto: ProtoUDP, Req: req})
+	}
+
+	replies := []struct {
+		reply *staticReply
+		want  func(req *dns.Msg) (resp *dns.Msg)
+		name  string
+	}{{
+		reply: static.ratelimited,
+		want:  c.NewMsgRatelimited,
+		name:  "ratelimited",
+	}, {
+		reply: static.overloaded,
+		want:  overloaded,
+		name:  "overloaded",
+	}, {
+		reply: static.truncated,
+		want:  truncated,
+		name:  "truncated",
+	}}
+
+	newReq := func(edns, do bool) (req *dns.Msg) {
+		req = newHostTestMessage("ExAmple.ORG")
+		req.CheckingDisabled = true
+		if edns {
+			req.SetEdns0(1232, do)
+		}
+
+		return req
+	}
+
+	requests := []struct {
+		req  *dns.Msg
+		name string
+	}{{
+		req:  newReq(false, false),
+		name: "plain",
+	}, {
+		req:  newReq(true, false),
+		name: "edns",
+	}, {
+		req:  newReq(true, true),
+		name: "do",
+	}, {
+		req: func() (req *dns.Msg) {
+			req = newReq(false, false)
+			req.Opcode = dns.OpcodeNotify
+
+			return req
+		}(),
+		name: "notify",
+	}}
+
+	buf := make([]byte, dns.MaxMsgSize)
+	for _, r := range replies {
+		for _, rc := range requests {
+			t.Run(r.name+"_"+rc.name, func(t *testing.T) {
+				b, ok := r.reply.appendTo(buf, rc.req)
+				require.True(t, ok)
+
+				packed, err := r.want(rc.req).Pack()
+				require.NoError(t, err)
+
+				want, got := &dns.Msg{}, &dns.Msg{}
+				require.NoError(t, want.Unpack(packed))
+				require.NoError(t, got.Unpack(b))
+
+				assert.Equal(t, want, got)
+
+				hdr := packedHeader(b, rc.req)
+				assert.Equal(t, want.MsgHdr, hdr.MsgHdr)
+			})
+		}
+	}
+
+	t.Run("no_question", func(t *testing.T) {
+		_, ok := static.overloaded.appendTo(buf, &dns.Msg{})
+		assert.False(t, ok)
+	})
+
+	t.Run("custom_constructor", func(t *testing.T) {
+		custom := newStaticReplies(struct{ DefaultMessageConstructor }{c})
+		assert.Nil(t, custom.ratelimited)
+		assert.Nil(t, custom.overloaded)
+		assert.NotNil(t, custom.truncated)
+	})
+}
+
+func BenchmarkStaticReply(b *testing.B) {
+	c := DefaultMessageConstructor{RespondRatelimited: true, ExtendedErrors: true}
+	reply := newStaticReplies(c).ratelimited
+
+	req := newHostTestMessage("example.org")
+	req.SetEdns0(1232, false)
+
+	buf := make([]byte, dns.MaxMsgSize)
+
+	b.Run("static", func(b *testing.B) {
+		b.ReportAllocs()
+		for range b.N {
+			_, _ = reply.appendTo(buf, req)
+		}
+	})
+
+	b.Run("msg", func(b *testing.B) {
+		b.ReportAllocs()
+		for range b.N {
+			_, _ = c.NewMsgRatelimited(req).PackBuffer(buf)
+		}
+	})
+}
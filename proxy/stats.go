@@ -0,0 +1,196 @@
+package proxy
+
+import (
+	"expvar"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// statsProtos are the protocols the requests are counted for, in the order of
+// [Stats.queries].
+var statsProtos = [...]Proto{
+	ProtoUDP,
+	ProtoTCP,
+	ProtoTLS,
+	ProtoHTTPS,
+	ProtoQUIC,
+	ProtoDNSCrypt,
+}
+
+// Stats contains the core counters of the proxy, so that the applications
+// embedding it are able to report them without the Prometheus metrics.  All
+// methods are safe for concurrent use.  Use [Proxy.Stats] to get the counters
+// of a proxy.
+type Stats struct {
+	// queries are the numbers of the processed requests by the protocols from
+	// [statsProtos].
+	queries [len(statsProtos)]atomic.Uint64
+
+	// servFails is the number of the requests answered with SERVFAIL.
+	servFails atomic.Uint64
+
+	// dropped is the number of the requests left without a response.
+	dropped atomic.Uint64
+
+	// cacheHits and cacheMisses are the numbers of the cache lookups.
+	cacheHits   atomic.Uint64
+	cacheMisses atomic.Uint64
+
+	// upstreamExchanges and upstreamFailures are the numbers of all and of the
+	// failed exchanges with the upstreams.
+	upstreamExchanges atomic.Uint64
+	upstreamFailures  atomic.Uint64
+
+	// ratelimited is the number of the ratelimited requests.
+	ratelimited atomic.Uint64
+
+	// backoffs are the backoff states of the failing upstreams.  It may be nil.
+	backoffs *upstreamBackoffs
+}
+
+// type check
+var _ MetricsListener = (*Stats)(nil)
+
+// Queries returns the number of the processed requests received over proto.
+func (s *Stats) Queries(proto Proto) (n uint64) {
+	for i, p := range statsProtos {
+		if p == proto {
+			return s.queries[i].Load()
+		}
+	}
+
+	return 0
+}
+
+// TotalQueries returns the number of the processed requests received over all
+// protocols.
+func (s *Stats) TotalQueries() (n uint64) {
+	for i := range s.queries {
+		n += s.queries[i].Load()
+	}
+
+	return n
+}
+
+// ServFails returns the number of the requests answered with SERVFAIL.
+func (s *Stats) ServFails() (n uint64) { return s.servFails.Load() }
+
+// Dropped returns the number of the requests left without a response.
+func (s *Stats) Dropped() (n uint64) { return s.dropped.Load() }
+
+// CacheHits returns the number of the responses served from the cache.
+func (s *Stats) CacheHits() (n uint64) { return s.cacheHits.Load() }
+
+// CacheMisses returns the number of the cache lookups without a response
+// found.
+func (s *Stats) CacheMisses() (n uint64) { return s.cacheMisses.Load() }
+
+// UpstreamExchanges returns the number of the exchanges with the upstreams.
+func (s *Stats) UpstreamExchanges() (n uint64) { return s.upstreamExchanges.Load() }
+
+// UpstreamFailures returns the number of the failed exchanges with the
+// upstreams.
+func (s *Stats) UpstreamFailures() (n uint64) { return s.upstreamFailures.Load() }
+
+// Ratelimited returns the number of the requests dropped due to ratelimiting.
+func (s *Stats) Ratelimited() (n uint64) { return s.ratelimited.Load() }
+
+// UpstreamBackoffs returns the states of the upstreams currently failing in a
+// row, sorted by address, see [Config.UpstreamBackoff].
+func (s *Stats) UpstreamBackoffs() (states []*UpstreamBackoff) { return s.backoffs.list() }
+
+// Var returns the [expvar.Var] reporting the counters as a JSON object, for
+// example to publish them with [expvar.Publish].
+func (s *Stats) Var() (v expvar.Var) {
+	return expvar.Func(func() (val any) {
+		queries := make(map[Proto]uint64, len(statsProtos))
+		for _, p := range statsProtos {
+			queries[p] = s.Queries(p)
+		}
+
+		backoffs := map[string]any{}
+		for _, b := range s.UpstreamBackoffs() {
+			backoffs[b.Address] = map[string]any{
+				"failures": b.Failures,
+				"until":    b.Until,
+			}
+		}
+
+		return map[string]any{
+			"queries":            queries,
+			"servfails":          s.ServFails(),
+			"dropped":            s.Dropped(),
+			"cache_hits":         s.CacheHits(),
+			"cache_misses":       s.CacheMisses(),
+			"upstream_exchanges": s.UpstreamExchanges(),
+			"upstream_failures":  s.UpstreamFailures(),
+			"ratelimited":        s.Ratelimited(),
+			"upstream_backoffs":  backoffs,
+		}
+	})
+}
+
+// OnRequest implements the [MetricsListener] interface for *Stats.
+func (s *Stats) OnRequest(proto Proto, resp *dns.Msg, _ time.Duration) {
+	for i, p := range statsProtos {
+		if p == proto {
+			s.queries[i].Add(1)
+
+			break
+		}
+	}
+
+	switch {
+	case resp == nil:
+		s.dropped.Add(1)
+	case resp.Rcode == dns.RcodeServerFailure:
+		s.servFails.Add(1)
+	default:
+		// Go on.
+	}
+}
+
+// OnCacheLookup implements the [MetricsListener] interface for *Stats.
+func (s *Stats) OnCacheLookup(hit bool) {
+	if hit {
+		s.cacheHits.Add(1)
+	} else {
+		s.cacheMisses.Add(1)
+	}
+}
+
+// OnUpstreamExchange implements the [MetricsListener] interface for *Stats.
+func (s *Stats) OnUpstreamExchange(_ string, _ time.Duration, err error) {
+	s.upstreamExchanges.Add(1)
+	if err != nil {
+		s.upstreamFailures.Add(1)
+	}
+}
+
+// OnRatelimited implements the [MetricsListener] interface for *Stats.
+func (s *Stats) OnRatelimited(_ Proto) {
+	s.ratelimited.Add(1)
+}
+
+// OnConnectionOpened implements the [MetricsListener] interface for *Stats.
+func (s *Stats) OnConnectionOpened(_ Proto) {}
+
+// OnConnectionClosed implements the [MetricsListener] interface for *Stats.
+func (s *Stats) OnConnectionClosed(_ Proto) {}
+
+// newMetricsListener returns the listener reporting the events to s and, if
+// it's not nil, to l.
+func newMetricsListener(s *Stats, l MetricsListener) (m MetricsListener) {
+	if l == nil {
+		return s
+	}
+
+	return MultiMetricsListener{s, l}
+}
+
+// Stats returns the core counters of the proxy.
+func (p *Proxy) Stats() (s *Stats) {
+	return p.stats
+}
@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_Stats(t *testing.T) {
+	ups := &fakeUpstream{
+		onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			if req.Question[0].Name == "fail.example." {
+				return nil, assert.AnError
+			}
+
+			return newCompareTestReply(req, "192.0.2.1", defaultTestTTL), nil
+		},
+		onAddress: func() (addr string) { return "ups" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	p := mustNew(t, &Config{
+		Logger:        testLogger,
+		UDPListenAddr: []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{ups},
+		},
+		TrustedProxies: defaultTrustedProxies,
+		CacheEnabled:   true,
+		CacheSizeBytes: defaultCacheSize,
+	})
+
+	ctx := context.Background()
+	require.NoError(t, p.Start(ctx))
+	testutil.CleanupAndRequireSuccess(t, func() (err error) { return p.Shutdown(ctx) })
+
+	client := &dns.Client{Net: string(ProtoUDP), Timeout: defaultTimeout}
+	addr := p.Addr(ProtoUDP).String()
+
+	for _, host := range []string{"ok.example", "ok.example", "fail.example"} {
+		_, _, err := client.Exchange(newHostTestMessage(host), addr)
+		require.NoError(t, err)
+	}
+
+	s := p.Stats()
+
+	// Make sure the deferred call finished.
+	require.Eventually(t, func() (ok bool) {
+		return s.TotalQueries() == 3
+	}, defaultTimeout, defaultTimeout/100)
+
+	assert.Equal(t, uint64(3), s.Queries(ProtoUDP))
+	assert.Zero(t, s.Queries(ProtoTCP))
+	assert.Equal(t, uint64(1), s.ServFails())
+	assert.Zero(t, s.Dropped())
+	assert.Equal(t, uint64(1), s.CacheHits())
+	assert.Equal(t, uint64(2), s.CacheMisses())
+	assert.Equal(t, uint64(2), s.UpstreamExchanges())
+	assert.Equal(t, uint64(1), s.UpstreamFailures())
+
+	var vars struct {
+		Queries map[Proto]uint64 `json:"queries"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(s.Var().String()), &vars))
+
+	assert.Equal(t, uint64(3), vars.Queries[ProtoUDP])
+}
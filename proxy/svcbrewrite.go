@@ -0,0 +1,290 @@
+package proxy
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/miekg/dns"
+)
+
+// SVCBRewriteConfig is the configuration of the rewriting of the SVCB and HTTPS
+// records in the responses.  Those records carry the addresses and the ECH
+// configurations of the services, which bypass the policies only considering
+// the A and AAAA records.
+//
+// Each field lists the domain names, the responses to the requests for which
+// and for their subdomains are rewritten.  The root domain "." matches all
+// requests.
+type SVCBRewriteConfig struct {
+	// StripECHDomains are the domains, for which the ech parameter is removed
+	// from the records.
+	StripECHDomains []string
+
+	// StripIPv4HintDomains are the domains, for which the ipv4hint parameter
+	// is removed from the records.
+	StripIPv4HintDomains []string
+
+	// StripIPv6HintDomains are the domains, for which the ipv6hint parameter
+	// is removed from the records.
+	StripIPv6HintDomains []string
+
+	// DropDomains are the domains, for which the records are removed from the
+	// responses entirely.
+	DropDomains []string
+}
+
+// validate returns an error if c is invalid.  c may be nil.
+func (c *SVCBRewriteConfig) validate() (err error) {
+	if c == nil {
+		return nil
+	}
+
+	for _, f := range []struct {
+		name    string
+		domains []string
+	}{{
+		name:    "strip ech domains",
+		domains: c.StripECHDomains,
+	}, {
+		name:    "strip ipv4hint domains",
+		domains: c.StripIPv4HintDomains,
+	}, {
+		name:    "strip ipv6hint domains",
+		domains: c.StripIPv6HintDomains,
+	}, {
+		name:    "drop domains",
+		domains: c.DropDomains,
+	}} {
+		err = validateSVCBDomains(f.domains)
+		if err != nil {
+			return fmt.Errorf("%s: %w", f.name, err)
+		}
+	}
+
+	return nil
+}
+
+// validateSVCBDomains returns an error if any of domains is invalid.  The root
+// domain is valid.
+func validateSVCBDomains(domains []string) (err error) {
+	for i, d := range domains {
+		if d == "." {
+			continue
+		}
+
+		err = netutil.ValidateDomainName(strings.TrimSuffix(d, "."))
+		if err != nil {
+			return fmt.Errorf("domain at index %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+// svcbDomains is a set of the lowercased FQDNs matching themselves and their
+// subdomains.
+type svcbDomains map[string]struct{}
+
+// newSVCBDomains returns a new set of domains.  It returns nil if domains are
+// empty.
+func newSVCBDomains(domains []string) (s svcbDomains) {
+	if len(domains) == 0 {
+		return nil
+	}
+
+	s = make(svcbDomains, len(domains))
+	for _, d := range domains {
+		s[dns.Fqdn(strings.ToLower(d))] = struct{}{}
+	}
+
+	return s
+}
+
+// match returns true if the lowercased FQDN name is one of s or their
+// subdomains.
+func (s svcbDomains) match(name string) (ok bool) {
+	if len(s) == 0 {
+		return false
+	}
+
+	if _, ok = s["."]; ok {
+		return true
+	}
+
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if _, ok = s[name[off:]]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// svcbRewriter rewrites the SVCB and HTTPS records in the responses, see
+// [Config.SVCBRewrite].  A nil *svcbRewriter rewrites nothing.
+type svcbRewriter struct {
+	// stripECH are the domains to remove the ech parameter for.
+	stripECH svcbDomains
+
+	// stripIPv4Hint are the domains to remove the ipv4hint parameter for.
+	stripIPv4Hint svcbDomains
+
+	// stripIPv6Hint are the domains to remove the ipv6hint parameter for.
+	stripIPv6Hint svcbDomains
+
+	// drop are the domains to remove the records for.
+	drop svcbDomains
+}
+
+// newSVCBRewriter returns a new rewriter for conf.  It returns nil if conf is
+// nil.
+func newSVCBRewriter(conf *SVCBRewriteConfig) (r *svcbRewriter) {
+	if conf == nil {
+		return nil
+	}
+
+	return &svcbRewriter{
+		stripECH:      newSVCBDomains(conf.StripECHDomains),
+		stripIPv4Hint: newSVCBDomains(conf.StripIPv4HintDomains),
+		stripIPv6Hint: newSVCBDomains(conf.StripIPv6HintDomains),
+		drop:          newSVCBDomains(conf.DropDomains),
+	}
+}
+
+// match returns true if any of the rules of r applies to the FQDN qname.  r
+// may be nil.
+func (r *svcbRewriter) match(qname string) (ok bool) {
+	if r == nil {
+		return false
+	}
+
+	qname = strings.ToLower(qname)
+
+	return r.drop.match(qname) ||
+		r.stripECH.match(qname) ||
+		r.stripIPv4Hint.match(qname) ||
+		r.stripIPv6Hint.match(qname)
+}
+
+// rewrite rewrites the SVCB and HTTPS records of resp to the request for the
+// FQDN qname.  resp must not be nil.
+func (r *svcbRewriter) rewrite(resp *dns.Msg, qname string) {
+	if r == nil {
+		return
+	}
+
+	qname = strings.ToLower(qname)
+	drop := r.drop.match(qname)
+
+	var keys []dns.SVCBKey
+	if r.stripECH.match(qname) {
+		keys = append(keys, dns.SVCB_ECHCONFIG)
+	}
+
+	if r.stripIPv4Hint.match(qname) {
+		keys = append(keys, dns.SVCB_IPV4HINT)
+	}
+
+	if r.stripIPv6Hint.match(qname) {
+		keys = append(keys, dns.SVCB_IPV6HINT)
+	}
+
+	if !drop && len(keys) == 0 {
+		return
+	}
+
+	var ansChanged, extraChanged bool
+	resp.Answer, ansChanged = rewriteSVCBRecords(resp.Answer, keys, drop)
+	resp.Extra, extraChanged = rewriteSVCBRecords(resp.Extra, keys, drop)
+	if ansChanged || extraChanged {
+		// The rewritten records don't match the signatures anymore.
+		resp.AuthenticatedData = false
+	}
+}
+
+// rewriteSVCBRecords removes the SVCB and HTTPS records from rrs, if drop is
+// true, or the parameters with keys from those otherwise.  The signatures of
+// the changed records are removed as well.  changed is true if any record has
+// been changed.
+func rewriteSVCBRecords(rrs []dns.RR, keys []dns.SVCBKey, drop bool) (res []dns.RR, changed bool) {
+	res = slices.DeleteFunc(rrs, func(rr dns.RR) (del bool) {
+		svcb := svcbOf(rr)
+		if svcb == nil {
+			return false
+		}
+
+		if drop {
+			changed = true
+
+			return true
+		}
+
+		changed = stripSVCBKeys(svcb, keys) || changed
+
+		return false
+	})
+
+	if !changed {
+		return res, false
+	}
+
+	res = slices.DeleteFunc(res, func(rr dns.RR) (del bool) {
+		sig, ok := rr.(*dns.RRSIG)
+
+		return ok && (sig.TypeCovered == dns.TypeSVCB || sig.TypeCovered == dns.TypeHTTPS)
+	})
+
+	return res, true
+}
+
+// svcbOf returns the SVCB data of rr, if it's an SVCB or HTTPS record, and nil
+// otherwise.
+func svcbOf(rr dns.RR) (svcb *dns.SVCB) {
+	switch rr := rr.(type) {
+	case *dns.SVCB:
+		return rr
+	case *dns.HTTPS:
+		return &rr.SVCB
+	default:
+		return nil
+	}
+}
+
+// stripSVCBKeys removes the parameters with keys from svcb, including those in
+// its mandatory parameter.  It returns true if any parameter has been removed.
+func stripSVCBKeys(svcb *dns.SVCB, keys []dns.SVCBKey) (changed bool) {
+	svcb.Value = slices.DeleteFunc(svcb.Value, func(kv dns.SVCBKeyValue) (del bool) {
+		if slices.Contains(keys, kv.Key()) {
+			changed = true
+
+			return true
+		}
+
+		mandatory, ok := kv.(*dns.SVCBMandatory)
+		if !ok {
+			return false
+		}
+
+		l := len(mandatory.Code)
+		mandatory.Code = slices.DeleteFunc(mandatory.Code, func(k dns.SVCBKey) (del bool) {
+			return slices.Contains(keys, k)
+		})
+		changed = changed || len(mandatory.Code) != l
+
+		return len(mandatory.Code) == 0
+	})
+
+	return changed
+}
+
+// rewriteSVCB rewrites the SVCB and HTTPS records of dctx.Res according to
+// [Config.SVCBRewrite].
+func (p *Proxy) rewriteSVCB(dctx *DNSContext) {
+	if dctx.Res == nil || len(dctx.Req.Question) == 0 {
+		return
+	}
+
+	p.svcbRewriter.rewrite(dctx.Res, dctx.Req.Question[0].Name)
+}
@@ -0,0 +1,210 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// svcbTestRdata is the data of the HTTPS records returned by the upstream from
+// [newSVCBTestUpstream].
+const svcbTestRdata = "1 . mandatory=ipv4hint,ech alpn=h2 ipv4hint=192.0.2.1 " +
+	"ipv6hint=2001:db8::1 ech=AEj+DQBEAQAgACAdd+scUi0IYFsXnUIU7ko2Nd9+F8M26pAGZVpz/KrWPgAE" +
+	"AAEAAWQVZWNoLXNpdGVzLmV4YW1wbGUubmV0AAA="
+
+// newSVCBTestUpstream returns a new upstream responding with the signed HTTPS
+// record with [svcbTestRdata].
+func newSVCBTestUpstream() (ups *fakeUpstream) {
+	return &fakeUpstream{
+		onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			resp = (&dns.Msg{}).SetReply(req)
+			resp.AuthenticatedData = true
+
+			name := req.Question[0].Name
+			rr, err := dns.NewRR(name + " 60 IN HTTPS " + svcbTestRdata)
+			if err != nil {
+				return nil, err
+			}
+
+			sig := &dns.RRSIG{
+				Hdr: dns.RR_Header{
+					Name:   name,
+					Rrtype: dns.TypeRRSIG,
+					Class:  dns.ClassINET,
+					Ttl:    60,
+				},
+				TypeCovered: dns.TypeHTTPS,
+			}
+			resp.Answer = append(resp.Answer, rr, sig)
+
+			return resp, nil
+		},
+		onAddress: func() (addr string) { return "fake.address" },
+		onClose:   func() (err error) { return nil },
+	}
+}
+
+func TestProxy_rewriteSVCB(t *testing.T) {
+	const rdata = svcbTestRdata
+
+	ups := newSVCBTestUpstream()
+
+	p := mustNew(t, &Config{
+		Logger:         testLogger,
+		UDPListenAddr:  []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig: &UpstreamConfig{Upstreams: []upstream.Upstream{ups}},
+		TrustedProxies: defaultTrustedProxies,
+		SVCBRewrite: &SVCBRewriteConfig{
+			StripECHDomains:      []string{"ech.example"},
+			StripIPv4HintDomains: []string{"hints.example"},
+			StripIPv6HintDomains: []string{"hints.example", "v6.example"},
+			DropDomains:          []string{"drop.example"},
+		},
+	})
+
+	testCases := []struct {
+		name      string
+		host      string
+		wantRdata string
+		wantAD    bool
+	}{{
+		name:      "unmatched",
+		host:      "other.example",
+		wantRdata: rdata,
+		wantAD:    true,
+	}, {
+		name: "ech",
+		host: "www.ech.example",
+		wantRdata: "1 . mandatory=ipv4hint alpn=\"h2\" ipv4hint=\"192.0.2.1\" " +
+			"ipv6hint=\"2001:db8::1\"",
+		wantAD: false,
+	}, {
+		name:      "hints",
+		host:      "hints.example",
+		wantRdata: "1 . mandatory=ech alpn=\"h2\" ech=\"" + rdata[strings.Index(rdata, "ech=")+4:] + "\"",
+		wantAD:    false,
+	}, {
+		name: "ipv6hint",
+		host: "v6.example",
+		wantRdata: "1 . mandatory=ipv4hint,ech alpn=\"h2\" ipv4hint=\"192.0.2.1\" ech=\"" +
+			rdata[strings.Index(rdata, "ech=")+4:] + "\"",
+		wantAD: false,
+	}, {
+		name:      "drop",
+		host:      "drop.example",
+		wantRdata: "",
+		wantAD:    false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := newHostTestMessage(tc.host)
+			req.Question[0].Qtype = dns.TypeHTTPS
+			req.SetEdns0(defaultUDPBufSize, true)
+
+			d := &DNSContext{Req: req}
+			require.NoError(t, p.Resolve(d))
+
+			assert.Equal(t, tc.wantAD, d.Res.AuthenticatedData)
+
+			if tc.wantRdata == "" {
+				assert.Empty(t, d.Res.Answer)
+
+				return
+			}
+
+			rrs := d.Res.Answer
+			if tc.wantAD {
+				require.Len(t, rrs, 2)
+			} else {
+				// The signature of the rewritten record is removed.
+				require.Len(t, rrs, 1)
+			}
+
+			https := testutil.RequireTypeAssert[*dns.HTTPS](t, rrs[0])
+			wantRR, err := dns.NewRR(https.Hdr.Name + " 60 IN HTTPS " + tc.wantRdata)
+			require.NoError(t, err)
+
+			assert.Equal(t, wantRR.String(), https.String())
+		})
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := New(&Config{
+			UDPListenAddr:  []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+			UpstreamConfig: &UpstreamConfig{Upstreams: []upstream.Upstream{ups}},
+			TrustedProxies: defaultTrustedProxies,
+			SVCBRewrite: &SVCBRewriteConfig{
+				DropDomains: []string{".", "bad domain"},
+			},
+		})
+		testutil.AssertErrorMsg(
+			t,
+			"validating svcb rewrite: drop domains: domain at index 1: "+
+				`bad domain name "bad domain": bad top-level domain name label "bad domain": `+
+				`bad top-level domain name label rune ' '`,
+			err,
+		)
+	})
+}
+
+func TestProxy_rewriteSVCB_cached(t *testing.T) {
+	p := mustNew(t, &Config{
+		Logger:         testLogger,
+		UDPListenAddr:  []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		TCPListenAddr:  []*net.TCPAddr{net.TCPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig: &UpstreamConfig{Upstreams: []upstream.Upstream{newSVCBTestUpstream()}},
+		TrustedProxies: defaultTrustedProxies,
+		CacheEnabled:   true,
+		CacheSizeBytes: testCacheSize,
+		SVCBRewrite: &SVCBRewriteConfig{
+			StripECHDomains: []string{"ech.example"},
+			DropDomains:     []string{"drop.example"},
+		},
+	})
+
+	ctx := context.Background()
+	require.NoError(t, p.Start(ctx))
+	testutil.CleanupAndRequireSuccess(t, func() (err error) { return p.Shutdown(ctx) })
+
+	for _, proto := range []Proto{ProtoUDP, ProtoTCP} {
+		client := &dns.Client{Net: string(proto), Timeout: defaultTimeout}
+		addr := p.Addr(proto).String()
+
+		t.Run(string(proto), func(t *testing.T) {
+			newReq := func(host string) (req *dns.Msg) {
+				req = (&dns.Msg{}).SetQuestion(dns.Fqdn(host), dns.TypeHTTPS)
+				req.SetEdns0(defaultUDPBufSize, true)
+
+				return req
+			}
+
+			// The second responses are served from the cache.
+			for range 2 {
+				resp, _, err := client.Exchange(newReq("drop.example"), addr)
+				require.NoError(t, err)
+
+				assert.Empty(t, resp.Answer)
+
+				resp, _, err = client.Exchange(newReq("www.ech.example"), addr)
+				require.NoError(t, err)
+
+				require.Len(t, resp.Answer, 1)
+				assert.NotContains(t, resp.Answer[0].String(), "ech=")
+
+				resp, _, err = client.Exchange(newReq("other.example"), addr)
+				require.NoError(t, err)
+
+				require.Len(t, resp.Answer, 2)
+				assert.Contains(t, resp.Answer[0].String(), "ech=")
+			}
+		})
+	}
+}
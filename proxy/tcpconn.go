@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"fmt"
+	"time"
+)
+
+// TCPConnConfig is the configuration of the connections accepted by a TCP or a
+// TLS listener.  The limits are applied to each listener separately.
+type TCPConnConfig struct {
+	// IdleTimeout is the maximum duration of waiting for the next query on a
+	// connection.  Zero means the default of 10 seconds.
+	IdleTimeout time.Duration
+
+	// ReadTimeout is the maximum duration of reading a query once its length
+	// is received, so that the slow clients can't hold the connections
+	// forever.  Zero means the default of 10 seconds.
+	ReadTimeout time.Duration
+
+	// MaxConns is the maximum number of the connections handled
+	// simultaneously.  The connections exceeding it are closed right away.
+	// Zero means no limit.
+	MaxConns uint
+
+	// MaxConnsPerIP is the maximum number of the connections from a single
+	// client address handled simultaneously.  The connections exceeding it are
+	// closed right away.  Zero means no limit.
+	MaxConnsPerIP uint
+
+	// MaxQueriesPerConn is the maximum number of the queries read from a
+	// single connection, after which it's closed once the queries are
+	// answered.  Zero means no limit.
+	MaxQueriesPerConn uint
+
+	// MaxWorkers is the maximum number of the goroutines handling the queries
+	// received over all the connections simultaneously.  The connections stop
+	// reading the queries while all of them are busy.  Zero means the default
+	// of 1024.
+	MaxWorkers uint
+}
+
+// validate returns an error if c is invalid.  c may be nil.
+func (c *TCPConnConfig) validate() (err error) {
+	switch {
+	case c == nil:
+		return nil
+	case c.IdleTimeout < 0:
+		return fmt.Errorf("idle timeout: negative value %s", c.IdleTimeout)
+	case c.ReadTimeout < 0:
+		return fmt.Errorf("read timeout: negative value %s", c.ReadTimeout)
+	default:
+		return nil
+	}
+}
+
+// idleTimeout returns the maximum duration of waiting for the next query.  c
+// may be nil.
+func (c *TCPConnConfig) idleTimeout() (d time.Duration) {
+	if c == nil || c.IdleTimeout == 0 {
+		return defaultTimeout
+	}
+
+	return c.IdleTimeout
+}
+
+// readTimeout returns the maximum duration of reading a query.  c may be nil.
+func (c *TCPConnConfig) readTimeout() (d time.Duration) {
+	if c == nil || c.ReadTimeout == 0 {
+		return defaultTimeout
+	}
+
+	return c.ReadTimeout
+}
+
+// maxQueries returns the maximum number of the queries read from a single
+// connection, zero meaning no limit.  c may be nil.
+func (c *TCPConnConfig) maxQueries() (n uint) {
+	if c == nil {
+		return 0
+	}
+
+	return c.MaxQueriesPerConn
+}
+
+// maxWorkers returns the maximum number of the goroutines handling the queries.
+// c may be nil.
+func (c *TCPConnConfig) maxWorkers() (n uint) {
+	if c == nil || c.MaxWorkers == 0 {
+		return defaultTCPWorkers
+	}
+
+	return c.MaxWorkers
+}
+
+// newConnTracker returns the tracker of the connections accepted by a single
+// listener configured with c.  c may be nil.  t is nil if the connections
+// aren't limited.
+func (c *TCPConnConfig) newConnTracker() (t *inflightTracker) {
+	if c == nil {
+		return nil
+	}
+
+	return newInflightTracker(c.MaxConns, c.MaxConnsPerIP)
+}
+
+// tcpConnConfig returns the configuration of the connections for proto, which
+// must be either [ProtoTCP] or [ProtoTLS].  c may be nil.
+func (p *Proxy) tcpConnConfig(proto Proto) (c *TCPConnConfig) {
+	if proto == ProtoTLS {
+		return p.TLSConn
+	}
+
+	return p.TCPConn
+}
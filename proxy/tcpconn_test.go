@@ -0,0 +1,161 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTCPConnConfig_validate(t *testing.T) {
+	testCases := []struct {
+		conf       *TCPConnConfig
+		name       string
+		wantErrMsg string
+	}{{
+		conf:       nil,
+		name:       "nil",
+		wantErrMsg: "",
+	}, {
+		conf:       &TCPConnConfig{IdleTimeout: time.Second, MaxConns: 10},
+		name:       "valid",
+		wantErrMsg: "",
+	}, {
+		conf:       &TCPConnConfig{IdleTimeout: -time.Second},
+		name:       "negative_idle",
+		wantErrMsg: "idle timeout: negative value -1s",
+	}, {
+		conf:       &TCPConnConfig{ReadTimeout: -time.Second},
+		name:       "negative_read",
+		wantErrMsg: "read timeout: negative value -1s",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, tc.conf.validate())
+		})
+	}
+}
+
+// startTCPConnTestProxy starts a new proxy with a TCP listener configured with
+// c and returns its address.
+func startTCPConnTestProxy(t *testing.T, c *TCPConnConfig) (addr string) {
+	t.Helper()
+
+	u := newProfileTestUpstream("192.0.2.1")
+	p := mustNew(t, &Config{
+		Logger:                 testLogger,
+		TCPListenAddr:          []*net.TCPAddr{net.TCPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig:         &UpstreamConfig{Upstreams: []upstream.Upstream{u}},
+		TrustedProxies:         defaultTrustedProxies,
+		TCPConn:                c,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+	})
+
+	ctx := context.Background()
+	require.NoError(t, p.Start(ctx))
+	testutil.CleanupAndRequireSuccess(t, func() (err error) { return p.Shutdown(ctx) })
+
+	return p.Addr(ProtoTCP).String()
+}
+
+// dialTCPConnTest returns a new DNS connection to addr closed on cleanup.
+func dialTCPConnTest(t *testing.T, addr string) (conn *dns.Conn) {
+	t.Helper()
+
+	conn, err := dns.Dial("tcp", addr)
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, func() (err error) {
+		err = conn.Close()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+
+		return err
+	})
+
+	require.NoError(t, conn.SetDeadline(time.Now().Add(defaultTimeout)))
+
+	return conn
+}
+
+// exchangeTCPConnTest sends a query over conn and returns the error of reading
+// the response.
+func exchangeTCPConnTest(t *testing.T, conn *dns.Conn) (err error) {
+	t.Helper()
+
+	req := newHostTestMessage("example.org")
+	require.NoError(t, conn.WriteMsg(req))
+
+	_, err = conn.ReadMsg()
+
+	return err
+}
+
+func TestProxy_tcpConn(t *testing.T) {
+	t.Run("max_conns_per_ip", func(t *testing.T) {
+		addr := startTCPConnTestProxy(t, &TCPConnConfig{MaxConnsPerIP: 1})
+
+		first := dialTCPConnTest(t, addr)
+		require.NoError(t, exchangeTCPConnTest(t, first))
+
+		second := dialTCPConnTest(t, addr)
+		assert.Error(t, exchangeTCPConnTest(t, second))
+
+		require.NoError(t, exchangeTCPConnTest(t, first))
+	})
+
+	t.Run("max_queries_per_conn", func(t *testing.T) {
+		addr := startTCPConnTestProxy(t, &TCPConnConfig{MaxQueriesPerConn: 2})
+
+		conn := dialTCPConnTest(t, addr)
+		require.NoError(t, exchangeTCPConnTest(t, conn))
+		require.NoError(t, exchangeTCPConnTest(t, conn))
+
+		assert.Error(t, exchangeTCPConnTest(t, conn))
+	})
+
+	t.Run("max_workers", func(t *testing.T) {
+		const queriesNum = 10
+
+		addr := startTCPConnTestProxy(t, &TCPConnConfig{MaxWorkers: 1})
+
+		conn := dialTCPConnTest(t, addr)
+		for i := range queriesNum {
+			req := newHostTestMessage("example.org")
+			req.Id = uint16(i)
+			require.NoError(t, conn.WriteMsg(req))
+		}
+
+		ids := map[uint16]struct{}{}
+		for range queriesNum {
+			resp, err := conn.ReadMsg()
+			require.NoError(t, err)
+
+			ids[resp.Id] = struct{}{}
+		}
+
+		assert.Len(t, ids, queriesNum)
+	})
+
+	t.Run("idle_timeout", func(t *testing.T) {
+		const idleTimeout = 100 * time.Millisecond
+
+		addr := startTCPConnTestProxy(t, &TCPConnConfig{IdleTimeout: idleTimeout})
+
+		conn := dialTCPConnTest(t, addr)
+		require.NoError(t, exchangeTCPConnTest(t, conn))
+
+		time.Sleep(2 * idleTimeout)
+
+		assert.Error(t, exchangeTCPConnTest(t, conn))
+	})
+}
@@ -0,0 +1,275 @@
+package proxy
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/syncutil"
+)
+
+// defaultTCPWorkers is the default maximum number of the workers handling the
+// queries received over the connections of a single TCP or TLS listener.
+const defaultTCPWorkers = 1024
+
+// tcpWorkerIdleTimeout is the duration an idle worker waits for the next query
+// before exiting.
+const tcpWorkerIdleTimeout = 10 * time.Second
+
+// tcpWorkerPool is the pool of the goroutines handling the queries received
+// over the connections of a single TCP or TLS listener.  The workers are
+// reused for the subsequent queries and are only started when all the running
+// ones are busy, so that the connections don't start a goroutine per query.
+type tcpWorkerPool struct {
+	// logger is used to log the panics of the jobs.  It's never nil.
+	logger *slog.Logger
+
+	// jobs are the jobs waiting for an idle worker.
+	jobs chan func()
+
+	// slots limits the number of the running workers.
+	slots chan struct{}
+
+	// done is closed when the pool is closed.
+	done chan struct{}
+
+	// wg counts the running workers.
+	wg *sync.WaitGroup
+}
+
+// newTCPWorkerPool returns a new properly initialized *tcpWorkerPool running
+// at most maxWorkers workers, which must be positive.  l must not be nil.
+func newTCPWorkerPool(maxWorkers uint, l *slog.Logger) (wp *tcpWorkerPool) {
+	return &tcpWorkerPool{
+		logger: l,
+		jobs:   make(chan func()),
+		slots:  make(chan struct{}, maxWorkers),
+		done:   make(chan struct{}),
+		wg:     &sync.WaitGroup{},
+	}
+}
+
+// submit runs job in an idle worker or in a new one, if there are no idle
+// workers and the limit isn't reached.  Otherwise, it waits for a worker to get
+// idle.  err is only returned if ctx is done before that.
+func (wp *tcpWorkerPool) submit(ctx context.Context, job func()) (err error) {
+	// Prefer the idle workers to starting the new ones.
+	select {
+	case wp.jobs <- job:
+		return nil
+	default:
+		// Go on.
+	}
+
+	select {
+	case wp.jobs <- job:
+		return nil
+	case wp.slots <- struct{}{}:
+		wp.wg.Add(1)
+		go wp.work(job)
+
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// work runs job and then the subsequent jobs until it's idle for
+// [tcpWorkerIdleTimeout] or the pool is closed.  It's intended to be used as a
+// goroutine.
+func (wp *tcpWorkerPool) work(job func()) {
+	defer wp.wg.Done()
+	defer func() { <-wp.slots }()
+
+	timer := time.NewTimer(tcpWorkerIdleTimeout)
+	defer timer.Stop()
+
+	stopTimer(timer)
+	for {
+		wp.run(job)
+
+		timer.Reset(tcpWorkerIdleTimeout)
+		select {
+		case job = <-wp.jobs:
+			stopTimer(timer)
+		case <-timer.C:
+			return
+		case <-wp.done:
+			return
+		}
+	}
+}
+
+// stopTimer stops t and drains its channel, so that it could be reset.  It
+// doesn't block, since the value may be either pending or not depending on the
+// implementation of the timers.
+func stopTimer(t *time.Timer) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+}
+
+// run runs job recovering from its panics, so that the worker survives them.
+func (wp *tcpWorkerPool) run(job func()) {
+	defer slogutil.RecoverAndLog(context.TODO(), wp.logger)
+
+	job()
+}
+
+// close makes the idle workers exit and waits for all the workers to finish.
+// It must only be called once no more jobs are submitted.
+func (wp *tcpWorkerPool) close() {
+	close(wp.done)
+	wp.wg.Wait()
+}
+
+// tcpConnWriter is a [net.Conn] which writes the responses to the underlying
+// connection from a single goroutine, so that the handlers of the pipelined
+// queries don't wait for each other or for a slow client.
+type tcpConnWriter struct {
+	net.Conn
+
+	// pool provides the buffers for the queued responses.  It's never nil.
+	pool *syncutil.Pool[[]byte]
+
+	// queue are the responses waiting to be written along with their buffers
+	// taken from pool.
+	queue chan tcpQueuedResp
+
+	// done is closed when the writing goroutine exits.
+	done chan struct{}
+
+	// failed is true if writing to the underlying connection has failed, so
+	// that the subsequent responses are discarded.
+	failed *atomic.Bool
+
+	// closing is true if w has been closed, so that no more queries are read
+	// from the underlying connection.
+	closing *atomic.Bool
+
+	// logger is used to log the errors of writing.  It's never nil.
+	logger *slog.Logger
+}
+
+// tcpQueuedResp is a response queued to be written.
+type tcpQueuedResp struct {
+	// bufPtr is the pooled buffer containing b, if any.
+	bufPtr *[]byte
+
+	// b is the packed response with its length prefix.
+	b []byte
+}
+
+// type check
+var _ net.Conn = (*tcpConnWriter)(nil)
+
+// newTCPConnWriter returns a new *tcpConnWriter writing to conn and starts its
+// writing goroutine.  queueLen is the maximum number of the responses waiting
+// to be written.  pool and l must not be nil.
+func newTCPConnWriter(
+	conn net.Conn,
+	queueLen uint,
+	pool *syncutil.Pool[[]byte],
+	l *slog.Logger,
+) (w *tcpConnWriter) {
+	w = &tcpConnWriter{
+		Conn:    conn,
+		pool:    pool,
+		queue:   make(chan tcpQueuedResp, queueLen),
+		done:    make(chan struct{}),
+		failed:  &atomic.Bool{},
+		closing: &atomic.Bool{},
+		logger:  l,
+	}
+
+	go w.writeLoop()
+
+	return w
+}
+
+// Write implements the [net.Conn] interface for *tcpConnWriter.  It queues a
+// copy of b and returns right away, so the errors of writing are only logged.
+// b must be a single response with its length prefix.
+func (w *tcpConnWriter) Write(b []byte) (n int, err error) {
+	if w.failed.Load() {
+		return 0, net.ErrClosed
+	}
+
+	resp := tcpQueuedResp{}
+	if bufPtr := w.pool.Get(); len(b) <= len(*bufPtr) {
+		resp.bufPtr, resp.b = bufPtr, (*bufPtr)[:len(b)]
+	} else {
+		w.pool.Put(bufPtr)
+		resp.b = make([]byte, len(b))
+	}
+
+	copy(resp.b, b)
+	w.queue <- resp
+
+	return len(b), nil
+}
+
+// Close implements the [net.Conn] interface for *tcpConnWriter.  It interrupts
+// reading the next query from the underlying connection, which is closed once
+// the responses to the queries already read are written.
+func (w *tcpConnWriter) Close() (err error) {
+	w.closing.Store(true)
+
+	return w.Conn.SetReadDeadline(time.Now())
+}
+
+// isClosing returns true if w has been closed, see [tcpConnWriter.Close].
+func (w *tcpConnWriter) isClosing() (ok bool) {
+	return w.closing.Load()
+}
+
+// SetWriteDeadline implements the [net.Conn] interface for *tcpConnWriter.  It
+// does nothing, since the deadline is set before writing each response.
+func (w *tcpConnWriter) SetWriteDeadline(_ time.Time) (err error) {
+	return nil
+}
+
+// writeLoop writes the queued responses to the underlying connection until the
+// queue is closed.  It's intended to be used as a goroutine.
+func (w *tcpConnWriter) writeLoop() {
+	defer close(w.done)
+
+	for resp := range w.queue {
+		if !w.failed.Load() {
+			w.write(resp.b)
+		}
+
+		if resp.bufPtr != nil {
+			w.pool.Put(resp.bufPtr)
+		}
+	}
+}
+
+// write writes b to the underlying connection and marks w as failed on error.
+func (w *tcpConnWriter) write(b []byte) {
+	err := w.Conn.SetWriteDeadline(time.Now().Add(defaultTimeout))
+	if err != nil {
+		// Consider deadline errors non-critical.
+		logWithNonCrit(w.logger, err, "handling tcp: setting write deadline")
+	}
+
+	err = writeTCP(w.Conn, b)
+	if err != nil {
+		w.failed.Store(true)
+		logWithNonCrit(w.logger, err, "handling tcp: writing response")
+	}
+}
+
+// closeQueue stops accepting the responses and waits for the queued ones to be
+// written.  It must only be called once no more responses are written to w.
+func (w *tcpConnWriter) closeQueue() {
+	close(w.queue)
+	<-w.done
+}
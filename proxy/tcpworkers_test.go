@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/syncutil"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTCPWorkerPool(t *testing.T) {
+	t.Run("reuse", func(t *testing.T) {
+		wp := newTCPWorkerPool(4, testLogger)
+
+		var n atomic.Int32
+		wg := &sync.WaitGroup{}
+		for range 100 {
+			wg.Add(1)
+			err := wp.submit(context.Background(), func() {
+				defer wg.Done()
+
+				n.Add(1)
+			})
+			require.NoError(t, err)
+		}
+
+		wg.Wait()
+		assert.Equal(t, int32(100), n.Load())
+		assert.LessOrEqual(t, len(wp.slots), 4)
+
+		wp.close()
+		assert.Zero(t, len(wp.slots))
+	})
+
+	t.Run("limit", func(t *testing.T) {
+		wp := newTCPWorkerPool(1, testLogger)
+		t.Cleanup(wp.close)
+
+		unblock := make(chan struct{})
+		require.NoError(t, wp.submit(context.Background(), func() { <-unblock }))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		t.Cleanup(cancel)
+
+		err := wp.submit(ctx, func() {})
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+		close(unblock)
+
+		done := make(chan struct{})
+		require.NoError(t, wp.submit(context.Background(), func() { close(done) }))
+		testutil.RequireReceive(t, done, defaultTimeout)
+	})
+
+	t.Run("panic", func(t *testing.T) {
+		wp := newTCPWorkerPool(1, testLogger)
+		t.Cleanup(wp.close)
+
+		require.NoError(t, wp.submit(context.Background(), func() { panic("test") }))
+
+		done := make(chan struct{})
+		require.NoError(t, wp.submit(context.Background(), func() { close(done) }))
+		testutil.RequireReceive(t, done, defaultTimeout)
+	})
+}
+
+func TestTCPConnWriter(t *testing.T) {
+	client, server := net.Pipe()
+	t.Cleanup(func() { _ = client.Close() })
+
+	pool := syncutil.NewSlicePool[byte](4)
+	w := newTCPConnWriter(server, 2, pool, testLogger)
+
+	msgs := [][]byte{{0, 1, 'a'}, {0, 6, 'l', 'o', 'n', 'g', 'e', 'r'}}
+	for _, m := range msgs {
+		n, err := w.Write(m)
+		require.NoError(t, err)
+		assert.Equal(t, len(m), n)
+
+		// Make sure the queued copy is written.
+		m[len(m)-1] = 0
+	}
+
+	for _, want := range [][]byte{{0, 1, 'a'}, {0, 6, 'l', 'o', 'n', 'g', 'e', 'r'}} {
+		got := make([]byte, len(want))
+		_, err := io.ReadFull(client, got)
+		require.NoError(t, err)
+
+		assert.Equal(t, want, got)
+	}
+
+	w.closeQueue()
+	require.NoError(t, server.Close())
+
+	// The writer must not block on the failed connection.
+	w = newTCPConnWriter(server, 1, pool, testLogger)
+	for range 3 {
+		_, _ = w.Write([]byte{0, 1, 'a'})
+	}
+	w.closeQueue()
+
+	_, err := w.Write([]byte{0, 1, 'a'})
+	assert.ErrorIs(t, err, net.ErrClosed)
+}
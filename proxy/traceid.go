@@ -0,0 +1,155 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+
+	"github.com/miekg/dns"
+)
+
+// DefaultTraceIDOptionCode is the default code of the EDNS option carrying the
+// trace ID, see [TraceIDConfig].  It's within the range reserved for the local
+// and experimental use, see RFC 6891.
+const DefaultTraceIDOptionCode uint16 = 65301
+
+// maxTraceIDLen is the maximum length of the trace ID received from the client
+// in bytes.
+const maxTraceIDLen = 16
+
+// TraceIDConfig is the configuration of the per-request trace identifiers,
+// which correlate a single request across the query log, the traces, and the
+// dnstap messages of a chain of dnsproxy instances.
+//
+// Each request is assigned a new random trace ID, unless it already carries
+// one in the EDNS option with OptionCode, for example from the downstream
+// dnsproxy instance, in which case that one is used.  The option is never sent
+// to the upstreams or the clients, unless Forward is set.
+type TraceIDConfig struct {
+	// OptionCode is the code of the EDNS option carrying the trace ID.  It must
+	// be within the local and experimental range of 65001 to 65534.  If zero,
+	// [DefaultTraceIDOptionCode] is used.
+	OptionCode uint16
+
+	// Forward, if true, makes the trace ID sent to the upstreams in the EDNS
+	// option, so that the cooperating upstreams use the same trace ID.
+	Forward bool
+}
+
+// validate returns an error if c is invalid.  c may be nil.
+func (c *TraceIDConfig) validate() (err error) {
+	if c == nil || c.OptionCode == 0 {
+		return nil
+	}
+
+	if c.OptionCode < dns.EDNS0LOCALSTART || c.OptionCode > dns.EDNS0LOCALEND {
+		return fmt.Errorf(
+			"option code: %d is not within the local range of %d to %d",
+			c.OptionCode,
+			dns.EDNS0LOCALSTART,
+			dns.EDNS0LOCALEND,
+		)
+	}
+
+	return nil
+}
+
+// optionCode returns the code of the EDNS option carrying the trace ID.  c
+// must not be nil.
+func (c *TraceIDConfig) optionCode() (code uint16) {
+	if c.OptionCode == 0 {
+		return DefaultTraceIDOptionCode
+	}
+
+	return c.OptionCode
+}
+
+// TraceIDFromMsg returns the trace ID carried by m in the EDNS option with
+// code, see [TraceIDConfig], as a lowercase hexadecimal string.  It returns an
+// empty string if m carries no valid trace ID.
+func TraceIDFromMsg(m *dns.Msg, code uint16) (id string) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return ""
+	}
+
+	for _, o := range opt.Option {
+		local, ok := o.(*dns.EDNS0_LOCAL)
+		if ok && local.Code == code && len(local.Data) > 0 && len(local.Data) <= maxTraceIDLen {
+			return hex.EncodeToString(local.Data)
+		}
+	}
+
+	return ""
+}
+
+// newTraceID returns a new random trace ID.
+func newTraceID() (id string) {
+	return hex.EncodeToString(binary.BigEndian.AppendUint64(nil, rand.Uint64()))
+}
+
+// assignTraceID sets the trace ID of d, if [Config.TraceID] is set and d has
+// none yet.
+func (p *Proxy) assignTraceID(d *DNSContext) {
+	if p.TraceID == nil || d.TraceID != "" {
+		return
+	}
+
+	d.TraceID = TraceIDFromMsg(d.Req, p.TraceID.optionCode())
+	if d.TraceID == "" {
+		d.TraceID = newTraceID()
+	}
+}
+
+// withTraceID returns req to send to the upstreams for d with the EDNS option
+// carrying the trace ID of d, if [TraceIDConfig.Forward] is set, or without
+// it otherwise.  req is copied, if it's d.Req, since the latter is used to
+// respond to the client.
+func (p *Proxy) withTraceID(d *DNSContext, req *dns.Msg) (res *dns.Msg) {
+	if p.TraceID == nil {
+		return req
+	}
+
+	code := p.TraceID.optionCode()
+	isTrace := func(o dns.EDNS0) (ok bool) { return o.Option() == code }
+
+	opt := req.IsEdns0()
+	hasTrace := opt != nil && slices.ContainsFunc(opt.Option, isTrace)
+	forward := p.TraceID.Forward && d.TraceID != ""
+	if !hasTrace && !forward {
+		return req
+	}
+
+	if req == d.Req {
+		req = req.Copy()
+	}
+
+	opt = req.IsEdns0()
+	if opt == nil {
+		// Don't advertise a larger buffer than the plain DNS does.
+		req.SetEdns0(dns.MinMsgSize, false)
+		opt = req.IsEdns0()
+	}
+
+	opt.Option = slices.DeleteFunc(opt.Option, isTrace)
+	if !forward {
+		return req
+	}
+
+	data, err := hex.DecodeString(d.TraceID)
+	if err != nil {
+		// Shouldn't happen, since the trace IDs are always hexadecimal.
+		p.logger.Debug("decoding trace id", "trace_id", d.TraceID)
+
+		return req
+	}
+
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{
+		Code: code,
+		Data: data,
+	})
+
+	return req
+}
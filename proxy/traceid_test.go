@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_Resolve_traceID(t *testing.T) {
+	const clientTraceID = "0102030405060708"
+
+	var upsReq *dns.Msg
+	ups := &fakeUpstream{
+		onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			upsReq = req
+
+			resp = (&dns.Msg{}).SetReply(req)
+			resp.SetEdns0(defaultUDPBufSize, false)
+			opt := resp.IsEdns0()
+			opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{
+				Code: DefaultTraceIDOptionCode,
+				Data: []byte{1, 2, 3, 4, 5, 6, 7, 8},
+			})
+
+			return resp, nil
+		},
+		onAddress: func() (a string) { return "ups" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	newReq := func(withTraceID bool) (req *dns.Msg) {
+		req = newHostTestMessage("example.org")
+		req.SetEdns0(defaultUDPBufSize, false)
+		if withTraceID {
+			opt := req.IsEdns0()
+			opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{
+				Code: DefaultTraceIDOptionCode,
+				Data: []byte{1, 2, 3, 4, 5, 6, 7, 8},
+			})
+		}
+
+		return req
+	}
+
+	testCases := []struct {
+		name         string
+		wantTraceID  string
+		withTraceID  bool
+		forward      bool
+		wantUpsTrace bool
+	}{{
+		name:         "generated",
+		wantTraceID:  "",
+		withTraceID:  false,
+		forward:      false,
+		wantUpsTrace: false,
+	}, {
+		name:         "from_client",
+		wantTraceID:  clientTraceID,
+		withTraceID:  true,
+		forward:      false,
+		wantUpsTrace: false,
+	}, {
+		name:         "forward_generated",
+		wantTraceID:  "",
+		withTraceID:  false,
+		forward:      true,
+		wantUpsTrace: true,
+	}, {
+		name:         "forward_from_client",
+		wantTraceID:  clientTraceID,
+		withTraceID:  true,
+		forward:      true,
+		wantUpsTrace: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := mustNew(t, &Config{
+				Logger:         testLogger,
+				UDPListenAddr:  []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+				UpstreamConfig: &UpstreamConfig{Upstreams: []upstream.Upstream{ups}},
+				TrustedProxies: defaultTrustedProxies,
+				TraceID:        &TraceIDConfig{Forward: tc.forward},
+			})
+
+			req := newReq(tc.withTraceID)
+			d := &DNSContext{Req: req}
+			require.NoError(t, p.Resolve(d))
+
+			if tc.wantTraceID == "" {
+				assert.Len(t, d.TraceID, 16)
+			} else {
+				assert.Equal(t, tc.wantTraceID, d.TraceID)
+			}
+
+			require.NotNil(t, upsReq)
+
+			upsTraceID := TraceIDFromMsg(upsReq, DefaultTraceIDOptionCode)
+			if tc.wantUpsTrace {
+				assert.Equal(t, d.TraceID, upsTraceID)
+			} else {
+				assert.Empty(t, upsTraceID)
+			}
+
+			// The client's request must be left intact.
+			assert.Equal(t, tc.withTraceID, TraceIDFromMsg(req, DefaultTraceIDOptionCode) != "")
+
+			require.NotNil(t, d.Res)
+			assert.Empty(t, TraceIDFromMsg(d.Res, DefaultTraceIDOptionCode))
+		})
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		p := mustNew(t, &Config{
+			Logger:         testLogger,
+			UDPListenAddr:  []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+			UpstreamConfig: &UpstreamConfig{Upstreams: []upstream.Upstream{ups}},
+			TrustedProxies: defaultTrustedProxies,
+		})
+
+		d := &DNSContext{Req: newReq(true)}
+		require.NoError(t, p.Resolve(d))
+
+		assert.Empty(t, d.TraceID)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := New(&Config{
+			UDPListenAddr:  []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+			UpstreamConfig: &UpstreamConfig{Upstreams: []upstream.Upstream{ups}},
+			TrustedProxies: defaultTrustedProxies,
+			TraceID:        &TraceIDConfig{OptionCode: 8},
+		})
+		testutil.AssertErrorMsg(
+			t,
+			"validating trace id: option code: 8 is not within the local range of 65001 to 65534",
+			err,
+		)
+	})
+}
@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// tracerName is the name of the tracer used by the proxy.
+const tracerName = "github.com/AdguardTeam/dnsproxy/proxy"
+
+// Names of the spans created while processing the request.
+const (
+	spanRequest  = "dnsproxy.request"
+	spanBefore   = "dnsproxy.before_request"
+	spanCache    = "dnsproxy.cache"
+	spanUpstream = "dnsproxy.upstream_exchange"
+	spanFallback = "dnsproxy.fallback_exchange"
+	spanAfter    = "dnsproxy.after_response"
+	spanRespond  = "dnsproxy.respond"
+)
+
+// Attribute keys of the spans.
+const (
+	attrProto    = attribute.Key("dns.proto")
+	attrQName    = attribute.Key("dns.question.name")
+	attrQType    = attribute.Key("dns.question.type")
+	attrRcode    = attribute.Key("dns.rcode")
+	attrUpstream = attribute.Key("dns.upstream")
+	attrCacheHit = attribute.Key("dns.cache.hit")
+	attrTraceID  = attribute.Key("dns.trace_id")
+)
+
+// newTracer returns the tracer from tp or the no-op one if tp is nil.
+func newTracer(tp trace.TracerProvider) (t trace.Tracer) {
+	if tp == nil {
+		tp = noop.NewTracerProvider()
+	}
+
+	return tp.Tracer(tracerName)
+}
+
+// startRequestSpan starts the root span of the request processing and sets its
+// context into d.
+func (p *Proxy) startRequestSpan(d *DNSContext) (span trace.Span) {
+	attrs := []attribute.KeyValue{attrProto.String(string(d.Proto))}
+	if len(d.Req.Question) > 0 {
+		q := d.Req.Question[0]
+		attrs = append(
+			attrs,
+			attrQName.String(q.Name),
+			attrQType.String(dns.Type(q.Qtype).String()),
+		)
+	}
+
+	if d.TraceID != "" {
+		attrs = append(attrs, attrTraceID.String(d.TraceID))
+	}
+
+	d.ctx, span = p.tracer.Start(
+		d.Context(),
+		spanRequest,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attrs...),
+	)
+
+	return span
+}
+
+// endRequestSpan sets the result attributes of the request processing to span
+// and ends it.
+func endRequestSpan(span trace.Span, d *DNSContext) {
+	if d.Res != nil {
+		span.SetAttributes(attrRcode.String(dns.RcodeToString[d.Res.Rcode]))
+	}
+
+	if d.Upstream != nil {
+		span.SetAttributes(attrUpstream.String(d.Upstream.Address()))
+	} else if d.CachedUpstreamAddr != "" {
+		span.SetAttributes(attrUpstream.String(d.CachedUpstreamAddr))
+	}
+
+	span.End()
+}
+
+// startChildSpan starts a span of some request processing stage.  It doesn't
+// modify the context of d so that the stages are siblings.
+func (p *Proxy) startChildSpan(d *DNSContext, name string) (span trace.Span) {
+	_, span = p.tracer.Start(d.Context(), name)
+
+	return span
+}
+
+// endSpanWithErr records err, if any, to span and ends it.
+func endSpanWithErr(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
+
+// endExchangeSpan sets the upstream that has resolved the request, if any, and
+// the exchange error to span and ends it.
+func endExchangeSpan(span trace.Span, u upstream.Upstream, err error) {
+	if u != nil {
+		span.SetAttributes(attrUpstream.String(u.Address()))
+	}
+
+	endSpanWithErr(span, err)
+}
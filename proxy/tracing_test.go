@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestProxy_TracerProvider(t *testing.T) {
+	const upsAddr = "fake"
+
+	rec := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))
+
+	p := mustNew(t, &Config{
+		TCPListenAddr: []*net.TCPAddr{net.TCPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{&fakeUpstream{
+				onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+					return (&dns.Msg{}).SetRcode(req, dns.RcodeNameError), nil
+				},
+				onAddress: func() (addr string) { return upsAddr },
+				onClose:   func() (err error) { return nil },
+			}},
+		},
+		TrustedProxies: defaultTrustedProxies,
+		CacheEnabled:   true,
+		CacheSizeBytes: defaultCacheSize,
+		TracerProvider: tp,
+	})
+
+	ctx := context.Background()
+	require.NoError(t, p.Start(ctx))
+	testutil.CleanupAndRequireSuccess(t, func() (err error) { return p.Shutdown(ctx) })
+
+	client := &dns.Client{Net: string(ProtoTCP), Timeout: defaultTimeout}
+	addr := p.Addr(ProtoTCP).String()
+
+	_, _, err := client.Exchange(newHostTestMessage("tracing.example"), addr)
+	require.NoError(t, err)
+
+	var root sdktrace.ReadOnlySpan
+	require.Eventually(t, func() (ok bool) {
+		for _, s := range rec.Ended() {
+			if s.Name() == spanRequest {
+				root = s
+
+				return true
+			}
+		}
+
+		return false
+	}, defaultTimeout, defaultTimeout/100)
+
+	assert.Subset(t, root.Attributes(), []attribute.KeyValue{
+		attrProto.String(string(ProtoTCP)),
+		attrQName.String("tracing.example."),
+		attrQType.String("A"),
+		attrRcode.String("NXDOMAIN"),
+		attrUpstream.String(upsAddr),
+	})
+
+	children := map[string]sdktrace.ReadOnlySpan{}
+	for _, s := range rec.Ended() {
+		if s.Parent().SpanID() == root.SpanContext().SpanID() {
+			children[s.Name()] = s
+		}
+	}
+
+	require.Contains(t, children, spanBefore)
+	require.Contains(t, children, spanRespond)
+
+	require.Contains(t, children, spanCache)
+	assert.Contains(t, children[spanCache].Attributes(), attrCacheHit.Bool(false))
+
+	require.Contains(t, children, spanUpstream)
+	assert.Contains(t, children[spanUpstream].Attributes(), attrUpstream.String(upsAddr))
+}
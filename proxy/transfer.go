@@ -0,0 +1,203 @@
+package proxy
+
+import (
+	"fmt"
+	"net/netip"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/miekg/dns"
+)
+
+// ZoneTransferConfig is the configuration of proxying the zone transfers, see
+// RFC 5936 and RFC 1995.  The AXFR and IXFR requests received over TCP and TLS
+// are sent to the designated upstreams, and the records are streamed back to
+// the client in multiple messages.  The ones received over UDP are answered
+// with the truncated responses, so that the clients retry over TCP, and the
+// ones received over other protocols are refused.
+type ZoneTransferConfig struct {
+	// Upstreams are the upstreams the transfers are proxied to.  Those are
+	// tried in order until one of them starts the transfer.  Each must
+	// implement [upstream.Transferer].
+	Upstreams []upstream.Upstream
+
+	// AllowedClients are the networks of the clients allowed to transfer the
+	// zones.  The requests from other clients are refused, unless signed with
+	// one of AllowedKeys.
+	AllowedClients []netip.Prefix
+
+	// AllowedKeys are the names of the keys from [Config.TSIGKeys], the
+	// requests signed with which are allowed regardless of the client address.
+	// If the upstreams require the transfers to be signed, use
+	// [upstream.Options.TSIGKey].
+	AllowedKeys []string
+}
+
+// validate returns an error if c is invalid.  c may be nil.
+func (c *ZoneTransferConfig) validate() (err error) {
+	if c == nil {
+		return nil
+	} else if len(c.Upstreams) == 0 {
+		return errors.Error("no upstreams")
+	}
+
+	for i, u := range c.Upstreams {
+		if _, ok := u.(upstream.Transferer); !ok {
+			return fmt.Errorf("upstream at index %d: zone transfers not supported", i)
+		}
+	}
+
+	for i, pref := range c.AllowedClients {
+		if !pref.IsValid() {
+			return fmt.Errorf("allowed client at index %d: bad prefix", i)
+		}
+	}
+
+	return nil
+}
+
+// isAllowed returns true if the client of d is allowed to transfer the zones.
+func (c *ZoneTransferConfig) isAllowed(d *DNSContext) (ok bool) {
+	return isClientAllowed(d, c.AllowedClients, c.AllowedKeys)
+}
+
+// isClientAllowed returns true if the client of d is within one of nets or the
+// request of d is signed with one of keys.
+func isClientAllowed(d *DNSContext, nets []netip.Prefix, keys []string) (ok bool) {
+	if d.tsig.hasKey(keys) {
+		return true
+	}
+
+	addr := d.Addr.Addr().Unmap()
+	for _, pref := range nets {
+		if pref.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isTransfer returns true if req is a zone transfer request.
+func isTransfer(req *dns.Msg) (ok bool) {
+	if len(req.Question) != 1 {
+		return false
+	}
+
+	qt := req.Question[0].Qtype
+
+	return qt == dns.TypeAXFR || qt == dns.TypeIXFR
+}
+
+// handleTransfer proxies the zone transfer request in d, if it's one and
+// [Config.ZoneTransfer] is set.  written is true if the response has already
+// been written to the client.  Otherwise, d.Res is set if the request has been
+// rejected.
+func (p *Proxy) handleTransfer(d *DNSContext) (written bool) {
+	conf := p.ZoneTransfer
+	if conf == nil || !isTransfer(d.Req) {
+		return false
+	}
+
+	if !conf.isAllowed(d) {
+		p.logger.Debug("zone transfer refused", "addr", p.anonymizer.addrPort(d.Addr))
+		d.Res = reply(d.Req, dns.RcodeRefused)
+
+		return false
+	}
+
+	switch d.Proto {
+	case ProtoTCP, ProtoTLS:
+		// Go on.
+	case ProtoUDP:
+		d.Res = reply(d.Req, dns.RcodeSuccess)
+		d.Res.Truncated = true
+
+		return false
+	default:
+		d.Res = reply(d.Req, dns.RcodeRefused)
+
+		return false
+	}
+
+	envs, u, err := p.startTransfer(conf, d.Req)
+	if err != nil {
+		p.logger.Error("starting zone transfer", slogutil.KeyError, err)
+		d.Res = p.messages.NewMsgSERVFAIL(d.Req)
+
+		return false
+	}
+
+	d.Upstream = u
+	p.streamTransfer(d, envs)
+
+	return true
+}
+
+// startTransfer starts the transfer requested by req from the first upstream
+// of conf which accepts it.
+func (p *Proxy) startTransfer(
+	conf *ZoneTransferConfig,
+	req *dns.Msg,
+) (envs <-chan *dns.Envelope, u upstream.Upstream, err error) {
+	var errs []error
+	for _, u = range conf.Upstreams {
+		envs, err = u.(upstream.Transferer).Transfer(req)
+		if err == nil {
+			return envs, u, nil
+		}
+
+		errs = append(errs, fmt.Errorf("upstream %s: %w", u.Address(), err))
+	}
+
+	return nil, nil, errors.Join(errs...)
+}
+
+// streamTransfer writes the records received from envs to the client of d,
+// one message per envelope.  If the transfer fails, SERVFAIL is written, which
+// aborts it, see RFC 5936 Section 2.2.
+func (p *Proxy) streamTransfer(d *DNSContext, envs <-chan *dns.Envelope) {
+	// Let the transfer finish, if the client has gone.
+	defer func() {
+		for range envs {
+		}
+	}()
+
+	bufPtr := p.bytesPool.Get()
+	defer p.bytesPool.Put(bufPtr)
+
+	var n int
+	for env := range envs {
+		msg := (&dns.Msg{}).SetReply(d.Req)
+		msg.Authoritative = true
+		msg.Answer = env.RR
+		if env.Error != nil {
+			p.logger.Error("zone transfer", "msgs", n, slogutil.KeyError, env.Error)
+			msg = p.messages.NewMsgSERVFAIL(d.Req)
+		}
+
+		if d.Res == nil {
+			// Keep the first message for the statistics and the query log.
+			d.Res = msg
+		}
+
+		b, err := packPrefixed(d, msg, *bufPtr)
+		if err == nil {
+			err = writeTCP(d.respConn(), b)
+		}
+
+		if err != nil {
+			logWithNonCrit(p.logger, err, "zone transfer: writing message")
+
+			return
+		}
+
+		n++
+		if env.Error != nil {
+			return
+		}
+	}
+
+	p.logger.Debug("zone transfer finished", "msgs", n)
+}
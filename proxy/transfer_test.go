@@ -0,0 +1,157 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTransferRecords returns the records of the test zone transferred in
+// several messages, starting and ending with the SOA record.
+func newTransferRecords(t *testing.T) (msgs [][]dns.RR) {
+	t.Helper()
+
+	soa, err := dns.NewRR("example.org. 3600 IN SOA ns.example.org. admin.example.org. 1 3600 600 86400 60")
+	require.NoError(t, err)
+
+	msgs = [][]dns.RR{{soa}}
+	for _, s := range []string{
+		"example.org. 3600 IN NS ns.example.org.",
+		"ns.example.org. 3600 IN A 192.0.2.1",
+		"www.example.org. 3600 IN A 192.0.2.2",
+	} {
+		var rr dns.RR
+		rr, err = dns.NewRR(s)
+		require.NoError(t, err)
+
+		msgs = append(msgs, []dns.RR{rr})
+	}
+
+	return append(msgs, []dns.RR{soa})
+}
+
+// newTransferProxy starts a proxy transferring the zones from upsAddr to the
+// clients from allowed.
+func newTransferProxy(t *testing.T, upsAddr netip.AddrPort, allowed netip.Prefix) (p *Proxy) {
+	t.Helper()
+
+	ups, err := upstream.AddressToUpstream("tcp://"+upsAddr.String(), &upstream.Options{
+		Logger:  testLogger,
+		Timeout: defaultTimeout,
+	})
+	require.NoError(t, err)
+
+	p = mustNew(t, &Config{
+		Logger:         testLogger,
+		UDPListenAddr:  []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		TCPListenAddr:  []*net.TCPAddr{net.TCPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig: newTestUpstreamConfig(t, defaultTimeout, testDefaultUpstreamAddr),
+		TrustedProxies: defaultTrustedProxies,
+		ZoneTransfer: &ZoneTransferConfig{
+			Upstreams:      []upstream.Upstream{ups},
+			AllowedClients: []netip.Prefix{allowed},
+		},
+	})
+
+	ctx := context.Background()
+	require.NoError(t, p.Start(ctx))
+	testutil.CleanupAndRequireSuccess(t, func() (err error) { return p.Shutdown(ctx) })
+
+	return p
+}
+
+func TestProxy_zoneTransfer(t *testing.T) {
+	recs := newTransferRecords(t)
+
+	var want []string
+	for _, rrs := range recs {
+		want = append(want, rrs[0].String())
+	}
+
+	upsAddr := newLocalUpstreamListener(t, 0, dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		envs := make(chan *dns.Envelope)
+		go func() {
+			defer close(envs)
+
+			for _, rrs := range recs {
+				envs <- &dns.Envelope{RR: rrs}
+			}
+		}()
+
+		require.NoError(testutil.PanicT{}, (&dns.Transfer{}).Out(w, req, envs))
+	}))
+
+	req := (&dns.Msg{}).SetAxfr("example.org.")
+
+	p := newTransferProxy(t, upsAddr, netip.MustParsePrefix("127.0.0.0/8"))
+
+	t.Run("tcp", func(t *testing.T) {
+		envs, err := (&dns.Transfer{}).In(req, p.Addr(ProtoTCP).String())
+		require.NoError(t, err)
+
+		// Each record is received in a separate message.
+		var got []string
+		for env := range envs {
+			require.NoError(t, env.Error)
+			require.Len(t, env.RR, 1)
+
+			got = append(got, env.RR[0].String())
+		}
+
+		assert.Equal(t, want, got)
+	})
+
+	t.Run("udp", func(t *testing.T) {
+		client := &dns.Client{Net: string(ProtoUDP), Timeout: defaultTimeout}
+		resp, _, err := client.Exchange(req, p.Addr(ProtoUDP).String())
+		require.NoError(t, err)
+
+		assert.True(t, resp.Truncated)
+		assert.Empty(t, resp.Answer)
+	})
+
+	t.Run("refused", func(t *testing.T) {
+		refusing := newTransferProxy(t, upsAddr, netip.MustParsePrefix("192.0.2.0/24"))
+
+		client := &dns.Client{Net: string(ProtoTCP), Timeout: defaultTimeout}
+		resp, _, err := client.Exchange(req, refusing.Addr(ProtoTCP).String())
+		require.NoError(t, err)
+
+		assert.Equal(t, dns.RcodeRefused, resp.Rcode)
+	})
+}
+
+func TestZoneTransferConfig_validate(t *testing.T) {
+	testCases := []struct {
+		conf       *ZoneTransferConfig
+		name       string
+		wantErrMsg string
+	}{{
+		conf:       nil,
+		name:       "nil",
+		wantErrMsg: "",
+	}, {
+		conf:       &ZoneTransferConfig{},
+		name:       "no_upstreams",
+		wantErrMsg: "no upstreams",
+	}, {
+		conf: &ZoneTransferConfig{
+			Upstreams: []upstream.Upstream{&fakeUpstream{}},
+		},
+		name:       "unsupported",
+		wantErrMsg: "upstream at index 0: zone transfers not supported",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, tc.conf.validate())
+		})
+	}
+}
@@ -0,0 +1,192 @@
+package proxy
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/miekg/dns"
+)
+
+// tsigState is the state of the TSIG signature of a request, see RFC 8945.
+type tsigState struct {
+	// key is the key the request is signed with.  It's nil if the key is
+	// unknown.
+	key *upstream.TSIGKey
+
+	// err is the error of verifying the signature.  It's nil if the signature
+	// is valid.
+	err error
+
+	// mac is the MAC the next response is signed with, which is the MAC of the
+	// request or of the previous response.
+	mac string
+
+	// timersOnly is true if only the timers of the next response are covered
+	// by its signature, which is the case for the subsequent messages of a zone
+	// transfer, see RFC 8945 Section 5.3.1.
+	timersOnly bool
+}
+
+// isValid returns true if the request has been signed with a valid signature.
+// ts may be nil.
+func (ts *tsigState) isValid() (ok bool) {
+	return ts != nil && ts.err == nil
+}
+
+// hasKey returns true if the request has been signed by one of keys with a
+// valid signature.  ts may be nil.
+func (ts *tsigState) hasKey(keys []string) (ok bool) {
+	if !ts.isValid() {
+		return false
+	}
+
+	name := ts.key.CanonicalName()
+	for _, k := range keys {
+		if dns.CanonicalName(k) == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sign packs resp signed with the key of the request.  ts must be valid.
+func (ts *tsigState) sign(resp *dns.Msg) (b []byte, err error) {
+	signed := resp.Copy()
+	if signed.IsTsig() != nil {
+		signed.Extra = signed.Extra[:len(signed.Extra)-1]
+	}
+
+	signed.SetTsig(ts.key.CanonicalName(), ts.key.Alg(), upstream.TSIGFudge, time.Now().Unix())
+
+	b, ts.mac, err = dns.TsigGenerate(signed, ts.key.Secret, ts.mac, ts.timersOnly)
+	ts.timersOnly = true
+
+	return b, err
+}
+
+// validateTSIGKeys returns an error if any of keys is invalid.
+func validateTSIGKeys(keys []*upstream.TSIGKey) (err error) {
+	for i, k := range keys {
+		err = k.Validate()
+		if err != nil {
+			return fmt.Errorf("key at index %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+// tsigKey returns the configured key with name and alg or nil if there is
+// none.
+func (p *Proxy) tsigKey(name, alg string) (k *upstream.TSIGKey) {
+	name, alg = dns.CanonicalName(name), dns.CanonicalName(alg)
+	for _, k = range p.TSIGKeys {
+		if k.CanonicalName() == name && k.Alg() == alg {
+			return k
+		}
+	}
+
+	return nil
+}
+
+// unpackRequest unpacks the request from b and verifies its TSIG signature, if
+// there is one and [Config.TSIGKeys] are set.  ts is nil otherwise.
+func (p *Proxy) unpackRequest(b []byte) (req *dns.Msg, ts *tsigState, err error) {
+	req = &dns.Msg{}
+	err = req.Unpack(b)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	t := req.IsTsig()
+	if t == nil || len(p.TSIGKeys) == 0 {
+		return req, nil, nil
+	}
+
+	ts = &tsigState{
+		key: p.tsigKey(t.Hdr.Name, t.Algorithm),
+		mac: t.MAC,
+	}
+
+	if ts.key == nil {
+		ts.err = dns.ErrSecret
+	} else {
+		ts.err = dns.TsigVerify(b, ts.key.Secret, "", false)
+	}
+
+	return req, ts, nil
+}
+
+// checkTSIG returns the NOTAUTH response if the request of d is signed with an
+// invalid signature, see RFC 8945 Section 5.2.  Otherwise, it removes the TSIG
+// record from the request, so that it isn't sent to the upstreams, and returns
+// nil.
+func (p *Proxy) checkTSIG(d *DNSContext) (resp *dns.Msg) {
+	t := d.Req.IsTsig()
+	if t == nil || len(p.TSIGKeys) == 0 {
+		return nil
+	}
+
+	if d.tsig == nil {
+		// The request has been received over the protocol, which doesn't
+		// allow verifying it, for example, DNSCrypt.
+		d.tsig = &tsigState{
+			err: errors.Error("verification not supported"),
+		}
+	}
+
+	if d.tsig.err == nil {
+		d.Req.Extra = d.Req.Extra[:len(d.Req.Extra)-1]
+
+		return nil
+	}
+
+	p.logger.Debug(
+		"bad tsig",
+		"addr", p.anonymizer.addrPort(d.Addr),
+		"key", t.Hdr.Name,
+		slogutil.KeyError, d.tsig.err,
+	)
+
+	resp = reply(d.Req, dns.RcodeNotAuth)
+	resp.Extra = append(resp.Extra, &dns.TSIG{
+		Hdr: dns.RR_Header{
+			Name:   t.Hdr.Name,
+			Rrtype: dns.TypeTSIG,
+			Class:  dns.ClassANY,
+		},
+		Algorithm:  t.Algorithm,
+		TimeSigned: t.TimeSigned,
+		Fudge:      t.Fudge,
+		OrigId:     d.Req.Id,
+		Error:      tsigErrorCode(d.tsig.err),
+	})
+
+	return resp
+}
+
+// tsigErrorCode returns the TSIG error code for the verification error err.
+func tsigErrorCode(err error) (code uint16) {
+	switch {
+	case errors.Is(err, dns.ErrSecret):
+		return dns.RcodeBadKey
+	case errors.Is(err, dns.ErrTime):
+		return dns.RcodeBadTime
+	default:
+		return dns.RcodeBadSig
+	}
+}
+
+// packResponse packs resp to the request of d using buf, signing it if the
+// request has been signed with a valid signature.
+func packResponse(d *DNSContext, resp *dns.Msg, buf []byte) (b []byte, err error) {
+	if d.tsig.isValid() {
+		return d.tsig.sign(resp)
+	}
+
+	return resp.PackBuffer(buf)
+}
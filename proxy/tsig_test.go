@@ -0,0 +1,230 @@
+package proxy
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testTSIGKey is the key used to sign the messages in tests.
+var testTSIGKey = &upstream.TSIGKey{
+	Name:   "test.key.",
+	Secret: "c2VjcmV0c2VjcmV0c2VjcmV0c2VjcmV0",
+}
+
+// newSignedReq returns a request for name signed with the key named keyName.
+func newSignedReq(name, keyName string) (req *dns.Msg) {
+	req = (&dns.Msg{}).SetQuestion(name, dns.TypeA)
+	req.SetTsig(keyName, dns.HmacSHA256, upstream.TSIGFudge, time.Now().Unix())
+
+	return req
+}
+
+func TestProxy_tsig(t *testing.T) {
+	var gotTSIG atomic.Bool
+	ups := &fakeUpstream{
+		onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			gotTSIG.Store(req.IsTsig() != nil)
+
+			return (&dns.Msg{}).SetReply(req), nil
+		},
+		onAddress: func() (addr string) { return "upstream.example" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	p := mustNew(t, &Config{
+		Logger:        testLogger,
+		UDPListenAddr: []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		TCPListenAddr: []*net.TCPAddr{net.TCPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{ups},
+		},
+		TrustedProxies: defaultTrustedProxies,
+		TSIGKeys:       []*upstream.TSIGKey{testTSIGKey},
+	})
+
+	ctx := context.Background()
+	require.NoError(t, p.Start(ctx))
+	testutil.CleanupAndRequireSuccess(t, func() (err error) { return p.Shutdown(ctx) })
+
+	t.Run("valid", func(t *testing.T) {
+		client := &dns.Client{
+			Net:        string(ProtoTCP),
+			Timeout:    defaultTimeout,
+			TsigSecret: map[string]string{testTSIGKey.Name: testTSIGKey.Secret},
+		}
+
+		// The client verifies the signature of the response.
+		resp, _, err := client.Exchange(newSignedReq("valid.example.", testTSIGKey.Name), p.Addr(ProtoTCP).String())
+		require.NoError(t, err)
+
+		assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+		assert.NotNil(t, resp.IsTsig())
+		assert.False(t, gotTSIG.Load())
+	})
+
+	testCases := []struct {
+		secret    string
+		name      string
+		keyName   string
+		wantError uint16
+	}{{
+		secret:    testTSIGKey.Secret,
+		name:      "unknown_key",
+		keyName:   "unknown.key.",
+		wantError: dns.RcodeBadKey,
+	}, {
+		secret:    "b3RoZXJzZWNyZXRvdGhlcnNlY3JldA==",
+		name:      "bad_signature",
+		keyName:   testTSIGKey.Name,
+		wantError: dns.RcodeBadSig,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			b, _, err := dns.TsigGenerate(newSignedReq("invalid.example.", tc.keyName), tc.secret, "", false)
+			require.NoError(t, err)
+
+			conn, err := net.Dial(string(ProtoUDP), p.Addr(ProtoUDP).String())
+			require.NoError(t, err)
+			testutil.CleanupAndRequireSuccess(t, conn.Close)
+
+			_, err = conn.Write(b)
+			require.NoError(t, err)
+
+			require.NoError(t, conn.SetReadDeadline(time.Now().Add(defaultTimeout)))
+
+			buf := make([]byte, dns.MinMsgSize)
+			n, err := conn.Read(buf)
+			require.NoError(t, err)
+
+			resp := &dns.Msg{}
+			require.NoError(t, resp.Unpack(buf[:n]))
+
+			assert.Equal(t, dns.RcodeNotAuth, resp.Rcode)
+
+			tsig := resp.IsTsig()
+			require.NotNil(t, tsig)
+
+			assert.Equal(t, tc.wantError, tsig.Error)
+		})
+	}
+}
+
+func TestProxy_zoneTransfer_tsig(t *testing.T) {
+	recs := newTransferRecords(t)
+
+	upsAddr := newLocalUpstreamListener(t, 0, dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		envs := make(chan *dns.Envelope)
+		go func() {
+			defer close(envs)
+
+			for _, rrs := range recs {
+				envs <- &dns.Envelope{RR: rrs}
+			}
+		}()
+
+		require.NoError(testutil.PanicT{}, (&dns.Transfer{}).Out(w, req, envs))
+	}))
+
+	ups, err := upstream.AddressToUpstream("tcp://"+upsAddr.String(), &upstream.Options{
+		Logger:  testLogger,
+		Timeout: defaultTimeout,
+	})
+	require.NoError(t, err)
+
+	p := mustNew(t, &Config{
+		Logger:         testLogger,
+		UDPListenAddr:  []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		TCPListenAddr:  []*net.TCPAddr{net.TCPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig: newTestUpstreamConfig(t, defaultTimeout, testDefaultUpstreamAddr),
+		TrustedProxies: defaultTrustedProxies,
+		TSIGKeys:       []*upstream.TSIGKey{testTSIGKey},
+		ZoneTransfer: &ZoneTransferConfig{
+			Upstreams: []upstream.Upstream{ups},
+			// The client isn't allowed by its address.
+			AllowedClients: []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")},
+			AllowedKeys:    []string{testTSIGKey.Name},
+		},
+	})
+
+	ctx := context.Background()
+	require.NoError(t, p.Start(ctx))
+	testutil.CleanupAndRequireSuccess(t, func() (err error) { return p.Shutdown(ctx) })
+
+	req := (&dns.Msg{}).SetAxfr("example.org.")
+	req.SetTsig(testTSIGKey.Name, dns.HmacSHA256, upstream.TSIGFudge, time.Now().Unix())
+
+	secret, err := base64.StdEncoding.DecodeString(testTSIGKey.Secret)
+	require.NoError(t, err)
+
+	prov := &countingTSIGProvider{secret: secret}
+	tr := &dns.Transfer{TsigProvider: prov}
+
+	envs, err := tr.In(req, p.Addr(ProtoTCP).String())
+	require.NoError(t, err)
+
+	var n int
+	for env := range envs {
+		require.NoError(t, env.Error)
+
+		n += len(env.RR)
+	}
+
+	assert.Equal(t, len(recs), n)
+
+	// Each record is received in a separate signed message.
+	assert.Equal(t, len(recs), prov.verified)
+}
+
+// countingTSIGProvider is a [dns.TsigProvider] for HMAC-SHA256 counting the
+// messages verified.
+type countingTSIGProvider struct {
+	// secret is the secret of the key.
+	secret []byte
+
+	// verified is the number of the messages verified.
+	verified int
+}
+
+// type check
+var _ dns.TsigProvider = (*countingTSIGProvider)(nil)
+
+// Generate implements the [dns.TsigProvider] interface for
+// *countingTSIGProvider.
+func (p *countingTSIGProvider) Generate(msg []byte, _ *dns.TSIG) (mac []byte, err error) {
+	h := hmac.New(sha256.New, p.secret)
+	_, _ = h.Write(msg)
+
+	return h.Sum(nil), nil
+}
+
+// Verify implements the [dns.TsigProvider] interface for *countingTSIGProvider.
+func (p *countingTSIGProvider) Verify(msg []byte, t *dns.TSIG) (err error) {
+	want, err := hex.DecodeString(t.MAC)
+	if err != nil {
+		return err
+	}
+
+	got, _ := p.Generate(msg, t)
+	if !hmac.Equal(got, want) {
+		return dns.ErrSig
+	}
+
+	p.verified++
+
+	return nil
+}
@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"sync"
+
+	proxynetutil "github.com/AdguardTeam/dnsproxy/internal/netutil"
+	"github.com/AdguardTeam/golibs/syncutil"
+)
+
+// udpWrite is a response waiting to be written by [udpBatchWriter].
+type udpWrite struct {
+	// done receives the result of writing msg.
+	done chan error
+
+	// msg is the message to write.
+	msg proxynetutil.UDPMessage
+}
+
+// udpBatchWriter writes the responses to the UDP clients in batches.  The
+// goroutine writing a response while there are no other writes in progress
+// writes all the responses queued meanwhile, so that the concurrent responses
+// are written by a single system call.  It's safe for concurrent use.
+type udpBatchWriter struct {
+	// conn is used to write the batches.
+	conn proxynetutil.UDPBatchConn
+
+	// writes is the pool of the queued responses, so that those aren't
+	// allocated for each write.
+	writes *syncutil.Pool[udpWrite]
+
+	// mu protects pending and flushing.
+	mu *sync.Mutex
+
+	// pending are the responses queued for writing.
+	pending []*udpWrite
+
+	// spare is the slice to be used for pending once the current ones are
+	// taken for writing.  It's only accessed by the flushing goroutine.
+	spare []*udpWrite
+
+	// msgs are the messages written by the flushing goroutine.  It's only
+	// accessed by the flushing goroutine.
+	msgs []proxynetutil.UDPMessage
+
+	// flushing is true if some goroutine is writing the pending responses.
+	flushing bool
+}
+
+// newUDPBatchWriter returns a new properly initialized *udpBatchWriter.
+func newUDPBatchWriter(conn proxynetutil.UDPBatchConn) (w *udpBatchWriter) {
+	return &udpBatchWriter{
+		conn: conn,
+		writes: syncutil.NewPool(func() (wr *udpWrite) {
+			return &udpWrite{
+				done: make(chan error, 1),
+			}
+		}),
+		mu:   &sync.Mutex{},
+		msgs: make([]proxynetutil.UDPMessage, 0, proxynetutil.UDPBatchSize),
+	}
+}
+
+// write writes msg and returns the error of writing it.  It blocks until msg
+// is written.
+func (w *udpBatchWriter) write(msg proxynetutil.UDPMessage) (err error) {
+	wr := w.writes.Get()
+	wr.msg = msg
+
+	w.mu.Lock()
+	w.pending = append(w.pending, wr)
+	if w.flushing {
+		w.mu.Unlock()
+
+		return w.wait(wr)
+	}
+
+	w.flushing = true
+	for len(w.pending) > 0 {
+		batch := w.pending
+		w.pending = w.spare
+		w.mu.Unlock()
+
+		w.flush(batch)
+		clear(batch)
+
+		w.mu.Lock()
+		w.spare = batch[:0]
+	}
+	w.flushing = false
+	w.mu.Unlock()
+
+	return w.wait(wr)
+}
+
+// wait returns the result of writing wr and returns wr to the pool.
+func (w *udpBatchWriter) wait(wr *udpWrite) (err error) {
+	err = <-wr.done
+	wr.msg = proxynetutil.UDPMessage{}
+	w.writes.Put(wr)
+
+	return err
+}
+
+// flush writes the responses of batch and reports the results.
+func (w *udpBatchWriter) flush(batch []*udpWrite) {
+	for len(batch) > 0 {
+		chunk := batch[:min(len(batch), proxynetutil.UDPBatchSize)]
+
+		msgs := w.msgs[:0]
+		for _, wr := range chunk {
+			msgs = append(msgs, wr.msg)
+		}
+
+		n, err := w.conn.WriteBatch(msgs)
+		clear(msgs)
+		for _, wr := range chunk[:n] {
+			wr.done <- nil
+		}
+
+		if n < len(chunk) && err != nil {
+			// Report the error to the failed message only and retry the rest.
+			chunk[n].done <- err
+			n++
+		}
+
+		batch = batch[n:]
+	}
+}
@@ -0,0 +1,147 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+
+	proxynetutil "github.com/AdguardTeam/dnsproxy/internal/netutil"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeUDPBatchConn is the function-based [proxynetutil.UDPBatchConn]
+// implementation.
+type fakeUDPBatchConn struct {
+	onReadBatch  func(msgs []proxynetutil.UDPMessage) (n int, err error)
+	onWriteBatch func(msgs []proxynetutil.UDPMessage) (n int, err error)
+}
+
+// type check
+var _ proxynetutil.UDPBatchConn = (*fakeUDPBatchConn)(nil)
+
+// ReadBatch implements the [proxynetutil.UDPBatchConn] interface for
+// *fakeUDPBatchConn.
+func (c *fakeUDPBatchConn) ReadBatch(msgs []proxynetutil.UDPMessage) (n int, err error) {
+	return c.onReadBatch(msgs)
+}
+
+// WriteBatch implements the [proxynetutil.UDPBatchConn] interface for
+// *fakeUDPBatchConn.
+func (c *fakeUDPBatchConn) WriteBatch(msgs []proxynetutil.UDPMessage) (n int, err error) {
+	return c.onWriteBatch(msgs)
+}
+
+func TestUDPBatchWriter_write(t *testing.T) {
+	const testErr errors.Error = "test error"
+
+	// Fail the messages with the data "fail" one by one.
+	var written []string
+	conn := &fakeUDPBatchConn{
+		onWriteBatch: func(msgs []proxynetutil.UDPMessage) (n int, err error) {
+			for _, msg := range msgs {
+				if string(msg.Buf) == "fail" {
+					return n, testErr
+				}
+
+				written = append(written, string(msg.Buf))
+				n++
+			}
+
+			return n, nil
+		},
+	}
+
+	w := newUDPBatchWriter(conn)
+	batch := []*udpWrite{}
+	for _, data := range []string{"1", "fail", "2", "fail", "3"} {
+		batch = append(batch, &udpWrite{
+			done: make(chan error, 1),
+			msg:  proxynetutil.UDPMessage{Buf: []byte(data)},
+		})
+	}
+
+	w.flush(batch)
+
+	assert.Equal(t, []string{"1", "2", "3"}, written)
+	for i, wantErr := range []error{nil, testErr, nil, testErr, nil} {
+		err, _ := testutil.RequireReceive(t, batch[i].done, defaultTimeout)
+		assert.ErrorIs(t, err, wantErr)
+	}
+}
+
+func TestUDPBatchWriter_concurrent(t *testing.T) {
+	const num = 3 * proxynetutil.UDPBatchSize
+
+	mu := &sync.Mutex{}
+	var written int
+	conn := &fakeUDPBatchConn{
+		onWriteBatch: func(msgs []proxynetutil.UDPMessage) (n int, err error) {
+			require.LessOrEqual(testutil.PanicT{}, len(msgs), proxynetutil.UDPBatchSize)
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			written += len(msgs)
+
+			return len(msgs), nil
+		},
+	}
+
+	w := newUDPBatchWriter(conn)
+	wg := &sync.WaitGroup{}
+	for range num {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			assert.NoError(t, w.write(proxynetutil.UDPMessage{Buf: []byte{1}}))
+		}()
+	}
+
+	wg.Wait()
+
+	assert.Equal(t, num, written)
+}
+
+func TestUdpProxy_concurrent(t *testing.T) {
+	p := mustNew(t, &Config{
+		Logger:        testLogger,
+		UDPListenAddr: []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{newProfileTestUpstream("192.0.2.1")},
+		},
+		TrustedProxies: defaultTrustedProxies,
+	})
+
+	ctx := context.Background()
+	require.NoError(t, p.Start(ctx))
+	testutil.CleanupAndRequireSuccess(t, func() (err error) { return p.Shutdown(ctx) })
+
+	addr := p.Addr(ProtoUDP).String()
+
+	const num = 4 * proxynetutil.UDPBatchSize
+
+	errCh := make(chan error, num)
+	for range num {
+		go func() {
+			client := &dns.Client{Net: string(ProtoUDP), Timeout: defaultTimeout}
+			resp, _, err := client.Exchange(newHostTestMessage("batch.example"), addr)
+			if err == nil && len(resp.Answer) != 1 {
+				err = errors.Error("unexpected answer")
+			}
+
+			errCh <- err
+		}()
+	}
+
+	for range num {
+		err, _ := testutil.RequireReceive(t, errCh, defaultTimeout)
+		assert.NoError(t, err)
+	}
+}
@@ -0,0 +1,202 @@
+package proxy
+
+import (
+	"cmp"
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"time"
+
+	glcache "github.com/AdguardTeam/golibs/cache"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/miekg/dns"
+)
+
+const (
+	// defaultVerifiedTTL is the default duration a client remains verified
+	// after its last request over a connection-oriented protocol.
+	defaultVerifiedTTL = 1 * time.Hour
+
+	// defaultMaxVerifiedClients is the default maximum number of the verified
+	// clients remembered.
+	defaultMaxVerifiedClients = 10_000
+)
+
+// UDPTruncationConfig is the configuration of the sizes of the responses sent
+// over plain DNS-over-UDP.
+type UDPTruncationConfig struct {
+	// ListenerMaxSizes maps the addresses the UDP listeners are bound to, as
+	// in [Config.UDPListenAddr], to the maximum sizes of the responses sent
+	// from them, overriding MaxSize.
+	ListenerMaxSizes map[netip.AddrPort]uint16
+
+	// VerifiedTTL is the duration a client remains verified after its last
+	// request over TCP, TLS, HTTPS, or QUIC, all of which prove the address of
+	// the client.  Zero means the default of one hour.
+	VerifiedTTL time.Duration
+
+	// MaxVerifiedClients is the maximum number of the verified clients
+	// remembered, see VerifiedTTL.  Once exceeded, the least recently verified
+	// clients are forgotten.  Zero means the default of 10000.
+	MaxVerifiedClients uint
+
+	// MaxSize is the maximum size of the responses, which is also advertised
+	// in their OPT records.  The larger responses are truncated regardless of
+	// the size advertised by the client.  Zero means no limit besides the one
+	// of the client.
+	MaxSize uint16
+
+	// UnverifiedMaxSize is the maximum size of the responses to the clients
+	// which haven't been verified, see VerifiedTTL.  The larger responses are
+	// truncated, so that the client retries over TCP, which mitigates the
+	// amplification attacks with spoofed addresses.  Zero disables it.
+	UnverifiedMaxSize uint16
+}
+
+// validate returns an error if c is invalid.  c may be nil.
+func (c *UDPTruncationConfig) validate() (err error) {
+	if c == nil {
+		return nil
+	}
+
+	err = validateUDPSize(c.MaxSize)
+	if err != nil {
+		return fmt.Errorf("max size: %w", err)
+	}
+
+	err = validateUDPSize(c.UnverifiedMaxSize)
+	if err != nil {
+		return fmt.Errorf("unverified max size: %w", err)
+	}
+
+	for addr, size := range c.ListenerMaxSizes {
+		err = validateUDPSize(size)
+		if err != nil {
+			return fmt.Errorf("max size for %s: %w", addr, err)
+		}
+	}
+
+	if c.VerifiedTTL < 0 {
+		return fmt.Errorf("verified ttl: negative value %s", c.VerifiedTTL)
+	}
+
+	return nil
+}
+
+// validateUDPSize returns an error if size is neither zero nor a valid size of
+// a UDP response.
+func validateUDPSize(size uint16) (err error) {
+	if size != 0 && size < dns.MinMsgSize {
+		return fmt.Errorf("%d is less than %d", size, dns.MinMsgSize)
+	}
+
+	return nil
+}
+
+// udpTruncator limits the sizes of the responses sent over UDP.  A nil
+// *udpTruncator doesn't limit anything.  All methods are safe for concurrent
+// use.
+type udpTruncator struct {
+	// verified maps the addresses of the verified clients to the times of
+	// their verification expiry.
+	verified glcache.Cache
+
+	// clock is used to check the verification expiry.
+	clock Clock
+
+	// conf is the configuration of the truncation.
+	conf *UDPTruncationConfig
+
+	// verifiedTTL is the duration a client remains verified.
+	verifiedTTL time.Duration
+}
+
+// newUDPTruncator returns a new truncator for conf.  It returns nil if conf is
+// nil.  clock must not be nil.
+func newUDPTruncator(conf *UDPTruncationConfig, clock Clock) (t *udpTruncator) {
+	if conf == nil {
+		return nil
+	}
+
+	t = &udpTruncator{
+		clock:       clock,
+		conf:        conf,
+		verifiedTTL: conf.VerifiedTTL,
+	}
+
+	if t.verifiedTTL == 0 {
+		t.verifiedTTL = defaultVerifiedTTL
+	}
+
+	if conf.UnverifiedMaxSize != 0 {
+		t.verified = glcache.New(glcache.Config{
+			EnableLRU: true,
+			MaxCount:  cmp.Or(conf.MaxVerifiedClients, defaultMaxVerifiedClients),
+		})
+	}
+
+	return t
+}
+
+// prepare sets the maximum size of the response to the UDP request of d, or
+// verifies the client of d if the request came over another protocol.
+func (t *udpTruncator) prepare(d *DNSContext) {
+	if t == nil {
+		return
+	}
+
+	switch d.Proto {
+	case ProtoUDP:
+		d.maxUDPSize = t.maxSize(d)
+	case ProtoTCP, ProtoTLS, ProtoHTTPS, ProtoQUIC:
+		t.verify(d.Addr.Addr().Unmap())
+	default:
+		// Don't trust the DNSCrypt requests since those may come over UDP.
+	}
+}
+
+// maxSize returns the maximum size of the response to the UDP request of d.
+// Zero means no limit.
+func (t *udpTruncator) maxSize(d *DNSContext) (size uint16) {
+	size = t.conf.MaxSize
+	if d.Conn != nil {
+		listenAddr := netutil.NetAddrToAddrPort(d.Conn.LocalAddr())
+		if listenerSize, ok := t.conf.ListenerMaxSizes[listenAddr]; ok {
+			size = listenerSize
+		}
+	}
+
+	unverified := t.conf.UnverifiedMaxSize
+	if unverified == 0 || t.isVerified(d.Addr.Addr().Unmap()) {
+		return size
+	}
+
+	if size == 0 {
+		return unverified
+	}
+
+	return min(size, unverified)
+}
+
+// verify marks addr verified for the configured duration.
+func (t *udpTruncator) verify(addr netip.Addr) {
+	if t.verified == nil {
+		return
+	}
+
+	expire := make([]byte, uint64sz)
+	binary.BigEndian.PutUint64(expire, uint64(t.clock.Now().Add(t.verifiedTTL).UnixNano()))
+
+	t.verified.Set(addr.AsSlice(), expire)
+}
+
+// isVerified returns true if addr has been verified and the verification
+// hasn't expired yet.
+func (t *udpTruncator) isVerified(addr netip.Addr) (ok bool) {
+	expire := t.verified.Get(addr.AsSlice())
+	if len(expire) != uint64sz {
+		return false
+	}
+
+	return t.clock.Now().UnixNano() < int64(binary.BigEndian.Uint64(expire))
+}
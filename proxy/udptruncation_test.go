@@ -0,0 +1,198 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newLargeTestUpstream returns an upstream answering each request with rrsNum
+// A records.
+func newLargeTestUpstream(rrsNum int) (u *fakeUpstream) {
+	return &fakeUpstream{
+		onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			resp = (&dns.Msg{}).SetReply(req)
+			for i := range rrsNum {
+				resp.Answer = append(resp.Answer, &dns.A{
+					Hdr: dns.RR_Header{
+						Name:   req.Question[0].Name,
+						Rrtype: dns.TypeA,
+						Class:  dns.ClassINET,
+						Ttl:    defaultTestTTL,
+					},
+					A: net.IP{192, 0, 2, byte(i)},
+				})
+			}
+
+			return resp, nil
+		},
+		onAddress: func() (addr string) { return "large" },
+		onClose:   func() (err error) { return nil },
+	}
+}
+
+func TestProxy_udpTruncation(t *testing.T) {
+	const (
+		// rrsNum is the number of the A records in each response, which makes
+		// it about 1.6 KiB long.
+		rrsNum = 100
+
+		clientUDPSize = 4096
+	)
+
+	newProxy := func(t *testing.T, udpAddr netip.AddrPort, conf *UDPTruncationConfig) (p *Proxy) {
+		t.Helper()
+
+		p = mustNew(t, &Config{
+			Logger:        testLogger,
+			UDPListenAddr: []*net.UDPAddr{net.UDPAddrFromAddrPort(udpAddr)},
+			TCPListenAddr: []*net.TCPAddr{net.TCPAddrFromAddrPort(localhostAnyPort)},
+			UpstreamConfig: &UpstreamConfig{
+				Upstreams: []upstream.Upstream{newLargeTestUpstream(rrsNum)},
+			},
+			TrustedProxies: defaultTrustedProxies,
+			UDPTruncation:  conf,
+		})
+
+		ctx := context.Background()
+		require.NoError(t, p.Start(ctx))
+		testutil.CleanupAndRequireSuccess(t, func() (err error) { return p.Shutdown(ctx) })
+
+		return p
+	}
+
+	// exchange sends the request over network to p and returns the size of the
+	// response with the response itself.
+	exchange := func(t *testing.T, p *Proxy, network string) (size int, resp *dns.Msg) {
+		t.Helper()
+
+		proto := ProtoUDP
+		if network == "tcp" {
+			proto = ProtoTCP
+		}
+
+		conn, err := dns.Dial(network, p.Addr(proto).String())
+		require.NoError(t, err)
+		testutil.CleanupAndRequireSuccess(t, conn.Close)
+
+		conn.UDPSize = clientUDPSize
+
+		req := newHostTestMessage("example.org")
+		req.SetEdns0(clientUDPSize, false)
+		require.NoError(t, conn.WriteMsg(req))
+
+		b, err := conn.ReadMsgHeader(nil)
+		require.NoError(t, err)
+
+		resp = &dns.Msg{}
+		require.NoError(t, resp.Unpack(b))
+
+		return len(b), resp
+	}
+
+	// requireOPTSize fails the test if the OPT record of resp doesn't
+	// advertise size.
+	requireOPTSize := func(t *testing.T, want uint16, resp *dns.Msg) {
+		t.Helper()
+
+		opt := resp.IsEdns0()
+		require.NotNil(t, opt)
+
+		assert.Equal(t, want, opt.UDPSize())
+	}
+
+	t.Run("none", func(t *testing.T) {
+		p := newProxy(t, localhostAnyPort, nil)
+
+		size, resp := exchange(t, p, "udp")
+		assert.Greater(t, size, 1232)
+		assert.False(t, resp.Truncated)
+		assert.Len(t, resp.Answer, rrsNum)
+		requireOPTSize(t, clientUDPSize, resp)
+	})
+
+	t.Run("max_size", func(t *testing.T) {
+		p := newProxy(t, localhostAnyPort, &UDPTruncationConfig{MaxSize: 1232})
+
+		size, resp := exchange(t, p, "udp")
+		assert.LessOrEqual(t, size, 1232)
+		assert.True(t, resp.Truncated)
+		requireOPTSize(t, 1232, resp)
+
+		// The limit doesn't apply to TCP.
+		_, resp = exchange(t, p, "tcp")
+		assert.False(t, resp.Truncated)
+		assert.Len(t, resp.Answer, rrsNum)
+	})
+
+	t.Run("listener", func(t *testing.T) {
+		listenAddr := freeUDPAddr(t)
+		p := newProxy(t, listenAddr, &UDPTruncationConfig{
+			ListenerMaxSizes: map[netip.AddrPort]uint16{listenAddr: 600},
+			MaxSize:          1232,
+		})
+
+		size, resp := exchange(t, p, "udp")
+		assert.LessOrEqual(t, size, 600)
+		assert.True(t, resp.Truncated)
+		requireOPTSize(t, 600, resp)
+	})
+
+	t.Run("unverified", func(t *testing.T) {
+		p := newProxy(t, localhostAnyPort, &UDPTruncationConfig{
+			UnverifiedMaxSize: dns.MinMsgSize,
+		})
+
+		size, resp := exchange(t, p, "udp")
+		assert.LessOrEqual(t, size, dns.MinMsgSize)
+		assert.True(t, resp.Truncated)
+
+		// Retrying over TCP verifies the client.
+		_, resp = exchange(t, p, "tcp")
+		require.False(t, resp.Truncated)
+
+		size, resp = exchange(t, p, "udp")
+		assert.Greater(t, size, dns.MinMsgSize)
+		assert.False(t, resp.Truncated)
+		assert.Len(t, resp.Answer, rrsNum)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := New(&Config{
+			UDPListenAddr: []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+			UpstreamConfig: &UpstreamConfig{
+				Upstreams: []upstream.Upstream{newLargeTestUpstream(rrsNum)},
+			},
+			TrustedProxies: defaultTrustedProxies,
+			UDPTruncation:  &UDPTruncationConfig{UnverifiedMaxSize: 100},
+		})
+		testutil.AssertErrorMsg(
+			t,
+			"validating udp truncation: unverified max size: 100 is less than 512",
+			err,
+		)
+	})
+}
+
+func TestUDPTruncator_maxVerifiedClients(t *testing.T) {
+	tr := newUDPTruncator(&UDPTruncationConfig{
+		MaxVerifiedClients: 1,
+		UnverifiedMaxSize:  dns.MinMsgSize,
+	}, realClock{})
+
+	first, second := netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("192.0.2.2")
+
+	tr.verify(first)
+	require.True(t, tr.isVerified(first))
+
+	tr.verify(second)
+	assert.True(t, tr.isVerified(second))
+	assert.False(t, tr.isVerified(first))
+}
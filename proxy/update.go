@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"fmt"
+	"net/netip"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/miekg/dns"
+)
+
+// DynamicUpdateConfig is the configuration of forwarding the dynamic updates,
+// see RFC 2136.  The UPDATE messages are sent to the primary server of the zone
+// and its response is returned to the client as is.  Those are never cached.
+type DynamicUpdateConfig struct {
+	// Upstreams are the upstreams the updates are forwarded to, normally the
+	// primary server of the zones.  Those are tried in order until one of them
+	// responds.  If empty, the upstreams selected for the zone name just like
+	// for the queries are used.
+	Upstreams []upstream.Upstream
+
+	// AllowedClients are the networks of the clients allowed to update the
+	// zones.  The updates from other clients are refused, unless signed with
+	// one of AllowedKeys.
+	AllowedClients []netip.Prefix
+
+	// AllowedKeys are the names of the keys from [Config.TSIGKeys], the
+	// updates signed with which are allowed regardless of the client address.
+	// If the primary servers require the updates to be signed, use
+	// [upstream.Options.TSIGKey].
+	AllowedKeys []string
+}
+
+// validate returns an error if c is invalid.  c may be nil.
+func (c *DynamicUpdateConfig) validate() (err error) {
+	if c == nil {
+		return nil
+	}
+
+	for i, u := range c.Upstreams {
+		if u == nil {
+			return fmt.Errorf("upstream at index %d: nil upstream", i)
+		}
+	}
+
+	for i, pref := range c.AllowedClients {
+		if !pref.IsValid() {
+			return fmt.Errorf("allowed client at index %d: bad prefix", i)
+		}
+	}
+
+	return nil
+}
+
+// isAllowed returns true if the client of d is allowed to update the zones.
+func (c *DynamicUpdateConfig) isAllowed(d *DNSContext) (ok bool) {
+	return isClientAllowed(d, c.AllowedClients, c.AllowedKeys)
+}
+
+// handleUpdate forwards the dynamic update request in d, if it's one and
+// [Config.DynamicUpdate] is set.  resp is nil if the request isn't an update.
+func (p *Proxy) handleUpdate(d *DNSContext) (resp *dns.Msg) {
+	conf := p.DynamicUpdate
+	if conf == nil || d.Req.Opcode != dns.OpcodeUpdate {
+		return nil
+	}
+
+	if !conf.isAllowed(d) {
+		p.logger.Debug("dynamic update refused", "addr", p.anonymizer.addrPort(d.Addr))
+
+		return reply(d.Req, dns.RcodeRefused)
+	}
+
+	ups := conf.Upstreams
+	if len(ups) == 0 {
+		ups, _ = p.selectUpstreams(d)
+	}
+
+	resp, u, err := p.forwardUpdate(d.Req, ups)
+	if err != nil {
+		p.logger.Error("forwarding dynamic update", slogutil.KeyError, err)
+
+		return p.messages.NewMsgSERVFAIL(d.Req)
+	}
+
+	d.Upstream = u
+
+	return resp
+}
+
+// forwardUpdate sends the update req to the first of ups which responds.
+func (p *Proxy) forwardUpdate(
+	req *dns.Msg,
+	ups []upstream.Upstream,
+) (resp *dns.Msg, u upstream.Upstream, err error) {
+	if len(ups) == 0 {
+		return nil, nil, upstream.ErrNoUpstreams
+	}
+
+	var errs []error
+	for _, u = range ups {
+		start := p.time.Now()
+		resp, err = u.Exchange(req)
+		p.recordExchange(u, req, resp, start, p.time.Now().Sub(start), err)
+		if err == nil {
+			return resp, u, nil
+		}
+
+		errs = append(errs, fmt.Errorf("upstream %s: %w", u.Address(), err))
+	}
+
+	return nil, nil, errors.Join(errs...)
+}
@@ -0,0 +1,156 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newUpdateUpstream returns an upstream which answers the updates with NOTIMP
+// if fail is true and with NOERROR otherwise.  The number of the updates
+// received is counted in updates.
+func newUpdateUpstream(fail bool, updates *atomic.Int32) (u *fakeUpstream) {
+	return &fakeUpstream{
+		onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			rcode := dns.RcodeSuccess
+			if req.Opcode == dns.OpcodeUpdate {
+				updates.Add(1)
+				if fail {
+					rcode = dns.RcodeNotImplemented
+				}
+			}
+
+			return reply(req, rcode), nil
+		},
+		onAddress: func() (addr string) { return "tcp://192.0.2.53:53" },
+		onClose:   func() (err error) { return nil },
+	}
+}
+
+// newUpdateProxy starts a proxy resolving the queries with ups and forwarding
+// the updates according to conf.
+func newUpdateProxy(t *testing.T, ups upstream.Upstream, conf *DynamicUpdateConfig) (p *Proxy) {
+	t.Helper()
+
+	p = mustNew(t, &Config{
+		Logger:        testLogger,
+		UDPListenAddr: []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		TCPListenAddr: []*net.TCPAddr{net.TCPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{ups},
+		},
+		TrustedProxies: defaultTrustedProxies,
+		DynamicUpdate:  conf,
+	})
+
+	ctx := context.Background()
+	require.NoError(t, p.Start(ctx))
+	testutil.CleanupAndRequireSuccess(t, func() (err error) { return p.Shutdown(ctx) })
+
+	return p
+}
+
+func TestProxy_dynamicUpdate(t *testing.T) {
+	rr, err := dns.NewRR("www.example.org. 3600 IN A 192.0.2.1")
+	require.NoError(t, err)
+
+	req := (&dns.Msg{}).SetUpdate("example.org.")
+	req.Insert([]dns.RR{rr})
+
+	localhost := netip.MustParsePrefix("127.0.0.0/8")
+
+	testCases := []struct {
+		allowed         netip.Prefix
+		name            string
+		wantQueryUpds   int32
+		wantPrimaryUpds int32
+		wantRcode       int
+		withPrimary     bool
+	}{{
+		allowed:         localhost,
+		name:            "primary",
+		wantQueryUpds:   0,
+		wantPrimaryUpds: 1,
+		wantRcode:       dns.RcodeSuccess,
+		withPrimary:     true,
+	}, {
+		allowed:         localhost,
+		name:            "query_upstreams",
+		wantQueryUpds:   1,
+		wantPrimaryUpds: 0,
+		wantRcode:       dns.RcodeNotImplemented,
+		withPrimary:     false,
+	}, {
+		allowed:         netip.MustParsePrefix("192.0.2.0/24"),
+		name:            "refused",
+		wantQueryUpds:   0,
+		wantPrimaryUpds: 0,
+		wantRcode:       dns.RcodeRefused,
+		withPrimary:     true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var queryUpdates, primaryUpdates atomic.Int32
+			conf := &DynamicUpdateConfig{
+				AllowedClients: []netip.Prefix{tc.allowed},
+			}
+			if tc.withPrimary {
+				conf.Upstreams = []upstream.Upstream{newUpdateUpstream(false, &primaryUpdates)}
+			}
+
+			p := newUpdateProxy(t, newUpdateUpstream(true, &queryUpdates), conf)
+
+			client := &dns.Client{Net: string(ProtoUDP), Timeout: defaultTimeout}
+			resp, _, exchErr := client.Exchange(req, p.Addr(ProtoUDP).String())
+			require.NoError(t, exchErr)
+
+			assert.Equal(t, tc.wantRcode, resp.Rcode)
+			assert.Equal(t, dns.OpcodeUpdate, resp.Opcode)
+			assert.Equal(t, tc.wantQueryUpds, queryUpdates.Load())
+			assert.Equal(t, tc.wantPrimaryUpds, primaryUpdates.Load())
+		})
+	}
+}
+
+func TestDynamicUpdateConfig_validate(t *testing.T) {
+	testCases := []struct {
+		conf       *DynamicUpdateConfig
+		name       string
+		wantErrMsg string
+	}{{
+		conf:       nil,
+		name:       "nil",
+		wantErrMsg: "",
+	}, {
+		conf:       &DynamicUpdateConfig{},
+		name:       "empty",
+		wantErrMsg: "",
+	}, {
+		conf: &DynamicUpdateConfig{
+			Upstreams: []upstream.Upstream{nil},
+		},
+		name:       "nil_upstream",
+		wantErrMsg: "upstream at index 0: nil upstream",
+	}, {
+		conf: &DynamicUpdateConfig{
+			AllowedClients: []netip.Prefix{{}},
+		},
+		name:       "bad_prefix",
+		wantErrMsg: "allowed client at index 0: bad prefix",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, tc.conf.validate())
+		})
+	}
+}
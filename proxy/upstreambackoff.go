@@ -0,0 +1,202 @@
+package proxy
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"golang.org/x/exp/rand"
+)
+
+// UpstreamBackoffConfig is the configuration of skipping the repeatedly failing
+// upstreams in the load-balancing mode.  Each failure of an upstream makes it
+// skipped for a time, which grows exponentially with the failures in a row,
+// while a success resets it.  If all the upstreams selected for a request are
+// skipped, they are used anyway.
+type UpstreamBackoffConfig struct {
+	// Backoff is the time an upstream is skipped for after its first failure
+	// in a row, which doubles with each next one.  The actual time is chosen
+	// randomly between the half of the current one and the whole.  It must be
+	// positive.
+	Backoff time.Duration
+
+	// MaxBackoff, if not zero, is the maximum time an upstream is skipped for.
+	MaxBackoff time.Duration
+}
+
+// validate returns an error if c is invalid.  c may be nil.
+func (c *UpstreamBackoffConfig) validate() (err error) {
+	if c == nil {
+		return nil
+	}
+
+	switch {
+	case c.Backoff <= 0:
+		return fmt.Errorf("backoff: must be positive, got %s", c.Backoff)
+	case c.MaxBackoff < 0:
+		return fmt.Errorf("max backoff: negative value %s", c.MaxBackoff)
+	default:
+		return nil
+	}
+}
+
+// UpstreamBackoff is the state of an upstream skipped due to its failures, see
+// [UpstreamBackoffConfig].
+type UpstreamBackoff struct {
+	// Until is the time until which the upstream is skipped.  Once it's passed,
+	// the upstream is tried again.
+	Until time.Time
+
+	// Address is the address of the upstream, see [upstream.Upstream.Address].
+	Address string
+
+	// Failures is the number of the failures of the upstream in a row.
+	Failures uint
+}
+
+// upstreamBackoffs keeps the backoff states of the failing upstreams.  A nil
+// *upstreamBackoffs doesn't skip any upstreams.  All methods are safe for
+// concurrent use.
+type upstreamBackoffs struct {
+	// mu protects states.
+	mu *sync.Mutex
+
+	// conf is the configuration of the backoff.  It's never nil.
+	conf *UpstreamBackoffConfig
+
+	// states maps the addresses of the upstreams failed the last time to their
+	// states.
+	states map[string]*UpstreamBackoff
+
+	// jitter returns a random number in the half-open interval [0.0, 1.0).
+	// It's replaced in tests.
+	jitter func() (f float64)
+}
+
+// newUpstreamBackoffs returns a new *upstreamBackoffs for conf.  It returns nil
+// if conf is nil.
+func newUpstreamBackoffs(conf *UpstreamBackoffConfig) (b *upstreamBackoffs) {
+	if conf == nil {
+		return nil
+	}
+
+	return &upstreamBackoffs{
+		mu:     &sync.Mutex{},
+		conf:   conf,
+		states: map[string]*UpstreamBackoff{},
+		jitter: rand.Float64,
+	}
+}
+
+// filter returns ups without the ones skipped at now.  It returns ups itself if
+// none of them is skipped or if all of them are.
+func (b *upstreamBackoffs) filter(ups []upstream.Upstream, now time.Time) (filtered []upstream.Upstream) {
+	if b == nil {
+		return ups
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.states) == 0 {
+		return ups
+	}
+
+	filtered = slices.DeleteFunc(slices.Clone(ups), func(u upstream.Upstream) (ok bool) {
+		s, ok := b.states[u.Address()]
+
+		return ok && now.Before(s.Until)
+	})
+
+	if len(filtered) == 0 {
+		return ups
+	}
+
+	return filtered
+}
+
+// update records the result of the exchange with the upstream with addr
+// finished at now.
+func (b *upstreamBackoffs) update(addr string, err error, now time.Time) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err == nil {
+		delete(b.states, addr)
+
+		return
+	}
+
+	s, ok := b.states[addr]
+	if !ok {
+		s = &UpstreamBackoff{
+			Address: addr,
+		}
+		b.states[addr] = s
+	}
+
+	s.Failures++
+	s.Until = now.Add(b.backoff(s.Failures))
+}
+
+// backoff returns the randomized time an upstream is skipped for after the
+// failures in a row.  failures must be positive.
+func (b *upstreamBackoffs) backoff(failures uint) (d time.Duration) {
+	d = b.conf.Backoff
+	for n := failures - 1; n > 0 && d < math.MaxInt64/2; n-- {
+		d *= 2
+	}
+
+	if b.conf.MaxBackoff > 0 {
+		d = min(d, b.conf.MaxBackoff)
+	}
+
+	half := d / 2
+
+	return half + time.Duration(b.jitter()*float64(d-half))
+}
+
+// restore sets the states of the failing upstreams to states.
+func (b *upstreamBackoffs) restore(states []*UpstreamBackoff) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, s := range states {
+		b.states[s.Address] = s
+	}
+}
+
+// list returns the copies of the states of the failing upstreams sorted by
+// address.
+func (b *upstreamBackoffs) list() (states []*UpstreamBackoff) {
+	if b == nil {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	states = make([]*UpstreamBackoff, 0, len(b.states))
+	for _, s := range b.states {
+		c := *s
+		states = append(states, &c)
+	}
+
+	slices.SortFunc(states, func(a, b *UpstreamBackoff) (res int) {
+		return strings.Compare(a.Address, b.Address)
+	})
+
+	return states
+}
@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpstreamBackoffs_backoff(t *testing.T) {
+	b := newUpstreamBackoffs(&UpstreamBackoffConfig{
+		Backoff:    1 * time.Second,
+		MaxBackoff: 5 * time.Second,
+	})
+
+	testCases := []struct {
+		name     string
+		jitter   float64
+		failures uint
+		want     time.Duration
+	}{{
+		name:     "first_min",
+		jitter:   0,
+		failures: 1,
+		want:     500 * time.Millisecond,
+	}, {
+		name:     "first_mid",
+		jitter:   0.5,
+		failures: 1,
+		want:     750 * time.Millisecond,
+	}, {
+		name:     "third_min",
+		jitter:   0,
+		failures: 3,
+		want:     2 * time.Second,
+	}, {
+		name:     "capped",
+		jitter:   0,
+		failures: 10,
+		want:     2500 * time.Millisecond,
+	}, {
+		name:     "overflow",
+		jitter:   0,
+		failures: 100,
+		want:     2500 * time.Millisecond,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			b.jitter = func() (f float64) { return tc.jitter }
+
+			assert.Equal(t, tc.want, b.backoff(tc.failures))
+		})
+	}
+}
+
+func TestProxy_upstreamBackoff(t *testing.T) {
+	const (
+		requestsNum = 100
+		backoff     = 2 * time.Second
+	)
+
+	var goodNum, badNum atomic.Int32
+	var badFixed atomic.Bool
+
+	goodUps := newCountingUpstream("good", &goodNum)
+	badUps := &fakeUpstream{
+		onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			badNum.Add(1)
+			if !badFixed.Load() {
+				return nil, assert.AnError
+			}
+
+			return newCompareTestReply(req, "192.0.2.2", defaultTestTTL), nil
+		},
+		onAddress: func() (addr string) { return "bad" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	now := time.Unix(0, 0)
+	p := mustNew(t, &Config{
+		Logger:        testLogger,
+		UDPListenAddr: []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{goodUps, badUps},
+		},
+		TrustedProxies: defaultTrustedProxies,
+		UpstreamMode:   UModeLoadBalance,
+		UpstreamBackoff: &UpstreamBackoffConfig{
+			Backoff: backoff,
+		},
+		Clock: &fakeClock{onNow: func() (n time.Time) { return now }},
+	})
+	p.backoffs.jitter = func() (f float64) { return 0 }
+
+	resolve := func(t *testing.T) {
+		t.Helper()
+
+		for range requestsNum {
+			require.NoError(t, p.Resolve(&DNSContext{Req: newHostTestMessage("example.org")}))
+		}
+	}
+
+	resolve(t)
+
+	// The failing upstream is skipped after the first failure.
+	assert.Equal(t, int32(1), badNum.Load())
+	assert.Equal(t, int32(requestsNum), goodNum.Load())
+	assert.Equal(t, []*UpstreamBackoff{{
+		Until:    now.Add(backoff / 2),
+		Address:  "bad",
+		Failures: 1,
+	}}, p.Stats().UpstreamBackoffs())
+
+	now = now.Add(backoff / 2)
+	resolve(t)
+
+	// It's tried again once the backoff is over and the backoff doubles.
+	assert.Equal(t, int32(2), badNum.Load())
+	assert.Equal(t, []*UpstreamBackoff{{
+		Until:    now.Add(backoff),
+		Address:  "bad",
+		Failures: 2,
+	}}, p.Stats().UpstreamBackoffs())
+
+	badFixed.Store(true)
+	now = now.Add(backoff)
+	resolve(t)
+
+	// A success resets the backoff.
+	assert.Greater(t, badNum.Load(), int32(2))
+	assert.Empty(t, p.Stats().UpstreamBackoffs())
+}
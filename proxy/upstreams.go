@@ -1,15 +1,18 @@
 package proxy
 
 import (
+	"cmp"
 	"fmt"
 	"io"
+	"log/slog"
+	"net/netip"
 	"slices"
+	"strconv"
 	"strings"
 
 	"github.com/AdguardTeam/dnsproxy/upstream"
 	"github.com/AdguardTeam/golibs/container"
 	"github.com/AdguardTeam/golibs/errors"
-	"github.com/AdguardTeam/golibs/log"
 	"github.com/AdguardTeam/golibs/mapsutil"
 	"github.com/AdguardTeam/golibs/netutil"
 )
@@ -57,6 +60,16 @@ var _ io.Closer = (*UpstreamConfig)(nil)
 // Where <upstreamString> is one or many upstreams separated by space (e.g.
 // `1.1.1.1` or `1.1.1.1 2.2.2.2`).
 //
+// Any domain may also be specified as a subnet in CIDR notation, which stands
+// for the ARPA domains covering the addresses within it.  For example:
+//
+//	[/10.1.0.0/16/10.2.0.0/20/]1.2.3.4
+//
+// will send the reverse DNS queries for the addresses within 10.1.0.0/16 and
+// 10.2.0.0/20 to 1.2.3.4.  The subnets not aligned to the labels of the ARPA
+// domains are covered by several domains, like 0.2.10.in-addr.arpa through
+// 15.2.10.in-addr.arpa for 10.2.0.0/20.
+//
 // More specific domains take priority over less specific domains.  To exclude
 // more specific domains from reserved upstreams querying you should use the
 // following syntax:
@@ -99,6 +112,7 @@ func ParseUpstreamsConfig(
 
 	p := &configParser{
 		options:                  opts,
+		logger:                   cmp.Or(opts.Logger, slog.Default()),
 		upstreamsIndex:           map[string]upstream.Upstream{},
 		domainReservedUpstreams:  map[string][]upstream.Upstream{},
 		specifiedDomainUpstreams: map[string][]upstream.Upstream{},
@@ -138,6 +152,9 @@ type configParser struct {
 	// options contains upstream properties.
 	options *upstream.Options
 
+	// logger is used for logging the parsing results.  It's never nil.
+	logger *slog.Logger
+
 	// upstreamsIndex is used to avoid creating duplicates of upstreams.
 	upstreamsIndex map[string]upstream.Upstream
 
@@ -226,7 +243,22 @@ func splitConfigLine(confLine string) (upstreams, domains []string, err error) {
 	}
 
 	// split domains list
-	for _, confHost := range strings.Split(domainsLine, "/") {
+	specs := strings.Split(domainsLine, "/")
+	for i := 0; i < len(specs); i++ {
+		confHost := specs[i]
+		if i+1 < len(specs) && isSubnetSpec(confHost, specs[i+1]) {
+			var pref netip.Prefix
+			pref, err = netip.ParsePrefix(confHost + "/" + specs[i+1])
+			if err != nil {
+				return nil, nil, err
+			}
+
+			domains = append(domains, reversedZones(pref)...)
+			i++
+
+			continue
+		}
+
 		if confHost == "" {
 			// empty domain specification means `unqualified names only`
 			domains = append(domains, UnqualifiedNames)
@@ -245,6 +277,58 @@ func splitConfigLine(confLine string) (upstreams, domains []string, err error) {
 	return strings.Fields(upstreamsLine), domains, nil
 }
 
+// isSubnetSpec returns true if addr and bits, which are two consecutive parts of
+// the domains specification, constitute a subnet in CIDR notation.
+func isSubnetSpec(addr, bits string) (ok bool) {
+	if bits == "" || strings.Trim(bits, "0123456789") != "" {
+		return false
+	}
+
+	_, err := netip.ParseAddr(addr)
+
+	return err == nil
+}
+
+// reversedZones returns the ARPA domain names covering exactly the addresses
+// within pref.  The prefixes not aligned to the labels of the ARPA domains are
+// covered by several domains, one for each value of the last label.
+func reversedZones(pref netip.Prefix) (zones []string) {
+	pref = pref.Masked()
+	data := pref.Addr().AsSlice()
+
+	labelBits, base, suffix := 4, 16, "ip6.arpa."
+	if pref.Addr().Is4() {
+		labelBits, base, suffix = 8, 10, "in-addr.arpa."
+	}
+
+	labelsNum := (pref.Bits() + labelBits - 1) / labelBits
+	zonesNum := 1 << (labelsNum*labelBits - pref.Bits())
+
+	zones = make([]string, 0, zonesNum)
+	for i := range zonesNum {
+		b := &strings.Builder{}
+		for l := labelsNum - 1; l >= 0; l-- {
+			var label int
+			if labelBits == 8 {
+				label = int(data[l])
+			} else {
+				label = int(data[l/2]>>(4*(1-l%2))) & 0xf
+			}
+
+			if l == labelsNum-1 {
+				label |= i
+			}
+
+			b.WriteString(strconv.FormatInt(int64(label), base))
+			b.WriteByte('.')
+		}
+
+		zones = append(zones, b.String()+suffix)
+	}
+
+	return zones
+}
+
 // specifyUpstream specifies the upstream for domains.
 func (p *configParser) specifyUpstream(domains []string, u string, idx int) (err error) {
 	dnsUpstream, ok := p.upstreamsIndex[u]
@@ -266,14 +350,15 @@ func (p *configParser) specifyUpstream(domains []string, u string, idx int) (err
 		p.upstreams = append(p.upstreams, dnsUpstream)
 
 		// TODO(s.chzhen):  Logs without index.
-		log.Debug("dnsproxy: upstream at index %d: %s", idx, addr)
+		p.logger.Debug("upstream parsed", "idx", idx, "addr", addr)
 	} else {
 		p.includeToReserved(dnsUpstream, domains)
 
-		log.Debug("dnsproxy: upstream at index %d: %s is reserved for %d domains",
-			idx,
-			addr,
-			len(domains),
+		p.logger.Debug(
+			"upstream parsed with reserved domains",
+			"idx", idx,
+			"addr", addr,
+			"domains_num", len(domains),
 		)
 	}
 
@@ -303,7 +388,7 @@ func (p *configParser) includeToReserved(dnsUpstream upstream.Upstream, domains
 			host = host[len("*."):]
 
 			p.subdomainsOnlyExclusions.Add(host)
-			log.Debug("domain %q is added to exclusions list", host)
+			p.logger.Debug("domain is added to exclusions list", "host", host)
 
 			p.subdomainsOnlyUpstreams[host] = append(p.subdomainsOnlyUpstreams[host], dnsUpstream)
 		} else {
@@ -460,6 +545,26 @@ func (uc *UpstreamConfig) lookupUpstreams(name string) (ups []upstream.Upstream,
 	return ups, true
 }
 
+// uses returns true if u is one of the upstreams of uc.
+func (uc *UpstreamConfig) uses(u upstream.Upstream) (ok bool) {
+	if slices.Contains(uc.Upstreams, u) {
+		return true
+	}
+
+	for _, specUps := range []map[string][]upstream.Upstream{
+		uc.DomainReservedUpstreams,
+		uc.SpecifiedDomainUpstreams,
+	} {
+		for _, ups := range specUps {
+			if slices.Contains(ups, u) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
 // Close implements the io.Closer interface for *UpstreamConfig.
 func (uc *UpstreamConfig) Close() (err error) {
 	closeErrs := closeAll(nil, uc.Upstreams...)
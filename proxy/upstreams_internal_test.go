@@ -253,6 +253,14 @@ func TestValidatePrivateConfig(t *testing.T) {
 		wantErr: `reversed subnet in "1.2.3.4.in-addr.arpa." is not private` +
 			"\n" + `bad arpa domain name "non.arpa": not a reversed ip network`,
 		u: "[/non.arpa/1.2.3.4.in-addr.arpa/127.in-addr.arpa/]#",
+	}, {
+		name:    "success_cidr",
+		wantErr: ``,
+		u:       "[/10.1.0.0/16/fd00::/8/]#",
+	}, {
+		name:    "non-private_cidr",
+		wantErr: `reversed subnet in "2.1.in-addr.arpa." is not private`,
+		u:       "[/1.2.0.0/16/]#",
 	}, {
 		name:    "partial_good",
 		wantErr: "",
@@ -271,6 +279,87 @@ func TestValidatePrivateConfig(t *testing.T) {
 	}
 }
 
+func TestUpstreamConfig_GetUpstreamsForDomain_subnets(t *testing.T) {
+	t.Parallel()
+
+	const (
+		siteAUpstream = "tcp://site-a.upstream:53"
+		siteBUpstream = "tcp://site-b.upstream:53"
+		siteCUpstream = "tcp://site-c.upstream:53"
+	)
+
+	config, err := ParseUpstreamsConfig([]string{
+		generalUpstream,
+		"[/10.1.0.0/16/]" + siteAUpstream,
+		"[/10.2.0.0/20/fd00:2::/36/]" + siteBUpstream,
+		"[/10.1.5.0/24/]#",
+		"[/" + topLevelDomain + "/192.168.0.0/16/]" + siteCUpstream,
+	}, nil)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name string
+		in   string
+		want []string
+	}{{
+		name: "aligned",
+		in:   "1.2.1.10.in-addr.arpa.",
+		want: []string{siteAUpstream},
+	}, {
+		name: "excluded",
+		in:   "1.5.1.10.in-addr.arpa.",
+		want: []string{generalUpstream},
+	}, {
+		name: "unaligned_first",
+		in:   "1.0.2.10.in-addr.arpa.",
+		want: []string{siteBUpstream},
+	}, {
+		name: "unaligned_last",
+		in:   "1.15.2.10.in-addr.arpa.",
+		want: []string{siteBUpstream},
+	}, {
+		name: "unaligned_outside",
+		in:   "1.16.2.10.in-addr.arpa.",
+		want: []string{generalUpstream},
+	}, {
+		name: "ipv6",
+		in:   "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.f.f.f.0.2.0.0.0.0.0.d.f.ip6.arpa.",
+		want: []string{siteBUpstream},
+	}, {
+		name: "ipv6_outside",
+		in:   "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.1.2.0.0.0.0.0.d.f.ip6.arpa.",
+		want: []string{generalUpstream},
+	}, {
+		name: "mixed_domain",
+		in:   firstLevelFQDN,
+		want: []string{siteCUpstream},
+	}, {
+		name: "mixed_subnet",
+		in:   "1.1.168.192.in-addr.arpa.",
+		want: []string{siteCUpstream},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			ups := config.getUpstreamsForDomain(tc.in)
+			assertUpstreamsAddrs(t, ups, tc.want)
+		})
+	}
+
+	t.Run("bad_subnet", func(t *testing.T) {
+		t.Parallel()
+
+		_, err = ParseUpstreamsConfig([]string{"[/10.1.0.0/33/]" + siteAUpstream}, nil)
+		testutil.AssertErrorMsg(
+			t,
+			`parsing error at index 0: netip.ParsePrefix("10.1.0.0/33"): prefix length out of range`,
+			err,
+		)
+	})
+}
+
 func TestGetUpstreamsForDomainWithoutDuplicates(t *testing.T) {
 	upstreams := []string{"[/example.com/]1.1.1.1", "[/example.org/]1.1.1.1"}
 	config, err := ParseUpstreamsConfig(
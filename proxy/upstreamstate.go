@@ -0,0 +1,130 @@
+package proxy
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// errUnknownUpstream is returned by [Proxy.SetUpstreamEnabled] when there is
+// no configured upstream with the address.
+const errUnknownUpstream errors.Error = "unknown upstream"
+
+// UpstreamState is the runtime state of a configured upstream.
+type UpstreamState struct {
+	// Address is the address of the upstream, see [upstream.Upstream.Address].
+	Address string
+
+	// Enabled is false if the upstream has been disabled with
+	// [Proxy.SetUpstreamEnabled].
+	Enabled bool
+}
+
+// Upstreams returns the states of the general and the domain-specific
+// upstreams from [Config.UpstreamConfig], sorted by address.
+func (p *Proxy) Upstreams() (states []*UpstreamState) {
+	var disabled map[string]struct{}
+	if cur := p.disabledUpstreams.Load(); cur != nil {
+		disabled = *cur
+	}
+
+	for _, addr := range p.upstreamAddrs() {
+		_, isDisabled := disabled[addr]
+		states = append(states, &UpstreamState{
+			Address: addr,
+			Enabled: !isDisabled,
+		})
+	}
+
+	return states
+}
+
+// SetUpstreamEnabled enables or disables the configured upstream with addr, so
+// that it's skipped when the general and the domain-specific upstreams are
+// selected for a request.  If all the upstreams selected for a request are
+// disabled, they are used anyway.  It returns an error if there is no such
+// upstream.  It's safe for concurrent use.
+func (p *Proxy) SetUpstreamEnabled(addr string, enabled bool) (err error) {
+	if !slices.Contains(p.upstreamAddrs(), addr) {
+		return fmt.Errorf("%w: %q", errUnknownUpstream, addr)
+	}
+
+	p.upstreamStateLock.Lock()
+	defer p.upstreamStateLock.Unlock()
+
+	// Copy the set, since it's read without locking.
+	next := map[string]struct{}{}
+	if cur := p.disabledUpstreams.Load(); cur != nil {
+		next = maps.Clone(*cur)
+	}
+
+	if enabled {
+		delete(next, addr)
+	} else {
+		next[addr] = struct{}{}
+	}
+
+	p.disabledUpstreams.Store(&next)
+
+	p.upstreamLogger.Info("upstream state changed", "addr", addr, "enabled", enabled)
+
+	return nil
+}
+
+// upstreamAddrs returns the sorted unique addresses of the general and the
+// domain-specific upstreams.
+func (p *Proxy) upstreamAddrs() (addrs []string) {
+	p.reconfigureLock.RLock()
+	defer p.reconfigureLock.RUnlock()
+
+	uc := p.UpstreamConfig
+	if uc == nil {
+		return nil
+	}
+
+	for _, u := range uc.Upstreams {
+		addrs = append(addrs, u.Address())
+	}
+
+	for _, specUps := range []map[string][]upstream.Upstream{
+		uc.DomainReservedUpstreams,
+		uc.SpecifiedDomainUpstreams,
+	} {
+		for _, ups := range specUps {
+			for _, u := range ups {
+				addrs = append(addrs, u.Address())
+			}
+		}
+	}
+
+	slices.SortFunc(addrs, strings.Compare)
+
+	return slices.Compact(addrs)
+}
+
+// filterDisabled returns ups without the disabled upstreams.  It returns ups
+// itself if none of them is disabled or if all of them are.
+func (p *Proxy) filterDisabled(ups []upstream.Upstream) (filtered []upstream.Upstream) {
+	disabled := p.disabledUpstreams.Load()
+	if disabled == nil || len(*disabled) == 0 {
+		return ups
+	}
+
+	filtered = slices.DeleteFunc(slices.Clone(ups), func(u upstream.Upstream) (ok bool) {
+		_, ok = (*disabled)[u.Address()]
+
+		return ok
+	})
+
+	if len(filtered) == 0 {
+		p.upstreamLogger.Debug("all selected upstreams are disabled, using them anyway")
+
+		return ups
+	}
+
+	return filtered
+}
@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newCountingUpstream returns the upstream with addr counting the exchanges in
+// n.
+func newCountingUpstream(addr string, n *atomic.Int32) (u *fakeUpstream) {
+	return &fakeUpstream{
+		onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			n.Add(1)
+
+			return newCompareTestReply(req, "192.0.2.1", defaultTestTTL), nil
+		},
+		onAddress: func() (a string) { return addr },
+		onClose:   func() (err error) { return nil },
+	}
+}
+
+func TestProxy_SetUpstreamEnabled(t *testing.T) {
+	var first, second, domain atomic.Int32
+	firstUps := newCountingUpstream("first", &first)
+	secondUps := newCountingUpstream("second", &second)
+	domainUps := newCountingUpstream("domain", &domain)
+
+	p := mustNew(t, &Config{
+		Logger:        testLogger,
+		UDPListenAddr: []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{firstUps, secondUps},
+			DomainReservedUpstreams: map[string][]upstream.Upstream{
+				"domain.example.": {domainUps},
+			},
+		},
+		TrustedProxies: defaultTrustedProxies,
+		UpstreamMode:   UModeLoadBalance,
+	})
+
+	assert.Equal(t, []*UpstreamState{
+		{Address: "domain", Enabled: true},
+		{Address: "first", Enabled: true},
+		{Address: "second", Enabled: true},
+	}, p.Upstreams())
+
+	err := p.SetUpstreamEnabled("unknown", false)
+	testutil.AssertErrorMsg(t, `unknown upstream: "unknown"`, err)
+
+	require.NoError(t, p.SetUpstreamEnabled("first", false))
+	assert.Equal(t, []*UpstreamState{
+		{Address: "domain", Enabled: true},
+		{Address: "first", Enabled: false},
+		{Address: "second", Enabled: true},
+	}, p.Upstreams())
+
+	exchange := func(t *testing.T, host string) {
+		t.Helper()
+
+		d := &DNSContext{Req: newHostTestMessage(host)}
+		require.NoError(t, p.Resolve(d))
+	}
+
+	for range 10 {
+		exchange(t, "example.org")
+	}
+
+	assert.Zero(t, first.Load())
+	assert.Equal(t, int32(10), second.Load())
+
+	t.Run("all_disabled", func(t *testing.T) {
+		require.NoError(t, p.SetUpstreamEnabled("domain", false))
+
+		exchange(t, "domain.example")
+		assert.Equal(t, int32(1), domain.Load())
+	})
+
+	t.Run("enabled_again", func(t *testing.T) {
+		require.NoError(t, p.SetUpstreamEnabled("first", true))
+		require.NoError(t, p.SetUpstreamEnabled("second", false))
+
+		exchange(t, "example.org")
+		assert.Equal(t, int32(1), first.Load())
+		assert.Equal(t, int32(10), second.Load())
+	})
+}
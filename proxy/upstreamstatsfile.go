@@ -0,0 +1,204 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+)
+
+// upstreamStatsFileVersion is the version of the format of the persisted
+// statistics of the upstreams.
+const upstreamStatsFileVersion = 1
+
+// upstreamStatsFile is the persisted statistics of the upstreams.
+type upstreamStatsFile struct {
+	// Upstreams are the statistics of the upstreams.
+	Upstreams []*upstreamStatsFileEntry `json:"upstreams"`
+
+	// Version is the version of the format, see [upstreamStatsFileVersion].
+	Version uint `json:"version"`
+}
+
+// upstreamStatsFileEntry is the persisted statistics of a single upstream.
+type upstreamStatsFileEntry struct {
+	// Address is the address of the upstream.
+	Address string `json:"address"`
+
+	// RTTSumUsec is the sum of the round-trip times, including the penalties
+	// for the failures, in microseconds.
+	RTTSumUsec float64 `json:"rtt_sum_usec"`
+
+	// Requests is the number of the requests the round-trip times are summed
+	// for.
+	Requests float64 `json:"requests"`
+
+	// BackoffUntil is the time until which the upstream is skipped, in Unix
+	// seconds, see [UpstreamBackoff].  It's zero if the upstream hasn't failed
+	// the last time.
+	BackoffUntil int64 `json:"backoff_until,omitempty"`
+
+	// Failures is the number of the failures of the upstream in a row.
+	Failures uint `json:"failures,omitempty"`
+}
+
+// loadUpstreamStats restores the statistics of the upstreams from
+// [Config.UpstreamStatsPath], if it's set.  The errors are only logged, since
+// the statistics are restored on a best-effort basis.
+func (p *Proxy) loadUpstreamStats(ctx context.Context) {
+	path := p.UpstreamStatsPath
+	if path == "" {
+		return
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			p.logger.WarnContext(ctx, "reading upstream stats", slogutil.KeyError, err)
+		}
+
+		return
+	}
+
+	file := &upstreamStatsFile{}
+	err = json.Unmarshal(b, file)
+	if err == nil && file.Version != upstreamStatsFileVersion {
+		err = fmt.Errorf("version: unsupported value %d", file.Version)
+	}
+
+	if err != nil {
+		p.logger.WarnContext(ctx, "decoding upstream stats", "path", path, slogutil.KeyError, err)
+
+		return
+	}
+
+	p.restoreUpstreamStats(file.Upstreams)
+
+	p.logger.DebugContext(ctx, "restored upstream stats", "path", path, "num", len(file.Upstreams))
+}
+
+// restoreUpstreamStats sets the statistics of the upstreams from entries.
+func (p *Proxy) restoreUpstreamStats(entries []*upstreamStatsFileEntry) {
+	p.rttLock.Lock()
+	defer p.rttLock.Unlock()
+
+	if p.upstreamRTTStats == nil {
+		p.upstreamRTTStats = map[string]upstreamRTTStats{}
+	}
+
+	var backoffs []*UpstreamBackoff
+	for _, e := range entries {
+		if e.Requests > 0 {
+			p.upstreamRTTStats[e.Address] = upstreamRTTStats{
+				rttSum: e.RTTSumUsec,
+				reqNum: e.Requests,
+			}
+		}
+
+		if e.Failures > 0 {
+			backoffs = append(backoffs, &UpstreamBackoff{
+				Until:    time.Unix(e.BackoffUntil, 0),
+				Address:  e.Address,
+				Failures: e.Failures,
+			})
+		}
+	}
+
+	p.backoffs.restore(backoffs)
+}
+
+// saveUpstreamStats writes the statistics of the upstreams to
+// [Config.UpstreamStatsPath], if it's set.  The file is replaced atomically.
+func (p *Proxy) saveUpstreamStats() (err error) {
+	path := p.UpstreamStatsPath
+	if path == "" {
+		return nil
+	}
+
+	file := &upstreamStatsFile{
+		Version: upstreamStatsFileVersion,
+	}
+
+	entries := map[string]*upstreamStatsFileEntry{}
+	func() {
+		p.rttLock.Lock()
+		defer p.rttLock.Unlock()
+
+		for addr, s := range p.upstreamRTTStats {
+			entries[addr] = &upstreamStatsFileEntry{
+				Address:    addr,
+				RTTSumUsec: s.rttSum,
+				Requests:   s.reqNum,
+			}
+		}
+	}()
+
+	for _, b := range p.backoffs.list() {
+		e, ok := entries[b.Address]
+		if !ok {
+			e = &upstreamStatsFileEntry{Address: b.Address}
+			entries[b.Address] = e
+		}
+
+		e.BackoffUntil = b.Until.Unix()
+		e.Failures = b.Failures
+	}
+
+	file.Upstreams = make([]*upstreamStatsFileEntry, 0, len(entries))
+	for _, e := range entries {
+		file.Upstreams = append(file.Upstreams, e)
+	}
+
+	slices.SortFunc(file.Upstreams, func(a, b *upstreamStatsFileEntry) (res int) {
+		return strings.Compare(a.Address, b.Address)
+	})
+
+	err = replaceFile(path, func(w io.Writer) (err error) {
+		return json.NewEncoder(w).Encode(file)
+	})
+	if err != nil {
+		return fmt.Errorf("saving upstream stats: %w", err)
+	}
+
+	return nil
+}
+
+// replaceFile atomically replaces the file at path with the data written by
+// write.
+func replaceFile(path string, write func(w io.Writer) (err error)) (err error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("creating: %w", err)
+	}
+
+	defer func() {
+		if err != nil {
+			err = errors.WithDeferred(err, os.Remove(tmp.Name()))
+		}
+	}()
+
+	err = write(tmp)
+	if err != nil {
+		return errors.WithDeferred(fmt.Errorf("writing: %w", err), tmp.Close())
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return fmt.Errorf("closing: %w", err)
+	}
+
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return fmt.Errorf("replacing: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_upstreamStats(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "upstreams.json")
+
+	const data = `{"version":1,"upstreams":[` +
+		`{"address":"192.0.2.1","rtt_sum_usec":30000,"requests":3},` +
+		`{"address":"192.0.2.2","rtt_sum_usec":10000000,"requests":1,` +
+		`"backoff_until":1700000000,"failures":2}` +
+		`]}`
+	require.NoError(t, os.WriteFile(path, []byte(data), 0o600))
+
+	p := mustNew(t, &Config{
+		Logger:        testLogger,
+		UDPListenAddr: []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{
+				newProfileTestUpstream("192.0.2.1"),
+				newProfileTestUpstream("192.0.2.2"),
+			},
+		},
+		TrustedProxies: defaultTrustedProxies,
+		UpstreamMode:   UModeLoadBalance,
+		UpstreamBackoff: &UpstreamBackoffConfig{
+			Backoff: time.Second,
+		},
+		UpstreamStatsPath: path,
+	})
+
+	ctx := context.Background()
+	require.NoError(t, p.Start(ctx))
+
+	wantWeights := []float64{1 / 10_000.0, 1 / 10_000_000.0}
+	assert.Equal(t, wantWeights, p.calcWeights(p.UpstreamConfig.Upstreams))
+	assert.Equal(t, []*UpstreamBackoff{{
+		Until:    time.Unix(1_700_000_000, 0),
+		Address:  "192.0.2.2",
+		Failures: 2,
+	}}, p.Stats().UpstreamBackoffs())
+
+	require.NoError(t, os.Remove(path))
+	require.NoError(t, p.Shutdown(ctx))
+
+	// The restored statistics are saved again on shutdown.
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	assert.JSONEq(t, data, string(b))
+}
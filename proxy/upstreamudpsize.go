@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"fmt"
+	"net/netip"
+
+	"github.com/miekg/dns"
+)
+
+// maxUpstreamUDPSize is the maximum EDNS buffer size advertised to the
+// upstreams.  The larger sizes are clamped to it, since the responses of such
+// sizes are fragmented on almost any path, see RFC 6891, section 6.2.5.
+const maxUpstreamUDPSize = 4096
+
+// UpstreamUDPSizeConfig is the configuration of the EDNS buffer sizes
+// advertised to the upstreams in the requests with the OPT record.  The sizes
+// are clamped between [dns.MinMsgSize] and 4096.  The sizes of the responses
+// sent to the clients over UDP are configured by [UDPTruncationConfig].
+type UpstreamUDPSizeConfig struct {
+	// ListenerSizes maps the addresses the listeners are bound to, as in
+	// [Config.UDPListenAddr] and the like, to the sizes advertised in the
+	// requests received on them, overriding Size.  An unspecified address
+	// matches the requests received on any address with the same port.
+	ListenerSizes map[netip.AddrPort]uint16
+
+	// Size is the size advertised in the requests received on the other
+	// listeners.  Zero means the size advertised by the client.
+	Size uint16
+}
+
+// validate returns an error if c is invalid.  c may be nil.
+func (c *UpstreamUDPSizeConfig) validate() (err error) {
+	if c == nil {
+		return nil
+	}
+
+	err = validateUDPSize(c.Size)
+	if err != nil {
+		return fmt.Errorf("size: %w", err)
+	}
+
+	for addr, size := range c.ListenerSizes {
+		err = validateUDPSize(size)
+		if err != nil {
+			return fmt.Errorf("size for %s: %w", addr, err)
+		}
+	}
+
+	return nil
+}
+
+// size returns the size to advertise in the requests received on the listener
+// bound to local.  Zero means the size advertised by the client.  c may be nil.
+func (c *UpstreamUDPSizeConfig) size(local netip.AddrPort) (size uint16) {
+	if c == nil {
+		return 0
+	}
+
+	size = c.Size
+	if !local.IsValid() || len(c.ListenerSizes) == 0 {
+		return min(size, maxUpstreamUDPSize)
+	}
+
+	local = netip.AddrPortFrom(local.Addr().Unmap(), local.Port())
+	for _, addr := range []netip.AddrPort{
+		local,
+		netip.AddrPortFrom(netip.IPv4Unspecified(), local.Port()),
+		netip.AddrPortFrom(netip.IPv6Unspecified(), local.Port()),
+	} {
+		if listenerSize, ok := c.ListenerSizes[addr]; ok {
+			size = listenerSize
+
+			break
+		}
+	}
+
+	return min(size, maxUpstreamUDPSize)
+}
+
+// upstreamRequest returns the request from d to send to the upstreams, which
+// advertises the configured EDNS buffer size.  It returns d.Req itself if it
+// already does or has no OPT record, since d.Req is also used to calculate the
+// size of the response to the client.
+func (p *Proxy) upstreamRequest(d *DNSContext) (req *dns.Msg) {
+	req = d.Req
+
+	opt := req.IsEdns0()
+	if opt == nil {
+		return req
+	}
+
+	size := p.UpstreamUDPSize.size(d.localAddr())
+	if size == 0 || opt.UDPSize() == size {
+		return req
+	}
+
+	req = req.Copy()
+	req.IsEdns0().SetUDPSize(size)
+
+	return req
+}
@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_upstreamRequest(t *testing.T) {
+	var gotSize uint16
+	ups := &fakeUpstream{
+		onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			gotSize = 0
+			if opt := req.IsEdns0(); opt != nil {
+				gotSize = opt.UDPSize()
+			}
+
+			return (&dns.Msg{}).SetReply(req), nil
+		},
+		onAddress: func() (addr string) { return "fake.address" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	p := mustNew(t, &Config{
+		Logger:         testLogger,
+		UDPListenAddr:  []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig: &UpstreamConfig{Upstreams: []upstream.Upstream{ups}},
+		TrustedProxies: defaultTrustedProxies,
+		UpstreamUDPSize: &UpstreamUDPSizeConfig{
+			ListenerSizes: map[netip.AddrPort]uint16{
+				netip.MustParseAddrPort("127.0.0.1:53"): 1400,
+				netip.MustParseAddrPort("[::]:5353"):    8192,
+			},
+			Size: 1232,
+		},
+	})
+
+	testCases := []struct {
+		name     string
+		local    string
+		wantSize uint16
+		withOPT  bool
+	}{{
+		name:     "listener",
+		local:    "127.0.0.1:53",
+		wantSize: 1400,
+		withOPT:  true,
+	}, {
+		name:     "unspecified_clamped",
+		local:    "192.0.2.1:5353",
+		wantSize: maxUpstreamUDPSize,
+		withOPT:  true,
+	}, {
+		name:     "default",
+		local:    "127.0.0.1:853",
+		wantSize: 1232,
+		withOPT:  true,
+	}, {
+		name:     "no_opt",
+		local:    "127.0.0.1:53",
+		wantSize: 0,
+		withOPT:  false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA)
+			if tc.withOPT {
+				req.SetEdns0(defaultUDPBufSize, false)
+			}
+
+			laddr := net.TCPAddrFromAddrPort(netip.MustParseAddrPort(tc.local))
+			ctx := context.WithValue(context.Background(), http.LocalAddrContextKey, laddr)
+
+			d := &DNSContext{
+				Proto:       ProtoHTTPS,
+				Req:         req,
+				HTTPRequest: httptest.NewRequest(http.MethodPost, "/dns-query", nil).WithContext(ctx),
+			}
+			require.NoError(t, p.Resolve(d))
+
+			assert.Equal(t, tc.wantSize, gotSize)
+			if tc.withOPT {
+				// The request of the client must be left intact.
+				assert.Equal(t, uint16(defaultUDPBufSize), req.IsEdns0().UDPSize())
+			}
+		})
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := New(&Config{
+			UDPListenAddr:  []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+			UpstreamConfig: &UpstreamConfig{Upstreams: []upstream.Upstream{ups}},
+			TrustedProxies: defaultTrustedProxies,
+			UpstreamUDPSize: &UpstreamUDPSizeConfig{
+				Size: 100,
+			},
+		})
+		testutil.AssertErrorMsg(t, "validating upstream udp size: size: 100 is less than 512", err)
+	})
+}
@@ -0,0 +1,213 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/internal/xdp"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+)
+
+// XDPConfig is the configuration of the in-kernel responder, which answers the
+// repeated plain DNS queries over UDP for the hot cache entries with an XDP
+// program attached to the network interface, so that those never reach the
+// proxy.  An entry becomes hot once it's used to answer a query over UDP, at
+// which point the response is pushed to the kernel and then served for the
+// queries identical to that one, except for the ID.  The queries it doesn't
+// have the response to are passed to the proxy as usual.
+//
+// The responses served by the kernel are neither logged nor counted, and keep
+// the TTLs they have been pushed with.  It's only supported on Linux 5.18 or
+// newer, when built with the xdp build tag, and requires CAP_BPF and
+// CAP_NET_ADMIN.  Only the queries over IPv4 without options and over IPv6
+// without extension headers are answered, and only with the responses up to
+// 512 bytes long.
+type XDPConfig struct {
+	// Interface is the name of the network interface the program is attached
+	// to.  The queries to the plain DNS UDP listeners received on it are
+	// answered.  It must not be empty.
+	Interface string
+
+	// MaxEntries is the maximum number of the responses stored in the kernel.
+	// The least recently used ones are evicted.  It must be positive.
+	MaxEntries uint
+
+	// MaxAge is the maximum duration a response is served by the kernel for,
+	// which limits how stale its TTLs get.  The responses are never served
+	// after they expire in the cache.  It must be positive.
+	MaxAge time.Duration
+}
+
+// validate returns an error if c is invalid.  c may be nil.
+func (c *XDPConfig) validate() (err error) {
+	if c == nil {
+		return nil
+	}
+
+	switch {
+	case c.Interface == "":
+		return errors.Error("interface: empty")
+	case c.MaxEntries == 0:
+		return errors.Error("max entries: must be positive")
+	case c.MaxAge <= 0:
+		return fmt.Errorf("max age: must be positive, got %s", c.MaxAge)
+	default:
+		return nil
+	}
+}
+
+// validateXDP returns an error if the in-kernel responder is configured but
+// isn't supported or would bypass the other settings of p, which all require
+// the requests to reach the proxy.
+func (p *Proxy) validateXDP() (err error) {
+	if p.XDP == nil {
+		return nil
+	}
+
+	if !xdp.Supported {
+		return errors.Error("not supported")
+	}
+
+	err = p.XDP.validate()
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return err
+	}
+
+	switch {
+	case len(p.UDPListenAddr) == 0:
+		return errors.Error("no udp listen addresses")
+	case p.BeforeRequestHandler != nil:
+		return errors.Error("incompatible with before request handler")
+	case p.RequestHandler != nil:
+		return errors.Error("incompatible with request handler")
+	case p.ResponseHandler != nil:
+		return errors.Error("incompatible with response handler")
+	case p.AfterResponseHandler != nil:
+		return errors.Error("incompatible with after response handler")
+	case len(p.TSIGKeys) > 0:
+		return errors.Error("incompatible with tsig keys")
+	case p.AnswerOrder == AnswerOrderShuffle:
+		return errors.Error("incompatible with shuffled answer order")
+	case len(p.Profiles) > 0:
+		return errors.Error("incompatible with profiles")
+	case len(p.ClientRoutes) > 0:
+		return errors.Error("incompatible with client routes")
+	case p.UDPTruncation != nil:
+		return errors.Error("incompatible with udp truncation")
+	case p.ListenerFaults != nil:
+		return errors.Error("incompatible with listener faults")
+	case p.Anomalies != nil:
+		return errors.Error("incompatible with anomalies")
+	default:
+		return nil
+	}
+}
+
+// validateXDPReloadable is the part of [Proxy.validateXDP] concerning the
+// settings which can be changed with [Proxy.Reconfigure].
+func (p *Proxy) validateXDPReloadable() (err error) {
+	switch {
+	case p.XDP == nil:
+		return nil
+	case !p.CacheEnabled:
+		return errors.Error("cache is disabled")
+	case p.Ratelimit > 0 || p.RatelimitTruncate > 0:
+		return errors.Error("incompatible with ratelimit")
+	case p.RatelimitDenylist != nil:
+		return errors.Error("incompatible with ratelimit denylist")
+	default:
+		return nil
+	}
+}
+
+// startXDP attaches the in-kernel responder for the plain DNS UDP listeners of
+// p, if configured.
+func (p *Proxy) startXDP(ctx context.Context) (err error) {
+	if p.XDP == nil {
+		return nil
+	} else if len(p.middlewares) > 0 {
+		// The middlewares are only known on start, see [Proxy.Use].
+		return errors.Error("incompatible with middlewares")
+	}
+
+	addrs := make([]netip.AddrPort, 0, len(p.udpListen))
+	for _, l := range p.udpListen {
+		addrs = append(addrs, l.LocalAddr().(*net.UDPAddr).AddrPort())
+	}
+
+	r, err := xdp.New(&xdp.Config{
+		Interface:  p.XDP.Interface,
+		Addrs:      addrs,
+		MaxEntries: p.XDP.MaxEntries,
+	})
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return err
+	}
+
+	p.xdpResponder.Store(r)
+	p.logger.InfoContext(ctx, "answering hot cache entries with xdp", "iface", p.XDP.Interface)
+
+	return nil
+}
+
+// closeXDP detaches the in-kernel responder, if any.  The responses pushed
+// concurrently fail, see [Proxy.pushXDP].
+func (p *Proxy) closeXDP() (err error) {
+	r := p.xdpResponder.Swap(nil)
+	if r == nil {
+		return nil
+	}
+
+	err = r.Close()
+	if err != nil {
+		return fmt.Errorf("closing xdp: %w", err)
+	}
+
+	return nil
+}
+
+// pushXDP stores b, the response to the request of d made of data, the packed
+// item of the general cache, in the kernel, if the in-kernel responder is
+// started.  now is the current Unix time.  It's called on each use of the
+// cached response, but the kernel is only updated when it doesn't have the
+// response yet, see [xdp.Responder.Set].  The errors are logged.
+func (p *Proxy) pushXDP(d *DNSContext, data, b []byte, now int64) {
+	r := p.xdpResponder.Load()
+	if r == nil || d.Proto != ProtoUDP || len(b) > xdp.MaxResponseLen {
+		return
+	}
+
+	req, err := d.Req.Pack()
+	if err != nil {
+		p.logger.Debug("packing request for xdp", slogutil.KeyError, err)
+
+		return
+	}
+
+	ttl := time.Duration(int64(binary.BigEndian.Uint32(data))-now) * time.Second
+	err = r.Set(req, b, min(ttl, p.XDP.MaxAge))
+	if err != nil {
+		p.logger.Debug("pushing response to xdp", slogutil.KeyError, err)
+	}
+}
+
+// clearXDP removes all the responses stored in the kernel, if any.  The errors
+// are logged.
+func (p *Proxy) clearXDP() {
+	r := p.xdpResponder.Load()
+	if r == nil {
+		return
+	}
+
+	err := r.Clear()
+	if err != nil {
+		p.logger.Error("clearing xdp", slogutil.KeyError, err)
+	}
+}
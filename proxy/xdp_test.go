@@ -0,0 +1,213 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/internal/xdp"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestXDPConfig_validate(t *testing.T) {
+	testCases := []struct {
+		conf       *XDPConfig
+		name       string
+		wantErrMsg string
+	}{{
+		conf:       nil,
+		name:       "nil",
+		wantErrMsg: "",
+	}, {
+		conf:       &XDPConfig{Interface: "eth0", MaxEntries: 1, MaxAge: time.Second},
+		name:       "valid",
+		wantErrMsg: "",
+	}, {
+		conf:       &XDPConfig{MaxEntries: 1, MaxAge: time.Second},
+		name:       "no_interface",
+		wantErrMsg: "interface: empty",
+	}, {
+		conf:       &XDPConfig{Interface: "eth0", MaxAge: time.Second},
+		name:       "zero_max_entries",
+		wantErrMsg: "max entries: must be positive",
+	}, {
+		conf:       &XDPConfig{Interface: "eth0", MaxEntries: 1},
+		name:       "zero_max_age",
+		wantErrMsg: "max age: must be positive, got 0s",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, tc.conf.validate())
+		})
+	}
+}
+
+func TestProxy_validateXDP(t *testing.T) {
+	xdpConf := &XDPConfig{Interface: "lo", MaxEntries: 1, MaxAge: time.Second}
+	udpAddrs := []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)}
+
+	testCases := []struct {
+		conf       *Config
+		name       string
+		wantErrMsg string
+	}{{
+		conf:       &Config{},
+		name:       "disabled",
+		wantErrMsg: "",
+	}, {
+		conf: &Config{
+			XDP:           xdpConf,
+			UDPListenAddr: udpAddrs,
+			CacheEnabled:  true,
+		},
+		name:       "valid",
+		wantErrMsg: "",
+	}, {
+		conf: &Config{
+			XDP:          xdpConf,
+			CacheEnabled: true,
+		},
+		name:       "no_udp",
+		wantErrMsg: "no udp listen addresses",
+	}, {
+		conf: &Config{
+			XDP:           xdpConf,
+			UDPListenAddr: udpAddrs,
+		},
+		name:       "no_cache",
+		wantErrMsg: "cache is disabled",
+	}, {
+		conf: &Config{
+			XDP:           xdpConf,
+			UDPListenAddr: udpAddrs,
+			CacheEnabled:  true,
+			Ratelimit:     1,
+		},
+		name:       "ratelimit",
+		wantErrMsg: "incompatible with ratelimit",
+	}, {
+		conf: &Config{
+			XDP:               xdpConf,
+			UDPListenAddr:     udpAddrs,
+			CacheEnabled:      true,
+			RatelimitDenylist: netutil.SliceSubnetSet{netip.MustParsePrefix("192.0.2.0/24")},
+		},
+		name:       "ratelimit_denylist",
+		wantErrMsg: "incompatible with ratelimit denylist",
+	}, {
+		conf: &Config{
+			XDP:           xdpConf,
+			UDPListenAddr: udpAddrs,
+			CacheEnabled:  true,
+			UDPTruncation: &UDPTruncationConfig{},
+		},
+		name:       "udp_truncation",
+		wantErrMsg: "incompatible with udp truncation",
+	}, {
+		conf: &Config{
+			XDP:            xdpConf,
+			UDPListenAddr:  udpAddrs,
+			CacheEnabled:   true,
+			RequestHandler: func(_ *Proxy, _ *DNSContext) (err error) { return nil },
+		},
+		name:       "request_handler",
+		wantErrMsg: "incompatible with request handler",
+	}, {
+		conf: &Config{
+			XDP:           xdpConf,
+			UDPListenAddr: udpAddrs,
+			CacheEnabled:  true,
+			AnswerOrder:   AnswerOrderShuffle,
+		},
+		name:       "answer_order_shuffle",
+		wantErrMsg: "incompatible with shuffled answer order",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			wantErrMsg := tc.wantErrMsg
+			if !xdp.Supported && tc.conf.XDP != nil {
+				wantErrMsg = "not supported"
+			}
+
+			p := &Proxy{Config: *tc.conf}
+			err := p.validateXDP()
+			if err == nil {
+				err = p.validateXDPReloadable()
+			}
+
+			testutil.AssertErrorMsg(t, wantErrMsg, err)
+		})
+	}
+}
+
+func TestProxy_XDP(t *testing.T) {
+	if !xdp.Supported {
+		t.Skip("xdp is not supported by this build")
+	}
+
+	events := &recordingEventListener{mu: &sync.Mutex{}}
+	p := mustNew(t, &Config{
+		Logger:         testLogger,
+		UDPListenAddr:  []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig: &UpstreamConfig{Upstreams: []upstream.Upstream{newProfileTestUpstream("8.8.8.8")}},
+		TrustedProxies: defaultTrustedProxies,
+		CacheEnabled:   true,
+		CacheSizeBytes: testCacheSize,
+		XDP: &XDPConfig{
+			Interface:  "lo",
+			MaxEntries: 16,
+			MaxAge:     time.Minute,
+		},
+
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+	})
+	p.AddEventListener(events)
+
+	ctx := context.Background()
+	err := p.Start(ctx)
+	if err != nil {
+		t.Skipf("attaching xdp programs is not supported: %s", err)
+	}
+
+	testutil.CleanupAndRequireSuccess(t, func() (err error) { return p.Shutdown(ctx) })
+
+	client := &dns.Client{Net: string(ProtoUDP), Timeout: defaultTimeout}
+	addr := p.Addr(ProtoUDP).String()
+
+	exchange := func(t *testing.T) {
+		t.Helper()
+
+		req := newHostTestMessage("example.org")
+		resp, _, exchErr := client.Exchange(req, addr)
+		require.NoError(t, exchErr)
+
+		requireResponse(t, req, resp)
+	}
+
+	exchange(t)
+	assert.Equal(t, []string{"cache_miss"}, events.take())
+
+	// Answered from the cache, which makes the entry hot.
+	exchange(t)
+	assert.Equal(t, []string{"cache_hit"}, events.take())
+
+	// Answered by the kernel.
+	exchange(t)
+	assert.Empty(t, events.take())
+
+	p.ClearCache()
+
+	exchange(t)
+	assert.Equal(t, []string{"cache_miss"}, events.take())
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	goFlags "github.com/jessevdk/go-flags"
+	"github.com/miekg/dns"
+)
+
+// queryCommand is the name of the subcommand sending a single query.
+const queryCommand = "query"
+
+// queryUsage is the usage line of the query subcommand.
+const queryUsage = "query [OPTIONS] name [type] @upstream"
+
+// defaultQueryTimeout is the timeout of the query used if the --timeout option
+// isn't set.
+const defaultQueryTimeout = 10 * time.Second
+
+// runQuery sends a single query described by the command-line arguments args of
+// the query subcommand to the upstream and prints the response.  The upstream
+// is created and bootstrapped from the options the same way as the proxy does
+// it.  It returns the exit code of the process.
+func runQuery(args []string) (code int) {
+	options, rest, err := parseArgs(args, goFlags.Default, queryUsage, nil)
+	if err != nil {
+		return parseErrorCode(err)
+	}
+
+	addr, req, err := parseQueryArgs(rest)
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "%s\nusage: dnsproxy %s\n", err, queryUsage)
+
+		return 1
+	}
+
+	l, levels, closeOutput, _ := newLogger(options)
+	defer closeOutput()
+
+	upsLogger := proxy.SubsystemLogger(l, levels.proxyLevels(), proxy.LogSubsystemUpstream)
+	upsOpts, err := newUpstreamOptions(upsLogger, options, nil, nil)
+	if err != nil {
+		l.Error("initializing upstream options", slogutil.KeyError, err)
+
+		return 1
+	}
+
+	upsOpts.Timeout = cmp.Or(upsOpts.Timeout, defaultQueryTimeout)
+
+	err = exchangeQuery(os.Stdout, addr, req, upsOpts)
+	if err != nil {
+		l.Error("querying upstream", "upstream", addr, slogutil.KeyError, err)
+
+		return 1
+	}
+
+	return 0
+}
+
+// parseQueryArgs parses the positional arguments of the query subcommand in the
+// dig-like form: the name, the optional type, and the upstream address prefixed
+// by "@" in any position.  The type is A by default.
+func parseQueryArgs(args []string) (addr string, req *dns.Msg, err error) {
+	var name, typStr string
+	for _, arg := range args {
+		switch {
+		case strings.HasPrefix(arg, "@"):
+			if addr != "" {
+				return "", nil, errors.Error("more than one upstream")
+			}
+
+			addr = arg[1:]
+		case name == "":
+			name = arg
+		case typStr == "":
+			typStr = arg
+		default:
+			return "", nil, fmt.Errorf("unexpected argument %q", arg)
+		}
+	}
+
+	if name == "" {
+		return "", nil, errors.Error("no name")
+	} else if addr == "" {
+		return "", nil, errors.Error("no upstream")
+	}
+
+	req, err = newQueryMsg(name, typStr)
+
+	return addr, req, err
+}
+
+// newQueryMsg returns the recursive query for name of the type typStr, which
+// is A if empty.  The query has the EDNS option just like the ones of dig.
+func newQueryMsg(name, typStr string) (req *dns.Msg, err error) {
+	qtype := dns.TypeA
+	if typStr != "" {
+		var ok bool
+		qtype, ok = dns.StringToType[strings.ToUpper(typStr)]
+		if !ok {
+			return nil, fmt.Errorf("unknown type %q", typStr)
+		}
+	}
+
+	req = (&dns.Msg{}).SetQuestion(dns.Fqdn(name), qtype)
+	req.SetEdns0(dns.DefaultMsgSize, false)
+
+	return req, nil
+}
+
+// exchangeQuery sends req to the upstream at addr created with opts and writes
+// the response with the timing into w in the dig-like format.
+func exchangeQuery(w io.Writer, addr string, req *dns.Msg, opts *upstream.Options) (err error) {
+	u, err := upstream.AddressToUpstream(addr, opts)
+	if err != nil {
+		return fmt.Errorf("creating upstream: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, u.Close()) }()
+
+	start := time.Now()
+	resp, err := u.Exchange(req)
+	elapsed := time.Since(start)
+	if err != nil {
+		return fmt.Errorf("exchanging: %w", err)
+	}
+
+	// The time includes establishing the connection and resolving the address
+	// of the upstream, since that's what the first query of the proxy takes.
+	_, err = fmt.Fprintf(
+		w,
+		"%s\n;; Query time: %d msec\n;; SERVER: %s\n;; WHEN: %s\n;; MSG SIZE  rcvd: %d\n",
+		resp,
+		elapsed.Milliseconds(),
+		u.Address(),
+		start.Format(time.RFC1123Z),
+		resp.Len(),
+	)
+
+	return err
+}
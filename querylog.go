@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/netip"
+	"strings"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/querylog"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/miekg/dns"
+)
+
+// initQueryLog sets the query loggers enabled in options into conf.  closers
+// are the enabled loggers, which should be closed on exit to flush the
+// remaining records.
+func initQueryLog(l *slog.Logger, conf *proxy.Config, options *Options) (closers []io.Closer) {
+	var sinks querylog.Multi
+
+	if options.QueryLogFile != "" {
+		ql, err := querylog.New(&querylog.Config{
+			Path:             options.QueryLogFile,
+			RotationInterval: options.QueryLogRotationInterval.Duration,
+			MaxSize:          options.QueryLogMaxSize,
+			MaxBackups:       options.QueryLogMaxBackups,
+			MaxAge:           options.QueryLogMaxAge,
+			Compress:         options.QueryLogCompress,
+			Logger:           l,
+		})
+		if err != nil {
+			fatal(l, "initializing query log", slogutil.KeyError, err)
+		}
+
+		l.Info("writing query log", "path", options.QueryLogFile)
+
+		sinks = append(sinks, ql)
+		closers = append(closers, ql)
+	}
+
+	if options.ClickHouseDSN != "" {
+		ch, err := querylog.NewClickHouse(&querylog.ClickHouseConfig{
+			DSN:           options.ClickHouseDSN,
+			Table:         options.ClickHouseTable,
+			BatchSize:     options.ClickHouseBatchSize,
+			FlushInterval: options.ClickHouseFlushInterval.Duration,
+			Logger:        l,
+		})
+		if err != nil {
+			fatal(l, "initializing clickhouse query log", slogutil.KeyError, err)
+		}
+
+		l.Info("inserting query log into clickhouse", "table", options.ClickHouseTable)
+
+		sinks = append(sinks, ch)
+		closers = append(closers, ch)
+	}
+
+	switch len(sinks) {
+	case 0:
+		return nil
+	case 1:
+		addQueryLogger(conf, filterQueryLog(l, sinks[0], options))
+	default:
+		addQueryLogger(conf, filterQueryLog(l, sinks, options))
+	}
+
+	return closers
+}
+
+// filterQueryLog returns sink wrapped into the filter of the query log set in
+// options, if any, and sink itself otherwise.
+func filterQueryLog(
+	l *slog.Logger,
+	sink proxy.QueryLogger,
+	options *Options,
+) (ql proxy.QueryLogger) {
+	if len(options.QueryLogFilters) == 0 && options.QueryLogSampleRate <= 1 {
+		return sink
+	}
+
+	c := &querylog.FilterConfig{
+		Logger:     sink,
+		SampleRate: options.QueryLogSampleRate,
+	}
+
+	for _, f := range options.QueryLogFilters {
+		err := addQueryLogFilter(c, f)
+		if err != nil {
+			fatal(l, "parsing query log filter", "filter", f, slogutil.KeyError, err)
+		}
+	}
+
+	l.Info(
+		"filtering query log",
+		"filters", options.QueryLogFilters,
+		"sample_rate", options.QueryLogSampleRate,
+	)
+
+	return querylog.NewFilter(c)
+}
+
+// addQueryLogFilter parses the query log filter f in the kind:value form and
+// adds it to c.
+func addQueryLogFilter(c *querylog.FilterConfig, f string) (err error) {
+	kind, val, ok := strings.Cut(f, ":")
+	if !ok || val == "" {
+		return errors.Error("bad format, want kind:value")
+	}
+
+	switch kind {
+	case "rcode":
+		rcode, found := dns.StringToRcode[strings.ToUpper(val)]
+		if !found {
+			return fmt.Errorf("unknown rcode %q", val)
+		}
+
+		c.Rcodes = append(c.Rcodes, rcode)
+	case "client":
+		var pref netip.Prefix
+		pref, err = parseClientPrefix(val)
+		if err != nil {
+			return err
+		}
+
+		c.Clients = append(c.Clients, pref)
+	case "domain":
+		c.Domains = append(c.Domains, val)
+	default:
+		return fmt.Errorf("unknown kind %q", kind)
+	}
+
+	return nil
+}
+
+// parseClientPrefix parses s as either a network or a single address.
+func parseClientPrefix(s string) (pref netip.Prefix, err error) {
+	if strings.Contains(s, "/") {
+		return netip.ParsePrefix(s)
+	}
+
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// addQueryLogger adds l to the query loggers of conf.
+func addQueryLogger(conf *proxy.Config, l proxy.QueryLogger) {
+	switch existing := conf.QueryLogger.(type) {
+	case nil:
+		conf.QueryLogger = l
+	case querylog.Multi:
+		conf.QueryLogger = append(existing, l)
+	default:
+		conf.QueryLogger = querylog.Multi{existing, l}
+	}
+}
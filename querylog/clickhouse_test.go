@@ -0,0 +1,129 @@
+package querylog_test
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/querylog"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// insertRequest is the captured insert request.
+type insertRequest struct {
+	query    string
+	user     string
+	password string
+	rows     int
+}
+
+// newClickHouseServer returns a test server imitating the ClickHouse HTTP
+// interface, which sends the received insert requests to reqs.
+func newClickHouseServer(t *testing.T, reqs chan<- insertRequest) (srv *httptest.Server) {
+	t.Helper()
+
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+
+		user, pass, _ := r.BasicAuth()
+		reqs <- insertRequest{
+			query:    r.URL.Query().Get("query"),
+			user:     user,
+			password: pass,
+			rows:     bytes.Count(body, []byte{'\n'}),
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func TestClickHouse(t *testing.T) {
+	reqs := make(chan insertRequest, 10)
+	srv := newClickHouseServer(t, reqs)
+
+	ch, err := querylog.NewClickHouse(&querylog.ClickHouseConfig{
+		DSN:           "http://user:pass@" + srv.Listener.Addr().String() + "/?database=db",
+		Table:         "dnsproxy.querylog",
+		BatchSize:     2,
+		FlushInterval: time.Hour,
+	})
+	require.NoError(t, err)
+
+	e := &proxy.QueryLogEntry{Proto: proxy.ProtoUDP, QName: "example.org."}
+	for range 3 {
+		ch.LogQuery(e)
+	}
+
+	// The full batch is inserted right away.
+	req, ok := testutil.RequireReceive(t, reqs, testTimeout)
+	require.True(t, ok)
+
+	assert.Equal(t, "INSERT INTO dnsproxy.querylog FORMAT JSONEachRow", req.query)
+	assert.Equal(t, "user", req.user)
+	assert.Equal(t, "pass", req.password)
+	assert.Equal(t, 2, req.rows)
+
+	// The rest is inserted on close.
+	require.NoError(t, ch.Close())
+
+	req, ok = testutil.RequireReceive(t, reqs, testTimeout)
+	require.True(t, ok)
+
+	assert.Equal(t, 1, req.rows)
+	assert.Zero(t, ch.Dropped())
+}
+
+func TestClickHouse_flushInterval(t *testing.T) {
+	reqs := make(chan insertRequest, 10)
+	srv := newClickHouseServer(t, reqs)
+
+	ch, err := querylog.NewClickHouse(&querylog.ClickHouseConfig{
+		DSN:           srv.URL,
+		FlushInterval: 10 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, ch.Close)
+
+	ch.LogQuery(&proxy.QueryLogEntry{Proto: proxy.ProtoTCP})
+
+	req, ok := testutil.RequireReceive(t, reqs, testTimeout)
+	require.True(t, ok)
+
+	assert.Equal(t, "INSERT INTO querylog FORMAT JSONEachRow", req.query)
+	assert.Empty(t, req.user)
+	assert.Equal(t, 1, req.rows)
+}
+
+func TestNewClickHouse_invalid(t *testing.T) {
+	testCases := []struct {
+		conf *querylog.ClickHouseConfig
+		name string
+	}{{
+		conf: &querylog.ClickHouseConfig{},
+		name: "empty_dsn",
+	}, {
+		conf: &querylog.ClickHouseConfig{DSN: "tcp://localhost:9000"},
+		name: "bad_scheme",
+	}, {
+		conf: &querylog.ClickHouseConfig{
+			DSN:   "http://localhost:8123",
+			Table: "querylog; DROP TABLE querylog",
+		},
+		name: "bad_table",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := querylog.NewClickHouse(tc.conf)
+			assert.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package querylog
+
+import (
+	"net/netip"
+	"slices"
+	"strings"
+	"sync/atomic"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+)
+
+// FilterConfig is the configuration of the [Filter].  The entries must match
+// all of the non-empty conditions to be logged.
+type FilterConfig struct {
+	// Logger is the query logger the matching entries are passed to.  It must
+	// not be nil.
+	Logger proxy.QueryLogger
+
+	// Rcodes, if not empty, are the response codes of the logged entries.
+	Rcodes []int
+
+	// Clients, if not empty, are the networks containing the clients of the
+	// logged entries.  Note that the clients are matched after the
+	// anonymization, see [proxy.ClientAnonymization].
+	Clients []netip.Prefix
+
+	// Domains, if not empty, are the domains the requests of the logged
+	// entries are for, including their subdomains.
+	Domains []string
+
+	// SampleRate, if greater than one, makes only one of each SampleRate
+	// matching entries logged.
+	SampleRate uint64
+}
+
+// Filter is the [proxy.QueryLogger] implementation that passes only the
+// matching and sampled entries to another logger.
+type Filter struct {
+	// logger is the query logger the matching entries are passed to.
+	logger proxy.QueryLogger
+
+	// rcodes are the response codes of the logged entries.
+	rcodes []int
+
+	// clients are the networks containing the clients of the logged entries.
+	clients []netip.Prefix
+
+	// domains are the lowercased FQDNs of the domains of the logged entries.
+	domains []string
+
+	// matched is the number of the matching entries, used for sampling.
+	matched atomic.Uint64
+
+	// sampleRate is the number of the matching entries per logged one.
+	sampleRate uint64
+}
+
+// NewFilter returns a new properly initialized *Filter.  c must not be nil.
+func NewFilter(c *FilterConfig) (f *Filter) {
+	domains := make([]string, 0, len(c.Domains))
+	for _, d := range c.Domains {
+		domains = append(domains, dns.Fqdn(strings.ToLower(d)))
+	}
+
+	return &Filter{
+		logger:     c.Logger,
+		rcodes:     c.Rcodes,
+		clients:    c.Clients,
+		domains:    domains,
+		sampleRate: max(c.SampleRate, 1),
+	}
+}
+
+// type check
+var _ proxy.QueryLogger = (*Filter)(nil)
+
+// LogQuery implements the [proxy.QueryLogger] interface for *Filter.
+func (f *Filter) LogQuery(e *proxy.QueryLogEntry) {
+	if !f.matches(e) {
+		return
+	}
+
+	// Log the first matching entry and then each sampleRate-th one.
+	if (f.matched.Add(1)-1)%f.sampleRate != 0 {
+		return
+	}
+
+	f.logger.LogQuery(e)
+}
+
+// matches returns true if e matches all the conditions of f.
+func (f *Filter) matches(e *proxy.QueryLogEntry) (ok bool) {
+	if len(f.rcodes) > 0 && !slices.Contains(f.rcodes, e.Rcode) {
+		return false
+	}
+
+	if len(f.clients) > 0 {
+		addr := e.Client.Addr().Unmap()
+		if !slices.ContainsFunc(f.clients, func(p netip.Prefix) (found bool) {
+			return p.Contains(addr)
+		}) {
+			return false
+		}
+	}
+
+	if len(f.domains) > 0 {
+		qname := strings.ToLower(e.QName)
+		if !slices.ContainsFunc(f.domains, func(d string) (found bool) {
+			return dns.IsSubDomain(d, qname)
+		}) {
+			return false
+		}
+	}
+
+	return true
+}
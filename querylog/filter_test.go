@@ -0,0 +1,107 @@
+package querylog_test
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/querylog"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingLogger is a [proxy.QueryLogger] recording the names of the logged
+// entries.
+type recordingLogger struct {
+	names []string
+}
+
+// LogQuery implements the [proxy.QueryLogger] interface for *recordingLogger.
+func (l *recordingLogger) LogQuery(e *proxy.QueryLogEntry) {
+	l.names = append(l.names, e.QName)
+}
+
+func TestFilter(t *testing.T) {
+	client := netip.MustParseAddrPort("192.0.2.1:53")
+	otherClient := netip.MustParseAddrPort("198.51.100.1:53")
+
+	entries := []*proxy.QueryLogEntry{{
+		QName:  "example.org.",
+		Client: client,
+		Rcode:  dns.RcodeSuccess,
+	}, {
+		QName:  "nx.example.org.",
+		Client: client,
+		Rcode:  dns.RcodeNameError,
+	}, {
+		QName:  "NX.Example.COM.",
+		Client: otherClient,
+		Rcode:  dns.RcodeNameError,
+	}, {
+		QName:  "notexample.org.",
+		Client: client,
+		Rcode:  dns.RcodeNameError,
+	}}
+
+	testCases := []struct {
+		conf *querylog.FilterConfig
+		name string
+		want []string
+	}{{
+		conf: &querylog.FilterConfig{},
+		name: "all",
+		want: []string{"example.org.", "nx.example.org.", "NX.Example.COM.", "notexample.org."},
+	}, {
+		conf: &querylog.FilterConfig{
+			Rcodes: []int{dns.RcodeNameError},
+		},
+		name: "rcode",
+		want: []string{"nx.example.org.", "NX.Example.COM.", "notexample.org."},
+	}, {
+		conf: &querylog.FilterConfig{
+			Clients: []netip.Prefix{netip.MustParsePrefix("198.51.100.0/24")},
+		},
+		name: "client",
+		want: []string{"NX.Example.COM."},
+	}, {
+		conf: &querylog.FilterConfig{
+			Domains: []string{"example.org", "example.com."},
+		},
+		name: "domains",
+		want: []string{"example.org.", "nx.example.org.", "NX.Example.COM."},
+	}, {
+		conf: &querylog.FilterConfig{
+			Rcodes:  []int{dns.RcodeNameError},
+			Domains: []string{"example.org"},
+		},
+		name: "rcode_and_domain",
+		want: []string{"nx.example.org."},
+	}, {
+		conf: &querylog.FilterConfig{
+			SampleRate: 2,
+		},
+		name: "sample",
+		want: []string{"example.org.", "NX.Example.COM."},
+	}, {
+		conf: &querylog.FilterConfig{
+			Rcodes:     []int{dns.RcodeNameError},
+			SampleRate: 2,
+		},
+		name: "sample_matching",
+		want: []string{"nx.example.org.", "notexample.org."},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			l := &recordingLogger{}
+			tc.conf.Logger = l
+
+			f := querylog.NewFilter(tc.conf)
+			for _, e := range entries {
+				f.LogQuery(e)
+			}
+
+			assert.Equal(t, tc.want, l.names)
+		})
+	}
+}
@@ -0,0 +1,17 @@
+package querylog
+
+import "github.com/AdguardTeam/dnsproxy/proxy"
+
+// Multi is the [proxy.QueryLogger] implementation that passes the entries to
+// each of the loggers in order.
+type Multi []proxy.QueryLogger
+
+// type check
+var _ proxy.QueryLogger = Multi(nil)
+
+// LogQuery implements the [proxy.QueryLogger] interface for Multi.
+func (m Multi) LogQuery(e *proxy.QueryLogEntry) {
+	for _, l := range m {
+		l.LogQuery(e)
+	}
+}
@@ -0,0 +1,186 @@
+// Package querylog implements the proxy query loggers writing the processed
+// requests to a file as JSON lines with rotation or to ClickHouse.
+package querylog
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/miekg/dns"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// Config is the configuration of the query [Logger].
+type Config struct {
+	// Path is the path to the log file.  The rotated files are placed into the
+	// same directory.  It must not be empty.
+	Path string
+
+	// RotationInterval is the interval to rotate the log file at regardless of
+	// its size.  If zero, the file is only rotated by size.
+	RotationInterval time.Duration
+
+	// MaxSize is the maximum size of the log file in megabytes before it gets
+	// rotated.  If zero, the default value of 100 megabytes is used.
+	MaxSize int
+
+	// MaxBackups is the maximum number of rotated files to retain.  If zero,
+	// all the rotated files are retained.
+	MaxBackups int
+
+	// MaxAge is the maximum number of days to retain the rotated files for.
+	// If zero, the files aren't removed based on age.
+	MaxAge int
+
+	// Logger is used to log the errors.  If nil, [slog.Default] is used.
+	Logger *slog.Logger
+
+	// Compress defines if the rotated files should be compressed using gzip.
+	Compress bool
+}
+
+// Logger is the [proxy.QueryLogger] implementation that writes the entries to
+// a file as JSON lines.
+type Logger struct {
+	// file writes and rotates the log file.  It's safe for concurrent use.
+	file *lumberjack.Logger
+
+	// stop is closed to stop the rotation goroutine.
+	stop chan struct{}
+
+	// done is closed when the rotation goroutine exits.
+	done chan struct{}
+
+	// logger is used to log the errors.  It's never nil.
+	logger *slog.Logger
+}
+
+// New returns a new properly initialized *Logger.  c must not be nil.
+func New(c *Config) (l *Logger, err error) {
+	if c.Path == "" {
+		return nil, errors.Error("empty path")
+	} else if c.RotationInterval < 0 {
+		return nil, fmt.Errorf("negative rotation interval: %s", c.RotationInterval)
+	}
+
+	l = &Logger{
+		file: &lumberjack.Logger{
+			Filename:   c.Path,
+			MaxSize:    c.MaxSize,
+			MaxBackups: c.MaxBackups,
+			MaxAge:     c.MaxAge,
+			Compress:   c.Compress,
+		},
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+		logger: cmp.Or(c.Logger, slog.Default()).With(slogutil.KeyPrefix, "querylog"),
+	}
+
+	if c.RotationInterval > 0 {
+		go l.rotateEvery(c.RotationInterval)
+	} else {
+		close(l.done)
+	}
+
+	return l, nil
+}
+
+// entry is the JSON representation of [proxy.QueryLogEntry].
+type entry struct {
+	Time     time.Time `json:"time"`
+	Client   string    `json:"client"`
+	Proto    string    `json:"proto"`
+	QName    string    `json:"qname"`
+	QType    string    `json:"qtype"`
+	Rcode    string    `json:"rcode"`
+	Upstream string    `json:"upstream,omitempty"`
+	TraceID  string    `json:"trace_id,omitempty"`
+	Country  string    `json:"country,omitempty"`
+	ASN      uint32    `json:"asn,omitempty"`
+	Duration float64   `json:"duration_ms"`
+	CacheHit bool      `json:"cache_hit"`
+}
+
+// encode returns e encoded as a JSON line.  ok is false if e can't be encoded,
+// in which case the error is logged using l.
+func encode(e *proxy.QueryLogEntry, l *slog.Logger) (b []byte, ok bool) {
+	b, err := json.Marshal(&entry{
+		Time:     e.Time,
+		Client:   e.Client.Addr().String(),
+		Proto:    string(e.Proto),
+		QName:    e.QName,
+		QType:    dns.Type(e.QType).String(),
+		Rcode:    dns.RcodeToString[e.Rcode],
+		Upstream: e.Upstream,
+		TraceID:  e.TraceID,
+		Country:  e.Country,
+		ASN:      e.ASN,
+		Duration: float64(e.Elapsed) / float64(time.Millisecond),
+		CacheHit: e.CacheHit,
+	})
+	if err != nil {
+		// Shouldn't happen, since the entry only consists of simple types.
+		l.Error("encoding entry", slogutil.KeyError, err)
+
+		return nil, false
+	}
+
+	return append(b, '\n'), true
+}
+
+// type check
+var _ proxy.QueryLogger = (*Logger)(nil)
+
+// LogQuery implements the [proxy.QueryLogger] interface for *Logger.
+func (l *Logger) LogQuery(e *proxy.QueryLogEntry) {
+	b, ok := encode(e, l.logger)
+	if !ok {
+		return
+	}
+
+	_, err := l.file.Write(b)
+	if err != nil {
+		l.logger.Error("writing entry", slogutil.KeyError, err)
+	}
+}
+
+// Close stops the rotation and closes the log file.
+func (l *Logger) Close() (err error) {
+	select {
+	case <-l.done:
+	default:
+		close(l.stop)
+		<-l.done
+	}
+
+	return l.file.Close()
+}
+
+// rotateEvery rotates the log file each ivl until l is closed.  It's intended
+// to be used as a goroutine.
+func (l *Logger) rotateEvery(ivl time.Duration) {
+	defer slogutil.RecoverAndLog(context.TODO(), l.logger)
+	defer close(l.done)
+
+	t := time.NewTicker(ivl)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-t.C:
+			err := l.file.Rotate()
+			if err != nil {
+				l.logger.Error("rotating", slogutil.KeyError, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package querylog_test
+
+import (
+	"encoding/json"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/querylog"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testTimeout is the common timeout for tests.
+const testTimeout = 1 * time.Second
+
+func TestLogger_LogQuery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "querylog.json")
+
+	l, err := querylog.New(&querylog.Config{
+		Path: path,
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, l.Close)
+
+	l.LogQuery(&proxy.QueryLogEntry{
+		Time:     time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		Client:   netip.MustParseAddrPort("192.0.2.1:12345"),
+		Proto:    proxy.ProtoUDP,
+		QName:    "example.org.",
+		Upstream: "8.8.8.8:53",
+		Country:  "DE",
+		Elapsed:  1500 * time.Microsecond,
+		Rcode:    dns.RcodeNameError,
+		ASN:      64496,
+		QType:    dns.TypeAAAA,
+	})
+	l.LogQuery(&proxy.QueryLogEntry{
+		Time:     time.Date(2024, 1, 2, 3, 4, 6, 0, time.UTC),
+		Client:   netip.MustParseAddrPort("[2001:db8::1]:53"),
+		Proto:    proxy.ProtoHTTPS,
+		QName:    "example.org.",
+		Rcode:    dns.RcodeSuccess,
+		QType:    dns.TypeA,
+		CacheHit: true,
+	})
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	require.Len(t, lines, 2)
+
+	want := []map[string]any{{
+		"time":        "2024-01-02T03:04:05Z",
+		"client":      "192.0.2.1",
+		"proto":       "udp",
+		"qname":       "example.org.",
+		"qtype":       "AAAA",
+		"rcode":       "NXDOMAIN",
+		"upstream":    "8.8.8.8:53",
+		"country":     "DE",
+		"asn":         64496.0,
+		"duration_ms": 1.5,
+		"cache_hit":   false,
+	}, {
+		"time":        "2024-01-02T03:04:06Z",
+		"client":      "2001:db8::1",
+		"proto":       "https",
+		"qname":       "example.org.",
+		"qtype":       "A",
+		"rcode":       "NOERROR",
+		"duration_ms": 0.0,
+		"cache_hit":   true,
+	}}
+
+	for i, line := range lines {
+		var got map[string]any
+		require.NoError(t, json.Unmarshal([]byte(line), &got))
+
+		assert.Equal(t, want[i], got)
+	}
+}
+
+func TestLogger_rotation(t *testing.T) {
+	dir := t.TempDir()
+
+	l, err := querylog.New(&querylog.Config{
+		Path:             filepath.Join(dir, "querylog.json"),
+		RotationInterval: 10 * time.Millisecond,
+		Compress:         true,
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, l.Close)
+
+	l.LogQuery(&proxy.QueryLogEntry{Proto: proxy.ProtoTCP})
+
+	require.Eventually(t, func() (ok bool) {
+		matches, globErr := filepath.Glob(filepath.Join(dir, "querylog-*.json.gz"))
+		require.NoError(t, globErr)
+
+		return len(matches) > 0
+	}, testTimeout, testTimeout/10)
+
+	// Wait for the compression of the files rotated before closing, since it's
+	// performed in the background.
+	require.NoError(t, l.Close())
+	require.Eventually(t, func() (ok bool) {
+		matches, globErr := filepath.Glob(filepath.Join(dir, "querylog-*.json"))
+		require.NoError(t, globErr)
+
+		return len(matches) == 0
+	}, testTimeout, testTimeout/10)
+}
+
+func TestNew_invalid(t *testing.T) {
+	_, err := querylog.New(&querylog.Config{})
+	assert.Error(t, err)
+
+	_, err = querylog.New(&querylog.Config{
+		Path:             "querylog.json",
+		RotationInterval: -time.Second,
+	})
+	assert.Error(t, err)
+}
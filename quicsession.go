@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+)
+
+// loadQUICSessions returns the TLS session cache of the DNS-over-QUIC
+// upstreams with the sessions restored from the file at path, if it's set.
+// The errors are only logged, since the sessions are restored on a best-effort
+// basis.
+func loadQUICSessions(l *slog.Logger, path string) (c *upstream.SessionCache) {
+	if path == "" {
+		return nil
+	}
+
+	c = upstream.NewSessionCache(0)
+
+	// #nosec G304 -- Trust the file path that is given in the configuration.
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			l.Warn("reading quic sessions", slogutil.KeyError, err)
+		}
+
+		return c
+	}
+
+	err = c.ReadCache(bytes.NewReader(b))
+	if err != nil {
+		l.Warn("decoding quic sessions", "path", path, slogutil.KeyError, err)
+
+		return c
+	}
+
+	l.Debug("restored quic sessions", "path", path)
+
+	return c
+}
+
+// saveQUICSessions writes the sessions from c to the file at path, if it's set.
+// The errors are only logged.
+func saveQUICSessions(l *slog.Logger, c *upstream.SessionCache, path string) {
+	if c == nil || path == "" {
+		return
+	}
+
+	err := writeQUICSessions(c, path)
+	if err != nil {
+		l.Error("saving quic sessions", slogutil.KeyError, err)
+
+		return
+	}
+
+	l.Debug("saved quic sessions", "path", path)
+}
+
+// writeQUICSessions replaces the file at path with the sessions from c
+// atomically.  The file is only readable by the owner, since it contains the
+// session secrets.
+func writeQUICSessions(c *upstream.SessionCache, path string) (err error) {
+	// The temporary file is created with the 0o600 permissions.
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("creating file: %w", err)
+	}
+
+	defer func() {
+		if err != nil {
+			err = errors.WithDeferred(err, os.Remove(tmp.Name()))
+		}
+	}()
+
+	err = c.WriteCache(tmp)
+	if err != nil {
+		return errors.WithDeferred(fmt.Errorf("writing file: %w", err), tmp.Close())
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return fmt.Errorf("closing file: %w", err)
+	}
+
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return fmt.Errorf("replacing file: %w", err)
+	}
+
+	return nil
+}
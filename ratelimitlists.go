@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/netutil"
+)
+
+// ratelimitListsInterval is the time between the checks of the modification
+// of the files of the ratelimit lists.
+const ratelimitListsInterval = 10 * time.Second
+
+// subnetFile is the set of the client networks read from a file, which is
+// re-read once it's modified.
+type subnetFile struct {
+	// logger is used to log the updates of the set.
+	logger *slog.Logger
+
+	// subnets are the networks from the last version of the file read.
+	subnets atomic.Pointer[netutil.SliceSubnetSet]
+
+	// path is the path to the file.
+	path string
+
+	// modTime is the modification time of the last version of the file read.
+	// It's only accessed by [subnetFile.update].
+	modTime time.Time
+}
+
+// newSubnetFile returns the set of the networks from the file at path with the
+// file read for the first time.  f is nil if path is empty.
+func newSubnetFile(l *slog.Logger, path string) (f *subnetFile, err error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	f = &subnetFile{
+		logger: l.With("file", path),
+		path:   path,
+	}
+
+	_, err = f.update()
+	if err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// type check
+var _ netutil.SubnetSet = (*subnetFile)(nil)
+
+// Contains implements the [netutil.SubnetSet] interface for *subnetFile.
+func (f *subnetFile) Contains(ip netip.Addr) (ok bool) {
+	return f.subnets.Load().Contains(ip)
+}
+
+// update re-reads the file if it's been modified since the last read.  If the
+// file can't be read or is invalid, the previous set is kept.
+func (f *subnetFile) update() (updated bool, err error) {
+	fi, err := os.Stat(f.path)
+	if err != nil {
+		return false, err
+	} else if fi.ModTime().Equal(f.modTime) {
+		return false, nil
+	}
+
+	// #nosec G304 -- Trust the file path that is given in the configuration.
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return false, err
+	}
+
+	subnets, err := parseSubnetsList(data)
+	if err != nil {
+		return false, err
+	}
+
+	f.subnets.Store(&subnets)
+	f.modTime = fi.ModTime()
+
+	return true, nil
+}
+
+// refresh re-reads the file if it's been modified and logs the result.
+func (f *subnetFile) refresh(ctx context.Context) {
+	updated, err := f.update()
+	if err != nil {
+		f.logger.ErrorContext(ctx, "updating list", slogutil.KeyError, err)
+	} else if updated {
+		f.logger.InfoContext(ctx, "list updated", "subnets", len(*f.subnets.Load()))
+	}
+}
+
+// parseSubnetsList returns the networks from the list in data, one IP address
+// or CIDR per line.  Empty lines and comments are ignored.
+func parseSubnetsList(data []byte) (subnets netutil.SliceSubnetSet, err error) {
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var pref netip.Prefix
+		pref, err = parseSubnet(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+
+		subnets = append(subnets, pref)
+	}
+
+	return subnets, nil
+}
+
+// parseSubnet parses s as either a CIDR or a single IP address.
+func parseSubnet(s string) (pref netip.Prefix, err error) {
+	if strings.Contains(s, "/") {
+		pref, err = netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+
+		return pref.Masked(), nil
+	}
+
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+
+	addr = addr.Unmap()
+
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// ratelimitLists are the ratelimit allowlist and denylist read from the files,
+// which are watched for modifications.
+type ratelimitLists struct {
+	// logger is used to log the updates of the lists.
+	logger *slog.Logger
+
+	// allow is the allowlist.  It may be nil.
+	allow *subnetFile
+
+	// deny is the denylist.  It may be nil.
+	deny *subnetFile
+}
+
+// initRatelimitLists reads the ratelimit lists configured by options and sets
+// them into conf.  lists is nil if neither is configured.
+func initRatelimitLists(
+	l *slog.Logger,
+	conf *proxy.Config,
+	options *Options,
+) (lists *ratelimitLists) {
+	l = l.With(slogutil.KeyPrefix, "ratelimit_lists")
+
+	allow, err := newSubnetFile(l, options.RatelimitAllowlistFile)
+	if err != nil {
+		fatal(l, "reading ratelimit allowlist", slogutil.KeyError, err)
+	}
+
+	deny, err := newSubnetFile(l, options.RatelimitDenylistFile)
+	if err != nil {
+		fatal(l, "reading ratelimit denylist", slogutil.KeyError, err)
+	}
+
+	if allow == nil && deny == nil {
+		return nil
+	}
+
+	lists = &ratelimitLists{
+		logger: l,
+		allow:  allow,
+		deny:   deny,
+	}
+	lists.apply(conf)
+
+	return lists
+}
+
+// apply sets the lists into conf.  lists may be nil.
+func (lists *ratelimitLists) apply(conf *proxy.Config) {
+	if lists == nil {
+		return
+	}
+
+	// Don't assign the nil pointers to the interface fields.
+	if lists.allow != nil {
+		conf.RatelimitAllowlist = lists.allow
+	}
+
+	if lists.deny != nil {
+		conf.RatelimitDenylist = lists.deny
+	}
+}
+
+// refresh checks the files for modifications every [ratelimitListsInterval]
+// and re-reads the modified ones.  It's intended to be used as a goroutine.
+func (lists *ratelimitLists) refresh(ctx context.Context) {
+	defer slogutil.RecoverAndLog(ctx, lists.logger)
+
+	ticker := time.NewTicker(ratelimitListsInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for _, f := range []*subnetFile{lists.allow, lists.deny} {
+			if f != nil {
+				f.refresh(ctx)
+			}
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+
+	"github.com/AdguardTeam/dnsproxy/internal/health"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	goFlags "github.com/jessevdk/go-flags"
+)
+
+// reloader reloads the configuration of the running proxy from the same
+// configuration file and command-line arguments it has been started with.
+type reloader struct {
+	// logger is used to log the reloads.
+	logger *slog.Logger
+
+	// levels are the logging levels of the proxy.
+	levels *logLevels
+
+	// proxy is the running proxy.
+	proxy *proxy.Proxy
+
+	// health is the health checker probing the general upstreams.  It may be
+	// nil.
+	health *health.Checker
+
+	// keyLog is used to write the TLS session secrets of the upstream
+	// connections, if not nil.  It's not reopened on reload.
+	keyLog io.Writer
+
+	// sessions is the TLS session cache of the DNS-over-QUIC upstreams, if not
+	// nil.  It's kept on reload.
+	sessions *upstream.SessionCache
+
+	// remote is the remote list of the general upstreams.  It may be nil.
+	// It's not reconfigured on reload.
+	remote *remoteUpstreams
+
+	// lists are the ratelimit lists read from the files.  It may be nil.  The
+	// same lists are kept on reload, since the files are watched anyway.
+	lists *ratelimitLists
+
+	// options are the options the configuration has last been loaded from.
+	// It's protected by mu.
+	options *Options
+
+	// mu serializes the reloads.
+	mu *sync.Mutex
+
+	// args are the command-line arguments.
+	args []string
+}
+
+// reload re-reads the configuration and applies its reloadable part to the
+// proxy.  The listeners and the requests being processed are kept.
+func (r *reloader) reload(_ context.Context) (err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Don't print the usage and errors to the output, since the process is
+	// already running.
+	options, err := parseOptions(r.args, goFlags.None)
+	if err != nil {
+		return fmt.Errorf("parsing options: %w", err)
+	}
+
+	return r.apply(options)
+}
+
+// resetUpstreams recreates the upstreams from the options the configuration
+// has last been loaded from, closing their connections and resolving their
+// addresses with a new bootstrap.
+func (r *reloader) resetUpstreams(_ context.Context) (err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.apply(r.options)
+}
+
+// apply applies the reloadable part of the configuration created from options
+// to the proxy.  r.mu must be locked.
+func (r *reloader) apply(options *Options) (err error) {
+	conf, err := newReloadedConfig(
+		r.logger,
+		r.levels,
+		options,
+		r.remote.list(),
+		r.keyLog,
+		r.sessions,
+	)
+	if err != nil {
+		return err
+	}
+
+	r.lists.apply(conf)
+
+	err = r.proxy.Reconfigure(conf)
+	if err != nil {
+		return errors.WithDeferred(err, closeUpstreamConfigs(conf))
+	}
+
+	if r.health != nil {
+		r.health.SetUpstreams(conf.UpstreamConfig.Upstreams)
+	}
+
+	r.options = options
+
+	return nil
+}
+
+// configDump returns the dump of the effective configuration of the running
+// proxy.
+func (r *reloader) configDump() (dump any) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return newConfigDump(r.proxy.CurrentConfig(), r.options, boundListeners(r.proxy))
+}
+
+// reloadLogged reloads the configuration and logs the result.
+func (r *reloader) reloadLogged(ctx context.Context) {
+	r.logger.InfoContext(ctx, "reloading configuration")
+
+	err := r.reload(ctx)
+	if err != nil {
+		r.logger.ErrorContext(ctx, "reloading configuration", slogutil.KeyError, err)
+
+		return
+	}
+
+	r.logger.InfoContext(ctx, "configuration reloaded")
+}
+
+// newReloadedConfig returns the reloadable part of the proxy configuration,
+// see [proxy.Proxy.Reconfigure], created from options and the general upstreams
+// from the remote list.  keyLog and sessions are used for the upstreams, see
+// [newUpstreamOptions].
+func newReloadedConfig(
+	l *slog.Logger,
+	levels *logLevels,
+	options *Options,
+	remote []string,
+	keyLog io.Writer,
+	sessions *upstream.SessionCache,
+) (conf *proxy.Config, err error) {
+	conf = &proxy.Config{
+		Logger:    l,
+		LogLevels: levels.proxyLevels(),
+
+		RatelimitSubnetLenIPv4: options.RatelimitSubnetLenIPv4,
+		RatelimitSubnetLenIPv6: options.RatelimitSubnetLenIPv6,
+		RatelimitIPv6:          options.RatelimitIPv6,
+		RatelimitBurst:         options.RatelimitBurst,
+		RatelimitBurstIPv6:     options.RatelimitBurstIPv6,
+		RatelimitTruncate:      options.RatelimitTruncate,
+		RatelimitSlip:          options.RatelimitSlip,
+
+		Ratelimit:       options.Ratelimit,
+		CacheEnabled:    options.Cache,
+		CacheSizeBytes:  options.CacheSizeBytes,
+		CacheMinTTL:     options.CacheMinTTL,
+		CacheMaxTTL:     options.CacheMaxTTL,
+		CacheOptimistic: options.CacheOptimistic,
+		UsePrivateRDNS:  options.UsePrivateRDNS,
+
+		CacheAggressiveNSEC: options.CacheAggressiveNSEC,
+		TrustUpstreamAD:     options.TrustUpstreamAD,
+	}
+
+	conf.CacheTTLOverrides, err = parseTTLOverrides(options.CacheTypeTTLs)
+	if err != nil {
+		return nil, fmt.Errorf("parsing cache type ttls: %w", err)
+	}
+
+	_, err = setUpstreams(l, conf, options, remote, keyLog, sessions)
+	if err != nil {
+		return nil, errors.WithDeferred(err, closeUpstreamConfigs(conf))
+	}
+
+	initBogusNXDomain(l, conf, options)
+
+	return conf, nil
+}
+
+// closeUpstreamConfigs closes the upstream configurations of conf which aren't
+// used by the proxy.
+func closeUpstreamConfigs(conf *proxy.Config) (err error) {
+	var errs []error
+	for _, uc := range []*proxy.UpstreamConfig{
+		conf.UpstreamConfig,
+		conf.PrivateRDNSUpstreamConfig,
+		conf.Fallbacks,
+	} {
+		if uc != nil {
+			errs = append(errs, uc.Close())
+		}
+	}
+
+	return errors.Join(errs...)
+}
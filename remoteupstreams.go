@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+)
+
+const (
+	// remoteUpstreamsMaxSize is the maximum size of the list of the upstreams,
+	// its signature, and its checksum fetched from the remote source.
+	remoteUpstreamsMaxSize = 1 << 20
+
+	// remoteUpstreamsSigExt is the extension of the URL of the signature of
+	// the list of the upstreams.
+	remoteUpstreamsSigExt = ".sig"
+
+	// remoteUpstreamsSumExt is the extension of the URL of the checksum of the
+	// list of the upstreams.
+	remoteUpstreamsSumExt = ".sha256"
+
+	// defaultRemoteUpstreamsInterval is the default time between the fetches
+	// of the list of the upstreams.
+	defaultRemoteUpstreamsInterval = 1 * time.Hour
+)
+
+// remoteUpstreams is the list of the general upstreams fetched from an HTTPS URL
+// or a file, which is used along with the ones from [Options.Upstreams].
+type remoteUpstreams struct {
+	// logger is used to log the updates of the list.
+	logger *slog.Logger
+
+	// client is used to fetch the list over HTTPS.
+	client *http.Client
+
+	// mu protects servers.
+	mu *sync.Mutex
+
+	// source is the URL with the https scheme, or the path to the file.
+	source string
+
+	// key, if not nil, is the key the signature of the list is verified with.
+	key ed25519.PublicKey
+
+	// servers are the addresses of the upstreams from the last list applied.
+	servers []string
+
+	// interval is the time between the fetches of the list.
+	interval time.Duration
+
+	// checksum, if true, makes the list verified with its SHA-256 checksum.
+	checksum bool
+}
+
+// initRemoteUpstreams returns the remote list of the upstreams configured by
+// options with the list fetched for the first time.  r is nil if it's not
+// configured.  A failure to fetch the list is only fatal if there are no other
+// general upstreams.
+func initRemoteUpstreams(l *slog.Logger, options *Options) (r *remoteUpstreams) {
+	r, err := newRemoteUpstreams(l, options)
+	if err != nil {
+		fatal(l, "initializing remote upstreams", slogutil.KeyError, err)
+	} else if r == nil {
+		return nil
+	}
+
+	err = r.init(context.Background())
+	if err == nil {
+		return r
+	} else if len(options.Upstreams) == 0 {
+		fatal(l, "fetching remote upstreams", slogutil.KeyError, err)
+	}
+
+	l.Error("fetching remote upstreams", slogutil.KeyError, err)
+
+	return r
+}
+
+// newRemoteUpstreams returns the remote list of the upstreams configured by
+// options.  r is nil if it's not configured.
+func newRemoteUpstreams(l *slog.Logger, options *Options) (r *remoteUpstreams, err error) {
+	source := options.UpstreamsURL
+	if source == "" {
+		return nil, nil
+	}
+
+	if scheme, _, ok := strings.Cut(source, "://"); ok && scheme != "https" {
+		return nil, fmt.Errorf("unsupported url scheme: %s", scheme)
+	}
+
+	r = &remoteUpstreams{
+		logger: l.With(slogutil.KeyPrefix, "remote_upstreams"),
+		client: &http.Client{
+			Timeout: options.Timeout.Duration,
+		},
+		mu:       &sync.Mutex{},
+		source:   source,
+		interval: cmp.Or(options.UpstreamsURLInterval.Duration, defaultRemoteUpstreamsInterval),
+		checksum: options.UpstreamsURLChecksum,
+	}
+
+	if options.UpstreamsURLKey != "" {
+		var key []byte
+		key, err = base64.StdEncoding.DecodeString(options.UpstreamsURLKey)
+		if err != nil {
+			return nil, fmt.Errorf("key: %w", err)
+		} else if len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("key: bad length %d, want %d", len(key), ed25519.PublicKeySize)
+		}
+
+		r.key = key
+	}
+
+	return r, nil
+}
+
+// list returns the addresses of the upstreams from the last list applied.  r
+// may be nil.
+func (r *remoteUpstreams) list() (servers []string) {
+	if r == nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.servers
+}
+
+// init fetches the list for the first time.
+func (r *remoteUpstreams) init(ctx context.Context) (err error) {
+	servers, err := r.fetchList(ctx)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.servers = servers
+
+	return nil
+}
+
+// refresh fetches the list every [remoteUpstreams.interval] and calls reload
+// once it's changed.  If reload fails, the previous list is kept.  It's
+// intended to be used as a goroutine.
+func (r *remoteUpstreams) refresh(ctx context.Context, reload func(ctx context.Context) (err error)) {
+	defer slogutil.RecoverAndLog(ctx, r.logger)
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		r.update(ctx, reload)
+	}
+}
+
+// update fetches the list and applies it with reload, if it's changed.
+func (r *remoteUpstreams) update(ctx context.Context, reload func(ctx context.Context) (err error)) {
+	servers, err := r.fetchList(ctx)
+	if err != nil {
+		r.logger.ErrorContext(ctx, "fetching list", slogutil.KeyError, err)
+
+		return
+	}
+
+	r.mu.Lock()
+	prev := r.servers
+	changed := !slices.Equal(prev, servers)
+	r.servers = servers
+	r.mu.Unlock()
+
+	if !changed {
+		r.logger.DebugContext(ctx, "list not changed")
+
+		return
+	}
+
+	err = reload(ctx)
+	if err != nil {
+		r.logger.ErrorContext(ctx, "applying list", slogutil.KeyError, err)
+
+		r.mu.Lock()
+		r.servers = prev
+		r.mu.Unlock()
+
+		return
+	}
+
+	r.logger.InfoContext(ctx, "list applied", "upstreams", len(servers))
+}
+
+// fetchList fetches and verifies the list and returns the addresses of the
+// upstreams from it.
+func (r *remoteUpstreams) fetchList(ctx context.Context) (servers []string, err error) {
+	data, err := r.fetch(ctx, r.source)
+	if err != nil {
+		return nil, err
+	}
+
+	err = r.verify(ctx, data)
+	if err != nil {
+		return nil, fmt.Errorf("verifying: %w", err)
+	}
+
+	servers = parseServersList(data)
+	if len(servers) == 0 {
+		return nil, errors.Error("no upstreams in list")
+	}
+
+	return servers, nil
+}
+
+// verify returns an error if data doesn't match its signature or checksum, if
+// configured.
+func (r *remoteUpstreams) verify(ctx context.Context, data []byte) (err error) {
+	if r.key != nil {
+		var sig []byte
+		sig, err = r.fetchDecoded(ctx, remoteUpstreamsSigExt, base64.StdEncoding.DecodeString)
+		if err != nil {
+			return fmt.Errorf("signature: %w", err)
+		}
+
+		if !ed25519.Verify(r.key, data, sig) {
+			return errors.Error("signature: mismatch")
+		}
+	}
+
+	if r.checksum {
+		var sum []byte
+		sum, err = r.fetchDecoded(ctx, remoteUpstreamsSumExt, hex.DecodeString)
+		if err != nil {
+			return fmt.Errorf("checksum: %w", err)
+		}
+
+		if got := sha256.Sum256(data); !bytes.Equal(got[:], sum) {
+			return errors.Error("checksum: mismatch")
+		}
+	}
+
+	return nil
+}
+
+// fetchDecoded fetches the file next to the list with ext appended to its URL
+// and decodes its first field with decode.
+func (r *remoteUpstreams) fetchDecoded(
+	ctx context.Context,
+	ext string,
+	decode func(s string) (b []byte, err error),
+) (b []byte, err error) {
+	data, err := r.fetch(ctx, r.source+ext)
+	if err != nil {
+		return nil, err
+	}
+
+	// The checksum files produced by sha256sum also contain the file name.
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return nil, errors.Error("empty")
+	}
+
+	return decode(fields[0])
+}
+
+// fetch returns the contents of the file from source, which is either the URL
+// with the https scheme or the path.
+func (r *remoteUpstreams) fetch(ctx context.Context, source string) (data []byte, err error) {
+	if !strings.HasPrefix(source, "https://") {
+		// #nosec G304 -- Trust the file path that is given in the
+		// configuration.
+		return os.ReadFile(source)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating request: %w", err)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		// Don't wrap the error, since it already contains the URL.
+		return nil, err
+	}
+	defer func() { err = errors.WithDeferred(err, resp.Body.Close()) }()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad status %d", resp.StatusCode)
+	}
+
+	data, err = io.ReadAll(io.LimitReader(resp.Body, remoteUpstreamsMaxSize))
+	if err != nil {
+		return nil, fmt.Errorf("reading body: %w", err)
+	}
+
+	return data, nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+
+	"github.com/AdguardTeam/dnsproxy/internal/script"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+)
+
+// initScript adds the hooks of the script from options to conf, if it's set.
+// scr is nil if there is no script, otherwise it should be closed on exit.
+func initScript(l *slog.Logger, conf *proxy.Config, options *Options) (scr *script.Script) {
+	path := options.ScriptPath
+	if path == "" {
+		return nil
+	}
+
+	// #nosec G304 -- Trust the file path that is given in the configuration.
+	src, err := os.ReadFile(path)
+	if err != nil {
+		fatal(l, "reading script", slogutil.KeyError, err)
+	}
+
+	l = l.With(slogutil.KeyPrefix, "script")
+
+	scr, err = script.New(&script.Config{
+		Logger:    l,
+		Name:      path,
+		Source:    string(src),
+		Timeout:   options.ScriptTimeout.Duration,
+		MaxMemory: options.ScriptMaxMemory,
+	})
+	if err != nil {
+		fatal(l, "initializing script", "path", path, slogutil.KeyError, err)
+	}
+
+	l.Info("running script", "path", path)
+
+	addBeforeRequestHandler(conf, scr)
+	conf.ResponseHandler = scr.HandleResponse
+
+	return scr
+}
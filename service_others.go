@@ -0,0 +1,31 @@
+//go:build !windows
+
+package main
+
+import (
+	"io"
+	"log/slog"
+	"os"
+)
+
+// prepareService does nothing, since the services are only supported on
+// Windows.
+func prepareService() {}
+
+// controlService exits with an error, since the services are only supported on
+// Windows.
+func controlService(_ *Options, _ []string) {
+	fatal(slog.Default(), "services are not supported on this platform")
+}
+
+// runService always returns false, since the services are only supported on
+// Windows.
+func runService(_ *Options) (ok bool) { return false }
+
+// notifyService does nothing, since the services are only supported on
+// Windows.
+func notifyService(_ chan<- os.Signal) {}
+
+// newServiceLogOutput always returns nil, since the services are only supported
+// on Windows.
+func newServiceLogOutput() (w io.WriteCloser) { return nil }
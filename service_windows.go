@@ -0,0 +1,302 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// serviceName is the name of the Windows service and of its event log source.
+const serviceName = "dnsproxy"
+
+// serviceEventID is the identifier of the event log entries written by the
+// service.
+const serviceEventID = 1
+
+// serviceSignals receives the signals emulated by the service control handler,
+// see [serviceHandler.Execute].
+var serviceSignals = make(chan os.Signal, 1)
+
+// isWindowsService returns true if the process is run by the service control
+// manager.
+func isWindowsService() (ok bool) {
+	ok, err := svc.IsWindowsService()
+
+	return err == nil && ok
+}
+
+// prepareService changes the working directory to the directory of the
+// executable, if the process is run as a service, so that the relative paths
+// in the options are resolved against it instead of the system directory.
+func prepareService() {
+	if !isWindowsService() {
+		return
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		fatal(slog.Default(), "getting executable path", slogutil.KeyError, err)
+	}
+
+	err = os.Chdir(filepath.Dir(exe))
+	if err != nil {
+		fatal(slog.Default(), "changing working directory", slogutil.KeyError, err)
+	}
+}
+
+// controlService performs the service action from options and exits.  args
+// are the command-line arguments of the process.
+func controlService(options *Options, args []string) {
+	l := slog.Default()
+
+	var err error
+	switch options.Service {
+	case "install":
+		err = installService(args)
+	case "uninstall":
+		err = uninstallService()
+	default:
+		err = fmt.Errorf("unknown action %q", options.Service)
+	}
+	if err != nil {
+		fatal(l, "controlling service", "action", options.Service, slogutil.KeyError, err)
+	}
+
+	l.Info("service action done", "action", options.Service)
+
+	os.Exit(0)
+}
+
+// installService installs the service started with args and registers the
+// event log source for it.
+func installService(args []string) (err error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("getting executable path: %w", err)
+	}
+
+	svcArgs, err := serviceArgs(args)
+	if err != nil {
+		return fmt.Errorf("preparing arguments: %w", err)
+	}
+
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("connecting to service manager: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, m.Disconnect()) }()
+
+	s, err := m.CreateService(serviceName, exe, mgr.Config{
+		DisplayName: serviceName,
+		Description: "Simple DNS proxy with DoH, DoT, DoQ and DNSCrypt support",
+		StartType:   mgr.StartAutomatic,
+	}, svcArgs...)
+	if err != nil {
+		return fmt.Errorf("creating service: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, s.Close()) }()
+
+	err = eventlog.InstallAsEventCreate(serviceName, eventlog.Error|eventlog.Warning|eventlog.Info)
+	if err != nil {
+		return errors.Join(
+			fmt.Errorf("installing event log source: %w", err),
+			s.Delete(),
+		)
+	}
+
+	return nil
+}
+
+// uninstallService removes the service and its event log source.
+func uninstallService() (err error) {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("connecting to service manager: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, m.Disconnect()) }()
+
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("opening service: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, s.Close()) }()
+
+	err = s.Delete()
+	if err != nil {
+		return fmt.Errorf("deleting service: %w", err)
+	}
+
+	err = eventlog.Remove(serviceName)
+	if err != nil {
+		return fmt.Errorf("removing event log source: %w", err)
+	}
+
+	return nil
+}
+
+// serviceArgs returns the arguments to start the service with: args without the
+// --service option and with the absolute path of the configuration file, since
+// the service is started in another working directory.
+func serviceArgs(args []string) (res []string, err error) {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--service":
+			// Skip the value as well.
+			i++
+		case strings.HasPrefix(arg, "--service="):
+			// Go on.
+		case strings.HasPrefix(arg, "--config-path="):
+			var path string
+			path, err = filepath.Abs(strings.TrimPrefix(arg, "--config-path="))
+			if err != nil {
+				return nil, fmt.Errorf("config path: %w", err)
+			}
+
+			res = append(res, "--config-path="+path)
+		default:
+			res = append(res, arg)
+		}
+	}
+
+	return res, nil
+}
+
+// runService runs the proxy with options as a service and returns true, if the
+// process is run by the service control manager.  Otherwise, it returns false.
+func runService(options *Options) (ok bool) {
+	if !isWindowsService() {
+		return false
+	}
+
+	err := svc.Run(serviceName, &serviceHandler{options: options})
+	if err != nil {
+		fatal(slog.Default(), "running service", slogutil.KeyError, err)
+	}
+
+	return true
+}
+
+// serviceHandler is the control handler of the service.
+type serviceHandler struct {
+	// options are the options to run the proxy with.
+	options *Options
+}
+
+// type check
+var _ svc.Handler = (*serviceHandler)(nil)
+
+// Execute implements the [svc.Handler] interface for *serviceHandler.  It runs
+// the proxy and translates the stop and shutdown requests into SIGTERM and the
+// parameter change requests into SIGHUP, so that they're handled the same way
+// as on other platforms.
+func (h *serviceHandler) Execute(
+	_ []string,
+	reqs <-chan svc.ChangeRequest,
+	status chan<- svc.Status,
+) (svcSpecificEC bool, exitCode uint32) {
+	status <- svc.Status{State: svc.StartPending}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		run(h.options)
+	}()
+
+	status <- svc.Status{
+		State:   svc.Running,
+		Accepts: svc.AcceptStop | svc.AcceptShutdown | svc.AcceptParamChange,
+	}
+
+	for {
+		select {
+		case <-done:
+			return false, 0
+		case req := <-reqs:
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				serviceSignals <- syscall.SIGTERM
+			case svc.ParamChange:
+				serviceSignals <- syscall.SIGHUP
+			default:
+				// Go on.
+			}
+		}
+	}
+}
+
+// notifyService makes the signals emulated by the service control handler to
+// be relayed to c.
+func notifyService(c chan<- os.Signal) {
+	go func() {
+		for sig := range serviceSignals {
+			c <- sig
+		}
+	}()
+}
+
+// newServiceLogOutput returns the event log writer, if the process is run as a
+// service.  Otherwise, it returns nil.
+func newServiceLogOutput() (w io.WriteCloser) {
+	if !isWindowsService() {
+		return nil
+	}
+
+	elog, err := eventlog.Open(serviceName)
+	if err != nil {
+		// Keep writing to stderr, since there is nowhere to report the error.
+		return nil
+	}
+
+	return &eventLogWriter{log: elog}
+}
+
+// eventLogWriter is an [io.WriteCloser] writing the log lines into the event
+// log with the types determined by their levels.
+type eventLogWriter struct {
+	// log is the opened event log.
+	log *eventlog.Log
+}
+
+// type check
+var _ io.WriteCloser = (*eventLogWriter)(nil)
+
+// Write implements the [io.Writer] interface for *eventLogWriter.  p is
+// expected to be a single log line starting with the level.
+func (w *eventLogWriter) Write(p []byte) (n int, err error) {
+	msg := strings.TrimSuffix(string(p), "\n")
+	switch {
+	case strings.HasPrefix(msg, slog.LevelError.String()):
+		err = w.log.Error(serviceEventID, msg)
+	case strings.HasPrefix(msg, slog.LevelWarn.String()):
+		err = w.log.Warning(serviceEventID, msg)
+	default:
+		err = w.log.Info(serviceEventID, msg)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// Close implements the [io.Closer] interface for *eventLogWriter.
+func (w *eventLogWriter) Close() (err error) {
+	return w.log.Close()
+}
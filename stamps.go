@@ -0,0 +1,313 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/ameshkov/dnsstamps"
+	goFlags "github.com/jessevdk/go-flags"
+	"github.com/skip2/go-qrcode"
+)
+
+// stampsCommand is the name of the subcommand printing the DNS stamps of the
+// listeners.
+const stampsCommand = "stamps"
+
+// stampsUsage is the usage line of the stamps subcommand.
+const stampsUsage = "stamps [OPTIONS]"
+
+// stampsOptions are the options of the stamps subcommand.  They're only set
+// from the command line, so unlike [Options], they have the default values.
+type stampsOptions struct {
+	// Addrs are the IP addresses the clients connect to.
+	Addrs []string `long:"stamp-addr" description:"IP address the clients connect to, for example the public one of the NAT, used instead of the listening addresses. Can be specified multiple times."`
+
+	// Hostname is the hostname of the server in the stamps of the TLS-based
+	// listeners.
+	Hostname string `long:"stamp-hostname" description:"Hostname of the server in the DNS-over-TLS, DNS-over-HTTPS, and DNS-over-QUIC stamps. The first DNS name of the TLS certificate is used if not set."`
+
+	// Path is the path of the DNS-over-HTTPS endpoint.
+	Path string `long:"stamp-path" description:"Path of the DNS-over-HTTPS endpoint." default:"/dns-query"`
+
+	// DNSSEC tells if the stamps should say the server validates DNSSEC.
+	DNSSEC bool `long:"stamp-dnssec" description:"If present, the stamps say the server validates DNSSEC."`
+
+	// NoLog tells if the stamps should say the server doesn't log the queries.
+	NoLog bool `long:"stamp-nolog" description:"If present, the stamps say the server doesn't log the queries."`
+
+	// NoFilter tells if the stamps should say the server doesn't filter the
+	// responses.
+	NoFilter bool `long:"stamp-nofilter" description:"If present, the stamps say the server doesn't filter the responses."`
+
+	// QR tells if the QR codes of the stamps should be printed.
+	QR bool `long:"qr" description:"If present, also prints the QR codes of the stamps."`
+}
+
+// props returns the informal properties of the stamps.
+func (o *stampsOptions) props() (props dnsstamps.ServerInformalProperties) {
+	if o.DNSSEC {
+		props |= dnsstamps.ServerInformalPropertyDNSSEC
+	}
+
+	if o.NoLog {
+		props |= dnsstamps.ServerInformalPropertyNoLog
+	}
+
+	if o.NoFilter {
+		props |= dnsstamps.ServerInformalPropertyNoFilter
+	}
+
+	return props
+}
+
+// namedStamp is a DNS stamp of a listener.
+type namedStamp struct {
+	// proto is the protocol of the listener.
+	proto string
+
+	// addr is the address of the listener.
+	addr string
+
+	// stamp is the DNS stamp of the listener.
+	stamp dnsstamps.ServerStamp
+}
+
+// runStamps prints the DNS stamps of the encrypted listeners configured in the
+// options, so that those could be handed to the clients.  It returns the exit
+// code of the process.
+func runStamps(args []string) (code int) {
+	stampsOpts := &stampsOptions{}
+	options, rest, err := parseArgs(args, goFlags.Default, stampsUsage, stampsOpts)
+	if err != nil {
+		return parseErrorCode(err)
+	} else if len(rest) > 0 {
+		_, _ = fmt.Fprintf(os.Stderr, "unexpected argument %q\nusage: dnsproxy %s\n", rest[0], stampsUsage)
+
+		return 1
+	}
+
+	l, _, closeOutput, _ := newLogger(options)
+	defer closeOutput()
+
+	stamps, err := listenerStamps(options, stampsOpts)
+	if err != nil {
+		l.Error("creating stamps", slogutil.KeyError, err)
+
+		return 1
+	} else if len(stamps) == 0 {
+		l.Error("no encrypted listeners configured")
+
+		return 1
+	}
+
+	err = printStamps(os.Stdout, stamps, stampsOpts.QR)
+	if err != nil {
+		l.Error("printing stamps", slogutil.KeyError, err)
+
+		return 1
+	}
+
+	return 0
+}
+
+// listenerStamps returns the DNS stamps of the encrypted listeners configured
+// in options.
+func listenerStamps(options *Options, stampsOpts *stampsOptions) (stamps []namedStamp, err error) {
+	ips, err := stampIPs(options, stampsOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	props := stampsOpts.props()
+	tlsStamps := len(options.TLSListenPorts) > 0 ||
+		len(options.HTTPSListenPorts) > 0 ||
+		len(options.QUICListenPorts) > 0
+
+	var hostname string
+	var hashes [][]uint8
+	if tlsStamps {
+		hostname, hashes, err = stampCertInfo(options.TLSCertPath, stampsOpts.Hostname)
+		if err != nil {
+			return nil, fmt.Errorf("tls certificate: %w", err)
+		}
+	}
+
+	newStamp := func(proto dnsstamps.StampProtoType, addr, path string) (s dnsstamps.ServerStamp) {
+		return dnsstamps.ServerStamp{
+			Props:         props,
+			ServerAddrStr: addr,
+			ProviderName:  hostname,
+			Path:          path,
+			Hashes:        hashes,
+			Proto:         proto,
+		}
+	}
+
+	for _, ip := range ips {
+		for _, port := range options.TLSListenPorts {
+			addr := stampAddr(ip, port)
+			stamps = append(stamps, namedStamp{"tls", addr, newStamp(dnsstamps.StampProtoTypeTLS, addr, "")})
+		}
+
+		for _, port := range options.HTTPSListenPorts {
+			addr := stampAddr(ip, port)
+			s := newStamp(dnsstamps.StampProtoTypeDoH, addr, stampsOpts.Path)
+			stamps = append(stamps, namedStamp{"https", addr, s})
+		}
+
+		for _, port := range options.QUICListenPorts {
+			addr := stampAddr(ip, port)
+			stamps = append(stamps, namedStamp{"quic", addr, newStamp(dnsstamps.StampProtoTypeDoQ, addr, "")})
+		}
+	}
+
+	if len(options.DNSCryptListenPorts) == 0 {
+		return stamps, nil
+	} else if options.DNSCryptConfigPath == "" {
+		return nil, errors.Error("dnscrypt listeners require dnscrypt config")
+	}
+
+	rc, err := loadDNSCryptConfig(options.DNSCryptConfigPath)
+	if err != nil {
+		return nil, fmt.Errorf("dnscrypt config: %w", err)
+	}
+
+	for _, ip := range ips {
+		for _, port := range options.DNSCryptListenPorts {
+			addr := stampAddr(ip, port)
+
+			var s dnsstamps.ServerStamp
+			s, err = rc.CreateStamp(addr)
+			if err != nil {
+				return nil, fmt.Errorf("dnscrypt stamp: %w", err)
+			}
+
+			s.Props = props
+			stamps = append(stamps, namedStamp{"dnscrypt", addr, s})
+		}
+	}
+
+	return stamps, nil
+}
+
+// stampIPs returns the IP addresses of the listeners to create the stamps for.
+// Unspecified addresses are skipped, since the clients can't connect to them.
+func stampIPs(options *Options, stampsOpts *stampsOptions) (ips []netip.Addr, err error) {
+	addrs := stampsOpts.Addrs
+	if len(addrs) == 0 {
+		addrs = options.ListenAddrs
+	}
+
+	for _, a := range addrs {
+		var ip netip.Addr
+		ip, err = netip.ParseAddr(a)
+		if err != nil {
+			return nil, fmt.Errorf("parsing address: %w", err)
+		}
+
+		if !ip.IsUnspecified() {
+			ips = append(ips, ip)
+		}
+	}
+
+	if len(ips) == 0 {
+		return nil, errors.Error("no specific addresses, use --stamp-addr")
+	}
+
+	return ips, nil
+}
+
+// stampAddr returns the address of the listener on ip and port in the form
+// used in the stamps.
+func stampAddr(ip netip.Addr, port int) (addr string) {
+	return net.JoinHostPort(ip.String(), strconv.Itoa(port))
+}
+
+// stampCertInfo returns the hostname and the hashes of the certificates in the
+// chain from the PEM file at path.  hostname is the first DNS name of the leaf
+// certificate, unless set.
+func stampCertInfo(path, hostname string) (name string, hashes [][]uint8, err error) {
+	if path == "" {
+		return "", nil, errors.Error("no certificate file")
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", nil, fmt.Errorf("reading: %w", err)
+	}
+
+	var leaf *x509.Certificate
+	for block, rest := pem.Decode(b); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		var cert *x509.Certificate
+		cert, err = x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return "", nil, fmt.Errorf("parsing: %w", err)
+		}
+
+		if leaf == nil {
+			leaf = cert
+		}
+
+		// The stamps pin the hashes of the to-be-signed parts of the
+		// certificates in the chain.
+		h := sha256.Sum256(cert.RawTBSCertificate)
+		hashes = append(hashes, h[:])
+	}
+
+	if leaf == nil {
+		return "", nil, errors.Error("no certificates found")
+	}
+
+	name = hostname
+	if name == "" {
+		if len(leaf.DNSNames) == 0 {
+			return "", nil, errors.Error("no dns names in certificate, use --stamp-hostname")
+		}
+
+		name = leaf.DNSNames[0]
+	}
+
+	return name, hashes, nil
+}
+
+// printStamps writes the stamps to w, each followed by its QR code, if qr is
+// true.
+func printStamps(w io.Writer, stamps []namedStamp, qr bool) (err error) {
+	for _, s := range stamps {
+		str := s.stamp.String()
+		_, err = fmt.Fprintf(w, "%s %s %s\n", s.proto, s.addr, str)
+		if err != nil {
+			return err
+		}
+
+		if !qr {
+			continue
+		}
+
+		var code *qrcode.QRCode
+		code, err = qrcode.New(str, qrcode.Medium)
+		if err != nil {
+			return fmt.Errorf("encoding qr code: %w", err)
+		}
+
+		_, err = io.WriteString(w, code.ToSmallString(false))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/internal/stats"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+)
+
+// initStats adds the statistics query logger to conf and starts the HTTP
+// server exposing the collected statistics, if it's enabled in options.  s is
+// nil if the statistics are neither served nor reported in the metrics.
+func initStats(baseLogger *slog.Logger, conf *proxy.Config, options *Options) (s *stats.Stats) {
+	addr := options.StatsListenAddr
+	needTalkers := options.MetricsListenAddr != "" && options.MetricsTopTalkers > 0
+	if addr == "" && !needTalkers {
+		return nil
+	}
+
+	s = stats.New(&stats.Config{
+		SubnetLenIPv4: options.RatelimitSubnetLenIPv4,
+		SubnetLenIPv6: options.RatelimitSubnetLenIPv6,
+	})
+	addQueryLogger(conf, s)
+
+	if addr == "" {
+		return s
+	}
+
+	l := baseLogger.With(slogutil.KeyPrefix, "stats")
+
+	mux := http.NewServeMux()
+	mux.Handle("/stats", s)
+
+	go func() {
+		l.Info("listening", "addr", addr)
+		srv := &http.Server{
+			Addr:        addr,
+			ReadTimeout: 60 * time.Second,
+			Handler:     mux,
+		}
+		err := listenAndServe(l, srv, options.ReusePort)
+		l.Error("running server", slogutil.KeyError, err)
+	}()
+
+	return s
+}
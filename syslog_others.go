@@ -0,0 +1,20 @@
+//go:build !unix
+
+package main
+
+import (
+	"io"
+	"log/slog"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+)
+
+// initSyslog fails if syslog is enabled in options, since it's not supported
+// on this platform.
+func initSyslog(l *slog.Logger, _ *proxy.Config, options *Options) (closer io.Closer) {
+	if options.Syslog {
+		fatal(l, "syslog is not supported on this platform")
+	}
+
+	return nil
+}
@@ -0,0 +1,63 @@
+//go:build unix
+
+package main
+
+import (
+	"cmp"
+	"io"
+	"log/slog"
+	"net/url"
+	"strings"
+
+	"github.com/AdguardTeam/dnsproxy/internal/syslog"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+)
+
+// initSyslog sets the syslog query logger and event listener into conf, if
+// it's enabled in options.  closer is nil if syslog is disabled, otherwise it
+// should be closed on exit.
+func initSyslog(l *slog.Logger, conf *proxy.Config, options *Options) (closer io.Closer) {
+	if !options.Syslog {
+		return nil
+	}
+
+	c := &syslog.Config{
+		Severities: map[syslog.Event]string{},
+		Facility:   options.SyslogFacility,
+		Tag:        "dnsproxy",
+		Logger:     l,
+	}
+
+	if addr := options.SyslogAddr; addr != "" {
+		u, err := url.Parse(addr)
+		if err != nil {
+			fatal(l, "parsing syslog address", slogutil.KeyError, err)
+		}
+
+		c.Network, c.Address = u.Scheme, u.Host
+	}
+
+	for _, s := range options.SyslogSeverities {
+		ev, sev, ok := strings.Cut(s, ":")
+		if !ok {
+			fatal(l, "bad syslog severity: expected event:severity", "value", s)
+		}
+
+		c.Severities[syslog.Event(ev)] = sev
+	}
+
+	sl, err := syslog.New(c)
+	if err != nil {
+		fatal(l, "initializing syslog", slogutil.KeyError, err)
+	}
+
+	addMetricsListener(conf, sl)
+	if options.SyslogQueries {
+		addQueryLogger(conf, sl)
+	}
+
+	l.Info("sending events to syslog", "addr", cmp.Or(options.SyslogAddr, "local syslog"))
+
+	return sl
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/AdguardTeam/dnsproxy/internal/version"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	sdkresource "go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// initTracing sets the OpenTelemetry tracer provider exporting the traces via
+// OTLP into conf, if it's enabled in options.  tp is nil if the tracing is
+// disabled, otherwise it should be shut down on exit to flush the remaining
+// spans.
+func initTracing(
+	l *slog.Logger,
+	conf *proxy.Config,
+	options *Options,
+) (tp *sdktrace.TracerProvider) {
+	if options.OTLPTracesURL == "" {
+		return nil
+	}
+
+	exp, err := otlptracehttp.New(
+		context.Background(),
+		otlptracehttp.WithEndpointURL(options.OTLPTracesURL),
+	)
+	if err != nil {
+		fatal(l, "creating otlp trace exporter", slogutil.KeyError, err)
+	}
+
+	res := sdkresource.NewSchemaless(
+		attribute.String("service.name", "dnsproxy"),
+		attribute.String("service.version", version.Version()),
+	)
+
+	tp = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(res),
+	)
+
+	l.Info("exporting traces", slogutil.KeyPrefix, "tracing", "url", options.OTLPTracesURL)
+
+	conf.TracerProvider = tp
+
+	return tp
+}
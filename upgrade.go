@@ -0,0 +1,29 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+
+	proxynetutil "github.com/AdguardTeam/dnsproxy/internal/netutil"
+)
+
+// listenAndServe is like [http.Server.ListenAndServe], but if reusePort is
+// true, it binds the address with the socket options of the plain DNS
+// listeners, so that the new process is able to bind it during a binary upgrade
+// while the old one is still running.
+func listenAndServe(l *slog.Logger, srv *http.Server, reusePort bool) (err error) {
+	lc := &net.ListenConfig{}
+	if reusePort {
+		lc = proxynetutil.ListenConfig(l)
+	}
+
+	lsnr, err := lc.Listen(context.Background(), "tcp", srv.Addr)
+	if err != nil {
+		return fmt.Errorf("listening: %w", err)
+	}
+
+	return srv.Serve(lsnr)
+}
@@ -0,0 +1,25 @@
+//go:build !unix
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+)
+
+// notifyUpgrade does nothing, since the binary upgrade isn't supported on this
+// platform.
+func notifyUpgrade(_ chan<- os.Signal) {}
+
+// isUpgradeSignal always returns false, since the binary upgrade isn't
+// supported on this platform.
+func isUpgradeSignal(_ os.Signal) (ok bool) { return false }
+
+// upgradeBinary always returns false, since the binary upgrade isn't supported
+// on this platform.
+func upgradeBinary(_ context.Context, _ *slog.Logger) (ok bool) { return false }
+
+// reportUpgradeReady does nothing, since the binary upgrade isn't supported on
+// this platform.
+func reportUpgradeReady(_ *slog.Logger) {}
@@ -0,0 +1,155 @@
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+)
+
+// upgradeFDEnv is the environment variable containing the descriptor of the
+// pipe used by the new process to report its readiness to the old one during a
+// binary upgrade.
+const upgradeFDEnv = "DNSPROXY_UPGRADE_FD"
+
+// upgradeTimeout is the maximum time the old process waits for the new one to
+// start serving during a binary upgrade.
+const upgradeTimeout = 1 * time.Minute
+
+// errUpgradeNotReady is returned when the new process exits without reporting
+// its readiness.
+const errUpgradeNotReady errors.Error = "new process exited before starting"
+
+// notifyUpgrade makes the upgrade signal delivered to ch.
+func notifyUpgrade(ch chan<- os.Signal) {
+	signal.Notify(ch, syscall.SIGUSR2)
+}
+
+// isUpgradeSignal returns true if sig requests a binary upgrade.
+func isUpgradeSignal(sig os.Signal) (ok bool) {
+	return sig == syscall.SIGUSR2
+}
+
+// upgradeBinary starts the new process from the current executable file with
+// the same arguments and waits for it to start serving.  Since the plain DNS
+// listeners, and all the other ones with --reuse-port, are bound with
+// SO_REUSEPORT, both processes serve the queries until the old one shuts down.
+// It returns true if the old process should shut down.
+func upgradeBinary(ctx context.Context, l *slog.Logger) (ok bool) {
+	l = l.With(slogutil.KeyPrefix, "upgrade")
+	l.InfoContext(ctx, "starting new process")
+
+	err := startNewProcess(l, false)
+	if err != nil {
+		l.ErrorContext(ctx, "starting new process", slogutil.KeyError, err)
+
+		return false
+	}
+
+	l.InfoContext(ctx, "new process is serving, shutting down")
+
+	return true
+}
+
+// startNewProcess starts the new process and waits for it to report its
+// readiness.  If detach is true, the new process is started in a new session
+// without the standard streams, so that it runs in the background.
+func startNewProcess(l *slog.Logger, detach bool) (err error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("getting executable: %w", err)
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("creating pipe: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, r.Close()) }()
+
+	// #nosec G204 -- Trust the path to the executable of the current process.
+	cmd := exec.Command(exe, os.Args[1:]...)
+	if detach {
+		// Leave the standard streams unset to connect them to the null device.
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	} else {
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	}
+
+	// The first of the extra files is the descriptor 3 in the new process.
+	cmd.ExtraFiles = []*os.File{w}
+	cmd.Env = append(os.Environ(), upgradeFDEnv+"=3")
+
+	err = cmd.Start()
+	closeErr := w.Close()
+	if err != nil {
+		return fmt.Errorf("running %q: %w", exe, err)
+	} else if closeErr != nil {
+		l.Debug("closing pipe", slogutil.KeyError, closeErr)
+	}
+
+	l.Info("started new process", "pid", cmd.Process.Pid)
+
+	readyCh := make(chan error, 1)
+	go func() {
+		_, readErr := r.Read(make([]byte, 1))
+		if errors.Is(readErr, io.EOF) {
+			readErr = errUpgradeNotReady
+		}
+
+		readyCh <- readErr
+	}()
+
+	select {
+	case err = <-readyCh:
+	case <-time.After(upgradeTimeout):
+		err = fmt.Errorf("new process not ready after %s", upgradeTimeout)
+	}
+
+	if err != nil {
+		// Don't leave both processes running.
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+
+		return err
+	}
+
+	// Don't wait for the new process, since it outlives the current one.
+	return cmd.Process.Release()
+}
+
+// reportUpgradeReady reports the readiness of the current process to the old
+// one, if it's been started during a binary upgrade or in the background.
+func reportUpgradeReady(l *slog.Logger) {
+	fdStr, ok := os.LookupEnv(upgradeFDEnv)
+	if !ok {
+		return
+	}
+
+	// Don't pass the descriptor to the processes started by the next upgrade.
+	_ = os.Unsetenv(upgradeFDEnv)
+
+	fd, err := strconv.Atoi(fdStr)
+	if err != nil {
+		l.Error("parsing upgrade descriptor", slogutil.KeyError, err)
+
+		return
+	}
+
+	f := os.NewFile(uintptr(fd), "upgrade")
+	_, err = f.Write([]byte{1})
+	err = errors.WithDeferred(err, f.Close())
+	if err != nil {
+		l.Error("reporting readiness to old process", slogutil.KeyError, err)
+	}
+}
@@ -0,0 +1,284 @@
+package upstream
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/miekg/dns"
+)
+
+// errCompression is returned when the compression pointers of a response are
+// malformed or exceed the limit, see [Options.MaxCompressionPointers].
+const errCompression errors.Error = "bad compression pointers"
+
+// errNotChecked is returned internally when the message is malformed in a way
+// not related to the compression, which is left to be reported by
+// [dns.Msg.Unpack].
+const errNotChecked errors.Error = "message not checked"
+
+// dnsHeaderLen is the length of the DNS message header.
+const dnsHeaderLen = 12
+
+// checkCompression returns an error wrapping [errCompression] if any domain
+// name of msg, the DNS message in the wire format, contains a compression
+// pointer not pointing before the name or its part pointed to, which includes
+// the loop-forming ones, or is formed by more than maxPtrs pointers.  The other
+// malformations are left to be reported by [dns.Msg.Unpack].  If maxPtrs is
+// zero, the message isn't checked.
+func checkCompression(msg []byte, maxPtrs uint) (err error) {
+	if maxPtrs == 0 || len(msg) < dnsHeaderLen {
+		return nil
+	}
+
+	err = checkMsgNames(msg, maxPtrs)
+	if errors.Is(err, errNotChecked) {
+		return nil
+	}
+
+	return err
+}
+
+// checkMsgNames checks all domain names of msg, which must contain the header.
+func checkMsgNames(msg []byte, maxPtrs uint) (err error) {
+	qdCount := int(binary.BigEndian.Uint16(msg[4:]))
+	rrCount := int(binary.BigEndian.Uint16(msg[6:])) +
+		int(binary.BigEndian.Uint16(msg[8:])) +
+		int(binary.BigEndian.Uint16(msg[10:]))
+
+	off := dnsHeaderLen
+	for i := 0; i < qdCount; i++ {
+		off, err = checkName(msg, off, maxPtrs)
+		if err != nil {
+			return fmt.Errorf("question %d: %w", i, err)
+		}
+
+		// Skip the type and the class.
+		off += 4
+	}
+
+	for i := 0; i < rrCount; i++ {
+		off, err = checkName(msg, off, maxPtrs)
+		if err != nil {
+			return fmt.Errorf("record %d: %w", i, err)
+		}
+
+		// The type, the class, the TTL, and the length of the data.
+		if off+10 > len(msg) {
+			return errNotChecked
+		}
+
+		rrType := binary.BigEndian.Uint16(msg[off:])
+		rdLen := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+
+		if off+rdLen > len(msg) {
+			return errNotChecked
+		}
+
+		err = checkRdataNames(msg, off, off+rdLen, rrType, maxPtrs)
+		if err != nil {
+			return fmt.Errorf("record %d: data: %w", i, err)
+		}
+
+		off += rdLen
+	}
+
+	return nil
+}
+
+// checkRdataNames checks the domain names of the data of the record of type
+// rrType located in msg between off and end.  Only the names of the types,
+// which may be compressed or are decompressed by [dns.Msg.Unpack], are
+// checked.
+func checkRdataNames(msg []byte, off, end int, rrType uint16, maxPtrs uint) (err error) {
+	// nameOff is the offset of the first name in the data, numNames is the
+	// number of the consecutive names starting there.
+	nameOff, numNames := 0, 1
+	switch rrType {
+	case
+		dns.TypeNS,
+		dns.TypeMD,
+		dns.TypeMF,
+		dns.TypeCNAME,
+		dns.TypeMB,
+		dns.TypeMG,
+		dns.TypeMR,
+		dns.TypePTR,
+		dns.TypeDNAME,
+		dns.TypeNSEC:
+		// Go on.
+	case dns.TypeSOA, dns.TypeMINFO, dns.TypeRP:
+		numNames = 2
+	case dns.TypeMX, dns.TypeAFSDB, dns.TypeRT, dns.TypeKX, dns.TypeSVCB, dns.TypeHTTPS:
+		nameOff = 2
+	case dns.TypePX:
+		nameOff, numNames = 2, 2
+	case dns.TypeSRV:
+		nameOff = 6
+	case dns.TypeRRSIG:
+		nameOff = 18
+	default:
+		return nil
+	}
+
+	off += nameOff
+	for range numNames {
+		if off >= end {
+			return errNotChecked
+		}
+
+		off, err = checkName(msg, off, maxPtrs)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkName checks the domain name of msg starting at off and returns the
+// offset right after it.  Each pointer must point before the part of the name
+// it's located in, so that the name can't form a loop.
+func checkName(msg []byte, off int, maxPtrs uint) (next int, err error) {
+	next, segStart := -1, off
+	for ptrs := uint(0); ; {
+		if off >= len(msg) {
+			return 0, errNotChecked
+		}
+
+		c := int(msg[off])
+		switch c & 0xC0 {
+		case 0x00:
+			if c != 0 {
+				off += 1 + c
+
+				continue
+			}
+
+			if next < 0 {
+				next = off + 1
+			}
+
+			return next, nil
+		case 0xC0:
+			if off+1 >= len(msg) {
+				return 0, errNotChecked
+			}
+
+			if next < 0 {
+				next = off + 2
+			}
+
+			ptr := (c^0xC0)<<8 | int(msg[off+1])
+			if ptr >= segStart {
+				return 0, fmt.Errorf("%w: pointer at %d to %d isn't backward", errCompression, off, ptr)
+			}
+
+			ptrs++
+			if ptrs > maxPtrs {
+				return 0, fmt.Errorf("%w: more than %d pointers", errCompression, maxPtrs)
+			}
+
+			off, segStart = ptr, ptr
+		default:
+			// The reserved label types are reported by [dns.Msg.Unpack].
+			return 0, errNotChecked
+		}
+	}
+}
+
+// packetConn is a connection [dns.Conn] reads the messages from as datagrams.
+type packetConn interface {
+	net.Conn
+	net.PacketConn
+}
+
+// withCompressionCheck returns conn checking the compression pointers of the
+// DNS messages read from it with [checkCompression] when used with [dns.Conn].
+// It returns conn itself if maxPtrs is zero.
+func withCompressionCheck(conn net.Conn, maxPtrs uint) (c net.Conn) {
+	if maxPtrs == 0 {
+		return conn
+	}
+
+	if pc, ok := conn.(packetConn); ok {
+		return &checkedPacketConn{packetConn: pc, maxPtrs: maxPtrs}
+	}
+
+	return &checkedStreamConn{Conn: conn, maxPtrs: maxPtrs}
+}
+
+// checkedPacketConn is a datagram connection checking the compression pointers
+// of each message read.
+type checkedPacketConn struct {
+	packetConn
+
+	// maxPtrs is the maximum number of the pointers in a domain name.
+	maxPtrs uint
+}
+
+// type check
+var _ packetConn = (*checkedPacketConn)(nil)
+
+// Read implements the [net.Conn] interface for *checkedPacketConn.
+func (c *checkedPacketConn) Read(b []byte) (n int, err error) {
+	n, err = c.packetConn.Read(b)
+	if err != nil {
+		return n, err
+	}
+
+	return n, checkCompression(b[:n], c.maxPtrs)
+}
+
+// checkedStreamConn is a stream connection checking the compression pointers
+// of each length-prefixed message read.  It reads the messages entirely, so it
+// must only be used with [dns.Conn].
+type checkedStreamConn struct {
+	net.Conn
+
+	// pending is the rest of the checked message not yet read.
+	pending []byte
+
+	// maxPtrs is the maximum number of the pointers in a domain name.
+	maxPtrs uint
+}
+
+// type check
+var _ net.Conn = (*checkedStreamConn)(nil)
+
+// Read implements the [net.Conn] interface for *checkedStreamConn.
+func (c *checkedStreamConn) Read(b []byte) (n int, err error) {
+	if len(c.pending) == 0 {
+		c.pending, err = c.readMsg()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n = copy(b, c.pending)
+	c.pending = c.pending[n:]
+
+	return n, nil
+}
+
+// readMsg reads and checks the next message with its length prefix.
+func (c *checkedStreamConn) readMsg() (msg []byte, err error) {
+	var l [2]byte
+	_, err = io.ReadFull(c.Conn, l[:])
+	if err != nil {
+		return nil, err
+	}
+
+	msg = make([]byte, 2+int(binary.BigEndian.Uint16(l[:])))
+	copy(msg, l[:])
+
+	_, err = io.ReadFull(c.Conn, msg[2:])
+	if err != nil {
+		return nil, err
+	}
+
+	return msg, checkCompression(msg[2:], c.maxPtrs)
+}
@@ -0,0 +1,165 @@
+package upstream
+
+import (
+	"encoding/binary"
+	"fmt"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newCompressionTestMsg returns a message in the wire format with a question
+// for "a." and the records of type rrType with the owner names and the data
+// from names and rdatas respectively, which may contain compression pointers.
+func newCompressionTestMsg(rrType uint16, names, rdatas [][]byte) (msg []byte) {
+	msg = make([]byte, dnsHeaderLen)
+	binary.BigEndian.PutUint16(msg[4:], 1)
+	binary.BigEndian.PutUint16(msg[6:], uint16(len(names)))
+
+	msg = append(msg, 1, 'a', 0)
+	msg = binary.BigEndian.AppendUint16(msg, dns.TypeA)
+	msg = binary.BigEndian.AppendUint16(msg, dns.ClassINET)
+
+	for i, name := range names {
+		msg = append(msg, name...)
+		msg = binary.BigEndian.AppendUint16(msg, rrType)
+		msg = binary.BigEndian.AppendUint16(msg, dns.ClassINET)
+		msg = binary.BigEndian.AppendUint32(msg, 60)
+		msg = binary.BigEndian.AppendUint16(msg, uint16(len(rdatas[i])))
+		msg = append(msg, rdatas[i]...)
+	}
+
+	return msg
+}
+
+func TestCheckCompression(t *testing.T) {
+	compressed := respondToTestMessage(createTestMessage())
+	compressed.Answer = append(compressed.Answer, &dns.CNAME{
+		Hdr: dns.RR_Header{
+			Name:   compressed.Question[0].Name,
+			Rrtype: dns.TypeCNAME,
+			Class:  dns.ClassINET,
+			Ttl:    60,
+		},
+		Target: "www." + compressed.Question[0].Name,
+	})
+	compressed.Compress = true
+
+	compressedMsg, err := compressed.Pack()
+	require.NoError(t, err)
+
+	// The question name "a." is at offset 12, and each record of the
+	// following message is 14 bytes long, so the record at offset 19+14*i has
+	// the owner name formed by i+1 pointers.
+	chainMsg := newCompressionTestMsg(dns.TypeA, [][]byte{
+		{1, 'b', 0xC0, 12},
+		{1, 'c', 0xC0, 19},
+		{1, 'd', 0xC0, 33},
+	}, [][]byte{{}, {}, {}})
+
+	testCases := []struct {
+		name       string
+		wantErrMsg string
+		msg        []byte
+		maxPtrs    uint
+	}{{
+		name:       "valid",
+		wantErrMsg: "",
+		msg:        compressedMsg,
+		maxPtrs:    1,
+	}, {
+		name:       "disabled",
+		wantErrMsg: "",
+		msg:        newCompressionTestMsg(dns.TypeA, [][]byte{{0xC0, 19}}, [][]byte{{}}),
+		maxPtrs:    0,
+	}, {
+		name:       "chain",
+		wantErrMsg: "",
+		msg:        chainMsg,
+		maxPtrs:    3,
+	}, {
+		name:       "chain_too_long",
+		wantErrMsg: "record 2: bad compression pointers: more than 2 pointers",
+		msg:        chainMsg,
+		maxPtrs:    2,
+	}, {
+		name: "self",
+		wantErrMsg: "record 0: bad compression pointers: " +
+			"pointer at 19 to 19 isn't backward",
+		msg:     newCompressionTestMsg(dns.TypeA, [][]byte{{0xC0, 19}}, [][]byte{{}}),
+		maxPtrs: 16,
+	}, {
+		name: "forward",
+		wantErrMsg: "record 0: bad compression pointers: " +
+			"pointer at 21 to 40 isn't backward",
+		msg:     newCompressionTestMsg(dns.TypeA, [][]byte{{1, 'b', 0xC0, 40}}, [][]byte{{}}),
+		maxPtrs: 16,
+	}, {
+		name: "loop",
+		wantErrMsg: "record 0: bad compression pointers: " +
+			"pointer at 21 to 35 isn't backward",
+		// The first name points to the second one, which points back to the
+		// first one.
+		msg: newCompressionTestMsg(dns.TypeA, [][]byte{
+			{1, 'b', 0xC0, 35},
+			{1, 'c', 0xC0, 19},
+		}, [][]byte{{}, {}}),
+		maxPtrs: 16,
+	}, {
+		name: "rdata",
+		wantErrMsg: "record 0: data: bad compression pointers: " +
+			"pointer at 31 to 31 isn't backward",
+		msg: newCompressionTestMsg(
+			dns.TypeCNAME,
+			[][]byte{{0xC0, 12}},
+			[][]byte{{0xC0, 31}},
+		),
+		maxPtrs: 16,
+	}, {
+		name:       "short",
+		wantErrMsg: "",
+		msg:        chainMsg[:len(chainMsg)-3],
+		maxPtrs:    3,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, checkCompression(tc.msg, tc.maxPtrs))
+		})
+	}
+}
+
+func TestUpstream_plainDNS_compressionCheck(t *testing.T) {
+	srv := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		// Respond with the question name pointing to itself.
+		msg := newCompressionTestMsg(dns.TypeA, nil, nil)
+		binary.BigEndian.PutUint16(msg, req.Id)
+		msg[2] = 0x80
+		msg = append(msg[:dnsHeaderLen], 0xC0, dnsHeaderLen, 0, 1, 0, 1)
+
+		_, err := w.Write(msg)
+		require.NoError(testutil.PanicT{}, err)
+	})
+	testutil.CleanupAndRequireSuccess(t, srv.Close)
+
+	for _, network := range []network{networkUDP, networkTCP} {
+		t.Run(network, func(t *testing.T) {
+			addr := fmt.Sprintf("%s://127.0.0.1:%d", network, srv.port)
+			u, err := AddressToUpstream(addr, &Options{
+				Timeout:                timeout,
+				MaxCompressionPointers: 16,
+			})
+			require.NoError(t, err)
+			testutil.CleanupAndRequireSuccess(t, u.Close)
+
+			_, err = u.Exchange(createTestMessage())
+			require.Error(t, err)
+
+			assert.ErrorIs(t, err, errCompression)
+			assertClasses(t, err, ErrMalformedResponse)
+		})
+	}
+}
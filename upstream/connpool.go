@@ -0,0 +1,242 @@
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/syncutil"
+)
+
+// ConnPoolConfig is the configuration of the pool of the connections to a
+// plain DNS-over-TCP or a DNS-over-TLS upstream.
+type ConnPoolConfig struct {
+	// MaxIdleConns is the maximum number of the idle connections kept for
+	// reuse.  The connections exceeding it are closed once the exchange is
+	// finished.  Zero means no limit.
+	MaxIdleConns uint
+
+	// MaxConnAge is the maximum duration since a connection is dialed, after
+	// which it isn't reused anymore.  Zero means no limit.
+	MaxConnAge time.Duration
+
+	// IdleTimeout is the maximum duration a connection is kept idle, after
+	// which it isn't reused anymore.  It should be less than the idle timeout
+	// of the server.  Zero means no limit.
+	IdleTimeout time.Duration
+
+	// MaxConcurrentDials is the maximum number of the connections dialed
+	// simultaneously.  The exchanges requiring more connections wait for the
+	// dials in progress to finish.  Zero means no limit.
+	MaxConcurrentDials uint
+
+	// Prewarm is the number of the connections dialed right after the upstream
+	// is created, so that the first exchanges don't wait for dialing.
+	Prewarm uint
+}
+
+// pooledConn is a connection stored in [connPool].
+type pooledConn struct {
+	net.Conn
+
+	// dialed is the time when the connection has been dialed.
+	dialed time.Time
+
+	// idleSince is the time when the connection has been put back into the
+	// pool.
+	idleSince time.Time
+}
+
+// connPool stores the connections to an upstream ready for reuse.  Don't use
+// [sync.Pool] here, since there is no need to deallocate these connections.
+type connPool struct {
+	// logger is used to log the pool events.  It's never nil.
+	logger *slog.Logger
+
+	// mu protects idle and closed.
+	mu *sync.Mutex
+
+	// dials limits the number of the connections dialed simultaneously.
+	dials syncutil.Semaphore
+
+	// idle are the connections ready for reuse, the most recently used last.
+	// The ones idle for longer than [ConnPoolConfig.IdleTimeout] are closed
+	// instead of being reused.
+	idle []*pooledConn
+
+	// conf is the configuration of the pool.
+	conf ConnPoolConfig
+
+	// closed is true if the pool has been closed.
+	closed bool
+}
+
+// newConnPool returns a new properly initialized *connPool.  c may be nil, in
+// which case the pool isn't limited.  l must not be nil.
+func newConnPool(c *ConnPoolConfig, l *slog.Logger) (p *connPool) {
+	p = &connPool{
+		logger: l,
+		mu:     &sync.Mutex{},
+		dials:  syncutil.EmptySemaphore{},
+	}
+
+	if c != nil {
+		p.conf = *c
+	}
+
+	if p.conf.MaxConcurrentDials > 0 {
+		p.dials = syncutil.NewChanSemaphore(p.conf.MaxConcurrentDials)
+	}
+
+	return p
+}
+
+// get returns the most recently used idle connection, if there is any, or dials
+// a new one otherwise.  reused is true if the connection has been taken from
+// the pool.  ctx is used to wait for the dialing.
+func (p *connPool) get(
+	ctx context.Context,
+	dial func() (conn net.Conn, err error),
+) (conn *pooledConn, reused bool, err error) {
+	conn, stale := p.takeIdle(time.Now())
+	for _, c := range stale {
+		p.closeConn(c)
+	}
+
+	if conn != nil {
+		return conn, true, nil
+	}
+
+	conn, err = p.dial(ctx, dial)
+
+	return conn, false, err
+}
+
+// takeIdle returns the most recently used idle connection which isn't stale by
+// now, if any, and the stale connections taken from the pool along the way.
+func (p *connPool) takeIdle(now time.Time) (conn *pooledConn, stale []*pooledConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for l := len(p.idle); l > 0; l = len(p.idle) {
+		p.idle, conn = p.idle[:l-1], p.idle[l-1]
+		if !p.isStale(conn, now) {
+			return conn, stale
+		}
+
+		stale = append(stale, conn)
+	}
+
+	return nil, stale
+}
+
+// isStale returns true if c shouldn't be reused by now.
+func (p *connPool) isStale(c *pooledConn, now time.Time) (ok bool) {
+	if p.conf.MaxConnAge > 0 && now.Sub(c.dialed) >= p.conf.MaxConnAge {
+		return true
+	}
+
+	return p.conf.IdleTimeout > 0 && now.Sub(c.idleSince) >= p.conf.IdleTimeout
+}
+
+// dial dials a new connection, waiting for the dials in progress if there are
+// too many of them.
+func (p *connPool) dial(
+	ctx context.Context,
+	dial func() (conn net.Conn, err error),
+) (conn *pooledConn, err error) {
+	err = p.dials.Acquire(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("waiting for dial: %w", err)
+	}
+	defer p.dials.Release()
+
+	c, err := dial()
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	return &pooledConn{
+		Conn:   c,
+		dialed: time.Now(),
+	}, nil
+}
+
+// put returns conn into the pool for reuse or closes it if the pool is full or
+// closed, or conn is too old.
+func (p *connPool) put(conn *pooledConn) {
+	now := time.Now()
+	conn.idleSince = now
+
+	if !p.tryPut(conn, now) {
+		p.closeConn(conn)
+	}
+}
+
+// closeConn closes conn, which isn't reused anymore, logging the unexpected
+// errors.
+func (p *connPool) closeConn(conn *pooledConn) {
+	err := conn.Close()
+	if err != nil && isCriticalTCP(err) {
+		p.logger.Debug("closing conn", "addr", conn.RemoteAddr(), slogutil.KeyError, err)
+	}
+}
+
+// tryPut adds conn to the idle connections, if it should be kept.
+func (p *connPool) tryPut(conn *pooledConn, now time.Time) (ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed || p.isStale(conn, now) {
+		return false
+	}
+
+	if p.conf.MaxIdleConns > 0 && uint(len(p.idle)) >= p.conf.MaxIdleConns {
+		return false
+	}
+
+	p.idle = append(p.idle, conn)
+
+	return true
+}
+
+// prewarm dials [ConnPoolConfig.Prewarm] connections and puts them into the
+// pool.
+func (p *connPool) prewarm(dial func() (conn net.Conn, err error)) {
+	for range p.conf.Prewarm {
+		conn, err := p.dial(context.Background(), dial)
+		if err != nil {
+			p.logger.Debug("prewarming conn", slogutil.KeyError, err)
+
+			return
+		}
+
+		p.put(conn)
+	}
+}
+
+// close closes all the idle connections and makes the pool close the
+// connections put back afterwards.
+func (p *connPool) close() (err error) {
+	p.mu.Lock()
+	p.closed = true
+	idle := p.idle
+	p.idle = nil
+	p.mu.Unlock()
+
+	var errs []error
+	for _, conn := range idle {
+		closeErr := conn.Close()
+		if closeErr != nil && isCriticalTCP(closeErr) {
+			errs = append(errs, closeErr)
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,174 @@
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newPipeDialer returns a dial function returning the client ends of the new
+// pipes, which are closed on cleanup.
+func newPipeDialer(t *testing.T) (dial func() (conn net.Conn, err error)) {
+	t.Helper()
+
+	return func() (conn net.Conn, err error) {
+		client, server := net.Pipe()
+		t.Cleanup(func() { _ = server.Close() })
+
+		return client, nil
+	}
+}
+
+func TestConnPool(t *testing.T) {
+	ctx := context.Background()
+	l := slogutil.NewDiscardLogger()
+	dial := newPipeDialer(t)
+
+	t.Run("reuse", func(t *testing.T) {
+		p := newConnPool(&ConnPoolConfig{MaxIdleConns: 1}, l)
+
+		first, reused, err := p.get(ctx, dial)
+		require.NoError(t, err)
+		assert.False(t, reused)
+
+		second, _, err := p.get(ctx, dial)
+		require.NoError(t, err)
+
+		p.put(first)
+		p.put(second)
+		require.Len(t, p.idle, 1)
+
+		conn, reused, err := p.get(ctx, dial)
+		require.NoError(t, err)
+		assert.True(t, reused)
+		assert.Same(t, first, conn)
+
+		// The second connection has been closed due to the limit.
+		_, err = second.Write([]byte{0})
+		assert.ErrorIs(t, err, io.ErrClosedPipe)
+	})
+
+	t.Run("stale", func(t *testing.T) {
+		p := newConnPool(&ConnPoolConfig{
+			MaxConnAge:  time.Hour,
+			IdleTimeout: time.Minute,
+		}, l)
+
+		old, _, err := p.get(ctx, dial)
+		require.NoError(t, err)
+
+		idle, _, err := p.get(ctx, dial)
+		require.NoError(t, err)
+
+		p.put(old)
+		p.put(idle)
+		require.Len(t, p.idle, 2)
+
+		old.dialed = old.dialed.Add(-time.Hour)
+		idle.idleSince = idle.idleSince.Add(-time.Minute)
+
+		conn, reused, err := p.get(ctx, dial)
+		require.NoError(t, err)
+		assert.False(t, reused)
+		assert.NotSame(t, old, conn)
+		assert.NotSame(t, idle, conn)
+		assert.Empty(t, p.idle)
+	})
+
+	t.Run("max_dials", func(t *testing.T) {
+		p := newConnPool(&ConnPoolConfig{MaxConcurrentDials: 1}, l)
+
+		unblock := make(chan struct{})
+		dialing := make(chan struct{}, 1)
+		go func() {
+			_, _, _ = p.get(ctx, func() (conn net.Conn, err error) {
+				dialing <- struct{}{}
+				<-unblock
+
+				return dial()
+			})
+		}()
+
+		testutil.RequireReceive(t, dialing, timeout)
+
+		shortCtx, cancel := context.WithTimeout(ctx, timeout/10)
+		defer cancel()
+
+		_, _, err := p.get(shortCtx, dial)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+		close(unblock)
+	})
+
+	t.Run("close", func(t *testing.T) {
+		p := newConnPool(nil, l)
+
+		conn, _, err := p.get(ctx, dial)
+		require.NoError(t, err)
+
+		p.put(conn)
+		require.NoError(t, p.close())
+		assert.Empty(t, p.idle)
+
+		_, err = conn.Write([]byte{0})
+		assert.ErrorIs(t, err, io.ErrClosedPipe)
+
+		// The connections put back after closing are closed as well.
+		conn, _, err = p.get(ctx, dial)
+		require.NoError(t, err)
+
+		p.put(conn)
+		assert.Empty(t, p.idle)
+	})
+}
+
+func TestUpstream_plainDNS_connPool(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		clients = map[string]struct{}{}
+	)
+
+	srv := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		mu.Lock()
+		clients[w.RemoteAddr().String()] = struct{}{}
+		mu.Unlock()
+
+		require.NoError(testutil.PanicT{}, w.WriteMsg(respondToTestMessage(req)))
+	})
+	testutil.CleanupAndRequireSuccess(t, srv.Close)
+
+	addr := fmt.Sprintf("tcp://127.0.0.1:%d", srv.port)
+	u, err := AddressToUpstream(addr, &Options{
+		Timeout:  timeout,
+		ConnPool: &ConnPoolConfig{MaxIdleConns: 2, Prewarm: 2},
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	p := testutil.RequireTypeAssert[*plainDNS](t, u)
+	require.Eventually(t, func() (ok bool) {
+		p.tcpConns.mu.Lock()
+		defer p.tcpConns.mu.Unlock()
+
+		return len(p.tcpConns.idle) == 2
+	}, timeout, timeout/100)
+
+	for range 3 {
+		checkUpstream(t, u, addr)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	assert.Len(t, clients, 1)
+}
@@ -0,0 +1,70 @@
+package upstream
+
+import (
+	"context"
+	"io"
+
+	"github.com/miekg/dns"
+)
+
+// ExchangeContext sends req to u and returns the response like
+// [Upstream.Exchange], but returns the error of ctx as soon as it's canceled,
+// so that the callers could enforce the deadlines of the particular queries.
+// If u implements [ContextExchanger], the exchange in progress is aborted,
+// otherwise it's left to finish in the background with a copy of req and its
+// result is discarded.  The deadline of ctx doesn't extend [Options.Timeout].
+func ExchangeContext(ctx context.Context, u Upstream, req *dns.Msg) (resp *dns.Msg, err error) {
+	if ce, ok := u.(ContextExchanger); ok {
+		return ce.ExchangeContext(ctx, req)
+	}
+
+	return awaitExchange(ctx, u.Exchange, req)
+}
+
+// awaitExchange returns the result of exchange called with req, or the error
+// of ctx as soon as it's canceled.  In the latter case, exchange is left to
+// finish in the background with a copy of req and its result is discarded.
+// It's used by the upstreams unable to abort the exchange in progress.
+func awaitExchange(
+	ctx context.Context,
+	exchange func(req *dns.Msg) (resp *dns.Msg, err error),
+	req *dns.Msg,
+) (resp *dns.Msg, err error) {
+	if ctx.Done() == nil {
+		// The context is never canceled.
+		return exchange(req)
+	}
+
+	err = ctx.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	type result struct {
+		resp *dns.Msg
+		err  error
+	}
+
+	// Copy the request, since the caller may reuse it once this function
+	// returns.
+	req = req.Copy()
+	resCh := make(chan result, 1)
+	go func() {
+		r, exchErr := exchange(req)
+		resCh <- result{resp: r, err: exchErr}
+	}()
+
+	select {
+	case res := <-resCh:
+		return res.resp, res.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// abortOnDone closes c once ctx is canceled, so that the I/O in progress on it
+// fails.  stop must be called once the I/O is over, and returns false if c has
+// been closed.
+func abortOnDone(ctx context.Context, c io.Closer) (stop func() (stopped bool)) {
+	return context.AfterFunc(ctx, func() { _ = c.Close() })
+}
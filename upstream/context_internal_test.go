@@ -0,0 +1,77 @@
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExchangeContext(t *testing.T) {
+	// unblock makes the server handlers return without responding.
+	unblock := make(chan struct{})
+	srv := startDNSServer(t, func(_ dns.ResponseWriter, _ *dns.Msg) {
+		<-unblock
+	})
+	testutil.CleanupAndRequireSuccess(t, srv.Close)
+	t.Cleanup(func() { close(unblock) })
+
+	const abortAfter = 100 * time.Millisecond
+
+	testCases := []struct {
+		u    func(t *testing.T) (u Upstream)
+		name string
+	}{{
+		u: func(t *testing.T) (u Upstream) {
+			t.Helper()
+
+			u, err := AddressToUpstream(fmt.Sprintf("127.0.0.1:%d", srv.port), &Options{
+				Timeout: timeout,
+			})
+			require.NoError(t, err)
+
+			return u
+		},
+		name: "plain_udp",
+	}, {
+		u: func(t *testing.T) (u Upstream) {
+			t.Helper()
+
+			u, err := AddressToUpstream(fmt.Sprintf("tcp://127.0.0.1:%d", srv.port), &Options{
+				Timeout: timeout,
+			})
+			require.NoError(t, err)
+
+			return u
+		},
+		name: "plain_tcp",
+	}, {
+		u: func(_ *testing.T) (u Upstream) {
+			return &testUpstream{sleep: timeout}
+		},
+		name: "no_context_support",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			u := tc.u(t)
+			testutil.CleanupAndRequireSuccess(t, u.Close)
+
+			ctx, cancel := context.WithTimeout(context.Background(), abortAfter)
+			t.Cleanup(cancel)
+
+			start := time.Now()
+			resp, err := ExchangeContext(ctx, u, createTestMessage())
+			elapsed := time.Since(start)
+
+			assert.ErrorIs(t, err, context.DeadlineExceeded)
+			assert.Nil(t, resp)
+			assert.Less(t, elapsed, timeout)
+		})
+	}
+}
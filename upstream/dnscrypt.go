@@ -1,15 +1,17 @@
 package upstream
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"log/slog"
+	"net/netip"
 	"net/url"
 	"os"
 	"sync"
 	"time"
 
 	"github.com/AdguardTeam/golibs/errors"
-	"github.com/AdguardTeam/golibs/log"
 	"github.com/ameshkov/dnscrypt/v2"
 	"github.com/miekg/dns"
 )
@@ -31,6 +33,14 @@ type dnsCrypt struct {
 	// verifyCert is a callback that verifies the resolver's certificate.
 	verifyCert func(cert *dnscrypt.Cert) (err error)
 
+	// relays are the addresses of the Anonymized DNSCrypt relays the queries
+	// are sent through.  If empty, the queries are sent to the server
+	// directly.
+	relays []netip.AddrPort
+
+	// logger is used for exchange logging.  It is never nil.
+	logger *slog.Logger
+
 	// timeout is the timeout for the DNS requests.
 	timeout time.Duration
 }
@@ -41,6 +51,8 @@ func newDNSCrypt(addr *url.URL, opts *Options) (u *dnsCrypt) {
 		mu:         &sync.RWMutex{},
 		addr:       addr,
 		verifyCert: opts.VerifyDNSCryptCertificate,
+		relays:     opts.DNSCryptRelays,
+		logger:     opts.Logger,
 		timeout:    opts.Timeout,
 	}
 }
@@ -53,6 +65,12 @@ func (p *dnsCrypt) Address() string { return p.addr.String() }
 
 // Exchange implements the [Upstream] interface for *dnsCrypt.
 func (p *dnsCrypt) Exchange(m *dns.Msg) (resp *dns.Msg, err error) {
+	return p.ExchangeContext(context.Background(), m)
+}
+
+// exchange sends m to the server, re-fetching the certificate of the server
+// once in case it has been rotated.
+func (p *dnsCrypt) exchange(m *dns.Msg) (resp *dns.Msg, err error) {
 	resp, err = p.exchangeDNSCrypt(m)
 	if errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, io.EOF) {
 		// If request times out, it is possible that the server configuration
@@ -70,6 +88,18 @@ func (p *dnsCrypt) Exchange(m *dns.Msg) (resp *dns.Msg, err error) {
 	return resp, err
 }
 
+// type check
+var _ ContextExchanger = (*dnsCrypt)(nil)
+
+// ExchangeContext implements the [ContextExchanger] interface for *dnsCrypt.
+// The exchange in progress isn't aborted, but its result is discarded once ctx
+// is canceled.
+func (p *dnsCrypt) ExchangeContext(ctx context.Context, m *dns.Msg) (resp *dns.Msg, err error) {
+	resp, err = awaitExchange(ctx, p.exchange, m)
+
+	return resp, classify(err)
+}
+
 // Close implements the [Upstream] interface for *dnsCrypt.
 func (p *dnsCrypt) Close() (err error) {
 	return nil
@@ -104,13 +134,13 @@ func (p *dnsCrypt) exchangeDNSCrypt(m *dns.Msg) (resp *dns.Msg, err error) {
 		// Go on.
 	}
 
-	resp, err = client.Exchange(m, resolverInfo)
+	resp, err = p.exchangeWith(client, m, resolverInfo)
 	if resp != nil && resp.Truncated {
 		q := &m.Question[0]
-		log.Debug("dnscrypt %s: received truncated, falling back to tcp with %s", p.addr, q)
+		p.logger.Debug("truncated response, falling back to tcp", "addr", p.addr, "question", q)
 
-		tcpClient := &dnscrypt.Client{Timeout: p.timeout, Net: networkTCP}
-		resp, err = tcpClient.Exchange(m, resolverInfo)
+		tcpClient := &dnscrypt.Client{Timeout: p.timeout, Net: networkTCP, UDPSize: client.UDPSize}
+		resp, err = p.exchangeWith(tcpClient, m, resolverInfo)
 	}
 	if err == nil && resp != nil && resp.Id != m.Id {
 		err = dns.ErrId
@@ -119,6 +149,20 @@ func (p *dnsCrypt) exchangeDNSCrypt(m *dns.Msg) (resp *dns.Msg, err error) {
 	return resp, err
 }
 
+// exchangeWith sends m to the server of ri using client, through a relay if
+// any are configured.
+func (p *dnsCrypt) exchangeWith(
+	client *dnscrypt.Client,
+	m *dns.Msg,
+	ri *dnscrypt.ResolverInfo,
+) (resp *dns.Msg, err error) {
+	if len(p.relays) > 0 {
+		return p.exchangeRelayed(client, m, ri)
+	}
+
+	return client.Exchange(m, ri)
+}
+
 // resetClient renews the DNSCrypt client and server properties and also sets
 // those to nil on fail.
 func (p *dnsCrypt) resetClient() (client *dnscrypt.Client, ri *dnscrypt.ResolverInfo, err error) {
@@ -133,7 +177,15 @@ func (p *dnsCrypt) resetClient() (client *dnscrypt.Client, ri *dnscrypt.Resolver
 
 	// Use UDP for DNSCrypt upstreams by default.
 	client = &dnscrypt.Client{Timeout: p.timeout, Net: networkUDP}
-	ri, err = client.Dial(addr)
+	if len(p.relays) > 0 {
+		// The client reads the responses through the relays as if those
+		// were UDP ones, so make sure the buffer fits the TCP ones as well.
+		client.UDPSize = dns.MaxMsgSize
+		ri, err = p.dialRelayed(addr)
+	} else {
+		ri, err = client.Dial(addr)
+	}
+
 	if err != nil {
 		// Trigger client and server info renewal on the next request.
 		client, ri = nil, nil
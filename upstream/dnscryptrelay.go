@@ -0,0 +1,284 @@
+package upstream
+
+import (
+	"bytes"
+	cryptorand "crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/ameshkov/dnscrypt/v2"
+	"github.com/ameshkov/dnscrypt/v2/xsecretbox"
+	"github.com/ameshkov/dnsstamps"
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// relayMagic is the prefix of the packets sent through the Anonymized DNSCrypt
+// relays, see https://github.com/DNSCrypt/dnscrypt-protocol/blob/master/ANONYMIZED-DNSCRYPT.txt.
+var relayMagic = []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x00, 0x00}
+
+// relayHeader returns the header of the packets sent through a relay to
+// server.
+func relayHeader(server netip.AddrPort) (hdr []byte) {
+	ip := server.Addr().As16()
+
+	hdr = make([]byte, 0, len(relayMagic)+len(ip)+2)
+	hdr = append(hdr, relayMagic...)
+	hdr = append(hdr, ip[:]...)
+
+	return binary.BigEndian.AppendUint16(hdr, server.Port())
+}
+
+// relayConn is a [net.Conn] sending the packets to a DNSCrypt server through an
+// Anonymized DNSCrypt relay.  Each Write must contain a single whole packet.
+// Note that the DNSCrypt client considers it a UDP connection, so the TCP
+// framing is done here.
+type relayConn struct {
+	net.Conn
+
+	// header is the header prepended to each packet.
+	header []byte
+
+	// tcp is true if the connection to the relay is a TCP one.
+	tcp bool
+}
+
+// Write implements the [net.Conn] interface for *relayConn.
+func (c *relayConn) Write(b []byte) (n int, err error) {
+	bufs := net.Buffers{c.header, b}
+	if c.tcp {
+		l := binary.BigEndian.AppendUint16(nil, uint16(len(c.header)+len(b)))
+		bufs = append(net.Buffers{l}, bufs...)
+	}
+
+	_, err = bufs.WriteTo(c.Conn)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+// Read implements the [net.Conn] interface for *relayConn.
+func (c *relayConn) Read(b []byte) (n int, err error) {
+	if !c.tcp {
+		return c.Conn.Read(b)
+	}
+
+	var l [2]byte
+	_, err = io.ReadFull(c.Conn, l[:])
+	if err != nil {
+		return 0, err
+	}
+
+	n = int(binary.BigEndian.Uint16(l[:]))
+	if n > len(b) {
+		return 0, io.ErrShortBuffer
+	}
+
+	return io.ReadFull(c.Conn, b[:n])
+}
+
+// dialRelay connects to a random relay of p over network to reach server.
+func (p *dnsCrypt) dialRelay(network, server string) (conn *relayConn, err error) {
+	serverAddr, err := netip.ParseAddrPort(server)
+	if err != nil {
+		return nil, fmt.Errorf("parsing server address: %w", err)
+	}
+
+	relay := p.relays[rand.IntN(len(p.relays))]
+
+	d := &net.Dialer{Timeout: p.timeout}
+	c, err := d.Dial(network, relay.String())
+	if err != nil {
+		return nil, fmt.Errorf("dialing relay %s: %w", relay, err)
+	}
+
+	p.logger.Debug("using relay", "addr", p.addr, "relay", relay, "network", network)
+
+	return &relayConn{
+		Conn:   c,
+		header: relayHeader(serverAddr),
+		tcp:    network == networkTCP,
+	}, nil
+}
+
+// exchangeRelayed sends m to the server of ri through a relay using client.
+func (p *dnsCrypt) exchangeRelayed(
+	client *dnscrypt.Client,
+	m *dns.Msg,
+	ri *dnscrypt.ResolverInfo,
+) (resp *dns.Msg, err error) {
+	conn, err := p.dialRelay(client.Net, ri.ServerAddress)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { err = errors.WithDeferred(err, conn.Close()) }()
+
+	return client.ExchangeConn(conn, m, ri)
+}
+
+// dialRelayed fetches the certificate of the server from the stamp addr
+// through a relay and returns the resolver information to encrypt the queries
+// with, like [dnscrypt.Client.Dial] does.
+func (p *dnsCrypt) dialRelayed(addr string) (ri *dnscrypt.ResolverInfo, err error) {
+	stamp, err := dnsstamps.NewServerStampFromString(addr)
+	if err != nil {
+		return nil, fmt.Errorf("parsing stamp: %w", err)
+	}
+
+	cert, err := p.fetchCertRelayed(stamp)
+	if err != nil {
+		return nil, err
+	}
+
+	ri = &dnscrypt.ResolverInfo{
+		ServerPublicKey: stamp.ServerPk,
+		ServerAddress:   stamp.ServerAddrStr,
+		ProviderName:    stamp.ProviderName,
+		ResolverCert:    cert,
+	}
+
+	_, err = cryptorand.Read(ri.SecretKey[:])
+	if err != nil {
+		return nil, fmt.Errorf("generating key: %w", err)
+	}
+
+	curve25519.ScalarBaseMult(&ri.PublicKey, &ri.SecretKey)
+
+	switch cert.EsVersion {
+	case dnscrypt.XChacha20Poly1305:
+		ri.SharedKey, err = xsecretbox.SharedKey(ri.SecretKey, cert.ResolverPk)
+		if err != nil {
+			return nil, fmt.Errorf("computing shared key: %w", err)
+		}
+	case dnscrypt.XSalsa20Poly1305:
+		box.Precompute(&ri.SharedKey, &cert.ResolverPk, &ri.SecretKey)
+	default:
+		return nil, dnscrypt.ErrEsVersion
+	}
+
+	return ri, nil
+}
+
+// fetchCertRelayed requests the certificates of the server from stamp through
+// a relay and returns the most recent valid one.
+func (p *dnsCrypt) fetchCertRelayed(stamp dnsstamps.ServerStamp) (cert *dnscrypt.Cert, err error) {
+	req := (&dns.Msg{}).SetQuestion(dns.Fqdn(stamp.ProviderName), dns.TypeTXT)
+	packed, err := req.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("packing certificate request: %w", err)
+	}
+
+	conn, err := p.dialRelay(networkUDP, stamp.ServerAddrStr)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { err = errors.WithDeferred(err, conn.Close()) }()
+
+	_ = conn.SetDeadline(time.Now().Add(p.timeout))
+
+	_, err = conn.Write(packed)
+	if err != nil {
+		return nil, fmt.Errorf("writing certificate request: %w", err)
+	}
+
+	buf := make([]byte, dns.MaxMsgSize)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, fmt.Errorf("reading certificate response: %w", err)
+	}
+
+	resp := &dns.Msg{}
+	err = resp.Unpack(buf[:n])
+	if err != nil {
+		return nil, fmt.Errorf("unpacking certificate response: %w", err)
+	} else if resp.Id != req.Id {
+		return nil, dns.ErrId
+	} else if resp.Rcode != dns.RcodeSuccess {
+		return nil, dnscrypt.ErrFailedToFetchCert
+	}
+
+	return bestCert(stamp, resp.Answer)
+}
+
+// bestCert returns the valid certificate from the TXT records in rrs with the
+// highest serial and, among those, the highest crypto construction.
+func bestCert(stamp dnsstamps.ServerStamp, rrs []dns.RR) (cert *dnscrypt.Cert, err error) {
+	var errs []error
+	for _, rr := range rrs {
+		txt, ok := rr.(*dns.TXT)
+		if !ok {
+			continue
+		}
+
+		c := &dnscrypt.Cert{}
+		err = c.Deserialize(unescapeTXT(strings.Join(txt.Txt, "")))
+		switch {
+		case err != nil:
+			errs = append(errs, fmt.Errorf("deserializing cert: %w", err))
+		case !c.VerifyDate():
+			errs = append(errs, dnscrypt.ErrInvalidDate)
+		case !c.VerifySignature(stamp.ServerPk):
+			errs = append(errs, dnscrypt.ErrInvalidCertSignature)
+		case
+			cert == nil,
+			c.Serial > cert.Serial,
+			c.Serial == cert.Serial && c.EsVersion > cert.EsVersion:
+			cert = c
+		default:
+			// Superseded by the previous one.
+		}
+	}
+
+	if cert != nil {
+		return cert, nil
+	} else if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	return nil, fmt.Errorf("no valid txt records for provider %q", stamp.ProviderName)
+}
+
+// unescapeTXT returns the data of the TXT character string s in the
+// presentation format, as produced by the DNS library.
+func unescapeTXT(s string) (data []byte) {
+	buf := &bytes.Buffer{}
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			buf.WriteByte(s[i])
+
+			continue
+		}
+
+		i++
+		switch {
+		case i+2 < len(s) && isDigit(s[i]) && isDigit(s[i+1]) && isDigit(s[i+2]):
+			buf.WriteByte((s[i]-'0')*100 + (s[i+1]-'0')*10 + (s[i+2] - '0'))
+			i += 2
+		case s[i] == 't':
+			buf.WriteByte('\t')
+		case s[i] == 'r':
+			buf.WriteByte('\r')
+		case s[i] == 'n':
+			buf.WriteByte('\n')
+		default:
+			buf.WriteByte(s[i])
+		}
+	}
+
+	return buf.Bytes()
+}
+
+// isDigit returns true if b is an ASCII digit.
+func isDigit(b byte) (ok bool) {
+	return b >= '0' && b <= '9'
+}
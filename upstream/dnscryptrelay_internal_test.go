@@ -0,0 +1,166 @@
+package upstream
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/ameshkov/dnscrypt/v2"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// cutRelayHeader returns the destination and the payload of the packet sent
+// through a relay.
+func cutRelayHeader(t require.TestingT, b []byte) (dst netip.AddrPort, payload []byte) {
+	require.True(t, bytes.HasPrefix(b, relayMagic))
+
+	b = b[len(relayMagic):]
+	require.GreaterOrEqual(t, len(b), 18)
+
+	addr := netip.AddrFrom16([16]byte(b[:16])).Unmap()
+
+	return netip.AddrPortFrom(addr, binary.BigEndian.Uint16(b[16:18])), b[18:]
+}
+
+// startTestRelay starts a UDP and TCP Anonymized DNSCrypt relay and returns
+// its address.  udpNum and tcpNum count the packets relayed over UDP and TCP.
+func startTestRelay(t *testing.T, udpNum, tcpNum *atomic.Uint32) (addr netip.AddrPort) {
+	t.Helper()
+
+	pt := testutil.PanicT{}
+	localhost := netutil.IPv4Localhost().AsSlice()
+
+	tcpListen, err := net.ListenTCP("tcp", &net.TCPAddr{IP: localhost})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, tcpListen.Close)
+
+	addr = tcpListen.Addr().(*net.TCPAddr).AddrPort()
+	udpConn, err := net.ListenUDP("udp", net.UDPAddrFromAddrPort(addr))
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, udpConn.Close)
+
+	go func() {
+		buf := make([]byte, dns.MaxMsgSize)
+		for {
+			n, from, rErr := udpConn.ReadFromUDPAddrPort(buf)
+			if rErr != nil {
+				return
+			}
+
+			udpNum.Add(1)
+			dst, payload := cutRelayHeader(pt, buf[:n])
+
+			srv, dErr := net.Dial("udp", dst.String())
+			require.NoError(pt, dErr)
+
+			_, wErr := srv.Write(payload)
+			require.NoError(pt, wErr)
+
+			resp := make([]byte, dns.MaxMsgSize)
+			n, rErr = srv.Read(resp)
+			require.NoError(pt, rErr)
+			require.NoError(pt, srv.Close())
+
+			_, wErr = udpConn.WriteToUDPAddrPort(resp[:n], from)
+			require.NoError(pt, wErr)
+		}
+	}()
+
+	go func() {
+		for {
+			conn, aErr := tcpListen.Accept()
+			if aErr != nil {
+				return
+			}
+
+			tcpNum.Add(1)
+			relayTCP(pt, conn)
+		}
+	}()
+
+	return addr
+}
+
+// relayTCP relays a single query from conn.
+func relayTCP(t require.TestingT, conn net.Conn) {
+	defer func() { require.NoError(t, conn.Close()) }()
+
+	var l [2]byte
+	_, err := io.ReadFull(conn, l[:])
+	require.NoError(t, err)
+
+	pkt := make([]byte, binary.BigEndian.Uint16(l[:]))
+	_, err = io.ReadFull(conn, pkt)
+	require.NoError(t, err)
+
+	dst, payload := cutRelayHeader(t, pkt)
+	srv, err := net.Dial("tcp", dst.String())
+	require.NoError(t, err)
+	defer func() { require.NoError(t, srv.Close()) }()
+
+	_, err = srv.Write(binary.BigEndian.AppendUint16(nil, uint16(len(payload))))
+	require.NoError(t, err)
+
+	_, err = srv.Write(payload)
+	require.NoError(t, err)
+
+	_, err = io.Copy(conn, srv)
+	require.NoError(t, err)
+}
+
+func TestDNSCrypt_Exchange_relay(t *testing.T) {
+	rc, err := dnscrypt.GenerateResolverConfig("example.org", nil)
+	require.NoError(t, err)
+
+	h := dnsCryptHandlerFunc(func(w dnscrypt.ResponseWriter, r *dns.Msg) (err error) {
+		res := (&dns.Msg{}).SetReply(r)
+		answer := &dns.TXT{
+			Hdr: dns.RR_Header{
+				Name:   r.Question[0].Name,
+				Rrtype: dns.TypeTXT,
+				Ttl:    300,
+				Class:  dns.ClassINET,
+			},
+		}
+		res.Answer = append(res.Answer, answer)
+
+		// Make the response truncated over UDP.
+		for range 50 {
+			answer.Txt = append(answer.Txt, strings.Repeat("VERY LONG STRING", 7))
+		}
+
+		return w.WriteMsg(res)
+	})
+	srvStamp := startTestDNSCryptServer(t, rc, h)
+
+	var udpNum, tcpNum atomic.Uint32
+	relay := startTestRelay(t, &udpNum, &tcpNum)
+
+	u, err := AddressToUpstream(srvStamp.String(), &Options{
+		Timeout:        timeout,
+		DNSCryptRelays: []netip.AddrPort{relay},
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	req := (&dns.Msg{}).SetQuestion("example.org.", dns.TypeTXT)
+	res, err := u.Exchange(req)
+	require.NoError(t, err)
+
+	assert.False(t, res.Truncated)
+	require.Len(t, res.Answer, 1)
+
+	// The certificate request and the query over UDP, then the query over
+	// TCP.
+	assert.Equal(t, uint32(2), udpNum.Load())
+	assert.Equal(t, uint32(1), tcpNum.Load())
+}
@@ -1,11 +1,13 @@
 package upstream
 
 import (
+	"cmp"
 	"context"
 	"crypto/tls"
 	"encoding/base64"
 	"fmt"
 	"io"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/url"
@@ -15,7 +17,8 @@ import (
 
 	"github.com/AdguardTeam/dnsproxy/internal/bootstrap"
 	"github.com/AdguardTeam/golibs/errors"
-	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/syncutil"
 	"github.com/miekg/dns"
 	"github.com/quic-go/quic-go"
 	"github.com/quic-go/quic-go/http3"
@@ -42,6 +45,71 @@ const (
 	dohMaxIdleConns = 2
 )
 
+// HTTP2Config is the configuration of the HTTP/2 transport of a DNS-over-HTTPS
+// upstream.
+type HTTP2Config struct {
+	// MaxConns is the maximum number of the connections to the server.  Zero
+	// means the default of 2.  Note, that setting it to 1 may cause issues
+	// with Go's http implementation, see
+	// https://github.com/AdguardTeam/dnsproxy/issues/278.
+	MaxConns uint
+
+	// MaxConcurrentStreams is the maximum number of the queries sent
+	// simultaneously over each connection, so that at most MaxConcurrentStreams
+	// multiplied by MaxConns queries are in flight.  The queries exceeding it
+	// wait for the ones in flight until the timeout of the upstream.  Zero
+	// means no limit other than the one advertised by the server.
+	MaxConcurrentStreams uint
+
+	// IdleConnTimeout is the maximum duration a connection is kept idle before
+	// closing it.  Zero means the default of 5 minutes.
+	IdleConnTimeout time.Duration
+
+	// ReadIdleTimeout is the duration without any frames received on a
+	// connection, after which a ping is sent to check its liveness.  Zero
+	// means the default of 30 seconds.
+	ReadIdleTimeout time.Duration
+
+	// PingTimeout is the maximum duration of waiting for the response to a
+	// ping, after which the connection is closed and replaced.  Zero means the
+	// default of 15 seconds.
+	PingTimeout time.Duration
+}
+
+// maxConns returns the maximum number of the connections.  c may be nil.
+func (c *HTTP2Config) maxConns() (n int) {
+	if c == nil || c.MaxConns == 0 {
+		return dohMaxConnsPerHost
+	}
+
+	return int(c.MaxConns)
+}
+
+// newStreamsSemaphore returns the semaphore limiting the number of the queries
+// in flight.  c may be nil.
+func (c *HTTP2Config) newStreamsSemaphore() (sema syncutil.Semaphore) {
+	if c == nil || c.MaxConcurrentStreams == 0 {
+		return syncutil.EmptySemaphore{}
+	}
+
+	return syncutil.NewChanSemaphore(c.MaxConcurrentStreams * uint(c.maxConns()))
+}
+
+// setTimeouts sets the timeouts of t1 and t2 configured with c.  c may be nil.
+func (c *HTTP2Config) setTimeouts(t1 *http.Transport, t2 *http2.Transport) {
+	t1.IdleConnTimeout = transportDefaultIdleConnTimeout
+	t2.ReadIdleTimeout = transportDefaultReadIdleTimeout
+	if c == nil {
+		return
+	}
+
+	t1.IdleConnTimeout = cmp.Or(c.IdleConnTimeout, t1.IdleConnTimeout)
+	t2.ReadIdleTimeout = cmp.Or(c.ReadIdleTimeout, t2.ReadIdleTimeout)
+
+	// Zero means the default of the package.
+	t2.PingTimeout = c.PingTimeout
+}
+
 // dnsOverHTTPS is a struct that implements the Upstream interface for the
 // DNS-over-HTTPS protocol.
 type dnsOverHTTPS struct {
@@ -49,12 +117,19 @@ type dnsOverHTTPS struct {
 	// one.
 	getDialer DialerInitializer
 
+	// listenPacket creates the UDP sockets of the HTTP/3 connections, if not
+	// nil, see [Options.ListenPacket].
+	listenPacket listenPacketFunc
+
 	// addr is the DNS-over-HTTPS server URL.
 	addr *url.URL
 
 	// tlsConf is the configuration of TLS.
 	tlsConf *tls.Config
 
+	// logger is used for exchange logging.  It is never nil.
+	logger *slog.Logger
+
 	// The Client's Transport typically has internal state (cached TCP
 	// connections), so Clients should be reused instead of created as needed.
 	// Clients are safe for concurrent use by multiple goroutines.
@@ -74,8 +149,22 @@ type dnsOverHTTPS struct {
 	// separately to reduce allocations during logging and error reporting.
 	addrRedacted string
 
+	// http2Conf is the configuration of the HTTP/2 transport.  It may be nil.
+	http2Conf *HTTP2Config
+
+	// streams limits the number of the queries in flight.  It's never nil.
+	streams syncutil.Semaphore
+
+	// ech is the Encrypted Client Hello configuration of the HTTP/1.1 and
+	// HTTP/2 connections.  It's nil if ECH is disabled.
+	ech *echConfig
+
 	// timeout is used in HTTP client and for H3 probes.
 	timeout time.Duration
+
+	// maxPtrs is the maximum number of the compression pointers in a domain
+	// name of a response, see [Options.MaxCompressionPointers].
+	maxPtrs uint
 }
 
 // newDoH returns the DNS-over-HTTPS Upstream.
@@ -91,8 +180,9 @@ func newDoH(addr *url.URL, opts *Options) (u Upstream, err error) {
 	}
 
 	ups := &dnsOverHTTPS{
-		getDialer: newDialerInitializer(addr, opts),
-		addr:      addr,
+		getDialer:    newDialerInitializer(addr, opts),
+		listenPacket: opts.ListenPacket,
+		addr:         addr,
 		quicConf: &quic.Config{
 			KeepAlivePeriod: QUICKeepAlivePeriod,
 			TokenStore:      newQUICTokenStore(),
@@ -113,10 +203,16 @@ func newDoH(addr *url.URL, opts *Options) (u Upstream, err error) {
 			InsecureSkipVerify:    opts.InsecureSkipVerify,
 			VerifyPeerCertificate: opts.VerifyServerCertificate,
 			VerifyConnection:      opts.VerifyConnection,
+			KeyLogWriter:          opts.KeyLogWriter,
 		},
+		logger:       opts.Logger,
 		clientMu:     &sync.Mutex{},
 		addrRedacted: addr.Redacted(),
+		http2Conf:    opts.HTTP2,
+		streams:      opts.HTTP2.newStreamsSemaphore(),
+		ech:          newECHConfig(addr, opts),
 		timeout:      opts.Timeout,
+		maxPtrs:      opts.MaxCompressionPointers,
 	}
 	for _, v := range httpVersions {
 		ups.tlsConf.NextProtos = append(ups.tlsConf.NextProtos, string(v))
@@ -137,6 +233,20 @@ func (p *dnsOverHTTPS) Address() string { return p.addrRedacted }
 
 // Exchange implements the Upstream interface for *dnsOverHTTPS.
 func (p *dnsOverHTTPS) Exchange(m *dns.Msg) (resp *dns.Msg, err error) {
+	return p.ExchangeContext(context.Background(), m)
+}
+
+// type check
+var _ ContextExchanger = (*dnsOverHTTPS)(nil)
+
+// ExchangeContext implements the [ContextExchanger] interface for
+// *dnsOverHTTPS.
+func (p *dnsOverHTTPS) ExchangeContext(
+	ctx context.Context,
+	m *dns.Msg,
+) (resp *dns.Msg, err error) {
+	defer func() { err = classify(err) }()
+
 	// In order to maximize HTTP cache friendliness, DoH clients using media
 	// formats that include the ID field from the DNS message header, such
 	// as "application/dns-message", SHOULD use a DNS ID of 0 in every DNS
@@ -153,6 +263,12 @@ func (p *dnsOverHTTPS) Exchange(m *dns.Msg) (resp *dns.Msg, err error) {
 		}
 	}()
 
+	err = p.acquireStream(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("waiting for stream to %s: %w", p.addrRedacted, err)
+	}
+	defer p.streams.Release()
+
 	// Check if there was already an active client before sending the request.
 	// We'll only attempt to re-connect if there was one.
 	client, isCached, err := p.getClient()
@@ -161,23 +277,26 @@ func (p *dnsOverHTTPS) Exchange(m *dns.Msg) (resp *dns.Msg, err error) {
 	}
 
 	// Make the first attempt to send the DNS query.
-	resp, err = p.exchangeHTTPS(client, m)
+	resp, err = p.exchangeHTTPS(ctx, client, m)
 
 	// Make up to 2 attempts to re-create the HTTP client and send the request
 	// again.  There are several cases (mostly, with QUIC) where this workaround
 	// is necessary to make HTTP client usable.  We need to make 2 attempts in
 	// the case when the connection was closed (due to inactivity for example)
 	// AND the server refuses to open a 0-RTT connection.
-	for i := 0; isCached && p.shouldRetry(err) && i < 2; i++ {
+	for i := 0; isCached && ctx.Err() == nil && p.shouldRetry(err) && i < 2; i++ {
 		client, err = p.resetClient(err)
 		if err != nil {
 			return nil, fmt.Errorf("failed to reset http client: %w", err)
 		}
 
-		resp, err = p.exchangeHTTPS(client, m)
+		resp, err = p.exchangeHTTPS(ctx, client, m)
 	}
 
-	if err != nil {
+	if err != nil && ctx.Err() != nil {
+		// The client is fine, the request has been aborted.
+		return nil, err
+	} else if err != nil {
 		// If the request failed anyway, make sure we don't use this client.
 		_, resErr := p.resetClient(err)
 
@@ -187,6 +306,18 @@ func (p *dnsOverHTTPS) Exchange(m *dns.Msg) (resp *dns.Msg, err error) {
 	return resp, err
 }
 
+// acquireStream waits until the number of the queries in flight is within the
+// limit, see [HTTP2Config.MaxConcurrentStreams].  ctx bounds the waiting.
+func (p *dnsOverHTTPS) acquireStream(ctx context.Context) (err error) {
+	if p.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.timeout)
+		defer cancel()
+	}
+
+	return p.streams.Acquire(ctx)
+}
+
 // Close implements the Upstream interface for *dnsOverHTTPS.
 func (p *dnsOverHTTPS) Close() (err error) {
 	p.clientMu.Lock()
@@ -213,21 +344,29 @@ func (p *dnsOverHTTPS) closeClient(client *http.Client) (err error) {
 }
 
 // exchangeHTTPS logs the request and its result and calls exchangeHTTPSClient.
-func (p *dnsOverHTTPS) exchangeHTTPS(client *http.Client, req *dns.Msg) (resp *dns.Msg, err error) {
+func (p *dnsOverHTTPS) exchangeHTTPS(
+	ctx context.Context,
+	client *http.Client,
+	req *dns.Msg,
+) (resp *dns.Msg, err error) {
 	n := networkTCP
 	if isHTTP3(client) {
 		n = networkUDP
 	}
 
-	logBegin(p.addrRedacted, n, req)
-	defer func() { logFinish(p.addrRedacted, n, err) }()
+	logBegin(p.logger, p.addrRedacted, n, req)
+	defer func() { logFinish(p.logger, p.addrRedacted, n, err) }()
+
+	resp, err = p.exchangeHTTPSClient(ctx, client, req)
+	p.ech.handleError(err)
 
-	return p.exchangeHTTPSClient(client, req)
+	return resp, err
 }
 
 // exchangeHTTPSClient sends the DNS query to a DoH resolver using the specified
-// http.Client instance.
+// http.Client instance.  The request is aborted once ctx is canceled.
 func (p *dnsOverHTTPS) exchangeHTTPSClient(
+	ctx context.Context,
 	client *http.Client,
 	req *dns.Msg,
 ) (resp *dns.Msg, err error) {
@@ -256,7 +395,7 @@ func (p *dnsOverHTTPS) exchangeHTTPSClient(
 		RawQuery: q.Encode(),
 	}
 
-	httpReq, err := http.NewRequest(method, u.String(), nil)
+	httpReq, err := http.NewRequestWithContext(ctx, method, u.String(), nil)
 	if err != nil {
 		return nil, fmt.Errorf("creating http request to %s: %w", p.addrRedacted, err)
 	}
@@ -268,7 +407,7 @@ func (p *dnsOverHTTPS) exchangeHTTPSClient(
 	if err != nil {
 		return nil, fmt.Errorf("requesting %s: %w", p.addrRedacted, err)
 	}
-	defer log.OnCloserError(httpResp.Body, log.DEBUG)
+	defer slogutil.CloseAndLog(context.TODO(), p.logger, httpResp.Body, slog.LevelDebug)
 
 	body, err := io.ReadAll(httpResp.Body)
 	if err != nil {
@@ -284,6 +423,11 @@ func (p *dnsOverHTTPS) exchangeHTTPSClient(
 		)
 	}
 
+	err = checkCompression(body, p.maxPtrs)
+	if err != nil {
+		return nil, fmt.Errorf("checking response from %s: %w", p.addrRedacted, err)
+	}
+
 	resp = &dns.Msg{}
 	err = resp.Unpack(body)
 	if err != nil {
@@ -342,11 +486,11 @@ func (p *dnsOverHTTPS) resetClient(resetErr error) (client *http.Client, err err
 	if oldClient != nil {
 		closeErr := p.closeClient(oldClient)
 		if closeErr != nil {
-			log.Info("warning: failed to close the old http client: %v", closeErr)
+			p.logger.Warn("failed to close the old http client", slogutil.KeyError, closeErr)
 		}
 	}
 
-	log.Debug("re-creating the http client due to %v", resetErr)
+	p.logger.Debug("re-creating the http client", "reason", resetErr)
 	p.client, err = p.createClient()
 
 	return p.client, err
@@ -390,7 +534,7 @@ func (p *dnsOverHTTPS) getClient() (c *http.Client, isCached bool, err error) {
 		return nil, false, fmt.Errorf("timeout exceeded: %s", elapsed)
 	}
 
-	log.Debug("creating a new http client")
+	p.logger.Debug("creating a new http client")
 	p.client, err = p.createClient()
 
 	return p.client, false, err
@@ -437,23 +581,24 @@ func (p *dnsOverHTTPS) createTransport() (t http.RoundTripper, err error) {
 	tlsConf := p.tlsConf.Clone()
 	transportH3, err := p.createTransportH3(tlsConf, dialContext)
 	if err == nil {
-		log.Debug("using HTTP/3 for this upstream: QUIC was faster")
+		p.logger.Debug("using http/3 for this upstream, quic was faster")
 		return transportH3, nil
 	}
 
-	log.Debug("using HTTP/2 for this upstream: %v", err)
+	p.logger.Debug("using http/2 for this upstream", slogutil.KeyError, err)
 
 	if !p.supportsHTTP() {
 		return nil, errors.Error("HTTP1/1 and HTTP2 are not supported by this upstream")
 	}
 
+	p.ech.apply(tlsConf)
+
 	transport := &http.Transport{
 		TLSClientConfig:    tlsConf,
 		DisableCompression: true,
 		DialContext:        dialContext,
-		IdleConnTimeout:    transportDefaultIdleConnTimeout,
-		MaxConnsPerHost:    dohMaxConnsPerHost,
-		MaxIdleConns:       dohMaxIdleConns,
+		MaxConnsPerHost:    p.http2Conf.maxConns(),
+		MaxIdleConns:       max(p.http2Conf.maxConns(), dohMaxIdleConns),
 		// Since we have a custom DialContext, we need to use this field to make
 		// golang http.Client attempt to use HTTP/2. Otherwise, it would only be
 		// used when negotiated on the TLS level.
@@ -470,7 +615,7 @@ func (p *dnsOverHTTPS) createTransport() (t http.RoundTripper, err error) {
 	}
 
 	// Enable HTTP/2 pings on idle connections.
-	transportH2.ReadIdleTimeout = transportDefaultReadIdleTimeout
+	p.http2Conf.setTimeouts(transport, transportH2)
 
 	return transport, nil
 }
@@ -550,8 +695,7 @@ func (p *dnsOverHTTPS) createTransportH3(
 			tlsCfg *tls.Config,
 			cfg *quic.Config,
 		) (c quic.EarlyConnection, err error) {
-			c, err = quic.DialAddrEarly(ctx, addr, tlsCfg, cfg)
-			return c, err
+			return dialQUIC(ctx, p.listenPacket, addr, tlsCfg, cfg)
 		},
 		DisableCompression: true,
 		TLSClientConfig:    tlsConfig,
@@ -578,12 +722,7 @@ func (p *dnsOverHTTPS) probeH3(
 	// It's never actually used.
 	_ = rawConn.Close()
 
-	udpConn, ok := rawConn.(*net.UDPConn)
-	if !ok {
-		return "", fmt.Errorf("not a UDP connection to %s", p.addrRedacted)
-	}
-
-	addr = udpConn.RemoteAddr().String()
+	addr = rawConn.RemoteAddr().String()
 
 	// Avoid spending time on probing if this upstream only supports HTTP/3.
 	if p.supportsH3() && !p.supportsHTTP() {
@@ -621,7 +760,7 @@ func (p *dnsOverHTTPS) probeH3(
 	case tlsErr := <-chTLS:
 		if tlsErr != nil {
 			// Return immediately, TLS failed.
-			log.Debug("probing TLS: %v", tlsErr)
+			p.logger.Debug("probing tls", slogutil.KeyError, tlsErr)
 			return addr, nil
 		}
 
@@ -641,7 +780,7 @@ func (p *dnsOverHTTPS) probeQUIC(addr string, tlsConfig *tls.Config, ch chan err
 	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(t))
 	defer cancel()
 
-	conn, err := quic.DialAddrEarly(ctx, addr, tlsConfig, p.getQUICConfig())
+	conn, err := dialQUIC(ctx, p.listenPacket, addr, tlsConfig, p.getQUICConfig())
 	if err != nil {
 		ch <- fmt.Errorf("opening quic connection to %s: %w", p.addrRedacted, err)
 		return
@@ -653,7 +792,7 @@ func (p *dnsOverHTTPS) probeQUIC(addr string, tlsConfig *tls.Config, ch chan err
 	ch <- nil
 
 	elapsed := time.Since(startTime)
-	log.Debug("elapsed on establishing a QUIC connection: %s", elapsed)
+	p.logger.Debug("quic connection established", "elapsed", elapsed)
 }
 
 // probeTLS attempts to establish a TLS connection to the specified address. We
@@ -673,7 +812,7 @@ func (p *dnsOverHTTPS) probeTLS(dialContext bootstrap.DialHandler, tlsConfig *tl
 	ch <- nil
 
 	elapsed := time.Since(startTime)
-	log.Debug("elapsed on establishing a TLS connection: %s", elapsed)
+	p.logger.Debug("tls connection established", "elapsed", elapsed)
 }
 
 // supportsH3 returns true if HTTP/3 is supported by this upstream.
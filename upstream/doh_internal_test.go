@@ -526,3 +526,42 @@ func createDoHHandler() (h http.Handler) {
 
 	return mux
 }
+
+func TestUpstreamDoH_http2Config(t *testing.T) {
+	srv := startDoHServer(t, testDoHServerOptions{})
+
+	address := fmt.Sprintf("https://%s/dns-query", srv.addr)
+	u, err := AddressToUpstream(address, &Options{
+		InsecureSkipVerify: true,
+		Timeout:            200 * time.Millisecond,
+		HTTP2: &HTTP2Config{
+			MaxConns:             1,
+			MaxConcurrentStreams: 1,
+			IdleConnTimeout:      time.Minute,
+			ReadIdleTimeout:      time.Second,
+			PingTimeout:          time.Second,
+		},
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	checkUpstream(t, u, address)
+
+	doh := testutil.RequireTypeAssert[*dnsOverHTTPS](t, u)
+	transport := testutil.RequireTypeAssert[*http.Transport](t, doh.client.Transport)
+	require.Equal(t, 1, transport.MaxConnsPerHost)
+	require.Equal(t, time.Minute, transport.IdleConnTimeout)
+
+	// Occupy the only stream.
+	require.NoError(t, doh.streams.Acquire(context.Background()))
+
+	_, err = u.Exchange(createTestMessage())
+	testutil.AssertErrorMsg(
+		t,
+		fmt.Sprintf("waiting for stream to %s: context deadline exceeded", address),
+		err,
+	)
+
+	doh.streams.Release()
+	checkUpstream(t, u, address)
+}
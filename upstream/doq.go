@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/tls"
 	"fmt"
+	"log/slog"
 	"net"
 	"net/url"
 	"os"
@@ -13,7 +14,7 @@ import (
 
 	"github.com/AdguardTeam/dnsproxy/proxyutil"
 	"github.com/AdguardTeam/golibs/errors"
-	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
 	"github.com/miekg/dns"
 	"github.com/quic-go/quic-go"
 	"github.com/quic-go/quic-go/http3"
@@ -29,6 +30,10 @@ const (
 	// connection.
 	QUICCodeInternalError = quic.ApplicationErrorCode(1)
 
+	// quicCodeRequestCancelled signals that the client has canceled the
+	// request, see RFC 9250 Section 4.3.
+	quicCodeRequestCancelled = quic.StreamErrorCode(3)
+
 	// QUICKeepAlivePeriod is the value that we pass to *quic.Config and that
 	// controls the period with with keep-alive frames are being sent to the
 	// connection. We set it to 20s as it would be in the quic-go@v0.27.1 with
@@ -58,12 +63,19 @@ type dnsOverQUIC struct {
 	// one.
 	getDialer DialerInitializer
 
+	// listenPacket creates the UDP sockets of the QUIC connections, if not
+	// nil, see [Options.ListenPacket].
+	listenPacket listenPacketFunc
+
 	// addr is the DNS-over-QUIC server URL.
 	addr *url.URL
 
 	// tlsConf is the configuration of TLS.
 	tlsConf *tls.Config
 
+	// logger is used for exchange logging.  It is never nil.
+	logger *slog.Logger
+
 	// quicConfig is the QUIC configuration that is used for establishing
 	// connections to the upstream.  This configuration includes the TokenStore
 	// that needs to be stored for the lifetime of dnsOverQUIC since we can
@@ -89,6 +101,10 @@ type dnsOverQUIC struct {
 
 	// timeout is the timeout for the upstream connection.
 	timeout time.Duration
+
+	// maxPtrs is the maximum number of the compression pointers in a domain
+	// name of a response, see [Options.MaxCompressionPointers].
+	maxPtrs uint
 }
 
 // newDoQ returns the DNS-over-QUIC Upstream.
@@ -96,33 +112,34 @@ func newDoQ(addr *url.URL, opts *Options) (u Upstream, err error) {
 	addPort(addr, defaultPortDoQ)
 
 	u = &dnsOverQUIC{
-		getDialer: newDialerInitializer(addr, opts),
-		addr:      addr,
+		getDialer:    newDialerInitializer(addr, opts),
+		listenPacket: opts.ListenPacket,
+		addr:         addr,
 		quicConfig: &quic.Config{
 			KeepAlivePeriod: QUICKeepAlivePeriod,
 			TokenStore:      newQUICTokenStore(),
 			Tracer:          opts.QUICTracer,
 		},
 		tlsConf: &tls.Config{
-			ServerName:   addr.Hostname(),
-			RootCAs:      opts.RootCAs,
-			CipherSuites: opts.CipherSuites,
-			// Use the default capacity for the LRU cache.  It may be useful to
-			// store several caches since the user may be routed to different
-			// servers in case there's load balancing on the server-side.
-			ClientSessionCache: tls.NewLRUClientSessionCache(0),
+			ServerName:         addr.Hostname(),
+			RootCAs:            opts.RootCAs,
+			CipherSuites:       opts.CipherSuites,
+			ClientSessionCache: newQUICSessionCache(opts),
 			MinVersion:         tls.VersionTLS12,
 			// #nosec G402 -- TLS certificate verification could be disabled by
 			// configuration.
 			InsecureSkipVerify:    opts.InsecureSkipVerify,
 			VerifyPeerCertificate: opts.VerifyServerCertificate,
 			VerifyConnection:      opts.VerifyConnection,
+			KeyLogWriter:          opts.KeyLogWriter,
 			NextProtos:            compatProtoDQ,
 		},
+		logger:       opts.Logger,
 		quicConfigMu: &sync.Mutex{},
 		connMu:       &sync.Mutex{},
 		bytesPoolMu:  &sync.Mutex{},
 		timeout:      opts.Timeout,
+		maxPtrs:      opts.MaxCompressionPointers,
 	}
 
 	runtime.SetFinalizer(u, (*dnsOverQUIC).Close)
@@ -138,6 +155,20 @@ func (p *dnsOverQUIC) Address() string { return p.addr.String() }
 
 // Exchange implements the [Upstream] interface for *dnsOverQUIC.
 func (p *dnsOverQUIC) Exchange(m *dns.Msg) (resp *dns.Msg, err error) {
+	return p.ExchangeContext(context.Background(), m)
+}
+
+// type check
+var _ ContextExchanger = (*dnsOverQUIC)(nil)
+
+// ExchangeContext implements the [ContextExchanger] interface for *dnsOverQUIC.
+// Only the stream of the aborted exchange is canceled, the connection is kept.
+func (p *dnsOverQUIC) ExchangeContext(
+	ctx context.Context,
+	m *dns.Msg,
+) (resp *dns.Msg, err error) {
+	defer func() { err = classify(err) }()
+
 	// When sending queries over a QUIC connection, the DNS Message ID MUST be
 	// set to zero.
 	id := m.Id
@@ -157,13 +188,16 @@ func (p *dnsOverQUIC) Exchange(m *dns.Msg) (resp *dns.Msg, err error) {
 	}
 
 	// Make the first attempt to send the DNS query.
-	resp, err = p.exchangeQUIC(m, conn)
+	resp, err = p.exchangeQUIC(ctx, m, conn)
+	if ctx.Err() != nil {
+		return nil, err
+	}
 
 	// Failure to use a cached connection should be handled gracefully as this
 	// connection could have been closed by the server or simply be broken due
 	// to how UDP NAT works.  In this case the connection should be re-created.
 	if cached && err != nil {
-		log.Debug("dnsproxy: re-creating the QUIC connection and retrying due to %v", err)
+		p.logger.Debug("re-creating the quic connection and retrying", slogutil.KeyError, err)
 
 		// Close the active connection to make sure the cached connection is
 		// cleaned up.
@@ -177,10 +211,10 @@ func (p *dnsOverQUIC) Exchange(m *dns.Msg) (resp *dns.Msg, err error) {
 		}
 
 		// Retry sending the request through the new connection.
-		resp, err = p.exchangeQUIC(m, conn)
+		resp, err = p.exchangeQUIC(ctx, m, conn)
 	}
 
-	if err != nil {
+	if err != nil && ctx.Err() == nil {
 		// If we're unable to exchange messages, make sure the connection is
 		// closed and signal about an internal error.
 		p.closeConnWithError(conn, err)
@@ -204,23 +238,38 @@ func (p *dnsOverQUIC) Close() (err error) {
 }
 
 // exchangeQUIC attempts to open a new QUIC stream, send the DNS message
-// through it and return the response it got from the server.
-func (p *dnsOverQUIC) exchangeQUIC(req *dns.Msg, conn quic.Connection) (resp *dns.Msg, err error) {
+// through it and return the response it got from the server.  The stream is
+// canceled once ctx is canceled, in which case the error of ctx is returned.
+func (p *dnsOverQUIC) exchangeQUIC(
+	ctx context.Context,
+	req *dns.Msg,
+	conn quic.Connection,
+) (resp *dns.Msg, err error) {
 	addr := p.Address()
 
-	logBegin(addr, networkUDP, req)
-	defer func() { logFinish(addr, networkUDP, err) }()
+	logBegin(p.logger, addr, networkUDP, req)
+	defer func() { logFinish(p.logger, addr, networkUDP, err) }()
 
 	buf, err := req.Pack()
 	if err != nil {
 		return nil, fmt.Errorf("failed to pack DNS message for DoQ: %w", err)
 	}
 
-	stream, err := p.openStream(conn)
+	stream, err := p.openStream(ctx, conn)
 	if err != nil {
 		return nil, fmt.Errorf("opening stream: %w", err)
 	}
 
+	stop := context.AfterFunc(ctx, func() {
+		stream.CancelRead(quicCodeRequestCancelled)
+		stream.CancelWrite(quicCodeRequestCancelled)
+	})
+	defer func() {
+		if !stop() {
+			resp, err = nil, ctx.Err()
+		}
+	}()
+
 	if p.timeout > 0 {
 		err = stream.SetDeadline(time.Now().Add(p.timeout))
 		if err != nil {
@@ -239,7 +288,7 @@ func (p *dnsOverQUIC) exchangeQUIC(req *dns.Msg, conn quic.Connection) (resp *dn
 	// of the stream, but does not prevent reading from it.
 	err = stream.Close()
 	if err != nil {
-		log.Debug("dnsproxy: closing quic stream: %s", err)
+		p.logger.Debug("closing quic stream", slogutil.KeyError, err)
 	}
 
 	return p.readMsg(stream)
@@ -303,9 +352,10 @@ func (p *dnsOverQUIC) resetQUICConfig() {
 	p.quicConfig.TokenStore = newQUICTokenStore()
 }
 
-// openStream opens a new QUIC stream for the specified connection.
-func (p *dnsOverQUIC) openStream(conn quic.Connection) (quic.Stream, error) {
-	ctx, cancel := p.withDeadline(context.Background())
+// openStream opens a new QUIC stream for the specified connection.  ctx bounds
+// the waiting for the stream.
+func (p *dnsOverQUIC) openStream(ctx context.Context, conn quic.Connection) (quic.Stream, error) {
+	ctx, cancel := p.withDeadline(ctx)
 	defer cancel()
 
 	stream, err := conn.OpenStreamSync(ctx)
@@ -334,20 +384,15 @@ func (p *dnsOverQUIC) openConnection() (conn quic.Connection, err error) {
 	// It's never actually used.
 	err = rawConn.Close()
 	if err != nil {
-		log.Debug("dnsproxy: closing raw connection for %s: %s", p.addr, err)
+		p.logger.Debug("closing raw connection", "addr", p.addr, slogutil.KeyError, err)
 	}
 
-	udpConn, ok := rawConn.(*net.UDPConn)
-	if !ok {
-		return nil, fmt.Errorf("unexpected type %T of connection; should be %T", rawConn, udpConn)
-	}
-
-	addr := udpConn.RemoteAddr().String()
+	addr := rawConn.RemoteAddr().String()
 
 	ctx, cancel := p.withDeadline(context.Background())
 	defer cancel()
 
-	conn, err = quic.DialAddrEarly(ctx, addr, p.tlsConf.Clone(), p.getQUICConfig())
+	conn, err = dialQUIC(ctx, p.listenPacket, addr, p.tlsConf.Clone(), p.getQUICConfig())
 	if err != nil {
 		return nil, fmt.Errorf("dialing quic connection to %s: %w", p.addr, err)
 	}
@@ -374,7 +419,7 @@ func (p *dnsOverQUIC) closeConnWithError(conn quic.Connection, err error) {
 
 	err = conn.CloseWithError(code, "")
 	if err != nil {
-		log.Error("dnsproxy: failed to close the conn: %v", err)
+		p.logger.Error("failed to close the conn", slogutil.KeyError, err)
 	}
 
 	// If the connection that's being closed is cached, reset the cache.
@@ -403,6 +448,13 @@ func (p *dnsOverQUIC) readMsg(stream quic.Stream) (m *dns.Msg, err error) {
 	// specified in [RFC1035].
 	// IMPORTANT: Note, that we ignore this prefix here as this implementation
 	// does not support receiving multiple messages over a single connection.
+	if n > 2 {
+		err = checkCompression(respBuf[2:n], p.maxPtrs)
+		if err != nil {
+			return nil, fmt.Errorf("checking response from %s: %w", p.addr, err)
+		}
+	}
+
 	m = new(dns.Msg)
 	err = m.Unpack(respBuf[2:])
 	if err != nil {
@@ -412,6 +464,19 @@ func (p *dnsOverQUIC) readMsg(stream quic.Stream) (m *dns.Msg, err error) {
 	return m, nil
 }
 
+// newQUICSessionCache returns the TLS session cache for a DNS-over-QUIC
+// upstream, which is [Options.QUICSessionCache] if it's set.
+func newQUICSessionCache(opts *Options) (c tls.ClientSessionCache) {
+	if opts.QUICSessionCache != nil {
+		return opts.QUICSessionCache
+	}
+
+	// Use the default capacity for the LRU cache.  It may be useful to store
+	// several caches since the user may be routed to different servers in case
+	// there's load balancing on the server-side.
+	return tls.NewLRUClientSessionCache(0)
+}
+
 // newQUICTokenStore creates a new quic.TokenStore that is necessary to have
 // in order to benefit from 0-RTT.
 func newQUICTokenStore() (s quic.TokenStore) {
@@ -422,6 +487,48 @@ func newQUICTokenStore() (s quic.TokenStore) {
 	return quic.NewLRUTokenStore(1, 10)
 }
 
+// listenPacketFunc creates the UDP socket, see [Options.ListenPacket].
+type listenPacketFunc = func(ctx context.Context, network, addr string) (conn net.PacketConn, err error)
+
+// dialQUIC dials the QUIC connection to addr using the UDP socket created with
+// listen, if it's not nil, and closes the socket once the connection is closed.
+// Otherwise, the socket is created by quic-go.  The errors belong to
+// [ErrQUICHandshake].
+func dialQUIC(
+	ctx context.Context,
+	listen listenPacketFunc,
+	addr string,
+	tlsConf *tls.Config,
+	conf *quic.Config,
+) (conn quic.EarlyConnection, err error) {
+	if listen == nil {
+		conn, err = quic.DialAddrEarly(ctx, addr, tlsConf, conf)
+
+		return conn, withClasses(err, ErrQUICHandshake)
+	}
+
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("parsing address: %w", err)
+	}
+
+	pc, err := listen(ctx, "udp", ":0")
+	if err != nil {
+		return nil, fmt.Errorf("creating udp socket: %w", err)
+	}
+
+	conn, err = quic.DialEarly(ctx, pc, udpAddr, tlsConf, conf)
+	if err != nil {
+		err = withClasses(err, ErrQUICHandshake)
+
+		return nil, errors.WithDeferred(err, pc.Close())
+	}
+
+	context.AfterFunc(conn.Context(), func() { _ = pc.Close() })
+
+	return conn, nil
+}
+
 // isQUICRetryError checks the error and determines whether it may signal that
 // we should re-create the QUIC connection.  This requirement is caused by
 // quic-go issues, see the comments inside this function.
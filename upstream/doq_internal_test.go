@@ -1,21 +1,24 @@
 package upstream
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
 	"encoding/binary"
 	"fmt"
 	"io"
+	"log/slog"
 	"net"
 	"net/netip"
 	"net/url"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/AdguardTeam/dnsproxy/proxyutil"
 	"github.com/AdguardTeam/golibs/errors"
-	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
 	"github.com/AdguardTeam/golibs/testutil"
 	"github.com/miekg/dns"
 	"github.com/quic-go/quic-go"
@@ -125,6 +128,47 @@ func TestUpstream_Exchange_quicServerCloseConn(t *testing.T) {
 	wg.Wait()
 }
 
+func TestUpstreamDoQ_dialHooks(t *testing.T) {
+	tlsConf, rootCAs := createServerTLSConfig(t, "127.0.0.1")
+	srv := startDoQServer(t, tlsConf, 0)
+
+	// dials and listens count the calls of the hooks.
+	var dials, listens atomic.Int32
+	lc := &net.ListenConfig{}
+	d := &net.Dialer{}
+
+	address := fmt.Sprintf("quic://%s", srv.addr)
+	u, err := AddressToUpstream(address, &Options{
+		RootCAs: rootCAs,
+		DialContext: func(ctx context.Context, network, addr string) (conn net.Conn, err error) {
+			dials.Add(1)
+
+			return d.DialContext(ctx, network, addr)
+		},
+		ListenPacket: func(
+			ctx context.Context,
+			network string,
+			addr string,
+		) (conn net.PacketConn, err error) {
+			listens.Add(1)
+
+			return lc.ListenPacket(ctx, network, addr)
+		},
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	checkUpstream(t, u, address)
+
+	assert.Equal(t, int32(1), dials.Load())
+	assert.Equal(t, int32(1), listens.Load())
+
+	// The connection is reused.
+	checkUpstream(t, u, address)
+
+	assert.Equal(t, int32(1), listens.Load())
+}
+
 func TestUpstreamDoQ_serverRestart(t *testing.T) {
 	// Use the same tlsConf for all servers to preserve the data necessary for
 	// 0-RTT connections.
@@ -218,6 +262,50 @@ func TestUpstreamDoQ_0RTT(t *testing.T) {
 	require.True(t, conns[1].is0RTT())
 }
 
+func TestUpstreamDoQ_0RTTPersisted(t *testing.T) {
+	tlsConf, rootCAs := createServerTLSConfig(t, "127.0.0.1")
+
+	srv := startDoQServer(t, tlsConf, 0)
+
+	tracer := &quicTracer{}
+	address := fmt.Sprintf("quic://%s", srv.addr)
+	req := createTestMessage()
+
+	exchange := func(t *testing.T, sessions *SessionCache) {
+		t.Helper()
+
+		u, err := AddressToUpstream(address, &Options{
+			QUICTracer:       tracer.TracerForConnection,
+			RootCAs:          rootCAs,
+			QUICSessionCache: sessions,
+		})
+		require.NoError(t, err)
+		testutil.CleanupAndRequireSuccess(t, u.Close)
+
+		resp, err := u.Exchange(req)
+		require.NoError(t, err)
+		requireResponse(t, req, resp)
+	}
+
+	sessions := NewSessionCache(0)
+	exchange(t, sessions)
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, sessions.WriteCache(buf))
+
+	restored := NewSessionCache(0)
+	require.NoError(t, restored.ReadCache(buf))
+
+	// Use a new upstream, as if the proxy has been restarted.
+	exchange(t, restored)
+
+	conns := tracer.getConnectionsInfo()
+	require.Len(t, conns, 2)
+
+	assert.False(t, conns[0].is0RTT())
+	assert.True(t, conns[1].is0RTT())
+}
+
 // testDoHServer is an instance of a test DNS-over-QUIC server.
 type testDoQServer struct {
 	// listener is the QUIC connections listener.
@@ -253,9 +341,9 @@ func (s *testDoQServer) Serve() {
 		}()
 		if err != nil {
 			if errors.Is(err, quic.ErrServerClosed) {
-				log.Debug("test doq: accepting: %s", err)
+				slog.Debug("test doq: accepting", slogutil.KeyError, err)
 			} else {
-				log.Error("test doq: accepting: %s", err)
+				slog.Error("test doq: accepting", slogutil.KeyError, err)
 			}
 
 			return
@@ -279,7 +367,11 @@ func (s *testDoQServer) handleQUICConnection(conn quic.EarlyConnection) {
 		go func() {
 			qErr := s.handleQUICStream(stream)
 			if qErr != nil {
-				log.Error("test doq: handling from %s: %s", conn.RemoteAddr(), qErr)
+				slog.Error(
+					"test doq: handling",
+					"raddr", conn.RemoteAddr(),
+					slogutil.KeyError, qErr,
+				)
 
 				_ = conn.CloseWithError(QUICCodeNoError, "")
 			}
@@ -290,7 +382,7 @@ func (s *testDoQServer) handleQUICConnection(conn quic.EarlyConnection) {
 // handleQUICStream handles new QUIC streams, reads DNS messages and responds to
 // them.
 func (s *testDoQServer) handleQUICStream(stream quic.Stream) (err error) {
-	defer log.OnCloserError(stream, log.DEBUG)
+	defer slogutil.CloseAndLog(context.Background(), slog.Default(), stream, slog.LevelDebug)
 
 	buf := make([]byte, dns.MaxMsgSize+2)
 	_, err = stream.Read(buf)
@@ -335,7 +427,7 @@ func (s *testDoQServer) closeConn(conn quic.EarlyConnection) {
 
 	err := conn.CloseWithError(QUICCodeNoError, "")
 	if err != nil {
-		log.Debug("failed to close conn: %v", err)
+		slog.Debug("test doq: closing conn", slogutil.KeyError, err)
 	}
 
 	delete(s.conns, conn)
@@ -5,16 +5,16 @@ import (
 	"crypto/tls"
 	"fmt"
 	"io"
+	"log/slog"
 	"net"
 	"net/url"
 	"os"
 	"runtime"
-	"sync"
 	"time"
 
 	"github.com/AdguardTeam/dnsproxy/internal/bootstrap"
 	"github.com/AdguardTeam/golibs/errors"
-	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
 	"github.com/miekg/dns"
 )
 
@@ -34,17 +34,19 @@ type dnsOverTLS struct {
 	// tlsConf is the configuration of TLS.
 	tlsConf *tls.Config
 
-	// connsMu protects conns.
-	connsMu *sync.Mutex
-
-	// conns stores the connections ready for reuse.  Don't use [sync.Pool]
-	// here, since there is no need to deallocate these connections.
-	//
-	// TODO(e.burkov, ameshkov):  Currently connections just stored in FILO
-	// order, which eventually makes most of them unusable due to timeouts.
-	// This leads to weak performance for all exchanges coming across such
-	// connections.
-	conns []net.Conn
+	// logger is used for exchange logging.  It is never nil.
+	logger *slog.Logger
+
+	// conns stores the connections ready for reuse.  It's never nil.
+	conns *connPool
+
+	// ech is the Encrypted Client Hello configuration.  It's nil if ECH is
+	// disabled.
+	ech *echConfig
+
+	// maxPtrs is the maximum number of the compression pointers in a domain
+	// name of a response, see [Options.MaxCompressionPointers].
+	maxPtrs uint
 }
 
 // newDoT returns the DNS-over-TLS Upstream.
@@ -68,12 +70,20 @@ func newDoT(addr *url.URL, opts *Options) (ups Upstream, err error) {
 			InsecureSkipVerify:    opts.InsecureSkipVerify,
 			VerifyPeerCertificate: opts.VerifyServerCertificate,
 			VerifyConnection:      opts.VerifyConnection,
+			KeyLogWriter:          opts.KeyLogWriter,
 		},
-		connsMu: &sync.Mutex{},
+		logger:  opts.Logger,
+		conns:   newConnPool(opts.ConnPool, opts.Logger),
+		ech:     newECHConfig(addr, opts),
+		maxPtrs: opts.MaxCompressionPointers,
 	}
 
 	runtime.SetFinalizer(tlsUps, (*dnsOverTLS).Close)
 
+	if opts.ConnPool != nil && opts.ConnPool.Prewarm > 0 {
+		go tlsUps.prewarm()
+	}
+
 	return tlsUps, nil
 }
 
@@ -85,43 +95,54 @@ func (p *dnsOverTLS) Address() string { return p.addr.String() }
 
 // Exchange implements the [Upstream] interface for *dnsOverTLS.
 func (p *dnsOverTLS) Exchange(m *dns.Msg) (reply *dns.Msg, err error) {
+	return p.ExchangeContext(context.Background(), m)
+}
+
+// type check
+var _ ContextExchanger = (*dnsOverTLS)(nil)
+
+// ExchangeContext implements the [ContextExchanger] interface for *dnsOverTLS.
+func (p *dnsOverTLS) ExchangeContext(
+	ctx context.Context,
+	m *dns.Msg,
+) (reply *dns.Msg, err error) {
+	defer func() { err = classify(err) }()
+
 	h, err := p.getDialer()
 	if err != nil {
 		return nil, fmt.Errorf("getting conn to %s: %w", p.addr, err)
 	}
 
-	conn, err := p.conn(h)
+	conn, err := p.conn(ctx, h)
 	if err != nil {
 		return nil, fmt.Errorf("getting conn to %s: %w", p.addr, err)
 	}
 
-	reply, err = p.exchangeWithConn(conn, m)
-	if err != nil {
+	reply, err = p.exchangeWithConn(ctx, conn, m)
+	if err != nil && ctx.Err() != nil {
+		// The connection has been closed on abort.
+		return nil, err
+	} else if err != nil {
 		// The pooled connection might have been closed already, see
 		// https://github.com/AdguardTeam/dnsproxy/issues/3.  The following
 		// connection from pool may also be malformed, so dial a new one.
 
 		err = errors.WithDeferred(err, conn.Close())
-		log.Debug("dot %s: bad conn from pool: %s", p.addr, err)
+		p.logger.Debug("bad conn from pool", "addr", p.addr, slogutil.KeyError, err)
 
 		// Retry.
-		conn, err = tlsDial(h, p.tlsConf.Clone())
+		conn, err = p.dialConn(ctx, h)
 		if err != nil {
-			return nil, fmt.Errorf(
-				"dialing %s: connecting to %s: %w",
-				p.addr,
-				p.tlsConf.ServerName,
-				err,
-			)
+			return nil, fmt.Errorf("dialing %s: %w", p.addr, err)
 		}
 
-		reply, err = p.exchangeWithConn(conn, m)
+		reply, err = p.exchangeWithConn(ctx, conn, m)
 		if err != nil {
 			return reply, errors.WithDeferred(err, conn.Close())
 		}
 	}
 
-	p.putBack(conn)
+	p.conns.put(conn)
 
 	return reply, nil
 }
@@ -130,70 +151,104 @@ func (p *dnsOverTLS) Exchange(m *dns.Msg) (reply *dns.Msg, err error) {
 func (p *dnsOverTLS) Close() (err error) {
 	runtime.SetFinalizer(p, nil)
 
-	p.connsMu.Lock()
-	defer p.connsMu.Unlock()
+	return p.conns.close()
+}
 
-	var closeErrs []error
-	for _, conn := range p.conns {
-		closeErr := conn.Close()
-		if closeErr != nil && isCriticalTCP(closeErr) {
-			closeErrs = append(closeErrs, closeErr)
-		}
+// prewarm dials the connections to put into the pool in advance.  It's
+// intended to be used as a goroutine.
+func (p *dnsOverTLS) prewarm() {
+	defer slogutil.RecoverAndLog(context.Background(), p.logger)
+
+	h, err := p.getDialer()
+	if err != nil {
+		p.logger.Debug("prewarming conns", "addr", p.addr, slogutil.KeyError, err)
+
+		return
 	}
 
-	return errors.Join(closeErrs...)
+	p.conns.prewarm(p.dialFunc(h))
 }
 
-// conn returns the first available connection from the pool if there is any, or
-// dials a new one otherwise.
-func (p *dnsOverTLS) conn(h bootstrap.DialHandler) (conn net.Conn, err error) {
-	// Dial a new connection outside the lock, if needed.
-	defer func() {
-		if conn == nil {
-			conn, err = tlsDial(h, p.tlsConf.Clone())
-			err = errors.Annotate(err, "connecting to %s: %w", p.tlsConf.ServerName)
-		}
-	}()
+// dialFunc returns the function dialing a new TLS connection with h.
+func (p *dnsOverTLS) dialFunc(h bootstrap.DialHandler) (dial func() (conn net.Conn, err error)) {
+	return func() (conn net.Conn, err error) {
+		conf := p.tlsConf.Clone()
+		p.ech.apply(conf)
 
-	p.connsMu.Lock()
-	defer p.connsMu.Unlock()
+		tlsConn, err := tlsDial(h, conf)
+		if err != nil {
+			p.ech.handleError(err)
+
+			return nil, fmt.Errorf("connecting to %s: %w", p.tlsConf.ServerName, err)
+		}
 
-	l := len(p.conns)
-	if l == 0 {
-		return nil, nil
+		return tlsConn, nil
 	}
+}
+
+// dialConn dials a new connection with h, waiting for the dials in progress if
+// there are too many of them.  ctx bounds the waiting.
+func (p *dnsOverTLS) dialConn(
+	ctx context.Context,
+	h bootstrap.DialHandler,
+) (conn *pooledConn, err error) {
+	ctx, cancel := context.WithTimeout(ctx, dialTimeout)
+	defer cancel()
+
+	return p.conns.dial(ctx, p.dialFunc(h))
+}
 
-	p.conns, conn = p.conns[:l-1], p.conns[l-1]
+// conn returns the most recently used connection from the pool if there is
+// any, or dials a new one otherwise.  ctx bounds the waiting for the dials.
+func (p *dnsOverTLS) conn(
+	ctx context.Context,
+	h bootstrap.DialHandler,
+) (conn *pooledConn, err error) {
+	ctx, cancel := context.WithTimeout(ctx, dialTimeout)
+	defer cancel()
+
+	conn, reused, err := p.conns.get(ctx, p.dialFunc(h))
+	if err != nil || !reused {
+		return conn, err
+	}
 
 	err = conn.SetDeadline(time.Now().Add(dialTimeout))
 	if err != nil {
-		log.Debug("dot upstream: setting deadline to conn from pool: %s", err)
+		p.logger.Debug("setting deadline to conn from pool", slogutil.KeyError, err)
 
 		// If deadLine can't be updated it means that connection was already
 		// closed.
-		return nil, nil
+		p.conns.closeConn(conn)
+
+		return p.conns.dial(ctx, p.dialFunc(h))
 	}
 
-	log.Debug("dot upstream: using existing conn %s", conn.RemoteAddr())
+	p.logger.Debug("using existing conn", "addr", conn.RemoteAddr())
 
 	return conn, nil
 }
 
-func (p *dnsOverTLS) putBack(conn net.Conn) {
-	p.connsMu.Lock()
-	defer p.connsMu.Unlock()
-
-	p.conns = append(p.conns, conn)
-}
-
-// exchangeWithConn tries to exchange the query using conn.
-func (p *dnsOverTLS) exchangeWithConn(conn net.Conn, m *dns.Msg) (reply *dns.Msg, err error) {
+// exchangeWithConn tries to exchange the query using conn.  The exchange is
+// aborted by closing conn once ctx is canceled, in which case the error of ctx
+// is returned.
+func (p *dnsOverTLS) exchangeWithConn(
+	ctx context.Context,
+	conn net.Conn,
+	m *dns.Msg,
+) (reply *dns.Msg, err error) {
 	addr := p.Address()
 
-	logBegin(addr, networkTCP, m)
-	defer func() { logFinish(addr, networkTCP, err) }()
+	logBegin(p.logger, addr, networkTCP, m)
+	defer func() { logFinish(p.logger, addr, networkTCP, err) }()
+
+	stop := abortOnDone(ctx, conn)
+	defer func() {
+		if !stop() {
+			reply, err = nil, ctx.Err()
+		}
+	}()
 
-	dnsConn := dns.Conn{Conn: conn}
+	dnsConn := dns.Conn{Conn: withCompressionCheck(conn, p.maxPtrs)}
 
 	err = dnsConn.WriteMsg(m)
 	if err != nil {
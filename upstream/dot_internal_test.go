@@ -1,6 +1,8 @@
 package upstream
 
 import (
+	"bytes"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
@@ -39,6 +41,30 @@ func TestUpstream_dnsOverTLS(t *testing.T) {
 	}
 }
 
+func TestUpstream_dnsOverTLS_keyLog(t *testing.T) {
+	srv := startDoTServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := respondToTestMessage(req)
+
+		err := w.WriteMsg(resp)
+
+		pt := testutil.PanicT{}
+		require.NoError(pt, err)
+	})
+
+	keyLog := &bytes.Buffer{}
+	addr := fmt.Sprintf("tls://127.0.0.1:%d", srv.port)
+	u, err := AddressToUpstream(addr, &Options{
+		InsecureSkipVerify: true,
+		KeyLogWriter:       keyLog,
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	checkUpstream(t, u, addr)
+
+	assert.Contains(t, keyLog.String(), "CLIENT_TRAFFIC_SECRET_0 ")
+}
+
 func TestUpstream_dnsOverTLS_race(t *testing.T) {
 	const count = 10
 
@@ -113,8 +139,8 @@ func TestUpstream_dnsOverTLS_poolReconnect(t *testing.T) {
 	requireResponse(t, req, reply)
 
 	// Now let's close the pooled connection.
-	require.Len(t, p.conns, 1)
-	conn := p.conns[0]
+	require.Len(t, p.conns.idle, 1)
+	conn := p.conns.idle[0]
 	require.NoError(t, conn.Close())
 
 	// Send the second test message.
@@ -124,8 +150,8 @@ func TestUpstream_dnsOverTLS_poolReconnect(t *testing.T) {
 	requireResponse(t, req, reply)
 
 	// Now assert that the number of connections in the pool is not changed.
-	require.Len(t, p.conns, 1)
-	assert.NotSame(t, conn, p.conns[0])
+	require.Len(t, p.conns.idle, 1)
+	assert.NotSame(t, conn, p.conns.idle[0])
 
 	// Check that the session was resumed on the last attempt.
 	assert.True(t, lastState.DidResume)
@@ -156,17 +182,17 @@ func TestUpstream_dnsOverTLS_poolDeadline(t *testing.T) {
 	p := testutil.RequireTypeAssert[*dnsOverTLS](t, u)
 
 	// Now let's get connection from the pool and use it again.
-	require.Len(t, p.conns, 1)
-	conn := p.conns[0]
+	require.Len(t, p.conns.idle, 1)
+	conn := p.conns.idle[0]
 
 	dialHandler, err := p.getDialer()
 	require.NoError(t, err)
 
-	usedConn, err := p.conn(dialHandler)
+	usedConn, err := p.conn(context.Background(), dialHandler)
 	require.NoError(t, err)
 	require.Same(t, usedConn, conn)
 
-	response, err = p.exchangeWithConn(conn, req)
+	response, err = p.exchangeWithConn(context.Background(), conn, req)
 	require.NoError(t, err)
 	requireResponse(t, req, response)
 
@@ -174,17 +200,17 @@ func TestUpstream_dnsOverTLS_poolDeadline(t *testing.T) {
 	err = conn.SetDeadline(time.Now().Add(10 * time.Hour))
 	require.NoError(t, err)
 
-	p.putBack(conn)
+	p.conns.put(conn)
 
 	// Get connection from the pool and reuse it.
-	require.Len(t, p.conns, 1)
-	conn = p.conns[0]
+	require.Len(t, p.conns.idle, 1)
+	conn = p.conns.idle[0]
 
-	usedConn, err = p.conn(dialHandler)
+	usedConn, err = p.conn(context.Background(), dialHandler)
 	require.NoError(t, err)
 	require.Same(t, usedConn, conn)
 
-	response, err = p.exchangeWithConn(usedConn, req)
+	response, err = p.exchangeWithConn(context.Background(), usedConn, req)
 	require.NoError(t, err)
 	requireResponse(t, req, response)
 
@@ -193,7 +219,7 @@ func TestUpstream_dnsOverTLS_poolDeadline(t *testing.T) {
 	require.NoError(t, err)
 
 	// Connection with expired deadLine can't be used.
-	response, err = p.exchangeWithConn(usedConn, req)
+	response, err = p.exchangeWithConn(context.Background(), usedConn, req)
 	require.Error(t, err)
 	require.Nil(t, response)
 }
@@ -0,0 +1,236 @@
+package upstream
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/miekg/dns"
+)
+
+// ECHResolver is implemented by the [Resolver]s able to look up the Encrypted
+// Client Hello configurations the hosts publish in their HTTPS records, see
+// RFC 9460.
+type ECHResolver interface {
+	// LookupECHConfigList returns the ECH configuration list of host, or nil
+	// if host publishes none.
+	LookupECHConfigList(ctx context.Context, host string) (list []byte, err error)
+}
+
+// type check
+var _ ECHResolver = (*UpstreamResolver)(nil)
+
+// LookupECHConfigList implements the [ECHResolver] interface for
+// *UpstreamResolver.  It uses the HTTPS record with the highest priority, which
+// contains the ECH configuration list.  The lookup is aborted once ctx is
+// canceled.
+func (r *UpstreamResolver) LookupECHConfigList(
+	ctx context.Context,
+	host string,
+) (list []byte, err error) {
+	req := &dns.Msg{
+		MsgHdr: dns.MsgHdr{
+			Id:               dns.Id(),
+			RecursionDesired: true,
+		},
+		Question: []dns.Question{{
+			Name:   dns.Fqdn(strings.ToLower(host)),
+			Qtype:  dns.TypeHTTPS,
+			Qclass: dns.ClassINET,
+		}},
+	}
+
+	resp, err := ExchangeContext(ctx, r.Upstream, req)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	var prio uint16
+	for _, rr := range resp.Answer {
+		https, ok := rr.(*dns.HTTPS)
+		if !ok || https.Priority == 0 || (list != nil && https.Priority >= prio) {
+			// Skip the records in the alias mode and the ones with the lower
+			// priority.
+			continue
+		}
+
+		for _, kv := range https.Value {
+			if ech, isECH := kv.(*dns.SVCBECHConfig); isECH && len(ech.ECH) > 0 {
+				list, prio = ech.ECH, https.Priority
+			}
+		}
+	}
+
+	return list, nil
+}
+
+// type check
+var _ ECHResolver = (*CachingResolver)(nil)
+
+// LookupECHConfigList implements the [ECHResolver] interface for
+// *CachingResolver.  The results aren't cached.
+func (r *CachingResolver) LookupECHConfigList(
+	ctx context.Context,
+	host string,
+) (list []byte, err error) {
+	return r.resolver.LookupECHConfigList(ctx, host)
+}
+
+// lookupECHConfigList looks up the ECH configuration list of host using boot.
+// The resolvers within [ParallelResolver] and [ConsequentResolver] are tried
+// in order until the first successful response.
+func lookupECHConfigList(ctx context.Context, boot Resolver, host string) (list []byte, err error) {
+	var resolvers []Resolver
+	switch boot := boot.(type) {
+	case ECHResolver:
+		return boot.LookupECHConfigList(ctx, host)
+	case ParallelResolver:
+		resolvers = boot
+	case ConsequentResolver:
+		resolvers = boot
+	default:
+		return nil, fmt.Errorf("bootstrap of type %T doesn't support https records", boot)
+	}
+
+	var errs []error
+	for _, r := range resolvers {
+		list, err = lookupECHConfigList(ctx, r, host)
+		if err == nil {
+			return list, nil
+		}
+
+		errs = append(errs, err)
+	}
+
+	return nil, errors.Join(errs...)
+}
+
+// echConfig is the Encrypted Client Hello configuration of a DNS-over-HTTPS or
+// DNS-over-TLS upstream.  A nil *echConfig is valid and means that ECH is
+// disabled.
+type echConfig struct {
+	// logger is used to log the lookups and the rejections.
+	logger *slog.Logger
+
+	// boot is used to look up the ECH configuration list.
+	boot Resolver
+
+	// mu protects list and looked.
+	mu *sync.Mutex
+
+	// host is the hostname of the upstream.
+	host string
+
+	// list is the current ECH configuration list.  Empty list means that the
+	// connections are dialed without ECH.
+	list []byte
+
+	// timeout is the timeout of the lookup.
+	timeout time.Duration
+
+	// looked is true if the lookup has already been made.
+	looked bool
+}
+
+// newECHConfig returns the ECH configuration for the upstream with addr, or
+// nil if it's disabled in opts or the upstream has no hostname to look up.
+func newECHConfig(addr *url.URL, opts *Options) (c *echConfig) {
+	if !opts.ECH {
+		return nil
+	}
+
+	host := addr.Hostname()
+	if _, err := netip.ParseAddr(host); err == nil {
+		return nil
+	}
+
+	return &echConfig{
+		logger:  opts.Logger,
+		boot:    opts.Bootstrap,
+		mu:      &sync.Mutex{},
+		host:    host,
+		timeout: opts.Timeout,
+	}
+}
+
+// apply sets the ECH configuration list to conf, looking it up first, if it
+// hasn't been yet.  The errors are only logged and conf is left unchanged, so
+// that the upstream is connected to without ECH.
+func (c *echConfig) apply(conf *tls.Config) {
+	if c == nil {
+		return
+	}
+
+	list := c.configList()
+	if len(list) == 0 {
+		return
+	}
+
+	err := setECHConfigList(conf, list)
+	if err != nil {
+		c.logger.Debug("setting ech config list", "host", c.host, slogutil.KeyError, err)
+	}
+}
+
+// configList returns the current ECH configuration list, looking it up first,
+// if it hasn't been yet.
+func (c *echConfig) configList() (list []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.looked {
+		return c.list
+	}
+
+	c.looked = true
+
+	ctx := context.Background()
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	list, err := lookupECHConfigList(ctx, c.boot, c.host)
+	if err != nil {
+		c.logger.Debug("looking up ech config list", "host", c.host, slogutil.KeyError, err)
+
+		return nil
+	}
+
+	c.logger.Debug("looked up ech config list", "host", c.host, "found", len(list) > 0)
+	c.list = list
+
+	return list
+}
+
+// handleError replaces the ECH configuration list with the one the server has
+// provided to retry with, if err is the rejection of ECH.  An empty list, which
+// means that the server has disabled ECH, makes the following connections
+// dialed without it.
+func (c *echConfig) handleError(err error) {
+	if c == nil {
+		return
+	}
+
+	list, ok := echRetryConfigList(err)
+	if !ok {
+		return
+	}
+
+	c.logger.Debug("ech rejected", "host", c.host, "retry", len(list) > 0)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.list = list
+}
@@ -0,0 +1,21 @@
+//go:build !go1.23
+
+package upstream
+
+import (
+	"crypto/tls"
+
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// setECHConfigList returns an error, since ECH is only supported by the TLS
+// clients since Go 1.23.
+func setECHConfigList(_ *tls.Config, _ []byte) (err error) {
+	return errors.Error("encrypted client hello requires go 1.23")
+}
+
+// echRetryConfigList always returns false, since ECH is only supported by the
+// TLS clients since Go 1.23.
+func echRetryConfigList(_ error) (list []byte, ok bool) {
+	return nil, false
+}
@@ -0,0 +1,29 @@
+//go:build go1.23
+
+package upstream
+
+import (
+	"crypto/tls"
+
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// setECHConfigList sets list as the ECH configuration list of conf.  ECH
+// requires TLS 1.3.
+func setECHConfigList(conf *tls.Config, list []byte) (err error) {
+	conf.EncryptedClientHelloConfigList = list
+	conf.MinVersion = tls.VersionTLS13
+
+	return nil
+}
+
+// echRetryConfigList returns the ECH configuration list the server has provided
+// to retry with, if err is the rejection of ECH.
+func echRetryConfigList(err error) (list []byte, ok bool) {
+	var echErr *tls.ECHRejectionError
+	if !errors.As(err, &echErr) {
+		return nil, false
+	}
+
+	return echErr.RetryConfigList, true
+}
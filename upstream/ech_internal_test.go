@@ -0,0 +1,109 @@
+package upstream
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/internal/dnsproxytest"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLookupECHConfigList(t *testing.T) {
+	const host = "dns.example"
+
+	var (
+		echLow  = []byte{1, 2, 3}
+		echHigh = []byte{4, 5, 6}
+	)
+
+	newHTTPS := func(prio uint16, ech []byte) (rr *dns.HTTPS) {
+		rr = &dns.HTTPS{SVCB: dns.SVCB{
+			Hdr: dns.RR_Header{
+				Name:   host + ".",
+				Rrtype: dns.TypeHTTPS,
+				Class:  dns.ClassINET,
+			},
+			Priority: prio,
+			Target:   ".",
+		}}
+
+		if ech != nil {
+			rr.Value = []dns.SVCBKeyValue{&dns.SVCBECHConfig{ECH: ech}}
+		}
+
+		return rr
+	}
+
+	newResolver := func(answer ...dns.RR) (r *UpstreamResolver) {
+		return &UpstreamResolver{Upstream: &dnsproxytest.FakeUpstream{
+			OnAddress: func() (_ string) { panic("not implemented") },
+			OnClose:   func() (_ error) { panic("not implemented") },
+			OnExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+				require.Equal(testutil.PanicT{}, dns.TypeHTTPS, req.Question[0].Qtype)
+
+				resp = (&dns.Msg{}).SetReply(req)
+				resp.Answer = answer
+
+				return resp, nil
+			},
+		}}
+	}
+
+	testCases := []struct {
+		boot       Resolver
+		name       string
+		wantErrMsg string
+		want       []byte
+	}{{
+		boot:       newResolver(newHTTPS(2, echLow), newHTTPS(1, echHigh)),
+		name:       "priority",
+		wantErrMsg: "",
+		want:       echHigh,
+	}, {
+		boot:       newResolver(newHTTPS(0, echHigh), newHTTPS(1, nil)),
+		name:       "none",
+		wantErrMsg: "",
+		want:       nil,
+	}, {
+		boot:       NewCachingResolver(newResolver(newHTTPS(1, echLow))),
+		name:       "caching",
+		wantErrMsg: "",
+		want:       echLow,
+	}, {
+		boot: ConsequentResolver{
+			StaticResolver{netip.MustParseAddr("192.0.2.1")},
+			newResolver(newHTTPS(1, echLow)),
+		},
+		name:       "consequent",
+		wantErrMsg: "",
+		want:       echLow,
+	}, {
+		boot:       StaticResolver{netip.MustParseAddr("192.0.2.1")},
+		name:       "unsupported",
+		wantErrMsg: "bootstrap of type bootstrap.StaticResolver doesn't support https records",
+		want:       nil,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			list, err := lookupECHConfigList(context.Background(), tc.boot, host)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+
+			assert.Equal(t, tc.want, list)
+		})
+	}
+
+	t.Run("canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		list, err := lookupECHConfigList(ctx, newResolver(newHTTPS(1, echLow)), host)
+		require.ErrorIs(t, err, context.Canceled)
+
+		assert.Nil(t, list)
+	})
+}
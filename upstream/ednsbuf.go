@@ -0,0 +1,190 @@
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/internal/bootstrap"
+	"github.com/miekg/dns"
+)
+
+const (
+	// defaultEDNSBufferSize is the default EDNS buffer size advertised to the
+	// plain DNS-over-UDP upstreams, recommended by the DNS Flag Day 2020.
+	defaultEDNSBufferSize = 1232
+
+	// defaultEDNSProbeInterval is the default duration the reduced EDNS buffer
+	// size of the path to an upstream is used for.
+	defaultEDNSProbeInterval = 10 * time.Minute
+)
+
+// EDNSBufferConfig is the configuration of the adaptive EDNS buffer sizing of
+// a plain DNS-over-UDP upstream, see https://www.dnsflagday.net/2020.  The
+// requests with EDNS advertise the buffer size of the path to the upstream,
+// unless they already advertise a smaller one.  Once such a request times out,
+// which looks like the loss of the fragmented response, it's retried with the
+// minimum buffer size of 512 bytes, and then over TCP, and the first one which
+// succeeds is used for the following requests to the upstream.
+type EDNSBufferConfig struct {
+	// Size is the buffer size advertised to the upstream initially.  It must
+	// not be less than 512.  Zero means the default of 1232.
+	Size uint16
+
+	// ProbeInterval is the duration the reduced buffer size or TCP is used for,
+	// after which Size is tried again.  Zero means the default of ten minutes.
+	ProbeInterval time.Duration
+}
+
+// validate returns an error if c is invalid.  c may be nil.
+func (c *EDNSBufferConfig) validate() (err error) {
+	if c == nil {
+		return nil
+	}
+
+	if c.Size != 0 && c.Size < dns.MinMsgSize {
+		return fmt.Errorf("size %d is less than %d", c.Size, dns.MinMsgSize)
+	}
+
+	if c.ProbeInterval < 0 {
+		return fmt.Errorf("negative probe interval %s", c.ProbeInterval)
+	}
+
+	return nil
+}
+
+// ednsPathTCP is the EDNS buffer size of the path meaning that UDP doesn't
+// work at all.
+const ednsPathTCP uint16 = 0
+
+// ednsPath is the characteristics of the path to a plain DNS-over-UDP
+// upstream.
+type ednsPath struct {
+	// now returns the current time.  It's replaced in tests.
+	now func() (t time.Time)
+
+	// mu protects size and reducedAt.
+	mu *sync.Mutex
+
+	// reducedAt is the time size has been reduced at.
+	reducedAt time.Time
+
+	// size is the current buffer size of the path or [ednsPathTCP].
+	size uint16
+
+	// initial is the buffer size advertised initially.
+	initial uint16
+
+	// probeIvl is the duration the reduced size is used for.
+	probeIvl time.Duration
+}
+
+// newEDNSPath returns a new path configured with c.  It returns nil if c is
+// nil.
+func newEDNSPath(c *EDNSBufferConfig) (p *ednsPath) {
+	if c == nil {
+		return nil
+	}
+
+	size := c.Size
+	if size == 0 {
+		size = defaultEDNSBufferSize
+	}
+
+	probeIvl := c.ProbeInterval
+	if probeIvl == 0 {
+		probeIvl = defaultEDNSProbeInterval
+	}
+
+	return &ednsPath{
+		now:      time.Now,
+		mu:       &sync.Mutex{},
+		size:     size,
+		initial:  size,
+		probeIvl: probeIvl,
+	}
+}
+
+// current returns the current buffer size of the path or [ednsPathTCP].
+func (p *ednsPath) current() (size uint16) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.size != p.initial && p.now().Sub(p.reducedAt) >= p.probeIvl {
+		p.size = p.initial
+	}
+
+	return p.size
+}
+
+// reduce records that the path only works with size, which must be less than
+// the current one, or [ednsPathTCP].
+func (p *ednsPath) reduce(size uint16) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.size == ednsPathTCP || (size != ednsPathTCP && size >= p.size) {
+		return
+	}
+
+	p.size = size
+	p.reducedAt = p.now()
+}
+
+// withUDPSize returns req advertising the EDNS buffer size of at most size.  It
+// returns req itself if it already does.  req must have the OPT record.
+func withUDPSize(req *dns.Msg, size uint16) (res *dns.Msg) {
+	if req.IsEdns0().UDPSize() <= size {
+		return req
+	}
+
+	res = req.Copy()
+	res.IsEdns0().SetUDPSize(size)
+
+	return res
+}
+
+// exchangeUDP exchanges req with the upstream over UDP, adapting the advertised
+// EDNS buffer size to the path, if enabled.  The exchange is aborted once ctx
+// is canceled.
+func (p *plainDNS) exchangeUDP(
+	ctx context.Context,
+	dial bootstrap.DialHandler,
+	req *dns.Msg,
+) (resp *dns.Msg, err error) {
+	if p.ednsPath == nil || req.IsEdns0() == nil {
+		return p.dialExchange(ctx, networkUDP, dial, req)
+	}
+
+	size := p.ednsPath.current()
+	if size == ednsPathTCP {
+		return p.dialExchange(ctx, networkTCP, dial, req)
+	}
+
+	resp, err = p.dialExchange(ctx, networkUDP, dial, withUDPSize(req, size))
+	if size <= dns.MinMsgSize || !isTimeout(err) || ctx.Err() != nil {
+		return resp, err
+	}
+
+	addr := p.Address()
+
+	p.logger.Debug("possible fragmentation loss", "addr", addr, "size", size)
+	resp, err = p.dialExchange(ctx, networkUDP, dial, withUDPSize(req, dns.MinMsgSize))
+	if err == nil {
+		p.logger.Info("reducing edns buffer size", "addr", addr, "size", dns.MinMsgSize)
+		p.ednsPath.reduce(dns.MinMsgSize)
+
+		return resp, nil
+	} else if !isTimeout(err) || ctx.Err() != nil {
+		return resp, err
+	}
+
+	resp, err = p.dialExchange(ctx, networkTCP, dial, req)
+	if err == nil {
+		p.logger.Info("udp lost, using tcp", "addr", addr)
+		p.ednsPath.reduce(ednsPathTCP)
+	}
+
+	return resp, err
+}
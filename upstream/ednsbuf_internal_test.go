@@ -0,0 +1,167 @@
+package upstream
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// ednsTestTimeout is the timeout of the upstreams in the tests of the adaptive
+// EDNS buffer sizing.
+const ednsTestTimeout = 100 * time.Millisecond
+
+// ednsRequest is a request received by the test server.
+type ednsRequest struct {
+	network string
+	size    uint16
+}
+
+func TestUpstream_plainDNS_ednsBuffer(t *testing.T) {
+	testCases := []struct {
+		name string
+		// maxUDPSize is the maximum advertised size the server responds to
+		// over UDP, emulating the loss of the fragmented responses.
+		maxUDPSize uint16
+		wantFirst  []ednsRequest
+		wantNext   []ednsRequest
+	}{{
+		name:       "no_loss",
+		maxUDPSize: dns.MaxMsgSize,
+		wantFirst:  []ednsRequest{{network: networkUDP, size: defaultEDNSBufferSize}},
+		wantNext:   []ednsRequest{{network: networkUDP, size: defaultEDNSBufferSize}},
+	}, {
+		name:       "fragmentation",
+		maxUDPSize: dns.MinMsgSize,
+		// Each timed out request is sent twice, see [plainDNS.dialExchange].
+		wantFirst: []ednsRequest{
+			{network: networkUDP, size: defaultEDNSBufferSize},
+			{network: networkUDP, size: defaultEDNSBufferSize},
+			{network: networkUDP, size: dns.MinMsgSize},
+		},
+		wantNext: []ednsRequest{{network: networkUDP, size: dns.MinMsgSize}},
+	}, {
+		name:       "udp_lost",
+		maxUDPSize: 0,
+		wantFirst: []ednsRequest{
+			{network: networkUDP, size: defaultEDNSBufferSize},
+			{network: networkUDP, size: defaultEDNSBufferSize},
+			{network: networkUDP, size: dns.MinMsgSize},
+			{network: networkUDP, size: dns.MinMsgSize},
+			{network: networkTCP, size: 4096},
+		},
+		wantNext: []ednsRequest{{network: networkTCP, size: 4096}},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mu := &sync.Mutex{}
+			var reqs []ednsRequest
+
+			srv := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+				network := w.RemoteAddr().Network()
+				size := req.IsEdns0().UDPSize()
+
+				mu.Lock()
+				reqs = append(reqs, ednsRequest{network: network, size: size})
+				mu.Unlock()
+
+				if network == networkUDP && size > tc.maxUDPSize {
+					return
+				}
+
+				require.NoError(testutil.PanicT{}, w.WriteMsg(respondToTestMessage(req)))
+			})
+			testutil.CleanupAndRequireSuccess(t, srv.Close)
+
+			u, err := AddressToUpstream(fmt.Sprintf("127.0.0.1:%d", srv.port), &Options{
+				Timeout:    ednsTestTimeout,
+				EDNSBuffer: &EDNSBufferConfig{},
+			})
+			require.NoError(t, err)
+			testutil.CleanupAndRequireSuccess(t, u.Close)
+
+			exchange := func(t *testing.T) (got []ednsRequest) {
+				t.Helper()
+
+				mu.Lock()
+				reqs = nil
+				mu.Unlock()
+
+				req := createTestMessage()
+				req.SetEdns0(4096, false)
+
+				resp, excErr := u.Exchange(req)
+				require.NoError(t, excErr)
+				requireResponse(t, req, resp)
+
+				// Make sure the request of the caller isn't modified.
+				assert.Equal(t, uint16(4096), req.IsEdns0().UDPSize())
+
+				mu.Lock()
+				defer mu.Unlock()
+
+				return reqs
+			}
+
+			assert.Equal(t, tc.wantFirst, exchange(t))
+			assert.Equal(t, tc.wantNext, exchange(t))
+		})
+	}
+}
+
+func TestEDNSPath(t *testing.T) {
+	now := time.Now()
+	p := newEDNSPath(&EDNSBufferConfig{ProbeInterval: time.Minute})
+	p.now = func() (t time.Time) { return now }
+
+	require.Equal(t, uint16(defaultEDNSBufferSize), p.current())
+
+	p.reduce(dns.MinMsgSize)
+	assert.Equal(t, uint16(dns.MinMsgSize), p.current())
+
+	// The greater size doesn't extend the path.
+	p.reduce(defaultEDNSBufferSize)
+	assert.Equal(t, uint16(dns.MinMsgSize), p.current())
+
+	p.reduce(ednsPathTCP)
+	assert.Equal(t, ednsPathTCP, p.current())
+
+	now = now.Add(time.Minute)
+	assert.Equal(t, uint16(defaultEDNSBufferSize), p.current())
+}
+
+func TestEDNSBufferConfig_validate(t *testing.T) {
+	testCases := []struct {
+		conf       *EDNSBufferConfig
+		name       string
+		wantErrMsg string
+	}{{
+		conf:       nil,
+		name:       "nil",
+		wantErrMsg: "",
+	}, {
+		conf:       &EDNSBufferConfig{},
+		name:       "default",
+		wantErrMsg: "",
+	}, {
+		conf:       &EDNSBufferConfig{Size: 511},
+		name:       "small_size",
+		wantErrMsg: "size 511 is less than 512",
+	}, {
+		conf:       &EDNSBufferConfig{ProbeInterval: -time.Second},
+		name:       "negative_interval",
+		wantErrMsg: "negative probe interval -1s",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, tc.conf.validate())
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package upstream
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"syscall"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/miekg/dns"
+)
+
+// The classes of the errors returned by the upstreams.  Use [errors.Is] to
+// check whether an error belongs to a class.  An error may belong to several
+// classes, for example a timed out QUIC handshake, and the errors of the
+// failures of other kinds don't belong to any.  The messages of the errors
+// aren't affected by their classes.
+const (
+	// ErrTimeout means that the upstream hasn't responded or the connection
+	// to it hasn't been established in time, including the deadline of the
+	// context of the exchange.
+	ErrTimeout errors.Error = "timeout"
+
+	// ErrConnRefused means that the upstream has refused the connection or
+	// the port of the upstream is closed.
+	ErrConnRefused errors.Error = "connection refused"
+
+	// ErrTLSVerification means that the certificate of the upstream has
+	// failed the verification.
+	ErrTLSVerification errors.Error = "tls verification failure"
+
+	// ErrQUICHandshake means that the QUIC connection to the DNS-over-QUIC or
+	// HTTP/3 upstream couldn't be established.
+	ErrQUICHandshake errors.Error = "quic handshake failure"
+
+	// ErrMalformedResponse means that the response of the upstream couldn't
+	// be parsed or doesn't match the request.
+	ErrMalformedResponse errors.Error = "malformed response"
+)
+
+// classifiedError is an error belonging to the classes of the upstream
+// errors, like [ErrTimeout].
+type classifiedError struct {
+	// err is the underlying error.
+	err error
+
+	// classes are the classes err belongs to.
+	classes []error
+}
+
+// type check
+var _ error = (*classifiedError)(nil)
+
+// Error implements the error interface for *classifiedError.  It returns the
+// message of the underlying error.
+func (e *classifiedError) Error() (msg string) {
+	return e.err.Error()
+}
+
+// Unwrap returns the underlying error and the classes of e.
+func (e *classifiedError) Unwrap() (errs []error) {
+	return append([]error{e.err}, e.classes...)
+}
+
+// withClasses returns err belonging to classes in addition to the ones it
+// already belongs to.  It returns err itself, if it's nil or already belongs to
+// all of classes.
+func withClasses(err error, classes ...error) (res error) {
+	if err == nil {
+		return nil
+	}
+
+	var added []error
+	for _, c := range classes {
+		if !errors.Is(err, c) {
+			added = append(added, c)
+		}
+	}
+
+	if len(added) == 0 {
+		return err
+	}
+
+	return &classifiedError{
+		err:     err,
+		classes: added,
+	}
+}
+
+// classify returns err belonging to the classes of the upstream errors
+// detected from its chain.  err may be nil.
+func classify(err error) (res error) {
+	if err == nil {
+		return nil
+	}
+
+	var classes []error
+	// Unlike the deadline, the cancellation isn't a failure of the upstream.
+	if isTimeout(err) && !errors.Is(err, context.Canceled) {
+		classes = append(classes, ErrTimeout)
+	}
+
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		classes = append(classes, ErrConnRefused)
+	}
+
+	if isVerificationError(err) {
+		classes = append(classes, ErrTLSVerification)
+	}
+
+	if isMalformedResponse(err) {
+		classes = append(classes, ErrMalformedResponse)
+	}
+
+	return withClasses(err, classes...)
+}
+
+// isVerificationError returns true if err means that the certificate of the
+// server has failed the verification.
+func isVerificationError(err error) (ok bool) {
+	var verifyErr *tls.CertificateVerificationError
+	var authErr x509.UnknownAuthorityError
+	var hostErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+
+	return errors.As(err, &verifyErr) ||
+		errors.As(err, &authErr) ||
+		errors.As(err, &hostErr) ||
+		errors.As(err, &invalidErr)
+}
+
+// isMalformedResponse returns true if err means that the response couldn't be
+// unpacked or doesn't match the request.
+func isMalformedResponse(err error) (ok bool) {
+	if errors.Is(err, errCompression) {
+		return true
+	}
+
+	var dnsErr *dns.Error
+	if !errors.As(err, &dnsErr) {
+		return false
+	}
+
+	// Unlike the other errors of the dns package, the following ones aren't
+	// about the contents of the response.
+	return dnsErr != dns.ErrConnEmpty && dnsErr != dns.ErrSecret && dnsErr != dns.ErrKey
+}
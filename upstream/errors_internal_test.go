@@ -0,0 +1,144 @@
+package upstream
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"syscall"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// errClasses are all the classes of the upstream errors.
+var errClasses = []error{
+	ErrTimeout,
+	ErrConnRefused,
+	ErrTLSVerification,
+	ErrQUICHandshake,
+	ErrMalformedResponse,
+}
+
+// assertClasses checks that err belongs to want classes only.
+func assertClasses(tb testing.TB, err error, want ...error) {
+	tb.Helper()
+
+	for _, c := range errClasses {
+		assert.Equalf(tb, slices.Contains(want, c), errors.Is(err, c), "class %q", c)
+	}
+}
+
+func TestClassify(t *testing.T) {
+	testCases := []struct {
+		err  error
+		name string
+		want []error
+	}{{
+		err:  nil,
+		name: "nil",
+		want: nil,
+	}, {
+		err:  errors.Error("test error"),
+		name: "unknown",
+		want: nil,
+	}, {
+		err:  fmt.Errorf("reading: %w", os.ErrDeadlineExceeded),
+		name: "deadline",
+		want: []error{ErrTimeout},
+	}, {
+		err:  context.DeadlineExceeded,
+		name: "context_deadline",
+		want: []error{ErrTimeout},
+	}, {
+		err:  context.Canceled,
+		name: "context_canceled",
+		want: nil,
+	}, {
+		err: &net.OpError{
+			Op:  "dial",
+			Net: "tcp",
+			Err: os.NewSyscallError("connect", syscall.ECONNREFUSED),
+		},
+		name: "refused",
+		want: []error{ErrConnRefused},
+	}, {
+		err: fmt.Errorf("handshake: %w", &tls.CertificateVerificationError{
+			Err: x509.UnknownAuthorityError{},
+		}),
+		name: "tls_verification",
+		want: []error{ErrTLSVerification},
+	}, {
+		err:  fmt.Errorf("unpacking: %w", dns.ErrShortRead),
+		name: "malformed",
+		want: []error{ErrMalformedResponse},
+	}, {
+		err:  dns.ErrConnEmpty,
+		name: "conn_empty",
+		want: nil,
+	}, {
+		err:  withClasses(os.ErrDeadlineExceeded, ErrQUICHandshake),
+		name: "quic_handshake_timeout",
+		want: []error{ErrTimeout, ErrQUICHandshake},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := classify(tc.err)
+			if tc.err == nil {
+				assert.NoError(t, err)
+
+				return
+			}
+
+			assert.Equal(t, tc.err.Error(), err.Error())
+			assert.ErrorIs(t, err, tc.err)
+			assertClasses(t, err, tc.want...)
+		})
+	}
+}
+
+func TestUpstream_Exchange_errorClasses(t *testing.T) {
+	t.Run("refused", func(t *testing.T) {
+		// Get a port nothing listens on.
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		addr := l.Addr().String()
+		require.NoError(t, l.Close())
+
+		u, err := AddressToUpstream("tcp://"+addr, &Options{Timeout: timeout})
+		require.NoError(t, err)
+		testutil.CleanupAndRequireSuccess(t, u.Close)
+
+		_, err = u.Exchange(createTestMessage())
+		require.Error(t, err)
+
+		assertClasses(t, err, ErrConnRefused)
+	})
+
+	t.Run("tls_verification", func(t *testing.T) {
+		srv := startDoTServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+			require.NoError(testutil.PanicT{}, w.WriteMsg(respondToTestMessage(req)))
+		})
+
+		// The certificate of the server isn't trusted.
+		u, err := AddressToUpstream(fmt.Sprintf("tls://127.0.0.1:%d", srv.port), &Options{
+			Timeout: timeout,
+		})
+		require.NoError(t, err)
+		testutil.CleanupAndRequireSuccess(t, u.Close)
+
+		_, err = u.Exchange(createTestMessage())
+		require.Error(t, err)
+
+		assertClasses(t, err, ErrTLSVerification)
+	})
+}
@@ -4,12 +4,12 @@ import (
 	"context"
 	"fmt"
 	"io/fs"
+	"log/slog"
 	"net/netip"
 	"slices"
 
 	"github.com/AdguardTeam/golibs/errors"
 	"github.com/AdguardTeam/golibs/hostsfile"
-	"github.com/AdguardTeam/golibs/log"
 )
 
 // HostsResolver is a [Resolver] that looks into system hosts files, see
@@ -52,7 +52,7 @@ func parseHostsFile(fsys fs.FS, hosts hostsfile.Set, filename string) (err error
 	f, err := fsys.Open(filename)
 	if err != nil {
 		if errors.Is(err, fs.ErrNotExist) {
-			log.Debug("hosts file %q doesn't exist", filename)
+			slog.Debug("hosts file doesn't exist", "filename", filename)
 
 			return nil
 		}
@@ -0,0 +1,67 @@
+package upstream
+
+import (
+	"fmt"
+
+	"github.com/AdguardTeam/dnsproxy/internal/bootstrap"
+)
+
+// IPVersion is the preference of the address family used to dial an upstream
+// when its hostname resolves to the addresses of both families.
+type IPVersion string
+
+// IPVersion values.
+const (
+	// IPVersionDefault means [IPVersionPreferIPv6] if [Options.PreferIPv6] is
+	// set and [IPVersionPreferIPv4] otherwise.
+	IPVersionDefault IPVersion = ""
+
+	// IPVersionPreferIPv4 makes the IPv4 addresses dialed first.
+	IPVersionPreferIPv4 IPVersion = "prefer-ipv4"
+
+	// IPVersionPreferIPv6 makes the IPv6 addresses dialed first.
+	IPVersionPreferIPv6 IPVersion = "prefer-ipv6"
+
+	// IPVersionIPv4Only makes only the IPv4 addresses dialed.
+	IPVersionIPv4Only IPVersion = "ipv4-only"
+
+	// IPVersionIPv6Only makes only the IPv6 addresses dialed.
+	IPVersionIPv6Only IPVersion = "ipv6-only"
+)
+
+// Validate returns an error if v is not a valid IP version preference.
+func (v IPVersion) Validate() (err error) {
+	switch v {
+	case
+		IPVersionDefault,
+		IPVersionPreferIPv4,
+		IPVersionPreferIPv6,
+		IPVersionIPv4Only,
+		IPVersionIPv6Only:
+		return nil
+	default:
+		return fmt.Errorf("unknown value %q", string(v))
+	}
+}
+
+// network returns the network to resolve the hostname of an upstream for.
+func (v IPVersion) network() (n bootstrap.Network) {
+	switch v {
+	case IPVersionIPv4Only:
+		return bootstrap.NetworkIP4
+	case IPVersionIPv6Only:
+		return bootstrap.NetworkIP6
+	default:
+		return bootstrap.NetworkIP
+	}
+}
+
+// dialIPVersion returns the IP version preference to dial the upstream with.
+// o must not be nil.
+func (o *Options) dialIPVersion() (v IPVersion) {
+	if o.IPVersion == IPVersionDefault && o.PreferIPv6 {
+		return IPVersionPreferIPv6
+	}
+
+	return o.IPVersion
+}
@@ -0,0 +1,93 @@
+package upstream
+
+import (
+	"fmt"
+	"net/netip"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddressToUpstream_ipVersion(t *testing.T) {
+	srv := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		require.NoError(testutil.PanicT{}, w.WriteMsg(respondToTestMessage(req)))
+	})
+	testutil.CleanupAndRequireSuccess(t, srv.Close)
+
+	addr := fmt.Sprintf("tcp://some.dns.server:%d", srv.port)
+
+	// The server only listens on the IPv4 address.
+	bothFamilies := StaticResolver{netip.IPv6Loopback(), netutil.IPv4Localhost()}
+	onlyIPv4 := StaticResolver{netutil.IPv4Localhost()}
+
+	testCases := []struct {
+		rslv       Resolver
+		versions   map[string]IPVersion
+		name       string
+		version    IPVersion
+		wantErrMsg string
+	}{{
+		rslv:       bothFamilies,
+		versions:   nil,
+		name:       "default",
+		version:    IPVersionDefault,
+		wantErrMsg: "",
+	}, {
+		rslv:       bothFamilies,
+		versions:   nil,
+		name:       "prefer_ipv6",
+		version:    IPVersionPreferIPv6,
+		wantErrMsg: "",
+	}, {
+		rslv:       bothFamilies,
+		versions:   nil,
+		name:       "ipv4_only",
+		version:    IPVersionIPv4Only,
+		wantErrMsg: "",
+	}, {
+		rslv:     onlyIPv4,
+		versions: nil,
+		name:     "ipv6_only",
+		version:  IPVersionIPv6Only,
+		wantErrMsg: fmt.Sprintf(
+			"dialing %q: resolving hostname: no ip6 addresses",
+			fmt.Sprintf("some.dns.server:%d", srv.port),
+		),
+	}, {
+		rslv:       onlyIPv4,
+		versions:   map[string]IPVersion{addr: IPVersionIPv4Only},
+		name:       "override",
+		version:    IPVersionIPv6Only,
+		wantErrMsg: "",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			u, err := AddressToUpstream(addr, &Options{
+				Bootstrap:  tc.rslv,
+				Timeout:    timeout,
+				IPVersion:  tc.version,
+				IPVersions: tc.versions,
+			})
+			require.NoError(t, err)
+			testutil.CleanupAndRequireSuccess(t, u.Close)
+
+			if tc.wantErrMsg == "" {
+				checkUpstream(t, u, addr)
+
+				return
+			}
+
+			_, err = u.Exchange(createTestMessage())
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+		})
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := AddressToUpstream(addr, &Options{IPVersion: "ipv5-only"})
+		testutil.AssertErrorMsg(t, `ip version: unknown value "ipv5-only"`, err)
+	})
+}
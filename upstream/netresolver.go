@@ -0,0 +1,272 @@
+package upstream
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// NewNetResolver returns a *net.Resolver sending the queries to u, so that the
+// name resolution of the standard library, like [net.Resolver.LookupNetIP],
+// could use the upstreams of any protocol.  The returned resolver always uses
+// the pure Go resolver of the standard library, and the hosts file is still
+// consulted before the queries.  Closing u is the caller's responsibility.
+func NewNetResolver(u Upstream) (r *net.Resolver) {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (conn net.Conn, err error) {
+			return newNetResolverConn(ctx, u), nil
+		},
+	}
+}
+
+// netResolverAddr is the address of the both ends of a [netResolverConn].
+type netResolverAddr struct{}
+
+// type check
+var _ net.Addr = netResolverAddr{}
+
+// Network implements the [net.Addr] interface for netResolverAddr.
+func (netResolverAddr) Network() (n string) { return "dnsproxy" }
+
+// String implements the [net.Addr] interface for netResolverAddr.
+func (netResolverAddr) String() (s string) { return "dnsproxy" }
+
+// netResolverConn is the [net.Conn] returned by the dialer of the resolver
+// created with [NewNetResolver].  It handles the messages the same way the
+// connections over TCP do: each of those is prefixed with its length, and the
+// query is exchanged with the upstream once it's been fully written.
+type netResolverConn struct {
+	// ctx is the context of the dial, which the exchanges are canceled with.
+	ctx context.Context
+
+	// ups is the upstream the queries are exchanged with.
+	ups Upstream
+
+	// done is closed when the connection is closed.
+	done chan struct{}
+
+	// mu protects the fields below.
+	mu *sync.Mutex
+
+	// written are the bytes written but not yet exchanged.
+	written *bytes.Buffer
+
+	// resps are the channels the results of the pending exchanges are sent to,
+	// in the order of the queries.
+	resps []chan *netResolverResult
+
+	// read are the bytes of the received responses not yet read.
+	read *bytes.Buffer
+
+	// deadline is the read deadline.  Zero means no deadline.
+	deadline time.Time
+
+	// closed is true if the connection has been closed.
+	closed bool
+}
+
+// netResolverResult is the result of an exchange made by a [netResolverConn].
+type netResolverResult struct {
+	// resp is the packed response prefixed with its length.
+	resp []byte
+
+	// err is the error of the exchange.
+	err error
+}
+
+// newNetResolverConn returns a new properly initialized *netResolverConn.
+func newNetResolverConn(ctx context.Context, ups Upstream) (c *netResolverConn) {
+	return &netResolverConn{
+		ctx:     ctx,
+		ups:     ups,
+		done:    make(chan struct{}),
+		mu:      &sync.Mutex{},
+		written: &bytes.Buffer{},
+		read:    &bytes.Buffer{},
+	}
+}
+
+// type check
+var _ net.Conn = (*netResolverConn)(nil)
+
+// Write implements the [net.Conn] interface for *netResolverConn.  It starts
+// the exchange for each query fully written.
+func (c *netResolverConn) Write(b []byte) (n int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+
+	c.written.Write(b)
+	for c.written.Len() >= 2 {
+		l := int(binary.BigEndian.Uint16(c.written.Bytes()))
+		if c.written.Len() < 2+l {
+			break
+		}
+
+		c.written.Next(2)
+
+		req := &dns.Msg{}
+		err = req.Unpack(c.written.Next(l))
+		if err != nil {
+			return len(b), fmt.Errorf("unpacking query: %w", err)
+		}
+
+		ch := make(chan *netResolverResult, 1)
+		c.resps = append(c.resps, ch)
+		go c.exchange(req, ch)
+	}
+
+	return len(b), nil
+}
+
+// exchange exchanges req with the upstream and sends the result to ch.  It's
+// intended to be used as a goroutine.
+func (c *netResolverConn) exchange(req *dns.Msg, ch chan<- *netResolverResult) {
+	resp, err := c.ups.Exchange(req)
+	if err != nil {
+		ch <- &netResolverResult{err: err}
+
+		return
+	}
+
+	b, err := resp.Pack()
+	if err != nil {
+		ch <- &netResolverResult{err: fmt.Errorf("packing response: %w", err)}
+
+		return
+	}
+
+	ch <- &netResolverResult{
+		resp: append(binary.BigEndian.AppendUint16(nil, uint16(len(b))), b...),
+		err:  nil,
+	}
+}
+
+// Read implements the [net.Conn] interface for *netResolverConn.  It waits for
+// the result of the earliest pending exchange, if there are no unread
+// responses.
+func (c *netResolverConn) Read(b []byte) (n int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+
+	if c.read.Len() == 0 {
+		err = c.receive()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return c.read.Read(b)
+}
+
+// receive waits for the result of the earliest pending exchange and adds the
+// response to the unread ones.  c.mu is expected to be locked, and it's
+// unlocked while waiting.
+func (c *netResolverConn) receive() (err error) {
+	if len(c.resps) == 0 {
+		return io.EOF
+	}
+
+	ch, deadline := c.resps[0], c.deadline
+	c.resps = c.resps[1:]
+
+	c.mu.Unlock()
+	res, err := c.wait(ch, deadline)
+	c.mu.Lock()
+
+	if err != nil {
+		return err
+	} else if res.err != nil {
+		return res.err
+	}
+
+	c.read.Write(res.resp)
+
+	return nil
+}
+
+// wait waits for the result from ch until deadline, if it's not zero.
+func (c *netResolverConn) wait(
+	ch <-chan *netResolverResult,
+	deadline time.Time,
+) (res *netResolverResult, err error) {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+
+		timeout = timer.C
+	}
+
+	select {
+	case res = <-ch:
+		return res, nil
+	case <-timeout:
+		return nil, os.ErrDeadlineExceeded
+	case <-c.ctx.Done():
+		return nil, c.ctx.Err()
+	case <-c.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close implements the [net.Conn] interface for *netResolverConn.  The pending
+// exchanges aren't canceled, but their results are discarded.
+func (c *netResolverConn) Close() (err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return net.ErrClosed
+	}
+
+	c.closed = true
+	c.resps = nil
+	close(c.done)
+
+	return nil
+}
+
+// LocalAddr implements the [net.Conn] interface for *netResolverConn.
+func (c *netResolverConn) LocalAddr() (addr net.Addr) { return netResolverAddr{} }
+
+// RemoteAddr implements the [net.Conn] interface for *netResolverConn.
+func (c *netResolverConn) RemoteAddr() (addr net.Addr) { return netResolverAddr{} }
+
+// SetDeadline implements the [net.Conn] interface for *netResolverConn.  Only
+// the reads have deadlines, since the writes never block.
+func (c *netResolverConn) SetDeadline(t time.Time) (err error) {
+	return c.SetReadDeadline(t)
+}
+
+// SetReadDeadline implements the [net.Conn] interface for *netResolverConn.
+func (c *netResolverConn) SetReadDeadline(t time.Time) (err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.deadline = t
+
+	return nil
+}
+
+// SetWriteDeadline implements the [net.Conn] interface for *netResolverConn.
+// The writes never block, so it does nothing.
+func (c *netResolverConn) SetWriteDeadline(_ time.Time) (err error) {
+	return nil
+}
@@ -0,0 +1,94 @@
+package upstream
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/internal/dnsproxytest"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewNetResolver(t *testing.T) {
+	const host = "netresolver.example."
+
+	ip4 := netip.MustParseAddr("192.0.2.1")
+	ip6 := netip.MustParseAddr("2001:db8::1")
+
+	ups := &dnsproxytest.FakeUpstream{
+		OnAddress: func() (_ string) { panic("not implemented") },
+		OnClose:   func() (_ error) { panic("not implemented") },
+		OnExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			q := req.Question[0]
+			if q.Name != host {
+				return (&dns.Msg{}).SetRcode(req, dns.RcodeNameError), nil
+			}
+
+			resp = (&dns.Msg{}).SetReply(req)
+			hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: 60}
+			switch q.Qtype {
+			case dns.TypeA:
+				resp.Answer = []dns.RR{&dns.A{Hdr: hdr, A: ip4.AsSlice()}}
+			case dns.TypeAAAA:
+				resp.Answer = []dns.RR{&dns.AAAA{Hdr: hdr, AAAA: ip6.AsSlice()}}
+			}
+
+			return resp, nil
+		},
+	}
+
+	r := NewNetResolver(ups)
+	ctx := context.Background()
+
+	t.Run("success", func(t *testing.T) {
+		addrs, err := r.LookupNetIP(ctx, "ip", host)
+		require.NoError(t, err)
+
+		assert.ElementsMatch(t, []netip.Addr{ip4, ip6}, addrs)
+	})
+
+	t.Run("nxdomain", func(t *testing.T) {
+		_, err := r.LookupNetIP(ctx, "ip4", "nonexistent.example.")
+
+		dnsErr := &net.DNSError{}
+		require.ErrorAs(t, err, &dnsErr)
+
+		assert.True(t, dnsErr.IsNotFound)
+	})
+}
+
+func TestNetResolverConn_deadline(t *testing.T) {
+	unblock := make(chan struct{})
+	t.Cleanup(func() { close(unblock) })
+
+	ups := &dnsproxytest.FakeUpstream{
+		OnAddress: func() (_ string) { panic("not implemented") },
+		OnClose:   func() (_ error) { panic("not implemented") },
+		OnExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			<-unblock
+
+			return nil, errors.Error("unblocked")
+		},
+	}
+
+	conn := newNetResolverConn(context.Background(), ups)
+
+	b, err := (&dns.Msg{}).SetQuestion("deadline.example.", dns.TypeA).Pack()
+	require.NoError(t, err)
+
+	_, err = conn.Write(append([]byte{0, byte(len(b))}, b...))
+	require.NoError(t, err)
+
+	require.NoError(t, conn.SetDeadline(time.Now().Add(10*time.Millisecond)))
+
+	_, err = conn.Read(make([]byte, 2))
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+
+	require.NoError(t, conn.Close())
+}
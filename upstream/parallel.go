@@ -3,12 +3,13 @@ package upstream
 import (
 	"context"
 	"fmt"
+	"log/slog"
 	"net/netip"
 	"slices"
 	"time"
 
 	"github.com/AdguardTeam/golibs/errors"
-	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
 	"github.com/miekg/dns"
 )
 
@@ -24,21 +25,40 @@ const (
 // ExchangeParallel returns the dirst successful response from one of u.  It
 // returns an error if all upstreams failed to exchange the request.
 func ExchangeParallel(ups []Upstream, req *dns.Msg) (reply *dns.Msg, resolved Upstream, err error) {
+	return ExchangeParallelContext(context.Background(), ups, req)
+}
+
+// ExchangeParallelContext is like [ExchangeParallel], but the exchanges are
+// aborted once ctx is canceled, see [ExchangeContext].  The exchanges still in
+// progress once the first successful response is received aren't aborted, so
+// that their connections may be reused.
+func ExchangeParallelContext(
+	ctx context.Context,
+	ups []Upstream,
+	req *dns.Msg,
+) (reply *dns.Msg, resolved Upstream, err error) {
 	upsNum := len(ups)
 	switch upsNum {
 	case 0:
 		return nil, nil, ErrNoUpstreams
 	case 1:
-		reply, err = exchangeAndLog(ups[0], req)
+		reply, err = exchangeAndLog(ctx, ups[0], req)
 
 		return reply, ups[0], err
 	default:
 		// Go on.
 	}
 
+	// Detach the exchanges from ctx once the first successful response is
+	// received, so that the ones still in progress aren't aborted when ctx is
+	// canceled later.
+	exchCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	stop := context.AfterFunc(ctx, cancel)
+	defer stop()
+
 	resCh := make(chan any, upsNum)
 	for _, f := range ups {
-		go exchangeAsync(f, req, resCh)
+		go exchangeAsync(exchCtx, f, req, resCh)
 	}
 
 	errs := []error{}
@@ -83,7 +103,7 @@ func ExchangeAll(ups []Upstream, req *dns.Msg) (res []ExchangeAllResult, err err
 		return nil, ErrNoUpstreams
 	case 1:
 		var reply *dns.Msg
-		reply, err = exchangeAndLog(ups[0], req)
+		reply, err = exchangeAndLog(context.Background(), ups[0], req)
 		if err != nil {
 			return nil, err
 		} else if reply == nil {
@@ -102,7 +122,7 @@ func ExchangeAll(ups []Upstream, req *dns.Msg) (res []ExchangeAllResult, err err
 
 	// Start exchanging concurrently.
 	for _, u := range ups {
-		go exchangeAsync(u, req, resCh)
+		go exchangeAsync(context.Background(), u, req, resCh)
 	}
 
 	// Wait for all exchanges to finish.
@@ -141,9 +161,9 @@ func receiveAsyncResult(resCh chan any) (res *ExchangeAllResult, err error) {
 }
 
 // exchangeAsync tries to resolve DNS request with one upstream and sends the
-// result to respCh.
-func exchangeAsync(u Upstream, req *dns.Msg, resCh chan any) {
-	reply, err := exchangeAndLog(u, req)
+// result to respCh.  The exchange is aborted once ctx is canceled.
+func exchangeAsync(ctx context.Context, u Upstream, req *dns.Msg, resCh chan any) {
+	reply, err := exchangeAndLog(ctx, u, req)
 	if err != nil {
 		resCh <- err
 	} else {
@@ -151,20 +171,27 @@ func exchangeAsync(u Upstream, req *dns.Msg, resCh chan any) {
 	}
 }
 
-// exchangeAndLog wraps the [Upstream.Exchange] method with logging.
-func exchangeAndLog(u Upstream, req *dns.Msg) (resp *dns.Msg, err error) {
+// exchangeAndLog wraps [ExchangeContext] with logging.
+func exchangeAndLog(ctx context.Context, u Upstream, req *dns.Msg) (resp *dns.Msg, err error) {
 	addr := u.Address()
 	req = req.Copy()
 
 	start := time.Now()
-	reply, err := u.Exchange(req)
+	reply, err := ExchangeContext(ctx, u, req)
 	dur := time.Since(start)
 
 	if len(req.Question) > 0 {
+		l := slog.Default()
 		if q := &req.Question[0]; err == nil {
-			log.Debug("dnsproxy: upstream %s exchanged %s successfully in %s", addr, q, dur)
+			l.Debug("upstream exchange succeeded", "addr", addr, "question", q, "elapsed", dur)
 		} else {
-			log.Debug("dnsproxy: upstream %s failed to exchange %s in %s: %s", addr, q, dur, err)
+			l.Debug(
+				"upstream exchange failed",
+				"addr", addr,
+				"question", q,
+				"elapsed", dur,
+				slogutil.KeyError, err,
+			)
 		}
 	}
 
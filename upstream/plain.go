@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"log/slog"
 	"net"
 	"net/url"
 	"strings"
@@ -11,7 +12,7 @@ import (
 
 	"github.com/AdguardTeam/dnsproxy/internal/bootstrap"
 	"github.com/AdguardTeam/golibs/errors"
-	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
 	"github.com/miekg/dns"
 )
 
@@ -37,9 +38,38 @@ type plainDNS struct {
 	// one.
 	getDialer DialerInitializer
 
+	// logger is used for exchange logging.  It is never nil.
+	logger *slog.Logger
+
+	// tcpConns stores the TCP connections ready for reuse.  It's nil if the
+	// TCP connections aren't reused, see [Options.ConnPool].
+	tcpConns *connPool
+
+	// udpConns stores the UDP sockets bound to the random source ports ready
+	// for reuse.  It's nil if the UDP sockets aren't reused, see
+	// [Options.UDPPorts].
+	udpConns *connPool
+
+	// udpPorts is the configuration of udpConns.  It's nil if udpConns is
+	// nil.
+	udpPorts *UDPPortPoolConfig
+
+	// ednsPath is the characteristics of the path to the upstream used to
+	// adapt the advertised EDNS buffer size.  It's nil if the adaptive sizing
+	// is disabled or the network is TCP, see [Options.EDNSBuffer].
+	ednsPath *ednsPath
+
+	// tsig is the key the requests are signed with.  It's nil if the requests
+	// aren't signed.
+	tsig *TSIGKey
+
 	// net is the network of the connections.
 	net network
 
+	// maxPtrs is the maximum number of the compression pointers in a domain
+	// name of a response, see [Options.MaxCompressionPointers].
+	maxPtrs uint
+
 	// timeout is the timeout for DNS requests.
 	timeout time.Duration
 }
@@ -56,16 +86,59 @@ func newPlain(addr *url.URL, opts *Options) (u *plainDNS, err error) {
 
 	addPort(addr, defaultPortPlain)
 
-	return &plainDNS{
+	err = opts.UDPPorts.validate()
+	if err != nil {
+		return nil, fmt.Errorf("udp ports: %w", err)
+	}
+
+	err = opts.EDNSBuffer.validate()
+	if err != nil {
+		return nil, fmt.Errorf("edns buffer: %w", err)
+	}
+
+	if opts.TSIGKey != nil {
+		err = opts.TSIGKey.Validate()
+		if err != nil {
+			return nil, fmt.Errorf("tsig key: %w", err)
+		}
+	}
+
+	u = &plainDNS{
 		addr:      addr,
 		getDialer: newDialerInitializer(addr, opts),
+		logger:    opts.Logger,
+		tsig:      opts.TSIGKey,
 		net:       addr.Scheme,
 		timeout:   opts.Timeout,
-	}, nil
+		maxPtrs:   opts.MaxCompressionPointers,
+	}
+
+	if opts.ConnPool != nil {
+		u.tcpConns = newConnPool(opts.ConnPool, opts.Logger)
+		if u.net == networkTCP && opts.ConnPool.Prewarm > 0 {
+			go u.prewarm(networkTCP)
+		}
+	}
+
+	if u.net == networkUDP {
+		u.ednsPath = newEDNSPath(opts.EDNSBuffer)
+	}
+
+	if opts.UDPPorts != nil && u.net == networkUDP {
+		u.udpPorts = opts.UDPPorts
+		u.udpConns = newConnPool(opts.UDPPorts.connPoolConfig(), opts.Logger)
+		go u.prewarm(networkUDP)
+	}
+
+	return u, nil
 }
 
 // type check
-var _ Upstream = &plainDNS{}
+var (
+	_ Upstream     = &plainDNS{}
+	_ TCPExchanger = &plainDNS{}
+	_ Transferer   = &plainDNS{}
+)
 
 // Address implements the [Upstream] interface for *plainDNS.
 func (p *plainDNS) Address() string {
@@ -80,48 +153,191 @@ func (p *plainDNS) Address() string {
 }
 
 // dialExchange performs a DNS exchange with the specified dial handler.
-// network must be either [networkUDP] or [networkTCP].
+// network must be either [networkUDP] or [networkTCP].  The exchange is aborted
+// once ctx is canceled.
 func (p *plainDNS) dialExchange(
+	ctx context.Context,
 	network network,
 	dial bootstrap.DialHandler,
 	req *dns.Msg,
 ) (resp *dns.Msg, err error) {
+	if p.tsig != nil {
+		req = p.tsig.sign(req)
+		defer func() {
+			if err == nil {
+				err = p.tsig.checkSigned(resp)
+			}
+		}()
+	}
+
+	if network == networkTCP && p.tcpConns != nil {
+		return p.pooledExchange(ctx, networkTCP, dial, req)
+	} else if network == networkUDP && p.udpConns != nil {
+		return p.pooledExchange(ctx, networkUDP, dial, req)
+	}
+
 	addr := p.Address()
-	client := &dns.Client{Timeout: p.timeout}
+	client := p.newClient()
 
 	conn := &dns.Conn{}
 	if network == networkUDP {
 		conn.UDPSize = dns.MinMsgSize
 	}
 
-	logBegin(addr, network, req)
-	defer func() { logFinish(addr, network, err) }()
+	logBegin(p.logger, addr, network, req)
+	defer func() { logFinish(p.logger, addr, network, err) }()
 
-	ctx := context.Background()
 	conn.Conn, err = dial(ctx, network, "")
 	if err != nil {
 		return nil, fmt.Errorf("dialing %s over %s: %w", p.addr.Host, network, err)
 	}
 	defer func(c net.Conn) { err = errors.WithDeferred(err, c.Close()) }(conn.Conn)
 
-	resp, _, err = client.ExchangeWithConn(req, conn)
-	if isExpectedConnErr(err) {
+	conn.Conn = withCompressionCheck(conn.Conn, p.maxPtrs)
+
+	resp, err = exchangeWithConn(ctx, client, req, conn)
+	if isExpectedConnErr(err) && ctx.Err() == nil {
 		conn.Conn, err = dial(ctx, network, "")
 		if err != nil {
 			return nil, fmt.Errorf("dialing %s over %s again: %w", p.addr.Host, network, err)
 		}
 		defer func(c net.Conn) { err = errors.WithDeferred(err, c.Close()) }(conn.Conn)
 
-		resp, _, err = client.ExchangeWithConn(req, conn)
+		conn.Conn = withCompressionCheck(conn.Conn, p.maxPtrs)
+
+		resp, err = exchangeWithConn(ctx, client, req, conn)
+	}
+
+	if err != nil {
+		return resp, fmt.Errorf("exchanging with %s over %s: %w", addr, network, err)
+	}
+
+	return resp, validatePlainResponse(req, resp)
+}
+
+// exchangeWithConn exchanges req over conn using client.  The exchange is
+// aborted by closing conn once ctx is canceled, in which case the error of ctx
+// is returned.
+func exchangeWithConn(
+	ctx context.Context,
+	client *dns.Client,
+	req *dns.Msg,
+	conn *dns.Conn,
+) (resp *dns.Msg, err error) {
+	stop := abortOnDone(ctx, conn)
+	resp, _, err = client.ExchangeWithConn(req, conn)
+	if !stop() {
+		return nil, ctx.Err()
+	}
+
+	return resp, err
+}
+
+// newClient returns a new DNS client for a single exchange.
+func (p *plainDNS) newClient() (c *dns.Client) {
+	c = &dns.Client{Timeout: p.timeout}
+	if p.tsig != nil {
+		c.TsigSecret = p.tsig.secrets()
+	}
+
+	return c
+}
+
+// pooledExchange performs a DNS exchange over network using a connection from
+// the pool, if there is any, or dialing a new one with dial otherwise.  The
+// pool of network must not be nil.  The exchange is aborted once ctx is
+// canceled.
+func (p *plainDNS) pooledExchange(
+	ctx context.Context,
+	network network,
+	dial bootstrap.DialHandler,
+	req *dns.Msg,
+) (resp *dns.Msg, err error) {
+	addr := p.Address()
+	client := p.newClient()
+
+	logBegin(p.logger, addr, network, req)
+	defer func() { logFinish(p.logger, addr, network, err) }()
+
+	if p.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.timeout)
+		defer cancel()
+	}
+
+	pool, dialConn := p.poolFor(ctx, network, dial)
+	conn, reused, err := pool.get(ctx, dialConn)
+	if err != nil {
+		return nil, fmt.Errorf("dialing %s over %s: %w", p.addr.Host, network, err)
+	}
+
+	resp, err = exchangeWithConn(ctx, client, req, p.newPooledDNSConn(network, conn))
+	if reused && isExpectedConnErr(err) && ctx.Err() == nil {
+		// The pooled connection might have been closed by the server, so dial
+		// a new one.
+		pool.closeConn(conn)
+
+		conn, err = pool.dial(ctx, dialConn)
+		if err != nil {
+			return nil, fmt.Errorf("dialing %s over %s again: %w", p.addr.Host, network, err)
+		}
+
+		resp, err = exchangeWithConn(ctx, client, req, p.newPooledDNSConn(network, conn))
 	}
 
 	if err != nil {
+		pool.closeConn(conn)
+
 		return resp, fmt.Errorf("exchanging with %s over %s: %w", addr, network, err)
 	}
 
+	pool.put(conn)
+
 	return resp, validatePlainResponse(req, resp)
 }
 
+// poolFor returns the pool of the connections over network and the function
+// dialing the new ones with dial.  ctx is used for dialing.
+func (p *plainDNS) poolFor(
+	ctx context.Context,
+	network network,
+	dial bootstrap.DialHandler,
+) (pool *connPool, dialConn func() (conn net.Conn, err error)) {
+	if network == networkUDP {
+		return p.udpConns, p.udpPorts.randomPortDial(ctx, dial)
+	}
+
+	return p.tcpConns, func() (conn net.Conn, err error) { return dial(ctx, networkTCP, "") }
+}
+
+// newPooledDNSConn returns a new DNS connection over network wrapping conn.  It
+// uses the underlying connection, since [dns.Conn] only uses the datagram
+// framing for the [net.PacketConn] ones.
+func (p *plainDNS) newPooledDNSConn(network network, conn *pooledConn) (c *dns.Conn) {
+	c = &dns.Conn{Conn: withCompressionCheck(conn.Conn, p.maxPtrs)}
+	if network == networkUDP {
+		c.UDPSize = dns.MinMsgSize
+	}
+
+	return c
+}
+
+// prewarm dials the connections over network to put into the pool in advance.
+// It's intended to be used as a goroutine.
+func (p *plainDNS) prewarm(network network) {
+	defer slogutil.RecoverAndLog(context.Background(), p.logger)
+
+	dial, err := p.getDialer()
+	if err != nil {
+		p.logger.Debug("prewarming conns", "addr", p.addr, slogutil.KeyError, err)
+
+		return
+	}
+
+	pool, dialConn := p.poolFor(context.Background(), network, dial)
+	pool.prewarm(dialConn)
+}
+
 // isExpectedConnErr returns true if the error is expected.  In this case,
 // we will make a second attempt to process the request.
 func isExpectedConnErr(err error) (is bool) {
@@ -132,6 +348,19 @@ func isExpectedConnErr(err error) (is bool) {
 
 // Exchange implements the [Upstream] interface for *plainDNS.
 func (p *plainDNS) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	return p.ExchangeContext(context.Background(), req)
+}
+
+// type check
+var _ ContextExchanger = (*plainDNS)(nil)
+
+// ExchangeContext implements the [ContextExchanger] interface for *plainDNS.
+func (p *plainDNS) ExchangeContext(
+	ctx context.Context,
+	req *dns.Msg,
+) (resp *dns.Msg, err error) {
+	defer func() { err = classify(err) }()
+
 	dial, err := p.getDialer()
 	if err != nil {
 		// Don't wrap the error since it's informative enough as is.
@@ -140,12 +369,12 @@ func (p *plainDNS) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
 
 	addr := p.Address()
 
-	resp, err = p.dialExchange(p.net, dial, req)
 	if p.net != networkUDP {
-		// The network is already TCP.
-		return resp, err
+		return p.dialExchange(ctx, networkTCP, dial, req)
 	}
 
+	resp, err = p.exchangeUDP(ctx, dial, req)
+
 	if resp == nil {
 		// There is likely an error with the upstream.
 		return resp, err
@@ -153,14 +382,14 @@ func (p *plainDNS) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
 
 	if errors.Is(err, errQuestion) {
 		// The upstream responds with malformed messages, so try TCP.
-		log.Debug("plain %s: %s, using tcp", addr, err)
+		p.logger.Debug("malformed response, using tcp", "addr", addr, slogutil.KeyError, err)
 
-		return p.dialExchange(networkTCP, dial, req)
+		return p.dialExchange(ctx, networkTCP, dial, req)
 	} else if resp.Truncated {
 		// Fallback to TCP on truncated responses.
-		log.Debug("plain %s: resp for %s is truncated, using tcp", &req.Question[0], addr)
+		p.logger.Debug("truncated response, using tcp", "question", &req.Question[0], "addr", addr)
 
-		return p.dialExchange(networkTCP, dial, req)
+		return p.dialExchange(ctx, networkTCP, dial, req)
 	}
 
 	// There is either no error or the error isn't related to the received
@@ -168,9 +397,60 @@ func (p *plainDNS) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
 	return resp, err
 }
 
+// ExchangeTCP implements the [TCPExchanger] interface for *plainDNS.
+func (p *plainDNS) ExchangeTCP(req *dns.Msg) (resp *dns.Msg, err error) {
+	dial, err := p.getDialer()
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	return p.dialExchange(context.Background(), networkTCP, dial, req)
+}
+
+// Transfer implements the [Transferer] interface for *plainDNS.
+func (p *plainDNS) Transfer(req *dns.Msg) (ch <-chan *dns.Envelope, err error) {
+	dial, err := p.getDialer()
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	conn, err := dial(context.Background(), networkTCP, "")
+	if err != nil {
+		return nil, fmt.Errorf("dialing %s over %s: %w", p.addr.Host, networkTCP, err)
+	}
+
+	t := &dns.Transfer{
+		Conn:         &dns.Conn{Conn: conn},
+		ReadTimeout:  p.timeout,
+		WriteTimeout: p.timeout,
+	}
+	if p.tsig != nil {
+		t.TsigSecret = p.tsig.secrets()
+		req = p.tsig.sign(req)
+	}
+
+	envs, err := t.In(req, p.addr.Host)
+	if err != nil {
+		return nil, errors.WithDeferred(fmt.Errorf("requesting transfer: %w", err), conn.Close())
+	}
+
+	return envs, nil
+}
+
 // Close implements the [Upstream] interface for *plainDNS.
 func (p *plainDNS) Close() (err error) {
-	return nil
+	var errs []error
+	if p.tcpConns != nil {
+		errs = append(errs, p.tcpConns.close())
+	}
+
+	if p.udpConns != nil {
+		errs = append(errs, p.udpConns.close())
+	}
+
+	return errors.Join(errs...)
 }
 
 // errQuestion is returned when a message has malformed question section.
@@ -178,9 +458,14 @@ const errQuestion errors.Error = "bad question section"
 
 // validatePlainResponse validates resp from an upstream DNS server for
 // compliance with req.  Any error returned wraps [ErrQuestion], since it
-// essentially validates the question section of resp.
+// essentially validates the question section of resp.  The zone section of the
+// response to a dynamic update is allowed to be empty, since some servers omit
+// it, for example, when they don't support the updates.
 func validatePlainResponse(req, resp *dns.Msg) (err error) {
-	if qlen := len(resp.Question); qlen != 1 {
+	qlen := len(resp.Question)
+	if qlen == 0 && req.Opcode == dns.OpcodeUpdate {
+		return nil
+	} else if qlen != 1 {
 		return fmt.Errorf("%w: only 1 question allowed; got %d", errQuestion, qlen)
 	}
 
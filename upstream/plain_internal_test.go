@@ -1,6 +1,7 @@
 package upstream
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net"
@@ -8,6 +9,7 @@ import (
 	"testing"
 	"time"
 
+	proxynetutil "github.com/AdguardTeam/dnsproxy/internal/netutil"
 	"github.com/AdguardTeam/golibs/errors"
 	"github.com/AdguardTeam/golibs/testutil"
 	"github.com/miekg/dns"
@@ -36,6 +38,156 @@ func TestUpstream_plainDNS(t *testing.T) {
 	}
 }
 
+func TestUpstream_plainDNS_fastOpen(t *testing.T) {
+	srv := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		require.NoError(testutil.PanicT{}, w.WriteMsg(respondToTestMessage(req)))
+	})
+	testutil.CleanupAndRequireSuccess(t, srv.Close)
+
+	addr := fmt.Sprintf("tcp://127.0.0.1:%d", srv.port)
+	u, err := AddressToUpstream(addr, &Options{TCPFastOpen: true})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	for range 3 {
+		checkUpstream(t, u, addr)
+	}
+}
+
+func TestUpstream_plainDNS_multipathTCP(t *testing.T) {
+	srv := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		require.NoError(testutil.PanicT{}, w.WriteMsg(respondToTestMessage(req)))
+	})
+	testutil.CleanupAndRequireSuccess(t, srv.Close)
+
+	// The server doesn't support Multipath TCP, so the connections should fall
+	// back to the regular TCP.
+	for _, proto := range []string{"udp", "tcp"} {
+		addr := fmt.Sprintf("%s://127.0.0.1:%d", proto, srv.port)
+
+		t.Run(proto, func(t *testing.T) {
+			u, err := AddressToUpstream(addr, &Options{MultipathTCP: true})
+			require.NoError(t, err)
+			testutil.CleanupAndRequireSuccess(t, u.Close)
+
+			checkUpstream(t, u, addr)
+		})
+	}
+}
+
+func TestUpstream_plainDNS_dialContext(t *testing.T) {
+	srv := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		require.NoError(testutil.PanicT{}, w.WriteMsg(respondToTestMessage(req)))
+	})
+	testutil.CleanupAndRequireSuccess(t, srv.Close)
+
+	for _, proto := range []string{"udp", "tcp"} {
+		addr := fmt.Sprintf("%s://127.0.0.1:%d", proto, srv.port)
+
+		t.Run(proto, func(t *testing.T) {
+			// networks are the networks of the dialed connections.
+			var networks []string
+			d := &net.Dialer{}
+
+			u, err := AddressToUpstream(addr, &Options{
+				DialContext: func(
+					ctx context.Context,
+					network string,
+					dialAddr string,
+				) (conn net.Conn, err error) {
+					networks = append(networks, network)
+
+					return d.DialContext(ctx, network, dialAddr)
+				},
+			})
+			require.NoError(t, err)
+			testutil.CleanupAndRequireSuccess(t, u.Close)
+
+			checkUpstream(t, u, addr)
+
+			assert.Equal(t, []string{proto}, networks)
+		})
+	}
+}
+
+func TestUpstream_plainDNS_dscp(t *testing.T) {
+	if !proxynetutil.DSCPSupported {
+		t.Skip("marking packets with dscp is not supported")
+	}
+
+	srv := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		require.NoError(testutil.PanicT{}, w.WriteMsg(respondToTestMessage(req)))
+	})
+	testutil.CleanupAndRequireSuccess(t, srv.Close)
+
+	for _, proto := range []string{"udp", "tcp"} {
+		addr := fmt.Sprintf("%s://127.0.0.1:%d", proto, srv.port)
+
+		t.Run(proto, func(t *testing.T) {
+			u, err := AddressToUpstream(addr, &Options{DSCP: 46})
+			require.NoError(t, err)
+			testutil.CleanupAndRequireSuccess(t, u.Close)
+
+			checkUpstream(t, u, addr)
+		})
+
+		t.Run(proto+"_invalid", func(t *testing.T) {
+			u, err := AddressToUpstream(addr, &Options{DSCP: 64})
+			require.NoError(t, err)
+			testutil.CleanupAndRequireSuccess(t, u.Close)
+
+			_, err = u.Exchange(createTestMessage())
+			assert.ErrorContains(t, err, "dscp: value 64 is greater than 63")
+		})
+	}
+}
+
+func TestUpstream_plainDNS_interface(t *testing.T) {
+	if !proxynetutil.BindToInterfaceSupported {
+		t.Skip("binding to interface is not supported")
+	}
+
+	ifaces, err := net.Interfaces()
+	require.NoError(t, err)
+
+	var loopback string
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 {
+			loopback = iface.Name
+
+			break
+		}
+	}
+	require.NotEmpty(t, loopback)
+
+	srv := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		require.NoError(testutil.PanicT{}, w.WriteMsg(respondToTestMessage(req)))
+	})
+	testutil.CleanupAndRequireSuccess(t, srv.Close)
+
+	for _, proto := range []string{"udp", "tcp"} {
+		addr := fmt.Sprintf("%s://127.0.0.1:%d", proto, srv.port)
+
+		t.Run(proto, func(t *testing.T) {
+			u, uErr := AddressToUpstream(addr, &Options{Interface: loopback})
+			require.NoError(t, uErr)
+			testutil.CleanupAndRequireSuccess(t, u.Close)
+
+			checkUpstream(t, u, addr)
+		})
+	}
+
+	t.Run("missing", func(t *testing.T) {
+		addr := fmt.Sprintf("127.0.0.1:%d", srv.port)
+		u, uErr := AddressToUpstream(addr, &Options{Interface: "dnsproxy-missing0"})
+		require.NoError(t, uErr)
+		testutil.CleanupAndRequireSuccess(t, u.Close)
+
+		_, err = u.Exchange(createTestMessage())
+		assert.Error(t, err)
+	})
+}
+
 func TestUpstream_plainDNS_badID(t *testing.T) {
 	req := createTestMessage()
 	badIDResp := respondToTestMessage(req)
@@ -138,6 +290,57 @@ func TestUpstream_plainDNS_fallbackToTCP(t *testing.T) {
 	}
 }
 
+func TestUpstream_plainDNS_exchangeTCP(t *testing.T) {
+	var udpReqNum, tcpReqNum atomic.Uint32
+	srv := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		if w.RemoteAddr().Network() == networkUDP {
+			udpReqNum.Add(1)
+		} else {
+			tcpReqNum.Add(1)
+		}
+
+		require.NoError(testutil.PanicT{}, w.WriteMsg(respondToTestMessage(req)))
+	})
+	testutil.CleanupAndRequireSuccess(t, srv.Close)
+
+	addr := fmt.Sprintf("127.0.0.1:%d", srv.port)
+	u, err := AddressToUpstream(addr, &Options{Timeout: timeout})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	require.Implements(t, (*TCPExchanger)(nil), u)
+
+	req := createTestMessage()
+	resp, err := u.(TCPExchanger).ExchangeTCP(req)
+	require.NoError(t, err)
+	requireResponse(t, req, resp)
+
+	assert.Zero(t, udpReqNum.Load())
+	assert.Equal(t, 1, int(tcpReqNum.Load()))
+}
+
+func TestUpstream_plainDNS_update(t *testing.T) {
+	// The server rejects the updates with the default message acceptance
+	// function, which responds with an empty question section.
+	srv := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		panic("unexpected request")
+	})
+	testutil.CleanupAndRequireSuccess(t, srv.Close)
+
+	u, err := AddressToUpstream(fmt.Sprintf("127.0.0.1:%d", srv.port), &Options{
+		Timeout: timeout,
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	req := (&dns.Msg{}).SetUpdate("example.org.")
+	resp, err := u.Exchange(req)
+	require.NoError(t, err)
+
+	assert.Empty(t, resp.Question)
+	assert.Equal(t, dns.RcodeNotImplemented, resp.Rcode)
+}
+
 // testDNSServer is a simple DNS server that can be used in unit-tests.
 type testDNSServer struct {
 	udpListener net.PacketConn
@@ -0,0 +1,709 @@
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/internal/bootstrap"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/miekg/dns"
+)
+
+const (
+	// recursiveMaxSteps is the maximum number of the queries sent to resolve a
+	// single name, including the minimized ones and the followed referrals.
+	recursiveMaxSteps = 64
+
+	// recursiveMaxDepth is the maximum depth of the nested resolutions of the
+	// name server addresses and the CNAME targets.
+	recursiveMaxDepth = 8
+
+	// recursiveMaxQueries is the maximum total number of the queries sent to
+	// the name servers for a single exchange.
+	recursiveMaxQueries = 256
+
+	// recursiveMaxCNAMEs is the maximum length of a CNAME chain followed.
+	recursiveMaxCNAMEs = 16
+
+	// recursiveMaxNSResolved is the maximum number of the name servers without
+	// glue which addresses are resolved for a single referral.
+	recursiveMaxNSResolved = 3
+
+	// recursiveMaxDelegations is the maximum number of the cached delegations.
+	// The cache is cleared once it's exceeded.
+	recursiveMaxDelegations = 10_000
+
+	// recursiveMaxDelegationTTL is the maximum time a delegation is cached
+	// for.
+	recursiveMaxDelegationTTL = 24 * time.Hour
+
+	// recursiveUDPSize is the EDNS(0) UDP payload size advertised to the name
+	// servers.  It's the value recommended by the DNS Flag Day 2020.
+	recursiveUDPSize = 1232
+)
+
+// defaultRootHints are the addresses of the root name servers published by
+// IANA, see https://www.iana.org/domains/root/servers.
+var defaultRootHints = []netip.AddrPort{
+	netip.MustParseAddrPort("198.41.0.4:53"),
+	netip.MustParseAddrPort("170.247.170.2:53"),
+	netip.MustParseAddrPort("192.33.4.12:53"),
+	netip.MustParseAddrPort("199.7.91.13:53"),
+	netip.MustParseAddrPort("192.203.230.10:53"),
+	netip.MustParseAddrPort("192.5.5.241:53"),
+	netip.MustParseAddrPort("192.112.36.4:53"),
+	netip.MustParseAddrPort("198.97.190.53:53"),
+	netip.MustParseAddrPort("192.36.148.17:53"),
+	netip.MustParseAddrPort("192.58.128.30:53"),
+	netip.MustParseAddrPort("193.0.14.129:53"),
+	netip.MustParseAddrPort("199.7.83.42:53"),
+	netip.MustParseAddrPort("202.12.27.33:53"),
+	netip.MustParseAddrPort("[2001:503:ba3e::2:30]:53"),
+	netip.MustParseAddrPort("[2801:1b8:10::b]:53"),
+	netip.MustParseAddrPort("[2001:500:2::c]:53"),
+	netip.MustParseAddrPort("[2001:500:2d::d]:53"),
+	netip.MustParseAddrPort("[2001:500:a8::e]:53"),
+	netip.MustParseAddrPort("[2001:500:2f::f]:53"),
+	netip.MustParseAddrPort("[2001:500:12::d0d]:53"),
+	netip.MustParseAddrPort("[2001:500:1::53]:53"),
+	netip.MustParseAddrPort("[2001:7fe::53]:53"),
+	netip.MustParseAddrPort("[2001:503:c27::2:30]:53"),
+	netip.MustParseAddrPort("[2001:7fd::1]:53"),
+	netip.MustParseAddrPort("[2001:500:9f::42]:53"),
+	netip.MustParseAddrPort("[2001:dc3::35]:53"),
+}
+
+// serverExchangeFunc sends req to the name server and returns its response.
+type serverExchangeFunc func(server netip.AddrPort, req *dns.Msg) (resp *dns.Msg, err error)
+
+// recursive is an [Upstream] which resolves the names iteratively, starting
+// from the root name servers and following the referrals down to the
+// authoritative ones.  The names are minimized as described by RFC 9156.
+// DNSSEC is not validated.
+type recursive struct {
+	// logger is used to log the resolution process.
+	logger *slog.Logger
+
+	// exchange sends the queries to the name servers.
+	exchange serverExchangeFunc
+
+	// delegations caches the name servers by the zones delegated to them.
+	delegations *delegationCache
+
+	// opts are used to dial the name servers.
+	opts *Options
+
+	// rootHints are the addresses of the root name servers.
+	rootHints []netip.AddrPort
+
+	// ipVersion is the preference of the address family of the name servers.
+	ipVersion IPVersion
+}
+
+// newRecursive returns a new recursive upstream.  addr must have no host or
+// path, since the name servers are discovered from the root ones.
+func newRecursive(addr *url.URL, opts *Options) (u *recursive, err error) {
+	if addr.Host != "" || strings.Trim(addr.Path, "/") != "" {
+		return nil, fmt.Errorf("recursive upstream must have no address, got %q", addr)
+	}
+
+	rootHints := opts.RootHints
+	if len(rootHints) == 0 {
+		rootHints = defaultRootHints
+	}
+
+	u = &recursive{
+		logger:      opts.Logger,
+		delegations: newDelegationCache(),
+		opts:        opts,
+		ipVersion:   opts.dialIPVersion(),
+	}
+	u.rootHints = u.filterServers(rootHints)
+	if len(u.rootHints) == 0 {
+		return nil, fmt.Errorf("no root hints of ip version %q", u.ipVersion)
+	}
+
+	u.exchange = u.exchangeServer
+
+	return u, nil
+}
+
+// type check
+var _ Upstream = (*recursive)(nil)
+
+// Address implements the [Upstream] interface for *recursive.
+func (r *recursive) Address() (addr string) { return "recursive://" }
+
+// Close implements the [Upstream] interface for *recursive.
+func (r *recursive) Close() (err error) { return nil }
+
+// resolution is the state of resolving a single request.
+type resolution struct {
+	// queries is the number of the queries sent.
+	queries int
+}
+
+// type check
+var _ ContextExchanger = (*recursive)(nil)
+
+// ExchangeContext implements the [ContextExchanger] interface for *recursive.
+// The resolution in progress isn't aborted, but its result is discarded once
+// ctx is canceled.
+func (r *recursive) ExchangeContext(
+	ctx context.Context,
+	req *dns.Msg,
+) (resp *dns.Msg, err error) {
+	return awaitExchange(ctx, r.Exchange, req)
+}
+
+// Exchange implements the [Upstream] interface for *recursive.
+func (r *recursive) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	if qlen := len(req.Question); qlen != 1 {
+		return nil, fmt.Errorf("%w: only 1 question allowed; got %d", errQuestion, qlen)
+	}
+
+	q := req.Question[0]
+	st := &resolution{}
+
+	res, answer, err := r.resolveChain(st, dns.CanonicalName(q.Name), q.Qtype)
+	if err != nil {
+		return nil, fmt.Errorf("resolving %q: %w", q.Name, err)
+	}
+
+	resp = (&dns.Msg{}).SetRcode(req, res.Rcode)
+	resp.RecursionAvailable = true
+	resp.Answer = answer
+	resp.Ns = res.Ns
+	for _, rr := range res.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			resp.Extra = append(resp.Extra, rr)
+		}
+	}
+
+	if req.IsEdns0() != nil {
+		resp.SetEdns0(dns.DefaultMsgSize, false)
+	}
+
+	return resp, nil
+}
+
+// resolveChain resolves name of qtype following the CNAME chain, if any.  res
+// is the last response received, and answer contains the answers of all the
+// responses in the chain.
+func (r *recursive) resolveChain(
+	st *resolution,
+	name string,
+	qtype uint16,
+) (res *dns.Msg, answer []dns.RR, err error) {
+	for range recursiveMaxCNAMEs {
+		res, err = r.resolve(st, name, qtype, 0)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		answer = append(answer, res.Answer...)
+
+		target := cnameTarget(res.Answer, name, qtype)
+		if target == "" || res.Rcode != dns.RcodeSuccess {
+			return res, answer, nil
+		}
+
+		r.logger.Debug("following cname", "name", name, "target", target)
+
+		name = target
+	}
+
+	return nil, nil, errors.Error("cname chain is too long")
+}
+
+// cnameTarget returns the name the CNAME chain for name ends with in answer,
+// unless it's already resolved to records of qtype or qtype is CNAME or ANY.
+func cnameTarget(answer []dns.RR, name string, qtype uint16) (target string) {
+	if qtype == dns.TypeCNAME || qtype == dns.TypeANY {
+		return ""
+	}
+
+	// Limit the iterations in case of the CNAME loops within answer.
+	for range len(answer) + 1 {
+		next := ""
+		for _, rr := range answer {
+			hdr := rr.Header()
+			if !strings.EqualFold(hdr.Name, name) {
+				continue
+			}
+
+			if hdr.Rrtype == qtype {
+				return ""
+			} else if cname, ok := rr.(*dns.CNAME); ok {
+				next = dns.CanonicalName(cname.Target)
+			}
+		}
+
+		if next == "" {
+			break
+		}
+
+		target, name = next, next
+	}
+
+	return target
+}
+
+// resolve resolves name of qtype iteratively without following CNAMEs.  depth
+// is the depth of the nested resolution.
+func (r *recursive) resolve(
+	st *resolution,
+	name string,
+	qtype uint16,
+	depth int,
+) (resp *dns.Msg, err error) {
+	if depth > recursiveMaxDepth {
+		return nil, errors.Error("resolution is too deep")
+	}
+
+	zone, servers := r.closestDelegation(name)
+
+	// known is the longest ancestor of name which is known to be served by
+	// servers.
+	known := zone
+	minimize := true
+	for range recursiveMaxSteps {
+		qname, qt := name, qtype
+		if minimize {
+			qname = childName(known, name)
+		}
+
+		minimized := qname != name
+		if minimized {
+			// Use A for the minimized queries, since some servers don't handle
+			// NS well, see RFC 9156 Section 2.1.
+			qt = dns.TypeA
+		}
+
+		resp, err = r.query(st, servers, qname, qt)
+		if err != nil {
+			return nil, err
+		}
+
+		if ref := findReferral(resp, zone, qname); ref != nil {
+			servers, err = r.referralServers(st, ref, zone, resp, depth)
+			if err != nil {
+				return nil, fmt.Errorf("following referral to %q: %w", ref.zone, err)
+			}
+
+			r.delegations.set(ref.zone, servers, ref.ttl)
+			zone, known = ref.zone, ref.zone
+
+			continue
+		}
+
+		if !minimized {
+			return resp, nil
+		}
+
+		if resp.Rcode == dns.RcodeSuccess {
+			// There is no zone cut at qname, so go on with the next label.
+			known = qname
+
+			continue
+		}
+
+		// Some servers respond to the minimized queries incorrectly, so fall
+		// back to the full name, see RFC 9156 Section 3.
+		r.logger.Debug("disabling qname minimization", "name", name, "rcode", resp.Rcode)
+		minimize = false
+	}
+
+	return nil, errors.Error("too many steps")
+}
+
+// closestDelegation returns the closest ancestor of name which name servers
+// are known, and those servers.
+func (r *recursive) closestDelegation(name string) (zone string, servers []netip.AddrPort) {
+	for zone = name; zone != "."; zone = parentName(zone) {
+		servers = r.delegations.get(zone)
+		if servers != nil {
+			return zone, servers
+		}
+	}
+
+	return ".", r.rootHints
+}
+
+// childName returns the ancestor of name which is the direct child of zone.
+// zone must be an ancestor of name.  name itself is returned if zone is its
+// parent or zone is name.
+func childName(zone, name string) (child string) {
+	n, z := dns.CountLabel(name), dns.CountLabel(zone)
+	if n <= z+1 {
+		return name
+	}
+
+	return name[dns.Split(name)[n-z-1]:]
+}
+
+// parentName returns the parent of a non-root name.
+func parentName(name string) (parent string) {
+	off, end := dns.NextLabel(name, 0)
+	if end {
+		return "."
+	}
+
+	return name[off:]
+}
+
+// referral is a delegation of a zone received from a name server.
+type referral struct {
+	// zone is the delegated zone.
+	zone string
+
+	// ns are the names of the name servers of zone.
+	ns []string
+
+	// ttl is the minimum TTL of the NS records.
+	ttl uint32
+}
+
+// findReferral returns the referral of a child zone of zone from resp, which
+// is the response for qname, if it contains any.
+func findReferral(resp *dns.Msg, zone, qname string) (ref *referral) {
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) > 0 {
+		return nil
+	}
+
+	for _, rr := range resp.Ns {
+		ns, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+
+		owner := dns.CanonicalName(ns.Hdr.Name)
+		if owner == zone || !dns.IsSubDomain(zone, owner) || !dns.IsSubDomain(owner, qname) {
+			continue
+		}
+
+		if ref == nil {
+			ref = &referral{zone: owner, ttl: ns.Hdr.Ttl}
+		} else if owner != ref.zone {
+			continue
+		}
+
+		ref.ns = append(ref.ns, dns.CanonicalName(ns.Ns))
+		ref.ttl = min(ref.ttl, ns.Hdr.Ttl)
+	}
+
+	return ref
+}
+
+// referralServers returns the addresses of the name servers of ref received
+// in resp from the servers of zone.  The glue records are only trusted for the
+// names within zone, the addresses of other name servers are resolved.
+func (r *recursive) referralServers(
+	st *resolution,
+	ref *referral,
+	zone string,
+	resp *dns.Msg,
+	depth int,
+) (servers []netip.AddrPort, err error) {
+	var unglued []string
+	for _, ns := range ref.ns {
+		var addrs []netip.AddrPort
+		if dns.IsSubDomain(zone, ns) {
+			addrs = glueAddrs(resp.Extra, ns)
+		}
+
+		if len(addrs) == 0 {
+			unglued = append(unglued, ns)
+		}
+
+		servers = append(servers, addrs...)
+	}
+
+	servers = r.filterServers(servers)
+	if len(servers) > 0 {
+		return servers, nil
+	}
+
+	var errs []error
+	for _, ns := range unglued[:min(len(unglued), recursiveMaxNSResolved)] {
+		var addrs []netip.AddrPort
+		addrs, err = r.resolveServer(st, ns, depth+1)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("resolving %q: %w", ns, err))
+
+			continue
+		}
+
+		servers = append(servers, addrs...)
+	}
+
+	servers = r.filterServers(servers)
+	if len(servers) == 0 {
+		errs = append(errs, errors.Error("no name server addresses"))
+
+		return nil, errors.Join(errs...)
+	}
+
+	return servers, nil
+}
+
+// glueAddrs returns the addresses of ns from the additional section extra.
+func glueAddrs(extra []dns.RR, ns string) (addrs []netip.AddrPort) {
+	for _, rr := range extra {
+		if !strings.EqualFold(rr.Header().Name, ns) {
+			continue
+		}
+
+		if ip := addrFromRR(rr); ip.IsValid() {
+			addrs = append(addrs, netip.AddrPortFrom(ip, defaultPortPlain))
+		}
+	}
+
+	return addrs
+}
+
+// addrFromRR returns the address from rr, if it's an A or AAAA record.
+func addrFromRR(rr dns.RR) (ip netip.Addr) {
+	switch rr := rr.(type) {
+	case *dns.A:
+		ip, _ = netip.AddrFromSlice(rr.A.To4())
+	case *dns.AAAA:
+		ip, _ = netip.AddrFromSlice(rr.AAAA)
+	}
+
+	return ip
+}
+
+// resolveServer resolves the addresses of the name server ns of the address
+// families allowed.
+func (r *recursive) resolveServer(
+	st *resolution,
+	ns string,
+	depth int,
+) (addrs []netip.AddrPort, err error) {
+	qtypes := []uint16{dns.TypeA, dns.TypeAAAA}
+	switch r.ipVersion {
+	case IPVersionIPv4Only:
+		qtypes = qtypes[:1]
+	case IPVersionIPv6Only:
+		qtypes = qtypes[1:]
+	default:
+		// Go on.
+	}
+
+	var errs []error
+	for _, qt := range qtypes {
+		var resp *dns.Msg
+		resp, err = r.resolve(st, ns, qt, depth)
+		if err != nil {
+			errs = append(errs, err)
+
+			continue
+		}
+
+		for _, rr := range resp.Answer {
+			if ip := addrFromRR(rr); ip.IsValid() {
+				addrs = append(addrs, netip.AddrPortFrom(ip, defaultPortPlain))
+			}
+		}
+	}
+
+	if len(addrs) == 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	return addrs, nil
+}
+
+// filterServers returns the servers of the address families allowed, ordered
+// by the preferred family.
+func (r *recursive) filterServers(servers []netip.AddrPort) (filtered []netip.AddrPort) {
+	var v4, v6 []netip.AddrPort
+	for _, s := range servers {
+		if s.Addr().Unmap().Is4() {
+			v4 = append(v4, s)
+		} else {
+			v6 = append(v6, s)
+		}
+	}
+
+	switch r.ipVersion {
+	case IPVersionIPv4Only:
+		return v4
+	case IPVersionIPv6Only:
+		return v6
+	case IPVersionPreferIPv6:
+		return append(v6, v4...)
+	default:
+		return append(v4, v6...)
+	}
+}
+
+// query sends the non-recursive query for qname of qtype to servers one by one
+// until one of them responds successfully.  If all of them fail, the last
+// response received is returned, if any.
+func (r *recursive) query(
+	st *resolution,
+	servers []netip.AddrPort,
+	qname string,
+	qtype uint16,
+) (resp *dns.Msg, err error) {
+	req := (&dns.Msg{}).SetQuestion(qname, qtype)
+	req.RecursionDesired = false
+	req.SetEdns0(recursiveUDPSize, false)
+
+	var errs []error
+	for _, s := range servers {
+		if st.queries >= recursiveMaxQueries {
+			return nil, errors.Error("too many queries")
+		}
+
+		st.queries++
+
+		var res *dns.Msg
+		res, err = r.exchange(s, req)
+		if err == nil {
+			err = validatePlainResponse(req, res)
+		}
+
+		if err != nil {
+			r.logger.Debug("querying name server", "server", s, "qname", qname, slogutil.KeyError, err)
+			errs = append(errs, fmt.Errorf("querying %s: %w", s, err))
+
+			continue
+		}
+
+		resp = res
+		switch resp.Rcode {
+		case dns.RcodeServerFailure, dns.RcodeRefused, dns.RcodeNotImplemented, dns.RcodeFormatError:
+			// Try the next server.
+			continue
+		default:
+			return resp, nil
+		}
+	}
+
+	if resp != nil {
+		return resp, nil
+	}
+
+	return nil, errors.Join(errs...)
+}
+
+// exchangeServer sends req to the name server over UDP, falling back to TCP
+// if the response is truncated.
+func (r *recursive) exchangeServer(server netip.AddrPort, req *dns.Msg) (resp *dns.Msg, err error) {
+	dial := bootstrap.NewDialContext(
+		r.opts.Timeout,
+		r.opts.dialControl(),
+		r.opts.MultipathTCP,
+		r.opts.DialContext,
+		r.logger,
+		server.String(),
+	)
+
+	resp, err = r.exchangeOver(networkUDP, dial, req)
+	if err != nil || !resp.Truncated {
+		return resp, err
+	}
+
+	return r.exchangeOver(networkTCP, dial, req)
+}
+
+// exchangeOver sends req over network using dial.
+func (r *recursive) exchangeOver(
+	network network,
+	dial bootstrap.DialHandler,
+	req *dns.Msg,
+) (resp *dns.Msg, err error) {
+	conn := &dns.Conn{}
+	if network == networkUDP {
+		conn.UDPSize = recursiveUDPSize
+	}
+
+	conn.Conn, err = dial(context.Background(), network, "")
+	if err != nil {
+		return nil, fmt.Errorf("dialing over %s: %w", network, err)
+	}
+	defer func(c net.Conn) { err = errors.WithDeferred(err, c.Close()) }(conn.Conn)
+
+	conn.Conn = withCompressionCheck(conn.Conn, r.opts.MaxCompressionPointers)
+
+	client := &dns.Client{Timeout: r.opts.Timeout}
+	resp, _, err = client.ExchangeWithConn(req, conn)
+
+	return resp, err
+}
+
+// delegationCache caches the name servers of the zones.  It's safe for
+// concurrent use.
+type delegationCache struct {
+	// mu protects zones.
+	mu *sync.Mutex
+
+	// zones are the delegations by the canonical names of the zones.
+	zones map[string]*delegation
+}
+
+// delegation is a cached set of the name servers of a zone.
+type delegation struct {
+	// expire is the time the delegation expires at.
+	expire time.Time
+
+	// servers are the addresses of the name servers.
+	servers []netip.AddrPort
+}
+
+// newDelegationCache returns a new empty cache of the delegations.
+func newDelegationCache() (c *delegationCache) {
+	return &delegationCache{
+		mu:    &sync.Mutex{},
+		zones: map[string]*delegation{},
+	}
+}
+
+// get returns the unexpired name servers of zone, if any.
+func (c *delegationCache) get(zone string) (servers []netip.AddrPort) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	d, ok := c.zones[zone]
+	if !ok {
+		return nil
+	} else if time.Now().After(d.expire) {
+		delete(c.zones, zone)
+
+		return nil
+	}
+
+	return d.servers
+}
+
+// set caches servers of zone for ttl seconds.  Zero ttl means the delegation
+// isn't cached.
+func (c *delegationCache) set(zone string, servers []netip.AddrPort, ttl uint32) {
+	if ttl == 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.zones) >= recursiveMaxDelegations {
+		clear(c.zones)
+	}
+
+	c.zones[zone] = &delegation{
+		expire:  time.Now().Add(min(time.Duration(ttl)*time.Second, recursiveMaxDelegationTTL)),
+		servers: slices.Clip(servers),
+	}
+}
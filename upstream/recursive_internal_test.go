@@ -0,0 +1,337 @@
+package upstream
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeNameServer handles the queries sent to a name server in tests.
+type fakeNameServer func(req *dns.Msg) (resp *dns.Msg)
+
+// fakeNetwork is a set of the name servers in tests.
+type fakeNetwork struct {
+	// mu protects queries.
+	mu *sync.Mutex
+
+	// servers are the name servers by their addresses.
+	servers map[netip.AddrPort]fakeNameServer
+
+	// queries are the queries received, formatted as "server qname qtype".
+	queries []string
+}
+
+// exchange implements the [serverExchangeFunc] for *fakeNetwork.
+func (n *fakeNetwork) exchange(server netip.AddrPort, req *dns.Msg) (resp *dns.Msg, err error) {
+	q := req.Question[0]
+
+	n.mu.Lock()
+	n.queries = append(n.queries, fmt.Sprintf("%s %s %s", server.Addr(), q.Name, dns.Type(q.Qtype)))
+	n.mu.Unlock()
+
+	ns, ok := n.servers[server]
+	if !ok {
+		return nil, errors.Error("unreachable")
+	}
+
+	return ns(req), nil
+}
+
+// newFakeResolver returns a recursive upstream resolving the names within n
+// starting from root.
+func newFakeResolver(t *testing.T, n *fakeNetwork, root ...netip.AddrPort) (r *recursive) {
+	t.Helper()
+
+	r, err := newRecursive(&url.URL{Scheme: "recursive"}, &Options{
+		Logger:    slogutil.NewDiscardLogger(),
+		RootHints: root,
+	})
+	require.NoError(t, err)
+
+	r.exchange = n.exchange
+
+	return r
+}
+
+// testNS returns the address of a name server in tests.
+func testNS(ip string) (addr netip.AddrPort) {
+	return netip.AddrPortFrom(netip.MustParseAddr(ip), defaultPortPlain)
+}
+
+// newReferral returns the referral to zone served by ns in response to req.
+// glue is added for ns, if it's valid.
+func newReferral(req *dns.Msg, zone, ns string, glue netip.Addr) (resp *dns.Msg) {
+	resp = (&dns.Msg{}).SetReply(req)
+	resp.Ns = []dns.RR{&dns.NS{
+		Hdr: dns.RR_Header{Name: zone, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 3600},
+		Ns:  ns,
+	}}
+
+	if glue.IsValid() {
+		resp.Extra = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: ns, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 3600},
+			A:   glue.AsSlice(),
+		}}
+	}
+
+	return resp
+}
+
+// newAuthReply returns the authoritative reply to req with ans.
+func newAuthReply(req *dns.Msg, rcode int, ans ...dns.RR) (resp *dns.Msg) {
+	resp = (&dns.Msg{}).SetRcode(req, rcode)
+	resp.Authoritative = true
+	resp.Answer = ans
+
+	return resp
+}
+
+// hasSuffix returns true if name is within zone.
+func hasSuffix(name, zone string) (ok bool) {
+	return strings.HasSuffix(name, "."+zone) || name == zone
+}
+
+func TestRecursive_Exchange(t *testing.T) {
+	var (
+		rootNS    = testNS("192.0.2.1")
+		exampleNS = testNS("192.0.2.2")
+		netNS     = testNS("192.0.2.4")
+		cdnNS     = testNS("192.0.2.5")
+
+		// bogusGlue must not be used, since it's out of the bailiwick.
+		bogusGlue = netip.MustParseAddr("198.51.100.1")
+
+		edgeIP = netip.MustParseAddr("2001:db8::1")
+	)
+
+	n := &fakeNetwork{
+		mu: &sync.Mutex{},
+		servers: map[netip.AddrPort]fakeNameServer{
+			rootNS: func(req *dns.Msg) (resp *dns.Msg) {
+				switch name := req.Question[0].Name; {
+				case hasSuffix(name, "example."):
+					return newReferral(req, "example.", "ns.example.", exampleNS.Addr())
+				case hasSuffix(name, "net."):
+					return newReferral(req, "net.", "a.ns.net.", netNS.Addr())
+				default:
+					return newAuthReply(req, dns.RcodeNameError)
+				}
+			},
+			exampleNS: func(req *dns.Msg) (resp *dns.Msg) {
+				if hasSuffix(req.Question[0].Name, "host.example.") {
+					return newReferral(req, "host.example.", "ns.cdn.net.", bogusGlue)
+				}
+
+				return newAuthReply(req, dns.RcodeSuccess)
+			},
+			netNS: func(req *dns.Msg) (resp *dns.Msg) {
+				if hasSuffix(req.Question[0].Name, "cdn.net.") {
+					return newReferral(req, "cdn.net.", "ns.cdn.net.", cdnNS.Addr())
+				}
+
+				return newAuthReply(req, dns.RcodeSuccess)
+			},
+			cdnNS: func(req *dns.Msg) (resp *dns.Msg) {
+				q := req.Question[0]
+				hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: 60}
+				switch {
+				case q.Name == "ns.cdn.net." && q.Qtype == dns.TypeA:
+					return newAuthReply(req, dns.RcodeSuccess, &dns.A{Hdr: hdr, A: cdnNS.Addr().AsSlice()})
+				case q.Name == "www.host.example.":
+					hdr.Rrtype = dns.TypeCNAME
+
+					return newAuthReply(req, dns.RcodeSuccess, &dns.CNAME{Hdr: hdr, Target: "edge.cdn.net."})
+				case q.Name == "edge.cdn.net." && q.Qtype == dns.TypeAAAA:
+					return newAuthReply(req, dns.RcodeSuccess, &dns.AAAA{Hdr: hdr, AAAA: edgeIP.AsSlice()})
+				case q.Name == "cdn.net.", q.Name == "host.example.", q.Name == "ns.cdn.net.":
+					return newAuthReply(req, dns.RcodeSuccess)
+				default:
+					return newAuthReply(req, dns.RcodeNameError)
+				}
+			},
+		},
+	}
+
+	r := newFakeResolver(t, n, rootNS)
+
+	req := (&dns.Msg{}).SetQuestion("WWW.host.example.", dns.TypeAAAA)
+	resp, err := r.Exchange(req)
+	require.NoError(t, err)
+
+	assert.Equal(t, req.Id, resp.Id)
+	assert.True(t, resp.RecursionAvailable)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+
+	require.Len(t, resp.Answer, 2)
+	require.IsType(t, &dns.CNAME{}, resp.Answer[0])
+	require.IsType(t, &dns.AAAA{}, resp.Answer[1])
+
+	assert.Equal(t, edgeIP.AsSlice(), []byte(resp.Answer[1].(*dns.AAAA).AAAA))
+
+	// The root and the TLD servers only see the minimized names.
+	assert.Equal(t, []string{
+		"192.0.2.1 example. A",
+		"192.0.2.2 host.example. A",
+		"192.0.2.1 net. A",
+		"192.0.2.4 cdn.net. A",
+		"192.0.2.5 ns.cdn.net. A",
+		"192.0.2.5 ns.cdn.net. AAAA",
+		"192.0.2.5 www.host.example. AAAA",
+		"192.0.2.5 edge.cdn.net. AAAA",
+	}, n.queries)
+
+	t.Run("cached_delegation", func(t *testing.T) {
+		n.queries = nil
+
+		req = (&dns.Msg{}).SetQuestion("edge.cdn.net.", dns.TypeAAAA)
+		resp, err = r.Exchange(req)
+		require.NoError(t, err)
+		require.Len(t, resp.Answer, 1)
+
+		assert.Equal(t, []string{"192.0.2.5 edge.cdn.net. AAAA"}, n.queries)
+	})
+
+	t.Run("nxdomain", func(t *testing.T) {
+		req = (&dns.Msg{}).SetQuestion("missing.cdn.net.", dns.TypeA)
+		resp, err = r.Exchange(req)
+		require.NoError(t, err)
+
+		assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+	})
+}
+
+func TestRecursive_Exchange_minimizationFallback(t *testing.T) {
+	rootNS := testNS("192.0.2.1")
+	ip := netip.MustParseAddr("192.0.2.100")
+
+	n := &fakeNetwork{
+		mu: &sync.Mutex{},
+		servers: map[netip.AddrPort]fakeNameServer{
+			// The server responds with NXDOMAIN to the empty non-terminals.
+			rootNS: func(req *dns.Msg) (resp *dns.Msg) {
+				q := req.Question[0]
+				if q.Name != "www.broken." {
+					return newAuthReply(req, dns.RcodeNameError)
+				}
+
+				hdr := dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}
+
+				return newAuthReply(req, dns.RcodeSuccess, &dns.A{Hdr: hdr, A: ip.AsSlice()})
+			},
+		},
+	}
+
+	r := newFakeResolver(t, n, rootNS)
+
+	resp, err := r.Exchange((&dns.Msg{}).SetQuestion("www.broken.", dns.TypeA))
+	require.NoError(t, err)
+	require.Len(t, resp.Answer, 1)
+
+	assert.Equal(t, []string{
+		"192.0.2.1 broken. A",
+		"192.0.2.1 www.broken. A",
+	}, n.queries)
+}
+
+func TestRecursive_Exchange_serverFailures(t *testing.T) {
+	var (
+		unreachableNS = testNS("192.0.2.1")
+		servfailNS    = testNS("192.0.2.2")
+	)
+
+	n := &fakeNetwork{
+		mu: &sync.Mutex{},
+		servers: map[netip.AddrPort]fakeNameServer{
+			servfailNS: func(req *dns.Msg) (resp *dns.Msg) {
+				return (&dns.Msg{}).SetRcode(req, dns.RcodeServerFailure)
+			},
+		},
+	}
+
+	t.Run("servfail", func(t *testing.T) {
+		r := newFakeResolver(t, n, unreachableNS, servfailNS)
+
+		resp, err := r.Exchange((&dns.Msg{}).SetQuestion("example.", dns.TypeA))
+		require.NoError(t, err)
+
+		assert.Equal(t, dns.RcodeServerFailure, resp.Rcode)
+	})
+
+	t.Run("unreachable", func(t *testing.T) {
+		r := newFakeResolver(t, n, unreachableNS)
+
+		_, err := r.Exchange((&dns.Msg{}).SetQuestion("example.", dns.TypeA))
+		testutil.AssertErrorMsg(
+			t,
+			`resolving "example.": querying 192.0.2.1:53: unreachable`,
+			err,
+		)
+	})
+}
+
+func TestAddressToUpstream_recursive(t *testing.T) {
+	opts := &Options{Logger: slogutil.NewDiscardLogger()}
+
+	u, err := AddressToUpstream("recursive://", opts)
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	assert.Equal(t, "recursive://", u.Address())
+
+	_, err = AddressToUpstream("recursive://192.0.2.1", opts)
+	testutil.AssertErrorMsg(
+		t,
+		`recursive upstream must have no address, got "recursive://192.0.2.1"`,
+		err,
+	)
+
+	_, err = AddressToUpstream("recursive://", &Options{
+		Logger:    slogutil.NewDiscardLogger(),
+		RootHints: []netip.AddrPort{testNS("192.0.2.1")},
+		IPVersion: IPVersionIPv6Only,
+	})
+	testutil.AssertErrorMsg(t, `no root hints of ip version "ipv6-only"`, err)
+}
+
+func TestRecursive_exchangeServer(t *testing.T) {
+	ip := netip.MustParseAddr("192.0.2.1")
+	srv := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		hdr := dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}
+		resp := newAuthReply(req, dns.RcodeSuccess, &dns.A{Hdr: hdr, A: ip.AsSlice()})
+
+		// Make the client fall back to TCP.
+		if _, ok := w.LocalAddr().(*net.UDPAddr); ok {
+			resp.Answer = nil
+			resp.Truncated = true
+		}
+
+		require.NoError(testutil.PanicT{}, w.WriteMsg(resp))
+	})
+	testutil.CleanupAndRequireSuccess(t, srv.Close)
+
+	// Resolve the names using the test server as the root one.
+	r, err := newRecursive(&url.URL{Scheme: "recursive"}, &Options{
+		Logger:    slogutil.NewDiscardLogger(),
+		RootHints: []netip.AddrPort{netip.AddrPortFrom(netutil.IPv4Localhost(), uint16(srv.port))},
+		Timeout:   timeout,
+	})
+	require.NoError(t, err)
+
+	resp, err := r.Exchange((&dns.Msg{}).SetQuestion("example.", dns.TypeA))
+	require.NoError(t, err)
+	require.Len(t, resp.Answer, 1)
+
+	assert.Equal(t, ip.AsSlice(), []byte(resp.Answer[0].(*dns.A).A))
+}
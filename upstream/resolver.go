@@ -1,8 +1,10 @@
 package upstream
 
 import (
+	"cmp"
 	"context"
 	"fmt"
+	"log/slog"
 	"math"
 	"net/netip"
 	"net/url"
@@ -13,7 +15,7 @@ import (
 	"github.com/AdguardTeam/dnsproxy/internal/bootstrap"
 	"github.com/AdguardTeam/dnsproxy/proxyutil"
 	"github.com/AdguardTeam/golibs/errors"
-	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
 	"github.com/miekg/dns"
 )
 
@@ -52,15 +54,17 @@ func NewUpstreamResolver(resolverAddress string, opts *Options) (r *UpstreamReso
 
 	// TODO(ameshkov):  Aren't other options needed here?
 	if opts != nil {
+		upsOpts.Logger = opts.Logger
 		upsOpts.Timeout = opts.Timeout
 		upsOpts.VerifyServerCertificate = opts.VerifyServerCertificate
 		upsOpts.PreferIPv6 = opts.PreferIPv6
+		upsOpts.IPVersion = opts.IPVersion
 	}
 
 	ups, err := AddressToUpstream(resolverAddress, upsOpts)
 	if err != nil {
 		err = fmt.Errorf("creating upstream: %w", err)
-		log.Error("upstream bootstrap: %s", err)
+		cmp.Or(upsOpts.Logger, slog.Default()).Error("upstream bootstrap", slogutil.KeyError, err)
 
 		return nil, err
 	}
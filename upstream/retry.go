@@ -0,0 +1,246 @@
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/miekg/dns"
+)
+
+// defaultRetryBackoff is the default initial delay before retrying an
+// exchange.
+const defaultRetryBackoff = 10 * time.Millisecond
+
+// RetryConfig is the configuration of retrying the failed exchanges with an
+// upstream.  The retries are made in addition to the redials of the broken
+// pooled connections, which happen within a single attempt.
+type RetryConfig struct {
+	// Rcodes are the response codes, the responses with which are retried
+	// like the failed exchanges, for example [dns.RcodeFormatError] or
+	// [dns.RcodeRefused].  The response to the last attempt is returned as is.
+	Rcodes []int
+
+	// Retries is the maximum number of the attempts after the first one.
+	Retries uint
+
+	// TryTimeout, if not zero, overrides [Options.Timeout], so that it limits
+	// each attempt instead of the whole exchange.
+	TryTimeout time.Duration
+
+	// Deadline, if not zero, is the maximum duration since the first attempt,
+	// after which no more attempts are started.
+	Deadline time.Duration
+
+	// Backoff is the delay before the first retry, which doubles with each
+	// next one.  The actual delay is chosen randomly between zero and the
+	// current one.  Zero means the default of 10ms.
+	Backoff time.Duration
+
+	// MaxBackoff, if not zero, is the maximum delay between the attempts.
+	MaxBackoff time.Duration
+}
+
+// validate returns an error if c is invalid.  c may be nil.
+func (c *RetryConfig) validate() (err error) {
+	if c == nil {
+		return nil
+	}
+
+	switch {
+	case c.TryTimeout < 0:
+		return fmt.Errorf("try timeout: negative value %s", c.TryTimeout)
+	case c.Deadline < 0:
+		return fmt.Errorf("deadline: negative value %s", c.Deadline)
+	case c.Backoff < 0:
+		return fmt.Errorf("backoff: negative value %s", c.Backoff)
+	case c.MaxBackoff < 0:
+		return fmt.Errorf("max backoff: negative value %s", c.MaxBackoff)
+	default:
+		return nil
+	}
+}
+
+// backoff returns the randomized delay before the retry number n, starting
+// from zero.  c must not be nil.
+func (c *RetryConfig) backoff(n uint) (d time.Duration) {
+	d = c.Backoff
+	if d == 0 {
+		d = defaultRetryBackoff
+	}
+
+	for ; n > 0 && d < math.MaxInt64/2; n-- {
+		d *= 2
+	}
+
+	if c.MaxBackoff > 0 {
+		d = min(d, c.MaxBackoff)
+	}
+
+	return rand.N(d + 1)
+}
+
+// retryUpstream is an [Upstream] retrying the failed exchanges according to
+// the configured policy.
+type retryUpstream struct {
+	Upstream
+
+	// logger is used to log the retries.
+	logger *slog.Logger
+
+	// conf is the retry policy.  It must not be nil.
+	conf *RetryConfig
+}
+
+// type check
+var _ Upstream = (*retryUpstream)(nil)
+
+// Exchange implements the [Upstream] interface for *retryUpstream.
+func (u *retryUpstream) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	return u.ExchangeContext(context.Background(), req)
+}
+
+// type check
+var _ ContextExchanger = (*retryUpstream)(nil)
+
+// ExchangeContext implements the [ContextExchanger] interface for
+// *retryUpstream.  The exchanges aren't retried once ctx is canceled.
+func (u *retryUpstream) ExchangeContext(
+	ctx context.Context,
+	req *dns.Msg,
+) (resp *dns.Msg, err error) {
+	return u.retry(ctx, func(req *dns.Msg) (resp *dns.Msg, err error) {
+		return ExchangeContext(ctx, u.Upstream, req)
+	}, req)
+}
+
+// retry calls exchange with req until it succeeds, the attempts are over, or
+// ctx is canceled.
+func (u *retryUpstream) retry(
+	ctx context.Context,
+	exchange func(req *dns.Msg) (resp *dns.Msg, err error),
+	req *dns.Msg,
+) (resp *dns.Msg, err error) {
+	start := time.Now()
+	for n := uint(0); ; n++ {
+		resp, err = exchange(req)
+		if ctx.Err() != nil {
+			return resp, err
+		} else if err == nil && (resp == nil || !slices.Contains(u.conf.Rcodes, resp.Rcode)) {
+			return resp, nil
+		}
+
+		if n == u.conf.Retries {
+			return resp, err
+		}
+
+		delay := u.conf.backoff(n)
+		if d := u.conf.Deadline; d > 0 && time.Since(start)+delay >= d {
+			return resp, err
+		}
+
+		// Don't retry if ctx expires before the retry starts, for example
+		// when the time budget of the request is spent.
+		if dl, ok := ctx.Deadline(); ok && time.Until(dl) <= delay {
+			return resp, err
+		}
+
+		u.logger.Debug(
+			"retrying exchange",
+			"addr", u.Address(),
+			"attempt", n+1,
+			"delay", delay,
+			"rcode", rcodeString(resp),
+			slogutil.KeyError, err,
+		)
+
+		if !sleepContext(ctx, delay) {
+			return resp, err
+		}
+	}
+}
+
+// sleepContext pauses for d or until ctx is canceled, whichever happens first.
+// It returns false in the latter case.
+func sleepContext(ctx context.Context, d time.Duration) (ok bool) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// rcodeString returns the text representation of the response code of resp,
+// if any.
+func rcodeString(resp *dns.Msg) (s string) {
+	if resp == nil {
+		return ""
+	}
+
+	return dns.RcodeToString[resp.Rcode]
+}
+
+// retryTCPUpstream is a [retryUpstream] also implementing the [TCPExchanger]
+// interface.
+type retryTCPUpstream struct {
+	*retryUpstream
+
+	// tcp is the same upstream as the embedded one.
+	tcp TCPExchanger
+}
+
+// type check
+var (
+	_ TCPExchanger = (*retryTCPUpstream)(nil)
+	_ Transferer   = (*retryTCPUpstream)(nil)
+)
+
+// ExchangeTCP implements the [TCPExchanger] interface for *retryTCPUpstream.
+func (u *retryTCPUpstream) ExchangeTCP(req *dns.Msg) (resp *dns.Msg, err error) {
+	return u.retry(context.Background(), u.tcp.ExchangeTCP, req)
+}
+
+// Transfer implements the [Transferer] interface for *retryTCPUpstream.  The
+// transfers aren't retried, since the records may already be sent.  It returns
+// [errors.ErrUnsupported] if the embedded upstream doesn't transfer zones.
+func (u *retryTCPUpstream) Transfer(req *dns.Msg) (ch <-chan *dns.Envelope, err error) {
+	t, ok := u.Upstream.(Transferer)
+	if !ok {
+		return nil, errors.ErrUnsupported
+	}
+
+	return t.Transfer(req)
+}
+
+// withRetries returns u wrapped to retry the failed exchanges according to
+// opts.Retry.  It returns u as is if opts.Retry is nil.  opts must not be nil.
+func withRetries(u Upstream, opts *Options) (wrapped Upstream) {
+	if opts.Retry == nil {
+		return u
+	}
+
+	r := &retryUpstream{
+		Upstream: u,
+		logger:   opts.Logger,
+		conf:     opts.Retry,
+	}
+
+	if tcp, ok := u.(TCPExchanger); ok {
+		return &retryTCPUpstream{
+			retryUpstream: r,
+			tcp:           tcp,
+		}
+	}
+
+	return r
+}
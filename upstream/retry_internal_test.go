@@ -0,0 +1,138 @@
+package upstream
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddressToUpstream_retry(t *testing.T) {
+	// refusedNum is the number of the first requests to each server answered
+	// with REFUSED.
+	const refusedNum = 2
+
+	testCases := []struct {
+		conf      *RetryConfig
+		name      string
+		wantRcode int
+		wantReqs  uint32
+	}{{
+		conf:      nil,
+		name:      "disabled",
+		wantRcode: dns.RcodeRefused,
+		wantReqs:  1,
+	}, {
+		conf:      &RetryConfig{Retries: refusedNum},
+		name:      "rcode_not_retried",
+		wantRcode: dns.RcodeRefused,
+		wantReqs:  1,
+	}, {
+		conf: &RetryConfig{
+			Rcodes:  []int{dns.RcodeRefused},
+			Retries: refusedNum,
+			Backoff: time.Millisecond,
+		},
+		name:      "success",
+		wantRcode: dns.RcodeSuccess,
+		wantReqs:  refusedNum + 1,
+	}, {
+		conf: &RetryConfig{
+			Rcodes:  []int{dns.RcodeRefused},
+			Retries: refusedNum - 1,
+			Backoff: time.Millisecond,
+		},
+		name:      "retries_over",
+		wantRcode: dns.RcodeRefused,
+		wantReqs:  refusedNum,
+	}, {
+		conf: &RetryConfig{
+			Rcodes:   []int{dns.RcodeRefused},
+			Retries:  refusedNum,
+			Deadline: time.Nanosecond,
+		},
+		name:      "deadline",
+		wantRcode: dns.RcodeRefused,
+		wantReqs:  1,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var reqNum atomic.Uint32
+			srv := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+				resp := respondToTestMessage(req)
+				if reqNum.Add(1) <= refusedNum {
+					resp = (&dns.Msg{}).SetRcode(req, dns.RcodeRefused)
+				}
+
+				require.NoError(testutil.PanicT{}, w.WriteMsg(resp))
+			})
+			testutil.CleanupAndRequireSuccess(t, srv.Close)
+
+			u, err := AddressToUpstream(fmt.Sprintf("127.0.0.1:%d", srv.port), &Options{
+				Timeout: timeout,
+				Retry:   tc.conf,
+			})
+			require.NoError(t, err)
+			testutil.CleanupAndRequireSuccess(t, u.Close)
+
+			resp, err := u.Exchange(createTestMessage())
+			require.NoError(t, err)
+			require.NotNil(t, resp)
+
+			assert.Equal(t, tc.wantRcode, resp.Rcode)
+			assert.Equal(t, tc.wantReqs, reqNum.Load())
+		})
+	}
+
+	t.Run("error", func(t *testing.T) {
+		var reqNum atomic.Uint32
+		srv := startDNSServer(t, func(_ dns.ResponseWriter, _ *dns.Msg) {
+			// Never respond.
+			reqNum.Add(1)
+		})
+		testutil.CleanupAndRequireSuccess(t, srv.Close)
+
+		u, err := AddressToUpstream(fmt.Sprintf("127.0.0.1:%d", srv.port), &Options{
+			Timeout: timeout,
+			Retry: &RetryConfig{
+				Retries:    1,
+				TryTimeout: 10 * time.Millisecond,
+				Backoff:    time.Millisecond,
+			},
+		})
+		require.NoError(t, err)
+		testutil.CleanupAndRequireSuccess(t, u.Close)
+
+		_, err = u.Exchange(createTestMessage())
+		require.Error(t, err)
+
+		// Each attempt also redials once after the timeout.
+		assert.Equal(t, uint32(4), reqNum.Load())
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := AddressToUpstream("127.0.0.1:53", &Options{
+			Retry: &RetryConfig{Backoff: -1},
+		})
+		testutil.AssertErrorMsg(t, "retry: backoff: negative value -1ns", err)
+	})
+}
+
+func TestRetryConfig_backoff(t *testing.T) {
+	c := &RetryConfig{
+		Backoff:    time.Second,
+		MaxBackoff: 5 * time.Second,
+	}
+
+	for n := range uint(100) {
+		d := c.backoff(n)
+		assert.GreaterOrEqual(t, d, time.Duration(0))
+		assert.LessOrEqual(t, d, min(time.Second<<min(n, 3), c.MaxBackoff))
+	}
+}
@@ -0,0 +1,218 @@
+package upstream
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// defaultSessionCacheCapacity is the default maximum number of the sessions
+// stored in a [SessionCache].
+const defaultSessionCacheCapacity = 64
+
+// sessionCacheVersion is the version of the format of the sessions written by
+// [SessionCache.WriteCache].
+const sessionCacheVersion = 1
+
+// SessionCache is a [tls.ClientSessionCache] the sessions of which could be
+// saved and restored, so that the connections dialed after a restart could be
+// resumed.  For DNS-over-QUIC, the QUIC transport parameters are stored within
+// the sessions, so the resumed connections could also use 0-RTT where the
+// server permits it.
+//
+// The saved sessions contain the secrets allowing to decrypt the resumed
+// connections, so those should be stored with the same care as private keys.
+type SessionCache struct {
+	// mu protects sessions and seq.
+	mu *sync.Mutex
+
+	// sessions are the stored sessions by the cache keys.
+	sessions map[string]*sessionCacheEntry
+
+	// seq is the sequence number of the last stored session.
+	seq uint64
+
+	// capacity is the maximum number of the stored sessions.
+	capacity int
+}
+
+// sessionCacheEntry is a single session stored in a [SessionCache].
+type sessionCacheEntry struct {
+	// state is the stored session.
+	state *tls.ClientSessionState
+
+	// seq is the sequence number of the session, used to evict the oldest
+	// one.
+	seq uint64
+}
+
+// NewSessionCache returns a new properly initialized *SessionCache storing at
+// most capacity sessions.  If capacity is not positive, a default of 64 is
+// used.
+func NewSessionCache(capacity int) (c *SessionCache) {
+	if capacity <= 0 {
+		capacity = defaultSessionCacheCapacity
+	}
+
+	return &SessionCache{
+		mu:       &sync.Mutex{},
+		sessions: map[string]*sessionCacheEntry{},
+		capacity: capacity,
+	}
+}
+
+// type check
+var _ tls.ClientSessionCache = (*SessionCache)(nil)
+
+// Get implements the [tls.ClientSessionCache] interface for *SessionCache.
+func (c *SessionCache) Get(key string) (cs *tls.ClientSessionState, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.sessions[key]
+	if !ok {
+		return nil, false
+	}
+
+	return e.state, true
+}
+
+// Put implements the [tls.ClientSessionCache] interface for *SessionCache.
+func (c *SessionCache) Put(key string, cs *tls.ClientSessionState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.put(key, cs)
+}
+
+// put stores cs by key, evicting the oldest session if the cache is full.  A
+// nil cs removes the session stored by key.  c.mu is expected to be locked.
+func (c *SessionCache) put(key string, cs *tls.ClientSessionState) {
+	if cs == nil {
+		delete(c.sessions, key)
+
+		return
+	}
+
+	if _, ok := c.sessions[key]; !ok && len(c.sessions) >= c.capacity {
+		c.evictOldest()
+	}
+
+	c.seq++
+	c.sessions[key] = &sessionCacheEntry{
+		state: cs,
+		seq:   c.seq,
+	}
+}
+
+// evictOldest removes the least recently stored session.  c.mu is expected to
+// be locked.
+func (c *SessionCache) evictOldest() {
+	var oldestKey string
+	var oldest *sessionCacheEntry
+	for k, e := range c.sessions {
+		if oldest == nil || e.seq < oldest.seq {
+			oldestKey, oldest = k, e
+		}
+	}
+
+	delete(c.sessions, oldestKey)
+}
+
+// sessionCacheFile is the JSON representation of the sessions of a
+// [SessionCache].
+type sessionCacheFile struct {
+	// Sessions are the stored sessions.
+	Sessions []*sessionCacheFileEntry `json:"sessions"`
+
+	// Version is the version of the format.
+	Version int `json:"version"`
+}
+
+// sessionCacheFileEntry is the JSON representation of a single session.
+type sessionCacheFileEntry struct {
+	// Key is the cache key of the session, usually the server name.
+	Key string `json:"key"`
+
+	// Ticket is the session ticket issued by the server.
+	Ticket []byte `json:"ticket"`
+
+	// State is the encoded [tls.SessionState].
+	State []byte `json:"state"`
+}
+
+// WriteCache writes the stored sessions to w in JSON, so that those could be
+// restored with [SessionCache.ReadCache], for example after a restart.  The
+// sessions which can't be resumed are skipped.
+func (c *SessionCache) WriteCache(w io.Writer) (err error) {
+	file := &sessionCacheFile{
+		Version: sessionCacheVersion,
+	}
+
+	c.mu.Lock()
+	for k, e := range c.sessions {
+		ticket, state, stateErr := e.state.ResumptionState()
+		if stateErr != nil || state == nil {
+			continue
+		}
+
+		b, stateErr := state.Bytes()
+		if stateErr != nil {
+			continue
+		}
+
+		file.Sessions = append(file.Sessions, &sessionCacheFileEntry{
+			Key:    k,
+			Ticket: ticket,
+			State:  b,
+		})
+	}
+	c.mu.Unlock()
+
+	err = json.NewEncoder(w).Encode(file)
+	if err != nil {
+		return fmt.Errorf("encoding sessions: %w", err)
+	}
+
+	return nil
+}
+
+// ReadCache reads the sessions written by [SessionCache.WriteCache] from r and
+// stores them in c.  The expired sessions are discarded by the TLS client once
+// it tries to resume them.
+func (c *SessionCache) ReadCache(r io.Reader) (err error) {
+	file := &sessionCacheFile{}
+	err = json.NewDecoder(r).Decode(file)
+	if err != nil {
+		return fmt.Errorf("decoding sessions: %w", err)
+	}
+
+	if file.Version != sessionCacheVersion {
+		return fmt.Errorf("sessions version: unsupported value %d", file.Version)
+	}
+
+	states := make(map[string]*tls.ClientSessionState, len(file.Sessions))
+	for i, e := range file.Sessions {
+		var state *tls.SessionState
+		state, err = tls.ParseSessionState(e.State)
+		if err != nil {
+			return fmt.Errorf("session at index %d: %w", i, err)
+		}
+
+		states[e.Key], err = tls.NewResumptionState(e.Ticket, state)
+		if err != nil {
+			return fmt.Errorf("session at index %d: %w", i, err)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for k, cs := range states {
+		c.put(k, cs)
+	}
+
+	return nil
+}
@@ -0,0 +1,402 @@
+package upstream
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/miekg/dns"
+)
+
+const (
+	// srvSchemePrefix is the prefix of the schemes of the upstreams discovered
+	// with the SRV records.
+	srvSchemePrefix = "srv+"
+
+	// defaultSRVRefreshInterval is the default value of
+	// [Options.SRVRefreshInterval].
+	defaultSRVRefreshInterval = 30 * time.Second
+
+	// errNoSRVInstances is returned when the SRV records of the upstream have
+	// no usable targets.
+	errNoSRVInstances errors.Error = "no instances"
+)
+
+// srvLookupFunc looks up the SRV records for name.  It has the signature of
+// [net.Resolver.LookupSRV].
+type srvLookupFunc func(
+	ctx context.Context,
+	service string,
+	proto string,
+	name string,
+) (cname string, addrs []*net.SRV, err error)
+
+// srvInstance is a single upstream discovered with the SRV records.
+type srvInstance struct {
+	// ups is the upstream of the target.
+	ups Upstream
+
+	// addr is the address of the target with port.
+	addr string
+
+	// priority is the priority of the SRV record of the target.
+	priority uint16
+}
+
+// srvUpstream is an [Upstream] which instances are the targets of the SRV
+// records of a name, for example, the pods of a headless Kubernetes service.
+// The records are looked up again once [Options.SRVRefreshInterval] has passed,
+// so that the instances are added and removed as the backing set scales.
+type srvUpstream struct {
+	// logger is used to log the changes of the instances.
+	logger *slog.Logger
+
+	// lookup looks up the SRV records.
+	lookup srvLookupFunc
+
+	// opts are used to create the instances.
+	opts *Options
+
+	// addr is the address of the upstream as specified.
+	addr *url.URL
+
+	// refreshMu serializes the lookups of the SRV records.
+	refreshMu *sync.Mutex
+
+	// mu protects instances, refreshedAt, and closed.
+	mu *sync.Mutex
+
+	// scheme is the scheme of the instances.
+	scheme string
+
+	// instances are the current instances sorted by priority.
+	instances []*srvInstance
+
+	// refreshedAt is the time of the last successful lookup.
+	refreshedAt time.Time
+
+	// next is used to spread the exchanges between the instances with the
+	// same priority.
+	next *atomic.Uint32
+
+	// refreshing is true while the records are being looked up in the
+	// background.
+	refreshing *atomic.Bool
+
+	// interval is the time between the lookups of the records.
+	interval time.Duration
+
+	// closed is true once the upstream is closed.
+	closed bool
+}
+
+// newSRV returns a new upstream discovering the instances by the SRV records
+// of the host of addr.  addr must have no port, and its scheme must be
+// [srvSchemePrefix] followed by the scheme of the instances.
+func newSRV(addr *url.URL, opts *Options) (u *srvUpstream, err error) {
+	scheme := strings.TrimPrefix(addr.Scheme, srvSchemePrefix)
+	switch scheme {
+	case "udp", "tcp", "tls", "https", "h3", "quic":
+		// Go on.
+	default:
+		return nil, fmt.Errorf("unsupported srv upstream scheme: %s", scheme)
+	}
+
+	if addr.Port() != "" {
+		return nil, fmt.Errorf("srv upstream must have no port, got %q", addr)
+	}
+
+	err = netutil.ValidateSRVDomainName(addr.Hostname())
+	if err != nil {
+		// Don't wrap the error, since it's informative enough as is.
+		return nil, err
+	}
+
+	return &srvUpstream{
+		logger:     opts.Logger,
+		lookup:     net.DefaultResolver.LookupSRV,
+		opts:       opts,
+		addr:       addr,
+		refreshMu:  &sync.Mutex{},
+		mu:         &sync.Mutex{},
+		scheme:     scheme,
+		next:       &atomic.Uint32{},
+		refreshing: &atomic.Bool{},
+		interval:   cmp.Or(opts.SRVRefreshInterval, defaultSRVRefreshInterval),
+	}, nil
+}
+
+// type check
+var _ Upstream = (*srvUpstream)(nil)
+
+// Address implements the [Upstream] interface for *srvUpstream.
+func (u *srvUpstream) Address() (addr string) { return u.addr.String() }
+
+// Exchange implements the [Upstream] interface for *srvUpstream.
+func (u *srvUpstream) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	return u.ExchangeContext(context.Background(), req)
+}
+
+// type check
+var _ ContextExchanger = (*srvUpstream)(nil)
+
+// ExchangeContext implements the [ContextExchanger] interface for *srvUpstream.
+// The instances are tried in the order of their priority until one of them
+// answers or ctx is canceled.
+func (u *srvUpstream) ExchangeContext(
+	ctx context.Context,
+	req *dns.Msg,
+) (resp *dns.Msg, err error) {
+	insts, err := u.currentInstances()
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []error
+	for _, inst := range u.order(insts) {
+		resp, err = ExchangeContext(ctx, inst.ups, req)
+		if err == nil {
+			return resp, nil
+		}
+
+		errs = append(errs, fmt.Errorf("instance %s: %w", inst.addr, err))
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	return nil, errors.Join(errs...)
+}
+
+// Close implements the [Upstream] interface for *srvUpstream.
+func (u *srvUpstream) Close() (err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.closed = true
+	insts := u.instances
+	u.instances = nil
+
+	return closeSRVInstances(insts)
+}
+
+// currentInstances returns the current instances, looking up the records if
+// there are none yet.  It starts a lookup in the background if the instances
+// are outdated.
+func (u *srvUpstream) currentInstances() (insts []*srvInstance, err error) {
+	u.mu.Lock()
+	insts, refreshedAt, closed := u.instances, u.refreshedAt, u.closed
+	u.mu.Unlock()
+
+	if closed {
+		return nil, net.ErrClosed
+	} else if len(insts) == 0 {
+		return u.refresh()
+	}
+
+	if time.Since(refreshedAt) >= u.interval && u.refreshing.CompareAndSwap(false, true) {
+		go u.refreshAsync()
+	}
+
+	return insts, nil
+}
+
+// refreshAsync looks up the records and logs the error, if any.  It's intended
+// to be used as a goroutine.
+func (u *srvUpstream) refreshAsync() {
+	defer slogutil.RecoverAndLog(context.TODO(), u.logger)
+	defer u.refreshing.Store(false)
+
+	_, err := u.refresh()
+	if err != nil {
+		u.logger.Error("refreshing srv upstream", "addr", u.addr, slogutil.KeyError, err)
+	}
+}
+
+// refresh looks up the records and updates the instances.  The instances of
+// the targets which are no longer in the records are closed.  If the lookup
+// fails, the previous instances are kept.
+func (u *srvUpstream) refresh() (insts []*srvInstance, err error) {
+	u.refreshMu.Lock()
+	defer u.refreshMu.Unlock()
+
+	u.mu.Lock()
+	prev, refreshedAt := u.instances, u.refreshedAt
+	u.mu.Unlock()
+
+	// Another goroutine may have already looked up the records.
+	if len(prev) > 0 && time.Since(refreshedAt) < u.interval {
+		return prev, nil
+	}
+
+	recs, err := u.lookupRecords()
+	if err != nil {
+		return prev, fmt.Errorf("looking up %s: %w", u.addr.Hostname(), err)
+	}
+
+	insts, err = u.newInstances(recs, prev)
+	if err != nil {
+		return prev, err
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.closed {
+		// The previous instances are already closed by [srvUpstream.Close].
+		return nil, errors.WithDeferred(net.ErrClosed, closeSRVInstances(unusedSRVInstances(insts, prev)))
+	}
+
+	u.instances, u.refreshedAt = insts, time.Now()
+
+	unused := unusedSRVInstances(prev, insts)
+	for _, inst := range unused {
+		u.logger.Info("srv upstream instance removed", "addr", u.addr, "instance", inst.addr)
+	}
+
+	return insts, closeSRVInstances(unused)
+}
+
+// lookupRecords looks up the SRV records of the host of the upstream.
+func (u *srvUpstream) lookupRecords() (recs []*net.SRV, err error) {
+	ctx := context.Background()
+	if u.opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, u.opts.Timeout)
+		defer cancel()
+	}
+
+	_, recs, err = u.lookup(ctx, "", "", u.addr.Hostname())
+
+	return recs, err
+}
+
+// newInstances returns the instances for recs, reusing the ones from prev with
+// the same addresses.
+func (u *srvUpstream) newInstances(
+	recs []*net.SRV,
+	prev []*srvInstance,
+) (insts []*srvInstance, err error) {
+	for _, rec := range recs {
+		target := strings.TrimSuffix(rec.Target, ".")
+		// The target "." means that the service isn't available, see RFC 2782.
+		if target == "" {
+			continue
+		}
+
+		addr := net.JoinHostPort(target, strconv.Itoa(int(rec.Port)))
+		if findSRVInstance(insts, addr) != nil {
+			continue
+		}
+
+		// Don't modify the previous instances, since they may be in use.
+		inst := &srvInstance{
+			addr:     addr,
+			priority: rec.Priority,
+		}
+
+		if old := findSRVInstance(prev, addr); old != nil {
+			inst.ups = old.ups
+		} else {
+			inst.ups, err = u.newUpstream(addr)
+			if err != nil {
+				return nil, errors.WithDeferred(err, closeSRVInstances(unusedSRVInstances(insts, prev)))
+			}
+
+			u.logger.Info("srv upstream instance added", "addr", u.addr, "instance", addr)
+		}
+
+		insts = append(insts, inst)
+	}
+
+	if len(insts) == 0 {
+		return nil, errNoSRVInstances
+	}
+
+	slices.SortStableFunc(insts, func(a, b *srvInstance) (res int) {
+		return int(a.priority) - int(b.priority)
+	})
+
+	return insts, nil
+}
+
+// newUpstream returns a new upstream for the target address with port.
+func (u *srvUpstream) newUpstream(addr string) (ups Upstream, err error) {
+	instURL := &url.URL{
+		Scheme: u.scheme,
+		Host:   addr,
+		Path:   u.addr.Path,
+	}
+
+	ups, err = urlToUpstream(instURL, u.opts)
+	if err != nil {
+		return nil, fmt.Errorf("instance %s: %w", addr, err)
+	}
+
+	return ups, nil
+}
+
+// order returns insts in the order they should be tried in.  The instances
+// with the highest priority are rotated, so that the load is spread between
+// them.
+func (u *srvUpstream) order(insts []*srvInstance) (ordered []*srvInstance) {
+	n := 1
+	for n < len(insts) && insts[n].priority == insts[0].priority {
+		n++
+	}
+
+	if n == 1 {
+		return insts
+	}
+
+	start := int(u.next.Add(1) % uint32(n))
+	ordered = make([]*srvInstance, 0, len(insts))
+	ordered = append(ordered, insts[start:n]...)
+	ordered = append(ordered, insts[:start]...)
+
+	return append(ordered, insts[n:]...)
+}
+
+// findSRVInstance returns the instance with addr from insts, if any.
+func findSRVInstance(insts []*srvInstance, addr string) (inst *srvInstance) {
+	i := slices.IndexFunc(insts, func(inst *srvInstance) (ok bool) { return inst.addr == addr })
+	if i < 0 {
+		return nil
+	}
+
+	return insts[i]
+}
+
+// unusedSRVInstances returns the instances from prev which addresses aren't in
+// cur.
+func unusedSRVInstances(prev, cur []*srvInstance) (unused []*srvInstance) {
+	for _, inst := range prev {
+		if findSRVInstance(cur, inst.addr) == nil {
+			unused = append(unused, inst)
+		}
+	}
+
+	return unused
+}
+
+// closeSRVInstances closes the upstreams of insts.
+func closeSRVInstances(insts []*srvInstance) (err error) {
+	var errs []error
+	for _, inst := range insts {
+		errs = append(errs, inst.ups.Close())
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,158 @@
+package upstream
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startSRVTestServer starts a test DNS server answering all the requests with
+// ip and returns its SRV record.
+func startSRVTestServer(t *testing.T, ip net.IP, prio uint16) (rec *net.SRV) {
+	t.Helper()
+
+	srv := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := (&dns.Msg{}).SetReply(req)
+		resp.Answer = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{
+				Name:   req.Question[0].Name,
+				Rrtype: dns.TypeA,
+				Class:  dns.ClassINET,
+				Ttl:    60,
+			},
+			A: ip,
+		}}
+
+		require.NoError(testutil.PanicT{}, w.WriteMsg(resp))
+	})
+	testutil.CleanupAndRequireSuccess(t, srv.Close)
+
+	return &net.SRV{
+		Target:   "127.0.0.1.",
+		Port:     uint16(srv.port),
+		Priority: prio,
+	}
+}
+
+func TestUpstream_srv(t *testing.T) {
+	const srvName = "_dns._udp.resolvers.example"
+
+	first := startSRVTestServer(t, net.IP{192, 0, 2, 1}, 10)
+	second := startSRVTestServer(t, net.IP{192, 0, 2, 2}, 20)
+
+	recs := &atomic.Pointer[[]*net.SRV]{}
+	recs.Store(&[]*net.SRV{second, first})
+
+	var lookups atomic.Int32
+	u, err := AddressToUpstream("srv+udp://"+srvName, &Options{
+		Timeout:            timeout,
+		SRVRefreshInterval: 100 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	assert.Equal(t, "srv+udp://"+srvName, u.Address())
+
+	srvUps := testutil.RequireTypeAssert[*srvUpstream](t, u)
+	srvUps.lookup = func(
+		_ context.Context,
+		service string,
+		proto string,
+		name string,
+	) (cname string, addrs []*net.SRV, err error) {
+		lookups.Add(1)
+		require.Equal(testutil.PanicT{}, srvName, name)
+
+		return name, *recs.Load(), nil
+	}
+
+	exchange := func() (ip net.IP) {
+		resp, exchErr := u.Exchange(createTestMessage())
+		require.NoError(testutil.PanicT{}, exchErr)
+		require.NotEmpty(testutil.PanicT{}, resp.Answer)
+
+		return resp.Answer[0].(*dns.A).A.To4()
+	}
+
+	// The instance with the highest priority is used.
+	assert.Equal(t, net.IP{192, 0, 2, 1}, exchange())
+	assert.Equal(t, net.IP{192, 0, 2, 1}, exchange())
+	assert.Equal(t, int32(1), lookups.Load())
+
+	// The removed instance isn't used once the records are looked up again.
+	recs.Store(&[]*net.SRV{second})
+	assert.Eventually(t, func() (ok bool) {
+		return exchange().Equal(net.IP{192, 0, 2, 2})
+	}, 2*time.Second, 50*time.Millisecond)
+}
+
+func TestUpstream_srv_failover(t *testing.T) {
+	working := startSRVTestServer(t, net.IP{192, 0, 2, 1}, 10)
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	// Don't answer the requests to the unresponsive instance.
+	testutil.CleanupAndRequireSuccess(t, pc.Close)
+
+	u, err := AddressToUpstream("srv+udp://_dns._udp.resolvers.example", &Options{
+		Timeout: 500 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	srvUps := testutil.RequireTypeAssert[*srvUpstream](t, u)
+	srvUps.lookup = func(
+		_ context.Context,
+		_ string,
+		_ string,
+		name string,
+	) (cname string, addrs []*net.SRV, err error) {
+		return name, []*net.SRV{{
+			Target:   "127.0.0.1.",
+			Port:     uint16(pc.LocalAddr().(*net.UDPAddr).Port),
+			Priority: 10,
+		}, working}, nil
+	}
+
+	for range 2 {
+		resp, exchErr := u.Exchange(createTestMessage())
+		require.NoError(t, exchErr)
+		require.NotEmpty(t, resp.Answer)
+	}
+}
+
+func TestAddressToUpstream_srv(t *testing.T) {
+	testCases := []struct {
+		name       string
+		addr       string
+		wantErrMsg string
+	}{{
+		name:       "port",
+		addr:       "srv+udp://_dns._udp.resolvers.example:53",
+		wantErrMsg: `srv upstream must have no port, got "srv+udp://_dns._udp.resolvers.example:53"`,
+	}, {
+		name:       "bad_scheme",
+		addr:       "srv+sdns://_dns._udp.resolvers.example",
+		wantErrMsg: "unsupported srv upstream scheme: sdns",
+	}, {
+		name: "bad_name",
+		addr: "srv+udp://_dns._udp.resolvers..example",
+		wantErrMsg: `bad service domain name "_dns._udp.resolvers..example": ` +
+			`bad hostname label "": hostname label is empty`,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := AddressToUpstream(tc.addr, &Options{Timeout: timeout})
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+		})
+	}
+}
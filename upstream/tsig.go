@@ -0,0 +1,105 @@
+package upstream
+
+import (
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/miekg/dns"
+)
+
+// TSIGFudge is the permitted difference in seconds between the time a message
+// is signed at and the time it's verified at, see RFC 8945 Section 10.
+const TSIGFudge = 300
+
+// TSIGKey is a shared secret key used to sign the DNS messages, see RFC 8945.
+type TSIGKey struct {
+	// Name is the name of the key.  It's compared in the canonical form.
+	Name string
+
+	// Algorithm is the name of the algorithm, for example [dns.HmacSHA256].  If
+	// empty, [dns.HmacSHA256] is used.
+	Algorithm string
+
+	// Secret is the base64-encoded secret of the key.
+	Secret string
+}
+
+// Validate returns an error if k is not a valid key.
+func (k *TSIGKey) Validate() (err error) {
+	if k == nil {
+		return errors.Error("no key")
+	} else if k.Name == "" {
+		return errors.Error("empty name")
+	}
+
+	switch alg := k.Alg(); alg {
+	case dns.HmacSHA1, dns.HmacSHA224, dns.HmacSHA256, dns.HmacSHA384, dns.HmacSHA512:
+		// Go on.
+	default:
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+
+	_, err = base64.StdEncoding.DecodeString(k.Secret)
+	if err != nil {
+		return fmt.Errorf("secret: %w", err)
+	}
+
+	return nil
+}
+
+// CanonicalName returns the name of k in the canonical form, as used in the
+// TSIG records.
+func (k *TSIGKey) CanonicalName() (name string) {
+	return dns.CanonicalName(k.Name)
+}
+
+// Alg returns the name of the algorithm of k in the canonical form.
+func (k *TSIGKey) Alg() (alg string) {
+	if k.Algorithm == "" {
+		return dns.HmacSHA256
+	}
+
+	return dns.CanonicalName(k.Algorithm)
+}
+
+// secrets returns the secrets of k in the form accepted by [dns.Client] and
+// [dns.Transfer].
+func (k *TSIGKey) secrets() (secrets map[string]string) {
+	return map[string]string{k.CanonicalName(): k.Secret}
+}
+
+// sign returns a copy of req to be signed with k when written.  The TSIG
+// record req is already signed with, if any, is replaced.
+func (k *TSIGKey) sign(req *dns.Msg) (signed *dns.Msg) {
+	signed = req.Copy()
+	if signed.IsTsig() != nil {
+		signed.Extra = signed.Extra[:len(signed.Extra)-1]
+	}
+
+	signed.SetTsig(k.CanonicalName(), k.Alg(), TSIGFudge, time.Now().Unix())
+
+	return signed
+}
+
+// errUnsigned is returned when the response to a signed request isn't signed.
+const errUnsigned errors.Error = "response is not signed"
+
+// checkSigned returns an error if resp to the request signed with k isn't
+// signed.  The signature itself is verified when the response is read.  It
+// removes the TSIG record from resp, since it's only valid for the exchange
+// with the upstream.
+func (k *TSIGKey) checkSigned(resp *dns.Msg) (err error) {
+	if k == nil || resp == nil {
+		return nil
+	}
+
+	if resp.IsTsig() == nil {
+		return errUnsigned
+	}
+
+	resp.Extra = resp.Extra[:len(resp.Extra)-1]
+
+	return nil
+}
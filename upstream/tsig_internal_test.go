@@ -0,0 +1,129 @@
+package upstream
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testTSIGKey is the key used to sign the messages in tests.
+var testTSIGKey = &TSIGKey{
+	Name:   "test.key.",
+	Secret: "c2VjcmV0c2VjcmV0c2VjcmV0c2VjcmV0",
+}
+
+// startTSIGServer starts a UDP DNS server verifying the signatures with
+// testTSIGKey.  The responses are signed only if sign is true.
+func startTSIGServer(t *testing.T, sign bool) (addr string) {
+	t.Helper()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	srv := &dns.Server{
+		PacketConn: pc,
+		TsigSecret: testTSIGKey.secrets(),
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			resp := respondToTestMessage(req)
+			if tsig := req.IsTsig(); tsig == nil || w.TsigStatus() != nil {
+				resp.Rcode = dns.RcodeNotAuth
+			} else if sign {
+				resp.SetTsig(tsig.Hdr.Name, tsig.Algorithm, TSIGFudge, time.Now().Unix())
+			}
+
+			require.NoError(testutil.PanicT{}, w.WriteMsg(resp))
+		}),
+	}
+
+	go func() {
+		require.NoError(testutil.PanicT{}, srv.ActivateAndServe())
+	}()
+	testutil.CleanupAndRequireSuccess(t, srv.Shutdown)
+
+	return pc.LocalAddr().String()
+}
+
+func TestUpstream_plainDNS_tsig(t *testing.T) {
+	t.Run("signed", func(t *testing.T) {
+		u, err := AddressToUpstream(startTSIGServer(t, true), &Options{
+			Timeout: timeout,
+			TSIGKey: testTSIGKey,
+		})
+		require.NoError(t, err)
+		testutil.CleanupAndRequireSuccess(t, u.Close)
+
+		resp, err := u.Exchange(createTestMessage())
+		require.NoError(t, err)
+
+		assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+		assert.Nil(t, resp.IsTsig())
+	})
+
+	t.Run("unsigned_response", func(t *testing.T) {
+		u, err := AddressToUpstream(startTSIGServer(t, false), &Options{
+			Timeout: timeout,
+			TSIGKey: testTSIGKey,
+		})
+		require.NoError(t, err)
+		testutil.CleanupAndRequireSuccess(t, u.Close)
+
+		_, err = u.Exchange(createTestMessage())
+		assert.ErrorIs(t, err, errUnsigned)
+	})
+
+	t.Run("unsigned_request", func(t *testing.T) {
+		u, err := AddressToUpstream(startTSIGServer(t, true), &Options{
+			Timeout: timeout,
+		})
+		require.NoError(t, err)
+		testutil.CleanupAndRequireSuccess(t, u.Close)
+
+		resp, err := u.Exchange(createTestMessage())
+		require.NoError(t, err)
+
+		assert.Equal(t, dns.RcodeNotAuth, resp.Rcode)
+	})
+}
+
+func TestTSIGKey_Validate(t *testing.T) {
+	testCases := []struct {
+		key        *TSIGKey
+		name       string
+		wantErrMsg string
+	}{{
+		key:        testTSIGKey,
+		name:       "valid",
+		wantErrMsg: "",
+	}, {
+		key:        nil,
+		name:       "nil",
+		wantErrMsg: "no key",
+	}, {
+		key:        &TSIGKey{Secret: testTSIGKey.Secret},
+		name:       "no_name",
+		wantErrMsg: "empty name",
+	}, {
+		key: &TSIGKey{
+			Name:      "test.key.",
+			Algorithm: "hmac-md5.sig-alg.reg.int.",
+			Secret:    testTSIGKey.Secret,
+		},
+		name:       "bad_algorithm",
+		wantErrMsg: `unsupported algorithm "hmac-md5.sig-alg.reg.int."`,
+	}, {
+		key:        &TSIGKey{Name: "test.key.", Secret: "!"},
+		name:       "bad_secret",
+		wantErrMsg: "secret: illegal base64 data at input byte 0",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, tc.key.Validate())
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/internal/bootstrap"
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+const (
+	// defaultUDPPortsSize is the default number of the sockets in the pool of
+	// a plain DNS-over-UDP upstream.
+	defaultUDPPortsSize = 16
+
+	// defaultUDPPortsLifetime is the default duration a pooled socket of a
+	// plain DNS-over-UDP upstream is used for.
+	defaultUDPPortsLifetime = time.Minute
+
+	// defaultUDPMinPort is the default lowest source port of the pooled
+	// sockets, which excludes the well-known ports.
+	defaultUDPMinPort = 1024
+
+	// defaultUDPMaxPort is the default highest source port of the pooled
+	// sockets.
+	defaultUDPMaxPort = 65535
+
+	// maxUDPPortAttempts is the maximum number of the random ports tried for a
+	// single socket before giving up.
+	maxUDPPortAttempts = 8
+)
+
+// UDPPortPoolConfig is the configuration of the pool of the sockets used for
+// the queries to a plain DNS-over-UDP upstream.  Each socket is bound to a
+// random source port and is replaced with another one once its lifetime is
+// over, so that the source ports of the queries are both unpredictable and
+// limited in number.
+type UDPPortPoolConfig struct {
+	// Size is the number of the sockets bound right after the upstream is
+	// created and kept for reuse.  The exchanges requiring more sockets bind
+	// the additional ones, which are closed once the exchange is finished.
+	// Zero means the default of 16.
+	Size uint
+
+	// Lifetime is the maximum duration since a socket is bound, after which
+	// it's closed and replaced with a new one.  Zero means the default of one
+	// minute.
+	Lifetime time.Duration
+
+	// MinPort is the lowest source port to bind the sockets to.  Zero means
+	// the default of 1024.
+	MinPort uint16
+
+	// MaxPort is the highest source port to bind the sockets to.  Zero means
+	// the default of 65535.
+	MaxPort uint16
+}
+
+// validate returns an error if c is invalid.  c may be nil.
+func (c *UDPPortPoolConfig) validate() (err error) {
+	if c == nil {
+		return nil
+	}
+
+	minPort, maxPort := c.ports()
+	if minPort > maxPort {
+		return fmt.Errorf("min port %d is greater than max port %d", minPort, maxPort)
+	}
+
+	return nil
+}
+
+// ports returns the range of the source ports.  c must not be nil.
+func (c *UDPPortPoolConfig) ports() (minPort, maxPort uint16) {
+	minPort, maxPort = c.MinPort, c.MaxPort
+	if minPort == 0 {
+		minPort = defaultUDPMinPort
+	}
+
+	if maxPort == 0 {
+		maxPort = defaultUDPMaxPort
+	}
+
+	return minPort, maxPort
+}
+
+// connPoolConfig returns the configuration of the pool storing the sockets.
+// c must not be nil.
+func (c *UDPPortPoolConfig) connPoolConfig() (conf *ConnPoolConfig) {
+	conf = &ConnPoolConfig{
+		MaxIdleConns: c.Size,
+		MaxConnAge:   c.Lifetime,
+		Prewarm:      c.Size,
+	}
+
+	if conf.MaxIdleConns == 0 {
+		conf.MaxIdleConns = defaultUDPPortsSize
+		conf.Prewarm = defaultUDPPortsSize
+	}
+
+	if conf.MaxConnAge == 0 {
+		conf.MaxConnAge = defaultUDPPortsLifetime
+	}
+
+	return conf
+}
+
+// randomPortDial returns a function dialing the UDP sockets with dial, each
+// bound to a random source port within the range of c.  c must not be nil.
+func (c *UDPPortPoolConfig) randomPortDial(
+	ctx context.Context,
+	dial bootstrap.DialHandler,
+) (f func() (conn net.Conn, err error)) {
+	minPort, maxPort := c.ports()
+	portsNum := uint(maxPort) - uint(minPort) + 1
+
+	return func() (conn net.Conn, err error) {
+		for range maxUDPPortAttempts {
+			port := minPort + uint16(rand.UintN(portsNum))
+			conn, err = dial(bootstrap.WithLocalPort(ctx, port), networkUDP, "")
+			if !errors.Is(err, syscall.EADDRINUSE) {
+				return conn, err
+			}
+		}
+
+		return nil, fmt.Errorf("no free port after %d attempts: %w", maxUDPPortAttempts, err)
+	}
+}
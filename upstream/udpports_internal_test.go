@@ -0,0 +1,132 @@
+package upstream
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpstream_plainDNS_udpPorts(t *testing.T) {
+	const (
+		minPort = 40000
+		maxPort = 40999
+	)
+
+	mu := &sync.Mutex{}
+	ports := map[uint16]struct{}{}
+
+	srv := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		addr, ok := w.RemoteAddr().(*net.UDPAddr)
+		if ok {
+			mu.Lock()
+			ports[uint16(addr.Port)] = struct{}{}
+			mu.Unlock()
+		}
+
+		require.NoError(testutil.PanicT{}, w.WriteMsg(respondToTestMessage(req)))
+	})
+	testutil.CleanupAndRequireSuccess(t, srv.Close)
+
+	addr := fmt.Sprintf("127.0.0.1:%d", srv.port)
+
+	// getPorts returns the source ports of the queries received so far and
+	// forgets them.
+	getPorts := func() (got []uint16) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		for p := range ports {
+			got = append(got, p)
+		}
+		clear(ports)
+
+		return got
+	}
+
+	t.Run("reuse", func(t *testing.T) {
+		u, err := AddressToUpstream(addr, &Options{
+			UDPPorts: &UDPPortPoolConfig{
+				Size:    2,
+				MinPort: minPort,
+				MaxPort: maxPort,
+			},
+		})
+		require.NoError(t, err)
+		testutil.CleanupAndRequireSuccess(t, u.Close)
+
+		for range 10 {
+			checkUpstream(t, u, addr)
+		}
+
+		got := getPorts()
+		assert.NotEmpty(t, got)
+		assert.LessOrEqual(t, len(got), 2)
+		for _, p := range got {
+			assert.GreaterOrEqual(t, p, uint16(minPort))
+			assert.LessOrEqual(t, p, uint16(maxPort))
+		}
+	})
+
+	t.Run("rotate", func(t *testing.T) {
+		u, err := AddressToUpstream(addr, &Options{
+			UDPPorts: &UDPPortPoolConfig{
+				Size:     1,
+				Lifetime: time.Nanosecond,
+				MinPort:  minPort,
+				MaxPort:  maxPort,
+			},
+		})
+		require.NoError(t, err)
+		testutil.CleanupAndRequireSuccess(t, u.Close)
+
+		// The sockets get stale right after they're bound, so each query should
+		// use a new one.
+		for range 5 {
+			checkUpstream(t, u, addr)
+		}
+
+		for _, p := range getPorts() {
+			assert.GreaterOrEqual(t, p, uint16(minPort))
+			assert.LessOrEqual(t, p, uint16(maxPort))
+		}
+	})
+
+	t.Run("busy_port", func(t *testing.T) {
+		busy, err := net.ListenUDP("udp", net.UDPAddrFromAddrPort(
+			netip.AddrPortFrom(netip.IPv4Unspecified(), 0),
+		))
+		require.NoError(t, err)
+		testutil.CleanupAndRequireSuccess(t, busy.Close)
+
+		port := uint16(busy.LocalAddr().(*net.UDPAddr).Port)
+		u, err := AddressToUpstream(addr, &Options{
+			UDPPorts: &UDPPortPoolConfig{
+				MinPort: port,
+				MaxPort: port,
+			},
+		})
+		require.NoError(t, err)
+		testutil.CleanupAndRequireSuccess(t, u.Close)
+
+		_, err = u.Exchange(createTestMessage())
+		assert.ErrorContains(t, err, "no free port after 8 attempts")
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := AddressToUpstream(addr, &Options{
+			UDPPorts: &UDPPortPoolConfig{
+				MinPort: maxPort,
+				MaxPort: minPort,
+			},
+		})
+		testutil.AssertErrorMsg(t, "udp ports: min port 40999 is greater than max port 40000", err)
+	})
+}
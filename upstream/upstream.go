@@ -8,6 +8,7 @@ import (
 	"crypto/x509"
 	"fmt"
 	"io"
+	"log/slog"
 	"net"
 	"net/netip"
 	"net/url"
@@ -17,8 +18,8 @@ import (
 	"time"
 
 	"github.com/AdguardTeam/dnsproxy/internal/bootstrap"
+	proxynetutil "github.com/AdguardTeam/dnsproxy/internal/netutil"
 	"github.com/AdguardTeam/golibs/errors"
-	"github.com/AdguardTeam/golibs/log"
 	"github.com/AdguardTeam/golibs/netutil"
 	"github.com/ameshkov/dnscrypt/v2"
 	"github.com/ameshkov/dnsstamps"
@@ -27,7 +28,9 @@ import (
 	"github.com/quic-go/quic-go/logging"
 )
 
-// Upstream is an interface for a DNS resolver.
+// Upstream is an interface for a DNS resolver.  The implementations able to
+// abort the exchange in progress should also implement [ContextExchanger], see
+// [ExchangeContext].
 type Upstream interface {
 	// Exchange sends the DNS query req to this upstream and returns the
 	// response that has been received or an error if something went wrong.
@@ -41,6 +44,32 @@ type Upstream interface {
 	io.Closer
 }
 
+// TCPExchanger is implemented by the upstreams able to exchange the messages
+// over TCP regardless of the network they are configured with.
+type TCPExchanger interface {
+	// ExchangeTCP is like [Upstream.Exchange], but always sends req over TCP.
+	ExchangeTCP(req *dns.Msg) (resp *dns.Msg, err error)
+}
+
+// ContextExchanger is implemented by the upstreams able to abort the exchange
+// in progress once its context is canceled.
+type ContextExchanger interface {
+	// ExchangeContext is like [Upstream.Exchange], but returns as soon as ctx
+	// is canceled, aborting the exchange.  It's the same as Exchange if ctx is
+	// [context.Background].
+	ExchangeContext(ctx context.Context, req *dns.Msg) (resp *dns.Msg, err error)
+}
+
+// Transferer is implemented by the upstreams able to transfer the zones, see
+// RFC 5936 and RFC 1995.
+type Transferer interface {
+	// Transfer sends the AXFR or IXFR request req over TCP and returns the
+	// channel the received records are sent to.  The channel is closed once
+	// the transfer is over, and the last envelope sent to it contains the
+	// error, if any.
+	Transfer(req *dns.Msg) (ch <-chan *dns.Envelope, err error)
+}
+
 // QUICTraceFunc is a function that returns a [logging.ConnectionTracer]
 // specific for a given role and connection ID.
 type QUICTraceFunc func(
@@ -52,6 +81,10 @@ type QUICTraceFunc func(
 // Options for AddressToUpstream func.  With these options we can configure the
 // upstream properties.
 type Options struct {
+	// Logger is used for logging during parsing and upstream exchange.  If nil,
+	// [slog.Default] is used.
+	Logger *slog.Logger
+
 	// VerifyServerCertificate is used to set the VerifyPeerCertificate property
 	// of the *tls.Config for DNS-over-HTTPS, DNS-over-QUIC, and DNS-over-TLS.
 	VerifyServerCertificate func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error
@@ -77,6 +110,12 @@ type Options struct {
 	// CipherSuites is a custom list of TLSv1.2 ciphers.
 	CipherSuites []uint16
 
+	// KeyLogWriter is used to set the KeyLogWriter property of the *tls.Config
+	// for DNS-over-HTTPS, DNS-over-QUIC, and DNS-over-TLS.  The TLS session
+	// secrets written to it allow decrypting the traffic, so it should only be
+	// used for debugging.
+	KeyLogWriter io.Writer
+
 	// Bootstrap is used to resolve upstreams' hostnames.  If nil, the
 	// [net.DefaultResolver] will be used.
 	Bootstrap Resolver
@@ -95,11 +134,138 @@ type Options struct {
 	// PreferIPv6 tells the bootstrapper to prefer IPv6 addresses for an
 	// upstream.
 	PreferIPv6 bool
+
+	// IPVersion is the preference of the address family used to dial the
+	// upstreams which hostnames resolve to the addresses of both families.  It
+	// doesn't affect the upstreams specified with an IP address.  If it's
+	// [IPVersionDefault], PreferIPv6 is used.
+	IPVersion IPVersion
+
+	// IPVersions overrides IPVersion for the particular upstreams.  The keys
+	// are the addresses of the upstreams as passed to [AddressToUpstream].
+	IPVersions map[string]IPVersion
+
+	// ReceiveBufferSize is the size of the receive buffer of the sockets
+	// dialed to plain DNS, DNS-over-TLS, and DNS-over-HTTPS upstreams, except
+	// for HTTP/3.  A value <= 0 means the system default.
+	ReceiveBufferSize int
+
+	// SendBufferSize is like ReceiveBufferSize, but for the send buffer.
+	SendBufferSize int
+
+	// TCPFastOpen enables TCP Fast Open for the connections to plain DNS over
+	// TCP, DNS-over-TLS, and DNS-over-HTTPS upstreams, except for HTTP/3, where
+	// the OS supports it.
+	TCPFastOpen bool
+
+	// MultipathTCP enables Multipath TCP for the connections to plain DNS over
+	// TCP, DNS-over-TLS, and DNS-over-HTTPS upstreams, except for HTTP/3, so
+	// that the long-lived connections survive switching between the uplinks.
+	// The connections fall back to the regular TCP where the OS or the server
+	// doesn't support it.
+	MultipathTCP bool
+
+	// DSCP is the Differentiated Services Code Point the packets sent to the
+	// upstreams are marked with, see RFC 2474.  It must not be greater than 63.
+	// Zero means the packets aren't marked.  It's applied to all the upstreams
+	// except for DNSCrypt ones, and isn't supported on Windows.
+	DSCP uint8
+
+	// Interface is the name of the network interface to bind the sockets
+	// dialed to the upstreams to, so that the queries are sent through it.  On
+	// Linux, it may also be a VRF device, so that the upstreams are resolved
+	// and reached using the routing table of the VRF.  It's applied to all the
+	// upstreams except for DNSCrypt ones, and only supported on Linux and
+	// macOS.  If empty, the sockets aren't bound to an interface.
+	Interface string
+
+	// ConnPool configures the pool of the connections to plain DNS-over-TCP
+	// and DNS-over-TLS upstreams.  If nil, the connections to DNS-over-TLS
+	// upstreams are pooled without limits, and the ones to plain DNS-over-TCP
+	// upstreams aren't reused.
+	ConnPool *ConnPoolConfig
+
+	// UDPPorts configures the pool of the sockets bound to the random source
+	// ports used for the queries to plain DNS-over-UDP upstreams.  If nil, a
+	// new socket is dialed for each query, bound to the port chosen by the OS.
+	UDPPorts *UDPPortPoolConfig
+
+	// MaxCompressionPointers is the maximum number of the compression pointers
+	// forming a single domain name in the responses.  Besides that, each
+	// pointer must point before the part of the name it's located in, which
+	// rules out the loops.  The responses violating that are rejected before
+	// being unpacked.  It doesn't affect DNSCrypt upstreams.  Zero disables
+	// the checks.
+	MaxCompressionPointers uint
+
+	// EDNSBuffer configures the adaptive EDNS buffer sizing of plain
+	// DNS-over-UDP upstreams.  If nil, the requests are sent as is.
+	EDNSBuffer *EDNSBufferConfig
+
+	// HTTP2 configures the HTTP/2 transport of DNS-over-HTTPS upstreams.  If
+	// nil, the defaults are used.
+	HTTP2 *HTTP2Config
+
+	// Retry configures retrying the failed exchanges with the upstreams.  If
+	// nil, the failed exchanges aren't retried.
+	Retry *RetryConfig
+
+	// RootHints are the addresses of the root name servers the recursive
+	// upstreams start the resolution from.  If empty, the root servers
+	// published by IANA are used.
+	RootHints []netip.AddrPort
+
+	// TSIGKey, if not nil, is the key the requests to the plain DNS upstreams
+	// are signed with, see RFC 8945.  The responses are required to be signed
+	// with the same key.  Other upstreams ignore it.
+	TSIGKey *TSIGKey
+
+	// ECH enables Encrypted Client Hello for the DNS-over-HTTPS and
+	// DNS-over-TLS upstreams, except for HTTP/3, specified with a hostname,
+	// which publishes the ECH configuration list in its HTTPS records.  Those
+	// are looked up with Bootstrap, which should implement [ECHResolver] or be
+	// a [ParallelResolver] or a [ConsequentResolver] of those.  The upstreams
+	// are connected to without ECH, if the lookup fails or the server disables
+	// it.  ECH is only supported when built with Go 1.23 or later.
+	ECH bool
+
+	// QUICSessionCache, if not nil, is the cache of the TLS sessions shared by
+	// the DNS-over-QUIC upstreams instead of the in-memory cache of each one,
+	// so that the sessions could be persisted and the connections dialed after
+	// a restart could use 0-RTT.
+	QUICSessionCache *SessionCache
+
+	// SRVRefreshInterval is the time after which the SRV records of the
+	// upstreams discovered with them are looked up again.  If zero, 30 seconds
+	// is used.
+	SRVRefreshInterval time.Duration
+
+	// DialContext, if not nil, is used to dial the connections to the
+	// upstreams and their bootstrapped addresses instead of [net.Dialer], so
+	// that the traffic could be routed through a VPN tunnel or a userspace
+	// network stack.  TCPFastOpen, MultipathTCP, DSCP, Interface, and the
+	// source ports of UDPPorts aren't applied to the connections dialed with
+	// it.  It's used by all the upstreams except for DNSCrypt ones.
+	DialContext func(ctx context.Context, network, addr string) (conn net.Conn, err error)
+
+	// ListenPacket, if not nil, is used to create the UDP sockets of the
+	// DNS-over-QUIC and HTTP/3 upstreams, which are otherwise created by the
+	// QUIC implementation.  The sockets are closed once the QUIC connections
+	// are closed.
+	ListenPacket func(ctx context.Context, network, addr string) (conn net.PacketConn, err error)
+
+	// DNSCryptRelays are the addresses of the Anonymized DNSCrypt relays the
+	// queries to the DNSCrypt upstreams, including the certificate requests,
+	// are sent through, hiding the address of the proxy from the servers.  A
+	// random one is used for each exchange.  If empty, the servers are queried
+	// directly.
+	DNSCryptRelays []netip.AddrPort
 }
 
 // Clone copies o to a new struct.  Note, that this is not a deep clone.
 func (o *Options) Clone() (clone *Options) {
 	return &Options{
+		Logger:                    o.Logger,
 		Bootstrap:                 o.Bootstrap,
 		Timeout:                   o.Timeout,
 		HTTPVersions:              o.HTTPVersions,
@@ -108,10 +274,51 @@ func (o *Options) Clone() (clone *Options) {
 		VerifyDNSCryptCertificate: o.VerifyDNSCryptCertificate,
 		InsecureSkipVerify:        o.InsecureSkipVerify,
 		PreferIPv6:                o.PreferIPv6,
+		IPVersion:                 o.IPVersion,
+		IPVersions:                o.IPVersions,
 		QUICTracer:                o.QUICTracer,
 		RootCAs:                   o.RootCAs,
 		CipherSuites:              o.CipherSuites,
+		KeyLogWriter:              o.KeyLogWriter,
+		ReceiveBufferSize:         o.ReceiveBufferSize,
+		SendBufferSize:            o.SendBufferSize,
+		TCPFastOpen:               o.TCPFastOpen,
+		MultipathTCP:              o.MultipathTCP,
+		DSCP:                      o.DSCP,
+		Interface:                 o.Interface,
+		ConnPool:                  o.ConnPool,
+		UDPPorts:                  o.UDPPorts,
+		EDNSBuffer:                o.EDNSBuffer,
+		MaxCompressionPointers:    o.MaxCompressionPointers,
+		HTTP2:                     o.HTTP2,
+		Retry:                     o.Retry,
+		RootHints:                 o.RootHints,
+		TSIGKey:                   o.TSIGKey,
+		QUICSessionCache:          o.QUICSessionCache,
+		ECH:                       o.ECH,
+		SRVRefreshInterval:        o.SRVRefreshInterval,
+		DNSCryptRelays:            o.DNSCryptRelays,
+		DialContext:               o.DialContext,
+		ListenPacket:              o.ListenPacket,
+	}
+}
+
+// dialControl returns the function setting up the sockets dialed to the
+// upstreams, if any.
+func (o *Options) dialControl() (f bootstrap.ControlFunc) {
+	if o.TCPFastOpen {
+		f = proxynetutil.FastOpenControl
+	}
+
+	if o.DSCP != 0 {
+		f = proxynetutil.ChainControl(f, proxynetutil.DSCPControl(o.DSCP))
+	}
+
+	if o.Interface != "" {
+		f = proxynetutil.ChainControl(f, proxynetutil.InterfaceControl(o.Interface))
 	}
+
+	return f
 }
 
 // HTTPVersion is an enumeration of the HTTP versions that we support.  Values
@@ -163,7 +370,12 @@ const (
 //   - quic://5.3.5.3:853 for DNS-over-QUIC using IP address;
 //   - quic://name.server:853 for DNS-over-QUIC using domain name;
 //   - h3://dns.google for DNS-over-HTTPS that only works with HTTP/3;
-//   - sdns://... for DNS stamp, see https://dnscrypt.info/stamps-specifications.
+//   - sdns://... for DNS stamp, see https://dnscrypt.info/stamps-specifications;
+//   - recursive:// for resolving the names iteratively starting from the root
+//     name servers, see [Options.RootHints];
+//   - srv+udp://_dns._udp.service.example for the instances discovered with the
+//     SRV records of the name, which addresses are used with the scheme after
+//     "srv+", see [Options.SRVRefreshInterval].
 //
 // If addr doesn't have port specified, the default port of the appropriate
 // protocol will be used.
@@ -177,6 +389,26 @@ func AddressToUpstream(addr string, opts *Options) (u Upstream, err error) {
 		opts = &Options{}
 	}
 
+	if opts.Logger == nil {
+		opts = opts.Clone()
+		opts.Logger = slog.Default()
+	}
+
+	if v, ok := opts.IPVersions[addr]; ok {
+		opts = opts.Clone()
+		opts.IPVersion = v
+	}
+
+	err = opts.IPVersion.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("ip version: %w", err)
+	}
+
+	err = opts.Retry.validate()
+	if err != nil {
+		return nil, fmt.Errorf("retry: %w", err)
+	}
+
 	var uu *url.URL
 	if strings.Contains(addr, "://") {
 		uu, err = url.Parse(addr)
@@ -196,12 +428,22 @@ func AddressToUpstream(addr string, opts *Options) (u Upstream, err error) {
 		return nil, err
 	}
 
-	return urlToUpstream(uu, opts)
+	if opts.Retry != nil && opts.Retry.TryTimeout > 0 {
+		opts = opts.Clone()
+		opts.Timeout = opts.Retry.TryTimeout
+	}
+
+	u, err = urlToUpstream(uu, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return withRetries(u, opts), nil
 }
 
 // validateUpstreamURL returns an error if the upstream URL is not valid.
 func validateUpstreamURL(u *url.URL) (err error) {
-	if u.Scheme == "sdns" {
+	if u.Scheme == "sdns" || u.Scheme == "recursive" || strings.HasPrefix(u.Scheme, srvSchemePrefix) {
 		return nil
 	}
 
@@ -251,7 +493,13 @@ func urlToUpstream(uu *url.URL, opts *Options) (u Upstream, err error) {
 		return newDoT(uu, opts)
 	case "h3", "https":
 		return newDoH(uu, opts)
+	case "recursive":
+		return newRecursive(uu, opts)
 	default:
+		if strings.HasPrefix(sch, srvSchemePrefix) {
+			return newSRV(uu, opts)
+		}
+
 		return nil, fmt.Errorf("unsupported url scheme: %s", sch)
 	}
 }
@@ -310,7 +558,7 @@ func addPort(u *url.URL, port uint16) {
 // logBegin logs the start of DNS request resolution.  It should be called right
 // before dialing the connection to the upstream.  n is the [network] that will
 // be used to send the request.
-func logBegin(addr string, n network, req *dns.Msg) {
+func logBegin(l *slog.Logger, addr string, n network, req *dns.Msg) {
 	var qtype dns.Type
 	var qname string
 	if len(req.Question) != 0 {
@@ -318,25 +566,25 @@ func logBegin(addr string, n network, req *dns.Msg) {
 		qname = req.Question[0].Name
 	}
 
-	log.Debug("dnsproxy: sending request to %s over %s: %s %q", addr, n, qtype, qname)
+	l.Debug("sending request", "addr", addr, "proto", n, "qtype", qtype, "qname", qname)
 }
 
 // logFinish logs the end of DNS request resolution.  It should be called right
 // after receiving the response from the upstream or the failing action.  n is
 // the [network] that was used to send the request.
-func logFinish(addr string, n network, err error) {
-	logRoutine := log.Debug
+func logFinish(l *slog.Logger, addr string, n network, err error) {
+	lvl := slog.LevelDebug
 
 	status := "ok"
 	if err != nil {
 		status = err.Error()
 		if isTimeout(err) {
 			// Notify user about the timeout.
-			logRoutine = log.Error
+			lvl = slog.LevelError
 		}
 	}
 
-	logRoutine("dnsproxy: %s: response received over %s: %q", addr, n, status)
+	l.Log(context.Background(), lvl, "response received", "addr", addr, "proto", n, "status", status)
 }
 
 // isTimeout returns true if err is a timeout error.
@@ -365,7 +613,15 @@ type DialerInitializer func() (handler bootstrap.DialHandler, err error)
 func newDialerInitializer(u *url.URL, opts *Options) (di DialerInitializer) {
 	if _, err := netip.ParseAddrPort(u.Host); err == nil {
 		// Don't resolve the address of the server since it's already an IP.
-		handler := bootstrap.NewDialContext(opts.Timeout, u.Host)
+		handler := bootstrap.NewDialContext(
+			opts.Timeout,
+			opts.dialControl(),
+			opts.MultipathTCP,
+			opts.DialContext,
+			opts.Logger,
+			u.Host,
+		)
+		handler = withBufferSizes(handler, opts)
 
 		return func() (h bootstrap.DialHandler, dialerErr error) {
 			return handler, nil
@@ -378,7 +634,50 @@ func newDialerInitializer(u *url.URL, opts *Options) (di DialerInitializer) {
 		boot = net.DefaultResolver
 	}
 
+	ipVer := opts.dialIPVersion()
+
 	return func() (h bootstrap.DialHandler, err error) {
-		return bootstrap.ResolveDialContext(u, opts.Timeout, boot, opts.PreferIPv6)
+		h, err = bootstrap.ResolveDialContext(
+			u,
+			opts.Timeout,
+			boot,
+			ipVer.network(),
+			ipVer == IPVersionPreferIPv6,
+			opts.dialControl(),
+			opts.MultipathTCP,
+			opts.DialContext,
+			opts.Logger,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		return withBufferSizes(h, opts), nil
+	}
+}
+
+// withBufferSizes returns the handler setting the sizes of the socket buffers
+// of the connections dialed by h according to opts.  It returns h itself if
+// the sizes are left to the system default.
+func withBufferSizes(h bootstrap.DialHandler, opts *Options) (wrapped bootstrap.DialHandler) {
+	recv, send := opts.ReceiveBufferSize, opts.SendBufferSize
+	if recv <= 0 && send <= 0 {
+		return h
+	}
+
+	return func(ctx context.Context, network, addr string) (conn net.Conn, err error) {
+		conn, err = h(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		err = proxynetutil.SetBufferSizes(conn, recv, send)
+		if err != nil {
+			_ = conn.Close()
+
+			return nil, err
+		}
+
+		return conn, nil
 	}
 }
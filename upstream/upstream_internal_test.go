@@ -1,6 +1,7 @@
 package upstream
 
 import (
+	"context"
 	"crypto/ecdsa"
 	"crypto/rand"
 	"crypto/rsa"
@@ -554,6 +555,59 @@ func TestAddPort(t *testing.T) {
 	}
 }
 
+// bufferTestConn is a [net.Conn] recording the sizes of its socket buffers.
+type bufferTestConn struct {
+	net.Conn
+
+	recv int
+	send int
+}
+
+// SetReadBuffer implements the bufferSetter interface for *bufferTestConn.
+func (c *bufferTestConn) SetReadBuffer(bytes int) (err error) {
+	c.recv = bytes
+
+	return nil
+}
+
+// SetWriteBuffer implements the bufferSetter interface for *bufferTestConn.
+func (c *bufferTestConn) SetWriteBuffer(bytes int) (err error) {
+	c.send = bytes
+
+	return nil
+}
+
+func TestWithBufferSizes(t *testing.T) {
+	const recv, send = 1 << 20, 1 << 19
+
+	conn := &bufferTestConn{}
+	h := func(_ context.Context, _, _ string) (c net.Conn, err error) {
+		return conn, nil
+	}
+
+	t.Run("default", func(t *testing.T) {
+		wrapped := withBufferSizes(h, &Options{})
+		c, err := wrapped(context.Background(), networkUDP, "")
+		require.NoError(t, err)
+
+		assert.Same(t, conn, c)
+		assert.Zero(t, conn.recv)
+		assert.Zero(t, conn.send)
+	})
+
+	t.Run("set", func(t *testing.T) {
+		wrapped := withBufferSizes(h, &Options{
+			ReceiveBufferSize: recv,
+			SendBufferSize:    send,
+		})
+		_, err := wrapped(context.Background(), networkUDP, "")
+		require.NoError(t, err)
+
+		assert.Equal(t, recv, conn.recv)
+		assert.Equal(t, send, conn.send)
+	})
+}
+
 // checkUpstream sends a test message to the upstream and checks the result.
 func checkUpstream(t *testing.T, u Upstream, addr string) {
 	t.Helper()
@@ -0,0 +1,113 @@
+package upstreamtest
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+)
+
+// Exchange is a single exchange recorded by a [Recorder].
+type Exchange struct {
+	// Req is the copy of the query.
+	Req *dns.Msg
+
+	// Resp is the copy of the response.  It's nil if there is none.
+	Resp *dns.Msg
+
+	// Err is the error of the exchange.
+	Err error
+
+	// Duration is the duration of the exchange.
+	Duration time.Duration
+}
+
+// Recorder is an [upstream.Upstream] recording the exchanges with another one.
+//
+// It's safe for concurrent use, if the wrapped upstream is.
+type Recorder struct {
+	// ups is the wrapped upstream.
+	ups upstream.Upstream
+
+	// mu protects exchanges.
+	mu *sync.Mutex
+
+	// exchanges are the recorded exchanges in the order of completion.
+	exchanges []*Exchange
+}
+
+// NewRecorder returns a new *Recorder of the exchanges with u, which must not be
+// nil.
+func NewRecorder(u upstream.Upstream) (r *Recorder) {
+	return &Recorder{
+		ups: u,
+		mu:  &sync.Mutex{},
+	}
+}
+
+// type check
+var _ upstream.Upstream = (*Recorder)(nil)
+
+// Address implements the [upstream.Upstream] interface for *Recorder.
+func (r *Recorder) Address() (addr string) {
+	return r.ups.Address()
+}
+
+// Exchange implements the [upstream.Upstream] interface for *Recorder.
+func (r *Recorder) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	return r.ExchangeContext(context.Background(), req)
+}
+
+// type check
+var _ upstream.ContextExchanger = (*Recorder)(nil)
+
+// ExchangeContext implements the [upstream.ContextExchanger] interface for
+// *Recorder.
+func (r *Recorder) ExchangeContext(
+	ctx context.Context,
+	req *dns.Msg,
+) (resp *dns.Msg, err error) {
+	e := &Exchange{
+		Req: req.Copy(),
+	}
+
+	start := time.Now()
+	resp, err = upstream.ExchangeContext(ctx, r.ups, req)
+	e.Duration = time.Since(start)
+
+	e.Err = err
+	if resp != nil {
+		e.Resp = resp.Copy()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.exchanges = append(r.exchanges, e)
+
+	return resp, err
+}
+
+// Close implements the [upstream.Upstream] interface for *Recorder.
+func (r *Recorder) Close() (err error) {
+	return r.ups.Close()
+}
+
+// Exchanges returns the exchanges recorded by r in the order of completion.
+// The returned exchanges must not be modified.
+func (r *Recorder) Exchanges() (es []*Exchange) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]*Exchange(nil), r.exchanges...)
+}
+
+// Reset discards the exchanges recorded by r.
+func (r *Recorder) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.exchanges = nil
+}
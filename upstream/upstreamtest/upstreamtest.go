@@ -0,0 +1,192 @@
+// Package upstreamtest provides the implementations of [upstream.Upstream] for
+// the unit testing of the code depending on it: the scripted upstreams
+// answering with the fixed responses, delays, and errors, and the recorders of
+// the exchanges with any other upstream.  None of those use the network.
+package upstreamtest
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+)
+
+// Handler returns the response to req or an error.  It must be safe for
+// concurrent use.
+type Handler func(req *dns.Msg) (resp *dns.Msg, err error)
+
+// Answer returns a [Handler] answering with the copies of rrs.
+func Answer(rrs ...dns.RR) (h Handler) {
+	return func(req *dns.Msg) (resp *dns.Msg, err error) {
+		resp = (&dns.Msg{}).SetReply(req)
+		resp.RecursionAvailable = true
+		for _, rr := range rrs {
+			resp.Answer = append(resp.Answer, dns.Copy(rr))
+		}
+
+		return resp, nil
+	}
+}
+
+// Rcode returns a [Handler] answering with rcode and no records.
+func Rcode(rcode int) (h Handler) {
+	return func(req *dns.Msg) (resp *dns.Msg, err error) {
+		resp = (&dns.Msg{}).SetRcode(req, rcode)
+		resp.RecursionAvailable = true
+
+		return resp, nil
+	}
+}
+
+// Error returns a [Handler] failing with err.
+func Error(err error) (h Handler) {
+	return func(_ *dns.Msg) (resp *dns.Msg, handlerErr error) {
+		return nil, err
+	}
+}
+
+// Delay returns a [Handler] calling h after waiting for d.
+func Delay(d time.Duration, h Handler) (res Handler) {
+	return func(req *dns.Msg) (resp *dns.Msg, err error) {
+		time.Sleep(d)
+
+		return h(req)
+	}
+}
+
+// Upstream is an [upstream.Upstream] exchanging the queries with the handlers
+// in order: the first query is handled by the first handler, the second one by
+// the second handler and so on, and the last handler handles all the rest.  The
+// queries without handlers are answered with SERVFAIL.  The queries are
+// recorded and could be inspected with [Upstream.Queries].
+//
+// It's safe for concurrent use.
+type Upstream struct {
+	// mu protects handlers, queries, and closed.
+	mu *sync.Mutex
+
+	// addr is the address of the upstream.
+	addr string
+
+	// handlers are the handlers of the queries in the order of use.
+	handlers []Handler
+
+	// queries are the copies of the received queries.
+	queries []*dns.Msg
+
+	// closed is true if the upstream has been closed.
+	closed bool
+}
+
+// New returns a new *Upstream with addr handling the queries with hs.
+func New(addr string, hs ...Handler) (u *Upstream) {
+	return &Upstream{
+		mu:       &sync.Mutex{},
+		addr:     addr,
+		handlers: hs,
+	}
+}
+
+// type check
+var _ upstream.Upstream = (*Upstream)(nil)
+
+// Address implements the [upstream.Upstream] interface for *Upstream.
+func (u *Upstream) Address() (addr string) {
+	return u.addr
+}
+
+// Exchange implements the [upstream.Upstream] interface for *Upstream.  It
+// returns [net.ErrClosed] if u has been closed.
+func (u *Upstream) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	return u.ExchangeContext(context.Background(), req)
+}
+
+// type check
+var _ upstream.ContextExchanger = (*Upstream)(nil)
+
+// ExchangeContext implements the [upstream.ContextExchanger] interface for
+// *Upstream.  It returns the error of ctx as soon as it's canceled, leaving
+// the handler to finish in the background.
+func (u *Upstream) ExchangeContext(
+	ctx context.Context,
+	req *dns.Msg,
+) (resp *dns.Msg, err error) {
+	h, err := u.next(req)
+	if err != nil {
+		return nil, err
+	} else if ctx.Done() == nil {
+		return h(req)
+	}
+
+	type result struct {
+		resp *dns.Msg
+		err  error
+	}
+
+	resCh := make(chan result, 1)
+	go func() {
+		r, hErr := h(req.Copy())
+		resCh <- result{resp: r, err: hErr}
+	}()
+
+	select {
+	case res := <-resCh:
+		return res.resp, res.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// next records req and returns the handler for it.
+func (u *Upstream) next(req *dns.Msg) (h Handler, err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.closed {
+		return nil, net.ErrClosed
+	}
+
+	n := len(u.queries)
+	u.queries = append(u.queries, req.Copy())
+
+	if len(u.handlers) == 0 {
+		return Rcode(dns.RcodeServerFailure), nil
+	}
+
+	return u.handlers[min(n, len(u.handlers)-1)], nil
+}
+
+// Close implements the [upstream.Upstream] interface for *Upstream.  The
+// following exchanges fail.
+func (u *Upstream) Close() (err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.closed = true
+
+	return nil
+}
+
+// Queries returns the copies of the queries received by u in order.
+func (u *Upstream) Queries() (reqs []*dns.Msg) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	reqs = make([]*dns.Msg, 0, len(u.queries))
+	for _, req := range u.queries {
+		reqs = append(reqs, req.Copy())
+	}
+
+	return reqs
+}
+
+// Closed returns true if u has been closed.
+func (u *Upstream) Closed() (ok bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return u.closed
+}
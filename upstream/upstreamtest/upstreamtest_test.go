@@ -0,0 +1,104 @@
+package upstreamtest_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream/upstreamtest"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testHost is the host used in tests.
+const testHost = "example.org."
+
+func TestUpstream(t *testing.T) {
+	const testErr errors.Error = "test error"
+
+	rr, err := dns.NewRR(testHost + " 60 IN A 192.0.2.1")
+	require.NoError(t, err)
+
+	u := upstreamtest.New(
+		"test.upstream",
+		upstreamtest.Answer(rr),
+		upstreamtest.Error(testErr),
+		upstreamtest.Rcode(dns.RcodeRefused),
+	)
+
+	assert.Equal(t, "test.upstream", u.Address())
+
+	req := (&dns.Msg{}).SetQuestion(testHost, dns.TypeA)
+
+	resp, err := u.Exchange(req)
+	require.NoError(t, err)
+	require.Len(t, resp.Answer, 1)
+
+	a := testutil.RequireTypeAssert[*dns.A](t, resp.Answer[0])
+	assert.Equal(t, net.IP{192, 0, 2, 1}, a.A.To4())
+
+	_, err = u.Exchange(req)
+	assert.ErrorIs(t, err, testErr)
+
+	for range 2 {
+		resp, err = u.Exchange(req)
+		require.NoError(t, err)
+
+		assert.Equal(t, dns.RcodeRefused, resp.Rcode)
+	}
+
+	queries := u.Queries()
+	require.Len(t, queries, 4)
+
+	assert.Equal(t, req.Question, queries[0].Question)
+
+	require.NoError(t, u.Close())
+	assert.True(t, u.Closed())
+
+	_, err = u.Exchange(req)
+	assert.ErrorIs(t, err, net.ErrClosed)
+}
+
+func TestUpstream_noHandlers(t *testing.T) {
+	u := upstreamtest.New("test.upstream")
+
+	resp, err := u.Exchange((&dns.Msg{}).SetQuestion(testHost, dns.TypeA))
+	require.NoError(t, err)
+
+	assert.Equal(t, dns.RcodeServerFailure, resp.Rcode)
+}
+
+func TestRecorder(t *testing.T) {
+	const delay = 10 * time.Millisecond
+
+	u := upstreamtest.New(
+		"test.upstream",
+		upstreamtest.Delay(delay, upstreamtest.Rcode(dns.RcodeNameError)),
+	)
+	r := upstreamtest.NewRecorder(u)
+
+	assert.Equal(t, u.Address(), r.Address())
+
+	req := (&dns.Msg{}).SetQuestion(testHost, dns.TypeAAAA)
+	_, err := r.Exchange(req)
+	require.NoError(t, err)
+
+	es := r.Exchanges()
+	require.Len(t, es, 1)
+
+	e := es[0]
+	assert.Equal(t, req.Question, e.Req.Question)
+	require.NotNil(t, e.Resp)
+	assert.Equal(t, dns.RcodeNameError, e.Resp.Rcode)
+	assert.NoError(t, e.Err)
+	assert.GreaterOrEqual(t, e.Duration, delay)
+
+	r.Reset()
+	assert.Empty(t, r.Exchanges())
+
+	require.NoError(t, r.Close())
+	assert.True(t, u.Closed())
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+)
+
+// Valid policies of the verification of the upstreams on startup, see
+// [Options.UpstreamVerification].
+const (
+	// upstreamVerificationNone means that the upstreams aren't verified.
+	upstreamVerificationNone = ""
+
+	// upstreamVerificationFail means that dnsproxy doesn't start if any of
+	// the upstreams fails.
+	upstreamVerificationFail = "fail"
+
+	// upstreamVerificationWarn means that the failing upstreams are only
+	// logged.
+	upstreamVerificationWarn = "warn"
+
+	// upstreamVerificationDisable means that the failing upstreams are removed
+	// from the configuration.
+	upstreamVerificationDisable = "disable"
+)
+
+// verifyUpstreams sends the probe query to each upstream of conf once and
+// handles the failing ones according to policy.  It exits the process if the
+// policy doesn't allow to start.
+func verifyUpstreams(l *slog.Logger, conf *proxy.Config, policy string) {
+	switch policy {
+	case upstreamVerificationNone:
+		return
+	case
+		upstreamVerificationFail,
+		upstreamVerificationWarn,
+		upstreamVerificationDisable:
+		// Go on.
+	default:
+		fatal(l, "upstream verification: unsupported policy", "policy", policy)
+	}
+
+	l = l.With(slogutil.KeyPrefix, "verify")
+
+	failed := map[string]struct{}{}
+	for _, res := range probeUpstreams(checkedUpstreams(conf)) {
+		if res.err != nil {
+			l.Error("probing upstream", "upstream", res.addr, slogutil.KeyError, res.err)
+			failed[res.addr] = struct{}{}
+
+			continue
+		}
+
+		l.Debug("upstream ok", "upstream", res.addr, "rtt", res.rtt)
+	}
+
+	if len(failed) == 0 {
+		l.Info("upstreams verified")
+
+		return
+	}
+
+	switch policy {
+	case upstreamVerificationFail:
+		fatal(l, "upstreams verification failed", "failed", len(failed))
+	case upstreamVerificationWarn:
+		l.Warn("starting with failing upstreams", "failed", len(failed))
+	default:
+		err := disableUpstreams(l, conf, failed)
+		if err != nil {
+			fatal(l, "disabling failing upstreams", slogutil.KeyError, err)
+		}
+
+		l.Warn("failing upstreams disabled", "failed", len(failed))
+	}
+}
+
+// disableUpstreams removes the upstreams with the addresses from failed from
+// all the upstream configurations of conf and closes them.  It returns an error
+// if any list of the upstreams would be left empty.
+func disableUpstreams(l *slog.Logger, conf *proxy.Config, failed map[string]struct{}) (err error) {
+	removed := map[upstream.Upstream]struct{}{}
+	defer func() {
+		for u := range removed {
+			closeErr := u.Close()
+			if closeErr != nil {
+				l.Debug("closing upstream", "upstream", u.Address(), slogutil.KeyError, closeErr)
+			}
+		}
+	}()
+
+	// Don't modify the lists in place, since those may be shared between the
+	// domains.
+	remove := func(ups []upstream.Upstream) (kept []upstream.Upstream) {
+		for _, u := range ups {
+			if _, ok := failed[u.Address()]; ok {
+				removed[u] = struct{}{}
+
+				continue
+			}
+
+			kept = append(kept, u)
+		}
+
+		return kept
+	}
+
+	type namedConfig struct {
+		uc   *proxy.UpstreamConfig
+		name string
+	}
+
+	ucs := []namedConfig{
+		{uc: conf.UpstreamConfig, name: "general"},
+		{uc: conf.PrivateRDNSUpstreamConfig, name: "private"},
+		{uc: conf.Fallbacks, name: "fallback"},
+		{uc: conf.CompareUpstreamConfig, name: "compare"},
+	}
+	for _, prof := range conf.Profiles {
+		ucs = append(ucs, namedConfig{uc: prof.UpstreamConfig, name: "profile " + prof.Name})
+	}
+
+	var errs []error
+	for _, c := range ucs {
+		if c.uc != nil {
+			errs = append(errs, disableConfigUpstreams(c.uc, remove, c.name))
+		}
+	}
+
+	if conf.MirrorUpstream != nil {
+		if _, ok := failed[conf.MirrorUpstream.Address()]; ok {
+			removed[conf.MirrorUpstream] = struct{}{}
+			conf.MirrorUpstream = nil
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// disableConfigUpstreams removes the upstreams from uc with remove.  It returns
+// an error if any list of the upstreams would be left empty.  name is the name
+// of uc used in the errors.
+func disableConfigUpstreams(
+	uc *proxy.UpstreamConfig,
+	remove func(ups []upstream.Upstream) (kept []upstream.Upstream),
+	name string,
+) (err error) {
+	var errs []error
+	if len(uc.Upstreams) > 0 {
+		uc.Upstreams = remove(uc.Upstreams)
+		if len(uc.Upstreams) == 0 {
+			errs = append(errs, fmt.Errorf("%s upstreams: no working upstreams", name))
+		}
+	}
+
+	// The same domain is usually both in the reserved and the specified ones, so
+	// only report it once.
+	reported := map[string]struct{}{}
+	for _, specUps := range []map[string][]upstream.Upstream{
+		uc.DomainReservedUpstreams,
+		uc.SpecifiedDomainUpstreams,
+	} {
+		for domain, ups := range specUps {
+			// Empty lists mean the general upstreams, so keep them.
+			if len(ups) == 0 {
+				continue
+			}
+
+			specUps[domain] = remove(ups)
+			if _, ok := reported[domain]; !ok && len(specUps[domain]) == 0 {
+				reported[domain] = struct{}{}
+				errs = append(errs, fmt.Errorf(
+					"%s upstreams for %q: no working upstreams",
+					name,
+					domain,
+				))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}